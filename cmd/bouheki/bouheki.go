@@ -4,7 +4,7 @@ import (
 	"os"
 
 	"github.com/mrtc0/bouheki/pkg/audit"
-	log "github.com/sirupsen/logrus"
+	"github.com/mrtc0/bouheki/pkg/errkind"
 )
 
 var (
@@ -15,6 +15,6 @@ func main() {
 	app := audit.NewApp(version)
 	err := app.Run(os.Args)
 	if err != nil {
-		log.Fatal(err)
+		errkind.Exit(err)
 	}
 }
@@ -0,0 +1,296 @@
+// Package alert evaluates the threshold rules of the alerts config over the internal counters and
+// the audit events, for deployments without an alerting system of their own.
+//
+// A rule that fires is logged at the error level and published as a notify.Alert, which reaches
+// the subscribers of the notifications that receive the alert type. It is published again,
+// resolved, once its condition clears.
+package alert
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/clock"
+	"github.com/mrtc0/bouheki/pkg/config"
+	log "github.com/mrtc0/bouheki/pkg/log"
+	"github.com/mrtc0/bouheki/pkg/notify"
+)
+
+// Event is an audit event, as matched by config.AlertEventFilter.
+type Event struct {
+	Audit  string
+	Action string
+	Comm   string
+	// LocalAddr and LocalPort are the local address and port of the socket of a network event,
+	// nil and 0 for the other events. Unbound is set when the socket was bound to neither.
+	LocalAddr net.IP
+	LocalPort uint16
+	Unbound   bool
+	// DestinationTags are the tags of the destination of a network event, see
+	// network.destination_tags.
+	DestinationTags []string
+}
+
+// Filter matches the events with a config.AlertEventFilter.
+type Filter struct {
+	conf  config.AlertEventFilter
+	local *net.IPNet
+}
+
+// NewFilter returns the filter of conf.
+func NewFilter(conf config.AlertEventFilter) (*Filter, error) {
+	local, err := conf.LocalNet()
+	if err != nil {
+		return nil, err
+	}
+	return &Filter{conf: conf, local: local}, nil
+}
+
+// Match reports whether event has every field set in the filter.
+func (f *Filter) Match(event Event) bool {
+	c := f.conf
+	if (c.Audit != "" && c.Audit != event.Audit) ||
+		(c.Action != "" && c.Action != event.Action) ||
+		(c.Comm != "" && c.Comm != event.Comm) {
+		return false
+	}
+	switch {
+	case c.LocalAddr == config.ALERT_LOCAL_ADDR_UNBOUND:
+		if !event.Unbound {
+			return false
+		}
+	case f.local != nil:
+		if event.LocalAddr == nil || !f.local.Contains(event.LocalAddr) {
+			return false
+		}
+	}
+	if c.LocalPort != 0 && c.LocalPort != event.LocalPort {
+		return false
+	}
+	return len(c.DestinationTags) == 0 || hasTag(event.DestinationTags, c.DestinationTags)
+}
+
+// hasTag reports whether tags has one of wanted.
+func hasTag(tags, wanted []string) bool {
+	for _, tag := range tags {
+		for _, w := range wanted {
+			if tag == w {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Metrics are the counters and gauges a rule can read, e.g. metrics.DefaultRegistry.
+type Metrics interface {
+	Snapshot() map[string]float64
+	// Kind returns "counter" or "gauge", or "" for an unknown metric.
+	Kind(name string) string
+}
+
+// DefaultEngine is the engine used by the package level Observe. It is nil without alert rules.
+var DefaultEngine *Engine
+
+// Observe counts event for the rules of the DefaultEngine.
+func Observe(event Event) {
+	if DefaultEngine != nil {
+		DefaultEngine.Observe(event)
+	}
+}
+
+type Engine struct {
+	mu       sync.Mutex
+	interval time.Duration
+	rules    []*rule
+	metrics  Metrics
+	hub      *notify.Hub
+	clock    clock.Clock
+}
+
+type rule struct {
+	conf config.AlertRule
+	// filter is the filter of an event rule, nil for a metric rule.
+	filter *Filter
+	// gauge is set for a rule of a gauge, whose value is compared as is.
+	gauge bool
+	// observed is the number of events that matched the filter of an event rule, counted like a counter.
+	observed float64
+	// samples are the values of the counter at every evaluation, the oldest first.
+	samples []sample
+	firing  bool
+	firedAt time.Time
+	value   float64
+}
+
+type sample struct {
+	at    time.Time
+	value float64
+}
+
+// NewEngine returns an engine of the rules of conf. The metrics of the rules must be registered.
+func NewEngine(conf config.AlertsConfig, metrics Metrics, hub *notify.Hub, clk clock.Clock) (*Engine, error) {
+	e := &Engine{interval: conf.Interval, metrics: metrics, hub: hub, clock: clk}
+	for _, c := range conf.Rules {
+		r := &rule{conf: c}
+		if c.Event != nil {
+			filter, err := NewFilter(*c.Event)
+			if err != nil {
+				return nil, fmt.Errorf("alert %s: %w", c.Name, err)
+			}
+			r.filter = filter
+		}
+		if c.Metric != "" {
+			switch metrics.Kind(c.Metric) {
+			case "counter":
+			case "gauge":
+				r.gauge = true
+			default:
+				return nil, fmt.Errorf("alert %s: unknown metric %q", c.Name, c.Metric)
+			}
+		}
+		e.rules = append(e.rules, r)
+	}
+
+	// The first samples are the baseline: what was counted before the engine started does not fire.
+	e.sample(clk.Now(), metrics.Snapshot())
+	return e, nil
+}
+
+// Observe counts event for the rules whose filter matches it.
+func (e *Engine) Observe(event Event) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, r := range e.rules {
+		if r.filter != nil && r.filter.Match(event) {
+			r.observed++
+		}
+	}
+}
+
+// Run evaluates the rules every interval until ctx is done.
+func (e *Engine) Run(ctx context.Context) {
+	for {
+		e.clock.Sleep(e.interval)
+		if ctx.Err() != nil {
+			return
+		}
+		e.Evaluate()
+	}
+}
+
+// Evaluate fires the rules whose condition holds, and resolves the firing ones whose condition cleared.
+func (e *Engine) Evaluate() {
+	now := e.clock.Now()
+	snapshot := e.metrics.Snapshot()
+
+	e.mu.Lock()
+	e.sample(now, snapshot)
+	notifications := []notification{}
+	for _, r := range e.rules {
+		exceeded := r.value > r.conf.Threshold
+		switch {
+		case exceeded && !r.firing:
+			// A rule in its cooldown stays silent until the cooldown has passed.
+			if !r.firedAt.IsZero() && now.Sub(r.firedAt) < r.conf.Cooldown {
+				continue
+			}
+			r.firing = true
+			r.firedAt = now
+			notifications = append(notifications, r.notification(notify.ALERT_FIRING))
+		case !exceeded && r.firing:
+			r.firing = false
+			notifications = append(notifications, r.notification(notify.ALERT_RESOLVED))
+		}
+	}
+	e.mu.Unlock()
+
+	for _, n := range notifications {
+		e.publish(n)
+	}
+}
+
+// sample records the value of every rule at now, and updates the values compared to the thresholds.
+func (e *Engine) sample(now time.Time, snapshot map[string]float64) {
+	for _, r := range e.rules {
+		value := r.observed
+		if r.conf.Metric != "" {
+			value = snapshot[r.conf.Metric]
+		}
+		if r.gauge {
+			r.value = value
+			continue
+		}
+
+		r.samples = append(r.samples, sample{at: now, value: value})
+		// The baseline is the latest sample taken at least a window ago.
+		start := now.Add(-r.conf.Window)
+		for len(r.samples) > 1 && !r.samples[1].at.After(start) {
+			r.samples = r.samples[1:]
+		}
+		r.value = increase(r.samples)
+	}
+}
+
+// increase returns how much a counter increased over samples. A counter that decreased was reset,
+// so it increased by its new value.
+func increase(samples []sample) float64 {
+	total := 0.0
+	for i := 1; i < len(samples); i++ {
+		if delta := samples[i].value - samples[i-1].value; delta >= 0 {
+			total += delta
+		} else {
+			total += samples[i].value
+		}
+	}
+	return total
+}
+
+// notification is an alert to publish once the lock of the engine is released.
+type notification struct {
+	alert  notify.Alert
+	window time.Duration
+}
+
+func (r *rule) notification(state string) notification {
+	alert := notify.Alert{
+		Rule:      r.conf.Name,
+		State:     state,
+		Value:     r.value,
+		Threshold: r.conf.Threshold,
+		Window:    r.conf.Window.String(),
+	}
+	if state == notify.ALERT_RESOLVED {
+		alert.Since = r.firedAt.UTC()
+	}
+	return notification{alert: alert, window: r.conf.Window}
+}
+
+func (e *Engine) publish(n notification) {
+	alertLog := log.AlertLog{Rule: n.alert.Rule, Value: n.alert.Value, Threshold: n.alert.Threshold, Window: n.window, Since: n.alert.Since}
+	if n.alert.State == notify.ALERT_FIRING {
+		alertLog.Error()
+	} else {
+		alertLog.Info()
+	}
+
+	e.hub.Publish(notify.New(n.alert, ""))
+}
+
+// Firing returns the names of the rules that are firing.
+func (e *Engine) Firing() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	names := []string{}
+	for _, r := range e.rules {
+		if r.firing {
+			names = append(names, r.conf.Name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,223 @@
+package alert
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/bouhekitest"
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/metrics"
+	"github.com/mrtc0/bouheki/pkg/notify"
+	"github.com/stretchr/testify/assert"
+)
+
+type alertTest struct {
+	engine   *Engine
+	registry *metrics.Registry
+	clock    *bouhekitest.Clock
+	alerts   *notify.Subscriber
+}
+
+func newAlertTest(t *testing.T, rules ...config.AlertRule) *alertTest {
+	registry := metrics.NewRegistry()
+	registry.Counter("events_dropped_total", "")
+	registry.Gauge("unresolved_domains", "")
+
+	hub := notify.NewHub(16)
+	clk := bouhekitest.NewClock(time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC))
+	engine, err := NewEngine(config.AlertsConfig{Interval: time.Minute, Rules: rules}, registry, hub, clk)
+	assert.Nil(t, err)
+
+	return &alertTest{engine: engine, registry: registry, clock: clk, alerts: hub.Subscribe(notify.TYPE_ALERT)}
+}
+
+// tick moves the clock by an interval and evaluates the rules.
+func (a *alertTest) tick() {
+	a.clock.Advance(time.Minute)
+	a.engine.Evaluate()
+}
+
+func (a *alertTest) next(t *testing.T) notify.Alert {
+	select {
+	case n := <-a.alerts.C:
+		return n.Payload.(notify.Alert)
+	default:
+		t.Fatal("no alert was published")
+		return notify.Alert{}
+	}
+}
+
+func TestCounterIncreaseOverTheWindow(t *testing.T) {
+	a := newAlertTest(t, config.AlertRule{Name: "drops", Metric: "events_dropped_total", Window: 3 * time.Minute, Threshold: 50})
+	dropped := a.registry.Counter("events_dropped_total", "")
+
+	dropped.Add(30)
+	a.tick()
+	assert.Empty(t, a.engine.Firing())
+
+	dropped.Add(30)
+	a.tick()
+	assert.Equal(t, []string{"drops"}, a.engine.Firing())
+	firing := a.next(t)
+	assert.Equal(t, notify.Alert{Rule: "drops", State: notify.ALERT_FIRING, Value: 60, Threshold: 50, Window: "3m0s"}, firing)
+
+	// Still firing, it is not published again.
+	a.tick()
+	assert.Len(t, a.alerts.C, 0)
+
+	// The first increment leaves the window.
+	a.tick()
+	assert.Empty(t, a.engine.Firing())
+	resolved := a.next(t)
+	assert.Equal(t, notify.ALERT_RESOLVED, resolved.State)
+	assert.Equal(t, 30.0, resolved.Value)
+	assert.Equal(t, time.Date(2026, 10, 1, 0, 2, 0, 0, time.UTC), resolved.Since)
+}
+
+func TestCooldown(t *testing.T) {
+	a := newAlertTest(t, config.AlertRule{Name: "drops", Metric: "events_dropped_total", Window: time.Minute, Cooldown: 5 * time.Minute})
+	dropped := a.registry.Counter("events_dropped_total", "")
+
+	dropped.Inc()
+	a.tick()
+	assert.Equal(t, notify.ALERT_FIRING, a.next(t).State)
+	a.tick()
+	assert.Equal(t, notify.ALERT_RESOLVED, a.next(t).State)
+
+	// Within the cooldown, the rule stays silent however long the condition holds.
+	for i := 0; i < 3; i++ {
+		dropped.Inc()
+		a.tick()
+		assert.Empty(t, a.engine.Firing())
+		assert.Len(t, a.alerts.C, 0)
+	}
+
+	dropped.Inc()
+	a.tick()
+	assert.Equal(t, notify.ALERT_FIRING, a.next(t).State)
+}
+
+func TestCounterReset(t *testing.T) {
+	samples := []sample{{value: 10}, {value: 15}, {value: 2}, {value: 4}}
+	assert.Equal(t, 9.0, increase(samples))
+}
+
+func TestGaugeIsComparedAsIs(t *testing.T) {
+	a := newAlertTest(t, config.AlertRule{Name: "unresolved", Metric: "unresolved_domains", Window: time.Minute, Threshold: 2})
+	unresolved := a.registry.Gauge("unresolved_domains", "")
+
+	unresolved.Set(3)
+	a.tick()
+	assert.Equal(t, 3.0, a.next(t).Value)
+	unresolved.Set(2)
+	a.tick()
+	assert.Equal(t, notify.ALERT_RESOLVED, a.next(t).State)
+}
+
+func TestEventRule(t *testing.T) {
+	a := newAlertTest(t, config.AlertRule{
+		Name:      "blocks",
+		Event:     &config.AlertEventFilter{Audit: config.ALERT_AUDIT_NETWORK, Action: "BLOCKED"},
+		Window:    5 * time.Minute,
+		Threshold: 2,
+	})
+
+	a.engine.Observe(Event{Audit: config.ALERT_AUDIT_NETWORK, Action: "BLOCKED", Comm: "curl"})
+	a.engine.Observe(Event{Audit: config.ALERT_AUDIT_NETWORK, Action: "MONITOR", Comm: "curl"})
+	a.engine.Observe(Event{Audit: config.ALERT_AUDIT_FILEACCESS, Action: "BLOCKED", Comm: "curl"})
+	a.engine.Observe(Event{Audit: config.ALERT_AUDIT_NETWORK, Action: "BLOCKED", Comm: "wget"})
+	a.tick()
+	assert.Empty(t, a.engine.Firing())
+
+	a.engine.Observe(Event{Audit: config.ALERT_AUDIT_NETWORK, Action: "BLOCKED", Comm: "wget"})
+	a.tick()
+	assert.Equal(t, 3.0, a.next(t).Value)
+}
+
+func TestFilterMatchesTheLocalAddress(t *testing.T) {
+	bound := Event{Audit: config.ALERT_AUDIT_NETWORK, Action: "BLOCKED", Comm: "curl", LocalAddr: net.ParseIP("10.0.0.2"), LocalPort: 40000}
+	unbound := Event{Audit: config.ALERT_AUDIT_NETWORK, Action: "BLOCKED", Comm: "curl", Unbound: true}
+	mount := Event{Audit: config.ALERT_AUDIT_MOUNT, Action: "BLOCKED", Comm: "mount"}
+
+	for _, test := range []struct {
+		filter  config.AlertEventFilter
+		matched []bool
+	}{
+		{config.AlertEventFilter{}, []bool{true, true, true}},
+		{config.AlertEventFilter{LocalAddr: "10.0.0.0/8"}, []bool{true, false, false}},
+		{config.AlertEventFilter{LocalAddr: "10.0.0.2", LocalPort: 40000}, []bool{true, false, false}},
+		{config.AlertEventFilter{LocalAddr: "10.0.0.2", LocalPort: 8080}, []bool{false, false, false}},
+		{config.AlertEventFilter{LocalAddr: "2001:db8::/32"}, []bool{false, false, false}},
+		{config.AlertEventFilter{LocalAddr: config.ALERT_LOCAL_ADDR_UNBOUND}, []bool{false, true, false}},
+	} {
+		filter, err := NewFilter(test.filter)
+		assert.Nil(t, err)
+		assert.Equal(t, test.matched, []bool{filter.Match(bound), filter.Match(unbound), filter.Match(mount)}, test.filter)
+	}
+
+	_, err := NewFilter(config.AlertEventFilter{LocalAddr: "localhost"})
+	assert.NotNil(t, err)
+}
+
+func TestFilterMatchesTheDestinationTags(t *testing.T) {
+	metadata := Event{Audit: config.ALERT_AUDIT_NETWORK, Action: "BLOCKED", Comm: "curl", DestinationTags: []string{"cloud-metadata", "link-local"}}
+	untagged := Event{Audit: config.ALERT_AUDIT_NETWORK, Action: "BLOCKED", Comm: "curl"}
+
+	for _, test := range []struct {
+		filter  config.AlertEventFilter
+		matched []bool
+	}{
+		{config.AlertEventFilter{}, []bool{true, true}},
+		{config.AlertEventFilter{DestinationTags: []string{"cloud-metadata"}}, []bool{true, false}},
+		{config.AlertEventFilter{DestinationTags: []string{"dns", "link-local"}}, []bool{true, false}},
+		{config.AlertEventFilter{DestinationTags: []string{"dns"}}, []bool{false, false}},
+		{config.AlertEventFilter{Action: "MONITOR", DestinationTags: []string{"cloud-metadata"}}, []bool{false, false}},
+	} {
+		filter, err := NewFilter(test.filter)
+		assert.Nil(t, err)
+		assert.Equal(t, test.matched, []bool{filter.Match(metadata), filter.Match(untagged)}, test.filter)
+	}
+}
+
+func TestAlertsReachTheSubscribersOfAlerts(t *testing.T) {
+	registry := metrics.NewRegistry()
+	// What was counted before the engine started does not fire.
+	registry.Counter("events_dropped_total", "").Add(5)
+	hub := notify.NewHub(16)
+	alerts := hub.Subscribe(notify.TYPE_ALERT)
+	rules := hub.Subscribe(notify.TYPE_DNS_RULE_CHANGE)
+	all := hub.Subscribe()
+
+	clk := bouhekitest.NewClock(time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC))
+	engine, err := NewEngine(config.AlertsConfig{Interval: time.Minute, Rules: []config.AlertRule{
+		{Name: "drops", Metric: "events_dropped_total", Window: time.Minute},
+	}}, registry, hub, clk)
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go engine.Run(ctx)
+
+	clk.BlockUntil(1)
+	clk.Advance(time.Minute)
+	clk.BlockUntil(1)
+	assert.Empty(t, engine.Firing())
+
+	registry.Counter("events_dropped_total", "").Inc()
+	clk.Advance(time.Minute)
+
+	n := <-alerts.C
+	assert.Equal(t, notify.TYPE_ALERT, n.Type)
+	assert.Equal(t, notify.TYPE_ALERT, (<-all.C).Type)
+	assert.Len(t, rules.C, 0)
+}
+
+func TestUnknownMetric(t *testing.T) {
+	_, err := NewEngine(config.AlertsConfig{Interval: time.Minute, Rules: []config.AlertRule{
+		{Name: "typo", Metric: "events_droped_total", Window: time.Minute},
+	}}, metrics.NewRegistry(), notify.NewHub(1), bouhekitest.NewClock(time.Now()))
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "events_droped_total")
+}
@@ -3,47 +3,205 @@ package audit
 import (
 	"context"
 	"errors"
+	"fmt"
+	"io/ioutil"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
+	"syscall"
 
+	"github.com/mrtc0/bouheki/pkg/alert"
 	"github.com/mrtc0/bouheki/pkg/audit/fileaccess"
 	"github.com/mrtc0/bouheki/pkg/audit/mount"
 	"github.com/mrtc0/bouheki/pkg/audit/network"
+	"github.com/mrtc0/bouheki/pkg/auditoutput"
+	"github.com/mrtc0/bouheki/pkg/clock"
 	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/containers"
+	"github.com/mrtc0/bouheki/pkg/control"
+	"github.com/mrtc0/bouheki/pkg/errkind"
+	"github.com/mrtc0/bouheki/pkg/eventpipe"
+	"github.com/mrtc0/bouheki/pkg/falco"
+	"github.com/mrtc0/bouheki/pkg/fallback"
+	"github.com/mrtc0/bouheki/pkg/features"
+	"github.com/mrtc0/bouheki/pkg/hostcheck"
 	log "github.com/mrtc0/bouheki/pkg/log"
+	"github.com/mrtc0/bouheki/pkg/metrics"
+	"github.com/mrtc0/bouheki/pkg/notify"
+	"github.com/mrtc0/bouheki/pkg/reload"
+	"github.com/mrtc0/bouheki/pkg/spool"
 	"github.com/mrtc0/bouheki/pkg/utils"
 	"github.com/urfave/cli/v2"
 )
 
 var (
+	errRootRequired = errkind.New(errkind.Preflight, errors.New("Must be run as root user"))
+
 	configFlag = cli.StringFlag{
 		Name:    "config",
 		Value:   "bouheki.yaml",
 		Usage:   "config file path",
 		EnvVars: []string{"BOUHEKI_CONFIG_PATH"},
 	}
+	allowConflictsFlag = cli.BoolFlag{
+		Name:    "allow-conflicts",
+		Usage:   "warn instead of fail when the same entry is in both an allow and a deny list (deny wins)",
+		EnvVars: []string{"BOUHEKI_ALLOW_CONFLICTS"},
+	}
+	strictCIDRsFlag = cli.BoolFlag{
+		Name:    "strict-cidrs",
+		Usage:   "fail instead of warn when a CIDR entry has host bits set, e.g. 10.1.2.3/8",
+		EnvVars: []string{"BOUHEKI_STRICT_CIDRS"},
+	}
+	keepAttachedFlag = cli.BoolFlag{
+		Name:    "keep-attached",
+		Usage:   "leave the programs attached when bouheki exits, with the links pinned in bpf.pin_path",
+		EnvVars: []string{"BOUHEKI_KEEP_ATTACHED"},
+	}
+	allowAllDestinationsFlag = cli.BoolFlag{
+		Name:    "allow-all-destinations",
+		Usage:   "accept 0.0.0.0/0 and ::/0 in the allow lists other than network.cidr.allow",
+		EnvVars: []string{"BOUHEKI_ALLOW_ALL_DESTINATIONS"},
+	}
+	strictConfigFlag = cli.BoolFlag{
+		Name:    "strict-config",
+		Usage:   "fail instead of warn on every problem `config validate` finds in the config file, with its line",
+		EnvVars: []string{"BOUHEKI_STRICT_CONFIG"},
+	}
+	forceMonitorFlag = cli.BoolFlag{
+		Name:    "force-monitor",
+		Usage:   "run the network restriction in monitor mode whatever network.mode, until `ctl clear-force-monitor`",
+		EnvVars: []string{"BOUHEKI_FORCE_MONITOR"},
+	}
 )
 
+// loadOptions are the checks of the global flags a config file is loaded with.
+type loadOptions struct {
+	allowConflicts       bool
+	strictCIDRs          bool
+	allowAllDestinations bool
+	keepAttached         bool
+	strictConfig         bool
+}
+
+func loadOptionsOf(c *cli.Context) loadOptions {
+	return loadOptions{
+		allowConflicts:       c.Bool("allow-conflicts"),
+		strictCIDRs:          c.Bool("strict-cidrs"),
+		allowAllDestinations: c.Bool("allow-all-destinations"),
+		keepAttached:         c.Bool("keep-attached"),
+		strictConfig:         c.Bool("strict-config"),
+	}
+}
+
+// loadConfig loads the config file given by --config and checks it for allow/deny conflicts.
+func loadConfig(c *cli.Context) (*config.Config, error) {
+	return loadConfigFile(c.String("config"), loadOptionsOf(c))
+}
+
+func loadConfigFile(path string, opts loadOptions) (*config.Config, error) {
+	if opts.strictConfig {
+		if err := lintConfigFile(path); err != nil {
+			return nil, err
+		}
+	}
+	conf, err := checkConfigFile(path, opts)
+	if err != nil {
+		return nil, err
+	}
+	logConfigWarnings(conf)
+	return conf, nil
+}
+
+// lintConfigFile fails with every problem config.Lint finds in the file, warnings included.
+func lintConfigFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errkind.New(errkind.Config, err)
+	}
+	problems := config.Lint(data)
+	if len(problems) == 0 {
+		return nil
+	}
+	lines := make([]string, len(problems))
+	for i, problem := range problems {
+		lines[i] = fmt.Sprintf("%s: %s", problem.Location(path), problem)
+	}
+	return errkind.Errorf(errkind.Config, "%d problems in the config with --strict-config:\n%s", len(problems), strings.Join(lines, "\n"))
+}
+
+// checkConfigFile loads the config file and applies the checks of opts, failing where they fail.
+func checkConfigFile(path string, opts loadOptions) (*config.Config, error) {
+	conf, err := config.NewConfig(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := conf.CheckConflicts(opts.allowConflicts); err != nil {
+		return nil, errkind.New(errkind.Config, err)
+	}
+	if _, err := conf.CheckHostBits(opts.strictCIDRs); err != nil {
+		return nil, errkind.New(errkind.Config, err)
+	}
+	if _, err := conf.CheckAllowAll(opts.allowAllDestinations); err != nil {
+		return nil, errkind.New(errkind.Config, err)
+	}
+	if err := conf.CheckKeepAttached(opts.keepAttached); err != nil {
+		return nil, errkind.New(errkind.Config, err)
+	}
+	return conf, nil
+}
+
+// logConfigWarnings logs what the checks of a loaded config warn about.
+func logConfigWarnings(conf *config.Config) {
+	for _, conflict := range conf.Conflicts() {
+		log.Warn(conflict.String())
+	}
+	for _, entry := range conf.HostBitsEntries() {
+		log.Warn(entry.String())
+	}
+	for _, entry := range conf.AllowAllEntries() {
+		log.Warn(entry.String())
+	}
+	for _, entry := range conf.ShadowedEntries() {
+		log.Warn(entry.String())
+	}
+	for _, rule := range conf.FamilyRules() {
+		log.Warn(rule.String())
+	}
+	for _, except := range conf.UncoveredExcepts() {
+		log.Warn(except.String())
+	}
+	for _, command := range conf.TruncatedCommands() {
+		log.Warn(command.String())
+	}
+	for _, field := range conf.IgnoredFields() {
+		log.Warn(fmt.Sprintf("%s (ignored: unknown fields are deprecated in configs without `version: %d`)", field, config.CURRENT_VERSION))
+	}
+}
+
 func NewApp(version string) *cli.App {
 	app := cli.NewApp()
 	app.Name = "bouheki"
 	app.Version = "0.0.10"
 	app.Usage = "..."
 
-	flags := []cli.Flag{&configFlag}
+	flags := []cli.Flag{&configFlag, &allowConflictsFlag, &strictCIDRsFlag, &allowAllDestinationsFlag, &keepAttachedFlag, &strictConfigFlag, &forceMonitorFlag}
 
 	app.Flags = flags
+	app.Commands = []*cli.Command{checkCommand(), cleanupCommand(), configCommand(), ctlCommand(), debugCommand(), doctorCommand(), domainsCommand(), historyCommand(), policyCommand(), reportCommand(), rulesCommand(), statusCommand(), subscribeCommand(), configValidateCommand(), whyCommand()}
 
 	app.Action = func(c *cli.Context) error {
-		path := c.String("config")
-		conf, err := config.NewConfig(path)
+		source := fallback.New(c.String("config"), func(path string) (*config.Config, error) {
+			return loadConfigFile(path, loadOptionsOf(c))
+		}, fallback.COPY_PATH)
+		conf, err := source.Start()
 		if err != nil {
-			log.Error(err)
-			return nil
+			return err
 		}
 		if !utils.AmIRootUser() {
-			return errors.New("Must be run as root user")
+			return errRootRequired
 		}
 
 		log.SetFormatter(conf.Log.Format)
@@ -51,10 +209,125 @@ func NewApp(version string) *cli.App {
 		log.SetRotation(conf.Log.Output, conf.Log.MaxSize, conf.Log.MaxAge)
 		log.SetLabel(conf.Log.Labels)
 		log.SetLevel(conf.Log.Level)
+		// The names were resolved before the level was set.
+		for _, name := range conf.ResolvedNames() {
+			log.Debug(name.String())
+		}
+
+		if !utils.SkipCompatibleCheck() {
+			report := features.Resolve(conf, features.DefaultProbes())
+			if err := report.Err(); err != nil {
+				return err
+			}
+			report.Warn()
+			metrics.Handle(features.STATUS_PATH, report)
+		}
+
+		if conf.RestrictedNetworkConfig.Enable && conf.RestrictedNetworkConfig.Command.HostCheck.OnStartup {
+			report := hostcheck.Check(conf, hostcheck.Roots(conf, hostcheck.PROC, os.Getenv("PATH")))
+			report.Warn()
+			metrics.Handle(hostcheck.STATUS_PATH, report)
+		}
+
+		metrics.Handle(fallback.STATUS_PATH, source)
+		if conf.Metrics.Enable {
+			go func() {
+				log.Info(fmt.Sprintf("Serving metrics on %s", conf.Metrics.Listen))
+				if err := metrics.Serve(conf.Metrics.Listen); err != nil {
+					log.Error(err)
+				}
+			}()
+		}
 
-		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+		// systemd stops services with SIGTERM: the audits drain their events before exiting.
+		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 		defer cancel()
 
+		if conf.Control.Enable {
+			go func() {
+				log.Info(fmt.Sprintf("Serving the control socket on %s", conf.Control.Socket))
+				if err := control.NewServer(notify.DefaultHub).Serve(ctx, conf.Control.Socket); err != nil {
+					log.Error(err)
+				}
+			}()
+		}
+
+		if len(conf.Alerts.Rules) > 0 {
+			engine, err := alert.NewEngine(conf.Alerts, metrics.DefaultRegistry, notify.DefaultHub, clock.Real())
+			if err != nil {
+				return errkind.New(errkind.Config, err)
+			}
+			alert.DefaultEngine = engine
+			go engine.Run(ctx)
+		}
+
+		if conf.EventOutput.Enable {
+			output, err := eventpipe.New(conf.EventOutput, clock.Real())
+			if err != nil {
+				return errkind.New(errkind.Config, err)
+			}
+			eventpipe.DefaultOutput = output
+			defer output.Close()
+		}
+
+		// The sinks that keep what they could not deliver, served for bouheki status --spools.
+		spools := spool.Sinks{}
+		if conf.FalcoOutput.Enable {
+			output, err := falco.New(conf.FalcoOutput, clock.Real())
+			if err != nil {
+				return errkind.New(errkind.Config, err)
+			}
+			falco.DefaultOutput = output
+			defer output.Close(conf.FalcoOutput.Timeout)
+			if sink := output.Sink(); sink != nil {
+				spools[falco.SPOOL_NAME] = sink
+			}
+		}
+
+		if conf.Containers.Enable {
+			containers.DefaultEnricher = containers.New(conf.Containers, clock.Real())
+		}
+
+		modes := map[string]string{
+			config.ALERT_AUDIT_NETWORK:    conf.RestrictedNetworkConfig.Mode,
+			config.ALERT_AUDIT_FILEACCESS: conf.RestrictedFileAccessConfig.Mode,
+			config.ALERT_AUDIT_MOUNT:      conf.RestrictedMountConfig.Mode,
+		}
+		if conf.AuditOutput.Enable {
+			output, err := auditoutput.New(conf.AuditOutput, modes, clock.Real())
+			if err != nil {
+				return errkind.New(errkind.Config, err)
+			}
+			auditoutput.DefaultOutput = output
+			defer output.Close()
+		}
+
+		if conf.AuditOutput.Webhook.Enable {
+			webhook, err := auditoutput.NewWebhook(conf.AuditOutput.Webhook, modes, clock.Real())
+			if err != nil {
+				return errkind.New(errkind.Config, err)
+			}
+			auditoutput.DefaultWebhook = webhook
+			defer webhook.Close(conf.AuditOutput.Webhook.Timeout)
+			if sink := webhook.Sink(); sink != nil {
+				spools[auditoutput.WEBHOOK_SPOOL_NAME] = sink
+			}
+		}
+		metrics.Handle(spool.STATUS_PATH, spools)
+
+		// Once the config loads again in place of the fallback, it is reloaded into the running
+		// programs as on SIGHUP, so the restriction stays in force throughout.
+		promote := func(conf *config.Config) error {
+			return reload.Default.Reload(conf).Err()
+		}
+		go source.Run(ctx, promote)
+
+		hangups := make(chan os.Signal, 1)
+		signal.Notify(hangups, syscall.SIGHUP)
+		defer signal.Stop(hangups)
+		go reloadOnHangup(ctx, hangups, source, reload.Default, promote)
+
+		network.ForceMonitorOnStart = c.Bool("force-monitor")
 		var wg sync.WaitGroup
 		wg.Add(3)
 
@@ -67,7 +340,7 @@ func NewApp(version string) *cli.App {
 		return nil
 	}
 
-	if os.Getenv("BOUHEKI_SKIP_COMPATIBLE_CHECK") == "" {
+	if !utils.SkipCompatibleCheck() {
 		err := utils.IsCompatible()
 		if err != nil {
 			log.Error(err)
@@ -0,0 +1,235 @@
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/audit/network"
+	"github.com/mrtc0/bouheki/pkg/bundle"
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/errkind"
+	"github.com/mrtc0/bouheki/pkg/features"
+	"github.com/mrtc0/bouheki/pkg/utils"
+	"github.com/urfave/cli/v2"
+)
+
+// BUNDLE_CAPTURE_MAX bounds --capture, which holds the command while the events are logged.
+const BUNDLE_CAPTURE_MAX = time.Minute
+
+var errLogStdout = errors.New("log.output is stdout, read the logs where the output of bouheki goes, e.g. journalctl -u bouheki")
+
+// bundleOptions are what `bouheki debug bundle` collects. conf is nil when the config does not
+// load, and confErr the reason.
+type bundleOptions struct {
+	conf     *config.Config
+	confErr  error
+	version  string
+	logLines int
+	// capture waits while the events are captured, nil without --capture.
+	capture func()
+	doctor  func(w io.Writer)
+	probes  features.Probes
+}
+
+func bundleCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "bundle",
+		Usage: "write a tar.gz of what a bug report needs, without the secrets and the fields of redaction.event_fields",
+		Flags: []cli.Flag{
+			&cli.StringFlag{Name: "output", Value: "bouheki-bundle.tar.gz", Usage: "the file the bundle is written to"},
+			&cli.IntFlag{Name: "log-lines", Value: 1000, Usage: "the number of the last operational log lines in the bundle"},
+			&cli.DurationFlag{Name: "capture", Usage: "also capture the events logged for this duration, e.g. 10s, at most 1m"},
+		},
+		Action: func(c *cli.Context) error {
+			conf, confErr := loadConfig(c)
+			opts := bundleOptions{
+				conf:     conf,
+				confErr:  confErr,
+				version:  c.App.Version,
+				logLines: c.Int("log-lines"),
+				doctor: func(w io.Writer) {
+					// The failures are in the output, the bundle is written either way.
+					doctor(w, runDoctorChecks(c))
+				},
+				probes: features.DefaultProbes(),
+			}
+			if d := c.Duration("capture"); d > 0 {
+				if d > BUNDLE_CAPTURE_MAX {
+					return errkind.New(errkind.Config, fmt.Errorf("--capture must be at most %s, got %s", BUNDLE_CAPTURE_MAX, d))
+				}
+				opts.capture = func() {
+					fmt.Fprintf(c.App.ErrWriter, "Capturing the events for %s...\n", d)
+					time.Sleep(d)
+				}
+			}
+
+			file, err := os.OpenFile(c.String("output"), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+			if err != nil {
+				return errkind.New(errkind.Runtime, err)
+			}
+			manifest, err := writeBundle(file, opts, time.Now())
+			if cerr := file.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return errkind.New(errkind.Runtime, err)
+			}
+
+			fmt.Fprintf(c.App.Writer, "Wrote %s: %d files, %d skipped.\n", c.String("output"), len(manifest.Files), len(manifest.Skipped))
+			for _, skipped := range manifest.Skipped {
+				fmt.Fprintf(c.App.Writer, "  skipped %s: %s\n", skipped.Name, skipped.Reason)
+			}
+			return nil
+		},
+	}
+}
+
+// writeBundle writes the bundle of opts to w, each file generated as the subcommand that prints it
+// does. Without the config, only the files that do not depend on it are collected.
+func writeBundle(w io.Writer, opts bundleOptions, now time.Time) (bundle.Manifest, error) {
+	// The redaction of the defaults applies when the config does not load.
+	conf := opts.conf
+	if conf == nil {
+		conf = config.DefaultConfig()
+	}
+	b := bundle.NewWriter(w, bundle.NewRedactor(conf), opts.version, now)
+
+	withConfig := func(generate func(w io.Writer) error) func(w io.Writer) error {
+		if opts.conf == nil {
+			return func(io.Writer) error { return fmt.Errorf("the config does not load: %v", opts.confErr) }
+		}
+		return generate
+	}
+	withMetrics := func(generate func(w io.Writer) error) func(w io.Writer) error {
+		return withConfig(func(w io.Writer) error {
+			if !conf.Metrics.Enable {
+				return errMetricsDisabled
+			}
+			return generate(w)
+		})
+	}
+	withLog := func(generate func(path string, w io.Writer) error) func(w io.Writer) error {
+		return withConfig(func(w io.Writer) error {
+			if conf.Log.Output == "" || conf.Log.Output == "stdout" {
+				return errLogStdout
+			}
+			return generate(conf.Log.Output, w)
+		})
+	}
+
+	files := []struct {
+		name     string
+		source   string
+		generate func(w io.Writer) error
+	}{
+		{"doctor.txt", "bouheki doctor", func(w io.Writer) error {
+			opts.doctor(w)
+			return nil
+		}},
+		{"kernel.txt", "the kernel and its capabilities", func(w io.Writer) error {
+			printKernel(w, opts.probes)
+			return nil
+		}},
+		{"config.yaml", "the config file, without its secrets", withConfig(func(w io.Writer) error {
+			return printEffectiveConfig(w, conf)
+		})},
+		{"config-dump.txt", "bouheki config dump", withConfig(func(w io.Writer) error {
+			printConfigMap(w, network.ConfigMapValue(conf))
+			printGroups(w, conf)
+			return nil
+		})},
+		{"status.json", "GET " + network.STATE_PATH, withMetrics(func(w io.Writer) error {
+			var state json.RawMessage
+			if err := fetchStatus(conf.Metrics.Listen, network.STATE_PATH, "is the network restriction enabled?", &state); err != nil {
+				return err
+			}
+			_, err := w.Write(state)
+			return err
+		})},
+		{"maps.txt", "bouheki status --resources", withMetrics(func(w io.Writer) error {
+			resources, err := fetchResourcesStatus(conf.Metrics.Listen)
+			if err != nil {
+				return err
+			}
+			printResourcesStatus(w, resources)
+			return nil
+		})},
+		{"logs.txt", "the operational logs of log.output", withLog(func(path string, w io.Writer) error {
+			lines, err := bundle.Tail(path, opts.logLines, func(line string) bool { return !bundle.IsEvent(line) })
+			return writeLines(w, lines, err)
+		})},
+		{"last-session.json", "the shutdown report of the last run in log.output", withLog(func(path string, w io.Writer) error {
+			lines, err := bundle.Tail(path, 1, bundle.IsShutdown)
+			if err == nil && len(lines) == 0 {
+				err = errors.New("log.output has no shutdown report")
+			}
+			return writeLines(w, lines, err)
+		})},
+	}
+	for _, file := range files {
+		if err := b.Add(file.name, file.source, file.generate); err != nil {
+			return b.Manifest(), err
+		}
+	}
+
+	// The events are only collected on request: they are the traffic of the host.
+	if opts.capture == nil {
+		b.Skip("events.jsonl", "the events logged during --capture", "not requested, see --capture")
+	} else if err := b.Add("events.jsonl", "the events logged during --capture", withLog(func(path string, w io.Writer) error {
+		lines, err := bundle.Capture(path, opts.capture, bundle.IsEvent)
+		return writeLines(w, lines, err)
+	})); err != nil {
+		return b.Manifest(), err
+	}
+
+	manifest := b.Manifest()
+	return manifest, b.Close()
+}
+
+func writeLines(w io.Writer, lines []string, err error) error {
+	if err != nil {
+		return err
+	}
+	for _, line := range lines {
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// printKernel prints the release of the kernel, its active LSMs and the capabilities bouheki probes.
+func printKernel(w io.Writer, probes features.Probes) {
+	release, err := utils.KernelRelease()
+	if err != nil {
+		release = err.Error()
+	}
+	fmt.Fprintf(w, "release: %s\n", release)
+
+	lsms, err := utils.ActiveLSMs()
+	if err != nil {
+		fmt.Fprintf(w, "lsm:     %v\n", err)
+	} else {
+		fmt.Fprintf(w, "lsm:     %s\n", strings.Join(lsms, ","))
+	}
+
+	fmt.Fprintln(w, "capabilities:")
+	names := make([]string, 0, len(probes))
+	for name := range probes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		result := "ok"
+		if err := probes[name](); err != nil {
+			result = err.Error()
+		}
+		fmt.Fprintf(w, "  %-20s %s\n", name, result)
+	}
+}
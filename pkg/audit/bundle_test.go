@@ -0,0 +1,144 @@
+package audit
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/bundle"
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/features"
+	"github.com/stretchr/testify/assert"
+)
+
+func untarBundle(t *testing.T, data []byte) map[string]string {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	assert.Nil(t, err)
+	r := tar.NewReader(gz)
+	files := map[string]string{}
+	for {
+		header, err := r.Next()
+		if err == io.EOF {
+			return files
+		}
+		assert.Nil(t, err)
+		content, err := ioutil.ReadAll(r)
+		assert.Nil(t, err)
+		files[filepath.Base(header.Name)] = string(content)
+	}
+}
+
+func bundleTestOptions(t *testing.T) (bundleOptions, string) {
+	path := filepath.Join(t.TempDir(), "bouheki.log")
+	assert.Nil(t, ioutil.WriteFile(path, []byte(strings.Join([]string{
+		`{"env":"prod","level":"info","msg":"Serving metrics on 127.0.0.1:9913"}`,
+		`{"Addr":"10.0.0.1","Comm":"curl","Hostname":"web-1","Port":443,"env":"prod","level":"info","msg":"Traffic is trapped in the filter."}`,
+		`{"Drained":3,"Startup":"120ms","env":"prod","level":"info","msg":"Drained the audit events on shutdown."}`,
+	}, "\n")+"\n"), 0600))
+
+	conf := config.DefaultConfig()
+	conf.Log.Output = path
+	conf.Log.Labels = map[string]string{"env": "prod"}
+	conf.Admin.FreezeOverrideToken = "s3cr3t"
+	conf.RestrictedNetworkConfig.Mode = "block"
+	return bundleOptions{
+		conf:     conf,
+		version:  "0.0.10",
+		logLines: 100,
+		doctor:   func(w io.Writer) { io.WriteString(w, "[OK]   root user\n") },
+		probes:   features.Probes{features.CAP_BTF: func() error { return nil }},
+	}, path
+}
+
+func TestWriteBundle(t *testing.T) {
+	opts, _ := bundleTestOptions(t)
+	var out bytes.Buffer
+	manifest, err := writeBundle(&out, opts, time.Now())
+	assert.Nil(t, err)
+
+	files := untarBundle(t, out.Bytes())
+	names := []string{}
+	for _, file := range manifest.Files {
+		names = append(names, file.Name)
+		assert.Len(t, files[file.Name], file.Size, file.Name)
+	}
+	assert.Equal(t, []string{"doctor.txt", "kernel.txt", "config.yaml", "config-dump.txt", "logs.txt", "last-session.json"}, names)
+	assert.Equal(t, []bundle.Skipped{
+		{Name: "status.json", Source: "GET /v1/state", Reason: errMetricsDisabled.Error()},
+		{Name: "maps.txt", Source: "bouheki status --resources", Reason: errMetricsDisabled.Error()},
+		{Name: "events.jsonl", Source: "the events logged during --capture", Reason: "not requested, see --capture"},
+	}, manifest.Skipped)
+
+	var written bundle.Manifest
+	assert.Nil(t, json.Unmarshal([]byte(files[bundle.MANIFEST_NAME]), &written))
+	assert.Equal(t, manifest.Files, written.Files)
+
+	assert.Equal(t, "[OK]   root user\n", files["doctor.txt"])
+	assert.Contains(t, files["kernel.txt"], "  BTF                  ok\n")
+	assert.Contains(t, files["config-dump.txt"], "  mode                       block\n")
+
+	// The secrets and the values of the labels are not in the config.
+	assert.NotContains(t, files["config.yaml"], "s3cr3t")
+	assert.NotContains(t, files["config.yaml"], "prod")
+	assert.Contains(t, files["config.yaml"], "freeze_override_token: '[redacted]'")
+
+	// The events are not operational logs.
+	assert.Equal(t, `{"env":"[redacted]","level":"info","msg":"Serving metrics on 127.0.0.1:9913"}`+"\n"+
+		`{"Drained":3,"Startup":"120ms","env":"[redacted]","level":"info","msg":"Drained the audit events on shutdown."}`+"\n", files["logs.txt"])
+	assert.Equal(t, `{"Drained":3,"Startup":"120ms","env":"[redacted]","level":"info","msg":"Drained the audit events on shutdown."}`+"\n", files["last-session.json"])
+	for name, content := range files {
+		assert.NotContains(t, content, "web-1", name)
+		assert.NotContains(t, content, "10.0.0.1", name)
+	}
+}
+
+func TestWriteBundleCapturesTheEventsOnRequest(t *testing.T) {
+	opts, path := bundleTestOptions(t)
+	opts.capture = func() {
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+		assert.Nil(t, err)
+		defer file.Close()
+		file.WriteString(`{"Addr":"192.0.2.1","Comm":"wget","Hostname":"web-1","Port":80,"level":"info","msg":"Traffic is trapped in the filter."}` + "\n")
+		file.WriteString(`{"level":"info","msg":"Reloaded the config."}` + "\n")
+		file.WriteString(`time="2026-10-14T12:00:00Z" level=info msg="File access is trapped in th filter." Path=/home/alice/.ssh/id_rsa Comm=cat` + "\n")
+	}
+
+	var out bytes.Buffer
+	manifest, err := writeBundle(&out, opts, time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, "events.jsonl", manifest.Files[len(manifest.Files)-1].Name)
+
+	files := untarBundle(t, out.Bytes())
+	assert.Equal(t, `{"Addr":"[redacted]","Comm":"wget","Hostname":"[redacted]","Port":80,"level":"info","msg":"Traffic is trapped in the filter."}`+"\n"+
+		`time="2026-10-14T12:00:00Z" level=info msg="File access is trapped in th filter." Path="[redacted]" Comm=cat`+"\n", files["events.jsonl"])
+
+	// Redaction applies to the capture like to any other file.
+	opts.conf.Redaction.EventFields = []string{"Comm"}
+	out.Reset()
+	_, err = writeBundle(&out, opts, time.Now())
+	assert.Nil(t, err)
+	assert.NotContains(t, untarBundle(t, out.Bytes())["events.jsonl"], "wget")
+}
+
+func TestWriteBundleWithoutConfig(t *testing.T) {
+	opts, _ := bundleTestOptions(t)
+	opts.conf, opts.confErr = nil, errors.New("open bouheki.yaml: no such file or directory")
+
+	var out bytes.Buffer
+	manifest, err := writeBundle(&out, opts, time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"doctor.txt", "kernel.txt"}, []string{manifest.Files[0].Name, manifest.Files[1].Name})
+	assert.Len(t, manifest.Files, 2)
+	assert.Equal(t, "the config does not load: open bouheki.yaml: no such file or directory", manifest.Skipped[0].Reason)
+	// The default redaction applies.
+	assert.Contains(t, manifest.RedactedFields, "Hostname")
+}
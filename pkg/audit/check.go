@@ -0,0 +1,80 @@
+package audit
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/mrtc0/bouheki/pkg/audit/network"
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/errkind"
+	"github.com/urfave/cli/v2"
+)
+
+// checkCommand evaluates a connection against the config file without the kernel, e.g. before a
+// policy change is rolled out.
+func checkCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "check",
+		Usage: "print whether the config file allows or blocks a connection, without making it",
+		Flags: []cli.Flag{
+			&cli.StringFlag{Name: "dst", Required: true, Usage: "the destination, an address or a domain"},
+			&cli.UintFlag{Name: "port", Value: 443, Usage: "the destination port"},
+			&cli.StringFlag{Name: "protocol", Value: config.PROTOCOL_TCP, Usage: "the protocol, tcp or udp"},
+			&cli.UintFlag{Name: "uid", Usage: "the uid of the process"},
+			&cli.UintFlag{Name: "gid", Usage: "the gid of the process"},
+			&cli.StringFlag{Name: "comm", Usage: "the command of the process, e.g. curl"},
+			&cli.StringFlag{Name: "exe-path", Usage: "the path of the executable of the process"},
+			&cli.BoolFlag{Name: "container", Usage: "the process runs in a container"},
+			&cli.BoolFlag{Name: "trace", Usage: "print the result of every check of the evaluation order"},
+		},
+		Action: func(c *cli.Context) error {
+			conf, err := loadConfig(c)
+			if err != nil {
+				return err
+			}
+			resolver, err := network.NewResolver(conf.RestrictedNetworkConfig.Domain.Resolver)
+			if err != nil {
+				return errkind.New(errkind.Preflight, err)
+			}
+
+			in := network.CheckInput{
+				Destination: c.String("dst"),
+				Port:        uint16(c.Uint("port")),
+				Protocol:    c.String("protocol"),
+				UID:         uint32(c.Uint("uid")),
+				GID:         uint32(c.Uint("gid")),
+				Command:     c.String("comm"),
+				ExePath:     c.String("exe-path"),
+				InContainer: c.Bool("container"),
+			}
+			results, err := network.Check(conf, resolver, in)
+			if err != nil {
+				return err
+			}
+			printCheckResults(c.App.Writer, in, results, c.Bool("trace"))
+			return nil
+		},
+	}
+}
+
+// printCheckResults prints the verdict for every address of the destination of in, with the rule
+// that denied it and the entries it matched.
+func printCheckResults(w io.Writer, in network.CheckInput, results []network.CheckResult, trace bool) {
+	for _, result := range results {
+		verdict := result.Verdict
+		if result.Rule != "" {
+			verdict += " by " + result.Rule
+		}
+		fmt.Fprintf(w, "%s/%s  %s\n", net.JoinHostPort(result.Addr.String(), strconv.Itoa(int(in.Port))), in.Protocol, verdict)
+		for _, entry := range result.Matched {
+			fmt.Fprintf(w, "  matched %s\n", entry)
+		}
+		if trace {
+			for _, step := range result.Trace {
+				fmt.Fprintf(w, "  check %s\n", step)
+			}
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package audit
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/mrtc0/bouheki/pkg/audit/network"
+	"github.com/mrtc0/bouheki/pkg/policy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrintCheckResults(t *testing.T) {
+	in := network.CheckInput{Destination: "example.com", Port: 443, Protocol: "tcp"}
+	results := []network.CheckResult{
+		{Addr: net.ParseIP("93.184.216.34"), Verdict: network.CHECK_ALLOW, Matched: []string{"network.domain.allow example.com → 93.184.216.34"}},
+		{Addr: net.ParseIP("2001:db8::34"), Verdict: network.CHECK_BLOCK, Rule: "network.cidr.deny 2001:db8::/32",
+			Trace: []policy.TraceStep{{Check: "cidr.deny", Result: policy.TRACE_DENY, Rule: "network.cidr.deny 2001:db8::/32"}}},
+	}
+
+	var buf bytes.Buffer
+	printCheckResults(&buf, in, results, false)
+	assert.Equal(t, `93.184.216.34:443/tcp  ALLOW
+  matched network.domain.allow example.com → 93.184.216.34
+[2001:db8::34]:443/tcp  BLOCK by network.cidr.deny 2001:db8::/32
+`, buf.String())
+
+	buf.Reset()
+	printCheckResults(&buf, in, results[1:], true)
+	assert.Contains(t, buf.String(), "  check cidr.deny: deny (network.cidr.deny 2001:db8::/32)\n")
+}
@@ -0,0 +1,47 @@
+package audit
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/mrtc0/bouheki/pkg/audit/network"
+	"github.com/mrtc0/bouheki/pkg/errkind"
+	"github.com/urfave/cli/v2"
+)
+
+var errNoPinPath = errkind.New(errkind.Config, errors.New("bouheki cleanup removes the pins of bpf.pin_path, which is not set"))
+
+func cleanupCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "cleanup",
+		Usage: "unpin the maps and programs left in bpf.pin_path, which detaches the programs",
+		Flags: []cli.Flag{
+			&cli.StringFlag{Name: "pin-path", Usage: "directory of the pins (default: bpf.pin_path of the config)"},
+		},
+		Action: func(c *cli.Context) error {
+			pinPath := c.String("pin-path")
+			if pinPath == "" {
+				conf, err := loadConfig(c)
+				if err != nil {
+					return err
+				}
+				pinPath = conf.BPF.PinPath
+			}
+			if pinPath == "" {
+				return errNoPinPath
+			}
+
+			removed, err := network.Unpin(pinPath)
+			for _, path := range removed {
+				fmt.Fprintf(c.App.Writer, "removed %s\n", path)
+			}
+			if err != nil {
+				return errkind.New(errkind.Runtime, err)
+			}
+			if len(removed) == 0 {
+				fmt.Fprintf(c.App.Writer, "nothing is pinned in %s\n", pinPath)
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,29 @@
+package audit
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCleanupRemovesThePins(t *testing.T) {
+	pinPath := filepath.Join(t.TempDir(), "bouheki")
+	assert.Nil(t, os.MkdirAll(filepath.Join(pinPath, "links"), 0700))
+	assert.Nil(t, os.WriteFile(filepath.Join(pinPath, "network_bouheki_config_map"), nil, 0600))
+	assert.Nil(t, os.WriteFile(filepath.Join(pinPath, "links", "socket_connect"), nil, 0600))
+
+	var buf bytes.Buffer
+	app := NewApp("")
+	app.Writer = &buf
+	assert.Nil(t, app.Run([]string{"bouheki", "cleanup", "--pin-path", pinPath}))
+	assert.Equal(t, "removed "+filepath.Join(pinPath, "links", "socket_connect")+"\nremoved "+filepath.Join(pinPath, "network_bouheki_config_map")+"\n", buf.String())
+	_, err := os.Stat(pinPath)
+	assert.True(t, os.IsNotExist(err))
+
+	buf.Reset()
+	assert.Nil(t, app.Run([]string{"bouheki", "cleanup", "--pin-path", pinPath}))
+	assert.Equal(t, "nothing is pinned in "+pinPath+"\n", buf.String())
+}
@@ -0,0 +1,326 @@
+package audit
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/mrtc0/bouheki/pkg/audit/network"
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/errkind"
+	"github.com/mrtc0/bouheki/pkg/hostcheck"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v2"
+)
+
+func configCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "config",
+		Usage: "inspect the config file",
+		Subcommands: []*cli.Command{
+			configValidateCommand(),
+			{
+				Name:  "dump",
+				Usage: "print the network config map written for the config file, as the BPF program reads it",
+				Action: func(c *cli.Context) error {
+					conf, err := loadConfig(c)
+					if err != nil {
+						return err
+					}
+
+					printConfigMap(c.App.Writer, network.ConfigMapValue(conf))
+					printGroups(c.App.Writer, conf)
+					return nil
+				},
+			},
+		},
+	}
+}
+
+// configValidateCommand returns config validate, which is also the validate command of the app.
+func configValidateCommand() *cli.Command {
+	return &cli.Command{
+		Name:      "validate",
+		Usage:     "validate the config file and check allow/deny lists for conflicts",
+		ArgsUsage: "[<config>]",
+		Flags: []cli.Flag{
+			&cli.BoolFlag{Name: "strict", Usage: "fail on the warnings too, as --strict-config does"},
+			&cli.StringFlag{Name: "format", Value: DUMP_FORMAT_TEXT, Usage: "the format of the problems, text or json"},
+			&cli.BoolFlag{Name: "fix-suggestions", Usage: "propose the nearest known field for each unknown field"},
+			&cli.BoolFlag{Name: "resources", Usage: "print the map sizes and their estimated memory, and check that the policy fits"},
+			&cli.BoolFlag{Name: "host-check", Usage: "warn about the commands that do not match the binaries installed on the host, or in the containers"},
+			&cli.BoolFlag{Name: "print-effective-config", Usage: "print the config with the group and preset references expanded, without its secrets"},
+		},
+		Action: func(c *cli.Context) error {
+			path := c.String("config")
+			if c.Args().Present() {
+				path = c.Args().First()
+			}
+			if err := lintConfig(c.App.Writer, path, c.String("format"), c.Bool("strict")); err != nil {
+				return err
+			}
+
+			// The problems were printed by lintConfig, so they are not logged again.
+			conf, err := checkConfigFile(path, loadOptionsOf(c))
+			if c.Bool("fix-suggestions") {
+				printFixSuggestions(c.App.Writer, unknownFields(conf, err))
+			}
+			if err != nil {
+				return err
+			}
+
+			if c.Bool("resources") {
+				if err := checkResources(c.App.Writer, conf); err != nil {
+					return err
+				}
+			}
+
+			// The host check only warns: the binaries may be installed after the config is written.
+			if c.Bool("host-check") {
+				hostcheck.Check(conf, hostcheck.Roots(conf, hostcheck.PROC, os.Getenv("PATH"))).Print(c.App.Writer)
+			}
+
+			if c.Bool("print-effective-config") {
+				if err := printEffectiveConfig(c.App.Writer, conf); err != nil {
+					return err
+				}
+			}
+
+			if c.String("format") == DUMP_FORMAT_TEXT {
+				fmt.Fprintf(c.App.Writer, "%s is valid\n", path)
+			}
+			return nil
+		},
+	}
+}
+
+// lintReport is the output of config validate --format json.
+type lintReport struct {
+	Config   string           `json:"config"`
+	Valid    bool             `json:"valid"`
+	Problems []config.Problem `json:"problems"`
+}
+
+// lintConfig prints the problems config.Lint finds in the config file at path, each with its line,
+// and fails if one is an error, or on any problem if strict.
+func lintConfig(w io.Writer, path, format string, strict bool) error {
+	if format != DUMP_FORMAT_TEXT && format != DUMP_FORMAT_JSON {
+		return errkind.Errorf(errkind.Config, "the format is %s or %s, not %q", DUMP_FORMAT_TEXT, DUMP_FORMAT_JSON, format)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errkind.New(errkind.Config, err)
+	}
+
+	problems := config.Lint(data)
+	failing := 0
+	for _, problem := range problems {
+		if strict || problem.Severity == config.SEVERITY_ERROR {
+			failing++
+		}
+	}
+
+	if format == DUMP_FORMAT_JSON {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(lintReport{Config: path, Valid: failing == 0, Problems: problems}); err != nil {
+			return err
+		}
+	} else {
+		for _, problem := range problems {
+			fmt.Fprintf(w, "%s: %s\n", problem.Location(path), problem)
+		}
+	}
+
+	if failing > 0 {
+		return errkind.Errorf(errkind.Config, "%s is not valid: %d problems", path, failing)
+	}
+	return nil
+}
+
+// printConfigMap prints the fields of a value of network.RESTRICT_NETWORK_CONFIG_MAP_NAME.
+func printConfigMap(w io.Writer, value []byte) {
+	field := func(index int) uint32 {
+		return binary.LittleEndian.Uint32(value[index : index+4])
+	}
+
+	mode := "monitor"
+	if field(network.MAP_MODE_START) == network.MODE_BLOCK {
+		mode = "block"
+	}
+	target := "host"
+	if field(network.MAP_TARGET_START) == network.TAREGT_CONTAINER {
+		target = "container"
+	}
+	classification := config.CLASSIFY_MOUNT_NAMESPACE
+	switch field(network.MAP_CLASSIFICATION_INDEX) {
+	case network.CLASSIFICATION_PID_NAMESPACE:
+		classification = config.CLASSIFY_PID_NAMESPACE
+	case network.CLASSIFICATION_CGROUP:
+		classification = "cgroup"
+	}
+	fmt.Fprintf(w, "%s:\n", network.RESTRICT_NETWORK_CONFIG_MAP_NAME)
+	fmt.Fprintf(w, "  %-26s %s\n", "mode", mode)
+	fmt.Fprintf(w, "  %-26s %s\n", "target", target)
+	fmt.Fprintf(w, "  %-26s %t\n", "command_case_insensitive", field(network.MAP_COMMAND_CASE_INSENSITIVE_INDEX) == 1)
+	fmt.Fprintf(w, "  %-26s %s\n", "classification", classification)
+	fmt.Fprintf(w, "  %-26s %t\n", "audit", field(network.MAP_AUDIT_DISABLED_INDEX) == 0)
+	fmt.Fprintf(w, "  %-26s %d\n", "deny_shards", field(network.MAP_DENY_SHARDS_INDEX))
+	disabled, audit := network.DecodeFamilies(value)
+	fmt.Fprintf(w, "  %-26s %s\n", "families", strings.Join(network.FamilyNames(disabled), ","))
+	fmt.Fprintf(w, "  %-26s %t\n", "other_families_audit", audit)
+	fmt.Fprintf(w, "  %-26s %d\n", "policy_entries", network.DecodePolicyEntries(value).Count)
+	defaultAction, precedence := network.DecodeDefaultAndPrecedence(value)
+	fmt.Fprintf(w, "  %-26s %s\n", "default", network.DefaultActionName(defaultAction))
+	fmt.Fprintf(w, "  %-26s %s\n", "precedence", network.PrecedenceName(precedence))
+
+	// An absent list and an empty one are both written as size 0.
+	lists := network.DecodeListSizes(value)
+	fmt.Fprintln(w, "lists:")
+	for _, list := range []struct {
+		name string
+		size uint32
+	}{
+		{"network.command.allow", lists.AllowCommand},
+		{"network.command.deny", lists.DenyCommand},
+		// The patterns of the command lists, which are not counted in their sizes.
+		{"network.command.allow *", lists.AllowCommandPattern},
+		{"network.command.deny *", lists.DenyCommandPattern},
+		{"network.command.allow_paths", lists.AllowPath},
+		{"network.command.deny_paths", lists.DenyPath},
+		{"network.uid.allow", lists.AllowUID},
+		{"network.uid.deny", lists.DenyUID},
+		{"network.gid.allow", lists.AllowGID},
+		{"network.gid.deny", lists.DenyGID},
+		{"network.ports.allow", lists.AllowPort},
+		{"network.ports.deny", lists.DenyPort},
+		{"network.ingress.cidr.allow", lists.IngressAllowCIDR},
+		{"network.ingress.ports.allow", lists.IngressAllowPort},
+		{"network.ingress.ports.deny", lists.IngressDenyPort},
+	} {
+		effect := "restricts"
+		if list.size == 0 {
+			effect = "no constraint"
+		}
+		fmt.Fprintf(w, "  %-27s %4d  %s\n", list.name, list.size, effect)
+	}
+	fmt.Fprintf(w, "value: %s\n", hex.EncodeToString(value))
+}
+
+// unknownFields returns the unknown fields rejected by a version 2 config or ignored by a legacy one.
+func unknownFields(conf *config.Config, err error) []config.UnknownField {
+	var unknown *config.UnknownFieldsError
+	if errors.As(err, &unknown) {
+		return unknown.Fields
+	}
+	if conf != nil {
+		return conf.IgnoredFields()
+	}
+	return nil
+}
+
+func printFixSuggestions(w io.Writer, fields []config.UnknownField) {
+	for _, field := range fields {
+		fmt.Fprintln(w, field.String())
+	}
+}
+
+// checkResources prints the sizes of the maps and the entries the policy needs, and returns
+// an error if the policy does not fit.
+func checkResources(w io.Writer, conf *config.Config) error {
+	sizes, err := network.NewMapSizes(conf.Resources)
+	if err != nil {
+		return errkind.New(errkind.Config, err)
+	}
+	required, err := network.RequiredEntries(conf)
+	if err != nil {
+		return err
+	}
+
+	printResources(w, conf.Resources.Profile, sizes, required)
+	if err := sizes.Check(conf.Resources, required); err != nil {
+		return errkind.New(errkind.Config, err)
+	}
+	return nil
+}
+
+func printResources(w io.Writer, profile string, sizes network.MapSizes, required map[string]int) {
+	fmt.Fprintf(w, "resources (profile %s):\n", profile)
+	fmt.Fprintf(w, "  %-29s %11s %9s %10s\n", "map", "max_entries", "required", "memory")
+	for _, name := range sizes.Names() {
+		fmt.Fprintf(w, "  %-29s %11d %9d %10s\n", name, sizes[name], required[name], formatBytes(sizes.Memory(name)))
+	}
+	fmt.Fprintf(w, "  %-29s %11s %9s %10s\n", "total", "", "", formatBytes(sizes.TotalMemory()))
+
+	fmt.Fprintln(w, "profiles:")
+	for _, name := range []string{config.RESOURCES_PROFILE_SMALL, config.RESOURCES_PROFILE_MEDIUM, config.RESOURCES_PROFILE_LARGE} {
+		mark := " "
+		if name == profile {
+			mark = "*"
+		}
+		profileSizes, _ := network.ProfileSizes(name)
+		fmt.Fprintf(w, "%s %-8s %10s\n", mark, name, formatBytes(profileSizes.TotalMemory()))
+	}
+}
+
+// printEffectiveConfig prints conf as it is enforced: its lists have the entries the group and
+// preset references expand to, and the defaults of the fields the file leaves out.
+func printEffectiveConfig(w io.Writer, conf *config.Config) error {
+	data, err := yaml.Marshal(conf.Redacted())
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// printGroups prints the number of entries of each group and the lists that reference it,
+// rather than the entries the references expand to.
+func printGroups(w io.Writer, conf *config.Config) {
+	references := map[string][]string{}
+	for _, list := range config.GroupListKeys() {
+		for _, name := range conf.ListGroups(list) {
+			references[name] = append(references[name], list)
+		}
+	}
+	// The presets are only listed when referenced, after the groups.
+	names := conf.GroupNames()
+	for _, name := range config.PresetNames() {
+		if len(references[config.PRESET_REFERENCE_PREFIX+name]) > 0 {
+			names = append(names, config.PRESET_REFERENCE_PREFIX+name)
+		}
+	}
+	if len(names) == 0 {
+		return
+	}
+
+	fmt.Fprintln(w, "groups:")
+	for _, name := range names {
+		lists := "not referenced"
+		if len(references[name]) > 0 {
+			lists = strings.Join(references[name], ", ")
+		}
+		fmt.Fprintf(w, "  %-24s %5d cidr %5d domain  %s\n", name,
+			len(conf.GroupEntries(name, config.GROUP_KIND_CIDR)), len(conf.GroupEntries(name, config.GROUP_KIND_DOMAIN)), lists)
+	}
+}
+
+// formatBytes formats n in binary units, e.g. 1.5MiB.
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	value, prefix := float64(n)/unit, 0
+	for value >= unit && prefix < 3 {
+		value /= unit
+		prefix++
+	}
+	return fmt.Sprintf("%.1f%ciB", value, "KMGT"[prefix])
+}
@@ -0,0 +1,228 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mrtc0/bouheki/pkg/audit/network"
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/errkind"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckResources(t *testing.T) {
+	conf := config.DefaultConfig()
+
+	var out bytes.Buffer
+	assert.Nil(t, checkResources(&out, conf))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Equal(t, "resources (profile small):", lines[0])
+	assert.Equal(t, "  allowed_v4_cidr_list                  256         1    22.5KiB", lines[2])
+	assert.Equal(t, "  allowed_path_list                     256         0   148.5KiB", lines[8])
+	assert.Equal(t, "  denied_port_list                      256         0    22.5KiB", lines[18])
+	assert.Equal(t, "  denied_v6_protocol_cidr_list          256         0    30.5KiB", lines[22])
+	assert.Equal(t, "  ingress_allowed_v6_cidr_list          256         0    28.5KiB", lines[24])
+	assert.Equal(t, "  total                                                   1.1MiB", lines[36])
+	assert.Equal(t, "profiles:", lines[37])
+	assert.Equal(t, "* small        1.1MiB", lines[38])
+	assert.True(t, strings.HasPrefix(lines[39], "  medium"))
+
+	// A rule set file larger than the profile.
+	dir := t.TempDir()
+	cidrs := []string{}
+	for i := 0; i < 300; i++ {
+		cidrs = append(cidrs, fmt.Sprintf("10.0.%d.%d/32", i/256, i%256))
+	}
+	path := filepath.Join(dir, "geoip-xx.txt")
+	assert.Nil(t, os.WriteFile(path, []byte(strings.Join(cidrs, "\n")), 0600))
+	conf.RestrictedNetworkConfig.RuleSets.Sets = []config.RuleSetConfig{{Name: "geoip-xx", List: config.RULE_SET_LIST_DENY, File: path}}
+
+	out.Reset()
+	err := checkResources(&out, conf)
+	assert.NotNil(t, err)
+	assert.Equal(t, errkind.Config, errkind.KindOf(err))
+	assert.Contains(t, err.Error(), "resources.profile small")
+	assert.Contains(t, out.String(), "  denied_v4_cidr_list                   256       300")
+}
+
+func TestPrintConfigMap(t *testing.T) {
+	conf := config.DefaultConfig()
+	conf.RestrictedNetworkConfig.Mode = "block"
+	conf.RestrictedNetworkConfig.Command.Allow = []string{"curl", "curl", "python*"}
+	conf.RestrictedNetworkConfig.Command.Deny = []string{}
+	conf.RestrictedNetworkConfig.GID.Allow = []string{"100"}
+	conf.RestrictedNetworkConfig.Ports.Deny = []string{"8000-8999"}
+	conf.RestrictedNetworkConfig.Ingress.Ports.Deny = []string{"4444"}
+	conf.RestrictedNetworkConfig.Audit.Enabled = false
+	conf.Resources.DenyShards = 4
+	conf.RestrictedNetworkConfig.Families = []string{config.FAMILY_IPV4}
+	conf.RestrictedNetworkConfig.Policies = []config.PolicyEntryConfig{{Name: "curl", Command: []string{"curl"}}}
+	conf.RestrictedNetworkConfig.Decision.Precedence = config.PRECEDENCE_ALLOW_FIRST
+
+	var out bytes.Buffer
+	printConfigMap(&out, network.ConfigMapValue(conf))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Equal(t, "network_bouheki_config_map:", lines[0])
+	assert.Equal(t, "  mode                       block", lines[1])
+	assert.Equal(t, "  classification             mount-namespace", lines[4])
+	assert.Equal(t, "  audit                      false", lines[5])
+	assert.Equal(t, "  deny_shards                4", lines[6])
+	assert.Equal(t, "  families                   ipv4", lines[7])
+	assert.Equal(t, "  other_families_audit       false", lines[8])
+	assert.Equal(t, "  policy_entries             1", lines[9])
+	assert.Equal(t, "  default                    deny", lines[10])
+	assert.Equal(t, "  precedence                 allow-first", lines[11])
+	assert.Equal(t, []string{
+		"lists:",
+		"  network.command.allow          1  restricts",
+		"  network.command.deny           0  no constraint",
+		"  network.command.allow *        1  restricts",
+		"  network.command.deny *         0  no constraint",
+		"  network.command.allow_paths    0  no constraint",
+		"  network.command.deny_paths     0  no constraint",
+		"  network.uid.allow              0  no constraint",
+		"  network.uid.deny               0  no constraint",
+		"  network.gid.allow              1  restricts",
+		"  network.gid.deny               0  no constraint",
+		"  network.ports.allow            0  no constraint",
+		"  network.ports.deny             6  restricts",
+		"  network.ingress.cidr.allow     0  no constraint",
+		"  network.ingress.ports.allow    0  no constraint",
+		"  network.ingress.ports.deny     1  restricts",
+	}, lines[12:28])
+	assert.True(t, strings.HasPrefix(lines[28], "value: 01000000"))
+}
+
+func TestFormatBytes(t *testing.T) {
+	assert.Equal(t, "512B", formatBytes(512))
+	assert.Equal(t, "1.5KiB", formatBytes(1536))
+	assert.Equal(t, "45.0MiB", formatBytes(45*1024*1024))
+}
+
+func TestPrintGroups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bouheki.yaml")
+	assert.Nil(t, os.WriteFile(path, []byte(`
+groups:
+  corp-proxies:
+    cidr: [10.0.1.0/24, 10.0.2.0/24]
+    domain: [proxy.corp.example.com]
+  unused:
+    cidr: [203.0.113.0/24]
+network:
+  cidr:
+    deny: [group:corp-proxies, "@link-local"]
+    allow_except: ["@cloud-metadata"]
+  domain:
+    allow: [group:corp-proxies]
+`), 0600))
+	conf, err := config.NewConfig(path)
+	assert.Nil(t, err)
+
+	var buf bytes.Buffer
+	printGroups(&buf, conf)
+	assert.Equal(t, "groups:\n"+
+		"  corp-proxies                 2 cidr     1 domain  network.cidr.deny, network.domain.allow\n"+
+		"  unused                       1 cidr     0 domain  not referenced\n"+
+		"  @cloud-metadata              3 cidr     0 domain  network.cidr.allow_except\n"+
+		"  @link-local                  2 cidr     0 domain  network.cidr.deny\n", buf.String())
+
+	buf.Reset()
+	printGroups(&buf, config.DefaultConfig())
+	assert.Empty(t, buf.String())
+}
+
+func TestPrintEffectiveConfig(t *testing.T) {
+	conf, err := config.Parse([]byte(`
+version: 2
+network:
+  mode: block
+  cidr:
+    allow: ["@private"]
+    deny: ["@cloud-metadata"]
+`))
+	assert.Nil(t, err)
+
+	var buf bytes.Buffer
+	assert.Nil(t, printEffectiveConfig(&buf, conf))
+	assert.Contains(t, buf.String(), `
+    allow:
+    - 10.0.0.0/8
+    - 172.16.0.0/12
+    - 192.168.0.0/16
+    - fc00::/7
+`)
+	assert.Contains(t, buf.String(), "    - 169.254.169.254/32\n")
+	assert.NotContains(t, buf.String(), "@private")
+}
+
+func TestLoadConfigFileChecksTheCIDRs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bouheki.yaml")
+	assert.Nil(t, os.WriteFile(path, []byte(`
+network:
+  cidr:
+    deny: [192.168.1.1/24]
+  ingress:
+    cidr:
+      allow: [0.0.0.0/0]
+`), 0600))
+
+	_, err := loadConfigFile(path, loadOptions{})
+	assert.EqualError(t, err, `1 allow list entries of every address (use --allow-all-destinations to confirm them): network.ingress.cidr.allow: "0.0.0.0/0" allows every address of the family`)
+	assert.Equal(t, errkind.Config, errkind.KindOf(err))
+
+	_, err = loadConfigFile(path, loadOptions{allowAllDestinations: true})
+	assert.Nil(t, err)
+	_, err = loadConfigFile(path, loadOptions{allowAllDestinations: true, strictCIDRs: true})
+	assert.EqualError(t, err, `1 CIDR entries with host bits set (write the network address, or drop --strict-cidrs to only warn): network.cidr.deny: "192.168.1.1/24" has host bits set, it is enforced as 192.168.1.0/24`)
+}
+
+func TestLintConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bouheki.yaml")
+	assert.Nil(t, os.WriteFile(path, []byte(`network:
+  cidr:
+    deny: [192.0.2.0/24, 192.0.2.0/24]
+`), 0600))
+
+	var buf bytes.Buffer
+	assert.Nil(t, lintConfig(&buf, path, DUMP_FORMAT_TEXT, false))
+	assert.Equal(t, path+`:3: warning: network.cidr.deny: "192.0.2.0/24" is listed twice`+"\n", buf.String())
+
+	// With --strict, and --strict-config as the config loads, the warnings fail too.
+	err := lintConfig(io.Discard, path, DUMP_FORMAT_TEXT, true)
+	assert.EqualError(t, err, path+" is not valid: 1 problems")
+	assert.Equal(t, errkind.Config, errkind.KindOf(err))
+	_, err = loadConfigFile(path, loadOptions{strictConfig: true})
+	assert.EqualError(t, err, "1 problems in the config with --strict-config:\n"+path+`:3: warning: network.cidr.deny: "192.0.2.0/24" is listed twice`)
+	_, err = loadConfigFile(path, loadOptions{})
+	assert.Nil(t, err)
+
+	buf.Reset()
+	assert.NotNil(t, lintConfig(&buf, path, DUMP_FORMAT_JSON, true))
+	var report lintReport
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &report))
+	assert.Equal(t, lintReport{Config: path, Valid: false, Problems: []config.Problem{
+		{Severity: config.SEVERITY_WARNING, Path: "network.cidr.deny", Line: 3, Message: `network.cidr.deny: "192.0.2.0/24" is listed twice`},
+	}}, report)
+}
+
+func TestValidateIsConfigValidate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bouheki.yaml")
+	assert.Nil(t, os.WriteFile(path, []byte(`network:
+  cidr:
+    deny: [192.0.2.0/24]
+`), 0600))
+
+	for _, args := range [][]string{{"bouheki", "config", "validate", path}, {"bouheki", "validate", path}} {
+		var buf bytes.Buffer
+		app := NewApp("")
+		app.Writer = &buf
+		assert.Nil(t, app.Run(args), args)
+		assert.Equal(t, path+" is valid\n", buf.String(), args)
+	}
+}
@@ -0,0 +1,184 @@
+package audit
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/control"
+	"github.com/mrtc0/bouheki/pkg/errkind"
+	"github.com/urfave/cli/v2"
+)
+
+var (
+	listFlag = cli.StringFlag{Name: "list", Value: "allow", Usage: "the list of network.cidr, allow or deny"}
+	cidrFlag = cli.StringFlag{Name: "cidr", Required: true, Usage: "the CIDR, or an address, e.g. 203.0.113.0/24"}
+)
+
+// ctlCommand changes the rules and the mode of the running bouheki on the control socket.
+func ctlCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "ctl",
+		Usage: "change the rules of the running bouheki on the control socket, until it restarts",
+		Subcommands: []*cli.Command{
+			{
+				Name:  "add-cidr",
+				Usage: "add a CIDR to network.cidr.allow or deny",
+				Flags: []cli.Flag{
+					&listFlag,
+					&cidrFlag,
+					&cli.DurationFlag{Name: "ttl", Usage: "remove the CIDR once the duration elapses, e.g. 1h"},
+				},
+				Action: func(c *cli.Context) error {
+					return withControl(c, func(ctx context.Context, socketPath string) error {
+						req := control.CIDRRequest{List: c.String("list"), CIDR: c.String("cidr")}
+						if ttl := c.Duration("ttl"); ttl > 0 {
+							req.TTL = ttl.String()
+						}
+						rule, err := control.AddCIDR(ctx, socketPath, req)
+						if err != nil {
+							return err
+						}
+						fmt.Fprintf(c.App.Writer, "Added %s to network.cidr.%s %s.\n", rule.CIDR, rule.List, expiry(rule))
+						return nil
+					})
+				},
+			},
+			{
+				Name:  "remove-cidr",
+				Usage: "remove a CIDR added by add-cidr",
+				Flags: []cli.Flag{&listFlag, &cidrFlag},
+				Action: func(c *cli.Context) error {
+					return withControl(c, func(ctx context.Context, socketPath string) error {
+						rule, err := control.RemoveCIDR(ctx, socketPath, c.String("list"), c.String("cidr"))
+						if err != nil {
+							return err
+						}
+						fmt.Fprintf(c.App.Writer, "Removed %s from network.cidr.%s.\n", rule.CIDR, rule.List)
+						return nil
+					})
+				},
+			},
+			{
+				Name:  "list-rules",
+				Usage: "list the CIDRs of network.cidr, of the config and added by add-cidr",
+				Action: func(c *cli.Context) error {
+					return withControl(c, func(ctx context.Context, socketPath string) error {
+						rules, err := control.ListRules(ctx, socketPath)
+						if err != nil {
+							return err
+						}
+						printRules(c.App.Writer, rules)
+						return nil
+					})
+				},
+			},
+			{
+				Name:  "force-monitor",
+				Usage: "force the network restriction into monitor mode, nothing is blocked until clear-force-monitor",
+				Action: func(c *cli.Context) error {
+					return setForceMonitor(c, true)
+				},
+			},
+			{
+				Name:  "clear-force-monitor",
+				Usage: "put the network restriction back into network.mode",
+				Action: func(c *cli.Context) error {
+					return setForceMonitor(c, false)
+				},
+			},
+			{
+				Name:  "mode",
+				Usage: "show the mode of the network restriction, and whether it is forced into monitor mode",
+				Action: func(c *cli.Context) error {
+					return withControl(c, func(ctx context.Context, socketPath string) error {
+						status, err := control.GetMode(ctx, socketPath)
+						if err != nil {
+							return err
+						}
+						printMode(c.App.Writer, status)
+						return nil
+					})
+				},
+			},
+		},
+	}
+}
+
+func setForceMonitor(c *cli.Context, force bool) error {
+	return withControl(c, func(ctx context.Context, socketPath string) error {
+		status, err := control.SetForceMonitor(ctx, socketPath, force)
+		if err != nil {
+			return err
+		}
+		printMode(c.App.Writer, status)
+		return nil
+	})
+}
+
+// printMode prints the mode of the network restriction, and by whom and since when it is forced into monitor mode.
+func printMode(w io.Writer, status control.ModeStatus) {
+	if !status.ForceMonitor {
+		fmt.Fprintf(w, "The network restriction is in mode: %s.\n", status.Mode)
+		return
+	}
+	by := status.Source
+	if status.UID != nil {
+		by = fmt.Sprintf("uid %d on the %s socket", *status.UID, status.Source)
+	} else if status.Source == "flag" {
+		by = "the --force-monitor flag"
+	}
+	line := fmt.Sprintf("The network restriction is forced into mode: monitor by %s", by)
+	if status.Since != nil {
+		line += " since " + status.Since.Local().Format(time.RFC3339)
+	}
+	fmt.Fprintf(w, "%s, network.mode is %s.\n", line, status.Configured)
+}
+
+// withControl runs fn with the control socket of the config, until it returns or is interrupted.
+func withControl(c *cli.Context, fn func(ctx context.Context, socketPath string) error) error {
+	conf, err := loadConfig(c)
+	if err != nil {
+		return err
+	}
+	if !conf.Control.Enable {
+		return errControlDisabled
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	if err := fn(ctx, conf.Control.Socket); err != nil {
+		return errkind.New(errkind.Runtime, err)
+	}
+	return nil
+}
+
+// expiry describes when rule is removed.
+func expiry(rule control.Rule) string {
+	if rule.Expires == nil {
+		return "until it is removed or bouheki restarts"
+	}
+	return "until " + rule.Expires.Local().Format(time.RFC3339)
+}
+
+// printRules prints every rule with its source, and when a runtime rule was added, by whom, and expires.
+func printRules(w io.Writer, rules []control.Rule) {
+	if len(rules) == 0 {
+		fmt.Fprintln(w, "network.cidr has no rule.")
+		return
+	}
+	for _, rule := range rules {
+		line := fmt.Sprintf("  %-8s %-6s %-43s", rule.Source, rule.List, rule.CIDR)
+		if rule.Source == control.RULE_SOURCE_RUNTIME {
+			if rule.UID != nil && rule.Added != nil {
+				line += fmt.Sprintf("  added by uid %d at %s", *rule.UID, rule.Added.Local().Format(time.RFC3339))
+			}
+			line += ", " + expiry(rule)
+		}
+		fmt.Fprintln(w, strings.TrimRight(line, " "))
+	}
+}
@@ -0,0 +1,48 @@
+package audit
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/control"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrintRules(t *testing.T) {
+	var buf bytes.Buffer
+	printRules(&buf, nil)
+	assert.Equal(t, "network.cidr has no rule.\n", buf.String())
+
+	uid := uint32(0)
+	added := time.Date(2026, 10, 14, 15, 6, 10, 0, time.Local)
+	expires := added.Add(time.Hour)
+	buf.Reset()
+	printRules(&buf, []control.Rule{
+		{Source: control.RULE_SOURCE_CONFIG, List: "allow", CIDR: "10.0.0.0/8"},
+		{Source: control.RULE_SOURCE_RUNTIME, List: "allow", CIDR: "203.0.113.0/24", UID: &uid, Added: &added, Expires: &expires},
+		{Source: control.RULE_SOURCE_RUNTIME, List: "deny", CIDR: "198.51.100.7/32", UID: &uid, Added: &added},
+	})
+	lines := strings.Split(strings.TrimRight(buf.String(), "\n"), "\n")
+	assert.Len(t, lines, 3)
+	assert.Equal(t, []string{"config", "allow", "10.0.0.0/8"}, strings.Fields(lines[0]))
+	assert.True(t, strings.HasSuffix(lines[1], "added by uid 0 at "+added.Format(time.RFC3339)+", until "+expires.Format(time.RFC3339)), lines[1])
+	assert.True(t, strings.HasSuffix(lines[2], ", until it is removed or bouheki restarts"), lines[2])
+}
+
+func TestPrintMode(t *testing.T) {
+	var buf bytes.Buffer
+	printMode(&buf, control.ModeStatus{Mode: "block", Configured: "block"})
+	assert.Equal(t, "The network restriction is in mode: block.\n", buf.String())
+
+	uid := uint32(0)
+	since := time.Date(2026, 10, 14, 15, 6, 10, 0, time.Local)
+	buf.Reset()
+	printMode(&buf, control.ModeStatus{Mode: "monitor", Configured: "block", ForceMonitor: true, Since: &since, Source: "control", UID: &uid})
+	assert.Equal(t, "The network restriction is forced into mode: monitor by uid 0 on the control socket since "+since.Format(time.RFC3339)+", network.mode is block.\n", buf.String())
+
+	buf.Reset()
+	printMode(&buf, control.ModeStatus{Mode: "monitor", Configured: "block", ForceMonitor: true, Since: &since, Source: "flag"})
+	assert.True(t, strings.HasPrefix(buf.String(), "The network restriction is forced into mode: monitor by the --force-monitor flag since "), buf.String())
+}
@@ -0,0 +1,137 @@
+package audit
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/mrtc0/bouheki/pkg/audit/network"
+	"github.com/mrtc0/bouheki/pkg/classify"
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/errkind"
+	"github.com/urfave/cli/v2"
+)
+
+const procRoot = "/proc"
+
+func debugCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "debug",
+		Usage: "helpers to debug the restrictions",
+		Subcommands: []*cli.Command{
+			{
+				Name:      "comm",
+				Usage:     "print the exact 16-byte comm of a process as it is compared with network.command",
+				ArgsUsage: "<pid>",
+				Action: func(c *cli.Context) error {
+					pid, err := strconv.Atoi(c.Args().First())
+					if err != nil || pid <= 0 {
+						return errors.New("usage: bouheki debug comm <pid>")
+					}
+
+					return printComm(c.App.Writer, procRoot, pid)
+				},
+			},
+			{
+				Name:  "classify",
+				Usage: "print whether a process is classified as a host or a container process, and why",
+				Flags: []cli.Flag{
+					&cli.IntFlag{Name: "pid", Usage: "the process to classify", Required: true},
+				},
+				Action: func(c *cli.Context) error {
+					conf, err := loadConfig(c)
+					if err != nil {
+						return err
+					}
+
+					classifier, err := classify.New(conf.RestrictedNetworkConfig.Classification)
+					if err != nil {
+						return errkind.New(errkind.Config, err)
+					}
+
+					p, err := classify.Read(procRoot, c.Int("pid"))
+					if err != nil {
+						return err
+					}
+
+					printClassification(c.App.Writer, classifier, p)
+					return nil
+				},
+			},
+			bundleCommand(),
+		},
+	}
+}
+
+// printComm prints the comm of each thread of pid. The BPF program reads the
+// comm of the thread that calls connect(2), which may differ from the process.
+func printComm(w io.Writer, root string, pid int) error {
+	paths, err := filepath.Glob(filepath.Join(root, strconv.Itoa(pid), "task", "*", "comm"))
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		return fmt.Errorf("process %d not found", pid)
+	}
+
+	printed := map[string]struct{}{}
+	for _, path := range paths {
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+
+		comm := strings.TrimSuffix(string(buf), "\n")
+		if _, ok := printed[comm]; ok {
+			continue
+		}
+		printed[comm] = struct{}{}
+
+		tid := filepath.Base(filepath.Dir(path))
+		fmt.Fprintf(w, "tid %s\n", tid)
+		fmt.Fprintf(w, "  comm: %q\n", comm)
+		fmt.Fprintf(w, "  key:  % x\n", network.CommandKey(comm))
+	}
+
+	return nil
+}
+
+// classifyStrategies are the strategies printed by printClassification. cgroup-list
+// is only printed when it is configured, since it matches nothing without a list.
+var classifyStrategies = []string{
+	config.CLASSIFY_MOUNT_NAMESPACE,
+	config.CLASSIFY_PID_NAMESPACE,
+	config.CLASSIFY_CGROUP_PATTERN,
+}
+
+// printClassification prints what the strategies see of p and how each classifies it.
+// The configured strategy, the one the BPF program uses, is marked with *.
+func printClassification(w io.Writer, classifier *classify.Classifier, p classify.Process) {
+	fmt.Fprintf(w, "pid %d\n", p.PID)
+	fmt.Fprintf(w, "  mount namespace: %d\n", p.MountNamespace)
+	fmt.Fprintf(w, "  pid namespace level: %d\n", p.PIDNamespaceLevel)
+	fmt.Fprintf(w, "  cgroup: %s\n", p.Cgroup)
+
+	strategies := classifyStrategies
+	if classifier.Strategy() == config.CLASSIFY_CGROUP_LIST {
+		strategies = append(strategies[:len(strategies):len(strategies)], config.CLASSIFY_CGROUP_LIST)
+	}
+
+	for _, strategy := range strategies {
+		mark := " "
+		if strategy == classifier.Strategy() {
+			mark = "*"
+		}
+
+		result := classifier.ClassifyWith(strategy, p)
+		target := "host"
+		if result.Container {
+			target = "container"
+		}
+		fmt.Fprintf(w, "%s %-16s %-9s %s\n", mark, strategy, target, result.Reason)
+	}
+}
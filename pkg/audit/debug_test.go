@@ -0,0 +1,66 @@
+package audit
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mrtc0/bouheki/pkg/classify"
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrintComm(t *testing.T) {
+	root := t.TempDir()
+	writeComm := func(tid string, comm string) {
+		dir := filepath.Join(root, "100", "task", tid)
+		assert.Nil(t, os.MkdirAll(dir, 0755))
+		assert.Nil(t, os.WriteFile(filepath.Join(dir, "comm"), []byte(comm+"\n"), 0644))
+	}
+	writeComm("100", "Curl ")
+	writeComm("101", "Curl ")
+	writeComm("102", "worker-thread-1")
+
+	var buf bytes.Buffer
+	assert.Nil(t, printComm(&buf, root, 100))
+	assert.Equal(t, `tid 100
+  comm: "Curl "
+  key:  43 75 72 6c 20 00 00 00 00 00 00 00 00 00 00 00
+tid 102
+  comm: "worker-thread-1"
+  key:  77 6f 72 6b 65 72 2d 74 68 72 65 61 64 2d 31 00
+`, buf.String())
+
+	assert.NotNil(t, printComm(&buf, root, 200))
+}
+
+func TestPrintClassification(t *testing.T) {
+	// docker run --pid=host
+	p := classify.Process{
+		PID:            23990,
+		MountNamespace: 4026532713,
+		Cgroup:         "/system.slice/docker-8c2d4e6f.scope",
+	}
+
+	classifier, err := classify.New(config.ClassificationConfig{Strategy: config.CLASSIFY_PID_NAMESPACE})
+	assert.Nil(t, err)
+
+	var buf bytes.Buffer
+	printClassification(&buf, classifier, p)
+	assert.Equal(t, `pid 23990
+  mount namespace: 4026532713
+  pid namespace level: 0
+  cgroup: /system.slice/docker-8c2d4e6f.scope
+  mount-namespace  container mount namespace 4026532713 is not the initial one (4026531840)
+* pid-namespace    host      in the initial pid namespace
+  cgroup-pattern   container cgroup /system.slice/docker-8c2d4e6f.scope matches ^/system\.slice/(docker|nerdctl)-[0-9a-f]+\.scope(/|$)
+`, buf.String())
+
+	classifier, err = classify.New(config.ClassificationConfig{Strategy: config.CLASSIFY_CGROUP_LIST, Cgroups: []string{"/system.slice"}})
+	assert.Nil(t, err)
+
+	buf.Reset()
+	printClassification(&buf, classifier, p)
+	assert.Contains(t, buf.String(), "* cgroup-list      container cgroup /system.slice/docker-8c2d4e6f.scope matches /system.slice\n")
+}
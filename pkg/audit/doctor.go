@@ -0,0 +1,87 @@
+package audit
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/mrtc0/bouheki/pkg/errkind"
+	"github.com/mrtc0/bouheki/pkg/features"
+	"github.com/mrtc0/bouheki/pkg/utils"
+	"github.com/urfave/cli/v2"
+)
+
+type finding struct {
+	name string
+	err  error
+	// degraded is how bouheki runs without what err reports missing. Such a finding is a warning.
+	degraded string
+}
+
+func doctorCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "doctor",
+		Usage: "check whether bouheki can run on this host with the given config",
+		Flags: []cli.Flag{&cli.StringFlag{Name: "config", Usage: "config file path, instead of the global --config"}},
+		Action: func(c *cli.Context) error {
+			// The local flag shadows the global one, which is the default of `bouheki doctor --config file.yaml`.
+			if c.String("config") == "" {
+				c.Set("config", c.Lineage()[1].String("config"))
+			}
+			return doctor(c.App.Writer, runDoctorChecks(c))
+		},
+	}
+}
+
+func runDoctorChecks(c *cli.Context) []finding {
+	findings := []finding{}
+	for _, check := range utils.PreflightChecks() {
+		findings = append(findings, finding{name: check.Name, err: errkind.New(errkind.Preflight, check.Run())})
+	}
+
+	var rootErr error
+	if !utils.AmIRootUser() {
+		rootErr = errRootRequired
+	}
+	findings = append(findings, finding{name: "root user", err: rootErr})
+
+	conf, err := loadConfig(c)
+	findings = append(findings, finding{name: fmt.Sprintf("config (%s)", c.String("config")), err: err})
+	if err != nil {
+		return findings
+	}
+
+	for _, result := range features.Check(conf, features.DefaultProbes()) {
+		findings = append(findings, finding{
+			name:     fmt.Sprintf("%s -> %s", result.Feature, result.Capability),
+			err:      errkind.New(errkind.Preflight, result.Err),
+			degraded: result.Degraded,
+		})
+	}
+
+	return findings
+}
+
+// doctor writes the findings and returns the first failure, so that
+// `bouheki doctor` exits with the same code as the daemon would. A degraded finding is a warning.
+func doctor(w io.Writer, findings []finding) error {
+	var first error
+	for _, f := range findings {
+		if f.err == nil {
+			fmt.Fprintf(w, "[OK]   %s\n", f.name)
+			continue
+		}
+
+		if f.degraded != "" {
+			fmt.Fprintf(w, "[WARN] %s: %v (degraded: %s)\n", f.name, f.err, f.degraded)
+			continue
+		}
+
+		kind := errkind.KindOf(f.err)
+		fmt.Fprintf(w, "[FAIL] %s: %v (kind: %s, exit code: %d)\n", f.name, f.err, kind, errkind.ExitCode(kind))
+		if first == nil {
+			first = f.err
+		}
+	}
+
+	return first
+}
@@ -0,0 +1,56 @@
+package audit
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/mrtc0/bouheki/pkg/errkind"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDoctor(t *testing.T) {
+	var buf bytes.Buffer
+	findings := []finding{
+		{name: "kernel version", err: nil},
+		{name: "BPF LSM", err: errkind.New(errkind.Preflight, errors.New("BPF LSM is not enabled"))},
+		{name: "config (bouheki.yaml)", err: errkind.New(errkind.Config, errors.New("open bouheki.yaml: no such file or directory"))},
+	}
+
+	err := doctor(&buf, findings)
+	assert.Equal(t, errkind.Preflight, errkind.KindOf(err))
+	assert.Equal(t, `[OK]   kernel version
+[FAIL] BPF LSM: BPF LSM is not enabled (kind: preflight, exit code: 69)
+[FAIL] config (bouheki.yaml): open bouheki.yaml: no such file or directory (kind: config, exit code: 78)
+`, buf.String())
+
+	buf.Reset()
+	assert.Nil(t, doctor(&buf, findings[:1]))
+}
+
+func TestDoctorWarnsOfDegradedFeatures(t *testing.T) {
+	var buf bytes.Buffer
+	findings := []finding{
+		{name: "network.enforcement.hook: auto -> BPF LSM", err: errkind.New(errkind.Preflight, errors.New("BPF LSM is not enabled")), degraded: "the kprobe fallback"},
+		{name: "network.enforcement.hook: auto -> kprobes"},
+	}
+
+	assert.Nil(t, doctor(&buf, findings))
+	assert.Equal(t, `[WARN] network.enforcement.hook: auto -> BPF LSM: BPF LSM is not enabled (degraded: the kprobe fallback)
+[OK]   network.enforcement.hook: auto -> kprobes
+`, buf.String())
+}
+
+func TestDoctorConfigFlag(t *testing.T) {
+	for name, args := range map[string][]string{
+		"after the command":  {"bouheki", "doctor", "--config", "missing.yaml"},
+		"before the command": {"bouheki", "--config", "missing.yaml", "doctor"},
+	} {
+		var buf bytes.Buffer
+		app := NewApp("")
+		app.Writer = &buf
+
+		assert.NotNil(t, app.Run(args), name)
+		assert.Contains(t, buf.String(), "[FAIL] config (missing.yaml)", name)
+	}
+}
@@ -0,0 +1,100 @@
+package audit
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/mrtc0/bouheki/pkg/audit/network"
+	"github.com/mrtc0/bouheki/pkg/errkind"
+	"github.com/urfave/cli/v2"
+)
+
+func domainsCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "domains",
+		Usage: "manage the DNS-derived rule state",
+		Subcommands: []*cli.Command{
+			{
+				Name:  "export",
+				Usage: "resolve the configured domains and write a signed snapshot for network.domain.preload_file",
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "key", Usage: "private key file generated by `bouheki domains keygen`", Required: true},
+					&cli.StringFlag{Name: "output", Aliases: []string{"o"}, Usage: "snapshot file path (default: stdout)"},
+				},
+				Action: exportDomains,
+			},
+			{
+				Name:  "keygen",
+				Usage: "generate a key pair for signing domain snapshots",
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "output", Aliases: []string{"o"}, Usage: "private key file path", Required: true},
+				},
+				Action: generateSnapshotKey,
+			},
+		},
+	}
+}
+
+func exportDomains(c *cli.Context) error {
+	conf, err := loadConfig(c)
+	if err != nil {
+		return err
+	}
+
+	key, err := readSnapshotPrivateKey(c.String("key"))
+	if err != nil {
+		return errkind.New(errkind.Config, err)
+	}
+
+	resolver, err := network.NewResolver(conf.RestrictedNetworkConfig.Domain.Resolver)
+	if err != nil {
+		return errkind.New(errkind.Preflight, err)
+	}
+
+	snapshot := network.ExportDomainSnapshot(conf, resolver)
+	data, err := network.SignDomainSnapshot(snapshot, key)
+	if err != nil {
+		return err
+	}
+
+	if c.String("output") == "" {
+		fmt.Fprintln(c.App.Writer, string(data))
+		return nil
+	}
+
+	return ioutil.WriteFile(c.String("output"), data, 0644)
+}
+
+func generateSnapshotKey(c *cli.Context) error {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(privateKey)
+	if err := ioutil.WriteFile(c.String("output"), []byte(encoded+"\n"), 0600); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(c.App.Writer, "network.domain.preload_public_key: %s\n", base64.StdEncoding.EncodeToString(publicKey))
+	return nil
+}
+
+func readSnapshotPrivateKey(path string) (ed25519.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != ed25519.PrivateKeySize {
+		return nil, errors.New("snapshot key must be a base64 encoded ed25519 private key")
+	}
+
+	return ed25519.PrivateKey(key), nil
+}
@@ -14,8 +14,15 @@ import (
 	"io"
 	"sync"
 
+	"github.com/mrtc0/bouheki/pkg/alert"
 	"github.com/mrtc0/bouheki/pkg/audit/helpers"
+	"github.com/mrtc0/bouheki/pkg/auditoutput"
 	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/containers"
+	"github.com/mrtc0/bouheki/pkg/errkind"
+	"github.com/mrtc0/bouheki/pkg/eventpipe"
+	"github.com/mrtc0/bouheki/pkg/falco"
+	"github.com/mrtc0/bouheki/pkg/utils"
 )
 
 const (
@@ -67,7 +74,7 @@ func RunAudit(ctx context.Context, wg *sync.WaitGroup, conf *config.Config) erro
 
 	mod, err := setupBPFProgram()
 	if err != nil {
-		log.Fatal(err)
+		log.Fatal(utils.ClassifyBPFError(err))
 	}
 	defer mod.Close()
 
@@ -76,17 +83,20 @@ func RunAudit(ctx context.Context, wg *sync.WaitGroup, conf *config.Config) erro
 		config: conf,
 	}
 
-	mgr.SetConfigToMap()
-	if err != nil {
-		log.Fatal(err)
+	if err = mgr.SetConfigToMap(); err != nil {
+		log.Fatal(errkind.Default(errkind.BPFLoad, err))
 	}
 
-	mgr.Attach()
+	if err = mgr.Attach(); err != nil {
+		log.Fatal(utils.ClassifyBPFError(err))
+	}
 
 	log.Info("Start the fileaccess audit.")
 	eventChannel := make(chan []byte)
 	lostChannel := make(chan uint64)
-	mgr.Start(eventChannel, lostChannel)
+	if err = mgr.Start(eventChannel, lostChannel); err != nil {
+		log.Fatal(errkind.Default(errkind.BPFLoad, err))
+	}
 
 	go func() {
 		for {
@@ -101,7 +111,13 @@ func RunAudit(ctx context.Context, wg *sync.WaitGroup, conf *config.Config) erro
 			}
 
 			auditLog := newAuditLog(event)
+			containers.Enrich(&auditLog.AuditEventLog)
 			auditLog.Info()
+			match := alert.Event{Audit: config.ALERT_AUDIT_FILEACCESS, Action: auditLog.Action, Comm: auditLog.Comm}
+			alert.Observe(match)
+			eventpipe.Write(match, auditLog)
+			falco.Write(match, auditLog)
+			auditoutput.Write(match, auditLog)
 		}
 	}()
 
@@ -119,6 +135,7 @@ func newAuditLog(event auditLog) log.RestrictedFileAccessLog {
 		PID:        event.PID,
 		Comm:       helpers.CommToString(event.Command),
 		ParentComm: helpers.CommToString(event.ParentCommand),
+		CgroupID:   event.CGroupID,
 	}
 
 	fileAccessLog := log.RestrictedFileAccessLog{
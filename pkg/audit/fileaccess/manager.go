@@ -37,12 +37,17 @@ func (m *Manager) Start(eventChannel chan []byte, lostChannel chan uint64) error
 	return nil
 }
 
+// Stop and Close do nothing before Start.
 func (m *Manager) Stop() {
-	m.pb.Stop()
+	if m.pb != nil {
+		m.pb.Stop()
+	}
 }
 
 func (m *Manager) Close() {
-	m.pb.Close()
+	if m.pb != nil {
+		m.pb.Close()
+	}
 }
 
 func (m *Manager) Attach() error {
@@ -0,0 +1,44 @@
+package audit
+
+import (
+	"context"
+	"os"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/fallback"
+	log "github.com/mrtc0/bouheki/pkg/log"
+	"github.com/mrtc0/bouheki/pkg/reload"
+)
+
+// reloadOnHangup loads the config of source again on every signal of hangups, until ctx is done,
+// and reloads it into the modules of coordinator: they write the rules that changed to the maps
+// of the running programs, which stay attached. A config that can not be loaded or applied
+// leaves every module on the current one, and the report of the reload is logged either way.
+//
+// When the reload fails over to the fallback policy, the fallback is reloaded, and promote is
+// called as on startup once the config loads again.
+func reloadOnHangup(ctx context.Context, hangups <-chan os.Signal, source *fallback.Source, coordinator *reload.Coordinator, promote func(*config.Config) error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangups:
+		}
+
+		// The config loads again through source.Run, which reloads it once it loads.
+		if source.Active() == fallback.SOURCE_FALLBACK {
+			log.Info("SIGHUP is ignored while the fallback policy is active, the config is reloaded once it loads.")
+			continue
+		}
+
+		conf, err := source.Reload()
+		if err != nil {
+			coordinator.LoadFailed(err)
+			continue
+		}
+		coordinator.Reload(conf)
+		if source.Active() == fallback.SOURCE_FALLBACK {
+			go source.Run(ctx, promote)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package audit
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/fallback"
+	"github.com/mrtc0/bouheki/pkg/notify"
+	"github.com/mrtc0/bouheki/pkg/reload"
+	"github.com/stretchr/testify/assert"
+)
+
+// appliedModule sends the configs it applies to applied.
+type appliedModule struct {
+	applied chan *config.Config
+}
+
+func (m appliedModule) Validate(conf *config.Config) error { return nil }
+func (m appliedModule) Plan(conf *config.Config) (reload.Plan, error) {
+	return reload.Plan{Summary: "network.cidr.deny", State: conf}, nil
+}
+func (m appliedModule) Apply(plan reload.Plan) error {
+	m.applied <- plan.State.(*config.Config)
+	return nil
+}
+func (m appliedModule) Rollback(plan reload.Plan) error { return nil }
+
+func TestReloadOnHangup(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "bouheki.yaml")
+	assert.Nil(t, os.WriteFile(path, []byte("network:\n  cidr:\n    deny: [10.0.0.0/8]\n"), 0600))
+	source := fallback.New(path, func(path string) (*config.Config, error) {
+		return loadConfigFile(path, loadOptions{})
+	}, filepath.Join(dir, "fallback-policy.yaml"))
+	_, err := source.Start()
+	assert.Nil(t, err)
+
+	module := appliedModule{applied: make(chan *config.Config, 1)}
+	coordinator := reload.NewCoordinator(func() string { return "digest" })
+	coordinator.Register("network", module)
+	s := notify.DefaultHub.Subscribe(notify.TYPE_CONFIG_RELOAD)
+	defer notify.DefaultHub.Unsubscribe(s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hangups := make(chan os.Signal)
+	go reloadOnHangup(ctx, hangups, source, coordinator, func(*config.Config) error { return nil })
+
+	assert.Nil(t, os.WriteFile(path, []byte("network:\n  cidr:\n    deny: [10.0.0.0/8, 192.0.2.0/24]\n"), 0600))
+	hangups <- syscall.SIGHUP
+	conf := <-module.applied
+	assert.Equal(t, []string{"10.0.0.0/8", "192.0.2.0/24"}, conf.RestrictedNetworkConfig.CIDR.Deny)
+	assert.True(t, (<-s.C).Payload.(notify.ConfigReload).Applied)
+
+	// An invalid config is not applied, and the reload reports why.
+	assert.Nil(t, os.WriteFile(path, []byte("network:\n  cidr:\n    allow: [192.0.2.0/24]\n    deny: [192.0.2.0/24]\n"), 0600))
+	hangups <- syscall.SIGHUP
+	reloaded := (<-s.C).Payload.(notify.ConfigReload)
+	assert.False(t, reloaded.Applied)
+	assert.Contains(t, reloaded.Error, "config reload failed to load: ")
+	assert.Contains(t, reloaded.Error, "192.0.2.0/24")
+	assert.Len(t, module.applied, 0)
+	assert.Equal(t, fallback.SOURCE_CONFIG, source.Active())
+}
@@ -0,0 +1,103 @@
+package audit
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/audit/network"
+	"github.com/mrtc0/bouheki/pkg/errkind"
+	"github.com/urfave/cli/v2"
+)
+
+// REPORT_NEW_DESTINATIONS_WINDOW is how recently a destination was first seen to be new in the report.
+const REPORT_NEW_DESTINATIONS_WINDOW = 24 * time.Hour
+
+// historyFilter selects the entries of the outcome history to print.
+type historyFilter struct {
+	comm           string
+	destination    string
+	minConnections uint64
+	// firstSeenAfter keeps the destinations first seen after it, unless it is zero.
+	firstSeenAfter time.Time
+	limit          int
+}
+
+func (f historyFilter) match(entry network.OutcomeEntry) bool {
+	return (f.comm == "" || entry.Comm == f.comm) &&
+		(f.destination == "" || entry.Destination == f.destination) &&
+		entry.Connections() >= f.minConnections &&
+		(f.firstSeenAfter.IsZero() || entry.FirstSeen.After(f.firstSeenAfter))
+}
+
+func historyCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "history",
+		Usage: "show the connections of every comm and destination counted by network.outcome_history",
+		Flags: []cli.Flag{
+			&cli.StringFlag{Name: "comm", Usage: "only the connections of this comm"},
+			&cli.StringFlag{Name: "destination", Usage: "only the connections to this domain or prefix"},
+			&cli.Uint64Flag{Name: "min-connections", Usage: "only the destinations connected to at least this many times"},
+			&cli.DurationFlag{Name: "new", Usage: "only the destinations first seen within this duration, e.g. 24h"},
+			&cli.IntFlag{Name: "limit", Value: 50, Usage: "the number of destinations to show, the most connections first. 0 shows all"},
+		},
+		Action: func(c *cli.Context) error {
+			conf, err := loadConfig(c)
+			if err != nil {
+				return err
+			}
+
+			filter := historyFilter{
+				comm:           c.String("comm"),
+				destination:    c.String("destination"),
+				minConnections: c.Uint64("min-connections"),
+				limit:          c.Int("limit"),
+			}
+			if d := c.Duration("new"); d > 0 {
+				filter.firstSeenAfter = time.Now().Add(-d)
+			}
+			return printOutcomeHistory(c.App.Writer, conf.RestrictedNetworkConfig.OutcomeHistory.StateDir, filter)
+		},
+	}
+}
+
+func printOutcomeHistory(w io.Writer, dir string, filter historyFilter) error {
+	history, err := network.ReadOutcomeHistory(dir)
+	if os.IsNotExist(err) {
+		fmt.Fprintf(w, "No outcome history in %s, is network.outcome_history enabled?\n", dir)
+		return nil
+	}
+	if err != nil {
+		return errkind.New(errkind.Runtime, err)
+	}
+
+	fmt.Fprintf(w, "outcome history, updated %s:\n", history.Updated.Local().Format(time.RFC3339))
+	printOutcomeEntries(w, history.Entries, filter)
+	return nil
+}
+
+// printOutcomeEntries prints the entries matching filter, which are ordered by connections.
+func printOutcomeEntries(w io.Writer, entries []network.OutcomeEntry, filter historyFilter) {
+	fmt.Fprintf(w, "  %11s %8s %8s  %-25s  %-25s  %-16s %s\n", "connections", "blocked", "denied", "first seen", "last seen", "comm", "destination")
+	printed := 0
+	for _, entry := range entries {
+		if !filter.match(entry) {
+			continue
+		}
+		if filter.limit > 0 && printed == filter.limit {
+			fmt.Fprintln(w, "  ...")
+			return
+		}
+		fmt.Fprintf(w, "  %11d %8d %8d  %-25s  %-25s  %-16s %s\n", entry.Connections(), entry.Blocked, entry.Denied,
+			entry.FirstSeen.Local().Format(time.RFC3339), entry.LastSeen.Local().Format(time.RFC3339), entry.Comm, entry.Destination)
+		printed++
+	}
+}
+
+// printNewDestinations prints the destinations of the history first seen in the last
+// REPORT_NEW_DESTINATIONS_WINDOW before now.
+func printNewDestinations(w io.Writer, history *network.OutcomeHistory, now time.Time) {
+	fmt.Fprintf(w, "\nnew destinations (first seen in the last %s):\n", REPORT_NEW_DESTINATIONS_WINDOW)
+	printOutcomeEntries(w, history.Entries, historyFilter{firstSeenAfter: now.Add(-REPORT_NEW_DESTINATIONS_WINDOW), limit: REPORT_BREAKDOWN_SIZE})
+}
@@ -0,0 +1,53 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/audit/network"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrintOutcomeHistory(t *testing.T) {
+	dir := t.TempDir()
+
+	var buf bytes.Buffer
+	assert.Nil(t, printOutcomeHistory(&buf, dir, historyFilter{}))
+	assert.Contains(t, buf.String(), "No outcome history")
+
+	now := time.Date(2026, 10, 14, 12, 0, 0, 0, time.Local)
+	history := &network.OutcomeHistory{Version: network.OUTCOME_HISTORY_VERSION, Updated: now, Entries: []network.OutcomeEntry{
+		{Comm: "curl", Destination: "api.example.com", Kind: network.OUTCOME_DESTINATION_DOMAIN, Allowed: 150, Denied: 150, FirstSeen: now.Add(-48 * time.Hour), LastSeen: now},
+		{Comm: "curl", Destination: "192.0.2.0/24", Kind: network.OUTCOME_DESTINATION_CIDR, Allowed: 10, FirstSeen: now.Add(-time.Hour), LastSeen: now},
+		{Comm: "wget", Destination: "198.51.100.0/24", Kind: network.OUTCOME_DESTINATION_CIDR, Blocked: 2, Denied: 2, FirstSeen: now.Add(-time.Minute), LastSeen: now},
+	}}
+	data, err := json.Marshal(history)
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(network.OutcomeHistoryPath(dir), data, 0600))
+
+	buf.Reset()
+	assert.Nil(t, printOutcomeHistory(&buf, dir, historyFilter{comm: "curl", minConnections: 100}))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equal(t, 3, len(lines))
+	assert.Equal(t, "outcome history, updated "+now.Format(time.RFC3339)+":", lines[0])
+	assert.Equal(t, strings.Fields("connections blocked denied first seen last seen comm destination"), strings.Fields(lines[1]))
+	assert.Equal(t, []string{"150", "0", "150", now.Add(-48 * time.Hour).Format(time.RFC3339), now.Format(time.RFC3339), "curl", "api.example.com"}, strings.Fields(lines[2]))
+
+	buf.Reset()
+	assert.Nil(t, printOutcomeHistory(&buf, dir, historyFilter{limit: 1}))
+	assert.True(t, strings.HasSuffix(buf.String(), "api.example.com\n  ...\n"))
+
+	// The report flags the destinations first seen in the last day.
+	buf.Reset()
+	printNewDestinations(&buf, history, now)
+	assert.NotContains(t, buf.String(), "api.example.com")
+	assert.Contains(t, buf.String(), "192.0.2.0/24")
+	assert.Contains(t, buf.String(), "198.51.100.0/24")
+
+	assert.Nil(t, os.WriteFile(network.OutcomeHistoryPath(dir), []byte("{"), 0600))
+	assert.NotNil(t, printOutcomeHistory(&buf, dir, historyFilter{}))
+}
@@ -1,19 +1,29 @@
 package network
 
 import (
-	"bytes"
 	"context"
-	"encoding/binary"
 	"fmt"
-	"io"
 	"net"
 	"sync"
 
-	"github.com/miekg/dns"
+	"github.com/mrtc0/bouheki/pkg/alert"
 	"github.com/mrtc0/bouheki/pkg/audit/helpers"
+	"github.com/mrtc0/bouheki/pkg/auditoutput"
 	"github.com/mrtc0/bouheki/pkg/bpf"
 	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/containers"
+	"github.com/mrtc0/bouheki/pkg/control"
+	"github.com/mrtc0/bouheki/pkg/errkind"
+	"github.com/mrtc0/bouheki/pkg/eventpipe"
+	"github.com/mrtc0/bouheki/pkg/falco"
+	"github.com/mrtc0/bouheki/pkg/jobs"
 	log "github.com/mrtc0/bouheki/pkg/log"
+	"github.com/mrtc0/bouheki/pkg/metrics"
+	"github.com/mrtc0/bouheki/pkg/notify"
+	"github.com/mrtc0/bouheki/pkg/reload"
+	"github.com/mrtc0/bouheki/pkg/startup"
+	"github.com/mrtc0/bouheki/pkg/timing"
+	"github.com/mrtc0/bouheki/pkg/utils"
 
 	"github.com/aquasecurity/libbpfgo"
 )
@@ -34,25 +44,58 @@ const (
 	ACTION_BLOCKED_STRING       = "BLOCKED"
 	ACTION_UNKNOWN_STRING       = "UNKNOWN"
 
+	VERDICT_ALLOW uint8 = 0
+	VERDICT_DENY  uint8 = 1
+
 	BLOCKED_IPV4 int32 = 0
 	BLOCKED_IPV6 int32 = 1
 
-	LSM_HOOK_POINT_CONNECT uint8 = 0
-	LSM_HOOK_POINT_SENDMSG uint8 = 1
+	LSM_HOOK_POINT_CONNECT        uint8 = 0
+	LSM_HOOK_POINT_SENDMSG        uint8 = 1
+	LSM_HOOK_POINT_CONNECT_KPROBE uint8 = 2
+	LSM_HOOK_POINT_BIND           uint8 = 3
+	LSM_HOOK_POINT_BIND_KPROBE    uint8 = 4
+	LSM_HOOK_POINT_SENDMSG_KPROBE uint8 = 5
 )
 
+// eventHeader is the header of an event, decoded from any schema version by parseEvent.
 type eventHeader struct {
+	// SchemaVersion is the EVENT_SCHEMA_VERSION of the programs that emitted the event.
+	SchemaVersion uint16
 	CGroupID      uint64
-	PID           uint32
-	EventType     int32
-	Nodename      [NEW_UTS_LEN + 1]byte
-	Command       [TASK_COMM_LEN]byte
-	ParentCommand [TASK_COMM_LEN]byte
-	_             [PADDING_LEN]byte
+	// MatchedCgroupID is the classified cgroup that CGroupID matched, itself or an
+	// ancestor. It is 0 unless the classification uses cgroups.
+	MatchedCgroupID uint64
+	PID             uint32
+	EventType       int32
+	UID             uint32
+	GID             uint32
+	Nodename        [NEW_UTS_LEN + 1]byte
+	Command         [TASK_COMM_LEN]byte
+	ParentCommand   [TASK_COMM_LEN]byte
+}
+
+// hasSubject reports whether the event has the uid and gid of the process, which the events
+// of schema version 1 do not.
+func (h eventHeader) hasSubject() bool {
+	return h.SchemaVersion >= 2
 }
 
 type detectEvent interface {
 	ActionResult() string
+	// Denied reports whether the kernel's policy decision was to deny the connection.
+	Denied() bool
+	// Operation is OPERATION_CONNECT, OPERATION_SENDMSG or OPERATION_BIND.
+	Operation() string
+	// MatchedRule is the list that denied the connection, a RULE_LIST_* plus one or
+	// EVENT_RULE_POLICY_ENTRY, and 0 for a permitted connection or an event before schema version 6.
+	MatchedRule() uint8
+	// MonitorRule reports whether MatchedRule is a deny entry in mode: monitor, which reported the
+	// connection without denying it. It is false before schema version 7.
+	MonitorRule() bool
+	// InContainer reports whether the task is in a classified container, which is always the case
+	// with target: container. It is false before schema version 8.
+	InContainer() bool
 }
 
 type detectEventIPv4 struct {
@@ -62,6 +105,14 @@ type detectEventIPv4 struct {
 	LsmHookPoint uint8
 	Action       uint8
 	SockType     uint8
+	Verdict      uint8
+	SrcPort      uint16
+	// Rule is the list that denied the connection, see MatchedRule.
+	Rule uint8
+	// Monitored is set when Rule is in mode: monitor, see MonitorRule.
+	Monitored uint8
+	// Container is set when the task is in a classified container, see InContainer.
+	Container uint8
 }
 
 type detectEventIPv6 struct {
@@ -71,6 +122,11 @@ type detectEventIPv6 struct {
 	LsmHookPoint uint8
 	Action       uint8
 	SockType     uint8
+	Verdict      uint8
+	SrcPort      uint16
+	Rule         uint8
+	Monitored    uint8
+	Container    uint8
 }
 
 func (e detectEventIPv4) ActionResult() string {
@@ -84,6 +140,60 @@ func (e detectEventIPv4) ActionResult() string {
 	}
 }
 
+func (e detectEventIPv4) Denied() bool {
+	return e.Verdict == VERDICT_DENY
+}
+
+func (e detectEventIPv4) Operation() string {
+	return hookPointOperation(e.LsmHookPoint)
+}
+
+func (e detectEventIPv4) MatchedRule() uint8 {
+	return e.Rule
+}
+
+func (e detectEventIPv4) MonitorRule() bool {
+	return e.Monitored != 0
+}
+
+func (e detectEventIPv4) InContainer() bool {
+	return e.Container != 0
+}
+
+func (e detectEventIPv6) Denied() bool {
+	return e.Verdict == VERDICT_DENY
+}
+
+func (e detectEventIPv6) Operation() string {
+	return hookPointOperation(e.LsmHookPoint)
+}
+
+func (e detectEventIPv6) MatchedRule() uint8 {
+	return e.Rule
+}
+
+func (e detectEventIPv6) MonitorRule() bool {
+	return e.Monitored != 0
+}
+
+func (e detectEventIPv6) InContainer() bool {
+	return e.Container != 0
+}
+
+// hookPointOperation returns the operation of the events of the hook point. The events of a bind
+// have the address and the port bound to as their destination, the events of a sendmsg the
+// destination of the datagram.
+func hookPointOperation(point uint8) string {
+	switch point {
+	case LSM_HOOK_POINT_BIND, LSM_HOOK_POINT_BIND_KPROBE:
+		return OPERATION_BIND
+	case LSM_HOOK_POINT_SENDMSG, LSM_HOOK_POINT_SENDMSG_KPROBE:
+		return OPERATION_SENDMSG
+	default:
+		return OPERATION_CONNECT
+	}
+}
+
 func (e detectEventIPv6) ActionResult() string {
 	switch e.Action {
 	case ACTION_MONITOR:
@@ -96,10 +206,195 @@ func (e detectEventIPv6) ActionResult() string {
 }
 
 const (
-	BPF_OBJECT_NAME = "restricted-network"
+	BPF_OBJECT_NAME     = "restricted-network"
+	LSM_PROGRAM_NAME    = "socket_connect"
+	KPROBE_PROGRAM_NAME = "kprobe_socket_connect"
+	KPROBE_ATTACH_POINT = "security_socket_connect"
+
+	// The variants of the programs that match the ancestors of the current cgroup.
+	LSM_ANCESTORS_PROGRAM_NAME    = "socket_connect_ancestors"
+	KPROBE_ANCESTORS_PROGRAM_NAME = "kprobe_socket_connect_ancestors"
+
+	// The programs of the sendmsg hook, which check the destination of the datagrams sent on the
+	// unconnected sockets as the connections are.
+	LSM_SENDMSG_PROGRAM_NAME              = "socket_sendmsg"
+	KPROBE_SENDMSG_PROGRAM_NAME           = "kprobe_socket_sendmsg"
+	KPROBE_SENDMSG_ATTACH_POINT           = "security_socket_sendmsg"
+	LSM_SENDMSG_ANCESTORS_PROGRAM_NAME    = "socket_sendmsg_ancestors"
+	KPROBE_SENDMSG_ANCESTORS_PROGRAM_NAME = "kprobe_socket_sendmsg_ancestors"
+
+	// The programs of the bind hook, which are only loaded when network.ingress has rules.
+	LSM_BIND_PROGRAM_NAME              = "socket_bind"
+	KPROBE_BIND_PROGRAM_NAME           = "kprobe_socket_bind"
+	KPROBE_BIND_ATTACH_POINT           = "security_socket_bind"
+	LSM_BIND_ANCESTORS_PROGRAM_NAME    = "socket_bind_ancestors"
+	KPROBE_BIND_ANCESTORS_PROGRAM_NAME = "kprobe_socket_bind_ancestors"
 )
 
-func setupBPFProgram() (*libbpfgo.Module, error) {
+// hookProgram are the programs of the hook of an operation: the LSM and the kprobe program of
+// each variant, and the kernel function the kprobe is attached to.
+type hookProgram struct {
+	operation       string
+	lsm             string
+	kprobe          string
+	lsmAncestors    string
+	kprobeAncestors string
+	attachPoint     string
+}
+
+var hookPrograms = []hookProgram{
+	{
+		operation:       OPERATION_CONNECT,
+		lsm:             LSM_PROGRAM_NAME,
+		kprobe:          KPROBE_PROGRAM_NAME,
+		lsmAncestors:    LSM_ANCESTORS_PROGRAM_NAME,
+		kprobeAncestors: KPROBE_ANCESTORS_PROGRAM_NAME,
+		attachPoint:     KPROBE_ATTACH_POINT,
+	},
+	{
+		operation:       OPERATION_SENDMSG,
+		lsm:             LSM_SENDMSG_PROGRAM_NAME,
+		kprobe:          KPROBE_SENDMSG_PROGRAM_NAME,
+		lsmAncestors:    LSM_SENDMSG_ANCESTORS_PROGRAM_NAME,
+		kprobeAncestors: KPROBE_SENDMSG_ANCESTORS_PROGRAM_NAME,
+		attachPoint:     KPROBE_SENDMSG_ATTACH_POINT,
+	},
+	{
+		operation:       OPERATION_BIND,
+		lsm:             LSM_BIND_PROGRAM_NAME,
+		kprobe:          KPROBE_BIND_PROGRAM_NAME,
+		lsmAncestors:    LSM_BIND_ANCESTORS_PROGRAM_NAME,
+		kprobeAncestors: KPROBE_BIND_ANCESTORS_PROGRAM_NAME,
+		attachPoint:     KPROBE_BIND_ATTACH_POINT,
+	},
+}
+
+// programNames returns the LSM and the kprobe program of the variant.
+func (h hookProgram) programNames(ancestors bool) (string, string) {
+	if ancestors {
+		return h.lsmAncestors, h.kprobeAncestors
+	}
+	return h.lsm, h.kprobe
+}
+
+// restrictedOperations returns the operations the programs of conf are attached for: the
+// connections and the datagrams sent without one, and the binds when network.ingress has rules.
+func restrictedOperations(conf *config.Config) []string {
+	operations := []string{OPERATION_CONNECT, OPERATION_SENDMSG}
+	if conf.RestrictedNetworkConfig.Ingress.HasRules() {
+		operations = append(operations, OPERATION_BIND)
+	}
+	return operations
+}
+
+// operationHooks returns the hooks of operations.
+func operationHooks(operations []string) []hookProgram {
+	hooks := []hookProgram{}
+	for _, h := range hookPrograms {
+		for _, operation := range operations {
+			if h.operation == operation {
+				hooks = append(hooks, h)
+			}
+		}
+	}
+	return hooks
+}
+
+// cgroupMatching returns network.classification.cgroup_matching, or config.CGROUP_MATCHING_WATCH
+// when the programs do not look up the cgroups, so that the ancestors are not walked for nothing.
+func cgroupMatching(conf *config.Config) string {
+	classification := conf.RestrictedNetworkConfig.Classification
+	if !classification.UsesCgroups() || !conf.ClassifiesContainers("network") {
+		return config.CGROUP_MATCHING_WATCH
+	}
+	return classification.CgroupMatching
+}
+
+// setupBPFProgram loads the programs of operations needed for hook and matching, and the ones
+// that track the executables of the tasks if exePaths, with the maps resized to sizes, and returns the hook that was loaded and whether the programs match the
+// ancestors of the current cgroup. Every attempt to load them is timed by timer.
+// With config.HOOK_AUTO, only the kprobes are loaded if the kernel can not load the LSM programs.
+// With pinPath, the maps are pinned there, or adopted from a previous bouheki, see setPinPaths.
+func setupBPFProgram(hook string, matching string, operations []string, exePaths bool, sizes MapSizes, pinPath string, timer *timing.Timer) (*libbpfgo.Module, string, bool, error) {
+	mod, ancestors, err := loadVariant(hook, matching, operations, exePaths, sizes, pinPath, timer)
+	if err != nil && hook == config.HOOK_AUTO {
+		log.Warn(fmt.Sprintf("Failed to load the BPF LSM program, falling back to the kprobe: %s", err))
+		hook = config.HOOK_KPROBE
+		mod, ancestors, err = loadVariant(hook, matching, operations, exePaths, sizes, pinPath, timer)
+	}
+	if err != nil {
+		return nil, hook, false, err
+	}
+	if err = adoptModuleEventSchema(mod); err != nil {
+		mod.Close()
+		return nil, hook, false, err
+	}
+
+	return mod, hook, ancestors, nil
+}
+
+// loadVariant loads the programs of hook for matching. With config.CGROUP_MATCHING_AUTO,
+// the variant that walks the ancestors is loaded if the kernel has the helper it calls.
+func loadVariant(hook string, matching string, operations []string, exePaths bool, sizes MapSizes, pinPath string, timer *timing.Timer) (*libbpfgo.Module, bool, error) {
+	if matching == config.CGROUP_MATCHING_WATCH {
+		mod, err := loadBPFProgram(hook, false, operations, exePaths, sizes, pinPath, timer)
+		return mod, false, err
+	}
+
+	mod, err := loadBPFProgram(hook, true, operations, exePaths, sizes, pinPath, timer)
+	if err == nil || matching == config.CGROUP_MATCHING_ANCESTORS {
+		return mod, true, err
+	}
+
+	mod, watchErr := loadBPFProgram(hook, false, operations, exePaths, sizes, pinPath, timer)
+	if watchErr != nil {
+		return nil, false, watchErr
+	}
+	log.Warn(fmt.Sprintf("Failed to load the programs that match the ancestor cgroups, watching the cgroups instead: %s", err))
+	return mod, false, nil
+}
+
+// loadBPFProgram times the opening of the object, with the programs it does not load and the
+// sizes of the maps, as the load phase of timer. libbpf relocates the programs against the BTF
+// of the kernel and has them verified in one call, which is the btf phase.
+func loadBPFProgram(hook string, ancestors bool, operations []string, exePaths bool, sizes MapSizes, pinPath string, timer *timing.Timer) (*libbpfgo.Module, error) {
+	load := timer.Begin(STARTUP_PHASE_LOAD)
+	mod, err := openBPFProgram(hook, ancestors, operations, exePaths, sizes)
+	if err == nil {
+		if err = setPinPaths(mod, pinPath); err != nil {
+			mod.Close()
+		}
+	}
+	load.End(err)
+	if err != nil {
+		return nil, err
+	}
+
+	adopting := hasPins(pinPath)
+	btf := timer.Begin(STARTUP_PHASE_BTF)
+	err = mod.BPFLoadObject()
+	btf.End(err)
+	if err != nil {
+		mod.Close()
+		if adopting {
+			return nil, adoptError(pinPath, err)
+		}
+		return nil, err
+	}
+	if adopting {
+		if err = checkModuleConfigMapLayout(mod); err != nil {
+			mod.Close()
+			return nil, adoptError(pinPath, err)
+		}
+		log.Info(fmt.Sprintf("Adopted the maps pinned in %s.", pinPath))
+	}
+
+	return mod, nil
+}
+
+// openBPFProgram opens the object, without the programs of hook and ancestors the operations do
+// not use, nor the ones that track the executables unless exePaths, and resizes its maps.
+func openBPFProgram(hook string, ancestors bool, operations []string, exePaths bool, sizes MapSizes) (*libbpfgo.Module, error) {
 	bytecode, err := bpf.EmbedFS.ReadFile("bytecode/restricted-network.bpf.o")
 	if err != nil {
 		return nil, err
@@ -109,7 +404,36 @@ func setupBPFProgram() (*libbpfgo.Module, error) {
 		return nil, err
 	}
 
-	if err = mod.BPFLoadObject(); err != nil {
+	used := map[string]bool{}
+	for _, h := range operationHooks(operations) {
+		lsmProgName, kprobeProgName := h.programNames(ancestors)
+		used[lsmProgName] = hook != config.HOOK_KPROBE
+		used[kprobeProgName] = hook != config.HOOK_LSM
+	}
+	// task_exec is an LSM program, which the kernels without the BPF LSM can not load.
+	used[TASK_EXEC_PROGRAM_NAME] = exePaths && hook != config.HOOK_KPROBE
+	used[TASK_FORK_PROGRAM_NAME] = exePaths
+	progNames := []string{TASK_EXEC_PROGRAM_NAME, TASK_FORK_PROGRAM_NAME}
+	for _, h := range hookPrograms {
+		progNames = append(progNames, h.lsm, h.kprobe, h.lsmAncestors, h.kprobeAncestors)
+	}
+	for _, progName := range progNames {
+		if used[progName] {
+			continue
+		}
+		prog, err := mod.GetProgram(progName)
+		if err != nil {
+			mod.Close()
+			return nil, err
+		}
+		if err = prog.SetAutoload(false); err != nil {
+			mod.Close()
+			return nil, err
+		}
+	}
+
+	if err = sizes.resize(mod); err != nil {
+		mod.Close()
 		return nil, err
 	}
 
@@ -124,31 +448,87 @@ func RunAudit(ctx context.Context, wg *sync.WaitGroup, conf *config.Config) erro
 		log.Info("netwrok audit is disable. shutdown...")
 		return nil
 	}
+	timer := timing.New(STARTUP_TIMER_NAME, nil)
 
-	mod, err := setupBPFProgram()
+	sizes, err := NewMapSizes(conf.Resources)
+	if err != nil {
+		log.Fatal(errkind.New(errkind.Config, err))
+	}
+	required, err := RequiredEntries(conf)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer mod.Close()
+	if err = sizes.Check(conf.Resources, required); err != nil {
+		log.Fatal(errkind.New(errkind.Config, err))
+	}
 
-	dnsConfig, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+	mod, hook, ancestors, err := setupBPFProgram(conf.RestrictedNetworkConfig.Enforcement.Hook, cgroupMatching(conf), restrictedOperations(conf), tracksExePaths(conf), sizes.withRingBuf(conf.RestrictedNetworkConfig.Audit.RingBufSize), conf.BPF.PinPath, timer)
 	if err != nil {
-		return err
+		log.Fatal(utils.ClassifyBPFError(err))
 	}
 
-	mgr := Manager{
-		mod:    mod,
-		config: conf,
-		dnsResolver: &DefaultResolver{
-			config:  dnsConfig,
-			client:  new(dns.Client),
-			message: new(dns.Msg),
-		},
+	resolver, err := NewResolver(conf.RestrictedNetworkConfig.Domain.Resolver)
+	if err != nil {
+		log.Fatal(errkind.New(errkind.Preflight, err))
 	}
 
-	if err = mgr.SetConfigToMap(); err != nil {
+	mgr, err := NewManager(conf, withProgram(mod, hook, ancestors), withStartupTimer(timer), WithDNSResolver(resolver))
+	if err != nil {
 		log.Fatal(err)
 	}
+	// Drain closes the module after the programs are detached and the ring buffer is released.
+	mgr.ownsModule = true
+	if ForceMonitorOnStart {
+		mgr.forceMonitorOnStart()
+	}
+
+	resources := newResourcesStatus(conf.Resources, sizes, required)
+	metrics.Handle(jobs.STATUS_PATH, mgr.Jobs())
+	metrics.Handle(RESOURCES_PATH, resources)
+	reloads := &reloadHistory{}
+	go reloads.run(ctx, notify.DefaultHub)
+	if mgr.versions = newPolicyVersions(conf.RestrictedNetworkConfig.PolicySnapshot); mgr.versions != nil {
+		go mgr.versions.run(ctx)
+	}
+	// The DNS proxy writes the addresses the containers resolve, which are never blocked for being new.
+	if !conf.EnableDNSProxy() {
+		if mgr.healer = newDNSHealer(mgr, conf.RestrictedNetworkConfig.Domain.Heal); mgr.healer != nil {
+			go mgr.healer.run(ctx)
+		}
+	}
+
+	checker, err := startup.FromConfig(conf.Startup, resolver.Client(), resolver.Servers())
+	if err != nil {
+		log.Fatal(errkind.New(errkind.Config, err))
+	}
+	checker.SetTiming(timer)
+	metrics.Handle(startup.STATUS_PATH, checker)
+	conditions := timer.Begin(STARTUP_PHASE_CONDITIONS)
+	err = checker.Wait(ctx)
+	conditions.End(err)
+	if err != nil {
+		if ctx.Err() != nil {
+			log.Info("Terminated the network audit before the startup conditions were met.")
+			return nil
+		}
+		log.Fatal(errkind.New(errkind.Preflight, err))
+	}
+
+	if err = mgr.SetConfigToMap(); err != nil {
+		log.Fatal(errkind.Default(errkind.BPFLoad, err))
+	}
+	mgr.completeStartup(checker)
+	// A SIGHUP reloads the rules into the maps of the running programs, see reload.Default.
+	reload.Default.SetPolicyDigest(func() string { return mgr.Policy().Digest() })
+	reload.Default.Register(RELOAD_MODULE, mgr)
+	if conf.RestrictedNetworkConfig.PolicySnapshot.Enable {
+		logPolicyDiff(conf)
+	}
+	metrics.Handle(RULE_SETS_PATH, ruleSetsStatus(mgr.ruleSets))
+
+	if err = setupDestinationTags(conf.RestrictedNetworkConfig.DestinationTags); err != nil {
+		log.Fatal(errkind.New(errkind.Config, err))
+	}
 
 	if mgr.config.EnableDNSProxy() {
 		for _, bindAddress := range mgr.config.DNSProxyConfig.BindAddresses {
@@ -156,53 +536,254 @@ func RunAudit(ctx context.Context, wg *sync.WaitGroup, conf *config.Config) erro
 				log.Info(fmt.Sprintf("Launching the DNS Proxy %s...", bindAddress))
 				err := mgr.StartDNSServer(bindAddress)
 				if err != nil {
-					log.Fatal(err)
+					log.Fatal(errkind.New(errkind.Runtime, err))
 				}
 			}(bindAddress)
 		}
+		go mgr.expireWildcards()
 	} else {
 		log.Info("Start async DNS Resolver...")
 		mgr.AsyncResolve()
 	}
+	metrics.Handle(DNS_REFRESH_PATH, dnsRefreshStatus{mgr: mgr})
 
-	if err = mgr.Attach(); err != nil {
-		log.Fatal(err)
+	exemption := timer.Begin(STARTUP_PHASE_SELF_EXEMPTION)
+	err = mgr.exemptSelf(resolver.Servers())
+	exemption.End(err)
+	if err != nil {
+		log.Error(fmt.Errorf("failed to exempt the endpoints of bouheki: %w", err))
+	}
+	metrics.Handle(SELF_EXEMPTION_PATH, selfExemptionStatus{mgr: mgr})
+	// The control socket adds and removes the runtime rules once the rules of the config are written.
+	control.SetRules(controlRules{mgr: mgr})
+	defer control.SetRules(nil)
+
+	attach := timer.Begin(STARTUP_PHASE_ATTACH)
+	err = mgr.Attach()
+	attach.End(err)
+	if err != nil {
+		log.Fatal(utils.ClassifyBPFError(err))
 	}
+	mgr.AsyncRuleSets(ctx)
+	mgr.AsyncUnclaimedSweep(ctx)
+	mgr.AsyncClassification()
+	mgr.AsyncSelfExemption()
+	mgr.AsyncRuntimeRules()
+	mgr.AsyncTaskMapSweep()
+	mgr.AsyncExePathSeed()
 
 	log.Info("Start the network audit.")
+	if !mgr.AuditEnabled() {
+		log.Info("network.audit.enabled is false: the connections are restricted without audit events.")
+	}
 	eventsChannel := make(chan []byte)
-	mgr.Start(eventsChannel)
+	if err = mgr.Start(eventsChannel); err != nil {
+		log.Fatal(errkind.Default(errkind.BPFLoad, err))
+	}
+	startupTiming := timer.End()
+	reportStartupTiming(startupTiming)
+	metrics.Handle(AUDIT_PATH, auditStatus{mgr: mgr})
+
+	var v *verifier
+	if conf.RestrictedNetworkConfig.Verification.Enable {
+		log.Info(fmt.Sprintf("Verifying %v of kernel decisions against the userspace policy.", conf.RestrictedNetworkConfig.Verification.SampleRate))
+		v = newVerifier(mgr.Policy(), conf.RestrictedNetworkConfig.Verification)
+	}
 
-	go func() {
-		for {
-			eventBytes := <-eventsChannel
-			header, body, err := parseEvent(eventBytes)
-			if err != nil {
-				if err == io.EOF {
-					return
-				}
+	var cov *coverage
+	if conf.RestrictedNetworkConfig.Coverage.Enable {
+		if conf.IsRestrictedMode("network") {
+			log.Warn("The allowlist coverage only counts the connections that are reported, which are only the denied ones in block mode.")
+		}
+		cov = newCoverage(mgr.Policy(), conf.RestrictedNetworkConfig.Coverage)
+		metrics.Handle(COVERAGE_PATH, cov)
+		go cov.run(ctx)
+	}
+	metrics.Handle(STATE_PATH, stateDocument{mgr: mgr, resources: resources, reloads: reloads, coverage: cov})
 
-				log.Error(err)
-				continue
-			}
+	var denials *denialRecorder
+	if conf.RestrictedNetworkConfig.DenialRecords.Enable {
+		denials = newDenialRecorder(mgr.Policy(), conf.RestrictedNetworkConfig.DenialRecords)
+		if err := denials.prepare(); err != nil {
+			log.Fatal(errkind.New(errkind.Preflight, err))
+		}
+		go denials.run(ctx)
+	}
+
+	var history *outcomeHistory
+	if conf.RestrictedNetworkConfig.OutcomeHistory.Enable {
+		history = newOutcomeHistory(mgr.Policy(), conf.RestrictedNetworkConfig.OutcomeHistory)
+		if err := history.load(); err != nil {
+			log.Error(fmt.Errorf("the outcome history of the last run is not continued: %w", err))
+		}
+		go history.run(ctx)
+	}
+
+	var learning *learningRecorder
+	if conf.RestrictedNetworkConfig.Mode == config.MODE_LEARNING {
+		log.Info(fmt.Sprintf("Learning the connections in %s.", LearnedConnectionsPath(conf.RestrictedNetworkConfig.Learning.StateDir)))
+		learning = newLearningRecorder(conf.RestrictedNetworkConfig.Learning)
+		if err := learning.load(); err != nil {
+			log.Error(fmt.Errorf("the connections learned by the last run are not continued: %w", err))
+		}
+		go learning.run(ctx)
+	}
+
+	var ruleHits *ruleHitRecorder
+	if conf.RestrictedNetworkConfig.RuleHits.Enable {
+		ruleHits = newRuleHitRecorder(mgr, conf.RestrictedNetworkConfig.RuleHits)
+		if err := ruleHits.load(); err != nil {
+			log.Error(fmt.Errorf("the last hits of the rules of the last run are not continued: %w", err))
+		}
+		mgr.ruleHits = ruleHits
+		go ruleHits.run(ctx)
+	}
+
+	var dedup *eventDedup
+	if conf.RestrictedNetworkConfig.Audit.Dedup.Enable {
+		dedup = newEventDedup(conf.RestrictedNetworkConfig.Audit.Dedup, mgr.clk(), logEvent)
+		go dedup.run(ctx)
+	}
 
-			auditLog := newAuditLog(header, body)
-			auditLog.Info()
+	drops := newDropReporter(mgr)
+	go drops.run(ctx)
+
+	consumed := make(chan struct{})
+	go func() {
+		defer close(consumed)
+		for eventBytes := range eventsChannel {
+			handleEvent(eventBytes, mgr.PolicyDigest(), mgr.Policy(), mgr.matchedRule, dedup, v, cov, denials, history, learning, mgr.healer)
+			mgr.Ack()
 		}
 	}()
 
 	<-ctx.Done()
-	mgr.Close()
+	drops.report()
+
+	// Every event emitted before the shutdown is reported before the ring buffer is closed.
+	report := mgr.Drain(conf.RestrictedNetworkConfig.Shutdown.DrainTimeout)
+	<-consumed
+	if dedup != nil {
+		dedup.flush()
+	}
+	if denials != nil {
+		denials.flush()
+	}
+	if history != nil {
+		history.flush()
+	}
+	if learning != nil {
+		learning.flush()
+	}
+	if ruleHits != nil {
+		ruleHits.flush()
+	}
+	if err := log.Flush(); err != nil {
+		log.Error(fmt.Errorf("failed to flush the log: %w", err))
+	}
+	shutdownLog := log.ShutdownLog{
+		Audit:       "network",
+		Submitted:   report.Submitted,
+		Drained:     report.Drained,
+		Lost:        report.Lost(),
+		Dropped:     report.Dropped,
+		Suppressed:  report.Suppressed,
+		DeadlineHit: report.DeadlineHit,
+		Duration:    report.Duration,
+		Startup:     startupTiming.Total,
+	}
+	if slowest, ok := startupTiming.Slowest(); ok {
+		shutdownLog.StartupSlowest = slowest.Name
+	}
+	shutdownLog.Info()
 	log.Info("Terminated the network audit.")
 
 	return nil
 }
 
+// handleEvent reports the event, stamped with policyDigest. It is the digest of the policy when
+// the event is read: a change written after the decision and before the read is already in it.
+// The pattern of the command lists the comm matched, and the entry of network.policies that
+// selected the task, are named by policy, as the programs do not report them. The rule the
+// programs report denied the connection is described by matchedRule. The events dedup
+// suppresses are only left out of the log and the outputs.
+func handleEvent(eventBytes []byte, policyDigest string, policy *Policy, matchedRule func(rule uint8, conn Connection) string, dedup *eventDedup, v *verifier, cov *coverage, denials *denialRecorder, history *outcomeHistory, learning *learningRecorder, healer *dnsHealer) {
+	header, body, err := parseEvent(eventBytes)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	auditLog := newAuditLog(header, body)
+	auditLog.PolicyDigest = policyDigest
+	containers.Enrich(&auditLog.AuditEventLog)
+	if policy != nil && body.Operation() != OPERATION_BIND {
+		auditLog.CommandPattern = policy.CommandPattern(auditLog.Comm)
+		if header.hasSubject() {
+			auditLog.PolicyEntry = policy.PolicyEntry(Connection{Command: auditLog.Comm, UID: header.UID, GID: header.GID, InContainer: body.InContainer()})
+		}
+	}
+	if matchedRule != nil {
+		auditLog.Rule = matchedRule(body.MatchedRule(), eventToConnection(header, body))
+	}
+	alert.Observe(alertEvent(auditLog))
+	if dedup == nil || dedup.admit(auditLog) {
+		logEvent(auditLog)
+	}
+
+	// The checks below are made by the policy of the connections.
+	if body.Operation() == OPERATION_BIND {
+		return
+	}
+	if v != nil && header.hasSubject() {
+		v.verify(header, body)
+	}
+	if cov != nil {
+		cov.observe(header, body)
+	}
+	if denials != nil && header.hasSubject() {
+		denials.record(header, body)
+	}
+	if history != nil {
+		history.observe(header, body)
+	}
+	if learning != nil && header.hasSubject() {
+		learning.observe(header, body)
+	}
+	if healer != nil {
+		healer.observe(header, body)
+	}
+}
+
+// logEvent writes networkLog to the log and to the outputs of the events.
+func logEvent(networkLog log.RestrictedNetworkLog) {
+	networkLog.Info()
+	match := alertEvent(networkLog)
+	eventpipe.Write(match, networkLog)
+	falco.Write(match, networkLog)
+	auditoutput.Write(match, networkLog)
+}
+
+// alertEvent returns the fields of networkLog the alert rules and the event output filter match.
+func alertEvent(networkLog log.RestrictedNetworkLog) alert.Event {
+	return alert.Event{
+		Audit:           config.ALERT_AUDIT_NETWORK,
+		Action:          networkLog.Action,
+		Comm:            networkLog.Comm,
+		LocalAddr:       net.ParseIP(networkLog.LocalAddr),
+		LocalPort:       networkLog.LocalPort,
+		Unbound:         networkLog.Unbound,
+		DestinationTags: networkLog.DestinationTags,
+	}
+}
+
 func newAuditLog(header eventHeader, body detectEvent) log.RestrictedNetworkLog {
 	var (
-		addr     string
-		port     uint16
-		socktype uint8
+		addr      string
+		port      uint16
+		socktype  uint8
+		localAddr net.IP
+		localPort uint16
 	)
 
 	if header.EventType == BLOCKED_IPV6 {
@@ -210,11 +791,20 @@ func newAuditLog(header eventHeader, body detectEvent) log.RestrictedNetworkLog
 		port = body.DstPort
 		addr = net.ParseIP(byte2IPv6(body.DstIP)).String()
 		socktype = body.SockType
+		localAddr, localPort = net.IP(body.SrcIP[:]), body.SrcPort
 	} else {
 		body := body.(detectEventIPv4)
 		port = body.DstPort
 		addr = byte2IPv4(body.DstIP)
 		socktype = body.SockType
+		localAddr, localPort = net.IPv4(body.SrcIP[0], body.SrcIP[1], body.SrcIP[2], body.SrcIP[3]), body.SrcPort
+	}
+
+	// A bind has no destination: the address and the port it binds to are the ones of the socket.
+	operation := body.Operation()
+	if operation == OPERATION_BIND {
+		localAddr, localPort = net.ParseIP(addr), port
+		addr, port = "", 0
 	}
 
 	auditEvent := log.AuditEventLog{
@@ -223,67 +813,35 @@ func newAuditLog(header eventHeader, body detectEvent) log.RestrictedNetworkLog
 		PID:        header.PID,
 		Comm:       helpers.CommToString(header.Command),
 		ParentComm: helpers.CommToString(header.ParentCommand),
+		CgroupID:   header.CGroupID,
 	}
 
 	networkLog := log.RestrictedNetworkLog{
-		AuditEventLog: auditEvent,
-		Addr:          addr,
-		Domain:        dnsCache[addr],
-		Port:          port,
-		Protocol:      sockTypeToProtocolName(socktype),
+		AuditEventLog:   auditEvent,
+		EventVersion:    log.NETWORK_EVENT_VERSION,
+		Operation:       operation,
+		Addr:            addr,
+		Domain:          dnsCache[addr],
+		Port:            port,
+		Protocol:        sockTypeToProtocolName(socktype),
+		LocalPort:       localPort,
+		DestinationTags: destinationTags.tags(addr),
+		Self:            ownProcess.owns(header),
+		MonitorRule:     body.MonitorRule(),
+		UID:             header.UID,
+		GID:             header.GID,
 	}
-
-	return networkLog
-}
-
-func parseEvent(eventBytes []byte) (eventHeader, detectEvent, error) {
-	buf := bytes.NewBuffer(eventBytes)
-	header, err := parseEventHeader(buf)
-	if err != nil {
-		return eventHeader{}, detectEventIPv4{}, err
+	// An unbound socket has neither an address nor a port. Without the port, the events before
+	// schema version 5 do not tell it apart from a socket bound to a port of any address.
+	switch {
+	case !localAddr.IsUnspecified() || localPort != 0:
+		networkLog.LocalAddr = localAddr.String()
+	case header.SchemaVersion >= 5:
+		networkLog.Unbound = true
 	}
-	if header.EventType == BLOCKED_IPV4 {
-		body, err := parseEventBlockedIPv4(buf)
-		if err != nil {
-			return eventHeader{}, detectEventIPv4{}, err
-		}
-
-		return header, body, nil
-	} else if header.EventType == BLOCKED_IPV6 {
-		body, err := parseEventBlockedIPv6(buf)
-		if err != nil {
-			return eventHeader{}, detectEventIPv6{}, err
-		}
-
-		return header, body, nil
-	} else {
-		return eventHeader{}, detectEventIPv4{}, err
+	if header.MatchedCgroupID != 0 {
+		networkLog.ContainerCgroup = classifiedCgroups.name(header.MatchedCgroupID)
 	}
-}
 
-func parseEventHeader(buf *bytes.Buffer) (eventHeader, error) {
-	var header eventHeader
-	err := binary.Read(buf, binary.LittleEndian, &header)
-	if err != nil {
-		return eventHeader{}, err
-	}
-	return header, nil
-}
-
-func parseEventBlockedIPv4(buf *bytes.Buffer) (detectEventIPv4, error) {
-	var body detectEventIPv4
-	if err := binary.Read(buf, binary.LittleEndian, &body); err != nil {
-		return detectEventIPv4{}, err
-	}
-
-	return body, nil
-}
-
-func parseEventBlockedIPv6(buf *bytes.Buffer) (detectEventIPv6, error) {
-	var body detectEventIPv6
-	if err := binary.Read(buf, binary.LittleEndian, &body); err != nil {
-		return detectEventIPv6{}, err
-	}
-
-	return body, nil
+	return networkLog
 }
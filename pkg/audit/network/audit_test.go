@@ -4,24 +4,31 @@
 package network
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"os"
 	"os/exec"
 	"os/signal"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/mrtc0/bouheki/pkg/audit/helpers"
 	"github.com/mrtc0/bouheki/pkg/config"
+	log "github.com/mrtc0/bouheki/pkg/log"
 	"github.com/stretchr/testify/assert"
 )
 
 type TestAuditManager struct {
-	manager Manager
+	manager *Manager
 	cmd     *exec.Cmd
 }
 
@@ -341,6 +348,29 @@ func TestAuditBlockModeV6(t *testing.T) {
 	auditManager.manager.mod.Close()
 }
 
+func TestAuditBlockModeDualStack(t *testing.T) {
+	fixture := "../../../testdata/block_dual_stack.yml"
+	eventsChannel := make(chan []byte)
+	auditManager := runAuditWithOnce(fixture, []string{"curl", "-6", "http://[2001:3984:3989::3]"}, eventsChannel)
+
+	eventBytes := <-eventsChannel
+	header, rawBody, err := parseEvent(eventBytes)
+	assert.Nil(t, err)
+	assert.Equal(t, BLOCKED_IPV6, header.EventType)
+	assert.Equal(t, ACTION_BLOCKED_STRING, rawBody.ActionResult())
+
+	go func() {
+		for range eventsChannel {
+		}
+	}()
+
+	assert.NotNil(t, exec.Command("curl", "http://10.254.249.3").Run())
+	assert.Nil(t, exec.Command("curl", "http://10.254.249.4").Run())
+	assert.Nil(t, exec.Command("curl", "-6", "http://[2001:3984:3989::4]").Run())
+
+	auditManager.manager.mod.Close()
+}
+
 func TestAuditMonitorModeV4(t *testing.T) {
 	fixture := "../../../testdata/monitor_v4.yml"
 	eventsChannel := make(chan []byte)
@@ -380,6 +410,68 @@ func TestAuditMonitorModeV6(t *testing.T) {
 	auditManager.manager.mod.Close()
 }
 
+func runFallbackAuditWithOnce(configPath string, sendSignal bool, execCmd []string, eventsChannel chan []byte) (TestAuditManager, error) {
+	conf := loadFixtureConfig(configPath)
+	conf.RestrictedNetworkConfig.Enforcement.Hook = config.HOOK_KPROBE
+	conf.RestrictedNetworkConfig.Enforcement.SendSignal = sendSignal
+	mgr := createManager(conf, &SpyIntegrationDNSResolver{})
+	if err := mgr.Attach(); err != nil {
+		panic(err)
+	}
+
+	mgr.Start(eventsChannel)
+
+	cmd := exec.Command(execCmd[0], execCmd[1:]...)
+	err := cmd.Run()
+
+	return TestAuditManager{manager: mgr, cmd: cmd}, err
+}
+
+func TestAuditKprobeFallbackV4(t *testing.T) {
+	fixture := "../../../testdata/block_v4.yml"
+	be_blocked_addr := "10.254.249.3"
+	eventsChannel := make(chan []byte)
+	auditManager, err := runFallbackAuditWithOnce(fixture, false, []string{"curl", fmt.Sprintf("http://%s", be_blocked_addr)}, eventsChannel)
+
+	// The kprobe can not deny the connection, so it is only reported.
+	assert.Nil(t, err)
+	assert.Equal(t, ENFORCEMENT_KPROBE_MONITOR, auditManager.manager.Enforcement())
+
+	eventBytes := <-eventsChannel
+	header, rawBody, err := parseEvent(eventBytes)
+	assert.Nil(t, err)
+
+	body := rawBody.(detectEventIPv4)
+	assert.Equal(t, ACTION_MONITOR_STRING, body.ActionResult())
+	assert.Equal(t, LSM_HOOK_POINT_CONNECT_KPROBE, body.LsmHookPoint)
+	assert.Equal(t, VERDICT_DENY, body.Verdict)
+	assert.Equal(t, auditManager.cmd.Process.Pid, int(header.PID))
+	assert.Equal(t, be_blocked_addr, byte2IPv4(body.DstIP))
+
+	auditManager.manager.mod.Close()
+}
+
+func TestAuditKprobeFallbackWithSignalV4(t *testing.T) {
+	fixture := "../../../testdata/block_v4.yml"
+	be_blocked_addr := "10.254.249.3"
+	eventsChannel := make(chan []byte)
+	auditManager, err := runFallbackAuditWithOnce(fixture, true, []string{"curl", fmt.Sprintf("http://%s", be_blocked_addr)}, eventsChannel)
+
+	assert.NotNil(t, err)
+	assert.Equal(t, ENFORCEMENT_KPROBE_SIGNAL, auditManager.manager.Enforcement())
+	assert.Equal(t, "signal: killed", err.Error())
+
+	eventBytes := <-eventsChannel
+	_, rawBody, err := parseEvent(eventBytes)
+	assert.Nil(t, err)
+
+	body := rawBody.(detectEventIPv4)
+	assert.Equal(t, ACTION_BLOCKED_STRING, body.ActionResult())
+	assert.Equal(t, LSM_HOOK_POINT_CONNECT_KPROBE, body.LsmHookPoint)
+
+	auditManager.manager.mod.Close()
+}
+
 func TestCanCommunicateWithRestrictedCommand(t *testing.T) {
 	fixture := "../../../testdata/command_allow.yml"
 	config := loadFixtureConfig(fixture)
@@ -417,6 +509,60 @@ func TestRestrictedCommand(t *testing.T) {
 	mgr.mod.Close()
 }
 
+// copyCurl copies curl to a binary named name, so that its comm is name.
+func copyCurl(t *testing.T, name string) string {
+	path, err := exec.LookPath("curl")
+	assert.Nil(t, err)
+
+	buf, err := os.ReadFile(path)
+	assert.Nil(t, err)
+
+	dst := filepath.Join(t.TempDir(), name)
+	assert.Nil(t, os.WriteFile(dst, buf, 0755))
+
+	return dst
+}
+
+func TestRestrictedCommandWithOddNames(t *testing.T) {
+	be_blocked_addr := "10.254.249.3"
+	tests := []struct {
+		name            string
+		binary          string
+		deny            []string
+		caseInsensitive bool
+		blocked         bool
+	}{
+		{name: "trailing whitespace in the config is trimmed", binary: "curl", deny: []string{"curl  "}, blocked: true},
+		{name: "longer than the comm", binary: "very-long-command-name", deny: []string{"very-long-command-name"}, blocked: true},
+		{name: "truncated to the comm", binary: "very-long-command-name", deny: []string{"very-long-comma"}, blocked: true},
+		{name: "different case", binary: "CURL", deny: []string{"curl"}, blocked: false},
+		{name: "different case with case_insensitive", binary: "CURL", deny: []string{"curl"}, caseInsensitive: true, blocked: true},
+		{name: "mixed case with case_insensitive", binary: "cUrL", deny: []string{"CuRl"}, caseInsensitive: true, blocked: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "bouheki.yml")
+			conf := fmt.Sprintf("network:\n  mode: block\n  target: host\n  cidr:\n    allow: [0.0.0.0/0]\n  command:\n    case_insensitive: %v\n    deny: %q\n", test.caseInsensitive, test.deny)
+			assert.Nil(t, os.WriteFile(path, []byte(conf), 0644))
+
+			mgr := createManager(loadFixtureConfig(path), &DefaultResolver{})
+			mgr.Attach()
+			eventsChannel := make(chan []byte, 16)
+			mgr.Start(eventsChannel)
+
+			err := exec.Command(copyCurl(t, test.binary), fmt.Sprintf("http://%s", be_blocked_addr)).Run()
+			if test.blocked {
+				assert.NotNil(t, err)
+			} else {
+				assert.Nil(t, err)
+			}
+
+			mgr.mod.Close()
+		})
+	}
+}
+
 func TestAuditContainerBlock(t *testing.T) {
 	fixture := "../../../testdata/container.yml"
 	eventsChannel := make(chan []byte)
@@ -502,6 +648,77 @@ func TestRunAudit_Conf(t *testing.T) {
 	assert.Nil(t, RunAudit(ctx, &wg, config))
 }
 
+func TestShutdownDrainsEveryEvent(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "bouheki.log")
+	log.SetFormatter("json")
+	log.SetOutput(output)
+	defer log.SetOutput("stdout")
+
+	conf := loadFixtureConfig("../../../testdata/block_v4.yml")
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go RunAudit(ctx, &wg, conf)
+	time.Sleep(2 * time.Second)
+
+	// Connect to the denied address until the audit has terminated, so that events are
+	// still being emitted when the shutdown starts.
+	var blocked int64
+	stopped := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(stopped)
+	}()
+	generated := make(chan struct{})
+	go func() {
+		defer close(generated)
+		for {
+			select {
+			case <-stopped:
+				return
+			default:
+			}
+			_, err := net.DialTimeout("tcp", "10.254.249.3:80", 100*time.Millisecond)
+			if errors.Is(err, syscall.EPERM) {
+				atomic.AddInt64(&blocked, 1)
+			}
+		}
+	}()
+
+	time.Sleep(2 * time.Second)
+	blockedBeforeShutdown := atomic.LoadInt64(&blocked)
+	cancel()
+	<-generated
+
+	f, err := os.Open(output)
+	assert.Nil(t, err)
+	defer f.Close()
+
+	var reported int64
+	var shutdown map[string]interface{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		entry := map[string]interface{}{}
+		if json.Unmarshal(scanner.Bytes(), &entry) != nil {
+			continue
+		}
+		if entry["Audit"] == "network" {
+			shutdown = entry
+		}
+		if entry["Addr"] == "10.254.249.3" && entry["PID"] == float64(os.Getpid()) {
+			reported++
+		}
+	}
+
+	// Every connection denied before the shutdown is in the log, and the ones denied
+	// after the programs were quiesced are counted as suppressed.
+	assert.NotNil(t, shutdown)
+	assert.Equal(t, float64(0), shutdown["Lost"])
+	assert.Equal(t, false, shutdown["DeadlineHit"])
+	assert.GreaterOrEqual(t, reported, blockedBeforeShutdown)
+	assert.Equal(t, atomic.LoadInt64(&blocked), reported+int64(shutdown["Suppressed"].(float64)))
+}
+
 func runAuditWithOnce(configPath string, execCmd []string, eventsChannel chan []byte) TestAuditManager {
 	config := loadFixtureConfig(configPath)
 	mgr := createManager(config, &SpyIntegrationDNSResolver{})
@@ -0,0 +1,87 @@
+package network
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/mrtc0/bouheki/pkg/freeze"
+)
+
+// AUDIT_PATH is where whether the network audit events are enabled is served next to /metrics.
+const AUDIT_PATH = "/audit"
+
+// idleRingBuffer stands for the ring buffer of a Manager started with the audit events disabled.
+// It only closes the events channel, as the ring buffer would have on Stop.
+type idleRingBuffer struct {
+	once   sync.Once
+	events chan []byte
+}
+
+func (i *idleRingBuffer) Start() {}
+
+func (i *idleRingBuffer) Stop() {
+	i.once.Do(func() { close(i.events) })
+}
+
+func (i *idleRingBuffer) Close() {
+	i.Stop()
+}
+
+// AuditEnabled reports whether the programs emit audit events.
+func (m *Manager) AuditEnabled() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return !m.auditDisabled
+}
+
+// SetAuditEnabled turns the audit events of the programs on or off, e.g. when network.audit.enabled
+// is reloaded. Turning them on creates the ring buffer of a Manager started without it, which
+// hands the events to the channel given to Start. The programs stay attached either way.
+func (m *Manager) SetAuditEnabled(enabled bool) error {
+	m.mu.Lock()
+	if idle, ok := m.rb.(*idleRingBuffer); ok && enabled && m.state == stateStarted {
+		rb, err := m.newRingBuffer(idle.events)
+		if err != nil {
+			m.mu.Unlock()
+			return err
+		}
+		rb.Start()
+		// The ring buffer closes the channel from now on.
+		m.rb = rb
+	}
+	m.auditDisabled = !enabled
+	m.mu.Unlock()
+
+	return m.runJob("network.audit.enabled", freeze.CHANGE_CONFIG_RELOAD, func(ctx context.Context) error {
+		return m.applyConfig()
+	})
+}
+
+// AuditStatus is whether the network audit events are enabled.
+type AuditStatus struct {
+	Enabled bool `json:"enabled"`
+	// RingBuffer is set once the ring buffer is polled. It stays set when the events are disabled at runtime.
+	RingBuffer bool `json:"ring_buffer"`
+	// Families are the families that are restricted, and OtherFamilies what is done with the
+	// connections of the others. Both are empty while every family is restricted.
+	Families      []string `json:"families,omitempty"`
+	OtherFamilies string   `json:"other_families,omitempty"`
+}
+
+type auditStatus struct {
+	mgr *Manager
+}
+
+// ServeHTTP writes the AuditStatus as JSON.
+func (s auditStatus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mgr.mu.Lock()
+	_, idle := s.mgr.rb.(*idleRingBuffer)
+	status := familyStatus(AuditStatus{Enabled: !s.mgr.auditDisabled, RingBuffer: s.mgr.rb != nil && !idle}, s.mgr.currentConfig().RestrictedNetworkConfig)
+	s.mgr.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,111 @@
+package network
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mrtc0/bouheki/pkg/bouhekitest"
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func auditDisabledFlag(value []byte) uint32 {
+	return binary.LittleEndian.Uint32(value[MAP_AUDIT_DISABLED_INDEX : MAP_AUDIT_DISABLED_INDEX+4])
+}
+
+func TestAuditDisabledFlagEncoding(t *testing.T) {
+	conf := config.DefaultConfig()
+	assert.Len(t, ConfigMapValue(conf), MAP_SIZE)
+	assert.Equal(t, uint32(0), auditDisabledFlag(ConfigMapValue(conf)))
+
+	conf.RestrictedNetworkConfig.Audit.Enabled = false
+	value := ConfigMapValue(conf)
+	assert.Equal(t, uint32(1), auditDisabledFlag(value))
+	// The other fields are unchanged.
+	assert.Equal(t, uint32(0), binary.LittleEndian.Uint32(value[MAP_QUIESCED_INDEX:MAP_QUIESCED_INDEX+4]))
+	assert.Equal(t, DecodeListSizes(ConfigMapValue(config.DefaultConfig())), DecodeListSizes(value))
+}
+
+// newAuditTestManager returns a Manager whose maps are written to maps, and counts the ring buffers it creates.
+func newAuditTestManager(t *testing.T, enabled bool) (*Manager, *bouhekitest.Maps, *[]*SpyRingBuffer) {
+	conf := stateTestConfig()
+	conf.RestrictedNetworkConfig.Audit.Enabled = enabled
+
+	maps := bouhekitest.NewMaps()
+	mgr, err := NewManager(conf, WithMapBackend(maps), WithDNSResolver(&FakeDNSResolver{}))
+	assert.Nil(t, err)
+	created := []*SpyRingBuffer{}
+	mgr.initRingBuf = func(eventsChannel chan []byte) (ringBuffer, error) {
+		rb := &SpyRingBuffer{eventsChannel: eventsChannel}
+		created = append(created, rb)
+		return rb, nil
+	}
+	assert.Nil(t, mgr.SetConfigToMap())
+	return mgr, maps, &created
+}
+
+func configMapEntry(maps *bouhekitest.Maps) []byte {
+	return maps.Entries(RESTRICT_NETWORK_CONFIG_MAP_NAME)[string([]byte{0})]
+}
+
+func auditStatusOf(t *testing.T, mgr *Manager) AuditStatus {
+	rec := httptest.NewRecorder()
+	auditStatus{mgr: mgr}.ServeHTTP(rec, httptest.NewRequest("GET", AUDIT_PATH, nil))
+	status := AuditStatus{}
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&status))
+	return status
+}
+
+func TestStartWithAuditDisabledSkipsTheRingBuffer(t *testing.T) {
+	mgr, maps, created := newAuditTestManager(t, false)
+	assert.Equal(t, uint32(1), auditDisabledFlag(configMapEntry(maps)))
+
+	eventsChannel := make(chan []byte)
+	assert.Nil(t, mgr.Start(eventsChannel))
+	assert.Len(t, *created, 0)
+	assert.False(t, mgr.AuditEnabled())
+	assert.Equal(t, AuditStatus{}, auditStatusOf(t, mgr))
+
+	// The channel is still closed, as the consumer expects.
+	report := mgr.Drain(0)
+	assert.Equal(t, uint64(0), report.Lost())
+	assertChannelClosed(t, eventsChannel)
+}
+
+func TestEnableAuditAtRuntime(t *testing.T) {
+	mgr, maps, created := newAuditTestManager(t, false)
+	eventsChannel := make(chan []byte)
+	assert.Nil(t, mgr.Start(eventsChannel))
+
+	assert.Nil(t, mgr.SetAuditEnabled(true))
+	assert.Equal(t, uint32(0), auditDisabledFlag(configMapEntry(maps)))
+	assert.Len(t, *created, 1)
+	assert.Equal(t, eventsChannel, (*created)[0].eventsChannel)
+	assert.Equal(t, AuditStatus{Enabled: true, RingBuffer: true}, auditStatusOf(t, mgr))
+
+	// Disabling keeps the ring buffer, enabling again does not create another.
+	assert.Nil(t, mgr.SetAuditEnabled(false))
+	assert.Equal(t, uint32(1), auditDisabledFlag(configMapEntry(maps)))
+	assert.Equal(t, AuditStatus{RingBuffer: true}, auditStatusOf(t, mgr))
+	assert.Nil(t, mgr.SetAuditEnabled(true))
+	assert.Len(t, *created, 1)
+
+	// The ring buffer closes the channel, once.
+	mgr.Close()
+	assert.True(t, (*created)[0].closed)
+	assertChannelClosed(t, eventsChannel)
+}
+
+func TestEnableAuditBeforeStart(t *testing.T) {
+	mgr, maps, created := newAuditTestManager(t, false)
+
+	assert.Nil(t, mgr.SetAuditEnabled(true))
+	assert.Equal(t, uint32(0), auditDisabledFlag(configMapEntry(maps)))
+	assert.Len(t, *created, 0)
+
+	assert.Nil(t, mgr.Start(make(chan []byte)))
+	assert.Len(t, *created, 1)
+	mgr.Close()
+}
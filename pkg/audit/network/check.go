@@ -0,0 +1,167 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/errkind"
+	"github.com/mrtc0/bouheki/pkg/policy"
+)
+
+// The verdicts of a CheckResult.
+const (
+	CHECK_ALLOW = "ALLOW"
+	CHECK_BLOCK = "BLOCK"
+	// CHECK_AUDIT is a connection the policy denies, which monitor mode reports but does not refuse,
+	// or one only a deny entry in mode: monitor denies, which is reported whatever the mode.
+	CHECK_AUDIT = "AUDIT"
+)
+
+// checkLists are the lists the entries a connection matched are looked up in, see CheckResult.Matched.
+var checkLists = []uint32{
+	RULE_LIST_ALLOWED_CIDR,
+	RULE_LIST_DENIED_CIDR,
+	RULE_LIST_ALLOWED_COMMAND,
+	RULE_LIST_DENIED_COMMAND,
+	RULE_LIST_ALLOWED_UID,
+	RULE_LIST_DENIED_UID,
+	RULE_LIST_ALLOWED_GID,
+	RULE_LIST_DENIED_GID,
+	RULE_LIST_ALLOWED_PORT,
+	RULE_LIST_DENIED_PORT,
+}
+
+// CheckInput is a connection `bouheki check` evaluates without making it.
+type CheckInput struct {
+	// Destination is an address, or a domain that is resolved to its addresses.
+	Destination string
+	Port        uint16
+	// Protocol is tcp or udp.
+	Protocol    string
+	UID         uint32
+	GID         uint32
+	Command     string
+	ExePath     string
+	InContainer bool
+}
+
+// CheckResult is the decision for the connection of a CheckInput to an address of its destination.
+type CheckResult struct {
+	Addr    net.IP
+	Verdict string
+	// Rule names the rule that denied the connection, as the events do. It is empty when the
+	// connection is permitted.
+	Rule string
+	// Matched are the entries of the allow and deny lists of the config the connection is in,
+	// whether or not they decided it, e.g. "network.domain.allow example.com → 93.184.216.34".
+	Matched []string
+	Trace   []policy.TraceStep
+}
+
+// Check evaluates in against the rules of conf, without loading the programs: the rules are
+// written, as the Manager writes them, to maps that are only mirrored in its Policy, and every
+// address of the destination is decided by it, see Policy.Trace. The domains of conf, and the
+// destination when it is a domain, are resolved with resolver. The rule sets, the self exemption
+// and the runtime rules are not part of the rules.
+func Check(conf *config.Config, resolver DNSResolver, in CheckInput) ([]CheckResult, error) {
+	if in.Protocol != config.PROTOCOL_TCP && in.Protocol != config.PROTOCOL_UDP {
+		return nil, errkind.Errorf(errkind.Config, "the protocol is %s or %s, not %q", config.PROTOCOL_TCP, config.PROTOCOL_UDP, in.Protocol)
+	}
+
+	mgr, err := NewManager(conf, WithMapBackend(discardMaps{}), WithDNSResolver(resolver))
+	if err != nil {
+		return nil, err
+	}
+	defer mgr.Close()
+	if err := mgr.applyConfig(); err != nil {
+		return nil, err
+	}
+	if err := mgr.initDomainList(nil); err != nil {
+		return nil, err
+	}
+
+	addrs, err := mgr.checkAddresses(in.Destination)
+	if err != nil {
+		return nil, err
+	}
+	results := []CheckResult{}
+	for _, addr := range addrs {
+		conn := Connection{
+			Addr:        addr,
+			Port:        in.Port,
+			SockType:    protocolSockType(in.Protocol),
+			Command:     in.Command,
+			ExePath:     in.ExePath,
+			UID:         in.UID,
+			GID:         in.GID,
+			InContainer: in.InContainer,
+		}
+		decision, steps := mgr.Policy().Trace(conn)
+		result := CheckResult{Addr: addr, Verdict: CHECK_ALLOW, Rule: decision.Rule, Matched: mgr.matchedEntries(conn), Trace: steps}
+		switch {
+		case decision.Blocked:
+			result.Verdict = CHECK_BLOCK
+		case decision.Denied, decision.Monitored:
+			result.Verdict = CHECK_AUDIT
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// checkAddresses returns destination if it is an address, or the addresses it resolves to. The
+// answers are also written to the lists of the wildcard domains the name is below, as the DNS
+// proxy writes the answers it relays.
+func (m *Manager) checkAddresses(destination string) ([]net.IP, error) {
+	if ip := net.ParseIP(destination); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	addrs := []net.IP{}
+	for _, resolve := range []func(domain string) (*DNSAnswer, error){m.ResolveAddressv4, m.ResolveAddressv6} {
+		answer, err := resolve(destination)
+		if err != nil {
+			continue
+		}
+		if err := m.updateWildcardDomains(answer); err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, answer.Addresses...)
+	}
+	if len(addrs) == 0 {
+		return nil, errkind.Errorf(errkind.Runtime, "%s does not resolve to an address", destination)
+	}
+	return addrs, nil
+}
+
+// matchedEntries describes the entries of checkLists conn is in. The entries of the protocol
+// lists of another protocol than the one of conn are left out.
+func (m *Manager) matchedEntries(conn Connection) []string {
+	caseInsensitive := m.currentConfig().RestrictedNetworkConfig.Command.CaseInsensitive
+	protocol := fmt.Sprintf("[%s]", ruleProtocol(conn.SockType))
+	matched := []string{}
+	for _, list := range checkLists {
+		for _, id := range m.ruleTable().rules(matchedRuleKey(list, conn, caseInsensitive)) {
+			if strings.Contains(id.list, "[") && !strings.Contains(id.list, protocol) {
+				continue
+			}
+			entry := id.list + " " + id.entry
+			if strings.HasPrefix(id.list, "network.domain.") {
+				entry += " → " + conn.Addr.String()
+			}
+			matched = append(matched, entry)
+		}
+	}
+	sort.Strings(matched)
+	return matched
+}
+
+// discardMaps is the MapBackend of Check, whose writes are only mirrored in the Policy.
+type discardMaps struct{}
+
+func (discardMaps) Update(mapName string, key, value []byte) error { return nil }
+
+func (discardMaps) Delete(mapName string, key []byte) error { return nil }
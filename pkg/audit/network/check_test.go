@@ -0,0 +1,110 @@
+package network
+
+import (
+	"net"
+	"testing"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/errkind"
+	"github.com/stretchr/testify/assert"
+)
+
+func checkTestConfig() *config.Config {
+	conf := config.DefaultConfig()
+	conf.RestrictedNetworkConfig.Mode = "block"
+	conf.RestrictedNetworkConfig.CIDR.Allow = []string{"10.0.0.0/8"}
+	conf.RestrictedNetworkConfig.CIDR.Deny = []string{"10.1.0.0/16"}
+	conf.RestrictedNetworkConfig.Domain.Allow = []string{"example.com", "*.cdn.example.net"}
+	conf.RestrictedNetworkConfig.UID.Deny = []string{"1001"}
+	return conf
+}
+
+func TestCheck(t *testing.T) {
+	resolver := &scriptedResolver{script: map[string][][]string{
+		"example.com":         {{"93.184.216.34", "2001:db8::34"}},
+		"img.cdn.example.net": {{"151.101.1.69"}},
+	}}
+	conf := checkTestConfig()
+	in := CheckInput{Destination: "10.2.3.4", Port: 443, Protocol: config.PROTOCOL_TCP, UID: 1000, GID: 1000, Command: "curl"}
+
+	results, err := Check(conf, resolver, in)
+	assert.Nil(t, err)
+	assert.Len(t, results, 1)
+	assert.Equal(t, CHECK_ALLOW, results[0].Verdict)
+	assert.Equal(t, []string{"network.cidr.allow 10.0.0.0/8"}, results[0].Matched)
+	assert.NotEmpty(t, results[0].Trace)
+
+	// A deny list is named by the rule, as in the events.
+	in.Destination = "10.1.2.3"
+	results, err = Check(conf, resolver, in)
+	assert.Nil(t, err)
+	assert.Equal(t, CHECK_BLOCK, results[0].Verdict)
+	assert.Equal(t, "network.cidr.deny 10.1.0.0/16", results[0].Rule)
+	assert.Equal(t, []string{"network.cidr.allow 10.0.0.0/8", "network.cidr.deny 10.1.0.0/16"}, results[0].Matched)
+
+	// A domain is decided for each of its addresses, as the domains of the config resolve.
+	in.Destination = "example.com"
+	results, err = Check(conf, resolver, in)
+	assert.Nil(t, err)
+	assert.Len(t, results, 2)
+	assert.Equal(t, net.ParseIP("93.184.216.34").String(), results[0].Addr.String())
+	assert.Equal(t, CHECK_ALLOW, results[0].Verdict)
+	assert.Equal(t, []string{"network.domain.allow example.com → 93.184.216.34"}, results[0].Matched)
+	assert.Equal(t, CHECK_ALLOW, results[1].Verdict)
+
+	// The answer for a name below a wildcard domain is written as the DNS proxy writes it.
+	in.Destination = "img.cdn.example.net"
+	results, err = Check(conf, resolver, in)
+	assert.Nil(t, err)
+	assert.Equal(t, CHECK_ALLOW, results[0].Verdict)
+	assert.Equal(t, []string{"network.domain.allow *.cdn.example.net → 151.101.1.69"}, results[0].Matched)
+
+	in.Destination, in.UID = "10.2.3.4", 1001
+	results, err = Check(conf, resolver, in)
+	assert.Nil(t, err)
+	assert.Equal(t, CHECK_BLOCK, results[0].Verdict)
+	assert.Equal(t, "network.uid.deny 1001", results[0].Rule)
+
+	// Monitor mode reports what it would block.
+	conf.RestrictedNetworkConfig.Mode = "monitor"
+	results, err = Check(conf, resolver, in)
+	assert.Nil(t, err)
+	assert.Equal(t, CHECK_AUDIT, results[0].Verdict)
+
+	in.Destination = "unknown.example.org"
+	_, err = Check(conf, resolver, in)
+	assert.Equal(t, errkind.Runtime, errkind.KindOf(err))
+	in.Destination, in.Protocol = "10.2.3.4", "icmp"
+	_, err = Check(conf, resolver, in)
+	assert.Equal(t, errkind.Config, errkind.KindOf(err))
+}
+
+func TestCheckMonitoredEntries(t *testing.T) {
+	resolver := &scriptedResolver{script: map[string][][]string{
+		"evil.example.org": {{"203.0.113.5"}},
+	}}
+	conf := checkTestConfig()
+	conf.RestrictedNetworkConfig.CIDR.Allow = []string{"0.0.0.0/0"}
+	conf.RestrictedNetworkConfig.CIDR.Monitor = []string{"10.1.0.0/16"}
+	conf.RestrictedNetworkConfig.Domain.Allow = []string{}
+	conf.RestrictedNetworkConfig.Domain.Deny = []string{"evil.example.org"}
+	conf.RestrictedNetworkConfig.Domain.Monitor = []string{"evil.example.org"}
+	in := CheckInput{Destination: "10.1.2.3", Port: 443, Protocol: config.PROTOCOL_TCP, UID: 1000, GID: 1000, Command: "curl"}
+
+	// A deny entry in mode: monitor reports the connection in block mode.
+	results, err := Check(conf, resolver, in)
+	assert.Nil(t, err)
+	assert.Equal(t, CHECK_AUDIT, results[0].Verdict)
+	assert.Equal(t, "network.cidr.deny 10.1.0.0/16", results[0].Rule)
+
+	in.Destination = "evil.example.org"
+	results, err = Check(conf, resolver, in)
+	assert.Nil(t, err)
+	assert.Equal(t, CHECK_AUDIT, results[0].Verdict)
+
+	// The uid deny list is not in mode: monitor.
+	in.UID = 1001
+	results, err = Check(conf, resolver, in)
+	assert.Nil(t, err)
+	assert.Equal(t, CHECK_BLOCK, results[0].Verdict)
+}
@@ -0,0 +1,324 @@
+package network
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/mrtc0/bouheki/pkg/classify"
+	"github.com/mrtc0/bouheki/pkg/errkind"
+	"github.com/mrtc0/bouheki/pkg/jobs"
+	log "github.com/mrtc0/bouheki/pkg/log"
+	"github.com/mrtc0/bouheki/pkg/metrics"
+)
+
+var missingCgroupsGauge = metrics.NewGauge("network_classification_missing_cgroups", "The cgroups of network.classification.cgroups that do not exist, which are looked up again by every rescan.")
+
+// classifiedCgroups is used by newAuditLog, like dnsCache.
+var classifiedCgroups = &cgroupRegistry{paths: map[uint64]string{}}
+
+// cgroupRegistry is the path of the cgroups written to CONTAINER_CGROUP_LIST_MAP_NAME, by id.
+type cgroupRegistry struct {
+	mu    sync.RWMutex
+	paths map[uint64]string
+}
+
+func (r *cgroupRegistry) replace(ids map[uint64]string) {
+	paths := make(map[uint64]string, len(ids))
+	for id, path := range ids {
+		paths[id] = path
+	}
+
+	r.mu.Lock()
+	r.paths = paths
+	r.mu.Unlock()
+}
+
+func (r *cgroupRegistry) snapshot() map[uint64]string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	ids := make(map[uint64]string, len(r.paths))
+	for id, path := range r.paths {
+		ids[id] = path
+	}
+	return ids
+}
+
+// name returns the path of the cgroup id, or the id if the cgroup has already been removed.
+func (r *cgroupRegistry) name(id uint64) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if path, ok := r.paths[id]; ok {
+		return path
+	}
+	return fmt.Sprintf("cgroup id %d", id)
+}
+
+func (m *Manager) classifier() (*classify.Classifier, error) {
+	c, err := classify.New(m.config.RestrictedNetworkConfig.Classification)
+	if err != nil {
+		return nil, errkind.Errorf(errkind.Config, "network.classification: %w", err)
+	}
+	return c, nil
+}
+
+// usesCgroups reports whether the program looks up CONTAINER_CGROUP_LIST_MAP_NAME.
+func (m *Manager) usesCgroups() bool {
+	c, err := m.classifier()
+	return err == nil && c.UsesCgroups() && m.config.ClassifiesContainers("network")
+}
+
+// cgroupRootPath returns where the cgroup v2 hierarchy is mounted, see classify.UnifiedRoot.
+func (m *Manager) cgroupRootPath() (string, error) {
+	if m.cgroupRoot != "" {
+		return m.cgroupRoot, nil
+	}
+	return classify.UnifiedRoot(classify.CGROUP_ROOT)
+}
+
+// containerCgroupIDs returns the cgroups classified as containers, by id. It is empty unless
+// the target is container and the strategy uses cgroups. When the programs match the ancestors,
+// only the topmost ones are returned.
+func (m *Manager) containerCgroupIDs() (map[uint64]string, error) {
+	c, err := m.classifier()
+	if err != nil {
+		return nil, err
+	}
+
+	if !c.UsesCgroups() || !m.config.ClassifiesContainers("network") {
+		return map[uint64]string{}, nil
+	}
+
+	root, err := m.cgroupRootPath()
+	if err != nil {
+		return nil, errkind.Errorf(errkind.Preflight, "network.classification.strategy: %s: %w", c.Strategy(), err)
+	}
+	ids, err := c.CgroupIDs(root)
+	if err != nil {
+		return nil, errkind.New(errkind.Preflight, err)
+	}
+	m.reportMissingCgroups(c, c.MissingCgroups(root))
+	if m.ancestors {
+		ids = c.Roots(ids)
+	}
+	return ids, nil
+}
+
+// containerCgroups returns the entries of CONTAINER_CGROUP_LIST_MAP_NAME for containerCgroupIDs.
+func (m *Manager) containerCgroups() (map[string][]byte, error) {
+	ids, err := m.containerCgroupIDs()
+	if err != nil {
+		return nil, err
+	}
+	return cgroupEntries(ids), nil
+}
+
+// cgroupEntries returns the entries of CONTAINER_CGROUP_LIST_MAP_NAME for ids, and records
+// their path for the audit log.
+func cgroupEntries(ids map[uint64]string) map[string][]byte {
+	classifiedCgroups.replace(ids)
+
+	entries := map[string][]byte{}
+	for id := range ids {
+		key := make([]byte, 8)
+		binary.LittleEndian.PutUint64(key, id)
+		entries[string(key)] = entryValue()
+	}
+	return entries
+}
+
+// rescanCgroups writes the cgroups of the containers started or stopped since the last scan.
+func (m *Manager) rescanCgroups() error {
+	ids, err := m.containerCgroupIDs()
+	if err != nil {
+		return err
+	}
+	return m.writeCgroups(ids)
+}
+
+// writeCgroups writes ids to CONTAINER_CGROUP_LIST_MAP_NAME.
+// Only CONTAINER_CGROUP_LIST_MAP_NAME is written; the rest of what was loaded is kept as is.
+func (m *Manager) writeCgroups(ids map[uint64]string) error {
+	cgroups := cgroupEntries(ids)
+
+	m.loadedMu.Lock()
+	desired := mapState{}
+	for mapName, entries := range m.loaded {
+		for key, value := range entries {
+			desired.set(mapName, []byte(key), value)
+		}
+	}
+	m.loadedMu.Unlock()
+	desired[CONTAINER_CGROUP_LIST_MAP_NAME] = cgroups
+
+	return m.applyState(desired)
+}
+
+// applyCgroupChanges writes the cgroups created below the classified ones and removes the
+// removed ones, as reported by the watcher. The cgroups are scanned again on an overflow.
+func (m *Manager) applyCgroupChanges(c *classify.Classifier, changes []classify.Change) error {
+	ids := classifiedCgroups.snapshot()
+	for _, change := range changes {
+		if change.Overflow {
+			return m.rescanCgroups()
+		}
+
+		if change.Removed {
+			for id, cgroup := range ids {
+				if cgroup == change.Cgroup || strings.HasPrefix(cgroup, change.Cgroup+"/") {
+					delete(ids, id)
+				}
+			}
+			continue
+		}
+
+		root, err := m.cgroupRootPath()
+		if err != nil {
+			return err
+		}
+		created, err := c.CgroupIDsBelow(root, change.Cgroup)
+		if err != nil {
+			return err
+		}
+		for id, cgroup := range created {
+			ids[id] = cgroup
+		}
+	}
+
+	return m.writeCgroups(ids)
+}
+
+// watchCgroups starts the watcher of the cgroups below which new cgroups are classified as
+// containers. The changes are written by "cgroup-watch" jobs, until the job queue is stopped.
+func (m *Manager) watchCgroups(c *classify.Classifier) error {
+	root, err := m.cgroupRootPath()
+	if err != nil {
+		return err
+	}
+	w, err := classify.NewWatcher(root)
+	if err != nil {
+		return err
+	}
+	for _, cgroup := range c.WatchedCgroups() {
+		if err := w.Add(cgroup); err != nil {
+			w.Close()
+			return err
+		}
+	}
+
+	m.mu.Lock()
+	m.watcher = w
+	m.mu.Unlock()
+
+	go func() {
+		for {
+			changes, err := w.Read()
+			if err == classify.ErrWatcherClosed {
+				return
+			}
+			if err != nil {
+				log.Error(fmt.Errorf("failed to watch the cgroups: %w", err))
+			}
+			if len(changes) == 0 {
+				continue
+			}
+
+			err = m.doJob("cgroup-watch", func(ctx context.Context) error {
+				return m.applyCgroupChanges(c, changes)
+			})
+			if err == jobs.ErrStopped {
+				w.Close()
+				return
+			}
+			if err != nil {
+				log.Error(err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// AsyncClassification rescans the cgroups every CGROUP_RESCAN_INTERVAL, if the classification uses them.
+// Unless the programs match the ancestors, the cgroups created below the classified ones are also
+// watched, so that they are written without waiting for the rescan.
+// The rescan follows the containers of the existing config, so it is not subject to the freeze windows.
+func (m *Manager) AsyncClassification() {
+	if !m.usesCgroups() {
+		return
+	}
+
+	c, err := m.classifier()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if !m.ancestors {
+		if err := m.watchCgroups(c); err != nil {
+			log.Warn(fmt.Sprintf("Failed to watch the cgroups, new cgroups are classified by the rescan only: %s", err))
+		}
+	}
+
+	go func() {
+		for {
+			m.sleep(CGROUP_RESCAN_INTERVAL)
+			m.rewatchCgroups(c)
+			err := m.doJob("cgroup-rescan", func(ctx context.Context) error {
+				return m.rescanCgroups()
+			})
+			if err == jobs.ErrStopped {
+				return
+			}
+			if err != nil {
+				log.Error(err)
+			}
+		}
+	}()
+}
+
+// rewatchCgroups watches the cgroups of the cgroup-list strategy that did not exist yet when
+// the watcher was started.
+func (m *Manager) rewatchCgroups(c *classify.Classifier) {
+	m.mu.Lock()
+	w := m.watcher
+	m.mu.Unlock()
+	if w == nil {
+		return
+	}
+
+	for _, cgroup := range c.WatchedCgroups() {
+		if err := w.Add(cgroup); err != nil {
+			log.Error(fmt.Errorf("failed to watch the cgroups: %w", err))
+		}
+	}
+}
+
+// reportMissingCgroups warns about the cgroups of network.classification.cgroups that do not
+// exist, once until they do: a service that is not started yet, or a pod not scheduled yet. The
+// rescan every CGROUP_RESCAN_INTERVAL looks them up again, and writes their id once they are
+// created, or again once they are recreated, e.g. by a restart of their systemd unit.
+func (m *Manager) reportMissingCgroups(c *classify.Classifier, missing []string) {
+	m.mu.Lock()
+	previous := m.missingCgroups
+	m.missingCgroups = map[string]bool{}
+	for _, cgroup := range missing {
+		m.missingCgroups[cgroup] = true
+	}
+	m.mu.Unlock()
+	missingCgroupsGauge.Set(float64(len(missing)))
+
+	for _, cgroup := range missing {
+		if !previous[cgroup] {
+			log.Warn(fmt.Sprintf("The cgroup %s of network.classification.cgroups does not exist yet, it is looked up again every %s.", cgroup, CGROUP_RESCAN_INTERVAL))
+		}
+	}
+	for _, cgroup := range c.WatchedCgroups() {
+		if previous[cgroup] && !m.missingCgroups[cgroup] {
+			log.Info(fmt.Sprintf("The cgroup %s of network.classification.cgroups exists, its processes are classified as containers.", cgroup))
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package network
+
+import (
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/bouhekitest"
+	"github.com/mrtc0/bouheki/pkg/classify"
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func cgroupKey(t *testing.T, path string) string {
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	key := make([]byte, 8)
+	binary.LittleEndian.PutUint64(key, info.Sys().(*syscall.Stat_t).Ino)
+	return string(key)
+}
+
+func cgroupID(t *testing.T, path string) uint64 {
+	return binary.LittleEndian.Uint64([]byte(cgroupKey(t, path)))
+}
+
+// containerCgroupState reads CONTAINER_CGROUP_LIST_MAP_NAME through the job queue, which the watcher writes from.
+func containerCgroupState(t *testing.T, mgr *Manager, maps *bouhekitest.Maps) map[string][]byte {
+	entries := map[string][]byte{}
+	assert.Nil(t, mgr.Jobs().Do("read", func(ctx context.Context) error {
+		for key, value := range maps.Entries(CONTAINER_CGROUP_LIST_MAP_NAME) {
+			entries[key] = value
+		}
+		return nil
+	}))
+	return entries
+}
+
+func TestConfigMapValueClassification(t *testing.T) {
+	for strategy, expected := range map[string]uint32{
+		config.CLASSIFY_MOUNT_NAMESPACE: CLASSIFICATION_MOUNT_NAMESPACE,
+		config.CLASSIFY_PID_NAMESPACE:   CLASSIFICATION_PID_NAMESPACE,
+		config.CLASSIFY_CGROUP_PATTERN:  CLASSIFICATION_CGROUP,
+		config.CLASSIFY_CGROUP_LIST:     CLASSIFICATION_CGROUP,
+	} {
+		conf := config.DefaultConfig()
+		conf.RestrictedNetworkConfig.Classification.Strategy = strategy
+		mgr := Manager{config: conf}
+
+		value := mgr.configMapValue()
+		assert.Equal(t, MAP_SIZE, len(value))
+		assert.Equal(t, expected, binary.LittleEndian.Uint32(value[MAP_CLASSIFICATION_INDEX:MAP_CLASSIFICATION_INDEX+4]), strategy)
+	}
+}
+
+func TestContainerCgroupsAreWritten(t *testing.T) {
+	root := t.TempDir()
+	docker := filepath.Join(root, "system.slice", "docker-0a1b2c.scope")
+	assert.Nil(t, os.MkdirAll(docker, 0755))
+	assert.Nil(t, os.MkdirAll(filepath.Join(root, "system.slice", "ssh.service"), 0755))
+
+	conf := config.DefaultConfig()
+	conf.RestrictedNetworkConfig.Target = "container"
+	conf.RestrictedNetworkConfig.Classification.Strategy = config.CLASSIFY_CGROUP_PATTERN
+	maps := bouhekitest.NewMaps()
+	mgr := Manager{config: conf, backend: maps, cgroupRoot: root}
+	defer mgr.Jobs().Stop()
+	assert.Nil(t, mgr.SetConfigToMap())
+
+	assert.Equal(t, map[string][]byte{cgroupKey(t, docker): entryValue()}, maps.Entries(CONTAINER_CGROUP_LIST_MAP_NAME))
+
+	// A rescan follows the containers, and writes nothing else.
+	podman := filepath.Join(root, "machine.slice", "libpod-3d4e5f.scope")
+	assert.Nil(t, os.MkdirAll(podman, 0755))
+	dockerKey := cgroupKey(t, docker)
+	assert.Nil(t, os.Remove(docker))
+
+	writes := len(maps.Writes())
+	assert.Nil(t, mgr.rescanCgroups())
+	assert.Equal(t, map[string][]byte{cgroupKey(t, podman): entryValue()}, maps.Entries(CONTAINER_CGROUP_LIST_MAP_NAME))
+	for _, op := range maps.Writes()[writes:] {
+		assert.Equal(t, CONTAINER_CGROUP_LIST_MAP_NAME, op.Map)
+	}
+	assert.Equal(t, []bouhekitest.Write{
+		{Map: CONTAINER_CGROUP_LIST_MAP_NAME, Key: []byte(cgroupKey(t, podman)), Value: entryValue()},
+		{Map: CONTAINER_CGROUP_LIST_MAP_NAME, Key: []byte(dockerKey)},
+	}, maps.Writes()[writes:])
+}
+
+func TestMissingCgroupsAreWrittenOnceCreated(t *testing.T) {
+	root := t.TempDir()
+	nginx := filepath.Join(root, "system.slice", "nginx.service")
+
+	conf := config.DefaultConfig()
+	conf.RestrictedNetworkConfig.Target = "container"
+	conf.RestrictedNetworkConfig.Classification.Strategy = config.CLASSIFY_CGROUP_LIST
+	conf.RestrictedNetworkConfig.Classification.Cgroups = []string{"/system.slice/nginx.service"}
+	maps := bouhekitest.NewMaps()
+	mgr := Manager{config: conf, backend: maps, cgroupRoot: root}
+	defer mgr.Jobs().Stop()
+	logs := captureLog(t)
+	assert.Nil(t, mgr.SetConfigToMap())
+
+	// A cgroup that does not exist yet is warned about once, and looked up again by the rescans.
+	assert.Empty(t, maps.Entries(CONTAINER_CGROUP_LIST_MAP_NAME))
+	assert.Equal(t, float64(1), missingCgroupsGauge.Value())
+	assert.Nil(t, mgr.rescanCgroups())
+	assert.Equal(t, 1, strings.Count(logs(), "The cgroup /system.slice/nginx.service of network.classification.cgroups does not exist yet"))
+
+	assert.Nil(t, os.MkdirAll(nginx, 0755))
+	assert.Nil(t, mgr.rescanCgroups())
+	assert.Equal(t, map[string][]byte{cgroupKey(t, nginx): entryValue()}, maps.Entries(CONTAINER_CGROUP_LIST_MAP_NAME))
+	assert.Equal(t, float64(0), missingCgroupsGauge.Value())
+	assert.Contains(t, logs(), "The cgroup /system.slice/nginx.service of network.classification.cgroups exists")
+
+	// A restart of the unit recreates the cgroup with another id, which the rescan writes instead.
+	assert.Nil(t, os.Remove(nginx))
+	assert.Nil(t, os.MkdirAll(nginx, 0755))
+	assert.Nil(t, mgr.rescanCgroups())
+	assert.Equal(t, map[string][]byte{cgroupKey(t, nginx): entryValue()}, maps.Entries(CONTAINER_CGROUP_LIST_MAP_NAME))
+}
+
+func TestContainerCgroupsAreOnlyWrittenForContainerTarget(t *testing.T) {
+	root := t.TempDir()
+	assert.Nil(t, os.MkdirAll(filepath.Join(root, "docker", "0a1b2c"), 0755))
+
+	conf := config.DefaultConfig()
+	conf.RestrictedNetworkConfig.Classification.Strategy = config.CLASSIFY_CGROUP_PATTERN
+	maps := bouhekitest.NewMaps()
+	mgr := Manager{config: conf, backend: maps, cgroupRoot: root}
+	assert.Nil(t, mgr.SetConfigToMap())
+
+	assert.Empty(t, maps.Entries(CONTAINER_CGROUP_LIST_MAP_NAME))
+	assert.False(t, mgr.usesCgroups())
+}
+
+func TestWatchedCgroupsAreWrittenAndRemoved(t *testing.T) {
+	root := t.TempDir()
+	sandbox := filepath.Join(root, "machine.slice", "sandbox.scope")
+	assert.Nil(t, os.MkdirAll(sandbox, 0755))
+
+	conf := config.DefaultConfig()
+	conf.RestrictedNetworkConfig.Target = "container"
+	conf.RestrictedNetworkConfig.Classification.Strategy = config.CLASSIFY_CGROUP_LIST
+	conf.RestrictedNetworkConfig.Classification.Cgroups = []string{"/machine.slice/sandbox.scope"}
+	maps := bouhekitest.NewMaps()
+	mgr := Manager{config: conf, backend: maps, cgroupRoot: root}
+	defer mgr.Close()
+	assert.Nil(t, mgr.SetConfigToMap())
+	c, err := mgr.classifier()
+	assert.Nil(t, err)
+	assert.Nil(t, mgr.watchCgroups(c))
+
+	// A transient scope started by systemd-run in the sandbox, and a cgroup delegated below it.
+	scope := filepath.Join(sandbox, "run-u42.scope")
+	assert.Nil(t, os.Mkdir(scope, 0755))
+	payload := filepath.Join(scope, "payload")
+	assert.Nil(t, os.Mkdir(payload, 0755))
+
+	expected := map[string][]byte{cgroupKey(t, sandbox): entryValue(), cgroupKey(t, scope): entryValue(), cgroupKey(t, payload): entryValue()}
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual(expected, containerCgroupState(t, &mgr, maps))
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "/machine.slice/sandbox.scope/run-u42.scope/payload", classifiedCgroups.name(cgroupID(t, payload)))
+
+	assert.Nil(t, os.Remove(payload))
+	assert.Nil(t, os.Remove(scope))
+	expected = map[string][]byte{cgroupKey(t, sandbox): entryValue()}
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual(expected, containerCgroupState(t, &mgr, maps))
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestCgroupChangesOverflowRescans(t *testing.T) {
+	root := t.TempDir()
+	docker := filepath.Join(root, "system.slice", "docker-0a1b2c.scope")
+	assert.Nil(t, os.MkdirAll(docker, 0755))
+
+	conf := config.DefaultConfig()
+	conf.RestrictedNetworkConfig.Target = "container"
+	conf.RestrictedNetworkConfig.Classification.Strategy = config.CLASSIFY_CGROUP_PATTERN
+	maps := bouhekitest.NewMaps()
+	mgr := Manager{config: conf, backend: maps, cgroupRoot: root}
+	defer mgr.Jobs().Stop()
+	assert.Nil(t, mgr.SetConfigToMap())
+	c, err := mgr.classifier()
+	assert.Nil(t, err)
+
+	podman := filepath.Join(root, "machine.slice", "libpod-3d4e5f.scope")
+	assert.Nil(t, os.MkdirAll(podman, 0755))
+	assert.Nil(t, mgr.applyCgroupChanges(c, []classify.Change{{Overflow: true}}))
+	assert.Equal(t, map[string][]byte{cgroupKey(t, docker): entryValue(), cgroupKey(t, podman): entryValue()}, maps.Entries(CONTAINER_CGROUP_LIST_MAP_NAME))
+}
+
+func TestAncestorMatchingWritesTheTopmostCgroups(t *testing.T) {
+	root := t.TempDir()
+	docker := filepath.Join(root, "system.slice", "docker-0a1b2c.scope")
+	assert.Nil(t, os.MkdirAll(filepath.Join(docker, "init.scope"), 0755))
+
+	conf := config.DefaultConfig()
+	conf.RestrictedNetworkConfig.Target = "container"
+	conf.RestrictedNetworkConfig.Classification.Strategy = config.CLASSIFY_CGROUP_PATTERN
+	maps := bouhekitest.NewMaps()
+	mgr := Manager{config: conf, backend: maps, cgroupRoot: root, ancestors: true}
+	defer mgr.Jobs().Stop()
+	assert.Nil(t, mgr.SetConfigToMap())
+	assert.Equal(t, map[string][]byte{cgroupKey(t, docker): entryValue()}, maps.Entries(CONTAINER_CGROUP_LIST_MAP_NAME))
+
+	// The programs find a cgroup created below it by its ancestor, so nothing is written.
+	assert.Nil(t, os.Mkdir(filepath.Join(docker, "payload"), 0755))
+	writes := len(maps.Writes())
+	assert.Nil(t, mgr.rescanCgroups())
+	assert.Equal(t, writes, len(maps.Writes()))
+}
+
+func TestAuditLogNamesTheMatchedCgroup(t *testing.T) {
+	classifiedCgroups.replace(map[uint64]string{4242: "/system.slice/docker-0a1b2c.scope"})
+
+	networkLog := newAuditLog(eventHeader{EventType: BLOCKED_IPV4, CGroupID: 4343, MatchedCgroupID: 4242}, detectEventIPv4{})
+	assert.Equal(t, "/system.slice/docker-0a1b2c.scope", networkLog.ContainerCgroup)
+
+	networkLog = newAuditLog(eventHeader{EventType: BLOCKED_IPV4, MatchedCgroupID: 4343}, detectEventIPv4{})
+	assert.Equal(t, "cgroup id 4343", networkLog.ContainerCgroup)
+
+	networkLog = newAuditLog(eventHeader{EventType: BLOCKED_IPV4}, detectEventIPv4{})
+	assert.Empty(t, networkLog.ContainerCgroup)
+}
+
+func TestParseEventHeaderMatchedCgroup(t *testing.T) {
+	raw := make([]byte, binary.Size(eventPrefix{})+binary.Size(eventHeaderV4{})+binary.Size(detectEventIPv4{}))
+	binary.LittleEndian.PutUint32(raw[0:], EVENT_MAGIC)
+	binary.LittleEndian.PutUint16(raw[4:], EVENT_SCHEMA_VERSION)
+	binary.LittleEndian.PutUint16(raw[6:], uint16(binary.Size(eventPrefix{})+binary.Size(eventHeaderV4{})))
+	binary.LittleEndian.PutUint32(raw[8:], uint32(len(raw)))
+	binary.LittleEndian.PutUint64(raw[16:], 4343)
+	binary.LittleEndian.PutUint64(raw[24:], 4242)
+
+	header, _, err := parseEvent(raw)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(4343), header.CGroupID)
+	assert.Equal(t, uint64(4242), header.MatchedCgroupID)
+}
@@ -0,0 +1,301 @@
+package network
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/metrics"
+)
+
+const (
+	// COVERAGE_PATH serves the CoverageStatus as JSON on the metrics server.
+	COVERAGE_PATH = "/coverage"
+
+	// COVERAGE_BUCKETS is the number of buckets a window is divided into.
+	// The window rolls forward one bucket at a time.
+	COVERAGE_BUCKETS = 12
+	// COVERAGE_MAX_KEYS bounds the breakdowns of a bucket. Further keys are counted as COVERAGE_OTHER.
+	COVERAGE_MAX_KEYS = 128
+	COVERAGE_OTHER    = "other"
+	COVERAGE_UNTAGGED = "untagged"
+
+	COVERAGE_UPDATE_INTERVAL = 15 * time.Second
+)
+
+var (
+	coverageObserved = metrics.NewCounter("network_allowlist_coverage_observed_total",
+		"Number of connections checked against the allow lists.")
+	coverageExcluded = metrics.NewCounter("network_allowlist_coverage_excluded_total",
+		"Number of connections left out of the allowlist coverage because a deny list matches them.")
+)
+
+// CoverageCounts are the connections observed in a window and how many of them the allow lists permit.
+type CoverageCounts struct {
+	Observed  uint64 `json:"observed"`
+	Permitted uint64 `json:"permitted"`
+}
+
+// Ratio returns the fraction of observed connections that are permitted, or 0 if none were observed.
+func (c CoverageCounts) Ratio() float64 {
+	if c.Observed == 0 {
+		return 0
+	}
+	return float64(c.Permitted) / float64(c.Observed)
+}
+
+func (c *CoverageCounts) add(other CoverageCounts) {
+	c.Observed += other.Observed
+	c.Permitted += other.Permitted
+}
+
+type CoveragePoint struct {
+	Start time.Time `json:"start"`
+	CoverageCounts
+}
+
+// CoverageWindow is the coverage of the last Window, overall and broken down by comm, uid and destination tag.
+type CoverageWindow struct {
+	Window  string                    `json:"window"`
+	Overall CoverageCounts            `json:"overall"`
+	Comm    map[string]CoverageCounts `json:"comm"`
+	UID     map[string]CoverageCounts `json:"uid"`
+	Tag     map[string]CoverageCounts `json:"tag"`
+	// Trend is the coverage of every bucket of the window, oldest first.
+	Trend []CoveragePoint `json:"trend"`
+}
+
+type CoverageStatus struct {
+	// Excluded is the number of connections matching a deny list since the start.
+	Excluded uint64           `json:"excluded"`
+	Windows  []CoverageWindow `json:"windows"`
+}
+
+// coverageSample is a connection that is not matched by a deny list.
+type coverageSample struct {
+	comm      string
+	uid       uint32
+	tags      []string
+	permitted bool
+}
+
+type coverageBucket struct {
+	start   time.Time
+	overall CoverageCounts
+	comm    map[string]CoverageCounts
+	uid     map[string]CoverageCounts
+	tag     map[string]CoverageCounts
+}
+
+func (b *coverageBucket) reset(start time.Time) {
+	*b = coverageBucket{
+		start: start,
+		comm:  map[string]CoverageCounts{},
+		uid:   map[string]CoverageCounts{},
+		tag:   map[string]CoverageCounts{},
+	}
+}
+
+func (b *coverageBucket) add(s coverageSample) {
+	counts := CoverageCounts{Observed: 1}
+	if s.permitted {
+		counts.Permitted = 1
+	}
+
+	b.overall.add(counts)
+	addBreakdown(b.comm, s.comm, counts)
+	addBreakdown(b.uid, strconv.FormatUint(uint64(s.uid), 10), counts)
+	if len(s.tags) == 0 {
+		addBreakdown(b.tag, COVERAGE_UNTAGGED, counts)
+	}
+	for _, tag := range s.tags {
+		addBreakdown(b.tag, tag, counts)
+	}
+}
+
+func addBreakdown(breakdown map[string]CoverageCounts, key string, counts CoverageCounts) {
+	if _, ok := breakdown[key]; !ok && len(breakdown) >= COVERAGE_MAX_KEYS {
+		key = COVERAGE_OTHER
+	}
+	c := breakdown[key]
+	c.add(counts)
+	breakdown[key] = c
+}
+
+// coverageWindow is a ring of buckets covering the last width of time.
+type coverageWindow struct {
+	width   time.Duration
+	bucket  time.Duration
+	buckets [COVERAGE_BUCKETS]coverageBucket
+	ratio   *metrics.Gauge
+}
+
+func newCoverageWindow(width time.Duration) *coverageWindow {
+	name := formatWindow(width)
+	return &coverageWindow{
+		width:  width,
+		bucket: width / COVERAGE_BUCKETS,
+		ratio: metrics.NewGauge("network_allowlist_coverage_ratio_"+name,
+			"Fraction of the connections of the last "+name+" that the allow lists permit."),
+	}
+}
+
+func (w *coverageWindow) observe(now time.Time, s coverageSample) {
+	start := now.Truncate(w.bucket)
+	b := &w.buckets[(start.UnixNano()/int64(w.bucket))%COVERAGE_BUCKETS]
+	if !b.start.Equal(start) {
+		b.reset(start)
+	}
+	b.add(s)
+}
+
+// current returns the buckets that are inside the window at now, oldest first.
+func (w *coverageWindow) current(now time.Time) []*coverageBucket {
+	oldest := now.Truncate(w.bucket).Add(-w.bucket * (COVERAGE_BUCKETS - 1))
+
+	buckets := []*coverageBucket{}
+	for i := range w.buckets {
+		b := &w.buckets[i]
+		if !b.start.IsZero() && !b.start.Before(oldest) && !b.start.After(now) {
+			buckets = append(buckets, b)
+		}
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].start.Before(buckets[j].start) })
+	return buckets
+}
+
+func (w *coverageWindow) status(now time.Time) CoverageWindow {
+	status := CoverageWindow{
+		Window: formatWindow(w.width),
+		Comm:   map[string]CoverageCounts{},
+		UID:    map[string]CoverageCounts{},
+		Tag:    map[string]CoverageCounts{},
+		Trend:  []CoveragePoint{},
+	}
+
+	for _, b := range w.current(now) {
+		status.Overall.add(b.overall)
+		mergeBreakdown(status.Comm, b.comm)
+		mergeBreakdown(status.UID, b.uid)
+		mergeBreakdown(status.Tag, b.tag)
+		status.Trend = append(status.Trend, CoveragePoint{Start: b.start, CoverageCounts: b.overall})
+	}
+
+	return status
+}
+
+func mergeBreakdown(dst, src map[string]CoverageCounts) {
+	for key, counts := range src {
+		c := dst[key]
+		c.add(counts)
+		dst[key] = c
+	}
+}
+
+// coverage maintains how much of the observed traffic the allow lists permit, so that
+// a rollout in monitor mode can tell when switching to block would no longer break anything.
+// Connections matching a deny list are intended blocks and are left out.
+type coverage struct {
+	mu       sync.Mutex
+	policy   *Policy
+	windows  []*coverageWindow
+	excluded uint64
+	now      func() time.Time
+}
+
+func newCoverage(policy *Policy, conf config.CoverageConfig) *coverage {
+	c := &coverage{policy: policy, now: time.Now}
+	for _, width := range conf.Windows {
+		c.windows = append(c.windows, newCoverageWindow(width))
+	}
+	return c
+}
+
+func (c *coverage) observe(header eventHeader, body detectEvent) {
+	conn := eventToConnection(header, body)
+
+	decision := c.policy.Evaluate(conn)
+	if decision.DenyListed {
+		c.mu.Lock()
+		c.excluded++
+		c.mu.Unlock()
+		coverageExcluded.Inc()
+		return
+	}
+
+	c.add(coverageSample{
+		comm:      conn.Command,
+		uid:       conn.UID,
+		tags:      destinationTags.tags(conn.Addr.String()),
+		permitted: !decision.Denied,
+	})
+}
+
+func (c *coverage) add(s coverageSample) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	for _, w := range c.windows {
+		w.observe(now, s)
+	}
+	coverageObserved.Inc()
+}
+
+func (c *coverage) Status() CoverageStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	status := CoverageStatus{Excluded: c.excluded, Windows: []CoverageWindow{}}
+	for _, w := range c.windows {
+		status.Windows = append(status.Windows, w.status(now))
+	}
+	return status
+}
+
+// updateMetrics sets the ratio gauges of the windows.
+func (c *coverage) updateMetrics() {
+	status := c.Status()
+	for i, w := range c.windows {
+		w.ratio.Set(status.Windows[i].Overall.Ratio())
+	}
+}
+
+// run updates the metrics every COVERAGE_UPDATE_INTERVAL until ctx is done.
+func (c *coverage) run(ctx context.Context) {
+	ticker := time.NewTicker(COVERAGE_UPDATE_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.updateMetrics()
+		}
+	}
+}
+
+func (c *coverage) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c.Status())
+}
+
+// formatWindow formats a window without the zero units, e.g. 24h instead of 24h0m0s.
+func formatWindow(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
@@ -0,0 +1,127 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestCoverage(windows ...time.Duration) (*coverage, *time.Time) {
+	now := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	c := newCoverage(NewPolicy(), config.CoverageConfig{Enable: true, Windows: windows})
+	c.now = func() time.Time { return now }
+	return c, &now
+}
+
+func TestCoverageRollingWindow(t *testing.T) {
+	c, now := newTestCoverage(time.Hour, 24*time.Hour)
+
+	// 3 of 4 connections are permitted in the first hour.
+	for _, permitted := range []bool{true, true, false, true} {
+		c.add(coverageSample{comm: "curl", uid: 1000, permitted: permitted})
+	}
+	status := c.Status()
+	assert.Equal(t, "1h", status.Windows[0].Window)
+	assert.Equal(t, CoverageCounts{Observed: 4, Permitted: 3}, status.Windows[0].Overall)
+	assert.Equal(t, 0.75, status.Windows[0].Overall.Ratio())
+
+	// Two hours later, only the 24h window still sees the first connections.
+	*now = now.Add(2 * time.Hour)
+	c.add(coverageSample{comm: "curl", uid: 1000, permitted: true})
+	status = c.Status()
+	assert.Equal(t, CoverageCounts{Observed: 1, Permitted: 1}, status.Windows[0].Overall)
+	assert.Equal(t, CoverageCounts{Observed: 5, Permitted: 4}, status.Windows[1].Overall)
+	assert.Equal(t, 2, len(status.Windows[1].Trend))
+	assert.True(t, status.Windows[1].Trend[0].Start.Before(status.Windows[1].Trend[1].Start))
+
+	// The buckets of the first hour are reused once the 24h window has moved past them.
+	*now = now.Add(23 * time.Hour)
+	c.add(coverageSample{comm: "curl", uid: 1000, permitted: false})
+	status = c.Status()
+	assert.Equal(t, CoverageCounts{Observed: 1}, status.Windows[0].Overall)
+	assert.Equal(t, CoverageCounts{Observed: 2, Permitted: 1}, status.Windows[1].Overall)
+}
+
+func TestCoverageWindowEdge(t *testing.T) {
+	c, now := newTestCoverage(time.Hour)
+	c.add(coverageSample{permitted: true})
+
+	// A bucket stays in the window until a whole window has passed after it.
+	*now = now.Add(time.Hour - time.Second)
+	assert.Equal(t, uint64(1), c.Status().Windows[0].Overall.Observed)
+
+	*now = now.Add(time.Second)
+	assert.Equal(t, uint64(0), c.Status().Windows[0].Overall.Observed)
+	assert.Equal(t, 0.0, c.Status().Windows[0].Overall.Ratio())
+}
+
+func TestCoverageBreakdown(t *testing.T) {
+	c, _ := newTestCoverage(time.Hour)
+
+	c.add(coverageSample{comm: "curl", uid: 1000, tags: []string{TAG_CLOUD_METADATA}, permitted: false})
+	c.add(coverageSample{comm: "curl", uid: 1000, permitted: true})
+	c.add(coverageSample{comm: "apt", uid: 0, tags: []string{"internal", "mirror"}, permitted: true})
+
+	window := c.Status().Windows[0]
+	assert.Equal(t, map[string]CoverageCounts{
+		"curl": {Observed: 2, Permitted: 1},
+		"apt":  {Observed: 1, Permitted: 1},
+	}, window.Comm)
+	assert.Equal(t, map[string]CoverageCounts{
+		"1000": {Observed: 2, Permitted: 1},
+		"0":    {Observed: 1, Permitted: 1},
+	}, window.UID)
+	assert.Equal(t, map[string]CoverageCounts{
+		TAG_CLOUD_METADATA: {Observed: 1},
+		COVERAGE_UNTAGGED:  {Observed: 1, Permitted: 1},
+		"internal":         {Observed: 1, Permitted: 1},
+		"mirror":           {Observed: 1, Permitted: 1},
+	}, window.Tag)
+}
+
+func TestCoverageBreakdownIsBounded(t *testing.T) {
+	c, _ := newTestCoverage(time.Hour)
+
+	for i := 0; i < COVERAGE_MAX_KEYS+10; i++ {
+		c.add(coverageSample{comm: fmt.Sprintf("comm-%d", i), permitted: true})
+	}
+
+	window := c.Status().Windows[0]
+	assert.Equal(t, COVERAGE_MAX_KEYS+1, len(window.Comm))
+	assert.Equal(t, CoverageCounts{Observed: 10, Permitted: 10}, window.Comm[COVERAGE_OTHER])
+}
+
+func TestCoverageExcludesDenyListed(t *testing.T) {
+	policy := newTestPolicy(MODE_MONITOR, []string{"10.0.0.0/8"}, []string{"10.1.0.0/16"})
+	policy.addCommand(DENIED_COMMAND_LIST_MAP_NAME, "nc")
+	c, _ := newTestCoverage(time.Hour)
+	c.policy = withListSizes(policy)
+
+	observe := func(addr string, comm string) {
+		header := eventHeader{EventType: BLOCKED_IPV4}
+		copy(header.Command[:], comm)
+		body := detectEventIPv4{}
+		copy(body.DstIP[:], net.ParseIP(addr).To4())
+		c.observe(header, body)
+	}
+
+	observe("10.0.0.1", "curl")
+	observe("192.168.0.1", "curl")
+	observe("10.1.0.1", "curl")
+	observe("10.0.0.1", "nc")
+
+	status := c.Status()
+	assert.Equal(t, uint64(2), status.Excluded)
+	assert.Equal(t, CoverageCounts{Observed: 2, Permitted: 1}, status.Windows[0].Overall)
+}
+
+func Test_formatWindow(t *testing.T) {
+	assert.Equal(t, "1h", formatWindow(time.Hour))
+	assert.Equal(t, "168h", formatWindow(7*24*time.Hour))
+	assert.Equal(t, "5m", formatWindow(5*time.Minute))
+	assert.Equal(t, "1h30m", formatWindow(90*time.Minute))
+}
@@ -0,0 +1,151 @@
+package network
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/clock"
+	"github.com/mrtc0/bouheki/pkg/config"
+	log "github.com/mrtc0/bouheki/pkg/log"
+)
+
+// dedupKey is what the identical events have in common: the process, the action, and the
+// destination, or the address a bind binds to.
+type dedupKey struct {
+	comm      string
+	pid       uint32
+	action    string
+	operation string
+	addr      string
+	port      uint16
+	protocol  string
+	localAddr string
+	localPort uint16
+}
+
+func newDedupKey(event log.RestrictedNetworkLog) dedupKey {
+	key := dedupKey{
+		comm:      event.Comm,
+		pid:       event.PID,
+		action:    event.Action,
+		operation: event.Operation,
+		addr:      event.Addr,
+		port:      event.Port,
+		protocol:  event.Protocol,
+	}
+	if event.Operation == OPERATION_BIND {
+		key.localAddr, key.localPort = event.LocalAddr, event.LocalPort
+	}
+	return key
+}
+
+// dedupWindow is the window of a key, opened by the event that was logged.
+type dedupWindow struct {
+	start time.Time
+	// last is the last event suppressed, which the summary of the window is.
+	last       log.RestrictedNetworkLog
+	suppressed uint64
+}
+
+// eventDedup suppresses the events identical to one logged less than network.audit.dedup.window
+// ago, and emits a summary of the suppressed ones, with their Count, once the window closes. An
+// event of a key that has no window while max_keys windows are open is logged, never dropped.
+// Only what is logged is deduplicated: the alert rules, the verification and the other readers
+// of the events still see every event.
+type eventDedup struct {
+	mu      sync.Mutex
+	conf    config.AuditDedupConfig
+	clock   clock.Clock
+	windows map[dedupKey]*dedupWindow
+	// emit logs the summary of a window.
+	emit func(event log.RestrictedNetworkLog)
+}
+
+func newEventDedup(conf config.AuditDedupConfig, clk clock.Clock, emit func(event log.RestrictedNetworkLog)) *eventDedup {
+	return &eventDedup{
+		conf:    conf,
+		clock:   clk,
+		windows: map[dedupKey]*dedupWindow{},
+		emit:    emit,
+	}
+}
+
+// admit reports whether event is to be logged, which opens a window of its key, or is suppressed
+// by the open window of an identical event. The window of the key that closed since is
+// summarized first.
+func (d *eventDedup) admit(event log.RestrictedNetworkLog) bool {
+	now := d.clock.Now()
+	key := newDedupKey(event)
+
+	d.mu.Lock()
+	w, ok := d.windows[key]
+	if ok && now.Sub(w.start) < d.conf.Window {
+		w.last = event
+		w.suppressed++
+		d.mu.Unlock()
+		return false
+	}
+	delete(d.windows, key)
+	if len(d.windows) < d.conf.MaxKeys {
+		d.windows[key] = &dedupWindow{start: now}
+	}
+	d.mu.Unlock()
+
+	if ok {
+		d.summarize(w)
+	}
+	return true
+}
+
+// sweep summarizes the windows closed at now, the oldest first.
+func (d *eventDedup) sweep(now time.Time) {
+	d.mu.Lock()
+	closed := []*dedupWindow{}
+	for key, w := range d.windows {
+		if now.Sub(w.start) >= d.conf.Window {
+			closed = append(closed, w)
+			delete(d.windows, key)
+		}
+	}
+	d.mu.Unlock()
+
+	sort.Slice(closed, func(i, j int) bool { return closed[i].start.Before(closed[j].start) })
+	for _, w := range closed {
+		d.summarize(w)
+	}
+}
+
+// flush summarizes every window, closed or not, on shutdown.
+func (d *eventDedup) flush() {
+	d.sweep(d.clock.Now().Add(d.conf.Window))
+}
+
+func (d *eventDedup) summarize(w *dedupWindow) {
+	if w.suppressed == 0 {
+		return
+	}
+	summary := w.last
+	summary.Count = w.suppressed
+	d.emit(summary)
+}
+
+// run summarizes the windows at most half a window after they close, until ctx is done.
+func (d *eventDedup) run(ctx context.Context) {
+	interval := d.conf.Window / 2
+	if interval <= 0 {
+		interval = d.conf.Window
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			d.sweep(d.clock.Now())
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package network
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/bouhekitest"
+	"github.com/mrtc0/bouheki/pkg/config"
+	log "github.com/mrtc0/bouheki/pkg/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func dedupTestEvent(pid uint32, addr string) log.RestrictedNetworkLog {
+	return log.RestrictedNetworkLog{
+		AuditEventLog: log.AuditEventLog{Action: "BLOCKED", Comm: "curl", PID: pid},
+		Operation:     OPERATION_CONNECT,
+		Addr:          addr,
+		Port:          443,
+		Protocol:      "TCP",
+	}
+}
+
+func TestEventDedup(t *testing.T) {
+	clk := bouhekitest.NewClock(time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC))
+	summaries := []log.RestrictedNetworkLog{}
+	conf := config.DefaultConfig().RestrictedNetworkConfig.Audit.Dedup
+	d := newEventDedup(conf, clk, func(event log.RestrictedNetworkLog) { summaries = append(summaries, event) })
+
+	// The first event of a window is logged, the identical ones are suppressed.
+	assert.True(t, d.admit(dedupTestEvent(4242, "203.0.113.10")))
+	for i := 0; i < 3; i++ {
+		clk.Advance(time.Second)
+		assert.False(t, d.admit(dedupTestEvent(4242, "203.0.113.10")))
+	}
+	// Another destination and another process are not identical.
+	assert.True(t, d.admit(dedupTestEvent(4242, "198.51.100.7")))
+	assert.True(t, d.admit(dedupTestEvent(4343, "203.0.113.10")))
+	allowed := dedupTestEvent(4242, "203.0.113.10")
+	allowed.Action = "ALLOWED"
+	assert.True(t, d.admit(allowed))
+
+	d.sweep(clk.Now())
+	assert.Len(t, summaries, 0)
+
+	// The window closes with a summary of the suppressed events; the windows without any have none.
+	clk.Advance(conf.Window)
+	d.sweep(clk.Now())
+	assert.Len(t, summaries, 1)
+	assert.Equal(t, uint64(3), summaries[0].Count)
+	assert.Equal(t, "203.0.113.10", summaries[0].Addr)
+
+	// The next event opens a new window.
+	assert.True(t, d.admit(dedupTestEvent(4242, "203.0.113.10")))
+	assert.False(t, d.admit(dedupTestEvent(4242, "203.0.113.10")))
+
+	// A window closed before the sweep is summarized by the next event of its key.
+	clk.Advance(conf.Window)
+	assert.True(t, d.admit(dedupTestEvent(4242, "203.0.113.10")))
+	assert.Len(t, summaries, 2)
+	assert.Equal(t, uint64(1), summaries[1].Count)
+
+	// The open windows are summarized on shutdown.
+	assert.False(t, d.admit(dedupTestEvent(4242, "203.0.113.10")))
+	d.flush()
+	assert.Len(t, summaries, 3)
+}
+
+func TestEventDedupMaxKeys(t *testing.T) {
+	clk := bouhekitest.NewClock(time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC))
+	conf := config.DefaultConfig().RestrictedNetworkConfig.Audit.Dedup
+	conf.MaxKeys = 1
+	d := newEventDedup(conf, clk, func(event log.RestrictedNetworkLog) {})
+
+	assert.True(t, d.admit(dedupTestEvent(4242, "203.0.113.10")))
+	assert.False(t, d.admit(dedupTestEvent(4242, "203.0.113.10")))
+	// Without room for a window, the events of another key are all logged.
+	assert.True(t, d.admit(dedupTestEvent(4242, "198.51.100.7")))
+	assert.True(t, d.admit(dedupTestEvent(4242, "198.51.100.7")))
+}
+
+func TestConfigMapValueReportInterval(t *testing.T) {
+	conf := config.DefaultConfig()
+	conf.RestrictedNetworkConfig.Audit.Dedup.KernelWindow = 5 * time.Second
+	assert.Len(t, ConfigMapValue(conf), MAP_SIZE)
+	// The kernel window is only written with the deduplication.
+	assert.Equal(t, uint64(0), binary.LittleEndian.Uint64(ConfigMapValue(conf)[MAP_REPORT_INTERVAL_INDEX:]))
+
+	conf.RestrictedNetworkConfig.Audit.Dedup.Enable = true
+	assert.Equal(t, uint64(5*time.Second), binary.LittleEndian.Uint64(ConfigMapValue(conf)[MAP_REPORT_INTERVAL_INDEX:]))
+}
@@ -0,0 +1,294 @@
+package network
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+	log "github.com/mrtc0/bouheki/pkg/log"
+	"github.com/mrtc0/bouheki/pkg/metrics"
+)
+
+const (
+	// DENIAL_RECORDS_MAX_UIDS bounds the uids whose records are kept in memory.
+	// The blocks of further uids are dropped until the records of a uid expire.
+	DENIAL_RECORDS_MAX_UIDS = 4096
+	// DENIAL_RECORD_MAX_FIELD truncates the domain and the rule of a record.
+	DENIAL_RECORD_MAX_FIELD = 256
+
+	DENIAL_RECORDS_CLEANUP_INTERVAL = time.Minute
+
+	// DENIAL_RULE_UNKNOWN is recorded when the policy mirror no longer denies the
+	// connection the kernel blocked, because the policy changed in the meantime.
+	DENIAL_RULE_UNKNOWN = "unknown, the policy changed since"
+)
+
+var (
+	denialRecordsWritten = metrics.NewCounter("network_denial_records_written_total",
+		"Number of denial record files written.")
+	denialRecordsDropped = metrics.NewCounter("network_denial_records_dropped_total",
+		"Number of blocked connections not recorded because too many uids have records.")
+)
+
+// denialRecordFile matches the files of the records directory, <uid>.json.
+var denialRecordFile = regexp.MustCompile(`^([0-9]+)\.json$`)
+
+type DenialRecord struct {
+	Time     time.Time `json:"time"`
+	Rule     string    `json:"rule"`
+	Addr     string    `json:"addr"`
+	Domain   string    `json:"domain,omitempty"`
+	Port     uint16    `json:"port"`
+	Protocol string    `json:"protocol"`
+	Comm     string    `json:"comm"`
+	PID      uint32    `json:"pid"`
+}
+
+// DenialRecords is the content of <dir>/<uid>.json, the most recent record first.
+type DenialRecords struct {
+	UID     uint32         `json:"uid"`
+	Records []DenialRecord `json:"records"`
+}
+
+// DenialRecordsPath returns the file holding the records of uid.
+func DenialRecordsPath(dir string, uid uint32) string {
+	return filepath.Join(dir, strconv.FormatUint(uint64(uid), 10)+".json")
+}
+
+// ReadDenialRecords reads the records of uid from dir. It needs no privilege
+// when run as uid, since the file belongs to uid.
+func ReadDenialRecords(dir string, uid uint32) (*DenialRecords, error) {
+	data, err := ioutil.ReadFile(DenialRecordsPath(dir, uid))
+	if err != nil {
+		return nil, err
+	}
+
+	records := &DenialRecords{}
+	if err := json.Unmarshal(data, records); err != nil {
+		return nil, fmt.Errorf("%s: %w", DenialRecordsPath(dir, uid), err)
+	}
+	return records, nil
+}
+
+// denialRecorder keeps the most recent blocked connections of every uid and writes them
+// to the records directory, so that a user can find out why a connection was refused
+// without access to the audit log.
+//
+// handleEvent only appends to memory. The files of the uids with new records are written
+// by run once per WriteInterval, so a process retrying a blocked connection in a loop
+// costs one write per interval.
+type denialRecorder struct {
+	mu        sync.Mutex
+	policy    *Policy
+	dir       string
+	max       int
+	interval  time.Duration
+	retention time.Duration
+	// records are the records of every uid, the most recent first.
+	records map[uint32][]DenialRecord
+	dirty   map[uint32]bool
+	now     func() time.Time
+}
+
+func newDenialRecorder(policy *Policy, conf config.DenialRecordsConfig) *denialRecorder {
+	return &denialRecorder{
+		policy:    policy,
+		dir:       conf.Dir,
+		max:       conf.MaxRecords,
+		interval:  conf.WriteInterval,
+		retention: conf.Retention,
+		records:   map[uint32][]DenialRecord{},
+		dirty:     map[uint32]bool{},
+		now:       time.Now,
+	}
+}
+
+// prepare creates the records directory. Anyone may open a file in it, but only the
+// daemon may list or change it, so that a user cannot replace the file of another uid.
+func (r *denialRecorder) prepare() error {
+	if err := os.MkdirAll(r.dir, 0711); err != nil {
+		return err
+	}
+
+	info, err := os.Lstat(r.dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", r.dir)
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && int(stat.Uid) != os.Geteuid() {
+		return fmt.Errorf("%s is owned by uid %d, not by bouheki", r.dir, stat.Uid)
+	}
+	return os.Chmod(r.dir, 0711)
+}
+
+// record adds the connection of an event to the records of its uid. Only blocked
+// connections are recorded.
+func (r *denialRecorder) record(header eventHeader, body detectEvent) {
+	if body.ActionResult() != ACTION_BLOCKED_STRING {
+		return
+	}
+
+	conn := eventToConnection(header, body)
+	rule := r.policy.Evaluate(conn).Rule
+	if rule == "" {
+		rule = DENIAL_RULE_UNKNOWN
+	}
+
+	auditLog := newAuditLog(header, body)
+	r.add(header.UID, DenialRecord{
+		Time:     r.now(),
+		Rule:     truncate(rule, DENIAL_RECORD_MAX_FIELD),
+		Addr:     auditLog.Addr,
+		Domain:   truncate(auditLog.Domain, DENIAL_RECORD_MAX_FIELD),
+		Port:     auditLog.Port,
+		Protocol: auditLog.Protocol,
+		Comm:     auditLog.Comm,
+		PID:      auditLog.PID,
+	})
+}
+
+func (r *denialRecorder) add(uid uint32, record DenialRecord) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	records, ok := r.records[uid]
+	if !ok && len(r.records) >= DENIAL_RECORDS_MAX_UIDS {
+		denialRecordsDropped.Inc()
+		return
+	}
+	if len(records) >= r.max {
+		records = records[:r.max-1]
+	}
+	r.records[uid] = append([]DenialRecord{record}, records...)
+	r.dirty[uid] = true
+}
+
+func (r *denialRecorder) run(ctx context.Context) {
+	flush := time.NewTicker(r.interval)
+	defer flush.Stop()
+	cleanup := time.NewTicker(DENIAL_RECORDS_CLEANUP_INTERVAL)
+	defer cleanup.Stop()
+
+	r.cleanup()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flush.C:
+			r.flush()
+		case <-cleanup.C:
+			r.cleanup()
+		}
+	}
+}
+
+// flush writes the files of the uids with new records.
+func (r *denialRecorder) flush() {
+	r.mu.Lock()
+	pending := map[uint32][]DenialRecord{}
+	for uid := range r.dirty {
+		pending[uid] = r.records[uid]
+	}
+	r.dirty = map[uint32]bool{}
+	r.mu.Unlock()
+
+	for uid, records := range pending {
+		if err := r.write(uid, records); err != nil {
+			log.Error(fmt.Errorf("failed to write the denial records of uid %d: %w", uid, err))
+			continue
+		}
+		denialRecordsWritten.Inc()
+	}
+}
+
+// write replaces the file of uid. The file is written under a temporary name, owned by uid
+// and only readable by it, before it is renamed, so that the uid never reads a partial
+// file and nobody else can read it at any point.
+func (r *denialRecorder) write(uid uint32, records []DenialRecord) error {
+	data, err := json.Marshal(DenialRecords{UID: uid, Records: records})
+	if err != nil {
+		return err
+	}
+
+	// TempFile creates the file with mode 0600.
+	f, err := ioutil.TempFile(r.dir, fmt.Sprintf(".%d.json.*.tmp", uid))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chown(int(uid), -1); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), DenialRecordsPath(r.dir, uid))
+}
+
+// cleanup forgets the uids without a block for the retention, and removes their files,
+// including the files left by a previous run. Temporary files of an interrupted write are
+// removed too.
+func (r *denialRecorder) cleanup() {
+	cutoff := r.now().Add(-r.retention)
+
+	r.mu.Lock()
+	for uid, records := range r.records {
+		if len(records) == 0 || records[0].Time.Before(cutoff) {
+			delete(r.records, uid)
+			delete(r.dirty, uid)
+		}
+	}
+	r.mu.Unlock()
+
+	entries, err := ioutil.ReadDir(r.dir)
+	if err != nil {
+		log.Error(fmt.Errorf("failed to clean up the denial records: %w", err))
+		return
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		stale := entry.ModTime().Before(cutoff)
+		if match := denialRecordFile.FindStringSubmatch(name); match != nil {
+			uid, err := strconv.ParseUint(match[1], 10, 32)
+			if err != nil {
+				continue
+			}
+			r.mu.Lock()
+			_, active := r.records[uint32(uid)]
+			r.mu.Unlock()
+			stale = stale && !active
+		} else if !(len(name) > 0 && name[0] == '.' && filepath.Ext(name) == ".tmp") {
+			continue
+		}
+
+		if stale {
+			if err := os.Remove(filepath.Join(r.dir, name)); err != nil && !os.IsNotExist(err) {
+				log.Error(fmt.Errorf("failed to remove the stale denial records %s: %w", name, err))
+			}
+		}
+	}
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n]
+}
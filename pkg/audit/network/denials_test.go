@@ -0,0 +1,179 @@
+package network
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestDenialRecorder(t *testing.T, policy *Policy, maxRecords int) (*denialRecorder, *time.Time) {
+	now := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	r := newDenialRecorder(policy, config.DenialRecordsConfig{
+		Enable:        true,
+		Dir:           filepath.Join(t.TempDir(), "last-denials"),
+		MaxRecords:    maxRecords,
+		WriteInterval: time.Second,
+		Retention:     time.Hour,
+	})
+	r.now = func() time.Time { return now }
+	assert.Nil(t, r.prepare())
+	return r, &now
+}
+
+func blockedEvent(uid uint32, addr string, action uint8) (eventHeader, detectEvent) {
+	header := eventHeader{PID: 4242, EventType: BLOCKED_IPV4, UID: uid}
+	copy(header.Command[:], "curl")
+	body := detectEventIPv4{DstPort: 443, Action: action, SockType: TCP, Verdict: VERDICT_DENY}
+	copy(body.DstIP[:], net.ParseIP(addr).To4())
+	return header, body
+}
+
+func TestDenialRecordsAreWrittenForTheUID(t *testing.T) {
+	uid := uint32(os.Getuid())
+	r, _ := newTestDenialRecorder(t, newTestPolicy(MODE_BLOCK, []string{"0.0.0.0/0"}, []string{"10.0.0.0/8"}), 2)
+
+	// Only blocked connections are recorded.
+	r.record(blockedEvent(uid, "10.0.0.1", ACTION_MONITOR))
+	r.flush()
+	_, err := ReadDenialRecords(r.dir, uid)
+	assert.True(t, os.IsNotExist(err))
+
+	for _, addr := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		r.record(blockedEvent(uid, addr, ACTION_BLOCKED))
+	}
+	r.flush()
+
+	records, err := ReadDenialRecords(r.dir, uid)
+	assert.Nil(t, err)
+	assert.Equal(t, uid, records.UID)
+	// The most recent first, bounded by max_records.
+	assert.Equal(t, 2, len(records.Records))
+	assert.Equal(t, "10.0.0.3", records.Records[0].Addr)
+	assert.Equal(t, "10.0.0.2", records.Records[1].Addr)
+	assert.Equal(t, "network.cidr.deny 10.0.0.0/8", records.Records[0].Rule)
+	assert.Equal(t, "curl", records.Records[0].Comm)
+	assert.Equal(t, uint16(443), records.Records[0].Port)
+	assert.Equal(t, "TCP", records.Records[0].Protocol)
+
+	info, err := os.Stat(DenialRecordsPath(r.dir, uid))
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	dir, err := os.Stat(r.dir)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0711), dir.Mode().Perm())
+
+	// No temporary file is left behind.
+	entries, err := os.ReadDir(r.dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(entries))
+}
+
+func TestDenialRecordsAreOnlyRewrittenWithNewRecords(t *testing.T) {
+	uid := uint32(os.Getuid())
+	r, _ := newTestDenialRecorder(t, newTestPolicy(MODE_BLOCK, []string{"0.0.0.0/0"}, []string{"10.0.0.0/8"}), 20)
+
+	r.record(blockedEvent(uid, "10.0.0.1", ACTION_BLOCKED))
+	r.flush()
+	path := DenialRecordsPath(r.dir, uid)
+	assert.Nil(t, os.Remove(path))
+
+	r.flush()
+	_, err := os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDenialRecordsOfAChangedPolicy(t *testing.T) {
+	uid := uint32(os.Getuid())
+	// The kernel blocked the connection before the mirror was updated.
+	r, _ := newTestDenialRecorder(t, newTestPolicy(MODE_BLOCK, []string{"0.0.0.0/0"}, nil), 20)
+
+	r.record(blockedEvent(uid, "10.0.0.1", ACTION_BLOCKED))
+	r.flush()
+
+	records, err := ReadDenialRecords(r.dir, uid)
+	assert.Nil(t, err)
+	assert.Equal(t, DENIAL_RULE_UNKNOWN, records.Records[0].Rule)
+}
+
+func TestDenialRecordsCleanup(t *testing.T) {
+	uid := uint32(os.Getuid())
+	r, now := newTestDenialRecorder(t, newTestPolicy(MODE_BLOCK, []string{"0.0.0.0/0"}, []string{"10.0.0.0/8"}), 20)
+
+	// The file of a uid from a previous run, one of an active uid, and files bouheki does not own.
+	old := time.Date(2026, 10, 14, 10, 0, 0, 0, time.UTC)
+	for _, name := range []string{"1001.json", ".1002.json.123.tmp", "README", DenialRecordsPath("", uid)} {
+		path := filepath.Join(r.dir, name)
+		assert.Nil(t, os.WriteFile(path, []byte("{}"), 0600))
+		assert.Nil(t, os.Chtimes(path, old, old))
+	}
+	r.record(blockedEvent(uid, "10.0.0.1", ACTION_BLOCKED))
+
+	r.cleanup()
+	names := func() []string {
+		entries, err := os.ReadDir(r.dir)
+		assert.Nil(t, err)
+		names := []string{}
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		return names
+	}
+	assert.ElementsMatch(t, []string{"README", filepath.Base(DenialRecordsPath(r.dir, uid))}, names())
+
+	// Once the uid has had no block for the retention, it is forgotten and its file removed.
+	r.flush()
+	*now = now.Add(2 * time.Hour)
+	assert.Nil(t, os.Chtimes(DenialRecordsPath(r.dir, uid), old, old))
+	r.cleanup()
+	assert.Equal(t, []string{"README"}, names())
+	assert.Empty(t, r.records)
+}
+
+func TestDenialRecordsBoundTheUIDs(t *testing.T) {
+	r, _ := newTestDenialRecorder(t, NewPolicy(), 20)
+	for uid := uint32(0); uid < DENIAL_RECORDS_MAX_UIDS+10; uid++ {
+		r.add(uid, DenialRecord{Addr: "10.0.0.1"})
+	}
+	assert.Equal(t, DENIAL_RECORDS_MAX_UIDS, len(r.records))
+
+	// The uids already recorded keep being recorded.
+	r.add(0, DenialRecord{Addr: "10.0.0.2"})
+	assert.Equal(t, "10.0.0.2", r.records[0][0].Addr)
+}
+
+func TestDenialRecordsRefuseADirectoryOwnedByAnotherUser(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to chown the directory")
+	}
+	r, _ := newTestDenialRecorder(t, NewPolicy(), 20)
+	assert.Nil(t, os.Chown(r.dir, 1000, 1000))
+	assert.NotNil(t, r.prepare())
+
+	// A symlink to a directory is not followed.
+	target := filepath.Join(filepath.Dir(r.dir), "target")
+	assert.Nil(t, os.Mkdir(target, 0711))
+	assert.Nil(t, os.Remove(r.dir))
+	assert.Nil(t, os.Symlink(target, r.dir))
+	assert.NotNil(t, r.prepare())
+}
+
+func TestDenialRecordsAreOwnedByTheUID(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to chown the records")
+	}
+	r, _ := newTestDenialRecorder(t, newTestPolicy(MODE_BLOCK, []string{"0.0.0.0/0"}, []string{"10.0.0.0/8"}), 20)
+	r.record(blockedEvent(1000, "10.0.0.1", ACTION_BLOCKED))
+	r.flush()
+
+	info, err := os.Stat(DenialRecordsPath(r.dir, 1000))
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1000), info.Sys().(*syscall.Stat_t).Uid)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
@@ -0,0 +1,287 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/freeze"
+	"github.com/mrtc0/bouheki/pkg/jobs"
+	log "github.com/mrtc0/bouheki/pkg/log"
+	"github.com/mrtc0/bouheki/pkg/metrics"
+)
+
+const (
+	// DNS_HEAL_IPV4_PREFIX and DNS_HEAL_IPV6_PREFIX are the networks a blocked address shares
+	// with an address of an allowed domain to be near it.
+	DNS_HEAL_IPV4_PREFIX = 24
+	DNS_HEAL_IPV6_PREFIX = 48
+
+	// DNS_HEAL_QUEUE_SIZE is the number of blocked addresses waiting to be healed. The
+	// addresses blocked while it is full are healed on their next blocked connection.
+	DNS_HEAL_QUEUE_SIZE = 64
+	// DNS_HEAL_MAX_BLOCKED bounds the blocked addresses that are remembered until they are healed.
+	DNS_HEAL_MAX_BLOCKED = 1024
+
+	// DNS_HEAL_RULE starts the Rule of the connections that no allow list entry matches, the
+	// only ones a new address of an allowed domain heals.
+	DNS_HEAL_RULE = "network.cidr.allow does not list"
+)
+
+var (
+	dnsHeals = metrics.NewCounter("network_dns_heals_total",
+		"Number of blocked addresses of an allowed domain added to the maps by resolving the domain out of schedule.")
+	dnsHealsRateLimited = metrics.NewCounter("network_dns_heals_rate_limited_total",
+		"Number of resolutions out of schedule skipped because the domain was resolved less than network.domain.heal.interval ago.")
+)
+
+// healKey is the addresses of a record type of an allowed domain.
+type healKey struct {
+	domain string
+	v6     bool
+}
+
+// blockedAddress is an address that was blocked since and has not been healed yet.
+type blockedAddress struct {
+	since time.Time
+	count int
+}
+
+// dnsHealer resolves an allowed domain again when a connection to an address near its
+// addresses is blocked: a domain whose addresses rotated between two refreshes blocks the
+// connections to its new addresses until the next refresh otherwise.
+type dnsHealer struct {
+	mgr  *Manager
+	conf config.DomainHealConfig
+	// lookupAddr returns the PTR records of an address, see network.domain.heal.reverse_dns.
+	lookupAddr func(addr string) ([]string, error)
+	queue      chan string
+
+	mu        sync.Mutex
+	addresses map[healKey][]net.IP
+	// attempts are when a domain, or the PTR records of an address, were last resolved.
+	attempts map[string]time.Time
+	blocked  map[string]*blockedAddress
+}
+
+func newDNSHealer(mgr *Manager, conf config.DomainHealConfig) *dnsHealer {
+	if !conf.Enable {
+		return nil
+	}
+	return &dnsHealer{
+		mgr:        mgr,
+		conf:       conf,
+		lookupAddr: net.LookupAddr,
+		queue:      make(chan string, DNS_HEAL_QUEUE_SIZE),
+		addresses:  map[healKey][]net.IP{},
+		attempts:   map[string]time.Time{},
+		blocked:    map[string]*blockedAddress{},
+	}
+}
+
+// remember keeps the addresses of an answer of an allowed domain, which the blocked addresses are near or not.
+func (h *dnsHealer) remember(answer *DNSAnswer) {
+	v4, v6 := []net.IP{}, []net.IP{}
+	for _, address := range answer.Addresses {
+		if address.To4() != nil {
+			v4 = append(v4, address)
+		} else {
+			v6 = append(v6, address)
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(v4) > 0 {
+		h.addresses[healKey{answer.Domain, false}] = v4
+	}
+	if len(v6) > 0 {
+		h.addresses[healKey{answer.Domain, true}] = v6
+	}
+}
+
+// observe queues the destination of a connection that no allow list entry matches to be healed.
+func (h *dnsHealer) observe(header eventHeader, body detectEvent) {
+	if !body.Denied() {
+		return
+	}
+	conn := eventToConnection(header, body)
+	if !strings.HasPrefix(h.mgr.Policy().Evaluate(conn).Rule, DNS_HEAL_RULE) {
+		return
+	}
+
+	addr := conn.Addr.String()
+	h.mu.Lock()
+	if b, ok := h.blocked[addr]; ok {
+		b.count++
+	} else if len(h.blocked) < DNS_HEAL_MAX_BLOCKED {
+		h.blocked[addr] = &blockedAddress{since: h.mgr.now(), count: 1}
+	} else {
+		h.mu.Unlock()
+		return
+	}
+	h.mu.Unlock()
+
+	select {
+	case h.queue <- addr:
+	default:
+	}
+}
+
+func (h *dnsHealer) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case addr := <-h.queue:
+			if err := h.heal(net.ParseIP(addr)); err == jobs.ErrStopped {
+				return
+			}
+		}
+	}
+}
+
+// heal resolves the allowed domains the blocked address may belong to, and adds it to the
+// maps if one of them resolves to it.
+func (h *dnsHealer) heal(addr net.IP) error {
+	domains := h.near(addr)
+	if len(domains) == 0 && h.conf.ReverseDNS {
+		domains = h.reverse(addr)
+	}
+
+	recordType := dns.TypeA
+	if addr.To4() == nil {
+		recordType = dns.TypeAAAA
+	}
+	for _, domain := range domains {
+		if !h.attempt(domain) {
+			dnsHealsRateLimited.Inc()
+			continue
+		}
+
+		answer, err := h.mgr.dnsResolver.Resolve(domain, recordType)
+		if err != nil {
+			log.Debug(fmt.Sprintf("%s (%s) resolve failed. %s\n", domain, dns.TypeToString[recordType], err))
+			continue
+		}
+		if !containsIP(answer.Addresses, addr) {
+			continue
+		}
+
+		err = h.mgr.runJob("dns-heal "+domain, freeze.CHANGE_DNS_REFRESH, func(ctx context.Context) error {
+			return h.mgr.updateAllowedFQDNist(answer)
+		})
+		if err != nil {
+			if err != jobs.ErrStopped && !errors.Is(err, jobs.ErrRejected) {
+				log.Error(fmt.Errorf("failed to heal %s of %s: %w", addr, domain, err))
+			}
+			return err
+		}
+		h.healed(domain, addr)
+		return nil
+	}
+	return nil
+}
+
+func (h *dnsHealer) healed(domain string, addr net.IP) {
+	h.mu.Lock()
+	b, ok := h.blocked[addr.String()]
+	delete(h.blocked, addr.String())
+	h.mu.Unlock()
+	if !ok {
+		b = &blockedAddress{since: h.mgr.now()}
+	}
+
+	dnsHeals.Inc()
+	healLog := log.DNSHealLog{
+		Domain:  domain,
+		Addr:    addr.String(),
+		Since:   b.since,
+		Gap:     h.mgr.now().Sub(b.since),
+		Blocked: b.count,
+	}
+	healLog.Info()
+}
+
+// near returns the allowed domains with an address in the same network as addr, sorted.
+func (h *dnsHealer) near(addr net.IP) []string {
+	key := healKey{v6: addr.To4() == nil}
+	bits, size := DNS_HEAL_IPV4_PREFIX, 32
+	if key.v6 {
+		bits, size = DNS_HEAL_IPV6_PREFIX, 128
+	}
+	network := &net.IPNet{IP: addr.Mask(net.CIDRMask(bits, size)), Mask: net.CIDRMask(bits, size)}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	domains := []string{}
+	for k, addresses := range h.addresses {
+		if k.v6 != key.v6 {
+			continue
+		}
+		for _, address := range addresses {
+			if network.Contains(address) {
+				domains = append(domains, k.domain)
+				break
+			}
+		}
+	}
+	sort.Strings(domains)
+	return domains
+}
+
+// reverse returns the allowed domains the PTR records of addr are, or are a subdomain of.
+// The PTR records of an address are looked up at most once every interval.
+func (h *dnsHealer) reverse(addr net.IP) []string {
+	if !h.attempt("ptr " + addr.String()) {
+		dnsHealsRateLimited.Inc()
+		return nil
+	}
+	names, err := h.lookupAddr(addr.String())
+	if err != nil {
+		log.Debug(fmt.Sprintf("%s (PTR) resolve failed. %s\n", addr, err))
+		return nil
+	}
+
+	domains := []string{}
+	for _, domain := range h.mgr.config.RestrictedNetworkConfig.Domain.Allow {
+		allowed := strings.ToLower(strings.TrimSuffix(domain, "."))
+		for _, name := range names {
+			name = strings.ToLower(strings.TrimSuffix(name, "."))
+			if name == allowed || strings.HasSuffix(name, "."+allowed) {
+				domains = append(domains, domain)
+				break
+			}
+		}
+	}
+	return domains
+}
+
+// attempt reports whether key was not attempted in the last interval, and records the attempt if so.
+func (h *dnsHealer) attempt(key string) bool {
+	now := h.mgr.now()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if last, ok := h.attempts[key]; ok && now.Sub(last) < h.conf.Interval {
+		return false
+	}
+	h.attempts[key] = now
+	return true
+}
+
+func containsIP(addresses []net.IP, addr net.IP) bool {
+	for _, address := range addresses {
+		if address.Equal(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,224 @@
+package network
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/mrtc0/bouheki/pkg/bouhekitest"
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// scriptedResolver answers the queries of a domain with the addresses of the script, in turn.
+// The last answer of a domain is repeated, a domain without a script does not resolve.
+type scriptedResolver struct {
+	mu      sync.Mutex
+	script  map[string][][]string
+	queries []string
+}
+
+func (r *scriptedResolver) Resolve(host string, recordType uint16) (*DNSAnswer, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.queries = append(r.queries, host+" "+dns.TypeToString[recordType])
+
+	answers := r.script[host]
+	if len(answers) == 0 {
+		return nil, errors.New(host + " has not records")
+	}
+	answer := &DNSAnswer{Domain: host, TTL: 300}
+	for _, address := range answers[0] {
+		ip := net.ParseIP(address)
+		if (ip.To4() == nil) == (recordType == dns.TypeAAAA) {
+			answer.Addresses = append(answer.Addresses, ip)
+		}
+	}
+	if len(answers) > 1 {
+		r.script[host] = answers[1:]
+	}
+	return answer, nil
+}
+
+func newHealTestManager(t *testing.T, resolver *scriptedResolver, domains ...string) (*Manager, *dnsHealer, *bouhekitest.Clock) {
+	conf := config.DefaultConfig()
+	conf.RestrictedNetworkConfig.Mode = "block"
+	conf.RestrictedNetworkConfig.CIDR.Allow = []string{}
+	conf.RestrictedNetworkConfig.Domain.Allow = domains
+	clock := bouhekitest.NewClock(time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC))
+	mgr, err := NewManager(conf, WithMapBackend(bouhekitest.NewMaps()), WithClock(clock), WithDNSResolver(resolver))
+	assert.Nil(t, err)
+	t.Cleanup(mgr.Close)
+
+	mgr.healer = newDNSHealer(mgr, config.DomainHealConfig{Enable: true, Interval: 30 * time.Second})
+	assert.Nil(t, mgr.SetConfigToMap())
+	return mgr, mgr.healer, clock
+}
+
+// blockedConnection is a blocked connection of curl to port 443 of addr.
+func blockedConnection(addr string) (eventHeader, detectEvent) {
+	header := eventHeader{SchemaVersion: EVENT_SCHEMA_VERSION, Command: commandBytes("curl")}
+	ip := net.ParseIP(addr)
+	if ip4 := ip.To4(); ip4 != nil {
+		header.EventType = BLOCKED_IPV4
+		body := detectEventIPv4{DstPort: 443, Action: ACTION_BLOCKED, SockType: TCP, Verdict: VERDICT_DENY}
+		copy(body.DstIP[:], ip4)
+		return header, body
+	}
+	header.EventType = BLOCKED_IPV6
+	body := detectEventIPv6{DstPort: 443, Action: ACTION_BLOCKED, SockType: TCP, Verdict: VERDICT_DENY}
+	copy(body.DstIP[:], ip.To16())
+	return header, body
+}
+
+func commandBytes(command string) [TASK_COMM_LEN]byte {
+	comm := [TASK_COMM_LEN]byte{}
+	copy(comm[:], command)
+	return comm
+}
+
+// allowed reports whether the allow list has addr, as the domains resolved to it write it.
+func allowed(mgr *Manager, addr string) bool {
+	ip := net.ParseIP(addr)
+	n := &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+	if ip4 := ip.To4(); ip4 != nil {
+		n = &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return mgr.Policy().hasCIDR(ALLOWED_V4_CIDR_LIST_MAP_NAME, PROTOCOL_ALL, n)
+}
+
+func TestDNSHealerAddsTheNewAddressOfANearDomain(t *testing.T) {
+	resolver := &scriptedResolver{script: map[string][][]string{
+		"example.com": {{"192.0.2.1", "2001:db8::1"}, {"192.0.2.1", "2001:db8::1"}, {"192.0.2.7"}, {"2001:db8:0:ff::7"}},
+	}}
+	mgr, healer, clock := newHealTestManager(t, resolver, "example.com")
+	assert.False(t, allowed(mgr, "192.0.2.7"))
+
+	healed := dnsHeals.Value()
+	healer.observe(blockedConnection("192.0.2.7"))
+	healer.observe(blockedConnection("192.0.2.7"))
+	assert.Len(t, healer.queue, 2)
+
+	clock.Advance(5 * time.Second)
+	assert.Nil(t, healer.heal(net.ParseIP(<-healer.queue)))
+	assert.True(t, allowed(mgr, "192.0.2.7"))
+	assert.Equal(t, healed+1, dnsHeals.Value())
+	assert.Empty(t, healer.blocked)
+
+	// The address queued twice is allowed by then, and healed once.
+	assert.Nil(t, healer.heal(net.ParseIP(<-healer.queue)))
+	assert.Equal(t, healed+1, dnsHeals.Value())
+
+	// Once healed, the connections to it are no longer queued.
+	healer.observe(blockedConnection("192.0.2.7"))
+	assert.Len(t, healer.queue, 0)
+
+	// The IPv6 addresses are near in the same /48.
+	clock.Advance(time.Minute)
+	healer.observe(blockedConnection("2001:db8:0:ff::7"))
+	assert.Nil(t, healer.heal(net.ParseIP(<-healer.queue)))
+	assert.True(t, allowed(mgr, "2001:db8:0:ff::7"))
+}
+
+func TestDNSHealerNearness(t *testing.T) {
+	resolver := &scriptedResolver{script: map[string][][]string{
+		"a.example.com": {{"192.0.2.1", "2001:db8:1::1"}},
+		"b.example.com": {{"192.0.2.200", "198.51.100.1"}},
+	}}
+	_, healer, _ := newHealTestManager(t, resolver, "b.example.com", "a.example.com")
+
+	assert.Equal(t, []string{"a.example.com", "b.example.com"}, healer.near(net.ParseIP("192.0.2.99")))
+	assert.Equal(t, []string{"b.example.com"}, healer.near(net.ParseIP("198.51.100.254")))
+	assert.Empty(t, healer.near(net.ParseIP("192.0.3.1")))
+	assert.Equal(t, []string{"a.example.com"}, healer.near(net.ParseIP("2001:db8:1:ffff::1")))
+	assert.Empty(t, healer.near(net.ParseIP("2001:db8:2::1")))
+	// The families are never near each other.
+	assert.Empty(t, healer.near(net.ParseIP("::ffff:10.0.0.1")))
+}
+
+func TestDNSHealerIsRateLimitedPerDomain(t *testing.T) {
+	resolver := &scriptedResolver{script: map[string][][]string{
+		"example.com": {{"192.0.2.1"}},
+	}}
+	_, healer, clock := newHealTestManager(t, resolver, "example.com")
+	resolver.queries = nil
+
+	limited := dnsHealsRateLimited.Value()
+	// The domain does not resolve to the blocked address, which stays blocked.
+	healer.observe(blockedConnection("192.0.2.9"))
+	assert.Nil(t, healer.heal(net.ParseIP("192.0.2.9")))
+	assert.Equal(t, []string{"example.com A"}, resolver.queries)
+	assert.Equal(t, 1, healer.blocked["192.0.2.9"].count)
+
+	clock.Advance(29 * time.Second)
+	assert.Nil(t, healer.heal(net.ParseIP("192.0.2.9")))
+	assert.Len(t, resolver.queries, 1)
+	assert.Equal(t, limited+1, dnsHealsRateLimited.Value())
+
+	clock.Advance(time.Second)
+	assert.Nil(t, healer.heal(net.ParseIP("192.0.2.9")))
+	assert.Len(t, resolver.queries, 2)
+}
+
+func TestDNSHealerReverseDNS(t *testing.T) {
+	resolver := &scriptedResolver{script: map[string][][]string{
+		"example.com": {{"192.0.2.1"}, {"203.0.113.5"}},
+	}}
+	mgr, healer, _ := newHealTestManager(t, resolver, "example.com")
+	lookups := []string{}
+	healer.lookupAddr = func(addr string) ([]string, error) {
+		lookups = append(lookups, addr)
+		return []string{"edge-5.cdn.EXAMPLE.com."}, nil
+	}
+
+	// The address is not near, and the reverse DNS is disabled.
+	assert.Nil(t, healer.heal(net.ParseIP("203.0.113.5")))
+	assert.Empty(t, lookups)
+	assert.False(t, allowed(mgr, "203.0.113.5"))
+
+	healer.conf.ReverseDNS = true
+	assert.Nil(t, healer.heal(net.ParseIP("203.0.113.5")))
+	assert.Equal(t, []string{"203.0.113.5"}, lookups)
+	assert.True(t, allowed(mgr, "203.0.113.5"))
+
+	// A PTR record of another domain resolves nothing.
+	healer.lookupAddr = func(addr string) ([]string, error) { return []string{"notexample.com."}, nil }
+	assert.Empty(t, healer.reverse(net.ParseIP("203.0.113.6")))
+}
+
+func TestDNSHealerOnlyHealsTheAddressesNoAllowListEntryMatches(t *testing.T) {
+	resolver := &scriptedResolver{script: map[string][][]string{
+		"example.com": {{"192.0.2.1"}},
+	}}
+	mgr, healer, _ := newHealTestManager(t, resolver, "example.com")
+	mgr.Policy().addCIDR(DENIED_V4_CIDR_LIST_MAP_NAME, PROTOCOL_ALL, &net.IPNet{IP: net.ParseIP("192.0.2.66").To4(), Mask: net.CIDRMask(32, 32)})
+
+	healer.observe(blockedConnection("192.0.2.66"))
+	header, body := blockedConnection("192.0.2.67")
+	allowedBody := body.(detectEventIPv4)
+	allowedBody.Verdict = VERDICT_ALLOW
+	healer.observe(header, allowedBody)
+	assert.Len(t, healer.queue, 0)
+	assert.Empty(t, healer.blocked)
+}
+
+func TestDNSHealerRemembersTheAllowedDomainsOnly(t *testing.T) {
+	resolver := &scriptedResolver{script: map[string][][]string{
+		"allowed.example.com": {{"192.0.2.1"}},
+		"denied.example.com":  {{"198.51.100.1"}},
+	}}
+	conf := config.DefaultConfig()
+	conf.RestrictedNetworkConfig.Domain.Allow = []string{"allowed.example.com"}
+	conf.RestrictedNetworkConfig.Domain.Deny = []string{"denied.example.com"}
+	mgr, err := NewManager(conf, WithMapBackend(bouhekitest.NewMaps()), WithDNSResolver(resolver))
+	assert.Nil(t, err)
+	t.Cleanup(mgr.Close)
+	mgr.healer = newDNSHealer(mgr, config.DomainHealConfig{Enable: true, Interval: time.Second})
+	assert.Nil(t, mgr.SetConfigToMap())
+
+	assert.Equal(t, map[healKey][]net.IP{{"allowed.example.com", false}: {net.ParseIP("192.0.2.1")}}, mgr.healer.addresses)
+	assert.Nil(t, newDNSHealer(mgr, config.DomainHealConfig{Enable: false}))
+}
@@ -1,10 +1,14 @@
 package network
 
 import (
+	"context"
+	"errors"
 	"fmt"
 
 	"github.com/miekg/dns"
 	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/freeze"
+	"github.com/mrtc0/bouheki/pkg/jobs"
 	log "github.com/mrtc0/bouheki/pkg/log"
 )
 
@@ -26,12 +30,12 @@ func dnsResponseToDNSAnswer(response *dns.Msg) *DNSAnswer {
 		case dns.TypeA:
 			if record, ok := answer.(*dns.A); ok {
 				dnsAnswer.Addresses = append(dnsAnswer.Addresses, record.A)
-				dnsAnswer.TTL = record.Hdr.Ttl
+				dnsAnswer.TTL = minTTL(dnsAnswer.TTL, record.Hdr.Ttl, len(dnsAnswer.Addresses) == 1)
 			}
 		case dns.TypeAAAA:
 			if record, ok := answer.(*dns.AAAA); ok {
 				dnsAnswer.Addresses = append(dnsAnswer.Addresses, record.AAAA)
-				dnsAnswer.TTL = record.Hdr.Ttl
+				dnsAnswer.TTL = minTTL(dnsAnswer.TTL, record.Hdr.Ttl, len(dnsAnswer.Addresses) == 1)
 			}
 		}
 	}
@@ -66,18 +70,50 @@ func (this *DNSProxy) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 
 		for _, allowedDomain := range this.manager.config.Domain.Allow {
 			if toFqdn(allowedDomain) == fqdn {
-				this.manager.updateAllowedFQDNist(dnsAnswer)
+				err := this.manager.runJob("dns-proxy "+fqdn, freeze.CHANGE_DNS_REFRESH, func(ctx context.Context) error {
+					return this.manager.updateAllowedFQDNist(dnsAnswer)
+				})
+				if err != nil && !errors.Is(err, jobs.ErrRejected) {
+					log.Error(err)
+				}
 				break
 			}
 		}
 
 		for _, deniedDomain := range this.manager.config.Domain.Deny {
 			if toFqdn(deniedDomain) == fqdn {
-				this.manager.updateDeniedFQDNList(dnsAnswer)
+				err := this.manager.runJob("dns-proxy "+fqdn, freeze.CHANGE_DNS_REFRESH, func(ctx context.Context) error {
+					return this.manager.updateDeniedFQDNList(dnsAnswer)
+				})
+				if err != nil && !errors.Is(err, jobs.ErrRejected) {
+					log.Error(err)
+				}
 				break
 			}
 		}
 
+		for _, list := range protocolDomainLists(this.manager.config.Domain) {
+			list := list
+			for _, domain := range list.domains {
+				if toFqdn(domain) == fqdn {
+					err := this.manager.runJob("dns-proxy "+fqdn, freeze.CHANGE_DNS_REFRESH, func(ctx context.Context) error {
+						return this.manager.updateProtocolFQDNList(dnsAnswer, list.list, list.protocol)
+					})
+					if err != nil && !errors.Is(err, jobs.ErrRejected) {
+						log.Error(err)
+					}
+					break
+				}
+			}
+		}
+
+		err = this.manager.runJob("dns-proxy "+fqdn, freeze.CHANGE_DNS_REFRESH, func(ctx context.Context) error {
+			return this.manager.updateWildcardDomains(dnsAnswer)
+		})
+		if err != nil && !errors.Is(err, jobs.ErrRejected) {
+			log.Error(err)
+		}
+
 		log.Debug(fmt.Sprintf("Domain resolved: %s (%d)\n", fqdn, q.Qtype))
 		log.Debug(fmt.Sprintf("Current DNS Cache: %#v\n", dnsCache))
 	}
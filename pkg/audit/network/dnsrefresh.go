@@ -0,0 +1,373 @@
+package network
+
+import (
+	"container/heap"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/freeze"
+	"github.com/mrtc0/bouheki/pkg/jobs"
+	log "github.com/mrtc0/bouheki/pkg/log"
+)
+
+const (
+	// DNS_REFRESH_PATH is where the next refreshes of the domains are served next to /metrics.
+	DNS_REFRESH_PATH = "/dns-refresh"
+
+	// DNS_RETRY_INTERVAL is when a domain that did not resolve is resolved again.
+	DNS_RETRY_INTERVAL = 5 * time.Second
+
+	// DNS_REFRESH_STATUS_SIZE is the number of refreshes listed in the DNSRefreshStatus.
+	DNS_REFRESH_STATUS_SIZE = 20
+)
+
+// domainRefresh is the next resolution of a record of a domain.
+type domainRefresh struct {
+	domain     string
+	recordType uint16
+	// list is SNAPSHOT_LIST_ALLOW or SNAPSHOT_LIST_DENY, of the protocol lists of protocol
+	// unless it is PROTOCOL_ALL.
+	list     string
+	protocol uint8
+	// policy is the name of the entry of network.policies whose tag protocol is, if set.
+	policy string
+	due    time.Time
+	// index is the position in the refreshQueue.
+	index int
+}
+
+func (r *domainRefresh) mapName() string {
+	switch {
+	case r.policy != "" && r.list == SNAPSHOT_LIST_ALLOW && r.recordType == dns.TypeA:
+		return ALLOWED_V4_ENTRY_CIDR_LIST_MAP_NAME
+	case r.policy != "" && r.list == SNAPSHOT_LIST_ALLOW:
+		return ALLOWED_V6_ENTRY_CIDR_LIST_MAP_NAME
+	case r.policy != "" && r.recordType == dns.TypeA:
+		return DENIED_V4_ENTRY_CIDR_LIST_MAP_NAME
+	case r.policy != "":
+		return DENIED_V6_ENTRY_CIDR_LIST_MAP_NAME
+	case r.protocol != PROTOCOL_ALL && r.list == SNAPSHOT_LIST_ALLOW && r.recordType == dns.TypeA:
+		return ALLOWED_V4_PROTOCOL_CIDR_LIST_MAP_NAME
+	case r.protocol != PROTOCOL_ALL && r.list == SNAPSHOT_LIST_ALLOW:
+		return ALLOWED_V6_PROTOCOL_CIDR_LIST_MAP_NAME
+	case r.protocol != PROTOCOL_ALL && r.recordType == dns.TypeA:
+		return DENIED_V4_PROTOCOL_CIDR_LIST_MAP_NAME
+	case r.protocol != PROTOCOL_ALL:
+		return DENIED_V6_PROTOCOL_CIDR_LIST_MAP_NAME
+	case r.list == SNAPSHOT_LIST_ALLOW && r.recordType == dns.TypeA:
+		return ALLOWED_V4_CIDR_LIST_MAP_NAME
+	case r.list == SNAPSHOT_LIST_ALLOW:
+		return ALLOWED_V6_CIDR_LIST_MAP_NAME
+	case r.recordType == dns.TypeA:
+		return DENIED_V4_CIDR_LIST_MAP_NAME
+	default:
+		return DENIED_V6_CIDR_LIST_MAP_NAME
+	}
+}
+
+func (r *domainRefresh) entry() domainEntry {
+	return domainEntry{domain: r.domain, list: r.list, protocol: r.protocol, policy: r.policy}
+}
+
+func (r *domainRefresh) listName() string {
+	return r.entry().listName()
+}
+
+// refreshQueue is a heap of the refreshes, the earliest due first.
+type refreshQueue []*domainRefresh
+
+func (q refreshQueue) Len() int           { return len(q) }
+func (q refreshQueue) Less(i, j int) bool { return q[i].due.Before(q[j].due) }
+func (q refreshQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index, q[j].index = i, j
+}
+
+func (q *refreshQueue) Push(x interface{}) {
+	r := x.(*domainRefresh)
+	r.index = len(*q)
+	*q = append(*q, r)
+}
+
+func (q *refreshQueue) Pop() interface{} {
+	old := *q
+	r := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return r
+}
+
+// refreshDelay is ttl brought forward by a random fraction of jitter, r in [0, 1).
+// A refresh is never later than the TTL, so that the addresses are never older than the records.
+func refreshDelay(ttl time.Duration, jitter, r float64) time.Duration {
+	return ttl - time.Duration(float64(ttl)*jitter*r)
+}
+
+// recordTTLs are the TTLs of the records of the domains the startup resolved, so that the
+// first refresh of a record is not earlier than needed. The zero value is ready to use.
+type recordTTLs struct {
+	mu   sync.Mutex
+	ttls map[domainEntry]map[uint16]uint32
+}
+
+func (t *recordTTLs) set(entry domainEntry, recordType uint16, ttl uint32) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.ttls == nil {
+		t.ttls = map[domainEntry]map[uint16]uint32{}
+	}
+	if t.ttls[entry] == nil {
+		t.ttls[entry] = map[uint16]uint32{}
+	}
+	t.ttls[entry][recordType] = ttl
+}
+
+func (t *recordTTLs) get(entry domainEntry, recordType uint16) (uint32, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ttl, ok := t.ttls[entry][recordType]
+	return ttl, ok
+}
+
+// dnsScheduler resolves the domains of network.domain again after their TTL.
+//
+// Instead of a timer per domain, the refreshes are kept in one queue and started every tick:
+// at most max_in_flight resolutions run at once, and the addresses of the refreshes of a tick
+// are written by one job. The TTL of every refresh is shortened by a random jitter, so that the
+// domains with the same TTL drift apart instead of resolving together on every cycle.
+type dnsScheduler struct {
+	mgr  *Manager
+	conf config.DomainRefreshConfig
+	// random returns a number in [0, 1). It is only called from the tick.
+	random func() float64
+
+	mu       sync.Mutex
+	queue    refreshQueue
+	inFlight int
+}
+
+func newDNSScheduler(mgr *Manager, random func() float64) *dnsScheduler {
+	domain := mgr.config.RestrictedNetworkConfig.Domain
+	s := &dnsScheduler{mgr: mgr, conf: domain.Refresh, random: random}
+
+	now := mgr.now()
+	lists := append([]domainList{
+		{list: SNAPSHOT_LIST_ALLOW, domains: domain.Allow},
+		{list: SNAPSHOT_LIST_DENY, domains: domain.Deny},
+	}, protocolDomainLists(domain)...)
+	lists = append(lists, policyDomainLists(mgr.config.RestrictedNetworkConfig.PolicyEntries())...)
+	for _, list := range lists {
+		for _, name := range list.domains {
+			for _, recordType := range []uint16{dns.TypeA, dns.TypeAAAA} {
+				if mgr.disabledFamilies()&recordTypeFamily(recordType) != 0 {
+					continue
+				}
+				r := &domainRefresh{domain: name, recordType: recordType, list: list.list, protocol: list.protocol, policy: list.policy}
+				r.due = now.Add(refreshDelay(s.initialDelay(r), s.conf.Jitter, random()))
+				heap.Push(&s.queue, r)
+			}
+		}
+	}
+	return s
+}
+
+// initialDelay is when r is first refreshed: after the TTL hint of the preload file, or the TTL
+// of the records the startup resolved. A record that did not resolve is refreshed right away.
+func (s *dnsScheduler) initialDelay(r *domainRefresh) time.Duration {
+	delay := s.mgr.initialRefreshDelay(r.domain, r.mapName())
+	if delay == 0 {
+		ttl, ok := s.mgr.startupTTLs.get(r.entry(), r.recordType)
+		if !ok {
+			return 0
+		}
+		delay = time.Duration(ttl) * time.Second
+	}
+	return s.conf.Interval(delay)
+}
+
+func (s *dnsScheduler) run() {
+	for {
+		if err := s.tick(); err == jobs.ErrStopped {
+			return
+		}
+		s.mgr.sleep(s.conf.Tick)
+	}
+}
+
+// tick resolves the refreshes that are due, writes their addresses and schedules them again.
+func (s *dnsScheduler) tick() error {
+	now := s.mgr.now()
+
+	s.mu.Lock()
+	due := []*domainRefresh{}
+	for len(s.queue) > 0 && !s.queue[0].due.After(now) {
+		due = append(due, heap.Pop(&s.queue).(*domainRefresh))
+	}
+	s.mu.Unlock()
+	if len(due) == 0 {
+		return nil
+	}
+
+	answers := s.resolve(due)
+
+	name := fmt.Sprintf("dns-refresh %d domains", len(due))
+	if len(due) == 1 {
+		name = "dns-refresh " + due[0].domain
+	}
+	err := s.mgr.runJob(name, freeze.CHANGE_DNS_REFRESH, func(ctx context.Context) error {
+		for i, r := range due {
+			if answers[i] == nil {
+				continue
+			}
+			if err := s.update(r, answers[i]); err != nil {
+				log.Error(fmt.Errorf("failed to update the addresses of %s: %w", r.domain, err))
+				answers[i] = nil
+			}
+		}
+		return nil
+	})
+	if err != nil && err != jobs.ErrStopped && !errors.Is(err, jobs.ErrRejected) {
+		log.Error(err)
+	}
+
+	if err == nil {
+		for i, r := range due {
+			unresolved, changed := s.mgr.unresolved.record(r.entry(), r.recordType, answers[i] != nil)
+			switch {
+			case changed && unresolved:
+				log.Warn(fmt.Sprintf("%s (%s) no longer resolves, it is resolved again every %s", r.domain, r.listName(), DNS_RETRY_INTERVAL))
+			case changed:
+				log.Info(fmt.Sprintf("%s (%s) resolves again", r.domain, r.listName()))
+			}
+		}
+	}
+
+	s.mu.Lock()
+	for i, r := range due {
+		ttl := DNS_RETRY_INTERVAL
+		if err == nil && answers[i] != nil {
+			ttl = s.conf.Interval(time.Duration(answers[i].TTL) * time.Second)
+		}
+		r.due = now.Add(refreshDelay(ttl, s.conf.Jitter, s.random()))
+		heap.Push(&s.queue, r)
+	}
+	s.mu.Unlock()
+
+	return err
+}
+
+// resolve resolves the refreshes with at most max_in_flight resolutions at once. The answer of
+// a refresh that did not resolve is nil.
+func (s *dnsScheduler) resolve(due []*domainRefresh) []*DNSAnswer {
+	answers := make([]*DNSAnswer, len(due))
+	next := make(chan int)
+	wg := sync.WaitGroup{}
+	for w := 0; w < s.conf.MaxInFlight && w < len(due); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				s.setInFlight(1)
+				answer, err := s.mgr.dnsResolver.Resolve(due[i].domain, due[i].recordType)
+				s.setInFlight(-1)
+				if err != nil {
+					log.Debug(fmt.Sprintf("%s (%s) resolve failed. %s\n", due[i].domain, dns.TypeToString[due[i].recordType], err))
+					continue
+				}
+				log.Debug(fmt.Sprintf("%s (%s) is %#v, TTL is %d\n", answer.Domain, dns.TypeToString[due[i].recordType], answer.Addresses, answer.TTL))
+				answers[i] = answer
+			}
+		}()
+	}
+	for i := range due {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	return answers
+}
+
+func (s *dnsScheduler) setInFlight(delta int) {
+	s.mu.Lock()
+	s.inFlight += delta
+	s.mu.Unlock()
+}
+
+func (s *dnsScheduler) update(r *domainRefresh, answer *DNSAnswer) error {
+	if r.policy != "" {
+		return s.mgr.updateEntryFQDNList(answer, r.list, r.protocol)
+	}
+	if r.protocol != PROTOCOL_ALL {
+		return s.mgr.updateProtocolFQDNList(answer, r.list, r.protocol)
+	}
+	if r.list == SNAPSHOT_LIST_DENY {
+		return s.mgr.updateDeniedFQDNList(answer)
+	}
+	return s.mgr.updateAllowedFQDNist(answer)
+}
+
+// DomainRefreshInfo is a scheduled resolution of a domain.
+type DomainRefreshInfo struct {
+	Domain string    `json:"domain"`
+	Type   string    `json:"type"`
+	List   string    `json:"list"`
+	Due    time.Time `json:"due"`
+}
+
+// DNSRefreshStatus is the state of the dnsScheduler, as shown by `bouheki status --dns`.
+type DNSRefreshStatus struct {
+	Scheduled int `json:"scheduled"`
+	InFlight  int `json:"in_flight"`
+	// Next are the DNS_REFRESH_STATUS_SIZE next refreshes, the earliest first.
+	Next []DomainRefreshInfo `json:"next"`
+}
+
+func (s *dnsScheduler) Status() DNSRefreshStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	queue := append(refreshQueue{}, s.queue...)
+	sort.Slice(queue, func(i, j int) bool { return queue[i].due.Before(queue[j].due) })
+	if len(queue) > DNS_REFRESH_STATUS_SIZE {
+		queue = queue[:DNS_REFRESH_STATUS_SIZE]
+	}
+
+	status := DNSRefreshStatus{Scheduled: len(s.queue), InFlight: s.inFlight, Next: []DomainRefreshInfo{}}
+	for _, r := range queue {
+		status.Next = append(status.Next, DomainRefreshInfo{
+			Domain: r.domain,
+			Type:   dns.TypeToString[r.recordType],
+			List:   r.listName(),
+			Due:    r.due.UTC(),
+		})
+	}
+	return status
+}
+
+type dnsRefreshStatus struct {
+	mgr *Manager
+}
+
+// ServeHTTP writes the DNSRefreshStatus as JSON. It is empty until AsyncResolve is called,
+// and with the DNS proxy, which does not resolve the domains on a schedule.
+func (s dnsRefreshStatus) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mgr.mu.Lock()
+	scheduler := s.mgr.dnsRefresh
+	s.mgr.mu.Unlock()
+
+	status := DNSRefreshStatus{Next: []DomainRefreshInfo{}}
+	if scheduler != nil {
+		status = scheduler.Status()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
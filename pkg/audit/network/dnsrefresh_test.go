@@ -0,0 +1,210 @@
+package network
+
+import (
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/mrtc0/bouheki/pkg/bouhekitest"
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestScheduler returns a scheduler of refreshes instead of the domains of the config of mgr.
+func newTestScheduler(mgr *Manager, refreshes ...*domainRefresh) *dnsScheduler {
+	s := &dnsScheduler{mgr: mgr, conf: mgr.config.RestrictedNetworkConfig.Domain.Refresh, random: rand.New(rand.NewSource(1)).Float64}
+	for _, r := range refreshes {
+		heap.Push(&s.queue, r)
+	}
+	return s
+}
+
+// countingResolver answers every query with the same address, and counts the queries and how
+// many of them run at once.
+type countingResolver struct {
+	mu          sync.Mutex
+	ttl         uint32
+	queries     int
+	inFlight    int
+	maxInFlight int
+	// delay keeps the queries in flight.
+	delay time.Duration
+}
+
+func (r *countingResolver) Resolve(host string, recordType uint16) (*DNSAnswer, error) {
+	r.mu.Lock()
+	r.queries++
+	r.inFlight++
+	if r.inFlight > r.maxInFlight {
+		r.maxInFlight = r.inFlight
+	}
+	r.mu.Unlock()
+
+	time.Sleep(r.delay)
+
+	r.mu.Lock()
+	r.inFlight--
+	r.mu.Unlock()
+
+	address := net.ParseIP("192.0.2.1")
+	if recordType == dns.TypeAAAA {
+		address = net.ParseIP("2001:db8::1")
+	}
+	return &DNSAnswer{Domain: host, Addresses: []net.IP{address}, TTL: r.ttl}, nil
+}
+
+func (r *countingResolver) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	queries := r.queries
+	r.queries = 0
+	return queries
+}
+
+func newRefreshTestManager(t *testing.T, domains int, resolver DNSResolver) (*Manager, *bouhekitest.Maps, *bouhekitest.Clock) {
+	conf := config.DefaultConfig()
+	conf.RestrictedNetworkConfig.CIDR.Allow = []string{}
+	for i := 0; i < domains; i++ {
+		conf.RestrictedNetworkConfig.Domain.Allow = append(conf.RestrictedNetworkConfig.Domain.Allow, fmt.Sprintf("host-%d.example.com", i))
+	}
+	clock := bouhekitest.NewClock(time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC))
+	maps := bouhekitest.NewMaps()
+	mgr, err := NewManager(conf, WithMapBackend(maps), WithClock(clock), WithDNSResolver(resolver))
+	assert.Nil(t, err)
+	t.Cleanup(mgr.Close)
+	return mgr, maps, clock
+}
+
+func TestRefreshDelayIsNeverLaterThanTheTTL(t *testing.T) {
+	assert.Equal(t, 300*time.Second, refreshDelay(300*time.Second, 0.1, 0))
+	assert.Equal(t, 285*time.Second, refreshDelay(300*time.Second, 0.1, 0.5))
+	assert.True(t, refreshDelay(300*time.Second, 0.1, 0.9999) > 270*time.Second)
+	assert.Equal(t, 300*time.Second, refreshDelay(300*time.Second, 0, 0.5))
+	assert.Equal(t, time.Duration(0), refreshDelay(0, 0.1, 0.5))
+}
+
+// Thousands of domains that resolve together with the same TTL are spread over the jitter of the
+// TTL on the next cycle, and further apart on every cycle after.
+func TestRefreshesAreSpreadOverTheJitter(t *testing.T) {
+	const domains = 2500
+	resolver := &countingResolver{ttl: 300}
+	mgr, _, clock := newRefreshTestManager(t, domains, resolver)
+	s := newDNSScheduler(mgr, rand.New(rand.NewSource(1)).Float64)
+	start := clock.Now()
+
+	// Without a preload file, every domain is refreshed right away.
+	assert.Nil(t, s.tick())
+	assert.Equal(t, 2*domains, resolver.count())
+
+	// maxPerTick is the largest number of queries of a tick in each cycle of the TTL.
+	maxPerTick := map[int]int{}
+	total := map[int]int{}
+	for clock.Now().Sub(start) < 3*300*time.Second {
+		clock.Advance(mgr.config.RestrictedNetworkConfig.Domain.Refresh.Tick)
+		assert.Nil(t, s.tick())
+
+		elapsed := clock.Now().Sub(start)
+		queries := resolver.count()
+		cycle := int((elapsed - time.Nanosecond) / (300 * time.Second))
+		total[cycle] += queries
+		if queries > maxPerTick[cycle] {
+			maxPerTick[cycle] = queries
+		}
+		// No refresh is due in the first 90% of the TTL of the first cycle.
+		if elapsed <= 270*time.Second {
+			assert.Zero(t, queries, elapsed)
+		}
+	}
+
+	// Every record is refreshed once per TTL at most.
+	assert.Equal(t, 2*domains, total[0])
+	// Spread evenly over the 30 seconds of jitter, a tick takes about 2*domains/30 queries.
+	assert.Less(t, maxPerTick[0], 2*2*domains/30)
+	assert.Less(t, maxPerTick[1], maxPerTick[0])
+	assert.Less(t, maxPerTick[2], maxPerTick[1])
+}
+
+func TestRefreshIsScheduledAfterTheTTLBetweenTheIntervals(t *testing.T) {
+	resolver := &countingResolver{ttl: 1}
+	mgr, _, clock := newRefreshTestManager(t, 1, resolver)
+	mgr.config.RestrictedNetworkConfig.Domain.Refresh.Jitter = 0
+	assert.Nil(t, mgr.SetConfigToMap())
+	assert.Equal(t, 2, resolver.count())
+
+	// The first refresh is after the TTL the startup resolved, raised to min_interval.
+	s := newDNSScheduler(mgr, rand.New(rand.NewSource(1)).Float64)
+	assert.Equal(t, clock.Now().Add(10*time.Second), s.Status().Next[0].Due)
+	clock.Advance(9 * time.Second)
+	assert.Nil(t, s.tick())
+	assert.Equal(t, 0, resolver.count())
+
+	// A TTL of a day is lowered to max_interval.
+	resolver.ttl = 86400
+	clock.Advance(time.Second)
+	assert.Nil(t, s.tick())
+	assert.Equal(t, 2, resolver.count())
+	assert.Equal(t, clock.Now().Add(time.Hour), s.Status().Next[0].Due)
+}
+
+func TestRefreshResolvesAtMostMaxInFlightAndWritesOneJobPerTick(t *testing.T) {
+	resolver := &countingResolver{ttl: 300, delay: time.Millisecond}
+	mgr, maps, _ := newRefreshTestManager(t, 50, resolver)
+	mgr.config.RestrictedNetworkConfig.Domain.Refresh.MaxInFlight = 4
+	s := newDNSScheduler(mgr, rand.New(rand.NewSource(1)).Float64)
+
+	assert.Nil(t, s.tick())
+	assert.Equal(t, 100, resolver.count())
+	assert.Equal(t, 4, resolver.maxInFlight)
+
+	history := mgr.Jobs().Status().History
+	assert.Len(t, history, 1)
+	assert.Equal(t, "dns-refresh 100 domains", history[0].Name)
+	assert.Len(t, maps.Entries(ALLOWED_V4_CIDR_LIST_MAP_NAME), 1)
+	assert.Len(t, maps.Entries(ALLOWED_V6_CIDR_LIST_MAP_NAME), 1)
+}
+
+func TestRefreshRetriesTheDomainsThatDoNotResolve(t *testing.T) {
+	mgr, _, clock := newRefreshTestManager(t, 0, aaaaResolver{"example.com": []net.IP{net.ParseIP("2001:db8::1")}})
+	s := newTestScheduler(mgr,
+		&domainRefresh{domain: "example.com", recordType: dns.TypeA, list: SNAPSHOT_LIST_ALLOW, due: clock.Now()},
+		&domainRefresh{domain: "example.com", recordType: dns.TypeAAAA, list: SNAPSHOT_LIST_ALLOW, due: clock.Now()},
+	)
+
+	assert.Nil(t, s.tick())
+	status := s.Status()
+	assert.Equal(t, 2, status.Scheduled)
+	// The A record is tried again after DNS_RETRY_INTERVAL, the AAAA record after its TTL.
+	assert.Equal(t, "A", status.Next[0].Type)
+	assert.True(t, status.Next[0].Due.After(clock.Now().Add(DNS_RETRY_INTERVAL*9/10)))
+	assert.False(t, status.Next[0].Due.After(clock.Now().Add(DNS_RETRY_INTERVAL)))
+	assert.Equal(t, "AAAA", status.Next[1].Type)
+	assert.True(t, status.Next[1].Due.After(clock.Now().Add(270*time.Second)))
+}
+
+func TestDNSRefreshStatus(t *testing.T) {
+	mgr, _, clock := newRefreshTestManager(t, 30, &countingResolver{ttl: 300})
+
+	status := DNSRefreshStatus{}
+	rec := httptest.NewRecorder()
+	dnsRefreshStatus{mgr: mgr}.ServeHTTP(rec, httptest.NewRequest("GET", DNS_REFRESH_PATH, nil))
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&status))
+	assert.Equal(t, DNSRefreshStatus{Next: []DomainRefreshInfo{}}, status)
+
+	s := newDNSScheduler(mgr, rand.New(rand.NewSource(1)).Float64)
+	assert.Nil(t, s.tick())
+	status = s.Status()
+	assert.Equal(t, 60, status.Scheduled)
+	assert.Len(t, status.Next, DNS_REFRESH_STATUS_SIZE)
+	for i := 1; i < len(status.Next); i++ {
+		assert.False(t, status.Next[i].Due.Before(status.Next[i-1].Due))
+	}
+	assert.True(t, status.Next[0].Due.After(clock.Now()))
+}
@@ -0,0 +1,143 @@
+package network
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	log "github.com/mrtc0/bouheki/pkg/log"
+)
+
+const (
+	AUDIT_EVENT_STATS_MAP_NAME = "audit_event_stats"
+	// AUDIT_EVENTS_MAP_NAME is the ring buffer of the events, sized by network.audit.ringbuf_size.
+	AUDIT_EVENTS_MAP_NAME = "audit_events"
+
+	// enum audit_event_stat of the BPF program.
+	AUDIT_EVENTS_SUBMITTED  uint32 = 0
+	AUDIT_EVENTS_DROPPED    uint32 = 1
+	AUDIT_EVENTS_SUPPRESSED uint32 = 2
+	AUDIT_EVENTS_REPEATED   uint32 = 3
+
+	// DRAIN_POLL_INTERVAL is how often Drain compares the events reported with the events emitted.
+	DRAIN_POLL_INTERVAL = 10 * time.Millisecond
+)
+
+// eventStats are the counters of AUDIT_EVENT_STATS_MAP_NAME.
+type eventStats struct {
+	Submitted  uint64
+	Dropped    uint64
+	Suppressed uint64
+	Repeated   uint64
+}
+
+// DrainReport is the outcome of Drain, written to the shutdown report.
+type DrainReport struct {
+	// Submitted is the number of events the programs wrote to the ring buffer.
+	Submitted uint64
+	// Drained is the number of events the consumer reported before the ring buffer was closed.
+	Drained uint64
+	// Dropped is the number of events the programs could not write because the ring buffer was full.
+	Dropped uint64
+	// Suppressed is the number of decisions made after the programs were quiesced.
+	Suppressed uint64
+	// DeadlineHit is set if network.shutdown.drain_timeout passed before every event was reported.
+	DeadlineHit bool
+	Duration    time.Duration
+}
+
+// Lost is the number of events written to the ring buffer that were not reported.
+func (r DrainReport) Lost() uint64 {
+	if r.Drained >= r.Submitted {
+		return 0
+	}
+	return r.Submitted - r.Drained
+}
+
+// Ack records that the consumer of the events channel has reported an event.
+// It must be called once for every event received, including the ones that fail to parse.
+func (m *Manager) Ack() {
+	atomic.AddUint64(&m.reported, 1)
+}
+
+// Drain closes the Manager once the events already emitted by the programs are reported.
+//
+// The job queue is stopped first, then the programs are quiesced: they keep enforcing the
+// policy but emit no new event. Drain then waits until the consumer has acknowledged every
+// event the programs wrote to the ring buffer, or timeout passes, and closes the Manager.
+// The consumer must keep reading the events channel until it is closed.
+func (m *Manager) Drain(timeout time.Duration) DrainReport {
+	start := time.Now()
+	report := DrainReport{}
+
+	m.Jobs().Stop()
+	if err := m.quiesce(); err != nil {
+		log.Error(fmt.Errorf("failed to quiesce the network programs: %w", err))
+	}
+
+	m.mu.Lock()
+	started := m.state == stateStarted
+	m.mu.Unlock()
+
+	deadline := start.Add(timeout)
+	for {
+		stats, err := m.eventStats()
+		if err != nil {
+			log.Error(fmt.Errorf("failed to read the event counters, closing without draining: %w", err))
+			break
+		}
+		report.Submitted, report.Dropped, report.Suppressed = stats.Submitted, stats.Dropped, stats.Suppressed
+		report.Drained = atomic.LoadUint64(&m.reported)
+
+		// Events of a Manager that was never started have nobody to read them.
+		if !started || report.Drained >= report.Submitted {
+			break
+		}
+		if !time.Now().Before(deadline) {
+			report.DeadlineHit = true
+			break
+		}
+		time.Sleep(DRAIN_POLL_INTERVAL)
+	}
+
+	m.Close()
+	report.Duration = time.Since(start)
+
+	return report
+}
+
+// quiesce rewrites the config map with the quiesced flag set.
+func (m *Manager) quiesce() error {
+	m.quiesced = true
+	return m.applyConfig()
+}
+
+func (m *Manager) eventStats() (eventStats, error) {
+	if m.readEventStats != nil {
+		return m.readEventStats()
+	}
+	if m.mod == nil {
+		return eventStats{}, ErrNoProgram
+	}
+
+	bpfMap, err := m.mod.GetMap(AUDIT_EVENT_STATS_MAP_NAME)
+	if err != nil {
+		return eventStats{}, err
+	}
+
+	counters := []uint64{}
+	for _, key := range []uint32{AUDIT_EVENTS_SUBMITTED, AUDIT_EVENTS_DROPPED, AUDIT_EVENTS_SUPPRESSED, AUDIT_EVENTS_REPEATED} {
+		value, err := bpfMap.GetValue(unsafe.Pointer(&key))
+		if err != nil {
+			return eventStats{}, err
+		}
+		if len(value) < 8 {
+			return eventStats{}, fmt.Errorf("%s: unexpected value size %d", AUDIT_EVENT_STATS_MAP_NAME, len(value))
+		}
+		counters = append(counters, binary.LittleEndian.Uint64(value))
+	}
+
+	return eventStats{Submitted: counters[0], Dropped: counters[1], Suppressed: counters[2], Repeated: counters[3]}, nil
+}
@@ -0,0 +1,136 @@
+package network
+
+import (
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/bouhekitest"
+	"github.com/mrtc0/bouheki/pkg/jobs"
+	"github.com/stretchr/testify/assert"
+)
+
+// drainTestRingBuffer hands out events slowly from a goroutine, and discards the
+// unread ones on Stop like libbpfgo does.
+type drainTestRingBuffer struct {
+	eventsChannel chan []byte
+	events        int
+	stop          chan struct{}
+	wg            sync.WaitGroup
+	stopOnce      sync.Once
+}
+
+func (rb *drainTestRingBuffer) Start() {
+	rb.stop = make(chan struct{})
+	rb.wg.Add(1)
+	go func() {
+		defer rb.wg.Done()
+		for i := 0; i < rb.events; i++ {
+			select {
+			case rb.eventsChannel <- []byte{byte(i)}:
+			case <-rb.stop:
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+}
+
+func (rb *drainTestRingBuffer) Stop() {
+	rb.stopOnce.Do(func() {
+		close(rb.stop)
+		go func() {
+			for range rb.eventsChannel {
+			}
+		}()
+		rb.wg.Wait()
+		close(rb.eventsChannel)
+	})
+}
+
+func (rb *drainTestRingBuffer) Close() {
+	rb.Stop()
+}
+
+// newDrainTestManager returns a started Manager whose programs wrote submitted events,
+// of which the ring buffer hands out delivered.
+func newDrainTestManager(t *testing.T, submitted, delivered int) (*Manager, *bouhekitest.Maps, chan []byte) {
+	maps := bouhekitest.NewMaps()
+	mgr := &Manager{config: stateTestConfig(), backend: maps}
+	assert.Nil(t, mgr.SetConfigToMap())
+
+	mgr.readEventStats = func() (eventStats, error) {
+		return eventStats{Submitted: uint64(submitted)}, nil
+	}
+	mgr.initRingBuf = func(eventsChannel chan []byte) (ringBuffer, error) {
+		return &drainTestRingBuffer{eventsChannel: eventsChannel, events: delivered}, nil
+	}
+
+	eventsChannel := make(chan []byte)
+	assert.Nil(t, mgr.Start(eventsChannel))
+	return mgr, maps, eventsChannel
+}
+
+// consume reads eventsChannel like RunAudit, slowly, until it is closed.
+func consume(mgr *Manager, eventsChannel chan []byte) (*int64, chan struct{}) {
+	var reported int64
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range eventsChannel {
+			time.Sleep(time.Millisecond)
+			atomic.AddInt64(&reported, 1)
+			mgr.Ack()
+		}
+	}()
+	return &reported, done
+}
+
+func TestDrainReportsEveryEmittedEvent(t *testing.T) {
+	mgr, maps, eventsChannel := newDrainTestManager(t, 50, 50)
+	reported, done := consume(mgr, eventsChannel)
+
+	report := mgr.Drain(5 * time.Second)
+	<-done
+
+	assert.Equal(t, int64(50), atomic.LoadInt64(reported))
+	assert.Equal(t, uint64(50), report.Drained)
+	assert.Equal(t, uint64(0), report.Lost())
+	assert.False(t, report.DeadlineHit)
+
+	// The programs were told to stop emitting events, and no job runs anymore.
+	value := maps.Entries(RESTRICT_NETWORK_CONFIG_MAP_NAME)[string([]byte{0})]
+	assert.Equal(t, uint32(1), binary.LittleEndian.Uint32(value[MAP_QUIESCED_INDEX:MAP_QUIESCED_INDEX+4]))
+	_, err := mgr.Jobs().Submit("after-drain", nil)
+	assert.ErrorIs(t, err, jobs.ErrStopped)
+}
+
+func TestDrainStopsAtTheDeadline(t *testing.T) {
+	// 5 events never reach the consumer.
+	mgr, _, eventsChannel := newDrainTestManager(t, 15, 10)
+	_, done := consume(mgr, eventsChannel)
+
+	report := mgr.Drain(100 * time.Millisecond)
+	<-done
+
+	assert.True(t, report.DeadlineHit)
+	assert.Equal(t, uint64(10), report.Drained)
+	assert.Equal(t, uint64(5), report.Lost())
+	assert.GreaterOrEqual(t, report.Duration, 100*time.Millisecond)
+}
+
+func TestDrainOfAManagerThatWasNotStarted(t *testing.T) {
+	maps := bouhekitest.NewMaps()
+	mgr := &Manager{config: stateTestConfig(), backend: maps}
+	assert.Nil(t, mgr.SetConfigToMap())
+	mgr.readEventStats = func() (eventStats, error) {
+		return eventStats{Submitted: 3}, nil
+	}
+
+	report := mgr.Drain(time.Minute)
+	assert.False(t, report.DeadlineHit)
+	assert.Equal(t, uint64(3), report.Lost())
+	assert.Less(t, report.Duration, time.Minute)
+}
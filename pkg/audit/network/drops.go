@@ -0,0 +1,62 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/mrtc0/bouheki/pkg/log"
+	"github.com/mrtc0/bouheki/pkg/metrics"
+)
+
+// DROPPED_EVENTS_REPORT_INTERVAL is how often the events dropped by the programs are reported.
+const DROPPED_EVENTS_REPORT_INTERVAL = time.Minute
+
+var droppedEvents = metrics.NewCounter("network_audit_events_dropped_total", "Number of audit events the programs could not write because the ring buffer was full.")
+
+// dropReporter reports the events the programs dropped since its last report, so that the
+// consumers of the events know that they missed some. It reads the counters of
+// AUDIT_EVENT_STATS_MAP_NAME, which the ring buffer does not count itself.
+type dropReporter struct {
+	stats func() (eventStats, error)
+	// dropped is the number of dropped events reported so far.
+	dropped uint64
+	last    time.Time
+	now     func() time.Time
+}
+
+func newDropReporter(mgr *Manager) *dropReporter {
+	return &dropReporter{stats: mgr.eventStats, last: mgr.now(), now: mgr.now}
+}
+
+func (r *dropReporter) run(ctx context.Context) {
+	ticker := time.NewTicker(DROPPED_EVENTS_REPORT_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.report()
+		}
+	}
+}
+
+// report logs the events dropped since the last report, if any, as an audit event.
+func (r *dropReporter) report() {
+	stats, err := r.stats()
+	if err != nil {
+		log.Debug(fmt.Sprintf("Failed to read the dropped events: %s", err))
+		return
+	}
+	if stats.Dropped <= r.dropped {
+		return
+	}
+
+	now := r.now()
+	dropped := stats.Dropped - r.dropped
+	droppedEvents.Add(dropped)
+	(&log.DroppedEventsLog{Audit: "network", Dropped: dropped, Total: stats.Dropped, Since: r.last}).Warn()
+	r.dropped, r.last = stats.Dropped, now
+}
@@ -0,0 +1,56 @@
+package network
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/mrtc0/bouheki/pkg/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDropReporterReportsTheEventsDroppedSinceTheLastReport(t *testing.T) {
+	output := captureLog(t)
+	stats := eventStats{}
+	var statsErr error
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	r := &dropReporter{
+		stats: func() (eventStats, error) { return stats, statsErr },
+		last:  now,
+		now:   func() time.Time { return now },
+	}
+	before := droppedEvents.Value()
+
+	// Nothing is reported without drops.
+	r.report()
+	assert.Equal(t, "", output())
+
+	stats.Dropped = 3
+	now = now.Add(time.Minute)
+	r.report()
+	stats.Dropped = 5
+	now = now.Add(time.Minute)
+	r.report()
+	// The counters can not be read: the drops are reported with the next read.
+	statsErr = errors.New("closed")
+	r.report()
+
+	lines := strings.Split(strings.TrimSpace(output()), "\n")
+	assert.Len(t, lines, 2)
+	assert.Contains(t, lines[0], `"Dropped":3`)
+	assert.Contains(t, lines[0], `"Total":3`)
+	assert.Contains(t, lines[0], `"Since":"2022-01-01T00:00:00Z"`)
+	assert.Contains(t, lines[1], `"Dropped":2`)
+	assert.Contains(t, lines[1], `"Total":5`)
+	assert.Contains(t, lines[1], `"Since":"2022-01-01T00:01:00Z"`)
+	assert.Contains(t, lines[1], log.EVENTS_DROPPED_MESSAGE)
+	assert.Equal(t, uint64(5), droppedEvents.Value()-before)
+}
+
+func TestWithRingBufSizesTheRingBufferOnlyIfSet(t *testing.T) {
+	sizes := MapSizes{ALLOWED_V4_CIDR_LIST_MAP_NAME: 256}
+	assert.Equal(t, sizes, sizes.withRingBuf(0))
+	assert.Equal(t, MapSizes{ALLOWED_V4_CIDR_LIST_MAP_NAME: 256, AUDIT_EVENTS_MAP_NAME: 1 << 20}, sizes.withRingBuf(1<<20))
+	assert.NotContains(t, sizes.withRingBuf(1<<20).Names(), AUDIT_EVENTS_MAP_NAME)
+}
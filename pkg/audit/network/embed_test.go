@@ -0,0 +1,124 @@
+package network_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/mrtc0/bouheki/pkg/audit/network"
+	"github.com/mrtc0/bouheki/pkg/bouhekitest"
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// These tests only use the exported API, as a program that embeds the Manager would.
+
+// resolver answers the A records of its addresses, and fails any other query.
+type resolver struct {
+	mu        sync.Mutex
+	addresses map[string][]net.IP
+}
+
+func (r *resolver) Resolve(host string, recordType uint16) (*network.DNSAnswer, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if addresses, ok := r.addresses[host]; ok && recordType == dns.TypeA {
+		return &network.DNSAnswer{Domain: host, Addresses: addresses, TTL: 60}, nil
+	}
+	return nil, errors.New("no answer")
+}
+
+func (r *resolver) set(host string, addresses ...net.IP) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.addresses[host] = addresses
+}
+
+func embedTestConfig() *config.Config {
+	conf := config.DefaultConfig()
+	conf.RestrictedNetworkConfig.Mode = "block"
+	conf.RestrictedNetworkConfig.CIDR.Allow = []string{}
+	conf.RestrictedNetworkConfig.Domain.Allow = []string{"example.com"}
+	return conf
+}
+
+func allowed(mgr *network.Manager, addr string) bool {
+	return !mgr.Policy().Evaluate(network.Connection{Addr: net.ParseIP(addr)}).Denied
+}
+
+func TestEmbeddedManagerRefreshesDomains(t *testing.T) {
+	maps := bouhekitest.NewMaps()
+	clk := bouhekitest.NewClock(time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC))
+	dnsResolver := &resolver{addresses: map[string][]net.IP{"example.com": {net.ParseIP("192.0.2.1")}}}
+
+	mgr, err := network.NewManager(embedTestConfig(), network.WithMapBackend(maps), network.WithClock(clk), network.WithDNSResolver(dnsResolver))
+	assert.Nil(t, err)
+	defer mgr.Close()
+
+	assert.Nil(t, mgr.SetConfigToMap())
+	assert.Len(t, maps.Entries(network.ALLOWED_V4_CIDR_LIST_MAP_NAME), 1)
+	assert.True(t, allowed(mgr, "192.0.2.1"))
+	assert.False(t, allowed(mgr, "192.0.2.2"))
+
+	// The refreshes wait for the next tick.
+	mgr.AsyncResolve()
+	clk.BlockUntil(1)
+
+	dnsResolver.set("example.com", net.ParseIP("192.0.2.2"))
+	clk.Advance(time.Minute)
+	assert.Eventually(t, func() bool { return allowed(mgr, "192.0.2.2") }, time.Second, time.Millisecond)
+	// The address the domain no longer resolves to is removed.
+	assert.Len(t, maps.Entries(network.ALLOWED_V4_CIDR_LIST_MAP_NAME), 1)
+	assert.False(t, allowed(mgr, "192.0.2.1"))
+
+	assert.ErrorIs(t, mgr.Attach(), network.ErrNoProgram)
+	assert.ErrorIs(t, mgr.Start(make(chan []byte)), network.ErrNoProgram)
+}
+
+func TestEmbeddedManagerExpiresPreloadedAddresses(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+
+	maps := bouhekitest.NewMaps()
+	clk := bouhekitest.NewClock(time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC))
+
+	signed, err := network.SignDomainSnapshot(&network.DomainSnapshot{
+		Version:   network.DOMAIN_SNAPSHOT_VERSION,
+		CreatedAt: clk.Now(),
+		Entries: []network.DomainSnapshotEntry{
+			{Domain: "example.com", List: network.SNAPSHOT_LIST_ALLOW, RecordType: "A", Addresses: []string{"192.0.2.10"}, TTL: 60, ResolvedAt: clk.Now()},
+		},
+	}, private)
+	assert.Nil(t, err)
+	file := filepath.Join(t.TempDir(), "domains.json")
+	assert.Nil(t, os.WriteFile(file, signed, 0600))
+
+	conf := embedTestConfig()
+	conf.RestrictedNetworkConfig.Domain.PreloadFile = file
+	conf.RestrictedNetworkConfig.Domain.PreloadPublicKey = base64.StdEncoding.EncodeToString(public)
+
+	// example.com never resolves, so the preloaded address is never confirmed.
+	mgr, err := network.NewManager(conf, network.WithMapBackend(maps), network.WithClock(clk), network.WithDNSResolver(&resolver{addresses: map[string][]net.IP{}}))
+	assert.Nil(t, err)
+	defer mgr.Close()
+
+	assert.Nil(t, mgr.SetConfigToMap())
+	assert.True(t, allowed(mgr, "192.0.2.10"))
+
+	// The expiry, and the refreshes.
+	mgr.AsyncResolve()
+	clk.BlockUntil(2)
+
+	clk.Advance(network.PRELOAD_MIN_LIFETIME + network.PRELOAD_EXPIRE_INTERVAL)
+	assert.Eventually(t, func() bool { return !allowed(mgr, "192.0.2.10") }, time.Second, time.Millisecond)
+	assert.Empty(t, maps.Entries(network.ALLOWED_V4_CIDR_LIST_MAP_NAME))
+}
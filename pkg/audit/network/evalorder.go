@@ -0,0 +1,64 @@
+package network
+
+import (
+	"encoding/binary"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/policy"
+)
+
+const (
+	CHECK_ACTIVE  = policy.CHECK_ACTIVE
+	CHECK_SKIPPED = policy.CHECK_SKIPPED
+
+	TRACE_PASS         = policy.TRACE_PASS
+	TRACE_PERMIT       = policy.TRACE_PERMIT
+	TRACE_DENY         = policy.TRACE_DENY
+	TRACE_OUT_OF_SCOPE = policy.TRACE_OUT_OF_SCOPE
+	TRACE_SKIPPED      = policy.TRACE_SKIPPED
+)
+
+type (
+	EvaluationCheck = policy.EvaluationCheck
+	OrderedCheck    = policy.OrderedCheck
+	TraceStep       = policy.TraceStep
+)
+
+// configShape is the policy.Shape conf is written to the maps as.
+func configShape(conf *config.Config) policy.Shape {
+	value := ConfigMapValue(conf)
+	lists := DecodeListSizes(value)
+	disabled, _ := DecodeFamilies(value)
+	network := conf.RestrictedNetworkConfig
+
+	deniedCIDR := len(network.CIDR.Deny)+len(network.CIDR.AllowExcept)+len(network.Domain.Deny) > 0
+	for _, protocol := range ruleProtocols {
+		_, cidrs := config.ProtocolLists(network.CIDR.Protocols, protocol)
+		_, domains := config.ProtocolLists(network.Domain.Protocols, protocol)
+		deniedCIDR = deniedCIDR || len(cidrs)+len(domains) > 0
+	}
+	for _, set := range network.RuleSets.Sets {
+		deniedCIDR = deniedCIDR || set.List == config.RULE_SET_LIST_DENY
+	}
+	defaultAction, precedence := DecodeDefaultAndPrecedence(value)
+	return policy.Shape{
+		Configured:             true,
+		Target:                 binary.LittleEndian.Uint32(value[MAP_TARGET_START:MAP_TARGET_END]),
+		CommandCaseInsensitive: network.Command.CaseInsensitive,
+		Lists:                  lists,
+		DeniedCIDR:             deniedCIDR,
+		AllowedSubjects:        lists.AllowCommand+lists.AllowCommandPattern+lists.AllowPath+lists.AllowUID+lists.AllowGID > 0,
+		DisabledFamilies:       disabled,
+		PolicyEntries:          DecodePolicyEntries(value).Count,
+		DefaultAction:          defaultAction,
+		Precedence:             precedence,
+		ExceptCIDR:             len(network.CIDR.AllowExcept) > 0,
+	}
+}
+
+// ExplainOrder returns the evaluation order of the connections with conf. The checks of the
+// dimensions conf does not restrict are CHECK_SKIPPED. Unlike policy.FromConfig, conf is looked
+// at as the Manager writes it, with the domains and the rule sets.
+func ExplainOrder(conf *config.Config) []OrderedCheck {
+	return policy.Order(configShape(conf))
+}
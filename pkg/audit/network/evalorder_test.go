@@ -0,0 +1,104 @@
+package network
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/bouhekitest"
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/policy"
+	"github.com/stretchr/testify/assert"
+)
+
+// conformanceEvent is the event socket_connect emits in block mode for c, with its verdict.
+func conformanceEvent(c Connection, permitted bool) (eventHeader, detectEvent) {
+	header := eventHeader{SchemaVersion: EVENT_SCHEMA_VERSION, UID: c.UID, GID: c.GID, Command: commandBytes(c.Command)}
+	verdict := VERDICT_DENY
+	if permitted {
+		verdict = VERDICT_ALLOW
+	}
+	if ip4 := c.Addr.To4(); ip4 != nil {
+		header.EventType = BLOCKED_IPV4
+		body := detectEventIPv4{DstPort: c.Port, Action: ACTION_BLOCKED, SockType: c.SockType, Verdict: verdict}
+		copy(body.DstIP[:], ip4)
+		return header, body
+	}
+	header.EventType = BLOCKED_IPV6
+	body := detectEventIPv6{DstPort: c.Port, Action: ACTION_BLOCKED, SockType: c.SockType, Verdict: verdict}
+	copy(body.DstIP[:], c.Addr.To16())
+	return header, body
+}
+
+func TestManagerConformsToTheConformanceCorpus(t *testing.T) {
+	cases, err := bouhekitest.LoadConformanceCases("../../policy/testdata/conformance.yaml")
+	assert.Nil(t, err)
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			conf, err := c.Parse()
+			if !assert.Nil(t, err) {
+				return
+			}
+			mgr := Manager{config: conf, backend: bouhekitest.NewMaps()}
+			assert.Nil(t, mgr.SetConfigToMap())
+			offline, err := policy.FromConfig(conf)
+			assert.Nil(t, err)
+			// The maps the Manager writes are the policy the config is loaded as.
+			assert.Equal(t, offline.Digest(), mgr.Policy().Digest())
+
+			v := newTestVerifier(mgr.Policy(), time.Now().Add(time.Hour))
+			for _, conn := range c.Connections {
+				message := fmt.Sprintf("%+v", conn)
+				decision := mgr.Policy().Evaluate(conn.Input())
+				assert.Equal(t, conn.Denied(), decision.Denied, message)
+				assert.Equal(t, conn.Rule, decision.Rule, message)
+				assert.Equal(t, offline.Evaluate(conn.Input()), decision, message)
+
+				// The event socket_connect emits for the connection has the verdict of the corpus.
+				v.exePath = func(uint32) string { return conn.ExePath }
+				header, body := conformanceEvent(conn.Input(), !conn.Denied())
+				assert.Equal(t, VERIFICATION_MATCH, v.verify(header, body), message)
+			}
+		})
+	}
+}
+
+func TestExplainOrder(t *testing.T) {
+	statuses := func(conf *config.Config) map[string]string {
+		statuses := map[string]string{}
+		for _, check := range ExplainOrder(conf) {
+			statuses[check.Name] = check.Status
+		}
+		return statuses
+	}
+
+	conf := config.DefaultConfig()
+	order := ExplainOrder(conf)
+	assert.Len(t, order, len(policy.Order(policy.Shape{})))
+	assert.Equal(t, "scope.family", order[0].Name)
+	assert.True(t, order[0].KernelOnly)
+	assert.Equal(t, "mode", order[len(order)-1].Name)
+	for name, status := range statuses(conf) {
+		switch name {
+		case "scope.family", "scope.port", "cidr.allow", "verdict", "mode":
+			assert.Equal(t, CHECK_ACTIVE, status, name)
+		default:
+			assert.Equal(t, CHECK_SKIPPED, status, name)
+		}
+	}
+
+	conf.RestrictedNetworkConfig.Target = "container"
+	conf.RestrictedNetworkConfig.Command.CaseInsensitive = true
+	conf.RestrictedNetworkConfig.Domain.Deny = []string{"evil.example.com"}
+	conf.RestrictedNetworkConfig.UID.Allow = []string{"1000"}
+	conf.RestrictedNetworkConfig.GID.Allow = []string{"100"}
+	conf.RestrictedNetworkConfig.Command.Deny = []string{"wget"}
+	active := statuses(conf)
+	for _, name := range []string{"scope.target", "command.case_insensitive", "cidr.deny", "cidr.deny.override", "command.deny", "uid.allow", "gid.allow"} {
+		assert.Equal(t, CHECK_ACTIVE, active[name], name)
+	}
+	for _, name := range []string{"uid.deny", "gid.deny", "command.allow"} {
+		assert.Equal(t, CHECK_SKIPPED, active[name], name)
+	}
+}
@@ -0,0 +1,336 @@
+package network
+
+import (
+	"encoding/binary"
+	"net"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/policy"
+)
+
+// Policy is the userspace view of what the Manager has written to the BPF maps.
+// Every successful map update is mirrored here, so Evaluate can answer what
+// the kernel is expected to decide for a connection. The rules are evaluated by
+// policy.Policy, which can also be built from a config without the maps.
+type Policy struct {
+	*policy.Policy
+}
+
+// Connection is the subject and destination of a connect(2) call.
+type Connection = policy.ConnInput
+
+type Decision = policy.Decision
+
+func NewPolicy() *Policy {
+	return &Policy{Policy: policy.NewPolicy()}
+}
+
+// mapList returns the list of the policy the entries of mapName are mirrored in. Both families
+// of a list are one list.
+func mapList(mapName string) (policy.List, bool) {
+	switch mapName {
+	case ALLOWED_V4_CIDR_LIST_MAP_NAME, ALLOWED_V6_CIDR_LIST_MAP_NAME:
+		return policy.LIST_ALLOW_CIDR, true
+	case DENIED_V4_CIDR_LIST_MAP_NAME, DENIED_V6_CIDR_LIST_MAP_NAME:
+		return policy.LIST_DENY_CIDR, true
+	case ALLOWED_V4_PROTOCOL_CIDR_LIST_MAP_NAME, ALLOWED_V6_PROTOCOL_CIDR_LIST_MAP_NAME:
+		return policy.LIST_ALLOW_PROTOCOL_CIDR, true
+	case DENIED_V4_PROTOCOL_CIDR_LIST_MAP_NAME, DENIED_V6_PROTOCOL_CIDR_LIST_MAP_NAME:
+		return policy.LIST_DENY_PROTOCOL_CIDR, true
+	case ALLOWED_V4_ENTRY_CIDR_LIST_MAP_NAME, ALLOWED_V6_ENTRY_CIDR_LIST_MAP_NAME:
+		return policy.LIST_ALLOW_ENTRY_CIDR, true
+	case DENIED_V4_ENTRY_CIDR_LIST_MAP_NAME, DENIED_V6_ENTRY_CIDR_LIST_MAP_NAME:
+		return policy.LIST_DENY_ENTRY_CIDR, true
+	case POLICY_ENTRY_UID_LIST_MAP_NAME:
+		return policy.LIST_ENTRY_UID, true
+	case POLICY_ENTRY_GID_LIST_MAP_NAME:
+		return policy.LIST_ENTRY_GID, true
+	case ALLOWED_COMMAND_LIST_MAP_NAME:
+		return policy.LIST_ALLOW_COMMAND, true
+	case DENIED_COMMAND_LIST_MAP_NAME:
+		return policy.LIST_DENY_COMMAND, true
+	case ALLOWED_PATH_LIST_MAP_NAME:
+		return policy.LIST_ALLOW_PATH, true
+	case DENIED_PATH_LIST_MAP_NAME:
+		return policy.LIST_DENY_PATH, true
+	case ALLOWED_COMMAND_PATTERN_LIST_MAP_NAME:
+		return policy.LIST_ALLOW_COMMAND_PATTERN, true
+	case DENIED_COMMAND_PATTERN_LIST_MAP_NAME:
+		return policy.LIST_DENY_COMMAND_PATTERN, true
+	case ALLOWED_UID_LIST_MAP_NAME:
+		return policy.LIST_ALLOW_UID, true
+	case DENIED_UID_LIST_MAP_NAME:
+		return policy.LIST_DENY_UID, true
+	case ALLOWED_UID_RANGE_LIST_MAP_NAME:
+		return policy.LIST_ALLOW_UID_RANGE, true
+	case DENIED_UID_RANGE_LIST_MAP_NAME:
+		return policy.LIST_DENY_UID_RANGE, true
+	case ALLOWED_GID_LIST_MAP_NAME:
+		return policy.LIST_ALLOW_GID, true
+	case DENIED_GID_LIST_MAP_NAME:
+		return policy.LIST_DENY_GID, true
+	case ALLOWED_PORT_LIST_MAP_NAME:
+		return policy.LIST_ALLOW_PORT, true
+	case DENIED_PORT_LIST_MAP_NAME:
+		return policy.LIST_DENY_PORT, true
+	case INGRESS_ALLOWED_V4_CIDR_LIST_MAP_NAME, INGRESS_ALLOWED_V6_CIDR_LIST_MAP_NAME:
+		return policy.LIST_INGRESS_ALLOW_CIDR, true
+	case INGRESS_DENIED_V4_CIDR_LIST_MAP_NAME, INGRESS_DENIED_V6_CIDR_LIST_MAP_NAME:
+		return policy.LIST_INGRESS_DENY_CIDR, true
+	case INGRESS_ALLOWED_PORT_LIST_MAP_NAME:
+		return policy.LIST_INGRESS_ALLOW_PORT, true
+	case INGRESS_DENIED_PORT_LIST_MAP_NAME:
+		return policy.LIST_INGRESS_DENY_PORT, true
+	default:
+		return 0, false
+	}
+}
+
+// setExcept records whether the deny entry n was written with exceptValue.
+func (p *Policy) setExcept(n *net.IPNet, except bool) {
+	if except {
+		p.AddCIDR(policy.LIST_DENY_EXCEPT_CIDR, PROTOCOL_ALL, n)
+	} else {
+		p.DeleteCIDR(policy.LIST_DENY_EXCEPT_CIDR, PROTOCOL_ALL, n)
+	}
+}
+
+// setMonitored records whether the deny entry n was written with monitorValue.
+func (p *Policy) setMonitored(n *net.IPNet, monitored bool) {
+	if monitored {
+		p.AddCIDR(policy.LIST_DENY_MONITOR_CIDR, PROTOCOL_ALL, n)
+	} else {
+		p.DeleteCIDR(policy.LIST_DENY_MONITOR_CIDR, PROTOCOL_ALL, n)
+	}
+}
+
+// setMonitoredCommand records whether the denied command was written with monitorCommandValue.
+func (p *Policy) setMonitoredCommand(command string, monitored bool) {
+	if monitored {
+		p.AddCommand(policy.LIST_DENY_MONITOR_COMMAND, command)
+	} else {
+		p.DeleteCommand(policy.LIST_DENY_MONITOR_COMMAND, command)
+	}
+}
+
+func (p *Policy) setModeAndTarget(mode, target uint32) {
+	p.SetModeAndTarget(mode, target)
+}
+
+// setDeniedGroups sets the group each prefix of network.cidr.deny came from, by prefix.
+func (p *Policy) setDeniedGroups(groups map[string]string) {
+	p.SetDeniedGroups(groups)
+}
+
+func (p *Policy) setCommandCaseInsensitive(caseInsensitive bool) {
+	p.SetCommandCaseInsensitive(caseInsensitive)
+}
+
+func (p *Policy) setListSizes(lists ListSizes) {
+	p.SetListSizes(lists)
+}
+
+func (p *Policy) setFamilies(disabled uint32, audit bool) {
+	p.SetFamilies(disabled, audit)
+}
+
+func (p *Policy) setDefaultAndPrecedence(defaultAction, precedence uint32) {
+	p.SetDefaultAndPrecedence(defaultAction, precedence)
+}
+
+func (p *Policy) addCIDR(mapName string, protocol uint8, n *net.IPNet) {
+	if list, ok := mapList(mapName); ok {
+		p.AddCIDR(list, protocol, n)
+	}
+}
+
+func (p *Policy) deleteCIDR(mapName string, protocol uint8, n *net.IPNet) {
+	if list, ok := mapList(mapName); ok {
+		p.DeleteCIDR(list, protocol, n)
+	}
+}
+
+func (p *Policy) hasCIDR(mapName string, protocol uint8, n *net.IPNet) bool {
+	list, ok := mapList(mapName)
+	return ok && p.HasCIDR(list, protocol, n)
+}
+
+func (p *Policy) addCommand(mapName string, command string) {
+	if list, ok := mapList(mapName); ok {
+		p.AddCommand(list, command)
+	}
+}
+
+func (p *Policy) deleteCommand(mapName string, command string) {
+	if list, ok := mapList(mapName); ok {
+		p.DeleteCommand(list, command)
+	}
+}
+
+func (p *Policy) addPath(mapName string, path string) {
+	if list, ok := mapList(mapName); ok {
+		p.AddPath(list, path)
+	}
+}
+
+func (p *Policy) deletePath(mapName string, path string) {
+	if list, ok := mapList(mapName); ok {
+		p.DeletePath(list, path)
+	}
+}
+
+func (p *Policy) setCommandPattern(mapName string, index uint32, pattern config.CommandPattern) {
+	if list, ok := mapList(mapName); ok {
+		p.SetCommandPattern(list, index, pattern)
+	}
+}
+
+func (p *Policy) deleteCommandPattern(mapName string, index uint32) {
+	if list, ok := mapList(mapName); ok {
+		p.DeleteCommandPattern(list, index)
+	}
+}
+
+func (p *Policy) setEntryID(mapName string, id uint32, mask uint64) {
+	if list, ok := mapList(mapName); ok {
+		p.SetEntryID(list, id, mask)
+	}
+}
+
+func (p *Policy) addID(mapName string, id uint) {
+	if list, ok := mapList(mapName); ok {
+		p.AddID(list, uint32(id))
+	}
+}
+
+func (p *Policy) deleteID(mapName string, id uint) {
+	if list, ok := mapList(mapName); ok {
+		p.DeleteID(list, uint32(id))
+	}
+}
+
+func (p *Policy) addPort(mapName string, prefix portPrefix) {
+	if list, ok := mapList(mapName); ok {
+		p.AddPort(list, prefix)
+	}
+}
+
+func (p *Policy) deletePort(mapName string, prefix portPrefix) {
+	if list, ok := mapList(mapName); ok {
+		p.DeletePort(list, prefix)
+	}
+}
+
+func (p *Policy) addUIDPrefix(mapName string, prefix uidPrefix) {
+	if list, ok := mapList(mapName); ok {
+		p.AddUIDPrefix(list, prefix)
+	}
+}
+
+func (p *Policy) deleteUIDPrefix(mapName string, prefix uidPrefix) {
+	if list, ok := mapList(mapName); ok {
+		p.DeleteUIDPrefix(list, prefix)
+	}
+}
+
+// version returns the PolicyVersion of the policy, with the digest of the same rules, and the
+// generation it is of.
+func (p *Policy) version() (*PolicyVersion, uint64) {
+	s := p.Snapshot()
+	v := &PolicyVersion{
+		Version:                POLICY_VERSION_FORMAT,
+		Digest:                 s.Digest,
+		RecordedAt:             s.UpdatedAt.UTC(),
+		Mode:                   "block",
+		Target:                 "host",
+		CommandCaseInsensitive: s.CommandCaseInsensitive,
+		CIDR:                   PolicyExportList(s.CIDR),
+		Command:                PolicyExportList(s.Command),
+		UID:                    PolicyExportIDList(s.UID),
+		GID:                    PolicyExportIDList(s.GID),
+		Ports:                  PolicyExportList(s.Ports),
+	}
+	for _, protocol := range ruleProtocols {
+		list, ok := s.ProtocolCIDR[protocol]
+		if !ok {
+			continue
+		}
+		if v.ProtocolCIDR == nil {
+			v.ProtocolCIDR = map[string]PolicyExportList{}
+		}
+		v.ProtocolCIDR[protocol] = PolicyExportList(list)
+	}
+	if len(s.Paths.Allow)+len(s.Paths.Deny) > 0 {
+		v.CommandPaths = &PolicyExportList{Allow: s.Paths.Allow, Deny: s.Paths.Deny}
+	}
+	if len(s.UIDRanges.Allow)+len(s.UIDRanges.Deny) > 0 {
+		v.UIDRanges = &PolicyExportList{Allow: s.UIDRanges.Allow, Deny: s.UIDRanges.Deny}
+	}
+	if s.HasIngressRules() {
+		v.Ingress = &PolicyExportIngress{CIDR: PolicyExportList(s.IngressCIDR), Ports: PolicyExportList(s.IngressPorts)}
+	}
+	if s.Mode == MODE_MONITOR {
+		v.Mode = "monitor"
+	}
+	switch s.Target {
+	case TAREGT_CONTAINER:
+		v.Target = "container"
+	case TARGET_ALL:
+		v.Target = "all"
+	}
+	return v, s.Generation
+}
+
+// cidrKeyToIPNet returns the socket type, or the tag of the entry, and the prefix of a key of mapName.
+func cidrKeyToIPNet(mapName string, key []byte) (uint8, *net.IPNet) {
+	if isProtocolCIDRList(mapName) || isEntryCIDRList(mapName) {
+		return protocolKeyToIPNet(key)
+	}
+	return PROTOCOL_ALL, keyToIPNet(key)
+}
+
+// isProtocolCIDRList reports whether mapName is one of the protocol lists.
+func isProtocolCIDRList(mapName string) bool {
+	switch mapName {
+	case ALLOWED_V4_PROTOCOL_CIDR_LIST_MAP_NAME, ALLOWED_V6_PROTOCOL_CIDR_LIST_MAP_NAME, DENIED_V4_PROTOCOL_CIDR_LIST_MAP_NAME, DENIED_V6_PROTOCOL_CIDR_LIST_MAP_NAME:
+		return true
+	}
+	return false
+}
+
+// isEntryCIDRList reports whether mapName is one of the CIDR lists of network.policies.
+func isEntryCIDRList(mapName string) bool {
+	switch mapName {
+	case ALLOWED_V4_ENTRY_CIDR_LIST_MAP_NAME, ALLOWED_V6_ENTRY_CIDR_LIST_MAP_NAME, DENIED_V4_ENTRY_CIDR_LIST_MAP_NAME, DENIED_V6_ENTRY_CIDR_LIST_MAP_NAME:
+		return true
+	}
+	return false
+}
+
+// protocolKeyToIPNet is the inverse of ipv4ToKey and ipv6ToKey for the keys of the protocol lists.
+func protocolKeyToIPNet(key []byte) (uint8, *net.IPNet) {
+	prefixLen := int(binary.LittleEndian.Uint32(key[0:4])) - PROTOCOL_KEY_BITS
+	addrLen := net.IPv4len
+	if len(key) >= 5+net.IPv6len {
+		addrLen = net.IPv6len
+	}
+
+	addr := make(net.IP, addrLen)
+	copy(addr, key[5:])
+	return key[4], &net.IPNet{IP: addr, Mask: net.CIDRMask(prefixLen, addrLen*8)}
+}
+
+// keyToIPNet is the inverse of ipv4ToKey and ipv6ToKey for PROTOCOL_ALL.
+func keyToIPNet(key []byte) *net.IPNet {
+	prefixLen := int(binary.LittleEndian.Uint32(key[0:4]))
+
+	if len(key) >= 4+net.IPv6len {
+		addr := make(net.IP, net.IPv6len)
+		copy(addr, key[4:])
+		return &net.IPNet{IP: addr, Mask: net.CIDRMask(prefixLen, 128)}
+	}
+
+	addr := make(net.IP, net.IPv4len)
+	copy(addr, key[4:])
+	return &net.IPNet{IP: addr, Mask: net.CIDRMask(prefixLen, 32)}
+}
@@ -0,0 +1,240 @@
+package network
+
+import (
+	"net"
+	"testing"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/policy"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestPolicy(mode uint32, allowCIDR, denyCIDR []string) *Policy {
+	policy := NewPolicy()
+	policy.setModeAndTarget(mode, TARGET_HOST)
+	for _, cidr := range allowCIDR {
+		_, n, _ := net.ParseCIDR(cidr)
+		policy.addCIDR(ALLOWED_V4_CIDR_LIST_MAP_NAME, PROTOCOL_ALL, n)
+	}
+	for _, cidr := range denyCIDR {
+		_, n, _ := net.ParseCIDR(cidr)
+		policy.addCIDR(DENIED_V4_CIDR_LIST_MAP_NAME, PROTOCOL_ALL, n)
+	}
+	return policy
+}
+
+// withListSizes writes the sizes of the lists of policy, as configMapValue does for a config with the same lists.
+func withListSizes(policy *Policy) *Policy {
+	s := policy.Snapshot()
+	policy.setListSizes(ListSizes{
+		AllowCommand: uint32(len(s.Command.Allow)),
+		AllowUID:     uint32(len(s.UID.Allow)),
+		AllowGID:     uint32(len(s.GID.Allow)),
+		DenyCommand:  uint32(len(s.Command.Deny)),
+		DenyUID:      uint32(len(s.UID.Deny)),
+		DenyGID:      uint32(len(s.GID.Deny)),
+		AllowPort:    uint32(len(s.Ports.Allow)),
+		DenyPort:     uint32(len(s.Ports.Deny)),
+	})
+	return policy
+}
+
+func TestPolicyEvaluate(t *testing.T) {
+	tests := []struct {
+		name       string
+		policy     func() *Policy
+		connection Connection
+		expected   Decision
+	}{
+		{
+			name:       "Allowed CIDR is not blocked",
+			policy:     func() *Policy { return newTestPolicy(MODE_BLOCK, []string{"10.0.0.0/8"}, nil) },
+			connection: Connection{Addr: net.ParseIP("10.0.0.1"), Command: "curl"},
+			expected:   Decision{},
+		},
+		{
+			name:       "Address outside the allowed CIDR is blocked",
+			policy:     func() *Policy { return newTestPolicy(MODE_BLOCK, []string{"10.0.0.0/8"}, nil) },
+			connection: Connection{Addr: net.ParseIP("192.168.0.1"), Command: "curl"},
+			expected:   Decision{Audited: true, Denied: true, Blocked: true, Rule: "network.cidr.allow does not list 192.168.0.1"},
+		},
+		{
+			name:       "Denied CIDR overrides allowed CIDR",
+			policy:     func() *Policy { return newTestPolicy(MODE_BLOCK, []string{"0.0.0.0/0"}, []string{"10.0.0.0/8"}) },
+			connection: Connection{Addr: net.ParseIP("10.0.0.1"), Command: "curl"},
+			expected:   Decision{Audited: true, Denied: true, Blocked: true, DenyListed: true, Rule: "network.cidr.deny 10.0.0.0/8"},
+		},
+		{
+			name: "Allowed command overrides denied CIDR",
+			policy: func() *Policy {
+				p := newTestPolicy(MODE_BLOCK, []string{"0.0.0.0/0"}, []string{"10.0.0.0/8"})
+				p.addCommand(ALLOWED_COMMAND_LIST_MAP_NAME, "curl")
+				return p
+			},
+			connection: Connection{Addr: net.ParseIP("10.0.0.1"), Command: "curl"},
+			expected:   Decision{},
+		},
+		{
+			name: "Denied command is compared case-sensitively by default",
+			policy: func() *Policy {
+				p := newTestPolicy(MODE_BLOCK, []string{"0.0.0.0/0"}, nil)
+				p.addCommand(DENIED_COMMAND_LIST_MAP_NAME, "curl")
+				return p
+			},
+			connection: Connection{Addr: net.ParseIP("10.0.0.1"), Command: "CURL"},
+			expected:   Decision{},
+		},
+		{
+			name: "Denied command is compared with the lowercased comm when case-insensitive",
+			policy: func() *Policy {
+				p := newTestPolicy(MODE_BLOCK, []string{"0.0.0.0/0"}, nil)
+				p.setCommandCaseInsensitive(true)
+				p.addCommand(DENIED_COMMAND_LIST_MAP_NAME, "curl")
+				return p
+			},
+			connection: Connection{Addr: net.ParseIP("10.0.0.1"), Command: "CURL"},
+			expected:   Decision{Audited: true, Denied: true, Blocked: true, DenyListed: true, Rule: "network.command.deny curl"},
+		},
+		{
+			name: "Denied command longer than the comm matches the truncated comm",
+			policy: func() *Policy {
+				p := newTestPolicy(MODE_BLOCK, []string{"0.0.0.0/0"}, nil)
+				p.addCommand(DENIED_COMMAND_LIST_MAP_NAME, "very-long-command-name")
+				return p
+			},
+			connection: Connection{Addr: net.ParseIP("10.0.0.1"), Command: "very-long-comma"},
+			expected:   Decision{Audited: true, Denied: true, Blocked: true, DenyListed: true, Rule: "network.command.deny very-long-comma"},
+		},
+		{
+			name: "Command outside the allow list is blocked",
+			policy: func() *Policy {
+				p := newTestPolicy(MODE_BLOCK, []string{"0.0.0.0/0"}, nil)
+				p.addCommand(ALLOWED_COMMAND_LIST_MAP_NAME, "curl")
+				return p
+			},
+			connection: Connection{Addr: net.ParseIP("10.0.0.1"), Command: "wget"},
+			expected:   Decision{Audited: true, Denied: true, Blocked: true, Rule: "network.command.allow does not list wget"},
+		},
+		{
+			name: "Denied UID is blocked",
+			policy: func() *Policy {
+				p := newTestPolicy(MODE_BLOCK, []string{"0.0.0.0/0"}, nil)
+				p.addID(DENIED_UID_LIST_MAP_NAME, 1000)
+				return p
+			},
+			connection: Connection{Addr: net.ParseIP("10.0.0.1"), UID: 1000},
+			expected:   Decision{Audited: true, Denied: true, Blocked: true, DenyListed: true, Rule: "network.uid.deny 1000"},
+		},
+		{
+			name: "GID outside the allowed gids is blocked",
+			policy: func() *Policy {
+				p := newTestPolicy(MODE_BLOCK, []string{"0.0.0.0/0"}, nil)
+				p.addID(ALLOWED_GID_LIST_MAP_NAME, 0)
+				return p
+			},
+			connection: Connection{Addr: net.ParseIP("10.0.0.1"), GID: 1000},
+			expected:   Decision{Audited: true, Denied: true, Blocked: true, Rule: "network.gid.allow does not list 1000"},
+		},
+		{
+			name: "Denied port wins over the allowed CIDR and the allowed command",
+			policy: func() *Policy {
+				p := newTestPolicy(MODE_BLOCK, []string{"10.0.0.0/8"}, nil)
+				p.addCommand(ALLOWED_COMMAND_LIST_MAP_NAME, "curl")
+				for _, prefix := range policy.PortRangePrefixes(config.PortRange{First: 8000, Last: 8999}) {
+					p.addPort(DENIED_PORT_LIST_MAP_NAME, prefix)
+				}
+				return p
+			},
+			connection: Connection{Addr: net.ParseIP("10.0.0.1"), Port: 8080, Command: "curl"},
+			expected:   Decision{Audited: true, Denied: true, Blocked: true, DenyListed: true, Rule: "network.ports.deny 8064-8191"},
+		},
+		{
+			name: "Port outside the allowed ports is blocked",
+			policy: func() *Policy {
+				p := newTestPolicy(MODE_BLOCK, []string{"10.0.0.0/8"}, nil)
+				p.addPort(ALLOWED_PORT_LIST_MAP_NAME, portPrefix{Port: 443, PrefixLen: 16})
+				p.addPort(ALLOWED_PORT_LIST_MAP_NAME, portPrefix{Port: 5432, PrefixLen: 16})
+				return p
+			},
+			connection: Connection{Addr: net.ParseIP("10.0.0.1"), Port: 22, Command: "curl"},
+			expected:   Decision{Audited: true, Denied: true, Blocked: true, Rule: "network.ports.allow does not list 22"},
+		},
+		{
+			name: "A connection without a port is not restricted by the ports",
+			policy: func() *Policy {
+				p := newTestPolicy(MODE_BLOCK, []string{"10.0.0.0/8"}, nil)
+				p.addPort(ALLOWED_PORT_LIST_MAP_NAME, portPrefix{Port: 443, PrefixLen: 16})
+				return p
+			},
+			connection: Connection{Addr: net.ParseIP("10.0.0.1"), Command: "curl"},
+			expected:   Decision{},
+		},
+		{
+			name:       "Monitor mode audits every connection and never blocks",
+			policy:     func() *Policy { return newTestPolicy(MODE_MONITOR, []string{"10.0.0.0/8"}, nil) },
+			connection: Connection{Addr: net.ParseIP("192.168.0.1")},
+			expected:   Decision{Audited: true, Denied: true, Rule: "network.cidr.allow does not list 192.168.0.1"},
+		},
+		{
+			name: "Host processes are ignored when only containers are targeted",
+			policy: func() *Policy {
+				p := newTestPolicy(MODE_BLOCK, nil, nil)
+				p.setModeAndTarget(MODE_BLOCK, TAREGT_CONTAINER)
+				return p
+			},
+			connection: Connection{Addr: net.ParseIP("192.168.0.1")},
+			expected:   Decision{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, withListSizes(test.policy()).Evaluate(test.connection))
+		})
+	}
+}
+
+func TestPolicyGeneration(t *testing.T) {
+	policy := NewPolicy()
+	generation, updatedAt := policy.Generation()
+	assert.Equal(t, uint64(0), generation)
+	assert.True(t, updatedAt.IsZero())
+
+	_, n, _ := net.ParseCIDR("10.0.0.0/8")
+	policy.addCIDR(ALLOWED_V4_CIDR_LIST_MAP_NAME, PROTOCOL_ALL, n)
+	policy.deleteCIDR(ALLOWED_V4_CIDR_LIST_MAP_NAME, PROTOCOL_ALL, n)
+	policy.deleteCIDR(ALLOWED_V4_CIDR_LIST_MAP_NAME, PROTOCOL_ALL, n)
+
+	generation, updatedAt = policy.Generation()
+	assert.Equal(t, uint64(2), generation, "deleting a missing prefix is not a change")
+	assert.False(t, updatedAt.IsZero())
+}
+
+func TestPolicyDigest(t *testing.T) {
+	a := newTestPolicy(MODE_BLOCK, []string{"10.0.0.0/8", "192.168.0.0/16"}, []string{"10.1.0.0/16"})
+	a.addCommand(DENIED_COMMAND_LIST_MAP_NAME, "curl")
+	a.addID(ALLOWED_UID_LIST_MAP_NAME, 1000)
+
+	b := newTestPolicy(MODE_BLOCK, []string{"192.168.0.0/16", "10.0.0.0/8"}, []string{"10.1.0.0/16"})
+	b.addID(ALLOWED_UID_LIST_MAP_NAME, 1000)
+	b.addCommand(DENIED_COMMAND_LIST_MAP_NAME, "curl")
+	assert.Equal(t, a.Digest(), b.Digest())
+
+	b.addID(ALLOWED_GID_LIST_MAP_NAME, 1000)
+	assert.NotEqual(t, a.Digest(), b.Digest())
+
+	c := newTestPolicy(MODE_MONITOR, []string{"10.0.0.0/8", "192.168.0.0/16"}, []string{"10.1.0.0/16"})
+	c.addCommand(DENIED_COMMAND_LIST_MAP_NAME, "curl")
+	c.addID(ALLOWED_UID_LIST_MAP_NAME, 1000)
+	assert.NotEqual(t, a.Digest(), c.Digest())
+}
+
+func Test_keyToIPNet(t *testing.T) {
+	for _, cidr := range []string{"192.168.1.0/24", "0.0.0.0/0", "2001:3984:3989::/64", "::/0"} {
+		t.Run(cidr, func(t *testing.T) {
+			addr, err := cidrToBPFMapKey(cidr)
+			assert.Nil(t, err)
+			assert.Equal(t, cidr, keyToIPNet(addr.key).String())
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package network
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/mrtc0/bouheki/pkg/audit/helpers"
+	"github.com/mrtc0/bouheki/pkg/config"
+	log "github.com/mrtc0/bouheki/pkg/log"
+)
+
+// AuditEvent is an event of the programs, decoded by DecodeEvent, for the users of the Manager
+// that do not want to know the layout of the events.
+type AuditEvent struct {
+	// SchemaVersion is the EVENT_SCHEMA_VERSION of the programs that emitted the event.
+	SchemaVersion uint16
+	// Action is ACTION_BLOCKED_STRING if the connection was blocked, ACTION_MONITOR_STRING if
+	// it was only reported, and Blocked is set for the former.
+	Action  string
+	Blocked bool
+	// Denied is set if the policy denies the connection, which only blocks it in block mode.
+	Denied bool
+	// Operation is OPERATION_CONNECT, OPERATION_SENDMSG or OPERATION_BIND.
+	Operation  string
+	Hostname   string
+	PID        uint32
+	Comm       string
+	ParentComm string
+	// UID and GID are the ids of the process, which the events of schema version 1 do not have.
+	UID        uint32
+	GID        uint32
+	HasSubject bool
+	CgroupID   uint64
+	// MatchedCgroupID is the classified cgroup that CgroupID matched, 0 unless the
+	// classification uses cgroups.
+	MatchedCgroupID uint64
+	// Family is config.FAMILY_IPV4 or config.FAMILY_IPV6, and Protocol TCP_STRING or UDP_STRING.
+	Family   string
+	Protocol string
+	// RemoteIP and RemotePort are the destination, nil and 0 for a bind.
+	RemoteIP   net.IP
+	RemotePort uint16
+	// LocalIP and LocalPort are the address of the socket, or the ones a bind binds to. The
+	// port is 0 before schema version 5.
+	LocalIP   net.IP
+	LocalPort uint16
+	// Rule describes the rule that denied the connection, see RestrictedNetworkLog.Rule. It is
+	// only set for the events of StartTyped, which knows the rules.
+	Rule string
+	// MonitorRule is set when the rule is a deny entry in mode: monitor, see
+	// RestrictedNetworkLog.MonitorRule.
+	MonitorRule bool
+}
+
+// DecodeEvent decodes an event of the programs, of any schema version.
+func DecodeEvent(eventBytes []byte) (AuditEvent, error) {
+	header, body, err := parseEvent(eventBytes)
+	if err != nil {
+		return AuditEvent{}, err
+	}
+	return newAuditEvent(header, body)
+}
+
+func newAuditEvent(header eventHeader, body detectEvent) (AuditEvent, error) {
+
+	event := AuditEvent{
+		SchemaVersion:   header.SchemaVersion,
+		Action:          body.ActionResult(),
+		Denied:          body.Denied(),
+		Operation:       body.Operation(),
+		Hostname:        helpers.NodenameToString(header.Nodename),
+		PID:             header.PID,
+		Comm:            helpers.CommToString(header.Command),
+		ParentComm:      helpers.CommToString(header.ParentCommand),
+		UID:             header.UID,
+		GID:             header.GID,
+		HasSubject:      header.hasSubject(),
+		CgroupID:        header.CGroupID,
+		MatchedCgroupID: header.MatchedCgroupID,
+		MonitorRule:     body.MonitorRule(),
+	}
+	event.Blocked = event.Action == ACTION_BLOCKED_STRING
+
+	var sockType uint8
+	switch body := body.(type) {
+	case detectEventIPv4:
+		event.Family, sockType = config.FAMILY_IPV4, body.SockType
+		event.RemoteIP, event.RemotePort = net.IP(append([]byte{}, body.DstIP[:]...)), body.DstPort
+		event.LocalIP, event.LocalPort = net.IP(append([]byte{}, body.SrcIP[:]...)), body.SrcPort
+	case detectEventIPv6:
+		event.Family, sockType = config.FAMILY_IPV6, body.SockType
+		event.RemoteIP, event.RemotePort = net.IP(append([]byte{}, body.DstIP[:]...)), body.DstPort
+		event.LocalIP, event.LocalPort = net.IP(append([]byte{}, body.SrcIP[:]...)), body.SrcPort
+	default:
+		return AuditEvent{}, fmt.Errorf("unknown event body %T", body)
+	}
+	event.Protocol = sockTypeToProtocolName(sockType)
+
+	// A bind has no destination: the address and the port it binds to are the ones of the socket.
+	if event.Operation == OPERATION_BIND {
+		event.LocalIP, event.LocalPort = event.RemoteIP, event.RemotePort
+		event.RemoteIP, event.RemotePort = nil, 0
+	}
+	return event, nil
+}
+
+// StartTyped starts the Manager as Start does, and sends the events to eventsChannel decoded,
+// with the rule that denied the connection described.
+// An event that can not be decoded is logged and skipped. Every event is acknowledged once it is
+// sent, see Ack, and eventsChannel is closed once the events are all sent after Stop.
+func (m *Manager) StartTyped(eventsChannel chan AuditEvent) error {
+	raw := make(chan []byte)
+	if err := m.Start(raw); err != nil {
+		close(eventsChannel)
+		return err
+	}
+
+	go func() {
+		defer close(eventsChannel)
+		for eventBytes := range raw {
+			header, body, err := parseEvent(eventBytes)
+			var event AuditEvent
+			if err == nil {
+				event, err = newAuditEvent(header, body)
+			}
+			if err != nil {
+				log.Error(err)
+				m.Ack()
+				continue
+			}
+			event.Rule = m.matchedRule(body.MatchedRule(), eventToConnection(header, body))
+			eventsChannel <- event
+			m.Ack()
+		}
+	}()
+	return nil
+}
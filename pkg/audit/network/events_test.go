@@ -0,0 +1,116 @@
+package network
+
+import (
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// The Go structs must have the size of the C structs they are read from: binary.Read does not
+// pad, so a field the C compiler aligns must be followed by an explicit padding field.
+func TestEventStructsHaveTheLayoutOfTheFixtures(t *testing.T) {
+	for fixture, body := range map[string]interface{}{"v6_ipv4": detectEventIPv4{}, "v6_ipv6": detectEventIPv6{}} {
+		event := readEventFixture(t, fixture)
+		headerSize := int(binary.LittleEndian.Uint16(event[6:]))
+		size := int(binary.LittleEndian.Uint32(event[8:]))
+
+		assert.Equal(t, binary.Size(eventPrefix{})+binary.Size(eventHeaderV4{}), headerSize, fixture)
+		assert.Equal(t, (binary.Size(body)+7)&^7, size-headerSize, fixture)
+		assert.Equal(t, size, len(event), fixture)
+	}
+}
+
+func TestDecodeEvent(t *testing.T) {
+	for _, test := range []struct {
+		fixture string
+		family  string
+		remote  string
+		local   string
+	}{
+		{"v6_ipv4", config.FAMILY_IPV4, "192.0.2.1", "10.0.0.2"},
+		{"v6_ipv6", config.FAMILY_IPV6, "2001:db8::1", "2001:db8::2"},
+	} {
+		event, err := DecodeEvent(readEventFixture(t, test.fixture))
+		assert.Nil(t, err)
+		assert.Equal(t, AuditEvent{
+			SchemaVersion:   6,
+			Action:          ACTION_BLOCKED_STRING,
+			Blocked:         true,
+			Denied:          true,
+			Operation:       OPERATION_CONNECT,
+			Hostname:        "node-1",
+			PID:             4242,
+			Comm:            "curl",
+			ParentComm:      "bash",
+			UID:             1000,
+			GID:             1001,
+			HasSubject:      true,
+			CgroupID:        4343,
+			MatchedCgroupID: 4242,
+			Family:          test.family,
+			Protocol:        TCP_STRING,
+			RemoteIP:        net.ParseIP(test.remote),
+			RemotePort:      443,
+			LocalIP:         net.ParseIP(test.local),
+			LocalPort:       40000,
+		}, normalizeEventIPs(event), test.fixture)
+	}
+
+	// The events of schema version 1 have no uid and gid.
+	event, err := DecodeEvent(readEventFixture(t, "v1_ipv4"))
+	assert.Nil(t, err)
+	assert.False(t, event.HasSubject)
+	assert.Equal(t, uint32(0), event.UID)
+
+	// A bind binds to the address of its event, and has no destination.
+	bind := readEventFixture(t, "v5_bound_ipv4")
+	bind[binary.LittleEndian.Uint16(bind[6:])+10] = LSM_HOOK_POINT_BIND
+	event, err = DecodeEvent(bind)
+	assert.Nil(t, err)
+	assert.Equal(t, OPERATION_BIND, event.Operation)
+	assert.Nil(t, event.RemoteIP)
+	assert.Equal(t, uint16(0), event.RemotePort)
+	assert.Equal(t, "192.0.2.1", event.LocalIP.String())
+	assert.Equal(t, uint16(443), event.LocalPort)
+
+	_, err = DecodeEvent([]byte{1, 2, 3})
+	assert.NotNil(t, err)
+}
+
+// normalizeEventIPs returns event with its addresses in the 16-byte form of net.ParseIP.
+func normalizeEventIPs(event AuditEvent) AuditEvent {
+	event.RemoteIP, event.LocalIP = event.RemoteIP.To16(), event.LocalIP.To16()
+	return event
+}
+
+func TestStartTypedDecodesTheEvents(t *testing.T) {
+	mgr, created := newSpyManager()
+	mgr.config.RestrictedNetworkConfig.CIDR.Deny = []string{"192.0.2.0/24"}
+	events := make(chan AuditEvent)
+
+	assert.Nil(t, mgr.StartTyped(events))
+	rb := (*created)[0]
+	go func() {
+		rb.eventsChannel <- []byte{1, 2, 3}
+		rb.eventsChannel <- readEventFixture(t, "v6_ipv4")
+		mgr.Close()
+	}()
+
+	event := <-events
+	assert.Equal(t, "curl", event.Comm)
+	assert.Equal(t, "denied by cidr 192.0.2.0/24", event.Rule)
+	_, ok := <-events
+	assert.False(t, ok)
+	// The event that could not be decoded is acknowledged too.
+	assert.Equal(t, uint64(2), atomic.LoadUint64(&mgr.reported))
+
+	// A closed Manager can not be started, and the channel is closed.
+	events = make(chan AuditEvent)
+	assert.Equal(t, ErrManagerClosed, mgr.StartTyped(events))
+	_, ok = <-events
+	assert.False(t, ok)
+}
@@ -0,0 +1,274 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"unsafe"
+
+	"github.com/aquasecurity/libbpfgo"
+)
+
+const (
+	// EVENT_SCHEMA_VERSION is the newest layout of the events parseEvent decodes, the one of
+	// restricted_network_structs.h. The layouts are:
+	//
+	//	1: the header without uid, gid and matched_cgroup, the events without verdict.
+	//	2: uid and gid after the type, and the verdict.
+	//	3: matched_cgroup after the cgroup.
+	//	4: the eventPrefix, which tells the sizes of the header and the event.
+	//	5: the local port after the verdict.
+	//	6: the rule that denied the connection after the local port.
+	//	7: whether the rule is a deny entry in mode: monitor after the rule.
+	//	8: whether the task is in a classified container after it.
+	//
+	// The events before 4 have no prefix and are told apart by their size. Since 4, a field
+	// is only ever added at the end of the header or of an event, and the version incremented.
+	EVENT_SCHEMA_VERSION = 8
+
+	// EVENT_MAGIC starts the eventPrefix, "BOHK" in little endian.
+	EVENT_MAGIC uint32 = 0x4b484f42
+
+	// EVENT_SCHEMA_MAP_NAME holds the EVENT_SCHEMA_VERSION of the loaded programs.
+	EVENT_SCHEMA_MAP_NAME = "event_schema"
+)
+
+// ErrEventSchemaTooNew is returned for programs whose events are newer than this bouheki decodes.
+var ErrEventSchemaTooNew = errors.New("the events of the programs are newer than this bouheki decodes")
+
+// eventPrefix starts the events since schema version 4. Its fields never move, so that any
+// version of the decoder finds the header and the body of any later version of the event.
+type eventPrefix struct {
+	Magic   uint32
+	Version uint16
+	// HeaderSize is the size of the header, the prefix included. The body follows it.
+	HeaderSize uint16
+	// Size is the size of the event, the header included.
+	Size uint32
+	_    uint32
+}
+
+// eventHeaderV4 is the header after the eventPrefix.
+type eventHeaderV4 struct {
+	CGroupID        uint64
+	MatchedCgroupID uint64
+	PID             uint32
+	EventType       int32
+	UID             uint32
+	GID             uint32
+	Nodename        [NEW_UTS_LEN + 1]byte
+	Command         [TASK_COMM_LEN]byte
+	ParentCommand   [TASK_COMM_LEN]byte
+	_               [PADDING_LEN]byte
+}
+
+// eventHeaderV3 is the header of the events of schema version 3, the same as version 4 without the prefix.
+type eventHeaderV3 = eventHeaderV4
+
+type eventHeaderV2 struct {
+	CGroupID      uint64
+	PID           uint32
+	EventType     int32
+	UID           uint32
+	GID           uint32
+	Nodename      [NEW_UTS_LEN + 1]byte
+	Command       [TASK_COMM_LEN]byte
+	ParentCommand [TASK_COMM_LEN]byte
+	_             [PADDING_LEN]byte
+}
+
+type eventHeaderV1 struct {
+	CGroupID      uint64
+	PID           uint32
+	EventType     int32
+	Nodename      [NEW_UTS_LEN + 1]byte
+	Command       [TASK_COMM_LEN]byte
+	ParentCommand [TASK_COMM_LEN]byte
+	_             [PADDING_LEN]byte
+}
+
+// legacyEvent is the layout of the events of a schema version before 4 and an event type.
+type legacyEvent struct {
+	version   uint16
+	eventType int32
+}
+
+// legacyEventSizes are the sizes of the events before schema version 4, the C structs
+// padded to 8 bytes.
+var legacyEventSizes = map[int]legacyEvent{
+	136: {1, BLOCKED_IPV4},
+	160: {1, BLOCKED_IPV6},
+	144: {2, BLOCKED_IPV4},
+	168: {2, BLOCKED_IPV6},
+	152: {3, BLOCKED_IPV4},
+	176: {3, BLOCKED_IPV6},
+}
+
+// parseEvent decodes an event of any schema version. The fields of a newer version than
+// EVENT_SCHEMA_VERSION are skipped, and the fields an older version does not have are zero,
+// except that the events of version 1, which were only emitted for denied connections,
+// have the deny verdict.
+func parseEvent(eventBytes []byte) (eventHeader, detectEvent, error) {
+	if len(eventBytes) >= binary.Size(eventPrefix{}) && binary.LittleEndian.Uint32(eventBytes) == EVENT_MAGIC {
+		return parseVersionedEvent(eventBytes)
+	}
+	legacy, ok := legacyEventSizes[len(eventBytes)]
+	if !ok {
+		return eventHeader{}, nil, fmt.Errorf("event of %d bytes has no known schema version", len(eventBytes))
+	}
+	return parseLegacyEvent(eventBytes, legacy)
+}
+
+func parseVersionedEvent(eventBytes []byte) (eventHeader, detectEvent, error) {
+	prefix := eventPrefix{}
+	if err := readPadded(eventBytes, &prefix); err != nil {
+		return eventHeader{}, nil, err
+	}
+	prefixSize := binary.Size(prefix)
+	switch {
+	case int(prefix.Size) > len(eventBytes):
+		return eventHeader{}, nil, fmt.Errorf("event of %d bytes is truncated, schema version %d events have %d", len(eventBytes), prefix.Version, prefix.Size)
+	case int(prefix.HeaderSize) < prefixSize || prefix.HeaderSize > uint16(prefix.Size):
+		return eventHeader{}, nil, fmt.Errorf("event of schema version %d has an invalid header size %d", prefix.Version, prefix.HeaderSize)
+	}
+
+	wire := eventHeaderV4{}
+	if err := readPadded(eventBytes[prefixSize:prefix.HeaderSize], &wire); err != nil {
+		return eventHeader{}, nil, err
+	}
+	header := eventHeader{
+		SchemaVersion:   prefix.Version,
+		CGroupID:        wire.CGroupID,
+		MatchedCgroupID: wire.MatchedCgroupID,
+		PID:             wire.PID,
+		EventType:       wire.EventType,
+		UID:             wire.UID,
+		GID:             wire.GID,
+		Nodename:        wire.Nodename,
+		Command:         wire.Command,
+		ParentCommand:   wire.ParentCommand,
+	}
+	body, err := parseEventBody(header.EventType, eventBytes[prefix.HeaderSize:prefix.Size])
+	if err != nil {
+		return eventHeader{}, nil, err
+	}
+	return header, body, nil
+}
+
+func parseLegacyEvent(eventBytes []byte, legacy legacyEvent) (eventHeader, detectEvent, error) {
+	header := eventHeader{SchemaVersion: legacy.version}
+	var wire interface{}
+	switch legacy.version {
+	case 1:
+		wire = &eventHeaderV1{}
+	case 2:
+		wire = &eventHeaderV2{}
+	default:
+		wire = &eventHeaderV3{}
+	}
+	if err := readPadded(eventBytes, wire); err != nil {
+		return eventHeader{}, nil, err
+	}
+
+	switch wire := wire.(type) {
+	case *eventHeaderV1:
+		header.CGroupID, header.PID, header.EventType = wire.CGroupID, wire.PID, wire.EventType
+		header.Nodename, header.Command, header.ParentCommand = wire.Nodename, wire.Command, wire.ParentCommand
+	case *eventHeaderV2:
+		header.CGroupID, header.PID, header.EventType, header.UID, header.GID = wire.CGroupID, wire.PID, wire.EventType, wire.UID, wire.GID
+		header.Nodename, header.Command, header.ParentCommand = wire.Nodename, wire.Command, wire.ParentCommand
+	case *eventHeaderV3:
+		header.CGroupID, header.MatchedCgroupID, header.PID, header.EventType, header.UID, header.GID = wire.CGroupID, wire.MatchedCgroupID, wire.PID, wire.EventType, wire.UID, wire.GID
+		header.Nodename, header.Command, header.ParentCommand = wire.Nodename, wire.Command, wire.ParentCommand
+	}
+	if header.EventType != legacy.eventType {
+		return eventHeader{}, nil, fmt.Errorf("event of %d bytes has type %d, schema version %d events of this size have type %d", len(eventBytes), header.EventType, legacy.version, legacy.eventType)
+	}
+
+	body, err := parseEventBody(header.EventType, eventBytes[binary.Size(wire):])
+	if err != nil {
+		return eventHeader{}, nil, err
+	}
+	if legacy.version == 1 {
+		switch b := body.(type) {
+		case detectEventIPv4:
+			b.Verdict = VERDICT_DENY
+			body = b
+		case detectEventIPv6:
+			b.Verdict = VERDICT_DENY
+			body = b
+		}
+	}
+	return header, body, nil
+}
+
+func parseEventBody(eventType int32, data []byte) (detectEvent, error) {
+	switch eventType {
+	case BLOCKED_IPV4:
+		body := detectEventIPv4{}
+		err := readPadded(data, &body)
+		return body, err
+	case BLOCKED_IPV6:
+		body := detectEventIPv6{}
+		err := readPadded(data, &body)
+		return body, err
+	default:
+		return nil, fmt.Errorf("unknown event type %d", eventType)
+	}
+}
+
+// readPadded decodes v from the start of data: the bytes of data after v are ignored, and
+// the fields of v after the end of data are zero.
+func readPadded(data []byte, v interface{}) error {
+	size := binary.Size(v)
+	if len(data) < size {
+		data = append(append([]byte{}, data...), make([]byte, size-len(data))...)
+	}
+	return binary.Read(bytes.NewReader(data[:size]), binary.LittleEndian, v)
+}
+
+// checkEventSchema refuses programs whose events are of a newer schema version than parseEvent decodes.
+func checkEventSchema(version uint32) error {
+	if version > EVENT_SCHEMA_VERSION {
+		return fmt.Errorf("%w: schema version %d, this bouheki decodes up to %d", ErrEventSchemaTooNew, version, EVENT_SCHEMA_VERSION)
+	}
+	return nil
+}
+
+// schemaMap is the subset of *libbpfgo.BPFMap EVENT_SCHEMA_MAP_NAME is read and written with.
+type schemaMap interface {
+	GetValue(key unsafe.Pointer) ([]byte, error)
+	Update(key, value unsafe.Pointer) error
+}
+
+// adoptEventSchema records the EVENT_SCHEMA_VERSION of programs that were just loaded, whose
+// map is still zero, and checks the one of programs loaded by another bouheki, e.g. pinned
+// programs that outlived the daemon that loaded them.
+func adoptEventSchema(schema schemaMap) error {
+	key := uint32(0)
+	value, err := schema.GetValue(unsafe.Pointer(&key))
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", EVENT_SCHEMA_MAP_NAME, err)
+	}
+	if len(value) != 4 {
+		return fmt.Errorf("%s: unexpected value size %d", EVENT_SCHEMA_MAP_NAME, len(value))
+	}
+	if version := binary.LittleEndian.Uint32(value); version != 0 {
+		return checkEventSchema(version)
+	}
+
+	version := uint32(EVENT_SCHEMA_VERSION)
+	if err := schema.Update(unsafe.Pointer(&key), unsafe.Pointer(&version)); err != nil {
+		return fmt.Errorf("failed to write %s: %w", EVENT_SCHEMA_MAP_NAME, err)
+	}
+	return nil
+}
+
+func adoptModuleEventSchema(mod *libbpfgo.Module) error {
+	schema, err := mod.GetMap(EVENT_SCHEMA_MAP_NAME)
+	if err != nil {
+		return err
+	}
+	return adoptEventSchema(schema)
+}
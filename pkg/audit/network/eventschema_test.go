@@ -0,0 +1,256 @@
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"unsafe"
+
+	"github.com/mrtc0/bouheki/pkg/audit/helpers"
+	"github.com/stretchr/testify/assert"
+)
+
+// The fixtures of testdata/events are the events of every schema version, as the programs of
+// that version emitted them: a blocked curl (pid 4242, cgroup 4343, uid 1000, gid 1001) run
+// by bash on node-1, connecting to port 443 of 192.0.2.1 or 2001:db8::1 from 10.0.0.2 or
+// 2001:db8::2, and since version 5 from port 40000 of those, or from an unbound socket. Since
+// version 6 they are denied by network.cidr.deny, since version 7 it is not in mode: monitor, and
+// since version 8 the task is not in a container.
+// They are never rewritten; a new schema version adds its own.
+func readEventFixture(t *testing.T, name string) []byte {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "events", name+".bin"))
+	assert.Nil(t, err)
+	return data
+}
+
+func TestParseEventOfEverySchemaVersion(t *testing.T) {
+	for _, test := range []struct {
+		fixture string
+		version uint16
+		matched uint64
+		uid     uint32
+		gid     uint32
+	}{
+		{"v1", 1, 0, 0, 0},
+		{"v2", 2, 0, 1000, 1001},
+		{"v3", 3, 4242, 1000, 1001},
+		{"v4", 4, 4242, 1000, 1001},
+		{"v5_bound", 5, 4242, 1000, 1001},
+		{"v5_unbound", 5, 4242, 1000, 1001},
+		{"v6", 6, 4242, 1000, 1001},
+		{"v7", 7, 4242, 1000, 1001},
+		{"v8", 8, 4242, 1000, 1001},
+	} {
+		for _, family := range []string{"ipv4", "ipv6"} {
+			t.Run(test.fixture+"_"+family, func(t *testing.T) {
+				header, body, err := parseEvent(readEventFixture(t, test.fixture+"_"+family))
+				assert.Nil(t, err)
+
+				assert.Equal(t, test.version, header.SchemaVersion)
+				assert.Equal(t, test.version >= 2, header.hasSubject())
+				assert.Equal(t, uint64(4343), header.CGroupID)
+				assert.Equal(t, test.matched, header.MatchedCgroupID)
+				assert.Equal(t, uint32(4242), header.PID)
+				assert.Equal(t, test.uid, header.UID)
+				assert.Equal(t, test.gid, header.GID)
+				assert.Equal(t, "node-1", helpers.NodenameToString(header.Nodename))
+				assert.Equal(t, "curl", helpers.CommToString(header.Command))
+				assert.Equal(t, "bash", helpers.CommToString(header.ParentCommand))
+
+				assert.Equal(t, ACTION_BLOCKED_STRING, body.ActionResult())
+				assert.True(t, body.Denied())
+				if test.version >= 6 {
+					assert.Equal(t, uint8(RULE_LIST_DENIED_CIDR+1), body.MatchedRule())
+				} else {
+					assert.Zero(t, body.MatchedRule())
+				}
+				assert.False(t, body.MonitorRule())
+				assert.False(t, body.InContainer())
+				networkLog := newAuditLog(header, body)
+				assert.Equal(t, uint16(443), networkLog.Port)
+				assert.Equal(t, "TCP", networkLog.Protocol)
+				if family == "ipv4" {
+					assert.Equal(t, BLOCKED_IPV4, header.EventType)
+					assert.Equal(t, "192.0.2.1", networkLog.Addr)
+				} else {
+					assert.Equal(t, BLOCKED_IPV6, header.EventType)
+					assert.Equal(t, "2001:db8::1", networkLog.Addr)
+				}
+			})
+		}
+	}
+}
+
+func TestParseMonitoredEvent(t *testing.T) {
+	// The byte after the rule is set for a deny entry in mode: monitor.
+	event := readEventFixture(t, "v7_ipv4")
+	headerSize := binary.LittleEndian.Uint16(event[6:])
+	event[uintptr(headerSize)+unsafe.Offsetof(detectEventIPv4{}.Monitored)] = 1
+	header, body, err := parseEvent(event)
+	assert.Nil(t, err)
+	assert.True(t, body.MonitorRule())
+	assert.True(t, newAuditLog(header, body).MonitorRule)
+}
+
+func TestParseContainerEvent(t *testing.T) {
+	// The byte after the monitored flag is set for a task in a classified container.
+	for _, fixture := range []string{"v8_ipv4", "v8_ipv6"} {
+		event := readEventFixture(t, fixture)
+		headerSize := binary.LittleEndian.Uint16(event[6:])
+		offset := unsafe.Offsetof(detectEventIPv4{}.Container)
+		if fixture == "v8_ipv6" {
+			offset = unsafe.Offsetof(detectEventIPv6{}.Container)
+		}
+		event[uintptr(headerSize)+offset] = 1
+		header, body, err := parseEvent(event)
+		assert.Nil(t, err)
+		assert.True(t, body.InContainer())
+		assert.True(t, eventToConnection(header, body).InContainer)
+	}
+
+	// Before version 8, the events are taken to be of a task in the target.
+	header, body, err := parseEvent(readEventFixture(t, "v7_ipv4"))
+	assert.Nil(t, err)
+	assert.True(t, eventToConnection(header, body).InContainer)
+}
+
+func TestParseEventLocalAddress(t *testing.T) {
+	for _, test := range []struct {
+		fixture   string
+		localAddr string
+		localPort uint16
+		unbound   bool
+	}{
+		// Before version 5 the port is unknown, not unbound.
+		{"v4_ipv4", "10.0.0.2", 0, false},
+		{"v4_ipv6", "2001:db8::2", 0, false},
+		{"v5_bound_ipv4", "10.0.0.2", 40000, false},
+		{"v5_bound_ipv6", "2001:db8::2", 40000, false},
+		{"v5_unbound_ipv4", "", 0, true},
+		{"v5_unbound_ipv6", "", 0, true},
+	} {
+		t.Run(test.fixture, func(t *testing.T) {
+			header, body, err := parseEvent(readEventFixture(t, test.fixture))
+			assert.Nil(t, err)
+
+			networkLog := newAuditLog(header, body)
+			assert.Equal(t, test.localAddr, networkLog.LocalAddr)
+			assert.Equal(t, test.localPort, networkLog.LocalPort)
+			assert.Equal(t, test.unbound, networkLog.Unbound)
+
+			match := alertEvent(networkLog)
+			assert.Equal(t, test.unbound, match.Unbound)
+			assert.Equal(t, test.localAddr != "", match.LocalAddr != nil)
+		})
+	}
+
+	// A socket bound to a port of any address is not unbound.
+	event := readEventFixture(t, "v5_unbound_ipv4")
+	binary.LittleEndian.PutUint16(event[len(event)-2:], 40000)
+	header, body, err := parseEvent(event)
+	assert.Nil(t, err)
+	networkLog := newAuditLog(header, body)
+	assert.Equal(t, "0.0.0.0", networkLog.LocalAddr)
+	assert.False(t, networkLog.Unbound)
+}
+
+// nextVersionEvent returns the v4 fixture as a later version that appended a field to the
+// header and another to the event.
+func nextVersionEvent(t *testing.T) []byte {
+	v4 := readEventFixture(t, "v4_ipv4")
+	headerSize := binary.LittleEndian.Uint16(v4[6:])
+
+	event := append([]byte{}, v4[:headerSize]...)
+	event = append(event, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff)
+	event = append(event, v4[headerSize:]...)
+	event = append(event, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff)
+	binary.LittleEndian.PutUint16(event[4:], EVENT_SCHEMA_VERSION+1)
+	binary.LittleEndian.PutUint16(event[6:], headerSize+8)
+	binary.LittleEndian.PutUint32(event[8:], uint32(len(event)))
+	return event
+}
+
+func TestParseEventSkipsTheFieldsOfNewerVersions(t *testing.T) {
+	header, body, err := parseEvent(nextVersionEvent(t))
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(EVENT_SCHEMA_VERSION+1), header.SchemaVersion)
+	assert.Equal(t, uint32(1000), header.UID)
+	assert.Equal(t, "192.0.2.1", byte2IPv4(body.(detectEventIPv4).DstIP))
+	assert.Equal(t, VERDICT_DENY, body.(detectEventIPv4).Verdict)
+
+	// Whatever the ring buffer adds after the size of the event is ignored too.
+	_, _, err = parseEvent(append(nextVersionEvent(t), 0, 0, 0, 0))
+	assert.Nil(t, err)
+}
+
+func TestParseEventZeroesTheMissingFields(t *testing.T) {
+	// A header that ends before the gid, as an older layout after the prefix would.
+	v4 := readEventFixture(t, "v4_ipv4")
+	event := append([]byte{}, v4[:44]...)
+	event = append(event, v4[binary.LittleEndian.Uint16(v4[6:]):]...)
+	binary.LittleEndian.PutUint16(event[6:], 44)
+	binary.LittleEndian.PutUint32(event[8:], uint32(len(event)))
+
+	header, body, err := parseEvent(event)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(4242), header.PID)
+	assert.Equal(t, uint32(1000), header.UID)
+	assert.Zero(t, header.GID)
+	assert.Equal(t, uint16(443), body.(detectEventIPv4).DstPort)
+}
+
+func TestParseEventRejectsMalformedEvents(t *testing.T) {
+	truncated := readEventFixture(t, "v4_ipv4")
+	binary.LittleEndian.PutUint32(truncated[8:], uint32(len(truncated)+8))
+	_, _, err := parseEvent(truncated)
+	assert.NotNil(t, err)
+
+	header := readEventFixture(t, "v4_ipv4")
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	_, _, err = parseEvent(header)
+	assert.NotNil(t, err)
+
+	_, _, err = parseEvent(make([]byte, 100))
+	assert.NotNil(t, err)
+
+	unknownType := readEventFixture(t, "v3_ipv4")
+	binary.LittleEndian.PutUint32(unknownType[20:], 7)
+	_, _, err = parseEvent(unknownType)
+	assert.NotNil(t, err)
+}
+
+type fakeSchemaMap struct {
+	value     uint32
+	updateErr error
+}
+
+func (m *fakeSchemaMap) GetValue(key unsafe.Pointer) ([]byte, error) {
+	value := make([]byte, 4)
+	binary.LittleEndian.PutUint32(value, m.value)
+	return value, nil
+}
+
+func (m *fakeSchemaMap) Update(key, value unsafe.Pointer) error {
+	if m.updateErr != nil {
+		return m.updateErr
+	}
+	m.value = *(*uint32)(value)
+	return nil
+}
+
+func TestAdoptEventSchema(t *testing.T) {
+	// Programs that were just loaded get the version of this bouheki.
+	loaded := &fakeSchemaMap{}
+	assert.Nil(t, adoptEventSchema(loaded))
+	assert.Equal(t, uint32(EVENT_SCHEMA_VERSION), loaded.value)
+
+	// Programs of an older bouheki are adopted, their events are decoded.
+	older := &fakeSchemaMap{value: EVENT_SCHEMA_VERSION - 1}
+	assert.Nil(t, adoptEventSchema(older))
+	assert.Equal(t, uint32(EVENT_SCHEMA_VERSION-1), older.value)
+
+	assert.ErrorIs(t, adoptEventSchema(&fakeSchemaMap{value: EVENT_SCHEMA_VERSION + 1}), ErrEventSchemaTooNew)
+	assert.NotNil(t, adoptEventSchema(&fakeSchemaMap{updateErr: errors.New("EPERM")}))
+}
@@ -0,0 +1,183 @@
+package network
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/jobs"
+	log "github.com/mrtc0/bouheki/pkg/log"
+	"github.com/mrtc0/bouheki/pkg/policy"
+)
+
+const (
+	// TASK_EXE_PATH_MAP_NAME is the per-task map of the executables the tasks run.
+	TASK_EXE_PATH_MAP_NAME = "task_exe_paths"
+	// TASK_EXEC_PROGRAM_NAME records the executable of a task when it executes one.
+	TASK_EXEC_PROGRAM_NAME = "task_exec"
+	// TASK_FORK_PROGRAM_NAME copies the executable of a process to the processes it forks.
+	TASK_FORK_PROGRAM_NAME = "task_fork"
+	// TASK_FORK_TRACEPOINT is the raw tracepoint TASK_FORK_PROGRAM_NAME is attached to.
+	TASK_FORK_TRACEPOINT = "sched_process_fork"
+
+	// EXE_PATH_ENTRY_SIZE is the size of struct exe_path_entry: the struct task_entry and the
+	// struct path_trie_key, padded to the alignment of the former.
+	EXE_PATH_ENTRY_SIZE = 8 + 4 + policy.EXE_PATH_LEN + 4
+
+	// EXE_PATH_SEED_INTERVAL is how often the executables of the tasks are read from /proc
+	// when task_exec can not be attached.
+	EXE_PATH_SEED_INTERVAL = 10 * time.Second
+)
+
+// tracksExePaths reports whether conf has rules of network.command.allow_paths or deny_paths,
+// for which the executables of the tasks are tracked.
+func tracksExePaths(conf *config.Config) bool {
+	command := conf.RestrictedNetworkConfig.Command
+	return len(command.AllowPaths) > 0 || len(command.DenyPaths) > 0
+}
+
+// exePathEntry returns the struct exe_path_entry of a task that started startTime, in USER_HZ
+// since boot, and runs exe.
+func exePathEntry(startTime uint64, exe string) []byte {
+	entry := make([]byte, EXE_PATH_ENTRY_SIZE)
+	binary.LittleEndian.PutUint64(entry[0:8], startTime*uint64(time.Second/USER_HZ))
+	// An executable is never a prefix: its NUL is in the prefix length, as bpf_d_path counts it.
+	copy(entry[8:], pathToKey(exe))
+	return entry
+}
+
+// attachExePaths attaches the programs that track the executables of the tasks, and writes the
+// ones of the tasks that are already running. Without the BPF LSM, task_exec can not be
+// attached, and AsyncExePathSeed reads the executables of the tasks from /proc instead, which
+// misses the ones a task executes between two reads.
+func (m *Manager) attachExePaths() {
+	if !tracksExePaths(m.config) {
+		return
+	}
+	m.registerTaskMap(TASK_EXE_PATH_MAP_NAME)
+
+	if err := m.attachRawTracepoint(TASK_FORK_PROGRAM_NAME, TASK_FORK_TRACEPOINT); err != nil {
+		log.Warn(fmt.Sprintf("Failed to attach %s, the executables of the forked processes are read from %s: %s", TASK_FORK_PROGRAM_NAME, PROC_ROOT, err))
+	} else if err := m.attachExec(); err != nil {
+		log.Warn(fmt.Sprintf("Failed to attach %s, the executables of the tasks are read from %s every %s: %s", TASK_EXEC_PROGRAM_NAME, PROC_ROOT, EXE_PATH_SEED_INTERVAL, err))
+	} else {
+		m.exeTracked = true
+	}
+
+	seeded, err := m.seedExePaths()
+	if err != nil {
+		log.Error(fmt.Errorf("failed to read the executables of the running tasks: %w", err))
+		return
+	}
+	log.Debug(fmt.Sprintf("Read the executables of %d running tasks.", seeded))
+}
+
+func (m *Manager) attachExec() error {
+	if m.hook == config.HOOK_KPROBE {
+		return fmt.Errorf("%s is an LSM program, and the kprobes are loaded", TASK_EXEC_PROGRAM_NAME)
+	}
+	prog, err := m.mod.GetProgram(TASK_EXEC_PROGRAM_NAME)
+	if err != nil {
+		return err
+	}
+	link, err := prog.AttachLSM()
+	if err != nil {
+		return err
+	}
+	m.addLink(link)
+	return nil
+}
+
+func (m *Manager) attachRawTracepoint(progName string, tracepoint string) error {
+	prog, err := m.mod.GetProgram(progName)
+	if err != nil {
+		return err
+	}
+	link, err := prog.AttachRawTracepoint(tracepoint)
+	if err != nil {
+		return err
+	}
+	m.addLink(link)
+	return nil
+}
+
+// AsyncExePathSeed reads the executables of the tasks every EXE_PATH_SEED_INTERVAL, when they
+// are tracked and task_exec could not be attached.
+func (m *Manager) AsyncExePathSeed() {
+	if !tracksExePaths(m.config) || m.exeTracked {
+		return
+	}
+
+	go func() {
+		for {
+			m.sleep(EXE_PATH_SEED_INTERVAL)
+			err := m.Jobs().Do("exe-path-seed", func(ctx context.Context) error {
+				_, err := m.seedExePaths()
+				return err
+			})
+			if err == jobs.ErrStopped {
+				return
+			}
+			if err != nil {
+				log.Error(err)
+			}
+		}
+	}()
+}
+
+// seedExePaths writes the executables of the processes under the proc root to the map. Once
+// task_exec is attached, the processes that have an entry are skipped, since it is newer than
+// what was read. It returns how many entries it wrote.
+func (m *Manager) seedExePaths() (int, error) {
+	root := m.procRoot
+	if root == "" {
+		root = PROC_ROOT
+	}
+	table, err := m.taskMap(TASK_EXE_PATH_MAP_NAME)
+	if err != nil {
+		return 0, err
+	}
+	known := map[string][]byte{}
+	if m.exeTracked {
+		if known, err = table.entries(); err != nil {
+			return 0, fmt.Errorf("%s: %w", TASK_EXE_PATH_MAP_NAME, err)
+		}
+	}
+	dirs, err := os.ReadDir(root)
+	if err != nil {
+		return 0, err
+	}
+
+	seeded := 0
+	for _, dir := range dirs {
+		tgid, err := strconv.ParseUint(dir.Name(), 10, 32)
+		if err != nil {
+			continue
+		}
+		key := make([]byte, 4)
+		binary.LittleEndian.PutUint32(key, uint32(tgid))
+		if _, ok := known[string(key)]; ok {
+			continue
+		}
+
+		// The kernel threads have no executable, and a task may exit meanwhile.
+		exe, err := os.Readlink(filepath.Join(root, dir.Name(), "exe"))
+		if err != nil || len(exe) >= policy.EXE_PATH_LEN {
+			continue
+		}
+		start, err := m.taskStartTime(uint32(tgid))
+		if err != nil {
+			continue
+		}
+		if err := table.Update(key, exePathEntry(start, exe)); err != nil {
+			return seeded, fmt.Errorf("%s: %w", TASK_EXE_PATH_MAP_NAME, err)
+		}
+		seeded++
+	}
+	return seeded, nil
+}
@@ -0,0 +1,76 @@
+package network
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/bouhekitest"
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPathToKey(t *testing.T) {
+	// An executable is matched with its NUL, a directory as a prefix.
+	key := pathToKey("/usr/bin/curl")
+	assert.Len(t, key, 4+256)
+	assert.Equal(t, uint32(14*8), binary.LittleEndian.Uint32(key[0:4]))
+	assert.Equal(t, "/usr/bin/curl", keyToPath(key))
+
+	key = pathToKey("/usr/local/bin/")
+	assert.Equal(t, uint32(15*8), binary.LittleEndian.Uint32(key[0:4]))
+	assert.Equal(t, "/usr/local/bin/", keyToPath(key))
+
+	entry := exePathEntry(12, "/usr/bin/curl")
+	assert.Len(t, entry, EXE_PATH_ENTRY_SIZE)
+	assert.Equal(t, uint64(12*time.Second/USER_HZ), binary.LittleEndian.Uint64(entry[0:8]))
+	assert.Equal(t, pathToKey("/usr/bin/curl"), entry[8:8+4+256])
+}
+
+// writeProc writes the stat and the exe of pid to the proc root, the exe unless it is empty.
+func writeProc(t *testing.T, root string, pid string, startTime string, exe string) {
+	dir := filepath.Join(root, pid)
+	assert.Nil(t, os.MkdirAll(dir, 0755))
+	stat := pid + " (a b) S 1 1 1 0 -1 4194304 0 0 0 0 0 0 0 0 20 0 1 0 " + startTime + " 0 0\n"
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "stat"), []byte(stat), 0644))
+	if exe != "" {
+		assert.Nil(t, os.Symlink(exe, filepath.Join(dir, "exe")))
+	}
+}
+
+func TestSeedExePaths(t *testing.T) {
+	root := t.TempDir()
+	writeProc(t, root, "100", "500", "/usr/bin/curl")
+	writeProc(t, root, "200", "600", "/usr/local/bin/tool")
+	// A kernel thread.
+	writeProc(t, root, "2", "1", "")
+	assert.Nil(t, os.MkdirAll(filepath.Join(root, "sys"), 0755))
+
+	conf := config.DefaultConfig()
+	conf.RestrictedNetworkConfig.Command.AllowPaths = []string{"/usr/bin/curl"}
+	maps := bouhekitest.NewMaps()
+	mgr := Manager{config: conf, backend: maps, procRoot: root}
+	assert.True(t, tracksExePaths(conf))
+
+	seeded, err := mgr.seedExePaths()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, seeded)
+	assert.Equal(t, exePathEntry(500, "/usr/bin/curl"), maps.Entries(TASK_EXE_PATH_MAP_NAME)[string(uintToKey(100))])
+
+	// Once task_exec records the executables, the entries it wrote are newer.
+	mgr.exeTracked = true
+	assert.Nil(t, maps.Update(TASK_EXE_PATH_MAP_NAME, uintToKey(100), exePathEntry(500, "/usr/bin/wget")))
+	seeded, err = mgr.seedExePaths()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, seeded)
+	assert.Equal(t, exePathEntry(500, "/usr/bin/wget"), maps.Entries(TASK_EXE_PATH_MAP_NAME)[string(uintToKey(100))])
+
+	// The entries are swept with the other per-task maps.
+	mgr.registerTaskMap(TASK_EXE_PATH_MAP_NAME)
+	assert.Nil(t, os.RemoveAll(filepath.Join(root, "200")))
+	swept, err := mgr.sweepTaskMaps()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, swept)
+}
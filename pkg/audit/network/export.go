@@ -0,0 +1,607 @@
+package network
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+	log "github.com/mrtc0/bouheki/pkg/log"
+)
+
+const (
+	// POLICY_EXPORT_VERSION is the version of the PolicyExport format.
+	POLICY_EXPORT_VERSION = 1
+
+	// POLICY_SNAPSHOT_FILE is the name of the snapshot in network.policy_snapshot.state_dir.
+	POLICY_SNAPSHOT_FILE = "policy.json"
+
+	// POLICY_DIFF_MAX_ENTRIES bounds the entries of a list that are spelled out in PolicyDiff.String.
+	POLICY_DIFF_MAX_ENTRIES = 10
+
+	POLICY_CHANGE_ADDED   = "added"
+	POLICY_CHANGE_REMOVED = "removed"
+	POLICY_CHANGE_CHANGED = "changed"
+)
+
+// PolicyExport is the canonical form of the rules of a config: the lists are normalized as they
+// are written to the maps, deduplicated and sorted, so that two configs with the same rules have
+// the same export. The addresses the domains resolve to are not part of it.
+type PolicyExport struct {
+	Version                int                   `json:"version"`
+	ExportedAt             time.Time             `json:"exported_at"`
+	Mode                   string                `json:"mode"`
+	Target                 string                `json:"target"`
+	CommandCaseInsensitive bool                  `json:"command_case_insensitive"`
+	CIDR                   PolicyExportList      `json:"cidr"`
+	Domain                 PolicyExportList      `json:"domain"`
+	Command                PolicyExportList      `json:"command"`
+	UID                    PolicyExportIDList    `json:"uid"`
+	GID                    PolicyExportIDList    `json:"gid"`
+	Ports                  PolicyExportList      `json:"ports"`
+	RuleSets               []PolicyExportRuleSet `json:"rule_sets"`
+	// Protocols are the protocol rules of network.cidr and network.domain, by protocol, of the
+	// protocols that have any.
+	Protocols map[string]PolicyExportProtocol `json:"protocols,omitempty"`
+	// Ingress are the lists of network.ingress, if any has entries.
+	Ingress *PolicyExportIngress `json:"ingress,omitempty"`
+	// CommandPaths are network.command.allow_paths and deny_paths, if either has entries.
+	CommandPaths *PolicyExportList `json:"command_paths,omitempty"`
+	// UIDRanges are the ranges of network.uid, if either list has any. UID has its other uids.
+	UIDRanges *PolicyExportList `json:"uid_ranges,omitempty"`
+	// CIDRAllowExcept is network.cidr.allow_except, if it has entries.
+	CIDRAllowExcept []string `json:"cidr_allow_except,omitempty"`
+	// Groups are the groups the lists reference, with their entries expanded, and
+	// GroupReferences the groups each list references. The lists include the entries of the groups.
+	Groups          map[string]PolicyExportGroup `json:"groups,omitempty"`
+	GroupReferences map[string][]string          `json:"group_references,omitempty"`
+	// LastHits are the rules with when they last matched a connection, when network.rule_hits
+	// is enabled. They are not compared by DiffPolicies.
+	LastHits []RuleHit `json:"last_hits,omitempty"`
+}
+
+type PolicyExportList struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+type PolicyExportProtocol struct {
+	CIDR   PolicyExportList `json:"cidr"`
+	Domain PolicyExportList `json:"domain"`
+}
+
+type PolicyExportIngress struct {
+	CIDR  PolicyExportList `json:"cidr"`
+	Ports PolicyExportList `json:"ports"`
+}
+
+// commandPaths returns network.command.allow_paths and deny_paths of e, empty if it has none.
+func (e *PolicyExport) commandPaths() PolicyExportList {
+	if e.CommandPaths == nil {
+		return PolicyExportList{}
+	}
+	return *e.CommandPaths
+}
+
+// uidRanges returns the ranges of network.uid of e, empty if it has none.
+func (e *PolicyExport) uidRanges() PolicyExportList {
+	if e.UIDRanges == nil {
+		return PolicyExportList{}
+	}
+	return *e.UIDRanges
+}
+
+// ingress returns the lists of network.ingress of e, empty if it has none.
+func (e *PolicyExport) ingress() PolicyExportIngress {
+	if e.Ingress == nil {
+		return PolicyExportIngress{}
+	}
+	return *e.Ingress
+}
+
+type PolicyExportIDList struct {
+	Allow []uint `json:"allow"`
+	Deny  []uint `json:"deny"`
+}
+
+type PolicyExportGroup struct {
+	CIDR   []string `json:"cidr"`
+	Domain []string `json:"domain"`
+}
+
+type PolicyExportRuleSet struct {
+	Name string `json:"name"`
+	List string `json:"list"`
+	File string `json:"file"`
+}
+
+// ExportPolicy returns the PolicyExport of the network rules of conf.
+func ExportPolicy(conf *config.Config) *PolicyExport {
+	network := conf.RestrictedNetworkConfig
+	export := &PolicyExport{
+		Version:                POLICY_EXPORT_VERSION,
+		ExportedAt:             time.Now().UTC(),
+		Mode:                   network.Mode,
+		Target:                 network.Target,
+		CommandCaseInsensitive: network.Command.CaseInsensitive,
+		CIDR:                   PolicyExportList{Allow: canonicalCIDRs(network.CIDR.Allow), Deny: canonicalCIDRs(network.CIDR.Deny)},
+		Domain:                 PolicyExportList{Allow: canonicalStrings(network.Domain.Allow, toCanonicalDomain), Deny: canonicalStrings(network.Domain.Deny, toCanonicalDomain)},
+		Command:                PolicyExportList{Allow: canonicalStrings(network.Command.Allow, toCanonicalCommand), Deny: canonicalStrings(network.Command.Deny, toCanonicalCommand)},
+		GID:                    PolicyExportIDList{Allow: canonicalIDs(config.GIDs(network.GID.Allow)), Deny: canonicalIDs(config.GIDs(network.GID.Deny))},
+		Ports:                  PolicyExportList{Allow: canonicalStrings(network.Ports.Allow, toCanonicalPortRange), Deny: canonicalStrings(network.Ports.Deny, toCanonicalPortRange)},
+		RuleSets:               []PolicyExportRuleSet{},
+	}
+	for _, protocol := range ruleProtocols {
+		cidrAllow, cidrDeny := config.ProtocolLists(network.CIDR.Protocols, protocol)
+		domainAllow, domainDeny := config.ProtocolLists(network.Domain.Protocols, protocol)
+		if len(cidrAllow)+len(cidrDeny)+len(domainAllow)+len(domainDeny) == 0 {
+			continue
+		}
+		if export.Protocols == nil {
+			export.Protocols = map[string]PolicyExportProtocol{}
+		}
+		export.Protocols[protocol] = PolicyExportProtocol{
+			CIDR:   PolicyExportList{Allow: canonicalCIDRs(cidrAllow), Deny: canonicalCIDRs(cidrDeny)},
+			Domain: PolicyExportList{Allow: canonicalStrings(domainAllow, toCanonicalDomain), Deny: canonicalStrings(domainDeny, toCanonicalDomain)},
+		}
+	}
+	if ingress := network.Ingress; ingress.HasRules() {
+		export.Ingress = &PolicyExportIngress{
+			CIDR:  PolicyExportList{Allow: canonicalCIDRs(ingress.CIDR.Allow), Deny: canonicalCIDRs(ingress.CIDR.Deny)},
+			Ports: PolicyExportList{Allow: canonicalStrings(ingress.Ports.Allow, toCanonicalPortRange), Deny: canonicalStrings(ingress.Ports.Deny, toCanonicalPortRange)},
+		}
+	}
+	allowedUIDs, allowedUIDRanges := config.SplitUIDs(network.UID.Allow)
+	deniedUIDs, deniedUIDRanges := config.SplitUIDs(network.UID.Deny)
+	export.UID = PolicyExportIDList{Allow: canonicalIDs(allowedUIDs), Deny: canonicalIDs(deniedUIDs)}
+	if len(allowedUIDRanges)+len(deniedUIDRanges) > 0 {
+		export.UIDRanges = &PolicyExportList{Allow: canonicalUIDRanges(allowedUIDRanges), Deny: canonicalUIDRanges(deniedUIDRanges)}
+	}
+	if len(network.CIDR.AllowExcept) > 0 {
+		export.CIDRAllowExcept = canonicalCIDRs(network.CIDR.AllowExcept)
+	}
+	if command := network.Command; len(command.AllowPaths)+len(command.DenyPaths) > 0 {
+		export.CommandPaths = &PolicyExportList{Allow: canonicalStrings(command.AllowPaths, toCanonicalPath), Deny: canonicalStrings(command.DenyPaths, toCanonicalPath)}
+	}
+	for _, set := range network.RuleSets.Sets {
+		export.RuleSets = append(export.RuleSets, PolicyExportRuleSet{Name: set.Name, List: set.List, File: set.File})
+	}
+	sort.Slice(export.RuleSets, func(i, j int) bool { return export.RuleSets[i].Name < export.RuleSets[j].Name })
+
+	for _, key := range config.GroupListKeys() {
+		for _, name := range conf.ListGroups(key) {
+			if export.GroupReferences == nil {
+				export.Groups = map[string]PolicyExportGroup{}
+				export.GroupReferences = map[string][]string{}
+			}
+			export.GroupReferences[key] = append(export.GroupReferences[key], name)
+			export.Groups[name] = PolicyExportGroup{
+				CIDR:   canonicalCIDRs(conf.GroupEntries(name, config.GROUP_KIND_CIDR)),
+				Domain: canonicalStrings(conf.GroupEntries(name, config.GROUP_KIND_DOMAIN), toCanonicalDomain),
+			}
+		}
+	}
+	return export
+}
+
+// deniedGroups returns the group of the prefixes of network.cidr.deny that came from a group, by
+// prefix. A prefix also listed directly, in whatever form, keeps no group.
+func deniedGroups(conf *config.Config) map[string]string {
+	groups, direct := map[string]string{}, map[string]struct{}{}
+	for _, entry := range conf.RestrictedNetworkConfig.CIDR.Deny {
+		prefix := canonicalCIDRs([]string{entry})[0]
+		if group := conf.EntryGroup("network.cidr.deny", entry); group != "" {
+			groups[prefix] = group
+		} else {
+			direct[prefix] = struct{}{}
+		}
+	}
+	for prefix := range direct {
+		delete(groups, prefix)
+	}
+	return groups
+}
+
+// groupEntries returns the entries the groups referenced by the list key add to it.
+func (e *PolicyExport) groupEntries(key string) map[string]struct{} {
+	entries := map[string]struct{}{}
+	for _, name := range e.GroupReferences[key] {
+		group := e.Groups[name]
+		list := group.CIDR
+		if strings.HasPrefix(key, "network.domain.") {
+			list = group.Domain
+		}
+		for _, entry := range list {
+			entries[entry] = struct{}{}
+		}
+	}
+	return entries
+}
+
+// canonicalCIDRs returns the prefixes the CIDRs are written to the maps as, e.g. 10.1.2.3/8 as 10.0.0.0/8.
+func canonicalCIDRs(cidrs []string) []string {
+	return canonicalStrings(cidrs, func(cidr string) string {
+		addr, err := cidrToBPFMapKey(cidr)
+		if err != nil {
+			return cidr
+		}
+		return keyToIPNet(addr.key).String()
+	})
+}
+
+func toCanonicalDomain(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(domain), ".")
+}
+
+// toCanonicalCommand returns the command as it is compared with the comm, truncated to its key.
+// A pattern is kept as it is parsed, unless it is the same as a command.
+func toCanonicalCommand(command string) string {
+	if config.IsCommandPattern(command) {
+		if pattern, err := config.ParseCommandPattern(command); err == nil {
+			if command, ok := pattern.Command(); ok {
+				return command
+			}
+			return pattern.String()
+		}
+	}
+	return strings.TrimRight(string(CommandKey(command)), "\x00")
+}
+
+// toCanonicalPath returns the path as it is written to the maps, which is as it is written in
+// the config, since only clean paths are valid.
+func toCanonicalPath(path string) string {
+	return path
+}
+
+// toCanonicalPortRange returns the range as it is parsed, e.g. 443-443 as 443.
+func toCanonicalPortRange(entry string) string {
+	r, err := config.ParsePortRange(entry)
+	if err != nil {
+		return entry
+	}
+	return r.String()
+}
+
+func canonicalUIDRanges(ranges []config.UIDRange) []string {
+	entries := []string{}
+	for _, r := range ranges {
+		entries = append(entries, r.String())
+	}
+	return canonicalStrings(entries, func(entry string) string { return entry })
+}
+
+func canonicalStrings(entries []string, canonical func(string) string) []string {
+	seen := map[string]struct{}{}
+	result := []string{}
+	for _, entry := range entries {
+		entry = canonical(entry)
+		if _, ok := seen[entry]; ok {
+			continue
+		}
+		seen[entry] = struct{}{}
+		result = append(result, entry)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func canonicalIDs(ids []uint) []uint {
+	seen := map[uint]struct{}{}
+	result := []uint{}
+	for _, id := range ids {
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+		result = append(result, id)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+	return result
+}
+
+// PolicyChange is a rule of Key that was added or removed, or a setting that changed From To.
+type PolicyChange struct {
+	Kind  string `json:"kind"`
+	Key   string `json:"key"`
+	Entry string `json:"entry,omitempty"`
+	From  string `json:"from,omitempty"`
+	To    string `json:"to,omitempty"`
+}
+
+// PolicyDiff is the difference between two exports, by key and then by entry.
+type PolicyDiff struct {
+	Changes []PolicyChange `json:"changes"`
+}
+
+func (d PolicyDiff) Empty() bool {
+	return len(d.Changes) == 0
+}
+
+// Count returns the number of changes of kind.
+func (d PolicyDiff) Count(kind string) int {
+	n := 0
+	for _, change := range d.Changes {
+		if change.Kind == kind {
+			n++
+		}
+	}
+	return n
+}
+
+// String returns the diff on one line, e.g.
+// "network.mode: monitor -> block; network.cidr.allow: +10.0.0.0/8 -192.0.2.0/24".
+// Only the first POLICY_DIFF_MAX_ENTRIES entries of a key are spelled out.
+func (d PolicyDiff) String() string {
+	if d.Empty() {
+		return "no changes"
+	}
+
+	groups := []string{}
+	for i := 0; i < len(d.Changes); {
+		key := d.Changes[i].Key
+		parts := []string{}
+		more := 0
+		for ; i < len(d.Changes) && d.Changes[i].Key == key; i++ {
+			change := d.Changes[i]
+			if len(parts) == POLICY_DIFF_MAX_ENTRIES {
+				more++
+				continue
+			}
+			switch change.Kind {
+			case POLICY_CHANGE_ADDED:
+				parts = append(parts, "+"+change.Entry)
+			case POLICY_CHANGE_REMOVED:
+				parts = append(parts, "-"+change.Entry)
+			default:
+				part := fmt.Sprintf("%s -> %s", change.From, change.To)
+				if change.Entry != "" {
+					part = fmt.Sprintf("~%s (%s)", change.Entry, part)
+				}
+				parts = append(parts, part)
+			}
+		}
+		if more > 0 {
+			parts = append(parts, fmt.Sprintf("(%d more)", more))
+		}
+		groups = append(groups, key+": "+strings.Join(parts, " "))
+	}
+	return strings.Join(groups, "; ")
+}
+
+// DiffPolicies returns the changes that turn previous into current. ExportedAt is not compared.
+// The entries a group adds to a list, or removes from it, are reported as the changes of the
+// group or of the references of the list rather than entry by entry.
+func DiffPolicies(previous, current *PolicyExport) PolicyDiff {
+	diff := PolicyDiff{Changes: []PolicyChange{}}
+
+	for _, setting := range []struct {
+		key      string
+		from, to string
+	}{
+		{"network.mode", previous.Mode, current.Mode},
+		{"network.target", previous.Target, current.Target},
+		{"network.command.case_insensitive", strconv.FormatBool(previous.CommandCaseInsensitive), strconv.FormatBool(current.CommandCaseInsensitive)},
+	} {
+		if setting.from != setting.to {
+			diff.Changes = append(diff.Changes, PolicyChange{Kind: POLICY_CHANGE_CHANGED, Key: setting.key, From: setting.from, To: setting.to})
+		}
+	}
+
+	type diffedList struct {
+		key      string
+		from, to []string
+	}
+	lists := []diffedList{
+		{"network.cidr.allow", previous.CIDR.Allow, current.CIDR.Allow},
+		{"network.cidr.deny", previous.CIDR.Deny, current.CIDR.Deny},
+		{"network.cidr.allow_except", previous.CIDRAllowExcept, current.CIDRAllowExcept},
+		{"network.domain.allow", previous.Domain.Allow, current.Domain.Allow},
+		{"network.domain.deny", previous.Domain.Deny, current.Domain.Deny},
+		{"network.command.allow", previous.Command.Allow, current.Command.Allow},
+		{"network.command.deny", previous.Command.Deny, current.Command.Deny},
+		{"network.command.allow_paths", previous.commandPaths().Allow, current.commandPaths().Allow},
+		{"network.command.deny_paths", previous.commandPaths().Deny, current.commandPaths().Deny},
+		{"network.uid.allow", append(idStrings(previous.UID.Allow), previous.uidRanges().Allow...), append(idStrings(current.UID.Allow), current.uidRanges().Allow...)},
+		{"network.uid.deny", append(idStrings(previous.UID.Deny), previous.uidRanges().Deny...), append(idStrings(current.UID.Deny), current.uidRanges().Deny...)},
+		{"network.gid.allow", idStrings(previous.GID.Allow), idStrings(current.GID.Allow)},
+		{"network.gid.deny", idStrings(previous.GID.Deny), idStrings(current.GID.Deny)},
+		{"network.ports.allow", previous.Ports.Allow, current.Ports.Allow},
+		{"network.ports.deny", previous.Ports.Deny, current.Ports.Deny},
+		{"network.ingress.cidr.allow", previous.ingress().CIDR.Allow, current.ingress().CIDR.Allow},
+		{"network.ingress.cidr.deny", previous.ingress().CIDR.Deny, current.ingress().CIDR.Deny},
+		{"network.ingress.ports.allow", previous.ingress().Ports.Allow, current.ingress().Ports.Allow},
+		{"network.ingress.ports.deny", previous.ingress().Ports.Deny, current.ingress().Ports.Deny},
+	}
+	for _, protocol := range ruleProtocols {
+		from, to := previous.Protocols[protocol], current.Protocols[protocol]
+		lists = append(lists,
+			diffedList{fmt.Sprintf("network.cidr.protocols[%s].allow", protocol), from.CIDR.Allow, to.CIDR.Allow},
+			diffedList{fmt.Sprintf("network.cidr.protocols[%s].deny", protocol), from.CIDR.Deny, to.CIDR.Deny},
+			diffedList{fmt.Sprintf("network.domain.protocols[%s].allow", protocol), from.Domain.Allow, to.Domain.Allow},
+			diffedList{fmt.Sprintf("network.domain.protocols[%s].deny", protocol), from.Domain.Deny, to.Domain.Deny},
+		)
+	}
+	for _, list := range lists {
+		diff.Changes = append(diff.Changes, diffList(list.key, groupReferences(previous.GroupReferences[list.key]), groupReferences(current.GroupReferences[list.key]))...)
+		removedByGroups, addedByGroups := previous.groupEntries(list.key), current.groupEntries(list.key)
+		for _, change := range diffList(list.key, list.from, list.to) {
+			if _, ok := addedByGroups[change.Entry]; ok && change.Kind == POLICY_CHANGE_ADDED {
+				continue
+			}
+			if _, ok := removedByGroups[change.Entry]; ok && change.Kind == POLICY_CHANGE_REMOVED {
+				continue
+			}
+			diff.Changes = append(diff.Changes, change)
+		}
+	}
+
+	diff.Changes = append(diff.Changes, diffRuleSets(previous.RuleSets, current.RuleSets)...)
+	diff.Changes = append(diff.Changes, diffGroups(previous.Groups, current.Groups)...)
+	return diff
+}
+
+func groupReferences(names []string) []string {
+	references := []string{}
+	for _, name := range names {
+		references = append(references, config.GroupReference(name))
+	}
+	return references
+}
+
+// diffGroups compares the entries of the groups present in both, by name. A group that is
+// only in one of them is added or removed with the reference of a list.
+func diffGroups(from, to map[string]PolicyExportGroup) []PolicyChange {
+	names := []string{}
+	for name := range to {
+		if _, ok := from[name]; ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	changes := []PolicyChange{}
+	for _, name := range names {
+		changes = append(changes, diffList("groups."+name+".cidr", from[name].CIDR, to[name].CIDR)...)
+		changes = append(changes, diffList("groups."+name+".domain", from[name].Domain, to[name].Domain)...)
+	}
+	return changes
+}
+
+func idStrings(ids []uint) []string {
+	result := make([]string, 0, len(ids))
+	for _, id := range ids {
+		result = append(result, strconv.FormatUint(uint64(id), 10))
+	}
+	return result
+}
+
+// diffList returns the entries added to key, then the removed ones, in the order of the lists.
+func diffList(key string, from, to []string) []PolicyChange {
+	changes := []PolicyChange{}
+	previous := map[string]struct{}{}
+	for _, entry := range from {
+		previous[entry] = struct{}{}
+	}
+	current := map[string]struct{}{}
+	for _, entry := range to {
+		current[entry] = struct{}{}
+		if _, ok := previous[entry]; !ok {
+			changes = append(changes, PolicyChange{Kind: POLICY_CHANGE_ADDED, Key: key, Entry: entry})
+		}
+	}
+	for _, entry := range from {
+		if _, ok := current[entry]; !ok {
+			changes = append(changes, PolicyChange{Kind: POLICY_CHANGE_REMOVED, Key: key, Entry: entry})
+		}
+	}
+	return changes
+}
+
+// diffRuleSets compares the rule sets by name. The entries of the files are not compared.
+func diffRuleSets(from, to []PolicyExportRuleSet) []PolicyChange {
+	const key = "network.rule_sets"
+	describe := func(set PolicyExportRuleSet) string {
+		return set.List + " " + set.File
+	}
+
+	changes := []PolicyChange{}
+	previous := map[string]PolicyExportRuleSet{}
+	for _, set := range from {
+		previous[set.Name] = set
+	}
+	current := map[string]struct{}{}
+	for _, set := range to {
+		current[set.Name] = struct{}{}
+		old, ok := previous[set.Name]
+		if !ok {
+			changes = append(changes, PolicyChange{Kind: POLICY_CHANGE_ADDED, Key: key, Entry: set.Name})
+		} else if old != set {
+			changes = append(changes, PolicyChange{Kind: POLICY_CHANGE_CHANGED, Key: key, Entry: set.Name, From: describe(old), To: describe(set)})
+		}
+	}
+	for _, set := range from {
+		if _, ok := current[set.Name]; !ok {
+			changes = append(changes, PolicyChange{Kind: POLICY_CHANGE_REMOVED, Key: key, Entry: set.Name})
+		}
+	}
+	return changes
+}
+
+func policySnapshotPath(dir string) string {
+	return filepath.Join(dir, POLICY_SNAPSHOT_FILE)
+}
+
+// loadPolicySnapshot reads the export saved by a previous run.
+func loadPolicySnapshot(dir string) (*PolicyExport, error) {
+	data, err := ioutil.ReadFile(policySnapshotPath(dir))
+	if err != nil {
+		return nil, err
+	}
+
+	export := &PolicyExport{}
+	if err := json.Unmarshal(data, export); err != nil {
+		return nil, err
+	}
+	if export.Version != POLICY_EXPORT_VERSION {
+		return nil, fmt.Errorf("unsupported version %d", export.Version)
+	}
+	return export, nil
+}
+
+// savePolicySnapshot writes export to a temporary file first, so a crash never leaves a truncated snapshot.
+func savePolicySnapshot(dir string, export *PolicyExport) error {
+	data, err := json.MarshalIndent(export, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	path := policySnapshotPath(dir)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// logPolicyDiff logs the difference between the policy of the last run and the one of conf,
+// which has just been loaded, and saves the latter for the next run. A missing or unreadable
+// snapshot is logged as having no baseline; neither stops the startup.
+func logPolicyDiff(conf *config.Config) {
+	dir := conf.RestrictedNetworkConfig.PolicySnapshot.StateDir
+	current := ExportPolicy(conf)
+	if hits := conf.RestrictedNetworkConfig.RuleHits; hits.Enable {
+		current.LastHits = WithLastHits(current, readRuleHits(hits.StateDir))
+	}
+
+	previous, err := loadPolicySnapshot(dir)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		log.Info(fmt.Sprintf("No baseline policy in %s, the changes are logged from the next start.", dir))
+	case err != nil:
+		log.Warn(fmt.Sprintf("No baseline policy, ignoring %s: %s", policySnapshotPath(dir), err))
+	default:
+		diff := DiffPolicies(previous, current)
+		diffLog := log.PolicyDiffLog{
+			Since:   previous.ExportedAt,
+			Added:   diff.Count(POLICY_CHANGE_ADDED),
+			Removed: diff.Count(POLICY_CHANGE_REMOVED),
+			Changed: diff.Count(POLICY_CHANGE_CHANGED),
+			Diff:    diff.String(),
+		}
+		diffLog.Info()
+	}
+
+	if err := savePolicySnapshot(dir, current); err != nil {
+		log.Error(fmt.Errorf("failed to save the policy snapshot: %w", err))
+	}
+}
@@ -0,0 +1,244 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mrtc0/bouheki/pkg/bouhekitest"
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportPolicyIsCanonical(t *testing.T) {
+	conf := config.DefaultConfig()
+	conf.RestrictedNetworkConfig.CIDR.Allow = []string{"10.1.2.3/8", "10.0.0.0/8", "2001:db8::1/32"}
+	conf.RestrictedNetworkConfig.Domain.Allow = []string{"Example.com.", "example.com"}
+	conf.RestrictedNetworkConfig.Command.Allow = []string{"curl", "a-very-long-command-name"}
+	conf.RestrictedNetworkConfig.UID.Deny = []string{"1000", "0", "1000"}
+	conf.RestrictedNetworkConfig.Ports.Allow = []string{"8000-8999", "443-443", "443"}
+	conf.RestrictedNetworkConfig.RuleSets.Sets = []config.RuleSetConfig{
+		{Name: "geo", List: config.RULE_SET_LIST_DENY, File: "/etc/bouheki/geo.txt"},
+		{Name: "asn", List: config.RULE_SET_LIST_ALLOW, File: "/etc/bouheki/asn.txt"},
+	}
+
+	export := ExportPolicy(conf)
+	assert.Equal(t, POLICY_EXPORT_VERSION, export.Version)
+	assert.Equal(t, []string{"10.0.0.0/8", "2001:db8::/32"}, export.CIDR.Allow)
+	assert.Equal(t, []string{"example.com"}, export.Domain.Allow)
+	assert.Equal(t, []string{"a-very-long-com", "curl"}, export.Command.Allow)
+	assert.Equal(t, []uint{0, 1000}, export.UID.Deny)
+	assert.Equal(t, []string{"443", "8000-8999"}, export.Ports.Allow)
+	assert.Equal(t, "asn", export.RuleSets[0].Name)
+	assert.Empty(t, DiffPolicies(export, ExportPolicy(conf)).Changes)
+}
+
+func TestDiffPolicies(t *testing.T) {
+	previous := config.DefaultConfig()
+	previous.RestrictedNetworkConfig.CIDR.Deny = []string{"192.0.2.0/24"}
+	previous.RestrictedNetworkConfig.Command.Deny = []string{"wget"}
+	previous.RestrictedNetworkConfig.RuleSets.Sets = []config.RuleSetConfig{
+		{Name: "geo", List: config.RULE_SET_LIST_DENY, File: "/etc/bouheki/geo.txt"},
+	}
+
+	current := config.DefaultConfig()
+	current.RestrictedNetworkConfig.Mode = "block"
+	current.RestrictedNetworkConfig.CIDR.Deny = []string{"198.51.100.0/24"}
+	current.RestrictedNetworkConfig.Command.Deny = []string{"wget"}
+	current.RestrictedNetworkConfig.GID.Deny = []string{"100"}
+	current.RestrictedNetworkConfig.RuleSets.Sets = []config.RuleSetConfig{
+		{Name: "geo", List: config.RULE_SET_LIST_DENY, File: "/etc/bouheki/geo-v2.txt"},
+	}
+
+	diff := DiffPolicies(ExportPolicy(previous), ExportPolicy(current))
+	assert.Equal(t, []PolicyChange{
+		{Kind: POLICY_CHANGE_CHANGED, Key: "network.mode", From: "monitor", To: "block"},
+		{Kind: POLICY_CHANGE_ADDED, Key: "network.cidr.deny", Entry: "198.51.100.0/24"},
+		{Kind: POLICY_CHANGE_REMOVED, Key: "network.cidr.deny", Entry: "192.0.2.0/24"},
+		{Kind: POLICY_CHANGE_ADDED, Key: "network.gid.deny", Entry: "100"},
+		{Kind: POLICY_CHANGE_CHANGED, Key: "network.rule_sets", Entry: "geo", From: "deny /etc/bouheki/geo.txt", To: "deny /etc/bouheki/geo-v2.txt"},
+	}, diff.Changes)
+	assert.Equal(t, 2, diff.Count(POLICY_CHANGE_ADDED))
+	assert.Equal(t,
+		"network.mode: monitor -> block; network.cidr.deny: +198.51.100.0/24 -192.0.2.0/24; network.gid.deny: +100; "+
+			"network.rule_sets: ~geo (deny /etc/bouheki/geo.txt -> deny /etc/bouheki/geo-v2.txt)",
+		diff.String())
+}
+
+func TestDiffPoliciesReportsTheIngressLists(t *testing.T) {
+	previous := config.DefaultConfig()
+	previous.RestrictedNetworkConfig.Ingress.Ports.Allow = []string{"8080"}
+
+	current := config.DefaultConfig()
+	current.RestrictedNetworkConfig.Ingress.CIDR.Allow = []string{"127.0.0.0/8"}
+	current.RestrictedNetworkConfig.Ingress.Ports.Allow = []string{"8443"}
+
+	assert.Nil(t, ExportPolicy(config.DefaultConfig()).Ingress)
+	assert.Equal(t, []string{"127.0.0.0/8"}, ExportPolicy(current).Ingress.CIDR.Allow)
+	assert.Equal(t,
+		"network.ingress.cidr.allow: +127.0.0.0/8; network.ingress.ports.allow: +8443 -8080",
+		DiffPolicies(ExportPolicy(previous), ExportPolicy(current)).String())
+}
+
+func TestDiffPoliciesReportsTheCommandPaths(t *testing.T) {
+	previous := config.DefaultConfig()
+	previous.RestrictedNetworkConfig.Command.AllowPaths = []string{"/usr/bin/curl"}
+
+	current := config.DefaultConfig()
+	current.RestrictedNetworkConfig.Command.AllowPaths = []string{"/usr/local/bin/", "/usr/bin/curl", "/usr/local/bin/"}
+	current.RestrictedNetworkConfig.Command.DenyPaths = []string{"/usr/local/bin/nc"}
+
+	assert.Nil(t, ExportPolicy(config.DefaultConfig()).CommandPaths)
+	assert.Equal(t, []string{"/usr/bin/curl", "/usr/local/bin/"}, ExportPolicy(current).CommandPaths.Allow)
+	assert.Equal(t,
+		"network.command.allow_paths: +/usr/local/bin/; network.command.deny_paths: +/usr/local/bin/nc",
+		DiffPolicies(ExportPolicy(previous), ExportPolicy(current)).String())
+}
+
+func TestDiffPoliciesReportsTheProtocolLists(t *testing.T) {
+	previous := config.DefaultConfig()
+	current := config.DefaultConfig()
+	current.RestrictedNetworkConfig.CIDR.Protocols = []config.ProtocolRulesConfig{{Protocol: config.PROTOCOL_UDP, Allow: []string{"192.0.2.53/32"}}}
+	current.RestrictedNetworkConfig.Domain.Protocols = []config.ProtocolRulesConfig{{Protocol: config.PROTOCOL_TCP, Deny: []string{"Example.com"}}}
+
+	export := ExportPolicy(current)
+	assert.Equal(t, map[string]PolicyExportProtocol{
+		config.PROTOCOL_TCP: {CIDR: PolicyExportList{Allow: []string{}, Deny: []string{}}, Domain: PolicyExportList{Allow: []string{}, Deny: []string{"example.com"}}},
+		config.PROTOCOL_UDP: {CIDR: PolicyExportList{Allow: []string{"192.0.2.53/32"}, Deny: []string{}}, Domain: PolicyExportList{Allow: []string{}, Deny: []string{}}},
+	}, export.Protocols)
+	assert.Nil(t, ExportPolicy(previous).Protocols)
+
+	assert.Equal(t, "network.domain.protocols[tcp].deny: +example.com; network.cidr.protocols[udp].allow: +192.0.2.53/32",
+		DiffPolicies(ExportPolicy(previous), export).String())
+}
+
+func TestPolicyDiffStringIsBounded(t *testing.T) {
+	current := config.DefaultConfig()
+	for i := 0; i < POLICY_DIFF_MAX_ENTRIES+5; i++ {
+		current.RestrictedNetworkConfig.CIDR.Deny = append(current.RestrictedNetworkConfig.CIDR.Deny, fmt.Sprintf("10.0.%d.0/24", i))
+	}
+
+	diff := DiffPolicies(ExportPolicy(config.DefaultConfig()), ExportPolicy(current))
+	assert.Equal(t, POLICY_DIFF_MAX_ENTRIES+5, len(diff.Changes))
+	assert.Contains(t, diff.String(), "(5 more)")
+	assert.Equal(t, "no changes", PolicyDiff{}.String())
+}
+
+func TestPolicySnapshotBaseline(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "state")
+	conf := config.DefaultConfig()
+	conf.RestrictedNetworkConfig.PolicySnapshot.StateDir = dir
+
+	// Without a baseline, the snapshot is written for the next start.
+	_, err := loadPolicySnapshot(dir)
+	assert.True(t, os.IsNotExist(err))
+	logPolicyDiff(conf)
+	saved, err := loadPolicySnapshot(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, ExportPolicy(conf).CIDR, saved.CIDR)
+	info, err := os.Stat(policySnapshotPath(dir))
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// The next start compares with it and replaces it.
+	conf.RestrictedNetworkConfig.CIDR.Deny = []string{"192.0.2.0/24"}
+	logPolicyDiff(conf)
+	saved, err = loadPolicySnapshot(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"192.0.2.0/24"}, saved.CIDR.Deny)
+
+	// A corrupted snapshot is no baseline, and is replaced.
+	assert.Nil(t, os.WriteFile(policySnapshotPath(dir), []byte("{"), 0600))
+	_, err = loadPolicySnapshot(dir)
+	assert.NotNil(t, err)
+	logPolicyDiff(conf)
+	_, err = loadPolicySnapshot(dir)
+	assert.Nil(t, err)
+
+	// So is the snapshot of another version.
+	assert.Nil(t, os.WriteFile(policySnapshotPath(dir), []byte(`{"version": 99}`), 0600))
+	_, err = loadPolicySnapshot(dir)
+	assert.NotNil(t, err)
+}
+
+// groupsConfig loads a config whose lists reference groups, which are expanded as the config is read.
+func groupsConfig(t *testing.T, content string) *config.Config {
+	path := filepath.Join(t.TempDir(), "bouheki.yaml")
+	assert.Nil(t, os.WriteFile(path, []byte(content), 0600))
+	conf, err := config.NewConfig(path)
+	assert.Nil(t, err)
+	return conf
+}
+
+func TestDiffPoliciesReportsTheChangesOfTheGroups(t *testing.T) {
+	previous := groupsConfig(t, `
+groups:
+  corp-proxies:
+    cidr: [10.0.1.0/24, 10.0.2.0/24]
+    domain: [proxy.corp.example.com]
+network:
+  cidr:
+    deny: [192.0.2.0/24, group:corp-proxies]
+`)
+	current := groupsConfig(t, `
+groups:
+  corp-proxies:
+    cidr: [10.0.1.0/24, 10.0.3.0/24, 10.0.4.0/24]
+    domain: [proxy.corp.example.com]
+network:
+  cidr:
+    deny: [192.0.2.0/24, 10.0.2.0/24, group:corp-proxies]
+  domain:
+    allow: [group:corp-proxies]
+`)
+
+	export := ExportPolicy(current)
+	assert.Equal(t, []string{"10.0.1.0/24", "10.0.2.0/24", "10.0.3.0/24", "10.0.4.0/24", "192.0.2.0/24"}, export.CIDR.Deny)
+	assert.Equal(t, []string{"proxy.corp.example.com"}, export.Domain.Allow)
+	assert.Equal(t, map[string][]string{"network.cidr.deny": {"corp-proxies"}, "network.domain.allow": {"corp-proxies"}}, export.GroupReferences)
+	assert.Equal(t, PolicyExportGroup{CIDR: []string{"10.0.1.0/24", "10.0.3.0/24", "10.0.4.0/24"}, Domain: []string{"proxy.corp.example.com"}}, export.Groups["corp-proxies"])
+
+	// The entries of the groups are not spelled out in the lists. 10.0.2.0/24 moved from the
+	// group to the list, and is still denied.
+	diff := DiffPolicies(ExportPolicy(previous), export)
+	assert.Equal(t, []PolicyChange{
+		{Kind: POLICY_CHANGE_ADDED, Key: "network.domain.allow", Entry: "group:corp-proxies"},
+		{Kind: POLICY_CHANGE_ADDED, Key: "groups.corp-proxies.cidr", Entry: "10.0.3.0/24"},
+		{Kind: POLICY_CHANGE_ADDED, Key: "groups.corp-proxies.cidr", Entry: "10.0.4.0/24"},
+		{Kind: POLICY_CHANGE_REMOVED, Key: "groups.corp-proxies.cidr", Entry: "10.0.2.0/24"},
+	}, diff.Changes)
+	assert.Equal(t, "network.domain.allow: +group:corp-proxies; groups.corp-proxies.cidr: +10.0.3.0/24 +10.0.4.0/24 -10.0.2.0/24", diff.String())
+
+	// Without the reference, the entries of the group leave the list.
+	diff = DiffPolicies(export, ExportPolicy(groupsConfig(t, `
+groups:
+  corp-proxies:
+    cidr: [10.0.1.0/24, 10.0.3.0/24, 10.0.4.0/24]
+network:
+  cidr:
+    deny: [192.0.2.0/24, 10.0.2.0/24, group:corp-proxies]
+`)))
+	assert.Equal(t, "network.domain.allow: -group:corp-proxies; groups.corp-proxies.domain: -proxy.corp.example.com", diff.String())
+}
+
+func TestTheGroupOfADeniedPrefixIsNamedInTheRule(t *testing.T) {
+	conf := groupsConfig(t, `
+groups:
+  corp-proxies:
+    cidr: [10.0.1.7/24]
+network:
+  mode: block
+  cidr:
+    allow: [0.0.0.0/0]
+    deny: [group:corp-proxies, 192.0.2.0/24]
+`)
+	mgr, err := NewManager(conf, WithMapBackend(bouhekitest.NewMaps()))
+	assert.Nil(t, err)
+	defer mgr.Close()
+	assert.Nil(t, mgr.SetConfigToMap())
+
+	assert.Equal(t, "network.cidr.deny 10.0.1.0/24 (group:corp-proxies)", mgr.Policy().Evaluate(Connection{Addr: net.ParseIP("10.0.1.1")}).Rule)
+	assert.Equal(t, "network.cidr.deny 192.0.2.0/24", mgr.Policy().Evaluate(Connection{Addr: net.ParseIP("192.0.2.1")}).Rule)
+}
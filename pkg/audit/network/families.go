@@ -0,0 +1,105 @@
+package network
+
+import (
+	"encoding/binary"
+
+	"github.com/miekg/dns"
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/policy"
+)
+
+// FAMILY_IPV4 and FAMILY_IPV6 are the flags of the families network.families leaves out, in the
+// disabled families of the config map.
+const (
+	FAMILY_IPV4 = policy.FAMILY_IPV4
+	FAMILY_IPV6 = policy.FAMILY_IPV6
+)
+
+// familyMaps are the family of the addresses of each CIDR map.
+var familyMaps = map[string]uint32{
+	ALLOWED_V4_CIDR_LIST_MAP_NAME:          FAMILY_IPV4,
+	DENIED_V4_CIDR_LIST_MAP_NAME:           FAMILY_IPV4,
+	ALLOWED_V4_PROTOCOL_CIDR_LIST_MAP_NAME: FAMILY_IPV4,
+	DENIED_V4_PROTOCOL_CIDR_LIST_MAP_NAME:  FAMILY_IPV4,
+	ALLOWED_V4_ENTRY_CIDR_LIST_MAP_NAME:    FAMILY_IPV4,
+	DENIED_V4_ENTRY_CIDR_LIST_MAP_NAME:     FAMILY_IPV4,
+	INGRESS_ALLOWED_V4_CIDR_LIST_MAP_NAME:  FAMILY_IPV4,
+	INGRESS_DENIED_V4_CIDR_LIST_MAP_NAME:   FAMILY_IPV4,
+	ALLOWED_V6_CIDR_LIST_MAP_NAME:          FAMILY_IPV6,
+	DENIED_V6_CIDR_LIST_MAP_NAME:           FAMILY_IPV6,
+	ALLOWED_V6_PROTOCOL_CIDR_LIST_MAP_NAME: FAMILY_IPV6,
+	DENIED_V6_PROTOCOL_CIDR_LIST_MAP_NAME:  FAMILY_IPV6,
+	ALLOWED_V6_ENTRY_CIDR_LIST_MAP_NAME:    FAMILY_IPV6,
+	DENIED_V6_ENTRY_CIDR_LIST_MAP_NAME:     FAMILY_IPV6,
+	INGRESS_ALLOWED_V6_CIDR_LIST_MAP_NAME:  FAMILY_IPV6,
+	INGRESS_DENIED_V6_CIDR_LIST_MAP_NAME:   FAMILY_IPV6,
+}
+
+// mapFamily returns the family of the addresses of mapName, a shard being of the family of its
+// deny list, and 0 for the maps of no family.
+func mapFamily(mapName string) uint32 {
+	if base, ok := denyShardBase(mapName); ok {
+		mapName = base
+	}
+	return familyMaps[mapName]
+}
+
+// recordTypeFamily returns the family of the addresses of a DNS record type, dns.TypeA or dns.TypeAAAA.
+func recordTypeFamily(recordType uint16) uint32 {
+	if recordType == dns.TypeAAAA {
+		return FAMILY_IPV6
+	}
+	return FAMILY_IPV4
+}
+
+// dropFamilies removes the maps of the disabled families from s: socket_connect never looks a
+// connection of those families up, so their addresses are not written.
+func (s mapState) dropFamilies(disabled uint32) mapState {
+	for mapName := range s {
+		if mapFamily(mapName)&disabled != 0 {
+			delete(s, mapName)
+		}
+	}
+	return s
+}
+
+// disabledFamilies returns the flags of the families the config does not restrict.
+func (m *Manager) disabledFamilies() uint32 {
+	return policy.DisabledFamilies(m.currentConfig().RestrictedNetworkConfig)
+}
+
+// familyDisabled reports whether mapName holds the addresses of a family the config does not restrict.
+func (m *Manager) familyDisabled(mapName string) bool {
+	return mapFamily(mapName)&m.disabledFamilies() != 0
+}
+
+// DecodeFamilies reads the flags of the families that are not restricted from a value of
+// RESTRICT_NETWORK_CONFIG_MAP_NAME, and whether their connections are reported.
+func DecodeFamilies(value []byte) (disabled uint32, audit bool) {
+	return binary.LittleEndian.Uint32(value[MAP_DISABLED_FAMILIES_INDEX : MAP_DISABLED_FAMILIES_INDEX+4]),
+		binary.LittleEndian.Uint32(value[MAP_OTHER_FAMILIES_AUDIT_INDEX:MAP_OTHER_FAMILIES_AUDIT_INDEX+4]) == 1
+}
+
+// FamilyNames returns the names of the families that are restricted by the flags of disabled.
+func FamilyNames(disabled uint32) []string {
+	names := []string{}
+	if disabled&FAMILY_IPV4 == 0 {
+		names = append(names, config.FAMILY_IPV4)
+	}
+	if disabled&FAMILY_IPV6 == 0 {
+		names = append(names, config.FAMILY_IPV6)
+	}
+	return names
+}
+
+// familyStatus sets the families of status when the config leaves one out.
+func familyStatus(status AuditStatus, conf config.RestrictedNetworkConfig) AuditStatus {
+	if disabled := policy.DisabledFamilies(conf); disabled != 0 {
+		status.Families = FamilyNames(disabled)
+		status.OtherFamilies = conf.OtherFamilies
+		if status.OtherFamilies == "" {
+			status.OtherFamilies = config.OTHER_FAMILIES_IGNORE
+		}
+	}
+	return status
+}
@@ -0,0 +1,85 @@
+package network
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/mrtc0/bouheki/pkg/bouhekitest"
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigMapValueFamilies(t *testing.T) {
+	tests := []struct {
+		families      []string
+		otherFamilies string
+		disabled      uint32
+		audit         bool
+	}{
+		{families: []string{config.FAMILY_IPV4, config.FAMILY_IPV6}, otherFamilies: config.OTHER_FAMILIES_AUDIT},
+		{families: nil, otherFamilies: config.OTHER_FAMILIES_IGNORE},
+		{families: []string{config.FAMILY_IPV4}, otherFamilies: config.OTHER_FAMILIES_IGNORE, disabled: FAMILY_IPV6},
+		{families: []string{config.FAMILY_IPV4}, otherFamilies: config.OTHER_FAMILIES_AUDIT, disabled: FAMILY_IPV6, audit: true},
+		{families: []string{config.FAMILY_IPV6}, otherFamilies: "", disabled: FAMILY_IPV4},
+		{families: []string{config.FAMILY_IPV6}, otherFamilies: config.OTHER_FAMILIES_AUDIT, disabled: FAMILY_IPV4, audit: true},
+	}
+
+	for _, test := range tests {
+		conf := config.DefaultConfig()
+		conf.RestrictedNetworkConfig.Families = test.families
+		conf.RestrictedNetworkConfig.OtherFamilies = test.otherFamilies
+		value := ConfigMapValue(conf)
+		assert.Len(t, value, MAP_SIZE)
+
+		disabled, audit := DecodeFamilies(value)
+		assert.Equal(t, test.disabled, disabled, "%v %s", test.families, test.otherFamilies)
+		assert.Equal(t, test.audit, audit, "%v %s", test.families, test.otherFamilies)
+	}
+
+	assert.Equal(t, []string{config.FAMILY_IPV4, config.FAMILY_IPV6}, FamilyNames(0))
+	assert.Equal(t, []string{config.FAMILY_IPV6}, FamilyNames(FAMILY_IPV4))
+}
+
+func TestDisabledFamilyIsNotWritten(t *testing.T) {
+	conf := config.DefaultConfig()
+	conf.RestrictedNetworkConfig.Mode = "block"
+	conf.RestrictedNetworkConfig.Families = []string{config.FAMILY_IPV4}
+	conf.RestrictedNetworkConfig.CIDR.Allow = []string{"10.0.0.0/8", "2001:db8::/32"}
+	conf.RestrictedNetworkConfig.CIDR.Deny = []string{"10.1.0.0/16"}
+	conf.RestrictedNetworkConfig.Ingress.CIDR.Allow = []string{"127.0.0.0/8", "::1/128"}
+	conf.Resources.DenyShards = 2
+	maps := bouhekitest.NewMaps()
+	mgr := Manager{config: conf, backend: maps}
+	assert.Nil(t, mgr.SetConfigToMap())
+
+	assert.True(t, maps.Has(ALLOWED_V4_CIDR_LIST_MAP_NAME, cidrKey(t, "10.0.0.0/8")))
+	for _, w := range maps.Writes() {
+		assert.NotEqual(t, FAMILY_IPV6, mapFamily(w.Map), w.Map)
+	}
+	lists := DecodeListSizes(ConfigMapValue(conf))
+	assert.Equal(t, uint32(1), lists.IngressAllowCIDR)
+
+	// The connections of ipv6 are not restricted, even out of network.cidr.allow.
+	policy := mgr.Policy()
+	assert.True(t, policy.Evaluate(Connection{Addr: net.ParseIP("10.1.0.1"), Port: 443, Command: "curl"}).Denied)
+	assert.True(t, policy.Evaluate(Connection{Addr: net.ParseIP("192.0.2.1"), Port: 443, Command: "curl"}).Denied)
+	assert.False(t, policy.Evaluate(Connection{Addr: net.ParseIP("2001:db9::1"), Port: 443, Command: "curl"}).Denied)
+}
+
+func TestRuleSetSkipsDisabledFamily(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "geoip-xx.txt")
+	writeRuleSetFile(t, file, []string{"10.0.0.0/24", "2001:db8::/48", "10.0.1.0/24"})
+	conf := config.RuleSetConfig{Name: "geoip-xx", List: config.RULE_SET_LIST_DENY, File: file}
+
+	state, _, err := newRuleSet(conf, 2, FAMILY_IPV6, nil).load()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, state.len())
+	for mapName := range state {
+		assert.Equal(t, FAMILY_IPV4, mapFamily(mapName), mapName)
+	}
+
+	state, _, err = newRuleSet(conf, 2, 0, nil).load()
+	assert.Nil(t, err)
+	assert.Equal(t, 3, state.len())
+}
@@ -0,0 +1,136 @@
+package network
+
+import (
+	"context"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/auditoutput"
+	"github.com/mrtc0/bouheki/pkg/config"
+	log "github.com/mrtc0/bouheki/pkg/log"
+	"github.com/mrtc0/bouheki/pkg/metrics"
+)
+
+// What forced the network restriction into monitor mode.
+const (
+	FORCE_MONITOR_SOURCE_FLAG    = "flag"
+	FORCE_MONITOR_SOURCE_CONTROL = "control"
+)
+
+// ForceMonitorOnStart forces the network restriction into monitor mode from the start, see the
+// --force-monitor flag. It is set before RunAudit.
+var ForceMonitorOnStart bool
+
+var forceMonitorGauge = metrics.NewGauge("network_force_monitor", "Whether the network restriction is forced into monitor mode, whatever network.mode.")
+
+// forcedMonitor is when and by what the network restriction was forced into monitor mode.
+type forcedMonitor struct {
+	since  time.Time
+	source string
+	uid    uint32
+}
+
+// ForceMonitorStatus is whether the network restriction is forced into monitor mode. Mode is the
+// mode the programs run in, and ConfiguredMode network.mode, which it is back to once cleared.
+type ForceMonitorStatus struct {
+	Forced         bool
+	Mode           string
+	ConfiguredMode string
+	Since          time.Time
+	Source         string
+	UID            uint32
+}
+
+// ForceMonitor returns whether the network restriction is forced into monitor mode.
+func (m *Manager) ForceMonitor() ForceMonitorStatus {
+	configured := m.currentConfig().RestrictedNetworkConfig.Mode
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	status := ForceMonitorStatus{Mode: configured, ConfiguredMode: configured}
+	if m.forced != nil {
+		status.Forced = true
+		status.Mode = "monitor"
+		status.Since, status.Source, status.UID = m.forced.since, m.forced.source, m.forced.uid
+	}
+	return status
+}
+
+// SetForceMonitor forces the network restriction into monitor mode, or back into network.mode,
+// on behalf of uid, without a restart. The programs keep their rules and report what they would
+// have blocked. It is an emergency switch: no freeze window holds it back, and it survives the
+// reloads of the config until it is cleared. The fileaccess and mount restrictions are not
+// forced, their mode can not change while they run.
+func (m *Manager) SetForceMonitor(force bool, source string, uid uint32) error {
+	m.mu.Lock()
+	previous := m.forced
+	if (previous != nil) == force {
+		m.mu.Unlock()
+		return nil
+	}
+	if force {
+		m.forced = &forcedMonitor{since: m.now(), source: source, uid: uid}
+	} else {
+		m.forced = nil
+	}
+	m.mu.Unlock()
+
+	err := m.doJob("force-monitor", func(ctx context.Context) error {
+		defer m.policyChanged()
+		return m.applyConfig()
+	})
+	if err != nil {
+		m.mu.Lock()
+		m.forced = previous
+		m.mu.Unlock()
+	}
+	m.forceMonitorChanged(force, source, uid, err)
+	return err
+}
+
+// forceMonitorChanged logs the forced mode, and exposes it in the metrics and the audit output.
+func (m *Manager) forceMonitorChanged(force bool, source string, uid uint32, err error) {
+	status := m.ForceMonitor()
+	l := log.ForceMonitorLog{Forced: force, Mode: status.Mode, Source: source, UID: uid}
+	if err != nil {
+		l.Err = err.Error()
+	}
+	l.Warn()
+
+	if status.Forced {
+		forceMonitorGauge.Set(1)
+	} else {
+		forceMonitorGauge.Set(0)
+	}
+	auditoutput.SetMode(config.ALERT_AUDIT_NETWORK, status.Mode)
+}
+
+// warnForcedMonitor logs again that the network restriction is forced into monitor mode, after a
+// reload whose network.mode it overrides.
+func (m *Manager) warnForcedMonitor() {
+	if status := m.ForceMonitor(); status.Forced {
+		(&log.ForceMonitorLog{Forced: true, Mode: status.Mode, Source: status.Source, UID: status.UID}).Warn()
+	}
+}
+
+// forceMonitorOnStart forces a Manager that has not written the maps yet into monitor mode, as
+// the --force-monitor flag does, so that the programs never block before it is cleared.
+func (m *Manager) forceMonitorOnStart() {
+	m.mu.Lock()
+	m.forced = &forcedMonitor{since: m.now(), source: FORCE_MONITOR_SOURCE_FLAG}
+	m.mu.Unlock()
+	m.forceMonitorChanged(true, FORCE_MONITOR_SOURCE_FLAG, 0, nil)
+}
+
+func (m *Manager) forcedMonitor() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.forced != nil
+}
+
+// effectiveMode is the network.mode of conf the programs run in: monitor while it is forced.
+func (m *Manager) effectiveMode(conf *config.Config) string {
+	if m.forcedMonitor() {
+		return "monitor"
+	}
+	return conf.RestrictedNetworkConfig.Mode
+}
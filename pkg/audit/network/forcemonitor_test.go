@@ -0,0 +1,57 @@
+package network
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/bouhekitest"
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/freeze"
+	"github.com/stretchr/testify/assert"
+)
+
+func configMapMode(maps *bouhekitest.Maps) uint32 {
+	return binary.LittleEndian.Uint32(configMapEntry(maps)[MAP_MODE_START:MAP_MODE_END])
+}
+
+func TestForceMonitor(t *testing.T) {
+	mgr, maps, clock := newRuntimeRulesTestManager(t)
+	assert.Equal(t, uint32(MODE_BLOCK), configMapMode(maps))
+
+	// No freeze window holds back the emergency switch.
+	guard, err := freeze.NewWithClock(config.AdminConfig{
+		FreezeWindows: []config.FreezeWindow{{Name: "incident-review", Start: "2026-10-14T11:00", End: "2026-10-15T00:00"}},
+	}, clock.Now)
+	assert.Nil(t, err)
+	mgr.freeze = guard
+
+	assert.Nil(t, mgr.SetForceMonitor(true, FORCE_MONITOR_SOURCE_CONTROL, 1000))
+	assert.Equal(t, uint32(MODE_MONITOR), configMapMode(maps))
+	assert.Equal(t, float64(1), forceMonitorGauge.Value())
+	assert.Equal(t, ForceMonitorStatus{
+		Forced:         true,
+		Mode:           "monitor",
+		ConfiguredMode: "block",
+		Since:          time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC),
+		Source:         FORCE_MONITOR_SOURCE_CONTROL,
+		UID:            1000,
+	}, mgr.ForceMonitor())
+
+	// Forcing it again changes nothing, not even who forced it.
+	assert.Nil(t, mgr.SetForceMonitor(true, FORCE_MONITOR_SOURCE_CONTROL, 0))
+	assert.Equal(t, uint32(1000), mgr.ForceMonitor().UID)
+
+	// A reloaded config does not clear it.
+	conf := config.DefaultConfig()
+	conf.RestrictedNetworkConfig.Mode = "block"
+	conf.RestrictedNetworkConfig.CIDR.Allow = []string{"10.0.0.0/8", "192.0.2.0/24"}
+	assert.Nil(t, mgr.replaceConfig(conf))
+	assert.Equal(t, uint32(MODE_MONITOR), configMapMode(maps))
+	assert.True(t, mgr.ForceMonitor().Forced)
+
+	assert.Nil(t, mgr.SetForceMonitor(false, FORCE_MONITOR_SOURCE_CONTROL, 1000))
+	assert.Equal(t, uint32(MODE_BLOCK), configMapMode(maps))
+	assert.Equal(t, float64(0), forceMonitorGauge.Value())
+	assert.Equal(t, ForceMonitorStatus{Mode: "block", ConfiguredMode: "block"}, mgr.ForceMonitor())
+}
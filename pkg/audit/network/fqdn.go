@@ -1,12 +1,16 @@
 package network
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"math/rand"
 	"net"
 	"time"
 
 	"github.com/miekg/dns"
+	"github.com/mrtc0/bouheki/pkg/config"
 	log "github.com/mrtc0/bouheki/pkg/log"
 )
 
@@ -16,6 +20,111 @@ type DNSAnswer struct {
 	TTL       uint32
 }
 
+// domainCache is the keys a domain last resolved to in each map. Every address of an answer
+// is kept, so that the next resolution of the domain can tell which of them it dropped.
+type domainCache struct {
+	// keys are the keys of each domain, by map and domain.
+	keys map[string]map[string][][]byte
+	// holders are the number of domains that resolved to each key, by map. Two domains can
+	// resolve to the same address, which stays in the map until neither does.
+	holders map[string]map[string]int
+	// missing are the number of consecutive resolutions a kept key of a domain was missing
+	// from, by map and domain.
+	missing map[string]map[string]map[string]int
+}
+
+// set records keys as the addresses domain resolved to in mapName. With replace, keys replace
+// the addresses of the previous resolution of the domain, otherwise they are added to them.
+// A replaced address is kept until it is missing from removeAfter consecutive resolutions.
+// The keys that no domain resolves to any more are returned.
+func (c *domainCache) set(mapName, domain string, keys [][]byte, replace bool, removeAfter int) [][]byte {
+	if c.keys == nil {
+		c.keys = map[string]map[string][][]byte{}
+		c.holders = map[string]map[string]int{}
+		c.missing = map[string]map[string]map[string]int{}
+	}
+	if c.keys[mapName] == nil {
+		c.keys[mapName] = map[string][][]byte{}
+		c.holders[mapName] = map[string]int{}
+		c.missing[mapName] = map[string]map[string]int{}
+	}
+
+	previous := c.keys[mapName][domain]
+	next := [][]byte{}
+	seen := map[string]bool{}
+	if !replace {
+		for _, key := range previous {
+			seen[string(key)] = true
+			next = append(next, key)
+		}
+	}
+	missing := map[string]int{}
+	for _, key := range keys {
+		if !seen[string(key)] {
+			seen[string(key)] = true
+			next = append(next, key)
+		}
+	}
+	for _, key := range previous {
+		if seen[string(key)] {
+			continue
+		}
+		if count := c.missing[mapName][domain][string(key)] + 1; count < removeAfter {
+			missing[string(key)] = count
+			seen[string(key)] = true
+			next = append(next, key)
+		}
+	}
+	if len(missing) > 0 {
+		c.missing[mapName][domain] = missing
+	} else {
+		delete(c.missing[mapName], domain)
+	}
+
+	held := map[string]bool{}
+	for _, key := range previous {
+		held[string(key)] = true
+	}
+	for _, key := range next {
+		if !held[string(key)] {
+			c.holders[mapName][string(key)]++
+		}
+	}
+	released := [][]byte{}
+	for _, key := range previous {
+		if seen[string(key)] {
+			continue
+		}
+		c.holders[mapName][string(key)]--
+		if c.holders[mapName][string(key)] <= 0 {
+			delete(c.holders[mapName], string(key))
+			released = append(released, key)
+		}
+	}
+
+	c.keys[mapName][domain] = next
+	return released
+}
+
+// has reports whether a domain resolved to key in mapName.
+func (c *domainCache) has(mapName string, key []byte) bool {
+	return c.holders[mapName][string(key)] > 0
+}
+
+// domain returns the keys domain resolved to in mapName.
+func (c *domainCache) domain(mapName, domain string) [][]byte {
+	return c.keys[mapName][domain]
+}
+
+// minTTL returns the lower of the TTL of the records so far and ttl, the TTL of the next
+// record, or ttl if it is the first.
+func minTTL(current, ttl uint32, first bool) uint32 {
+	if first || ttl < current {
+		return ttl
+	}
+	return current
+}
+
 var dnsCache map[string]string
 
 func initDNSCache() {
@@ -34,11 +143,69 @@ func toFqdn(domainName string) string {
 	return domainName + "."
 }
 
-func (r *DefaultResolver) exchange(message *dns.Msg) (*dns.Msg, error) {
+// NewResolver returns the resolver of network.domain.resolver: its nameservers, over TLS with
+// tls, or else the servers of RESOLV_CONF.
+func NewResolver(conf config.DomainResolverConfig) (*DefaultResolver, error) {
+	if len(conf.Nameservers) == 0 {
+		dnsConfig, err := dns.ClientConfigFromFile(RESOLV_CONF)
+		if err != nil {
+			return nil, err
+		}
+		r := NewDefaultResolver(dnsConfig)
+		r.timeout = conf.Timeout
+		return r, nil
+	}
+
+	client := new(dns.Client)
+	if conf.TLS {
+		client.Net = "tcp-tls"
+		client.TLSConfig = &tls.Config{ServerName: conf.ServerName, MinVersion: tls.VersionTLS12}
+	}
+	r := &DefaultResolver{config: &dns.ClientConfig{}, client: client, addresses: conf.Addresses(), timeout: conf.Timeout}
+	for _, address := range r.addresses {
+		host, port, _ := net.SplitHostPort(address)
+		r.config.Servers = append(r.config.Servers, host)
+		r.config.Port = port
+	}
+	return r, nil
+}
+
+// Servers returns the servers r queries, as host:port.
+func (r *DefaultResolver) Servers() []string {
+	if r.addresses != nil {
+		return append([]string{}, r.addresses...)
+	}
+	port := r.config.Port
+	if port == "" {
+		port = config.DNS_PORT
+	}
+	servers := []string{}
 	for _, server := range r.config.Servers {
-		res, _, err := r.client.Exchange(r.message, server+":53")
+		servers = append(servers, net.JoinHostPort(server, port))
+	}
+	return servers
+}
+
+// Client returns the client r queries the servers with.
+func (r *DefaultResolver) Client() *dns.Client {
+	return r.client
+}
+
+func (r *DefaultResolver) exchange(message *dns.Msg) (*dns.Msg, error) {
+	ctx := context.Background()
+	if r.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.timeout)
+		defer cancel()
+	}
+
+	for _, server := range r.Servers() {
+		res, _, err := r.client.ExchangeContext(ctx, message, server)
 		if err != nil {
 			log.Error(err)
+			if ctx.Err() != nil {
+				return nil, fmt.Errorf("resolve failed: no answer within %s", r.timeout)
+			}
 			continue
 		}
 		return res, err
@@ -47,15 +214,14 @@ func (r *DefaultResolver) exchange(message *dns.Msg) (*dns.Msg, error) {
 	return nil, errors.New("resolve failed")
 }
 
+// Resolve is safe to call concurrently: the refreshes of network.domain.refresh.max_in_flight
+// domains run at the same time.
 func (r *DefaultResolver) Resolve(host string, recordType uint16) (*DNSAnswer, error) {
-	r.mux.Lock()
-
-	r.message.SetQuestion(toFqdn(host), recordType)
-	r.message.RecursionDesired = true
-
-	res, err := r.exchange(r.message)
-	r.mux.Unlock()
+	message := new(dns.Msg)
+	message.SetQuestion(toFqdn(host), recordType)
+	message.RecursionDesired = true
 
+	res, err := r.exchange(message)
 	if err != nil {
 		return nil, err
 	}
@@ -74,12 +240,12 @@ func (r *DefaultResolver) Resolve(host string, recordType uint16) (*DNSAnswer, e
 		case dns.TypeA:
 			if record, ok := rr.(*dns.A); ok {
 				answer.Addresses = append(answer.Addresses, record.A)
-				answer.TTL = record.Hdr.Ttl
+				answer.TTL = minTTL(answer.TTL, record.Hdr.Ttl, len(answer.Addresses) == 1)
 			}
 		case dns.TypeAAAA:
 			if record, ok := rr.(*dns.AAAA); ok {
 				answer.Addresses = append(answer.Addresses, record.AAAA)
-				answer.TTL = record.Hdr.Ttl
+				answer.TTL = minTTL(answer.TTL, record.Hdr.Ttl, len(answer.Addresses) == 1)
 			}
 		}
 	}
@@ -109,114 +275,16 @@ func (mgr *Manager) ResolveAddressv6(domain string) (*DNSAnswer, error) {
 	return answer, nil
 }
 
-func (mgr *Manager) resolveAndUpdateAllowedFQDNList(domainName string, recordType uint16) (uint32, error) {
-	switch recordType {
-	case dns.TypeA:
-		answer, err := mgr.ResolveAddressv4(domainName)
-		if err != nil {
-			log.Debug(fmt.Sprintf("%s (A) resolve failed. %s\n", domainName, err))
-			return 5, nil
-		}
-		err = mgr.updateAllowedFQDNist(answer)
-		if err != nil {
-			return 5, nil
-		}
-
-		log.Debug(fmt.Sprintf("%s (A) is %#v, TTL is %d\n", answer.Domain, answer.Addresses, answer.TTL))
-		return answer.TTL, nil
-	case dns.TypeAAAA:
-		answer, err := mgr.ResolveAddressv6(domainName)
-		if err != nil {
-			log.Debug(fmt.Sprintf("%s (AAAA) resolve failed. %s\n", domainName, err))
-			return 5, nil
-		}
-		err = mgr.updateAllowedFQDNist(answer)
-		if err != nil {
-			return 5, nil
-		}
-
-		log.Debug(fmt.Sprintf("%s (AAAA) is %#v, TTL is %d\n", answer.Domain, answer.Addresses, answer.TTL))
-		return answer.TTL, nil
-	}
-
-	return 5, errors.New("invalid record type")
-}
-
-func (mgr *Manager) resolveAndUpdateDeniedFQDNList(domainName string, recordType uint16) (uint32, error) {
-	switch recordType {
-	case dns.TypeA:
-		answer, err := mgr.ResolveAddressv4(domainName)
-		if err != nil {
-			log.Debug(fmt.Sprintf("%s (A) resolve failed. %s\n", domainName, err))
-			return 5, nil
-		}
-		err = mgr.updateDeniedFQDNList(answer)
-		if err != nil {
-			return 5, nil
-		}
-
-		log.Debug(fmt.Sprintf("%s (A) is %#v, TTL is %d\n", answer.Domain, answer.Addresses, answer.TTL))
-		return answer.TTL, nil
-	case dns.TypeAAAA:
-		answer, err := mgr.ResolveAddressv6(domainName)
-		if err != nil {
-			log.Debug(fmt.Sprintf("%s (AAAA) resolve failed. %s\n", domainName, err))
-			return 5, nil
-		}
-		err = mgr.updateDeniedFQDNList(answer)
-		if err != nil {
-			return 5, nil
-		}
-
-		log.Debug(fmt.Sprintf("%s (AAAA) is %#v, TTL is %d\n", answer.Domain, answer.Addresses, answer.TTL))
-		return answer.TTL, nil
-	}
-
-	return 5, errors.New("invalid record type")
-}
-
+// AsyncResolve keeps the addresses of the domains up to date, see dnsScheduler, and expires the
+// preloaded addresses that are not confirmed.
 func (mgr *Manager) AsyncResolve() {
-	for _, allowedDomain := range mgr.config.RestrictedNetworkConfig.Domain.Allow {
-		go func(domainName string) {
-			for {
-				ttl, err := mgr.resolveAndUpdateAllowedFQDNList(domainName, dns.TypeA)
-				if err != nil {
-					log.Error(err)
-				}
-				time.Sleep(time.Duration(ttl) * time.Second)
-			}
-		}(allowedDomain)
-
-		go func(domainName string) {
-			for {
-				ttl, err := mgr.resolveAndUpdateAllowedFQDNList(domainName, dns.TypeAAAA)
-				if err != nil {
-					log.Error(err)
-				}
-				time.Sleep(time.Duration(ttl) * time.Second)
-			}
-		}(allowedDomain)
+	if mgr.config.RestrictedNetworkConfig.Domain.PreloadFile != "" {
+		go mgr.expirePreloaded()
 	}
 
-	for _, deniedDomain := range mgr.config.RestrictedNetworkConfig.Domain.Deny {
-		go func(domainName string) {
-			for {
-				ttl, err := mgr.resolveAndUpdateDeniedFQDNList(domainName, dns.TypeA)
-				if err != nil {
-					log.Error(err)
-				}
-				time.Sleep(time.Duration(ttl) * time.Second)
-			}
-		}(deniedDomain)
-
-		go func(domainName string) {
-			for {
-				ttl, err := mgr.resolveAndUpdateDeniedFQDNList(domainName, dns.TypeAAAA)
-				if err != nil {
-					log.Error(err)
-				}
-				time.Sleep(time.Duration(ttl) * time.Second)
-			}
-		}(deniedDomain)
-	}
+	s := newDNSScheduler(mgr, rand.New(rand.NewSource(time.Now().UnixNano())).Float64)
+	mgr.mu.Lock()
+	mgr.dnsRefresh = s
+	mgr.mu.Unlock()
+	go s.run()
 }
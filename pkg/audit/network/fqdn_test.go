@@ -1,8 +1,16 @@
 package network
 
 import (
+	"context"
+	"net"
 	"testing"
+	"time"
 
+	"github.com/miekg/dns"
+	"github.com/mrtc0/bouheki/pkg/bouhekitest"
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/freeze"
+	"github.com/mrtc0/bouheki/pkg/jobs"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -30,3 +38,262 @@ func Test_toFqdn(t *testing.T) {
 		})
 	}
 }
+
+func newFreezeTestManager(t *testing.T, freezeDNSRefresh bool) (*Manager, *bouhekitest.Maps, *bouhekitest.Clock) {
+	clock := bouhekitest.NewClock(time.Date(2026, 12, 19, 23, 59, 0, 0, time.UTC))
+	guard, err := freeze.NewWithClock(config.AdminConfig{
+		FreezeWindows:    []config.FreezeWindow{{Name: "year-end", Start: "2026-12-20T00:00", End: "2027-01-04T00:00"}},
+		FreezeDNSRefresh: freezeDNSRefresh,
+	}, clock.Now)
+	assert.Nil(t, err)
+
+	conf := config.DefaultConfig()
+	conf.RestrictedNetworkConfig.CIDR.Allow = []string{}
+	maps := bouhekitest.NewMaps()
+	mgr := &Manager{
+		config:      conf,
+		backend:     maps,
+		dnsResolver: aaaaResolver{"example.com": []net.IP{net.ParseIP("2001:db8::1")}},
+		freeze:      guard,
+	}
+	assert.Nil(t, mgr.SetConfigToMap())
+	return mgr, maps, clock
+}
+
+func TestDNSRefreshIsCheckedWhenTheJobRuns(t *testing.T) {
+	mgr, maps, clock := newFreezeTestManager(t, true)
+	defer mgr.Jobs().Stop()
+
+	// The refresh is queued behind another job before the window starts, and runs after.
+	release := make(chan struct{})
+	_, err := mgr.Jobs().Submit("blocker", func(ctx context.Context) error {
+		<-release
+		return nil
+	})
+	assert.Nil(t, err)
+
+	s := newTestScheduler(mgr, &domainRefresh{domain: "example.com", recordType: dns.TypeAAAA, list: SNAPSHOT_LIST_ALLOW})
+	done := make(chan error)
+	go func() {
+		done <- s.tick()
+	}()
+	assert.Eventually(t, func() bool { return mgr.Jobs().Status().Depth == 1 }, time.Second, time.Millisecond)
+
+	clock.Advance(time.Date(2026, 12, 20, 0, 1, 0, 0, time.UTC).Sub(clock.Now()))
+	close(release)
+
+	err = <-done
+	assert.ErrorIs(t, err, jobs.ErrRejected)
+	assert.Contains(t, err.Error(), "year-end")
+	assert.Empty(t, maps.Entries(ALLOWED_V6_CIDR_LIST_MAP_NAME))
+
+	history := mgr.Jobs().Status().History
+	assert.Equal(t, jobs.OUTCOME_REJECTED, history[len(history)-1].Outcome)
+
+	// Once the window is over, the refresh goes through again.
+	clock.Advance(time.Date(2027, 1, 4, 0, 0, 0, 0, time.UTC).Sub(clock.Now()))
+	s.queue[0].due = time.Time{}
+	err = s.tick()
+	assert.Nil(t, err)
+	assert.Len(t, maps.Entries(ALLOWED_V6_CIDR_LIST_MAP_NAME), 1)
+}
+
+func TestDNSRefreshContinuesDuringFreezeByDefault(t *testing.T) {
+	mgr, maps, clock := newFreezeTestManager(t, false)
+	defer mgr.Jobs().Stop()
+
+	clock.Advance(time.Date(2026, 12, 25, 0, 0, 0, 0, time.UTC).Sub(clock.Now()))
+	err := newTestScheduler(mgr, &domainRefresh{domain: "example.com", recordType: dns.TypeAAAA, list: SNAPSHOT_LIST_ALLOW}).tick()
+	assert.Nil(t, err)
+	assert.Len(t, maps.Entries(ALLOWED_V6_CIDR_LIST_MAP_NAME), 1)
+}
+
+func TestResolutionReplacesTheAddressesOfTheDomain(t *testing.T) {
+	for _, test := range []struct {
+		list    string
+		mapName string
+	}{
+		{SNAPSHOT_LIST_ALLOW, ALLOWED_V4_CIDR_LIST_MAP_NAME},
+		{SNAPSHOT_LIST_DENY, DENIED_V4_CIDR_LIST_MAP_NAME},
+	} {
+		t.Run(test.list, func(t *testing.T) {
+			conf := config.DefaultConfig()
+			conf.RestrictedNetworkConfig.Mode = "block"
+			conf.RestrictedNetworkConfig.CIDR.Allow = []string{}
+			if test.list == SNAPSHOT_LIST_DENY {
+				conf.RestrictedNetworkConfig.Domain.Deny = []string{"example.com"}
+			} else {
+				conf.RestrictedNetworkConfig.Domain.Allow = []string{"example.com"}
+			}
+			resolver := &FakeDNSResolver{answers: map[uint16][]net.IP{
+				dns.TypeA: {net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2"), net.ParseIP("192.0.2.3")},
+			}}
+			maps := bouhekitest.NewMaps()
+			mgr, err := NewManager(conf, WithMapBackend(maps), WithDNSResolver(resolver))
+			assert.Nil(t, err)
+
+			assert.Nil(t, mgr.SetConfigToMap())
+			assert.Len(t, mgr.resolved.domain(test.mapName, "example.com"), 3)
+			assert.Len(t, maps.Entries(test.mapName), 3)
+
+			resolver.answers[dns.TypeA] = []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.3")}
+			maps.ClearWrites()
+			assert.Nil(t, mgr.initDomainList(nil))
+			assert.Equal(t, [][]byte{cidrKey(t, "192.0.2.1/32"), cidrKey(t, "192.0.2.3/32")}, mgr.resolved.domain(test.mapName, "example.com"))
+
+			deletes := []bouhekitest.Write{}
+			for _, w := range maps.Writes() {
+				if w.IsDelete() {
+					deletes = append(deletes, w)
+				}
+			}
+			assert.Equal(t, []bouhekitest.Write{{Map: test.mapName, Key: cidrKey(t, "192.0.2.2/32")}}, deletes)
+			assert.False(t, mgr.Policy().hasCIDR(test.mapName, PROTOCOL_ALL, keyToIPNet(cidrKey(t, "192.0.2.2/32"))))
+		})
+	}
+}
+
+func TestDomainCacheKeepsTheAddressesOtherDomainsResolvedTo(t *testing.T) {
+	a, b, c := []byte{1}, []byte{2}, []byte{3}
+	cache := domainCache{}
+
+	assert.Empty(t, cache.set(ALLOWED_V4_CIDR_LIST_MAP_NAME, "example.com", [][]byte{a, b}, true, 1))
+	assert.Empty(t, cache.set(ALLOWED_V4_CIDR_LIST_MAP_NAME, "example.org", [][]byte{b}, true, 1))
+
+	// b is still an address of example.org.
+	assert.Equal(t, [][]byte{a}, cache.set(ALLOWED_V4_CIDR_LIST_MAP_NAME, "example.com", [][]byte{c}, true, 1))
+	assert.False(t, cache.has(ALLOWED_V4_CIDR_LIST_MAP_NAME, a))
+	assert.True(t, cache.has(ALLOWED_V4_CIDR_LIST_MAP_NAME, b))
+	assert.Equal(t, [][]byte{b}, cache.set(ALLOWED_V4_CIDR_LIST_MAP_NAME, "example.org", [][]byte{}, true, 1))
+
+	// Without replace, as for the answers of the DNS proxy, the addresses add up.
+	assert.Empty(t, cache.set(ALLOWED_V4_CIDR_LIST_MAP_NAME, "example.com", [][]byte{a}, false, 1))
+	assert.Equal(t, [][]byte{c, a}, cache.domain(ALLOWED_V4_CIDR_LIST_MAP_NAME, "example.com"))
+	assert.False(t, cache.has(ALLOWED_V6_CIDR_LIST_MAP_NAME, a))
+}
+
+// startNameserver answers the A and AAAA records of example.com.
+func startNameserver(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	mux := dns.NewServeMux()
+	mux.HandleFunc("example.com.", func(w dns.ResponseWriter, req *dns.Msg) {
+		res := new(dns.Msg)
+		res.SetReply(req)
+		record := "example.com. 60 IN A 192.0.2.1"
+		if req.Question[0].Qtype == dns.TypeAAAA {
+			record = "example.com. 120 IN AAAA 2001:db8::1"
+		}
+		rr, _ := dns.NewRR(record)
+		res.Answer = append(res.Answer, rr)
+		w.WriteMsg(res)
+	})
+	server := &dns.Server{PacketConn: conn, Handler: mux}
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+
+	return conn.LocalAddr().String()
+}
+
+func TestResolverQueriesTheConfiguredNameservers(t *testing.T) {
+	nameserver := startNameserver(t)
+	resolver, err := NewResolver(config.DomainResolverConfig{Nameservers: []string{nameserver}, Timeout: 5 * time.Second})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{nameserver}, resolver.Servers())
+
+	answer, err := resolver.Resolve("example.com", dns.TypeA)
+	assert.Nil(t, err)
+	assert.Equal(t, "192.0.2.1", answer.Addresses[0].String())
+	assert.Equal(t, uint32(60), answer.TTL)
+
+	answer, err = resolver.Resolve("example.com", dns.TypeAAAA)
+	assert.Nil(t, err)
+	assert.Equal(t, "2001:db8::1", answer.Addresses[0].String())
+	assert.Equal(t, uint32(120), answer.TTL)
+}
+
+func TestResolverGivesUpAfterTheTimeout(t *testing.T) {
+	// A nameserver that never answers.
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	resolver, err := NewResolver(config.DomainResolverConfig{Nameservers: []string{conn.LocalAddr().String(), conn.LocalAddr().String()}, Timeout: 200 * time.Millisecond})
+	assert.Nil(t, err)
+
+	started := time.Now()
+	_, err = resolver.Resolve("example.com", dns.TypeA)
+	assert.NotNil(t, err)
+	assert.Less(t, time.Since(started), time.Second)
+}
+
+func TestResolverOverTLS(t *testing.T) {
+	resolver, err := NewResolver(config.DomainResolverConfig{Nameservers: []string{"192.0.2.53"}, Timeout: time.Second, TLS: true, ServerName: "dns.example.com"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"192.0.2.53:853"}, resolver.Servers())
+	assert.Equal(t, "tcp-tls", resolver.Client().Net)
+	assert.Equal(t, "dns.example.com", resolver.Client().TLSConfig.ServerName)
+}
+
+func TestAddressSharedByTwoDomainsSurvivesTheRotationOfOne(t *testing.T) {
+	resolver := aaaaResolver{
+		"a.example.com": {net.ParseIP("2001:db8::4"), net.ParseIP("2001:db8:1::7")},
+		"b.example.com": {net.ParseIP("2001:db8::4")},
+	}
+	conf := config.DefaultConfig()
+	conf.RestrictedNetworkConfig.Mode = "block"
+	conf.RestrictedNetworkConfig.CIDR.Allow = []string{"2001:db8:1::7/128"}
+	conf.RestrictedNetworkConfig.Domain.Allow = []string{"a.example.com", "b.example.com"}
+	maps := bouhekitest.NewMaps()
+	mgr, err := NewManager(conf, WithMapBackend(maps), WithDNSResolver(resolver))
+	assert.Nil(t, err)
+	t.Cleanup(mgr.Close)
+	assert.Nil(t, mgr.SetConfigToMap())
+
+	// a moves: the address b still resolves to, and the one of network.cidr.allow, stay.
+	resolver["a.example.com"] = []net.IP{net.ParseIP("2001:db8::5")}
+	assert.Nil(t, mgr.initDomainList(nil))
+	for _, cidr := range []string{"2001:db8::4/128", "2001:db8::5/128", "2001:db8:1::7/128"} {
+		assert.True(t, maps.Has(ALLOWED_V6_CIDR_LIST_MAP_NAME, cidrKey(t, cidr)), cidr)
+	}
+
+	// Once b moves too, no domain holds it any more.
+	resolver["b.example.com"] = []net.IP{net.ParseIP("2001:db8::6")}
+	assert.Nil(t, mgr.initDomainList(nil))
+	assert.False(t, maps.Has(ALLOWED_V6_CIDR_LIST_MAP_NAME, cidrKey(t, "2001:db8::4/128")))
+	assert.True(t, maps.Has(ALLOWED_V6_CIDR_LIST_MAP_NAME, cidrKey(t, "2001:db8:1::7/128")))
+}
+
+func TestDomainCacheKeepsAMissingAddressUntilRemoveAfter(t *testing.T) {
+	a, b, c := []byte{1}, []byte{2}, []byte{3}
+	cache := domainCache{}
+
+	assert.Empty(t, cache.set(ALLOWED_V4_CIDR_LIST_MAP_NAME, "example.com", [][]byte{a, b}, true, 3))
+	// A round-robin answer with a part of the addresses keeps the others.
+	assert.Empty(t, cache.set(ALLOWED_V4_CIDR_LIST_MAP_NAME, "example.com", [][]byte{a}, true, 3))
+	assert.Empty(t, cache.set(ALLOWED_V4_CIDR_LIST_MAP_NAME, "example.com", [][]byte{a, c}, true, 3))
+	assert.True(t, cache.has(ALLOWED_V4_CIDR_LIST_MAP_NAME, b))
+
+	// Back in an answer, b is missing from none.
+	assert.Empty(t, cache.set(ALLOWED_V4_CIDR_LIST_MAP_NAME, "example.com", [][]byte{b}, true, 3))
+	assert.Empty(t, cache.set(ALLOWED_V4_CIDR_LIST_MAP_NAME, "example.com", [][]byte{c}, true, 3))
+
+	// a was missing from 3 consecutive resolutions, b from 2.
+	assert.Equal(t, [][]byte{a}, cache.set(ALLOWED_V4_CIDR_LIST_MAP_NAME, "example.com", [][]byte{c}, true, 3))
+	assert.Equal(t, [][]byte{b}, cache.set(ALLOWED_V4_CIDR_LIST_MAP_NAME, "example.com", [][]byte{c}, true, 3))
+	assert.Equal(t, [][]byte{c}, cache.domain(ALLOWED_V4_CIDR_LIST_MAP_NAME, "example.com"))
+}
+
+func TestAnswerHasTheLowestTTLOfItsRecords(t *testing.T) {
+	response := new(dns.Msg)
+	for _, record := range []string{"example.com. 300 IN A 192.0.2.1", "example.com. 60 IN A 192.0.2.2", "example.com. 120 IN A 192.0.2.3"} {
+		rr, err := dns.NewRR(record)
+		assert.Nil(t, err)
+		response.Answer = append(response.Answer, rr)
+	}
+
+	answer := dnsResponseToDNSAnswer(response)
+	assert.Len(t, answer.Addresses, 3)
+	assert.Equal(t, uint32(60), answer.TTL)
+}
@@ -3,11 +3,15 @@ package network
 import (
 	"fmt"
 	"strings"
+
+	"github.com/mrtc0/bouheki/pkg/policy"
 )
 
 const (
-	TCP                     = 1
-	UDP                     = 2
+	// PROTOCOL_ALL is the protocol of the rules that apply to every socket type.
+	PROTOCOL_ALL            = policy.PROTOCOL_ALL
+	TCP                     = policy.TCP
+	UDP                     = policy.UDP
 	TCP_STRING              = "TCP"
 	UDP_STRING              = "UDP"
 	PROTOCOL_UNKNOWN_STRING = "UNKOWN"
@@ -34,6 +38,24 @@ func byte2IPv6(addrBytes [16]byte) string {
 	return strings.Join(s, ":")
 }
 
+// protocolSockType returns the socket type of a protocol of the config, config.PROTOCOL_TCP or config.PROTOCOL_UDP.
+func protocolSockType(protocol string) uint8 {
+	return policy.ProtocolSockType(protocol)
+}
+
+// ruleProtocols are the protocols of the protocol lists, in the order they are listed in.
+var ruleProtocols = policy.RuleProtocols
+
+// ruleProtocol is the inverse of protocolSockType, "" for a socket type no protocol list has.
+func ruleProtocol(sockType uint8) string {
+	for _, protocol := range ruleProtocols {
+		if protocolSockType(protocol) == sockType {
+			return protocol
+		}
+	}
+	return ""
+}
+
 func sockTypeToProtocolName(sockType uint8) string {
 	// https://elixir.bootlin.com/linux/latest/source/include/linux/net.h#L61
 	switch sockType {
@@ -0,0 +1,45 @@
+package network
+
+import (
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/errkind"
+	"github.com/mrtc0/bouheki/pkg/policy"
+)
+
+const (
+	// OPERATION_CONNECT, OPERATION_SENDMSG and OPERATION_BIND are the operations the events are
+	// reported for, as the Operation of the audit log.
+	OPERATION_CONNECT = "connect"
+	OPERATION_SENDMSG = "sendmsg"
+	OPERATION_BIND    = "bind"
+)
+
+// Binding is the local address and port of a bind(2) call.
+type Binding = policy.Binding
+
+// ingressState returns the content of the lists of network.ingress.
+func ingressState(conf config.IngressConfig) (mapState, error) {
+	state := mapState{}
+	if err := state.setCIDRs(conf.CIDR.Allow, INGRESS_ALLOWED_V4_CIDR_LIST_MAP_NAME, INGRESS_ALLOWED_V6_CIDR_LIST_MAP_NAME); err != nil {
+		return nil, errkind.Errorf(errkind.Config, "network.ingress.cidr.allow: %w", err)
+	}
+	if err := state.setCIDRs(conf.CIDR.Deny, INGRESS_DENIED_V4_CIDR_LIST_MAP_NAME, INGRESS_DENIED_V6_CIDR_LIST_MAP_NAME); err != nil {
+		return nil, errkind.Errorf(errkind.Config, "network.ingress.cidr.deny: %w", err)
+	}
+	if err := state.setPorts(conf.Ports.Allow, INGRESS_ALLOWED_PORT_LIST_MAP_NAME); err != nil {
+		return nil, errkind.Errorf(errkind.Config, "network.ingress.ports.allow: %w", err)
+	}
+	if err := state.setPorts(conf.Ports.Deny, INGRESS_DENIED_PORT_LIST_MAP_NAME); err != nil {
+		return nil, errkind.Errorf(errkind.Config, "network.ingress.ports.deny: %w", err)
+	}
+	return state, nil
+}
+
+// isIngressCIDRList reports whether mapName is one of the CIDR lists of network.ingress.
+func isIngressCIDRList(mapName string) bool {
+	switch mapName {
+	case INGRESS_ALLOWED_V4_CIDR_LIST_MAP_NAME, INGRESS_ALLOWED_V6_CIDR_LIST_MAP_NAME, INGRESS_DENIED_V4_CIDR_LIST_MAP_NAME, INGRESS_DENIED_V6_CIDR_LIST_MAP_NAME:
+		return true
+	}
+	return false
+}
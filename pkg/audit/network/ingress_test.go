@@ -0,0 +1,170 @@
+package network
+
+import (
+	"net"
+	"testing"
+
+	"github.com/mrtc0/bouheki/pkg/bouhekitest"
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/policy"
+	"github.com/stretchr/testify/assert"
+)
+
+func ingressTestConfig() *config.Config {
+	conf := stateTestConfig()
+	conf.RestrictedNetworkConfig.Ingress.CIDR.Allow = []string{"127.0.0.0/8", "::1/128"}
+	conf.RestrictedNetworkConfig.Ingress.CIDR.Deny = []string{"127.0.0.53/32"}
+	conf.RestrictedNetworkConfig.Ingress.Ports.Allow = []string{"8000-8999"}
+	conf.RestrictedNetworkConfig.Ingress.Ports.Deny = []string{"8022"}
+	return conf
+}
+
+func TestSetConfigToMapWritesTheIngressLists(t *testing.T) {
+	maps := bouhekitest.NewMaps()
+	mgr := Manager{config: ingressTestConfig(), backend: maps}
+	assert.Nil(t, mgr.SetConfigToMap())
+
+	assert.True(t, maps.Has(INGRESS_ALLOWED_V4_CIDR_LIST_MAP_NAME, cidrKey(t, "127.0.0.0/8")))
+	assert.True(t, maps.Has(INGRESS_ALLOWED_V6_CIDR_LIST_MAP_NAME, cidrKey(t, "::1/128")))
+	assert.True(t, maps.Has(INGRESS_DENIED_V4_CIDR_LIST_MAP_NAME, cidrKey(t, "127.0.0.53/32")))
+	allowed, err := config.ParsePortRange("8000-8999")
+	assert.Nil(t, err)
+	assert.Len(t, maps.Entries(INGRESS_ALLOWED_PORT_LIST_MAP_NAME), len(policy.PortRangePrefixes(allowed)))
+	assert.Len(t, maps.Entries(INGRESS_DENIED_PORT_LIST_MAP_NAME), 1)
+	// The lists of the connections are the ones of the config without network.ingress.
+	assert.Len(t, maps.Entries(ALLOWED_V4_CIDR_LIST_MAP_NAME), 1)
+
+	sizes := DecodeListSizes(maps.Entries(RESTRICT_NETWORK_CONFIG_MAP_NAME)[string([]byte{0})])
+	assert.Equal(t, uint32(2), sizes.IngressAllowCIDR)
+	assert.Equal(t, uint32(len(policy.PortRangePrefixes(allowed))), sizes.IngressAllowPort)
+	assert.Equal(t, uint32(1), sizes.IngressDenyPort)
+
+	// A config without network.ingress leaves the lists empty.
+	mgr.config = stateTestConfig()
+	assert.Nil(t, mgr.SetConfigToMap())
+	assert.Len(t, maps.Entries(INGRESS_ALLOWED_V4_CIDR_LIST_MAP_NAME), 0)
+	assert.Len(t, maps.Entries(INGRESS_ALLOWED_PORT_LIST_MAP_NAME), 0)
+	assert.False(t, mgr.Policy().HasIngressRules())
+}
+
+func TestPolicyEvaluateBind(t *testing.T) {
+	tests := []struct {
+		name     string
+		conf     func() *config.Config
+		binding  Binding
+		expected Decision
+	}{
+		{
+			name:     "Allowed address and port",
+			conf:     ingressTestConfig,
+			binding:  Binding{Addr: net.ParseIP("127.0.0.1"), Port: 8080},
+			expected: Decision{},
+		},
+		{
+			name:     "Address outside the allowed CIDR",
+			conf:     ingressTestConfig,
+			binding:  Binding{Addr: net.ParseIP("0.0.0.0"), Port: 8080},
+			expected: Decision{Audited: true, Denied: true, Blocked: true, Rule: "network.ingress.cidr.allow does not list 0.0.0.0"},
+		},
+		{
+			name:     "Port outside the allowed ports",
+			conf:     ingressTestConfig,
+			binding:  Binding{Addr: net.ParseIP("::1"), Port: 9000},
+			expected: Decision{Audited: true, Denied: true, Blocked: true, Rule: "network.ingress.ports.allow does not list 9000"},
+		},
+		{
+			name:     "Denied port overrides the allowed ports",
+			conf:     ingressTestConfig,
+			binding:  Binding{Addr: net.ParseIP("127.0.0.1"), Port: 8022},
+			expected: Decision{Audited: true, Denied: true, Blocked: true, DenyListed: true, Rule: "network.ingress.ports.deny 8022"},
+		},
+		{
+			name:     "Denied address overrides the allowed CIDR",
+			conf:     ingressTestConfig,
+			binding:  Binding{Addr: net.ParseIP("127.0.0.53"), Port: 8053},
+			expected: Decision{Audited: true, Denied: true, Blocked: true, DenyListed: true, Rule: "network.ingress.cidr.deny 127.0.0.53/32"},
+		},
+		{
+			name:     "Port 0 is not restricted",
+			conf:     ingressTestConfig,
+			binding:  Binding{Addr: net.ParseIP("0.0.0.0"), Port: 0},
+			expected: Decision{},
+		},
+		{
+			name:     "The lists of the connections play no part",
+			conf:     stateTestConfig,
+			binding:  Binding{Addr: net.ParseIP("192.168.1.1"), Port: 22},
+			expected: Decision{},
+		},
+		{
+			name: "Monitor mode audits every bind",
+			conf: func() *config.Config {
+				conf := ingressTestConfig()
+				conf.RestrictedNetworkConfig.Mode = "monitor"
+				return conf
+			},
+			binding:  Binding{Addr: net.ParseIP("127.0.0.1"), Port: 8080},
+			expected: Decision{Audited: true},
+		},
+		{
+			name: "Host binds are not restricted with the container target",
+			conf: func() *config.Config {
+				conf := ingressTestConfig()
+				conf.RestrictedNetworkConfig.Target = "container"
+				return conf
+			},
+			binding:  Binding{Addr: net.ParseIP("0.0.0.0"), Port: 22},
+			expected: Decision{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mgr := Manager{config: test.conf(), backend: bouhekitest.NewMaps()}
+			assert.Nil(t, mgr.SetConfigToMap())
+			assert.Equal(t, test.expected, mgr.Policy().EvaluateBind(test.binding))
+		})
+	}
+}
+
+func TestAuditLogOfABind(t *testing.T) {
+	body := detectEventIPv4{DstIP: [4]byte{127, 0, 0, 1}, DstPort: 8022, LsmHookPoint: LSM_HOOK_POINT_BIND, Action: ACTION_BLOCKED, SockType: 1}
+	networkLog := newAuditLog(eventHeader{EventType: BLOCKED_IPV4}, body)
+	assert.Equal(t, OPERATION_BIND, networkLog.Operation)
+	assert.Equal(t, "127.0.0.1", networkLog.LocalAddr)
+	assert.Equal(t, uint16(8022), networkLog.LocalPort)
+	assert.Equal(t, "", networkLog.Addr)
+	assert.Equal(t, uint16(0), networkLog.Port)
+
+	body.LsmHookPoint = LSM_HOOK_POINT_CONNECT
+	networkLog = newAuditLog(eventHeader{EventType: BLOCKED_IPV4}, body)
+	assert.Equal(t, OPERATION_CONNECT, networkLog.Operation)
+	assert.Equal(t, "127.0.0.1", networkLog.Addr)
+
+	// A datagram sent without a connection has a destination, as a connection.
+	for _, point := range []uint8{LSM_HOOK_POINT_SENDMSG, LSM_HOOK_POINT_SENDMSG_KPROBE} {
+		body.LsmHookPoint, body.SockType = point, 2
+		networkLog = newAuditLog(eventHeader{EventType: BLOCKED_IPV4}, body)
+		assert.Equal(t, OPERATION_SENDMSG, networkLog.Operation)
+		assert.Equal(t, "127.0.0.1", networkLog.Addr)
+		assert.Equal(t, uint16(8022), networkLog.Port)
+	}
+}
+
+func TestRestrictedOperations(t *testing.T) {
+	assert.Equal(t, []string{OPERATION_CONNECT, OPERATION_SENDMSG}, restrictedOperations(stateTestConfig()))
+	assert.Equal(t, []string{OPERATION_CONNECT, OPERATION_SENDMSG, OPERATION_BIND}, restrictedOperations(ingressTestConfig()))
+
+	hooks := operationHooks([]string{OPERATION_CONNECT, OPERATION_BIND})
+	assert.Len(t, hooks, 2)
+	lsm, kprobe := hooks[1].programNames(true)
+	assert.Equal(t, LSM_BIND_ANCESTORS_PROGRAM_NAME, lsm)
+	assert.Equal(t, KPROBE_BIND_ANCESTORS_PROGRAM_NAME, kprobe)
+
+	hooks = operationHooks(restrictedOperations(stateTestConfig()))
+	assert.Len(t, hooks, 2)
+	lsm, kprobe = hooks[1].programNames(false)
+	assert.Equal(t, LSM_SENDMSG_PROGRAM_NAME, lsm)
+	assert.Equal(t, KPROBE_SENDMSG_PROGRAM_NAME, kprobe)
+	assert.Equal(t, KPROBE_SENDMSG_ATTACH_POINT, hooks[1].attachPoint)
+}
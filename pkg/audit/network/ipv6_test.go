@@ -0,0 +1,212 @@
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/mrtc0/bouheki/pkg/bouhekitest"
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/errkind"
+	"github.com/stretchr/testify/assert"
+)
+
+type ipv6Fixture struct {
+	name string
+	cidr string
+	// network is the canonical form of cidr.
+	network string
+	// inside and outside are addresses in and out of the network. outside is empty for ::/0.
+	inside  string
+	outside string
+}
+
+var ipv6Fixtures = []ipv6Fixture{
+	{name: "ULA", cidr: "fd12:3456:789a::/48", network: "fd12:3456:789a::/48", inside: "fd12:3456:789a:1::1", outside: "fd12:3456:789b::1"},
+	{name: "global", cidr: "2001:db8:abcd::/48", network: "2001:db8:abcd::/48", inside: "2001:db8:abcd:12::1", outside: "2001:db8:abce::1"},
+	{name: "default route", cidr: "::/0", network: "::/0", inside: "2001:db8::1"},
+	{name: "host", cidr: "2001:db8::1/128", network: "2001:db8::1/128", inside: "2001:db8::1", outside: "2001:db8::2"},
+	{name: "compressed", cidr: "2001:db8:0:0:1::/80", network: "2001:db8:0:0:1::/80", inside: "2001:db8::1:0:0:1", outside: "2001:db8::2:0:0:1"},
+	{name: "expanded", cidr: "2001:0db8:0000:0000:0001:0000:0000:0000/80", network: "2001:db8:0:0:1::/80", inside: "2001:db8::1:0:0:1", outside: "2001:db8::2:0:0:1"},
+	{name: "uppercase hex", cidr: "2001:DB8:ABCD::/48", network: "2001:db8:abcd::/48", inside: "2001:db8:abcd::1", outside: "2001:db8:abce::1"},
+	{name: "host bits are cleared", cidr: "2001:db8:abcd::1/48", network: "2001:db8:abcd::/48", inside: "2001:db8:abcd::2", outside: "2001:db8:abce::1"},
+	{name: "link-local with zone", cidr: "fe80::1%eth0/64", network: "fe80::/64", inside: "fe80::2", outside: "fe81::1"},
+}
+
+// v6Key returns the expected key of network, built independently of ipv6ToKey.
+func v6Key(t *testing.T, network string) []byte {
+	_, n, err := net.ParseCIDR(network)
+	assert.Nil(t, err)
+	prefixLen, _ := n.Mask.Size()
+
+	key := make([]byte, 20)
+	binary.LittleEndian.PutUint32(key, uint32(prefixLen))
+	copy(key[4:], n.IP.To16())
+	return key
+}
+
+func TestIPv6FixturesKey(t *testing.T) {
+	for _, fixture := range ipv6Fixtures {
+		t.Run(fixture.name, func(t *testing.T) {
+			addr, err := cidrToBPFMapKey(fixture.cidr)
+			assert.Nil(t, err)
+			assert.True(t, addr.isV6address())
+			assert.Equal(t, v6Key(t, fixture.network), addr.key)
+			assert.Equal(t, fixture.network, keyToIPNet(addr.key).String())
+		})
+	}
+}
+
+func TestInvalidIPv6CIDRNamesTheEntry(t *testing.T) {
+	for _, cidr := range []string{"2001:db8::/129", "2001:db8::/-1", "2001:db8:::/64"} {
+		t.Run(cidr, func(t *testing.T) {
+			conf := config.DefaultConfig()
+			conf.RestrictedNetworkConfig.CIDR.Deny = []string{"2001:db8::/32", cidr}
+			mgr := Manager{config: conf, backend: bouhekitest.NewMaps()}
+
+			err := mgr.SetConfigToMap()
+			assert.Equal(t, errkind.Config, errkind.KindOf(err))
+			assert.Contains(t, err.Error(), "network.cidr.deny")
+			assert.Contains(t, err.Error(), cidr)
+		})
+	}
+}
+
+func TestIPv4MappedCIDRsAreIPv4Keys(t *testing.T) {
+	for _, test := range []struct{ mapped, v4 string }{
+		{"::ffff:10.0.0.0/104", "10.0.0.0/8"},
+		{"::ffff:203.0.113.7/128", "203.0.113.7/32"},
+		{"::FFFF:192.168.1.1/120", "192.168.1.0/24"},
+	} {
+		t.Run(test.mapped, func(t *testing.T) {
+			mapped, err := cidrToBPFMapKey(test.mapped)
+			assert.Nil(t, err)
+			v4, err := cidrToBPFMapKey(test.v4)
+			assert.Nil(t, err)
+			assert.False(t, mapped.isV6address())
+			assert.Equal(t, v4.key, mapped.key)
+		})
+	}
+
+	conf := config.DefaultConfig()
+	conf.RestrictedNetworkConfig.Mode = "block"
+	conf.RestrictedNetworkConfig.CIDR.Allow = []string{"::ffff:10.0.0.0/104"}
+	conf.RestrictedNetworkConfig.CIDR.Deny = []string{"::ffff:10.0.0.1/128"}
+	maps := bouhekitest.NewMaps()
+	mgr := Manager{config: conf, backend: maps}
+	assert.Nil(t, mgr.SetConfigToMap())
+
+	assert.Len(t, maps.Entries(ALLOWED_V4_CIDR_LIST_MAP_NAME), 1)
+	assert.Len(t, maps.Entries(DENIED_V4_CIDR_LIST_MAP_NAME), 1)
+	assert.Empty(t, maps.Entries(ALLOWED_V6_CIDR_LIST_MAP_NAME))
+	assert.Empty(t, maps.Entries(DENIED_V6_CIDR_LIST_MAP_NAME))
+
+	policy := mgr.Policy()
+	for _, addr := range []string{"10.0.0.1", "::ffff:10.0.0.1"} {
+		assert.True(t, policy.Evaluate(Connection{Addr: net.ParseIP(addr)}).Denied, addr)
+	}
+	for _, addr := range []string{"10.0.0.2", "::ffff:10.0.0.2"} {
+		assert.False(t, policy.Evaluate(Connection{Addr: net.ParseIP(addr)}).Denied, addr)
+	}
+}
+
+func TestIPv4MappedDomainAddressesAreIPv4Keys(t *testing.T) {
+	resolver := aaaaResolver{"mapped.example.com": {net.ParseIP("::ffff:203.0.113.7")}}
+	conf := config.DefaultConfig()
+	conf.RestrictedNetworkConfig.Mode = "block"
+	conf.RestrictedNetworkConfig.Domain.Deny = []string{"mapped.example.com"}
+	maps := bouhekitest.NewMaps()
+	mgr := Manager{config: conf, backend: maps, dnsResolver: resolver}
+	assert.Nil(t, mgr.SetConfigToMap())
+
+	v4, err := cidrToBPFMapKey("203.0.113.7/32")
+	assert.Nil(t, err)
+	_, ok := maps.Entries(DENIED_V4_CIDR_LIST_MAP_NAME)[string(v4.key)]
+	assert.True(t, ok)
+	assert.Empty(t, maps.Entries(DENIED_V6_CIDR_LIST_MAP_NAME))
+
+	policy := mgr.Policy()
+	for _, addr := range []string{"203.0.113.7", "::ffff:203.0.113.7"} {
+		assert.True(t, policy.Evaluate(Connection{Addr: net.ParseIP(addr)}).Denied, addr)
+	}
+}
+
+// aaaaResolver answers AAAA queries from a table and has no A records, like an IPv6-only domain.
+type aaaaResolver map[string][]net.IP
+
+func (r aaaaResolver) Resolve(host string, recordType uint16) (*DNSAnswer, error) {
+	addresses, ok := r[host]
+	if !ok || recordType != dns.TypeAAAA {
+		return nil, errors.New("no records")
+	}
+	return &DNSAnswer{Domain: host, Addresses: addresses, TTL: 300}, nil
+}
+
+func TestIPv6FixturesDomainResolution(t *testing.T) {
+	resolver := aaaaResolver{}
+	domains := []string{}
+	for _, fixture := range ipv6Fixtures {
+		domain := fixture.name + ".example.com"
+		resolver[domain] = []net.IP{net.ParseIP(fixture.inside)}
+		domains = append(domains, domain)
+	}
+
+	conf := config.DefaultConfig()
+	conf.RestrictedNetworkConfig.CIDR.Allow = []string{}
+	conf.RestrictedNetworkConfig.Domain.Allow = domains
+	maps := bouhekitest.NewMaps()
+	mgr := Manager{config: conf, backend: maps, dnsResolver: resolver}
+
+	assert.Nil(t, mgr.SetConfigToMap())
+
+	for _, fixture := range ipv6Fixtures {
+		key := v6Key(t, fixture.inside+"/128")
+		_, ok := maps.Entries(ALLOWED_V6_CIDR_LIST_MAP_NAME)[string(key)]
+		assert.True(t, ok, fixture.name)
+
+		addrs, err := domainNameToBPFMapKey(fixture.name, []net.IP{net.ParseIP(fixture.inside)}, PROTOCOL_ALL)
+		assert.Nil(t, err)
+		assert.Equal(t, key, addrs[0].key)
+	}
+	assert.Empty(t, maps.Entries(ALLOWED_V4_CIDR_LIST_MAP_NAME))
+}
+
+func TestIPv6FixturesEvaluate(t *testing.T) {
+	for _, fixture := range ipv6Fixtures {
+		t.Run(fixture.name, func(t *testing.T) {
+			conf := config.DefaultConfig()
+			conf.RestrictedNetworkConfig.Mode = "block"
+			conf.RestrictedNetworkConfig.CIDR.Allow = []string{"10.0.0.0/8", fixture.cidr}
+			mgr := Manager{config: conf, backend: bouhekitest.NewMaps()}
+			assert.Nil(t, mgr.SetConfigToMap())
+
+			policy := mgr.Policy()
+			assert.False(t, policy.Evaluate(Connection{Addr: net.ParseIP(fixture.inside)}).Denied)
+			assert.False(t, policy.Evaluate(Connection{Addr: net.ParseIP("10.1.1.1")}).Denied)
+			if fixture.outside != "" {
+				assert.True(t, policy.Evaluate(Connection{Addr: net.ParseIP(fixture.outside)}).Denied)
+			}
+		})
+	}
+}
+
+func TestDualStackEvaluate(t *testing.T) {
+	conf := config.DefaultConfig()
+	conf.RestrictedNetworkConfig.Mode = "block"
+	conf.RestrictedNetworkConfig.CIDR.Allow = []string{"0.0.0.0/0", "::/0"}
+	conf.RestrictedNetworkConfig.CIDR.Deny = []string{"10.254.249.3/32", "2001:3984:3989:0000:0000:0000:0000:0003/128"}
+	maps := bouhekitest.NewMaps()
+	mgr := Manager{config: conf, backend: maps}
+	assert.Nil(t, mgr.SetConfigToMap())
+
+	assert.Len(t, maps.Entries(DENIED_V4_CIDR_LIST_MAP_NAME), 1)
+	assert.Len(t, maps.Entries(DENIED_V6_CIDR_LIST_MAP_NAME), 1)
+
+	policy := mgr.Policy()
+	assert.True(t, policy.Evaluate(Connection{Addr: net.ParseIP("10.254.249.3")}).Denied)
+	assert.True(t, policy.Evaluate(Connection{Addr: net.ParseIP("2001:3984:3989::3")}).Denied)
+	assert.False(t, policy.Evaluate(Connection{Addr: net.ParseIP("10.254.249.4")}).Denied)
+	assert.False(t, policy.Evaluate(Connection{Addr: net.ParseIP("2001:3984:3989::4")}).Denied)
+}
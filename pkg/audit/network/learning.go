@@ -0,0 +1,460 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+	log "github.com/mrtc0/bouheki/pkg/log"
+	"github.com/mrtc0/bouheki/pkg/metrics"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	LEARNED_CONNECTIONS_FILE = "learned-connections.json"
+	// LEARNED_CONNECTIONS_VERSION is the version of the format of LEARNED_CONNECTIONS_FILE.
+	LEARNED_CONNECTIONS_VERSION = 1
+)
+
+var (
+	learnedConnections = metrics.NewGauge("network_learned_connections",
+		"Number of comm, uid, destination and port tuples kept by the learning mode.")
+	learnedConnectionsEvicted = metrics.NewCounter("network_learned_connections_evicted_total",
+		"Number of tuples forgotten for a new one because the learned connections were full.")
+)
+
+// LearnedConnection counts the connections of a comm and a uid to a destination and a port.
+type LearnedConnection struct {
+	Comm string `json:"comm"`
+	UID  uint32 `json:"uid"`
+	// Destination is the prefix of the addresses, aggregated to network.learning.v4_prefix or
+	// v6_prefix, and Domain the domain the DNS proxy resolved them for, if any.
+	Destination string    `json:"destination"`
+	Domain      string    `json:"domain,omitempty"`
+	Port        uint16    `json:"port"`
+	Connections uint64    `json:"connections"`
+	FirstSeen   time.Time `json:"first_seen"`
+	LastSeen    time.Time `json:"last_seen"`
+}
+
+// LearnedConnections is the content of <state_dir>/learned-connections.json.
+type LearnedConnections struct {
+	Version     int                 `json:"version"`
+	Updated     time.Time           `json:"updated"`
+	Connections []LearnedConnection `json:"connections"`
+}
+
+// LearnedConnectionsPath returns the file holding the learned connections in dir.
+func LearnedConnectionsPath(dir string) string {
+	return filepath.Join(dir, LEARNED_CONNECTIONS_FILE)
+}
+
+// ReadLearnedConnections reads a file of learned connections, of this host or copied from another.
+func ReadLearnedConnections(path string) (*LearnedConnections, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	learned := &LearnedConnections{}
+	if err := json.Unmarshal(data, learned); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if learned.Version != LEARNED_CONNECTIONS_VERSION {
+		return nil, fmt.Errorf("%s: unsupported version %d, expected %d", path, learned.Version, LEARNED_CONNECTIONS_VERSION)
+	}
+	return learned, nil
+}
+
+type learnedKey struct {
+	comm        string
+	uid         uint32
+	destination string
+	domain      string
+	port        uint16
+}
+
+func (c LearnedConnection) key() learnedKey {
+	return learnedKey{comm: c.Comm, uid: c.UID, destination: c.Destination, domain: c.Domain, port: c.Port}
+}
+
+// merge adds the connections of o, seen by another run or on another host, to c.
+func (c *LearnedConnection) merge(o LearnedConnection) {
+	c.Connections += o.Connections
+	if o.FirstSeen.Before(c.FirstSeen) {
+		c.FirstSeen = o.FirstSeen
+	}
+	if o.LastSeen.After(c.LastSeen) {
+		c.LastSeen = o.LastSeen
+	}
+}
+
+// MergeLearnedConnections merges the connections of several files by their tuple, the most
+// connections first.
+func MergeLearnedConnections(sets ...*LearnedConnections) []LearnedConnection {
+	merged := map[learnedKey]*LearnedConnection{}
+	for _, set := range sets {
+		for _, conn := range set.Connections {
+			if existing, ok := merged[conn.key()]; ok {
+				existing.merge(conn)
+				continue
+			}
+			conn := conn
+			merged[conn.key()] = &conn
+		}
+	}
+
+	connections := make([]LearnedConnection, 0, len(merged))
+	for _, conn := range merged {
+		connections = append(connections, *conn)
+	}
+	sortLearnedConnections(connections)
+	return connections
+}
+
+func sortLearnedConnections(connections []LearnedConnection) {
+	sort.Slice(connections, func(i, j int) bool {
+		a, b := connections[i], connections[j]
+		if a.Connections != b.Connections {
+			return a.Connections > b.Connections
+		}
+		if a.Comm != b.Comm {
+			return a.Comm < b.Comm
+		}
+		if a.UID != b.UID {
+			return a.UID < b.UID
+		}
+		if a.Destination != b.Destination {
+			return a.Destination < b.Destination
+		}
+		if a.Domain != b.Domain {
+			return a.Domain < b.Domain
+		}
+		return a.Port < b.Port
+	})
+}
+
+// learningRecorder aggregates the connections of the events of mode: learning by their tuple.
+// observe only counts in memory, and run writes them every write_interval, as the outcome
+// history does.
+type learningRecorder struct {
+	mu      sync.Mutex
+	conf    config.LearningConfig
+	entries map[learnedKey]*LearnedConnection
+	dirty   bool
+	now     func() time.Time
+}
+
+func newLearningRecorder(conf config.LearningConfig) *learningRecorder {
+	return &learningRecorder{
+		conf:    conf,
+		entries: map[learnedKey]*LearnedConnection{},
+		now:     time.Now,
+	}
+}
+
+// load continues the connections learned by a previous run. A file that does not exist yet is
+// not an error. If it has more than max_entries, the most recently seen are kept.
+func (r *learningRecorder) load() error {
+	learned, err := ReadLearnedConnections(LearnedConnectionsPath(r.conf.StateDir))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	connections := learned.Connections
+	sort.SliceStable(connections, func(i, j int) bool { return connections[i].LastSeen.After(connections[j].LastSeen) })
+	if len(connections) > r.conf.MaxEntries {
+		connections = connections[:r.conf.MaxEntries]
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range connections {
+		conn := connections[i]
+		r.entries[conn.key()] = &conn
+	}
+	learnedConnections.Set(float64(len(r.entries)))
+	return nil
+}
+
+func (r *learningRecorder) observe(header eventHeader, body detectEvent) {
+	conn := eventToConnection(header, body)
+	r.add(conn.Command, conn.UID, conn.Addr, newAuditLog(header, body).Domain, conn.Port)
+}
+
+func (r *learningRecorder) add(comm string, uid uint32, addr net.IP, domain string, port uint16) {
+	key := learnedKey{comm: comm, uid: uid, destination: r.destination(addr), domain: strings.TrimSuffix(domain, "."), port: port}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	entry, ok := r.entries[key]
+	if !ok {
+		if len(r.entries) >= r.conf.MaxEntries {
+			r.evict()
+		}
+		entry = &LearnedConnection{Comm: comm, UID: uid, Destination: key.destination, Domain: key.domain, Port: port, FirstSeen: now}
+		r.entries[key] = entry
+		learnedConnections.Set(float64(len(r.entries)))
+	}
+	entry.Connections++
+	entry.LastSeen = now
+	r.dirty = true
+}
+
+// destination returns the prefix addr is aggregated into, e.g. 192.0.2.0/24.
+func (r *learningRecorder) destination(addr net.IP) string {
+	if v4 := addr.To4(); v4 != nil {
+		mask := net.CIDRMask(r.conf.V4Prefix, 32)
+		return (&net.IPNet{IP: v4.Mask(mask), Mask: mask}).String()
+	}
+	mask := net.CIDRMask(r.conf.V6Prefix, 128)
+	return (&net.IPNet{IP: addr.Mask(mask), Mask: mask}).String()
+}
+
+// evict forgets the least recently seen connection.
+func (r *learningRecorder) evict() {
+	var (
+		oldest learnedKey
+		found  bool
+	)
+	for key, entry := range r.entries {
+		if !found || entry.LastSeen.Before(r.entries[oldest].LastSeen) {
+			oldest, found = key, true
+		}
+	}
+	if found {
+		delete(r.entries, oldest)
+		learnedConnectionsEvicted.Inc()
+	}
+}
+
+// snapshot returns the learned connections, the most connections first.
+func (r *learningRecorder) snapshot() LearnedConnections {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	learned := LearnedConnections{Version: LEARNED_CONNECTIONS_VERSION, Updated: r.now(), Connections: []LearnedConnection{}}
+	for _, entry := range r.entries {
+		learned.Connections = append(learned.Connections, *entry)
+	}
+	sortLearnedConnections(learned.Connections)
+	return learned
+}
+
+func (r *learningRecorder) run(ctx context.Context) {
+	ticker := time.NewTicker(r.conf.WriteInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.flush()
+		}
+	}
+}
+
+// flush writes the learned connections if a connection was counted since the last write.
+func (r *learningRecorder) flush() {
+	r.mu.Lock()
+	dirty := r.dirty
+	r.dirty = false
+	r.mu.Unlock()
+	if !dirty {
+		return
+	}
+
+	data, err := json.Marshal(r.snapshot())
+	if err == nil {
+		err = writeStateFile(r.conf.StateDir, LEARNED_CONNECTIONS_FILE, data)
+	}
+	if err != nil {
+		log.Error(fmt.Errorf("failed to write the learned connections: %w", err))
+	}
+}
+
+// GeneratedList is an allow list of a generated network section.
+type GeneratedList struct {
+	Allow []string `yaml:"allow"`
+}
+
+// GeneratedNetwork is the network section GeneratePolicy returns, with the keys of the config.
+// CIDR is always written, even empty, as the default network.cidr.allow allows every address.
+type GeneratedNetwork struct {
+	Domain  *GeneratedList `yaml:"domain,omitempty"`
+	CIDR    GeneratedList  `yaml:"cidr"`
+	Command *GeneratedList `yaml:"command,omitempty"`
+	UID     *GeneratedList `yaml:"uid,omitempty"`
+	Ports   *GeneratedList `yaml:"ports,omitempty"`
+}
+
+// GeneratePolicy returns the allow lists that permit the learned connections seen at least
+// minConnections times: the domains the DNS proxy resolved the addresses for, the prefixes of the
+// other addresses, collapsed, and the comms, uids and ports of these connections.
+func GeneratePolicy(connections []LearnedConnection, minConnections uint64) GeneratedNetwork {
+	domains := map[string]bool{}
+	prefixes := []*net.IPNet{}
+	comms := map[string]bool{}
+	uids := map[uint32]bool{}
+	ports := map[uint16]bool{}
+	for _, conn := range connections {
+		if conn.Connections < minConnections {
+			continue
+		}
+		if conn.Domain != "" {
+			domains[conn.Domain] = true
+		} else if _, n, err := net.ParseCIDR(conn.Destination); err == nil {
+			prefixes = append(prefixes, n)
+		}
+		comms[conn.Comm] = true
+		uids[conn.UID] = true
+		ports[conn.Port] = true
+	}
+
+	network := GeneratedNetwork{CIDR: GeneratedList{Allow: []string{}}}
+	for _, n := range collapsePrefixes(prefixes) {
+		network.CIDR.Allow = append(network.CIDR.Allow, n.String())
+	}
+	if len(domains) > 0 {
+		network.Domain = &GeneratedList{Allow: sortedSet(domains)}
+	}
+	if len(comms) > 0 {
+		network.Command = &GeneratedList{Allow: sortedSet(comms)}
+	}
+	if len(uids) > 0 {
+		list := &GeneratedList{}
+		for _, uid := range sortedUints(uids) {
+			list.Allow = append(list.Allow, strconv.FormatUint(uint64(uid), 10))
+		}
+		network.UID = list
+	}
+	if len(ports) > 0 {
+		list := &GeneratedList{}
+		for port := range ports {
+			list.Allow = append(list.Allow, strconv.Itoa(int(port)))
+		}
+		sort.Slice(list.Allow, func(i, j int) bool {
+			a, _ := strconv.Atoi(list.Allow[i])
+			b, _ := strconv.Atoi(list.Allow[j])
+			return a < b
+		})
+		network.Ports = list
+	}
+	return network
+}
+
+// MarshalGeneratedPolicy returns network as the YAML of a config, under a comment saying how it
+// was learned.
+func MarshalGeneratedPolicy(network GeneratedNetwork, connections int) ([]byte, error) {
+	data, err := yaml.Marshal(struct {
+		Network GeneratedNetwork `yaml:"network"`
+	}{network})
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# The allow lists of %d learned connections. Review them, and run them in\n", connections)
+	fmt.Fprintln(&buf, "# mode: monitor before mode: block.")
+	buf.Write(data)
+	return buf.Bytes(), nil
+}
+
+// collapsePrefixes returns the prefixes without the ones inside another, and with the adjacent
+// halves of a prefix merged into it, e.g. 192.0.2.0/25 and 192.0.2.128/25 into 192.0.2.0/24.
+func collapsePrefixes(prefixes []*net.IPNet) []*net.IPNet {
+	collapsed := []*net.IPNet{}
+	for _, n := range prefixes {
+		collapsed = append(collapsed, config.Unmap(n))
+	}
+
+	for {
+		sort.Slice(collapsed, func(i, j int) bool { return comparePrefixes(collapsed[i], collapsed[j]) < 0 })
+		next := []*net.IPNet{}
+		merged := false
+		for _, n := range collapsed {
+			if len(next) == 0 {
+				next = append(next, n)
+				continue
+			}
+			last := next[len(next)-1]
+			if config.PrefixInside(n, last) {
+				merged = true
+				continue
+			}
+			if parent, ok := siblingParent(last, n); ok {
+				next[len(next)-1] = parent
+				merged = true
+				continue
+			}
+			next = append(next, n)
+		}
+		collapsed = next
+		if !merged {
+			return collapsed
+		}
+	}
+}
+
+// comparePrefixes orders the prefixes by family, address, then length, so that a prefix comes
+// before the prefixes inside it, and right before its sibling.
+func comparePrefixes(a, b *net.IPNet) int {
+	if len(a.IP) != len(b.IP) {
+		return len(a.IP) - len(b.IP)
+	}
+	if c := bytes.Compare(a.IP, b.IP); c != 0 {
+		return c
+	}
+	aOnes, _ := a.Mask.Size()
+	bOnes, _ := b.Mask.Size()
+	return aOnes - bOnes
+}
+
+// siblingParent returns the prefix a and b are the two halves of, if they are.
+func siblingParent(a, b *net.IPNet) (*net.IPNet, bool) {
+	ones, bits := a.Mask.Size()
+	bOnes, bBits := b.Mask.Size()
+	if ones == 0 || ones != bOnes || bits != bBits {
+		return nil, false
+	}
+	mask := net.CIDRMask(ones-1, bits)
+	if !a.IP.Mask(mask).Equal(b.IP.Mask(mask)) || a.IP.Equal(b.IP) {
+		return nil, false
+	}
+	return &net.IPNet{IP: a.IP.Mask(mask), Mask: mask}, true
+}
+
+func sortedSet(set map[string]bool) []string {
+	values := make([]string, 0, len(set))
+	for value := range set {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	return values
+}
+
+func sortedUints(set map[uint32]bool) []uint32 {
+	values := make([]uint32, 0, len(set))
+	for value := range set {
+		values = append(values, value)
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+	return values
+}
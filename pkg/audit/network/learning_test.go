@@ -0,0 +1,172 @@
+package network
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+func newTestLearningRecorder(t *testing.T, maxEntries int) (*learningRecorder, *time.Time) {
+	now := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	conf := config.DefaultConfig().RestrictedNetworkConfig.Learning
+	conf.StateDir = filepath.Join(t.TempDir(), "state")
+	conf.MaxEntries = maxEntries
+	r := newLearningRecorder(conf)
+	r.now = func() time.Time { return now }
+	return r, &now
+}
+
+func TestLearningRecorderAggregatesTheConnections(t *testing.T) {
+	r, now := newTestLearningRecorder(t, 100)
+
+	r.observe(blockedEvent(1000, "192.0.2.1", ACTION_MONITOR))
+	*now = now.Add(time.Minute)
+	r.observe(blockedEvent(1000, "192.0.2.200", ACTION_MONITOR))
+	r.add("curl", 1000, net.ParseIP("2001:db8:1:2:3::1"), "", 443)
+	r.add("curl", 1000, net.ParseIP("203.0.113.1"), "api.example.com.", 443)
+	r.add("curl", 0, net.ParseIP("203.0.113.1"), "api.example.com.", 443)
+
+	learned := r.snapshot()
+	assert.Equal(t, LEARNED_CONNECTIONS_VERSION, learned.Version)
+	assert.Equal(t, []LearnedConnection{
+		{Comm: "curl", UID: 1000, Destination: "192.0.2.0/24", Port: 443, Connections: 2, FirstSeen: now.Add(-time.Minute), LastSeen: *now},
+		{Comm: "curl", UID: 0, Destination: "203.0.113.0/24", Domain: "api.example.com", Port: 443, Connections: 1, FirstSeen: *now, LastSeen: *now},
+		{Comm: "curl", UID: 1000, Destination: "2001:db8:1:2::/64", Port: 443, Connections: 1, FirstSeen: *now, LastSeen: *now},
+		{Comm: "curl", UID: 1000, Destination: "203.0.113.0/24", Domain: "api.example.com", Port: 443, Connections: 1, FirstSeen: *now, LastSeen: *now},
+	}, learned.Connections)
+
+	// The prefix is configurable.
+	r.conf.V4Prefix = 16
+	r.add("curl", 1000, net.ParseIP("198.51.100.7"), "", 80)
+	assert.Contains(t, r.snapshot().Connections, LearnedConnection{Comm: "curl", UID: 1000, Destination: "198.51.0.0/16", Port: 80, Connections: 1, FirstSeen: *now, LastSeen: *now})
+}
+
+func TestLearnedConnectionsAreContinuedAndMerged(t *testing.T) {
+	r, now := newTestLearningRecorder(t, 100)
+	// Nothing is written before a connection is counted.
+	r.flush()
+	_, err := ReadLearnedConnections(LearnedConnectionsPath(r.conf.StateDir))
+	assert.True(t, os.IsNotExist(err))
+
+	r.add("curl", 1000, net.ParseIP("192.0.2.1"), "", 443)
+	r.flush()
+	info, err := os.Stat(LearnedConnectionsPath(r.conf.StateDir))
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// The next run continues the connections.
+	next, _ := newTestLearningRecorder(t, 100)
+	next.conf.StateDir = r.conf.StateDir
+	assert.Nil(t, next.load())
+	next.add("curl", 1000, net.ParseIP("192.0.2.2"), "", 443)
+	assert.Equal(t, uint64(2), next.snapshot().Connections[0].Connections)
+
+	// The files of several hosts are merged by tuple.
+	other := &LearnedConnections{Version: LEARNED_CONNECTIONS_VERSION, Connections: []LearnedConnection{
+		{Comm: "curl", UID: 1000, Destination: "192.0.2.0/24", Port: 443, Connections: 5, FirstSeen: now.Add(-time.Hour), LastSeen: now.Add(-time.Hour)},
+		{Comm: "wget", UID: 1000, Destination: "192.0.2.0/24", Port: 443, Connections: 1, FirstSeen: *now, LastSeen: *now},
+	}}
+	learned, err := ReadLearnedConnections(LearnedConnectionsPath(r.conf.StateDir))
+	assert.Nil(t, err)
+	merged := MergeLearnedConnections(learned, other)
+	assert.Equal(t, []LearnedConnection{
+		{Comm: "curl", UID: 1000, Destination: "192.0.2.0/24", Port: 443, Connections: 6, FirstSeen: now.Add(-time.Hour), LastSeen: *now},
+		{Comm: "wget", UID: 1000, Destination: "192.0.2.0/24", Port: 443, Connections: 1, FirstSeen: *now, LastSeen: *now},
+	}, merged)
+}
+
+func TestLearningRecorderForgetsTheLeastRecentlySeenWhenFull(t *testing.T) {
+	r, now := newTestLearningRecorder(t, 2)
+	evicted := learnedConnectionsEvicted.Value()
+
+	r.add("curl", 1000, net.ParseIP("10.0.1.1"), "", 443)
+	*now = now.Add(time.Second)
+	r.add("curl", 1000, net.ParseIP("10.0.2.1"), "", 443)
+	*now = now.Add(time.Second)
+	r.add("curl", 1000, net.ParseIP("10.0.3.1"), "", 443)
+
+	destinations := []string{}
+	for _, conn := range r.snapshot().Connections {
+		destinations = append(destinations, conn.Destination)
+	}
+	assert.ElementsMatch(t, []string{"10.0.2.0/24", "10.0.3.0/24"}, destinations)
+	assert.Equal(t, evicted+1, learnedConnectionsEvicted.Value())
+}
+
+func TestGeneratePolicy(t *testing.T) {
+	connections := []LearnedConnection{
+		{Comm: "curl", UID: 1000, Destination: "192.0.2.0/25", Port: 443, Connections: 10},
+		{Comm: "curl", UID: 1000, Destination: "192.0.2.128/25", Port: 443, Connections: 10},
+		{Comm: "curl", UID: 1000, Destination: "192.0.2.64/26", Port: 8443, Connections: 10},
+		{Comm: "git", UID: 1001, Destination: "203.0.113.0/24", Domain: "github.com", Port: 22, Connections: 10},
+		{Comm: "nc", UID: 0, Destination: "198.51.100.0/24", Port: 4444, Connections: 1},
+	}
+
+	network := GeneratePolicy(connections, 2)
+	assert.Equal(t, GeneratedNetwork{
+		Domain:  &GeneratedList{Allow: []string{"github.com"}},
+		CIDR:    GeneratedList{Allow: []string{"192.0.2.0/24"}},
+		Command: &GeneratedList{Allow: []string{"curl", "git"}},
+		UID:     &GeneratedList{Allow: []string{"1000", "1001"}},
+		Ports:   &GeneratedList{Allow: []string{"22", "443", "8443"}},
+	}, network)
+
+	// The section is a config, which allows the learned connections and nothing else.
+	data, err := MarshalGeneratedPolicy(network, len(connections))
+	assert.Nil(t, err)
+	conf, err := config.Parse(data)
+	assert.Nil(t, err)
+	conf.RestrictedNetworkConfig.Mode = "block"
+	resolver := &scriptedResolver{script: map[string][][]string{"github.com": {{"203.0.113.5"}}}}
+	for _, c := range []struct {
+		in   CheckInput
+		want string
+	}{
+		{CheckInput{Destination: "192.0.2.1", Port: 443, Protocol: config.PROTOCOL_TCP, UID: 1000, Command: "curl"}, CHECK_ALLOW},
+		{CheckInput{Destination: "github.com", Port: 22, Protocol: config.PROTOCOL_TCP, UID: 1001, Command: "git"}, CHECK_ALLOW},
+		{CheckInput{Destination: "198.51.100.1", Port: 443, Protocol: config.PROTOCOL_TCP, UID: 1000, Command: "curl"}, CHECK_BLOCK},
+		{CheckInput{Destination: "192.0.2.1", Port: 443, Protocol: config.PROTOCOL_TCP, UID: 0, Command: "nc"}, CHECK_BLOCK},
+	} {
+		results, err := Check(conf, resolver, c.in)
+		assert.Nil(t, err)
+		assert.Equal(t, c.want, results[0].Verdict, c.in.Destination)
+	}
+
+	var section map[string]interface{}
+	assert.Nil(t, yaml.Unmarshal(data, &section))
+	assert.Contains(t, section, "network")
+
+	// Without connections, the section still empties network.cidr.allow.
+	assert.Equal(t, GeneratedNetwork{CIDR: GeneratedList{Allow: []string{}}}, GeneratePolicy(nil, 1))
+}
+
+func TestCollapsePrefixes(t *testing.T) {
+	parse := func(cidrs ...string) []*net.IPNet {
+		prefixes := []*net.IPNet{}
+		for _, cidr := range cidrs {
+			_, n, err := net.ParseCIDR(cidr)
+			assert.Nil(t, err)
+			prefixes = append(prefixes, n)
+		}
+		return prefixes
+	}
+	strings := func(prefixes []*net.IPNet) []string {
+		s := []string{}
+		for _, n := range prefixes {
+			s = append(s, n.String())
+		}
+		return s
+	}
+
+	assert.Equal(t, []string{"10.0.0.0/22", "192.0.2.0/24", "2001:db8::/63"}, strings(collapsePrefixes(parse(
+		"10.0.0.0/24", "10.0.1.0/24", "10.0.2.0/24", "10.0.3.0/24", "10.0.1.0/25",
+		"192.0.2.0/24", "2001:db8::/64", "2001:db8:0:1::/64"))))
+	// Prefixes that are not the two halves of one are kept apart.
+	assert.Equal(t, []string{"10.0.1.0/24", "10.0.2.0/24"}, strings(collapsePrefixes(parse("10.0.2.0/24", "10.0.1.0/24"))))
+}
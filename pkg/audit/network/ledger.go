@@ -0,0 +1,319 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/mrtc0/bouheki/pkg/jobs"
+	log "github.com/mrtc0/bouheki/pkg/log"
+	"github.com/mrtc0/bouheki/pkg/metrics"
+)
+
+const (
+	// OUTSIDE_JOBS is the writer of the writes made while no job runs, e.g. by SetConfigToMap.
+	OUTSIDE_JOBS = "a writer outside the job queue"
+	// UNRECORDED_WRITER is the writer of a change the ledger has no write for, e.g. another
+	// process writing the maps.
+	UNRECORDED_WRITER = "an unrecorded writer"
+)
+
+var mapInvariantViolations = metrics.NewCounter("network_map_invariant_violations_total",
+	"Number of policy map keys a job did not leave in the state it wrote them in, which were written again.")
+
+// ledgerKey is a key of a policy map.
+type ledgerKey struct {
+	mapName string
+	key     string
+}
+
+// writeRecord is a write to a key: the job that made it, and the value it wrote, nil for a deletion.
+type writeRecord struct {
+	job   string
+	value []byte
+}
+
+// mutationBatch is the writes of a job: the state it left each key it touched in, and the write
+// each of them had before, by the order the job first touched them.
+type mutationBatch struct {
+	job      string
+	keys     []ledgerKey
+	expected map[ledgerKey]writeRecord
+	previous map[ledgerKey]writeRecord
+}
+
+// mapLedger records who wrote the keys of the policy maps. The jobs run one at a time, so the
+// writes made while a job runs are its batch; verifyBatch checks them once the job returns.
+type mapLedger struct {
+	mu sync.Mutex
+	// last is the last write of every key the maps have. A deleted key is forgotten.
+	last  map[ledgerKey]writeRecord
+	batch *mutationBatch
+	// violations is the number of keys verifyBatch has written again.
+	violations int
+}
+
+func (l *mapLedger) begin(job string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.batch = &mutationBatch{job: job, expected: map[ledgerKey]writeRecord{}, previous: map[ledgerKey]writeRecord{}}
+}
+
+func (l *mapLedger) end() *mutationBatch {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	batch := l.batch
+	l.batch = nil
+	return batch
+}
+
+// record records a successful write of key in mapName. A nil value deletes key.
+func (l *mapLedger) record(mapName string, key, value []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	id := ledgerKey{mapName: mapName, key: string(key)}
+	write := writeRecord{job: OUTSIDE_JOBS}
+	if value != nil {
+		write.value = append([]byte{}, value...)
+	}
+	if l.batch != nil {
+		write.job = l.batch.job
+		if _, ok := l.batch.expected[id]; !ok {
+			l.batch.keys = append(l.batch.keys, id)
+			l.batch.previous[id] = l.last[id]
+		}
+		l.batch.expected[id] = write
+	}
+
+	if l.last == nil {
+		l.last = map[ledgerKey]writeRecord{}
+	}
+	if write.value == nil {
+		delete(l.last, id)
+	} else {
+		l.last[id] = write
+	}
+}
+
+func (l *mapLedger) lastWriter(id ledgerKey) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.last[id].job
+}
+
+func (l *mapLedger) violated() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.violations++
+}
+
+// violationCount returns the number of keys the jobs did not leave as they wrote them.
+func (l *mapLedger) violationCount() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.violations
+}
+
+// recordedMap records the successful writes of a policy map in the ledger.
+type recordedMap struct {
+	table  policyMap
+	ledger *mapLedger
+	name   string
+}
+
+func (r recordedMap) Update(key, value []byte) error {
+	if err := r.table.Update(key, value); err != nil {
+		return err
+	}
+	r.ledger.record(r.name, key, value)
+	return nil
+}
+
+func (r recordedMap) DeleteKey(key []byte) error {
+	if err := r.table.DeleteKey(key); err != nil {
+		return err
+	}
+	r.ledger.record(r.name, key, nil)
+	return nil
+}
+
+// reader returns the map to read the keys back from, if the backend can.
+func (r recordedMap) reader() (mapReader, bool) {
+	reader, ok := r.table.(mapReader)
+	return reader, ok
+}
+
+// mutate runs fn as the batch of the job name, and verifies the batch once fn returns, whether
+// or not it failed: the writes it made before failing are in the maps.
+func (m *Manager) mutate(ctx context.Context, name string, fn jobs.Func) error {
+	m.ledger.begin(name)
+	err := fn(ctx)
+	m.verifyBatch(m.ledger.end())
+	return err
+}
+
+// verifyBatch reads back the keys batch wrote, and writes again the ones it did not leave as
+// they must be: a key another writer changed since, or one the batch deleted although the config,
+// a rule set, the self exemption, a runtime rule or live resolution still has it. The keys an LPM
+// trie no longer has can not be told from the ones a prefix covers, so only the keys it has are
+// read back.
+func (m *Manager) verifyBatch(batch *mutationBatch) {
+	repairs := []mapOp{}
+	for _, id := range batch.keys {
+		want := batch.expected[id]
+		key := []byte(id.key)
+
+		if want.value == nil {
+			if holder, ok := m.holder(id.mapName, key); ok {
+				before := batch.previous[id]
+				if before.value == nil {
+					before.value = entryValue()
+				}
+				m.violation(batch.job, fmt.Sprintf("%s (%s)", writerName(before.job), holder), id, before.value, nil)
+				repairs = append(repairs, mapOp{mapName: id.mapName, key: key, value: before.value})
+				continue
+			}
+		}
+
+		table, err := m.policyMap(id.mapName)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		reader, ok := table.(recordedMap).reader()
+		if !ok {
+			continue
+		}
+		value, found, err := reader.Lookup(key)
+		if err != nil {
+			log.Error(fmt.Errorf("failed to verify %s in %s after job %q: %w", describeKey(id.mapName, key), id.mapName, batch.job, err))
+			continue
+		}
+		if !found {
+			value = nil
+		}
+
+		if want.value == nil && found && lpmMap(id.mapName) {
+			continue
+		}
+		if (want.value == nil) != (value == nil) || !bytes.Equal(value, want.value) {
+			m.violation(batch.job, m.otherWriter(batch.job, id), id, want.value, value)
+			repairs = append(repairs, mapOp{mapName: id.mapName, key: key, value: want.value})
+		}
+	}
+	if len(repairs) == 0 {
+		return
+	}
+
+	m.ledger.begin(batch.job)
+	defer m.ledger.end()
+	for _, op := range repairs {
+		table, err := m.policyMap(op.mapName)
+		if err == nil && op.isDelete() {
+			err = table.DeleteKey(op.key)
+		} else if err == nil {
+			err = table.Update(op.key, op.value)
+		}
+		if err != nil {
+			log.Error(fmt.Errorf("failed to write %s to %s again: %w", describeKey(op.mapName, op.key), op.mapName, err))
+			continue
+		}
+		m.mirror(op)
+	}
+}
+
+// otherWriter returns the writer of a change to id after job, as far as the ledger knows: the
+// writes made while job runs are its own.
+func (m *Manager) otherWriter(job string, id ledgerKey) string {
+	if writer := m.ledger.lastWriter(id); writer != job {
+		return writerName(writer)
+	}
+	return UNRECORDED_WRITER
+}
+
+// writerName returns the writer of a write as the logs show it: the quoted name of its job.
+func writerName(job string) string {
+	switch job {
+	case "":
+		return UNRECORDED_WRITER
+	case OUTSIDE_JOBS, UNRECORDED_WRITER:
+		return job
+	}
+	return strconv.Quote(job)
+}
+
+// violation logs that job did not leave id with the value expected, because of writer.
+func (m *Manager) violation(job, writer string, id ledgerKey, expected, found []byte) {
+	m.ledger.violated()
+	mapInvariantViolations.Inc()
+	(&log.MapInvariantLog{
+		Job:      job,
+		Writer:   writer,
+		Map:      id.mapName,
+		Key:      describeKey(id.mapName, []byte(id.key)),
+		Expected: describeValue(expected),
+		Found:    describeValue(found),
+	}).Error()
+}
+
+func describeValue(value []byte) string {
+	if value == nil {
+		return "deleted"
+	}
+	return fmt.Sprintf("%x", value)
+}
+
+// holder returns what, besides the writer that deleted it, still has key in mapName.
+func (m *Manager) holder(mapName string, key []byte) (string, bool) {
+	switch {
+	case m.configured(mapName, key):
+		return "the config", true
+	case m.inRuleSet(mapName, key, nil):
+		return "a rule set", true
+	case m.selfExempted(mapName, key):
+		return "the self exemption", true
+	case m.runtimeRule(mapName, key):
+		return "a runtime rule", true
+	case m.resolvedAddress(mapName, key):
+		return "live resolution", true
+	case m.wildcardAddress(mapName, key):
+		return "a wildcard domain", true
+	}
+	return "", false
+}
+
+// lpmMap reports whether mapName is an LPM trie.
+func lpmMap(mapName string) bool {
+	if _, ok := denyShardBase(mapName); ok {
+		return true
+	}
+	for _, sized := range sizedMaps {
+		if sized.name == mapName {
+			return sized.lpm
+		}
+	}
+	return false
+}
+
+// describeKey returns key as the logs show it: the CIDR of a key of the CIDR lists.
+func describeKey(mapName string, key []byte) string {
+	base := mapName
+	if shardBase, ok := denyShardBase(mapName); ok {
+		base = shardBase
+	}
+	switch base {
+	case ALLOWED_V4_CIDR_LIST_MAP_NAME, ALLOWED_V6_CIDR_LIST_MAP_NAME, DENIED_V4_CIDR_LIST_MAP_NAME, DENIED_V6_CIDR_LIST_MAP_NAME:
+		return keyToIPNet(key).String()
+	}
+	if isIngressCIDRList(base) {
+		return keyToIPNet(key).String()
+	}
+	if isProtocolCIDRList(base) {
+		_, n := protocolKeyToIPNet(key)
+		return n.String()
+	}
+	return fmt.Sprintf("%x", key)
+}
@@ -0,0 +1,207 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/bouhekitest"
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/freeze"
+	log "github.com/mrtc0/bouheki/pkg/log"
+	"github.com/mrtc0/bouheki/pkg/reload"
+	"github.com/stretchr/testify/assert"
+)
+
+func ledgerTestConfig(deny ...string) *config.Config {
+	conf := stateTestConfig()
+	conf.RestrictedNetworkConfig.Domain.Allow = []string{"app.example"}
+	conf.RestrictedNetworkConfig.Domain.Deny = []string{"blocked.example"}
+	conf.RestrictedNetworkConfig.CIDR.Deny = append([]string{"192.168.1.1/32"}, deny...)
+	return conf
+}
+
+func newLedgerTestManager(t *testing.T, conf *config.Config) (*Manager, *bouhekitest.Maps) {
+	maps := bouhekitest.NewMaps()
+	mgr, err := NewManager(conf, WithMapBackend(maps), WithDNSResolver(&FakeDNSResolver{}))
+	assert.Nil(t, err)
+	assert.Nil(t, mgr.SetConfigToMap())
+	t.Cleanup(mgr.Jobs().Stop)
+	return mgr, maps
+}
+
+// resolve writes the addresses of domain as the DNS refresh does.
+func resolve(t *testing.T, mgr *Manager, list, domain string, addresses ...string) {
+	answer := &DNSAnswer{Domain: domain}
+	for _, addr := range addresses {
+		answer.Addresses = append(answer.Addresses, net.ParseIP(addr))
+	}
+	v4MapName, v6MapName := ALLOWED_V4_CIDR_LIST_MAP_NAME, ALLOWED_V6_CIDR_LIST_MAP_NAME
+	if list == SNAPSHOT_LIST_DENY {
+		v4MapName, v6MapName = DENIED_V4_CIDR_LIST_MAP_NAME, DENIED_V6_CIDR_LIST_MAP_NAME
+	}
+	assert.Nil(t, mgr.runJob("dns-refresh "+domain, freeze.CHANGE_DNS_REFRESH, func(ctx context.Context) error {
+		return mgr.updateFQDNList(answer, list, v4MapName, v6MapName)
+	}))
+}
+
+func captureLog(t *testing.T) func() string {
+	output := filepath.Join(t.TempDir(), "bouheki.log")
+	log.SetFormatter("json")
+	log.SetOutput(output)
+	t.Cleanup(func() { log.SetOutput("stdout") })
+	return func() string {
+		data, err := ioutil.ReadFile(output)
+		assert.Nil(t, err)
+		return string(data)
+	}
+}
+
+func TestReloadKeepsTheResolvedAddresses(t *testing.T) {
+	mgr, maps := newLedgerTestManager(t, ledgerTestConfig("192.0.2.1/32"))
+	coordinator := reload.NewCoordinator(nil)
+	coordinator.Register(RELOAD_MODULE, mgr)
+
+	// blocked.example resolves to an address the config denies too, which the reload drops.
+	resolve(t, mgr, SNAPSHOT_LIST_DENY, "blocked.example", "192.0.2.1")
+	report := coordinator.Reload(ledgerTestConfig())
+	assert.True(t, report.Applied, report.String())
+
+	assert.True(t, maps.Has(DENIED_V4_CIDR_LIST_MAP_NAME, cidrKey(t, "192.0.2.1/32")))
+	assert.True(t, mgr.Policy().hasCIDR(DENIED_V4_CIDR_LIST_MAP_NAME, PROTOCOL_ALL, keyToIPNet(cidrKey(t, "192.0.2.1/32"))))
+	assert.Equal(t, 0, mgr.ledger.violationCount())
+}
+
+func TestVerifyBatchWritesAgainWhatTheJobDidNotLeave(t *testing.T) {
+	t.Run("a key another writer changed", func(t *testing.T) {
+		mgr, maps := newLedgerTestManager(t, ledgerTestConfig())
+		logs := captureLog(t)
+
+		// A writer the ledger does not know deletes the first address while the job writes the second.
+		first, second := cidrKey(t, "192.0.2.1/32"), cidrKey(t, "192.0.2.2/32")
+		var once sync.Once
+		maps.OnWrite(func(w bouhekitest.Write) {
+			if string(w.Key) == string(second) {
+				once.Do(func() { assert.Nil(t, maps.Delete(DENIED_V4_CIDR_LIST_MAP_NAME, first)) })
+			}
+		})
+		resolve(t, mgr, SNAPSHOT_LIST_DENY, "blocked.example", "192.0.2.1", "192.0.2.2")
+
+		assert.True(t, maps.Has(DENIED_V4_CIDR_LIST_MAP_NAME, first))
+		assert.True(t, maps.Has(DENIED_V4_CIDR_LIST_MAP_NAME, second))
+		assert.Equal(t, 1, mgr.ledger.violationCount())
+		assert.Contains(t, logs(), `"Expected":"00","Found":"deleted","Job":"dns-refresh blocked.example","Key":"192.0.2.1/32","Map":"denied_v4_cidr_list","Writer":"an unrecorded writer"`)
+	})
+
+	t.Run("a key the job deleted that another writer still has", func(t *testing.T) {
+		mgr, maps := newLedgerTestManager(t, ledgerTestConfig())
+		logs := captureLog(t)
+		resolve(t, mgr, SNAPSHOT_LIST_DENY, "blocked.example", "192.0.2.1")
+
+		// A job that ignores who else has the key deletes it.
+		key := cidrKey(t, "192.0.2.1/32")
+		assert.Nil(t, mgr.runJob("manual", freeze.CHANGE_CONFIG_RELOAD, func(ctx context.Context) error {
+			table, err := mgr.policyMap(DENIED_V4_CIDR_LIST_MAP_NAME)
+			assert.Nil(t, err)
+			if err := table.DeleteKey(key); err != nil {
+				return err
+			}
+			mgr.mirror(mapOp{mapName: DENIED_V4_CIDR_LIST_MAP_NAME, key: key})
+			return nil
+		}))
+
+		assert.True(t, maps.Has(DENIED_V4_CIDR_LIST_MAP_NAME, key))
+		assert.True(t, mgr.Policy().hasCIDR(DENIED_V4_CIDR_LIST_MAP_NAME, PROTOCOL_ALL, keyToIPNet(cidrKey(t, "192.0.2.1/32"))))
+		assert.Equal(t, 1, mgr.ledger.violationCount())
+		assert.Contains(t, logs(), `"Job":"manual","Key":"192.0.2.1/32","Map":"denied_v4_cidr_list","Writer":"\"dns-refresh blocked.example\" (live resolution)"`)
+	})
+}
+
+// TestConcurrentJobsConvergeOnTheDesiredState runs the DNS refresh, the reloads, the expiry of
+// the preloaded addresses and the self exemption at once, and checks the maps end up with what
+// the config, the resolved addresses and the endpoints make, whatever order the jobs ran in.
+// Run it with -race.
+func TestConcurrentJobsConvergeOnTheDesiredState(t *testing.T) {
+	iterations := 2000
+	if testing.Short() {
+		iterations = 200
+	}
+	configs := []*config.Config{
+		ledgerTestConfig("192.0.2.1/32", "192.0.2.2/32"),
+		ledgerTestConfig("192.0.2.3/32", "192.0.2.20/32"),
+	}
+	configs[0].RestrictedNetworkConfig.CIDR.Allow = append(configs[0].RestrictedNetworkConfig.CIDR.Allow, "198.51.100.1/32")
+	mgr, maps := newLedgerTestManager(t, configs[0])
+	coordinator := reload.NewCoordinator(nil)
+	coordinator.Register(RELOAD_MODULE, mgr)
+	captureLog(t)
+
+	var wg sync.WaitGroup
+	run := func(fn func(i int)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				fn(i)
+			}
+		}()
+	}
+	run(func(i int) {
+		resolve(t, mgr, SNAPSHOT_LIST_DENY, "blocked.example", fmt.Sprintf("192.0.2.%d", i%8))
+		resolve(t, mgr, SNAPSHOT_LIST_ALLOW, "app.example", fmt.Sprintf("198.51.100.%d", i%8))
+	})
+	run(func(i int) {
+		report := coordinator.Reload(configs[i%2])
+		assert.True(t, report.Applied, report.String())
+	})
+	run(func(i int) {
+		addr, err := cidrToBPFMapKey(fmt.Sprintf("198.51.100.%d/32", 8+i%8))
+		assert.Nil(t, err)
+		assert.Nil(t, mgr.runJob("preload", freeze.CHANGE_DNS_REFRESH, func(ctx context.Context) error {
+			if !mgr.preload.add(preloadedEntry{domain: "app.example", mapName: ALLOWED_V4_CIDR_LIST_MAP_NAME, key: addr.key, expiresAt: mgr.now()}) {
+				return nil
+			}
+			return mgr.writeCIDR(addr, ALLOWED_V4_CIDR_LIST_MAP_NAME)
+		}))
+		assert.Nil(t, mgr.runJob("preload-expire", freeze.CHANGE_DNS_REFRESH, func(ctx context.Context) error {
+			mgr.removeExpiredPreloaded(mgr.now())
+			return nil
+		}))
+	})
+	run(func(i int) {
+		assert.Nil(t, mgr.SetSelfEndpoints("manual", []string{fmt.Sprintf("198.51.100.%d", i%4), "192.0.2.1"}))
+	})
+	wg.Wait()
+
+	final := configs[0]
+	report := coordinator.Reload(final)
+	assert.True(t, report.Applied, report.String())
+	assert.Nil(t, mgr.SetSelfEndpoints("manual", []string{"198.51.100.30"}))
+	assert.Nil(t, mgr.runJob("preload-expire", freeze.CHANGE_DNS_REFRESH, func(ctx context.Context) error {
+		mgr.removeExpiredPreloaded(mgr.now().Add(time.Hour))
+		return nil
+	}))
+
+	// The maps of the final config, with the addresses the domains last resolved to and the endpoint.
+	desired := bouhekitest.NewMaps()
+	model, err := NewManager(final, WithMapBackend(desired), WithDNSResolver(&FakeDNSResolver{}))
+	assert.Nil(t, err)
+	assert.Nil(t, model.SetConfigToMap())
+	last := (iterations - 1) % 8
+	assert.Nil(t, desired.Update(DENIED_V4_CIDR_LIST_MAP_NAME, cidrKey(t, fmt.Sprintf("192.0.2.%d/32", last)), entryValue()))
+	assert.Nil(t, desired.Update(ALLOWED_V4_CIDR_LIST_MAP_NAME, cidrKey(t, fmt.Sprintf("198.51.100.%d/32", last)), entryValue()))
+	assert.Nil(t, desired.Update(ALLOWED_V4_CIDR_LIST_MAP_NAME, cidrKey(t, "198.51.100.30/32"), entryValue()))
+
+	for _, mapName := range policyMapOrder {
+		assert.Equal(t, desired.Entries(mapName), maps.Entries(mapName), mapName)
+	}
+	for key := range desired.Entries(DENIED_V4_CIDR_LIST_MAP_NAME) {
+		assert.True(t, mgr.Policy().hasCIDR(DENIED_V4_CIDR_LIST_MAP_NAME, PROTOCOL_ALL, keyToIPNet([]byte(key))))
+	}
+	assert.Equal(t, 0, mgr.ledger.violationCount())
+}
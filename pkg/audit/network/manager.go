@@ -1,24 +1,40 @@
 package network
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
+	"sort"
 	"sync"
-	"unsafe"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/aquasecurity/libbpfgo"
 	"github.com/miekg/dns"
+	"github.com/mrtc0/bouheki/pkg/classify"
+	"github.com/mrtc0/bouheki/pkg/clock"
 	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/freeze"
+	"github.com/mrtc0/bouheki/pkg/jobs"
 	log "github.com/mrtc0/bouheki/pkg/log"
+	"github.com/mrtc0/bouheki/pkg/metrics"
+	"github.com/mrtc0/bouheki/pkg/notify"
+	"github.com/mrtc0/bouheki/pkg/policy"
+	"github.com/mrtc0/bouheki/pkg/timing"
+	"github.com/mrtc0/bouheki/pkg/utils"
 )
 
 const (
-	MODE_MONITOR uint32 = 0
-	MODE_BLOCK   uint32 = 1
+	MODE_MONITOR = policy.MODE_MONITOR
+	MODE_BLOCK   = policy.MODE_BLOCK
 
-	TARGET_HOST      uint32 = 0
-	TAREGT_CONTAINER uint32 = 1
+	TARGET_HOST      = policy.TARGET_HOST
+	TAREGT_CONTAINER = policy.TARGET_CONTAINER
+	TARGET_ALL       = policy.TARGET_ALL
 
 	// BPF Map Names
 	RESTRICT_NETWORK_CONFIG_MAP_NAME = "network_bouheki_config_map"
@@ -28,10 +44,44 @@ const (
 	DENIED_V6_CIDR_LIST_MAP_NAME     = "denied_v6_cidr_list"
 	ALLOWED_UID_LIST_MAP_NAME        = "allowed_uid_list"
 	DENIED_UID_LIST_MAP_NAME         = "denied_uid_list"
+	ALLOWED_UID_RANGE_LIST_MAP_NAME  = "allowed_uid_range_list"
+	DENIED_UID_RANGE_LIST_MAP_NAME   = "denied_uid_range_list"
 	ALLOWED_GID_LIST_MAP_NAME        = "allowed_gid_list"
 	DENIED_GID_LIST_MAP_NAME         = "denied_gid_list"
 	ALLOWED_COMMAND_LIST_MAP_NAME    = "allowed_command_list"
 	DENIED_COMMAND_LIST_MAP_NAME     = "denied_command_list"
+	CONTAINER_CGROUP_LIST_MAP_NAME   = "container_cgroup_list"
+	ALLOWED_PORT_LIST_MAP_NAME       = "allowed_port_list"
+	DENIED_PORT_LIST_MAP_NAME        = "denied_port_list"
+	// The protocol lists are keyed by the socket type, TCP or UDP, followed by the address.
+	ALLOWED_V4_PROTOCOL_CIDR_LIST_MAP_NAME = "allowed_v4_protocol_cidr_list"
+	ALLOWED_V6_PROTOCOL_CIDR_LIST_MAP_NAME = "allowed_v6_protocol_cidr_list"
+	DENIED_V4_PROTOCOL_CIDR_LIST_MAP_NAME  = "denied_v4_protocol_cidr_list"
+	DENIED_V6_PROTOCOL_CIDR_LIST_MAP_NAME  = "denied_v6_protocol_cidr_list"
+	// The lists of network.ingress, which the local address and port of a bind are looked up in.
+	INGRESS_ALLOWED_V4_CIDR_LIST_MAP_NAME = "ingress_allowed_v4_cidr_list"
+	INGRESS_ALLOWED_V6_CIDR_LIST_MAP_NAME = "ingress_allowed_v6_cidr_list"
+	INGRESS_DENIED_V4_CIDR_LIST_MAP_NAME  = "ingress_denied_v4_cidr_list"
+	INGRESS_DENIED_V6_CIDR_LIST_MAP_NAME  = "ingress_denied_v6_cidr_list"
+	INGRESS_ALLOWED_PORT_LIST_MAP_NAME    = "ingress_allowed_port_list"
+	INGRESS_DENIED_PORT_LIST_MAP_NAME     = "ingress_denied_port_list"
+	// The lists of network.command.allow_paths and deny_paths, keyed by a path, see pathToKey.
+	ALLOWED_PATH_LIST_MAP_NAME = "allowed_path_list"
+	DENIED_PATH_LIST_MAP_NAME  = "denied_path_list"
+	// The patterns of network.command.allow and deny, keyed by their index, see commandPatternValue.
+	ALLOWED_COMMAND_PATTERN_LIST_MAP_NAME = "allowed_command_pattern_list"
+	DENIED_COMMAND_PATTERN_LIST_MAP_NAME  = "denied_command_pattern_list"
+	// The selectors of network.policies, which map a command, a uid or a gid to the mask of the
+	// entries that list it, see policy.PolicyEntries.
+	POLICY_ENTRY_COMMAND_LIST_MAP_NAME = "policy_entry_command_list"
+	POLICY_ENTRY_UID_LIST_MAP_NAME     = "policy_entry_uid_list"
+	POLICY_ENTRY_GID_LIST_MAP_NAME     = "policy_entry_gid_list"
+	// The CIDR lists of network.policies are keyed as the protocol lists, with the tag of the
+	// entry, see policy.EntryTag, in place of the socket type.
+	ALLOWED_V4_ENTRY_CIDR_LIST_MAP_NAME = "allowed_v4_entry_cidr_list"
+	ALLOWED_V6_ENTRY_CIDR_LIST_MAP_NAME = "allowed_v6_entry_cidr_list"
+	DENIED_V4_ENTRY_CIDR_LIST_MAP_NAME  = "denied_v4_entry_cidr_list"
+	DENIED_V6_ENTRY_CIDR_LIST_MAP_NAME  = "denied_v6_entry_cidr_list"
 
 	/*
 	   +---------------+---------------+-------------------+-------------------+-------------------+
@@ -39,46 +89,277 @@ const (
 	   +---------------+---------------+-------------------+-------------------+-------------------+
 	   |      MODE     |     TARGET    | Allow Command Size|  Allow UID Size   | Allow GID Size    |
 	   +---------------+---------------+-------------------+-------------------+-------------------+
+
+	   followed by the case insensitivity, the classification, the quiesced flag, the sizes of
+	   the deny lists, the audit disabled flag, the number of deny shards, the sizes of the port
+	   lists, the sizes of the allow lists and of the denied ports of network.ingress, and the
+	   families network.families leaves out with whether their connections are audited,
+	   whether the matches of the rules are recorded, the sizes of the path lists, the
+	   numbers of patterns of the command lists, the number of entries of network.policies
+	   with their masks, the default action and the precedence of network.policy, and the
+	   interval the connections of a task to a destination are reported at, the masks of
+	   network.host and network.container among the entries, and the layout version. A list of
+	   size 0 does not restrict, whether it is absent from the config or empty.
 	*/
 
-	MAP_SIZE                = 20
-	MAP_MODE_START          = 0
-	MAP_MODE_END            = 4
-	MAP_TARGET_START        = 4
-	MAP_TARGET_END          = 8
-	MAP_ALLOW_COMMAND_INDEX = 8
-	MAP_ALLOW_UID_INDEX     = 12
-	MAP_ALLOW_GID_INDEX     = 16
+	MAP_SIZE                           = 176
+	MAP_MODE_START                     = 0
+	MAP_MODE_END                       = 4
+	MAP_TARGET_START                   = 4
+	MAP_TARGET_END                     = 8
+	MAP_ALLOW_COMMAND_INDEX            = 8
+	MAP_ALLOW_UID_INDEX                = 12
+	MAP_ALLOW_GID_INDEX                = 16
+	MAP_COMMAND_CASE_INSENSITIVE_INDEX = 20
+	MAP_CLASSIFICATION_INDEX           = 24
+	MAP_QUIESCED_INDEX                 = 28
+	MAP_DENY_COMMAND_INDEX             = 32
+	MAP_DENY_UID_INDEX                 = 36
+	MAP_DENY_GID_INDEX                 = 40
+	MAP_AUDIT_DISABLED_INDEX           = 44
+	MAP_DENY_SHARDS_INDEX              = 48
+	MAP_ALLOW_PORT_INDEX               = 52
+	MAP_DENY_PORT_INDEX                = 56
+	MAP_INGRESS_ALLOW_CIDR_INDEX       = 60
+	MAP_INGRESS_ALLOW_PORT_INDEX       = 64
+	MAP_INGRESS_DENY_PORT_INDEX        = 68
+	MAP_DISABLED_FAMILIES_INDEX        = 72
+	MAP_OTHER_FAMILIES_AUDIT_INDEX     = 76
+	MAP_RULE_HITS_INDEX                = 80
+	MAP_ALLOW_PATH_INDEX               = 84
+	MAP_DENY_PATH_INDEX                = 88
+	MAP_ALLOW_COMMAND_PATTERN_INDEX    = 92
+	MAP_DENY_COMMAND_PATTERN_INDEX     = 96
+	MAP_POLICY_ENTRIES_INDEX           = 100
+	// The masks are 64-bit, the first one aligned.
+	MAP_POLICY_ENTRY_ANY_COMMAND_INDEX = 104
+	MAP_POLICY_ENTRY_ANY_UID_INDEX     = 112
+	MAP_POLICY_ENTRY_ANY_GID_INDEX     = 120
+	MAP_POLICY_ENTRY_HAS_ALLOW_INDEX   = 128
+	MAP_DEFAULT_ACTION_INDEX           = 136
+	MAP_PRECEDENCE_INDEX               = 140
+	MAP_REPORT_INTERVAL_INDEX          = 144
+	MAP_POLICY_ENTRY_HOST_INDEX        = 152
+	MAP_POLICY_ENTRY_CONTAINER_INDEX   = 160
+	MAP_LAYOUT_VERSION_INDEX           = 168
+
+	// CONFIG_MAP_LAYOUT_VERSION is the version of the layout above, written at
+	// MAP_LAYOUT_VERSION_INDEX. It is raised whenever a field moves or changes meaning, so that
+	// the maps pinned by a bouheki with another layout are not adopted.
+	CONFIG_MAP_LAYOUT_VERSION = 1
+
+	// COMMAND_PATTERN_VALUE_SIZE is the size of struct command_pattern.
+	COMMAND_PATTERN_VALUE_SIZE = 4 + 4 + TASK_COMM_LEN + TASK_COMM_LEN
+
+	// PORT_KEY_BITS is the number of bits of a port a key of the port lists can prefix.
+	PORT_KEY_BITS = policy.PORT_KEY_BITS
+	// PROTOCOL_KEY_BITS is the prefix the socket type takes in a key of the protocol lists.
+	PROTOCOL_KEY_BITS = 8
+)
+
+// enum classification of the BPF program.
+const (
+	CLASSIFICATION_MOUNT_NAMESPACE uint32 = 0
+	CLASSIFICATION_PID_NAMESPACE   uint32 = 1
+	CLASSIFICATION_CGROUP          uint32 = 2
+
+	// CGROUP_RESCAN_INTERVAL is how often the cgroups are walked for new containers,
+	// when network.classification uses cgroups.
+	CGROUP_RESCAN_INTERVAL = 5 * time.Second
+)
+
+// managerState is the lifecycle of a Manager.
+// A Manager moves created -> started -> stopping -> stopped and never goes back.
+type managerState int
+
+const (
+	stateCreated managerState = iota
+	stateStarted
+	stateStopping
+	stateStopped
+)
+
+const (
+	ENFORCEMENT_LSM            = "lsm"
+	ENFORCEMENT_KPROBE_MONITOR = "monitor-only fallback"
+	ENFORCEMENT_KPROBE_SIGNAL  = "signal fallback"
+
+	// ENOTSUPP is a kernel internal errno that some BPF syscalls return to userspace.
+	ENOTSUPP = syscall.Errno(524)
+)
+
+var enforcementFallback = metrics.NewGauge("network_enforcement_fallback", "Whether the network restriction runs on the kprobe fallback instead of the BPF LSM.")
+
+var (
+	ErrManagerClosed       = errors.New("network manager is already closed")
+	ErrEventsChannelClosed = errors.New("events channel is already closed")
+	ErrInvalidMapKey       = errors.New("invalid CIDR map key")
+	// ErrNoProgram is returned by what needs the BPF programs, which a Manager with a MapBackend does not load.
+	ErrNoProgram = errors.New("the BPF programs are not loaded")
 )
 
+// ringBuffer is the subset of *libbpfgo.RingBuffer used by the Manager.
+type ringBuffer interface {
+	Start()
+	Stop()
+	Close()
+}
+
 type Manager struct {
-	mod         *libbpfgo.Module
-	config      *config.Config
-	rb          *libbpfgo.RingBuffer
+	mod    *libbpfgo.Module
+	config *config.Config
+	// configMu guards config, which a reload replaces, against the readers outside of the jobs.
+	// The jobs read config without it, since only the jobs replace it.
+	configMu sync.RWMutex
+	// ownsModule is set when NewManager loaded mod, which Close then closes.
+	ownsModule bool
+	// hook is the hook loaded by setupBPFProgram.
+	hook string
+	// operations are the operations the programs are loaded and attached for, see restrictedOperations.
+	operations []string
+	// ancestors is set when the loaded programs match the ancestors of the current cgroup,
+	// so that only the topmost classified cgroups are written to CONTAINER_CGROUP_LIST_MAP_NAME.
+	// Otherwise the cgroups created below them are watched and written as they are created.
+	ancestors   bool
+	enforcement string
+	// links are the links of the programs attached by Attach. libbpfgo destroys them when mod is
+	// closed, which detaches the programs unless their links are pinned, see pinLink.
+	links       []*libbpfgo.BPFLink
+	rb          ringBuffer
 	dnsResolver DNSResolver
 	dnsCache    map[string]string
+
+	mu       sync.Mutex
+	state    managerState
+	events   chan []byte
+	released map[chan []byte]struct{}
+	// reported is the number of events the consumer has acknowledged with Ack. Accessed atomically.
+	reported uint64
+
+	policyOnce sync.Once
+	policy     *Policy
+	preload    preloadTracker
+
+	// jobs serializes every mutation of the maps after SetConfigToMap.
+	jobsOnce sync.Once
+	jobs     *jobs.Queue
+	// freeze rejects the jobs that run during a freeze window. nil allows every job.
+	freeze *freeze.Guard
+	// ruleSets are the bulk lists of network.rule_sets, written by their own jobs.
+	ruleSets []*ruleSet
+	// stopRuleSets stops the refreshes AsyncRuleSets started, and ruleSetsRunning waits for them.
+	stopRuleSets    context.CancelFunc
+	ruleSetsRunning sync.WaitGroup
+	// quiesced stops the programs from emitting events while Drain reads the ring buffer.
+	quiesced bool
+	// auditDisabled stops the programs from emitting events at all, see network.audit.enabled.
+	auditDisabled bool
+	// forced forces the programs into monitor mode whatever network.mode, see SetForceMonitor.
+	forced *forcedMonitor
+	// loaded is what applyState has written to the maps. unclaimed are the entries of the adopted
+	// maps that no owner had at startup, which sweepUnclaimed deletes once the owners repopulated.
+	loadedMu  sync.Mutex
+	loaded    mapState
+	unclaimed mapState
+	// resolved are the addresses live resolution has written, which the config, the rule sets
+	// and the self exemption leave in the maps when they drop them.
+	resolvedMu sync.Mutex
+	resolved   domainCache
+	// wildcards are the addresses the DNS proxy relayed for the wildcard domains.
+	wildcards wildcardTracker
+	// ledger records who wrote the keys of the policy maps, see verifyBatch.
+	ledger mapLedger
+	// readEventStats overrides how the event counters of the programs are read. Used by tests.
+	readEventStats func() (eventStats, error)
+	// initRingBuf overrides how the ring buffer is created. Used by tests.
+	initRingBuf func(eventsChannel chan []byte) (ringBuffer, error)
+	// backend replaces the maps of mod, see WithMapBackend.
+	backend MapBackend
+	// clock is the time of the timers, see WithClock.
+	clock clock.Clock
+	// cgroupRoot overrides classify.CGROUP_ROOT. Used by tests.
+	cgroupRoot string
+	// watcher reports the cgroups created below the classified ones, unless ancestors is set.
+	watcher *classify.Watcher
+	// missingCgroups are the cgroups of network.classification.cgroups that did not exist at the
+	// last scan, see reportMissingCgroups.
+	missingCgroups map[string]bool
+	// self allows the endpoints bouheki itself connects to.
+	self selfExemption
+	// runtime are the rules added on the control socket.
+	runtime runtimeRules
+	// taskMaps are the per-task maps whose entries are deleted when their task exits.
+	taskMaps taskMapRegistry
+	// procRoot overrides PROC_ROOT. Used by tests.
+	procRoot string
+	// exeTracked is set once task_exec records the executables the tasks run.
+	exeTracked bool
+	// dnsRefresh schedules the resolutions of the domains once AsyncResolve is called.
+	dnsRefresh *dnsScheduler
+	// unresolved are the domains that do not resolve, retried by the dnsRefresh.
+	unresolved unresolvedDomains
+	// startupTTLs are the TTLs of the records SetConfigToMap resolved, when the dnsRefresh
+	// first refreshes them.
+	startupTTLs recordTTLs
+
+	// policyDigest caches the digest of the policy for the events, see PolicyDigest.
+	digestMu         sync.Mutex
+	digestGeneration uint64
+	policyDigest     atomic.Value
+	// rules indexes the rules the events are described by, see ruleTable. resolvedChanges counts
+	// the changes of resolved and wildcards, which the policy generation does not tell. Accessed
+	// atomically.
+	rulesMu         sync.Mutex
+	rules           *ruleHitIndex
+	rulesGeneration uint64
+	rulesResolved   uint64
+	resolvedChanges uint64
+	// versions saves the policies the events are decided by. nil saves none.
+	versions *policyVersions
+	// healer resolves the allowed domains whose new addresses are blocked. nil heals none.
+	healer *dnsHealer
+	// ruleHits records the hits of the rules. nil records none.
+	ruleHits *ruleHitRecorder
+	// startup times the phases of the startup, see withStartupTimer. nil times none.
+	startup *timing.Timer
 }
 
 type IPAddress struct {
 	address  net.IP
 	cidrMask net.IPMask
+	// protocol is the socket type of a rule of the protocol lists, PROTOCOL_ALL for the others.
+	protocol uint8
 	key      []byte
+	// zone is the IPv6 zone (e.g. "eth0" in "fe80::1%eth0/64") the entry was written with.
+	// Map keys can not carry a zone, so it is only recorded for logging.
+	zone string
+	// monitored is set for an address of a domain of network.domain.monitor, see denyValue.
+	monitored bool
 }
 
 func (i *IPAddress) isV6address() bool {
 	return i.address.To4() == nil
 }
 
-func (i *IPAddress) ipAddressToBPFMapKey() []byte {
+func (i *IPAddress) ipAddressToBPFMapKey() ([]byte, error) {
+	// An IPv4-mapped IPv6 address, e.g. ::ffff:10.0.0.1, is always stored as an IPv4 key,
+	// however the net.IP was built.
+	if n := config.Unmap(&net.IPNet{IP: i.address, Mask: i.cidrMask}); len(n.Mask) == net.IPv4len {
+		i.address, i.cidrMask = n.IP.To4(), n.Mask
+	}
 	ip := net.IPNet{IP: i.address.Mask(i.cidrMask), Mask: i.cidrMask}
+	if ip.IP == nil {
+		return nil, fmt.Errorf("%w: mask %s does not match the address %s", ErrInvalidMapKey, i.cidrMask, i.address)
+	}
 
+	var err error
 	if i.isV6address() {
-		i.key = ipv6ToKey(ip)
+		i.key, err = ipv6ToKey(ip, i.protocol)
 	} else {
-		i.key = ipv4ToKey(ip)
+		i.key, err = ipv4ToKey(ip, i.protocol)
 	}
 
-	return i.key
+	return i.key, err
 }
 
 type DNSResolver interface {
@@ -88,276 +369,609 @@ type DNSResolver interface {
 type DefaultResolver struct {
 	config        *dns.ClientConfig
 	client        *dns.Client
-	message       *dns.Msg
-	mux           sync.Mutex
 	oldResolvConf []byte
+	// addresses are the servers as ip:port, see network.domain.resolver. The servers of config
+	// are queried on port 53 when it is nil.
+	addresses []string
+	// timeout is the deadline of a resolution, over every server. Zero has none.
+	timeout time.Duration
+}
+
+func NewDefaultResolver(config *dns.ClientConfig) *DefaultResolver {
+	return &DefaultResolver{
+		config: config,
+		client: new(dns.Client),
+	}
 }
 
+// SetConfigToMap writes the policy of the config to the maps and resolves the domains.
+//
+// Only the difference from what the previous calls have written is applied, so calling it
+// again is a no-op and a call that failed part way resumes where it stopped.
 func (m *Manager) SetConfigToMap() error {
 	initDNSCache()
 
-	if err := m.setConfigMap(); err != nil {
-		return err
-	}
-	if err := m.setAllowedCIDRList(); err != nil {
-		return err
-	}
-	if err := m.setDeniedCIDRList(); err != nil {
+	m.Policy().setDeniedGroups(deniedGroups(m.config))
+	// The rule sets know what they installed before the reconcile, which leaves their entries.
+	m.initRuleSets()
+	populate := m.startup.Begin(STARTUP_PHASE_MAPS_POPULATE)
+	err := m.reconcileConfigIn(populate)
+	populate.End(err)
+	if err != nil {
 		return err
 	}
 
 	if !m.config.DNSProxyConfig.Enable {
-		if err := m.initDomainList(); err != nil {
+		preload := m.startup.Begin(STARTUP_PHASE_DOMAINS_PRELOAD)
+		err := m.preloadDomains()
+		preload.End(err)
+		if err != nil {
+			return err
+		}
+		resolve := m.startup.Begin(STARTUP_PHASE_DOMAINS_RESOLVE)
+		err = m.initDomainList(resolve)
+		resolve.End(err)
+		if err != nil {
 			return err
 		}
 	}
+	m.policyChanged()
 
-	if err := m.setAllowedCommandList(); err != nil {
-		return err
-	}
-	if err := m.setDeniedCommandList(); err != nil {
-		return err
-	}
-	if err := m.setAllowedUIDList(); err != nil {
-		return err
-	}
-	if err := m.setDeniedUIDList(); err != nil {
-		return err
-	}
-	if err := m.setAllowedGIDList(); err != nil {
-		return err
-	}
-	if err := m.setDeniedGIDList(); err != nil {
-		return err
-	}
 	return nil
 }
 
+// Start begins polling audit events into eventsChannel.
+//
+// The Manager takes ownership of eventsChannel and closes it exactly once:
+// when the Manager is stopped, or immediately if Start fails or the Manager
+// is already closed. Consumers should treat a closed channel as the end of
+// the event stream. A channel must not be passed to Start again after it
+// has been closed. Calling Start on a started Manager is a no-op.
 func (m *Manager) Start(eventsChannel chan []byte) error {
-	rb, err := m.mod.InitRingBuf("audit_events", eventsChannel)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch m.state {
+	case stateStarted:
+		m.releaseEventsChannel(eventsChannel)
+		return nil
+	case stateStopping, stateStopped:
+		m.releaseEventsChannel(eventsChannel)
+		return ErrManagerClosed
+	}
+
+	if _, ok := m.released[eventsChannel]; ok {
+		return ErrEventsChannelClosed
+	}
 
+	// Without audit events there is nothing to poll until SetAuditEnabled turns them on.
+	if m.auditDisabled {
+		m.rb = &idleRingBuffer{events: eventsChannel}
+		m.events = eventsChannel
+		m.state = stateStarted
+		return nil
+	}
+
+	rb, err := m.newRingBuffer(eventsChannel)
 	if err != nil {
+		m.releaseEventsChannel(eventsChannel)
 		return err
 	}
 
 	rb.Start()
 	m.rb = rb
+	m.events = eventsChannel
+	m.state = stateStarted
 
 	return nil
 }
 
+// Stop stops polling the ring buffer. The events channel is closed once
+// in-flight events have been handed over. It is safe to call Stop at any time.
 func (m *Manager) Stop() {
-	m.rb.Stop()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.state == stateStarted {
+		m.rb.Stop()
+		m.state = stateStopping
+	}
 }
 
+// Close detaches the programs, stops polling and releases the ring buffer, then closes the module
+// if NewManager loaded it. With bpf.keep_attached, the pinned links are left, which keeps the
+// programs attached after bouheki exits.
+// It is safe to call Close at any time and more than once, and on a nil Manager; a closed Manager
+// can not be started again.
 func (m *Manager) Close() {
-	m.rb.Close()
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	stopRuleSets := m.stopRuleSets
+	m.mu.Unlock()
+	if stopRuleSets != nil {
+		stopRuleSets()
+	}
+	m.Jobs().Stop()
+	m.ruleSetsRunning.Wait()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// The pins of the links are removed first, so that the programs are detached with the links.
+	m.unpinLinksOnClose()
+	if m.state == stateStarted || m.state == stateStopping {
+		m.state = stateStopping
+		m.rb.Close()
+	}
+	if m.watcher != nil {
+		m.watcher.Close()
+		m.watcher = nil
+	}
+	if m.ownsModule && m.mod != nil {
+		m.unpinOnClose()
+		m.mod.Close()
+		m.mod = nil
+		m.links = nil
+	}
+	m.state = stateStopped
 }
 
-func (m *Manager) Attach() error {
-	programs := []string{"socket_connect"}
-	for _, progName := range programs {
-		prog, err := m.mod.GetProgram(progName)
+// addLink keeps link, which Close detaches.
+func (m *Manager) addLink(link *libbpfgo.BPFLink) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-		if err != nil {
-			return err
+	m.links = append(m.links, link)
+}
+
+// Policy returns the userspace mirror of the policy written to the BPF maps.
+func (m *Manager) Policy() *Policy {
+	m.policyOnce.Do(func() {
+		if m.policy == nil {
+			m.policy = NewPolicy()
+			m.policy.SetClock(m.now)
 		}
+	})
 
-		_, err = prog.AttachLSM()
-		if err != nil {
-			return err
+	return m.policy
+}
+
+// Jobs returns the queue that serializes DNS refreshes and the other mutations of the maps.
+func (m *Manager) Jobs() *jobs.Queue {
+	m.jobsOnce.Do(func() {
+		if m.jobs == nil {
+			m.jobs = jobs.New("network", jobs.DEFAULT_QUEUE_SIZE)
 		}
+	})
 
-		log.Debug(fmt.Sprintf("%s attached.", progName))
-	}
+	return m.jobs
+}
 
-	return nil
+// currentConfig returns the config, for the readers outside of the jobs.
+func (m *Manager) currentConfig() *config.Config {
+	m.configMu.RLock()
+	defer m.configMu.RUnlock()
+	return m.config
 }
 
-func (m *Manager) setMode(table *libbpfgo.BPFMap, key []byte) []byte {
-	if m.config.IsRestrictedMode("network") {
-		binary.LittleEndian.PutUint32(key[MAP_MODE_START:MAP_MODE_END], MODE_BLOCK)
-	} else {
-		binary.LittleEndian.PutUint32(key[MAP_MODE_START:MAP_MODE_END], MODE_MONITOR)
-	}
+// runJob runs fn on the job queue and waits for it. change is the kind of change
+// fn makes, checked against the freeze windows when the job starts rather than when
+// it is queued, so a job waiting behind others can not slip into a window.
+func (m *Manager) runJob(name string, change string, fn func(ctx context.Context) error) error {
+	return m.Jobs().Do(name, func(ctx context.Context) error {
+		if err := m.freeze.Check(change, name, ""); err != nil {
+			return err
+		}
+		defer m.policyChanged()
+		return m.mutate(ctx, name, fn)
+	})
+}
 
-	return key
+// doJob runs fn on the job queue and waits for it, like runJob for the jobs that no freeze
+// window holds back.
+func (m *Manager) doJob(name string, fn jobs.Func) error {
+	return m.Jobs().Do(name, func(ctx context.Context) error {
+		return m.mutate(ctx, name, fn)
+	})
 }
 
-func (m *Manager) setTarget(table *libbpfgo.BPFMap, key []byte) []byte {
-	if m.config.IsOnlyContainer("network") {
-		binary.LittleEndian.PutUint32(key[MAP_TARGET_START:MAP_TARGET_END], TAREGT_CONTAINER)
-	} else {
-		binary.LittleEndian.PutUint32(key[MAP_TARGET_START:MAP_TARGET_END], TARGET_HOST)
+// PolicyDigest returns the digest of the policy as of the last change: it is updated by
+// SetConfigToMap and after every job, and is cheap enough to be read for every event.
+func (m *Manager) PolicyDigest() string {
+	if digest, ok := m.policyDigest.Load().(string); ok {
+		return digest
 	}
+	m.policyChanged()
+	return m.policyDigest.Load().(string)
+}
 
-	return key
+// policyChanged updates the PolicyDigest if the policy changed since, and queues the new
+// version to be saved.
+func (m *Manager) policyChanged() {
+	m.digestMu.Lock()
+	defer m.digestMu.Unlock()
+
+	if generation, _ := m.Policy().Generation(); generation == m.digestGeneration && m.policyDigest.Load() != nil {
+		return
+	}
+	version, generation := m.Policy().version()
+	m.policyDigest.Store(version.Digest)
+	m.digestGeneration = generation
+	if m.versions != nil {
+		m.versions.record(version)
+	}
 }
 
-func (m *Manager) setConfigMap() error {
-	configMap, err := m.mod.GetMap(RESTRICT_NETWORK_CONFIG_MAP_NAME)
-	if err != nil {
-		return err
+func (m *Manager) newRingBuffer(eventsChannel chan []byte) (ringBuffer, error) {
+	if m.initRingBuf != nil {
+		return m.initRingBuf(eventsChannel)
+	}
+	if m.mod == nil {
+		return nil, ErrNoProgram
 	}
 
-	key := make([]byte, MAP_SIZE)
+	rb, err := m.mod.InitRingBuf(AUDIT_EVENTS_MAP_NAME, eventsChannel)
+	if err != nil {
+		return nil, err
+	}
 
-	key = m.setMode(configMap, key)
-	key = m.setTarget(configMap, key)
+	return rb, nil
+}
 
-	binary.LittleEndian.PutUint32(key[MAP_ALLOW_COMMAND_INDEX:MAP_ALLOW_COMMAND_INDEX+4], uint32(len(m.config.RestrictedNetworkConfig.Command.Allow)))
-	binary.LittleEndian.PutUint32(key[MAP_ALLOW_UID_INDEX:MAP_ALLOW_UID_INDEX+4], uint32(len(m.config.RestrictedNetworkConfig.UID.Allow)))
-	binary.LittleEndian.PutUint32(key[MAP_ALLOW_GID_INDEX:MAP_ALLOW_GID_INDEX+4], uint32(len(m.config.RestrictedNetworkConfig.GID.Allow)))
+// releaseEventsChannel closes a channel handed to Start that the Manager will not use.
+// The channel that is currently in use is closed by the ring buffer instead,
+// and a channel that was already released is never closed twice.
+func (m *Manager) releaseEventsChannel(eventsChannel chan []byte) {
+	if eventsChannel == m.events {
+		return
+	}
+	if _, ok := m.released[eventsChannel]; ok {
+		return
+	}
+	if m.released == nil {
+		m.released = make(map[chan []byte]struct{})
+	}
+	m.released[eventsChannel] = struct{}{}
+	close(eventsChannel)
+}
 
-	k := uint8(0)
-	err = configMap.Update(unsafe.Pointer(&k), unsafe.Pointer(&key[0]))
+// Attach attaches the hooks of the operations of the config, the connect and the sendmsg hooks and
+// the bind hook when network.ingress has rules, the tracking of the executables when
+// network.command has path rules, and the cleanup of the per-task maps. With config.HOOK_AUTO,
+// the kprobe fallback is attached when the BPF LSM is not active or the kernel can not attach it.
+func (m *Manager) Attach() error {
+	if m.mod == nil {
+		return ErrNoProgram
+	}
 
-	if err != nil {
+	if err := m.attachHooks(); err != nil {
 		return err
 	}
-
+	m.attachExePaths()
+	m.attachTaskExit()
 	return nil
 }
 
-func (m *Manager) setAllowedCommandList() error {
-	commands, err := m.mod.GetMap(ALLOWED_COMMAND_LIST_MAP_NAME)
-	if err != nil {
-		return err
+// restricts reports whether the programs are attached for operation.
+func (m *Manager) restricts(operation string) bool {
+	for _, o := range m.operations {
+		if o == operation {
+			return true
+		}
 	}
+	return false
+}
 
-	for _, c := range m.config.RestrictedNetworkConfig.Command.Allow {
-		key := byteToKey([]byte(c))
-		value := uint8(0)
-		err = commands.Update(unsafe.Pointer(&key[0]), unsafe.Pointer(&value))
-		if err != nil {
-			return err
-		}
+func (m *Manager) attachHooks() error {
+	switch m.hook {
+	case config.HOOK_KPROBE:
+		return m.attachFallback()
+	case config.HOOK_LSM:
+		return m.attachLSM()
 	}
 
-	return nil
+	if active, err := utils.IsBPFLSMActive(); err == nil && !active {
+		log.Warn("BPF LSM is not active. Falling back to the kprobe.")
+		return m.attachFallback()
+	}
+
+	err := m.attachLSM()
+	if err != nil && isLSMUnavailable(err) {
+		log.Warn(fmt.Sprintf("%s. Falling back to the kprobe.", err))
+		return m.attachFallback()
+	}
+
+	return err
 }
 
-func (m *Manager) setDeniedCommandList() error {
-	commands, err := m.mod.GetMap(DENIED_COMMAND_LIST_MAP_NAME)
-	if err != nil {
-		return err
+// Enforcement returns how connections are restricted after Attach.
+func (m *Manager) Enforcement() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.enforcement
+}
+
+func (m *Manager) setEnforcement(enforcement string) {
+	m.mu.Lock()
+	previous := m.enforcement
+	m.enforcement = enforcement
+	m.mu.Unlock()
+
+	if enforcement == ENFORCEMENT_LSM {
+		enforcementFallback.Set(0)
+	} else {
+		enforcementFallback.Set(1)
+	}
+
+	if previous != enforcement {
+		notify.Publish(notify.EnforcementMode{From: previous, To: enforcement}, m.Policy().Digest())
 	}
+}
 
-	for _, c := range m.config.RestrictedNetworkConfig.Command.Deny {
-		key := byteToKey([]byte(c))
-		value := uint8(0)
-		err = commands.Update(unsafe.Pointer(&key[0]), unsafe.Pointer(&value))
+func (m *Manager) attachLSM() error {
+	for _, h := range operationHooks(m.operations) {
+		progName, _ := h.programNames(m.ancestors)
+		prog, err := m.mod.GetProgram(progName)
 		if err != nil {
 			return err
 		}
+
+		link, err := prog.AttachLSM()
+		if err != nil {
+			return err
+		}
+		m.addLink(link)
+		log.Debug(fmt.Sprintf("%s attached.", progName))
+
+		// A pinned link keeps the program attached after bouheki exits.
+		if pinPath := m.config.BPF.PinPath; pinPath != "" {
+			if err = pinLink(pinPath, progName, link); err != nil {
+				return err
+			}
+		}
 	}
 
+	m.setEnforcement(ENFORCEMENT_LSM)
 	return nil
 }
 
-func (m *Manager) setAllowedUIDList() error {
-	uids, err := m.mod.GetMap(ALLOWED_UID_LIST_MAP_NAME)
-	if err != nil {
+func (m *Manager) attachFallback() error {
+	enforcement := ENFORCEMENT_KPROBE_MONITOR
+	if m.config.RestrictedNetworkConfig.Enforcement.SendSignal {
+		enforcement = ENFORCEMENT_KPROBE_SIGNAL
+	}
+	m.setEnforcement(enforcement)
+
+	// Rewrite the mode so that events are not reported as blocked when nothing blocks them.
+	if err := m.applyConfig(); err != nil {
 		return err
 	}
-	for _, uid := range m.config.RestrictedNetworkConfig.UID.Allow {
-		key := uintToKey(uid)
-		value := uint8(0)
-		err = uids.Update(unsafe.Pointer(&key[0]), unsafe.Pointer(&value))
+
+	for _, h := range operationHooks(m.operations) {
+		_, progName := h.programNames(m.ancestors)
+		prog, err := m.mod.GetProgram(progName)
 		if err != nil {
 			return err
 		}
+
+		link, err := prog.AttachKprobe(h.attachPoint)
+		if err != nil {
+			return err
+		}
+		m.addLink(link)
+		log.Debug(fmt.Sprintf("%s attached.", progName))
 	}
 
+	log.Warn(fmt.Sprintf("The network restriction is running in %s mode.", enforcement))
+	if pinPath := m.config.BPF.PinPath; pinPath != "" {
+		log.Warn(fmt.Sprintf("The kprobes are not pinned in %s, they are detached when bouheki exits.", pinPath))
+	}
 	return nil
 }
 
-func (m *Manager) setDeniedUIDList() error {
-	uids, err := m.mod.GetMap(DENIED_UID_LIST_MAP_NAME)
-	if err != nil {
-		return err
+// isLSMUnavailable reports whether err is the error AttachLSM returns when
+// the kernel does not support attaching BPF LSM programs.
+func isLSMUnavailable(err error) bool {
+	return errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, ENOTSUPP) || errors.Is(err, syscall.ENOSYS)
+}
+
+func (m *Manager) setMode(key []byte) []byte {
+	if m.config.IsRestrictedMode("network") && m.Enforcement() != ENFORCEMENT_KPROBE_MONITOR && !m.forcedMonitor() {
+		binary.LittleEndian.PutUint32(key[MAP_MODE_START:MAP_MODE_END], MODE_BLOCK)
+	} else {
+		binary.LittleEndian.PutUint32(key[MAP_MODE_START:MAP_MODE_END], MODE_MONITOR)
 	}
-	for _, uid := range m.config.RestrictedNetworkConfig.UID.Deny {
-		key := uintToKey(uid)
-		value := uint8(0)
-		err = uids.Update(unsafe.Pointer(&key[0]), unsafe.Pointer(&value))
-		if err != nil {
-			return err
-		}
+
+	return key
+}
+
+func (m *Manager) setTarget(key []byte) []byte {
+	if m.config.IsOnlyContainer("network") {
+		binary.LittleEndian.PutUint32(key[MAP_TARGET_START:MAP_TARGET_END], TAREGT_CONTAINER)
+	} else if m.config.ClassifiesContainers("network") {
+		binary.LittleEndian.PutUint32(key[MAP_TARGET_START:MAP_TARGET_END], TARGET_ALL)
+	} else {
+		binary.LittleEndian.PutUint32(key[MAP_TARGET_START:MAP_TARGET_END], TARGET_HOST)
 	}
 
-	return nil
+	return key
 }
 
-func (m *Manager) setAllowedGIDList() error {
-	gids, err := m.mod.GetMap(ALLOWED_GID_LIST_MAP_NAME)
-	if err != nil {
-		return err
+// configMapValue returns the value of RESTRICT_NETWORK_CONFIG_MAP_NAME.
+func (m *Manager) configMapValue() []byte {
+	key := make([]byte, MAP_SIZE)
+
+	key = m.setMode(key)
+	key = m.setTarget(key)
+	binary.LittleEndian.PutUint32(key[MAP_LAYOUT_VERSION_INDEX:MAP_LAYOUT_VERSION_INDEX+4], CONFIG_MAP_LAYOUT_VERSION)
+
+	// The sizes are the number of entries written to each list, so socket_connect never infers them from a lookup.
+	lists := subjectState(m.config.RestrictedNetworkConfig)
+	binary.LittleEndian.PutUint32(key[MAP_ALLOW_COMMAND_INDEX:MAP_ALLOW_COMMAND_INDEX+4], uint32(len(lists[ALLOWED_COMMAND_LIST_MAP_NAME])))
+	binary.LittleEndian.PutUint32(key[MAP_ALLOW_UID_INDEX:MAP_ALLOW_UID_INDEX+4], uint32(len(lists[ALLOWED_UID_LIST_MAP_NAME])+len(lists[ALLOWED_UID_RANGE_LIST_MAP_NAME])))
+	binary.LittleEndian.PutUint32(key[MAP_ALLOW_GID_INDEX:MAP_ALLOW_GID_INDEX+4], uint32(len(lists[ALLOWED_GID_LIST_MAP_NAME])))
+	binary.LittleEndian.PutUint32(key[MAP_DENY_COMMAND_INDEX:MAP_DENY_COMMAND_INDEX+4], uint32(len(lists[DENIED_COMMAND_LIST_MAP_NAME])))
+	binary.LittleEndian.PutUint32(key[MAP_DENY_UID_INDEX:MAP_DENY_UID_INDEX+4], uint32(len(lists[DENIED_UID_LIST_MAP_NAME])+len(lists[DENIED_UID_RANGE_LIST_MAP_NAME])))
+	binary.LittleEndian.PutUint32(key[MAP_DENY_GID_INDEX:MAP_DENY_GID_INDEX+4], uint32(len(lists[DENIED_GID_LIST_MAP_NAME])))
+	// An entry that does not parse fails policyState before the config map is written.
+	ports, _ := portState(m.config.RestrictedNetworkConfig)
+	binary.LittleEndian.PutUint32(key[MAP_ALLOW_PORT_INDEX:MAP_ALLOW_PORT_INDEX+4], uint32(len(ports[ALLOWED_PORT_LIST_MAP_NAME])))
+	binary.LittleEndian.PutUint32(key[MAP_DENY_PORT_INDEX:MAP_DENY_PORT_INDEX+4], uint32(len(ports[DENIED_PORT_LIST_MAP_NAME])))
+	disabled := policy.DisabledFamilies(m.config.RestrictedNetworkConfig)
+	ingress, _ := ingressState(m.config.RestrictedNetworkConfig.Ingress)
+	ingress.dropFamilies(disabled)
+	binary.LittleEndian.PutUint32(key[MAP_INGRESS_ALLOW_CIDR_INDEX:MAP_INGRESS_ALLOW_CIDR_INDEX+4], uint32(len(ingress[INGRESS_ALLOWED_V4_CIDR_LIST_MAP_NAME])+len(ingress[INGRESS_ALLOWED_V6_CIDR_LIST_MAP_NAME])))
+	binary.LittleEndian.PutUint32(key[MAP_INGRESS_ALLOW_PORT_INDEX:MAP_INGRESS_ALLOW_PORT_INDEX+4], uint32(len(ingress[INGRESS_ALLOWED_PORT_LIST_MAP_NAME])))
+	binary.LittleEndian.PutUint32(key[MAP_INGRESS_DENY_PORT_INDEX:MAP_INGRESS_DENY_PORT_INDEX+4], uint32(len(ingress[INGRESS_DENIED_PORT_LIST_MAP_NAME])))
+	if m.config.RestrictedNetworkConfig.Command.CaseInsensitive {
+		binary.LittleEndian.PutUint32(key[MAP_COMMAND_CASE_INSENSITIVE_INDEX:MAP_COMMAND_CASE_INSENSITIVE_INDEX+4], 1)
 	}
-	for _, gid := range m.config.RestrictedNetworkConfig.GID.Allow {
-		key := uintToKey(gid)
-		value := uint8(0)
-		err = gids.Update(unsafe.Pointer(&key[0]), unsafe.Pointer(&value))
-		if err != nil {
-			return err
-		}
+
+	classification := CLASSIFICATION_MOUNT_NAMESPACE
+	switch m.config.RestrictedNetworkConfig.Classification.Strategy {
+	case config.CLASSIFY_PID_NAMESPACE:
+		classification = CLASSIFICATION_PID_NAMESPACE
+	case config.CLASSIFY_CGROUP_PATTERN, config.CLASSIFY_CGROUP_LIST:
+		classification = CLASSIFICATION_CGROUP
 	}
+	binary.LittleEndian.PutUint32(key[MAP_CLASSIFICATION_INDEX:MAP_CLASSIFICATION_INDEX+4], classification)
 
-	return nil
+	if m.quiesced {
+		binary.LittleEndian.PutUint32(key[MAP_QUIESCED_INDEX:MAP_QUIESCED_INDEX+4], 1)
+	}
+	if m.auditDisabled {
+		binary.LittleEndian.PutUint32(key[MAP_AUDIT_DISABLED_INDEX:MAP_AUDIT_DISABLED_INDEX+4], 1)
+	}
+	binary.LittleEndian.PutUint32(key[MAP_DENY_SHARDS_INDEX:MAP_DENY_SHARDS_INDEX+4], uint32(m.config.Resources.DenyShards))
+	binary.LittleEndian.PutUint32(key[MAP_DISABLED_FAMILIES_INDEX:MAP_DISABLED_FAMILIES_INDEX+4], disabled)
+	if disabled != 0 && m.config.RestrictedNetworkConfig.OtherFamilies == config.OTHER_FAMILIES_AUDIT {
+		binary.LittleEndian.PutUint32(key[MAP_OTHER_FAMILIES_AUDIT_INDEX:MAP_OTHER_FAMILIES_AUDIT_INDEX+4], 1)
+	}
+	if m.config.RestrictedNetworkConfig.RuleHits.Enable {
+		binary.LittleEndian.PutUint32(key[MAP_RULE_HITS_INDEX:MAP_RULE_HITS_INDEX+4], 1)
+	}
+	binary.LittleEndian.PutUint32(key[MAP_ALLOW_PATH_INDEX:MAP_ALLOW_PATH_INDEX+4], uint32(len(lists[ALLOWED_PATH_LIST_MAP_NAME])))
+	binary.LittleEndian.PutUint32(key[MAP_DENY_PATH_INDEX:MAP_DENY_PATH_INDEX+4], uint32(len(lists[DENIED_PATH_LIST_MAP_NAME])))
+	binary.LittleEndian.PutUint32(key[MAP_ALLOW_COMMAND_PATTERN_INDEX:MAP_ALLOW_COMMAND_PATTERN_INDEX+4], uint32(len(lists[ALLOWED_COMMAND_PATTERN_LIST_MAP_NAME])))
+	binary.LittleEndian.PutUint32(key[MAP_DENY_COMMAND_PATTERN_INDEX:MAP_DENY_COMMAND_PATTERN_INDEX+4], uint32(len(lists[DENIED_COMMAND_PATTERN_LIST_MAP_NAME])))
+	entries, _, _, _ := policy.EntryMasks(m.config.RestrictedNetworkConfig.PolicyEntries())
+	binary.LittleEndian.PutUint32(key[MAP_POLICY_ENTRIES_INDEX:MAP_POLICY_ENTRIES_INDEX+4], entries.Count)
+	binary.LittleEndian.PutUint64(key[MAP_POLICY_ENTRY_ANY_COMMAND_INDEX:MAP_POLICY_ENTRY_ANY_COMMAND_INDEX+8], entries.AnyCommand)
+	binary.LittleEndian.PutUint64(key[MAP_POLICY_ENTRY_ANY_UID_INDEX:MAP_POLICY_ENTRY_ANY_UID_INDEX+8], entries.AnyUID)
+	binary.LittleEndian.PutUint64(key[MAP_POLICY_ENTRY_ANY_GID_INDEX:MAP_POLICY_ENTRY_ANY_GID_INDEX+8], entries.AnyGID)
+	binary.LittleEndian.PutUint64(key[MAP_POLICY_ENTRY_HAS_ALLOW_INDEX:MAP_POLICY_ENTRY_HAS_ALLOW_INDEX+8], entries.HasAllow)
+	binary.LittleEndian.PutUint64(key[MAP_POLICY_ENTRY_HOST_INDEX:MAP_POLICY_ENTRY_HOST_INDEX+8], entries.Host)
+	binary.LittleEndian.PutUint64(key[MAP_POLICY_ENTRY_CONTAINER_INDEX:MAP_POLICY_ENTRY_CONTAINER_INDEX+8], entries.Container)
+	defaultAction, precedence := policy.DefaultAndPrecedence(m.config.RestrictedNetworkConfig)
+	binary.LittleEndian.PutUint32(key[MAP_DEFAULT_ACTION_INDEX:MAP_DEFAULT_ACTION_INDEX+4], defaultAction)
+	binary.LittleEndian.PutUint32(key[MAP_PRECEDENCE_INDEX:MAP_PRECEDENCE_INDEX+4], precedence)
+	if dedup := m.config.RestrictedNetworkConfig.Audit.Dedup; dedup.Enable {
+		binary.LittleEndian.PutUint64(key[MAP_REPORT_INTERVAL_INDEX:MAP_REPORT_INTERVAL_INDEX+8], uint64(dedup.KernelWindow))
+	}
+
+	return key
 }
 
-func (m *Manager) setDeniedGIDList() error {
-	gids, err := m.mod.GetMap(DENIED_UID_LIST_MAP_NAME)
-	if err != nil {
-		return err
+// ConfigMapValue returns the value conf is written to RESTRICT_NETWORK_CONFIG_MAP_NAME as.
+func ConfigMapValue(conf *config.Config) []byte {
+	return (&Manager{config: conf, auditDisabled: !conf.RestrictedNetworkConfig.Audit.Enabled}).configMapValue()
+}
+
+// ListSizes are the sizes of the allow and deny lists in the config map.
+type ListSizes = policy.ListSizes
+
+// DecodeListSizes reads the ListSizes of a value of RESTRICT_NETWORK_CONFIG_MAP_NAME.
+func DecodeListSizes(value []byte) ListSizes {
+	return ListSizes{
+		AllowCommand:        binary.LittleEndian.Uint32(value[MAP_ALLOW_COMMAND_INDEX : MAP_ALLOW_COMMAND_INDEX+4]),
+		AllowUID:            binary.LittleEndian.Uint32(value[MAP_ALLOW_UID_INDEX : MAP_ALLOW_UID_INDEX+4]),
+		AllowGID:            binary.LittleEndian.Uint32(value[MAP_ALLOW_GID_INDEX : MAP_ALLOW_GID_INDEX+4]),
+		DenyCommand:         binary.LittleEndian.Uint32(value[MAP_DENY_COMMAND_INDEX : MAP_DENY_COMMAND_INDEX+4]),
+		DenyUID:             binary.LittleEndian.Uint32(value[MAP_DENY_UID_INDEX : MAP_DENY_UID_INDEX+4]),
+		DenyGID:             binary.LittleEndian.Uint32(value[MAP_DENY_GID_INDEX : MAP_DENY_GID_INDEX+4]),
+		AllowPort:           binary.LittleEndian.Uint32(value[MAP_ALLOW_PORT_INDEX : MAP_ALLOW_PORT_INDEX+4]),
+		DenyPort:            binary.LittleEndian.Uint32(value[MAP_DENY_PORT_INDEX : MAP_DENY_PORT_INDEX+4]),
+		IngressAllowCIDR:    binary.LittleEndian.Uint32(value[MAP_INGRESS_ALLOW_CIDR_INDEX : MAP_INGRESS_ALLOW_CIDR_INDEX+4]),
+		IngressAllowPort:    binary.LittleEndian.Uint32(value[MAP_INGRESS_ALLOW_PORT_INDEX : MAP_INGRESS_ALLOW_PORT_INDEX+4]),
+		IngressDenyPort:     binary.LittleEndian.Uint32(value[MAP_INGRESS_DENY_PORT_INDEX : MAP_INGRESS_DENY_PORT_INDEX+4]),
+		AllowPath:           binary.LittleEndian.Uint32(value[MAP_ALLOW_PATH_INDEX : MAP_ALLOW_PATH_INDEX+4]),
+		DenyPath:            binary.LittleEndian.Uint32(value[MAP_DENY_PATH_INDEX : MAP_DENY_PATH_INDEX+4]),
+		AllowCommandPattern: binary.LittleEndian.Uint32(value[MAP_ALLOW_COMMAND_PATTERN_INDEX : MAP_ALLOW_COMMAND_PATTERN_INDEX+4]),
+		DenyCommandPattern:  binary.LittleEndian.Uint32(value[MAP_DENY_COMMAND_PATTERN_INDEX : MAP_DENY_COMMAND_PATTERN_INDEX+4]),
 	}
-	for _, gid := range m.config.RestrictedNetworkConfig.GID.Deny {
-		key := uintToKey(gid)
-		value := uint8(0)
-		err = gids.Update(unsafe.Pointer(&key[0]), unsafe.Pointer(&value))
-		if err != nil {
-			return err
-		}
+}
+
+// DecodePolicyEntries reads the masks of network.policies, network.host and network.container of a value of RESTRICT_NETWORK_CONFIG_MAP_NAME.
+func DecodePolicyEntries(value []byte) policy.PolicyEntries {
+	return policy.PolicyEntries{
+		Count:      binary.LittleEndian.Uint32(value[MAP_POLICY_ENTRIES_INDEX : MAP_POLICY_ENTRIES_INDEX+4]),
+		AnyCommand: binary.LittleEndian.Uint64(value[MAP_POLICY_ENTRY_ANY_COMMAND_INDEX : MAP_POLICY_ENTRY_ANY_COMMAND_INDEX+8]),
+		AnyUID:     binary.LittleEndian.Uint64(value[MAP_POLICY_ENTRY_ANY_UID_INDEX : MAP_POLICY_ENTRY_ANY_UID_INDEX+8]),
+		AnyGID:     binary.LittleEndian.Uint64(value[MAP_POLICY_ENTRY_ANY_GID_INDEX : MAP_POLICY_ENTRY_ANY_GID_INDEX+8]),
+		HasAllow:   binary.LittleEndian.Uint64(value[MAP_POLICY_ENTRY_HAS_ALLOW_INDEX : MAP_POLICY_ENTRY_HAS_ALLOW_INDEX+8]),
+		Host:       binary.LittleEndian.Uint64(value[MAP_POLICY_ENTRY_HOST_INDEX : MAP_POLICY_ENTRY_HOST_INDEX+8]),
+		Container:  binary.LittleEndian.Uint64(value[MAP_POLICY_ENTRY_CONTAINER_INDEX : MAP_POLICY_ENTRY_CONTAINER_INDEX+8]),
 	}
+}
 
-	return nil
+// DecodeDefaultAndPrecedence reads network.policy of a value of RESTRICT_NETWORK_CONFIG_MAP_NAME,
+// a policy.DEFAULT_ACTION and a policy.PRECEDENCE.
+func DecodeDefaultAndPrecedence(value []byte) (uint32, uint32) {
+	return binary.LittleEndian.Uint32(value[MAP_DEFAULT_ACTION_INDEX : MAP_DEFAULT_ACTION_INDEX+4]),
+		binary.LittleEndian.Uint32(value[MAP_PRECEDENCE_INDEX : MAP_PRECEDENCE_INDEX+4])
 }
 
-func (m *Manager) setAllowedCIDRList() error {
-	for _, addr := range m.config.RestrictedNetworkConfig.CIDR.Allow {
-		allowedAddress, err := cidrToBPFMapKey(addr)
-		if err != nil {
-			return err
-		}
-		if allowedAddress.isV6address() {
-			err = m.cidrListUpdate(allowedAddress, ALLOWED_V6_CIDR_LIST_MAP_NAME)
-			if err != nil {
-				return err
-			}
-		} else {
-			err = m.cidrListUpdate(allowedAddress, ALLOWED_V4_CIDR_LIST_MAP_NAME)
-			if err != nil {
-				return err
-			}
-		}
+// DefaultActionName returns network.policy.default of a policy.DEFAULT_ACTION.
+func DefaultActionName(defaultAction uint32) string {
+	if defaultAction == policy.DEFAULT_ACTION_ALLOW {
+		return config.DEFAULT_ACTION_ALLOW
 	}
+	return config.DEFAULT_ACTION_DENY
+}
 
-	return nil
+// PrecedenceName returns network.policy.precedence of a policy.PRECEDENCE.
+func PrecedenceName(precedence uint32) string {
+	if precedence == policy.PRECEDENCE_ALLOW_FIRST {
+		return config.PRECEDENCE_ALLOW_FIRST
+	}
+	return config.PRECEDENCE_DENY_FIRST
 }
 
-func (m *Manager) setDeniedCIDRList() error {
-	for _, addr := range m.config.RestrictedNetworkConfig.CIDR.Deny {
-		deniedAddress, err := cidrToBPFMapKey(addr)
-		if err != nil {
+// initDomainList resolves the domains of the config, each timed as a phase of span.
+func (m *Manager) initDomainList(span *timing.Span) error {
+	m.unresolved.reset()
+
+	for _, domain := range m.config.RestrictedNetworkConfig.Domain.Deny {
+		entry := domainEntry{domain: domain, list: SNAPSHOT_LIST_DENY, protocol: PROTOCOL_ALL}
+		if err := m.initDomain(span, entry, m.updateDeniedFQDNList); err != nil {
 			return err
 		}
-		if deniedAddress.isV6address() {
-			err = m.cidrListUpdate(deniedAddress, DENIED_V6_CIDR_LIST_MAP_NAME)
-			if err != nil {
-				return err
-			}
-		} else {
-			err = m.cidrListUpdate(deniedAddress, DENIED_V4_CIDR_LIST_MAP_NAME)
+	}
+
+	for _, domain := range m.config.RestrictedNetworkConfig.Domain.Allow {
+		entry := domainEntry{domain: domain, list: SNAPSHOT_LIST_ALLOW, protocol: PROTOCOL_ALL}
+		if err := m.initDomain(span, entry, m.updateAllowedFQDNist); err != nil {
+			return err
+		}
+	}
+
+	// The snapshot of the preload file has no protocol lists, nor the lists of network.policies:
+	// their domains are always resolved.
+	lists := append(protocolDomainLists(m.config.RestrictedNetworkConfig.Domain), policyDomainLists(m.config.RestrictedNetworkConfig.PolicyEntries())...)
+	for _, list := range lists {
+		list := list
+		update := func(answer *DNSAnswer) error { return m.updateProtocolFQDNList(answer, list.list, list.protocol) }
+		if list.policy != "" {
+			update = func(answer *DNSAnswer) error { return m.updateEntryFQDNList(answer, list.list, list.protocol) }
+		}
+		for _, domain := range list.domains {
+			resolve := span.Begin(domain)
+			entry := domainEntry{domain: domain, list: list.list, protocol: list.protocol, policy: list.policy}
+			err := m.resolveDomain(entry, update)
+			resolve.End(err)
 			if err != nil {
 				return err
 			}
@@ -367,184 +981,427 @@ func (m *Manager) setDeniedCIDRList() error {
 	return nil
 }
 
-func (m *Manager) initDomainList() error {
-	for _, domain := range m.config.RestrictedNetworkConfig.Domain.Deny {
-		answer, err := m.ResolveAddressv4(domain)
-		if err != nil {
-			log.Debug(fmt.Sprintf("%s (A) resolve failed. %s\n", domain, err))
-			continue
-		}
+// initDomain writes the A and the AAAA records of the domain of entry, unless the preload file has.
+func (m *Manager) initDomain(span *timing.Span, entry domainEntry, update func(answer *DNSAnswer) error) error {
+	if m.preload.hasDomain(entry.domain) {
+		return nil
+	}
+	resolve := span.Begin(entry.domain)
+	err := m.resolveDomain(entry, update)
+	resolve.End(err)
+	return err
+}
 
-		log.Debug(fmt.Sprintf("%s (A) is %#v, TTL is %d\n", answer.Domain, answer.Addresses, answer.TTL))
-		err = m.updateDeniedFQDNList(answer)
-		if err != nil {
-			return err
+// resolveDomain writes the A and the AAAA records of the domain of entry. Either may be missing,
+// e.g. an IPv6-only domain has no A record. The records of a family network.families leaves
+// out are not looked up.
+//
+// A domain none of whose records resolve is skipped with a warning and retried by the refreshes,
+// or fails with network.domain.strict.
+func (m *Manager) resolveDomain(entry domainEntry, update func(answer *DNSAnswer) error) error {
+	domain := entry.domain
+	disabled := m.disabledFamilies()
+	var lastErr error
+	for _, lookup := range []struct {
+		recordType uint16
+		family     uint32
+		resolve    func(domain string) (*DNSAnswer, error)
+	}{
+		{recordType: dns.TypeA, family: FAMILY_IPV4, resolve: m.ResolveAddressv4},
+		{recordType: dns.TypeAAAA, family: FAMILY_IPV6, resolve: m.ResolveAddressv6},
+	} {
+		if disabled&lookup.family != 0 {
+			continue
 		}
-
-		answer, err = m.ResolveAddressv6(domain)
+		answer, err := lookup.resolve(domain)
+		m.unresolved.record(entry, lookup.recordType, err == nil)
 		if err != nil {
-			log.Debug(fmt.Sprintf("%s (AAAA) resolve failed. %s\n", domain, err))
+			log.Debug(fmt.Sprintf("%s (%s) resolve failed. %s\n", domain, dns.TypeToString[lookup.recordType], err))
+			lastErr = err
 			continue
 		}
 
-		log.Debug(fmt.Sprintf("%s (AAAA) is %#v, TTL is %d\n", answer.Domain, answer.Addresses, answer.TTL))
-		err = m.updateDeniedFQDNList(answer)
-		if err != nil {
+		log.Debug(fmt.Sprintf("%s (%s) is %#v, TTL is %d\n", answer.Domain, dns.TypeToString[lookup.recordType], answer.Addresses, answer.TTL))
+		if err := update(answer); err != nil {
 			return err
 		}
+		m.startupTTLs.set(entry, lookup.recordType, answer.TTL)
 	}
 
-	for _, domain := range m.config.RestrictedNetworkConfig.Domain.Allow {
-		answer, err := m.ResolveAddressv4(domain)
-		if err != nil {
-			log.Debug(fmt.Sprintf("%s (A) resolve failed. %s\n", domain, err))
-			continue
-		}
+	if !m.unresolved.contains(entry) {
+		return nil
+	}
+	if m.config.RestrictedNetworkConfig.Domain.Strict {
+		return fmt.Errorf("network.domain.strict: %s (%s) does not resolve: %w", domain, entry.listName(), lastErr)
+	}
+	log.Warn(fmt.Sprintf("%s (%s) does not resolve, it is skipped and resolved again every %s: %s", domain, entry.listName(), DNS_RETRY_INTERVAL, lastErr))
+	return nil
+}
 
-		log.Debug(fmt.Sprintf("%s (A) is %#v, TTL is %d\n", answer.Domain, answer.Addresses, answer.TTL))
-		err = m.updateAllowedFQDNist(answer)
-		if err != nil {
-			return err
-		}
+// domainList is a protocol list of network.domain, or a domain list of an entry of network.policies.
+type domainList struct {
+	// list is SNAPSHOT_LIST_ALLOW or SNAPSHOT_LIST_DENY.
+	list     string
+	protocol uint8
+	// policy is the name of the entry of network.policies whose tag protocol is, if set.
+	policy  string
+	domains []string
+}
 
-		answer, err = m.ResolveAddressv6(domain)
-		if err != nil {
-			log.Debug(fmt.Sprintf("%s (AAAA) resolve failed. %s\n", domain, err))
-			continue
+// protocolDomainLists returns the protocol lists of domain with entries, the allow list of a
+// protocol first.
+func protocolDomainLists(domain config.DomainConfig) []domainList {
+	lists := []domainList{}
+	for _, protocol := range ruleProtocols {
+		allow, deny := config.ProtocolLists(domain.Protocols, protocol)
+		for _, list := range []domainList{
+			{list: SNAPSHOT_LIST_ALLOW, protocol: protocolSockType(protocol), domains: allow},
+			{list: SNAPSHOT_LIST_DENY, protocol: protocolSockType(protocol), domains: deny},
+		} {
+			if len(list.domains) > 0 {
+				lists = append(lists, list)
+			}
 		}
+	}
+	return lists
+}
 
-		log.Debug(fmt.Sprintf("%s (AAAA) is %#v, TTL is %d\n", answer.Domain, answer.Addresses, answer.TTL))
-		err = m.updateAllowedFQDNist(answer)
-		if err != nil {
-			return err
+// policyDomainLists returns the domain lists of the entries of network.policies with entries,
+// the allow list of an entry first.
+func policyDomainLists(entries []config.PolicyEntryConfig) []domainList {
+	lists := []domainList{}
+	for i, entry := range entries {
+		for _, list := range []domainList{
+			{list: SNAPSHOT_LIST_ALLOW, protocol: policy.EntryTag(i), policy: entry.Name, domains: entry.Domain.Allow},
+			{list: SNAPSHOT_LIST_DENY, protocol: policy.EntryTag(i), policy: entry.Name, domains: entry.Domain.Deny},
+		} {
+			if len(list.domains) > 0 {
+				lists = append(lists, list)
+			}
 		}
 	}
-
-	return nil
+	return lists
 }
 
 func (m *Manager) updateAllowedFQDNist(answer *DNSAnswer) error {
-	allowedAddresses, err := domainNameToBPFMapKey(answer.Domain, answer.Addresses)
+	return m.updateFQDNList(answer, SNAPSHOT_LIST_ALLOW, ALLOWED_V4_CIDR_LIST_MAP_NAME, ALLOWED_V6_CIDR_LIST_MAP_NAME)
+}
+
+func (m *Manager) updateDeniedFQDNList(answer *DNSAnswer) error {
+	return m.updateFQDNList(answer, SNAPSHOT_LIST_DENY, DENIED_V4_CIDR_LIST_MAP_NAME, DENIED_V6_CIDR_LIST_MAP_NAME)
+}
+
+// updateProtocolFQDNList writes the resolved addresses of a domain of the list of protocol.
+func (m *Manager) updateProtocolFQDNList(answer *DNSAnswer, list string, protocol uint8) error {
+	if list == SNAPSHOT_LIST_DENY {
+		return m.writeFQDNList(answer, list, protocol, DENIED_V4_PROTOCOL_CIDR_LIST_MAP_NAME, DENIED_V6_PROTOCOL_CIDR_LIST_MAP_NAME)
+	}
+	return m.writeFQDNList(answer, list, protocol, ALLOWED_V4_PROTOCOL_CIDR_LIST_MAP_NAME, ALLOWED_V6_PROTOCOL_CIDR_LIST_MAP_NAME)
+}
+
+// updateEntryFQDNList writes the resolved addresses of a domain of the list of the entry of
+// network.policies of tag.
+func (m *Manager) updateEntryFQDNList(answer *DNSAnswer, list string, tag uint8) error {
+	if list == SNAPSHOT_LIST_DENY {
+		return m.writeFQDNList(answer, list, tag, DENIED_V4_ENTRY_CIDR_LIST_MAP_NAME, DENIED_V6_ENTRY_CIDR_LIST_MAP_NAME)
+	}
+	return m.writeFQDNList(answer, list, tag, ALLOWED_V4_ENTRY_CIDR_LIST_MAP_NAME, ALLOWED_V6_ENTRY_CIDR_LIST_MAP_NAME)
+}
+
+func (m *Manager) updateFQDNList(answer *DNSAnswer, list string, v4MapName, v6MapName string) error {
+	return m.writeFQDNList(answer, list, PROTOCOL_ALL, v4MapName, v6MapName)
+}
+
+// writeFQDNList writes the resolved addresses of a domain and publishes the change, if any.
+func (m *Manager) writeFQDNList(answer *DNSAnswer, list string, protocol uint8, v4MapName, v6MapName string) error {
+	addresses, err := domainNameToBPFMapKey(answer.Domain, answer.Addresses, protocol)
 	if err != nil {
 		return err
 	}
 
-	for _, addr := range allowedAddresses {
+	// Two entries of network.policies can list the same domain: each keeps its own addresses.
+	owner := answer.Domain
+	if isEntryCIDRList(v4MapName) {
+		owner = fmt.Sprintf("%s#%d", answer.Domain, protocol)
+	}
+
+	change := notify.DNSRuleChange{Domain: answer.Domain, List: list}
+	keys := map[string][][]byte{}
+	for _, addr := range addresses {
+		mapName := v4MapName
 		if addr.isV6address() {
-			if err = m.cidrListUpdate(addr, ALLOWED_V6_CIDR_LIST_MAP_NAME); err != nil {
-				return err
-			}
-		} else {
-			if err = m.cidrListUpdate(addr, ALLOWED_V4_CIDR_LIST_MAP_NAME); err != nil {
-				return err
-			}
+			mapName = v6MapName
+		}
+		// The DNS proxy relays the answers of both families.
+		if m.familyDisabled(mapName) {
+			continue
+		}
+
+		n := &net.IPNet{IP: addr.address, Mask: addr.cidrMask}
+		if !m.Policy().hasCIDR(mapName, protocol, n) {
+			change.Added = append(change.Added, n.String())
+		}
+		addr.monitored = m.monitoredDomain(answer.Domain)
+		if err = m.cidrListUpdate(addr, mapName); err != nil {
+			// The addresses written so far are kept until the domain resolves again.
+			m.recordResolved(owner, keys, false)
+			return err
 		}
+		keys[mapName] = append(keys[mapName], addr.key)
 	}
 
-	return nil
+	// The DNS proxy adds the addresses of every answer it relays, since the clients may still
+	// connect to those of an earlier one. A resolution of bouheki replaces the previous one.
+	released := m.recordResolved(owner, keys, !m.currentConfig().DNSProxyConfig.Enable)
+	for _, entry := range released {
+		if err := m.cidrListDeleteKey(entry.mapName, []byte(entry.key)); err != nil {
+			return err
+		}
+		_, n := cidrKeyToIPNet(entry.mapName, []byte(entry.key))
+		change.Removed = append(change.Removed, n.String())
+		log.Debug(fmt.Sprintf("%s: removed %s, which it no longer resolves to", answer.Domain, n))
+	}
+
+	removed, err := m.reconcilePreloaded(answer.Domain, addresses, v4MapName, v6MapName)
+	change.Removed = append(change.Removed, removed...)
+	if m.healer != nil && list == SNAPSHOT_LIST_ALLOW && protocol == PROTOCOL_ALL {
+		m.healer.remember(answer)
+	}
+	m.publishDNSRuleChange(change)
+	return err
 }
 
-func (m *Manager) updateDeniedFQDNList(answer *DNSAnswer) error {
-	deniedAddresses, err := domainNameToBPFMapKey(answer.Domain, answer.Addresses)
-	if err != nil {
-		return err
+// recordResolved records keys, the addresses domain resolved to by map, in resolved, and returns
+// the addresses that no domain resolves to any more, see domainCache.set.
+func (m *Manager) recordResolved(domain string, keys map[string][][]byte, replace bool) []ledgerKey {
+	m.resolvedMu.Lock()
+	defer m.resolvedMu.Unlock()
+
+	mapNames := []string{}
+	for mapName := range keys {
+		mapNames = append(mapNames, mapName)
 	}
+	sort.Strings(mapNames)
 
-	for _, addr := range deniedAddresses {
-		if addr.isV6address() {
-			err = m.cidrListUpdate(addr, DENIED_V6_CIDR_LIST_MAP_NAME)
-			if err != nil {
-				return err
-			}
-		} else {
-			err = m.cidrListUpdate(addr, DENIED_V4_CIDR_LIST_MAP_NAME)
-			if err != nil {
-				return err
-			}
+	defer m.resolvedChanged()
+
+	released := []ledgerKey{}
+	for _, mapName := range mapNames {
+		for _, key := range m.resolved.set(mapName, domain, keys[mapName], replace, m.config.RestrictedNetworkConfig.Domain.Refresh.RemoveAfter) {
+			released = append(released, ledgerKey{mapName: mapName, key: string(key)})
 		}
 	}
+	return released
+}
 
-	return nil
+func (m *Manager) publishDNSRuleChange(change notify.DNSRuleChange) {
+	if len(change.Added) == 0 && len(change.Removed) == 0 {
+		return
+	}
+	notify.Publish(change, m.Policy().Digest())
 }
 
+// cidrListDeleteKey deletes a preloaded address, or one a domain no longer resolves to, unless
+// the config, a rule set, the self exemption, a runtime rule or live resolution of another domain
+// has written it too.
 func (m *Manager) cidrListDeleteKey(mapName string, key []byte) error {
-	cidr_list, err := m.mod.GetMap(mapName)
+	if _, ok := m.holder(mapName, key); ok {
+		return nil
+	}
+
+	cidr_list, err := m.policyMap(mapName)
 	if err != nil {
 		return err
 	}
 
-	if err := cidr_list.DeleteKey(unsafe.Pointer(&key[0])); err != nil {
+	if err := cidr_list.DeleteKey(key); err != nil {
 		return err
 	}
+	protocol, n := cidrKeyToIPNet(mapName, key)
+	m.Policy().deleteCIDR(mapName, protocol, n)
+	if mapName == DENIED_V4_CIDR_LIST_MAP_NAME || mapName == DENIED_V6_CIDR_LIST_MAP_NAME {
+		m.Policy().setExcept(n, false)
+		m.Policy().setMonitored(n, false)
+	}
 	return nil
 }
 
+// cidrListUpdate writes addr, an address of live resolution, to mapName and confirms it if it was
+// preloaded. writeFQDNList records it in resolved once the answer is written.
 func (m *Manager) cidrListUpdate(addr IPAddress, mapName string) error {
-	cidr_list, err := m.mod.GetMap(mapName)
+	if err := m.writeCIDR(addr, mapName); err != nil {
+		return err
+	}
+	m.preload.confirm(mapName, addr.key)
+	return nil
+}
+
+// resolvedAddress reports whether live resolution has written key to mapName.
+func (m *Manager) resolvedAddress(mapName string, key []byte) bool {
+	m.resolvedMu.Lock()
+	defer m.resolvedMu.Unlock()
+	return m.resolved.has(mapName, key)
+}
+
+func (m *Manager) writeCIDR(addr IPAddress, mapName string) error {
+	cidr_list, err := m.policyMap(mapName)
 	if err != nil {
 		return err
 	}
-	value := uint8(0)
-	// NOTE: Slices and arrays are supported but references should be passed to the first element in the slice or array.
-	err = cidr_list.Update(unsafe.Pointer(&addr.key[0]), unsafe.Pointer(&value))
+	value := m.denyValue(addr, mapName)
+	err = cidr_list.Update(addr.key, value)
 	if err != nil {
 		return err
 	}
+	n := &net.IPNet{IP: addr.address, Mask: addr.cidrMask}
+	m.Policy().addCIDR(mapName, addr.protocol, n)
+	if bytes.Equal(value, exceptValue()) {
+		m.Policy().setExcept(n, true)
+	}
+	if mapName == DENIED_V4_CIDR_LIST_MAP_NAME || mapName == DENIED_V6_CIDR_LIST_MAP_NAME {
+		m.Policy().setMonitored(n, bytes.Equal(value, monitorValue()))
+	}
 	return nil
 }
 
+// denyValue returns the value addr is written to mapName with: the one of denyEntryValue, or
+// DENY_ENTRY_MONITOR for an address of a domain of network.domain.monitor in the deny list, as
+// long as no prefix that denies whatever mode: monitor has it and no other deny entry wrote it.
+func (m *Manager) denyValue(addr IPAddress, mapName string) []byte {
+	network := m.config.RestrictedNetworkConfig
+	value := denyEntryValue(mapName, addr.key, policy.ExceptPrefixes(network))
+	if !addr.monitored || !bytes.Equal(value, entryValue()) {
+		return value
+	}
+	if mapName != DENIED_V4_CIDR_LIST_MAP_NAME && mapName != DENIED_V6_CIDR_LIST_MAP_NAME {
+		return value
+	}
+	n := &net.IPNet{IP: addr.address, Mask: addr.cidrMask}
+	if _, denied := policy.MonitorPrefixes(network); policy.InsidePrefixes(n, denied) {
+		return value
+	}
+	if m.Policy().hasCIDR(mapName, addr.protocol, n) && !m.Policy().HasCIDR(policy.LIST_DENY_MONITOR_CIDR, PROTOCOL_ALL, n) {
+		return value
+	}
+	return monitorValue()
+}
+
+// monitoredDomain reports whether domain, a domain or a wildcard pattern, is an entry of
+// network.domain.monitor.
+func (m *Manager) monitoredDomain(domain string) bool {
+	for _, entry := range m.config.RestrictedNetworkConfig.Domain.Monitor {
+		if toCanonicalDomain(entry) == toCanonicalDomain(domain) {
+			return true
+		}
+	}
+	return false
+}
+
 func cidrToBPFMapKey(cidr string) (IPAddress, error) {
 	ipaddr := IPAddress{}
-	_, n, err := net.ParseCIDR(cidr)
+	n, zone, err := policy.ParseCIDR(cidr)
 	if err != nil {
 		return ipaddr, err
 	}
 	ipaddr.address = n.IP
 	ipaddr.cidrMask = n.Mask
-	ipaddr.ipAddressToBPFMapKey()
+	ipaddr.zone = zone
+
+	if zone != "" {
+		log.Warn(fmt.Sprintf("%s: zone %q is ignored because interface-scoped rules are not supported. The rule applies to %s on all interfaces.", cidr, zone, n.String()))
+	}
+
+	if _, err := ipaddr.ipAddressToBPFMapKey(); err != nil {
+		return ipaddr, fmt.Errorf("%s: %w", cidr, err)
+	}
 	return ipaddr, nil
 }
 
-func domainNameToBPFMapKey(host string, addresses []net.IP) ([]IPAddress, error) {
+func domainNameToBPFMapKey(host string, addresses []net.IP, protocol uint8) ([]IPAddress, error) {
 	var addrs = []IPAddress{}
 	for _, addr := range addresses {
-		ipaddr := IPAddress{address: addr}
+		if v4 := addr.To4(); v4 != nil {
+			addr = v4
+		}
+		ipaddr := IPAddress{address: addr, protocol: protocol}
 		if ipaddr.isV6address() {
 			ipaddr.cidrMask = net.CIDRMask(128, 128)
 		} else {
 			ipaddr.cidrMask = net.CIDRMask(32, 32)
 		}
-		ipaddr.ipAddressToBPFMapKey()
+		if _, err := ipaddr.ipAddressToBPFMapKey(); err != nil {
+			return nil, fmt.Errorf("%s: %w", host, err)
+		}
 		addrs = append(addrs, ipaddr)
 	}
 
 	return addrs, nil
 }
 
-func ipv4ToKey(n net.IPNet) []byte {
+// ipv4ToKey returns the key of n in the v4 lists of protocol. A key of the protocol lists starts
+// with the socket type, which the prefix covers.
+func ipv4ToKey(n net.IPNet, protocol uint8) ([]byte, error) {
+	prefixLen, err := keyPrefixLen(n, net.IPv4len)
+	if err != nil {
+		return nil, err
+	}
+
 	key := make([]byte, 16)
-	prefixLen, _ := n.Mask.Size()
+	if protocol != PROTOCOL_ALL {
+		key = make([]byte, 12)
+	}
+	putAddressKey(key, n.IP, prefixLen, protocol)
+	return key, nil
+}
 
-	binary.LittleEndian.PutUint32(key[0:4], uint32(prefixLen))
-	copy(key[4:], n.IP)
+func ipv6ToKey(n net.IPNet, protocol uint8) ([]byte, error) {
+	prefixLen, err := keyPrefixLen(n, net.IPv6len)
+	if err != nil {
+		return nil, err
+	}
 
-	return key
+	key := make([]byte, 20)
+	if protocol != PROTOCOL_ALL {
+		key = make([]byte, 24)
+	}
+	putAddressKey(key, n.IP, prefixLen, protocol)
+	return key, nil
 }
 
-func ipv6ToKey(n net.IPNet) []byte {
-	key := make([]byte, 20)
-	prefixLen, _ := n.Mask.Size()
+func putAddressKey(key []byte, ip net.IP, prefixLen int, protocol uint8) {
+	if protocol == PROTOCOL_ALL {
+		binary.LittleEndian.PutUint32(key[0:4], uint32(prefixLen))
+		copy(key[4:], ip)
+		return
+	}
+	binary.LittleEndian.PutUint32(key[0:4], uint32(PROTOCOL_KEY_BITS+prefixLen))
+	key[4] = protocol
+	copy(key[5:], ip)
+}
 
-	binary.LittleEndian.PutUint32(key[0:4], uint32(prefixLen))
-	copy(key[4:], n.IP)
+// keyPrefixLen returns the prefix length of n after checking that the address and
+// the mask are addrLen bytes long and that the mask is a prefix.
+func keyPrefixLen(n net.IPNet, addrLen int) (int, error) {
+	if len(n.IP) != addrLen {
+		return 0, fmt.Errorf("%w: %s is %d bytes long, expected %d", ErrInvalidMapKey, n.IP, len(n.IP), addrLen)
+	}
 
-	return key
+	prefixLen, bits := n.Mask.Size()
+	if bits != addrLen*8 {
+		return 0, fmt.Errorf("%w: mask %s is not a prefix of %d bits", ErrInvalidMapKey, n.Mask, addrLen*8)
+	}
+
+	return prefixLen, nil
 }
 
+// byteToKey returns the command key as the kernel stores a comm, see policy.CommandKey.
 func byteToKey(b []byte) []byte {
-	key := make([]byte, 16)
-	copy(key[0:], b)
-	return key
+	return policy.CommandKey(string(b))
+}
+
+// CommandKey returns the key of command in the command lists.
+func CommandKey(command string) []byte {
+	return policy.CommandKey(command)
 }
 
 func uintToKey(i uint) []byte {
@@ -552,3 +1409,77 @@ func uintToKey(i uint) []byte {
 	binary.LittleEndian.PutUint32(key[0:4], uint32(i))
 	return key
 }
+
+// portPrefix is an entry of the port lists.
+type portPrefix = policy.PortPrefix
+
+// portToKey returns the key of p in the port lists: the prefix length, and the port in network
+// byte order as the trie compares it, padded to the size of struct port_trie_key.
+func portToKey(p portPrefix) []byte {
+	key := make([]byte, 8)
+	binary.LittleEndian.PutUint32(key[0:4], uint32(p.PrefixLen))
+	binary.BigEndian.PutUint16(key[4:6], p.Port)
+	return key
+}
+
+// uidPrefix is an entry of the uid range lists.
+type uidPrefix = policy.UIDPrefix
+
+// uidPrefixToKey returns the key of p in the uid range lists, struct uid_trie_key: the prefix
+// length, and the uid in network byte order as the trie compares it.
+func uidPrefixToKey(p uidPrefix) []byte {
+	key := make([]byte, 8)
+	binary.LittleEndian.PutUint32(key[0:4], uint32(p.PrefixLen))
+	binary.BigEndian.PutUint32(key[4:8], p.UID)
+	return key
+}
+
+// keyToUIDPrefix is the inverse of uidPrefixToKey.
+func keyToUIDPrefix(key []byte) uidPrefix {
+	return uidPrefix{UID: binary.BigEndian.Uint32(key[4:8]), PrefixLen: int(binary.LittleEndian.Uint32(key[0:4]))}
+}
+
+// pathToKey returns the key of a path rule in the path lists, struct path_trie_key: the prefix
+// length in bits, and the path. An executable is followed by its NUL, which is in the prefix, so
+// that it only matches itself, while a directory ending with / prefixes the executables below it.
+func pathToKey(path string) []byte {
+	key := make([]byte, 4+policy.EXE_PATH_LEN)
+	n := copy(key[4:], path)
+	if !policy.IsPathPrefix(path) {
+		n++
+	}
+	binary.LittleEndian.PutUint32(key[0:4], uint32(n*8))
+	return key
+}
+
+// keyToPath is the inverse of pathToKey.
+func keyToPath(key []byte) string {
+	n := int(binary.LittleEndian.Uint32(key[0:4]) / 8)
+	return string(bytes.TrimRight(key[4:4+n], "\x00"))
+}
+
+// commandPatternValue returns the value of a pattern in the pattern lists, struct
+// command_pattern: the lengths of the prefix and the suffix, and both, NUL padded.
+func commandPatternValue(pattern config.CommandPattern) []byte {
+	value := make([]byte, COMMAND_PATTERN_VALUE_SIZE)
+	binary.LittleEndian.PutUint32(value[0:4], uint32(len(pattern.Prefix)))
+	binary.LittleEndian.PutUint32(value[4:8], uint32(len(pattern.Suffix)))
+	copy(value[8:8+TASK_COMM_LEN], pattern.Prefix)
+	copy(value[8+TASK_COMM_LEN:], pattern.Suffix)
+	return value
+}
+
+// valueToCommandPattern is the inverse of commandPatternValue.
+func valueToCommandPattern(value []byte) config.CommandPattern {
+	prefixLen := binary.LittleEndian.Uint32(value[0:4])
+	suffixLen := binary.LittleEndian.Uint32(value[4:8])
+	return config.CommandPattern{
+		Prefix: string(value[8 : 8+prefixLen]),
+		Suffix: string(value[8+TASK_COMM_LEN : 8+TASK_COMM_LEN+suffixLen]),
+	}
+}
+
+// keyToPortPrefix is the inverse of portToKey.
+func keyToPortPrefix(key []byte) portPrefix {
+	return portPrefix{Port: binary.BigEndian.Uint16(key[4:6]), PrefixLen: int(binary.LittleEndian.Uint32(key[0:4]))}
+}
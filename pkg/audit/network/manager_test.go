@@ -1,11 +1,20 @@
 package network
 
 import (
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/errkind"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -51,11 +60,140 @@ func Test_cidrToBPFMapKey(t *testing.T) {
 	}
 }
 
+func Test_cidrToBPFMapKeyWithZone(t *testing.T) {
+	tests := []struct {
+		name     string
+		cidr     string
+		expected IPAddress
+		hasError bool
+	}{
+		{
+			name: "The zone of a link-local address is stripped from the key and recorded",
+			cidr: "fe80::1%eth0/64",
+			expected: IPAddress{
+				address:  net.IP{0xfe, 0x80, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0},
+				cidrMask: net.CIDRMask(64, 128),
+				key:      []byte{0x40, 0x0, 0x0, 0x0, 0xfe, 0x80, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0},
+				zone:     "eth0",
+			},
+		},
+		{
+			name: "Numeric zones are accepted",
+			cidr: "fe80::1%2/128",
+			expected: IPAddress{
+				address:  net.IP{0xfe, 0x80, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x1},
+				cidrMask: net.CIDRMask(128, 128),
+				key:      []byte{0x80, 0x0, 0x0, 0x0, 0xfe, 0x80, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x1},
+				zone:     "2",
+			},
+		},
+		{
+			name:     "A zone on an IPv4 address is an error",
+			cidr:     "192.168.1.1%eth0/24",
+			hasError: true,
+		},
+		{
+			name:     "A zone without a prefix length is an error",
+			cidr:     "fe80::1%eth0",
+			hasError: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ipaddr, err := cidrToBPFMapKey(test.cidr)
+			if test.hasError {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, test.expected, ipaddr)
+		})
+	}
+}
+
+func TestSetCIDRListClassifiesInvalidCIDRAsConfigError(t *testing.T) {
+	conf := config.DefaultConfig()
+	conf.RestrictedNetworkConfig.CIDR.Allow = []string{"10.0.0.0/33"}
+	mgr := Manager{config: conf}
+
+	_, err := mgr.desiredState()
+	assert.Equal(t, errkind.Config, errkind.KindOf(err))
+	assert.Contains(t, err.Error(), "network.cidr.allow")
+
+	conf.RestrictedNetworkConfig.CIDR.Allow = nil
+	conf.RestrictedNetworkConfig.CIDR.Deny = []string{"192.168.1.1"}
+	_, err = mgr.desiredState()
+	assert.Equal(t, errkind.Config, errkind.KindOf(err))
+	assert.Contains(t, err.Error(), "network.cidr.deny")
+}
+
+func Test_isLSMUnavailable(t *testing.T) {
+	assert.True(t, isLSMUnavailable(fmt.Errorf("failed to attach lsm to program socket_connect: %w", ENOTSUPP)))
+	assert.True(t, isLSMUnavailable(fmt.Errorf("failed to attach lsm to program socket_connect: %w", syscall.EOPNOTSUPP)))
+	assert.False(t, isLSMUnavailable(fmt.Errorf("failed to attach lsm to program socket_connect: %w", syscall.EPERM)))
+	assert.False(t, isLSMUnavailable(errors.New("program socket_connect not found")))
+}
+
+func TestSetModeWithFallback(t *testing.T) {
+	tests := []struct {
+		name        string
+		mode        string
+		enforcement string
+		expected    uint32
+	}{
+		{name: "block with LSM", mode: "block", enforcement: ENFORCEMENT_LSM, expected: MODE_BLOCK},
+		{name: "block with the monitor-only fallback", mode: "block", enforcement: ENFORCEMENT_KPROBE_MONITOR, expected: MODE_MONITOR},
+		{name: "block with the signal fallback", mode: "block", enforcement: ENFORCEMENT_KPROBE_SIGNAL, expected: MODE_BLOCK},
+		{name: "monitor with the signal fallback", mode: "monitor", enforcement: ENFORCEMENT_KPROBE_SIGNAL, expected: MODE_MONITOR},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conf := config.DefaultConfig()
+			conf.RestrictedNetworkConfig.Mode = test.mode
+			mgr := Manager{config: conf}
+			mgr.setEnforcement(test.enforcement)
+
+			key := mgr.setMode(make([]byte, MAP_SIZE))
+			assert.Equal(t, test.expected, binary.LittleEndian.Uint32(key[MAP_MODE_START:MAP_MODE_END]))
+			assert.Equal(t, test.enforcement, mgr.Enforcement())
+		})
+	}
+}
+
+func Test_byteToKey(t *testing.T) {
+	tests := []struct {
+		name     string
+		command  string
+		expected []byte
+	}{
+		{name: "short command is NUL padded", command: "curl", expected: []byte{'c', 'u', 'r', 'l', 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}},
+		{name: "whitespace is kept", command: "curl ", expected: []byte{'c', 'u', 'r', 'l', ' ', 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}},
+		{name: "15 bytes fit", command: "systemd-resolve", expected: append([]byte("systemd-resolve"), 0)},
+		{name: "longer commands are truncated like the kernel comm", command: "very-long-command-name", expected: append([]byte("very-long-comma"), 0)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, byteToKey([]byte(test.command)))
+			assert.Equal(t, test.expected, CommandKey(test.command))
+		})
+	}
+}
+
+func Test_portToKey(t *testing.T) {
+	key := portToKey(portPrefix{Port: 8080, PrefixLen: 16})
+	assert.Equal(t, []byte{16, 0, 0, 0, 0x1f, 0x90, 0, 0}, key)
+	assert.Equal(t, portPrefix{Port: 8080, PrefixLen: 16}, keyToPortPrefix(key))
+}
+
 func Test_ipAddressToBPFMapKey(t *testing.T) {
 	tests := []struct {
 		name      string
 		ipAddress IPAddress
 		expected  []byte
+		hasError  bool
 	}{
 		{
 			name: "IPv4",
@@ -73,15 +211,88 @@ func Test_ipAddressToBPFMapKey(t *testing.T) {
 			},
 			expected: []byte{0x80, 0x0, 0x0, 0x0, 0x20, 0x1, 0x39, 0x84, 0x39, 0x89, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x3},
 		},
+		{
+			name: "IPv6 address with an IPv4 mask is an error",
+			ipAddress: IPAddress{
+				address:  net.ParseIP("2001:db8::1"),
+				cidrMask: net.CIDRMask(24, 32),
+			},
+			hasError: true,
+		},
+		{
+			name: "Non-prefix mask is an error",
+			ipAddress: IPAddress{
+				address:  net.IP{0xc0, 0xa8, 0x1, 0x1},
+				cidrMask: net.IPMask{0xff, 0x0, 0xff, 0x0},
+			},
+			hasError: true,
+		},
+		{
+			name: "IPv4-mapped IPv6 address with an IPv6 mask",
+			ipAddress: IPAddress{
+				address:  net.ParseIP("::ffff:192.168.1.1"),
+				cidrMask: net.CIDRMask(120, 128),
+			},
+			expected: []byte{0x18, 0x0, 0x0, 0x0, 0xc0, 0xa8, 0x1, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0},
+		},
+		{
+			name: "16 byte IPv4 address with an IPv4 mask",
+			ipAddress: IPAddress{
+				address:  net.ParseIP("192.168.1.1"),
+				cidrMask: net.CIDRMask(24, 32),
+			},
+			expected: []byte{0x18, 0x0, 0x0, 0x0, 0xc0, 0xa8, 0x1, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0},
+		},
 	}
 
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			assert.Equal(t, test.expected, test.ipAddress.ipAddressToBPFMapKey())
+			key, err := test.ipAddress.ipAddressToBPFMapKey()
+			if test.hasError {
+				assert.ErrorIs(t, err, ErrInvalidMapKey)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, test.expected, key)
 		})
 	}
 }
 
+func Test_ipv6ToKey(t *testing.T) {
+	_, err := ipv6ToKey(net.IPNet{IP: net.IP{10, 0, 0, 0}, Mask: net.CIDRMask(8, 128)}, PROTOCOL_ALL)
+	assert.ErrorIs(t, err, ErrInvalidMapKey)
+
+	_, err = ipv6ToKey(net.IPNet{IP: net.ParseIP("2001:db8::"), Mask: net.CIDRMask(32, 32)}, PROTOCOL_ALL)
+	assert.ErrorIs(t, err, ErrInvalidMapKey)
+
+	_, err = ipv4ToKey(net.IPNet{IP: net.ParseIP("10.0.0.0"), Mask: net.CIDRMask(8, 32)}, PROTOCOL_ALL)
+	assert.ErrorIs(t, err, ErrInvalidMapKey, "a 16 byte IPv4 address must be converted before building the key")
+
+	key, err := ipv6ToKey(net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}, PROTOCOL_ALL)
+	assert.Nil(t, err)
+	assert.Equal(t, make([]byte, 20), key)
+}
+
+func Test_protocolKeys(t *testing.T) {
+	_, n, _ := net.ParseCIDR("10.0.0.53/32")
+	key, err := ipv4ToKey(net.IPNet{IP: n.IP.To4(), Mask: n.Mask}, UDP)
+	assert.Nil(t, err)
+	// The prefix covers the socket type, which comes before the address.
+	assert.Equal(t, []byte{40, 0, 0, 0, UDP, 10, 0, 0, 53, 0, 0, 0}, key)
+	protocol, decoded := cidrKeyToIPNet(ALLOWED_V4_PROTOCOL_CIDR_LIST_MAP_NAME, key)
+	assert.Equal(t, uint8(UDP), protocol)
+	assert.Equal(t, "10.0.0.53/32", decoded.String())
+
+	_, n, _ = net.ParseCIDR("2001:db8::/32")
+	key, err = ipv6ToKey(*n, TCP)
+	assert.Nil(t, err)
+	assert.Len(t, key, 24)
+	assert.Equal(t, []byte{40, 0, 0, 0, TCP, 0x20, 0x01, 0x0d, 0xb8}, key[:9])
+	protocol, decoded = cidrKeyToIPNet(DENIED_V6_PROTOCOL_CIDR_LIST_MAP_NAME, key)
+	assert.Equal(t, uint8(TCP), protocol)
+	assert.Equal(t, "2001:db8::/32", decoded.String())
+}
+
 func Test_domainNameToBPFMapKey(t *testing.T) {
 	tests := []struct {
 		name       string
@@ -98,21 +309,49 @@ func Test_domainNameToBPFMapKey(t *testing.T) {
 			},
 			expected: []IPAddress{
 				{
-					address:  []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0xff, 0xff, 0xc0, 0xa8, 0x1, 0x1},
+					address:  []byte{0xc0, 0xa8, 0x1, 0x1},
 					cidrMask: net.IPMask{0xff, 0xff, 0xff, 0xff},
 					key:      []byte{0x20, 0x0, 0x0, 0x0, 0xc0, 0xa8, 0x1, 0x1, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0},
 				},
 				{
-					address:  []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0xff, 0xff, 0xa, 0x0, 0x1, 0x1},
+					address:  []byte{0xa, 0x0, 0x1, 0x1},
 					cidrMask: net.IPMask{0xff, 0xff, 0xff, 0xff},
 					key:      []byte{0x20, 0x0, 0x0, 0x0, 0xa, 0x0, 0x1, 0x1, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0},
 				},
 			},
 		},
+		{
+			name:       "IPv4-mapped IPv6 addresses in answers become IPv4 keys",
+			domainName: "mapped.example.com",
+			addresses: []net.IP{
+				net.ParseIP("::ffff:203.0.113.7"),
+			},
+			expected: []IPAddress{
+				{
+					address:  []byte{0xcb, 0x0, 0x71, 0x7},
+					cidrMask: net.IPMask{0xff, 0xff, 0xff, 0xff},
+					key:      []byte{0x20, 0x0, 0x0, 0x0, 0xcb, 0x0, 0x71, 0x7, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0},
+				},
+			},
+		},
+		{
+			name:       "link-local addresses in answers become /128 keys",
+			domainName: "link-local.example.com",
+			addresses: []net.IP{
+				net.ParseIP("fe80::1"),
+			},
+			expected: []IPAddress{
+				{
+					address:  net.ParseIP("fe80::1"),
+					cidrMask: net.CIDRMask(128, 128),
+					key:      []byte{0x80, 0x0, 0x0, 0x0, 0xfe, 0x80, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x1},
+				},
+			},
+		},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			addrs, err := domainNameToBPFMapKey(test.domainName, test.addresses)
+			addrs, err := domainNameToBPFMapKey(test.domainName, test.addresses, PROTOCOL_ALL)
 			if err != nil {
 				t.Errorf("domanNameToBPFMapKey return error: %#v", err)
 			}
@@ -140,15 +379,22 @@ func loadFixtureConfig(path string) *config.Config {
 	return conf
 }
 
-func createManager(conf *config.Config, dnsResolver DNSResolver) Manager {
-	mod, err := setupBPFProgram()
+func createManager(conf *config.Config, dnsResolver DNSResolver) *Manager {
+	sizes, err := NewMapSizes(conf.Resources)
+	if err != nil {
+		panic(err)
+	}
+	mod, hook, ancestors, err := setupBPFProgram(conf.RestrictedNetworkConfig.Enforcement.Hook, cgroupMatching(conf), restrictedOperations(conf), tracksExePaths(conf), sizes, "", nil)
 	if err != nil {
 		panic(err)
 	}
 
-	mgr := Manager{
+	mgr := &Manager{
 		mod:         mod,
 		config:      conf,
+		hook:        hook,
+		ancestors:   ancestors,
+		operations:  restrictedOperations(conf),
 		dnsResolver: dnsResolver,
 	}
 
@@ -159,3 +405,158 @@ func createManager(conf *config.Config, dnsResolver DNSResolver) Manager {
 
 	return mgr
 }
+
+type SpyRingBuffer struct {
+	eventsChannel chan []byte
+	stopped       bool
+	closed        bool
+}
+
+func (rb *SpyRingBuffer) Start() {}
+
+// Stop closes the events channel like libbpfgo does.
+func (rb *SpyRingBuffer) Stop() {
+	if !rb.stopped {
+		close(rb.eventsChannel)
+		rb.stopped = true
+	}
+}
+
+func (rb *SpyRingBuffer) Close() {
+	rb.Stop()
+	rb.closed = true
+}
+
+func newSpyManager() (*Manager, *[]*SpyRingBuffer) {
+	created := []*SpyRingBuffer{}
+	mgr := &Manager{config: config.DefaultConfig()}
+	mgr.initRingBuf = func(eventsChannel chan []byte) (ringBuffer, error) {
+		rb := &SpyRingBuffer{eventsChannel: eventsChannel}
+		created = append(created, rb)
+		return rb, nil
+	}
+	return mgr, &created
+}
+
+func assertChannelClosed(t *testing.T, eventsChannel chan []byte) {
+	select {
+	case _, ok := <-eventsChannel:
+		assert.False(t, ok, "events channel must be closed")
+	case <-time.After(time.Second):
+		t.Fatal("events channel was not closed")
+	}
+}
+
+func TestManagerLifecycle(t *testing.T) {
+	t.Run("Start and Close closes the events channel once", func(t *testing.T) {
+		mgr, created := newSpyManager()
+		eventsChannel := make(chan []byte)
+
+		assert.Nil(t, mgr.Start(eventsChannel))
+		assert.Nil(t, mgr.Start(eventsChannel))
+		mgr.Stop()
+		mgr.Close()
+		mgr.Close()
+
+		assert.Len(t, *created, 1)
+		assert.True(t, (*created)[0].closed)
+		assertChannelClosed(t, eventsChannel)
+	})
+
+	t.Run("Close before Start is safe and Start is rejected", func(t *testing.T) {
+		mgr, created := newSpyManager()
+		eventsChannel := make(chan []byte)
+
+		mgr.Stop()
+		mgr.Close()
+
+		assert.Equal(t, ErrManagerClosed, mgr.Start(eventsChannel))
+		assert.Len(t, *created, 0)
+		assertChannelClosed(t, eventsChannel)
+	})
+
+	t.Run("A failed Start closes the events channel", func(t *testing.T) {
+		mgr := &Manager{config: config.DefaultConfig()}
+		mgr.initRingBuf = func(eventsChannel chan []byte) (ringBuffer, error) {
+			return nil, errors.New("failed to initialize ring buffer")
+		}
+		eventsChannel := make(chan []byte)
+
+		assert.NotNil(t, mgr.Start(eventsChannel))
+		assertChannelClosed(t, eventsChannel)
+		assert.Equal(t, ErrEventsChannelClosed, mgr.Start(eventsChannel))
+		mgr.Close()
+	})
+
+	t.Run("A second channel passed to a started Manager is closed", func(t *testing.T) {
+		mgr, _ := newSpyManager()
+		eventsChannel := make(chan []byte)
+		unusedChannel := make(chan []byte)
+
+		assert.Nil(t, mgr.Start(eventsChannel))
+		assert.Nil(t, mgr.Start(unusedChannel))
+		assertChannelClosed(t, unusedChannel)
+
+		mgr.Close()
+		assertChannelClosed(t, eventsChannel)
+	})
+
+	t.Run("Close of a nil Manager is safe", func(t *testing.T) {
+		var mgr *Manager
+		mgr.Close()
+	})
+
+	t.Run("Close unpins the links unless bpf.keep_attached is set, and leaves the maps", func(t *testing.T) {
+		for keepAttached, pinned := range map[bool][]string{false: {}, true: {"socket_connect"}} {
+			pinPath := t.TempDir()
+			assert.Nil(t, os.MkdirAll(filepath.Join(pinPath, PIN_LINKS_DIR), 0700))
+			assert.Nil(t, os.WriteFile(filepath.Join(pinPath, PIN_LINKS_DIR, "socket_connect"), nil, 0600))
+			assert.Nil(t, os.WriteFile(filepath.Join(pinPath, RESTRICT_NETWORK_CONFIG_MAP_NAME), nil, 0600))
+
+			mgr, _ := newSpyManager()
+			mgr.config.BPF = config.BPFConfig{PinPath: pinPath, KeepAttached: keepAttached}
+			mgr.Close()
+
+			links, err := os.ReadDir(filepath.Join(pinPath, PIN_LINKS_DIR))
+			assert.Nil(t, err)
+			names := []string{}
+			for _, link := range links {
+				names = append(names, link.Name())
+			}
+			assert.Equal(t, pinned, names, keepAttached)
+			assert.FileExists(t, filepath.Join(pinPath, RESTRICT_NETWORK_CONFIG_MAP_NAME))
+		}
+	})
+}
+
+func TestManagerLifecycleConcurrentStartAndClose(t *testing.T) {
+	for i := 0; i < 200; i++ {
+		mgr, _ := newSpyManager()
+		eventsChannel := make(chan []byte)
+
+		var wg sync.WaitGroup
+		for j := 0; j < 4; j++ {
+			wg.Add(3)
+			go func() {
+				defer wg.Done()
+				err := mgr.Start(eventsChannel)
+				if err != nil && err != ErrManagerClosed {
+					t.Error(err)
+				}
+			}()
+			go func() {
+				defer wg.Done()
+				mgr.Stop()
+			}()
+			go func() {
+				defer wg.Done()
+				mgr.Close()
+			}()
+		}
+		wg.Wait()
+
+		mgr.Close()
+		assert.Equal(t, stateStopped, mgr.state)
+		assertChannelClosed(t, eventsChannel)
+	}
+}
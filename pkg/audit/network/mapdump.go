@@ -0,0 +1,193 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/mrtc0/bouheki/pkg/control"
+	"github.com/mrtc0/bouheki/pkg/policy"
+)
+
+// The sources of an entry of a map dump, by the writers of the maps.
+const (
+	DUMP_SOURCE_CONFIG          = "config"
+	DUMP_SOURCE_RULE_SET        = "rule_set"
+	DUMP_SOURCE_SELF_EXEMPTION  = "self_exemption"
+	DUMP_SOURCE_RUNTIME         = "runtime"
+	DUMP_SOURCE_DOMAIN          = "domain"
+	DUMP_SOURCE_WILDCARD_DOMAIN = "wildcard_domain"
+
+	// DUMP_VALUE_EXCEPT is the value of the entries of the deny CIDR lists inside a prefix of
+	// network.cidr.allow_except.
+	DUMP_VALUE_EXCEPT = "allow_except"
+	// DUMP_VALUE_MONITOR is the value of the entries of the deny CIDR lists and of the denied
+	// commands in mode: monitor.
+	DUMP_VALUE_MONITOR = "monitor"
+)
+
+// DumpMaps returns the entries every map of the rules has, in policyMapOrder and by key, with
+// their keys decoded and what wrote them. The config map is left out, `bouheki config dump`
+// shows it. It runs on the job queue, as the StateDocument does, so that no job writes the
+// maps while they are read.
+func (m *Manager) DumpMaps(ctx context.Context) ([]control.MapDump, error) {
+	dumps := make(chan []control.MapDump, 1)
+	err := m.Jobs().Snapshot(ctx, "map-dump", func(ctx context.Context) error {
+		maps, err := m.dumpMaps()
+		if err != nil {
+			return err
+		}
+		dumps <- maps
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return <-dumps, nil
+}
+
+func (m *Manager) dumpMaps() ([]control.MapDump, error) {
+	domains := m.keyDomains()
+	names := entryNames(m.currentConfig().RestrictedNetworkConfig.PolicyEntries())
+	cgroups := classifiedCgroups.snapshot()
+
+	maps := []control.MapDump{}
+	for _, mapName := range policyMapOrder {
+		if mapName == RESTRICT_NETWORK_CONFIG_MAP_NAME {
+			continue
+		}
+		entries, err := m.mapEntries(mapName)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", mapName, err)
+		}
+
+		dump := control.MapDump{Map: mapName, Count: len(entries), Entries: []control.MapEntry{}}
+		for _, key := range sortedKeys(entries) {
+			entry := dumpEntry(mapName, []byte(key), entries[key], names, cgroups)
+			entry.Sources = m.dumpSources(mapName, []byte(key))
+			entry.Domains = domains[ledgerKey{mapName: mapName, key: key}]
+			dump.Entries = append(dump.Entries, entry)
+		}
+		maps = append(maps, dump)
+	}
+	return maps, nil
+}
+
+// keyDomains returns the domains that live resolution, or the DNS proxy for a wildcard domain,
+// wrote each key for, by map and key. resolvedDomains has them by rule instead.
+func (m *Manager) keyDomains() map[ledgerKey][]string {
+	domains := map[ledgerKey][]string{}
+	m.resolvedMu.Lock()
+	for mapName, byDomain := range m.resolved.keys {
+		for domain, keys := range byDomain {
+			for _, key := range keys {
+				id := ledgerKey{mapName: mapName, key: string(key)}
+				domains[id] = append(domains[id], toCanonicalDomain(domain))
+			}
+		}
+	}
+	m.resolvedMu.Unlock()
+
+	for id, patterns := range m.wildcards.domains() {
+		domains[id] = append(domains[id], patterns...)
+	}
+	for id := range domains {
+		sort.Strings(domains[id])
+	}
+	return domains
+}
+
+// dumpSources returns every writer that holds key in mapName, see holder.
+func (m *Manager) dumpSources(mapName string, key []byte) []string {
+	sources := []string{}
+	for _, holder := range []struct {
+		source string
+		holds  bool
+	}{
+		{DUMP_SOURCE_CONFIG, m.configured(mapName, key)},
+		{DUMP_SOURCE_RULE_SET, m.inRuleSet(mapName, key, nil)},
+		{DUMP_SOURCE_SELF_EXEMPTION, m.selfExempted(mapName, key)},
+		{DUMP_SOURCE_RUNTIME, m.runtimeRule(mapName, key)},
+		{DUMP_SOURCE_DOMAIN, m.resolvedAddress(mapName, key)},
+		{DUMP_SOURCE_WILDCARD_DOMAIN, m.wildcardAddress(mapName, key)},
+	} {
+		if holder.holds {
+			sources = append(sources, holder.source)
+		}
+	}
+	return sources
+}
+
+// dumpEntry decodes an entry of mapName, the inverse of ipv4ToKey, ipv6ToKey, byteToKey, uintToKey
+// and the other keys the maps are written with. names are the names of the entries of
+// network.policies, and cgroups the paths of the container cgroups, by id.
+func dumpEntry(mapName string, key, value []byte, names []string, cgroups map[uint64]string) control.MapEntry {
+	base := mapName
+	if shardBase, ok := denyShardBase(mapName); ok {
+		base = shardBase
+	}
+
+	switch {
+	case base == ALLOWED_V4_CIDR_LIST_MAP_NAME, base == ALLOWED_V6_CIDR_LIST_MAP_NAME, isIngressCIDRList(base):
+		return control.MapEntry{Key: keyToIPNet(key).String()}
+	case base == DENIED_V4_CIDR_LIST_MAP_NAME, base == DENIED_V6_CIDR_LIST_MAP_NAME:
+		entry := control.MapEntry{Key: keyToIPNet(key).String()}
+		if bytes.Equal(value, exceptValue()) {
+			entry.Value = DUMP_VALUE_EXCEPT
+		} else if bytes.Equal(value, monitorValue()) {
+			entry.Value = DUMP_VALUE_MONITOR
+		}
+		return entry
+	case isProtocolCIDRList(base):
+		protocol, n := protocolKeyToIPNet(key)
+		return control.MapEntry{Key: n.String(), Protocol: ruleProtocol(protocol)}
+	case isEntryCIDRList(base):
+		tag, n := protocolKeyToIPNet(key)
+		return control.MapEntry{Key: n.String(), Entries: maskNames(uint64(1)<<(tag-policy.EntryTag(0)), names)}
+	}
+
+	switch base {
+	case ALLOWED_COMMAND_LIST_MAP_NAME, DENIED_COMMAND_LIST_MAP_NAME:
+		entry := control.MapEntry{Key: string(bytes.TrimRight(key, "\x00"))}
+		if base == DENIED_COMMAND_LIST_MAP_NAME && bytes.Equal(value, monitorCommandValue()) {
+			entry.Value = DUMP_VALUE_MONITOR
+		}
+		return entry
+	case POLICY_ENTRY_COMMAND_LIST_MAP_NAME:
+		return control.MapEntry{Key: string(bytes.TrimRight(key, "\x00")), Entries: maskNames(binary.LittleEndian.Uint64(value), names)}
+	case POLICY_ENTRY_UID_LIST_MAP_NAME, POLICY_ENTRY_GID_LIST_MAP_NAME:
+		return control.MapEntry{Key: strconv.FormatUint(uint64(binary.LittleEndian.Uint32(key)), 10), Entries: maskNames(binary.LittleEndian.Uint64(value), names)}
+	case ALLOWED_PATH_LIST_MAP_NAME, DENIED_PATH_LIST_MAP_NAME:
+		return control.MapEntry{Key: keyToPath(key)}
+	case ALLOWED_COMMAND_PATTERN_LIST_MAP_NAME, DENIED_COMMAND_PATTERN_LIST_MAP_NAME:
+		return control.MapEntry{Key: strconv.FormatUint(uint64(binary.LittleEndian.Uint32(key)), 10), Value: valueToCommandPattern(value).String()}
+	case ALLOWED_UID_RANGE_LIST_MAP_NAME, DENIED_UID_RANGE_LIST_MAP_NAME:
+		r := keyToUIDPrefix(key).Range()
+		return control.MapEntry{Key: fmt.Sprintf("%d-%d", r.First, r.Last)}
+	case ALLOWED_PORT_LIST_MAP_NAME, DENIED_PORT_LIST_MAP_NAME, INGRESS_ALLOWED_PORT_LIST_MAP_NAME, INGRESS_DENIED_PORT_LIST_MAP_NAME:
+		r := keyToPortPrefix(key).Range()
+		if r.First == r.Last {
+			return control.MapEntry{Key: strconv.Itoa(int(r.First))}
+		}
+		return control.MapEntry{Key: fmt.Sprintf("%d-%d", r.First, r.Last)}
+	case CONTAINER_CGROUP_LIST_MAP_NAME:
+		id := binary.LittleEndian.Uint64(key)
+		return control.MapEntry{Key: strconv.FormatUint(id, 10), Value: cgroups[id]}
+	}
+	// The uid and gid lists.
+	return control.MapEntry{Key: strconv.FormatUint(uint64(binary.LittleEndian.Uint32(key)), 10)}
+}
+
+// maskNames returns the names of the entries of network.policies whose bit mask has.
+func maskNames(mask uint64, names []string) []string {
+	selected := []string{}
+	for i, name := range names {
+		if mask&(uint64(1)<<uint(i)) != 0 {
+			selected = append(selected, name)
+		}
+	}
+	return selected
+}
@@ -0,0 +1,74 @@
+package network
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/bouhekitest"
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/control"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDumpMaps(t *testing.T) {
+	resolver := &scriptedResolver{script: map[string][][]string{"example.com": {{"192.0.2.1", "10.1.2.3"}}}}
+	conf := config.DefaultConfig()
+	conf.RestrictedNetworkConfig.Mode = "block"
+	conf.RestrictedNetworkConfig.CIDR.Allow = []string{"10.0.0.0/8"}
+	conf.RestrictedNetworkConfig.CIDR.Deny = []string{"2001:db8::/32"}
+	conf.RestrictedNetworkConfig.Domain.Allow = []string{"example.com"}
+	conf.RestrictedNetworkConfig.Command.Allow = []string{"curl"}
+	conf.RestrictedNetworkConfig.UID.Deny = []string{"1000"}
+	mgr, err := NewManager(conf, WithMapBackend(bouhekitest.NewMaps()), WithDNSResolver(resolver))
+	assert.Nil(t, err)
+	t.Cleanup(mgr.Close)
+	assert.Nil(t, mgr.SetConfigToMap())
+	_, err = mgr.AddRuntimeCIDR(RUNTIME_LIST_ALLOW, "10.0.0.0/8", time.Hour, 0)
+	assert.Nil(t, err)
+
+	maps, err := mgr.DumpMaps(context.Background())
+	assert.Nil(t, err)
+	dumps := map[string]control.MapDump{}
+	for _, dump := range maps {
+		assert.Equal(t, len(dump.Entries), dump.Count)
+		dumps[dump.Map] = dump
+	}
+	assert.NotContains(t, dumps, RESTRICT_NETWORK_CONFIG_MAP_NAME)
+
+	// The entries of a domain name it, and the ones of two writers list both.
+	assert.Equal(t, []control.MapEntry{
+		{Key: "10.0.0.0/8", Sources: []string{DUMP_SOURCE_CONFIG, DUMP_SOURCE_RUNTIME}},
+		{Key: "10.1.2.3/32", Sources: []string{DUMP_SOURCE_DOMAIN}, Domains: []string{"example.com"}},
+		{Key: "192.0.2.1/32", Sources: []string{DUMP_SOURCE_DOMAIN}, Domains: []string{"example.com"}},
+	}, dumps[ALLOWED_V4_CIDR_LIST_MAP_NAME].Entries)
+	assert.Equal(t, []control.MapEntry{{Key: "2001:db8::/32", Sources: []string{DUMP_SOURCE_CONFIG}}}, dumps[DENIED_V6_CIDR_LIST_MAP_NAME].Entries)
+	assert.Equal(t, []control.MapEntry{{Key: "curl", Sources: []string{DUMP_SOURCE_CONFIG}}}, dumps[ALLOWED_COMMAND_LIST_MAP_NAME].Entries)
+	assert.Equal(t, []control.MapEntry{{Key: "1000", Sources: []string{DUMP_SOURCE_CONFIG}}}, dumps[DENIED_UID_LIST_MAP_NAME].Entries)
+	assert.Equal(t, 0, dumps[ALLOWED_GID_LIST_MAP_NAME].Count)
+}
+
+func TestDumpEntry(t *testing.T) {
+	names := []string{"web", "batch"}
+	_, n, err := net.ParseCIDR("192.0.2.0/24")
+	assert.Nil(t, err)
+	protocolKey, err := ipv4ToKey(*n, TCP)
+	assert.Nil(t, err)
+	for _, c := range []struct {
+		mapName    string
+		key, value []byte
+		want       control.MapEntry
+	}{
+		{DENIED_V4_CIDR_LIST_MAP_NAME, cidrKey(t, "10.1.0.0/16"), exceptValue(), control.MapEntry{Key: "10.1.0.0/16", Value: DUMP_VALUE_EXCEPT}},
+		{DENIED_V4_CIDR_LIST_MAP_NAME, cidrKey(t, "10.1.0.0/16"), monitorValue(), control.MapEntry{Key: "10.1.0.0/16", Value: DUMP_VALUE_MONITOR}},
+		{DENIED_COMMAND_LIST_MAP_NAME, CommandKey("wget"), monitorCommandValue(), control.MapEntry{Key: "wget", Value: DUMP_VALUE_MONITOR}},
+		{ALLOWED_V4_PROTOCOL_CIDR_LIST_MAP_NAME, protocolKey, entryValue(), control.MapEntry{Key: "192.0.2.0/24", Protocol: config.PROTOCOL_TCP}},
+		{POLICY_ENTRY_UID_LIST_MAP_NAME, uintToKey(1000), maskValue(3), control.MapEntry{Key: "1000", Entries: []string{"web", "batch"}}},
+		{ALLOWED_PATH_LIST_MAP_NAME, pathToKey("/usr/bin/"), entryValue(), control.MapEntry{Key: "/usr/bin/"}},
+		{ALLOWED_PORT_LIST_MAP_NAME, portToKey(portPrefix{Port: 8000, PrefixLen: 13}), entryValue(), control.MapEntry{Key: "8000-8007"}},
+		{DENIED_COMMAND_PATTERN_LIST_MAP_NAME, uintToKey(0), commandPatternValue(config.CommandPattern{Prefix: "python"}), control.MapEntry{Key: "0", Value: "python*"}},
+	} {
+		assert.Equal(t, c.want, dumpEntry(c.mapName, c.key, c.value, names, nil), c.mapName)
+	}
+}
@@ -0,0 +1,172 @@
+package network
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/mrtc0/bouheki/pkg/policy"
+)
+
+// EVENT_RULE_POLICY_ENTRY is the rule of the events denied by an entry of network.policies,
+// see restricted_network_structs.h. The other rules are a RULE_LIST_* plus one.
+const EVENT_RULE_POLICY_ENTRY uint8 = 255
+
+// ruleSections are the sections of the config of the lists of the rules, by RULE_LIST_* of
+// either side.
+var ruleSections = map[uint32]string{
+	RULE_LIST_ALLOWED_CIDR:    "network.cidr or network.domain",
+	RULE_LIST_DENIED_CIDR:     "network.cidr or network.domain",
+	RULE_LIST_ALLOWED_COMMAND: "network.command",
+	RULE_LIST_DENIED_COMMAND:  "network.command",
+	RULE_LIST_ALLOWED_UID:     "network.uid",
+	RULE_LIST_DENIED_UID:      "network.uid",
+	RULE_LIST_ALLOWED_GID:     "network.gid",
+	RULE_LIST_DENIED_GID:      "network.gid",
+	RULE_LIST_ALLOWED_PORT:    "network.ports",
+	RULE_LIST_DENIED_PORT:     "network.ports",
+}
+
+// policyRulePrefixes are the prefixes of the rules of the policy each deny list is named by, when
+// the rule table does not attribute its denial to an entry.
+var policyRulePrefixes = map[uint32]string{
+	RULE_LIST_DENIED_CIDR:    "network.cidr.",
+	RULE_LIST_DENIED_COMMAND: "network.command.",
+	RULE_LIST_DENIED_UID:     "network.uid.",
+	RULE_LIST_DENIED_GID:     "network.gid.",
+	RULE_LIST_DENIED_PORT:    "network.ports.",
+}
+
+// matchedRule describes rule, the list an event reports denied conn, by the entry of the list
+// that matched: e.g. "denied by cidr 10.0.0.0/8", or "denied by domain evil.example.com →
+// 203.0.113.5" for an address a domain resolved to. The entries are looked up in the rule
+// table, see ruleTable. A denial the table does not attribute to an entry, e.g. of
+// network.command.deny_paths or of an entry of network.policies, is named by the policy.
+func (m *Manager) matchedRule(rule uint8, conn Connection) string {
+	if rule == 0 || m.currentConfig() == nil {
+		return ""
+	}
+	if rule == EVENT_RULE_POLICY_ENTRY {
+		// The entry is network.host or network.container for a task no entry of network.policies selects.
+		entry := m.Policy().PolicyEntry(conn)
+		if entry == "" {
+			entry = "network.policies"
+		}
+		return m.policyRule(conn, entry, "denied by "+entry)
+	}
+
+	list := uint32(rule - 1)
+	section, ok := ruleSections[list]
+	if !ok {
+		return fmt.Sprintf("denied by unknown rule %d", rule)
+	}
+	// An allow list denies what it does not list, which is no entry of it.
+	if list == RULE_LIST_ALLOWED_CIDR || list == RULE_LIST_ALLOWED_COMMAND || list == RULE_LIST_ALLOWED_UID ||
+		list == RULE_LIST_ALLOWED_GID || list == RULE_LIST_ALLOWED_PORT {
+		return "not allowed by " + section
+	}
+	network := m.currentConfig().RestrictedNetworkConfig
+	ids := m.ruleTable().rules(matchedRuleKey(list, conn, network.Command.CaseInsensitive))
+	if len(ids) == 0 {
+		return m.policyRule(conn, policyRulePrefixes[list], "denied by "+section)
+	}
+
+	// A destination in both a CIDR and a domain list is named by the domain, which says more.
+	sort.Slice(ids, func(i, j int) bool {
+		iDomain, jDomain := strings.HasPrefix(ids[i].list, "network.domain."), strings.HasPrefix(ids[j].list, "network.domain.")
+		if iDomain != jDomain {
+			return iDomain
+		}
+		if ids[i].list != ids[j].list {
+			return ids[i].list < ids[j].list
+		}
+		return ids[i].entry < ids[j].entry
+	})
+	return describeRule(ids[0], conn.Addr)
+}
+
+// policyRule returns the first entry of a deny list of the policy that denies conn and begins
+// with prefix, or otherwise if there is none. The allow lists that do not list conn are skipped,
+// the programs report those as such.
+func (m *Manager) policyRule(conn Connection, prefix string, otherwise string) string {
+	_, steps := m.Policy().Trace(conn)
+	for _, step := range steps {
+		if (step.Result == policy.TRACE_DENY || step.Result == policy.TRACE_MONITOR) && strings.HasPrefix(step.Rule, prefix) && !strings.Contains(step.Rule, " not list") {
+			return "denied by " + step.Rule
+		}
+	}
+	return otherwise
+}
+
+// describeRule describes id, an entry of a deny list that matched a connection to addr.
+func describeRule(id ruleID, addr net.IP) string {
+	// e.g. network.cidr.deny or network.domain.protocols[udp].deny
+	kind := strings.SplitN(id.list, ".", 3)[1]
+	if kind == "ports" {
+		kind = "port"
+	}
+	description := fmt.Sprintf("denied by %s %s", kind, id.entry)
+	if kind == "domain" {
+		description += " → " + addr.String()
+	}
+	if start, end := strings.Index(id.list, "["), strings.Index(id.list, "]"); start >= 0 && end > start {
+		description += fmt.Sprintf(" (%s)", id.list[start+1:end])
+	}
+	return description
+}
+
+// matchedRuleKey returns the key the programs looked list up with for conn, as they record the
+// hits of the rules in RULE_LAST_HIT_MAP_NAME.
+func matchedRuleKey(list uint32, conn Connection, caseInsensitive bool) ruleHitKey {
+	key := ruleHitKey{list: list}
+	switch list {
+	case RULE_LIST_ALLOWED_CIDR, RULE_LIST_DENIED_CIDR:
+		// An IPv4-mapped address is looked up in the v4 lists.
+		if v4 := conn.Addr.To4(); v4 != nil {
+			key.family = syscall.AF_INET
+			copy(key.value[:], v4)
+		} else {
+			key.family = syscall.AF_INET6
+			copy(key.value[:], conn.Addr.To16())
+		}
+	case RULE_LIST_ALLOWED_COMMAND, RULE_LIST_DENIED_COMMAND:
+		comm := conn.Command
+		if caseInsensitive {
+			comm = strings.ToLower(comm)
+		}
+		copy(key.value[:TASK_COMM_LEN], comm)
+	case RULE_LIST_ALLOWED_UID, RULE_LIST_DENIED_UID:
+		binary.LittleEndian.PutUint32(key.value[:4], conn.UID)
+	case RULE_LIST_ALLOWED_GID, RULE_LIST_DENIED_GID:
+		binary.LittleEndian.PutUint32(key.value[:4], conn.GID)
+	case RULE_LIST_ALLOWED_PORT, RULE_LIST_DENIED_PORT:
+		binary.LittleEndian.PutUint16(key.value[:2], conn.Port)
+	}
+	return key
+}
+
+// ruleTable returns the index of the rules of the config and of the addresses the domains
+// resolved to, which the rules of the events are described by. It is indexed again once the
+// policy or the resolved addresses changed since.
+func (m *Manager) ruleTable() *ruleHitIndex {
+	generation, _ := m.Policy().Generation()
+	resolved := atomic.LoadUint64(&m.resolvedChanges)
+
+	m.rulesMu.Lock()
+	defer m.rulesMu.Unlock()
+
+	if m.rules == nil || generation != m.rulesGeneration || resolved != m.rulesResolved {
+		m.rules = newRuleHitIndex(ExportPolicy(m.currentConfig()), m.resolvedDomains())
+		m.rulesGeneration, m.rulesResolved = generation, resolved
+	}
+	return m.rules
+}
+
+// resolvedChanged marks the addresses the domains resolved to as changed, for the ruleTable.
+func (m *Manager) resolvedChanged() {
+	atomic.AddUint64(&m.resolvedChanges, 1)
+}
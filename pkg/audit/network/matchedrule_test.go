@@ -0,0 +1,72 @@
+package network
+
+import (
+	"net"
+	"testing"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchedRule(t *testing.T) {
+	conf := config.DefaultConfig()
+	network := &conf.RestrictedNetworkConfig
+	network.CIDR.Deny = []string{"10.0.0.0/8", "10.1.0.0/16"}
+	network.Domain.Deny = []string{"evil.example.com"}
+	network.Command.Deny = []string{"nc", "python*"}
+	network.Command.CaseInsensitive = true
+	network.UID.Deny = []string{"0", "2000-2999"}
+	network.GID.Deny = []string{"27"}
+	network.Ports.Deny = []string{"25"}
+	mgr := &Manager{config: conf}
+
+	key, err := cidrToBPFMapKey("203.0.113.5/32")
+	assert.Nil(t, err)
+	mgr.recordResolved("evil.example.com", map[string][][]byte{DENIED_V4_CIDR_LIST_MAP_NAME: {key.key}}, true)
+
+	conn := Connection{Addr: net.ParseIP("192.0.2.1"), Port: 443, Command: "curl", UID: 1000, GID: 1000}
+	for _, test := range []struct {
+		rule     uint32
+		update   func(c *Connection)
+		expected string
+	}{
+		{RULE_LIST_DENIED_CIDR, func(c *Connection) { c.Addr = net.ParseIP("10.1.2.3") }, "denied by cidr 10.1.0.0/16"},
+		{RULE_LIST_DENIED_CIDR, func(c *Connection) { c.Addr = net.ParseIP("203.0.113.5") }, "denied by domain evil.example.com → 203.0.113.5"},
+		// A dual-stack socket connecting to an IPv4-mapped address is looked up in the v4 lists.
+		{RULE_LIST_DENIED_CIDR, func(c *Connection) { c.Addr = net.ParseIP("::ffff:10.2.0.1") }, "denied by cidr 10.0.0.0/8"},
+		{RULE_LIST_DENIED_COMMAND, func(c *Connection) { c.Command = "NC" }, "denied by command nc"},
+		{RULE_LIST_DENIED_COMMAND, func(c *Connection) { c.Command = "python3" }, "denied by command python*"},
+		{RULE_LIST_DENIED_UID, func(c *Connection) { c.UID = 0 }, "denied by uid 0"},
+		{RULE_LIST_DENIED_UID, func(c *Connection) { c.UID = 2500 }, "denied by uid 2000-2999"},
+		{RULE_LIST_DENIED_GID, func(c *Connection) { c.GID = 27 }, "denied by gid 27"},
+		{RULE_LIST_DENIED_PORT, func(c *Connection) { c.Port = 25 }, "denied by port 25"},
+		{RULE_LIST_ALLOWED_CIDR, nil, "not allowed by network.cidr or network.domain"},
+		{RULE_LIST_ALLOWED_COMMAND, nil, "not allowed by network.command"},
+		// The programs denied a destination no rule of the config denies, e.g. one of a rule set.
+		{RULE_LIST_DENIED_CIDR, nil, "denied by network.cidr or network.domain"},
+	} {
+		c := conn
+		if test.update != nil {
+			test.update(&c)
+		}
+		assert.Equal(t, test.expected, mgr.matchedRule(uint8(test.rule+1), c), test.expected)
+	}
+
+	// A permitted connection has no rule.
+	assert.Equal(t, "", mgr.matchedRule(0, conn))
+	assert.Equal(t, "denied by network.policies", mgr.matchedRule(EVENT_RULE_POLICY_ENTRY, conn))
+}
+
+func TestMatchedRuleFollowsTheResolvedAddresses(t *testing.T) {
+	conf := config.DefaultConfig()
+	conf.RestrictedNetworkConfig.Domain.Deny = []string{"evil.example.com"}
+	mgr := &Manager{config: conf}
+	conn := Connection{Addr: net.ParseIP("203.0.113.5"), Port: 443, Command: "curl"}
+	assert.Equal(t, "denied by network.cidr or network.domain", mgr.matchedRule(uint8(RULE_LIST_DENIED_CIDR+1), conn))
+
+	// The rule table is indexed again once the domain resolves to the address.
+	key, err := cidrToBPFMapKey("203.0.113.5/32")
+	assert.Nil(t, err)
+	mgr.recordResolved("evil.example.com", map[string][][]byte{DENIED_V4_CIDR_LIST_MAP_NAME: {key.key}}, true)
+	assert.Equal(t, "denied by domain evil.example.com → 203.0.113.5", mgr.matchedRule(uint8(RULE_LIST_DENIED_CIDR+1), conn))
+}
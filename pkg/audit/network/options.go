@@ -0,0 +1,139 @@
+package network
+
+import (
+	"context"
+	"time"
+
+	"github.com/aquasecurity/libbpfgo"
+	"github.com/mrtc0/bouheki/pkg/clock"
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/errkind"
+	"github.com/mrtc0/bouheki/pkg/freeze"
+	"github.com/mrtc0/bouheki/pkg/timing"
+	"github.com/mrtc0/bouheki/pkg/utils"
+)
+
+// RESOLV_CONF has the DNS servers that resolve the domains, unless network.domain.resolver
+// has nameservers or WithDNSResolver is given.
+const RESOLV_CONF = "/etc/resolv.conf"
+
+// Option configures a Manager created by NewManager.
+type Option func(m *Manager)
+
+// WithDNSResolver resolves the domains of the config with resolver instead of the servers of RESOLV_CONF.
+func WithDNSResolver(resolver DNSResolver) Option {
+	return func(m *Manager) {
+		m.dnsResolver = resolver
+	}
+}
+
+// WithClock runs the timers of the Manager, e.g. the refresh of the domains and the expiry
+// of the preloaded addresses, on c instead of the wall clock.
+func WithClock(c clock.Clock) Option {
+	return func(m *Manager) {
+		m.clock = c
+	}
+}
+
+// WithMapBackend writes the policy maps to backend instead of loading the BPF programs, so that
+// the Manager needs neither root nor a kernel. Attach and Start then return ErrNoProgram.
+func WithMapBackend(backend MapBackend) Option {
+	return func(m *Manager) {
+		m.backend = backend
+	}
+}
+
+// withStartupTimer times the phases of the startup of the Manager with timer.
+func withStartupTimer(timer *timing.Timer) Option {
+	return func(m *Manager) {
+		m.startup = timer
+	}
+}
+
+// withProgram gives the programs RunAudit has loaded after checking the sizes of the maps.
+func withProgram(mod *libbpfgo.Module, hook string, ancestors bool) Option {
+	return func(m *Manager) {
+		m.mod = mod
+		m.hook = hook
+		m.ancestors = ancestors
+	}
+}
+
+// NewManager returns a Manager of the network restriction of conf. Unless WithMapBackend is
+// given, it loads the BPF programs, which Close unloads.
+func NewManager(conf *config.Config, opts ...Option) (*Manager, error) {
+	m := &Manager{config: conf, operations: restrictedOperations(conf), auditDisabled: !conf.RestrictedNetworkConfig.Audit.Enabled}
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	guard, err := freeze.New(conf.Admin)
+	if err != nil {
+		return nil, errkind.New(errkind.Config, err)
+	}
+	m.freeze = guard
+
+	if m.dnsResolver == nil {
+		resolver, err := NewResolver(conf.RestrictedNetworkConfig.Domain.Resolver)
+		if err != nil {
+			return nil, errkind.New(errkind.Preflight, err)
+		}
+		m.dnsResolver = resolver
+	}
+
+	if m.backend == nil && m.mod == nil {
+		sizes, err := NewMapSizes(conf.Resources)
+		if err != nil {
+			return nil, errkind.New(errkind.Config, err)
+		}
+		m.mod, m.hook, m.ancestors, err = setupBPFProgram(conf.RestrictedNetworkConfig.Enforcement.Hook, cgroupMatching(conf), m.operations, tracksExePaths(conf), sizes.withRingBuf(conf.RestrictedNetworkConfig.Audit.RingBufSize), conf.BPF.PinPath, m.startup)
+		if err != nil {
+			return nil, utils.ClassifyBPFError(err)
+		}
+		m.ownsModule = true
+	}
+
+	return m, nil
+}
+
+// clk is the clock of the timers, the clock of the system unless WithClock is given.
+func (m *Manager) clk() clock.Clock {
+	if m.clock == nil {
+		return clock.Real()
+	}
+	return m.clock
+}
+
+func (m *Manager) now() time.Time {
+	return m.clk().Now()
+}
+
+func (m *Manager) sleep(d time.Duration) {
+	m.clk().Sleep(d)
+}
+
+// sleepContext sleeps like sleep, but returns ctx.Err() as soon as ctx is done.
+func (m *Manager) sleepContext(ctx context.Context, d time.Duration) error {
+	if m.clock == nil {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+			return nil
+		}
+	}
+
+	slept := make(chan struct{})
+	go func() {
+		m.clock.Sleep(d)
+		close(slept)
+	}()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-slept:
+		return nil
+	}
+}
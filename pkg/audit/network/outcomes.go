@@ -0,0 +1,357 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+	log "github.com/mrtc0/bouheki/pkg/log"
+	"github.com/mrtc0/bouheki/pkg/metrics"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	OUTCOME_HISTORY_FILE     = "outcome-history.json"
+	OUTCOME_SUGGESTIONS_FILE = "allow-suggestions.yaml"
+	// OUTCOME_HISTORY_VERSION is the version of the format of OUTCOME_HISTORY_FILE.
+	OUTCOME_HISTORY_VERSION = 1
+
+	OUTCOME_DESTINATION_DOMAIN = "domain"
+	OUTCOME_DESTINATION_CIDR   = "cidr"
+	// OUTCOME_V4_PREFIX and OUTCOME_V6_PREFIX aggregate the addresses without a domain.
+	OUTCOME_V4_PREFIX = 24
+	OUTCOME_V6_PREFIX = 64
+)
+
+var (
+	outcomeHistoryEntries = metrics.NewGauge("network_outcome_history_entries",
+		"Number of comm and destination pairs kept in the outcome history.")
+	outcomeHistoryEvicted = metrics.NewCounter("network_outcome_history_evicted_total",
+		"Number of comm and destination pairs forgotten for a new one because the outcome history was full.")
+)
+
+// OutcomeEntry counts the connections of a comm to a destination.
+type OutcomeEntry struct {
+	Comm string `json:"comm"`
+	// Destination is a domain, or the prefix of the addresses without one.
+	Destination string `json:"destination"`
+	Kind        string `json:"kind"`
+	Allowed     uint64 `json:"allowed"`
+	Blocked     uint64 `json:"blocked"`
+	// Denied counts the connections the policy does not permit, including the ones monitor mode allowed.
+	Denied    uint64    `json:"denied"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	// LastAddr is the address of the last connection, which the suggestions evaluate the policy with.
+	LastAddr string `json:"last_addr"`
+}
+
+func (e OutcomeEntry) Connections() uint64 {
+	return e.Allowed + e.Blocked
+}
+
+// OutcomeHistory is the content of <state_dir>/outcome-history.json, the most connections first.
+type OutcomeHistory struct {
+	Version int            `json:"version"`
+	Updated time.Time      `json:"updated"`
+	Entries []OutcomeEntry `json:"entries"`
+}
+
+// OutcomeHistoryPath returns the file holding the outcome history in dir.
+func OutcomeHistoryPath(dir string) string {
+	return filepath.Join(dir, OUTCOME_HISTORY_FILE)
+}
+
+// ReadOutcomeHistory reads the outcome history of dir.
+func ReadOutcomeHistory(dir string) (*OutcomeHistory, error) {
+	path := OutcomeHistoryPath(dir)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	history := &OutcomeHistory{}
+	if err := json.Unmarshal(data, history); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if history.Version != OUTCOME_HISTORY_VERSION {
+		return nil, fmt.Errorf("%s: unsupported version %d, expected %d", path, history.Version, OUTCOME_HISTORY_VERSION)
+	}
+	return history, nil
+}
+
+// OutcomeSuggestion is an allow-rule candidate: a destination of the history that the policy
+// does not permit, and was seen often enough.
+type OutcomeSuggestion struct {
+	List        string    `yaml:"list"`
+	Entry       string    `yaml:"entry"`
+	Comm        string    `yaml:"comm"`
+	Connections uint64    `yaml:"connections"`
+	FirstSeen   time.Time `yaml:"first_seen"`
+	LastSeen    time.Time `yaml:"last_seen"`
+}
+
+// OutcomeSuggestions is the content of <state_dir>/allow-suggestions.yaml.
+type OutcomeSuggestions struct {
+	Generated   time.Time           `yaml:"generated"`
+	Suggestions []OutcomeSuggestion `yaml:"suggestions"`
+}
+
+type outcomeKey struct {
+	comm        string
+	destination string
+}
+
+// outcomeHistory aggregates the connections of the events by comm and destination, so that
+// the destinations a binary keeps connecting to can be told from the new ones. handleEvent only
+// counts in memory, and run writes the history, and the suggestions, every write_interval.
+type outcomeHistory struct {
+	mu      sync.Mutex
+	policy  *Policy
+	conf    config.OutcomeHistoryConfig
+	entries map[outcomeKey]*OutcomeEntry
+	dirty   bool
+	now     func() time.Time
+}
+
+func newOutcomeHistory(policy *Policy, conf config.OutcomeHistoryConfig) *outcomeHistory {
+	return &outcomeHistory{
+		policy:  policy,
+		conf:    conf,
+		entries: map[outcomeKey]*OutcomeEntry{},
+		now:     time.Now,
+	}
+}
+
+// load continues the history written by a previous run. A history that does not exist yet is
+// not an error. If it has more than max_entries, the most recently seen are kept.
+func (h *outcomeHistory) load() error {
+	history, err := ReadOutcomeHistory(h.conf.StateDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	entries := history.Entries
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].LastSeen.After(entries[j].LastSeen) })
+	if len(entries) > h.conf.MaxEntries {
+		entries = entries[:h.conf.MaxEntries]
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i := range entries {
+		entry := entries[i]
+		h.entries[outcomeKey{entry.Comm, entry.Destination}] = &entry
+	}
+	outcomeHistoryEntries.Set(float64(len(h.entries)))
+	return nil
+}
+
+func (h *outcomeHistory) observe(header eventHeader, body detectEvent) {
+	conn := eventToConnection(header, body)
+	auditLog := newAuditLog(header, body)
+	h.add(conn.Command, conn.Addr, auditLog.Domain, body.ActionResult() == ACTION_BLOCKED_STRING, h.policy.Evaluate(conn).Denied)
+}
+
+func (h *outcomeHistory) add(comm string, addr net.IP, domain string, blocked, denied bool) {
+	key := outcomeKey{comm: comm, destination: strings.TrimSuffix(domain, ".")}
+	kind := OUTCOME_DESTINATION_DOMAIN
+	if key.destination == "" {
+		key.destination, kind = outcomeDestination(addr), OUTCOME_DESTINATION_CIDR
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := h.now()
+	entry, ok := h.entries[key]
+	if !ok {
+		if len(h.entries) >= h.conf.MaxEntries {
+			h.evict()
+		}
+		entry = &OutcomeEntry{Comm: comm, Destination: key.destination, Kind: kind, FirstSeen: now}
+		h.entries[key] = entry
+		outcomeHistoryEntries.Set(float64(len(h.entries)))
+	}
+	if blocked {
+		entry.Blocked++
+	} else {
+		entry.Allowed++
+	}
+	if denied {
+		entry.Denied++
+	}
+	entry.LastSeen = now
+	entry.LastAddr = addr.String()
+	h.dirty = true
+}
+
+// evict forgets the least recently seen entry.
+func (h *outcomeHistory) evict() {
+	var (
+		oldest outcomeKey
+		found  bool
+	)
+	for key, entry := range h.entries {
+		if !found || entry.LastSeen.Before(h.entries[oldest].LastSeen) {
+			oldest, found = key, true
+		}
+	}
+	if found {
+		delete(h.entries, oldest)
+		outcomeHistoryEvicted.Inc()
+	}
+}
+
+// outcomeDestination returns the prefix addr is aggregated into, e.g. 192.0.2.0/24.
+func outcomeDestination(addr net.IP) string {
+	if v4 := addr.To4(); v4 != nil {
+		return (&net.IPNet{IP: v4.Mask(net.CIDRMask(OUTCOME_V4_PREFIX, 32)), Mask: net.CIDRMask(OUTCOME_V4_PREFIX, 32)}).String()
+	}
+	return (&net.IPNet{IP: addr.Mask(net.CIDRMask(OUTCOME_V6_PREFIX, 128)), Mask: net.CIDRMask(OUTCOME_V6_PREFIX, 128)}).String()
+}
+
+// snapshot returns the history, the most connections first.
+func (h *outcomeHistory) snapshot() OutcomeHistory {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	history := OutcomeHistory{Version: OUTCOME_HISTORY_VERSION, Updated: h.now(), Entries: []OutcomeEntry{}}
+	for _, entry := range h.entries {
+		history.Entries = append(history.Entries, *entry)
+	}
+	sortOutcomeEntries(history.Entries)
+	return history
+}
+
+func sortOutcomeEntries(entries []OutcomeEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Connections() != entries[j].Connections() {
+			return entries[i].Connections() > entries[j].Connections()
+		}
+		if entries[i].Comm != entries[j].Comm {
+			return entries[i].Comm < entries[j].Comm
+		}
+		return entries[i].Destination < entries[j].Destination
+	})
+}
+
+func (h *outcomeHistory) run(ctx context.Context) {
+	ticker := time.NewTicker(h.conf.WriteInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			h.flush()
+		}
+	}
+}
+
+// flush writes the history, and the suggestions, if a connection was counted since the last write.
+func (h *outcomeHistory) flush() {
+	h.mu.Lock()
+	dirty := h.dirty
+	h.dirty = false
+	h.mu.Unlock()
+	if !dirty {
+		return
+	}
+
+	history := h.snapshot()
+	data, err := json.Marshal(history)
+	if err == nil {
+		err = writeStateFile(h.conf.StateDir, OUTCOME_HISTORY_FILE, data)
+	}
+	if err != nil {
+		log.Error(fmt.Errorf("failed to write the outcome history: %w", err))
+	}
+
+	if !h.conf.Suggestions.Enable {
+		return
+	}
+	suggestions := OutcomeSuggestions{Generated: history.Updated, Suggestions: suggestOutcomes(history, h.policy, h.conf.Suggestions)}
+	if err := writeOutcomeSuggestions(h.conf.StateDir, suggestions); err != nil {
+		log.Error(fmt.Errorf("failed to write the allow-rule suggestions: %w", err))
+	}
+}
+
+// suggestOutcomes returns the entries of history seen at least min_connections times over at
+// least min_observed, whose last address the policy denies for missing from the allow lists.
+func suggestOutcomes(history OutcomeHistory, policy *Policy, conf config.OutcomeSuggestionsConfig) []OutcomeSuggestion {
+	suggestions := []OutcomeSuggestion{}
+	for _, entry := range history.Entries {
+		if entry.Connections() < conf.MinConnections || entry.LastSeen.Sub(entry.FirstSeen) < conf.MinObserved {
+			continue
+		}
+		decision := policy.Evaluate(Connection{Addr: net.ParseIP(entry.LastAddr), Command: entry.Comm, InContainer: true})
+		if !decision.Denied || decision.DenyListed {
+			continue
+		}
+
+		list := "network.cidr.allow"
+		if entry.Kind == OUTCOME_DESTINATION_DOMAIN {
+			list = "network.domain.allow"
+		}
+		suggestions = append(suggestions, OutcomeSuggestion{
+			List:        list,
+			Entry:       entry.Destination,
+			Comm:        entry.Comm,
+			Connections: entry.Connections(),
+			FirstSeen:   entry.FirstSeen,
+			LastSeen:    entry.LastSeen,
+		})
+	}
+	return suggestions
+}
+
+func writeOutcomeSuggestions(dir string, suggestions OutcomeSuggestions) error {
+	data, err := yaml.Marshal(suggestions)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintln(&buf, "# Allow-rule candidates of the outcome history. bouheki does not apply them:")
+	fmt.Fprintln(&buf, "# review them and add the entries to the lists of the config.")
+	buf.Write(data)
+	return writeStateFile(dir, OUTCOME_SUGGESTIONS_FILE, buf.Bytes())
+}
+
+// writeStateFile replaces dir/name, readable only by bouheki, under a temporary name first so
+// that a reader never sees a partial file.
+func writeStateFile(dir, name string, data []byte) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	// TempFile creates the file with mode 0600.
+	f, err := ioutil.TempFile(dir, "."+name+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(dir, name))
+}
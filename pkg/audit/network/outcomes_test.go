@@ -0,0 +1,158 @@
+package network
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+func newTestOutcomeHistory(t *testing.T, policy *Policy, maxEntries int) (*outcomeHistory, *time.Time) {
+	now := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	conf := config.DefaultConfig().RestrictedNetworkConfig.OutcomeHistory
+	conf.Enable = true
+	conf.StateDir = filepath.Join(t.TempDir(), "state")
+	conf.MaxEntries = maxEntries
+	conf.Suggestions = config.OutcomeSuggestionsConfig{Enable: true, MinConnections: 3, MinObserved: time.Hour}
+	h := newOutcomeHistory(policy, conf)
+	h.now = func() time.Time { return now }
+	return h, &now
+}
+
+func TestOutcomeHistoryAggregatesByCommAndDestination(t *testing.T) {
+	h, now := newTestOutcomeHistory(t, newTestPolicy(MODE_MONITOR, []string{"192.0.2.0/24"}, nil), 100)
+
+	h.observe(blockedEvent(1000, "192.0.2.1", ACTION_MONITOR))
+	*now = now.Add(time.Minute)
+	h.observe(blockedEvent(1000, "192.0.2.200", ACTION_MONITOR))
+	h.observe(blockedEvent(1000, "198.51.100.7", ACTION_MONITOR))
+	h.observe(blockedEvent(1000, "198.51.100.8", ACTION_BLOCKED))
+	h.add("curl", net.ParseIP("2001:db8:1:2:3::1"), "", false, false)
+	h.add("curl", net.ParseIP("203.0.113.1"), "api.example.com.", false, true)
+	h.add("wget", net.ParseIP("203.0.113.2"), "api.example.com", false, true)
+
+	history := h.snapshot()
+	assert.Equal(t, OUTCOME_HISTORY_VERSION, history.Version)
+	assert.Equal(t, []OutcomeEntry{
+		{Comm: "curl", Destination: "192.0.2.0/24", Kind: OUTCOME_DESTINATION_CIDR, Allowed: 2, FirstSeen: now.Add(-time.Minute), LastSeen: *now, LastAddr: "192.0.2.200"},
+		{Comm: "curl", Destination: "198.51.100.0/24", Kind: OUTCOME_DESTINATION_CIDR, Allowed: 1, Blocked: 1, Denied: 2, FirstSeen: *now, LastSeen: *now, LastAddr: "198.51.100.8"},
+		{Comm: "curl", Destination: "2001:db8:1:2::/64", Kind: OUTCOME_DESTINATION_CIDR, Allowed: 1, FirstSeen: *now, LastSeen: *now, LastAddr: "2001:db8:1:2:3::1"},
+		{Comm: "curl", Destination: "api.example.com", Kind: OUTCOME_DESTINATION_DOMAIN, Allowed: 1, Denied: 1, FirstSeen: *now, LastSeen: *now, LastAddr: "203.0.113.1"},
+		{Comm: "wget", Destination: "api.example.com", Kind: OUTCOME_DESTINATION_DOMAIN, Allowed: 1, Denied: 1, FirstSeen: *now, LastSeen: *now, LastAddr: "203.0.113.2"},
+	}, history.Entries)
+}
+
+func TestOutcomeHistoryForgetsTheLeastRecentlySeenWhenFull(t *testing.T) {
+	h, now := newTestOutcomeHistory(t, NewPolicy(), 3)
+	evicted := outcomeHistoryEvicted.Value()
+
+	for _, addr := range []string{"10.0.1.1", "10.0.2.1", "10.0.3.1"} {
+		h.add("curl", net.ParseIP(addr), "", false, false)
+		*now = now.Add(time.Second)
+	}
+	// 10.0.1.0/24 is seen again, so 10.0.2.0/24 is the least recently seen.
+	h.add("curl", net.ParseIP("10.0.1.2"), "", false, false)
+	*now = now.Add(time.Second)
+	h.add("curl", net.ParseIP("10.0.4.1"), "", false, false)
+
+	destinations := []string{}
+	for _, entry := range h.snapshot().Entries {
+		destinations = append(destinations, entry.Destination)
+	}
+	assert.Equal(t, []string{"10.0.1.0/24", "10.0.3.0/24", "10.0.4.0/24"}, destinations)
+	assert.Equal(t, evicted+1, outcomeHistoryEvicted.Value())
+	assert.Equal(t, float64(3), outcomeHistoryEntries.Value())
+}
+
+func TestOutcomeHistoryIsPersisted(t *testing.T) {
+	h, now := newTestOutcomeHistory(t, NewPolicy(), 100)
+	// Nothing is written before a connection is counted.
+	h.flush()
+	_, err := ReadOutcomeHistory(h.conf.StateDir)
+	assert.True(t, os.IsNotExist(err))
+
+	for i := 0; i < 3; i++ {
+		h.add("curl", net.ParseIP("10.0.1.1"), "", false, false)
+	}
+	h.add("wget", net.ParseIP("10.0.2.1"), "", true, true)
+	h.flush()
+
+	history, err := ReadOutcomeHistory(h.conf.StateDir)
+	assert.Nil(t, err)
+	assert.Equal(t, h.snapshot().Entries, history.Entries)
+	assert.Equal(t, *now, history.Updated)
+	info, err := os.Stat(OutcomeHistoryPath(h.conf.StateDir))
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	entries, err := os.ReadDir(h.conf.StateDir)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(entries), "the history, the suggestions and no temporary file")
+
+	// The next run continues the counts, and keeps the most recently seen when max_entries shrank.
+	*now = now.Add(time.Hour)
+	h.add("wget", net.ParseIP("10.0.2.1"), "", true, true)
+	h.flush()
+	next, _ := newTestOutcomeHistory(t, NewPolicy(), 1)
+	next.conf.StateDir = h.conf.StateDir
+	next.now = h.now
+	assert.Nil(t, next.load())
+	next.add("wget", net.ParseIP("10.0.2.2"), "", false, true)
+	assert.Equal(t, []OutcomeEntry{
+		{Comm: "wget", Destination: "10.0.2.0/24", Kind: OUTCOME_DESTINATION_CIDR, Allowed: 1, Blocked: 2, Denied: 3, FirstSeen: now.Add(-time.Hour), LastSeen: *now, LastAddr: "10.0.2.2"},
+	}, next.snapshot().Entries)
+
+	// A history of another format is not loaded.
+	assert.Nil(t, ioutil.WriteFile(OutcomeHistoryPath(h.conf.StateDir), []byte(`{"version":2,"entries":[]}`), 0600))
+	err = next.load()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "unsupported version 2")
+}
+
+func TestOutcomeSuggestions(t *testing.T) {
+	policy := newTestPolicy(MODE_MONITOR, []string{"192.0.2.0/24"}, []string{"198.51.100.0/24"})
+	h, now := newTestOutcomeHistory(t, policy, 100)
+	start := *now
+
+	add := func(comm, addr, domain string, n int) {
+		for i := 0; i < n; i++ {
+			h.add(comm, net.ParseIP(addr), domain, false, true)
+		}
+	}
+	add("curl", "203.0.113.1", "", 3)
+	add("curl", "203.0.113.9", "api.example.com", 5)
+	// Below min_connections.
+	add("wget", "203.0.113.1", "", 2)
+	// Permitted by the allow list, or denied by a deny list.
+	add("curl", "192.0.2.1", "", 3)
+	add("curl", "198.51.100.1", "", 3)
+	// Seen for less than min_observed.
+	*now = now.Add(time.Hour)
+	add("curl", "203.0.113.1", "", 1)
+	add("curl", "203.0.113.9", "api.example.com", 1)
+	add("apt", "203.0.113.50", "", 10)
+
+	suggestions := suggestOutcomes(h.snapshot(), policy, h.conf.Suggestions)
+	assert.Equal(t, []OutcomeSuggestion{
+		{List: "network.domain.allow", Entry: "api.example.com", Comm: "curl", Connections: 6, FirstSeen: start, LastSeen: *now},
+		{List: "network.cidr.allow", Entry: "203.0.113.0/24", Comm: "curl", Connections: 4, FirstSeen: start, LastSeen: *now},
+	}, suggestions)
+
+	// The suggestions are written for review with the history, and the policy is unchanged.
+	h.flush()
+	data, err := ioutil.ReadFile(filepath.Join(h.conf.StateDir, OUTCOME_SUGGESTIONS_FILE))
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(string(data), "# Allow-rule candidates"))
+	written := OutcomeSuggestions{}
+	assert.Nil(t, yaml.Unmarshal(data, &written))
+	assert.Equal(t, *now, written.Generated.UTC())
+	assert.Equal(t, 2, len(written.Suggestions))
+	assert.Equal(t, "api.example.com", written.Suggestions[0].Entry)
+	assert.True(t, policy.Evaluate(Connection{Addr: net.ParseIP("203.0.113.1"), Command: "curl", InContainer: true}).Denied)
+}
@@ -0,0 +1,201 @@
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+
+	"github.com/aquasecurity/libbpfgo"
+	log "github.com/mrtc0/bouheki/pkg/log"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// PIN_LINKS_DIR is the directory of bpf.pin_path where the LSM links are pinned.
+	PIN_LINKS_DIR = "links"
+)
+
+// pinnedMapNames are the maps pinned in bpf.pin_path: the policy, which the next bouheki adopts
+// and reconciles with its config, and the layout of the events the programs write.
+func pinnedMapNames() []string {
+	return append(append([]string{}, policyMapOrder...), EVENT_SCHEMA_MAP_NAME)
+}
+
+// setPinPaths has libbpf pin the maps of pinnedMapNames in pinPath when mod is loaded, or reuse
+// the maps already pinned there by a previous bouheki, so that the programs loaded next enforce
+// the policy left by it until the config is applied.
+func setPinPaths(mod *libbpfgo.Module, pinPath string) error {
+	if pinPath == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Join(pinPath, PIN_LINKS_DIR), 0700); err != nil {
+		return err
+	}
+	for _, mapName := range pinnedMapNames() {
+		bpfMap, err := mod.GetMap(mapName)
+		if err != nil {
+			return err
+		}
+		if err = bpfMap.SetPinPath(filepath.Join(pinPath, mapName)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hasPins reports whether a previous bouheki pinned its maps in pinPath.
+func hasPins(pinPath string) bool {
+	if pinPath == "" {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(pinPath, RESTRICT_NETWORK_CONFIG_MAP_NAME))
+	return err == nil
+}
+
+// ErrConfigMapLayout is returned for pinned maps whose config map has another layout than
+// CONFIG_MAP_LAYOUT_VERSION, which the programs of this bouheki would misread.
+var ErrConfigMapLayout = errors.New("the config map has another layout than this bouheki writes")
+
+// adoptError explains that the maps pinned in pinPath can not be reused, which libbpf reports
+// when the maps were loaded with other sizes, e.g. after resources was changed, and
+// checkConfigMapLayout when they were written by a bouheki with another layout.
+func adoptError(pinPath string, err error) error {
+	if errors.Is(err, ErrConfigMapLayout) {
+		return fmt.Errorf("failed to adopt the maps pinned in %s, run bouheki cleanup to remove them as they were written by another version of bouheki: %w", pinPath, err)
+	}
+	return fmt.Errorf("failed to adopt the maps pinned in %s, run bouheki cleanup to remove them if they were loaded with other resources: %w", pinPath, err)
+}
+
+// checkConfigMapLayout checks the layout version of the config map of adopted maps. A config map
+// without an entry has not been written yet, and has no layout.
+func checkConfigMapLayout(configMap schemaMap) error {
+	key := uint32(0)
+	value, err := configMap.GetValue(unsafe.Pointer(&key))
+	if errors.Is(err, syscall.ENOENT) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", RESTRICT_NETWORK_CONFIG_MAP_NAME, err)
+	}
+	if len(value) != MAP_SIZE {
+		return fmt.Errorf("%w: %s has values of %d bytes, this bouheki writes %d", ErrConfigMapLayout, RESTRICT_NETWORK_CONFIG_MAP_NAME, len(value), MAP_SIZE)
+	}
+	if version := binary.LittleEndian.Uint32(value[MAP_LAYOUT_VERSION_INDEX : MAP_LAYOUT_VERSION_INDEX+4]); version != CONFIG_MAP_LAYOUT_VERSION {
+		return fmt.Errorf("%w: %s has layout version %d, this bouheki writes version %d", ErrConfigMapLayout, RESTRICT_NETWORK_CONFIG_MAP_NAME, version, CONFIG_MAP_LAYOUT_VERSION)
+	}
+	return nil
+}
+
+func checkModuleConfigMapLayout(mod *libbpfgo.Module) error {
+	configMap, err := mod.GetMap(RESTRICT_NETWORK_CONFIG_MAP_NAME)
+	if err != nil {
+		return err
+	}
+	return checkConfigMapLayout(configMap)
+}
+
+// pinLink pins link as progName in the links directory of pinPath, in place of the link pinned by
+// a previous bouheki. The new link is attached before the old one is unpinned, so that a
+// connection is restricted by either of them while the links are replaced.
+func pinLink(pinPath string, progName string, link *libbpfgo.BPFLink) error {
+	path := filepath.Join(pinPath, PIN_LINKS_DIR, progName)
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return pinObject(link.GetFd(), path)
+}
+
+// pinObject pins the BPF object of fd at path with bpf(2), libbpfgo having no call to pin a link.
+func pinObject(fd int, path string) error {
+	pathname, err := unix.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	attr := struct {
+		pathname  uint64
+		bpfFd     uint32
+		fileFlags uint32
+	}{pathname: uint64(uintptr(unsafe.Pointer(pathname))), bpfFd: uint32(fd)}
+	_, _, errno := unix.Syscall(unix.SYS_BPF, unix.BPF_OBJ_PIN, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr))
+	if errno != 0 {
+		return fmt.Errorf("failed to pin %s: %w", path, errno)
+	}
+	return nil
+}
+
+// Unpin removes the maps and links pinned in pinPath. The programs of the links are detached,
+// and the maps freed, once no bouheki holds them.
+func Unpin(pinPath string) ([]string, error) {
+	removed := []string{}
+	for _, dir := range []string{filepath.Join(pinPath, PIN_LINKS_DIR), pinPath} {
+		entries, err := os.ReadDir(dir)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return removed, err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+			path := filepath.Join(dir, entry.Name())
+			if err = os.Remove(path); err != nil {
+				return removed, err
+			}
+			removed = append(removed, path)
+		}
+	}
+	for _, dir := range []string{filepath.Join(pinPath, PIN_LINKS_DIR), pinPath} {
+		if err := os.Remove(dir); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+// unpinLinks removes the links pinned in pinPath, which detaches their programs once no bouheki
+// holds them, and leaves the maps for the next bouheki to adopt.
+func unpinLinks(pinPath string) error {
+	dir := filepath.Join(pinPath, PIN_LINKS_DIR)
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err = os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unpinLinksOnClose removes the pinned links unless bpf.keep_attached is set, so that closing
+// the module detaches the programs.
+func (m *Manager) unpinLinksOnClose() {
+	pinPath := m.config.BPF.PinPath
+	if pinPath == "" || m.config.BPF.KeepAttached {
+		return
+	}
+	if err := unpinLinks(pinPath); err != nil {
+		log.Error(fmt.Errorf("failed to unpin the links of %s, the programs stay attached: %w", pinPath, err))
+	}
+}
+
+// unpinOnClose removes the pins when bpf.unpin_on_exit is set, before the module is closed.
+func (m *Manager) unpinOnClose() {
+	pinPath := m.config.BPF.PinPath
+	if pinPath == "" || !m.config.BPF.UnpinOnExit {
+		return
+	}
+	if _, err := Unpin(pinPath); err != nil {
+		log.Error(fmt.Errorf("failed to unpin %s: %w", pinPath, err))
+	}
+}
@@ -0,0 +1,40 @@
+package network
+
+import (
+	"encoding/binary"
+	"fmt"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeConfigMap struct {
+	value []byte
+	err   error
+}
+
+func (m *fakeConfigMap) GetValue(key unsafe.Pointer) ([]byte, error) {
+	return m.value, m.err
+}
+
+func (m *fakeConfigMap) Update(key, value unsafe.Pointer) error {
+	return nil
+}
+
+func TestCheckConfigMapLayout(t *testing.T) {
+	// A config map that was never written, and one of this bouheki, are adopted.
+	assert.Nil(t, checkConfigMapLayout(&fakeConfigMap{err: fmt.Errorf("lookup: %w", syscall.ENOENT)}))
+	assert.Nil(t, checkConfigMapLayout(&fakeConfigMap{value: ConfigMapValue(config.DefaultConfig())}))
+
+	newer := ConfigMapValue(config.DefaultConfig())
+	binary.LittleEndian.PutUint32(newer[MAP_LAYOUT_VERSION_INDEX:MAP_LAYOUT_VERSION_INDEX+4], CONFIG_MAP_LAYOUT_VERSION+1)
+	err := checkConfigMapLayout(&fakeConfigMap{value: newer})
+	assert.ErrorIs(t, err, ErrConfigMapLayout)
+	assert.EqualError(t, adoptError("/sys/fs/bpf/bouheki", err), "failed to adopt the maps pinned in /sys/fs/bpf/bouheki, run bouheki cleanup to remove them as they were written by another version of bouheki: the config map has another layout than this bouheki writes: network_bouheki_config_map has layout version 2, this bouheki writes version 1")
+
+	assert.ErrorIs(t, checkConfigMapLayout(&fakeConfigMap{value: make([]byte, MAP_SIZE-8)}), ErrConfigMapLayout)
+	assert.NotErrorIs(t, checkConfigMapLayout(&fakeConfigMap{err: syscall.EPERM}), ErrConfigMapLayout)
+}
@@ -0,0 +1,242 @@
+package network
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+	log "github.com/mrtc0/bouheki/pkg/log"
+	"github.com/mrtc0/bouheki/pkg/metrics"
+)
+
+const (
+	// POLICY_VERSION_FORMAT is the version of the PolicyVersion format.
+	POLICY_VERSION_FORMAT = 1
+
+	// POLICY_VERSIONS_DIR is the directory of the versions in network.policy_snapshot.state_dir.
+	POLICY_VERSIONS_DIR = "versions"
+
+	// POLICY_VERSIONS_QUEUE_SIZE is the number of versions waiting to be written before new ones are dropped.
+	POLICY_VERSIONS_QUEUE_SIZE = 16
+
+	// POLICY_DIGEST_MIN_PREFIX is the shortest prefix of a digest LoadPolicyVersion accepts.
+	POLICY_DIGEST_MIN_PREFIX = 8
+)
+
+var policyVersionsDropped = metrics.NewCounter("network_policy_versions_dropped_total", "Number of policy versions that were not saved because the writer was behind.")
+
+// PolicyVersion is the content of the Policy an event was decided by, as the address prefixes,
+// commands and ids in the maps rather than as the config: the domains are their addresses and
+// the rule sets their entries. Digest is the PolicyDigest of the events.
+type PolicyVersion struct {
+	Version int    `json:"version"`
+	Digest  string `json:"digest"`
+	// RecordedAt is when the policy last became the one in the maps.
+	RecordedAt             time.Time          `json:"recorded_at"`
+	Mode                   string             `json:"mode"`
+	Target                 string             `json:"target"`
+	CommandCaseInsensitive bool               `json:"command_case_insensitive"`
+	CIDR                   PolicyExportList   `json:"cidr"`
+	Command                PolicyExportList   `json:"command"`
+	UID                    PolicyExportIDList `json:"uid"`
+	GID                    PolicyExportIDList `json:"gid"`
+	Ports                  PolicyExportList   `json:"ports"`
+	// ProtocolCIDR are the protocol lists, by protocol, those with entries only.
+	ProtocolCIDR map[string]PolicyExportList `json:"protocol_cidr,omitempty"`
+	// Ingress are the lists of network.ingress, if any has entries.
+	Ingress *PolicyExportIngress `json:"ingress,omitempty"`
+	// CommandPaths are the executable paths of network.command, if any has entries.
+	CommandPaths *PolicyExportList `json:"command_paths,omitempty"`
+	// UIDRanges are the ranges of the prefixes of the uid range lists, if any has entries.
+	UIDRanges *PolicyExportList `json:"uid_ranges,omitempty"`
+}
+
+// PolicyVersionInfo is a version kept in the state directory, as listed by `bouheki policy list`.
+type PolicyVersionInfo struct {
+	Digest     string    `json:"digest"`
+	RecordedAt time.Time `json:"recorded_at"`
+}
+
+// policyVersions writes the versions of the policy to <state_dir>/versions/<digest>.json and
+// keeps the most recent ones. It runs off the jobs that change the policy: record only queues.
+type policyVersions struct {
+	dir   string
+	keep  int
+	queue chan *PolicyVersion
+}
+
+// newPolicyVersions returns nil when network.policy_snapshot keeps no versions.
+func newPolicyVersions(conf config.PolicySnapshotConfig) *policyVersions {
+	if !conf.Enable || conf.Versions == 0 {
+		return nil
+	}
+	return &policyVersions{
+		dir:   filepath.Join(conf.StateDir, POLICY_VERSIONS_DIR),
+		keep:  conf.Versions,
+		queue: make(chan *PolicyVersion, POLICY_VERSIONS_QUEUE_SIZE),
+	}
+}
+
+// record queues version to be written. It never blocks the job that changed the policy: when
+// the writer is behind, the version is dropped and the events it decided can not be resolved.
+func (v *policyVersions) record(version *PolicyVersion) {
+	select {
+	case v.queue <- version:
+	default:
+		policyVersionsDropped.Inc()
+		log.Warn(fmt.Sprintf("The policy version %s is not saved, the writer is behind.", version.Digest))
+	}
+}
+
+// run writes the queued versions until ctx is done, and then the ones still queued.
+func (v *policyVersions) run(ctx context.Context) {
+	for {
+		select {
+		case version := <-v.queue:
+			v.save(version)
+		case <-ctx.Done():
+			for {
+				select {
+				case version := <-v.queue:
+					v.save(version)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (v *policyVersions) save(version *PolicyVersion) {
+	if err := v.write(version); err != nil {
+		log.Error(fmt.Errorf("failed to save the policy version %s: %w", version.Digest, err))
+		return
+	}
+	if err := v.prune(); err != nil {
+		log.Error(fmt.Errorf("failed to remove the old policy versions: %w", err))
+	}
+}
+
+// write replaces the file of the digest, so that a policy that comes back is kept as recent.
+// The modification time of the file is RecordedAt, which prune orders the versions by.
+func (v *policyVersions) write(version *PolicyVersion) error {
+	data, err := json.MarshalIndent(version, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(v.dir, 0700); err != nil {
+		return err
+	}
+
+	path := filepath.Join(v.dir, version.Digest+".json")
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Chtimes(tmp, version.RecordedAt, version.RecordedAt); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// prune removes the versions beyond the keep most recent ones.
+func (v *policyVersions) prune() error {
+	versions, err := listPolicyVersions(v.dir)
+	if err != nil {
+		return err
+	}
+	if len(versions) <= v.keep {
+		return nil
+	}
+	for _, version := range versions[v.keep:] {
+		if err := os.Remove(filepath.Join(v.dir, version.Digest+".json")); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func listPolicyVersions(dir string) ([]PolicyVersionInfo, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := []PolicyVersionInfo{}
+	for _, entry := range entries {
+		digest := strings.TrimSuffix(entry.Name(), ".json")
+		if entry.IsDir() || digest == entry.Name() || !isDigest(digest) {
+			continue
+		}
+		versions = append(versions, PolicyVersionInfo{Digest: digest, RecordedAt: entry.ModTime().UTC()})
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		if !versions[i].RecordedAt.Equal(versions[j].RecordedAt) {
+			return versions[i].RecordedAt.After(versions[j].RecordedAt)
+		}
+		return versions[i].Digest < versions[j].Digest
+	})
+	return versions, nil
+}
+
+func isDigest(s string) bool {
+	_, err := hex.DecodeString(s)
+	return err == nil && len(s) == 64
+}
+
+// ListPolicyVersions returns the versions kept in the network.policy_snapshot.state_dir stateDir,
+// the most recent first.
+func ListPolicyVersions(stateDir string) ([]PolicyVersionInfo, error) {
+	return listPolicyVersions(filepath.Join(stateDir, POLICY_VERSIONS_DIR))
+}
+
+// LoadPolicyVersion resolves the PolicyDigest of an event to the version kept in stateDir.
+// digest may be a unique prefix of at least POLICY_DIGEST_MIN_PREFIX characters.
+func LoadPolicyVersion(stateDir, digest string) (*PolicyVersion, error) {
+	digest = strings.ToLower(digest)
+	if len(digest) < POLICY_DIGEST_MIN_PREFIX {
+		return nil, fmt.Errorf("policy digest %q is shorter than %d characters", digest, POLICY_DIGEST_MIN_PREFIX)
+	}
+	if strings.Trim(digest, "0123456789abcdef") != "" || len(digest) > 64 {
+		return nil, fmt.Errorf("%q is not a policy digest", digest)
+	}
+
+	versions, err := ListPolicyVersions(stateDir)
+	if err != nil {
+		return nil, err
+	}
+	matches := []string{}
+	for _, version := range versions {
+		if strings.HasPrefix(version.Digest, digest) {
+			matches = append(matches, version.Digest)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("policy %s is not kept in %s: %w", digest, filepath.Join(stateDir, POLICY_VERSIONS_DIR), os.ErrNotExist)
+	case 1:
+	default:
+		return nil, fmt.Errorf("policy digest %s is ambiguous: %s", digest, strings.Join(matches, ", "))
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(stateDir, POLICY_VERSIONS_DIR, matches[0]+".json"))
+	if err != nil {
+		return nil, err
+	}
+	version := &PolicyVersion{}
+	if err := json.Unmarshal(data, version); err != nil {
+		return nil, err
+	}
+	if version.Version != POLICY_VERSION_FORMAT {
+		return nil, fmt.Errorf("unsupported version %d", version.Version)
+	}
+	return version, nil
+}
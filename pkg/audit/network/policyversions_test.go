@@ -0,0 +1,118 @@
+package network
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/freeze"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPolicyDigestIsUpdatedByTheJobsThatChangeThePolicy(t *testing.T) {
+	mgr, _, clock := newRefreshTestManager(t, 0, &countingResolver{ttl: 300})
+	dir := t.TempDir()
+	mgr.versions = newPolicyVersions(config.PolicySnapshotConfig{Enable: true, StateDir: dir, Versions: 2})
+	assert.Nil(t, mgr.SetConfigToMap())
+
+	configured := mgr.PolicyDigest()
+	assert.Equal(t, mgr.Policy().Digest(), configured)
+	assert.Len(t, mgr.versions.queue, 1)
+
+	// A job that changes nothing keeps the digest, and queues no version.
+	assert.Nil(t, mgr.runJob("noop", freeze.CHANGE_DNS_REFRESH, func(ctx context.Context) error { return nil }))
+	assert.Equal(t, configured, mgr.PolicyDigest())
+	assert.Len(t, mgr.versions.queue, 1)
+
+	for i, address := range []string{"192.0.2.1", "192.0.2.2"} {
+		clock.Advance(time.Minute)
+		err := mgr.runJob("dns-refresh example.com", freeze.CHANGE_DNS_REFRESH, func(ctx context.Context) error {
+			return mgr.updateAllowedFQDNist(&DNSAnswer{Domain: "example.com", Addresses: []net.IP{net.ParseIP(address)}, TTL: 300})
+		})
+		assert.Nil(t, err)
+		assert.NotEqual(t, configured, mgr.PolicyDigest())
+		assert.Equal(t, mgr.Policy().Digest(), mgr.PolicyDigest())
+		assert.Len(t, mgr.versions.queue, i+2)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	mgr.versions.run(ctx)
+
+	// Only the 2 most recent versions are kept.
+	versions, err := ListPolicyVersions(dir)
+	assert.Nil(t, err)
+	assert.Len(t, versions, 2)
+	assert.Equal(t, mgr.PolicyDigest(), versions[0].Digest)
+	assert.Equal(t, clock.Now().UTC(), versions[0].RecordedAt)
+	_, err = LoadPolicyVersion(dir, configured)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	version, err := LoadPolicyVersion(dir, mgr.PolicyDigest()[:POLICY_DIGEST_MIN_PREFIX])
+	assert.Nil(t, err)
+	assert.Equal(t, mgr.PolicyDigest(), version.Digest)
+	assert.Equal(t, "monitor", version.Mode)
+	// The second resolution replaced the address of the first.
+	assert.Equal(t, []string{"192.0.2.2/32"}, version.CIDR.Allow)
+}
+
+func TestPolicyVersionIsTheContentOfTheDigest(t *testing.T) {
+	p := newTestPolicy(MODE_MONITOR, []string{"192.168.0.0/16", "10.0.0.0/8"}, []string{"10.1.0.0/16"})
+	p.addCommand(DENIED_COMMAND_LIST_MAP_NAME, "curl")
+	p.addID(ALLOWED_UID_LIST_MAP_NAME, 1000)
+	p.addID(ALLOWED_UID_LIST_MAP_NAME, 0)
+
+	version, generation := p.version()
+	current, _ := p.Generation()
+	assert.Equal(t, current, generation)
+	assert.Equal(t, p.Digest(), version.Digest)
+	assert.Equal(t, "monitor", version.Mode)
+	assert.Equal(t, "host", version.Target)
+	assert.Equal(t, PolicyExportList{Allow: []string{"10.0.0.0/8", "192.168.0.0/16"}, Deny: []string{"10.1.0.0/16"}}, version.CIDR)
+	assert.Equal(t, PolicyExportList{Allow: []string{}, Deny: []string{"curl"}}, version.Command)
+	assert.Equal(t, PolicyExportIDList{Allow: []uint{0, 1000}, Deny: []uint{}}, version.UID)
+}
+
+func TestPolicyVersionsDropInsteadOfBlocking(t *testing.T) {
+	versions := newPolicyVersions(config.PolicySnapshotConfig{Enable: true, StateDir: t.TempDir(), Versions: 1})
+	for i := 0; i < POLICY_VERSIONS_QUEUE_SIZE+1; i++ {
+		versions.record(&PolicyVersion{Digest: strings.Repeat("a", 64)})
+	}
+	assert.Len(t, versions.queue, POLICY_VERSIONS_QUEUE_SIZE)
+
+	assert.Nil(t, newPolicyVersions(config.PolicySnapshotConfig{Enable: true, StateDir: t.TempDir(), Versions: 0}))
+	assert.Nil(t, newPolicyVersions(config.PolicySnapshotConfig{Enable: false, StateDir: t.TempDir(), Versions: 1}))
+}
+
+func TestLoadPolicyVersionNeedsAUniqueDigest(t *testing.T) {
+	dir := t.TempDir()
+	versions := newPolicyVersions(config.PolicySnapshotConfig{Enable: true, StateDir: dir, Versions: 4})
+	for _, digest := range []string{"abcdef01" + strings.Repeat("0", 56), "abcdef01" + strings.Repeat("1", 56)} {
+		assert.Nil(t, versions.write(&PolicyVersion{Version: POLICY_VERSION_FORMAT, Digest: digest, RecordedAt: time.Now()}))
+	}
+	// Only the files named by a digest are versions.
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, POLICY_VERSIONS_DIR, "notes.json"), []byte("{}"), 0600))
+
+	_, err := LoadPolicyVersion(dir, "abcdef01")
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "ambiguous")
+
+	_, err = LoadPolicyVersion(dir, "abcd")
+	assert.NotNil(t, err)
+	_, err = LoadPolicyVersion(dir, "../../etc/passwd")
+	assert.NotNil(t, err)
+
+	version, err := LoadPolicyVersion(dir, "ABCDEF011")
+	assert.Nil(t, err)
+	assert.Equal(t, "abcdef01"+strings.Repeat("1", 56), version.Digest)
+
+	list, err := ListPolicyVersions(dir)
+	assert.Nil(t, err)
+	assert.Len(t, list, 2)
+}
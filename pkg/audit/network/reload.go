@@ -0,0 +1,167 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"github.com/mrtc0/bouheki/pkg/auditoutput"
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/freeze"
+	log "github.com/mrtc0/bouheki/pkg/log"
+	"github.com/mrtc0/bouheki/pkg/reload"
+	"github.com/mrtc0/bouheki/pkg/timing"
+)
+
+// RELOAD_MODULE is the name the Manager is registered with in a reload.Coordinator.
+const RELOAD_MODULE = "network"
+
+// reloadPlan is the reload.Plan state of the Manager: the config it replaces and the one it applies.
+type reloadPlan struct {
+	previous *config.Config
+	next     *config.Config
+}
+
+var _ reload.Reloadable = (*Manager)(nil)
+
+// reloadableRules clears the settings of conf a reload applies to the running programs: the mode,
+// the target, the lists of CIDRs, commands, uids, gids and ports, with the groups they reference, and
+// the lists of network.ingress.
+// Whatever is left needs a restart.
+func reloadableRules(conf *config.Config) config.Config {
+	c := *conf
+	c.Groups = nil
+	n := c.RestrictedNetworkConfig
+	n.Mode, n.Target = "", ""
+	n.CIDR = config.CIDRConfig{}
+	n.Command = config.CommandConfig{}
+	n.UID = config.UIDConfig{}
+	n.GID = config.GIDConfig{}
+	n.Ports = config.PortsConfig{}
+	n.Ingress = config.IngressConfig{}
+	c.RestrictedNetworkConfig = n
+	return c
+}
+
+// Validate returns an error if conf changes what the Manager can not apply without a restart,
+// e.g. the domains, which are resolved when the Manager starts, or has an invalid rule.
+func (m *Manager) Validate(conf *config.Config) error {
+	if _, err := policyState(conf.RestrictedNetworkConfig); err != nil {
+		return err
+	}
+	// The bind hook is only attached at startup, when network.ingress has rules.
+	if conf.RestrictedNetworkConfig.Ingress.HasRules() && !m.restricts(OPERATION_BIND) {
+		return fmt.Errorf("network.ingress can not be added by a reload, restart bouheki to attach the bind hook")
+	}
+
+	current, next := reloadableRules(m.currentConfig()), reloadableRules(conf)
+	for _, setting := range []struct {
+		key      string
+		from, to interface{}
+	}{
+		{"network.enable", current.RestrictedNetworkConfig.Enable, next.RestrictedNetworkConfig.Enable},
+		// The connections are only learned by a bouheki started in mode: learning.
+		{"network.mode: learning", m.currentConfig().RestrictedNetworkConfig.Mode == config.MODE_LEARNING, conf.RestrictedNetworkConfig.Mode == config.MODE_LEARNING},
+		{"network.domain", current.RestrictedNetworkConfig.Domain, next.RestrictedNetworkConfig.Domain},
+		{"network.classification", current.RestrictedNetworkConfig.Classification, next.RestrictedNetworkConfig.Classification},
+		{"network.rule_sets", current.RestrictedNetworkConfig.RuleSets, next.RestrictedNetworkConfig.RuleSets},
+		{"resources.deny_shards", current.Resources.DenyShards, next.Resources.DenyShards},
+		{"dns_proxy", current.DNSProxyConfig, next.DNSProxyConfig},
+	} {
+		if !reflect.DeepEqual(setting.from, setting.to) {
+			return fmt.Errorf("%s can not be reloaded, restart bouheki to change it", setting.key)
+		}
+	}
+	if !reflect.DeepEqual(current.RestrictedNetworkConfig, next.RestrictedNetworkConfig) {
+		return fmt.Errorf("only network.mode, network.target, network.cidr, network.command, network.uid, network.gid, network.ports and network.ingress can be reloaded, restart bouheki to change the other network settings")
+	}
+	return nil
+}
+
+// Plan returns the plan replacing the rules of the Manager with the ones of conf, summarized
+// as the diff of their policies.
+func (m *Manager) Plan(conf *config.Config) (reload.Plan, error) {
+	if _, err := policyState(conf.RestrictedNetworkConfig); err != nil {
+		return reload.Plan{}, err
+	}
+
+	previous := m.currentConfig()
+	diff := DiffPolicies(ExportPolicy(previous), ExportPolicy(conf))
+	return reload.Plan{
+		Summary:   diff.String(),
+		Unchanged: diff.Empty(),
+		Added:     diff.Count(POLICY_CHANGE_ADDED),
+		Removed:   diff.Count(POLICY_CHANGE_REMOVED),
+		State:     reloadPlan{previous: previous, next: conf},
+	}, nil
+}
+
+// Apply writes the rules of the config of the plan to the maps. When a write fails, the writes
+// made before it are undone, so the maps keep the rules of the config the plan replaces.
+func (m *Manager) Apply(plan reload.Plan) error {
+	state, ok := plan.State.(reloadPlan)
+	if !ok {
+		return fmt.Errorf("not a plan of the network manager")
+	}
+	return m.runJob("network.reload", freeze.CHANGE_CONFIG_RELOAD, func(ctx context.Context) error {
+		// The writes are timed as in the startup, to tell which map a slow reload spends its time in.
+		timer := timing.New("network.reload", m.now)
+		populate := timer.Begin(STARTUP_PHASE_MAPS_POPULATE)
+		err := m.replaceConfigIn(populate, state.next)
+		populate.End(err)
+		log.Debug(timer.End().Table(0))
+		if err == nil {
+			m.warnForcedMonitor()
+		}
+		return err
+	})
+}
+
+// Rollback writes the rules of the config the plan replaced back to the maps, after an Apply
+// of another module failed. Only the writes Apply made are undone, since applyState only writes
+// what differs from what it has written.
+func (m *Manager) Rollback(plan reload.Plan) error {
+	state, ok := plan.State.(reloadPlan)
+	if !ok {
+		return fmt.Errorf("not a plan of the network manager")
+	}
+	// The rollback restores the rules in force, which a freeze window does not hold back.
+	return m.Jobs().Do("network.reload.rollback", func(ctx context.Context) error {
+		defer m.policyChanged()
+		return m.mutate(ctx, "network.reload.rollback", func(ctx context.Context) error {
+			return m.replaceConfig(state.previous)
+		})
+	})
+}
+
+// replaceConfig makes conf the config of the Manager, and writes its rules to the maps. The
+// rules of the config are only read by the jobs, which run one at a time, and the readers
+// outside of them read it with currentConfig.
+func (m *Manager) replaceConfig(conf *config.Config) error {
+	return m.replaceConfigIn(nil, conf)
+}
+
+// replaceConfigIn is replaceConfig with the writes timed in span. When the writes fail, the
+// config it replaces is kept, whose rules applyState leaves in the maps.
+func (m *Manager) replaceConfigIn(span *timing.Span, conf *config.Config) error {
+	// The matches so far are attributed to the rules they matched, not to the ones of conf.
+	if m.ruleHits != nil {
+		m.ruleHits.settle()
+	}
+	previous := m.currentConfig()
+	m.setConfig(conf)
+	if err := m.applyConfigIn(span); err != nil {
+		m.setConfig(previous)
+		return err
+	}
+	return nil
+}
+
+// setConfig makes conf the config of the Manager.
+func (m *Manager) setConfig(conf *config.Config) {
+	m.configMu.Lock()
+	m.config = conf
+	m.configMu.Unlock()
+	m.Policy().setDeniedGroups(deniedGroups(conf))
+	auditoutput.SetMode(config.ALERT_AUDIT_NETWORK, m.effectiveMode(conf))
+}
@@ -0,0 +1,153 @@
+package network
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/mrtc0/bouheki/pkg/bouhekitest"
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/reload"
+	"github.com/stretchr/testify/assert"
+)
+
+// failingModule is a module of the reload that fails to apply.
+type failingModule struct{}
+
+func (failingModule) Validate(conf *config.Config) error { return nil }
+func (failingModule) Plan(conf *config.Config) (reload.Plan, error) {
+	return reload.Plan{Summary: "+1 fileaccess.deny"}, nil
+}
+func (failingModule) Apply(plan reload.Plan) error    { return errors.New("injected") }
+func (failingModule) Rollback(plan reload.Plan) error { return nil }
+
+func newReloadTestManager(t *testing.T) (*Manager, *bouhekitest.Maps) {
+	maps := bouhekitest.NewMaps()
+	mgr, err := NewManager(stateTestConfig(), WithMapBackend(maps), WithDNSResolver(&FakeDNSResolver{}))
+	assert.Nil(t, err)
+	assert.Nil(t, mgr.SetConfigToMap())
+	return mgr, maps
+}
+
+func reloadedConfig() *config.Config {
+	conf := stateTestConfig()
+	conf.RestrictedNetworkConfig.CIDR.Allow = []string{"10.0.0.0/8", "192.0.2.0/24"}
+	conf.RestrictedNetworkConfig.Command.Deny = []string{}
+	return conf
+}
+
+func TestReloadTheRulesOfTheManager(t *testing.T) {
+	mgr, maps := newReloadTestManager(t)
+	coordinator := reload.NewCoordinator(nil)
+	coordinator.Register(RELOAD_MODULE, mgr)
+
+	report := coordinator.Reload(reloadedConfig())
+	assert.True(t, report.Applied, report.String())
+	assert.Equal(t, reload.MODULE_APPLIED, report.Modules[0].Status)
+	assert.Equal(t, "network.cidr.allow: +192.0.2.0/24 -2001:db8::/32; network.command.deny: -wget", report.Modules[0].Summary)
+	assert.Equal(t, 1, report.Added())
+	assert.Equal(t, 2, report.Removed())
+	// The entries removed from the config are deleted from the maps.
+	_, ok := maps.Entries(ALLOWED_V6_CIDR_LIST_MAP_NAME)[string(cidrKey(t, "2001:db8::/32"))]
+	assert.False(t, ok)
+	assert.Empty(t, maps.Entries(DENIED_COMMAND_LIST_MAP_NAME))
+
+	// The maps and the Policy hold the rules of the new config, as if it had been loaded at startup.
+	fresh := bouhekitest.NewMaps()
+	loaded, err := NewManager(reloadedConfig(), WithMapBackend(fresh), WithDNSResolver(&FakeDNSResolver{}))
+	assert.Nil(t, err)
+	assert.Nil(t, loaded.SetConfigToMap())
+	for _, mapName := range policyMapOrder {
+		assert.Equal(t, fresh.Entries(mapName), maps.Entries(mapName), mapName)
+	}
+	assert.False(t, mgr.Policy().Evaluate(Connection{Addr: net.ParseIP("192.0.2.1"), Command: "curl", UID: 1000, GID: 100}).Denied)
+
+	// Reloading the same config changes nothing.
+	maps.ClearWrites()
+	report = coordinator.Reload(reloadedConfig())
+	assert.True(t, report.Applied)
+	assert.Equal(t, reload.MODULE_UNCHANGED, report.Modules[0].Status)
+	assert.Len(t, maps.Writes(), 0)
+}
+
+func TestReloadRejectsWhatNeedsARestart(t *testing.T) {
+	mgr, maps := newReloadTestManager(t)
+	maps.ClearWrites()
+
+	conf := reloadedConfig()
+	conf.RestrictedNetworkConfig.Domain.Allow = []string{"example.com"}
+	err := mgr.Validate(conf)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "network.domain can not be reloaded")
+
+	conf = reloadedConfig()
+	conf.RestrictedNetworkConfig.Shutdown.DrainTimeout++
+	err = mgr.Validate(conf)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "restart bouheki to change the other network settings")
+
+	conf = reloadedConfig()
+	conf.RestrictedNetworkConfig.CIDR.Deny = []string{"not a cidr"}
+	assert.NotNil(t, mgr.Validate(conf))
+
+	// The bind hook is only attached when bouheki starts with network.ingress.
+	conf = reloadedConfig()
+	conf.RestrictedNetworkConfig.Ingress.Ports.Allow = []string{"8080"}
+	err = mgr.Validate(conf)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "network.ingress can not be added by a reload")
+
+	// The mode is reloaded.
+	conf = reloadedConfig()
+	conf.RestrictedNetworkConfig.Mode = "monitor"
+	assert.Nil(t, mgr.Validate(conf))
+	assert.Len(t, maps.Writes(), 0)
+
+	// Except into the learning mode, whose connections are only learned from the startup.
+	conf.RestrictedNetworkConfig.Mode = config.MODE_LEARNING
+	err = mgr.Validate(conf)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "network.mode: learning can not be reloaded")
+}
+
+func TestReloadRollsBackTheManager(t *testing.T) {
+	t.Run("when a later module fails", func(t *testing.T) {
+		mgr, maps := newReloadTestManager(t)
+		before := maps.Len()
+		allowed := maps.Entries(ALLOWED_V6_CIDR_LIST_MAP_NAME)
+		coordinator := reload.NewCoordinator(nil)
+		coordinator.Register(RELOAD_MODULE, mgr)
+		coordinator.Register("fileaccess", failingModule{})
+
+		report := coordinator.Reload(reloadedConfig())
+		assert.False(t, report.Applied)
+		assert.Equal(t, reload.STAGE_APPLY, report.Stage)
+		assert.Equal(t, reload.MODULE_ROLLED_BACK, report.Modules[0].Status)
+		assert.Equal(t, before, maps.Len())
+		assert.Equal(t, allowed, maps.Entries(ALLOWED_V6_CIDR_LIST_MAP_NAME))
+		assert.Equal(t, stateTestConfig().RestrictedNetworkConfig.CIDR, mgr.config.RestrictedNetworkConfig.CIDR)
+		assert.True(t, mgr.Policy().Evaluate(Connection{Addr: net.ParseIP("192.0.2.1"), Command: "curl", UID: 1000, GID: 100}).Denied)
+	})
+
+	t.Run("when a write of the Manager fails half way", func(t *testing.T) {
+		mgr, maps := newReloadTestManager(t)
+		before := map[string]map[string][]byte{}
+		for _, mapName := range policyMapOrder {
+			before[mapName] = maps.Entries(mapName)
+		}
+		maps.ClearWrites()
+		// The addition of 192.0.2.0/24 is written, and the write of the list sizes fails.
+		maps.FailAt(2)
+
+		coordinator := reload.NewCoordinator(nil)
+		coordinator.Register(RELOAD_MODULE, mgr)
+		report := coordinator.Reload(reloadedConfig())
+		assert.False(t, report.Applied)
+		assert.Equal(t, reload.MODULE_FAILED, report.Modules[0].Status)
+		assert.Contains(t, report.Modules[0].Error, bouhekitest.ErrInjected.Error())
+		assert.True(t, report.RolledBack())
+		for _, mapName := range policyMapOrder {
+			assert.Equal(t, before[mapName], maps.Entries(mapName), mapName)
+		}
+	})
+}
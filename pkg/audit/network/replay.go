@@ -0,0 +1,233 @@
+package network
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/mrtc0/bouheki/pkg/config"
+	log "github.com/mrtc0/bouheki/pkg/log"
+)
+
+// REPLAY_MAX_LINE_SIZE is the longest line of the events that is read, as bundle.MAX_LINE_SIZE.
+const REPLAY_MAX_LINE_SIZE = 1024 * 1024
+
+// ReplayDelta is the events of a comm to a destination whose decision the candidate policy changes.
+type ReplayDelta struct {
+	Comm string `json:"comm"`
+	// Destination is the domain the DNS proxy resolved the address for, or else the address.
+	Destination string `json:"destination"`
+	Port        uint16 `json:"port"`
+	Protocol    string `json:"protocol"`
+	Events      uint64 `json:"events"`
+	// Rule is the rule that denies the connections: the one of the candidate policy for a newly
+	// blocked delta, and the one of the events for a newly allowed one, which is empty before
+	// event schema version 6.
+	Rule string `json:"rule,omitempty"`
+}
+
+// ReplayReport is how a candidate policy decides the events of the network audit compared with
+// the policy that decided them. The counts are of events, the ones network.audit.dedup
+// suppressed included.
+type ReplayReport struct {
+	Replayed  uint64 `json:"replayed"`
+	Unchanged uint64 `json:"unchanged"`
+	// Skipped are the events that are not decided by the destination lists: the binds, and the
+	// connections of bouheki itself, which the self exemption allows.
+	Skipped uint64 `json:"skipped"`
+	// NewlyBlocked are the connections the events permitted that the candidate policy denies, the
+	// regressions, and NewlyAllowed the other way around. Both are ordered by events.
+	NewlyBlocked []ReplayDelta `json:"newly_blocked"`
+	NewlyAllowed []ReplayDelta `json:"newly_allowed"`
+}
+
+// Regressions returns the number of events the candidate policy newly blocks.
+func (r *ReplayReport) Regressions() uint64 {
+	var events uint64
+	for _, delta := range r.NewlyBlocked {
+		events += delta.Events
+	}
+	return events
+}
+
+// ReadReplayEvents reads the network events of a log written with log.format: json, one per line.
+// The operational logs and the events of the other audits are left out.
+func ReadReplayEvents(r io.Reader) ([]log.RestrictedNetworkLog, error) {
+	events := []log.RestrictedNetworkLog{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), REPLAY_MAX_LINE_SIZE)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var entry struct {
+			log.RestrictedNetworkLog
+			Msg string `json:"msg"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("line %d is not a JSON log, the events are read from a log of log.format: json: %w", line, err)
+		}
+		if entry.Msg == log.NETWORK_EVENT_MESSAGE {
+			events = append(events, entry.RestrictedNetworkLog)
+		}
+	}
+	return events, scanner.Err()
+}
+
+// Replay decides the events again with the rules of conf, as Check does, and reports the ones
+// whose decision changes. An event was permitted unless it was blocked or names the rule that
+// denied it, as monitor mode reports, other than a deny entry in mode: monitor; it is denied by
+// conf whatever its network.mode, and a deny entry of conf in mode: monitor does not. The
+// domains of conf resolve to the addresses the events recorded for them, never to the ones
+// they resolve to now, so that a connection to an address of a domain is decided as it was
+// made. The path lists are not replayed: the events have no executable path.
+func Replay(conf *config.Config, events []log.RestrictedNetworkLog) (*ReplayReport, error) {
+	resolver := newRecordedResolver(events)
+	mgr, err := NewManager(conf, WithMapBackend(discardMaps{}), WithDNSResolver(resolver))
+	if err != nil {
+		return nil, err
+	}
+	defer mgr.Close()
+	if err := mgr.applyConfig(); err != nil {
+		return nil, err
+	}
+	if err := mgr.initDomainList(nil); err != nil {
+		return nil, err
+	}
+	for _, answer := range resolver.answers() {
+		if err := mgr.updateWildcardDomains(answer); err != nil {
+			return nil, err
+		}
+	}
+
+	report := &ReplayReport{}
+	newlyBlocked := map[ReplayDelta]uint64{}
+	newlyAllowed := map[ReplayDelta]uint64{}
+	for _, event := range events {
+		count := event.Count
+		if count == 0 {
+			count = 1
+		}
+		addr := net.ParseIP(event.Addr)
+		if event.Operation == OPERATION_BIND || event.Self || addr == nil {
+			report.Skipped += count
+			continue
+		}
+		report.Replayed += count
+
+		protocol := strings.ToLower(event.Protocol)
+		decision := mgr.Policy().Evaluate(Connection{
+			Addr:        addr,
+			Port:        event.Port,
+			SockType:    protocolSockType(protocol),
+			Command:     event.Comm,
+			UID:         event.UID,
+			GID:         event.GID,
+			InContainer: event.ContainerCgroup != "" || event.PolicyEntry == "network.container",
+		})
+		delta := ReplayDelta{Comm: event.Comm, Destination: event.Addr, Port: event.Port, Protocol: protocol}
+		if event.Domain != "" {
+			delta.Destination = toCanonicalDomain(event.Domain)
+		}
+
+		permitted := event.Action != ACTION_BLOCKED_STRING && (event.Rule == "" || event.MonitorRule)
+		switch {
+		case permitted && decision.Denied:
+			delta.Rule = decision.Rule
+			newlyBlocked[delta] += count
+		case !permitted && !decision.Denied:
+			delta.Rule = event.Rule
+			newlyAllowed[delta] += count
+		default:
+			report.Unchanged += count
+		}
+	}
+	report.NewlyBlocked = replayDeltas(newlyBlocked)
+	report.NewlyAllowed = replayDeltas(newlyAllowed)
+	return report, nil
+}
+
+// replayDeltas returns the deltas with their events, the most events first.
+func replayDeltas(counts map[ReplayDelta]uint64) []ReplayDelta {
+	deltas := []ReplayDelta{}
+	for delta, events := range counts {
+		delta.Events = events
+		deltas = append(deltas, delta)
+	}
+	sort.Slice(deltas, func(i, j int) bool {
+		a, b := deltas[i], deltas[j]
+		if a.Events != b.Events {
+			return a.Events > b.Events
+		}
+		if a.Comm != b.Comm {
+			return a.Comm < b.Comm
+		}
+		if a.Destination != b.Destination {
+			return a.Destination < b.Destination
+		}
+		if a.Port != b.Port {
+			return a.Port < b.Port
+		}
+		return a.Protocol < b.Protocol
+	})
+	return deltas
+}
+
+// recordedResolver answers with the addresses the events recorded for a domain. A domain no event
+// recorded has no address, rather than failing to resolve, so that network.domain.strict does not
+// fail the replay.
+type recordedResolver struct {
+	addresses map[string][]net.IP
+}
+
+func newRecordedResolver(events []log.RestrictedNetworkLog) *recordedResolver {
+	r := &recordedResolver{addresses: map[string][]net.IP{}}
+	seen := map[string]bool{}
+	for _, event := range events {
+		addr := net.ParseIP(event.Addr)
+		if event.Domain == "" || addr == nil {
+			continue
+		}
+		domain := toCanonicalDomain(event.Domain)
+		if seen[domain+" "+addr.String()] {
+			continue
+		}
+		seen[domain+" "+addr.String()] = true
+		r.addresses[domain] = append(r.addresses[domain], addr)
+	}
+	return r
+}
+
+func (r *recordedResolver) Resolve(host string, recordType uint16) (*DNSAnswer, error) {
+	answer := &DNSAnswer{Domain: toCanonicalDomain(host)}
+	for _, addr := range r.addresses[answer.Domain] {
+		if (addr.To4() == nil) == (recordType == dns.TypeAAAA) {
+			answer.Addresses = append(answer.Addresses, addr)
+		}
+	}
+	return answer, nil
+}
+
+// answers returns the A and the AAAA answer of every recorded domain, by domain.
+func (r *recordedResolver) answers() []*DNSAnswer {
+	domains := make([]string, 0, len(r.addresses))
+	for domain := range r.addresses {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+
+	answers := []*DNSAnswer{}
+	for _, domain := range domains {
+		for _, recordType := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			if answer, _ := r.Resolve(domain, recordType); len(answer.Addresses) > 0 {
+				answers = append(answers, answer)
+			}
+		}
+	}
+	return answers
+}
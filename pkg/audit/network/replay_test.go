@@ -0,0 +1,91 @@
+package network
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/mrtc0/bouheki/pkg/config"
+	log "github.com/mrtc0/bouheki/pkg/log"
+	"github.com/stretchr/testify/assert"
+)
+
+const replayTestEvents = `{"level":"info","msg":"Loaded the config.","time":"2026-10-08T12:00:00+09:00"}
+{"Action":"MONITOR","Addr":"93.184.216.34","Comm":"curl","Domain":"example.com","Port":443,"Protocol":"TCP","UID":1000,"msg":"Traffic is trapped in the filter."}
+{"Action":"MONITOR","Addr":"151.101.1.69","Comm":"curl","Domain":"img.cdn.example.net.","Port":443,"Protocol":"TCP","UID":1000,"msg":"Traffic is trapped in the filter."}
+{"Action":"MONITOR","Addr":"10.2.3.4","Comm":"psql","Port":5432,"Protocol":"TCP","UID":1000,"Count":4,"msg":"Traffic is trapped in the filter."}
+{"Action":"MONITOR","Addr":"10.1.2.3","Comm":"psql","Port":5432,"Protocol":"TCP","UID":1000,"msg":"Traffic is trapped in the filter."}
+{"Action":"MONITOR","Addr":"10.3.0.1","Comm":"wget","Port":443,"Protocol":"TCP","UID":1000,"Rule":"denied by cidr 10.3.0.0/16","MonitorRule":true,"msg":"Traffic is trapped in the filter."}
+{"Action":"BLOCKED","Addr":"192.0.2.1","Comm":"wget","Port":80,"Protocol":"TCP","UID":1000,"Rule":"denied by cidr allow list","msg":"Traffic is trapped in the filter."}
+{"Action":"MONITOR","Addr":"","Comm":"nginx","Operation":"bind","LocalAddr":"0.0.0.0","LocalPort":80,"Protocol":"TCP","msg":"Traffic is trapped in the filter."}
+{"Action":"MONITOR","Addr":"198.51.100.1","Comm":"bouheki","Port":443,"Protocol":"TCP","Self":true,"msg":"Traffic is trapped in the filter."}
+`
+
+func TestReadReplayEvents(t *testing.T) {
+	events, err := ReadReplayEvents(strings.NewReader(replayTestEvents))
+	assert.Nil(t, err)
+	assert.Len(t, events, 8)
+	assert.Equal(t, "curl", events[0].Comm)
+	assert.Equal(t, "example.com", events[0].Domain)
+	assert.Equal(t, uint32(1000), events[0].UID)
+	assert.Equal(t, uint64(4), events[2].Count)
+
+	_, err = ReadReplayEvents(strings.NewReader("time=2026-10-08T12:00:00+09:00 level=info msg=\"Loaded the config.\"\n"))
+	assert.NotNil(t, err)
+}
+
+func TestReplay(t *testing.T) {
+	events, err := ReadReplayEvents(strings.NewReader(replayTestEvents))
+	assert.Nil(t, err)
+
+	// The domains resolve to the addresses of the events, and the candidate is replayed whatever
+	// its mode. The wget to 10.3.0.1 was permitted, only a deny entry in mode: monitor named it.
+	conf := config.DefaultConfig()
+	conf.RestrictedNetworkConfig.Mode = "monitor"
+	conf.RestrictedNetworkConfig.CIDR.Allow = []string{"10.0.0.0/8", "192.0.2.0/24"}
+	conf.RestrictedNetworkConfig.CIDR.Deny = []string{"10.1.0.0/16"}
+	conf.RestrictedNetworkConfig.Domain.Allow = []string{"example.com", "*.cdn.example.net"}
+	conf.RestrictedNetworkConfig.Domain.Strict = true
+
+	report, err := Replay(conf, events)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(9), report.Replayed)
+	assert.Equal(t, uint64(2), report.Skipped)
+	assert.Equal(t, uint64(7), report.Unchanged)
+	assert.Equal(t, []ReplayDelta{
+		{Comm: "psql", Destination: "10.1.2.3", Port: 5432, Protocol: "tcp", Events: 1, Rule: "network.cidr.deny 10.1.0.0/16"},
+	}, report.NewlyBlocked)
+	assert.Equal(t, []ReplayDelta{
+		{Comm: "wget", Destination: "192.0.2.1", Port: 80, Protocol: "tcp", Events: 1, Rule: "denied by cidr allow list"},
+	}, report.NewlyAllowed)
+	assert.Equal(t, uint64(1), report.Regressions())
+
+	// Without the domains, the connections to their recorded addresses are newly blocked.
+	conf.RestrictedNetworkConfig.Domain.Allow = nil
+	conf.RestrictedNetworkConfig.CIDR.Deny = nil
+	report, err = Replay(conf, events)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), report.Regressions())
+	assert.Equal(t, "example.com", report.NewlyBlocked[0].Destination)
+	assert.Equal(t, "img.cdn.example.net", report.NewlyBlocked[1].Destination)
+}
+
+func TestRecordedResolver(t *testing.T) {
+	resolver := newRecordedResolver([]log.RestrictedNetworkLog{
+		{Addr: "93.184.216.34", Domain: "Example.com."},
+		{Addr: "93.184.216.34", Domain: "example.com"},
+		{Addr: "2001:db8::34", Domain: "example.com"},
+		{Addr: "10.2.3.4"},
+	})
+
+	answer, err := resolver.Resolve("example.com", dns.TypeA)
+	assert.Nil(t, err)
+	assert.Equal(t, "example.com", answer.Domain)
+	assert.Len(t, answer.Addresses, 1)
+	assert.Len(t, resolver.answers(), 2)
+
+	// A domain the events have no address for has none, rather than failing.
+	answer, err = resolver.Resolve("unknown.example.org", dns.TypeA)
+	assert.Nil(t, err)
+	assert.Empty(t, answer.Addresses)
+}
@@ -0,0 +1,318 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/aquasecurity/libbpfgo"
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/policy"
+)
+
+const (
+	// RESOURCES_PATH serves the ResourcesStatus as JSON on the metrics server.
+	RESOURCES_PATH = "/resources"
+
+	// HTAB_ELEM_OVERHEAD is the size of struct htab_elem before the key, on 64-bit kernels.
+	HTAB_ELEM_OVERHEAD = 48
+	// HTAB_BUCKET_SIZE is the size of struct bucket.
+	HTAB_BUCKET_SIZE = 16
+	// LPM_NODE_OVERHEAD is the size of struct lpm_trie_node before the data.
+	LPM_NODE_OVERHEAD = 40
+)
+
+// sizedMap is a map of the program whose max_entries is set by the resources config.
+type sizedMap struct {
+	name      string
+	lpm       bool
+	keySize   int
+	valueSize int
+}
+
+// sizedMaps are the maps sized by resources, with the key and the value of their definition.
+var sizedMaps = []sizedMap{
+	{name: ALLOWED_V4_CIDR_LIST_MAP_NAME, lpm: true, keySize: 8, valueSize: 1},
+	{name: ALLOWED_V6_CIDR_LIST_MAP_NAME, lpm: true, keySize: 20, valueSize: 1},
+	{name: DENIED_V4_CIDR_LIST_MAP_NAME, lpm: true, keySize: 8, valueSize: 1},
+	{name: DENIED_V6_CIDR_LIST_MAP_NAME, lpm: true, keySize: 20, valueSize: 1},
+	{name: ALLOWED_COMMAND_LIST_MAP_NAME, keySize: TASK_COMM_LEN, valueSize: 4},
+	{name: DENIED_COMMAND_LIST_MAP_NAME, keySize: TASK_COMM_LEN, valueSize: 4},
+	{name: ALLOWED_PATH_LIST_MAP_NAME, lpm: true, keySize: 4 + policy.EXE_PATH_LEN, valueSize: 1},
+	{name: DENIED_PATH_LIST_MAP_NAME, lpm: true, keySize: 4 + policy.EXE_PATH_LEN, valueSize: 1},
+	{name: ALLOWED_UID_LIST_MAP_NAME, keySize: 4, valueSize: 4},
+	{name: DENIED_UID_LIST_MAP_NAME, keySize: 4, valueSize: 4},
+	{name: ALLOWED_UID_RANGE_LIST_MAP_NAME, lpm: true, keySize: 8, valueSize: 1},
+	{name: DENIED_UID_RANGE_LIST_MAP_NAME, lpm: true, keySize: 8, valueSize: 1},
+	{name: ALLOWED_GID_LIST_MAP_NAME, keySize: 4, valueSize: 4},
+	{name: DENIED_GID_LIST_MAP_NAME, keySize: 4, valueSize: 4},
+	{name: CONTAINER_CGROUP_LIST_MAP_NAME, keySize: 8, valueSize: 1},
+	{name: ALLOWED_PORT_LIST_MAP_NAME, lpm: true, keySize: 8, valueSize: 1},
+	{name: DENIED_PORT_LIST_MAP_NAME, lpm: true, keySize: 8, valueSize: 1},
+	{name: ALLOWED_V4_PROTOCOL_CIDR_LIST_MAP_NAME, lpm: true, keySize: 12, valueSize: 1},
+	{name: ALLOWED_V6_PROTOCOL_CIDR_LIST_MAP_NAME, lpm: true, keySize: 24, valueSize: 1},
+	{name: DENIED_V4_PROTOCOL_CIDR_LIST_MAP_NAME, lpm: true, keySize: 12, valueSize: 1},
+	{name: DENIED_V6_PROTOCOL_CIDR_LIST_MAP_NAME, lpm: true, keySize: 24, valueSize: 1},
+	{name: INGRESS_ALLOWED_V4_CIDR_LIST_MAP_NAME, lpm: true, keySize: 8, valueSize: 1},
+	{name: INGRESS_ALLOWED_V6_CIDR_LIST_MAP_NAME, lpm: true, keySize: 20, valueSize: 1},
+	{name: INGRESS_DENIED_V4_CIDR_LIST_MAP_NAME, lpm: true, keySize: 8, valueSize: 1},
+	{name: INGRESS_DENIED_V6_CIDR_LIST_MAP_NAME, lpm: true, keySize: 20, valueSize: 1},
+	{name: INGRESS_ALLOWED_PORT_LIST_MAP_NAME, lpm: true, keySize: 8, valueSize: 1},
+	{name: INGRESS_DENIED_PORT_LIST_MAP_NAME, lpm: true, keySize: 8, valueSize: 1},
+	{name: POLICY_ENTRY_COMMAND_LIST_MAP_NAME, keySize: TASK_COMM_LEN, valueSize: 8},
+	{name: POLICY_ENTRY_UID_LIST_MAP_NAME, keySize: 4, valueSize: 8},
+	{name: POLICY_ENTRY_GID_LIST_MAP_NAME, keySize: 4, valueSize: 8},
+	{name: ALLOWED_V4_ENTRY_CIDR_LIST_MAP_NAME, lpm: true, keySize: 12, valueSize: 1},
+	{name: ALLOWED_V6_ENTRY_CIDR_LIST_MAP_NAME, lpm: true, keySize: 24, valueSize: 1},
+	{name: DENIED_V4_ENTRY_CIDR_LIST_MAP_NAME, lpm: true, keySize: 12, valueSize: 1},
+	{name: DENIED_V6_ENTRY_CIDR_LIST_MAP_NAME, lpm: true, keySize: 24, valueSize: 1},
+}
+
+// MapSizes are the max_entries of the sized maps, by map name.
+type MapSizes map[string]uint32
+
+// profileSizes returns the sizes of a profile: cidrs for each CIDR list, ids for each list
+// of commands, uids, gids and ports, each protocol list and each list of network.ingress, and
+// cgroups for the classified cgroups.
+func profileSizes(cidrs, ids, cgroups uint32) MapSizes {
+	sizes := MapSizes{}
+	for _, m := range sizedMaps {
+		switch {
+		case m.name == ALLOWED_PORT_LIST_MAP_NAME || m.name == DENIED_PORT_LIST_MAP_NAME, m.name == ALLOWED_PATH_LIST_MAP_NAME || m.name == DENIED_PATH_LIST_MAP_NAME,
+			m.name == ALLOWED_UID_RANGE_LIST_MAP_NAME || m.name == DENIED_UID_RANGE_LIST_MAP_NAME:
+			sizes[m.name] = ids
+		case isProtocolCIDRList(m.name), isIngressCIDRList(m.name), isEntryCIDRList(m.name), m.name == INGRESS_ALLOWED_PORT_LIST_MAP_NAME || m.name == INGRESS_DENIED_PORT_LIST_MAP_NAME:
+			// The protocol, the ingress and the entry lists are only written from the config, never from the rule sets.
+			sizes[m.name] = ids
+		case m.lpm:
+			sizes[m.name] = cidrs
+		case m.name == CONTAINER_CGROUP_LIST_MAP_NAME:
+			sizes[m.name] = cgroups
+		default:
+			sizes[m.name] = ids
+		}
+	}
+	return sizes
+}
+
+// The small profile is the size the maps are compiled with.
+var resourceProfiles = map[string]MapSizes{
+	config.RESOURCES_PROFILE_SMALL:  profileSizes(256, 256, 1024),
+	config.RESOURCES_PROFILE_MEDIUM: profileSizes(16384, 1024, 4096),
+	config.RESOURCES_PROFILE_LARGE:  profileSizes(524288, 4096, 16384),
+}
+
+// ProfileSizes returns the sizes of profile, without the overrides of resources.max_entries.
+func ProfileSizes(profile string) (MapSizes, error) {
+	sizes, ok := resourceProfiles[profile]
+	if !ok {
+		return nil, fmt.Errorf("resources.profile: unknown profile %q", profile)
+	}
+	return sizes.copy(), nil
+}
+
+// NewMapSizes returns the sizes of the profile of conf, with the overrides of resources.max_entries.
+// The resources.deny_shards shards of a deny list are sized as the deny list of the profile;
+// the other shards are never written, and keep the size they are compiled with.
+func NewMapSizes(conf config.ResourcesConfig) (MapSizes, error) {
+	sizes, err := ProfileSizes(conf.Profile)
+	if err != nil {
+		return nil, err
+	}
+	for _, mapName := range []string{DENIED_V4_CIDR_LIST_MAP_NAME, DENIED_V6_CIDR_LIST_MAP_NAME} {
+		for shard := 0; shard < conf.DenyShards; shard++ {
+			sizes[denyShardMapName(mapName, shard)] = sizes[mapName]
+		}
+	}
+
+	for name, entries := range conf.MaxEntries {
+		if _, ok := sizes[name]; !ok {
+			return nil, fmt.Errorf("resources.max_entries.%s: unknown map, must be one of %s", name, strings.Join(SizedMapNames(), ", "))
+		}
+		sizes[name] = entries
+	}
+	return sizes, nil
+}
+
+// SizedMapNames returns the names of the maps that resources sizes.
+func SizedMapNames() []string {
+	names := []string{}
+	for _, m := range sizedMaps {
+		names = append(names, m.name)
+	}
+	return names
+}
+
+func (s MapSizes) copy() MapSizes {
+	sizes := MapSizes{}
+	for name, entries := range s {
+		sizes[name] = entries
+	}
+	return sizes
+}
+
+// Names returns the names of the maps of s: the sized maps, followed by the shards in use.
+func (s MapSizes) Names() []string {
+	names := SizedMapNames()
+	for _, name := range denyShardMapNames() {
+		if _, ok := s[name]; ok {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Check returns an error for the first map that has fewer entries than required.
+func (s MapSizes) Check(conf config.ResourcesConfig, required map[string]int) error {
+	for _, name := range s.Names() {
+		n := required[name]
+		if n <= int(s[name]) {
+			continue
+		}
+		if entries, ok := conf.MaxEntries[name]; ok {
+			return fmt.Errorf("the policy needs %d entries in %s, but resources.max_entries.%s is %d", n, name, name, entries)
+		}
+		return fmt.Errorf("the policy needs %d entries in %s, but resources.profile %s has %d: use a larger resources.profile or set resources.max_entries.%s",
+			n, name, conf.Profile, s[name], name)
+	}
+	return nil
+}
+
+// Memory estimates the kernel memory of the map name with its size, in bytes.
+func (s MapSizes) Memory(name string) uint64 {
+	// A shard is defined as its deny list.
+	definition := name
+	if base, ok := denyShardBase(name); ok {
+		definition = base
+	}
+	for _, m := range sizedMaps {
+		if m.name == definition {
+			return m.memory(s[name])
+		}
+	}
+	return 0
+}
+
+// TotalMemory estimates the kernel memory of the sized maps, in bytes.
+func (s MapSizes) TotalMemory() uint64 {
+	total := uint64(0)
+	for _, name := range s.Names() {
+		total += s.Memory(name)
+	}
+	return total
+}
+
+// memory is an upper bound: a hash map preallocates all of its elements and a
+// bucket for each power of two, and a trie, which allocates its nodes as they are
+// inserted, has at most one intermediate node for every entry.
+func (m sizedMap) memory(entries uint32) uint64 {
+	if m.lpm {
+		return 2 * uint64(entries) * uint64(LPM_NODE_OVERHEAD+m.keySize-4+m.valueSize)
+	}
+	buckets := uint64(1)
+	for buckets < uint64(entries) {
+		buckets <<= 1
+	}
+	return uint64(entries)*uint64(HTAB_ELEM_OVERHEAD+roundUp8(m.keySize)+roundUp8(m.valueSize)) + buckets*HTAB_BUCKET_SIZE
+}
+
+func roundUp8(n int) int {
+	return (n + 7) &^ 7
+}
+
+// withRingBuf returns s with the size of AUDIT_EVENTS_MAP_NAME, in bytes, if size is set. The ring
+// buffer is resized with the maps, but it is not one of their Names.
+func (s MapSizes) withRingBuf(size uint32) MapSizes {
+	if size == 0 {
+		return s
+	}
+	sizes := s.copy()
+	sizes[AUDIT_EVENTS_MAP_NAME] = size
+	return sizes
+}
+
+// resize sets the max_entries of the maps of mod. It must be called before BPFLoadObject.
+func (s MapSizes) resize(mod *libbpfgo.Module) error {
+	names := make([]string, 0, len(s))
+	for name := range s {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		bpfMap, err := mod.GetMap(name)
+		if err != nil {
+			return err
+		}
+		if err := bpfMap.Resize(s[name]); err != nil {
+			return fmt.Errorf("failed to resize %s to %d entries: %w", name, s[name], err)
+		}
+	}
+	return nil
+}
+
+// RequiredEntries returns the number of entries that the rules of conf and the files of
+// network.rule_sets need in each map. A rule set file that can not be read is not counted;
+// its refresh reports the error. The addresses of the domains are not counted either,
+// since they are only known once the domains are resolved.
+func RequiredEntries(conf *config.Config) (map[string]int, error) {
+	state, err := policyState(conf.RestrictedNetworkConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, setConf := range conf.RestrictedNetworkConfig.RuleSets.Sets {
+		set := newRuleSet(setConf, conf.Resources.DenyShards, policy.DisabledFamilies(conf.RestrictedNetworkConfig), policy.ExceptPrefixes(conf.RestrictedNetworkConfig))
+		entries, _, err := set.load()
+		if err != nil {
+			continue
+		}
+		for mapName, keys := range entries {
+			for key, value := range keys {
+				state.set(mapName, []byte(key), value)
+			}
+		}
+	}
+
+	required := map[string]int{}
+	for mapName, entries := range state {
+		required[mapName] = len(entries)
+	}
+	return required, nil
+}
+
+// MapResources is the size of a map in the ResourcesStatus.
+type MapResources struct {
+	Name       string `json:"name"`
+	MaxEntries uint32 `json:"max_entries"`
+	// Required is the number of entries the policy needed when it was loaded.
+	Required int `json:"required"`
+	// Memory is the estimated kernel memory of the map, in bytes.
+	Memory uint64 `json:"memory"`
+}
+
+// ResourcesStatus is the size of the maps the programs were loaded with.
+type ResourcesStatus struct {
+	Profile string         `json:"profile"`
+	Maps    []MapResources `json:"maps"`
+}
+
+func newResourcesStatus(conf config.ResourcesConfig, sizes MapSizes, required map[string]int) ResourcesStatus {
+	status := ResourcesStatus{Profile: conf.Profile, Maps: []MapResources{}}
+	for _, name := range sizes.Names() {
+		status.Maps = append(status.Maps, MapResources{
+			Name:       name,
+			MaxEntries: sizes[name],
+			Required:   required[name],
+			Memory:     sizes.Memory(name),
+		})
+	}
+	return status
+}
+
+func (s ResourcesStatus) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
@@ -0,0 +1,131 @@
+package network
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/policy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMapSizes(t *testing.T) {
+	// The small profile is what the maps are compiled with.
+	small, err := NewMapSizes(config.DefaultConfig().Resources)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(256), small[DENIED_V4_CIDR_LIST_MAP_NAME])
+	assert.Equal(t, uint32(256), small[ALLOWED_COMMAND_LIST_MAP_NAME])
+	assert.Equal(t, uint32(1024), small[CONTAINER_CGROUP_LIST_MAP_NAME])
+	assert.Equal(t, len(SizedMapNames()), len(small))
+
+	sizes, err := NewMapSizes(config.ResourcesConfig{Profile: config.RESOURCES_PROFILE_MEDIUM, MaxEntries: map[string]uint32{DENIED_V4_CIDR_LIST_MAP_NAME: 600000}})
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(600000), sizes[DENIED_V4_CIDR_LIST_MAP_NAME])
+	assert.Equal(t, uint32(16384), sizes[DENIED_V6_CIDR_LIST_MAP_NAME])
+	// The protocol lists have the size of the lists of commands, not of the CIDR lists.
+	assert.Equal(t, uint32(1024), sizes[DENIED_V6_PROTOCOL_CIDR_LIST_MAP_NAME])
+
+	// The overrides do not change the profile.
+	medium, err := ProfileSizes(config.RESOURCES_PROFILE_MEDIUM)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(16384), medium[DENIED_V4_CIDR_LIST_MAP_NAME])
+
+	_, err = NewMapSizes(config.ResourcesConfig{Profile: config.RESOURCES_PROFILE_SMALL, MaxEntries: map[string]uint32{"audit_events": 1 << 20}})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "resources.max_entries.audit_events: unknown map")
+}
+
+func TestMapSizesMemory(t *testing.T) {
+	sizes, err := ProfileSizes(config.RESOURCES_PROFILE_SMALL)
+	assert.Nil(t, err)
+
+	// 2 * 256 trie nodes of 40 bytes, 4 bytes of address and 1 of value.
+	assert.Equal(t, uint64(23040), sizes.Memory(DENIED_V4_CIDR_LIST_MAP_NAME))
+	// 256 elements of 48 bytes, 16 of key and 8 of value, and 256 buckets of 16 bytes.
+	assert.Equal(t, uint64(22528), sizes.Memory(ALLOWED_COMMAND_LIST_MAP_NAME))
+	assert.Equal(t, uint64(81920), sizes.Memory(CONTAINER_CGROUP_LIST_MAP_NAME))
+	// The port lists are tries of the size of the id lists, with keys of the size of an IPv4 one.
+	assert.Equal(t, uint64(23040), sizes.Memory(DENIED_PORT_LIST_MAP_NAME))
+	// The keys of the protocol lists start with the socket type and are padded.
+	assert.Equal(t, uint64(2*256*(40+8+1)), sizes.Memory(ALLOWED_V4_PROTOCOL_CIDR_LIST_MAP_NAME))
+	// The ingress lists are tries of the size of the id lists too.
+	assert.Equal(t, uint64(2*256*(40+16+1)), sizes.Memory(INGRESS_ALLOWED_V6_CIDR_LIST_MAP_NAME))
+	// The path lists are tries of the size of the id lists, keyed by the path.
+	assert.Equal(t, uint64(2*256*(40+policy.EXE_PATH_LEN+1)), sizes.Memory(ALLOWED_PATH_LIST_MAP_NAME))
+	// The entry lists of network.policies are keyed as the protocol lists.
+	assert.Equal(t, uint64(2*256*(40+8+1)), sizes.Memory(DENIED_V4_ENTRY_CIDR_LIST_MAP_NAME))
+	// The uid range lists are tries of the size of the id lists, keyed by the uid.
+	assert.Equal(t, uint64(2*256*(40+4+1)), sizes.Memory(ALLOWED_UID_RANGE_LIST_MAP_NAME))
+	assert.Equal(t, uint64(1148928), sizes.TotalMemory())
+
+	// The buckets are rounded up to a power of two.
+	sizes[ALLOWED_UID_LIST_MAP_NAME] = 300
+	assert.Equal(t, uint64(300*64+512*16), sizes.Memory(ALLOWED_UID_LIST_MAP_NAME))
+
+	large, err := ProfileSizes(config.RESOURCES_PROFILE_LARGE)
+	assert.Nil(t, err)
+	assert.Greater(t, large.TotalMemory(), sizes.TotalMemory())
+}
+
+func TestRequiredEntries(t *testing.T) {
+	dir := t.TempDir()
+	writeRuleSetFile(t, filepath.Join(dir, "geoip-xx.txt"), append(prefixes(0, 300), "10.96.0.0/12"))
+
+	conf := config.DefaultConfig()
+	conf.RestrictedNetworkConfig.CIDR.Deny = []string{"10.96.0.0/12", "192.0.2.0/24"}
+	conf.RestrictedNetworkConfig.Command.Allow = []string{"curl", "wget"}
+	conf.RestrictedNetworkConfig.RuleSets.Sets = []config.RuleSetConfig{
+		{Name: "geoip-xx", List: config.RULE_SET_LIST_DENY, File: filepath.Join(dir, "geoip-xx.txt")},
+		{Name: "asn-64500", List: config.RULE_SET_LIST_ALLOW, File: filepath.Join(dir, "missing.txt")},
+	}
+
+	required, err := RequiredEntries(conf)
+	assert.Nil(t, err)
+	// The entries of the config and of the rule sets are counted once.
+	assert.Equal(t, 302, required[DENIED_V4_CIDR_LIST_MAP_NAME])
+	assert.Equal(t, 1, required[ALLOWED_V4_CIDR_LIST_MAP_NAME])
+	assert.Equal(t, 1, required[ALLOWED_V6_CIDR_LIST_MAP_NAME])
+	assert.Equal(t, 2, required[ALLOWED_COMMAND_LIST_MAP_NAME])
+
+	t.Run("a policy larger than the profile is rejected", func(t *testing.T) {
+		sizes, err := NewMapSizes(conf.Resources)
+		assert.Nil(t, err)
+		err = sizes.Check(conf.Resources, required)
+		assert.EqualError(t, err, "the policy needs 302 entries in denied_v4_cidr_list, but resources.profile small has 256: use a larger resources.profile or set resources.max_entries.denied_v4_cidr_list")
+	})
+
+	t.Run("an override too small is named", func(t *testing.T) {
+		resources := config.ResourcesConfig{Profile: config.RESOURCES_PROFILE_MEDIUM, MaxEntries: map[string]uint32{DENIED_V4_CIDR_LIST_MAP_NAME: 300}}
+		sizes, err := NewMapSizes(resources)
+		assert.Nil(t, err)
+		err = sizes.Check(resources, required)
+		assert.EqualError(t, err, "the policy needs 302 entries in denied_v4_cidr_list, but resources.max_entries.denied_v4_cidr_list is 300")
+	})
+
+	t.Run("a larger profile fits", func(t *testing.T) {
+		resources := config.ResourcesConfig{Profile: config.RESOURCES_PROFILE_MEDIUM}
+		sizes, err := NewMapSizes(resources)
+		assert.Nil(t, err)
+		assert.Nil(t, sizes.Check(resources, required))
+	})
+}
+
+func TestResourcesStatus(t *testing.T) {
+	resources := config.ResourcesConfig{Profile: config.RESOURCES_PROFILE_SMALL}
+	sizes, err := NewMapSizes(resources)
+	assert.Nil(t, err)
+
+	server := httptest.NewServer(newResourcesStatus(resources, sizes, map[string]int{DENIED_V4_CIDR_LIST_MAP_NAME: 3}))
+	defer server.Close()
+	res, err := server.Client().Get(server.URL)
+	assert.Nil(t, err)
+	defer res.Body.Close()
+
+	status := ResourcesStatus{}
+	assert.Nil(t, json.NewDecoder(res.Body).Decode(&status))
+	assert.Equal(t, config.RESOURCES_PROFILE_SMALL, status.Profile)
+	assert.Equal(t, len(SizedMapNames()), len(status.Maps))
+	assert.Equal(t, MapResources{Name: DENIED_V4_CIDR_LIST_MAP_NAME, MaxEntries: 256, Required: 3, Memory: 23040}, status.Maps[2])
+}
@@ -0,0 +1,589 @@
+package network
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+	log "github.com/mrtc0/bouheki/pkg/log"
+	"github.com/mrtc0/bouheki/pkg/policy"
+	"github.com/mrtc0/bouheki/pkg/policy/cidrset"
+)
+
+const (
+	RULE_LAST_HIT_MAP_NAME = "rule_last_hit"
+	RULE_HITS_FILE         = "rule-hits.json"
+	// RULE_HITS_VERSION is the version of the format of RULE_HITS_FILE.
+	RULE_HITS_VERSION = 1
+	// RULE_HIT_KEY_SIZE is the size of struct rule_hit_key.
+	RULE_HIT_KEY_SIZE = 24
+	// RULE_HIT_VALUE_SIZE is the size of struct rule_hit.
+	RULE_HIT_VALUE_SIZE = 16
+
+	// CLOCK_MONOTONIC is the clock of bpf_ktime_get_ns.
+	CLOCK_MONOTONIC = 1
+)
+
+// enum rule_list of restricted_network_structs.h.
+const (
+	RULE_LIST_ALLOWED_CIDR uint32 = iota
+	RULE_LIST_DENIED_CIDR
+	RULE_LIST_ALLOWED_COMMAND
+	RULE_LIST_DENIED_COMMAND
+	RULE_LIST_ALLOWED_UID
+	RULE_LIST_DENIED_UID
+	RULE_LIST_ALLOWED_GID
+	RULE_LIST_DENIED_GID
+	RULE_LIST_ALLOWED_PORT
+	RULE_LIST_DENIED_PORT
+)
+
+// RuleHit is when a rule, an entry of a list of the config, last matched a connection, and how
+// many times it did. A zero LastHit is a rule that never did. Hits counts the matches since the
+// rule was added to the config: a reload that keeps the list and the entry of the rule keeps its
+// count, and a rule removed from the config starts again from zero.
+type RuleHit struct {
+	List    string    `json:"list"`
+	Entry   string    `json:"entry"`
+	LastHit time.Time `json:"last_hit"`
+	Hits    uint64    `json:"hits"`
+}
+
+// RuleHits is the content of <state_dir>/rule-hits.json, by list and entry.
+type RuleHits struct {
+	Version int       `json:"version"`
+	Updated time.Time `json:"updated"`
+	Rules   []RuleHit `json:"rules"`
+}
+
+// RuleHitsPath returns the file holding the last hits of the rules in dir.
+func RuleHitsPath(dir string) string {
+	return filepath.Join(dir, RULE_HITS_FILE)
+}
+
+// ReadRuleHits reads the last hits of the rules kept in dir.
+func ReadRuleHits(dir string) (*RuleHits, error) {
+	path := RuleHitsPath(dir)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	hits := &RuleHits{}
+	if err := json.Unmarshal(data, hits); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if hits.Version != RULE_HITS_VERSION {
+		return nil, fmt.Errorf("%s: unsupported version %d, expected %d", path, hits.Version, RULE_HITS_VERSION)
+	}
+	return hits, nil
+}
+
+// readRuleHits returns the hits kept in dir, none if they can not be read.
+func readRuleHits(dir string) []RuleHit {
+	hits, err := ReadRuleHits(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warn(fmt.Sprintf("Ignoring the last hits of the rules: %s", err))
+		}
+		return nil
+	}
+	return hits.Rules
+}
+
+type ruleID struct {
+	list  string
+	entry string
+}
+
+// mergeRuleHits returns the most recent hit of every rule of previous and current, by list and
+// entry, with the sum of their counts.
+func mergeRuleHits(previous, current []RuleHit) []RuleHit {
+	merged := map[ruleID]RuleHit{}
+	for _, hits := range [][]RuleHit{previous, current} {
+		for _, hit := range hits {
+			id := ruleID{hit.List, hit.Entry}
+			m, ok := merged[id]
+			if !ok || hit.LastHit.After(m.LastHit) {
+				m.List, m.Entry, m.LastHit = hit.List, hit.Entry, hit.LastHit
+			}
+			m.Hits += hit.Hits
+			merged[id] = m
+		}
+	}
+
+	hits := make([]RuleHit, 0, len(merged))
+	for _, hit := range merged {
+		hits = append(hits, hit)
+	}
+	sortRuleHits(hits)
+	return hits
+}
+
+func sortRuleHits(hits []RuleHit) {
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].List != hits[j].List {
+			return hits[i].List < hits[j].List
+		}
+		return hits[i].Entry < hits[j].Entry
+	})
+}
+
+// PolicyRules returns every rule of export that a hit is recorded for, with a zero LastHit. The
+// groups are their entries, and the rule sets and network.ingress are not tracked.
+func PolicyRules(export *PolicyExport) []RuleHit {
+	rules := []RuleHit{}
+	add := func(list string, entries []string) {
+		for _, entry := range entries {
+			rules = append(rules, RuleHit{List: list, Entry: entry})
+		}
+	}
+	ids := func(ids []uint) []string {
+		entries := []string{}
+		for _, id := range ids {
+			entries = append(entries, strconv.FormatUint(uint64(id), 10))
+		}
+		return entries
+	}
+
+	add("network.cidr.allow", export.CIDR.Allow)
+	add("network.cidr.deny", export.CIDR.Deny)
+	add("network.domain.allow", export.Domain.Allow)
+	add("network.domain.deny", export.Domain.Deny)
+	add("network.command.allow", export.Command.Allow)
+	add("network.command.deny", export.Command.Deny)
+	add("network.uid.allow", append(ids(export.UID.Allow), export.uidRanges().Allow...))
+	add("network.uid.deny", append(ids(export.UID.Deny), export.uidRanges().Deny...))
+	add("network.gid.allow", ids(export.GID.Allow))
+	add("network.gid.deny", ids(export.GID.Deny))
+	add("network.ports.allow", export.Ports.Allow)
+	add("network.ports.deny", export.Ports.Deny)
+	for _, protocol := range ruleProtocols {
+		lists, ok := export.Protocols[protocol]
+		if !ok {
+			continue
+		}
+		add(protocolRuleList("cidr", protocol, "allow"), lists.CIDR.Allow)
+		add(protocolRuleList("cidr", protocol, "deny"), lists.CIDR.Deny)
+		add(protocolRuleList("domain", protocol, "allow"), lists.Domain.Allow)
+		add(protocolRuleList("domain", protocol, "deny"), lists.Domain.Deny)
+	}
+	sortRuleHits(rules)
+	return rules
+}
+
+func protocolRuleList(kind, protocol, list string) string {
+	return fmt.Sprintf("network.%s.protocols[%s].%s", kind, protocol, list)
+}
+
+// WithLastHits returns the rules of export with their last hit and their count in hits.
+func WithLastHits(export *PolicyExport, hits []RuleHit) []RuleHit {
+	latest := map[ruleID]RuleHit{}
+	for _, hit := range hits {
+		latest[ruleID{hit.List, hit.Entry}] = hit
+	}
+
+	rules := PolicyRules(export)
+	for i := range rules {
+		hit := latest[ruleID{rules[i].List, rules[i].Entry}]
+		rules[i].LastHit, rules[i].Hits = hit.LastHit, hit.Hits
+	}
+	return rules
+}
+
+// StaleRules returns the rules of export that did not match a connection in the last after,
+// including the ones that never did. It is advisory: the rules are never removed.
+func StaleRules(export *PolicyExport, hits []RuleHit, now time.Time, after time.Duration) []RuleHit {
+	stale := []RuleHit{}
+	for _, rule := range WithLastHits(export, hits) {
+		if rule.LastHit.IsZero() || now.Sub(rule.LastHit) >= after {
+			stale = append(stale, rule)
+		}
+	}
+	return stale
+}
+
+// ktimeToTime converts ktime, a bpf_ktime_get_ns of the programs, to the wall clock. monotonic
+// is the CLOCK_MONOTONIC read at now.
+func ktimeToTime(ktime uint64, now time.Time, monotonic time.Duration) time.Time {
+	return now.Add(time.Duration(ktime) - monotonic).UTC()
+}
+
+// monotonicNow reads CLOCK_MONOTONIC, the clock bpf_ktime_get_ns reads.
+func monotonicNow() (time.Duration, error) {
+	var ts syscall.Timespec
+	if _, _, errno := syscall.Syscall(syscall.SYS_CLOCK_GETTIME, CLOCK_MONOTONIC, uintptr(unsafe.Pointer(&ts)), 0); errno != 0 {
+		return 0, errno
+	}
+	return time.Duration(ts.Nano()), nil
+}
+
+// ruleHitKey is a struct rule_hit_key: what a rule of list was looked up with.
+type ruleHitKey struct {
+	list   uint32
+	family uint16
+	value  [16]byte
+}
+
+func decodeRuleHitKey(key []byte) (ruleHitKey, error) {
+	if len(key) != RULE_HIT_KEY_SIZE {
+		return ruleHitKey{}, fmt.Errorf("%s: unexpected key size %d", RULE_LAST_HIT_MAP_NAME, len(key))
+	}
+	k := ruleHitKey{list: binary.LittleEndian.Uint32(key[0:4]), family: binary.LittleEndian.Uint16(key[4:6])}
+	copy(k.value[:], key[8:])
+	return k, nil
+}
+
+// addr returns the destination address of a hit of the CIDR lists.
+func (k ruleHitKey) addr() net.IP {
+	if k.family == syscall.AF_INET6 {
+		return net.IP(append([]byte{}, k.value[:]...))
+	}
+	return net.IPv4(k.value[0], k.value[1], k.value[2], k.value[3])
+}
+
+// ruleHitIndex attributes the keys of RULE_LAST_HIT_MAP_NAME to the rules of a policy.
+type ruleHitIndex struct {
+	// cidrs are the CIDR lists of each side, allow or deny, by list name.
+	cidrs map[uint32]map[string]*cidrset.Set
+	// domains are the domains that resolved to each address, by side and list name.
+	domains map[uint32]map[string]map[string][]string
+	ids     map[uint32]map[string]bool
+	// patterns are the patterns of the command lists.
+	patterns map[uint32][]config.CommandPattern
+	// ports and uidRanges are the ranges of the port lists and of the uid lists.
+	ports     map[uint32][]string
+	uidRanges map[uint32][]string
+	names     map[uint32]string
+}
+
+// newRuleHitIndex indexes the rules of export. resolved are the domains of every list of
+// PolicyRules that resolved to each address.
+func newRuleHitIndex(export *PolicyExport, resolved map[string]map[string][]string) *ruleHitIndex {
+	index := &ruleHitIndex{
+		cidrs:     map[uint32]map[string]*cidrset.Set{RULE_LIST_ALLOWED_CIDR: {}, RULE_LIST_DENIED_CIDR: {}},
+		domains:   map[uint32]map[string]map[string][]string{RULE_LIST_ALLOWED_CIDR: {}, RULE_LIST_DENIED_CIDR: {}},
+		ids:       map[uint32]map[string]bool{},
+		patterns:  map[uint32][]config.CommandPattern{},
+		ports:     map[uint32][]string{RULE_LIST_ALLOWED_PORT: export.Ports.Allow, RULE_LIST_DENIED_PORT: export.Ports.Deny},
+		uidRanges: map[uint32][]string{RULE_LIST_ALLOWED_UID: export.uidRanges().Allow, RULE_LIST_DENIED_UID: export.uidRanges().Deny},
+		names: map[uint32]string{
+			RULE_LIST_ALLOWED_COMMAND: "network.command.allow",
+			RULE_LIST_DENIED_COMMAND:  "network.command.deny",
+			RULE_LIST_ALLOWED_UID:     "network.uid.allow",
+			RULE_LIST_DENIED_UID:      "network.uid.deny",
+			RULE_LIST_ALLOWED_GID:     "network.gid.allow",
+			RULE_LIST_DENIED_GID:      "network.gid.deny",
+			RULE_LIST_ALLOWED_PORT:    "network.ports.allow",
+			RULE_LIST_DENIED_PORT:     "network.ports.deny",
+		},
+	}
+
+	for _, rule := range PolicyRules(export) {
+		side := RULE_LIST_ALLOWED_CIDR
+		if strings.HasSuffix(rule.List, ".deny") {
+			side = RULE_LIST_DENIED_CIDR
+		}
+		switch {
+		case strings.HasPrefix(rule.List, "network.cidr."):
+			_, n, err := net.ParseCIDR(rule.Entry)
+			if err != nil {
+				continue
+			}
+			if index.cidrs[side][rule.List] == nil {
+				index.cidrs[side][rule.List] = cidrset.New()
+			}
+			index.cidrs[side][rule.List].Insert(n, rule.Entry)
+		case strings.HasPrefix(rule.List, "network.domain."):
+			index.domains[side][rule.List] = resolved[rule.List]
+		}
+	}
+
+	for list, entries := range map[uint32][]string{
+		RULE_LIST_ALLOWED_COMMAND: export.Command.Allow,
+		RULE_LIST_DENIED_COMMAND:  export.Command.Deny,
+	} {
+		index.ids[list] = map[string]bool{}
+		for _, entry := range entries {
+			index.ids[list][entry] = true
+		}
+		_, index.patterns[list] = config.SplitCommands(entries)
+	}
+	for list, ids := range map[uint32][]uint{
+		RULE_LIST_ALLOWED_UID: export.UID.Allow,
+		RULE_LIST_DENIED_UID:  export.UID.Deny,
+		RULE_LIST_ALLOWED_GID: export.GID.Allow,
+		RULE_LIST_DENIED_GID:  export.GID.Deny,
+	} {
+		index.ids[list] = map[string]bool{}
+		for _, id := range ids {
+			index.ids[list][strconv.FormatUint(uint64(id), 10)] = true
+		}
+	}
+	return index
+}
+
+// rules returns the rules a hit of key is attributed to. A destination is attributed to every
+// rule of its side that matches it: the longest prefix of each CIDR list, and every domain that
+// resolved to it. The kernel does not tell which of them it matched, and crediting all of them
+// never reports a rule in use as stale.
+func (i *ruleHitIndex) rules(key ruleHitKey) []ruleID {
+	ids := []ruleID{}
+	switch key.list {
+	case RULE_LIST_ALLOWED_CIDR, RULE_LIST_DENIED_CIDR:
+		addr := key.addr()
+		for list, set := range i.cidrs[key.list] {
+			if _, entry, ok := set.Lookup(addr); ok {
+				ids = append(ids, ruleID{list, entry.(string)})
+			}
+		}
+		for list, addresses := range i.domains[key.list] {
+			for _, domain := range addresses[addr.String()] {
+				ids = append(ids, ruleID{list, domain})
+			}
+		}
+	case RULE_LIST_ALLOWED_COMMAND, RULE_LIST_DENIED_COMMAND:
+		// A comm no command matches is attributed to every pattern it matches, as a destination is.
+		comm := strings.TrimRight(string(key.value[:]), "\x00")
+		if i.ids[key.list][comm] {
+			ids = append(ids, ruleID{i.names[key.list], comm})
+			break
+		}
+		for _, pattern := range i.patterns[key.list] {
+			if pattern.Match(comm) {
+				ids = append(ids, ruleID{i.names[key.list], pattern.String()})
+			}
+		}
+	case RULE_LIST_ALLOWED_UID, RULE_LIST_DENIED_UID, RULE_LIST_ALLOWED_GID, RULE_LIST_DENIED_GID:
+		uid := binary.LittleEndian.Uint32(key.value[:4])
+		if id := strconv.FormatUint(uint64(uid), 10); i.ids[key.list][id] {
+			ids = append(ids, ruleID{i.names[key.list], id})
+			break
+		}
+		// A uid no uid of the list has is attributed to every range of it that has the uid.
+		for _, entry := range i.uidRanges[key.list] {
+			if r, err := config.ParseUIDRange(entry); err == nil && r.Contains(uid) {
+				ids = append(ids, ruleID{i.names[key.list], entry})
+			}
+		}
+	case RULE_LIST_ALLOWED_PORT, RULE_LIST_DENIED_PORT:
+		port := binary.LittleEndian.Uint16(key.value[:2])
+		for _, entry := range i.ports[key.list] {
+			if r, err := config.ParsePortRange(entry); err == nil && r.First <= port && port <= r.Last {
+				ids = append(ids, ruleID{i.names[key.list], entry})
+			}
+		}
+	}
+	return ids
+}
+
+// attributeRuleHits converts the entries of RULE_LAST_HIT_MAP_NAME to the last hits of the rules
+// of index, with the matches counted since seen, the counts of the keys when they were last
+// attributed. A count below the one seen is of a key evicted and inserted again, counted from
+// zero. The keys no rule matches any more, e.g. of a rule removed by a reload, are dropped. It
+// returns the counts of the keys of entries, to be seen by the next attribution.
+func attributeRuleHits(index *ruleHitIndex, entries map[string][]byte, seen map[string]uint64, now time.Time, monotonic time.Duration) ([]RuleHit, map[string]uint64, error) {
+	hits := []RuleHit{}
+	counts := map[string]uint64{}
+	for rawKey, value := range entries {
+		key, err := decodeRuleHitKey([]byte(rawKey))
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(value) != RULE_HIT_VALUE_SIZE {
+			return nil, nil, fmt.Errorf("%s: unexpected value size %d", RULE_LAST_HIT_MAP_NAME, len(value))
+		}
+		last := ktimeToTime(binary.LittleEndian.Uint64(value[0:8]), now, monotonic)
+		count := binary.LittleEndian.Uint64(value[8:16])
+		counts[rawKey] = count
+		if previous := seen[rawKey]; previous <= count {
+			count -= previous
+		}
+		for _, id := range index.rules(key) {
+			hits = append(hits, RuleHit{List: id.list, Entry: id.entry, LastHit: last, Hits: count})
+		}
+	}
+	return mergeRuleHits(nil, hits), counts, nil
+}
+
+// resetRemovedRules returns hits with the count of the rules that are not in rules set to zero,
+// so that a rule added back to the config is counted from zero.
+func resetRemovedRules(hits []RuleHit, rules []RuleHit) []RuleHit {
+	current := map[ruleID]bool{}
+	for _, rule := range rules {
+		current[ruleID{rule.List, rule.Entry}] = true
+	}
+	for i := range hits {
+		if !current[ruleID{hits[i].List, hits[i].Entry}] {
+			hits[i].Hits = 0
+		}
+	}
+	return hits
+}
+
+// ruleHitRecorder keeps the last hits of the rules across the runs. The programs record the
+// matches in RULE_LAST_HIT_MAP_NAME, which starts empty with every run: the hits of the previous
+// runs are loaded from the state directory and merged with the ones of the map when they are written.
+//
+// The keys of the map are attributed to the rules of the config when they are collected, so the
+// matches are collected before a reload changes the rules, see Manager.replaceConfigIn.
+type ruleHitRecorder struct {
+	mgr  *Manager
+	conf config.RuleHitsConfig
+
+	mu   sync.Mutex
+	hits []RuleHit
+	// counts are the counts of the keys of the map when they were last collected.
+	counts    map[string]uint64
+	now       func() time.Time
+	monotonic func() (time.Duration, error)
+}
+
+func newRuleHitRecorder(mgr *Manager, conf config.RuleHitsConfig) *ruleHitRecorder {
+	return &ruleHitRecorder{
+		mgr:       mgr,
+		conf:      conf,
+		hits:      []RuleHit{},
+		counts:    map[string]uint64{},
+		now:       time.Now,
+		monotonic: monotonicNow,
+	}
+}
+
+// load continues the hits written by a previous run. Hits that do not exist yet are not an error.
+func (r *ruleHitRecorder) load() error {
+	hits, err := ReadRuleHits(r.conf.StateDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.hits = mergeRuleHits(r.hits, hits.Rules)
+	return nil
+}
+
+// collect merges the hits of the map into the ones kept, with the matches counted since the
+// last collect.
+func (r *ruleHitRecorder) collect() error {
+	entries, err := r.mgr.mapEntries(RULE_LAST_HIT_MAP_NAME)
+	if err != nil {
+		return err
+	}
+	monotonic, err := r.monotonic()
+	if err != nil {
+		return err
+	}
+
+	export := ExportPolicy(r.mgr.currentConfig())
+	index := newRuleHitIndex(export, r.mgr.resolvedDomains())
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	hits, counts, err := attributeRuleHits(index, entries, r.counts, r.now(), monotonic)
+	if err != nil {
+		return err
+	}
+	r.counts = counts
+	r.hits = resetRemovedRules(mergeRuleHits(r.hits, hits), PolicyRules(export))
+	return nil
+}
+
+// settle collects the matches of the rules in force, before a reload replaces them.
+func (r *ruleHitRecorder) settle() {
+	if err := r.collect(); err != nil {
+		log.Error(fmt.Errorf("failed to read the last hits of the rules: %w", err))
+	}
+}
+
+func (r *ruleHitRecorder) run(ctx context.Context) {
+	ticker := time.NewTicker(r.conf.WriteInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.flush()
+		}
+	}
+}
+
+// flush writes the hits kept, with the ones of the map, to the state directory.
+func (r *ruleHitRecorder) flush() {
+	r.settle()
+
+	r.mu.Lock()
+	hits := RuleHits{Version: RULE_HITS_VERSION, Updated: r.now().UTC(), Rules: append([]RuleHit{}, r.hits...)}
+	r.mu.Unlock()
+
+	data, err := json.Marshal(hits)
+	if err == nil {
+		err = writeStateFile(r.conf.StateDir, RULE_HITS_FILE, data)
+	}
+	if err != nil {
+		log.Error(fmt.Errorf("failed to write the last hits of the rules: %w", err))
+	}
+}
+
+// resolvedDomains returns the domains that live resolution, or the DNS proxy for a wildcard
+// domain, wrote each address for, by the list of PolicyRules they are in.
+func (m *Manager) resolvedDomains() map[string]map[string][]string {
+	domains := map[string]map[string][]string{}
+	add := func(mapName, domain string, key []byte) {
+		// The lists of network.policies do not record their matches.
+		if isEntryCIDRList(mapName) {
+			return
+		}
+		side := "allow"
+		if list, _ := mapList(mapName); list == policy.LIST_DENY_CIDR || list == policy.LIST_DENY_PROTOCOL_CIDR {
+			side = "deny"
+		}
+		protocol, n := cidrKeyToIPNet(mapName, key)
+		list := "network.domain." + side
+		for _, name := range ruleProtocols {
+			if protocol != PROTOCOL_ALL && protocolSockType(name) == protocol {
+				list = protocolRuleList("domain", name, side)
+			}
+		}
+		if domains[list] == nil {
+			domains[list] = map[string][]string{}
+		}
+		addr := n.IP.String()
+		domains[list][addr] = append(domains[list][addr], toCanonicalDomain(domain))
+	}
+
+	m.resolvedMu.Lock()
+	for mapName, byDomain := range m.resolved.keys {
+		for domain, keys := range byDomain {
+			for _, key := range keys {
+				add(mapName, domain, key)
+			}
+		}
+	}
+	m.resolvedMu.Unlock()
+
+	for id, patterns := range m.wildcards.domains() {
+		for _, pattern := range patterns {
+			add(id.mapName, pattern, []byte(id.key))
+		}
+	}
+	return domains
+}
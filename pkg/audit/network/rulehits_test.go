@@ -0,0 +1,203 @@
+package network
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/bouhekitest"
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func ruleHitKeyBytes(list uint32, family uint16, value []byte) []byte {
+	key := make([]byte, RULE_HIT_KEY_SIZE)
+	binary.LittleEndian.PutUint32(key[0:4], list)
+	binary.LittleEndian.PutUint16(key[4:6], family)
+	copy(key[8:], value)
+	return key
+}
+
+func ruleHitValue(ktime time.Duration, count uint64) []byte {
+	value := make([]byte, RULE_HIT_VALUE_SIZE)
+	binary.LittleEndian.PutUint64(value[0:8], uint64(ktime))
+	binary.LittleEndian.PutUint64(value[8:16], count)
+	return value
+}
+
+func TestKtimeToTime(t *testing.T) {
+	now := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	// Booted 10 hours ago: a hit 9 hours after the boot was an hour ago.
+	assert.Equal(t, now.Add(-time.Hour), ktimeToTime(uint64(9*time.Hour), now, 10*time.Hour))
+	assert.Equal(t, now, ktimeToTime(uint64(10*time.Hour), now, 10*time.Hour))
+
+	monotonic, err := monotonicNow()
+	assert.Nil(t, err)
+	assert.True(t, monotonic > 0)
+}
+
+func TestMergeRuleHits(t *testing.T) {
+	now := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	previous := []RuleHit{
+		{List: "network.cidr.allow", Entry: "10.0.0.0/8", LastHit: now.Add(-48 * time.Hour), Hits: 10},
+		{List: "network.command.allow", Entry: "curl", LastHit: now.Add(-time.Hour), Hits: 3},
+	}
+	current := []RuleHit{
+		{List: "network.cidr.allow", Entry: "10.0.0.0/8", LastHit: now, Hits: 2},
+		{List: "network.command.allow", Entry: "curl", LastHit: now.Add(-2 * time.Hour)},
+		{List: "network.uid.deny", Entry: "0", LastHit: now, Hits: 1},
+	}
+
+	assert.Equal(t, []RuleHit{
+		{List: "network.cidr.allow", Entry: "10.0.0.0/8", LastHit: now, Hits: 12},
+		{List: "network.command.allow", Entry: "curl", LastHit: now.Add(-time.Hour), Hits: 3},
+		{List: "network.uid.deny", Entry: "0", LastHit: now, Hits: 1},
+	}, mergeRuleHits(previous, current))
+	assert.Equal(t, mergeRuleHits(previous, current), mergeRuleHits(current, previous))
+}
+
+func TestStaleRules(t *testing.T) {
+	conf := config.DefaultConfig()
+	conf.RestrictedNetworkConfig.CIDR.Allow = []string{"10.0.0.0/8", "192.168.0.0/16"}
+	conf.RestrictedNetworkConfig.Domain.Allow = []string{"example.com"}
+	conf.RestrictedNetworkConfig.Command.Deny = []string{"nc"}
+	now := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	hits := []RuleHit{
+		{List: "network.cidr.allow", Entry: "10.0.0.0/8", LastHit: now.Add(-time.Hour)},
+		{List: "network.domain.allow", Entry: "example.com", LastHit: now.Add(-31 * 24 * time.Hour)},
+		// A rule that is no longer in the config is not reported.
+		{List: "network.cidr.allow", Entry: "172.16.0.0/12", LastHit: now.Add(-365 * 24 * time.Hour)},
+	}
+
+	assert.Equal(t, []RuleHit{
+		{List: "network.cidr.allow", Entry: "192.168.0.0/16"},
+		{List: "network.command.deny", Entry: "nc"},
+		{List: "network.domain.allow", Entry: "example.com", LastHit: now.Add(-31 * 24 * time.Hour)},
+	}, StaleRules(ExportPolicy(conf), hits, now, 30*24*time.Hour))
+	assert.Len(t, StaleRules(ExportPolicy(conf), hits, now, 60*24*time.Hour), 2)
+}
+
+func TestAttributeRuleHits(t *testing.T) {
+	conf := config.DefaultConfig()
+	conf.RestrictedNetworkConfig.CIDR.Allow = []string{"10.0.0.0/8", "10.1.0.0/16", "2001:db8::/32"}
+	conf.RestrictedNetworkConfig.CIDR.Deny = []string{"10.1.2.0/24"}
+	conf.RestrictedNetworkConfig.Domain.Allow = []string{"example.com"}
+	conf.RestrictedNetworkConfig.Command.Allow = []string{"curl", "python*", "py*"}
+	conf.RestrictedNetworkConfig.UID.Deny = []string{"0"}
+	conf.RestrictedNetworkConfig.Ports.Allow = []string{"443", "8000-8999"}
+	resolved := map[string]map[string][]string{"network.domain.allow": {"10.1.3.4": {"example.com"}}}
+	index := newRuleHitIndex(ExportPolicy(conf), resolved)
+
+	port := make([]byte, 2)
+	binary.LittleEndian.PutUint16(port, 8080)
+	uid := make([]byte, 4)
+	now := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	entries := map[string][]byte{
+		string(ruleHitKeyBytes(RULE_LIST_ALLOWED_CIDR, syscall.AF_INET, net.ParseIP("10.1.3.4").To4())): ruleHitValue(9*time.Hour, 9),
+		string(ruleHitKeyBytes(RULE_LIST_ALLOWED_CIDR, syscall.AF_INET6, net.ParseIP("2001:db8::1"))):   ruleHitValue(8*time.Hour, 8),
+		string(ruleHitKeyBytes(RULE_LIST_DENIED_CIDR, syscall.AF_INET, net.ParseIP("10.1.2.3").To4())):  ruleHitValue(7*time.Hour, 7),
+		string(ruleHitKeyBytes(RULE_LIST_ALLOWED_COMMAND, 0, []byte("curl"))):                           ruleHitValue(6*time.Hour, 6),
+		string(ruleHitKeyBytes(RULE_LIST_DENIED_UID, 0, uid)):                                           ruleHitValue(5*time.Hour, 5),
+		string(ruleHitKeyBytes(RULE_LIST_ALLOWED_PORT, 0, port)):                                        ruleHitValue(4*time.Hour, 4),
+		// A comm no command matches is attributed to every pattern it matches.
+		string(ruleHitKeyBytes(RULE_LIST_ALLOWED_COMMAND, 0, []byte("python3"))): ruleHitValue(2*time.Hour, 2),
+		// The command of a rule removed since the hit is dropped.
+		string(ruleHitKeyBytes(RULE_LIST_ALLOWED_COMMAND, 0, []byte("wget"))): ruleHitValue(3*time.Hour, 3),
+	}
+
+	hits, counts, err := attributeRuleHits(index, entries, map[string]uint64{}, now, 10*time.Hour)
+	assert.Nil(t, err)
+	assert.Equal(t, []RuleHit{
+		{List: "network.cidr.allow", Entry: "10.1.0.0/16", LastHit: now.Add(-time.Hour), Hits: 9},
+		{List: "network.cidr.allow", Entry: "2001:db8::/32", LastHit: now.Add(-2 * time.Hour), Hits: 8},
+		{List: "network.cidr.deny", Entry: "10.1.2.0/24", LastHit: now.Add(-3 * time.Hour), Hits: 7},
+		{List: "network.command.allow", Entry: "curl", LastHit: now.Add(-4 * time.Hour), Hits: 6},
+		{List: "network.command.allow", Entry: "py*", LastHit: now.Add(-8 * time.Hour), Hits: 2},
+		{List: "network.command.allow", Entry: "python*", LastHit: now.Add(-8 * time.Hour), Hits: 2},
+		{List: "network.domain.allow", Entry: "example.com", LastHit: now.Add(-time.Hour), Hits: 9},
+		{List: "network.ports.allow", Entry: "8000-8999", LastHit: now.Add(-6 * time.Hour), Hits: 4},
+		{List: "network.uid.deny", Entry: "0", LastHit: now.Add(-5 * time.Hour), Hits: 5},
+	}, hits)
+	assert.Len(t, counts, len(entries))
+
+	// The matches seen are not counted again, and a key evicted since counts from zero.
+	curl := string(ruleHitKeyBytes(RULE_LIST_ALLOWED_COMMAND, 0, []byte("curl")))
+	uid0 := string(ruleHitKeyBytes(RULE_LIST_DENIED_UID, 0, uid))
+	hits, _, err = attributeRuleHits(index, map[string][]byte{
+		curl: ruleHitValue(9*time.Hour, 10),
+		uid0: ruleHitValue(9*time.Hour, 2),
+	}, counts, now, 10*time.Hour)
+	assert.Nil(t, err)
+	assert.Equal(t, []RuleHit{
+		{List: "network.command.allow", Entry: "curl", LastHit: now.Add(-time.Hour), Hits: 4},
+		{List: "network.uid.deny", Entry: "0", LastHit: now.Add(-time.Hour), Hits: 2},
+	}, hits)
+
+	_, _, err = attributeRuleHits(index, map[string][]byte{"short": ruleHitValue(0, 0)}, map[string]uint64{}, now, 10*time.Hour)
+	assert.NotNil(t, err)
+	_, _, err = attributeRuleHits(index, map[string][]byte{curl: make([]byte, 8)}, map[string]uint64{}, now, 10*time.Hour)
+	assert.NotNil(t, err)
+}
+
+func TestRuleHitRecorder(t *testing.T) {
+	dir := t.TempDir()
+	conf := config.DefaultConfig()
+	conf.RestrictedNetworkConfig.Command.Allow = []string{"curl", "wget"}
+	conf.RestrictedNetworkConfig.RuleHits = config.RuleHitsConfig{Enable: true, StateDir: dir, WriteInterval: time.Minute}
+	maps := bouhekitest.NewMaps()
+	mgr := &Manager{config: conf, backend: maps}
+
+	now := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	previous := RuleHits{Version: RULE_HITS_VERSION, Updated: now.Add(-24 * time.Hour), Rules: []RuleHit{
+		{List: "network.command.allow", Entry: "curl", LastHit: now.Add(-48 * time.Hour), Hits: 5},
+		{List: "network.command.allow", Entry: "wget", LastHit: now.Add(-24 * time.Hour), Hits: 2},
+	}}
+	data, err := json.Marshal(previous)
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(RuleHitsPath(dir), data, 0600))
+
+	// The map of this run only has the hit of curl, since it was recreated.
+	assert.Nil(t, maps.Update(RULE_LAST_HIT_MAP_NAME, ruleHitKeyBytes(RULE_LIST_ALLOWED_COMMAND, 0, []byte("curl")), ruleHitValue(time.Hour, 3)))
+
+	recorder := newRuleHitRecorder(mgr, conf.RestrictedNetworkConfig.RuleHits)
+	recorder.now = func() time.Time { return now }
+	recorder.monotonic = func() (time.Duration, error) { return 2 * time.Hour, nil }
+	assert.Nil(t, recorder.load())
+	recorder.flush()
+
+	hits, err := ReadRuleHits(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, now, hits.Updated)
+	assert.Equal(t, []RuleHit{
+		{List: "network.command.allow", Entry: "curl", LastHit: now.Add(-time.Hour), Hits: 8},
+		{List: "network.command.allow", Entry: "wget", LastHit: now.Add(-24 * time.Hour), Hits: 2},
+	}, hits.Rules)
+
+	// A reload that keeps curl keeps its count, and wget, removed, is counted from zero.
+	assert.Nil(t, maps.Update(RULE_LAST_HIT_MAP_NAME, ruleHitKeyBytes(RULE_LIST_ALLOWED_COMMAND, 0, []byte("curl")), ruleHitValue(time.Hour, 4)))
+	next := *conf
+	next.RestrictedNetworkConfig.Command.Allow = []string{"curl"}
+	mgr.config = &next
+	recorder.flush()
+	hits, err = ReadRuleHits(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, []RuleHit{
+		{List: "network.command.allow", Entry: "curl", LastHit: now.Add(-time.Hour), Hits: 9},
+		{List: "network.command.allow", Entry: "wget", LastHit: now.Add(-24 * time.Hour)},
+	}, hits.Rules)
+
+	assert.Nil(t, os.WriteFile(RuleHitsPath(dir), []byte(`{"version": 2}`), 0600))
+	assert.NotNil(t, newRuleHitRecorder(mgr, conf.RestrictedNetworkConfig.RuleHits).load())
+}
+
+func TestConfigMapValueRuleHits(t *testing.T) {
+	conf := config.DefaultConfig()
+	assert.Equal(t, uint32(0), binary.LittleEndian.Uint32(ConfigMapValue(conf)[MAP_RULE_HITS_INDEX:]))
+
+	conf.RestrictedNetworkConfig.RuleHits.Enable = true
+	assert.Equal(t, uint32(1), binary.LittleEndian.Uint32(ConfigMapValue(conf)[MAP_RULE_HITS_INDEX:]))
+}
@@ -0,0 +1,567 @@
+package network
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/freeze"
+	"github.com/mrtc0/bouheki/pkg/jobs"
+	log "github.com/mrtc0/bouheki/pkg/log"
+	"github.com/mrtc0/bouheki/pkg/policy"
+)
+
+const (
+	// RULE_SETS_PATH serves the RuleSetProgress of every rule set as JSON on the metrics server.
+	RULE_SETS_PATH = "/rule_sets"
+
+	// RULE_SET_RETRY_INTERVAL is the delay before a failed refresh is attempted again.
+	RULE_SET_RETRY_INTERVAL = time.Minute
+)
+
+// RuleSetProgress is the state of the last refresh of a rule set.
+type RuleSetProgress struct {
+	Name string `json:"name"`
+	List string `json:"list"`
+	// Digest is the SHA-256 of the file being applied.
+	Digest string `json:"digest"`
+	// Installed is the number of entries of the set in the maps.
+	Installed int `json:"installed"`
+	// Applied of Total writes of the refresh are done.
+	Applied   int       `json:"applied"`
+	Total     int       `json:"total"`
+	Complete  bool      `json:"complete"`
+	StartedAt time.Time `json:"started_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// ruleSet is a bulk list of CIDRs read from a file. Every entry is tagged with the set,
+// so that a refresh only writes the difference with what the set installed before.
+type ruleSet struct {
+	conf                 config.RuleSetConfig
+	v4MapName, v6MapName string
+	// shards is the number of shards a deny set is split across, see resources.deny_shards.
+	shards int
+	// disabledFamilies are the families whose entries are not installed, see network.families.
+	disabledFamilies uint32
+	// excepts are the prefixes of network.cidr.allow_except, whose deny entries have exceptValue.
+	excepts []*net.IPNet
+
+	// installed is what the set has written to the maps. It is only written by the jobs of the set.
+	installed mapState
+
+	mu       sync.Mutex
+	progress RuleSetProgress
+}
+
+func newRuleSet(conf config.RuleSetConfig, denyShards int, disabledFamilies uint32, excepts []*net.IPNet) *ruleSet {
+	set := &ruleSet{
+		conf:             conf,
+		v4MapName:        ALLOWED_V4_CIDR_LIST_MAP_NAME,
+		v6MapName:        ALLOWED_V6_CIDR_LIST_MAP_NAME,
+		disabledFamilies: disabledFamilies,
+		installed:        mapState{},
+		progress:         RuleSetProgress{Name: conf.Name, List: conf.List},
+	}
+	if conf.List == config.RULE_SET_LIST_DENY {
+		set.v4MapName = DENIED_V4_CIDR_LIST_MAP_NAME
+		set.v6MapName = DENIED_V6_CIDR_LIST_MAP_NAME
+		set.shards = denyShards
+		set.excepts = excepts
+	}
+	return set
+}
+
+// load reads the file of the set, with the entries of a sharded set in their shard.
+func (s *ruleSet) load() (mapState, string, error) {
+	state, digest, err := loadRuleSetFile(s.conf.File, s.v4MapName, s.v6MapName)
+	if err != nil {
+		return state, digest, err
+	}
+	state.dropFamilies(s.disabledFamilies)
+	if s.shards == 0 {
+		state.markExcepts(s.excepts)
+		return state, digest, nil
+	}
+	return shardState(state, s.shards), digest, nil
+}
+
+func (s *ruleSet) Progress() RuleSetProgress {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.progress
+}
+
+func (s *ruleSet) update(f func(p *RuleSetProgress)) RuleSetProgress {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f(&s.progress)
+	s.progress.Installed = s.installed.len()
+	return s.progress
+}
+
+// loadRuleSetFile reads a file of one CIDR per line. Blank lines and lines starting with # are skipped.
+func loadRuleSetFile(path string, v4MapName, v6MapName string) (mapState, string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, "", err
+	}
+	digest := sha256.Sum256(data)
+
+	state := mapState{}
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		if err := state.setCIDRs([]string{entry}, v4MapName, v6MapName); err != nil {
+			return nil, "", fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, "", err
+	}
+
+	return state, hex.EncodeToString(digest[:]), nil
+}
+
+// refreshRuleSet writes the difference between the file of set and what the set installed,
+// one job of network.rule_sets.chunk_size writes at a time, so that the other jobs run in
+// between. The writes of a sharded set only touch the shards of the entries that changed. The additions come first: when a chunk fails, every entry of the previous version
+// is still in the maps, and the next refresh resumes from the failed chunk. It stops between two
+// chunks once ctx is done.
+func (m *Manager) refreshRuleSet(ctx context.Context, set *ruleSet) error {
+	conf := m.config.RestrictedNetworkConfig.RuleSets
+
+	desired, digest, err := set.load()
+	if err != nil {
+		m.saveRuleSetProgress(set.update(func(p *RuleSetProgress) { p.Error = err.Error() }))
+		return err
+	}
+
+	ops := diffState(set.installed, desired)
+	previous := set.Progress()
+	if len(ops) == 0 && previous.Digest == digest && previous.Complete {
+		return nil
+	}
+	if previous.Digest != digest || previous.Complete {
+		// The next run rebuilds what the set installed from what it had and the changes applied.
+		m.saveRuleSetBase(set.conf.Name, ruleSetBase{Digest: digest, Base: encodeState(set.snapshot()), Target: encodeState(desired)})
+	}
+
+	progress := set.update(func(p *RuleSetProgress) {
+		now := m.now()
+		if p.Digest != digest || p.Complete {
+			*p = RuleSetProgress{Name: p.Name, List: p.List, Digest: digest, StartedAt: now}
+		}
+		// An interrupted refresh of the same file keeps what it applied.
+		p.Total = p.Applied + len(ops)
+		p.Complete = len(ops) == 0
+		p.UpdatedAt = now
+		p.Error = ""
+	})
+	m.saveRuleSetProgress(progress)
+
+	for start := 0; start < len(ops); start += conf.ChunkSize {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		end := start + conf.ChunkSize
+		if end > len(ops) {
+			end = len(ops)
+		}
+		chunk := ops[start:end]
+
+		name := fmt.Sprintf("rule-set %s %d/%d", set.conf.Name, progress.Applied+len(chunk), progress.Total)
+		err := m.runJob(name, freeze.CHANGE_RULE_SET_REFRESH, func(ctx context.Context) error {
+			return m.applyRuleSetOps(set, chunk)
+		})
+		progress = set.update(func(p *RuleSetProgress) {
+			p.UpdatedAt = m.now()
+			p.Complete = err == nil && end == len(ops)
+			if err != nil {
+				p.Error = err.Error()
+			}
+		})
+		m.saveRuleSetProgress(progress)
+		if err != nil {
+			return err
+		}
+
+		if end < len(ops) && conf.ChunkDelay > 0 {
+			if err := m.sleepContext(ctx, conf.ChunkDelay); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(ops) > 0 {
+		log.Info(fmt.Sprintf("rule set %s: applied %d changes, %d entries installed", set.conf.Name, len(ops), progress.Installed))
+	}
+	return nil
+}
+
+// applyRuleSetOps writes ops of set to the maps. An entry that is removed from set is left
+// in the maps if the config, another rule set, the self exemption, a runtime rule or live resolution
+// still has it.
+func (m *Manager) applyRuleSetOps(set *ruleSet, ops []mapOp) error {
+	for _, op := range ops {
+		if op.isDelete() && (m.configured(op.mapName, op.key) || m.inRuleSet(op.mapName, op.key, set) || m.selfExempted(op.mapName, op.key) || m.runtimeRule(op.mapName, op.key) || m.resolvedAddress(op.mapName, op.key)) {
+			set.record(op)
+			continue
+		}
+
+		table, err := m.policyMap(op.mapName)
+		if err != nil {
+			return err
+		}
+		if op.isDelete() {
+			err = table.DeleteKey(op.key)
+		} else {
+			err = table.Update(op.key, op.value)
+		}
+		if err != nil {
+			return err
+		}
+
+		m.mirror(op)
+		set.record(op)
+	}
+	return nil
+}
+
+// record records a successful write of the set.
+func (s *ruleSet) record(op mapOp) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if op.isDelete() {
+		s.installed.delete(op.mapName, op.key)
+	} else {
+		s.installed.set(op.mapName, op.key, op.value)
+	}
+	s.progress.Applied++
+	s.progress.Installed = s.installed.len()
+}
+
+// snapshot returns a copy of what the set has installed.
+func (s *ruleSet) snapshot() mapState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state := mapState{}
+	for mapName, entries := range s.installed {
+		for key, value := range entries {
+			state.set(mapName, []byte(key), value)
+		}
+	}
+	return state
+}
+
+func (s *ruleSet) has(mapName string, key []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.installed[mapName][string(key)]
+	return ok
+}
+
+// configured reports whether applyState has written key to mapName.
+func (m *Manager) configured(mapName string, key []byte) bool {
+	m.loadedMu.Lock()
+	defer m.loadedMu.Unlock()
+	_, ok := m.loaded[mapName][string(key)]
+	return ok
+}
+
+// inRuleSet reports whether a rule set other than except has installed key in mapName.
+func (m *Manager) inRuleSet(mapName string, key []byte, except *ruleSet) bool {
+	for _, set := range m.ruleSets {
+		if set != except && set.has(mapName, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// ruleSetProgressPath returns the file the progress of set is kept in, or "" if network.rule_sets.state_dir is not set.
+func (m *Manager) ruleSetProgressPath(name string) string {
+	dir := m.config.RestrictedNetworkConfig.RuleSets.StateDir
+	if dir == "" {
+		return ""
+	}
+	return filepath.Join(dir, name+".json")
+}
+
+func (m *Manager) saveRuleSetProgress(progress RuleSetProgress) {
+	path := m.ruleSetProgressPath(progress.Name)
+	if path == "" {
+		return
+	}
+
+	data, err := json.Marshal(progress)
+	if err == nil {
+		// Written to a temporary file first, so a crash never leaves a truncated marker.
+		tmp := path + ".tmp"
+		if err = ioutil.WriteFile(tmp, data, 0600); err == nil {
+			err = os.Rename(tmp, path)
+		}
+	}
+	if err != nil {
+		log.Error(fmt.Errorf("rule set %s: failed to save the progress: %w", progress.Name, err))
+	}
+}
+
+// loadRuleSetProgress returns the progress saved by a previous run, if any.
+func (m *Manager) loadRuleSetProgress(name string) (RuleSetProgress, bool) {
+	path := m.ruleSetProgressPath(name)
+	if path == "" {
+		return RuleSetProgress{}, false
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Error(fmt.Errorf("rule set %s: %w", name, err))
+		}
+		return RuleSetProgress{}, false
+	}
+
+	progress := RuleSetProgress{}
+	if err := json.Unmarshal(data, &progress); err != nil {
+		log.Error(fmt.Errorf("rule set %s: ignoring the saved progress: %w", name, err))
+		return RuleSetProgress{}, false
+	}
+	return progress, true
+}
+
+// ruleSetBase is what a rule set had installed when the refresh of Digest started, and what the
+// file of Digest has, from which the next run tells what the set has installed, see resumeRuleSet.
+type ruleSetBase struct {
+	Digest string       `json:"digest"`
+	Base   encodedState `json:"base"`
+	Target encodedState `json:"target"`
+}
+
+// encodedState is a mapState written as JSON: map name -> hex key -> hex value.
+type encodedState map[string]map[string]string
+
+func encodeState(state mapState) encodedState {
+	encoded := encodedState{}
+	for mapName, entries := range state {
+		encoded[mapName] = map[string]string{}
+		for key, value := range entries {
+			encoded[mapName][hex.EncodeToString([]byte(key))] = hex.EncodeToString(value)
+		}
+	}
+	return encoded
+}
+
+func decodeState(encoded encodedState) (mapState, error) {
+	state := mapState{}
+	for mapName, entries := range encoded {
+		for key, value := range entries {
+			k, err := hex.DecodeString(key)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", mapName, err)
+			}
+			v, err := hex.DecodeString(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", mapName, err)
+			}
+			state.set(mapName, k, v)
+		}
+	}
+	return state, nil
+}
+
+// ruleSetBasePath returns the file the base of set is kept in, or "" if network.rule_sets.state_dir is not set.
+func (m *Manager) ruleSetBasePath(name string) string {
+	dir := m.config.RestrictedNetworkConfig.RuleSets.StateDir
+	if dir == "" {
+		return ""
+	}
+	return filepath.Join(dir, name+".base.json")
+}
+
+func (m *Manager) saveRuleSetBase(name string, base ruleSetBase) {
+	path := m.ruleSetBasePath(name)
+	if path == "" {
+		return
+	}
+
+	data, err := json.Marshal(base)
+	if err == nil {
+		tmp := path + ".tmp"
+		if err = ioutil.WriteFile(tmp, data, 0600); err == nil {
+			err = os.Rename(tmp, path)
+		}
+	}
+	if err != nil {
+		log.Error(fmt.Errorf("rule set %s: failed to save the base: %w", name, err))
+	}
+}
+
+func (m *Manager) loadRuleSetBase(name string) (ruleSetBase, bool) {
+	path := m.ruleSetBasePath(name)
+	if path == "" {
+		return ruleSetBase{}, false
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Error(fmt.Errorf("rule set %s: %w", name, err))
+		}
+		return ruleSetBase{}, false
+	}
+
+	base := ruleSetBase{}
+	if err := json.Unmarshal(data, &base); err != nil {
+		log.Error(fmt.Errorf("rule set %s: ignoring the saved base: %w", name, err))
+		return ruleSetBase{}, false
+	}
+	return base, true
+}
+
+// resumeRuleSet continues the refresh of set the previous run saved in previous, in maps that
+// have what it wrote, e.g. the pinned maps bouheki adopted: the first previous.Applied changes from
+// the base to the file are installed already, so the refresh resumes after them. Only the
+// entries the maps have are taken as installed; in maps created empty, the set is applied again.
+func (m *Manager) resumeRuleSet(set *ruleSet, previous RuleSetProgress, present mapState) {
+	saved, ok := m.loadRuleSetBase(set.conf.Name)
+	if !ok || saved.Digest != previous.Digest {
+		if !previous.Complete {
+			log.Warn(fmt.Sprintf("rule set %s: the previous run stopped after %d of %d changes, applying the set again",
+				set.conf.Name, previous.Applied, previous.Total))
+		}
+		return
+	}
+	base, err := decodeState(saved.Base)
+	if err == nil {
+		var target mapState
+		if target, err = decodeState(saved.Target); err == nil {
+			ops := diffState(base, target)
+			if previous.Applied < len(ops) {
+				ops = ops[:previous.Applied]
+			}
+			for _, op := range ops {
+				if op.isDelete() {
+					base.delete(op.mapName, op.key)
+				} else {
+					base.set(op.mapName, op.key, op.value)
+				}
+			}
+		}
+	}
+	if err != nil {
+		log.Error(fmt.Errorf("rule set %s: ignoring the saved base: %w", set.conf.Name, err))
+		return
+	}
+
+	missing := 0
+	for mapName, entries := range base {
+		for key := range entries {
+			if value, ok := present[mapName][key]; ok {
+				set.installed.set(mapName, []byte(key), value)
+			} else {
+				missing++
+			}
+		}
+	}
+	if missing > 0 {
+		if !previous.Complete {
+			log.Warn(fmt.Sprintf("rule set %s: the previous run stopped after %d of %d changes, applying the set again",
+				set.conf.Name, previous.Applied, previous.Total))
+		}
+		return
+	}
+
+	set.update(func(p *RuleSetProgress) { *p = previous })
+	if !previous.Complete {
+		log.Info(fmt.Sprintf("rule set %s: resuming after %d of %d changes", set.conf.Name, previous.Applied, previous.Total))
+	}
+}
+
+// initRuleSets creates the rule sets of the config, resuming what the previous run saved. It does
+// not write them; see AsyncRuleSets.
+func (m *Manager) initRuleSets() {
+	m.ruleSets = nil
+	var present mapState
+	for _, conf := range m.config.RestrictedNetworkConfig.RuleSets.Sets {
+		set := newRuleSet(conf, m.config.Resources.DenyShards, policy.DisabledFamilies(m.config.RestrictedNetworkConfig), policy.ExceptPrefixes(m.config.RestrictedNetworkConfig))
+
+		if previous, ok := m.loadRuleSetProgress(conf.Name); ok {
+			if present == nil {
+				var err error
+				if present, err = m.presentState(); err != nil {
+					log.Error(fmt.Errorf("rule set %s: %w", conf.Name, err))
+					present = mapState{}
+				}
+			}
+			m.resumeRuleSet(set, previous, present)
+		}
+
+		m.ruleSets = append(m.ruleSets, set)
+	}
+}
+
+// AsyncRuleSets applies the rule sets in the background and refreshes them every refresh_interval,
+// until ctx is done or Close stops them.
+func (m *Manager) AsyncRuleSets(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	m.mu.Lock()
+	m.stopRuleSets = cancel
+	m.mu.Unlock()
+
+	for _, set := range m.ruleSets {
+		m.ruleSetsRunning.Add(1)
+		go func(set *ruleSet) {
+			defer m.ruleSetsRunning.Done()
+			for {
+				err := m.refreshRuleSet(ctx, set)
+				if errors.Is(err, jobs.ErrStopped) || ctx.Err() != nil {
+					return
+				}
+
+				interval := set.conf.RefreshInterval
+				if err != nil {
+					if !errors.Is(err, jobs.ErrRejected) {
+						log.Error(fmt.Errorf("rule set %s: %w", set.conf.Name, err))
+					}
+					interval = RULE_SET_RETRY_INTERVAL
+				} else if interval == 0 {
+					return
+				}
+				if m.sleepContext(ctx, interval) != nil {
+					return
+				}
+			}
+		}(set)
+	}
+}
+
+// ruleSetsStatus serves the progress of the rule sets.
+type ruleSetsStatus []*ruleSet
+
+func (s ruleSetsStatus) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	status := []RuleSetProgress{}
+	for _, set := range s {
+		status = append(status, set.Progress())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,294 @@
+package network
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/bouhekitest"
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/jobs"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeRuleSetFile(t *testing.T, path string, cidrs []string) {
+	data := "# generated from a GeoIP database\n\n" + strings.Join(cidrs, "\n") + "\n"
+	assert.Nil(t, ioutil.WriteFile(path, []byte(data), 0600))
+}
+
+// prefixes returns n distinct /24 prefixes starting from 10.first.0.0.
+func prefixes(first, n int) []string {
+	cidrs := []string{}
+	for i := 0; i < n; i++ {
+		cidrs = append(cidrs, fmt.Sprintf("10.%d.%d.0/24", first+i/256, i%256))
+	}
+	return cidrs
+}
+
+func newRuleSetTestManager(t *testing.T, chunkSize int) (*Manager, *bouhekitest.Maps, string) {
+	dir := t.TempDir()
+	conf := config.DefaultConfig()
+	conf.RestrictedNetworkConfig.RuleSets.ChunkSize = chunkSize
+	conf.RestrictedNetworkConfig.RuleSets.ChunkDelay = 0
+	conf.RestrictedNetworkConfig.RuleSets.StateDir = dir
+	conf.RestrictedNetworkConfig.RuleSets.Sets = []config.RuleSetConfig{
+		{Name: "geoip-xx", List: config.RULE_SET_LIST_DENY, File: filepath.Join(dir, "geoip-xx.txt")},
+	}
+
+	maps := bouhekitest.NewMaps()
+	mgr := &Manager{config: conf, backend: maps}
+	assert.Nil(t, mgr.SetConfigToMap())
+	return mgr, maps, filepath.Join(dir, "geoip-xx.txt")
+}
+
+func ruleSetJobs(q *jobs.Queue) []jobs.Info {
+	infos := []jobs.Info{}
+	for _, info := range q.Status().History {
+		if strings.HasPrefix(info.Name, "rule-set ") {
+			infos = append(infos, info)
+		}
+	}
+	return infos
+}
+
+func TestRuleSetIsAppliedInChunks(t *testing.T) {
+	mgr, maps, file := newRuleSetTestManager(t, 1000)
+	defer mgr.Jobs().Stop()
+	writeRuleSetFile(t, file, prefixes(0, 4500))
+
+	writes := len(maps.Writes())
+	assert.Nil(t, mgr.refreshRuleSet(context.Background(), mgr.ruleSets[0]))
+
+	assert.Equal(t, 4500, len(maps.Writes())-writes)
+	assert.Len(t, maps.Entries(DENIED_V4_CIDR_LIST_MAP_NAME), 4500)
+	names := []string{}
+	for _, info := range ruleSetJobs(mgr.Jobs()) {
+		assert.Equal(t, jobs.OUTCOME_OK, info.Outcome)
+		names = append(names, info.Name)
+	}
+	assert.Equal(t, []string{
+		"rule-set geoip-xx 1000/4500",
+		"rule-set geoip-xx 2000/4500",
+		"rule-set geoip-xx 3000/4500",
+		"rule-set geoip-xx 4000/4500",
+		"rule-set geoip-xx 4500/4500",
+	}, names)
+
+	progress := mgr.ruleSets[0].Progress()
+	assert.True(t, progress.Complete)
+	assert.Equal(t, 4500, progress.Installed)
+	assert.True(t, mgr.Policy().Evaluate(Connection{Addr: net.ParseIP("10.0.1.1")}).DenyListed)
+
+	// The same file again writes nothing.
+	writes = len(maps.Writes())
+	assert.Nil(t, mgr.refreshRuleSet(context.Background(), mgr.ruleSets[0]))
+	assert.Equal(t, writes, len(maps.Writes()))
+}
+
+func TestRuleSetChunksInterleaveWithOtherJobs(t *testing.T) {
+	mgr, maps, file := newRuleSetTestManager(t, 2)
+	defer mgr.Jobs().Stop()
+	writeRuleSetFile(t, file, prefixes(0, 6))
+
+	// A manual rule submitted while the first chunk is written runs before the second chunk.
+	submitted := false
+	maps.OnWrite(func(w bouhekitest.Write) {
+		if submitted {
+			return
+		}
+		submitted = true
+		_, err := mgr.Jobs().Submit("manual-rule", func(ctx context.Context) error { return nil })
+		assert.Nil(t, err)
+	})
+
+	assert.Nil(t, mgr.refreshRuleSet(context.Background(), mgr.ruleSets[0]))
+
+	names := []string{}
+	for _, info := range mgr.Jobs().Status().History {
+		names = append(names, info.Name)
+	}
+	assert.Equal(t, []string{
+		"rule-set geoip-xx 2/6",
+		"manual-rule",
+		"rule-set geoip-xx 4/6",
+		"rule-set geoip-xx 6/6",
+	}, names)
+}
+
+func TestRuleSetFailedRefreshKeepsThePreviousSet(t *testing.T) {
+	mgr, maps, file := newRuleSetTestManager(t, 2)
+	defer mgr.Jobs().Stop()
+	set := mgr.ruleSets[0]
+
+	writeRuleSetFile(t, file, []string{"10.0.0.0/24", "10.0.1.0/24", "10.0.2.0/24"})
+	assert.Nil(t, mgr.refreshRuleSet(context.Background(), set))
+
+	// The new version adds 3 prefixes and removes 2; the third addition fails.
+	writeRuleSetFile(t, file, []string{"10.0.2.0/24", "10.0.3.0/24", "10.0.4.0/24", "10.0.5.0/24"})
+	maps.FailAt(len(maps.Writes()) + 3)
+	assert.ErrorIs(t, mgr.refreshRuleSet(context.Background(), set), bouhekitest.ErrInjected)
+
+	for _, cidr := range []string{"10.0.0.0/24", "10.0.1.0/24", "10.0.2.0/24"} {
+		_, ok := maps.Entries(DENIED_V4_CIDR_LIST_MAP_NAME)[string(cidrKey(t, cidr))]
+		assert.True(t, ok, cidr)
+	}
+	progress := set.Progress()
+	assert.False(t, progress.Complete)
+	assert.Equal(t, 2, progress.Applied)
+	assert.Equal(t, 5, progress.Total)
+	assert.Contains(t, progress.Error, bouhekitest.ErrInjected.Error())
+
+	// The next refresh resumes from the failed write.
+	writes := len(maps.Writes())
+	assert.Nil(t, mgr.refreshRuleSet(context.Background(), set))
+	assert.Equal(t, 3, len(maps.Writes())-writes)
+
+	progress = set.Progress()
+	assert.True(t, progress.Complete)
+	assert.Equal(t, 5, progress.Applied)
+	assert.Equal(t, 4, progress.Installed)
+	assert.Len(t, maps.Entries(DENIED_V4_CIDR_LIST_MAP_NAME), 4)
+	_, ok := maps.Entries(DENIED_V4_CIDR_LIST_MAP_NAME)[string(cidrKey(t, "10.0.0.0/24"))]
+	assert.False(t, ok)
+}
+
+func TestRuleSetDoesNotRemoveConfiguredEntries(t *testing.T) {
+	mgr, maps, file := newRuleSetTestManager(t, 10)
+	defer mgr.Jobs().Stop()
+	mgr.config.RestrictedNetworkConfig.CIDR.Deny = []string{"10.0.0.0/24"}
+	assert.Nil(t, mgr.applyConfig())
+
+	writeRuleSetFile(t, file, []string{"10.0.0.0/24", "10.0.1.0/24"})
+	assert.Nil(t, mgr.refreshRuleSet(context.Background(), mgr.ruleSets[0]))
+	writeRuleSetFile(t, file, []string{})
+	assert.Nil(t, mgr.refreshRuleSet(context.Background(), mgr.ruleSets[0]))
+
+	assert.Len(t, maps.Entries(DENIED_V4_CIDR_LIST_MAP_NAME), 1)
+	assert.True(t, mgr.Policy().Evaluate(Connection{Addr: net.ParseIP("10.0.0.1")}).DenyListed)
+
+	// Nor does the config remove the entries of a rule set.
+	writeRuleSetFile(t, file, []string{"10.0.0.0/24"})
+	assert.Nil(t, mgr.refreshRuleSet(context.Background(), mgr.ruleSets[0]))
+	mgr.config.RestrictedNetworkConfig.CIDR.Deny = []string{}
+	assert.Nil(t, mgr.applyConfig())
+	assert.Len(t, maps.Entries(DENIED_V4_CIDR_LIST_MAP_NAME), 1)
+}
+
+func TestRuleSetInvalidFileWritesNothing(t *testing.T) {
+	mgr, maps, file := newRuleSetTestManager(t, 10)
+	defer mgr.Jobs().Stop()
+	writeRuleSetFile(t, file, []string{"10.0.0.0/24", "10.0.1.0/33"})
+
+	writes := len(maps.Writes())
+	err := mgr.refreshRuleSet(context.Background(), mgr.ruleSets[0])
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "geoip-xx.txt:4")
+	assert.Equal(t, writes, len(maps.Writes()))
+}
+
+func TestRuleSetProgressIsSaved(t *testing.T) {
+	mgr, maps, file := newRuleSetTestManager(t, 2)
+	defer mgr.Jobs().Stop()
+	writeRuleSetFile(t, file, prefixes(0, 4))
+	maps.FailAt(len(maps.Writes()) + 3)
+	assert.NotNil(t, mgr.refreshRuleSet(context.Background(), mgr.ruleSets[0]))
+
+	data, err := ioutil.ReadFile(filepath.Join(filepath.Dir(file), "geoip-xx.json"))
+	assert.Nil(t, err)
+	saved := RuleSetProgress{}
+	assert.Nil(t, json.Unmarshal(data, &saved))
+	assert.Equal(t, "geoip-xx", saved.Name)
+	assert.Equal(t, 2, saved.Applied)
+	assert.Equal(t, 4, saved.Total)
+	assert.False(t, saved.Complete)
+	assert.NotEmpty(t, saved.Digest)
+
+	progress, ok := mgr.loadRuleSetProgress("geoip-xx")
+	assert.True(t, ok)
+	assert.Equal(t, saved, progress)
+}
+
+func TestRuleSetResumesInAdoptedMaps(t *testing.T) {
+	mgr, maps, file := newRuleSetTestManager(t, 2)
+	writeRuleSetFile(t, file, prefixes(0, 6))
+	maps.FailAt(len(maps.Writes()) + 3)
+	assert.NotNil(t, mgr.refreshRuleSet(context.Background(), mgr.ruleSets[0]))
+	mgr.Jobs().Stop()
+
+	// The next run adopts the maps, which have the 2 entries the first chunk wrote.
+	next := &Manager{config: mgr.config, backend: maps}
+	defer next.Jobs().Stop()
+	assert.Nil(t, next.SetConfigToMap())
+	assert.Len(t, maps.Entries(DENIED_V4_CIDR_LIST_MAP_NAME), 2)
+	progress := next.ruleSets[0].Progress()
+	assert.Equal(t, 2, progress.Applied)
+	assert.Equal(t, 2, progress.Installed)
+
+	writes := len(maps.Writes())
+	assert.Nil(t, next.refreshRuleSet(context.Background(), next.ruleSets[0]))
+	assert.Equal(t, 4, len(maps.Writes())-writes)
+
+	progress = next.ruleSets[0].Progress()
+	assert.True(t, progress.Complete)
+	assert.Equal(t, 6, progress.Applied)
+	assert.Equal(t, 6, progress.Total)
+	assert.Len(t, maps.Entries(DENIED_V4_CIDR_LIST_MAP_NAME), 6)
+
+	// A run after the refresh completed has nothing to write.
+	next.Jobs().Stop()
+	last := &Manager{config: mgr.config, backend: maps}
+	defer last.Jobs().Stop()
+	assert.Nil(t, last.SetConfigToMap())
+	writes = len(maps.Writes())
+	assert.Nil(t, last.refreshRuleSet(context.Background(), last.ruleSets[0]))
+	assert.Equal(t, writes, len(maps.Writes()))
+	assert.Equal(t, 6, last.ruleSets[0].Progress().Installed)
+}
+
+func TestRuleSetIsAppliedAgainInEmptyMaps(t *testing.T) {
+	mgr, maps, file := newRuleSetTestManager(t, 2)
+	writeRuleSetFile(t, file, prefixes(0, 6))
+	maps.FailAt(len(maps.Writes()) + 3)
+	assert.NotNil(t, mgr.refreshRuleSet(context.Background(), mgr.ruleSets[0]))
+	mgr.Jobs().Stop()
+
+	// The maps of the next run are created empty.
+	empty := bouhekitest.NewMaps()
+	next := &Manager{config: mgr.config, backend: empty}
+	defer next.Jobs().Stop()
+	assert.Nil(t, next.SetConfigToMap())
+	assert.Equal(t, 0, next.ruleSets[0].Progress().Applied)
+
+	assert.Nil(t, next.refreshRuleSet(context.Background(), next.ruleSets[0]))
+	progress := next.ruleSets[0].Progress()
+	assert.True(t, progress.Complete)
+	assert.Equal(t, 6, progress.Applied)
+	assert.Equal(t, 6, progress.Total)
+	assert.Len(t, empty.Entries(DENIED_V4_CIDR_LIST_MAP_NAME), 6)
+}
+
+func TestRuleSetRefreshesStopOnClose(t *testing.T) {
+	mgr, _, file := newRuleSetTestManager(t, 2)
+	mgr.ruleSets[0].conf.RefreshInterval = time.Hour
+	writeRuleSetFile(t, file, prefixes(0, 6))
+
+	mgr.AsyncRuleSets(context.Background())
+	assert.Eventually(t, func() bool { return mgr.ruleSets[0].Progress().Complete }, 5*time.Second, time.Millisecond)
+
+	closed := make(chan struct{})
+	go func() {
+		mgr.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not stop the refreshes of the rule sets")
+	}
+}
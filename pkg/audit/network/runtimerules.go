@@ -0,0 +1,458 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/control"
+	"github.com/mrtc0/bouheki/pkg/errkind"
+	"github.com/mrtc0/bouheki/pkg/freeze"
+	"github.com/mrtc0/bouheki/pkg/jobs"
+	log "github.com/mrtc0/bouheki/pkg/log"
+	"github.com/mrtc0/bouheki/pkg/notify"
+	"github.com/mrtc0/bouheki/pkg/policy"
+)
+
+const (
+	// RUNTIME_RULES_EXPIRE_INTERVAL is how often the runtime rules whose TTL elapsed are removed.
+	RUNTIME_RULES_EXPIRE_INTERVAL = time.Second
+
+	// The lists a runtime rule is added to, network.cidr.allow and network.cidr.deny.
+	RUNTIME_LIST_ALLOW = "allow"
+	RUNTIME_LIST_DENY  = "deny"
+
+	// The operations of a log.RuntimeRuleLog.
+	RUNTIME_OPERATION_ADD    = "add-cidr"
+	RUNTIME_OPERATION_REMOVE = "remove-cidr"
+	RUNTIME_OPERATION_EXPIRE = "expire"
+)
+
+// ErrRuntimeRuleNotFound is returned for the removal of a CIDR that was not added at runtime.
+var ErrRuntimeRuleNotFound = control.ErrRuleNotFound
+
+// RuntimeRule is a CIDR added to network.cidr.allow or deny on the control socket by the process
+// of UID. It is ephemeral: it is only kept in memory, a reload of the config neither removes it
+// nor makes it part of the config, and it is gone once bouheki restarts.
+type RuntimeRule struct {
+	List  string
+	CIDR  string
+	UID   uint32
+	Added time.Time
+	// Expires is when the rule is removed, zero for a rule without TTL.
+	Expires time.Time
+}
+
+func (r RuntimeRule) expired(now time.Time) bool {
+	return !r.Expires.IsZero() && !now.Before(r.Expires)
+}
+
+// runtimeRules are the rules added on the control socket. Like the self exemption, they write the
+// difference with what they installed before, and an entry that the config or a rule set also has
+// is left in the maps when its rule is removed.
+type runtimeRules struct {
+	mu    sync.Mutex
+	rules map[string]RuntimeRule
+	// installed is what the rules have written to the maps. It is only written by their jobs.
+	installed mapState
+}
+
+func runtimeRuleKey(list, cidr string) string {
+	return list + " " + cidr
+}
+
+// set adds rule, and returns the rule it replaces, if any.
+func (r *runtimeRules) set(rule RuntimeRule) (RuntimeRule, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.rules == nil {
+		r.rules = map[string]RuntimeRule{}
+	}
+	key := runtimeRuleKey(rule.List, rule.CIDR)
+	previous, ok := r.rules[key]
+	r.rules[key] = rule
+	return previous, ok
+}
+
+func (r *runtimeRules) get(list, cidr string) (RuntimeRule, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rule, ok := r.rules[runtimeRuleKey(list, cidr)]
+	return rule, ok
+}
+
+func (r *runtimeRules) delete(list, cidr string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.rules, runtimeRuleKey(list, cidr))
+}
+
+// list returns the rules by list and CIDR.
+func (r *runtimeRules) list() []RuntimeRule {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rules := make([]RuntimeRule, 0, len(r.rules))
+	for _, rule := range r.rules {
+		rules = append(rules, rule)
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		if rules[i].List != rules[j].List {
+			return rules[i].List < rules[j].List
+		}
+		return rules[i].CIDR < rules[j].CIDR
+	})
+	return rules
+}
+
+// expiring returns the rules expired at now.
+func (r *runtimeRules) expiring(now time.Time) []RuntimeRule {
+	expired := []RuntimeRule{}
+	for _, rule := range r.list() {
+		if rule.expired(now) {
+			expired = append(expired, rule)
+		}
+	}
+	return expired
+}
+
+// record records a successful write of the rules.
+func (r *runtimeRules) record(op mapOp) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if op.isDelete() {
+		r.installed.delete(op.mapName, op.key)
+	} else {
+		r.installed.set(op.mapName, op.key, op.value)
+	}
+}
+
+func (r *runtimeRules) has(mapName string, key []byte) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.installed[mapName][string(key)]
+	return ok
+}
+
+// runtimeRule reports whether the runtime rules have installed key in mapName.
+func (m *Manager) runtimeRule(mapName string, key []byte) bool {
+	return m.runtime.has(mapName, key)
+}
+
+// RuntimeRules returns the rules added on the control socket, by list and CIDR.
+func (m *Manager) RuntimeRules() []RuntimeRule {
+	return m.runtime.list()
+}
+
+// parseRuntimeRule checks list and returns cidr as the network it is written as, e.g. 203.0.113.0/24,
+// or a host CIDR for an address.
+func parseRuntimeRule(list, cidr string) (string, error) {
+	if list != RUNTIME_LIST_ALLOW && list != RUNTIME_LIST_DENY {
+		return "", errkind.Errorf(errkind.Config, "the list of a runtime rule is %s or %s, not %q", RUNTIME_LIST_ALLOW, RUNTIME_LIST_DENY, list)
+	}
+	if ip := net.ParseIP(cidr); ip != nil {
+		return hostCIDR(ip), nil
+	}
+	n, _, err := policy.ParseCIDR(cidr)
+	if err != nil {
+		return "", errkind.New(errkind.Config, err)
+	}
+	return n.String(), nil
+}
+
+// checkRuntimeRule returns an error if rule would not be written, as network.families does not
+// restrict the family of its CIDR.
+func (m *Manager) checkRuntimeRule(rule RuntimeRule) error {
+	state, err := runtimeRuleState([]RuntimeRule{rule}, m.currentConfig().RestrictedNetworkConfig)
+	if err != nil {
+		return err
+	}
+	if state.len() == 0 {
+		return errkind.Errorf(errkind.Config, "%s is of a family network.families does not restrict", rule.CIDR)
+	}
+	return nil
+}
+
+// AddRuntimeCIDR adds cidr to network.cidr.list, allow or deny, on behalf of uid, until ttl elapses
+// or, without ttl, until it is removed. Adding a CIDR again replaces its TTL. The change is
+// logged, and is rejected during a freeze window.
+func (m *Manager) AddRuntimeCIDR(list, cidr string, ttl time.Duration, uid uint32) (RuntimeRule, error) {
+	rule := RuntimeRule{List: list, CIDR: cidr, UID: uid, Added: m.now()}
+	if ttl > 0 {
+		rule.Expires = rule.Added.Add(ttl)
+	}
+
+	normalized, err := parseRuntimeRule(list, cidr)
+	if err == nil {
+		rule.CIDR = normalized
+		err = m.checkRuntimeRule(rule)
+	}
+	if err == nil {
+		change := freeze.CHANGE_CONTROL
+		if ttl > 0 {
+			change = freeze.CHANGE_TEMPORARY_RULE
+		}
+		err = m.runJob(fmt.Sprintf("control %s %s %s", RUNTIME_OPERATION_ADD, list, rule.CIDR), change, func(ctx context.Context) error {
+			previous, replaced := m.runtime.set(rule)
+			if err := m.refreshRuntimeRules(); err != nil {
+				m.runtime.delete(rule.List, rule.CIDR)
+				if replaced {
+					m.runtime.set(previous)
+				}
+				return err
+			}
+			return nil
+		})
+	}
+
+	logRuntimeRule(RUNTIME_OPERATION_ADD, rule, ttl, err)
+	if err == nil {
+		m.publishTemporaryRule(notify.TEMPORARY_RULE_ADDED, rule)
+	}
+	return rule, err
+}
+
+// RemoveRuntimeCIDR removes cidr, added to network.cidr.list at runtime, on behalf of uid. The
+// change is logged, and is rejected during a freeze window.
+func (m *Manager) RemoveRuntimeCIDR(list, cidr string, uid uint32) (RuntimeRule, error) {
+	rule := RuntimeRule{List: list, CIDR: cidr, UID: uid}
+
+	normalized, err := parseRuntimeRule(list, cidr)
+	if err == nil {
+		rule.CIDR = normalized
+		err = m.runJob(fmt.Sprintf("control %s %s %s", RUNTIME_OPERATION_REMOVE, list, rule.CIDR), freeze.CHANGE_CONTROL, func(ctx context.Context) error {
+			removed, ok := m.runtime.get(list, rule.CIDR)
+			if !ok {
+				return fmt.Errorf("%s is not in network.cidr.%s: %w", rule.CIDR, list, ErrRuntimeRuleNotFound)
+			}
+			rule.Added, rule.Expires = removed.Added, removed.Expires
+
+			m.runtime.delete(list, rule.CIDR)
+			if err := m.refreshRuntimeRules(); err != nil {
+				m.runtime.set(removed)
+				return err
+			}
+			return nil
+		})
+	}
+
+	logRuntimeRule(RUNTIME_OPERATION_REMOVE, rule, 0, err)
+	return rule, err
+}
+
+// AsyncRuntimeRules removes the runtime rules once their TTL elapses.
+func (m *Manager) AsyncRuntimeRules() {
+	go func() {
+		for {
+			m.sleep(RUNTIME_RULES_EXPIRE_INTERVAL)
+			if len(m.runtime.expiring(m.now())) == 0 {
+				continue
+			}
+			// Not subject to the freeze: the rules were only added for their TTL.
+			err := m.Jobs().Do("control "+RUNTIME_OPERATION_EXPIRE, func(ctx context.Context) error {
+				defer m.policyChanged()
+				return m.mutate(ctx, "control "+RUNTIME_OPERATION_EXPIRE, func(ctx context.Context) error {
+					return m.removeExpiredRuntimeRules(m.now())
+				})
+			})
+			if err == jobs.ErrStopped {
+				return
+			}
+			if err != nil {
+				log.Error(err)
+			}
+		}
+	}()
+}
+
+// removeExpiredRuntimeRules removes the runtime rules expired at now. When the maps can not be
+// written, the rules are kept and removed by the next attempt.
+func (m *Manager) removeExpiredRuntimeRules(now time.Time) error {
+	expired := m.runtime.expiring(now)
+	for _, rule := range expired {
+		m.runtime.delete(rule.List, rule.CIDR)
+	}
+	err := m.refreshRuntimeRules()
+	if err != nil {
+		for _, rule := range expired {
+			m.runtime.set(rule)
+		}
+	}
+	for _, rule := range expired {
+		logRuntimeRule(RUNTIME_OPERATION_EXPIRE, rule, 0, err)
+		if err == nil {
+			m.publishTemporaryRule(notify.TEMPORARY_RULE_EXPIRED, rule)
+		}
+	}
+	return err
+}
+
+// publishTemporaryRule notifies the subscribers that rule, if it has a TTL, was added or expired.
+func (m *Manager) publishTemporaryRule(action string, rule RuntimeRule) {
+	if rule.Expires.IsZero() {
+		return
+	}
+	notify.Publish(notify.TemporaryRule{
+		Action:    action,
+		Rule:      fmt.Sprintf("network.cidr.%s %s", rule.List, rule.CIDR),
+		ExpiresAt: rule.Expires,
+	}, m.Policy().Digest())
+}
+
+// runtimeRuleState returns the content of the CIDR lists for rules, without the CIDRs of the
+// families network.families leaves out.
+func runtimeRuleState(rules []RuntimeRule, conf config.RestrictedNetworkConfig) (mapState, error) {
+	desired := mapState{}
+	for _, rule := range rules {
+		v4MapName, v6MapName := ALLOWED_V4_CIDR_LIST_MAP_NAME, ALLOWED_V6_CIDR_LIST_MAP_NAME
+		if rule.List == RUNTIME_LIST_DENY {
+			v4MapName, v6MapName = DENIED_V4_CIDR_LIST_MAP_NAME, DENIED_V6_CIDR_LIST_MAP_NAME
+		}
+		if err := desired.setCIDRs([]string{rule.CIDR}, v4MapName, v6MapName); err != nil {
+			return nil, errkind.New(errkind.Config, err)
+		}
+	}
+	desired.markExcepts(policy.ExceptPrefixes(conf))
+	return desired.dropFamilies(policy.DisabledFamilies(conf)), nil
+}
+
+// refreshRuntimeRules writes the difference between the rules and what they installed. A removed
+// entry is left in the maps if the config, a rule set, the self exemption or live resolution has it.
+func (m *Manager) refreshRuntimeRules() error {
+	desired, err := runtimeRuleState(m.runtime.list(), m.currentConfig().RestrictedNetworkConfig)
+	if err != nil {
+		return err
+	}
+
+	m.runtime.mu.Lock()
+	if m.runtime.installed == nil {
+		m.runtime.installed = mapState{}
+	}
+	ops := diffState(m.runtime.installed, desired)
+	m.runtime.mu.Unlock()
+
+	for _, op := range ops {
+		if op.isDelete() && (m.configured(op.mapName, op.key) || m.inRuleSet(op.mapName, op.key, nil) || m.selfExempted(op.mapName, op.key) || m.resolvedAddress(op.mapName, op.key)) {
+			m.runtime.record(op)
+			continue
+		}
+
+		table, err := m.policyMap(op.mapName)
+		if err != nil {
+			return err
+		}
+		if op.isDelete() {
+			err = table.DeleteKey(op.key)
+		} else {
+			err = table.Update(op.key, op.value)
+		}
+		if err != nil {
+			return err
+		}
+
+		m.mirror(op)
+		m.runtime.record(op)
+	}
+	return nil
+}
+
+func logRuntimeRule(operation string, rule RuntimeRule, ttl time.Duration, err error) {
+	l := log.RuntimeRuleLog{
+		Operation: operation,
+		List:      rule.List,
+		CIDR:      rule.CIDR,
+		TTL:       ttl,
+		Expires:   rule.Expires,
+		UID:       rule.UID,
+	}
+	if err != nil {
+		l.Err = err.Error()
+		l.Warn()
+		return
+	}
+	l.Info()
+}
+
+// controlRules are the rules the control socket changes, the CIDRs of network.cidr and the forced
+// monitor mode, and dumps.
+type controlRules struct {
+	mgr *Manager
+}
+
+var _ control.Rules = controlRules{}
+
+func (c controlRules) AddCIDR(list, cidr string, ttl time.Duration, uid uint32) (control.Rule, error) {
+	rule, err := c.mgr.AddRuntimeCIDR(list, cidr, ttl, uid)
+	return controlRule(rule), err
+}
+
+func (c controlRules) RemoveCIDR(list, cidr string, uid uint32) (control.Rule, error) {
+	rule, err := c.mgr.RemoveRuntimeCIDR(list, cidr, uid)
+	return controlRule(rule), err
+}
+
+// List returns the CIDRs of network.cidr.allow and deny of the config, followed by the runtime rules.
+func (c controlRules) List() []control.Rule {
+	conf := c.mgr.currentConfig().RestrictedNetworkConfig
+	rules := []control.Rule{}
+	for _, list := range []struct {
+		name  string
+		cidrs []string
+	}{
+		{RUNTIME_LIST_ALLOW, conf.CIDR.Allow},
+		{RUNTIME_LIST_DENY, conf.CIDR.Deny},
+	} {
+		for _, cidr := range list.cidrs {
+			rules = append(rules, control.Rule{Source: control.RULE_SOURCE_CONFIG, List: list.name, CIDR: cidr})
+		}
+	}
+	for _, rule := range c.mgr.RuntimeRules() {
+		rules = append(rules, controlRule(rule))
+	}
+	return rules
+}
+
+func (c controlRules) DumpMaps(ctx context.Context) ([]control.MapDump, error) {
+	ctx, cancel := context.WithTimeout(ctx, STATE_TIMEOUT)
+	defer cancel()
+	return c.mgr.DumpMaps(ctx)
+}
+
+func (c controlRules) Mode() control.ModeStatus {
+	return controlMode(c.mgr.ForceMonitor())
+}
+
+func (c controlRules) SetForceMonitor(force bool, uid uint32) (control.ModeStatus, error) {
+	err := c.mgr.SetForceMonitor(force, FORCE_MONITOR_SOURCE_CONTROL, uid)
+	return c.Mode(), err
+}
+
+func controlMode(status ForceMonitorStatus) control.ModeStatus {
+	mode := control.ModeStatus{Mode: status.Mode, Configured: status.ConfiguredMode, ForceMonitor: status.Forced}
+	if status.Forced {
+		since := status.Since
+		mode.Since, mode.Source = &since, status.Source
+		if status.Source == FORCE_MONITOR_SOURCE_CONTROL {
+			uid := status.UID
+			mode.UID = &uid
+		}
+	}
+	return mode
+}
+
+func controlRule(rule RuntimeRule) control.Rule {
+	uid := rule.UID
+	r := control.Rule{Source: control.RULE_SOURCE_RUNTIME, List: rule.List, CIDR: rule.CIDR, UID: &uid}
+	if !rule.Added.IsZero() {
+		added := rule.Added
+		r.Added = &added
+	}
+	if !rule.Expires.IsZero() {
+		expires := rule.Expires
+		r.Expires = &expires
+	}
+	return r
+}
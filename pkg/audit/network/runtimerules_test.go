@@ -0,0 +1,117 @@
+package network
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/bouhekitest"
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/errkind"
+	"github.com/mrtc0/bouheki/pkg/freeze"
+	"github.com/mrtc0/bouheki/pkg/jobs"
+	"github.com/mrtc0/bouheki/pkg/notify"
+	"github.com/stretchr/testify/assert"
+)
+
+func newRuntimeRulesTestManager(t *testing.T) (*Manager, *bouhekitest.Maps, *bouhekitest.Clock) {
+	clock := bouhekitest.NewClock(time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC))
+	maps := bouhekitest.NewMaps()
+	conf := config.DefaultConfig()
+	conf.RestrictedNetworkConfig.Mode = "block"
+	conf.RestrictedNetworkConfig.CIDR.Allow = []string{"10.0.0.0/8"}
+	mgr := &Manager{config: conf, backend: maps, clock: clock}
+	assert.Nil(t, mgr.applyConfig())
+	t.Cleanup(mgr.Jobs().Stop)
+	return mgr, maps, clock
+}
+
+func TestRuntimeRules(t *testing.T) {
+	mgr, maps, clock := newRuntimeRulesTestManager(t)
+	subscriber := notify.DefaultHub.Subscribe(notify.TYPE_TEMPORARY_RULE)
+	defer notify.DefaultHub.Unsubscribe(subscriber)
+
+	rule, err := mgr.AddRuntimeCIDR(RUNTIME_LIST_ALLOW, "203.0.113.7/24", time.Hour, 1000)
+	assert.Nil(t, err)
+	// The CIDR is written as its network.
+	assert.Equal(t, RuntimeRule{List: RUNTIME_LIST_ALLOW, CIDR: "203.0.113.0/24", UID: 1000, Added: clock.Now(), Expires: clock.Now().Add(time.Hour)}, rule)
+	_, ok := maps.Entries(ALLOWED_V4_CIDR_LIST_MAP_NAME)[string(cidrKey(t, "203.0.113.0/24"))]
+	assert.True(t, ok)
+	assert.True(t, mgr.Policy().hasCIDR(ALLOWED_V4_CIDR_LIST_MAP_NAME, PROTOCOL_ALL, keyToIPNet(cidrKey(t, "203.0.113.0/24"))))
+	n := <-subscriber.C
+	assert.Equal(t, notify.TemporaryRule{Action: notify.TEMPORARY_RULE_ADDED, Rule: "network.cidr.allow 203.0.113.0/24", ExpiresAt: rule.Expires}, n.Payload)
+
+	_, err = mgr.AddRuntimeCIDR(RUNTIME_LIST_DENY, "2001:db8::1", 0, 0)
+	assert.Nil(t, err)
+	_, ok = maps.Entries(DENIED_V6_CIDR_LIST_MAP_NAME)[string(cidrKey(t, "2001:db8::1/128"))]
+	assert.True(t, ok)
+	assert.Len(t, mgr.RuntimeRules(), 2)
+
+	_, err = mgr.AddRuntimeCIDR("allowed", "203.0.113.0/24", 0, 0)
+	assert.Equal(t, errkind.Config, errkind.KindOf(err))
+	_, err = mgr.AddRuntimeCIDR(RUNTIME_LIST_ALLOW, "203.0.113.0/33", 0, 0)
+	assert.Equal(t, errkind.Config, errkind.KindOf(err))
+
+	// A reload neither removes the runtime rules nor the entries they share with the config.
+	_, err = mgr.AddRuntimeCIDR(RUNTIME_LIST_ALLOW, "10.0.0.0/8", 0, 0)
+	assert.Nil(t, err)
+	next := *mgr.config
+	next.RestrictedNetworkConfig.CIDR.Allow = []string{"192.168.0.0/16"}
+	assert.Nil(t, mgr.replaceConfig(&next))
+	for _, cidr := range []string{"10.0.0.0/8", "192.168.0.0/16", "203.0.113.0/24"} {
+		_, ok = maps.Entries(ALLOWED_V4_CIDR_LIST_MAP_NAME)[string(cidrKey(t, cidr))]
+		assert.True(t, ok, cidr)
+	}
+	assert.Len(t, mgr.RuntimeRules(), 3)
+
+	// Removing a runtime rule leaves the entry the config has.
+	_, err = mgr.AddRuntimeCIDR(RUNTIME_LIST_ALLOW, "192.168.0.0/16", 0, 0)
+	assert.Nil(t, err)
+	_, err = mgr.RemoveRuntimeCIDR(RUNTIME_LIST_ALLOW, "192.168.0.0/16", 0)
+	assert.Nil(t, err)
+	_, ok = maps.Entries(ALLOWED_V4_CIDR_LIST_MAP_NAME)[string(cidrKey(t, "192.168.0.0/16"))]
+	assert.True(t, ok)
+
+	_, err = mgr.RemoveRuntimeCIDR(RUNTIME_LIST_ALLOW, "10.0.0.0/8", 0)
+	assert.Nil(t, err)
+	_, ok = maps.Entries(ALLOWED_V4_CIDR_LIST_MAP_NAME)[string(cidrKey(t, "10.0.0.0/8"))]
+	assert.False(t, ok)
+	_, err = mgr.RemoveRuntimeCIDR(RUNTIME_LIST_ALLOW, "10.0.0.0/8", 0)
+	assert.True(t, errors.Is(err, ErrRuntimeRuleNotFound))
+
+	// The rule is removed once its TTL elapses.
+	clock.Advance(time.Hour)
+	assert.Nil(t, mgr.removeExpiredRuntimeRules(clock.Now()))
+	_, ok = maps.Entries(ALLOWED_V4_CIDR_LIST_MAP_NAME)[string(cidrKey(t, "203.0.113.0/24"))]
+	assert.False(t, ok)
+	assert.False(t, mgr.Policy().hasCIDR(ALLOWED_V4_CIDR_LIST_MAP_NAME, PROTOCOL_ALL, keyToIPNet(cidrKey(t, "203.0.113.0/24"))))
+	// Only the rules with a TTL are notified.
+	n = <-subscriber.C
+	assert.Equal(t, notify.TEMPORARY_RULE_EXPIRED, n.Payload.(notify.TemporaryRule).Action)
+	assert.Equal(t, []RuntimeRule{{List: RUNTIME_LIST_DENY, CIDR: "2001:db8::1/128", Added: clock.Now().Add(-time.Hour)}}, mgr.RuntimeRules())
+}
+
+func TestRuntimeRulesFreeze(t *testing.T) {
+	mgr, maps, clock := newRuntimeRulesTestManager(t)
+	guard, err := freeze.NewWithClock(config.AdminConfig{
+		FreezeWindows: []config.FreezeWindow{{Name: "incident-review", Start: "2026-10-14T13:00", End: "2026-10-15T00:00"}},
+	}, clock.Now)
+	assert.Nil(t, err)
+	mgr.freeze = guard
+
+	_, err = mgr.AddRuntimeCIDR(RUNTIME_LIST_ALLOW, "203.0.113.0/24", 2*time.Hour, 0)
+	assert.Nil(t, err)
+
+	// A freeze window rejects the changes, but not the expiry of a rule.
+	clock.Advance(time.Hour)
+	_, err = mgr.AddRuntimeCIDR(RUNTIME_LIST_ALLOW, "198.51.100.0/24", time.Hour, 0)
+	assert.True(t, errors.Is(err, jobs.ErrRejected))
+	_, err = mgr.RemoveRuntimeCIDR(RUNTIME_LIST_ALLOW, "203.0.113.0/24", 0)
+	assert.True(t, errors.Is(err, jobs.ErrRejected))
+	assert.Len(t, mgr.RuntimeRules(), 1)
+
+	clock.Advance(time.Hour)
+	assert.Nil(t, mgr.removeExpiredRuntimeRules(clock.Now()))
+	assert.Len(t, mgr.RuntimeRules(), 0)
+	assert.Len(t, maps.Entries(ALLOWED_V4_CIDR_LIST_MAP_NAME), 1)
+}
@@ -0,0 +1,358 @@
+package network
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/mrtc0/bouheki/pkg/classify"
+	"github.com/mrtc0/bouheki/pkg/jobs"
+	log "github.com/mrtc0/bouheki/pkg/log"
+)
+
+const (
+	// SELF_EXEMPTION_PATH serves the SelfExemptionEntry of every installed entry as JSON on the metrics server.
+	SELF_EXEMPTION_PATH = "/self-exemption"
+
+	// SELF_PROVENANCE tags the entries bouheki writes for its own endpoints.
+	SELF_PROVENANCE = "self"
+
+	// The sources of the endpoints bouheki connects to.
+	SELF_SOURCE_DNS_RESOLVER = "dns-resolver"
+	SELF_SOURCE_DNS_PROXY    = "dns-proxy"
+
+	// INIT_PID_NS_INUM is the inode number of the initial pid namespace, PROC_PID_INIT_INO.
+	INIT_PID_NS_INUM = 0xEFFFFFFC
+)
+
+// SelfExemptionEntry is an allow entry written for an endpoint of a source.
+type SelfExemptionEntry struct {
+	Provenance string `json:"provenance"`
+	Source     string `json:"source"`
+	Endpoint   string `json:"endpoint"`
+	CIDR       string `json:"cidr"`
+}
+
+// selfExemption is what the Manager allows for the endpoints bouheki itself connects to.
+// Like a rule set, it writes the difference with what it installed before, and an entry
+// that the config or a rule set also has is left in the maps when the exemption drops it.
+type selfExemption struct {
+	mu sync.Mutex
+	// endpoints are the endpoints of every source, as given to SetSelfEndpoints.
+	endpoints map[string][]string
+	// resolved are the CIDRs of every endpoint of a source. An endpoint that fails to
+	// resolve keeps the CIDRs of its last resolution.
+	resolved map[string]map[string][]string
+	// installed is what the exemption has written to the maps. It is only written by its jobs.
+	installed mapState
+}
+
+// SetSelfEndpoints replaces the endpoints of source, e.g. the upstreams of the DNS proxy, and
+// writes the allow entries of their addresses. An endpoint is a host, a host:port, or a URL.
+// It is a no-op when network.self_exemption is disabled.
+func (m *Manager) SetSelfEndpoints(source string, endpoints []string) error {
+	if !m.currentConfig().RestrictedNetworkConfig.SelfExemption.Enable {
+		return nil
+	}
+
+	m.self.mu.Lock()
+	if m.self.endpoints == nil {
+		m.self.endpoints = map[string][]string{}
+	}
+	if len(endpoints) == 0 {
+		delete(m.self.endpoints, source)
+	} else {
+		m.self.endpoints[source] = append([]string{}, endpoints...)
+	}
+	m.self.mu.Unlock()
+
+	// Not subject to the freeze: the entries keep bouheki connected to its own endpoints.
+	return m.doJob("self-exemption "+source, func(ctx context.Context) error {
+		return m.refreshSelfExemption()
+	})
+}
+
+// AsyncSelfExemption resolves the endpoints given by name every network.self_exemption.refresh_interval,
+// so that the entries follow the addresses of the endpoints as they rotate.
+func (m *Manager) AsyncSelfExemption() {
+	conf := m.config.RestrictedNetworkConfig.SelfExemption
+	if !conf.Enable {
+		return
+	}
+
+	go func() {
+		for {
+			m.sleep(conf.RefreshInterval)
+			err := m.doJob("self-exemption", func(ctx context.Context) error {
+				return m.refreshSelfExemption()
+			})
+			if err == jobs.ErrStopped {
+				return
+			}
+			if err != nil {
+				log.Error(err)
+			}
+		}
+	}()
+}
+
+// exemptSelf identifies the events of bouheki, and allows the DNS servers it queries: the
+// upstreams of the DNS proxy, or servers, as host:port, that resolve the domains.
+func (m *Manager) exemptSelf(servers []string) error {
+	self, err := identifySelf(classify.PROC_ROOT, classify.CGROUP_ROOT)
+	if err != nil {
+		log.Warn(fmt.Sprintf("Failed to identify the process of bouheki, its connections may not be marked as its own: %s", err))
+	}
+	ownProcess = self
+
+	if m.config.EnableDNSProxy() {
+		return m.SetSelfEndpoints(SELF_SOURCE_DNS_PROXY, m.config.DNSProxyConfig.Upstreams)
+	}
+	return m.SetSelfEndpoints(SELF_SOURCE_DNS_RESOLVER, servers)
+}
+
+// refreshSelfExemption resolves the endpoints and writes the difference with what the exemption installed.
+func (m *Manager) refreshSelfExemption() error {
+	desired := mapState{}
+	for _, cidr := range m.resolveSelfEndpoints() {
+		if err := desired.setCIDRs([]string{cidr}, ALLOWED_V4_CIDR_LIST_MAP_NAME, ALLOWED_V6_CIDR_LIST_MAP_NAME); err != nil {
+			return err
+		}
+	}
+	desired.dropFamilies(m.disabledFamilies())
+
+	m.self.mu.Lock()
+	if m.self.installed == nil {
+		m.self.installed = mapState{}
+	}
+	ops := diffState(m.self.installed, desired)
+	m.self.mu.Unlock()
+
+	for _, op := range ops {
+		if op.isDelete() && (m.configured(op.mapName, op.key) || m.inRuleSet(op.mapName, op.key, nil) || m.runtimeRule(op.mapName, op.key) || m.resolvedAddress(op.mapName, op.key)) {
+			m.self.record(op)
+			continue
+		}
+
+		table, err := m.policyMap(op.mapName)
+		if err != nil {
+			return err
+		}
+		if op.isDelete() {
+			err = table.DeleteKey(op.key)
+		} else {
+			err = table.Update(op.key, op.value)
+		}
+		if err != nil {
+			return err
+		}
+
+		m.mirror(op)
+		m.self.record(op)
+	}
+	return nil
+}
+
+// resolveSelfEndpoints returns the CIDRs of every endpoint and records them by source.
+func (m *Manager) resolveSelfEndpoints() []string {
+	m.self.mu.Lock()
+	endpoints := make(map[string][]string, len(m.self.endpoints))
+	for source, list := range m.self.endpoints {
+		endpoints[source] = list
+	}
+	previous := m.self.resolved
+	m.self.mu.Unlock()
+
+	resolved := map[string]map[string][]string{}
+	cidrs := []string{}
+	for source, list := range endpoints {
+		resolved[source] = map[string][]string{}
+		for _, endpoint := range list {
+			endpointCIDRs, err := m.resolveSelfEndpoint(endpoint)
+			if err != nil {
+				log.Warn(fmt.Sprintf("self exemption %s: failed to resolve %s, keeping its previous addresses: %s", source, endpoint, err))
+				endpointCIDRs = previous[source][endpoint]
+			}
+			resolved[source][endpoint] = endpointCIDRs
+			cidrs = append(cidrs, endpointCIDRs...)
+		}
+	}
+
+	m.self.mu.Lock()
+	m.self.resolved = resolved
+	m.self.mu.Unlock()
+	return cidrs
+}
+
+// resolveSelfEndpoint returns the host CIDRs of the addresses of endpoint.
+func (m *Manager) resolveSelfEndpoint(endpoint string) ([]string, error) {
+	host := selfEndpointHost(endpoint)
+	if host == "" {
+		return nil, fmt.Errorf("%q has no host", endpoint)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return []string{hostCIDR(ip)}, nil
+	}
+
+	cidrs := []string{}
+	var lastErr error
+	for _, resolve := range []func(domain string) (*DNSAnswer, error){m.ResolveAddressv4, m.ResolveAddressv6} {
+		answer, err := resolve(host)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, ip := range answer.Addresses {
+			cidrs = append(cidrs, hostCIDR(ip))
+		}
+	}
+	if len(cidrs) == 0 {
+		return nil, lastErr
+	}
+	return cidrs, nil
+}
+
+// selfEndpointHost returns the host of a host, a host:port, or a URL.
+func selfEndpointHost(endpoint string) string {
+	if strings.Contains(endpoint, "://") {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return ""
+		}
+		return u.Hostname()
+	}
+	if host, _, err := net.SplitHostPort(endpoint); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(endpoint, "["), "]")
+}
+
+func hostCIDR(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String() + "/32"
+	}
+	return ip.String() + "/128"
+}
+
+// record records a successful write of the exemption.
+func (s *selfExemption) record(op mapOp) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if op.isDelete() {
+		s.installed.delete(op.mapName, op.key)
+	} else {
+		s.installed.set(op.mapName, op.key, op.value)
+	}
+}
+
+func (s *selfExemption) has(mapName string, key []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.installed[mapName][string(key)]
+	return ok
+}
+
+// selfExempted reports whether the exemption has installed key in mapName.
+func (m *Manager) selfExempted(mapName string, key []byte) bool {
+	return m.self.has(mapName, key)
+}
+
+// SelfExemption returns the entries of the endpoints, by source and endpoint.
+func (m *Manager) SelfExemption() []SelfExemptionEntry {
+	m.self.mu.Lock()
+	defer m.self.mu.Unlock()
+
+	entries := []SelfExemptionEntry{}
+	for source, resolved := range m.self.resolved {
+		for endpoint, cidrs := range resolved {
+			for _, cidr := range cidrs {
+				entries = append(entries, SelfExemptionEntry{Provenance: SELF_PROVENANCE, Source: source, Endpoint: endpoint, CIDR: cidr})
+			}
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Source != entries[j].Source {
+			return entries[i].Source < entries[j].Source
+		}
+		if entries[i].Endpoint != entries[j].Endpoint {
+			return entries[i].Endpoint < entries[j].Endpoint
+		}
+		return entries[i].CIDR < entries[j].CIDR
+	})
+	return entries
+}
+
+// selfExemptionStatus serves the installed entries of the exemption.
+type selfExemptionStatus struct {
+	mgr *Manager
+}
+
+func (s selfExemptionStatus) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.mgr.SelfExemption())
+}
+
+// ownProcess is used by newAuditLog, like dnsCache, to mark the events of bouheki's own connections.
+var ownProcess selfProcess
+
+// selfProcess identifies bouheki in the events: by its pid, and by its cgroup, which also has
+// the processes it runs. The pid of an event is in the initial pid namespace, so only the cgroup
+// identifies bouheki when it runs in a container.
+type selfProcess struct {
+	pid      uint32
+	cgroupID uint64
+}
+
+// identifySelf reads the pid namespace and the cgroup of the current process from the proc
+// filesystem mounted at procRoot and the cgroup v2 hierarchy mounted at cgroupRoot. The root
+// cgroup is shared with the other processes of the host, so it does not identify bouheki.
+func identifySelf(procRoot string, cgroupRoot string) (selfProcess, error) {
+	self := selfProcess{}
+
+	pid := os.Getpid()
+	target, err := os.Readlink(filepath.Join(procRoot, strconv.Itoa(pid), "ns", "pid"))
+	if err != nil {
+		return self, err
+	}
+	if target == fmt.Sprintf("pid:[%d]", INIT_PID_NS_INUM) {
+		self.pid = uint32(pid)
+	}
+
+	p, err := classify.Read(procRoot, pid)
+	if err != nil {
+		return self, err
+	}
+	if p.Cgroup == "" || p.Cgroup == "/" {
+		return self, nil
+	}
+
+	info, err := os.Stat(filepath.Join(cgroupRoot, filepath.FromSlash(p.Cgroup)))
+	if err != nil {
+		return self, err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return self, errors.New("failed to read the inode of the cgroup")
+	}
+	self.cgroupID = stat.Ino
+	return self, nil
+}
+
+// owns reports whether the event is of a connection of bouheki.
+func (p selfProcess) owns(header eventHeader) bool {
+	if p.pid != 0 && header.PID == p.pid {
+		return true
+	}
+	return p.cgroupID != 0 && header.CGroupID == p.cgroupID
+}
@@ -0,0 +1,152 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/mrtc0/bouheki/pkg/bouhekitest"
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func newSelfExemptionTestManager(t *testing.T, resolver DNSResolver) (*Manager, *bouhekitest.Maps) {
+	maps := bouhekitest.NewMaps()
+	conf := config.DefaultConfig()
+	conf.RestrictedNetworkConfig.Mode = "block"
+	conf.RestrictedNetworkConfig.CIDR.Allow = []string{}
+	mgr := &Manager{config: conf, backend: maps, dnsResolver: resolver}
+	assert.Nil(t, mgr.applyConfig())
+	t.Cleanup(mgr.Jobs().Stop)
+	return mgr, maps
+}
+
+func TestSelfEndpointHost(t *testing.T) {
+	for endpoint, host := range map[string]string{
+		"192.0.2.53":                      "192.0.2.53",
+		"192.0.2.53:53":                   "192.0.2.53",
+		"2001:db8::53":                    "2001:db8::53",
+		"[2001:db8::53]:53":               "2001:db8::53",
+		"https://hooks.example.com/event": "hooks.example.com",
+		"collector.example.com:4317":      "collector.example.com",
+	} {
+		assert.Equal(t, host, selfEndpointHost(endpoint), endpoint)
+	}
+}
+
+func TestSelfExemptionLifecycle(t *testing.T) {
+	resolver := &FakeDNSResolver{answers: map[uint16][]net.IP{dns.TypeA: {net.IPv4(198, 51, 100, 1)}}}
+	mgr, maps := newSelfExemptionTestManager(t, resolver)
+
+	assert.Nil(t, mgr.SetSelfEndpoints(SELF_SOURCE_DNS_RESOLVER, []string{"192.0.2.53", "2001:db8::53"}))
+	assert.Nil(t, mgr.SetSelfEndpoints("webhook", []string{"https://hooks.example.com/event"}))
+
+	assert.Len(t, maps.Entries(ALLOWED_V4_CIDR_LIST_MAP_NAME), 2)
+	assert.Len(t, maps.Entries(ALLOWED_V6_CIDR_LIST_MAP_NAME), 1)
+	assert.True(t, mgr.Policy().hasCIDR(ALLOWED_V4_CIDR_LIST_MAP_NAME, PROTOCOL_ALL, &net.IPNet{IP: net.ParseIP("192.0.2.53").To4(), Mask: net.CIDRMask(32, 32)}))
+	assert.Equal(t, []SelfExemptionEntry{
+		{Provenance: SELF_PROVENANCE, Source: SELF_SOURCE_DNS_RESOLVER, Endpoint: "192.0.2.53", CIDR: "192.0.2.53/32"},
+		{Provenance: SELF_PROVENANCE, Source: SELF_SOURCE_DNS_RESOLVER, Endpoint: "2001:db8::53", CIDR: "2001:db8::53/128"},
+		{Provenance: SELF_PROVENANCE, Source: "webhook", Endpoint: "https://hooks.example.com/event", CIDR: "198.51.100.1/32"},
+	}, mgr.SelfExemption())
+
+	// The sink rotates to another address.
+	resolver.answers[dns.TypeA] = []net.IP{net.IPv4(198, 51, 100, 2)}
+	assert.Nil(t, mgr.refreshSelfExemption())
+	_, ok := maps.Entries(ALLOWED_V4_CIDR_LIST_MAP_NAME)[string(cidrKey(t, "198.51.100.1/32"))]
+	assert.False(t, ok)
+	_, ok = maps.Entries(ALLOWED_V4_CIDR_LIST_MAP_NAME)[string(cidrKey(t, "198.51.100.2/32"))]
+	assert.True(t, ok)
+
+	// A failed resolution keeps the address the sink had.
+	resolver.answers = map[uint16][]net.IP{}
+	assert.Nil(t, mgr.refreshSelfExemption())
+	_, ok = maps.Entries(ALLOWED_V4_CIDR_LIST_MAP_NAME)[string(cidrKey(t, "198.51.100.2/32"))]
+	assert.True(t, ok)
+
+	// Removing the endpoints of a source removes their entries only.
+	assert.Nil(t, mgr.SetSelfEndpoints("webhook", nil))
+	assert.Len(t, maps.Entries(ALLOWED_V4_CIDR_LIST_MAP_NAME), 1)
+	assert.Len(t, mgr.SelfExemption(), 2)
+}
+
+func TestSelfExemptionKeepsConfiguredEntries(t *testing.T) {
+	mgr, maps := newSelfExemptionTestManager(t, &FakeDNSResolver{})
+	mgr.config.RestrictedNetworkConfig.CIDR.Allow = []string{"192.0.2.53/32"}
+	assert.Nil(t, mgr.applyConfig())
+
+	assert.Nil(t, mgr.SetSelfEndpoints(SELF_SOURCE_DNS_RESOLVER, []string{"192.0.2.53", "192.0.2.54"}))
+	assert.Nil(t, mgr.SetSelfEndpoints(SELF_SOURCE_DNS_RESOLVER, nil))
+
+	// The entry the config also has stays.
+	assert.Len(t, maps.Entries(ALLOWED_V4_CIDR_LIST_MAP_NAME), 1)
+	_, ok := maps.Entries(ALLOWED_V4_CIDR_LIST_MAP_NAME)[string(cidrKey(t, "192.0.2.53/32"))]
+	assert.True(t, ok)
+
+	// Nor does the config remove the entries of the exemption.
+	assert.Nil(t, mgr.SetSelfEndpoints(SELF_SOURCE_DNS_RESOLVER, []string{"192.0.2.53"}))
+	mgr.config.RestrictedNetworkConfig.CIDR.Allow = []string{}
+	assert.Nil(t, mgr.applyConfig())
+	_, ok = maps.Entries(ALLOWED_V4_CIDR_LIST_MAP_NAME)[string(cidrKey(t, "192.0.2.53/32"))]
+	assert.True(t, ok)
+
+	// Nor does a preloaded address that expires.
+	assert.Nil(t, mgr.cidrListDeleteKey(ALLOWED_V4_CIDR_LIST_MAP_NAME, cidrKey(t, "192.0.2.53/32")))
+	_, ok = maps.Entries(ALLOWED_V4_CIDR_LIST_MAP_NAME)[string(cidrKey(t, "192.0.2.53/32"))]
+	assert.True(t, ok)
+}
+
+func TestSelfExemptionCanBeDisabled(t *testing.T) {
+	mgr, maps := newSelfExemptionTestManager(t, &FakeDNSResolver{})
+	mgr.config.RestrictedNetworkConfig.SelfExemption.Enable = false
+
+	assert.Nil(t, mgr.SetSelfEndpoints(SELF_SOURCE_DNS_RESOLVER, []string{"192.0.2.53"}))
+	assert.Empty(t, maps.Entries(ALLOWED_V4_CIDR_LIST_MAP_NAME))
+	assert.Empty(t, mgr.SelfExemption())
+}
+
+// writeSelfProc writes the entries identifySelf reads of the current process.
+func writeSelfProc(t *testing.T, pidNamespace uint64, cgroup string) string {
+	root := t.TempDir()
+	dir := filepath.Join(root, strconv.Itoa(os.Getpid()))
+	assert.Nil(t, os.MkdirAll(filepath.Join(dir, "ns"), 0755))
+	assert.Nil(t, os.Symlink(fmt.Sprintf("pid:[%d]", pidNamespace), filepath.Join(dir, "ns", "pid")))
+	assert.Nil(t, os.Symlink("mnt:[4026531841]", filepath.Join(dir, "ns", "mnt")))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "status"), []byte(fmt.Sprintf("NSpid:\t%d\n", os.Getpid())), 0644))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "cgroup"), []byte("0::"+cgroup+"\n"), 0644))
+	return root
+}
+
+func TestOwnEventsAreMarked(t *testing.T) {
+	cgroupRoot := t.TempDir()
+	cgroup := filepath.Join(cgroupRoot, "system.slice", "bouheki.service")
+	assert.Nil(t, os.MkdirAll(cgroup, 0755))
+	info, err := os.Stat(cgroup)
+	assert.Nil(t, err)
+	cgroupID := info.Sys().(*syscall.Stat_t).Ino
+
+	self, err := identifySelf(writeSelfProc(t, INIT_PID_NS_INUM, "/system.slice/bouheki.service"), cgroupRoot)
+	assert.Nil(t, err)
+	assert.Equal(t, selfProcess{pid: uint32(os.Getpid()), cgroupID: cgroupID}, self)
+
+	ownProcess = self
+	defer func() { ownProcess = selfProcess{} }()
+
+	assert.True(t, newAuditLog(eventHeader{EventType: BLOCKED_IPV4, PID: uint32(os.Getpid())}, detectEventIPv4{}).Self)
+	// A process bouheki runs, e.g. a hook.
+	assert.True(t, newAuditLog(eventHeader{EventType: BLOCKED_IPV4, PID: 1, CGroupID: cgroupID}, detectEventIPv4{}).Self)
+	assert.False(t, newAuditLog(eventHeader{EventType: BLOCKED_IPV4, PID: 1, CGroupID: cgroupID + 1}, detectEventIPv4{}).Self)
+}
+
+func TestIdentifySelfInAContainer(t *testing.T) {
+	// The pid is not the one of the events, and the root cgroup is shared with the host.
+	self, err := identifySelf(writeSelfProc(t, 4026532000, "/"), t.TempDir())
+	assert.Nil(t, err)
+	assert.Equal(t, selfProcess{}, self)
+	assert.False(t, self.owns(eventHeader{PID: uint32(os.Getpid())}))
+}
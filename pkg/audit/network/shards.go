@@ -0,0 +1,109 @@
+package network
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"strings"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+)
+
+const (
+	DENIED_V4_CIDR_SHARD_MAP_NAME_PREFIX = "denied_v4_cidr_shard_"
+	DENIED_V6_CIDR_SHARD_MAP_NAME_PREFIX = "denied_v6_cidr_shard_"
+
+	// DENY_SHARD_V4_BITS and DENY_SHARD_V6_BITS are the first bits of a prefix that choose
+	// its shard, so that the prefixes of a network, which a feed lists together, are
+	// written to the same shard.
+	DENY_SHARD_V4_BITS = 16
+	DENY_SHARD_V6_BITS = 32
+)
+
+// denyShardMapName returns the name of a shard of the deny list mapName, e.g. denied_v4_cidr_shard_0.
+func denyShardMapName(mapName string, shard int) string {
+	if mapName == DENIED_V6_CIDR_LIST_MAP_NAME {
+		return fmt.Sprintf("%s%d", DENIED_V6_CIDR_SHARD_MAP_NAME_PREFIX, shard)
+	}
+	return fmt.Sprintf("%s%d", DENIED_V4_CIDR_SHARD_MAP_NAME_PREFIX, shard)
+}
+
+// denyShardMapNames returns the names of the shards of the program, the IPv4 shards first.
+func denyShardMapNames() []string {
+	names := []string{}
+	for _, mapName := range []string{DENIED_V4_CIDR_LIST_MAP_NAME, DENIED_V6_CIDR_LIST_MAP_NAME} {
+		for shard := 0; shard < config.RESOURCES_MAX_DENY_SHARDS; shard++ {
+			names = append(names, denyShardMapName(mapName, shard))
+		}
+	}
+	return names
+}
+
+// denyShardBase returns the deny list the shard mapName is part of, if it is a shard.
+func denyShardBase(mapName string) (string, bool) {
+	switch {
+	case strings.HasPrefix(mapName, DENIED_V4_CIDR_SHARD_MAP_NAME_PREFIX):
+		return DENIED_V4_CIDR_LIST_MAP_NAME, true
+	case strings.HasPrefix(mapName, DENIED_V6_CIDR_SHARD_MAP_NAME_PREFIX):
+		return DENIED_V6_CIDR_LIST_MAP_NAME, true
+	default:
+		return "", false
+	}
+}
+
+// denyShard returns the shard of a deny entry among shards. It hashes the family and the first
+// bits of the prefix, DENY_SHARD_V4_BITS or DENY_SHARD_V6_BITS at most, so an entry is always
+// written to the same shard, whatever the other entries of its rule set are. The BPF program
+// looks a destination up in every shard, so a prefix shorter than the hashed bits may be in
+// any shard.
+func denyShard(key []byte, shards int) int {
+	n := keyToIPNet(key)
+	ones, size := n.Mask.Size()
+	bits, family := DENY_SHARD_V4_BITS, byte(4)
+	if size == 128 {
+		bits, family = DENY_SHARD_V6_BITS, byte(6)
+	}
+	if ones < bits {
+		bits = ones
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte{family})
+	h.Write(n.IP.Mask(net.CIDRMask(bits, size)))
+	return int(h.Sum32() % uint32(shards))
+}
+
+// shardState returns state with the entries of the deny lists moved to their shard among shards.
+func shardState(state mapState, shards int) mapState {
+	sharded := mapState{}
+	for mapName, entries := range state {
+		for key, value := range entries {
+			switch mapName {
+			case DENIED_V4_CIDR_LIST_MAP_NAME, DENIED_V6_CIDR_LIST_MAP_NAME:
+				sharded.set(denyShardMapName(mapName, denyShard([]byte(key), shards)), []byte(key), value)
+			default:
+				sharded.set(mapName, []byte(key), value)
+			}
+		}
+	}
+	return sharded
+}
+
+// deniedElsewhere reports whether a deny entry removed from mapName is still in the deny list
+// or in a shard of its family, which the Policy mirrors in one set. applyState calls it with
+// loadedMu held, for the deny lists only, whose entries are only looked up in the rule sets.
+func (m *Manager) deniedElsewhere(mapName string, key []byte) bool {
+	switch mapName {
+	case DENIED_V4_CIDR_LIST_MAP_NAME, DENIED_V6_CIDR_LIST_MAP_NAME:
+		for shard := 0; shard < m.config.Resources.DenyShards; shard++ {
+			if m.inRuleSet(denyShardMapName(mapName, shard), key, nil) {
+				return true
+			}
+		}
+	default:
+		if base, ok := denyShardBase(mapName); ok {
+			return m.configured(base, key) || m.inRuleSet(base, key, nil) || m.runtimeRule(base, key)
+		}
+	}
+	return false
+}
@@ -0,0 +1,159 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"testing"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/policy/cidrset"
+	"github.com/stretchr/testify/assert"
+)
+
+// randomPrefix returns a random prefix, with short prefixes around a few networks so that
+// the prefixes overlap, across the shards and within them.
+func randomPrefix(r *rand.Rand) *net.IPNet {
+	if r.Intn(4) == 0 {
+		ip := net.IP{0x20, 0x01, 0x0d, 0xb8, byte(r.Intn(4)), byte(r.Intn(256)), 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+		ones := 16 + r.Intn(113)
+		return &net.IPNet{IP: ip.Mask(net.CIDRMask(ones, 128)), Mask: net.CIDRMask(ones, 128)}
+	}
+	ip := net.IPv4(10, byte(r.Intn(4)), byte(r.Intn(256)), byte(r.Intn(256))).To4()
+	ones := 8 + r.Intn(25)
+	return &net.IPNet{IP: ip.Mask(net.CIDRMask(ones, 32)), Mask: net.CIDRMask(ones, 32)}
+}
+
+func randomAddr(r *rand.Rand) net.IP {
+	if r.Intn(4) == 0 {
+		return net.IP{0x20, 0x01, 0x0d, 0xb8, byte(r.Intn(4)), byte(r.Intn(256)), 0, 0, 0, 0, 0, 0, 0, 0, byte(r.Intn(256)), byte(r.Intn(256))}
+	}
+	return net.IPv4(10, byte(r.Intn(4)), byte(r.Intn(256)), byte(r.Intn(256))).To4()
+}
+
+func TestShardedLookupMatchesASingleTrie(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, shards := range []int{1, 2, 3, config.RESOURCES_MAX_DENY_SHARDS} {
+		t.Run(fmt.Sprintf("%d shards", shards), func(t *testing.T) {
+			for round := 0; round < 20; round++ {
+				reference := cidrset.New()
+				state := mapState{}
+				for i := 0; i < 200; i++ {
+					prefix := randomPrefix(r)
+					reference.Insert(prefix, nil)
+					assert.Nil(t, state.setCIDRs([]string{prefix.String()}, DENIED_V4_CIDR_LIST_MAP_NAME, DENIED_V6_CIDR_LIST_MAP_NAME))
+				}
+
+				// Every shard is a trie of its own, looked up in order as the BPF program does.
+				tries := map[string]*cidrset.Set{}
+				for mapName, entries := range shardState(state, shards) {
+					tries[mapName] = cidrset.New()
+					for key := range entries {
+						tries[mapName].Insert(keyToIPNet([]byte(key)), nil)
+					}
+				}
+				assert.LessOrEqual(t, len(tries), 2*shards)
+
+				for i := 0; i < 1000; i++ {
+					addr := randomAddr(r)
+					denied := false
+					for _, trie := range tries {
+						denied = denied || trie.Contains(addr)
+					}
+					if !assert.Equal(t, reference.Contains(addr), denied, addr.String()) {
+						return
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestDenyShard(t *testing.T) {
+	shard := denyShard(cidrKey(t, "10.1.0.0/24"), 4)
+	assert.Equal(t, shard, denyShard(cidrKey(t, "10.1.0.0/24"), 4))
+	// The prefixes of a network are written to the same shard.
+	assert.Equal(t, shard, denyShard(cidrKey(t, "10.1.255.7/32"), 4))
+	assert.Equal(t, shard, denyShard(cidrKey(t, "10.1.0.0/16"), 4))
+	assert.Equal(t, denyShard(cidrKey(t, "2001:db8::/48"), 4), denyShard(cidrKey(t, "2001:db8:ffff::1/128"), 4))
+
+	used := map[int]bool{}
+	for _, cidr := range prefixes(0, 1024) {
+		used[denyShard(cidrKey(t, cidr), 4)] = true
+	}
+	for i := 0; i < 256; i++ {
+		used[denyShard(cidrKey(t, fmt.Sprintf("10.%d.0.0/16", i)), 4)] = true
+	}
+	assert.Len(t, used, 4)
+	assert.Equal(t, 0, denyShard(cidrKey(t, "10.1.0.0/24"), 1))
+}
+
+func TestShardedRuleSetOnlyWritesTheShardsOfItsChanges(t *testing.T) {
+	mgr, maps, file := newRuleSetTestManager(t, 1000)
+	defer mgr.Jobs().Stop()
+	mgr.config.Resources.DenyShards = 4
+	mgr.config.RestrictedNetworkConfig.CIDR.Deny = []string{"10.1.0.0/24"}
+	assert.Nil(t, mgr.SetConfigToMap())
+	cidrs := append(prefixes(0, 1024), "2001:db8::/32")
+	writeRuleSetFile(t, file, cidrs)
+
+	assert.Nil(t, mgr.refreshRuleSet(context.Background(), mgr.ruleSets[0]))
+	assert.Len(t, maps.Entries(DENIED_V4_CIDR_LIST_MAP_NAME), 1)
+	total := 0
+	for shard := 0; shard < 4; shard++ {
+		entries := maps.Entries(denyShardMapName(DENIED_V4_CIDR_LIST_MAP_NAME, shard))
+		assert.NotEmpty(t, entries)
+		total += len(entries)
+	}
+	assert.Equal(t, 1024, total)
+	assert.True(t, maps.Has(denyShardMapName(DENIED_V6_CIDR_LIST_MAP_NAME, denyShard(cidrKey(t, "2001:db8::/32"), 4)), cidrKey(t, "2001:db8::/32")))
+	assert.Empty(t, maps.Entries(denyShardMapName(DENIED_V4_CIDR_LIST_MAP_NAME, 4)))
+
+	// A refresh that replaces a prefix writes the shards of the two prefixes only.
+	maps.ClearWrites()
+	cidrs[100] = "172.16.0.0/12"
+	writeRuleSetFile(t, file, cidrs)
+	assert.Nil(t, mgr.refreshRuleSet(context.Background(), mgr.ruleSets[0]))
+	written := []string{}
+	for _, w := range maps.Writes() {
+		written = append(written, w.Map)
+	}
+	assert.Equal(t, []string{
+		denyShardMapName(DENIED_V4_CIDR_LIST_MAP_NAME, denyShard(cidrKey(t, "172.16.0.0/12"), 4)),
+		denyShardMapName(DENIED_V4_CIDR_LIST_MAP_NAME, denyShard(cidrKey(t, "10.0.100.0/24"), 4)),
+	}, written)
+
+	policy := mgr.Policy()
+	assert.True(t, policy.Evaluate(Connection{Addr: net.ParseIP("172.16.3.4")}).DenyListed)
+	assert.False(t, policy.Evaluate(Connection{Addr: net.ParseIP("10.0.100.1")}).DenyListed)
+
+	// A prefix the config also denies stays denied when the rule set removes it.
+	cidrs[256] = "192.0.2.0/24"
+	writeRuleSetFile(t, file, cidrs)
+	assert.Nil(t, mgr.refreshRuleSet(context.Background(), mgr.ruleSets[0]))
+	assert.False(t, mgr.ruleSets[0].has(denyShardMapName(DENIED_V4_CIDR_LIST_MAP_NAME, denyShard(cidrKey(t, "10.1.0.0/24"), 4)), cidrKey(t, "10.1.0.0/24")))
+	assert.True(t, policy.Evaluate(Connection{Addr: net.ParseIP("10.1.0.1")}).DenyListed)
+}
+
+func TestNewMapSizesSizesTheShardsInUse(t *testing.T) {
+	conf := config.DefaultConfig().Resources
+	sizes, err := NewMapSizes(conf)
+	assert.Nil(t, err)
+	assert.Equal(t, SizedMapNames(), sizes.Names())
+
+	conf.Profile = config.RESOURCES_PROFILE_MEDIUM
+	conf.DenyShards = 2
+	conf.MaxEntries = map[string]uint32{"denied_v6_cidr_shard_1": 100}
+	sizes, err = NewMapSizes(conf)
+	assert.Nil(t, err)
+	assert.Equal(t, append(SizedMapNames(), "denied_v4_cidr_shard_0", "denied_v4_cidr_shard_1", "denied_v6_cidr_shard_0", "denied_v6_cidr_shard_1"), sizes.Names())
+	assert.Equal(t, uint32(16384), sizes["denied_v4_cidr_shard_1"])
+	assert.Equal(t, uint32(100), sizes["denied_v6_cidr_shard_1"])
+	assert.Equal(t, sizes.Memory(DENIED_V4_CIDR_LIST_MAP_NAME), sizes.Memory("denied_v4_cidr_shard_0"))
+
+	// The shards that are not in use can not be sized.
+	conf.MaxEntries = map[string]uint32{"denied_v4_cidr_shard_2": 100}
+	_, err = NewMapSizes(conf)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,444 @@
+package network
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/freeze"
+	"github.com/mrtc0/bouheki/pkg/jobs"
+	log "github.com/mrtc0/bouheki/pkg/log"
+	"github.com/mrtc0/bouheki/pkg/notify"
+)
+
+const (
+	DOMAIN_SNAPSHOT_VERSION = 1
+
+	SNAPSHOT_LIST_ALLOW = "allow"
+	SNAPSHOT_LIST_DENY  = "deny"
+
+	// PRELOAD_MIN_LIFETIME is the minimum time a preloaded address stays installed
+	// without being confirmed by live resolution.
+	PRELOAD_MIN_LIFETIME = 5 * time.Minute
+	// PRELOAD_EXPIRE_INTERVAL is how often unconfirmed preloaded addresses are checked for expiry.
+	PRELOAD_EXPIRE_INTERVAL = time.Minute
+)
+
+var ErrInvalidSnapshotSignature = errors.New("domain snapshot signature verification failed")
+
+// DomainSnapshot is the result of resolving the configured domains on a reference host.
+type DomainSnapshot struct {
+	Version   int                   `json:"version"`
+	CreatedAt time.Time             `json:"created_at"`
+	Hostname  string                `json:"hostname"`
+	Entries   []DomainSnapshotEntry `json:"entries"`
+}
+
+type DomainSnapshotEntry struct {
+	Domain     string    `json:"domain"`
+	List       string    `json:"list"`
+	RecordType string    `json:"record_type"`
+	Addresses  []string  `json:"addresses"`
+	TTL        uint32    `json:"ttl"`
+	ResolvedAt time.Time `json:"resolved_at"`
+}
+
+// signedDomainSnapshot is the file format of an exported snapshot.
+// The signature covers the exact bytes of Snapshot.
+type signedDomainSnapshot struct {
+	Snapshot  json.RawMessage `json:"snapshot"`
+	Signature []byte          `json:"signature"`
+}
+
+// ExportDomainSnapshot resolves the allowed and denied domains of conf.
+// Domains that fail to resolve are left out of the snapshot.
+func ExportDomainSnapshot(conf *config.Config, resolver DNSResolver) *DomainSnapshot {
+	hostname, _ := os.Hostname()
+	snapshot := DomainSnapshot{
+		Version:   DOMAIN_SNAPSHOT_VERSION,
+		CreatedAt: time.Now().UTC(),
+		Hostname:  hostname,
+		Entries:   []DomainSnapshotEntry{},
+	}
+
+	lists := []struct {
+		name    string
+		domains []string
+	}{
+		{name: SNAPSHOT_LIST_ALLOW, domains: conf.RestrictedNetworkConfig.Domain.Allow},
+		{name: SNAPSHOT_LIST_DENY, domains: conf.RestrictedNetworkConfig.Domain.Deny},
+	}
+
+	for _, list := range lists {
+		for _, domain := range list.domains {
+			// The names of a wildcard domain are only known from the answers of the DNS proxy.
+			if config.IsWildcardDomain(domain) {
+				continue
+			}
+			for _, recordType := range []uint16{dns.TypeA, dns.TypeAAAA} {
+				answer, err := resolver.Resolve(domain, recordType)
+				if err != nil {
+					log.Debug(fmt.Sprintf("%s (%s) resolve failed. %s\n", domain, dns.TypeToString[recordType], err))
+					continue
+				}
+
+				entry := DomainSnapshotEntry{
+					Domain:     domain,
+					List:       list.name,
+					RecordType: dns.TypeToString[recordType],
+					TTL:        answer.TTL,
+					ResolvedAt: time.Now().UTC(),
+				}
+				for _, addr := range answer.Addresses {
+					entry.Addresses = append(entry.Addresses, addr.String())
+				}
+				snapshot.Entries = append(snapshot.Entries, entry)
+			}
+		}
+	}
+
+	return &snapshot
+}
+
+func SignDomainSnapshot(snapshot *DomainSnapshot, key ed25519.PrivateKey) ([]byte, error) {
+	raw, err := json.Marshal(snapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(signedDomainSnapshot{
+		Snapshot:  raw,
+		Signature: ed25519.Sign(key, raw),
+	})
+}
+
+func VerifyDomainSnapshot(data []byte, key ed25519.PublicKey) (*DomainSnapshot, error) {
+	signed := signedDomainSnapshot{}
+	if err := json.Unmarshal(data, &signed); err != nil {
+		return nil, err
+	}
+
+	if !ed25519.Verify(key, signed.Snapshot, signed.Signature) {
+		return nil, ErrInvalidSnapshotSignature
+	}
+
+	snapshot := DomainSnapshot{}
+	if err := json.Unmarshal(signed.Snapshot, &snapshot); err != nil {
+		return nil, err
+	}
+
+	if snapshot.Version != DOMAIN_SNAPSHOT_VERSION {
+		return nil, fmt.Errorf("unsupported domain snapshot version %d", snapshot.Version)
+	}
+
+	return &snapshot, nil
+}
+
+func LoadDomainSnapshot(path string, key ed25519.PublicKey) (*DomainSnapshot, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return VerifyDomainSnapshot(data, key)
+}
+
+type preloadedEntry struct {
+	domain    string
+	mapName   string
+	key       []byte
+	ttl       uint32
+	expiresAt time.Time
+}
+
+// preloadTracker remembers addresses installed from a domain snapshot until
+// live resolution confirms them. Unconfirmed addresses are removed when the
+// domain is resolved without them, or when they expire.
+type preloadTracker struct {
+	mu        sync.Mutex
+	pending   map[string]preloadedEntry
+	confirmed map[string]struct{}
+}
+
+func preloadID(mapName string, key []byte) string {
+	return mapName + "/" + string(key)
+}
+
+// add records a preloaded address. It returns false if the address is already
+// installed by the config or by live resolution and must not be tracked.
+func (t *preloadTracker) add(entry preloadedEntry) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	id := preloadID(entry.mapName, entry.key)
+	if _, ok := t.confirmed[id]; ok {
+		return false
+	}
+	if _, ok := t.pending[id]; ok {
+		return false
+	}
+
+	if t.pending == nil {
+		t.pending = map[string]preloadedEntry{}
+	}
+	t.pending[id] = entry
+	return true
+}
+
+func (t *preloadTracker) confirm(mapName string, key []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	id := preloadID(mapName, key)
+	if t.confirmed == nil {
+		t.confirmed = map[string]struct{}{}
+	}
+	t.confirmed[id] = struct{}{}
+	delete(t.pending, id)
+}
+
+// reconcile removes and returns the preloaded addresses of domain in mapName
+// that were not confirmed by live resolution.
+func (t *preloadTracker) reconcile(domain string, mapName string) []preloadedEntry {
+	return t.remove(func(entry preloadedEntry) bool {
+		return entry.domain == domain && entry.mapName == mapName
+	})
+}
+
+// expire removes and returns the preloaded addresses that expired at now.
+func (t *preloadTracker) expire(now time.Time) []preloadedEntry {
+	return t.remove(func(entry preloadedEntry) bool {
+		return !now.Before(entry.expiresAt)
+	})
+}
+
+func (t *preloadTracker) remove(match func(entry preloadedEntry) bool) []preloadedEntry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	removed := []preloadedEntry{}
+	for id, entry := range t.pending {
+		if match(entry) {
+			removed = append(removed, entry)
+			delete(t.pending, id)
+		}
+	}
+
+	return removed
+}
+
+// ttl returns the TTL hint of a preloaded domain in mapName.
+func (t *preloadTracker) ttl(domain string, mapName string) (uint32, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, entry := range t.pending {
+		if entry.domain == domain && entry.mapName == mapName {
+			return entry.ttl, true
+		}
+	}
+
+	return 0, false
+}
+
+func (t *preloadTracker) hasDomain(domain string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, entry := range t.pending {
+		if entry.domain == domain {
+			return true
+		}
+	}
+
+	return false
+}
+
+// configuredDomain returns the configured spelling of domain in list, if any.
+func configuredDomain(domains []string, domain string) (string, bool) {
+	for _, d := range domains {
+		if strings.EqualFold(toFqdn(d), toFqdn(domain)) {
+			return d, true
+		}
+	}
+
+	return "", false
+}
+
+// preloadDomains installs the addresses of the domain snapshot configured in
+// network.domain.preload_file. Entries of domains that are not configured are
+// ignored, so a snapshot can not add domains to the allow list.
+func (m *Manager) preloadDomains() error {
+	conf := m.config.RestrictedNetworkConfig.Domain
+	if conf.PreloadFile == "" {
+		return nil
+	}
+
+	key, err := conf.PreloadKey()
+	if err != nil {
+		return err
+	}
+
+	snapshot, err := LoadDomainSnapshot(conf.PreloadFile, key)
+	if err != nil {
+		log.Error(fmt.Errorf("ignore domain snapshot %s: %w", conf.PreloadFile, err))
+		return nil
+	}
+
+	now := m.now()
+	if age := now.Sub(snapshot.CreatedAt); conf.PreloadMaxAge > 0 && age > conf.PreloadMaxAge {
+		log.Warn(fmt.Sprintf("ignore domain snapshot %s: created %s ago, exceeds network.domain.preload_max_age", conf.PreloadFile, age.Round(time.Second)))
+		return nil
+	}
+
+	preloaded := 0
+	for _, entry := range snapshot.Entries {
+		var domains []string
+		var v4MapName, v6MapName string
+		switch entry.List {
+		case SNAPSHOT_LIST_ALLOW:
+			domains, v4MapName, v6MapName = conf.Allow, ALLOWED_V4_CIDR_LIST_MAP_NAME, ALLOWED_V6_CIDR_LIST_MAP_NAME
+		case SNAPSHOT_LIST_DENY:
+			domains, v4MapName, v6MapName = conf.Deny, DENIED_V4_CIDR_LIST_MAP_NAME, DENIED_V6_CIDR_LIST_MAP_NAME
+		default:
+			continue
+		}
+
+		domain, ok := configuredDomain(domains, entry.Domain)
+		if !ok {
+			log.Debug(fmt.Sprintf("%s is not in network.domain.%s, skip preloading", entry.Domain, entry.List))
+			continue
+		}
+
+		ips := []net.IP{}
+		for _, addr := range entry.Addresses {
+			if ip := net.ParseIP(addr); ip != nil {
+				ips = append(ips, ip)
+			}
+		}
+
+		addresses, err := domainNameToBPFMapKey(domain, ips, PROTOCOL_ALL)
+		if err != nil {
+			return err
+		}
+
+		lifetime := time.Duration(entry.TTL) * time.Second
+		if lifetime < PRELOAD_MIN_LIFETIME {
+			lifetime = PRELOAD_MIN_LIFETIME
+		}
+
+		for _, addr := range addresses {
+			mapName := v4MapName
+			if addr.isV6address() {
+				mapName = v6MapName
+			}
+			if m.familyDisabled(mapName) {
+				continue
+			}
+
+			tracked := m.preload.add(preloadedEntry{
+				domain:    domain,
+				mapName:   mapName,
+				key:       addr.key,
+				ttl:       entry.TTL,
+				expiresAt: now.Add(lifetime),
+			})
+			if !tracked {
+				continue
+			}
+
+			addr.monitored = m.monitoredDomain(domain)
+			if err := m.writeCIDR(addr, mapName); err != nil {
+				return err
+			}
+			preloaded++
+		}
+	}
+
+	log.Info(fmt.Sprintf("Preloaded %d addresses from domain snapshot %s", preloaded, conf.PreloadFile))
+	return nil
+}
+
+// reconcilePreloaded removes preloaded addresses of domain that live resolution did not return,
+// and returns the removed addresses.
+func (m *Manager) reconcilePreloaded(domain string, addresses []IPAddress, v4MapName, v6MapName string) ([]string, error) {
+	mapNames := map[string]struct{}{}
+	for _, addr := range addresses {
+		if addr.isV6address() {
+			mapNames[v6MapName] = struct{}{}
+		} else {
+			mapNames[v4MapName] = struct{}{}
+		}
+	}
+
+	removed := []string{}
+	for mapName := range mapNames {
+		for _, entry := range m.preload.reconcile(domain, mapName) {
+			if err := m.cidrListDeleteKey(entry.mapName, entry.key); err != nil {
+				return removed, err
+			}
+			removed = append(removed, keyToIPNet(entry.key).String())
+			log.Debug(fmt.Sprintf("%s: removed a preloaded address not returned by live resolution", domain))
+		}
+	}
+
+	return removed, nil
+}
+
+func listOfMap(mapName string) string {
+	switch mapName {
+	case DENIED_V4_CIDR_LIST_MAP_NAME, DENIED_V6_CIDR_LIST_MAP_NAME, DENIED_V4_PROTOCOL_CIDR_LIST_MAP_NAME, DENIED_V6_PROTOCOL_CIDR_LIST_MAP_NAME, DENIED_V4_ENTRY_CIDR_LIST_MAP_NAME, DENIED_V6_ENTRY_CIDR_LIST_MAP_NAME:
+		return SNAPSHOT_LIST_DENY
+	default:
+		return SNAPSHOT_LIST_ALLOW
+	}
+}
+
+// initialRefreshDelay delays the first live resolution of a preloaded domain until its TTL hint.
+func (m *Manager) initialRefreshDelay(domain string, mapName string) time.Duration {
+	ttl, ok := m.preload.ttl(domain, mapName)
+	if !ok {
+		return 0
+	}
+
+	return time.Duration(ttl) * time.Second
+}
+
+func (m *Manager) expirePreloaded() {
+	for {
+		m.sleep(PRELOAD_EXPIRE_INTERVAL)
+		err := m.runJob("preload-expire", freeze.CHANGE_DNS_REFRESH, func(ctx context.Context) error {
+			m.removeExpiredPreloaded(m.now())
+			return nil
+		})
+		if err == jobs.ErrStopped {
+			return
+		}
+	}
+}
+
+// removeExpiredPreloaded deletes the preloaded addresses that expired at now.
+func (m *Manager) removeExpiredPreloaded(now time.Time) {
+	for _, entry := range m.preload.expire(now) {
+		if err := m.cidrListDeleteKey(entry.mapName, entry.key); err != nil {
+			log.Error(err)
+			continue
+		}
+		log.Debug(fmt.Sprintf("%s: removed a preloaded address that was never confirmed by live resolution", entry.domain))
+		m.publishDNSRuleChange(notify.DNSRuleChange{
+			Domain:  entry.domain,
+			List:    listOfMap(entry.mapName),
+			Removed: []string{keyToIPNet(entry.key).String()},
+		})
+	}
+}
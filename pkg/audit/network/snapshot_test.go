@@ -0,0 +1,144 @@
+package network
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+type FakeDNSResolver struct {
+	answers map[uint16][]net.IP
+}
+
+func (r *FakeDNSResolver) Resolve(host string, recordType uint16) (*DNSAnswer, error) {
+	addresses, ok := r.answers[recordType]
+	if !ok {
+		return nil, errors.New("no records")
+	}
+
+	return &DNSAnswer{Domain: host, Addresses: addresses, TTL: 300}, nil
+}
+
+func TestExportDomainSnapshot(t *testing.T) {
+	conf := config.DefaultConfig()
+	conf.RestrictedNetworkConfig.Domain.Allow = []string{"example.com"}
+	conf.RestrictedNetworkConfig.Domain.Deny = []string{"evil.example.com"}
+	resolver := &FakeDNSResolver{answers: map[uint16][]net.IP{
+		dns.TypeA: {net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 2)},
+	}}
+
+	snapshot := ExportDomainSnapshot(conf, resolver)
+
+	assert.Equal(t, DOMAIN_SNAPSHOT_VERSION, snapshot.Version)
+	assert.Len(t, snapshot.Entries, 2)
+	assert.Equal(t, "example.com", snapshot.Entries[0].Domain)
+	assert.Equal(t, SNAPSHOT_LIST_ALLOW, snapshot.Entries[0].List)
+	assert.Equal(t, "A", snapshot.Entries[0].RecordType)
+	assert.Equal(t, []string{"192.0.2.1", "192.0.2.2"}, snapshot.Entries[0].Addresses)
+	assert.Equal(t, uint32(300), snapshot.Entries[0].TTL)
+	assert.Equal(t, SNAPSHOT_LIST_DENY, snapshot.Entries[1].List)
+}
+
+func TestSignAndVerifyDomainSnapshot(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	assert.Nil(t, err)
+	otherKey, _, err := ed25519.GenerateKey(nil)
+	assert.Nil(t, err)
+
+	snapshot := &DomainSnapshot{
+		Version:   DOMAIN_SNAPSHOT_VERSION,
+		CreatedAt: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+		Entries: []DomainSnapshotEntry{
+			{Domain: "example.com", List: SNAPSHOT_LIST_ALLOW, RecordType: "A", Addresses: []string{"192.0.2.1"}, TTL: 300},
+		},
+	}
+
+	data, err := SignDomainSnapshot(snapshot, privateKey)
+	assert.Nil(t, err)
+
+	t.Run("valid signature", func(t *testing.T) {
+		verified, err := VerifyDomainSnapshot(data, publicKey)
+		assert.Nil(t, err)
+		assert.Equal(t, snapshot.Entries, verified.Entries)
+	})
+
+	t.Run("tampered snapshot", func(t *testing.T) {
+		tampered := bytes.Replace(data, []byte("192.0.2.1"), []byte("0.0.0.0/0"), 1)
+		_, err := VerifyDomainSnapshot(tampered, publicKey)
+		assert.ErrorIs(t, err, ErrInvalidSnapshotSignature)
+	})
+
+	t.Run("signed by another key", func(t *testing.T) {
+		_, err := VerifyDomainSnapshot(data, otherKey)
+		assert.ErrorIs(t, err, ErrInvalidSnapshotSignature)
+	})
+}
+
+func TestPreloadTracker(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	entry := func(domain string, key string, expiresAt time.Time) preloadedEntry {
+		return preloadedEntry{domain: domain, mapName: ALLOWED_V4_CIDR_LIST_MAP_NAME, key: []byte(key), ttl: 60, expiresAt: expiresAt}
+	}
+
+	t.Run("addresses already installed are not tracked", func(t *testing.T) {
+		tracker := preloadTracker{}
+		tracker.confirm(ALLOWED_V4_CIDR_LIST_MAP_NAME, []byte("a"))
+
+		assert.False(t, tracker.add(entry("example.com", "a", now)))
+		assert.True(t, tracker.add(entry("example.com", "b", now)))
+		assert.False(t, tracker.add(entry("example.org", "b", now)))
+		assert.True(t, tracker.hasDomain("example.com"))
+		assert.False(t, tracker.hasDomain("example.org"))
+	})
+
+	t.Run("reconcile removes addresses not confirmed by live resolution", func(t *testing.T) {
+		tracker := preloadTracker{}
+		tracker.add(entry("example.com", "a", now))
+		tracker.add(entry("example.com", "b", now))
+		tracker.add(entry("example.org", "c", now))
+
+		ttl, ok := tracker.ttl("example.com", ALLOWED_V4_CIDR_LIST_MAP_NAME)
+		assert.True(t, ok)
+		assert.Equal(t, uint32(60), ttl)
+
+		tracker.confirm(ALLOWED_V4_CIDR_LIST_MAP_NAME, []byte("a"))
+		removed := tracker.reconcile("example.com", ALLOWED_V4_CIDR_LIST_MAP_NAME)
+
+		assert.Equal(t, []preloadedEntry{entry("example.com", "b", now)}, removed)
+		assert.Empty(t, tracker.reconcile("example.com", ALLOWED_V4_CIDR_LIST_MAP_NAME))
+		assert.True(t, tracker.hasDomain("example.org"))
+	})
+
+	t.Run("expire removes addresses never confirmed", func(t *testing.T) {
+		tracker := preloadTracker{}
+		tracker.add(entry("example.com", "a", now))
+		tracker.add(entry("example.com", "b", now.Add(time.Hour)))
+
+		assert.Empty(t, tracker.expire(now.Add(-time.Second)))
+		assert.Equal(t, []preloadedEntry{entry("example.com", "a", now)}, tracker.expire(now))
+		assert.Len(t, tracker.expire(now.Add(time.Hour)), 1)
+		assert.False(t, tracker.hasDomain("example.com"))
+	})
+}
+
+func Test_configuredDomain(t *testing.T) {
+	domains := []string{"Example.com", "example.org."}
+
+	domain, ok := configuredDomain(domains, "example.com.")
+	assert.True(t, ok)
+	assert.Equal(t, "Example.com", domain)
+
+	domain, ok = configuredDomain(domains, "example.org")
+	assert.True(t, ok)
+	assert.Equal(t, "example.org.", domain)
+
+	_, ok = configuredDomain(domains, "example.net")
+	assert.False(t, ok)
+}
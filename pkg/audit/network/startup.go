@@ -0,0 +1,102 @@
+package network
+
+import (
+	"context"
+	"errors"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/freeze"
+	"github.com/mrtc0/bouheki/pkg/jobs"
+	log "github.com/mrtc0/bouheki/pkg/log"
+	"github.com/mrtc0/bouheki/pkg/metrics"
+	"github.com/mrtc0/bouheki/pkg/startup"
+	"github.com/mrtc0/bouheki/pkg/timing"
+)
+
+// The phases of the startup of the network audit, in the order they run. The programs are
+// loaded again when a variant fails to load, which adds a load and a btf phase.
+const (
+	STARTUP_TIMER_NAME = "network startup"
+
+	STARTUP_PHASE_LOAD       = "load"
+	STARTUP_PHASE_BTF        = "btf"
+	STARTUP_PHASE_CONDITIONS = "startup-conditions"
+	// The writes to every map are added up as a phase named after the map.
+	STARTUP_PHASE_MAPS_POPULATE   = "maps-populate"
+	STARTUP_PHASE_DOMAINS_PRELOAD = "domains-preload"
+	// Every domain resolved is a phase named after the domain.
+	STARTUP_PHASE_DOMAINS_RESOLVE = "domains-resolve"
+	STARTUP_PHASE_SELF_EXEMPTION  = "self-exemption"
+	STARTUP_PHASE_ATTACH          = "attach"
+
+	// STARTUP_LOG_DEPTH is the depth of the phases in the startup log and in bouheki status.
+	// The phases below, e.g. every domain resolved, are logged at debug level.
+	STARTUP_LOG_DEPTH = 1
+)
+
+var (
+	startupSeconds = metrics.NewGauge("network_startup_seconds",
+		"Time from the launch of the network audit until it was ready, 0 until then.")
+	startupSlowestPhaseSeconds = metrics.NewGauge("network_startup_slowest_phase_seconds",
+		"Duration of the slowest phase of the startup of the network audit, which the startup log and /startup name.")
+)
+
+// reportStartupTiming logs the phases of the startup once the audit is ready, and exports
+// the total and its slowest phase.
+func reportStartupTiming(r timing.Record) {
+	startupSeconds.Set(r.Total.Seconds())
+
+	timingLog := log.TimingLog{Run: r.Name, Total: r.Total, Phases: r.Table(STARTUP_LOG_DEPTH)}
+	if slowest, ok := r.Slowest(); ok {
+		startupSlowestPhaseSeconds.Set(slowest.Duration.Seconds())
+		timingLog.Slowest, timingLog.SlowestDuration = slowest.Name, slowest.Duration
+	}
+	timingLog.Info()
+	log.Debug(r.Table(0))
+}
+
+// completeStartup registers the tasks that write what SetConfigToMap could not write
+// without the startup conditions that proceeded degraded.
+func (m *Manager) completeStartup(checker *startup.Checker) {
+	checker.OnRecovered(config.STARTUP_CONDITION_DNS, m.completeDomains)
+	// The cgroups of the containers exist once the runtime or the kubelet is up.
+	checker.OnRecovered(config.STARTUP_CONDITION_SOCKET, m.completeCgroups)
+	checker.OnRecovered(config.STARTUP_CONDITION_HTTP, m.completeCgroups)
+}
+
+// completeDomains resolves the configured domains once DNS is reachable, rather than
+// when they are next refreshed.
+func (m *Manager) completeDomains() {
+	if m.config.DNSProxyConfig.Enable {
+		return
+	}
+
+	err := m.runJob("startup-dns", freeze.CHANGE_DNS_REFRESH, func(ctx context.Context) error {
+		return m.initDomainList(nil)
+	})
+	if err != nil && err != jobs.ErrStopped && !errors.Is(err, jobs.ErrRejected) {
+		log.Error(err)
+	}
+}
+
+// completeCgroups classifies the cgroups of the containers started before the runtime
+// was reachable, rather than at the next rescan.
+func (m *Manager) completeCgroups() {
+	if !m.usesCgroups() {
+		return
+	}
+
+	c, err := m.classifier()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	m.rewatchCgroups(c)
+
+	err = m.doJob("startup-cgroups", func(ctx context.Context) error {
+		return m.rescanCgroups()
+	})
+	if err != nil && err != jobs.ErrStopped {
+		log.Error(err)
+	}
+}
@@ -0,0 +1,42 @@
+package network
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/mrtc0/bouheki/pkg/bouhekitest"
+	"github.com/mrtc0/bouheki/pkg/timing"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetConfigToMapTimesThePhases(t *testing.T) {
+	conf := stateTestConfig()
+	conf.RestrictedNetworkConfig.Domain.Allow = []string{"example.com", "example.org"}
+	resolver := &FakeDNSResolver{answers: map[uint16][]net.IP{dns.TypeA: {net.IPv4(192, 0, 2, 1)}}}
+	timer := timing.New(STARTUP_TIMER_NAME, nil)
+	mgr, err := NewManager(conf, WithMapBackend(bouhekitest.NewMaps()), WithDNSResolver(resolver), withStartupTimer(timer))
+	assert.Nil(t, err)
+
+	assert.Nil(t, mgr.SetConfigToMap())
+	r := timer.End()
+
+	// The writes add up by map.
+	allowed, ok := r.Find(STARTUP_PHASE_MAPS_POPULATE, ALLOWED_V4_CIDR_LIST_MAP_NAME)
+	assert.True(t, ok)
+	assert.Equal(t, 1, allowed.Runs)
+	commands, ok := r.Find(STARTUP_PHASE_MAPS_POPULATE, ALLOWED_COMMAND_LIST_MAP_NAME)
+	assert.True(t, ok)
+	assert.Equal(t, 1, commands.Runs)
+
+	// Each domain is resolved in a phase of its own.
+	resolve, ok := r.Find(STARTUP_PHASE_DOMAINS_RESOLVE)
+	assert.True(t, ok)
+	names := []string{}
+	for _, p := range resolve.Phases {
+		names = append(names, p.Name)
+	}
+	assert.Equal(t, []string{"example.com", "example.org"}, names)
+	_, ok = r.Find(STARTUP_PHASE_DOMAINS_PRELOAD)
+	assert.True(t, ok)
+}
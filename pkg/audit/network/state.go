@@ -0,0 +1,858 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"syscall"
+	"unsafe"
+
+	"github.com/aquasecurity/libbpfgo"
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/errkind"
+	"github.com/mrtc0/bouheki/pkg/policy"
+	"github.com/mrtc0/bouheki/pkg/timing"
+)
+
+// policyMapOrder is the order in which the maps are written by applyState.
+// The config map comes after the lists, so the list sizes it holds are
+// only raised once the entries they count are written.
+var policyMapOrder = append(append([]string{
+	ALLOWED_V4_CIDR_LIST_MAP_NAME,
+	ALLOWED_V6_CIDR_LIST_MAP_NAME,
+	DENIED_V4_CIDR_LIST_MAP_NAME,
+	DENIED_V6_CIDR_LIST_MAP_NAME,
+}, denyShardMapNames()...),
+	ALLOWED_V4_PROTOCOL_CIDR_LIST_MAP_NAME,
+	ALLOWED_V6_PROTOCOL_CIDR_LIST_MAP_NAME,
+	DENIED_V4_PROTOCOL_CIDR_LIST_MAP_NAME,
+	DENIED_V6_PROTOCOL_CIDR_LIST_MAP_NAME,
+	ALLOWED_COMMAND_LIST_MAP_NAME,
+	DENIED_COMMAND_LIST_MAP_NAME,
+	ALLOWED_PATH_LIST_MAP_NAME,
+	DENIED_PATH_LIST_MAP_NAME,
+	ALLOWED_COMMAND_PATTERN_LIST_MAP_NAME,
+	DENIED_COMMAND_PATTERN_LIST_MAP_NAME,
+	ALLOWED_UID_LIST_MAP_NAME,
+	DENIED_UID_LIST_MAP_NAME,
+	ALLOWED_UID_RANGE_LIST_MAP_NAME,
+	DENIED_UID_RANGE_LIST_MAP_NAME,
+	ALLOWED_GID_LIST_MAP_NAME,
+	DENIED_GID_LIST_MAP_NAME,
+	ALLOWED_PORT_LIST_MAP_NAME,
+	DENIED_PORT_LIST_MAP_NAME,
+	INGRESS_ALLOWED_V4_CIDR_LIST_MAP_NAME,
+	INGRESS_ALLOWED_V6_CIDR_LIST_MAP_NAME,
+	INGRESS_DENIED_V4_CIDR_LIST_MAP_NAME,
+	INGRESS_DENIED_V6_CIDR_LIST_MAP_NAME,
+	INGRESS_ALLOWED_PORT_LIST_MAP_NAME,
+	INGRESS_DENIED_PORT_LIST_MAP_NAME,
+	ALLOWED_V4_ENTRY_CIDR_LIST_MAP_NAME,
+	ALLOWED_V6_ENTRY_CIDR_LIST_MAP_NAME,
+	DENIED_V4_ENTRY_CIDR_LIST_MAP_NAME,
+	DENIED_V6_ENTRY_CIDR_LIST_MAP_NAME,
+	POLICY_ENTRY_COMMAND_LIST_MAP_NAME,
+	POLICY_ENTRY_UID_LIST_MAP_NAME,
+	POLICY_ENTRY_GID_LIST_MAP_NAME,
+	CONTAINER_CGROUP_LIST_MAP_NAME,
+	RESTRICT_NETWORK_CONFIG_MAP_NAME,
+)
+
+// policyMap is the subset of *libbpfgo.BPFMap the Manager writes the policy with.
+type policyMap interface {
+	Update(key, value []byte) error
+	DeleteKey(key []byte) error
+}
+
+// mapReader is implemented by the policy maps verifyBatch can read back.
+type mapReader interface {
+	// Lookup returns the value of key, and whether the map has it.
+	Lookup(key []byte) ([]byte, bool, error)
+}
+
+// MapBackend writes the policy maps by name. The Manager writes the maps of the loaded BPF programs,
+// unless another backend is given with WithMapBackend, e.g. bouhekitest.Maps in tests.
+type MapBackend interface {
+	Update(mapName string, key, value []byte) error
+	Delete(mapName string, key []byte) error
+}
+
+// MapReader is implemented by the backends whose maps can be read back, which the Manager does
+// to verify its jobs, see verifyBatch.
+type MapReader interface {
+	Lookup(mapName string, key []byte) ([]byte, bool, error)
+}
+
+type backendMap struct {
+	backend MapBackend
+	name    string
+}
+
+func (b backendMap) Update(key, value []byte) error {
+	return b.backend.Update(b.name, key, value)
+}
+
+func (b backendMap) DeleteKey(key []byte) error {
+	return b.backend.Delete(b.name, key)
+}
+
+// readableBackendMap is a backendMap whose backend is a MapReader.
+type readableBackendMap struct {
+	backendMap
+	reader MapReader
+}
+
+func (b readableBackendMap) Lookup(key []byte) ([]byte, bool, error) {
+	return b.reader.Lookup(b.name, key)
+}
+
+type bpfPolicyMap struct {
+	bpfMap *libbpfgo.BPFMap
+}
+
+func (b bpfPolicyMap) Update(key, value []byte) error {
+	// NOTE: Slices and arrays are supported but references should be passed to the first element in the slice or array.
+	return b.bpfMap.Update(unsafe.Pointer(&key[0]), unsafe.Pointer(&value[0]))
+}
+
+func (b bpfPolicyMap) DeleteKey(key []byte) error {
+	return b.bpfMap.DeleteKey(unsafe.Pointer(&key[0]))
+}
+
+// Lookup looks key up as the BPF program does: in an LPM trie, a key that is not in the map is
+// found if a prefix covering it is.
+func (b bpfPolicyMap) Lookup(key []byte) ([]byte, bool, error) {
+	value, err := b.bpfMap.GetValue(unsafe.Pointer(&key[0]))
+	if errors.Is(err, syscall.ENOENT) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+// mapState is the content of the policy maps: map name -> key -> value.
+type mapState map[string]map[string][]byte
+
+func (s mapState) set(mapName string, key, value []byte) {
+	if s[mapName] == nil {
+		s[mapName] = map[string][]byte{}
+	}
+	s[mapName][string(key)] = value
+}
+
+func (s mapState) delete(mapName string, key []byte) {
+	delete(s[mapName], string(key))
+}
+
+func (s mapState) len() int {
+	n := 0
+	for _, entries := range s {
+		n += len(entries)
+	}
+	return n
+}
+
+func (s mapState) setCIDRs(cidrs []string, v4MapName, v6MapName string) error {
+	return s.setProtocolCIDRs(cidrs, PROTOCOL_ALL, v4MapName, v6MapName)
+}
+
+// setProtocolCIDRs sets the keys of cidrs for the socket type protocol.
+func (s mapState) setProtocolCIDRs(cidrs []string, protocol uint8, v4MapName, v6MapName string) error {
+	for _, cidr := range cidrs {
+		addr, err := cidrToBPFMapKey(cidr)
+		if err != nil {
+			return err
+		}
+		if protocol != PROTOCOL_ALL {
+			addr.protocol = protocol
+			if _, err := addr.ipAddressToBPFMapKey(); err != nil {
+				return err
+			}
+		}
+		if addr.isV6address() {
+			s.set(v6MapName, addr.key, entryValue())
+		} else {
+			s.set(v4MapName, addr.key, entryValue())
+		}
+	}
+	return nil
+}
+
+// setPorts sets the prefixes that cover the port ranges of entries.
+func (s mapState) setPorts(entries []string, mapName string) error {
+	for _, entry := range entries {
+		r, err := config.ParsePortRange(entry)
+		if err != nil {
+			return err
+		}
+		for _, prefix := range policy.PortRangePrefixes(r) {
+			s.set(mapName, portToKey(prefix), entryValue())
+		}
+	}
+	return nil
+}
+
+// entryValue is the value of the list entries. The BPF program only looks at the keys, but for
+// the entries of the deny CIDR lists of exceptValue.
+func entryValue() []byte {
+	return []byte{policy.DENY_ENTRY_DENY}
+}
+
+// exceptValue is the value of the entries of the deny CIDR lists that nothing overrides.
+func exceptValue() []byte {
+	return []byte{policy.DENY_ENTRY_EXCEPT}
+}
+
+// monitorValue is the value of the entries of the deny CIDR lists in mode: monitor, and
+// monitorCommandValue the one of the commands of denied_command_list, whose values are u32.
+func monitorValue() []byte {
+	return []byte{policy.DENY_ENTRY_MONITOR}
+}
+
+func monitorCommandValue() []byte {
+	return uintToKey(policy.DENY_ENTRY_MONITOR)
+}
+
+// denyEntryValue returns the value of the entry key of the deny CIDR list mapName: exceptValue
+// if it is inside a prefix of excepts, so that the longest prefix match finds an entry of
+// exceptValue for every address of network.cidr.allow_except.
+func denyEntryValue(mapName string, key []byte, excepts []*net.IPNet) []byte {
+	switch mapName {
+	case DENIED_V4_CIDR_LIST_MAP_NAME, DENIED_V6_CIDR_LIST_MAP_NAME:
+		if policy.InsideExcept(keyToIPNet(key), excepts) {
+			return exceptValue()
+		}
+	}
+	return entryValue()
+}
+
+// markExcepts sets the entries of the deny CIDR lists of s that are inside a prefix of excepts
+// to exceptValue.
+func (s mapState) markExcepts(excepts []*net.IPNet) {
+	if len(excepts) == 0 {
+		return
+	}
+	for _, mapName := range []string{DENIED_V4_CIDR_LIST_MAP_NAME, DENIED_V6_CIDR_LIST_MAP_NAME} {
+		for key := range s[mapName] {
+			s.set(mapName, []byte(key), denyEntryValue(mapName, []byte(key), excepts))
+		}
+	}
+}
+
+// markMonitored sets the entries of the deny CIDR lists of s that are prefixes of
+// network.cidr.monitor, and inside no prefix that denies whatever mode: monitor, to monitorValue.
+func (s mapState) markMonitored(conf config.RestrictedNetworkConfig) {
+	monitored, denied := policy.MonitorPrefixes(conf)
+	if len(monitored) == 0 {
+		return
+	}
+	for _, mapName := range []string{DENIED_V4_CIDR_LIST_MAP_NAME, DENIED_V6_CIDR_LIST_MAP_NAME} {
+		for key := range s[mapName] {
+			if policy.MonitoredEntry(keyToIPNet([]byte(key)), monitored, denied) {
+				s.set(mapName, []byte(key), monitorValue())
+			}
+		}
+	}
+}
+
+// mapOp is a write to a policy map. A nil value deletes the key.
+type mapOp struct {
+	mapName string
+	key     []byte
+	value   []byte
+}
+
+func (o mapOp) isDelete() bool {
+	return o.value == nil
+}
+
+// diffState returns the writes that turn loaded into desired. Updates come first, in
+// policyMapOrder and then by key, followed by the deletions in the reverse order, so
+// that a rule is never missing from the maps while it is replaced.
+func diffState(loaded, desired mapState) []mapOp {
+	ops := []mapOp{}
+
+	for _, mapName := range policyMapOrder {
+		for _, key := range sortedKeys(desired[mapName]) {
+			value := desired[mapName][key]
+			if current, ok := loaded[mapName][key]; ok && bytes.Equal(current, value) {
+				continue
+			}
+			ops = append(ops, mapOp{mapName: mapName, key: []byte(key), value: value})
+		}
+	}
+
+	for i := len(policyMapOrder) - 1; i >= 0; i-- {
+		mapName := policyMapOrder[i]
+		for _, key := range sortedKeys(loaded[mapName]) {
+			if _, ok := desired[mapName][key]; ok {
+				continue
+			}
+			ops = append(ops, mapOp{mapName: mapName, key: []byte(key)})
+		}
+	}
+
+	return ops
+}
+
+func sortedKeys(entries map[string][]byte) []string {
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// desiredState returns the content of the maps for the rules of the config.
+// Duplicated rules, and rules that normalize to the same key, are written once.
+// The addresses of the domains are not part of it; they are written as the domains are resolved.
+func (m *Manager) desiredState() (mapState, error) {
+	state, err := policyState(m.config.RestrictedNetworkConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	state.set(RESTRICT_NETWORK_CONFIG_MAP_NAME, []byte{0}, m.configMapValue())
+
+	cgroups, err := m.containerCgroups()
+	if err != nil {
+		return nil, err
+	}
+	state[CONTAINER_CGROUP_LIST_MAP_NAME] = cgroups
+
+	return state, nil
+}
+
+// policyState returns the content of the rule maps: the lists of CIDRs, commands, uids, gids and
+// ports, and the lists of network.ingress, without the CIDRs of the families network.families leaves out.
+func policyState(conf config.RestrictedNetworkConfig) (mapState, error) {
+	state := mapState{}
+
+	if err := state.setCIDRs(conf.CIDR.Allow, ALLOWED_V4_CIDR_LIST_MAP_NAME, ALLOWED_V6_CIDR_LIST_MAP_NAME); err != nil {
+		return nil, errkind.Errorf(errkind.Config, "network.cidr.allow: %w", err)
+	}
+	if err := state.setCIDRs(conf.CIDR.Deny, DENIED_V4_CIDR_LIST_MAP_NAME, DENIED_V6_CIDR_LIST_MAP_NAME); err != nil {
+		return nil, errkind.Errorf(errkind.Config, "network.cidr.deny: %w", err)
+	}
+	if err := state.setCIDRs(conf.CIDR.AllowExcept, DENIED_V4_CIDR_LIST_MAP_NAME, DENIED_V6_CIDR_LIST_MAP_NAME); err != nil {
+		return nil, errkind.Errorf(errkind.Config, "network.cidr.allow_except: %w", err)
+	}
+	state.markExcepts(policy.ExceptPrefixes(conf))
+	state.markMonitored(conf)
+	for _, protocol := range ruleProtocols {
+		allow, deny := config.ProtocolLists(conf.CIDR.Protocols, protocol)
+		if err := state.setProtocolCIDRs(allow, protocolSockType(protocol), ALLOWED_V4_PROTOCOL_CIDR_LIST_MAP_NAME, ALLOWED_V6_PROTOCOL_CIDR_LIST_MAP_NAME); err != nil {
+			return nil, errkind.Errorf(errkind.Config, "network.cidr.protocols[%s].allow: %w", protocol, err)
+		}
+		if err := state.setProtocolCIDRs(deny, protocolSockType(protocol), DENIED_V4_PROTOCOL_CIDR_LIST_MAP_NAME, DENIED_V6_PROTOCOL_CIDR_LIST_MAP_NAME); err != nil {
+			return nil, errkind.Errorf(errkind.Config, "network.cidr.protocols[%s].deny: %w", protocol, err)
+		}
+	}
+
+	for mapName, entries := range subjectState(conf) {
+		state[mapName] = entries
+	}
+	ports, err := portState(conf)
+	if err != nil {
+		return nil, err
+	}
+	for mapName, entries := range ports {
+		state[mapName] = entries
+	}
+	ingress, err := ingressState(conf.Ingress)
+	if err != nil {
+		return nil, err
+	}
+	for mapName, entries := range ingress {
+		state[mapName] = entries
+	}
+	entries, err := entryState(conf.PolicyEntries())
+	if err != nil {
+		return nil, err
+	}
+	for mapName, values := range entries {
+		state[mapName] = values
+	}
+	return state.dropFamilies(policy.DisabledFamilies(conf)), nil
+}
+
+// portState returns the content of the port lists, each range as the prefixes that cover it.
+func portState(conf config.RestrictedNetworkConfig) (mapState, error) {
+	state := mapState{}
+	for _, list := range []struct {
+		name    string
+		mapName string
+		entries []string
+	}{
+		{"network.ports.allow", ALLOWED_PORT_LIST_MAP_NAME, conf.Ports.Allow},
+		{"network.ports.deny", DENIED_PORT_LIST_MAP_NAME, conf.Ports.Deny},
+	} {
+		if err := state.setPorts(list.entries, list.mapName); err != nil {
+			return nil, errkind.Errorf(errkind.Config, "%s: %w", list.name, err)
+		}
+	}
+	return state, nil
+}
+
+// subjectState returns the content of the lists of commands, paths, uids and gids. The config map holds
+// the number of entries of each, which is 0 whether the list is absent from the config or empty.
+// The patterns of the command lists that can not be expanded to a command are in the pattern
+// lists, keyed by their index.
+func subjectState(conf config.RestrictedNetworkConfig) mapState {
+	state := mapState{}
+	monitored := policy.MonitoredCommands(conf)
+	for _, list := range []struct {
+		mapName        string
+		patternMapName string
+		entries        []string
+	}{
+		{ALLOWED_COMMAND_LIST_MAP_NAME, ALLOWED_COMMAND_PATTERN_LIST_MAP_NAME, conf.Command.Allow},
+		{DENIED_COMMAND_LIST_MAP_NAME, DENIED_COMMAND_PATTERN_LIST_MAP_NAME, conf.Command.Deny},
+	} {
+		commands, patterns := config.SplitCommands(list.entries)
+		for _, c := range commands {
+			key := byteToKey([]byte(c))
+			if _, ok := monitored[string(key)]; ok && list.mapName == DENIED_COMMAND_LIST_MAP_NAME {
+				state.set(list.mapName, key, monitorCommandValue())
+				continue
+			}
+			state.set(list.mapName, key, entryValue())
+		}
+		for i, pattern := range patterns {
+			state.set(list.patternMapName, uintToKey(uint(i)), commandPatternValue(pattern))
+		}
+	}
+	for _, path := range conf.Command.AllowPaths {
+		state.set(ALLOWED_PATH_LIST_MAP_NAME, pathToKey(path), entryValue())
+	}
+	for _, path := range conf.Command.DenyPaths {
+		state.set(DENIED_PATH_LIST_MAP_NAME, pathToKey(path), entryValue())
+	}
+	for _, list := range []struct {
+		mapName      string
+		rangeMapName string
+		entries      []string
+	}{
+		{ALLOWED_UID_LIST_MAP_NAME, ALLOWED_UID_RANGE_LIST_MAP_NAME, conf.UID.Allow},
+		{DENIED_UID_LIST_MAP_NAME, DENIED_UID_RANGE_LIST_MAP_NAME, conf.UID.Deny},
+	} {
+		uids, ranges := config.SplitUIDs(list.entries)
+		for _, uid := range uids {
+			state.set(list.mapName, uintToKey(uid), entryValue())
+		}
+		for _, r := range ranges {
+			for _, prefix := range policy.UIDRangePrefixes(r) {
+				state.set(list.rangeMapName, uidPrefixToKey(prefix), entryValue())
+			}
+		}
+	}
+	for _, gid := range config.GIDs(conf.GID.Allow) {
+		state.set(ALLOWED_GID_LIST_MAP_NAME, uintToKey(gid), entryValue())
+	}
+	for _, gid := range config.GIDs(conf.GID.Deny) {
+		state.set(DENIED_GID_LIST_MAP_NAME, uintToKey(gid), entryValue())
+	}
+
+	return state
+}
+
+// entryState returns the content of the lists of network.policies: the masks of the entries each
+// command, uid and gid selects, and the CIDRs of each entry, keyed with its tag.
+func entryState(entries []config.PolicyEntryConfig) (mapState, error) {
+	state := mapState{}
+	for i, entry := range entries {
+		tag := policy.EntryTag(i)
+		if err := state.setProtocolCIDRs(entry.CIDR.Allow, tag, ALLOWED_V4_ENTRY_CIDR_LIST_MAP_NAME, ALLOWED_V6_ENTRY_CIDR_LIST_MAP_NAME); err != nil {
+			return nil, errkind.Errorf(errkind.Config, "%s.cidr.allow: %w", entry.Key(), err)
+		}
+		if err := state.setProtocolCIDRs(entry.CIDR.Deny, tag, DENIED_V4_ENTRY_CIDR_LIST_MAP_NAME, DENIED_V6_ENTRY_CIDR_LIST_MAP_NAME); err != nil {
+			return nil, errkind.Errorf(errkind.Config, "%s.cidr.deny: %w", entry.Key(), err)
+		}
+	}
+
+	_, commands, uids, gids := policy.EntryMasks(entries)
+	for command, mask := range commands {
+		state.set(POLICY_ENTRY_COMMAND_LIST_MAP_NAME, byteToKey([]byte(command)), maskValue(mask))
+	}
+	for uid, mask := range uids {
+		state.set(POLICY_ENTRY_UID_LIST_MAP_NAME, uintToKey(uint(uid)), maskValue(mask))
+	}
+	for gid, mask := range gids {
+		state.set(POLICY_ENTRY_GID_LIST_MAP_NAME, uintToKey(uint(gid)), maskValue(mask))
+	}
+	return state, nil
+}
+
+// maskValue is the value of the selector lists of network.policies, a mask of the entries.
+func maskValue(mask uint64) []byte {
+	value := make([]byte, 8)
+	binary.LittleEndian.PutUint64(value, mask)
+	return value
+}
+
+// entryNames returns the names of the entries of network.policies, which the maps do not have.
+func entryNames(entries []config.PolicyEntryConfig) []string {
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name)
+	}
+	return names
+}
+
+// ApplyError is a write of applyState that failed, after which the writes made before it
+// were undone.
+type ApplyError struct {
+	Map string
+	// Key is the key as the logs show it, see describeKey.
+	Key string
+	Err error
+	// Undo is the error of the first undo that failed, nil if the previous policy was restored.
+	Undo error
+}
+
+func (e *ApplyError) Error() string {
+	if e.Undo != nil {
+		return fmt.Sprintf("%s: key %s: %s, and undoing the writes before it failed, the maps are left with part of the policy: %s", e.Map, e.Key, e.Err, e.Undo)
+	}
+	return fmt.Sprintf("%s: key %s: %s, the previous policy is still in effect", e.Map, e.Key, e.Err)
+}
+
+func (e *ApplyError) Unwrap() error {
+	return e.Err
+}
+
+// applyState writes the difference between desired and what the previous calls have written,
+// as one transaction: the writes are planned in full before the first one is made, and when a
+// write fails, the ones made before it are undone in the reverse order, so the maps are left
+// with the previous policy and the error, an *ApplyError, names the map and the key.
+//
+// The config map is written last, so the list sizes it holds switch to the new policy in one
+// update once every entry they count is written.
+func (m *Manager) applyState(desired mapState) error {
+	return m.applyStateIn(nil, desired)
+}
+
+// applyStateIn is applyState with the writes to each map added up as a phase of span.
+func (m *Manager) applyStateIn(span *timing.Span, desired mapState) error {
+	m.loadedMu.Lock()
+	defer m.loadedMu.Unlock()
+
+	if m.loaded == nil {
+		m.loaded = mapState{}
+	}
+
+	// The maps are looked up before the first write, so a missing map fails with nothing written.
+	ops := diffState(m.loaded, desired)
+	tables := map[string]policyMap{}
+	for _, op := range ops {
+		if _, ok := tables[op.mapName]; ok {
+			continue
+		}
+		table, err := m.policyMap(op.mapName)
+		if err != nil {
+			return err
+		}
+		tables[op.mapName] = table
+	}
+
+	// undo are the writes that restore what the applied ops replaced, latest first.
+	undo := []undoOp{}
+	for _, op := range ops {
+		revert := undoOp{op: mapOp{mapName: op.mapName, key: op.key}}
+		if previous, ok := m.loaded[op.mapName][string(op.key)]; ok {
+			revert.op.value = previous
+		}
+
+		written, err := m.writeOp(span, tables[op.mapName], op)
+		if err != nil {
+			return &ApplyError{Map: op.mapName, Key: describeKey(op.mapName, op.key), Err: err, Undo: m.undo(tables, undo)}
+		}
+		revert.forgotten = !written
+		undo = append([]undoOp{revert}, undo...)
+	}
+
+	return nil
+}
+
+// undoOp restores a key applyState wrote. A key that was only forgotten, since the map still
+// has it, is recorded again without a write.
+type undoOp struct {
+	op        mapOp
+	forgotten bool
+}
+
+// writeOp writes op to table and records it in loaded, and reports whether the map was written:
+// a CIDR removed from the config stays if another owner has it, see ownedElsewhere, and is only
+// forgotten.
+func (m *Manager) writeOp(span *timing.Span, table policyMap, op mapOp) (bool, error) {
+	if op.isDelete() {
+		if m.ownedElsewhere(op.mapName, op.key) {
+			m.loaded.delete(op.mapName, op.key)
+			return false, nil
+		}
+		if err := span.Measure(op.mapName, func() error { return table.DeleteKey(op.key) }); err != nil {
+			return false, err
+		}
+		m.loaded.delete(op.mapName, op.key)
+	} else {
+		if err := span.Measure(op.mapName, func() error { return table.Update(op.key, op.value) }); err != nil {
+			return false, err
+		}
+		m.loaded.set(op.mapName, op.key, op.value)
+	}
+	m.mirror(op)
+	return true, nil
+}
+
+// undo makes the undo ops of a failed applyState. It returns the error of the first write that
+// fails, after trying the others.
+func (m *Manager) undo(tables map[string]policyMap, undo []undoOp) error {
+	var failed error
+	for _, u := range undo {
+		if u.forgotten {
+			m.loaded.set(u.op.mapName, u.op.key, u.op.value)
+			continue
+		}
+		if _, err := m.writeOp(nil, tables[u.op.mapName], u.op); err != nil && failed == nil {
+			failed = fmt.Errorf("%s: key %s: %w", u.op.mapName, describeKey(u.op.mapName, u.op.key), err)
+		}
+	}
+	return failed
+}
+
+// presentState returns the entries the policy maps have, read from the maps. A backend that can
+// not list the entries of its maps has none.
+func (m *Manager) presentState() (mapState, error) {
+	state := mapState{}
+	if _, ok := m.backend.(entryLister); m.backend != nil && !ok {
+		return state, nil
+	}
+	for _, mapName := range policyMapOrder {
+		entries, err := m.mapEntries(mapName)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", mapName, err)
+		}
+		for key, value := range entries {
+			state.set(mapName, []byte(key), value)
+		}
+	}
+	return state, nil
+}
+
+// ownedElsewhere reports whether an owner of the keys of the policy maps other than the config
+// has key in mapName: a rule set, the self exemption, a runtime rule, live resolution or a
+// wildcard domain. The config only owns the keys no other owner has, and leaves the others in the
+// maps when it drops them.
+func (m *Manager) ownedElsewhere(mapName string, key []byte) bool {
+	return m.inRuleSet(mapName, key, nil) || m.selfExempted(mapName, key) || m.runtimeRule(mapName, key) || m.resolvedAddress(mapName, key) || m.wildcardAddress(mapName, key)
+}
+
+// reconcileConfigIn writes the rules of the config to the maps as applyConfigIn does, but against
+// the entries the maps have rather than the ones applyState wrote. The config owns the entries
+// the maps have that no other owner has, see ownedElsewhere: the ones no rule of the config has
+// are deleted, and the missing ones are written. The entries of the other owners are left to them.
+// In the maps the other owners write to, see sharedMap, an entry that neither the config wrote nor
+// an owner has yet may be one an owner has not written again since the startup, e.g. the address
+// of a domain, so it is left as unclaimed for sweepUnclaimed rather than deleted.
+// The entries the maps have are mirrored in the Policy first, so that it is what the programs
+// enforce at every step; the ones applyState wrote already are.
+func (m *Manager) reconcileConfigIn(span *timing.Span) error {
+	present, err := m.presentState()
+	if err != nil {
+		return err
+	}
+	desired, err := m.desiredState()
+	if err != nil {
+		return err
+	}
+
+	owned, unclaimed := mapState{}, mapState{}
+	m.loadedMu.Lock()
+	for _, mapName := range policyMapOrder {
+		for _, key := range sortedKeys(present[mapName]) {
+			value := present[mapName][key]
+			written, loaded := m.loaded[mapName][key]
+			if !loaded || !bytes.Equal(written, value) {
+				m.mirror(mapOp{mapName: mapName, key: []byte(key), value: value})
+			}
+			if m.ownedElsewhere(mapName, []byte(key)) {
+				continue
+			}
+			if _, ok := desired[mapName][key]; !ok && !loaded && sharedMap(mapName) {
+				unclaimed.set(mapName, []byte(key), value)
+				continue
+			}
+			owned.set(mapName, []byte(key), value)
+		}
+	}
+	m.loaded = owned
+	m.unclaimed = unclaimed
+	m.loadedMu.Unlock()
+
+	return m.applyStateIn(span, desired)
+}
+
+// applyConfig writes the rules of the config to the maps.
+func (m *Manager) applyConfig() error {
+	return m.applyConfigIn(nil)
+}
+
+// applyConfigIn is applyConfig timed in span, see applyStateIn.
+func (m *Manager) applyConfigIn(span *timing.Span) error {
+	desired, err := m.desiredState()
+	if err != nil {
+		return err
+	}
+	return m.applyStateIn(span, desired)
+}
+
+// mirror records a successful write in the Policy.
+func (m *Manager) mirror(op mapOp) {
+	policy := m.Policy()
+
+	// The shards of a deny list are mirrored with it.
+	mapName := op.mapName
+	if base, ok := denyShardBase(mapName); ok {
+		mapName = base
+	}
+
+	switch mapName {
+	case RESTRICT_NETWORK_CONFIG_MAP_NAME:
+		if op.isDelete() {
+			return
+		}
+		policy.setModeAndTarget(
+			binary.LittleEndian.Uint32(op.value[MAP_MODE_START:MAP_MODE_END]),
+			binary.LittleEndian.Uint32(op.value[MAP_TARGET_START:MAP_TARGET_END]),
+		)
+		policy.setCommandCaseInsensitive(binary.LittleEndian.Uint32(op.value[MAP_COMMAND_CASE_INSENSITIVE_INDEX:MAP_COMMAND_CASE_INSENSITIVE_INDEX+4]) == 1)
+		policy.setListSizes(DecodeListSizes(op.value))
+		policy.setFamilies(DecodeFamilies(op.value))
+		policy.setDefaultAndPrecedence(DecodeDefaultAndPrecedence(op.value))
+		policy.SetPolicyEntries(DecodePolicyEntries(op.value), entryNames(m.config.RestrictedNetworkConfig.PolicyEntries()))
+	case ALLOWED_V4_CIDR_LIST_MAP_NAME, ALLOWED_V6_CIDR_LIST_MAP_NAME, DENIED_V4_CIDR_LIST_MAP_NAME, DENIED_V6_CIDR_LIST_MAP_NAME:
+		if op.isDelete() {
+			if !m.deniedElsewhere(op.mapName, op.key) {
+				policy.deleteCIDR(mapName, PROTOCOL_ALL, keyToIPNet(op.key))
+				policy.setExcept(keyToIPNet(op.key), false)
+				policy.setMonitored(keyToIPNet(op.key), false)
+			}
+			return
+		}
+		policy.addCIDR(mapName, PROTOCOL_ALL, keyToIPNet(op.key))
+		if mapName == DENIED_V4_CIDR_LIST_MAP_NAME || mapName == DENIED_V6_CIDR_LIST_MAP_NAME {
+			policy.setExcept(keyToIPNet(op.key), bytes.Equal(op.value, exceptValue()))
+			policy.setMonitored(keyToIPNet(op.key), bytes.Equal(op.value, monitorValue()))
+		}
+		// Preloaded addresses that are also configured must not expire.
+		m.preload.confirm(op.mapName, op.key)
+	case ALLOWED_V4_PROTOCOL_CIDR_LIST_MAP_NAME, ALLOWED_V6_PROTOCOL_CIDR_LIST_MAP_NAME, DENIED_V4_PROTOCOL_CIDR_LIST_MAP_NAME, DENIED_V6_PROTOCOL_CIDR_LIST_MAP_NAME:
+		protocol, n := protocolKeyToIPNet(op.key)
+		if op.isDelete() {
+			policy.deleteCIDR(mapName, protocol, n)
+			return
+		}
+		policy.addCIDR(mapName, protocol, n)
+	case ALLOWED_V4_ENTRY_CIDR_LIST_MAP_NAME, ALLOWED_V6_ENTRY_CIDR_LIST_MAP_NAME, DENIED_V4_ENTRY_CIDR_LIST_MAP_NAME, DENIED_V6_ENTRY_CIDR_LIST_MAP_NAME:
+		tag, n := protocolKeyToIPNet(op.key)
+		if op.isDelete() {
+			policy.deleteCIDR(mapName, tag, n)
+			return
+		}
+		policy.addCIDR(mapName, tag, n)
+	case POLICY_ENTRY_COMMAND_LIST_MAP_NAME:
+		var mask uint64
+		if !op.isDelete() {
+			mask = binary.LittleEndian.Uint64(op.value)
+		}
+		policy.SetEntryCommand(string(bytes.TrimRight(op.key, "\x00")), mask)
+	case POLICY_ENTRY_UID_LIST_MAP_NAME, POLICY_ENTRY_GID_LIST_MAP_NAME:
+		var mask uint64
+		if !op.isDelete() {
+			mask = binary.LittleEndian.Uint64(op.value)
+		}
+		policy.setEntryID(op.mapName, binary.LittleEndian.Uint32(op.key), mask)
+	case INGRESS_ALLOWED_V4_CIDR_LIST_MAP_NAME, INGRESS_ALLOWED_V6_CIDR_LIST_MAP_NAME, INGRESS_DENIED_V4_CIDR_LIST_MAP_NAME, INGRESS_DENIED_V6_CIDR_LIST_MAP_NAME:
+		if op.isDelete() {
+			policy.deleteCIDR(mapName, PROTOCOL_ALL, keyToIPNet(op.key))
+			return
+		}
+		policy.addCIDR(mapName, PROTOCOL_ALL, keyToIPNet(op.key))
+	case CONTAINER_CGROUP_LIST_MAP_NAME:
+		// Not mirrored: the callers of Policy.Evaluate tell whether a connection is in a container.
+		return
+	case ALLOWED_COMMAND_LIST_MAP_NAME, DENIED_COMMAND_LIST_MAP_NAME:
+		command := string(bytes.TrimRight(op.key, "\x00"))
+		if op.isDelete() {
+			policy.deleteCommand(op.mapName, command)
+			if op.mapName == DENIED_COMMAND_LIST_MAP_NAME {
+				policy.setMonitoredCommand(command, false)
+			}
+			return
+		}
+		policy.addCommand(op.mapName, command)
+		if op.mapName == DENIED_COMMAND_LIST_MAP_NAME {
+			policy.setMonitoredCommand(command, bytes.Equal(op.value, monitorCommandValue()))
+		}
+	case ALLOWED_PATH_LIST_MAP_NAME, DENIED_PATH_LIST_MAP_NAME:
+		if op.isDelete() {
+			policy.deletePath(op.mapName, keyToPath(op.key))
+			return
+		}
+		policy.addPath(op.mapName, keyToPath(op.key))
+	case ALLOWED_COMMAND_PATTERN_LIST_MAP_NAME, DENIED_COMMAND_PATTERN_LIST_MAP_NAME:
+		index := binary.LittleEndian.Uint32(op.key)
+		if op.isDelete() {
+			policy.deleteCommandPattern(op.mapName, index)
+			return
+		}
+		policy.setCommandPattern(op.mapName, index, valueToCommandPattern(op.value))
+	case ALLOWED_PORT_LIST_MAP_NAME, DENIED_PORT_LIST_MAP_NAME, INGRESS_ALLOWED_PORT_LIST_MAP_NAME, INGRESS_DENIED_PORT_LIST_MAP_NAME:
+		if op.isDelete() {
+			policy.deletePort(op.mapName, keyToPortPrefix(op.key))
+			return
+		}
+		policy.addPort(op.mapName, keyToPortPrefix(op.key))
+	case ALLOWED_UID_RANGE_LIST_MAP_NAME, DENIED_UID_RANGE_LIST_MAP_NAME:
+		if op.isDelete() {
+			policy.deleteUIDPrefix(op.mapName, keyToUIDPrefix(op.key))
+			return
+		}
+		policy.addUIDPrefix(op.mapName, keyToUIDPrefix(op.key))
+	default:
+		id := uint(binary.LittleEndian.Uint32(op.key))
+		if op.isDelete() {
+			policy.deleteID(op.mapName, id)
+			return
+		}
+		policy.addID(op.mapName, id)
+	}
+}
+
+// policyMap returns mapName, whose writes are recorded in the ledger of the Manager.
+func (m *Manager) policyMap(mapName string) (policyMap, error) {
+	var table policyMap
+	switch {
+	case m.backend != nil:
+		backend := backendMap{backend: m.backend, name: mapName}
+		table = backend
+		if reader, ok := m.backend.(MapReader); ok {
+			table = readableBackendMap{backendMap: backend, reader: reader}
+		}
+	case m.mod == nil:
+		return nil, ErrNoProgram
+	default:
+		bpfMap, err := m.mod.GetMap(mapName)
+		if err != nil {
+			return nil, err
+		}
+		table = bpfPolicyMap{bpfMap: bpfMap}
+	}
+	return recordedMap{table: table, ledger: &m.ledger, name: mapName}, nil
+}
@@ -0,0 +1,831 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/mrtc0/bouheki/pkg/bouhekitest"
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/policy"
+	"github.com/stretchr/testify/assert"
+)
+
+func cidrKey(t *testing.T, cidr string) []byte {
+	addr, err := cidrToBPFMapKey(cidr)
+	assert.Nil(t, err)
+	return addr.key
+}
+
+func stateTestConfig() *config.Config {
+	conf := config.DefaultConfig()
+	conf.RestrictedNetworkConfig.Mode = "block"
+	conf.RestrictedNetworkConfig.CIDR.Allow = []string{"10.0.0.0/8", "10.1.2.3/8", "2001:db8::/32"}
+	conf.RestrictedNetworkConfig.CIDR.Deny = []string{"192.168.1.1/32"}
+	conf.RestrictedNetworkConfig.Command.Allow = []string{"curl", "curl"}
+	conf.RestrictedNetworkConfig.Command.Deny = []string{"wget"}
+	conf.RestrictedNetworkConfig.UID.Allow = []string{"1000"}
+	conf.RestrictedNetworkConfig.GID.Allow = []string{"100"}
+	return conf
+}
+
+func TestSetConfigToMapIsIdempotent(t *testing.T) {
+	maps := bouhekitest.NewMaps()
+	mgr := Manager{config: stateTestConfig(), backend: maps}
+
+	assert.Nil(t, mgr.SetConfigToMap())
+	// 10.1.2.3/8 and the second curl normalize to the keys of the first rules.
+	assert.Len(t, maps.Writes(), 8)
+	assert.Equal(t, 8, maps.Len())
+	generation, _ := mgr.Policy().Generation()
+
+	assert.Nil(t, mgr.SetConfigToMap())
+	assert.Len(t, maps.Writes(), 8)
+	again, _ := mgr.Policy().Generation()
+	assert.Equal(t, generation, again)
+}
+
+func TestSetConfigToMapUndoesAFailedApplication(t *testing.T) {
+	conf := stateTestConfig()
+
+	want := bouhekitest.NewMaps()
+	assert.Nil(t, (&Manager{config: conf, backend: want}).SetConfigToMap())
+
+	for failAt := 1; failAt <= len(want.Writes()); failAt++ {
+		maps := bouhekitest.NewMaps()
+		maps.FailAt(failAt)
+		mgr := Manager{config: conf, backend: maps}
+
+		err := mgr.SetConfigToMap()
+		assert.ErrorIs(t, err, bouhekitest.ErrInjected)
+		failed := &ApplyError{}
+		assert.ErrorAs(t, err, &failed)
+		assert.Equal(t, want.Writes()[failAt-1].Map, failed.Map)
+		assert.Nil(t, failed.Undo)
+		assert.Contains(t, err.Error(), "the previous policy is still in effect")
+		// The writes before the failed one are undone.
+		assert.Equal(t, 0, maps.Len())
+		assert.Equal(t, 2*(failAt-1), len(maps.Writes()))
+		assert.False(t, mgr.Policy().Evaluate(Connection{Addr: net.ParseIP("192.168.1.1"), Command: "curl", UID: 1000, GID: 100}).DenyListed)
+
+		assert.Nil(t, mgr.SetConfigToMap())
+		for _, w := range want.Writes() {
+			assert.Equal(t, want.Entries(w.Map), maps.Entries(w.Map))
+		}
+	}
+}
+
+func TestApplyStateKeepsThePreviousPolicyWhenAMapIsFull(t *testing.T) {
+	conf := stateTestConfig()
+	maps := bouhekitest.NewMaps()
+	mgr := Manager{config: conf, backend: maps}
+	assert.Nil(t, mgr.SetConfigToMap())
+	before := map[string]map[string][]byte{}
+	for _, mapName := range policyMapOrder {
+		before[mapName] = maps.Entries(mapName)
+	}
+
+	next := stateTestConfig()
+	next.RestrictedNetworkConfig.CIDR.Allow = []string{"172.16.0.0/12"}
+	next.RestrictedNetworkConfig.CIDR.Deny = []string{"192.168.1.1/32", "192.168.2.0/24", "192.168.3.0/24"}
+	next.RestrictedNetworkConfig.Command.Deny = nil
+	maps.Limit(DENIED_V4_CIDR_LIST_MAP_NAME, 2)
+
+	err := mgr.replaceConfig(next)
+	assert.ErrorIs(t, err, bouhekitest.ErrMapFull)
+	assert.EqualError(t, err, fmt.Sprintf("%s: key 192.168.3.0/24: %s, the previous policy is still in effect", DENIED_V4_CIDR_LIST_MAP_NAME, bouhekitest.ErrMapFull))
+	for _, mapName := range policyMapOrder {
+		assert.Equal(t, before[mapName], maps.Entries(mapName), mapName)
+	}
+	assert.Equal(t, conf, mgr.currentConfig())
+
+	policy := mgr.Policy()
+	assert.False(t, policy.Evaluate(Connection{Addr: net.ParseIP("10.0.0.1"), Command: "curl", UID: 1000, GID: 100}).Denied)
+	assert.True(t, policy.Evaluate(Connection{Addr: net.ParseIP("172.16.0.1"), Command: "curl", UID: 1000, GID: 100}).Denied)
+	assert.False(t, policy.Evaluate(Connection{Addr: net.ParseIP("192.168.2.1"), Command: "curl", UID: 1000, GID: 100}).DenyListed)
+	assert.True(t, policy.Evaluate(Connection{Addr: net.ParseIP("10.0.0.1"), Command: "wget", UID: 1000, GID: 100}).Denied)
+}
+
+func TestApplyErrorNamesAFailedUndo(t *testing.T) {
+	maps := bouhekitest.NewMaps()
+	mgr := Manager{config: stateTestConfig(), backend: maps}
+	// The third write fails, and so does the undo of the second.
+	failures := 0
+	maps.OnWrite(func(w bouhekitest.Write) {
+		failures++
+		if failures == 3 {
+			maps.FailAt(len(maps.Writes()) + 1)
+		}
+		if failures == 4 {
+			maps.FailAt(len(maps.Writes()) + 1)
+		}
+	})
+
+	err := mgr.SetConfigToMap()
+	failed := &ApplyError{}
+	assert.ErrorAs(t, err, &failed)
+	assert.Equal(t, DENIED_V4_CIDR_LIST_MAP_NAME, failed.Map)
+	assert.ErrorIs(t, failed.Undo, bouhekitest.ErrInjected)
+	assert.Contains(t, err.Error(), "the maps are left with part of the policy: "+ALLOWED_V6_CIDR_LIST_MAP_NAME+": key 2001:db8::/32")
+}
+
+func TestSetConfigToMapDeletesTheKeysOfNoRule(t *testing.T) {
+	// The maps have keys no owner has, some of which the config has too.
+	maps := bouhekitest.NewMaps()
+	stale := []bouhekitest.Write{
+		{Map: ALLOWED_V4_CIDR_LIST_MAP_NAME, Key: cidrKey(t, "10.0.0.0/8"), Value: entryValue()},
+		{Map: ALLOWED_V4_CIDR_LIST_MAP_NAME, Key: cidrKey(t, "172.16.0.0/12"), Value: entryValue()},
+		{Map: DENIED_V6_CIDR_LIST_MAP_NAME, Key: cidrKey(t, "2001:db8:1::/48"), Value: entryValue()},
+		{Map: DENIED_COMMAND_LIST_MAP_NAME, Key: byteToKey([]byte("nc")), Value: entryValue()},
+		{Map: ALLOWED_UID_LIST_MAP_NAME, Key: uintToKey(0), Value: entryValue()},
+		{Map: DENIED_GID_LIST_MAP_NAME, Key: uintToKey(27), Value: entryValue()},
+	}
+	for _, w := range stale {
+		assert.Nil(t, maps.Update(w.Map, w.Key, w.Value))
+	}
+	maps.ClearWrites()
+
+	conf := stateTestConfig()
+	mgr := Manager{config: conf, backend: maps}
+	assert.Nil(t, mgr.SetConfigToMap())
+
+	// 10.0.0.0/8 was already written, the keys of the lists only the config writes are deleted.
+	want := bouhekitest.NewMaps()
+	assert.Nil(t, (&Manager{config: conf, backend: want}).SetConfigToMap())
+	assert.Equal(t, len(want.Writes())-1+3, len(maps.Writes()))
+
+	// The CIDRs are left until the sweep, an owner other than the config could write them again.
+	policy := mgr.Policy()
+	assert.False(t, policy.Evaluate(Connection{Addr: net.ParseIP("172.16.0.1"), Command: "curl", UID: 1000, GID: 100}).Denied)
+	swept, err := mgr.sweepUnclaimed()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, swept)
+
+	// The maps have the keys of the config, and only those, as if they had been empty.
+	for _, mapName := range policyMapOrder {
+		assert.Equal(t, want.Entries(mapName), maps.Entries(mapName), mapName)
+	}
+	assert.Equal(t, len(want.Writes())-1+5, len(maps.Writes()))
+
+	policy = mgr.Policy()
+	assert.True(t, policy.Evaluate(Connection{Addr: net.ParseIP("172.16.0.1"), Command: "curl", UID: 1000, GID: 100}).Denied)
+	assert.False(t, policy.Evaluate(Connection{Addr: net.ParseIP("2001:db8:1::1"), Command: "curl", UID: 1000, GID: 100}).Denied)
+	assert.False(t, policy.Evaluate(Connection{Addr: net.ParseIP("10.0.0.1"), Command: "nc", UID: 1000, GID: 27}).DenyListed)
+	assert.True(t, policy.Evaluate(Connection{Addr: net.ParseIP("10.0.0.1"), Command: "curl", UID: 0, GID: 100}).Denied)
+}
+
+func TestSetConfigToMapLeavesTheKeysOfOtherOwners(t *testing.T) {
+	maps := bouhekitest.NewMaps()
+	exempted := cidrKey(t, "192.0.2.53/32")
+	assert.Nil(t, maps.Update(ALLOWED_V4_CIDR_LIST_MAP_NAME, exempted, entryValue()))
+	assert.Nil(t, maps.Update(ALLOWED_V4_CIDR_LIST_MAP_NAME, cidrKey(t, "198.51.100.0/24"), entryValue()))
+
+	// The self exemption owns one of the keys, which no rule of the config has.
+	mgr := Manager{config: stateTestConfig(), backend: maps}
+	mgr.self.installed = mapState{}
+	mgr.self.installed.set(ALLOWED_V4_CIDR_LIST_MAP_NAME, exempted, entryValue())
+	assert.Nil(t, mgr.reconcileConfigIn(nil))
+	_, err := mgr.sweepUnclaimed()
+	assert.Nil(t, err)
+
+	entries := maps.Entries(ALLOWED_V4_CIDR_LIST_MAP_NAME)
+	assert.Contains(t, entries, string(exempted))
+	assert.NotContains(t, entries, string(cidrKey(t, "198.51.100.0/24")))
+	assert.False(t, mgr.configured(ALLOWED_V4_CIDR_LIST_MAP_NAME, exempted))
+	assert.False(t, mgr.Policy().Evaluate(Connection{Addr: net.ParseIP("192.0.2.53"), Command: "curl", UID: 1000, GID: 100}).Denied)
+}
+
+func TestSetConfigToMapLeavesTheEntriesOfOwnersThatWriteLater(t *testing.T) {
+	dir := t.TempDir()
+	conf := config.DefaultConfig()
+	conf.RestrictedNetworkConfig.Mode = "block"
+	conf.RestrictedNetworkConfig.Domain.Allow = []string{"example.com"}
+	conf.DNSProxyConfig.Enable = true
+	conf.RestrictedNetworkConfig.RuleSets.ChunkDelay = 0
+	conf.RestrictedNetworkConfig.RuleSets.StateDir = dir
+	conf.RestrictedNetworkConfig.RuleSets.Sets = []config.RuleSetConfig{
+		{Name: "geoip-xx", List: config.RULE_SET_LIST_DENY, File: filepath.Join(dir, "geoip-xx.txt")},
+	}
+	writeRuleSetFile(t, filepath.Join(dir, "geoip-xx.txt"), prefixes(0, 4))
+
+	// The adopted maps have the entries of a rule set whose progress was lost, the address of a
+	// domain the DNS proxy has not relayed yet, and an entry no owner writes again.
+	maps := bouhekitest.NewMaps()
+	kept := []bouhekitest.Write{{Map: ALLOWED_V6_CIDR_LIST_MAP_NAME, Key: cidrKey(t, "2001:db8::1/128"), Value: entryValue()}}
+	for _, cidr := range prefixes(0, 4) {
+		kept = append(kept, bouhekitest.Write{Map: DENIED_V4_CIDR_LIST_MAP_NAME, Key: cidrKey(t, cidr), Value: entryValue()})
+	}
+	stale := cidrKey(t, "198.51.100.0/24")
+	for _, w := range append(kept, bouhekitest.Write{Map: ALLOWED_V4_CIDR_LIST_MAP_NAME, Key: stale, Value: entryValue()}) {
+		assert.Nil(t, maps.Update(w.Map, w.Key, w.Value))
+	}
+	maps.ClearWrites()
+
+	mgr := &Manager{config: conf, backend: maps}
+	defer mgr.Jobs().Stop()
+	assert.Nil(t, mgr.SetConfigToMap())
+	assert.True(t, mgr.Policy().Evaluate(Connection{Addr: net.ParseIP("10.0.0.1"), Command: "curl"}).Denied)
+	assert.False(t, mgr.Policy().Evaluate(Connection{Addr: net.ParseIP("2001:db8::1"), Command: "curl"}).Denied)
+
+	// The owners write their entries again, and the sweep only deletes the one they do not have.
+	assert.Nil(t, mgr.refreshRuleSet(context.Background(), mgr.ruleSets[0]))
+	assert.Nil(t, mgr.updateAllowedFQDNist(&DNSAnswer{Domain: "example.com", Addresses: []net.IP{net.ParseIP("2001:db8::1")}, TTL: 300}))
+	swept, err := mgr.sweepUnclaimed()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, swept)
+	assert.False(t, maps.Has(ALLOWED_V4_CIDR_LIST_MAP_NAME, stale))
+
+	for _, w := range maps.Writes() {
+		for _, k := range kept {
+			assert.False(t, w.IsDelete() && w.Map == k.Map && string(w.Key) == string(k.Key), "%s: %v deleted", w.Map, w.Key)
+		}
+	}
+	for _, k := range kept {
+		assert.True(t, maps.Has(k.Map, k.Key), k.Map)
+	}
+}
+
+func TestApplyStateOrder(t *testing.T) {
+	maps := bouhekitest.NewMaps()
+	mgr := Manager{config: stateTestConfig(), backend: maps}
+	assert.Nil(t, mgr.SetConfigToMap())
+
+	names := []string{}
+	for _, op := range maps.Writes() {
+		names = append(names, op.Map)
+	}
+	assert.Equal(t, []string{
+		ALLOWED_V4_CIDR_LIST_MAP_NAME,
+		ALLOWED_V6_CIDR_LIST_MAP_NAME,
+		DENIED_V4_CIDR_LIST_MAP_NAME,
+		ALLOWED_COMMAND_LIST_MAP_NAME,
+		DENIED_COMMAND_LIST_MAP_NAME,
+		ALLOWED_UID_LIST_MAP_NAME,
+		ALLOWED_GID_LIST_MAP_NAME,
+		RESTRICT_NETWORK_CONFIG_MAP_NAME,
+	}, names)
+}
+
+func TestApplyStateRemovesStaleEntries(t *testing.T) {
+	conf := stateTestConfig()
+	maps := bouhekitest.NewMaps()
+	mgr := Manager{config: conf, backend: maps}
+	assert.Nil(t, mgr.SetConfigToMap())
+
+	conf.RestrictedNetworkConfig.CIDR.Allow = []string{"10.0.0.0/8", "172.16.0.0/12"}
+	conf.RestrictedNetworkConfig.Command.Deny = nil
+	maps.ClearWrites()
+	assert.Nil(t, mgr.SetConfigToMap())
+
+	assert.Equal(t, []bouhekitest.Write{
+		{Map: ALLOWED_V4_CIDR_LIST_MAP_NAME, Key: cidrKey(t, "172.16.0.0/12"), Value: entryValue()},
+		// The size of the deny list is 0 before its entries are deleted.
+		{Map: RESTRICT_NETWORK_CONFIG_MAP_NAME, Key: []byte{0}, Value: mgr.configMapValue()},
+		{Map: DENIED_COMMAND_LIST_MAP_NAME, Key: byteToKey([]byte("wget"))},
+		{Map: ALLOWED_V6_CIDR_LIST_MAP_NAME, Key: cidrKey(t, "2001:db8::/32")},
+	}, maps.Writes())
+
+	policy := mgr.Policy()
+	assert.False(t, policy.Evaluate(Connection{Addr: net.ParseIP("172.16.0.1"), Command: "curl", UID: 1000, GID: 100}).Denied)
+	assert.True(t, policy.Evaluate(Connection{Addr: net.ParseIP("2001:db8::1"), Command: "curl", UID: 1000, GID: 100}).Denied)
+	assert.False(t, policy.hasCIDR(ALLOWED_V6_CIDR_LIST_MAP_NAME, PROTOCOL_ALL, &net.IPNet{IP: net.ParseIP("2001:db8::"), Mask: net.CIDRMask(32, 128)}))
+}
+
+func TestApplyStateRewritesConfigMap(t *testing.T) {
+	conf := stateTestConfig()
+	maps := bouhekitest.NewMaps()
+	mgr := Manager{config: conf, backend: maps}
+	assert.Nil(t, mgr.SetConfigToMap())
+
+	maps.ClearWrites()
+	mgr.setEnforcement(ENFORCEMENT_KPROBE_MONITOR)
+	assert.Nil(t, mgr.applyConfig())
+
+	assert.Len(t, maps.Writes(), 1)
+	assert.Equal(t, RESTRICT_NETWORK_CONFIG_MAP_NAME, maps.Writes()[0].Map)
+	assert.False(t, mgr.Policy().Evaluate(Connection{Addr: net.ParseIP("192.168.1.1"), Command: "curl", UID: 1000, GID: 100}).Blocked)
+}
+
+func TestDiffState(t *testing.T) {
+	loaded := mapState{}
+	loaded.set(DENIED_UID_LIST_MAP_NAME, uintToKey(1), entryValue())
+	loaded.set(ALLOWED_UID_LIST_MAP_NAME, uintToKey(2), entryValue())
+	loaded.set(RESTRICT_NETWORK_CONFIG_MAP_NAME, []byte{0}, []byte{1})
+
+	desired := mapState{}
+	desired.set(ALLOWED_UID_LIST_MAP_NAME, uintToKey(3), entryValue())
+	desired.set(ALLOWED_UID_LIST_MAP_NAME, uintToKey(2), entryValue())
+	desired.set(ALLOWED_COMMAND_LIST_MAP_NAME, byteToKey([]byte("curl")), entryValue())
+	desired.set(RESTRICT_NETWORK_CONFIG_MAP_NAME, []byte{0}, []byte{2})
+
+	assert.Equal(t, []mapOp{
+		{mapName: ALLOWED_COMMAND_LIST_MAP_NAME, key: byteToKey([]byte("curl")), value: entryValue()},
+		{mapName: ALLOWED_UID_LIST_MAP_NAME, key: uintToKey(3), value: entryValue()},
+		{mapName: RESTRICT_NETWORK_CONFIG_MAP_NAME, key: []byte{0}, value: []byte{2}},
+		{mapName: DENIED_UID_LIST_MAP_NAME, key: uintToKey(1)},
+	}, diffState(loaded, desired))
+
+	assert.Empty(t, diffState(desired, desired))
+}
+
+func TestListsAbsentEmptyAndPopulated(t *testing.T) {
+	listed := Connection{Addr: net.ParseIP("10.0.0.1"), Port: 443, Command: "curl", UID: 1000, GID: 100}
+	unlisted := Connection{Addr: net.ParseIP("10.0.0.1"), Port: 8080, Command: "wget", UID: 2000, GID: 200}
+	// swapped has the uid and the gid of listed the other way around: a list of uids must not
+	// match it by its gid, nor a list of gids by its uid.
+	swapped := Connection{Addr: net.ParseIP("10.0.0.1"), Port: 8080, Command: "wget", UID: 100, GID: 1000}
+
+	tests := []struct {
+		list string
+		set  func(conf *config.RestrictedNetworkConfig, populated bool)
+		// mapName is the only map the populated list writes to, besides the config map.
+		mapName string
+		// sizes are the sizes of the populated list.
+		sizes          ListSizes
+		listedDenied   bool
+		unlistedDenied bool
+	}{
+		{
+			list:           "command.allow",
+			set:            func(c *config.RestrictedNetworkConfig, p bool) { c.Command.Allow = commands(p, "curl") },
+			mapName:        ALLOWED_COMMAND_LIST_MAP_NAME,
+			sizes:          ListSizes{AllowCommand: 1},
+			unlistedDenied: true,
+		},
+		{
+			list:         "command.deny",
+			set:          func(c *config.RestrictedNetworkConfig, p bool) { c.Command.Deny = commands(p, "curl") },
+			mapName:      DENIED_COMMAND_LIST_MAP_NAME,
+			sizes:        ListSizes{DenyCommand: 1},
+			listedDenied: true,
+		},
+		{
+			list:           "uid.allow",
+			set:            func(c *config.RestrictedNetworkConfig, p bool) { c.UID.Allow = ids(p, "1000") },
+			mapName:        ALLOWED_UID_LIST_MAP_NAME,
+			sizes:          ListSizes{AllowUID: 1},
+			unlistedDenied: true,
+		},
+		{
+			list:         "uid.deny",
+			set:          func(c *config.RestrictedNetworkConfig, p bool) { c.UID.Deny = ids(p, "1000") },
+			mapName:      DENIED_UID_LIST_MAP_NAME,
+			sizes:        ListSizes{DenyUID: 1},
+			listedDenied: true,
+		},
+		{
+			list:           "gid.allow",
+			set:            func(c *config.RestrictedNetworkConfig, p bool) { c.GID.Allow = ids(p, "100") },
+			mapName:        ALLOWED_GID_LIST_MAP_NAME,
+			sizes:          ListSizes{AllowGID: 1},
+			unlistedDenied: true,
+		},
+		{
+			list:         "gid.deny",
+			set:          func(c *config.RestrictedNetworkConfig, p bool) { c.GID.Deny = ids(p, "100") },
+			mapName:      DENIED_GID_LIST_MAP_NAME,
+			sizes:        ListSizes{DenyGID: 1},
+			listedDenied: true,
+		},
+		{
+			list:           "ports.allow",
+			set:            func(c *config.RestrictedNetworkConfig, p bool) { c.Ports.Allow = commands(p, "443") },
+			mapName:        ALLOWED_PORT_LIST_MAP_NAME,
+			sizes:          ListSizes{AllowPort: 1},
+			unlistedDenied: true,
+		},
+		{
+			list:         "ports.deny",
+			set:          func(c *config.RestrictedNetworkConfig, p bool) { c.Ports.Deny = commands(p, "443") },
+			mapName:      DENIED_PORT_LIST_MAP_NAME,
+			sizes:        ListSizes{DenyPort: 1},
+			listedDenied: true,
+		},
+	}
+
+	for _, test := range tests {
+		values := map[string][]byte{}
+		for _, presence := range []string{"absent", "empty", "populated"} {
+			t.Run(test.list+" "+presence, func(t *testing.T) {
+				conf := config.DefaultConfig()
+				conf.RestrictedNetworkConfig.Mode = "block"
+				if presence != "absent" {
+					test.set(&conf.RestrictedNetworkConfig, presence == "populated")
+				}
+				maps := bouhekitest.NewMaps()
+				mgr := Manager{config: conf, backend: maps}
+				assert.Nil(t, mgr.SetConfigToMap())
+
+				value := maps.Entries(RESTRICT_NETWORK_CONFIG_MAP_NAME)[string([]byte{0})]
+				assert.Len(t, value, MAP_SIZE)
+				values[presence] = value
+
+				policy := mgr.Policy()
+				if presence != "populated" {
+					assert.Equal(t, ListSizes{}, DecodeListSizes(value))
+					assert.False(t, policy.Evaluate(listed).Denied)
+					assert.False(t, policy.Evaluate(unlisted).Denied)
+					return
+				}
+				assert.Equal(t, test.sizes, DecodeListSizes(value))
+				assert.Equal(t, []string{test.mapName}, writtenLists(maps))
+				assert.Equal(t, test.listedDenied, policy.Evaluate(listed).Denied)
+				assert.Equal(t, test.unlistedDenied, policy.Evaluate(unlisted).Denied)
+				assert.Equal(t, test.unlistedDenied, policy.Evaluate(swapped).Denied)
+			})
+		}
+		assert.Equal(t, values["absent"], values["empty"], test.list)
+	}
+}
+
+func TestAllowAndDenyListCombinations(t *testing.T) {
+	base := Connection{Addr: net.ParseIP("10.0.0.1"), Port: 443, Command: "curl", UID: 1000, GID: 100}
+
+	// Each list pair is set to an allowed and a denied value, and connected to with the allowed
+	// value, the denied value and a value of neither list.
+	tests := []struct {
+		lists string
+		set   func(conf *config.RestrictedNetworkConfig, allow, deny bool)
+		with  [3]func(c *Connection)
+	}{
+		{
+			lists: "command",
+			set: func(c *config.RestrictedNetworkConfig, allow, deny bool) {
+				c.Command.Allow, c.Command.Deny = commands(allow, "curl"), commands(deny, "nc")
+			},
+			with: [3]func(c *Connection){
+				func(c *Connection) { c.Command = "curl" },
+				func(c *Connection) { c.Command = "nc" },
+				func(c *Connection) { c.Command = "wget" },
+			},
+		},
+		{
+			lists: "uid",
+			set: func(c *config.RestrictedNetworkConfig, allow, deny bool) {
+				c.UID.Allow, c.UID.Deny = ids(allow, "1000"), ids(deny, "2000")
+			},
+			with: [3]func(c *Connection){
+				func(c *Connection) { c.UID = 1000 },
+				func(c *Connection) { c.UID = 2000 },
+				func(c *Connection) { c.UID = 3000 },
+			},
+		},
+		{
+			lists: "gid",
+			set: func(c *config.RestrictedNetworkConfig, allow, deny bool) {
+				c.GID.Allow, c.GID.Deny = ids(allow, "100"), ids(deny, "200")
+			},
+			with: [3]func(c *Connection){
+				func(c *Connection) { c.GID = 100 },
+				func(c *Connection) { c.GID = 200 },
+				func(c *Connection) { c.GID = 300 },
+			},
+		},
+		{
+			lists: "ports",
+			set: func(c *config.RestrictedNetworkConfig, allow, deny bool) {
+				c.Ports.Allow, c.Ports.Deny = commands(allow, "443"), commands(deny, "8080")
+			},
+			with: [3]func(c *Connection){
+				func(c *Connection) { c.Port = 443 },
+				func(c *Connection) { c.Port = 8080 },
+				func(c *Connection) { c.Port = 22 },
+			},
+		},
+	}
+
+	for _, test := range tests {
+		for _, allow := range []bool{false, true} {
+			for _, deny := range []bool{false, true} {
+				t.Run(fmt.Sprintf("%s allow=%t deny=%t", test.lists, allow, deny), func(t *testing.T) {
+					conf := config.DefaultConfig()
+					conf.RestrictedNetworkConfig.Mode = "block"
+					test.set(&conf.RestrictedNetworkConfig, allow, deny)
+					assert.Nil(t, conf.Validate())
+					mgr := Manager{config: conf, backend: bouhekitest.NewMaps()}
+					assert.Nil(t, mgr.SetConfigToMap())
+
+					// An empty list is no constraint: only a populated allow list denies the
+					// values it does not list, and only a populated deny list its own.
+					for i, denied := range []bool{false, allow || deny, allow} {
+						conn := base
+						test.with[i](&conn)
+						assert.Equal(t, denied, mgr.Policy().Evaluate(conn).Denied, i)
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestAllowAndDenyCIDRListCombinations(t *testing.T) {
+	allowed := Connection{Addr: net.ParseIP("10.0.0.1"), Port: 443, Command: "curl"}
+	denied := Connection{Addr: net.ParseIP("169.254.169.254"), Port: 80, Command: "curl"}
+	other := Connection{Addr: net.ParseIP("192.168.0.1"), Port: 443, Command: "curl"}
+
+	// The destination lists decide with network.policy.default, so an empty allow list allows
+	// nothing, unless the default is allow. A deny list alone is rejected with the default deny.
+	tests := []struct {
+		allow, deny   bool
+		defaultAction string
+		denied        [3]bool
+		err           bool
+	}{
+		{allow: false, deny: false, defaultAction: config.DEFAULT_ACTION_DENY, denied: [3]bool{true, true, true}},
+		{allow: true, deny: false, defaultAction: config.DEFAULT_ACTION_DENY, denied: [3]bool{false, true, true}},
+		{allow: false, deny: true, defaultAction: config.DEFAULT_ACTION_DENY, err: true},
+		{allow: true, deny: true, defaultAction: config.DEFAULT_ACTION_DENY, denied: [3]bool{false, true, true}},
+		{allow: false, deny: false, defaultAction: config.DEFAULT_ACTION_ALLOW, denied: [3]bool{false, false, false}},
+		{allow: true, deny: false, defaultAction: config.DEFAULT_ACTION_ALLOW, denied: [3]bool{false, false, false}},
+		{allow: false, deny: true, defaultAction: config.DEFAULT_ACTION_ALLOW, denied: [3]bool{false, true, false}},
+		{allow: true, deny: true, defaultAction: config.DEFAULT_ACTION_ALLOW, denied: [3]bool{false, true, false}},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("allow=%t deny=%t default=%s", test.allow, test.deny, test.defaultAction), func(t *testing.T) {
+			conf := config.DefaultConfig()
+			conf.RestrictedNetworkConfig.Mode = "block"
+			conf.RestrictedNetworkConfig.Decision.Default = test.defaultAction
+			conf.RestrictedNetworkConfig.CIDR.Allow, conf.RestrictedNetworkConfig.CIDR.Deny = []string{}, []string{}
+			if test.allow {
+				conf.RestrictedNetworkConfig.CIDR.Allow = []string{"10.0.0.0/8"}
+			}
+			if test.deny {
+				conf.RestrictedNetworkConfig.CIDR.Deny = []string{"169.254.169.254/32"}
+			}
+			if test.err {
+				assert.NotNil(t, conf.Validate())
+				return
+			}
+			assert.Nil(t, conf.Validate())
+			mgr := Manager{config: conf, backend: bouhekitest.NewMaps()}
+			assert.Nil(t, mgr.SetConfigToMap())
+
+			for i, conn := range []Connection{allowed, denied, other} {
+				assert.Equal(t, test.denied[i], mgr.Policy().Evaluate(conn).Denied, conn.Addr.String())
+			}
+		})
+	}
+}
+
+// writtenLists returns the maps written to, in the order of the first write, but the config map
+// and the cidr allow lists, which hold the 0.0.0.0/0 and ::/0 of the default config.
+func writtenLists(maps *bouhekitest.Maps) []string {
+	names := []string{}
+	seen := map[string]bool{RESTRICT_NETWORK_CONFIG_MAP_NAME: true, ALLOWED_V4_CIDR_LIST_MAP_NAME: true, ALLOWED_V6_CIDR_LIST_MAP_NAME: true}
+	for _, w := range maps.Writes() {
+		if seen[w.Map] {
+			continue
+		}
+		seen[w.Map] = true
+		names = append(names, w.Map)
+	}
+	return names
+}
+
+func TestDeniedGIDsAreWrittenToTheGIDList(t *testing.T) {
+	conf := config.DefaultConfig()
+	conf.RestrictedNetworkConfig.Mode = "block"
+	conf.RestrictedNetworkConfig.GID.Deny = []string{"999"}
+	maps := bouhekitest.NewMaps()
+	mgr := Manager{config: conf, backend: maps}
+	assert.Nil(t, mgr.SetConfigToMap())
+
+	assert.True(t, maps.Has(DENIED_GID_LIST_MAP_NAME, uintToKey(999)))
+	assert.Empty(t, maps.Entries(DENIED_UID_LIST_MAP_NAME))
+
+	// A uid with the value of the gid is not denied.
+	conn := Connection{Addr: net.ParseIP("10.0.0.1"), Port: 443, Command: "curl", UID: 999, GID: 100}
+	assert.False(t, mgr.Policy().Evaluate(conn).Denied)
+	conn.GID = 999
+	assert.True(t, mgr.Policy().Evaluate(conn).Denied)
+}
+
+func TestUIDRangesAreWrittenToTheRangeLists(t *testing.T) {
+	conf := config.DefaultConfig()
+	conf.RestrictedNetworkConfig.Mode = "block"
+	conf.RestrictedNetworkConfig.UID.Allow = []string{"0", "10000-59999"}
+	conf.RestrictedNetworkConfig.UID.Deny = []string{"20000-20999"}
+	maps := bouhekitest.NewMaps()
+	mgr := Manager{config: conf, backend: maps}
+	assert.Nil(t, mgr.SetConfigToMap())
+
+	assert.Equal(t, map[string][]byte{string(uintToKey(0)): entryValue()}, maps.Entries(ALLOWED_UID_LIST_MAP_NAME))
+	assert.Len(t, maps.Entries(ALLOWED_UID_RANGE_LIST_MAP_NAME), 13)
+	assert.True(t, maps.Has(DENIED_UID_RANGE_LIST_MAP_NAME, uidPrefixToKey(uidPrefix{UID: 20480, PrefixLen: 23})))
+	assert.Equal(t, uidPrefix{UID: 20480, PrefixLen: 23}, keyToUIDPrefix(uidPrefixToKey(uidPrefix{UID: 20480, PrefixLen: 23})))
+	// The sizes count the prefixes with the uids.
+	lists := DecodeListSizes(mgr.configMapValue())
+	assert.Equal(t, uint32(14), lists.AllowUID)
+	assert.Equal(t, uint32(6), lists.DenyUID)
+
+	conn := Connection{Addr: net.ParseIP("10.0.0.1"), Port: 443, Command: "curl", UID: 30000}
+	assert.False(t, mgr.Policy().Evaluate(conn).Denied)
+	conn.UID = 20500
+	assert.Equal(t, "network.uid.deny 20480-20991", mgr.Policy().Evaluate(conn).Rule)
+	conn.UID = 60000
+	assert.Equal(t, "network.uid.allow does not list 60000", mgr.Policy().Evaluate(conn).Rule)
+
+	export := ExportPolicy(conf)
+	assert.Equal(t, PolicyExportIDList{Allow: []uint{0}, Deny: []uint{}}, export.UID)
+	assert.Equal(t, &PolicyExportList{Allow: []string{"10000-59999"}, Deny: []string{"20000-20999"}}, export.UIDRanges)
+
+	// A range removed from the list has its prefixes deleted.
+	conf.RestrictedNetworkConfig.UID.Allow = []string{"0"}
+	assert.Nil(t, mgr.SetConfigToMap())
+	assert.Empty(t, maps.Entries(ALLOWED_UID_RANGE_LIST_MAP_NAME))
+	conn.UID = 30000
+	assert.Equal(t, "network.uid.allow does not list 30000", mgr.Policy().Evaluate(conn).Rule)
+	assert.Empty(t, ExportPolicy(conf).UIDRanges.Allow)
+}
+
+func TestCommandPatternsAreWrittenByIndex(t *testing.T) {
+	conf := config.DefaultConfig()
+	conf.RestrictedNetworkConfig.Mode = "block"
+	conf.RestrictedNetworkConfig.Command.Allow = []string{"curl", "python*", "*-agent", "kubernetes-control*"}
+	maps := bouhekitest.NewMaps()
+	mgr := Manager{config: conf, backend: maps}
+	assert.Nil(t, mgr.SetConfigToMap())
+
+	assert.True(t, maps.Has(ALLOWED_COMMAND_LIST_MAP_NAME, byteToKey([]byte("kubernetes-cont"))))
+	assert.Equal(t, map[string][]byte{
+		string(uintToKey(0)): commandPatternValue(config.CommandPattern{Prefix: "python"}),
+		string(uintToKey(1)): commandPatternValue(config.CommandPattern{Suffix: "-agent"}),
+	}, maps.Entries(ALLOWED_COMMAND_PATTERN_LIST_MAP_NAME))
+	assert.Equal(t, config.CommandPattern{Suffix: "-agent"}, valueToCommandPattern(commandPatternValue(config.CommandPattern{Suffix: "-agent"})))
+	assert.Equal(t, uint32(2), DecodeListSizes(mgr.configMapValue()).AllowCommandPattern)
+
+	conn := Connection{Addr: net.ParseIP("10.0.0.1"), Port: 443, Command: "node-agent"}
+	assert.False(t, mgr.Policy().Evaluate(conn).Denied)
+	assert.Equal(t, "network.command.allow *-agent", mgr.Policy().CommandPattern("node-agent"))
+
+	// A pattern removed from the list is deleted by its index.
+	conf.RestrictedNetworkConfig.Command.Allow = []string{"curl", "python*"}
+	assert.Nil(t, mgr.SetConfigToMap())
+	assert.Len(t, maps.Entries(ALLOWED_COMMAND_PATTERN_LIST_MAP_NAME), 1)
+	assert.True(t, mgr.Policy().Evaluate(conn).Denied)
+}
+
+func TestPolicyEntriesAreWrittenToTheirLists(t *testing.T) {
+	conf := config.DefaultConfig()
+	conf.RestrictedNetworkConfig.Mode = "block"
+	conf.RestrictedNetworkConfig.CIDR.Allow = []string{"10.0.0.0/8"}
+	conf.RestrictedNetworkConfig.Policies = []config.PolicyEntryConfig{
+		{Name: "curl", Command: []string{"curl"}, CIDR: config.PolicyListsConfig{Allow: []string{"10.1.0.0/16"}}, Domain: config.PolicyListsConfig{Allow: []string{"example.com"}}},
+		{Name: "deploy", Command: []string{"curl"}, UID: []uint{1000}, Domain: config.PolicyListsConfig{Deny: []string{"example.com"}}},
+	}
+	resolver := &FakeDNSResolver{answers: map[uint16][]net.IP{dns.TypeA: {net.ParseIP("192.0.2.1")}}}
+	maps := bouhekitest.NewMaps()
+	mgr, err := NewManager(conf, WithMapBackend(maps), WithDNSResolver(resolver))
+	assert.Nil(t, err)
+	assert.Nil(t, mgr.SetConfigToMap())
+
+	assert.Equal(t, maskValue(0b11), maps.Entries(POLICY_ENTRY_COMMAND_LIST_MAP_NAME)[string(byteToKey([]byte("curl")))])
+	assert.Equal(t, maskValue(0b10), maps.Entries(POLICY_ENTRY_UID_LIST_MAP_NAME)[string(uintToKey(1000))])
+	assert.Equal(t, policy.PolicyEntries{Count: 2, AnyUID: 0b01, AnyGID: 0b11, HasAllow: 0b01}, DecodePolicyEntries(mgr.configMapValue()))
+
+	// Each entry has the addresses of its domains, keyed with its tag.
+	allowed, err := ipv4ToKey(net.IPNet{IP: net.ParseIP("192.0.2.1").To4(), Mask: net.CIDRMask(32, 32)}, 1)
+	assert.Nil(t, err)
+	denied, err := ipv4ToKey(net.IPNet{IP: net.ParseIP("192.0.2.1").To4(), Mask: net.CIDRMask(32, 32)}, 2)
+	assert.Nil(t, err)
+	assert.True(t, maps.Has(ALLOWED_V4_ENTRY_CIDR_LIST_MAP_NAME, allowed))
+	assert.True(t, maps.Has(DENIED_V4_ENTRY_CIDR_LIST_MAP_NAME, denied))
+	assert.Len(t, mgr.resolved.domain(ALLOWED_V4_ENTRY_CIDR_LIST_MAP_NAME, "example.com#1"), 1)
+
+	p := mgr.Policy()
+	for _, test := range []struct {
+		conn   Connection
+		denied bool
+		entry  string
+	}{
+		{Connection{Addr: net.ParseIP("10.1.0.1"), Port: 443, Command: "curl"}, false, "network.policies[curl]"},
+		{Connection{Addr: net.ParseIP("192.0.2.1"), Port: 443, Command: "curl"}, false, "network.policies[curl]"},
+		{Connection{Addr: net.ParseIP("10.2.0.1"), Port: 443, Command: "curl"}, true, "network.policies[curl]"},
+		{Connection{Addr: net.ParseIP("10.2.0.1"), Port: 443, Command: "wget"}, false, ""},
+	} {
+		assert.Equal(t, test.denied, p.Evaluate(test.conn).Denied, test.conn)
+		assert.Equal(t, test.entry, p.PolicyEntry(test.conn))
+	}
+
+	// The entries removed from the config are deleted from the lists.
+	conf.RestrictedNetworkConfig.Policies = conf.RestrictedNetworkConfig.Policies[:1]
+	assert.Nil(t, mgr.SetConfigToMap())
+	assert.Equal(t, maskValue(0b01), maps.Entries(POLICY_ENTRY_COMMAND_LIST_MAP_NAME)[string(byteToKey([]byte("curl")))])
+	assert.Empty(t, maps.Entries(POLICY_ENTRY_UID_LIST_MAP_NAME))
+}
+
+// commands returns a list of command, or of another string entry, if populated, or an empty list.
+func commands(populated bool, command string) []string {
+	if populated {
+		return []string{command}
+	}
+	return []string{}
+}
+
+func ids(populated bool, id string) []string {
+	if populated {
+		return []string{id}
+	}
+	return []string{}
+}
+
+func TestProtocolRulesOnlyMatchTheirProtocol(t *testing.T) {
+	conf := config.DefaultConfig()
+	conf.RestrictedNetworkConfig.Mode = "block"
+	conf.RestrictedNetworkConfig.CIDR.Allow = []string{"10.0.0.0/8"}
+	conf.RestrictedNetworkConfig.CIDR.Protocols = []config.ProtocolRulesConfig{
+		{Protocol: config.PROTOCOL_UDP, Allow: []string{"192.0.2.53/32"}},
+		{Protocol: config.PROTOCOL_TCP, Deny: []string{"10.0.0.0/16"}},
+	}
+	maps := bouhekitest.NewMaps()
+	mgr := Manager{config: conf, backend: maps}
+	assert.Nil(t, mgr.SetConfigToMap())
+
+	assert.Len(t, maps.Entries(ALLOWED_V4_PROTOCOL_CIDR_LIST_MAP_NAME), 1)
+	assert.Len(t, maps.Entries(DENIED_V4_PROTOCOL_CIDR_LIST_MAP_NAME), 1)
+	assert.Len(t, maps.Entries(ALLOWED_V4_CIDR_LIST_MAP_NAME), 1)
+
+	policy := mgr.Policy()
+	dns := Connection{Addr: net.ParseIP("192.0.2.53"), Port: 53, UID: 1000}
+	internal := Connection{Addr: net.ParseIP("10.0.0.1"), Port: 443, UID: 1000}
+	for _, test := range []struct {
+		c        Connection
+		sockType uint8
+		rule     string
+	}{
+		{dns, UDP, ""},
+		{dns, TCP, "network.cidr.allow does not list 192.0.2.53"},
+		{internal, TCP, "network.cidr.protocols[tcp].deny 10.0.0.0/16"},
+		{internal, UDP, ""},
+		// The other socket types are only restricted by the lists of every protocol.
+		{dns, 3, "network.cidr.allow does not list 192.0.2.53"},
+		{internal, 3, ""},
+	} {
+		test.c.SockType = test.sockType
+		decision := policy.Evaluate(test.c)
+		assert.Equal(t, test.rule != "", decision.Denied, "%s %d", test.c.Addr, test.sockType)
+		assert.Equal(t, test.rule, decision.Rule, "%s %d", test.c.Addr, test.sockType)
+	}
+
+	// The Policy mirrors the writes of the protocol maps under their protocol.
+	version, _ := policy.version()
+	assert.Equal(t, map[string]PolicyExportList{
+		config.PROTOCOL_TCP: {Allow: []string{}, Deny: []string{"10.0.0.0/16"}},
+		config.PROTOCOL_UDP: {Allow: []string{"192.0.2.53/32"}, Deny: []string{}},
+	}, version.ProtocolCIDR)
+}
+
+func TestDenyListOfSizeZeroIsNotLookedUp(t *testing.T) {
+	conf := stateTestConfig()
+	maps := bouhekitest.NewMaps()
+	mgr := Manager{config: conf, backend: maps}
+	assert.Nil(t, mgr.SetConfigToMap())
+	wget := Connection{Addr: net.ParseIP("10.0.0.1"), Command: "wget", UID: 1000, GID: 100}
+	assert.True(t, mgr.Policy().Evaluate(wget).DenyListed)
+
+	// The entry is left in its map, e.g. by a failed delete.
+	policy := mgr.Policy()
+	policy.setListSizes(ListSizes{AllowCommand: 1, AllowUID: 1, AllowGID: 1})
+	assert.False(t, policy.Evaluate(wget).DenyListed)
+}
+
+func TestAllowExceptsAreFlaggedInTheDenyLists(t *testing.T) {
+	conf := config.DefaultConfig()
+	conf.RestrictedNetworkConfig.Mode = "block"
+	conf.RestrictedNetworkConfig.CIDR.Allow = []string{"0.0.0.0/0", "::/0"}
+	conf.RestrictedNetworkConfig.CIDR.AllowExcept = []string{"169.254.0.0/16", "fd00:ec2::254/128"}
+	conf.RestrictedNetworkConfig.CIDR.Deny = []string{"169.254.169.254/32", "192.168.0.0/16"}
+	conf.RestrictedNetworkConfig.Command.Allow = []string{"curl"}
+	maps := bouhekitest.NewMaps()
+	mgr := Manager{config: conf, backend: maps}
+	assert.Nil(t, mgr.SetConfigToMap())
+
+	// The deny entries inside an except are flagged too, so that the longest match has the flag.
+	assert.Equal(t, map[string][]byte{
+		string(cidrKey(t, "169.254.0.0/16")):     exceptValue(),
+		string(cidrKey(t, "169.254.169.254/32")): exceptValue(),
+		string(cidrKey(t, "192.168.0.0/16")):     entryValue(),
+	}, maps.Entries(DENIED_V4_CIDR_LIST_MAP_NAME))
+	assert.Equal(t, map[string][]byte{string(cidrKey(t, "fd00:ec2::254/128")): exceptValue()}, maps.Entries(DENIED_V6_CIDR_LIST_MAP_NAME))
+
+	// An allowed command still connects to the other deny entries, but not to an except.
+	conn := Connection{Addr: net.ParseIP("192.168.0.1"), Port: 443, Command: "curl"}
+	assert.False(t, mgr.Policy().Evaluate(conn).Denied)
+	conn.Addr = net.ParseIP("169.254.169.254")
+	// The rule is the longest match, as the kernel reports it.
+	assert.Equal(t, "network.cidr.allow_except 169.254.169.254/32", mgr.Policy().Evaluate(conn).Rule)
+	conn.Addr = net.ParseIP("169.254.0.1")
+	assert.Equal(t, "network.cidr.allow_except 169.254.0.0/16", mgr.Policy().Evaluate(conn).Rule)
+
+	// An except removed from the config clears the flag of the entries inside it.
+	conf.RestrictedNetworkConfig.CIDR.AllowExcept = []string{}
+	assert.Nil(t, mgr.SetConfigToMap())
+	assert.Equal(t, entryValue(), maps.Entries(DENIED_V4_CIDR_LIST_MAP_NAME)[string(cidrKey(t, "169.254.169.254/32"))])
+	assert.False(t, mgr.Policy().Evaluate(conn).Denied)
+	conn.Addr = net.ParseIP("169.254.169.254")
+	assert.False(t, mgr.Policy().Evaluate(conn).Denied)
+}
@@ -0,0 +1,249 @@
+package network
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/alert"
+	"github.com/mrtc0/bouheki/pkg/eventpipe"
+	"github.com/mrtc0/bouheki/pkg/notify"
+)
+
+const (
+	// STATE_PATH is where the StateDocument is served next to /metrics.
+	STATE_PATH = "/v1/state"
+
+	// STATE_DOCUMENT_VERSION is the version of the StateDocument. Like notify.VERSION, it is
+	// incremented when a field is removed or changes meaning; new fields keep the version.
+	STATE_DOCUMENT_VERSION = 1
+
+	// STATE_RELOAD_HISTORY_SIZE is the number of config reloads kept in the StateDocument.
+	STATE_RELOAD_HISTORY_SIZE = 16
+
+	// STATE_TIMEOUT bounds how long a request waits for the job queue before it gives up.
+	STATE_TIMEOUT = 5 * time.Second
+)
+
+var managerStateNames = map[managerState]string{
+	stateCreated:  "created",
+	stateStarted:  "started",
+	stateStopping: "stopping",
+	stateStopped:  "stopped",
+}
+
+// StateDocument is everything `bouheki status` and `bouheki config dump` show about the network
+// audit, in one document for the consumers that read it remotely.
+type StateDocument struct {
+	Version     int       `json:"version"`
+	GeneratedAt time.Time `json:"generated_at"`
+	// PolicyDigest is the digest of the rules in the maps, as in the notifications.
+	PolicyDigest string          `json:"policy_digest"`
+	Policy       *PolicyExport   `json:"policy"`
+	Status       StateStatus     `json:"status"`
+	Reloads      []StateReload   `json:"reloads"`
+	Coverage     *CoverageStatus `json:"coverage"`
+	Alerts       StateAlerts     `json:"alerts"`
+}
+
+type StateStatus struct {
+	// State is the lifecycle of the programs: created, started, stopping or stopped.
+	State string `json:"state"`
+	// Hook is the hook of the loaded programs, Enforcement the one they are attached to.
+	Hook        string      `json:"hook"`
+	Enforcement string      `json:"enforcement"`
+	Mode        string      `json:"mode"`
+	Audit       AuditStatus `json:"audit"`
+	Maps        []StateMap  `json:"maps"`
+	Events      StateEvents `json:"events"`
+}
+
+// StateMap is the usage of a map.
+type StateMap struct {
+	Name       string `json:"name"`
+	MaxEntries uint32 `json:"max_entries"`
+	// Entries is the number of entries bouheki has written to the map.
+	Entries  int `json:"entries"`
+	Required int `json:"required"`
+}
+
+// StateEvents are the counters of the audit events since the programs were loaded.
+type StateEvents struct {
+	Submitted  uint64 `json:"submitted"`
+	Dropped    uint64 `json:"dropped"`
+	Suppressed uint64 `json:"suppressed"`
+	// Repeated is the number of the decisions of a sendmsg that were not reported, because the
+	// task had sent to the destination shortly before.
+	Repeated uint64 `json:"repeated"`
+	Reported uint64 `json:"reported"`
+	// OutputDropped is the number of events the consumer of event_output did not take.
+	OutputDropped uint64 `json:"output_dropped"`
+	// Error is set when the counters of the programs could not be read.
+	Error string `json:"error,omitempty"`
+}
+
+// StateReload is a config reload, from the most recent.
+type StateReload struct {
+	Time         time.Time `json:"time"`
+	Applied      bool      `json:"applied"`
+	Error        string    `json:"error,omitempty"`
+	Diff         string    `json:"diff,omitempty"`
+	PolicyDigest string    `json:"policy_digest"`
+}
+
+type StateAlerts struct {
+	Firing []string `json:"firing"`
+}
+
+// reloadHistory keeps the last config_reload notifications.
+type reloadHistory struct {
+	mu      sync.Mutex
+	reloads []StateReload
+}
+
+func (h *reloadHistory) record(n notify.Notification) {
+	reload, ok := n.Payload.(notify.ConfigReload)
+	if !ok {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.reloads = append([]StateReload{{
+		Time:         n.Time,
+		Applied:      reload.Applied,
+		Error:        reload.Error,
+		Diff:         reload.Diff,
+		PolicyDigest: n.PolicyDigest,
+	}}, h.reloads...)
+	if len(h.reloads) > STATE_RELOAD_HISTORY_SIZE {
+		h.reloads = h.reloads[:STATE_RELOAD_HISTORY_SIZE]
+	}
+}
+
+func (h *reloadHistory) list() []StateReload {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return append([]StateReload{}, h.reloads...)
+}
+
+// run records the config reloads published to hub until ctx is done.
+func (h *reloadHistory) run(ctx context.Context, hub *notify.Hub) {
+	for {
+		s := hub.Subscribe(notify.TYPE_CONFIG_RELOAD)
+		for open := true; open; {
+			select {
+			case <-ctx.Done():
+				hub.Unsubscribe(s)
+				return
+			case n, ok := <-s.C:
+				if ok {
+					h.record(n)
+				}
+				open = ok
+			}
+		}
+		// Dropped for being too slow: subscribe again, the missed reloads are lost.
+	}
+}
+
+// stateDocument serves the StateDocument of mgr.
+type stateDocument struct {
+	mgr       *Manager
+	resources ResourcesStatus
+	reloads   *reloadHistory
+	// coverage is nil unless network.coverage is enabled.
+	coverage *coverage
+}
+
+// build returns the StateDocument. It runs on the job queue, so that the maps are not read while
+// a job writes them; the events channel is not involved.
+func (s stateDocument) build(ctx context.Context) (StateDocument, error) {
+	docs := make(chan StateDocument, 1)
+	err := s.mgr.Jobs().Snapshot(ctx, "state-document", func(ctx context.Context) error {
+		docs <- s.snapshot()
+		return nil
+	})
+	if err != nil {
+		return StateDocument{}, err
+	}
+	return <-docs, nil
+}
+
+func (s stateDocument) snapshot() StateDocument {
+	mgr := s.mgr
+	doc := StateDocument{
+		Version:      STATE_DOCUMENT_VERSION,
+		GeneratedAt:  mgr.now().UTC(),
+		PolicyDigest: mgr.Policy().Digest(),
+		Policy:       ExportPolicy(mgr.config),
+		Reloads:      s.reloads.list(),
+		Alerts:       StateAlerts{Firing: []string{}},
+	}
+	doc.Policy.ExportedAt = doc.GeneratedAt
+
+	mgr.mu.Lock()
+	_, idle := mgr.rb.(*idleRingBuffer)
+	doc.Status = StateStatus{
+		State:       managerStateNames[mgr.state],
+		Hook:        mgr.hook,
+		Enforcement: mgr.enforcement,
+		Mode:        mgr.config.RestrictedNetworkConfig.Mode,
+		Audit:       familyStatus(AuditStatus{Enabled: !mgr.auditDisabled, RingBuffer: mgr.rb != nil && !idle}, mgr.config.RestrictedNetworkConfig),
+		Maps:        []StateMap{},
+	}
+	mgr.mu.Unlock()
+
+	mgr.loadedMu.Lock()
+	for _, m := range s.resources.Maps {
+		doc.Status.Maps = append(doc.Status.Maps, StateMap{
+			Name:       m.Name,
+			MaxEntries: m.MaxEntries,
+			Entries:    len(mgr.loaded[m.Name]),
+			Required:   m.Required,
+		})
+	}
+	mgr.loadedMu.Unlock()
+
+	stats, err := mgr.eventStats()
+	if err != nil {
+		doc.Status.Events.Error = err.Error()
+	}
+	doc.Status.Events.Submitted, doc.Status.Events.Dropped, doc.Status.Events.Suppressed = stats.Submitted, stats.Dropped, stats.Suppressed
+	doc.Status.Events.Repeated = stats.Repeated
+	doc.Status.Events.Reported = atomic.LoadUint64(&mgr.reported)
+	if eventpipe.DefaultOutput != nil {
+		doc.Status.Events.OutputDropped = eventpipe.DefaultOutput.Stats().Dropped
+	}
+
+	if s.coverage != nil {
+		coverage := s.coverage.Status()
+		doc.Coverage = &coverage
+	}
+	if alert.DefaultEngine != nil {
+		doc.Alerts.Firing = alert.DefaultEngine.Firing()
+	}
+
+	return doc
+}
+
+// ServeHTTP writes the StateDocument as JSON.
+func (s stateDocument) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	ctx, cancel := context.WithTimeout(req.Context(), STATE_TIMEOUT)
+	defer cancel()
+
+	doc, err := s.build(ctx)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to snapshot the state: %s", err), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(doc)
+}
@@ -0,0 +1,104 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/bouhekitest"
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/notify"
+	"github.com/stretchr/testify/assert"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files of testdata")
+
+var stateTestTime = time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+
+func newStateTestDocument(t *testing.T) stateDocument {
+	mgr, _, _ := newAuditTestManager(t, true)
+	mgr.clock = bouhekitest.NewClock(stateTestTime)
+	mgr.hook, mgr.enforcement = config.HOOK_LSM, ENFORCEMENT_LSM
+	mgr.readEventStats = func() (eventStats, error) {
+		return eventStats{Submitted: 12, Dropped: 2, Suppressed: 1, Repeated: 4}, nil
+	}
+	assert.Nil(t, mgr.Start(make(chan []byte)))
+	t.Cleanup(mgr.Close)
+	mgr.Ack()
+
+	sizes, err := NewMapSizes(mgr.config.Resources)
+	assert.Nil(t, err)
+	required, err := RequiredEntries(mgr.config)
+	assert.Nil(t, err)
+
+	reloads := &reloadHistory{}
+	reloads.record(notify.Notification{Time: stateTestTime.Add(-time.Hour), PolicyDigest: "old", Payload: notify.ConfigReload{Applied: false, Error: "invalid cidr"}})
+	reloads.record(notify.Notification{Time: stateTestTime.Add(-time.Minute), PolicyDigest: mgr.Policy().Digest(), Payload: notify.ConfigReload{Applied: true, Diff: "+1 network.cidr.deny"}})
+
+	cov := newCoverage(mgr.Policy(), config.CoverageConfig{Enable: true, Windows: []time.Duration{time.Hour}})
+	cov.now = func() time.Time { return stateTestTime }
+
+	return stateDocument{mgr: mgr, resources: newResourcesStatus(mgr.config.Resources, sizes, required), reloads: reloads, coverage: cov}
+}
+
+// The StateDocument is read by other programs: a change of testdata/state_document.json must
+// be additive, or come with a new STATE_DOCUMENT_VERSION. Run the tests with -update to rewrite it.
+func TestStateDocumentGolden(t *testing.T) {
+	rec := httptest.NewRecorder()
+	newStateTestDocument(t).ServeHTTP(rec, httptest.NewRequest("GET", STATE_PATH, nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	got := bytes.Buffer{}
+	assert.Nil(t, json.Indent(&got, rec.Body.Bytes(), "", "  "))
+
+	golden := filepath.Join("testdata", "state_document.json")
+	if *updateGolden {
+		assert.Nil(t, ioutil.WriteFile(golden, got.Bytes(), 0644))
+	}
+	want, err := ioutil.ReadFile(golden)
+	assert.Nil(t, err)
+	assert.Equal(t, string(want), got.String())
+}
+
+func TestStateDocumentWaitsForTheRunningJob(t *testing.T) {
+	s := newStateTestDocument(t)
+
+	release := make(chan struct{})
+	job, err := s.mgr.Jobs().Submit("slow", func(ctx context.Context) error {
+		<-release
+		return nil
+	})
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = s.build(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	close(release)
+	assert.Nil(t, job.Wait())
+	doc, err := s.build(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, STATE_DOCUMENT_VERSION, doc.Version)
+	// Building the document is not recorded as a job.
+	assert.Len(t, s.mgr.Jobs().Status().History, 1)
+}
+
+func TestReloadHistoryIsBounded(t *testing.T) {
+	reloads := &reloadHistory{}
+	for i := 0; i < STATE_RELOAD_HISTORY_SIZE+3; i++ {
+		reloads.record(notify.Notification{Time: stateTestTime.Add(time.Duration(i) * time.Second), Payload: notify.ConfigReload{Applied: true}})
+	}
+	reloads.record(notify.Notification{Payload: notify.DNSRuleChange{Domain: "example.com"}})
+
+	list := reloads.list()
+	assert.Len(t, list, STATE_RELOAD_HISTORY_SIZE)
+	assert.Equal(t, stateTestTime.Add(time.Duration(STATE_RELOAD_HISTORY_SIZE+2)*time.Second), list[0].Time)
+}
@@ -0,0 +1,177 @@
+package network
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+	log "github.com/mrtc0/bouheki/pkg/log"
+	"github.com/mrtc0/bouheki/pkg/policy"
+	"github.com/mrtc0/bouheki/pkg/policy/cidrset"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	TAG_CLOUD_METADATA = "cloud-metadata"
+	TAG_KUBERNETES_API = "kubernetes-api"
+
+	KUBEADM_KUBECONFIG_PATH = "/etc/kubernetes/admin.conf"
+)
+
+var defaultDestinationTags = []config.DestinationTag{
+	{CIDR: "169.254.169.254/32", Tags: []string{TAG_CLOUD_METADATA}},
+	{CIDR: "fd00:ec2::254/128", Tags: []string{TAG_CLOUD_METADATA}},
+}
+
+// destinationTags is used by newAuditLog, like dnsCache.
+var destinationTags *destinationTagger
+
+// destinationTagger looks up the tags of the longest prefix containing a destination.
+type destinationTagger struct {
+	set *cidrset.Set
+}
+
+func newDestinationTagger(conf config.DestinationTagsConfig, kubernetesAPIServers []net.IP) (*destinationTagger, error) {
+	t := &destinationTagger{set: cidrset.New()}
+
+	if !conf.DisableDefaults {
+		for _, entry := range defaultDestinationTags {
+			if err := t.insert(entry); err != nil {
+				return nil, err
+			}
+		}
+		for _, ip := range kubernetesAPIServers {
+			t.set.Insert(hostNetwork(ip), []string{TAG_KUBERNETES_API})
+		}
+	}
+
+	// entries are inserted last, so they replace the defaults of the same CIDR.
+	for _, entry := range conf.Entries {
+		if err := t.insert(entry); err != nil {
+			return nil, err
+		}
+	}
+
+	return t, nil
+}
+
+func (t *destinationTagger) insert(entry config.DestinationTag) error {
+	unzoned, _ := policy.SplitZone(entry.CIDR)
+	_, n, err := net.ParseCIDR(unzoned)
+	if err != nil {
+		return err
+	}
+	t.set.Insert(n, entry.Tags)
+	return nil
+}
+
+// tags returns the tags of addr, or an empty list if it is not a tagged destination.
+func (t *destinationTagger) tags(addr string) []string {
+	if t == nil {
+		return []string{}
+	}
+
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return []string{}
+	}
+
+	_, value, ok := t.set.Lookup(ip)
+	if !ok {
+		return []string{}
+	}
+	return value.([]string)
+}
+
+func hostNetwork(ip net.IP) *net.IPNet {
+	if v4 := ip.To4(); v4 != nil {
+		return &net.IPNet{IP: v4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+type kubeconfig struct {
+	Clusters []struct {
+		Cluster struct {
+			Server string `yaml:"server"`
+		} `yaml:"cluster"`
+	} `yaml:"clusters"`
+}
+
+// discoverKubernetesAPIServers returns the apiserver addresses from the in-cluster
+// environment and from the kubeconfig files. Servers given by a hostname are skipped,
+// as resolving them at startup could block.
+func discoverKubernetesAPIServers(getenv func(string) string, readFile func(string) ([]byte, error)) []net.IP {
+	servers := []net.IP{}
+	seen := map[string]struct{}{}
+	add := func(host string) {
+		ip := net.ParseIP(strings.Trim(host, "[]"))
+		if ip == nil {
+			if host != "" {
+				log.Debug(fmt.Sprintf("kubernetes apiserver %s is not an IP address, it is not tagged", host))
+			}
+			return
+		}
+		if _, ok := seen[ip.String()]; ok {
+			return
+		}
+		seen[ip.String()] = struct{}{}
+		servers = append(servers, ip)
+	}
+
+	add(getenv("KUBERNETES_SERVICE_HOST"))
+
+	for _, path := range kubeconfigPaths(getenv) {
+		data, err := readFile(path)
+		if err != nil {
+			continue
+		}
+
+		var kc kubeconfig
+		if err := yaml.Unmarshal(data, &kc); err != nil {
+			log.Debug(fmt.Sprintf("failed to parse kubeconfig %s: %s", path, err))
+			continue
+		}
+		for _, cluster := range kc.Clusters {
+			server, err := url.Parse(cluster.Cluster.Server)
+			if err != nil {
+				continue
+			}
+			add(server.Hostname())
+		}
+	}
+
+	return servers
+}
+
+func kubeconfigPaths(getenv func(string) string) []string {
+	if env := getenv("KUBECONFIG"); env != "" {
+		return filepath.SplitList(env)
+	}
+
+	paths := []string{}
+	if home := getenv("HOME"); home != "" {
+		paths = append(paths, filepath.Join(home, ".kube", "config"))
+	}
+	return append(paths, KUBEADM_KUBECONFIG_PATH)
+}
+
+// setupDestinationTags builds the tagger used by newAuditLog.
+func setupDestinationTags(conf config.DestinationTagsConfig) error {
+	var servers []net.IP
+	if !conf.DisableDefaults {
+		servers = discoverKubernetesAPIServers(os.Getenv, ioutil.ReadFile)
+	}
+
+	tagger, err := newDestinationTagger(conf, servers)
+	if err != nil {
+		return err
+	}
+	destinationTags = tagger
+	return nil
+}
@@ -0,0 +1,85 @@
+package network
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDestinationTagger(t *testing.T) {
+	tagger, err := newDestinationTagger(config.DestinationTagsConfig{
+		Entries: []config.DestinationTag{
+			{CIDR: "10.0.0.0/8", Tags: []string{"internal"}},
+			{CIDR: "10.1.0.0/16", Tags: []string{"internal", "database"}},
+		},
+	}, []net.IP{net.ParseIP("10.96.0.1")})
+	assert.Nil(t, err)
+
+	assert.Equal(t, []string{TAG_CLOUD_METADATA}, tagger.tags("169.254.169.254"))
+	assert.Equal(t, []string{TAG_CLOUD_METADATA}, tagger.tags("fd00:ec2::254"))
+	assert.Equal(t, []string{TAG_KUBERNETES_API}, tagger.tags("10.96.0.1"))
+	assert.Equal(t, []string{"internal"}, tagger.tags("10.96.0.2"))
+	assert.Equal(t, []string{"internal", "database"}, tagger.tags("10.1.2.3"))
+	assert.Equal(t, []string{}, tagger.tags("93.184.216.34"))
+	assert.Equal(t, []string{}, tagger.tags("invalid"))
+
+	var noTagger *destinationTagger
+	assert.Equal(t, []string{}, noTagger.tags("169.254.169.254"))
+}
+
+func TestDestinationTaggerOverridesDefaults(t *testing.T) {
+	tagger, err := newDestinationTagger(config.DestinationTagsConfig{
+		Entries: []config.DestinationTag{
+			{CIDR: "169.254.169.254/32", Tags: []string{"aws-imds"}},
+		},
+	}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"aws-imds"}, tagger.tags("169.254.169.254"))
+
+	tagger, err = newDestinationTagger(config.DestinationTagsConfig{DisableDefaults: true}, []net.IP{net.ParseIP("10.96.0.1")})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{}, tagger.tags("169.254.169.254"))
+	assert.Equal(t, []string{}, tagger.tags("10.96.0.1"))
+}
+
+func TestDiscoverKubernetesAPIServers(t *testing.T) {
+	files := map[string]string{
+		"/root/.kube/config": `
+clusters:
+- name: kind
+  cluster:
+    server: https://172.18.0.2:6443
+- name: ipv6
+  cluster:
+    server: https://[fd00::1]:6443
+- name: remote
+  cluster:
+    server: https://k8s.example.com
+`,
+		KUBEADM_KUBECONFIG_PATH: `
+clusters:
+- cluster:
+    server: https://172.18.0.2:6443
+`,
+	}
+	readFile := func(path string) ([]byte, error) {
+		if content, ok := files[path]; ok {
+			return []byte(content), nil
+		}
+		return nil, errors.New("not found")
+	}
+	env := map[string]string{"HOME": "/root", "KUBERNETES_SERVICE_HOST": "10.96.0.1"}
+	getenv := func(key string) string { return env[key] }
+
+	assert.Equal(t, []net.IP{
+		net.ParseIP("10.96.0.1"),
+		net.ParseIP("172.18.0.2"),
+		net.ParseIP("fd00::1"),
+	}, discoverKubernetesAPIServers(getenv, readFile))
+
+	env = map[string]string{"KUBECONFIG": "/missing:" + KUBEADM_KUBECONFIG_PATH}
+	assert.Equal(t, []net.IP{net.ParseIP("172.18.0.2")}, discoverKubernetesAPIServers(getenv, readFile))
+}
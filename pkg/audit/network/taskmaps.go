@@ -0,0 +1,256 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/mrtc0/bouheki/pkg/jobs"
+	log "github.com/mrtc0/bouheki/pkg/log"
+	"github.com/mrtc0/bouheki/pkg/metrics"
+)
+
+const (
+	TASK_EXIT_PROGRAM_NAME = "task_exit"
+	// TASK_EXIT_TRACEPOINT is where TASK_EXIT_PROGRAM_NAME is attached.
+	TASK_EXIT_TRACEPOINT = "sched:sched_process_exit"
+
+	// TASK_MAP_SWEEP_INTERVAL is how often the entries task_exit missed are deleted, e.g. the ones
+	// of the tasks that exited while it could not be attached.
+	TASK_MAP_SWEEP_INTERVAL = time.Minute
+
+	// PROC_ROOT is where the start times of the tasks are read.
+	PROC_ROOT = "/proc"
+	// USER_HZ is the unit of the start time in /proc/<pid>/stat.
+	USER_HZ = 100
+)
+
+var taskMapEntriesSwept = metrics.NewCounter("network_task_map_entries_swept_total",
+	"Number of entries of the per-task maps deleted by the sweep, rather than when their task exited.")
+
+// taskMapRegistry lists the maps keyed by the tgid of a task, whose values begin with the
+// struct task_entry of restricted-network.bpf.c. A feature that keeps per-task state registers
+// its map, instead of cleaning it up on its own: task_exit deletes the entries of a task when it
+// exits, and the sweep deletes the ones it missed.
+type taskMapRegistry struct {
+	mu    sync.Mutex
+	names []string
+}
+
+// registerTaskMap registers the per-task map mapName, which must also be in TASK_MAPS of task_exit.
+func (m *Manager) registerTaskMap(mapName string) {
+	m.taskMaps.mu.Lock()
+	defer m.taskMaps.mu.Unlock()
+
+	for _, name := range m.taskMaps.names {
+		if name == mapName {
+			return
+		}
+	}
+	m.taskMaps.names = append(m.taskMaps.names, mapName)
+}
+
+func (m *Manager) registeredTaskMaps() []string {
+	m.taskMaps.mu.Lock()
+	defer m.taskMaps.mu.Unlock()
+
+	return append([]string{}, m.taskMaps.names...)
+}
+
+// attachTaskExit attaches the program that deletes the entries of the exiting tasks, if a per-task map is registered.
+// Without it, the entries are only deleted by the sweep.
+func (m *Manager) attachTaskExit() {
+	if len(m.registeredTaskMaps()) == 0 {
+		return
+	}
+
+	if err := m.attachTracepoint(TASK_EXIT_PROGRAM_NAME, TASK_EXIT_TRACEPOINT); err != nil {
+		log.Warn(fmt.Sprintf("Failed to attach %s, the entries of the exited tasks are deleted every %s: %s", TASK_EXIT_PROGRAM_NAME, TASK_MAP_SWEEP_INTERVAL, err))
+		return
+	}
+	log.Debug(fmt.Sprintf("%s attached.", TASK_EXIT_PROGRAM_NAME))
+}
+
+func (m *Manager) attachTracepoint(progName string, tracepoint string) error {
+	prog, err := m.mod.GetProgram(progName)
+	if err != nil {
+		return err
+	}
+	category, name := tracepoint, ""
+	if i := strings.Index(tracepoint, ":"); i >= 0 {
+		category, name = tracepoint[:i], tracepoint[i+1:]
+	}
+	link, err := prog.AttachTracepoint(category, name)
+	if err != nil {
+		return err
+	}
+	m.addLink(link)
+	return nil
+}
+
+// AsyncTaskMapSweep sweeps the per-task maps every TASK_MAP_SWEEP_INTERVAL, if any is registered.
+// The sweep only deletes the state of tasks that are gone, so it is not subject to the freeze windows.
+func (m *Manager) AsyncTaskMapSweep() {
+	if len(m.registeredTaskMaps()) == 0 {
+		return
+	}
+
+	go func() {
+		for {
+			m.sleep(TASK_MAP_SWEEP_INTERVAL)
+			err := m.Jobs().Do("task-map-sweep", func(ctx context.Context) error {
+				_, err := m.sweepTaskMaps()
+				return err
+			})
+			if err == jobs.ErrStopped {
+				return
+			}
+			if err != nil {
+				log.Error(err)
+			}
+		}
+	}()
+}
+
+// sweepTaskMaps deletes the entries of the tasks that exited, and of the pids reused by another
+// task since the entry was written. It returns how many entries it deleted.
+func (m *Manager) sweepTaskMaps() (int, error) {
+	swept := 0
+	for _, mapName := range m.registeredTaskMaps() {
+		table, err := m.taskMap(mapName)
+		if err != nil {
+			return swept, err
+		}
+		entries, err := table.entries()
+		if err != nil {
+			return swept, fmt.Errorf("%s: %w", mapName, err)
+		}
+
+		for key, value := range entries {
+			if len(key) != 4 || len(value) < 8 {
+				continue
+			}
+			tgid := binary.LittleEndian.Uint32([]byte(key))
+			if m.isRunning(tgid, binary.LittleEndian.Uint64(value[:8])) {
+				continue
+			}
+			// task_exit may have deleted the entry meanwhile.
+			if err := table.DeleteKey([]byte(key)); err != nil && !errors.Is(err, syscall.ENOENT) {
+				return swept, fmt.Errorf("%s: %w", mapName, err)
+			}
+			swept++
+		}
+	}
+
+	taskMapEntriesSwept.Add(uint64(swept))
+	return swept, nil
+}
+
+// isRunning reports whether tgid is still the task that started at startBoottime, in nanoseconds since boot.
+func (m *Manager) isRunning(tgid uint32, startBoottime uint64) bool {
+	start, err := m.taskStartTime(tgid)
+	if err != nil {
+		return false
+	}
+	return start == startBoottime/uint64(time.Second/USER_HZ)
+}
+
+// taskStartTime returns the start time of tgid since boot, in USER_HZ, as the kernel computes
+// it from the start_boottime of the task.
+func (m *Manager) taskStartTime(tgid uint32) (uint64, error) {
+	root := m.procRoot
+	if root == "" {
+		root = PROC_ROOT
+	}
+
+	stat, err := os.ReadFile(filepath.Join(root, strconv.FormatUint(uint64(tgid), 10), "stat"))
+	if err != nil {
+		return 0, err
+	}
+	// The comm, in parentheses, may contain spaces: the fields are counted after it.
+	end := bytes.LastIndexByte(stat, ')')
+	if end < 0 {
+		return 0, fmt.Errorf("malformed stat of %d", tgid)
+	}
+	fields := strings.Fields(string(stat[end+1:]))
+	// starttime is the 22nd field, the 20th after the comm.
+	if len(fields) < 20 {
+		return 0, fmt.Errorf("malformed stat of %d", tgid)
+	}
+	return strconv.ParseUint(fields[19], 10, 64)
+}
+
+// taskMap is a per-task map that can also be listed.
+type taskMap interface {
+	policyMap
+	entries() (map[string][]byte, error)
+}
+
+// entryLister is implemented by the backends that can list the entries of a map, e.g. bouhekitest.Maps.
+type entryLister interface {
+	Entries(mapName string) map[string][]byte
+}
+
+func (m *Manager) taskMap(mapName string) (taskMap, error) {
+	if m.backend != nil {
+		lister, ok := m.backend.(entryLister)
+		if !ok {
+			return nil, fmt.Errorf("the map backend can not list the entries of %s", mapName)
+		}
+		return listedBackendMap{backendMap: backendMap{backend: m.backend, name: mapName}, lister: lister}, nil
+	}
+	if m.mod == nil {
+		return nil, ErrNoProgram
+	}
+
+	bpfMap, err := m.mod.GetMap(mapName)
+	if err != nil {
+		return nil, err
+	}
+	return bpfPolicyMap{bpfMap: bpfMap}, nil
+}
+
+// mapEntries returns the entries of mapName, a map that is not a policy map, e.g. a per-task map.
+func (m *Manager) mapEntries(mapName string) (map[string][]byte, error) {
+	table, err := m.taskMap(mapName)
+	if err != nil {
+		return nil, err
+	}
+	return table.entries()
+}
+
+type listedBackendMap struct {
+	backendMap
+	lister entryLister
+}
+
+func (b listedBackendMap) entries() (map[string][]byte, error) {
+	return b.lister.Entries(b.name), nil
+}
+
+func (b bpfPolicyMap) entries() (map[string][]byte, error) {
+	entries := map[string][]byte{}
+	iter := b.bpfMap.Iterator()
+	for iter.Next() {
+		key := iter.Key()
+		value, err := b.bpfMap.GetValue(unsafe.Pointer(&key[0]))
+		if errors.Is(err, syscall.ENOENT) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries[string(key)] = value
+	}
+	return entries, iter.Err()
+}
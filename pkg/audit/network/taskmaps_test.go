@@ -0,0 +1,95 @@
+package network
+
+import (
+	"encoding/binary"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/bouhekitest"
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+const testTaskMap = "test_task_map"
+
+// writeTaskEntry writes the entry of tgid as a program would, with the start time of the task in nanoseconds.
+func writeTaskEntry(t *testing.T, maps *bouhekitest.Maps, tgid uint32, startTime uint64) {
+	key := make([]byte, 4)
+	binary.LittleEndian.PutUint32(key, tgid)
+	value := make([]byte, 16)
+	binary.LittleEndian.PutUint64(value, startTime*uint64(time.Second/USER_HZ))
+	assert.Nil(t, maps.Update(testTaskMap, key, value))
+}
+
+func TestSweepTaskMapsOfChurnedProcesses(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts thousands of processes")
+	}
+
+	maps := bouhekitest.NewMaps()
+	mgr := Manager{config: config.DefaultConfig(), backend: maps}
+	mgr.registerTaskMap(testTaskMap)
+
+	self := uint32(os.Getpid())
+	selfStart, err := mgr.taskStartTime(self)
+	assert.Nil(t, err)
+	writeTaskEntry(t, maps, self, selfStart)
+
+	const processes, batch = 2000, 250
+	for i := 0; i < processes; i++ {
+		cmd := exec.Command("true")
+		assert.Nil(t, cmd.Start())
+		// The exited task stays readable in /proc until it is waited for.
+		pid := uint32(cmd.Process.Pid)
+		start, err := mgr.taskStartTime(pid)
+		assert.Nil(t, err)
+		writeTaskEntry(t, maps, pid, start)
+		assert.Nil(t, cmd.Wait())
+
+		if (i+1)%batch == 0 {
+			_, err := mgr.sweepTaskMaps()
+			assert.Nil(t, err)
+			// Only the entry of the running test is left.
+			assert.Len(t, maps.Entries(testTaskMap), 1)
+		}
+	}
+
+	assert.True(t, maps.Has(testTaskMap, uintToKey(uint(self))))
+}
+
+func TestSweepTaskMapsDeletesRecycledPIDs(t *testing.T) {
+	maps := bouhekitest.NewMaps()
+	mgr := Manager{config: config.DefaultConfig(), backend: maps}
+	mgr.registerTaskMap(testTaskMap)
+	mgr.registerTaskMap(testTaskMap)
+
+	self := uint32(os.Getpid())
+	selfStart, err := mgr.taskStartTime(self)
+	assert.Nil(t, err)
+	// An entry written by a task that had the pid of the test before.
+	writeTaskEntry(t, maps, self, selfStart-1)
+
+	swept, err := mgr.sweepTaskMaps()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, swept)
+	assert.Empty(t, maps.Entries(testTaskMap))
+	assert.Equal(t, []string{testTaskMap}, mgr.registeredTaskMaps())
+}
+
+func TestTaskStartTime(t *testing.T) {
+	root := t.TempDir()
+	assert.Nil(t, os.MkdirAll(filepath.Join(root, "42"), 0755))
+	stat := "42 (a) b (c) S 1 42 42 0 -1 4194560 100 0 0 0 0 0 0 0 20 0 1 0 123456 1000 10\n"
+	assert.Nil(t, os.WriteFile(filepath.Join(root, "42", "stat"), []byte(stat), 0644))
+
+	mgr := Manager{procRoot: root}
+	start, err := mgr.taskStartTime(42)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(123456), start)
+
+	assert.True(t, mgr.isRunning(42, 123456*uint64(time.Second/USER_HZ)))
+	assert.False(t, mgr.isRunning(43, 123456*uint64(time.Second/USER_HZ)))
+}
@@ -0,0 +1,117 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"syscall"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/freeze"
+	"github.com/mrtc0/bouheki/pkg/jobs"
+	log "github.com/mrtc0/bouheki/pkg/log"
+)
+
+const (
+	// UNCLAIMED_SWEEP_DELAY is how long after the startup the entries of the adopted maps that no
+	// owner claimed are deleted, once the rule sets are applied too. It leaves the owners that
+	// write on their own schedule, e.g. the DNS proxy, the time to write their entries again.
+	UNCLAIMED_SWEEP_DELAY = 10 * time.Minute
+	// UNCLAIMED_SWEEP_RETRY_INTERVAL is how often the sweep is tried again while a rule set is
+	// being applied, or a freeze window rejects it.
+	UNCLAIMED_SWEEP_RETRY_INTERVAL = time.Minute
+)
+
+// sharedMap reports whether owners other than the config write to mapName: the rule sets, the
+// self exemption, the runtime rules and the addresses of the domains all write CIDR lists.
+func sharedMap(mapName string) bool {
+	if _, ok := denyShardBase(mapName); ok {
+		return true
+	}
+	switch mapName {
+	case ALLOWED_V4_CIDR_LIST_MAP_NAME, ALLOWED_V6_CIDR_LIST_MAP_NAME, DENIED_V4_CIDR_LIST_MAP_NAME, DENIED_V6_CIDR_LIST_MAP_NAME,
+		ALLOWED_V4_PROTOCOL_CIDR_LIST_MAP_NAME, ALLOWED_V6_PROTOCOL_CIDR_LIST_MAP_NAME, DENIED_V4_PROTOCOL_CIDR_LIST_MAP_NAME, DENIED_V6_PROTOCOL_CIDR_LIST_MAP_NAME,
+		ALLOWED_V4_ENTRY_CIDR_LIST_MAP_NAME, ALLOWED_V6_ENTRY_CIDR_LIST_MAP_NAME, DENIED_V4_ENTRY_CIDR_LIST_MAP_NAME, DENIED_V6_ENTRY_CIDR_LIST_MAP_NAME:
+		return true
+	default:
+		return false
+	}
+}
+
+// ruleSetsApplied reports whether every rule set has been applied completely.
+func (m *Manager) ruleSetsApplied() bool {
+	for _, set := range m.ruleSets {
+		if !set.Progress().Complete {
+			return false
+		}
+	}
+	return true
+}
+
+// AsyncUnclaimedSweep deletes the unclaimed entries of the adopted maps UNCLAIMED_SWEEP_DELAY
+// after the startup, once the rule sets are applied, until ctx is done.
+func (m *Manager) AsyncUnclaimedSweep(ctx context.Context) {
+	m.loadedMu.Lock()
+	unclaimed := m.unclaimed.len()
+	m.loadedMu.Unlock()
+	if unclaimed == 0 {
+		return
+	}
+
+	go func() {
+		if m.sleepContext(ctx, UNCLAIMED_SWEEP_DELAY) != nil {
+			return
+		}
+		for {
+			if m.ruleSetsApplied() {
+				err := m.runJob("unclaimed-sweep", freeze.CHANGE_CONFIG_RELOAD, func(ctx context.Context) error {
+					_, err := m.sweepUnclaimed()
+					return err
+				})
+				if err == nil || errors.Is(err, jobs.ErrStopped) {
+					return
+				}
+				if !errors.Is(err, jobs.ErrRejected) {
+					log.Error(err)
+				}
+			}
+			if m.sleepContext(ctx, UNCLAIMED_SWEEP_RETRY_INTERVAL) != nil {
+				return
+			}
+		}
+	}()
+}
+
+// sweepUnclaimed deletes the unclaimed entries that still have no owner, and forgets the others.
+// It returns how many entries it deleted.
+func (m *Manager) sweepUnclaimed() (int, error) {
+	m.loadedMu.Lock()
+	unclaimed := m.unclaimed
+	m.loadedMu.Unlock()
+
+	swept := 0
+	for i := len(policyMapOrder) - 1; i >= 0; i-- {
+		mapName := policyMapOrder[i]
+		for _, key := range sortedKeys(unclaimed[mapName]) {
+			if !m.configured(mapName, []byte(key)) && !m.ownedElsewhere(mapName, []byte(key)) {
+				table, err := m.policyMap(mapName)
+				if err != nil {
+					return swept, err
+				}
+				if err = table.DeleteKey([]byte(key)); err != nil && !errors.Is(err, syscall.ENOENT) {
+					return swept, fmt.Errorf("failed to delete the unclaimed entries of %s: %w", mapName, err)
+				}
+				m.mirror(mapOp{mapName: mapName, key: []byte(key)})
+				swept++
+			}
+
+			m.loadedMu.Lock()
+			m.unclaimed.delete(mapName, []byte(key))
+			m.loadedMu.Unlock()
+		}
+	}
+	if swept > 0 {
+		log.Info(fmt.Sprintf("Deleted %d entries of the adopted maps that no rule has.", swept))
+	}
+	return swept, nil
+}
@@ -0,0 +1,102 @@
+package network
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/mrtc0/bouheki/pkg/metrics"
+)
+
+var unresolvedDomainsGauge = metrics.NewGauge("network_unresolved_domains",
+	"Number of domains of network.domain whose every record failed to resolve on its last resolution.")
+
+// domainEntry is a domain of a list of network.domain, or of an entry of network.policies.
+type domainEntry struct {
+	domain string
+	// list is SNAPSHOT_LIST_ALLOW or SNAPSHOT_LIST_DENY, of the protocol lists of protocol
+	// unless it is PROTOCOL_ALL.
+	list     string
+	protocol uint8
+	// policy is the name of the entry of network.policies whose tag protocol is, if set.
+	policy string
+}
+
+// listName is the list of entry in the logs and the DNSRefreshStatus, e.g. "allow", "udp allow"
+// or "policies[curl] allow".
+func (e domainEntry) listName() string {
+	if e.policy != "" {
+		return "policies[" + e.policy + "] " + e.list
+	}
+	if e.protocol == PROTOCOL_ALL {
+		return e.list
+	}
+	return strings.ToLower(sockTypeToProtocolName(e.protocol)) + " " + e.list
+}
+
+// unresolvedDomains keeps whether the last resolution of each record of the domains succeeded.
+// A domain is unresolved while none of its records does. The zero value is ready to use.
+type unresolvedDomains struct {
+	mu      sync.Mutex
+	records map[domainEntry]map[uint16]bool
+}
+
+// record saves the outcome of the resolution of a record of entry. It returns whether entry is
+// unresolved, and whether it was not before.
+func (u *unresolvedDomains) record(entry domainEntry, recordType uint16, ok bool) (unresolved, changed bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.records == nil {
+		u.records = map[domainEntry]map[uint16]bool{}
+	}
+	if u.records[entry] == nil {
+		u.records[entry] = map[uint16]bool{}
+	}
+	before := u.isUnresolved(entry)
+	u.records[entry][recordType] = ok
+	unresolved = u.isUnresolved(entry)
+	unresolvedDomainsGauge.Set(float64(u.countLocked()))
+	return unresolved, unresolved != before
+}
+
+func (u *unresolvedDomains) isUnresolved(entry domainEntry) bool {
+	records := u.records[entry]
+	for _, ok := range records {
+		if ok {
+			return false
+		}
+	}
+	return len(records) > 0
+}
+
+func (u *unresolvedDomains) countLocked() int {
+	n := 0
+	for entry := range u.records {
+		if u.isUnresolved(entry) {
+			n++
+		}
+	}
+	return n
+}
+
+// contains reports whether entry is unresolved.
+func (u *unresolvedDomains) contains(entry domainEntry) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.isUnresolved(entry)
+}
+
+// count returns the number of unresolved domains.
+func (u *unresolvedDomains) count() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.countLocked()
+}
+
+// reset forgets the outcomes, before the domains of a new config are resolved.
+func (u *unresolvedDomains) reset() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.records = nil
+	unresolvedDomainsGauge.Set(0)
+}
@@ -0,0 +1,60 @@
+package network
+
+import (
+	"math/rand"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnresolvedDomainIsSkippedAndRetried(t *testing.T) {
+	resolver := aaaaResolver{"example.com": []net.IP{net.ParseIP("2001:db8::1")}}
+	mgr, maps, _ := newRefreshTestManager(t, 0, resolver)
+	mgr.config.RestrictedNetworkConfig.Domain.Allow = []string{"down.example.com", "example.com"}
+
+	assert.Nil(t, mgr.SetConfigToMap())
+	assert.Len(t, maps.Entries(ALLOWED_V6_CIDR_LIST_MAP_NAME), 1)
+	assert.Equal(t, 1, mgr.unresolved.count())
+	assert.Equal(t, float64(1), unresolvedDomainsGauge.Value())
+
+	// The refreshes write the addresses of the domain once it resolves.
+	resolver["down.example.com"] = []net.IP{net.ParseIP("2001:db8::2")}
+	s := newDNSScheduler(mgr, rand.New(rand.NewSource(1)).Float64)
+	assert.Nil(t, s.tick())
+	assert.Len(t, maps.Entries(ALLOWED_V6_CIDR_LIST_MAP_NAME), 2)
+	assert.Equal(t, 0, mgr.unresolved.count())
+	assert.Equal(t, float64(0), unresolvedDomainsGauge.Value())
+}
+
+func TestUnresolvedDomainFailsTheStartupWithStrict(t *testing.T) {
+	mgr, _, _ := newRefreshTestManager(t, 0, aaaaResolver{})
+	mgr.config.RestrictedNetworkConfig.Domain.Allow = []string{"down.example.com"}
+	mgr.config.RestrictedNetworkConfig.Domain.Strict = true
+
+	err := mgr.SetConfigToMap()
+	assert.NotNil(t, err)
+	assert.True(t, strings.Contains(err.Error(), "down.example.com (allow) does not resolve"), err)
+}
+
+func TestUnresolvedDomainsCountsTheDomainsWithoutAnyRecord(t *testing.T) {
+	u := unresolvedDomains{}
+	entry := domainEntry{domain: "example.com", list: SNAPSHOT_LIST_ALLOW, protocol: PROTOCOL_ALL}
+	udp := domainEntry{domain: "example.com", list: SNAPSHOT_LIST_ALLOW, protocol: protocolSockType("udp")}
+
+	unresolved, changed := u.record(entry, dns.TypeA, false)
+	assert.True(t, unresolved)
+	assert.True(t, changed)
+	unresolved, changed = u.record(entry, dns.TypeAAAA, true)
+	assert.False(t, unresolved)
+	assert.True(t, changed)
+	u.record(udp, dns.TypeA, false)
+	assert.Equal(t, 1, u.count())
+	assert.Equal(t, "udp allow", udp.listName())
+
+	u.reset()
+	assert.Equal(t, 0, u.count())
+	assert.False(t, u.contains(udp))
+}
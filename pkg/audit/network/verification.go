@@ -0,0 +1,140 @@
+package network
+
+import (
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/audit/helpers"
+	"github.com/mrtc0/bouheki/pkg/config"
+	log "github.com/mrtc0/bouheki/pkg/log"
+	"github.com/mrtc0/bouheki/pkg/metrics"
+)
+
+const (
+	VERIFICATION_MATCH        = "match"
+	VERIFICATION_MISMATCH     = "mismatch"
+	VERIFICATION_STALE_POLICY = "stale-policy"
+
+	// A disagreement is attributed to a policy change when the policy
+	// changed within this window before the event was checked.
+	VERIFICATION_STALE_WINDOW = 2 * time.Second
+)
+
+var (
+	verificationChecked = metrics.NewCounter("verification_checked_total",
+		"Number of kernel decisions re-evaluated in userspace.")
+	verificationMismatch = metrics.NewCounter("verification_mismatch_total",
+		"Number of kernel decisions that disagree with the userspace policy.")
+	verificationStalePolicy = metrics.NewCounter("verification_stale_policy_total",
+		"Number of disagreements explained by a policy change after the kernel decision.")
+)
+
+// verifier re-evaluates a sample of kernel decisions against the Manager's policy mirror.
+// A mismatch means the BPF program and Evaluate have diverged, or the maps
+// no longer contain what the Manager wrote to them.
+type verifier struct {
+	policy      *Policy
+	sampleRate  float64
+	staleWindow time.Duration
+	sample      func() float64
+	now         func() time.Time
+	// exePath returns the executable of the process pid, or "" if it is unknown.
+	exePath func(pid uint32) string
+}
+
+func newVerifier(policy *Policy, conf config.VerificationConfig) *verifier {
+	return &verifier{
+		policy:      policy,
+		sampleRate:  conf.SampleRate,
+		staleWindow: VERIFICATION_STALE_WINDOW,
+		sample:      rand.Float64,
+		now:         time.Now,
+		exePath:     procExePath,
+	}
+}
+
+// verify returns the verification result, or an empty string when the event was not sampled.
+func (v *verifier) verify(header eventHeader, body detectEvent) string {
+	if v.sample() >= v.sampleRate {
+		return ""
+	}
+
+	conn := eventToConnection(header, body)
+	// The events do not carry the executable, which is read once the process may have executed
+	// another one or exited: the path rules can only be verified for the long-running processes.
+	conn.ExePath = v.exePath(header.PID)
+
+	expected := v.policy.Evaluate(conn)
+	verificationChecked.Inc()
+
+	if expected.Denied == body.Denied() {
+		return VERIFICATION_MATCH
+	}
+
+	result := VERIFICATION_MISMATCH
+	generation, updatedAt := v.policy.Generation()
+	if !updatedAt.IsZero() && v.now().Sub(updatedAt) < v.staleWindow {
+		result = VERIFICATION_STALE_POLICY
+		verificationStalePolicy.Inc()
+	} else {
+		verificationMismatch.Inc()
+	}
+
+	trace := []string{}
+	_, steps := v.policy.Trace(conn)
+	for _, step := range steps {
+		if step.Result != TRACE_SKIPPED {
+			trace = append(trace, step.String())
+		}
+	}
+
+	verificationLog := log.VerificationLog{
+		RestrictedNetworkLog: newAuditLog(header, body),
+		Result:               result,
+		KernelDenied:         body.Denied(),
+		ExpectedDenied:       expected.Denied,
+		PolicyGeneration:     generation,
+		Trace:                trace,
+	}
+	verificationLog.Warn()
+
+	return result
+}
+
+// procExePath returns the executable of pid under PROC_ROOT, or "" if it is unknown.
+func procExePath(pid uint32) string {
+	exe, err := os.Readlink(filepath.Join(PROC_ROOT, strconv.FormatUint(uint64(pid), 10), "exe"))
+	if err != nil {
+		return ""
+	}
+	return exe
+}
+
+func eventToConnection(header eventHeader, body detectEvent) Connection {
+	conn := Connection{
+		Command: helpers.CommToString(header.Command),
+		UID:     header.UID,
+		GID:     header.GID,
+		// The events are only emitted for the processes in the target, so a container-only
+		// policy has already been satisfied by the kernel. Before schema version 8, they do not
+		// tell whether the task is in a container, which only target: all needs.
+		InContainer: body.InContainer() || header.SchemaVersion < 8,
+	}
+
+	switch body := body.(type) {
+	case detectEventIPv4:
+		conn.Addr = net.IP(body.DstIP[:])
+		conn.Port = body.DstPort
+		conn.SockType = body.SockType
+	case detectEventIPv6:
+		conn.Addr = net.IP(body.DstIP[:])
+		conn.Port = body.DstPort
+		conn.SockType = body.SockType
+	}
+
+	return conn
+}
@@ -0,0 +1,56 @@
+package network
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestVerifier(policy *Policy, now time.Time) *verifier {
+	v := newVerifier(policy, config.VerificationConfig{Enable: true, SampleRate: 1})
+	v.sample = func() float64 { return 0 }
+	v.now = func() time.Time { return now }
+	return v
+}
+
+func TestVerify(t *testing.T) {
+	header := eventHeader{EventType: BLOCKED_IPV4, UID: 1000, Command: [TASK_COMM_LEN]byte{'c', 'u', 'r', 'l'}}
+	blocked := detectEventIPv4{DstIP: [4]byte{192, 168, 0, 1}, Action: ACTION_BLOCKED, Verdict: VERDICT_DENY}
+	allowedByPolicy := detectEventIPv4{DstIP: [4]byte{10, 0, 0, 1}, Action: ACTION_BLOCKED, Verdict: VERDICT_DENY}
+
+	policyChangedAt := time.Date(2022, 4, 1, 0, 0, 0, 0, time.UTC)
+	newPolicyAt := func() *Policy {
+		policy := newTestPolicy(MODE_BLOCK, []string{"10.0.0.0/8"}, nil)
+		policy.SetClock(func() time.Time { return policyChangedAt })
+		policy.setModeAndTarget(MODE_BLOCK, TARGET_HOST)
+		return policy
+	}
+
+	t.Run("Agreeing decisions are a match", func(t *testing.T) {
+		v := newTestVerifier(newPolicyAt(), policyChangedAt.Add(time.Hour))
+		assert.Equal(t, VERIFICATION_MATCH, v.verify(header, blocked))
+	})
+
+	t.Run("Disagreeing decisions are a mismatch", func(t *testing.T) {
+		before := verificationMismatch.Value()
+		v := newTestVerifier(newPolicyAt(), policyChangedAt.Add(time.Hour))
+		assert.Equal(t, VERIFICATION_MISMATCH, v.verify(header, allowedByPolicy))
+		assert.Equal(t, before+1, verificationMismatch.Value())
+	})
+
+	t.Run("Disagreement right after a policy change is stale-policy", func(t *testing.T) {
+		before := verificationStalePolicy.Value()
+		v := newTestVerifier(newPolicyAt(), policyChangedAt.Add(time.Second))
+		assert.Equal(t, VERIFICATION_STALE_POLICY, v.verify(header, allowedByPolicy))
+		assert.Equal(t, before+1, verificationStalePolicy.Value())
+	})
+
+	t.Run("Events outside the sample are skipped", func(t *testing.T) {
+		v := newTestVerifier(newPolicyAt(), policyChangedAt.Add(time.Hour))
+		v.sampleRate = 0.1
+		v.sample = func() float64 { return 0.5 }
+		assert.Equal(t, "", v.verify(header, allowedByPolicy))
+	})
+}
@@ -0,0 +1,235 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/freeze"
+	"github.com/mrtc0/bouheki/pkg/jobs"
+	log "github.com/mrtc0/bouheki/pkg/log"
+	"github.com/mrtc0/bouheki/pkg/notify"
+)
+
+// WILDCARD_EXPIRE_INTERVAL is how often the addresses of the wildcard domains whose TTL expired
+// are removed from the maps.
+const WILDCARD_EXPIRE_INTERVAL = 10 * time.Second
+
+// wildcardAddress is an address the DNS proxy relayed for the names of wildcard domains.
+type wildcardAddress struct {
+	// patterns are the wildcard domains, e.g. *.example.com, a name resolved to the address for.
+	patterns map[string]bool
+	expires  time.Time
+}
+
+// wildcardTracker keeps the addresses of the wildcard domains of network.domain until the TTL
+// of the answer they were relayed in expires. The addresses of the other domains are kept in
+// resolved until the domain no longer resolves to them, but no resolution of bouheki tells
+// when a name below a wildcard domain moves. The zero value is ready to use.
+type wildcardTracker struct {
+	mu        sync.Mutex
+	addresses map[ledgerKey]*wildcardAddress
+}
+
+// add records key of mapName as an address of pattern until expires, or later if another
+// answer was relayed for it.
+func (t *wildcardTracker) add(mapName string, key []byte, pattern string, expires time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.addresses == nil {
+		t.addresses = map[ledgerKey]*wildcardAddress{}
+	}
+	id := ledgerKey{mapName: mapName, key: string(key)}
+	addr, ok := t.addresses[id]
+	if !ok {
+		addr = &wildcardAddress{patterns: map[string]bool{}}
+		t.addresses[id] = addr
+	}
+	addr.patterns[pattern] = true
+	if expires.After(addr.expires) {
+		addr.expires = expires
+	}
+}
+
+// has reports whether key of mapName is an address of a wildcard domain.
+func (t *wildcardTracker) has(mapName string, key []byte) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.addresses[ledgerKey{mapName: mapName, key: string(key)}]
+	return ok
+}
+
+// wildcardExpiry is an address whose TTL expired, and the wildcard domains it was relayed for.
+type wildcardExpiry struct {
+	ledgerKey
+	patterns []string
+}
+
+// expire forgets the addresses that expired at now and returns them, in the order of their keys.
+func (t *wildcardTracker) expire(now time.Time) []wildcardExpiry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	expired := []wildcardExpiry{}
+	for id, addr := range t.addresses {
+		if now.Before(addr.expires) {
+			continue
+		}
+		delete(t.addresses, id)
+		patterns := []string{}
+		for pattern := range addr.patterns {
+			patterns = append(patterns, pattern)
+		}
+		sort.Strings(patterns)
+		expired = append(expired, wildcardExpiry{ledgerKey: id, patterns: patterns})
+	}
+	sort.Slice(expired, func(i, j int) bool {
+		if expired[i].mapName != expired[j].mapName {
+			return expired[i].mapName < expired[j].mapName
+		}
+		return expired[i].key < expired[j].key
+	})
+	return expired
+}
+
+// domains returns the wildcard domains each address was relayed for, by map and key.
+func (t *wildcardTracker) domains() map[ledgerKey][]string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	domains := map[ledgerKey][]string{}
+	for id, addr := range t.addresses {
+		for pattern := range addr.patterns {
+			domains[id] = append(domains[id], pattern)
+		}
+		sort.Strings(domains[id])
+	}
+	return domains
+}
+
+// wildcardList is a list of network.domain, and the maps its addresses are written to.
+type wildcardList struct {
+	domainList
+	v4MapName string
+	v6MapName string
+}
+
+// wildcardLists returns the lists of domain, each with the maps of its addresses.
+func wildcardLists(domain config.DomainConfig) []wildcardList {
+	lists := []wildcardList{
+		{domainList: domainList{list: SNAPSHOT_LIST_ALLOW, protocol: PROTOCOL_ALL, domains: domain.Allow}, v4MapName: ALLOWED_V4_CIDR_LIST_MAP_NAME, v6MapName: ALLOWED_V6_CIDR_LIST_MAP_NAME},
+		{domainList: domainList{list: SNAPSHOT_LIST_DENY, protocol: PROTOCOL_ALL, domains: domain.Deny}, v4MapName: DENIED_V4_CIDR_LIST_MAP_NAME, v6MapName: DENIED_V6_CIDR_LIST_MAP_NAME},
+	}
+	for _, list := range protocolDomainLists(domain) {
+		if list.list == SNAPSHOT_LIST_DENY {
+			lists = append(lists, wildcardList{domainList: list, v4MapName: DENIED_V4_PROTOCOL_CIDR_LIST_MAP_NAME, v6MapName: DENIED_V6_PROTOCOL_CIDR_LIST_MAP_NAME})
+		} else {
+			lists = append(lists, wildcardList{domainList: list, v4MapName: ALLOWED_V4_PROTOCOL_CIDR_LIST_MAP_NAME, v6MapName: ALLOWED_V6_PROTOCOL_CIDR_LIST_MAP_NAME})
+		}
+	}
+	return lists
+}
+
+// updateWildcardDomains writes the addresses of answer, relayed by the DNS proxy, to the lists
+// of the wildcard domains its name is below.
+func (m *Manager) updateWildcardDomains(answer *DNSAnswer) error {
+	for _, list := range wildcardLists(m.config.RestrictedNetworkConfig.Domain) {
+		for _, pattern := range list.domains {
+			if !config.MatchWildcardDomain(pattern, answer.Domain) {
+				continue
+			}
+			if err := m.writeWildcardList(pattern, answer, list); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeWildcardList writes the addresses of answer to list as addresses of pattern until its TTL,
+// at least network.domain.wildcard_min_ttl, expires.
+func (m *Manager) writeWildcardList(pattern string, answer *DNSAnswer, list wildcardList) error {
+	addresses, err := domainNameToBPFMapKey(answer.Domain, answer.Addresses, list.protocol)
+	if err != nil {
+		return err
+	}
+
+	ttl := time.Duration(answer.TTL) * time.Second
+	if min := m.config.RestrictedNetworkConfig.Domain.WildcardMinTTL; ttl < min {
+		ttl = min
+	}
+	expires := m.now().Add(ttl)
+
+	change := notify.DNSRuleChange{Domain: pattern, List: list.list}
+	for _, addr := range addresses {
+		mapName := list.v4MapName
+		if addr.isV6address() {
+			mapName = list.v6MapName
+		}
+		if m.familyDisabled(mapName) {
+			continue
+		}
+
+		n := &net.IPNet{IP: addr.address, Mask: addr.cidrMask}
+		if !m.Policy().hasCIDR(mapName, list.protocol, n) {
+			change.Added = append(change.Added, n.String())
+		}
+		addr.monitored = m.monitoredDomain(pattern)
+		if err := m.writeCIDR(addr, mapName); err != nil {
+			return err
+		}
+		m.wildcards.add(mapName, addr.key, pattern, expires)
+		m.resolvedChanged()
+		log.Debug(fmt.Sprintf("%s (%s): added %s of %s until %s", pattern, list.listName(), n, answer.Domain, expires.Format(time.RFC3339)))
+	}
+	m.publishDNSRuleChange(change)
+	return nil
+}
+
+// listName is the list in the logs, as domainEntry.listName.
+func (l wildcardList) listName() string {
+	return domainEntry{list: l.list, protocol: l.protocol}.listName()
+}
+
+// wildcardAddress reports whether a wildcard domain has written key to mapName.
+func (m *Manager) wildcardAddress(mapName string, key []byte) bool {
+	return m.wildcards.has(mapName, key)
+}
+
+// expireWildcards removes the addresses of the wildcard domains once their TTL expires.
+func (m *Manager) expireWildcards() {
+	for {
+		m.sleep(WILDCARD_EXPIRE_INTERVAL)
+		err := m.runJob("wildcard-expire", freeze.CHANGE_DNS_REFRESH, func(ctx context.Context) error {
+			m.removeExpiredWildcards(m.now())
+			return nil
+		})
+		if err == jobs.ErrStopped {
+			return
+		}
+	}
+}
+
+// removeExpiredWildcards deletes the addresses of the wildcard domains that expired at now,
+// unless the config, a rule set, the self exemption or another domain has written them too.
+func (m *Manager) removeExpiredWildcards(now time.Time) {
+	for _, entry := range m.wildcards.expire(now) {
+		if err := m.cidrListDeleteKey(entry.mapName, []byte(entry.key)); err != nil {
+			log.Error(err)
+			continue
+		}
+		protocol, n := cidrKeyToIPNet(entry.mapName, []byte(entry.key))
+		if m.Policy().hasCIDR(entry.mapName, protocol, n) {
+			continue
+		}
+		for _, pattern := range entry.patterns {
+			log.Debug(fmt.Sprintf("%s: removed %s, whose TTL expired", pattern, n))
+			m.publishDNSRuleChange(notify.DNSRuleChange{Domain: pattern, List: listOfMap(entry.mapName), Removed: []string{n.String()}})
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package network
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/bouhekitest"
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func newWildcardTestManager(t *testing.T) (*Manager, *bouhekitest.Clock) {
+	conf := config.DefaultConfig()
+	conf.RestrictedNetworkConfig.Mode = "block"
+	conf.RestrictedNetworkConfig.CIDR.Allow = []string{"192.0.2.9/32"}
+	conf.RestrictedNetworkConfig.Domain.Allow = []string{"*.s3.amazonaws.com"}
+	conf.RestrictedNetworkConfig.Domain.Protocols = []config.ProtocolRulesConfig{{Protocol: config.PROTOCOL_UDP, Deny: []string{"*.example.org"}}}
+	conf.DNSProxyConfig = config.DNSProxyConfig{Enable: true, Upstreams: []string{"192.0.2.53"}}
+	clock := bouhekitest.NewClock(time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC))
+	mgr, err := NewManager(conf, WithMapBackend(bouhekitest.NewMaps()), WithClock(clock))
+	assert.Nil(t, err)
+	t.Cleanup(mgr.Close)
+	assert.Nil(t, mgr.SetConfigToMap())
+	return mgr, clock
+}
+
+func relayed(name string, ttl uint32, addresses ...string) *DNSAnswer {
+	answer := &DNSAnswer{Domain: name, TTL: ttl}
+	for _, address := range addresses {
+		answer.Addresses = append(answer.Addresses, net.ParseIP(address))
+	}
+	return answer
+}
+
+func TestWildcardDomainsMatchTheNamesBelowThem(t *testing.T) {
+	mgr, _ := newWildcardTestManager(t)
+
+	assert.Nil(t, mgr.updateWildcardDomains(relayed("bucket.s3.amazonaws.com.", 300, "192.0.2.1")))
+	assert.Nil(t, mgr.updateWildcardDomains(relayed("a.bucket.s3.amazonaws.com.", 300, "192.0.2.2")))
+	// The apex is not matched unless it is listed too.
+	assert.Nil(t, mgr.updateWildcardDomains(relayed("s3.amazonaws.com.", 300, "192.0.2.3")))
+	assert.Nil(t, mgr.updateWildcardDomains(relayed("s3.amazonaws.com.example.net.", 300, "192.0.2.4")))
+
+	assert.True(t, allowed(mgr, "192.0.2.1"))
+	assert.True(t, allowed(mgr, "192.0.2.2"))
+	assert.False(t, allowed(mgr, "192.0.2.3"))
+	assert.False(t, allowed(mgr, "192.0.2.4"))
+
+	assert.Nil(t, mgr.updateWildcardDomains(relayed("www.example.org.", 300, "198.51.100.1")))
+	n := &net.IPNet{IP: net.ParseIP("198.51.100.1").To4(), Mask: net.CIDRMask(32, 32)}
+	assert.True(t, mgr.Policy().hasCIDR(DENIED_V4_PROTOCOL_CIDR_LIST_MAP_NAME, protocolSockType(config.PROTOCOL_UDP), n))
+	assert.False(t, mgr.Policy().hasCIDR(DENIED_V4_CIDR_LIST_MAP_NAME, PROTOCOL_ALL, n))
+}
+
+func TestWildcardDomainsExpireWithTheirTTL(t *testing.T) {
+	mgr, clock := newWildcardTestManager(t)
+
+	// A TTL below network.domain.wildcard_min_ttl is raised to it.
+	assert.Nil(t, mgr.updateWildcardDomains(relayed("a.s3.amazonaws.com.", 5, "192.0.2.1")))
+	assert.Nil(t, mgr.updateWildcardDomains(relayed("b.s3.amazonaws.com.", 300, "192.0.2.2", "192.0.2.9")))
+
+	clock.Advance(time.Minute)
+	mgr.removeExpiredWildcards(clock.Now())
+	assert.False(t, allowed(mgr, "192.0.2.1"))
+	assert.True(t, allowed(mgr, "192.0.2.2"))
+
+	// Another answer for an address extends it.
+	assert.Nil(t, mgr.updateWildcardDomains(relayed("c.s3.amazonaws.com.", 600, "192.0.2.2")))
+	clock.Advance(5 * time.Minute)
+	mgr.removeExpiredWildcards(clock.Now())
+	assert.True(t, allowed(mgr, "192.0.2.2"))
+
+	clock.Advance(5 * time.Minute)
+	mgr.removeExpiredWildcards(clock.Now())
+	assert.False(t, allowed(mgr, "192.0.2.2"))
+	// The address of the config stays.
+	assert.True(t, allowed(mgr, "192.0.2.9"))
+}
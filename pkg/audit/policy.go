@@ -0,0 +1,224 @@
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/audit/network"
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/errkind"
+	"github.com/urfave/cli/v2"
+)
+
+var stateDirFlag = cli.StringFlag{
+	Name:    "state-dir",
+	Value:   config.DEFAULT_POLICY_SNAPSHOT_DIR,
+	Usage:   "the network.policy_snapshot.state_dir of the running bouheki",
+	EnvVars: []string{"BOUHEKI_STATE_DIR"},
+}
+
+// policyCommand reads the versions of the policy the network events were decided by.
+func policyCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "policy",
+		Usage: "resolve the PolicyDigest of the network events to the rules, explain their evaluation, generate and replay them",
+		Subcommands: []*cli.Command{
+			{
+				Name:  "list",
+				Usage: "list the kept policy versions, most recent first",
+				Flags: []cli.Flag{&stateDirFlag},
+				Action: func(c *cli.Context) error {
+					return printPolicyVersions(c.App.Writer, c.String("state-dir"))
+				},
+			},
+			{
+				Name:      "show",
+				Usage:     "print the policy version of a digest as JSON",
+				ArgsUsage: "<digest>",
+				Flags:     []cli.Flag{&stateDirFlag},
+				Action: func(c *cli.Context) error {
+					if c.NArg() != 1 {
+						return errkind.New(errkind.Config, errors.New("policy show needs the digest of an event"))
+					}
+					return printPolicyVersion(c.App.Writer, c.String("state-dir"), c.Args().First())
+				},
+			},
+			{
+				Name:  "explain-order",
+				Usage: "print the order the checks of the config file are evaluated in",
+				Action: func(c *cli.Context) error {
+					conf, err := loadConfig(c)
+					if err != nil {
+						return err
+					}
+
+					printEvaluationOrder(c.App.Writer, network.ExplainOrder(conf))
+					return nil
+				},
+			},
+			{
+				Name:      "generate",
+				Usage:     "print the network allow lists of the connections learned by network.mode: learning",
+				ArgsUsage: "[<learned-connections.json>...]",
+				Flags: []cli.Flag{
+					&cli.Uint64Flag{Name: "min-connections", Value: 1, Usage: "leave out the tuples seen fewer times"},
+				},
+				Action: func(c *cli.Context) error {
+					paths := c.Args().Slice()
+					if len(paths) == 0 {
+						conf, err := loadConfig(c)
+						if err != nil {
+							return err
+						}
+						paths = []string{network.LearnedConnectionsPath(conf.RestrictedNetworkConfig.Learning.StateDir)}
+					}
+					return generatePolicy(c.App.Writer, paths, c.Uint64("min-connections"))
+				},
+			},
+			{
+				Name:  "replay",
+				Usage: "decide the network events of a JSON log again with a candidate config, and fail if it blocks a connection they permitted",
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "events", Required: true, Usage: "the log of the events, written with log.format: json"},
+					&cli.StringFlag{Name: "config", Required: true, Usage: "the candidate config file"},
+					&cli.StringFlag{Name: "format", Value: DUMP_FORMAT_TEXT, Usage: "the format, text or json"},
+				},
+				Action: func(c *cli.Context) error {
+					format := c.String("format")
+					if format != DUMP_FORMAT_TEXT && format != DUMP_FORMAT_JSON {
+						return errkind.Errorf(errkind.Config, "the format is %s or %s, not %q", DUMP_FORMAT_TEXT, DUMP_FORMAT_JSON, format)
+					}
+					conf, err := loadConfig(c)
+					if err != nil {
+						return err
+					}
+					return replayPolicy(c.App.Writer, conf, c.String("config"), c.String("events"), format)
+				},
+			},
+		},
+	}
+}
+
+func printPolicyVersions(w io.Writer, stateDir string) error {
+	versions, err := network.ListPolicyVersions(stateDir)
+	if os.IsNotExist(err) || (err == nil && len(versions) == 0) {
+		fmt.Fprintf(w, "No policy version is kept in %s.\n", stateDir)
+		return nil
+	}
+	if err != nil {
+		return errkind.New(errkind.Runtime, err)
+	}
+
+	for _, version := range versions {
+		fmt.Fprintf(w, "%s  %s\n", version.Digest, version.RecordedAt.Local().Format(time.RFC3339))
+	}
+	return nil
+}
+
+func printPolicyVersion(w io.Writer, stateDir, digest string) error {
+	version, err := network.LoadPolicyVersion(stateDir, digest)
+	if err != nil {
+		return errkind.New(errkind.Runtime, err)
+	}
+
+	data, err := json.MarshalIndent(version, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(w, string(data))
+	return nil
+}
+
+// generatePolicy prints the network section of the connections learned in the files, merged.
+func generatePolicy(w io.Writer, paths []string, minConnections uint64) error {
+	sets := []*network.LearnedConnections{}
+	for _, path := range paths {
+		learned, err := network.ReadLearnedConnections(path)
+		if err != nil {
+			return errkind.New(errkind.Runtime, err)
+		}
+		sets = append(sets, learned)
+	}
+
+	connections := network.MergeLearnedConnections(sets...)
+	data, err := network.MarshalGeneratedPolicy(network.GeneratePolicy(connections, minConnections), len(connections))
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// replayPolicy prints how conf, the candidate config at path, decides the network events of the
+// log at events differently, and fails if it newly blocks any, so that it can gate a change.
+func replayPolicy(w io.Writer, conf *config.Config, path, events, format string) error {
+	file, err := os.Open(events)
+	if err != nil {
+		return errkind.New(errkind.Runtime, err)
+	}
+	defer file.Close()
+	logged, err := network.ReadReplayEvents(file)
+	if err != nil {
+		return errkind.New(errkind.Runtime, fmt.Errorf("%s: %w", events, err))
+	}
+
+	report, err := network.Replay(conf, logged)
+	if err != nil {
+		return err
+	}
+	if format == DUMP_FORMAT_JSON {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			return err
+		}
+	} else {
+		printReplayReport(w, report, path, events)
+	}
+
+	if regressions := report.Regressions(); regressions > 0 {
+		return errkind.Errorf(errkind.Config, "%s blocks %d events of %s that were permitted", path, regressions, events)
+	}
+	return nil
+}
+
+func printReplayReport(w io.Writer, report *network.ReplayReport, path, events string) {
+	fmt.Fprintf(w, "Replayed %d events of %s with %s: %d unchanged, %d skipped.\n", report.Replayed, events, path, report.Unchanged, report.Skipped)
+	for _, section := range []struct {
+		title  string
+		deltas []network.ReplayDelta
+	}{
+		{"newly blocked", report.NewlyBlocked},
+		{"newly allowed", report.NewlyAllowed},
+	} {
+		if len(section.deltas) == 0 {
+			fmt.Fprintf(w, "%s: none\n", section.title)
+			continue
+		}
+		fmt.Fprintf(w, "%s:\n", section.title)
+		fmt.Fprintf(w, "  %8s  %-16s %-40s %s\n", "events", "comm", "destination", "rule")
+		for _, delta := range section.deltas {
+			destination := fmt.Sprintf("%s/%s", net.JoinHostPort(delta.Destination, strconv.Itoa(int(delta.Port))), delta.Protocol)
+			fmt.Fprintf(w, "  %8d  %-16s %-40s %s\n", delta.Events, delta.Comm, destination, delta.Rule)
+		}
+	}
+}
+
+// printEvaluationOrder prints the checks, first to last. A connection is decided by the first
+// check that denies it, unless a later one overrides it.
+func printEvaluationOrder(w io.Writer, checks []network.OrderedCheck) {
+	fmt.Fprintln(w, "Connections are evaluated by these checks, in order:")
+	for i, check := range checks {
+		semantics := check.Semantics
+		if check.KernelOnly {
+			semantics += " (kernel only)"
+		}
+		fmt.Fprintf(w, "  %2d. %-24s %-7s  %s\n", i+1, check.Name, check.Status, semantics)
+	}
+}
@@ -0,0 +1,124 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/audit/network"
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/errkind"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrintPolicyVersions(t *testing.T) {
+	dir := t.TempDir()
+
+	var buf bytes.Buffer
+	assert.Nil(t, printPolicyVersions(&buf, dir))
+	assert.Equal(t, "No policy version is kept in "+dir+".\n", buf.String())
+
+	digest := strings.Repeat("ab", 32)
+	at := time.Date(2026, 10, 14, 12, 0, 0, 0, time.Local)
+	data, err := json.Marshal(network.PolicyVersion{Version: network.POLICY_VERSION_FORMAT, Digest: digest, RecordedAt: at, Mode: "block"})
+	assert.Nil(t, err)
+	path := filepath.Join(dir, network.POLICY_VERSIONS_DIR, digest+".json")
+	assert.Nil(t, os.MkdirAll(filepath.Dir(path), 0700))
+	assert.Nil(t, os.WriteFile(path, data, 0600))
+	assert.Nil(t, os.Chtimes(path, at, at))
+
+	buf.Reset()
+	assert.Nil(t, printPolicyVersions(&buf, dir))
+	assert.Equal(t, digest+"  "+at.Format(time.RFC3339)+"\n", buf.String())
+
+	buf.Reset()
+	assert.Nil(t, printPolicyVersion(&buf, dir, digest[:12]))
+	version := network.PolicyVersion{}
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &version))
+	assert.Equal(t, "block", version.Mode)
+
+	assert.NotNil(t, printPolicyVersion(&buf, dir, strings.Repeat("cd", 32)))
+}
+
+func TestPrintEvaluationOrder(t *testing.T) {
+	conf := config.DefaultConfig()
+	conf.RestrictedNetworkConfig.Command.Deny = []string{"wget"}
+
+	var buf bytes.Buffer
+	printEvaluationOrder(&buf, network.ExplainOrder(conf))
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	assert.Equal(t, "Connections are evaluated by these checks, in order:", lines[0])
+	assert.Equal(t, "   1. scope.family             active   Only the IPv4 and IPv6 connections are restricted. (kernel only)", lines[1])
+	assert.Contains(t, buf.String(), "  12. command.deny             active   A command in network.command.deny or matching one of its patterns, or an executable in network.command.deny_paths, is denied. A command in mode: monitor does not deny, it reports the connection if nothing else denies it.\n")
+	assert.Contains(t, buf.String(), "  13. uid.deny                 skipped  A uid in network.uid.deny is denied.\n")
+}
+
+func TestGeneratePolicy(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, connections ...network.LearnedConnection) string {
+		data, err := json.Marshal(network.LearnedConnections{Version: network.LEARNED_CONNECTIONS_VERSION, Connections: connections})
+		assert.Nil(t, err)
+		path := filepath.Join(dir, name)
+		assert.Nil(t, os.WriteFile(path, data, 0600))
+		return path
+	}
+	// The files of two hosts are merged, so that a tuple seen once on each is kept.
+	first := write("a.json", network.LearnedConnection{Comm: "curl", UID: 1000, Destination: "192.0.2.0/24", Port: 443, Connections: 1})
+	second := write("b.json",
+		network.LearnedConnection{Comm: "curl", UID: 1000, Destination: "192.0.2.0/24", Port: 443, Connections: 1},
+		network.LearnedConnection{Comm: "nc", UID: 0, Destination: "198.51.100.0/24", Port: 4444, Connections: 1})
+
+	var buf bytes.Buffer
+	assert.Nil(t, generatePolicy(&buf, []string{first, second}, 2))
+	assert.Equal(t, `# The allow lists of 2 learned connections. Review them, and run them in
+# mode: monitor before mode: block.
+network:
+  cidr:
+    allow:
+    - 192.0.2.0/24
+  command:
+    allow:
+    - curl
+  uid:
+    allow:
+    - "1000"
+  ports:
+    allow:
+    - "443"
+`, buf.String())
+
+	assert.NotNil(t, generatePolicy(&buf, []string{filepath.Join(dir, "missing.json")}, 1))
+}
+
+func TestReplayPolicy(t *testing.T) {
+	events := filepath.Join(t.TempDir(), "audit.jsonl")
+	assert.Nil(t, os.WriteFile(events, []byte(`{"Action":"MONITOR","Addr":"10.1.2.3","Comm":"psql","Port":5432,"Protocol":"TCP","msg":"Traffic is trapped in the filter."}
+{"Action":"MONITOR","Addr":"10.2.3.4","Comm":"psql","Port":5432,"Protocol":"TCP","Count":3,"msg":"Traffic is trapped in the filter."}
+`), 0600))
+	conf := config.DefaultConfig()
+	conf.RestrictedNetworkConfig.CIDR.Allow = []string{"10.2.0.0/16"}
+
+	// A connection the events permitted that the candidate denies fails the replay.
+	var buf bytes.Buffer
+	err := replayPolicy(&buf, conf, "new.yaml", events, DUMP_FORMAT_TEXT)
+	assert.Equal(t, errkind.Config, errkind.KindOf(err))
+	assert.Equal(t, "Replayed 4 events of "+events+" with new.yaml: 3 unchanged, 0 skipped.\n"+
+		"newly blocked:\n"+
+		"    events  comm             destination                              rule\n"+
+		"         1  psql             10.1.2.3:5432/tcp                        network.cidr.allow does not list 10.1.2.3\n"+
+		"newly allowed: none\n", buf.String())
+
+	conf.RestrictedNetworkConfig.CIDR.Allow = []string{"10.0.0.0/8"}
+	buf.Reset()
+	assert.Nil(t, replayPolicy(&buf, conf, "new.yaml", events, DUMP_FORMAT_JSON))
+	var report network.ReplayReport
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &report))
+	assert.Equal(t, uint64(4), report.Unchanged)
+	assert.Empty(t, report.NewlyBlocked)
+
+	assert.Equal(t, errkind.Runtime, errkind.KindOf(replayPolicy(&buf, conf, "new.yaml", events+".missing", DUMP_FORMAT_TEXT)))
+}
@@ -0,0 +1,158 @@
+package audit
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/audit/network"
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/errkind"
+	"github.com/urfave/cli/v2"
+)
+
+// REPORT_BREAKDOWN_SIZE is the number of least covered comms, uids and tags in the report.
+const REPORT_BREAKDOWN_SIZE = 10
+
+func reportCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "report",
+		Usage: "report how much of the observed traffic the allow lists permit, to decide when to switch to block",
+		Flags: []cli.Flag{
+			&cli.DurationFlag{Name: "stale-rules", Usage: "only list the rules that did not match a connection within this duration, e.g. 720h, recorded by network.rule_hits"},
+		},
+		Action: func(c *cli.Context) error {
+			conf, err := loadConfig(c)
+			if err != nil {
+				return err
+			}
+			if after := c.Duration("stale-rules"); after > 0 {
+				return printStaleRules(c.App.Writer, conf, after, time.Now())
+			}
+			if !conf.Metrics.Enable {
+				return errMetricsDisabled
+			}
+
+			status, err := fetchCoverageStatus(conf.Metrics.Listen)
+			if err != nil {
+				return errkind.New(errkind.Runtime, err)
+			}
+
+			printCoverageReport(c.App.Writer, status)
+
+			if conf.RestrictedNetworkConfig.OutcomeHistory.Enable {
+				history, err := network.ReadOutcomeHistory(conf.RestrictedNetworkConfig.OutcomeHistory.StateDir)
+				if err != nil && !os.IsNotExist(err) {
+					return errkind.New(errkind.Runtime, err)
+				}
+				if history != nil {
+					printNewDestinations(c.App.Writer, history, time.Now())
+				}
+			}
+			return nil
+		},
+	}
+}
+
+// printStaleRules prints the rules of conf that did not match a connection within after. The
+// rules are only listed for review, never removed.
+func printStaleRules(w io.Writer, conf *config.Config, after time.Duration, now time.Time) error {
+	hits := conf.RestrictedNetworkConfig.RuleHits
+	if !hits.Enable {
+		return errkind.New(errkind.Config, errors.New("the last hits of the rules are not recorded, enable network.rule_hits"))
+	}
+	recorded, err := network.ReadRuleHits(hits.StateDir)
+	if err != nil && !os.IsNotExist(err) {
+		return errkind.New(errkind.Runtime, err)
+	}
+	var rules []network.RuleHit
+	if recorded != nil {
+		rules = recorded.Rules
+	}
+
+	stale := network.StaleRules(network.ExportPolicy(conf), rules, now, after)
+	if len(stale) == 0 {
+		fmt.Fprintf(w, "Every rule matched a connection in the last %s.\n", after)
+		return nil
+	}
+	fmt.Fprintf(w, "%d rules did not match a connection in the last %s:\n", len(stale), after)
+	for _, rule := range stale {
+		last := "never"
+		if !rule.LastHit.IsZero() {
+			last = rule.LastHit.Local().Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "  %-32s %-40s %s\n", rule.List, rule.Entry, last)
+	}
+	return nil
+}
+
+// printCoverageReport prints the coverage of every window, then the trend and
+// the least covered breakdowns of the longest window.
+func printCoverageReport(w io.Writer, status *network.CoverageStatus) {
+	printCoverageSummary(w, status)
+	fmt.Fprintf(w, "excluded by deny lists: %d\n", status.Excluded)
+
+	if len(status.Windows) == 0 {
+		return
+	}
+	longest := status.Windows[0]
+	for _, window := range status.Windows[1:] {
+		if windowLength(window) > windowLength(longest) {
+			longest = window
+		}
+	}
+
+	fmt.Fprintf(w, "\ntrend (%s):\n", longest.Window)
+	for _, point := range longest.Trend {
+		fmt.Fprintf(w, "  %s  %s\n", point.Start.Format(time.RFC3339), formatCoverage(point.CoverageCounts))
+	}
+
+	for _, breakdown := range []struct {
+		name   string
+		counts map[string]network.CoverageCounts
+	}{
+		{name: "comm", counts: longest.Comm},
+		{name: "uid", counts: longest.UID},
+		{name: "tag", counts: longest.Tag},
+	} {
+		fmt.Fprintf(w, "\nleast covered %s (%s):\n", breakdown.name, longest.Window)
+		for _, key := range leastCovered(breakdown.counts, REPORT_BREAKDOWN_SIZE) {
+			fmt.Fprintf(w, "  %-16s %s\n", key, formatCoverage(breakdown.counts[key]))
+		}
+	}
+
+	if longest.Overall.Observed > 0 && longest.Overall.Permitted == longest.Overall.Observed {
+		fmt.Fprintf(w, "\nThe allow lists permit every connection observed in the last %s.\n", longest.Window)
+	}
+}
+
+func windowLength(window network.CoverageWindow) time.Duration {
+	d, _ := time.ParseDuration(window.Window)
+	return d
+}
+
+// leastCovered returns up to n keys with the lowest coverage, the most observed first on a tie.
+func leastCovered(counts map[string]network.CoverageCounts, n int) []string {
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := counts[keys[i]], counts[keys[j]]
+		if a.Ratio() != b.Ratio() {
+			return a.Ratio() < b.Ratio()
+		}
+		if a.Observed != b.Observed {
+			return a.Observed > b.Observed
+		}
+		return keys[i] < keys[j]
+	})
+
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+	return keys
+}
@@ -0,0 +1,42 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/audit/network"
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrintStaleRules(t *testing.T) {
+	conf := config.DefaultConfig()
+	conf.RestrictedNetworkConfig.CIDR.Allow = []string{"10.0.0.0/8", "192.168.0.0/16"}
+
+	var buf bytes.Buffer
+	assert.NotNil(t, printStaleRules(&buf, conf, time.Hour, time.Now()))
+
+	dir := t.TempDir()
+	conf.RestrictedNetworkConfig.RuleHits = config.RuleHitsConfig{Enable: true, StateDir: dir, WriteInterval: time.Minute}
+	now := time.Date(2026, 10, 14, 12, 0, 0, 0, time.Local)
+	hits := network.RuleHits{Version: network.RULE_HITS_VERSION, Updated: now, Rules: []network.RuleHit{
+		{List: "network.cidr.allow", Entry: "10.0.0.0/8", LastHit: now.Add(-time.Hour)},
+		{List: "network.cidr.allow", Entry: "192.168.0.0/16", LastHit: now.Add(-31 * 24 * time.Hour)},
+	}}
+	data, err := json.Marshal(hits)
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(network.RuleHitsPath(dir), data, 0600))
+
+	assert.Nil(t, printStaleRules(&buf, conf, 30*24*time.Hour, now))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equal(t, 2, len(lines))
+	assert.Equal(t, []string{"network.cidr.allow", "192.168.0.0/16", now.Add(-31 * 24 * time.Hour).Format(time.RFC3339)}, strings.Fields(lines[1]))
+
+	buf.Reset()
+	assert.Nil(t, printStaleRules(&buf, conf, 60*24*time.Hour, now))
+	assert.Contains(t, buf.String(), "Every rule matched")
+}
@@ -0,0 +1,144 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/audit/network"
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/control"
+	"github.com/mrtc0/bouheki/pkg/errkind"
+	"github.com/urfave/cli/v2"
+)
+
+// The formats of bouheki rules dump, config validate and policy replay.
+const (
+	DUMP_FORMAT_TEXT = "text"
+	DUMP_FORMAT_JSON = "json"
+)
+
+// rulesCommand reads the hits of the rules recorded by network.rule_hits, and the maps of the
+// running bouheki.
+func rulesCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "rules",
+		Usage: "inspect the rules of the config file and of the running bouheki",
+		Subcommands: []*cli.Command{
+			{
+				Name:  "stats",
+				Usage: "print how many connections every rule of the config file matched, recorded by network.rule_hits",
+				Action: func(c *cli.Context) error {
+					conf, err := loadConfig(c)
+					if err != nil {
+						return err
+					}
+					return printRuleStats(c.App.Writer, conf)
+				},
+			},
+			{
+				Name:  "dump",
+				Usage: "print the entries of the maps of the running bouheki, decoded, on the control socket",
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "format", Value: DUMP_FORMAT_TEXT, Usage: "the format, text or json"},
+				},
+				Action: func(c *cli.Context) error {
+					format := c.String("format")
+					if format != DUMP_FORMAT_TEXT && format != DUMP_FORMAT_JSON {
+						return errkind.Errorf(errkind.Config, "the format is %s or %s, not %q", DUMP_FORMAT_TEXT, DUMP_FORMAT_JSON, format)
+					}
+					return withControl(c, func(ctx context.Context, socketPath string) error {
+						maps, err := control.DumpMaps(ctx, socketPath)
+						if err != nil {
+							return err
+						}
+						if format == DUMP_FORMAT_JSON {
+							encoder := json.NewEncoder(c.App.Writer)
+							encoder.SetIndent("", "  ")
+							return encoder.Encode(maps)
+						}
+						printMaps(c.App.Writer, maps)
+						return nil
+					})
+				},
+			},
+		},
+	}
+}
+
+// printMaps prints the entries of every map that has any, under the map and its count, with
+// what wrote them and the domains they were resolved from.
+func printMaps(w io.Writer, maps []control.MapDump) {
+	empty := 0
+	for _, m := range maps {
+		if m.Count == 0 {
+			empty++
+			continue
+		}
+		fmt.Fprintf(w, "%s (%d)\n", m.Map, m.Count)
+		for _, entry := range m.Entries {
+			key := entry.Key
+			if entry.Protocol != "" {
+				key = entry.Protocol + " " + key
+			}
+			line := fmt.Sprintf("  %-43s", key)
+			if entry.Value != "" {
+				line += " " + entry.Value
+			}
+			if len(entry.Entries) > 0 {
+				line += " entries=" + strings.Join(entry.Entries, ",")
+			}
+			sources := "unknown"
+			if len(entry.Sources) > 0 {
+				sources = strings.Join(entry.Sources, ",")
+			}
+			line += " from " + sources
+			if len(entry.Domains) > 0 {
+				line += " (" + strings.Join(entry.Domains, ", ") + ")"
+			}
+			fmt.Fprintln(w, line)
+		}
+	}
+	fmt.Fprintf(w, "%d of the %d maps have no entry.\n", empty, len(maps))
+}
+
+// printRuleStats prints every rule of conf with the connections it matched and its last hit,
+// including the rules that never matched one.
+func printRuleStats(w io.Writer, conf *config.Config) error {
+	hits := conf.RestrictedNetworkConfig.RuleHits
+	if !hits.Enable {
+		return errkind.New(errkind.Config, errors.New("the hits of the rules are not recorded, enable network.rule_hits"))
+	}
+	recorded, err := network.ReadRuleHits(hits.StateDir)
+	if err != nil && !os.IsNotExist(err) {
+		return errkind.New(errkind.Runtime, err)
+	}
+	var rules []network.RuleHit
+	if recorded != nil {
+		rules = recorded.Rules
+	}
+
+	stats := network.WithLastHits(network.ExportPolicy(conf), rules)
+	if len(stats) == 0 {
+		fmt.Fprintln(w, "The config has no rule whose hits are recorded.")
+		return nil
+	}
+	if recorded != nil {
+		fmt.Fprintf(w, "Hits of the rules as of %s:\n", recorded.Updated.Local().Format(time.RFC3339))
+	} else {
+		fmt.Fprintln(w, "No hit of the rules was recorded yet:")
+	}
+	for _, rule := range stats {
+		last := "never"
+		if !rule.LastHit.IsZero() {
+			last = rule.LastHit.Local().Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "  %-32s %-40s %10d  %s\n", rule.List, rule.Entry, rule.Hits, last)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/audit/network"
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/control"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrintRuleStats(t *testing.T) {
+	conf := config.DefaultConfig()
+	conf.RestrictedNetworkConfig.CIDR.Allow = []string{"10.0.0.0/8", "192.168.0.0/16"}
+
+	var buf bytes.Buffer
+	assert.NotNil(t, printRuleStats(&buf, conf))
+
+	dir := t.TempDir()
+	conf.RestrictedNetworkConfig.RuleHits = config.RuleHitsConfig{Enable: true, StateDir: dir, WriteInterval: time.Minute}
+	assert.Nil(t, printRuleStats(&buf, conf))
+	assert.Contains(t, buf.String(), "No hit of the rules was recorded yet")
+
+	now := time.Date(2026, 10, 14, 12, 0, 0, 0, time.Local)
+	hits := network.RuleHits{Version: network.RULE_HITS_VERSION, Updated: now, Rules: []network.RuleHit{
+		{List: "network.cidr.allow", Entry: "10.0.0.0/8", LastHit: now.Add(-time.Hour), Hits: 1532},
+		// A rule that is no longer in the config is not listed.
+		{List: "network.cidr.allow", Entry: "172.16.0.0/12", LastHit: now.Add(-time.Hour), Hits: 7},
+	}}
+	data, err := json.Marshal(hits)
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(network.RuleHitsPath(dir), data, 0600))
+
+	buf.Reset()
+	assert.Nil(t, printRuleStats(&buf, conf))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equal(t, 3, len(lines))
+	assert.Equal(t, []string{"network.cidr.allow", "10.0.0.0/8", "1532", now.Add(-time.Hour).Format(time.RFC3339)}, strings.Fields(lines[1]))
+	assert.Equal(t, []string{"network.cidr.allow", "192.168.0.0/16", "0", "never"}, strings.Fields(lines[2]))
+}
+
+func TestPrintMaps(t *testing.T) {
+	var buf bytes.Buffer
+	printMaps(&buf, []control.MapDump{
+		{Map: network.ALLOWED_V4_CIDR_LIST_MAP_NAME, Count: 2, Entries: []control.MapEntry{
+			{Key: "10.0.0.0/8", Sources: []string{"config", "runtime"}},
+			{Key: "192.0.2.1/32", Sources: []string{"domain"}, Domains: []string{"example.com"}},
+		}},
+		{Map: network.DENIED_V4_PROTOCOL_CIDR_LIST_MAP_NAME, Count: 1, Entries: []control.MapEntry{
+			{Key: "198.51.100.0/24", Protocol: "udp"},
+		}},
+		{Map: network.ALLOWED_GID_LIST_MAP_NAME, Entries: []control.MapEntry{}},
+	})
+	lines := strings.Split(strings.TrimRight(buf.String(), "\n"), "\n")
+	assert.Equal(t, []string{
+		"allowed_v4_cidr_list (2)",
+		"  10.0.0.0/8                                  from config,runtime",
+		"  192.0.2.1/32                                from domain (example.com)",
+		"denied_v4_protocol_cidr_list (1)",
+		"  udp 198.51.100.0/24                         from unknown",
+		"1 of the 3 maps have no entry.",
+	}, lines)
+}
@@ -0,0 +1,327 @@
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/audit/network"
+	"github.com/mrtc0/bouheki/pkg/errkind"
+	"github.com/mrtc0/bouheki/pkg/hostcheck"
+	"github.com/mrtc0/bouheki/pkg/jobs"
+	"github.com/mrtc0/bouheki/pkg/spool"
+	"github.com/mrtc0/bouheki/pkg/startup"
+	"github.com/urfave/cli/v2"
+)
+
+var errMetricsDisabled = errkind.New(errkind.Config, errors.New("bouheki status reads the metrics server, set metrics.enable to true"))
+
+func statusCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "status",
+		Usage: "show the state of the running bouheki",
+		Flags: []cli.Flag{
+			&cli.BoolFlag{Name: "jobs", Usage: "show the running job and the recent history of the network job queue"},
+			&cli.BoolFlag{Name: "coverage", Usage: "show the fraction of observed connections that the allow lists permit"},
+			&cli.BoolFlag{Name: "rule-sets", Usage: "show the progress of the refreshes of network.rule_sets"},
+			&cli.BoolFlag{Name: "resources", Usage: "show the sizes the maps were loaded with"},
+			&cli.BoolFlag{Name: "startup", Usage: "show the startup conditions and whether they are met"},
+			&cli.BoolFlag{Name: "dns", Usage: "show the next scheduled resolutions of network.domain"},
+			&cli.BoolFlag{Name: "host-check", Usage: "show the warnings of the host check of the commands at startup"},
+			&cli.BoolFlag{Name: "spools", Usage: "show the undelivered events spooled by falco_output and audit_output.webhook"},
+		},
+		Action: func(c *cli.Context) error {
+			conf, err := loadConfig(c)
+			if err != nil {
+				return err
+			}
+			if !conf.Metrics.Enable {
+				return errMetricsDisabled
+			}
+
+			// The startup conditions are printed first: the jobs are not running while they are waited for.
+			if c.Bool("startup") {
+				startupStatus, err := fetchStartupStatus(conf.Metrics.Listen)
+				if err != nil {
+					return errkind.New(errkind.Runtime, err)
+				}
+				printStartupStatus(c.App.Writer, startupStatus)
+			}
+
+			status, err := fetchJobsStatus(conf.Metrics.Listen)
+			if err != nil {
+				return errkind.New(errkind.Runtime, err)
+			}
+
+			printJobsStatus(c.App.Writer, status, c.Bool("jobs"))
+
+			audit, err := fetchAuditStatus(conf.Metrics.Listen)
+			if err != nil {
+				return errkind.New(errkind.Runtime, err)
+			}
+			printAuditStatus(c.App.Writer, audit)
+
+			if c.Bool("coverage") {
+				coverage, err := fetchCoverageStatus(conf.Metrics.Listen)
+				if err != nil {
+					return errkind.New(errkind.Runtime, err)
+				}
+				printCoverageSummary(c.App.Writer, coverage)
+			}
+
+			if c.Bool("rule-sets") {
+				ruleSets, err := fetchRuleSetsStatus(conf.Metrics.Listen)
+				if err != nil {
+					return errkind.New(errkind.Runtime, err)
+				}
+				printRuleSetsStatus(c.App.Writer, ruleSets)
+			}
+
+			if c.Bool("resources") {
+				resources, err := fetchResourcesStatus(conf.Metrics.Listen)
+				if err != nil {
+					return errkind.New(errkind.Runtime, err)
+				}
+				printResourcesStatus(c.App.Writer, resources)
+			}
+
+			if c.Bool("dns") {
+				refresh, err := fetchDNSRefreshStatus(conf.Metrics.Listen)
+				if err != nil {
+					return errkind.New(errkind.Runtime, err)
+				}
+				printDNSRefreshStatus(c.App.Writer, refresh)
+			}
+
+			if c.Bool("host-check") {
+				report, err := fetchHostCheckStatus(conf.Metrics.Listen)
+				if err != nil {
+					return errkind.New(errkind.Runtime, err)
+				}
+				report.Print(c.App.Writer)
+			}
+
+			if c.Bool("spools") {
+				spools, err := fetchSpoolsStatus(conf.Metrics.Listen)
+				if err != nil {
+					return errkind.New(errkind.Runtime, err)
+				}
+				printSpoolsStatus(c.App.Writer, spools)
+			}
+			return nil
+		},
+	}
+}
+
+func fetchJobsStatus(listen string) (*jobs.Status, error) {
+	status := &jobs.Status{}
+	if err := fetchStatus(listen, jobs.STATUS_PATH, "is the network restriction enabled?", status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+func fetchAuditStatus(listen string) (*network.AuditStatus, error) {
+	status := &network.AuditStatus{}
+	if err := fetchStatus(listen, network.AUDIT_PATH, "is the network restriction enabled?", status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+func fetchCoverageStatus(listen string) (*network.CoverageStatus, error) {
+	status := &network.CoverageStatus{}
+	if err := fetchStatus(listen, network.COVERAGE_PATH, "is network.coverage.enable set?", status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+func fetchRuleSetsStatus(listen string) ([]network.RuleSetProgress, error) {
+	status := []network.RuleSetProgress{}
+	if err := fetchStatus(listen, network.RULE_SETS_PATH, "is the network restriction enabled?", &status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+func fetchResourcesStatus(listen string) (*network.ResourcesStatus, error) {
+	status := &network.ResourcesStatus{}
+	if err := fetchStatus(listen, network.RESOURCES_PATH, "is the network restriction enabled?", status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+func fetchDNSRefreshStatus(listen string) (*network.DNSRefreshStatus, error) {
+	status := &network.DNSRefreshStatus{}
+	if err := fetchStatus(listen, network.DNS_REFRESH_PATH, "is the network restriction enabled?", status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+func fetchStartupStatus(listen string) (*startup.Status, error) {
+	status := &startup.Status{}
+	if err := fetchStatus(listen, startup.STATUS_PATH, "is the network restriction enabled?", status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+func fetchHostCheckStatus(listen string) (*hostcheck.Report, error) {
+	report := &hostcheck.Report{}
+	if err := fetchStatus(listen, hostcheck.STATUS_PATH, "is network.command.host_check.on_startup set?", report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func fetchSpoolsStatus(listen string) ([]spool.SinkStatus, error) {
+	status := []spool.SinkStatus{}
+	if err := fetchStatus(listen, spool.STATUS_PATH, "is the running bouheki older than this one?", &status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// fetchStatus decodes the JSON served on path of the metrics server. hint is added to the error when path is not served.
+func fetchStatus(listen, path, hint string, v interface{}) error {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+
+	client := http.Client{Timeout: 5 * time.Second}
+	res, err := client.Get(fmt.Sprintf("http://%s%s", net.JoinHostPort(host, port), path))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s, %s", path, res.Status, hint)
+	}
+
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+func printJobsStatus(w io.Writer, status *jobs.Status, history bool) {
+	fmt.Fprintf(w, "queue:   %d/%d\n", status.Depth, status.Capacity)
+	if status.Running == nil {
+		fmt.Fprintln(w, "running: -")
+	} else {
+		fmt.Fprintf(w, "running: %s (%s)\n", status.Running.Name, status.Running.Duration.Round(time.Millisecond))
+	}
+
+	if !history {
+		return
+	}
+
+	fmt.Fprintln(w, "history:")
+	for i := len(status.History) - 1; i >= 0; i-- {
+		info := status.History[i]
+		line := fmt.Sprintf("  %s  %-9s %8s  %s", info.SubmittedAt.Format(time.RFC3339), info.Outcome, info.Duration.Round(time.Millisecond), info.Name)
+		if info.Error != "" {
+			line += ": " + info.Error
+		}
+		fmt.Fprintln(w, line)
+	}
+}
+
+func printAuditStatus(w io.Writer, status *network.AuditStatus) {
+	if status.Enabled {
+		fmt.Fprintln(w, "audit:   enabled")
+	} else {
+		fmt.Fprintln(w, "audit:   disabled (network.audit.enabled: false)")
+	}
+	if len(status.Families) > 0 {
+		fmt.Fprintf(w, "families: %s (other families: %s)\n", strings.Join(status.Families, ", "), status.OtherFamilies)
+	}
+}
+
+func printCoverageSummary(w io.Writer, status *network.CoverageStatus) {
+	fmt.Fprintln(w, "coverage:")
+	for _, window := range status.Windows {
+		fmt.Fprintf(w, "  %-6s %s\n", window.Window, formatCoverage(window.Overall))
+	}
+}
+
+func formatCoverage(c network.CoverageCounts) string {
+	if c.Observed == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%6.2f%% (%d/%d)", c.Ratio()*100, c.Permitted, c.Observed)
+}
+
+func printRuleSetsStatus(w io.Writer, status []network.RuleSetProgress) {
+	fmt.Fprintln(w, "rule sets:")
+	for _, progress := range status {
+		state := "done"
+		if !progress.Complete {
+			state = fmt.Sprintf("%d/%d", progress.Applied, progress.Total)
+		}
+		line := fmt.Sprintf("  %-16s %-5s %8d entries  %s", progress.Name, progress.List, progress.Installed, state)
+		if progress.Error != "" {
+			line += ": " + progress.Error
+		}
+		fmt.Fprintln(w, line)
+	}
+}
+
+func printDNSRefreshStatus(w io.Writer, status *network.DNSRefreshStatus) {
+	fmt.Fprintf(w, "dns refresh: %d scheduled, %d in flight\n", status.Scheduled, status.InFlight)
+	for _, refresh := range status.Next {
+		fmt.Fprintf(w, "  %s  %-5s %-4s  %s\n", refresh.Due.Format(time.RFC3339), refresh.List, refresh.Type, refresh.Domain)
+	}
+}
+
+func printStartupStatus(w io.Writer, status *startup.Status) {
+	fmt.Fprintln(w, "startup conditions:")
+	for _, cond := range status.Conditions {
+		line := fmt.Sprintf("  %-16s %-6s %-16s %-8s %8s", cond.Name, cond.Type, cond.Policy, cond.State, cond.Waited.Round(time.Millisecond))
+		if cond.State != startup.STATE_READY && cond.Error != "" {
+			line += "  " + cond.Error
+		}
+		fmt.Fprintln(w, line)
+	}
+
+	if status.Timing == nil {
+		return
+	}
+	fmt.Fprintln(w, "startup phases:")
+	for _, line := range strings.SplitAfter(status.Timing.Table(network.STARTUP_LOG_DEPTH), "\n") {
+		if line != "" {
+			fmt.Fprint(w, "  "+line)
+		}
+	}
+}
+
+func printResourcesStatus(w io.Writer, status *network.ResourcesStatus) {
+	fmt.Fprintf(w, "resources (profile %s):\n", status.Profile)
+	total := uint64(0)
+	for _, m := range status.Maps {
+		fmt.Fprintf(w, "  %-24s %8d/%-8d %10s\n", m.Name, m.Required, m.MaxEntries, formatBytes(m.Memory))
+		total += m.Memory
+	}
+	fmt.Fprintf(w, "  %-24s %17s %10s\n", "total", "", formatBytes(total))
+}
+
+func printSpoolsStatus(w io.Writer, status []spool.SinkStatus) {
+	fmt.Fprintln(w, "spools:")
+	if len(status) == 0 {
+		fmt.Fprintln(w, "  no output spools its events")
+		return
+	}
+	for _, sink := range status {
+		fmt.Fprintf(w, "  %-8s %8d records %10s %4d segments  dropped %d, rejected %d\n", sink.Name, sink.Records, formatBytes(uint64(sink.Bytes)), sink.Segments, sink.Dropped, sink.Rejected)
+	}
+}
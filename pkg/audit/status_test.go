@@ -0,0 +1,256 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/audit/network"
+	"github.com/mrtc0/bouheki/pkg/hostcheck"
+	"github.com/mrtc0/bouheki/pkg/jobs"
+	"github.com/mrtc0/bouheki/pkg/spool"
+	"github.com/mrtc0/bouheki/pkg/startup"
+	"github.com/mrtc0/bouheki/pkg/timing"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFetchAndPrintJobsStatus(t *testing.T) {
+	q := jobs.New("status_test", 4)
+	defer q.Stop()
+	assert.Nil(t, q.Do("dns-refresh example.com", func(ctx context.Context) error { return nil }))
+	assert.NotNil(t, q.Do("preload-expire", func(ctx context.Context) error { return errors.New("map is gone") }))
+
+	server := httptest.NewServer(q)
+	defer server.Close()
+
+	status, err := fetchJobsStatus(strings.TrimPrefix(server.URL, "http://"))
+	assert.Nil(t, err)
+	assert.Equal(t, 4, status.Capacity)
+	assert.Equal(t, 2, len(status.History))
+
+	var summary bytes.Buffer
+	printJobsStatus(&summary, status, false)
+	assert.Equal(t, "queue:   0/4\nrunning: -\n", summary.String())
+
+	var full bytes.Buffer
+	printJobsStatus(&full, status, true)
+	lines := strings.Split(strings.TrimSpace(full.String()), "\n")
+	assert.Equal(t, 5, len(lines))
+	assert.Contains(t, lines[3], "failed")
+	assert.Contains(t, lines[3], "preload-expire: map is gone")
+	assert.Contains(t, lines[4], "ok")
+	assert.Contains(t, lines[4], "dns-refresh example.com")
+}
+
+func TestPrintAuditStatus(t *testing.T) {
+	var out bytes.Buffer
+	printAuditStatus(&out, &network.AuditStatus{Enabled: true, RingBuffer: true})
+	printAuditStatus(&out, &network.AuditStatus{})
+	assert.Equal(t, "audit:   enabled\naudit:   disabled (network.audit.enabled: false)\n", out.String())
+
+	out.Reset()
+	printAuditStatus(&out, &network.AuditStatus{Enabled: true, Families: []string{"ipv4"}, OtherFamilies: "audit"})
+	assert.Equal(t, "audit:   enabled\nfamilies: ipv4 (other families: audit)\n", out.String())
+}
+
+func TestFetchAndPrintCoverageReport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, network.COVERAGE_PATH, req.URL.Path)
+		json.NewEncoder(w).Encode(network.CoverageStatus{
+			Excluded: 3,
+			Windows: []network.CoverageWindow{
+				{Window: "1h", Overall: network.CoverageCounts{Observed: 4, Permitted: 4}},
+				{
+					Window:  "24h",
+					Overall: network.CoverageCounts{Observed: 8, Permitted: 6},
+					Comm: map[string]network.CoverageCounts{
+						"curl": {Observed: 4, Permitted: 2},
+						"apt":  {Observed: 4, Permitted: 4},
+					},
+					Trend: []network.CoveragePoint{
+						{Start: time.Date(2026, 10, 14, 0, 0, 0, 0, time.UTC), CoverageCounts: network.CoverageCounts{Observed: 4, Permitted: 2}},
+					},
+				},
+			},
+		})
+	}))
+	defer server.Close()
+
+	status, err := fetchCoverageStatus(strings.TrimPrefix(server.URL, "http://"))
+	assert.Nil(t, err)
+
+	var summary bytes.Buffer
+	printCoverageSummary(&summary, status)
+	assert.Equal(t, "coverage:\n  1h     100.00% (4/4)\n  24h     75.00% (6/8)\n", summary.String())
+
+	var report bytes.Buffer
+	printCoverageReport(&report, status)
+	assert.Contains(t, report.String(), "excluded by deny lists: 3\n")
+	assert.Contains(t, report.String(), "trend (24h):\n  2026-10-14T00:00:00Z   50.00% (2/4)\n")
+	assert.Contains(t, report.String(), "least covered comm (24h):\n  curl              50.00% (2/4)\n  apt              100.00% (4/4)\n")
+	assert.NotContains(t, report.String(), "permit every connection")
+}
+
+func TestFetchAndPrintRuleSetsStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, network.RULE_SETS_PATH, req.URL.Path)
+		json.NewEncoder(w).Encode([]network.RuleSetProgress{
+			{Name: "geoip-xx", List: "deny", Installed: 4500, Applied: 4500, Total: 4500, Complete: true},
+			{Name: "asn-64500", List: "allow", Installed: 120, Applied: 120, Total: 300, Error: "map is full"},
+		})
+	}))
+	defer server.Close()
+
+	status, err := fetchRuleSetsStatus(strings.TrimPrefix(server.URL, "http://"))
+	assert.Nil(t, err)
+
+	var out bytes.Buffer
+	printRuleSetsStatus(&out, status)
+	assert.Equal(t, "rule sets:\n"+
+		"  geoip-xx         deny      4500 entries  done\n"+
+		"  asn-64500        allow      120 entries  120/300: map is full\n", out.String())
+}
+
+func TestFetchAndPrintResourcesStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, network.RESOURCES_PATH, req.URL.Path)
+		json.NewEncoder(w).Encode(network.ResourcesStatus{
+			Profile: "large",
+			Maps: []network.MapResources{
+				{Name: "denied_v4_cidr_list", MaxEntries: 524288, Required: 412000, Memory: 47185920},
+				{Name: "allowed_uid_list", MaxEntries: 4096, Required: 2, Memory: 327680},
+			},
+		})
+	}))
+	defer server.Close()
+
+	status, err := fetchResourcesStatus(strings.TrimPrefix(server.URL, "http://"))
+	assert.Nil(t, err)
+
+	var out bytes.Buffer
+	printResourcesStatus(&out, status)
+	assert.Equal(t, "resources (profile large):\n"+
+		"  denied_v4_cidr_list        412000/524288      45.0MiB\n"+
+		"  allowed_uid_list                2/4096       320.0KiB\n"+
+		"  total                                         45.3MiB\n", out.String())
+}
+
+func TestFetchAndPrintStartupStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, startup.STATUS_PATH, req.URL.Path)
+		json.NewEncoder(w).Encode(startup.Status{Conditions: []startup.ConditionStatus{
+			{Name: "dns", Type: "dns", Policy: "proceed-degraded", State: startup.STATE_DEGRADED, Waited: 31*time.Second + 2*time.Millisecond, Attempts: 31, Error: "read udp 127.0.0.1:53: i/o timeout"},
+			{Name: "containerd", Type: "socket", Policy: "wait", State: startup.STATE_READY, Waited: 1500 * time.Millisecond, Attempts: 2},
+		}})
+	}))
+	defer server.Close()
+
+	status, err := fetchStartupStatus(strings.TrimPrefix(server.URL, "http://"))
+	assert.Nil(t, err)
+
+	var out bytes.Buffer
+	printStartupStatus(&out, status)
+	assert.Equal(t, "startup conditions:\n"+
+		"  dns              dns    proceed-degraded degraded  31.002s  read udp 127.0.0.1:53: i/o timeout\n"+
+		"  containerd       socket wait             ready        1.5s\n", out.String())
+
+	// The phases below the top ones are only in the JSON.
+	status.Timing = &timing.Record{Name: network.STARTUP_TIMER_NAME, Total: 34 * time.Second, Done: true, Phases: []timing.Phase{
+		{Name: network.STARTUP_PHASE_LOAD, Duration: 800 * time.Millisecond},
+		{Name: network.STARTUP_PHASE_CONDITIONS, Duration: 31 * time.Second},
+		{Name: network.STARTUP_PHASE_DOMAINS_RESOLVE, Duration: 2 * time.Second, Phases: []timing.Phase{{Name: "example.com", Duration: 2 * time.Second}}},
+	}}
+	out.Reset()
+	printStartupStatus(&out, status)
+	assert.Equal(t, "startup conditions:\n"+
+		"  dns              dns    proceed-degraded degraded  31.002s  read udp 127.0.0.1:53: i/o timeout\n"+
+		"  containerd       socket wait             ready        1.5s\n"+
+		"startup phases:\n"+
+		"  network startup                                 34s\n"+
+		"    load                                        800ms   2.4%\n"+
+		"    startup-conditions                            31s  91.2%\n"+
+		"    domains-resolve                                2s   5.9%\n", out.String())
+}
+
+func TestFetchAndPrintDNSRefreshStatus(t *testing.T) {
+	due := time.Date(2026, 10, 14, 15, 6, 10, 0, time.UTC)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, network.DNS_REFRESH_PATH, req.URL.Path)
+		json.NewEncoder(w).Encode(network.DNSRefreshStatus{Scheduled: 412, InFlight: 3, Next: []network.DomainRefreshInfo{
+			{Domain: "example.com", Type: "A", List: "allow", Due: due},
+			{Domain: "evil.example.com", Type: "AAAA", List: "deny", Due: due.Add(2 * time.Second)},
+		}})
+	}))
+	defer server.Close()
+
+	status, err := fetchDNSRefreshStatus(strings.TrimPrefix(server.URL, "http://"))
+	assert.Nil(t, err)
+
+	var out bytes.Buffer
+	printDNSRefreshStatus(&out, status)
+	assert.Equal(t, "dns refresh: 412 scheduled, 3 in flight\n"+
+		"  2026-10-14T15:06:10Z  allow A     example.com\n"+
+		"  2026-10-14T15:06:12Z  deny  AAAA  evil.example.com\n", out.String())
+}
+
+func TestFetchAndPrintHostCheckStatus(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle(hostcheck.STATUS_PATH, &hostcheck.Report{Roots: []string{hostcheck.HOST}, Warnings: []hostcheck.Warning{
+		{List: "network.command.allow", Command: "python", Kind: hostcheck.WARNING_NOT_FOUND, Candidates: []string{"python3"}},
+	}})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	report, err := fetchHostCheckStatus(strings.TrimPrefix(server.URL, "http://"))
+	assert.Nil(t, err)
+
+	var out bytes.Buffer
+	report.Print(&out)
+	assert.Equal(t, "host check (host):\n"+
+		"  network.command.allow: \"python\" is not the name of any binary in the PATH, the comm of the task may be one of python3\n", out.String())
+
+	out.Reset()
+	(&hostcheck.Report{Roots: []string{"mnt:[4026532281]"}}).Print(&out)
+	assert.Equal(t, "host check (mnt:[4026532281]):\n  every command is installed\n", out.String())
+}
+
+// downSender is a sink that takes no event.
+type downSender struct{}
+
+func (downSender) Send(event []byte) error {
+	return errors.New("the webhook answered 503 Service Unavailable")
+}
+
+func TestFetchAndPrintSpoolsStatus(t *testing.T) {
+	s, err := spool.Open("status_test", spool.Config{Dir: t.TempDir()})
+	assert.Nil(t, err)
+	sink := spool.NewSink(downSender{}, s, time.Hour)
+	defer sink.Close(0)
+	assert.Nil(t, sink.Send([]byte(`{"audit":"network"}`)))
+	assert.Nil(t, sink.Send([]byte(`{"audit":"network"}`)))
+
+	mux := http.NewServeMux()
+	mux.Handle(spool.STATUS_PATH, spool.Sinks{"webhook": sink})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	status, err := fetchSpoolsStatus(strings.TrimPrefix(server.URL, "http://"))
+	assert.Nil(t, err)
+	assert.Equal(t, []spool.SinkStatus{{Name: "webhook", Stats: sink.Stats()}}, status)
+	assert.Equal(t, 2, status[0].Records)
+
+	var out bytes.Buffer
+	printSpoolsStatus(&out, status)
+	assert.Equal(t, fmt.Sprintf("spools:\n  webhook         2 records %10s    1 segments  dropped 0, rejected 0\n", formatBytes(uint64(status[0].Bytes))), out.String())
+
+	out.Reset()
+	printSpoolsStatus(&out, []spool.SinkStatus{})
+	assert.Equal(t, "spools:\n  no output spools its events\n", out.String())
+}
@@ -0,0 +1,51 @@
+package audit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+
+	"github.com/mrtc0/bouheki/pkg/control"
+	"github.com/mrtc0/bouheki/pkg/errkind"
+	"github.com/mrtc0/bouheki/pkg/notify"
+	"github.com/urfave/cli/v2"
+)
+
+var errControlDisabled = errkind.New(errkind.Config, errors.New("bouheki subscribe and bouheki ctl use the control socket, set control.enable to true"))
+
+func subscribeCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "subscribe",
+		Usage: "stream policy change notifications of the running bouheki as JSON lines",
+		Flags: []cli.Flag{
+			&cli.StringSliceFlag{Name: "type", Usage: "only stream the notifications of this type, e.g. alert (can be repeated)"},
+		},
+		Action: func(c *cli.Context) error {
+			conf, err := loadConfig(c)
+			if err != nil {
+				return err
+			}
+			if !conf.Control.Enable {
+				return errControlDisabled
+			}
+
+			ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+			defer cancel()
+
+			err = control.Subscribe(ctx, conf.Control.Socket, c.StringSlice("type"), func(n notify.Notification) error {
+				data, err := notify.Marshal(n)
+				if err != nil {
+					return err
+				}
+				_, err = fmt.Fprintln(c.App.Writer, string(data))
+				return err
+			})
+			if err != nil {
+				return errkind.New(errkind.Runtime, err)
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,54 @@
+package audit
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/audit/network"
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/errkind"
+	"github.com/urfave/cli/v2"
+)
+
+// whyCommand needs no root and no config: any user can read the records of their own uid.
+func whyCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "why",
+		Usage: "show your recently blocked connections and the rules that blocked them",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "dir",
+				Value:   config.DEFAULT_DENIAL_RECORDS_DIR,
+				Usage:   "the network.denial_records.dir of the running bouheki",
+				EnvVars: []string{"BOUHEKI_DENIAL_RECORDS_DIR"},
+			},
+		},
+		Action: func(c *cli.Context) error {
+			return printDenialRecords(c.App.Writer, c.String("dir"), uint32(os.Getuid()))
+		},
+	}
+}
+
+func printDenialRecords(w io.Writer, dir string, uid uint32) error {
+	records, err := network.ReadDenialRecords(dir, uid)
+	if os.IsNotExist(err) {
+		fmt.Fprintf(w, "No connection of uid %d was blocked recently.\n", uid)
+		return nil
+	}
+	if err != nil {
+		return errkind.New(errkind.Runtime, err)
+	}
+
+	fmt.Fprintf(w, "Connections of uid %d blocked by bouheki, most recent first:\n", uid)
+	for _, record := range records.Records {
+		destination := fmt.Sprintf("%s:%d/%s", record.Addr, record.Port, record.Protocol)
+		if record.Domain != "" {
+			destination += " (" + record.Domain + ")"
+		}
+		fmt.Fprintf(w, "  %s  %s (pid %d) -> %s\n", record.Time.Local().Format(time.RFC3339), record.Comm, record.PID, destination)
+		fmt.Fprintf(w, "    rule: %s\n", record.Rule)
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/audit/network"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrintDenialRecords(t *testing.T) {
+	dir := t.TempDir()
+
+	var buf bytes.Buffer
+	assert.Nil(t, printDenialRecords(&buf, dir, 1000))
+	assert.Equal(t, "No connection of uid 1000 was blocked recently.\n", buf.String())
+
+	at := time.Date(2026, 10, 14, 12, 0, 0, 0, time.Local)
+	data, err := json.Marshal(network.DenialRecords{UID: 1000, Records: []network.DenialRecord{
+		{Time: at, Rule: "network.cidr.deny 10.0.0.0/8", Addr: "10.0.0.1", Domain: "internal.example.com", Port: 443, Protocol: "TCP", Comm: "curl", PID: 4242},
+		{Time: at.Add(-time.Minute), Rule: "network.command.allow does not list wget", Addr: "192.0.2.1", Port: 80, Protocol: "TCP", Comm: "wget", PID: 4200},
+	}})
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "1000.json"), data, 0600))
+
+	buf.Reset()
+	assert.Nil(t, printDenialRecords(&buf, dir, 1000))
+	assert.Equal(t, `Connections of uid 1000 blocked by bouheki, most recent first:
+  `+at.Format(time.RFC3339)+`  curl (pid 4242) -> 10.0.0.1:443/TCP (internal.example.com)
+    rule: network.cidr.deny 10.0.0.0/8
+  `+at.Add(-time.Minute).Format(time.RFC3339)+`  wget (pid 4200) -> 192.0.2.1:80/TCP
+    rule: network.command.allow does not list wget
+`, buf.String())
+
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "1000.json"), []byte("{"), 0600))
+	assert.NotNil(t, printDenialRecords(&buf, dir, 1000))
+}
@@ -0,0 +1,255 @@
+// Package auditoutput appends the audit events to a file as JSON lines with stable field names,
+// for the log shippers that index them, e.g. into Elasticsearch, next to the log that keeps
+// reporting them as it does, and posts them to a webhook, e.g. of Slack or Alertmanager.
+//
+// The file is rotated by size, and by time if audit_output.rotate_interval is set; the rotated
+// files are removed by age and by count, and gzipped if audit_output.compress is set.
+//
+// The webhook never blocks the audits. The events of the same process and destination within a
+// window are posted once with their count, the requests are rate limited, and a request that
+// fails is retried with an exponential backoff before its events are dropped and counted.
+package auditoutput
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/alert"
+	"github.com/mrtc0/bouheki/pkg/clock"
+	"github.com/mrtc0/bouheki/pkg/config"
+	log "github.com/mrtc0/bouheki/pkg/log"
+	"github.com/mrtc0/bouheki/pkg/metrics"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+var (
+	recordsWritten = metrics.NewCounter("audit_output_written_total",
+		"Number of audit events written to the audit output.")
+	recordsDropped = metrics.NewCounter("audit_output_dropped_total",
+		"Number of audit events dropped because they could not be written to the audit output.")
+)
+
+// DefaultOutput is the output used by the package level Write and SetMode. It is nil unless
+// audit_output is enabled.
+var DefaultOutput *Output
+
+// Write writes event to the DefaultOutput, and to the DefaultWebhook. match is the audit of the
+// event and the fields the filters of the outputs match.
+func Write(match alert.Event, event interface{}) {
+	if DefaultOutput != nil {
+		DefaultOutput.Write(match, event)
+	}
+	if DefaultWebhook != nil {
+		DefaultWebhook.Write(match, event)
+	}
+}
+
+// SetMode sets the mode the events of audit are written with by the DefaultOutput and the
+// DefaultWebhook.
+func SetMode(audit string, mode string) {
+	if DefaultOutput != nil {
+		DefaultOutput.SetMode(audit, mode)
+	}
+	if DefaultWebhook != nil {
+		DefaultWebhook.SetMode(audit, mode)
+	}
+}
+
+// Record is a line of the output. The names of its fields do not change: a field is only ever
+// added. UID and GID are omitted for the audits that do not report them, and the fields of the
+// other audits are omitted when empty.
+type Record struct {
+	Timestamp  time.Time `json:"timestamp"`
+	Audit      string    `json:"audit"`
+	Mode       string    `json:"mode"`
+	Action     string    `json:"action"`
+	Hostname   string    `json:"hostname"`
+	Comm       string    `json:"comm"`
+	ParentComm string    `json:"parent_comm"`
+	PID        uint32    `json:"pid"`
+	UID        *uint32   `json:"uid,omitempty"`
+	GID        *uint32   `json:"gid,omitempty"`
+	Operation  string    `json:"operation,omitempty"`
+	DstIP      string    `json:"dst_ip,omitempty"`
+	DstPort    uint16    `json:"dst_port,omitempty"`
+	Domain     string    `json:"domain,omitempty"`
+	Protocol   string    `json:"protocol,omitempty"`
+	LocalIP    string    `json:"local_ip,omitempty"`
+	LocalPort  uint16    `json:"local_port,omitempty"`
+	Rule       string    `json:"rule,omitempty"`
+	// DestinationTags are the tags of network.destination_tags of the destination.
+	DestinationTags []string `json:"destination_tags,omitempty"`
+	// Count is the number of the identical events the record of a summary stands for.
+	Count      uint64 `json:"count,omitempty"`
+	Path       string `json:"path,omitempty"`
+	SourcePath string `json:"source_path,omitempty"`
+	// CgroupID is the cgroup of the process, and the fields of the container are set with
+	// containers.enable for a process in a container.
+	CgroupID       uint64 `json:"cgroup_id,omitempty"`
+	ContainerID    string `json:"container_id,omitempty"`
+	ContainerName  string `json:"container_name,omitempty"`
+	ContainerImage string `json:"container_image,omitempty"`
+	PodName        string `json:"pod_name,omitempty"`
+	PodNamespace   string `json:"pod_namespace,omitempty"`
+}
+
+// NewRecord returns the record of event, an event of audit as written to the log, e.g. a
+// log.RestrictedNetworkLog, with the mode of the audit.
+func NewRecord(audit string, mode string, event interface{}, now time.Time) (Record, error) {
+	r := Record{Timestamp: now.UTC(), Audit: audit, Mode: mode}
+	var common log.AuditEventLog
+	switch e := event.(type) {
+	case log.RestrictedNetworkLog:
+		common = e.AuditEventLog
+		uid, gid := e.UID, e.GID
+		r.UID, r.GID = &uid, &gid
+		r.Operation = e.Operation
+		r.DstIP, r.DstPort, r.Domain = e.Addr, e.Port, e.Domain
+		r.Protocol = e.Protocol
+		r.LocalIP, r.LocalPort = e.LocalAddr, e.LocalPort
+		r.Rule, r.Count = e.Rule, e.Count
+		r.DestinationTags = e.DestinationTags
+	case log.RestrictedFileAccessLog:
+		common = e.AuditEventLog
+		r.Path = e.Path
+	case log.RestrictedMountLog:
+		common = e.AuditEventLog
+		r.SourcePath = e.SourcePath
+	default:
+		return Record{}, fmt.Errorf("an event of type %T has no record", event)
+	}
+	r.Action, r.Hostname = common.Action, common.Hostname
+	r.Comm, r.ParentComm, r.PID = common.Comm, common.ParentComm, common.PID
+	r.CgroupID, r.ContainerID = common.CgroupID, common.ContainerID
+	r.ContainerName, r.ContainerImage = common.ContainerName, common.ContainerImage
+	r.PodName, r.PodNamespace = common.PodName, common.PodNamespace
+	return r, nil
+}
+
+// Stats are the events written and dropped since the output was created.
+type Stats struct {
+	Written uint64
+	Dropped uint64
+}
+
+type Output struct {
+	mu    sync.Mutex
+	conf  config.AuditOutputConfig
+	clock clock.Clock
+	// filter is the filter of the config, nil to write every event.
+	filter *alert.Filter
+	// modes are the modes of the audits, by audit.
+	modes map[string]string
+	file  *lumberjack.Logger
+	stats Stats
+	// done stops the rotation every rotate_interval.
+	done chan struct{}
+}
+
+// New returns an output of conf, writing the events of every audit with its mode of modes. The
+// file is opened by the first event.
+func New(conf config.AuditOutputConfig, modes map[string]string, clk clock.Clock) (*Output, error) {
+	o := &Output{conf: conf, clock: clk, modes: map[string]string{}, done: make(chan struct{})}
+	if conf.Filter != nil {
+		filter, err := alert.NewFilter(*conf.Filter)
+		if err != nil {
+			return nil, fmt.Errorf("audit_output.filter: %w", err)
+		}
+		o.filter = filter
+	}
+	for audit, mode := range modes {
+		o.modes[audit] = mode
+	}
+	o.file = &lumberjack.Logger{
+		Filename:   conf.File,
+		MaxSize:    conf.MaxSize,
+		MaxAge:     conf.MaxAge,
+		MaxBackups: conf.MaxBackups,
+		Compress:   conf.Compress,
+	}
+	if conf.RotateInterval > 0 {
+		go o.rotate(conf.RotateInterval)
+	}
+	return o, nil
+}
+
+// SetMode sets the mode the events of audit are written with, when a reload changes it.
+func (o *Output) SetMode(audit string, mode string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.modes[audit] = mode
+}
+
+// Write writes the record of event of the audit of match. The events the filter does not match
+// are skipped, and counted as neither.
+func (o *Output) Write(match alert.Event, event interface{}) {
+	if o.filter != nil && !o.filter.Match(match) {
+		return
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	r, err := NewRecord(match.Audit, o.modes[match.Audit], event, o.clock.Now())
+	if err != nil {
+		o.drop(err)
+		return
+	}
+	line, err := json.Marshal(r)
+	if err != nil {
+		o.drop(err)
+		return
+	}
+	if _, err = o.file.Write(append(line, '\n')); err != nil {
+		o.drop(err)
+		return
+	}
+	o.stats.Written++
+	recordsWritten.Inc()
+}
+
+// drop counts an event that could not be written. o.mu is held.
+func (o *Output) drop(err error) {
+	o.stats.Dropped++
+	recordsDropped.Inc()
+	log.Debug(fmt.Sprintf("audit_output: dropped an event: %s", err))
+}
+
+// rotate rotates the file every interval until Close.
+func (o *Output) rotate(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-o.done:
+			return
+		case <-ticker.C:
+		}
+		if err := o.Rotate(); err != nil {
+			log.Error(fmt.Errorf("audit_output: failed to rotate %s: %w", o.conf.File, err))
+		}
+	}
+}
+
+// Rotate moves the file aside, compressed if audit_output.compress is set, and writes the next
+// events to a new one.
+func (o *Output) Rotate() error {
+	return o.file.Rotate()
+}
+
+// Stats returns the events written and dropped so far.
+func (o *Output) Stats() Stats {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.stats
+}
+
+// Close stops the rotation and closes the file.
+func (o *Output) Close() error {
+	close(o.done)
+	return o.file.Close()
+}
@@ -0,0 +1,193 @@
+package auditoutput
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/alert"
+	"github.com/mrtc0/bouheki/pkg/bouhekitest"
+	"github.com/mrtc0/bouheki/pkg/config"
+	log "github.com/mrtc0/bouheki/pkg/log"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	now     = time.Date(2026, 10, 15, 9, 30, 0, 0, time.UTC)
+	blocked = log.RestrictedNetworkLog{
+		AuditEventLog: log.AuditEventLog{Action: "BLOCKED", Hostname: "web-1", PID: 4242, Comm: "curl", ParentComm: "bash"},
+		Operation:     "connect",
+		Addr:          "203.0.113.10",
+		Port:          443,
+		Protocol:      "TCP",
+		Rule:          "denied by cidr 203.0.113.0/24",
+		UID:           1000,
+		GID:           1000,
+	}
+)
+
+func testConfig(t *testing.T) config.AuditOutputConfig {
+	conf := config.DefaultConfig().AuditOutput
+	conf.Enable = true
+	conf.File = filepath.Join(t.TempDir(), "audit.jsonl")
+	return conf
+}
+
+// readLines returns the JSON lines of path as maps, to check the names of the fields.
+func readLines(t *testing.T, path string) []map[string]interface{} {
+	f, err := os.Open(path)
+	assert.Nil(t, err)
+	defer f.Close()
+
+	lines := []map[string]interface{}{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := map[string]interface{}{}
+		assert.Nil(t, json.Unmarshal(scanner.Bytes(), &line))
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestWrite(t *testing.T) {
+	conf := testConfig(t)
+	modes := map[string]string{config.ALERT_AUDIT_NETWORK: "block", config.ALERT_AUDIT_FILEACCESS: "monitor"}
+	o, err := New(conf, modes, bouhekitest.NewClock(now))
+	assert.Nil(t, err)
+
+	o.Write(alert.Event{Audit: config.ALERT_AUDIT_NETWORK, Action: "BLOCKED", Comm: "curl"}, blocked)
+	o.Write(alert.Event{Audit: config.ALERT_AUDIT_FILEACCESS, Action: "MONITOR", Comm: "cat"}, log.RestrictedFileAccessLog{
+		AuditEventLog: log.AuditEventLog{Action: "MONITOR", Hostname: "web-1", PID: 7, Comm: "cat"},
+		Path:          "/etc/shadow",
+	})
+	o.SetMode(config.ALERT_AUDIT_NETWORK, "monitor")
+	o.Write(alert.Event{Audit: config.ALERT_AUDIT_NETWORK, Action: "BLOCKED", Comm: "curl"}, blocked)
+	assert.Nil(t, o.Close())
+
+	lines := readLines(t, conf.File)
+	assert.Len(t, lines, 3)
+	assert.Equal(t, map[string]interface{}{
+		"timestamp":   "2026-10-15T09:30:00Z",
+		"audit":       "network",
+		"mode":        "block",
+		"action":      "BLOCKED",
+		"hostname":    "web-1",
+		"comm":        "curl",
+		"parent_comm": "bash",
+		"pid":         float64(4242),
+		"uid":         float64(1000),
+		"gid":         float64(1000),
+		"operation":   "connect",
+		"dst_ip":      "203.0.113.10",
+		"dst_port":    float64(443),
+		"protocol":    "TCP",
+		"rule":        "denied by cidr 203.0.113.0/24",
+	}, lines[0])
+
+	// The events of the file access have no uid, no gid and no destination.
+	assert.Equal(t, "/etc/shadow", lines[1]["path"])
+	assert.Equal(t, "monitor", lines[1]["mode"])
+	assert.NotContains(t, lines[1], "uid")
+	assert.NotContains(t, lines[1], "dst_ip")
+
+	assert.Equal(t, "monitor", lines[2]["mode"])
+	assert.Equal(t, Stats{Written: 3}, o.Stats())
+}
+
+func TestWriteDropsUnknownEvents(t *testing.T) {
+	conf := testConfig(t)
+	o, err := New(conf, nil, bouhekitest.NewClock(now))
+	assert.Nil(t, err)
+	defer o.Close()
+
+	o.Write(alert.Event{Audit: config.ALERT_AUDIT_NETWORK}, struct{ Addr string }{"203.0.113.10"})
+	assert.Equal(t, Stats{Dropped: 1}, o.Stats())
+}
+
+func TestWriteFilter(t *testing.T) {
+	conf := testConfig(t)
+	conf.Filter = &config.AlertEventFilter{Audit: config.ALERT_AUDIT_NETWORK, Action: "BLOCKED"}
+	o, err := New(conf, nil, bouhekitest.NewClock(now))
+	assert.Nil(t, err)
+
+	o.Write(alert.Event{Audit: config.ALERT_AUDIT_NETWORK, Action: "MONITOR", Comm: "curl"}, blocked)
+	o.Write(alert.Event{Audit: config.ALERT_AUDIT_NETWORK, Action: "BLOCKED", Comm: "curl"}, blocked)
+	assert.Nil(t, o.Close())
+
+	assert.Len(t, readLines(t, conf.File), 1)
+	assert.Equal(t, Stats{Written: 1}, o.Stats())
+}
+
+func TestDestinationTagsRouteTheEvents(t *testing.T) {
+	conf := testConfig(t)
+	conf.Filter = &config.AlertEventFilter{DestinationTags: []string{"cloud-metadata"}}
+	o, err := New(conf, nil, bouhekitest.NewClock(now))
+	assert.Nil(t, err)
+
+	r := &receiver{}
+	w, _ := testWebhook(t, r, func(c *config.AuditWebhookConfig) {
+		c.Filter = &config.AlertEventFilter{DestinationTags: []string{"dns"}}
+	})
+
+	// The event to the metadata endpoint only reaches the file, the one to a resolver only the webhook.
+	metadata := blockedTo("169.254.169.254")
+	metadata.DestinationTags = []string{"cloud-metadata"}
+	resolver := blockedTo("8.8.8.8")
+	resolver.DestinationTags = []string{"dns"}
+	for _, event := range []log.RestrictedNetworkLog{metadata, resolver} {
+		match := alert.Event{Audit: config.ALERT_AUDIT_NETWORK, Action: "BLOCKED", Comm: "curl", DestinationTags: event.DestinationTags}
+		o.Write(match, event)
+		w.Write(match, event)
+	}
+	assert.Nil(t, o.Close())
+	w.flush()
+
+	lines := readLines(t, conf.File)
+	assert.Len(t, lines, 1)
+	assert.Equal(t, "169.254.169.254", lines[0]["dst_ip"])
+	bodies := r.received()
+	assert.Len(t, bodies, 1)
+	var n Notification
+	assert.Nil(t, json.Unmarshal([]byte(bodies[0]), &n))
+	assert.Equal(t, "8.8.8.8", n.DstIP)
+}
+
+func TestRotate(t *testing.T) {
+	conf := testConfig(t)
+	conf.Compress = true
+	o, err := New(conf, nil, bouhekitest.NewClock(now))
+	assert.Nil(t, err)
+
+	match := alert.Event{Audit: config.ALERT_AUDIT_NETWORK, Action: "BLOCKED", Comm: "curl"}
+	o.Write(match, blocked)
+	assert.Nil(t, o.Rotate())
+	o.Write(match, blocked)
+	assert.Nil(t, o.Close())
+
+	// The rotated file is compressed in the background.
+	var rotated string
+	assert.Eventually(t, func() bool {
+		matches, _ := filepath.Glob(strings.TrimSuffix(conf.File, ".jsonl") + "-*.jsonl.gz")
+		if len(matches) != 1 {
+			return false
+		}
+		rotated = matches[0]
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+
+	f, err := os.Open(rotated)
+	assert.Nil(t, err)
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	assert.Nil(t, err)
+	var record Record
+	assert.Nil(t, json.NewDecoder(r).Decode(&record))
+	assert.Equal(t, "203.0.113.10", record.DstIP)
+
+	assert.Len(t, readLines(t, conf.File), 1)
+}
@@ -0,0 +1,406 @@
+package auditoutput
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/alert"
+	"github.com/mrtc0/bouheki/pkg/clock"
+	"github.com/mrtc0/bouheki/pkg/config"
+	log "github.com/mrtc0/bouheki/pkg/log"
+	"github.com/mrtc0/bouheki/pkg/metrics"
+	"github.com/mrtc0/bouheki/pkg/spool"
+)
+
+// WEBHOOK_SPOOL_NAME names the metrics of the spool of the webhook, e.g.
+// bouheki_spool_webhook_records.
+const WEBHOOK_SPOOL_NAME = "webhook"
+
+var (
+	webhookPosted = metrics.NewCounter("audit_output_webhook_posted_total",
+		"Number of audit events posted to the webhook, or spooled to be posted, counting the events of a window posted together.")
+	webhookDropped = metrics.NewCounter("audit_output_webhook_dropped_total",
+		"Number of audit events dropped because the queue of the webhook was full, the webhook failed every retry or the spool rejected them.")
+)
+
+// DefaultWebhook is the webhook used by the package level Write and SetMode. It is nil unless
+// audit_output.webhook is enabled.
+var DefaultWebhook *Webhook
+
+// Notification is the body of a request to the webhook: the record of the first event of a
+// window, and the number of events of the window it stands for, up to the last one.
+type Notification struct {
+	Record
+	Count    int       `json:"count"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// key is what the events posted together have in common: the audit, the action, the process
+// and the destination.
+func (n *Notification) key() string {
+	return strings.Join([]string{n.Audit, n.Action, n.Comm, n.Operation, n.DstIP, strconv.Itoa(int(n.DstPort)), n.Protocol, n.Path, n.SourcePath}, "\x00")
+}
+
+type Webhook struct {
+	mu    sync.Mutex
+	conf  config.AuditWebhookConfig
+	clock clock.Clock
+	// filter is the filter of the config, nil to post every event.
+	filter *alert.Filter
+	// body is the template of the body, nil to post the notifications as JSON.
+	body   *template.Template
+	client *http.Client
+	modes  map[string]string
+	// pending are the notifications of the current window by key, and order their keys in the
+	// order of their first event.
+	pending map[string]*Notification
+	order   []string
+	stats   Stats
+	// next is the earliest time of the next request, for the rate limit.
+	next time.Time
+	// wait sleeps d, and returns false if the webhook was closed first.
+	wait func(d time.Duration) bool
+	// spool keeps the notifications the webhook did not take, when the config has one. The sink
+	// posts them, or spools them to be posted again every retry_interval, from start on.
+	spool *spool.Spool
+	sink  *spool.Sink
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// NewWebhook returns the webhook of conf, posting the events of every audit with its mode of
+// modes, and starts the goroutine that posts them every window.
+func NewWebhook(conf config.AuditWebhookConfig, modes map[string]string, clk clock.Clock) (*Webhook, error) {
+	w, err := newWebhook(conf, modes, clk)
+	if err != nil {
+		return nil, err
+	}
+	w.start()
+	return w, nil
+}
+
+// newWebhook returns the webhook of conf, whose notifications are posted by flush. It opens the
+// spool, whose sink is started by start.
+func newWebhook(conf config.AuditWebhookConfig, modes map[string]string, clk clock.Clock) (*Webhook, error) {
+	w := &Webhook{
+		conf:    conf,
+		clock:   clk,
+		client:  &http.Client{Timeout: conf.Timeout},
+		modes:   map[string]string{},
+		pending: map[string]*Notification{},
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if conf.Filter != nil {
+		filter, err := alert.NewFilter(*conf.Filter)
+		if err != nil {
+			return nil, fmt.Errorf("audit_output.webhook.filter: %w", err)
+		}
+		w.filter = filter
+	}
+	if conf.Body != "" {
+		body, err := template.New("body").Parse(conf.Body)
+		if err != nil {
+			return nil, fmt.Errorf("audit_output.webhook.body: %w", err)
+		}
+		w.body = body
+	}
+	for audit, mode := range modes {
+		w.modes[audit] = mode
+	}
+	if conf.Spool != nil {
+		s, err := spool.Open(WEBHOOK_SPOOL_NAME, *conf.Spool)
+		if err != nil {
+			return nil, fmt.Errorf("audit_output.webhook.spool: %w", err)
+		}
+		w.spool = s
+	}
+	w.wait = w.sleep
+	return w, nil
+}
+
+// start starts the sink of the spool, which posts the spooled notifications again every
+// retry_interval, and the goroutine that posts the notifications every window.
+func (w *Webhook) start() {
+	if w.spool != nil {
+		w.sink = spool.NewSink(webhookSender{w}, w.spool, w.conf.RetryInterval)
+	}
+	go w.run()
+}
+
+// Sink returns the sink of the spool, nil without a spool.
+func (w *Webhook) Sink() *spool.Sink {
+	return w.sink
+}
+
+// SetMode sets the mode the events of audit are posted with, when a reload changes it.
+func (w *Webhook) SetMode(audit string, mode string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.modes[audit] = mode
+}
+
+// Write adds event of the audit of match to the notifications of the window: to the one of the
+// same process and destination if there is one, which counts it. The events the filter does
+// not match are skipped, and counted as neither.
+func (w *Webhook) Write(match alert.Event, event interface{}) {
+	if w.filter != nil && !w.filter.Match(match) {
+		return
+	}
+
+	w.mu.Lock()
+	r, err := NewRecord(match.Audit, w.modes[match.Audit], event, w.clock.Now())
+	if err != nil {
+		w.mu.Unlock()
+		w.drop(1, err)
+		return
+	}
+	n := &Notification{Record: r, Count: 1, LastSeen: r.Timestamp}
+	// The summary of the events the audit suppressed stands for them.
+	if r.Count > 0 {
+		n.Count = int(r.Count)
+	}
+	key := n.key()
+	if pending, ok := w.pending[key]; ok {
+		pending.Count += n.Count
+		pending.LastSeen = r.Timestamp
+		w.mu.Unlock()
+		return
+	}
+	if len(w.pending) >= w.conf.QueueSize {
+		w.mu.Unlock()
+		w.drop(1, fmt.Errorf("the queue of %d notifications is full", w.conf.QueueSize))
+		return
+	}
+	w.pending[key] = n
+	w.order = append(w.order, key)
+	w.mu.Unlock()
+}
+
+// run posts the notifications of every window until Close.
+func (w *Webhook) run() {
+	defer close(w.done)
+
+	ticker := time.NewTicker(w.conf.Window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+		}
+		w.flush()
+	}
+}
+
+// take returns the notifications of the window, in order, and starts the next window.
+func (w *Webhook) take() []*Notification {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	notifications := make([]*Notification, 0, len(w.order))
+	for _, key := range w.order {
+		notifications = append(notifications, w.pending[key])
+	}
+	w.pending = map[string]*Notification{}
+	w.order = nil
+	return notifications
+}
+
+// flush posts the notifications of the window, at most rate_limit per second. Those left when
+// the webhook is closed are dropped. With a spool, the sender waits for the rate limit instead.
+func (w *Webhook) flush() {
+	notifications := w.take()
+	for i, n := range notifications {
+		if w.sink == nil && !w.wait(w.next.Sub(w.clock.Now())) {
+			for _, left := range notifications[i:] {
+				w.drop(left.Count, fmt.Errorf("the webhook was closed"))
+			}
+			return
+		}
+		w.post(n)
+	}
+}
+
+// post posts n, and retries with an exponential backoff until it is taken or max_retries is
+// reached, when it is dropped. With a spool, n is handed to the sink instead.
+func (w *Webhook) post(n *Notification) {
+	body, err := w.render(n)
+	if err != nil {
+		w.drop(n.Count, err)
+		return
+	}
+	if w.sink != nil {
+		w.handOff(n.Count, body)
+		return
+	}
+
+	interval := w.conf.RetryInterval
+	for attempt := 0; ; attempt++ {
+		w.next = w.clock.Now().Add(time.Duration(float64(time.Second) / w.conf.RateLimit))
+		err = w.send(body)
+		if err == nil {
+			w.posted(n.Count)
+			return
+		}
+		if attempt == w.conf.MaxRetries || !w.wait(interval) || !w.wait(w.next.Sub(w.clock.Now())) {
+			w.drop(n.Count, err)
+			return
+		}
+		if interval *= 2; interval > w.conf.MaxRetryInterval {
+			interval = w.conf.MaxRetryInterval
+		}
+	}
+}
+
+// handOff hands the body of count events to the sink, which posts it, or spools it when the
+// webhook fails or older notifications are spooled. A spooled notification is posted: it is only
+// dropped when the spool rejects it.
+func (w *Webhook) handOff(count int, body []byte) {
+	if err := w.sink.Send(body); err != nil {
+		w.drop(count, err)
+		return
+	}
+	w.posted(count)
+}
+
+// render returns the body of n, executed with the template of the config or as JSON.
+func (w *Webhook) render(n *Notification) ([]byte, error) {
+	if w.body == nil {
+		return json.Marshal(n)
+	}
+	var body bytes.Buffer
+	if err := w.body.Execute(&body, n); err != nil {
+		return nil, fmt.Errorf("audit_output.webhook.body: %w", err)
+	}
+	return body.Bytes(), nil
+}
+
+func (w *Webhook) send(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, w.conf.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if w.conf.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+w.conf.BearerToken)
+	}
+	for key, value := range w.conf.Headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("the webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// webhookSender posts the notifications of the sink, at most rate_limit per second. The sink
+// calls it with its lock held, so one request is made at a time. Once the webhook is closed, it
+// no longer waits, as Close posts the notifications within its timeout.
+type webhookSender struct {
+	w *Webhook
+}
+
+func (s webhookSender) Send(body []byte) error {
+	s.w.wait(s.w.next.Sub(s.w.clock.Now()))
+	s.w.next = s.w.clock.Now().Add(time.Duration(float64(time.Second) / s.w.conf.RateLimit))
+	return s.w.send(body)
+}
+
+// sleep is the wait of the webhook, on the time of the system.
+func (w *Webhook) sleep(d time.Duration) bool {
+	if d <= 0 {
+		select {
+		case <-w.stop:
+			return false
+		default:
+			return true
+		}
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-w.stop:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func (w *Webhook) posted(count int) {
+	w.mu.Lock()
+	w.stats.Written += uint64(count)
+	w.mu.Unlock()
+	webhookPosted.Add(uint64(count))
+}
+
+// drop counts the events of a notification that could not be posted.
+func (w *Webhook) drop(count int, err error) {
+	w.mu.Lock()
+	w.stats.Dropped += uint64(count)
+	dropped := w.stats.Dropped
+	w.mu.Unlock()
+	webhookDropped.Add(uint64(count))
+	log.Warn(fmt.Sprintf("audit_output.webhook: dropped %d events, %d so far: %s", count, dropped, err))
+}
+
+// Stats returns the events posted and dropped so far. An event spooled to be posted is posted.
+func (w *Webhook) Stats() Stats {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.stats
+}
+
+// Close stops the windows, and posts the notifications of the last one once each, without a
+// retry, within timeout. The notifications left are dropped, or kept in the spool with the ones
+// spooled before to be posted after a restart.
+func (w *Webhook) Close(timeout time.Duration) error {
+	close(w.stop)
+	<-w.done
+
+	deadline := time.Now().Add(timeout)
+	for _, n := range w.take() {
+		if w.sink == nil && time.Now().After(deadline) {
+			w.drop(n.Count, fmt.Errorf("the webhook was closed"))
+			continue
+		}
+		body, err := w.render(n)
+		if err != nil {
+			w.drop(n.Count, err)
+			continue
+		}
+		if w.sink != nil {
+			w.handOff(n.Count, body)
+			continue
+		}
+		if err := w.send(body); err != nil {
+			w.drop(n.Count, err)
+			continue
+		}
+		w.posted(n.Count)
+	}
+
+	if w.sink == nil {
+		return nil
+	}
+	return w.sink.Close(time.Until(deadline))
+}
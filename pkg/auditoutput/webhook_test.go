@@ -0,0 +1,261 @@
+package auditoutput
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/alert"
+	"github.com/mrtc0/bouheki/pkg/bouhekitest"
+	"github.com/mrtc0/bouheki/pkg/config"
+	log "github.com/mrtc0/bouheki/pkg/log"
+	"github.com/mrtc0/bouheki/pkg/spool/spoolconf"
+	"github.com/stretchr/testify/assert"
+)
+
+// receiver is a webhook that records the requests it takes, and answers an error to the first
+// failures requests.
+type receiver struct {
+	mu       sync.Mutex
+	failures int
+	requests []*http.Request
+	bodies   []string
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.failures > 0 {
+		r.failures--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	body, _ := ioutil.ReadAll(req.Body)
+	r.requests = append(r.requests, req)
+	r.bodies = append(r.bodies, string(body))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (r *receiver) received() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]string{}, r.bodies...)
+}
+
+// testWebhook returns a webhook posting to r, whose waits move clk and are recorded in waits.
+func testWebhook(t *testing.T, r *receiver, update func(c *config.AuditWebhookConfig)) (*Webhook, *[]time.Duration) {
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+
+	conf := config.DefaultConfig().AuditOutput.Webhook
+	conf.Enable = true
+	conf.URL = server.URL
+	if update != nil {
+		update(&conf)
+	}
+	clk := bouhekitest.NewClock(now)
+	w, err := newWebhook(conf, map[string]string{config.ALERT_AUDIT_NETWORK: "block"}, clk)
+	assert.Nil(t, err)
+
+	waits := []time.Duration{}
+	w.wait = func(d time.Duration) bool {
+		if d > 0 {
+			waits = append(waits, d)
+			clk.Advance(d)
+		}
+		return true
+	}
+	return w, &waits
+}
+
+func blockedTo(addr string) log.RestrictedNetworkLog {
+	event := blocked
+	event.Addr = addr
+	return event
+}
+
+func TestWebhookAggregates(t *testing.T) {
+	r := &receiver{}
+	w, _ := testWebhook(t, r, func(c *config.AuditWebhookConfig) {
+		c.BearerToken = "t0ken"
+		c.Headers = map[string]string{"X-Source": "bouheki"}
+	})
+
+	match := alert.Event{Audit: config.ALERT_AUDIT_NETWORK, Action: "BLOCKED", Comm: "curl"}
+	for i := 0; i < 3; i++ {
+		w.Write(match, blocked)
+	}
+	w.Write(match, blockedTo("198.51.100.7"))
+	w.flush()
+
+	bodies := r.received()
+	assert.Len(t, bodies, 2)
+	var n Notification
+	assert.Nil(t, json.Unmarshal([]byte(bodies[0]), &n))
+	assert.Equal(t, 3, n.Count)
+	assert.Equal(t, "203.0.113.10", n.DstIP)
+	assert.Equal(t, "block", n.Mode)
+	assert.Nil(t, json.Unmarshal([]byte(bodies[1]), &n))
+	assert.Equal(t, 1, n.Count)
+	assert.Equal(t, "198.51.100.7", n.DstIP)
+
+	assert.Equal(t, "Bearer t0ken", r.requests[0].Header.Get("Authorization"))
+	assert.Equal(t, "bouheki", r.requests[0].Header.Get("X-Source"))
+	assert.Equal(t, "application/json", r.requests[0].Header.Get("Content-Type"))
+	assert.Equal(t, Stats{Written: 4}, w.Stats())
+
+	// The next window starts empty.
+	w.flush()
+	assert.Len(t, r.received(), 2)
+}
+
+func TestWebhookSummary(t *testing.T) {
+	r := &receiver{}
+	w, _ := testWebhook(t, r, nil)
+
+	// The summary of the events the audit suppressed counts them.
+	summary := blocked
+	summary.Count = 41
+	match := alert.Event{Audit: config.ALERT_AUDIT_NETWORK, Action: "BLOCKED", Comm: "curl"}
+	w.Write(match, blocked)
+	w.Write(match, summary)
+	w.flush()
+
+	bodies := r.received()
+	assert.Len(t, bodies, 1)
+	var n Notification
+	assert.Nil(t, json.Unmarshal([]byte(bodies[0]), &n))
+	assert.Equal(t, 42, n.Count)
+	assert.Equal(t, Stats{Written: 42}, w.Stats())
+}
+
+func TestWebhookBody(t *testing.T) {
+	r := &receiver{}
+	w, _ := testWebhook(t, r, func(c *config.AuditWebhookConfig) {
+		c.Body = `{"text":"bouheki {{.Action}} {{.Comm}} to {{.DstIP}}:{{.DstPort}} ({{.Count}}x)"}`
+	})
+
+	match := alert.Event{Audit: config.ALERT_AUDIT_NETWORK, Action: "BLOCKED", Comm: "curl"}
+	w.Write(match, blocked)
+	w.Write(match, blocked)
+	w.flush()
+
+	assert.Equal(t, []string{`{"text":"bouheki BLOCKED curl to 203.0.113.10:443 (2x)"}`}, r.received())
+}
+
+func TestWebhookRateLimit(t *testing.T) {
+	r := &receiver{}
+	w, waits := testWebhook(t, r, func(c *config.AuditWebhookConfig) { c.RateLimit = 2 })
+
+	match := alert.Event{Audit: config.ALERT_AUDIT_NETWORK, Action: "BLOCKED", Comm: "curl"}
+	for _, addr := range []string{"203.0.113.1", "203.0.113.2", "203.0.113.3"} {
+		w.Write(match, blockedTo(addr))
+	}
+	w.flush()
+
+	assert.Len(t, r.received(), 3)
+	assert.Equal(t, []time.Duration{500 * time.Millisecond, 500 * time.Millisecond}, *waits)
+}
+
+func TestWebhookRetries(t *testing.T) {
+	r := &receiver{failures: 2}
+	w, waits := testWebhook(t, r, nil)
+
+	match := alert.Event{Audit: config.ALERT_AUDIT_NETWORK, Action: "BLOCKED", Comm: "curl"}
+	w.Write(match, blocked)
+	w.flush()
+
+	assert.Len(t, r.received(), 1)
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second}, *waits)
+	assert.Equal(t, Stats{Written: 1}, w.Stats())
+}
+
+func TestWebhookDrops(t *testing.T) {
+	r := &receiver{failures: 10}
+	w, waits := testWebhook(t, r, func(c *config.AuditWebhookConfig) {
+		c.MaxRetries = 3
+		c.MaxRetryInterval = 3 * time.Second
+		c.QueueSize = 1
+	})
+
+	match := alert.Event{Audit: config.ALERT_AUDIT_NETWORK, Action: "BLOCKED", Comm: "curl"}
+	w.Write(match, blocked)
+	w.Write(match, blocked)
+	// The queue holds a single notification.
+	w.Write(match, blockedTo("198.51.100.7"))
+	assert.Equal(t, Stats{Dropped: 1}, w.Stats())
+
+	w.flush()
+	assert.Len(t, r.received(), 0)
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second, 3 * time.Second}, *waits)
+	assert.Equal(t, Stats{Dropped: 3}, w.Stats())
+}
+
+func TestWebhookClose(t *testing.T) {
+	r := &receiver{}
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	conf := config.DefaultConfig().AuditOutput.Webhook
+	conf.Enable = true
+	conf.URL = server.URL
+	conf.Window = time.Hour
+	conf.Filter = &config.AlertEventFilter{Action: "BLOCKED"}
+	w, err := NewWebhook(conf, nil, bouhekitest.NewClock(now))
+	assert.Nil(t, err)
+
+	w.Write(alert.Event{Audit: config.ALERT_AUDIT_NETWORK, Action: "MONITOR", Comm: "curl"}, blocked)
+	w.Write(alert.Event{Audit: config.ALERT_AUDIT_NETWORK, Action: "BLOCKED", Comm: "curl"}, blocked)
+	w.Close(time.Second)
+
+	assert.Len(t, r.received(), 1)
+	assert.Equal(t, Stats{Written: 1}, w.Stats())
+}
+
+func TestWebhookSpoolsThroughAnOutage(t *testing.T) {
+	r := &receiver{failures: 1000}
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	conf := config.DefaultConfig().AuditOutput.Webhook
+	conf.Enable = true
+	conf.URL = server.URL
+	conf.Window = time.Hour
+	conf.RateLimit = 1000
+	conf.RetryInterval = 10 * time.Millisecond
+	conf.Spool = &spoolconf.Config{Dir: t.TempDir()}
+	w, err := NewWebhook(conf, nil, bouhekitest.NewClock(now))
+	assert.Nil(t, err)
+
+	// While the webhook is down, the events are spooled rather than dropped, and kept across a
+	// restart.
+	w.Write(alert.Event{Audit: config.ALERT_AUDIT_NETWORK, Action: "BLOCKED", Comm: "curl"}, blocked)
+	w.flush()
+	w.Write(alert.Event{Audit: config.ALERT_AUDIT_NETWORK, Action: "BLOCKED", Comm: "curl"}, blockedTo("198.51.100.7"))
+	assert.Nil(t, w.Close(10*time.Millisecond))
+	assert.Len(t, r.received(), 0)
+	assert.Equal(t, Stats{Written: 2}, w.Stats())
+	assert.Equal(t, 2, w.Sink().Stats().Records)
+
+	// Once it is back, the spooled events are posted in order.
+	r.mu.Lock()
+	r.failures = 0
+	r.mu.Unlock()
+	w, err = NewWebhook(conf, nil, bouhekitest.NewClock(now))
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool { return len(r.received()) == 2 }, time.Second, 5*time.Millisecond)
+	assert.Nil(t, w.Close(time.Second))
+	assert.Equal(t, 0, w.Sink().Stats().Records)
+
+	var first, second Notification
+	assert.Nil(t, json.Unmarshal([]byte(r.received()[0]), &first))
+	assert.Nil(t, json.Unmarshal([]byte(r.received()[1]), &second))
+	assert.Equal(t, "203.0.113.10", first.DstIP)
+	assert.Equal(t, "198.51.100.7", second.DstIP)
+}
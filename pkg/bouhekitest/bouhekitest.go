@@ -0,0 +1,21 @@
+// Package bouhekitest has the fakes to test code that embeds the network Manager without root,
+// a kernel or a DNS server: Maps, a network.MapBackend, and Clock, a clock.Clock driven by the
+// test. network.DNSResolver is small enough to be implemented by the test itself.
+//
+//	maps := bouhekitest.NewMaps()
+//	clk := bouhekitest.NewClock(time.Now())
+//	mgr, err := network.NewManager(conf, network.WithMapBackend(maps), network.WithClock(clk), network.WithDNSResolver(resolver))
+//
+// Maps reproduces what the Manager can observe of the BPF maps: an update inserts or replaces
+// the value of a key, a delete of a missing key fails with ErrKeyNotExist as the kernel
+// returns ENOENT, and with Limit, an update of a new key fails with ErrMapFull once the map
+// has its max entries. It does not check the sizes of the keys and values, and does not look
+// up anything: the decisions of the programs are what network.Policy.Evaluate returns.
+//
+// Clock only moves when Advance is called, and a Sleep returns once Advance reaches its end.
+// The timers of the Manager all sleep on its clock, so a test that advances the clock past a
+// refresh interval or an expiry sees the jobs of these timers run, e.g. with assert.Eventually.
+//
+// ConformanceCase is a case of a conformance corpus, the decisions the network restriction makes
+// for connections under a config, which the policy and the Manager are both tested against.
+package bouhekitest
@@ -0,0 +1,85 @@
+package bouhekitest
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is a clock.Clock that only moves when Advance is called.
+type Clock struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	now      time.Time
+	sleepers []*sleeper
+}
+
+type sleeper struct {
+	until time.Time
+	done  chan struct{}
+}
+
+func NewClock(now time.Time) *Clock {
+	c := &Clock{now: now}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Sleep returns once Advance has moved the clock by d. It returns right away if d is not positive.
+func (c *Clock) Sleep(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	s := &sleeper{until: c.now.Add(d), done: make(chan struct{})}
+	c.sleepers = append(c.sleepers, s)
+	c.cond.Broadcast()
+	c.mu.Unlock()
+
+	<-s.done
+}
+
+// Advance moves the clock by d, and wakes the sleepers whose end it reaches, the earliest first.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+	for {
+		next := -1
+		for i, s := range c.sleepers {
+			if !s.until.After(c.now) && (next < 0 || s.until.Before(c.sleepers[next].until)) {
+				next = i
+			}
+		}
+		if next < 0 {
+			break
+		}
+		close(c.sleepers[next].done)
+		c.sleepers = append(c.sleepers[:next], c.sleepers[next+1:]...)
+	}
+	c.cond.Broadcast()
+}
+
+// Sleepers returns the number of goroutines blocked in Sleep.
+func (c *Clock) Sleepers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.sleepers)
+}
+
+// BlockUntil blocks until n goroutines are blocked in Sleep, so that a timer is armed
+// before the test advances the clock past it.
+func (c *Clock) BlockUntil(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.sleepers) < n {
+		c.cond.Wait()
+	}
+}
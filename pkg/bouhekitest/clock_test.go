@@ -0,0 +1,34 @@
+package bouhekitest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClock(t *testing.T) {
+	start := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	clk := NewClock(start)
+	clk.Sleep(0)
+
+	woken := make(chan time.Duration, 2)
+	for _, d := range []time.Duration{2 * time.Minute, time.Minute} {
+		go func(d time.Duration) {
+			clk.Sleep(d)
+			woken <- d
+		}(d)
+	}
+	clk.BlockUntil(2)
+
+	clk.Advance(30 * time.Second)
+	assert.Equal(t, 2, clk.Sleepers())
+
+	clk.Advance(30 * time.Second)
+	assert.Equal(t, time.Minute, <-woken)
+	assert.Equal(t, 1, clk.Sleepers())
+
+	clk.Advance(time.Minute)
+	assert.Equal(t, 2*time.Minute, <-woken)
+	assert.Equal(t, start.Add(2*time.Minute), clk.Now())
+}
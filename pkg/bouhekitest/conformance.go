@@ -0,0 +1,89 @@
+package bouhekitest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/policy"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	DECISION_ALLOW = "allow"
+	DECISION_DENY  = "deny"
+)
+
+// ConformanceCase is a config of a conformance corpus, such as pkg/policy/testdata/conformance.yaml,
+// and the decisions of the network restriction for connections under it.
+type ConformanceCase struct {
+	Name        string                  `yaml:"name"`
+	Config      string                  `yaml:"config"`
+	Connections []ConformanceConnection `yaml:"connections"`
+}
+
+// ConformanceConnection is a connection of a ConformanceCase, and its expected decision.
+type ConformanceConnection struct {
+	Addr     string `yaml:"addr"`
+	Port     uint16 `yaml:"port"`
+	Protocol string `yaml:"protocol"`
+	Command  string `yaml:"command"`
+	// ExePath is the executable of the task, which no path rule matches when it is empty.
+	ExePath string `yaml:"exe_path"`
+	UID     uint32 `yaml:"uid"`
+	GID     uint32 `yaml:"gid"`
+	// Decision is DECISION_ALLOW or DECISION_DENY.
+	Decision string `yaml:"decision"`
+	// Rule is the Rule of the decision of a denied connection, or of a permitted one a deny
+	// entry in mode: monitor would have denied.
+	Rule string `yaml:"rule"`
+}
+
+// LoadConformanceCases reads the cases of the corpus at path.
+func LoadConformanceCases(path string) ([]ConformanceCase, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	corpus := struct {
+		Cases []ConformanceCase `yaml:"cases"`
+	}{}
+	if err := yaml.UnmarshalStrict(data, &corpus); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for _, c := range corpus.Cases {
+		for _, conn := range c.Connections {
+			if net.ParseIP(conn.Addr) == nil {
+				return nil, fmt.Errorf("%s: case %q: %q is not an address", path, c.Name, conn.Addr)
+			}
+			if conn.Decision != DECISION_ALLOW && conn.Decision != DECISION_DENY {
+				return nil, fmt.Errorf("%s: case %q: the decision of %s is %q, expected %s or %s", path, c.Name, conn.Addr, conn.Decision, DECISION_ALLOW, DECISION_DENY)
+			}
+		}
+	}
+	return corpus.Cases, nil
+}
+
+// Parse returns the config of the case.
+func (c ConformanceCase) Parse() (*config.Config, error) {
+	return config.Parse([]byte(c.Config))
+}
+
+// Input returns the connection as the policy evaluates it.
+func (c ConformanceConnection) Input() policy.ConnInput {
+	return policy.ConnInput{
+		Addr:     net.ParseIP(c.Addr),
+		Port:     c.Port,
+		SockType: policy.ProtocolSockType(c.Protocol),
+		Command:  c.Command,
+		ExePath:  c.ExePath,
+		UID:      c.UID,
+		GID:      c.GID,
+	}
+}
+
+// Denied reports whether the connection is expected to be denied.
+func (c ConformanceConnection) Denied() bool {
+	return c.Decision == DECISION_DENY
+}
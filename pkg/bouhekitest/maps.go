@@ -0,0 +1,169 @@
+package bouhekitest
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"syscall"
+)
+
+var (
+	// ErrKeyNotExist is returned by Delete for a missing key.
+	ErrKeyNotExist = fmt.Errorf("key does not exist: %w", syscall.ENOENT)
+	// ErrMapFull is returned by Update for a new key once the map has the entries of Limit.
+	ErrMapFull = fmt.Errorf("map is full: %w", syscall.E2BIG)
+	// ErrInjected is returned by the write that FailAt selects.
+	ErrInjected = errors.New("injected write failure")
+)
+
+// Write is a successful write to a map. A nil Value deletes Key.
+type Write struct {
+	Map   string
+	Key   []byte
+	Value []byte
+}
+
+func (w Write) IsDelete() bool {
+	return w.Value == nil
+}
+
+// Maps keeps the entries written by the Manager in memory and records the writes.
+type Maps struct {
+	mu      sync.Mutex
+	entries map[string]map[string][]byte
+	writes  []Write
+	limits  map[string]int
+	failAt  int
+	onWrite func(w Write)
+}
+
+func NewMaps() *Maps {
+	return &Maps{entries: map[string]map[string][]byte{}, limits: map[string]int{}}
+}
+
+func (m *Maps) Update(mapName string, key, value []byte) error {
+	return m.write(Write{Map: mapName, Key: copyBytes(key), Value: copyBytes(value)})
+}
+
+func (m *Maps) Delete(mapName string, key []byte) error {
+	return m.write(Write{Map: mapName, Key: copyBytes(key)})
+}
+
+func (m *Maps) write(w Write) error {
+	m.mu.Lock()
+	onWrite := m.onWrite
+	m.mu.Unlock()
+	if onWrite != nil {
+		onWrite(w)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.failAt > 0 && len(m.writes)+1 == m.failAt {
+		m.failAt = 0
+		return ErrInjected
+	}
+
+	entries := m.entries[w.Map]
+	_, exists := entries[string(w.Key)]
+	if w.IsDelete() {
+		if !exists {
+			return ErrKeyNotExist
+		}
+		delete(entries, string(w.Key))
+	} else {
+		if limit, ok := m.limits[w.Map]; ok && !exists && len(entries) >= limit {
+			return ErrMapFull
+		}
+		if entries == nil {
+			entries = map[string][]byte{}
+			m.entries[w.Map] = entries
+		}
+		entries[string(w.Key)] = w.Value
+	}
+	m.writes = append(m.writes, w)
+	return nil
+}
+
+// Entries returns a copy of the entries of mapName, by key.
+func (m *Maps) Entries(mapName string) map[string][]byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entries := make(map[string][]byte, len(m.entries[mapName]))
+	for key, value := range m.entries[mapName] {
+		entries[key] = copyBytes(value)
+	}
+	return entries
+}
+
+// Len returns the number of entries of every map.
+func (m *Maps) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n := 0
+	for _, entries := range m.entries {
+		n += len(entries)
+	}
+	return n
+}
+
+// Has reports whether mapName has key.
+func (m *Maps) Has(mapName string, key []byte) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.entries[mapName][string(key)]
+	return ok
+}
+
+// Lookup returns the value of key in mapName, and whether mapName has it.
+func (m *Maps) Lookup(mapName string, key []byte) ([]byte, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	value, ok := m.entries[mapName][string(key)]
+	return copyBytes(value), ok, nil
+}
+
+// Writes returns the successful writes since NewMaps or the last ClearWrites, in order.
+func (m *Maps) Writes() []Write {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Write{}, m.writes...)
+}
+
+// ClearWrites forgets the recorded writes. The entries are kept.
+func (m *Maps) ClearWrites() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.writes = nil
+}
+
+// Limit bounds the number of entries of mapName, like the max entries of a BPF map.
+func (m *Maps) Limit(mapName string, maxEntries int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.limits[mapName] = maxEntries
+}
+
+// FailAt makes the n-th write, counted from 1 over the recorded writes, fail once with ErrInjected.
+func (m *Maps) FailAt(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failAt = n
+}
+
+// OnWrite calls fn before every write, successful or not.
+func (m *Maps) OnWrite(fn func(w Write)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onWrite = fn
+}
+
+func copyBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
@@ -0,0 +1,64 @@
+package bouhekitest
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaps(t *testing.T) {
+	maps := NewMaps()
+	assert.Nil(t, maps.Update("allowed_uid_list", []byte{1}, []byte{1}))
+	assert.Nil(t, maps.Update("allowed_uid_list", []byte{1}, []byte{2}))
+	assert.Equal(t, map[string][]byte{"\x01": {2}}, maps.Entries("allowed_uid_list"))
+	assert.Equal(t, 1, maps.Len())
+
+	assert.Nil(t, maps.Delete("allowed_uid_list", []byte{1}))
+	assert.False(t, maps.Has("allowed_uid_list", []byte{1}))
+	// Like the kernel, a missing key can not be deleted.
+	err := maps.Delete("allowed_uid_list", []byte{1})
+	assert.ErrorIs(t, err, ErrKeyNotExist)
+	assert.ErrorIs(t, err, syscall.ENOENT)
+
+	assert.Equal(t, []Write{
+		{Map: "allowed_uid_list", Key: []byte{1}, Value: []byte{1}},
+		{Map: "allowed_uid_list", Key: []byte{1}, Value: []byte{2}},
+		{Map: "allowed_uid_list", Key: []byte{1}},
+	}, maps.Writes())
+	maps.ClearWrites()
+	assert.Empty(t, maps.Writes())
+}
+
+func TestMapsLimit(t *testing.T) {
+	maps := NewMaps()
+	maps.Limit("denied_v4_cidr_list", 1)
+
+	assert.Nil(t, maps.Update("denied_v4_cidr_list", []byte{1}, []byte{1}))
+	assert.ErrorIs(t, maps.Update("denied_v4_cidr_list", []byte{2}, []byte{1}), syscall.E2BIG)
+	// A full map still replaces the values of its keys.
+	assert.Nil(t, maps.Update("denied_v4_cidr_list", []byte{1}, []byte{2}))
+}
+
+func TestMapsFailAt(t *testing.T) {
+	maps := NewMaps()
+	written := []Write{}
+	maps.OnWrite(func(w Write) { written = append(written, w) })
+	maps.FailAt(2)
+
+	assert.Nil(t, maps.Update("allowed_uid_list", []byte{1}, []byte{1}))
+	assert.ErrorIs(t, maps.Update("allowed_uid_list", []byte{2}, []byte{1}), ErrInjected)
+	// It fails once.
+	assert.Nil(t, maps.Update("allowed_uid_list", []byte{2}, []byte{1}))
+
+	assert.Len(t, maps.Writes(), 2)
+	assert.Len(t, written, 3)
+}
+
+func TestMapsCopyTheKeys(t *testing.T) {
+	maps := NewMaps()
+	key := []byte{1}
+	assert.Nil(t, maps.Update("allowed_uid_list", key, []byte{1}))
+	key[0] = 2
+	assert.True(t, maps.Has("allowed_uid_list", []byte{1}))
+}
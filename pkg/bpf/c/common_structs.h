@@ -4,6 +4,7 @@
 #include <bpf/bpf_tracing.h>
 
 #define ALLOW_ACCESS 0
+// The size of audit_events unless network.audit.ringbuf_size is set, see config.AUDIT_DEFAULT_RINGBUF_SIZE.
 #define AUDIT_EVENTS_RING_SIZE (4 * 4096)
 #define TASK_COMM_LEN 16
 #define NEW_UTS_LEN 64
@@ -24,6 +25,24 @@
     __type(value, val_type);                     \
   } name SEC(".maps")
 
+#define BPF_LRU_HASH(name, key_type, val_type, size) \
+  struct                                             \
+  {                                                  \
+    __uint(type, BPF_MAP_TYPE_LRU_HASH);             \
+    __uint(max_entries, size);                       \
+    __type(key, key_type);                           \
+    __type(value, val_type);                         \
+  } name SEC(".maps")
+
+#define BPF_ARRAY(name, val_type, size) \
+  struct                                \
+  {                                     \
+    __uint(type, BPF_MAP_TYPE_ARRAY);   \
+    __uint(max_entries, size);          \
+    __type(key, u32);                   \
+    __type(value, val_type);            \
+  } name SEC(".maps")
+
 enum mode
 {
   MODE_MONITOR,
@@ -33,13 +52,28 @@ enum mode
 enum target
 {
   TARGET_HOST,
-  TARGET_CONTAINER
+  TARGET_CONTAINER,
+  // Both, the network restriction only: network.host and network.container are selected by
+  // whether the task is in a classified container.
+  TARGET_ALL
+};
+
+// How is_container decides that the current task runs in a container.
+enum classification
+{
+  CLASSIFY_MOUNT_NAMESPACE, // Not in the initial mount namespace.
+  CLASSIFY_PID_NAMESPACE,   // In a nested pid namespace.
+  CLASSIFY_CGROUP           // In a cgroup listed by userspace.
 };
 
 enum lsm_hook_point
 {
   CONNECT,
-  SENDMSG // Not implemented yet.
+  SENDMSG, // The destination of a datagram sent on an unconnected socket.
+  CONNECT_KPROBE, // security_socket_connect kprobe, used without BPF LSM.
+  BIND,
+  BIND_KPROBE, // security_socket_bind kprobe, used without BPF LSM.
+  SENDMSG_KPROBE // security_socket_sendmsg kprobe, used without BPF LSM.
 };
 
 static inline int _is_host_mntns()
@@ -67,6 +101,17 @@ static inline int is_container()
   return !_is_host_mntns();
 }
 
+static inline int _is_nested_pidns()
+{
+  struct task_struct *current_task;
+  unsigned int level;
+
+  current_task = (struct task_struct *)bpf_get_current_task();
+  level = BPF_CORE_READ(current_task, thread_pid, level);
+
+  return level > 0;
+}
+
 static inline int strcmp(const unsigned char *a, const unsigned char *b, size_t len)
 {
   unsigned char c1, c2;
@@ -14,20 +14,175 @@ struct network_bouheki_config
   enum target target;
   int has_allow_command;
   int has_allow_uid;
+  int has_allow_gid;
+  int command_case_insensitive;
+  enum classification classification;
+  int quiesced; // Set while userspace drains audit_events on shutdown.
+  // A deny list is only looked up when it has entries: an absent list and an empty one are the same.
+  int has_deny_command;
+  int has_deny_uid;
+  int has_deny_gid;
+  int audit_disabled; // network.audit.enabled: false, nothing is written to audit_events.
+  int deny_shards; // resources.deny_shards, the shards of denied_v4_cidr_shards and denied_v6_cidr_shards in use.
+  // The port lists hold each range as the prefixes that cover it.
+  int has_allow_port;
+  int has_deny_port;
+  // The sizes of the lists of network.ingress, which socket_bind looks the local address up in.
+  int has_ingress_allow_cidr;
+  int has_ingress_allow_port;
+  int has_ingress_deny_port;
+  // network.families: the connections of these families are not restricted, and are only
+  // reported, as allowed, when other_families_audit is set.
+  int disabled_families;
+  int other_families_audit;
+  int rule_hits; // network.rule_hits.enable, the matches are recorded in rule_last_hit.
+  // The sizes of network.command.allow_paths and deny_paths.
+  int has_allow_path;
+  int has_deny_path;
+  // The numbers of patterns of network.command.allow and deny, at indices 0 to the number - 1.
+  int has_allow_command_pattern;
+  int has_deny_command_pattern;
+  // The number of entries of network.policies, and their masks: bit i is the entry at index i.
+  int policy_entries;
+  u64 policy_entry_any_command; // The entries without a command, which select every comm.
+  u64 policy_entry_any_uid;
+  u64 policy_entry_any_gid;
+  u64 policy_entry_has_allow; // The entries with an allow list, which deny the other destinations.
+  enum default_action default_action;
+  enum precedence precedence;
+  // network.audit.dedup.kernel_window: a task's connections to a destination are reported once
+  // per report_interval_ns, 0 for the datagrams only, once per SENDMSG_REPORT_INTERVAL_NS.
+  u64 report_interval_ns;
+  // With target: all, the entries of network.host and network.container, which only select the
+  // tasks outside and inside the classified containers.
+  u64 policy_entry_host;
+  u64 policy_entry_container;
+  // CONFIG_MAP_LAYOUT_VERSION of manager.go, which a bouheki checks before it adopts the pinned maps.
+  int layout_version;
 };
 
 BPF_RING_BUF(audit_events, AUDIT_EVENTS_RING_SIZE);
+
+// Counts the events written to audit_events, so that userspace knows when it has read them all.
+enum audit_event_stat
+{
+  AUDIT_EVENTS_SUBMITTED,
+  AUDIT_EVENTS_DROPPED,
+  AUDIT_EVENTS_SUPPRESSED,
+  AUDIT_EVENTS_REPEATED,
+  AUDIT_EVENT_STATS_LEN
+};
+BPF_ARRAY(audit_event_stats, u64, AUDIT_EVENT_STATS_LEN);
+// The EVENT_SCHEMA_VERSION of the programs, written by the daemon that loads them, so
+// that a daemon adopting them can tell whether it decodes their events.
+BPF_ARRAY(event_schema, u32, 1);
+
 BPF_HASH(network_bouheki_config_map, u32, struct network_bouheki_config, 256);
 
 BPF_HASH(allowed_command_list, struct allowed_command_key, u32, 256);
 BPF_HASH(denied_command_list, struct denied_command_key, u32, 256);
+BPF_HASH(allowed_command_pattern_list, u32, struct command_pattern, COMMAND_PATTERN_MAX);
+BPF_HASH(denied_command_pattern_list, u32, struct command_pattern, COMMAND_PATTERN_MAX);
+
+// Per-task state is kept in maps keyed by the tgid of a task, whose values begin with a
+// struct task_entry. task_exit deletes the entries of a task when it exits, so that a
+// recycled pid never sees the state of an exited task. A feature declares its map with
+// BPF_TASK_HASH, adds it to TASK_MAPS and registers it with registerTaskMap in taskmaps.go.
+struct task_entry
+{
+  u64 start_boottime; // Of the thread group leader, to tell a recycled pid from the task.
+};
+
+#define BPF_TASK_HASH(name, val_type, size) BPF_HASH(name, u32, val_type, size)
+
+// The path of the executable of each task, which network.command.allow_paths and deny_paths
+// match. It is written when the task executes, inherited by the processes it forks, and written
+// by userspace for the tasks that were running when it started.
+struct exe_path_entry
+{
+  struct task_entry task;
+  struct path_trie_key key; // prefixlen covers the path and its NUL.
+};
+
+BPF_TASK_HASH(task_exe_paths, struct exe_path_entry, 16384);
+
+// TASK_MAPS(f) applies f to every per-task map.
+#define TASK_MAPS(f) f(task_exe_paths)
+
+static __always_inline void task_entry_init(struct task_entry *entry) {
+  struct task_struct *task = (struct task_struct *)bpf_get_current_task();
+  entry->start_boottime = BPF_CORE_READ(task, group_leader, start_boottime);
+}
+
+// The path lists hold an executable as its path and NUL, and a directory as its path ending
+// with /, which prefixes the executables below it.
+struct {
+  __uint(type, BPF_MAP_TYPE_LPM_TRIE);
+  __uint(max_entries, 256);
+  __type(key, struct path_trie_key);
+  __type(value, char);
+  __uint(map_flags, BPF_F_NO_PREALLOC);
+} allowed_path_list SEC(".maps");
+
+struct {
+  __uint(type, BPF_MAP_TYPE_LPM_TRIE);
+  __uint(max_entries, 256);
+  __type(key, struct path_trie_key);
+  __type(value, char);
+  __uint(map_flags, BPF_F_NO_PREALLOC);
+} denied_path_list SEC(".maps");
 
 BPF_HASH(allowed_uid_list, struct allowed_uid_key, u32, 256);
 BPF_HASH(denied_uid_list, struct denied_uid_key, u32, 256);
 
+// The ranges of network.uid, which the hashes above would need an entry of each uid for.
+struct {
+  __uint(type, BPF_MAP_TYPE_LPM_TRIE);
+  __uint(max_entries, 256);
+  __type(key, struct uid_trie_key);
+  __type(value, char);
+  __uint(map_flags, BPF_F_NO_PREALLOC);
+} allowed_uid_range_list SEC(".maps");
+
+struct {
+  __uint(type, BPF_MAP_TYPE_LPM_TRIE);
+  __uint(max_entries, 256);
+  __type(key, struct uid_trie_key);
+  __type(value, char);
+  __uint(map_flags, BPF_F_NO_PREALLOC);
+} denied_uid_range_list SEC(".maps");
+
 BPF_HASH(allowed_gid_list, struct allowed_gid_key, u32, 256);
 BPF_HASH(denied_gid_list, struct denied_gid_key, u32, 256);
 
+// The selectors of network.policies: the mask of the entries that list each comm, uid and gid.
+BPF_HASH(policy_entry_command_list, struct allowed_command_key, u64, 256);
+BPF_HASH(policy_entry_uid_list, u32, u64, 256);
+BPF_HASH(policy_entry_gid_list, u32, u64, 256);
+
+// Cgroup ids classified as containers by userspace, for CLASSIFY_CGROUP.
+BPF_HASH(container_cgroup_list, u64, u8, 1024);
+
+// A task sending datagrams to a destination calls sendmsg for each of them. The decision of every
+// datagram stands, but a destination is only reported once per SENDMSG_REPORT_INTERVAL_NS for a
+// task, so that a blocked sender does not fill audit_events. With report_interval_ns, the
+// connections are reported the same way, once per report_interval_ns.
+#define SENDMSG_REPORT_INTERVAL_NS (1000ULL * 1000 * 1000)
+
+struct sendmsg_report_key
+{
+  u32 tgid;
+  u16 family;
+  u16 port; // In network byte order.
+  u8 addr[16];
+};
+
+// The time of the last report of each destination, the least recently reported evicted first.
+BPF_LRU_HASH(sendmsg_reported, struct sendmsg_report_key, u64, 4096);
+
+// The last match and the number of matches of each rule_hit_key, the least recently matched evicted first.
+BPF_LRU_HASH(rule_last_hit, struct rule_hit_key, struct rule_hit, 8192);
+
 struct {
   __uint(type, BPF_MAP_TYPE_LPM_TRIE);
   __uint(max_entries, 256);
@@ -60,7 +215,228 @@ struct {
   __uint(map_flags, BPF_F_NO_PREALLOC);
 } allowed_v6_cidr_list SEC(".maps");
 
-static inline void report_ipv4_event(void *ctx, u64 cg, enum action action,
+struct {
+  __uint(type, BPF_MAP_TYPE_LPM_TRIE);
+  __uint(max_entries, 256);
+  __type(key, struct ipv4_protocol_trie_key);
+  __type(value, char);
+  __uint(map_flags, BPF_F_NO_PREALLOC);
+} allowed_v4_protocol_cidr_list SEC(".maps");
+
+struct {
+  __uint(type, BPF_MAP_TYPE_LPM_TRIE);
+  __uint(max_entries, 256);
+  __type(key, struct ipv6_protocol_trie_key);
+  __type(value, char);
+  __uint(map_flags, BPF_F_NO_PREALLOC);
+} allowed_v6_protocol_cidr_list SEC(".maps");
+
+struct {
+  __uint(type, BPF_MAP_TYPE_LPM_TRIE);
+  __uint(max_entries, 256);
+  __type(key, struct ipv4_protocol_trie_key);
+  __type(value, char);
+  __uint(map_flags, BPF_F_NO_PREALLOC);
+} denied_v4_protocol_cidr_list SEC(".maps");
+
+struct {
+  __uint(type, BPF_MAP_TYPE_LPM_TRIE);
+  __uint(max_entries, 256);
+  __type(key, struct ipv6_protocol_trie_key);
+  __type(value, char);
+  __uint(map_flags, BPF_F_NO_PREALLOC);
+} denied_v6_protocol_cidr_list SEC(".maps");
+
+// The CIDR lists of network.policies hold the tag of the entry, its index + 1, where the
+// protocol lists hold the socket type.
+struct {
+  __uint(type, BPF_MAP_TYPE_LPM_TRIE);
+  __uint(max_entries, 256);
+  __type(key, struct ipv4_protocol_trie_key);
+  __type(value, char);
+  __uint(map_flags, BPF_F_NO_PREALLOC);
+} allowed_v4_entry_cidr_list SEC(".maps");
+
+struct {
+  __uint(type, BPF_MAP_TYPE_LPM_TRIE);
+  __uint(max_entries, 256);
+  __type(key, struct ipv6_protocol_trie_key);
+  __type(value, char);
+  __uint(map_flags, BPF_F_NO_PREALLOC);
+} allowed_v6_entry_cidr_list SEC(".maps");
+
+struct {
+  __uint(type, BPF_MAP_TYPE_LPM_TRIE);
+  __uint(max_entries, 256);
+  __type(key, struct ipv4_protocol_trie_key);
+  __type(value, char);
+  __uint(map_flags, BPF_F_NO_PREALLOC);
+} denied_v4_entry_cidr_list SEC(".maps");
+
+struct {
+  __uint(type, BPF_MAP_TYPE_LPM_TRIE);
+  __uint(max_entries, 256);
+  __type(key, struct ipv6_protocol_trie_key);
+  __type(value, char);
+  __uint(map_flags, BPF_F_NO_PREALLOC);
+} denied_v6_entry_cidr_list SEC(".maps");
+
+struct {
+  __uint(type, BPF_MAP_TYPE_LPM_TRIE);
+  __uint(max_entries, 256);
+  __type(key, struct port_trie_key);
+  __type(value, char);
+  __uint(map_flags, BPF_F_NO_PREALLOC);
+} allowed_port_list SEC(".maps");
+
+struct {
+  __uint(type, BPF_MAP_TYPE_LPM_TRIE);
+  __uint(max_entries, 256);
+  __type(key, struct port_trie_key);
+  __type(value, char);
+  __uint(map_flags, BPF_F_NO_PREALLOC);
+} denied_port_list SEC(".maps");
+
+// The lists of network.ingress, keyed as the lists of the connections.
+struct {
+  __uint(type, BPF_MAP_TYPE_LPM_TRIE);
+  __uint(max_entries, 256);
+  __type(key, struct ipv4_trie_key);
+  __type(value, char);
+  __uint(map_flags, BPF_F_NO_PREALLOC);
+} ingress_allowed_v4_cidr_list SEC(".maps");
+
+struct {
+  __uint(type, BPF_MAP_TYPE_LPM_TRIE);
+  __uint(max_entries, 256);
+  __type(key, struct ipv6_trie_key);
+  __type(value, char);
+  __uint(map_flags, BPF_F_NO_PREALLOC);
+} ingress_allowed_v6_cidr_list SEC(".maps");
+
+struct {
+  __uint(type, BPF_MAP_TYPE_LPM_TRIE);
+  __uint(max_entries, 256);
+  __type(key, struct ipv4_trie_key);
+  __type(value, char);
+  __uint(map_flags, BPF_F_NO_PREALLOC);
+} ingress_denied_v4_cidr_list SEC(".maps");
+
+struct {
+  __uint(type, BPF_MAP_TYPE_LPM_TRIE);
+  __uint(max_entries, 256);
+  __type(key, struct ipv6_trie_key);
+  __type(value, char);
+  __uint(map_flags, BPF_F_NO_PREALLOC);
+} ingress_denied_v6_cidr_list SEC(".maps");
+
+struct {
+  __uint(type, BPF_MAP_TYPE_LPM_TRIE);
+  __uint(max_entries, 256);
+  __type(key, struct port_trie_key);
+  __type(value, char);
+  __uint(map_flags, BPF_F_NO_PREALLOC);
+} ingress_allowed_port_list SEC(".maps");
+
+struct {
+  __uint(type, BPF_MAP_TYPE_LPM_TRIE);
+  __uint(max_entries, 256);
+  __type(key, struct port_trie_key);
+  __type(value, char);
+  __uint(map_flags, BPF_F_NO_PREALLOC);
+} ingress_denied_port_list SEC(".maps");
+
+// DENY_SHARDS_MAX is RESOURCES_MAX_DENY_SHARDS of pkg/config. The deny rule sets are split across
+// deny_shards tries of each family when resources.deny_shards is set, so that a very large
+// feed is never written to a single trie. The shards are not preallocated: the unused ones are empty.
+#define DENY_SHARDS_MAX 8
+
+struct denied_v4_cidr_shard {
+  __uint(type, BPF_MAP_TYPE_LPM_TRIE);
+  __uint(max_entries, 256);
+  __type(key, struct ipv4_trie_key);
+  __type(value, char);
+  __uint(map_flags, BPF_F_NO_PREALLOC);
+};
+
+struct denied_v6_cidr_shard {
+  __uint(type, BPF_MAP_TYPE_LPM_TRIE);
+  __uint(max_entries, 256);
+  __type(key, struct ipv6_trie_key);
+  __type(value, char);
+  __uint(map_flags, BPF_F_NO_PREALLOC);
+};
+
+struct denied_v4_cidr_shard denied_v4_cidr_shard_0 SEC(".maps");
+struct denied_v4_cidr_shard denied_v4_cidr_shard_1 SEC(".maps");
+struct denied_v4_cidr_shard denied_v4_cidr_shard_2 SEC(".maps");
+struct denied_v4_cidr_shard denied_v4_cidr_shard_3 SEC(".maps");
+struct denied_v4_cidr_shard denied_v4_cidr_shard_4 SEC(".maps");
+struct denied_v4_cidr_shard denied_v4_cidr_shard_5 SEC(".maps");
+struct denied_v4_cidr_shard denied_v4_cidr_shard_6 SEC(".maps");
+struct denied_v4_cidr_shard denied_v4_cidr_shard_7 SEC(".maps");
+
+struct denied_v6_cidr_shard denied_v6_cidr_shard_0 SEC(".maps");
+struct denied_v6_cidr_shard denied_v6_cidr_shard_1 SEC(".maps");
+struct denied_v6_cidr_shard denied_v6_cidr_shard_2 SEC(".maps");
+struct denied_v6_cidr_shard denied_v6_cidr_shard_3 SEC(".maps");
+struct denied_v6_cidr_shard denied_v6_cidr_shard_4 SEC(".maps");
+struct denied_v6_cidr_shard denied_v6_cidr_shard_5 SEC(".maps");
+struct denied_v6_cidr_shard denied_v6_cidr_shard_6 SEC(".maps");
+struct denied_v6_cidr_shard denied_v6_cidr_shard_7 SEC(".maps");
+
+struct {
+  __uint(type, BPF_MAP_TYPE_ARRAY_OF_MAPS);
+  __uint(max_entries, DENY_SHARDS_MAX);
+  __type(key, u32);
+  __array(values, struct denied_v4_cidr_shard);
+} denied_v4_cidr_shards SEC(".maps") = {
+  .values = {
+    &denied_v4_cidr_shard_0,
+    &denied_v4_cidr_shard_1,
+    &denied_v4_cidr_shard_2,
+    &denied_v4_cidr_shard_3,
+    &denied_v4_cidr_shard_4,
+    &denied_v4_cidr_shard_5,
+    &denied_v4_cidr_shard_6,
+    &denied_v4_cidr_shard_7,
+  },
+};
+
+struct {
+  __uint(type, BPF_MAP_TYPE_ARRAY_OF_MAPS);
+  __uint(max_entries, DENY_SHARDS_MAX);
+  __type(key, u32);
+  __array(values, struct denied_v6_cidr_shard);
+} denied_v6_cidr_shards SEC(".maps") = {
+  .values = {
+    &denied_v6_cidr_shard_0,
+    &denied_v6_cidr_shard_1,
+    &denied_v6_cidr_shard_2,
+    &denied_v6_cidr_shard_3,
+    &denied_v6_cidr_shard_4,
+    &denied_v6_cidr_shard_5,
+    &denied_v6_cidr_shard_6,
+    &denied_v6_cidr_shard_7,
+  },
+};
+
+static inline void count_audit_stat(u32 key) {
+  u64 *count = bpf_map_lookup_elem(&audit_event_stats, &key);
+  if (count)
+    __sync_fetch_and_add(count, 1);
+}
+
+static inline void count_audit_event(long err) {
+  count_audit_stat(err ? AUDIT_EVENTS_DROPPED : AUDIT_EVENTS_SUBMITTED);
+}
+
+static inline void report_ipv4_event(void *ctx, u64 cg, u64 matched,
+                                     enum action action,
+                                     enum verdict verdict,
+                                     u8 rule,
+                                     u8 monitored,
+                                     u8 container,
                                      enum lsm_hook_point point,
                                      struct socket *sock,
                                      const struct sockaddr_in *daddr) {
@@ -77,26 +453,43 @@ static inline void report_ipv4_event(void *ctx, u64 cg, enum action action,
   __builtin_memset(&ev, 0, sizeof(ev));
   BPF_CORE_READ_INTO(&ev.hdr.nodename, uts_ns, name.nodename);
 
+  ev.hdr.magic = EVENT_MAGIC;
+  ev.hdr.version = EVENT_SCHEMA_VERSION;
+  ev.hdr.header_size = sizeof(ev.hdr);
+  ev.hdr.size = sizeof(ev);
   ev.hdr.cgroup = cg;
+  ev.hdr.matched_cgroup = matched;
   ev.hdr.pid = (u32)(bpf_get_current_pid_tgid() >> 32);
   ev.hdr.type = BLOCKED_IPV4;
+  ev.hdr.uid = (u32)(bpf_get_current_uid_gid() & 0xffffffff);
+  ev.hdr.gid = (u32)(bpf_get_current_uid_gid() >> 32);
   bpf_get_current_comm(&ev.hdr.task, sizeof(ev.hdr.task));
 
   struct task_struct *parent_task = BPF_CORE_READ(current_task, real_parent);
   bpf_probe_read_kernel_str(&ev.hdr.parent_task, sizeof(ev.hdr.parent_task),
                             &parent_task->comm);
 
-  ev.dport = __builtin_bswap16(daddr->sin_port);
+  ev.dport = __builtin_bswap16(BPF_CORE_READ(daddr, sin_port));
   ev.src = src_addr4(sock);
+  ev.sport = src_port(sock);
   ev.dst = BPF_CORE_READ(daddr, sin_addr);
   ev.operation = (u8)point;
   ev.action = (u8)action;
-  ev.sock_type = (u8)sock->type;
+  ev.sock_type = (u8)BPF_CORE_READ(sock, type);
+  ev.verdict = (u8)verdict;
+  ev.rule = rule;
+  ev.monitored = monitored;
+  ev.container = container;
 
-  bpf_ringbuf_output(&audit_events, &ev, sizeof(ev), 0);
+  count_audit_event(bpf_ringbuf_output(&audit_events, &ev, sizeof(ev), 0));
 }
 
-static inline void report_ipv6_event(void *ctx, u64 cg, enum action action,
+static inline void report_ipv6_event(void *ctx, u64 cg, u64 matched,
+                                     enum action action,
+                                     enum verdict verdict,
+                                     u8 rule,
+                                     u8 monitored,
+                                     u8 container,
                                      enum lsm_hook_point point,
                                      struct socket *sock,
                                      const struct sockaddr_in6 *daddr) {
@@ -113,50 +506,309 @@ static inline void report_ipv6_event(void *ctx, u64 cg, enum action action,
   __builtin_memset(&ev, 0, sizeof(ev));
   BPF_CORE_READ_INTO(&ev.hdr.nodename, uts_ns, name.nodename);
 
+  ev.hdr.magic = EVENT_MAGIC;
+  ev.hdr.version = EVENT_SCHEMA_VERSION;
+  ev.hdr.header_size = sizeof(ev.hdr);
+  ev.hdr.size = sizeof(ev);
   ev.hdr.cgroup = cg;
+  ev.hdr.matched_cgroup = matched;
   ev.hdr.pid = (u32)(bpf_get_current_pid_tgid() >> 32);
   ev.hdr.type = BLOCKED_IPV6;
+  ev.hdr.uid = (u32)(bpf_get_current_uid_gid() & 0xffffffff);
+  ev.hdr.gid = (u32)(bpf_get_current_uid_gid() >> 32);
   bpf_get_current_comm(&ev.hdr.task, sizeof(ev.hdr.task));
 
   struct task_struct *parent_task = BPF_CORE_READ(current_task, real_parent);
   bpf_probe_read_kernel_str(&ev.hdr.parent_task, sizeof(ev.hdr.parent_task),
                             &parent_task->comm);
 
-  ev.dport = __builtin_bswap16(daddr->sin6_port);
+  ev.dport = __builtin_bswap16(BPF_CORE_READ(daddr, sin6_port));
   ev.src = src_addr6(sock);
+  ev.sport = src_port(sock);
   ev.dst = BPF_CORE_READ(daddr, sin6_addr);
   ev.operation = (u8)point;
   ev.action = (u8)action;
-  ev.sock_type = (u8)sock->type;
+  ev.sock_type = (u8)BPF_CORE_READ(sock, type);
+  ev.verdict = (u8)verdict;
+  ev.rule = rule;
+  ev.monitored = monitored;
+  ev.container = container;
+
+  count_audit_event(bpf_ringbuf_output(&audit_events, &ev, sizeof(ev), 0));
+}
+
+// is_classified_container sets matched to the entry of container_cgroup_list that cg matched.
+// With ancestors, the ancestors of cg are looked up too, so that only the topmost classified
+// cgroups need to be in the map. bpf_get_current_ancestor_cgroup_id needs 5.14; the programs
+// that call it are only loaded when the kernel has it.
+static __always_inline int is_classified_container(struct network_bouheki_config *c, u64 cg,
+                                                   bool ancestors, u64 *matched) {
+  switch (c->classification) {
+  case CLASSIFY_PID_NAMESPACE:
+    return _is_nested_pidns();
+  case CLASSIFY_CGROUP:
+    if (bpf_map_lookup_elem(&container_cgroup_list, &cg)) {
+      *matched = cg;
+      return 1;
+    }
+    if (!ancestors)
+      return 0;
+    // Level 0 is the root cgroup.
+#pragma unroll
+    for (int level = 0; level < MAX_CGROUP_DEPTH; level++) {
+      u64 ancestor = bpf_get_current_ancestor_cgroup_id(level);
+      if (ancestor == 0 || ancestor == cg)
+        break;
+      if (bpf_map_lookup_elem(&container_cgroup_list, &ancestor)) {
+        *matched = ancestor;
+        return 1;
+      }
+    }
+    return 0;
+  default:
+    return is_container();
+  }
+}
+
+static __always_inline void to_lower(char *s, size_t len) {
+#pragma unroll
+  for (size_t i = 0; i < TASK_COMM_LEN; i++) {
+    if (i >= len)
+      break;
+    if (s[i] >= 'A' && s[i] <= 'Z')
+      s[i] += 'a' - 'A';
+  }
+}
 
-  bpf_ringbuf_output(&audit_events, &ev, sizeof(ev), 0);
+static __always_inline bool match_command_pattern(struct command_pattern *p, const char *comm, u32 len) {
+  if (p->prefix_len + p->suffix_len > len)
+    return false;
+#pragma unroll
+  for (u32 i = 0; i < TASK_COMM_LEN; i++) {
+    if (i >= p->prefix_len)
+      break;
+    if (comm[i] != p->prefix[i])
+      return false;
+  }
+  u32 start = len - p->suffix_len;
+#pragma unroll
+  for (u32 i = 0; i < TASK_COMM_LEN; i++) {
+    if (i >= p->suffix_len)
+      break;
+    if (comm[(start + i) & (TASK_COMM_LEN - 1)] != p->suffix[i])
+      return false;
+  }
+  return true;
+}
+
+// find_command_pattern returns whether one of the count first patterns of map matches comm,
+// scanning them in order as userspace does to name the rule.
+static __always_inline bool find_command_pattern(void *map, int count, const char *comm) {
+  if (count == 0)
+    return false;
+  u32 len = 0;
+#pragma unroll
+  for (u32 i = 0; i < TASK_COMM_LEN; i++) {
+    if (comm[i] == '\0')
+      break;
+    len++;
+  }
+  for (u32 i = 0; i < COMMAND_PATTERN_MAX; i++) {
+    if (i >= count)
+      break;
+    struct command_pattern *p = bpf_map_lookup_elem(map, &i);
+    if (p && match_command_pattern(p, comm, len))
+      return true;
+  }
+  return false;
+}
+
+// select_policy_entry returns the index of the first entry of network.policies whose selectors
+// all match the task, or -1. An entry matches any value of a selector it does not set, and the
+// entries of network.host and network.container only the tasks outside or inside a container.
+static __always_inline int select_policy_entry(struct network_bouheki_config *c,
+                                               struct allowed_command_key *command, u32 uid, u32 gid,
+                                               u8 container) {
+  if (!c || c->policy_entries == 0)
+    return -1;
+  u64 *commands = bpf_map_lookup_elem(&policy_entry_command_list, command);
+  u64 *uids = bpf_map_lookup_elem(&policy_entry_uid_list, &uid);
+  u64 *gids = bpf_map_lookup_elem(&policy_entry_gid_list, &gid);
+  u64 mask = ((commands ? *commands : 0) | c->policy_entry_any_command) &
+             ((uids ? *uids : 0) | c->policy_entry_any_uid) &
+             ((gids ? *gids : 0) | c->policy_entry_any_gid);
+  mask &= ~(container ? c->policy_entry_host : c->policy_entry_container);
+  if (c->policy_entries < POLICY_ENTRY_MAX)
+    mask &= (1ULL << c->policy_entries) - 1;
+  for (int i = 0; i < POLICY_ENTRY_MAX; i++) {
+    if (mask & (1ULL << i))
+      return i;
+  }
+  return -1;
 }
 
 // In some cases, such as getaddrinfo(), sin_port is set to 0.
 // Not audited because no communication actually occurs.
 static inline bool is_destination_port_zero_v4(struct sockaddr_in *inet_addr) {
-  return __builtin_bswap16(inet_addr->sin_port) == 0;
+  return __builtin_bswap16(BPF_CORE_READ(inet_addr, sin_port)) == 0;
 }
 
 static inline bool is_destination_port_zero_v6(struct sockaddr_in6 *inet_addr) {
-  return __builtin_bswap16(inet_addr->sin6_port) == 0;
+  return __builtin_bswap16(BPF_CORE_READ(inet_addr, sin6_port)) == 0;
 }
 
-// TODO: lsm/send_msg
-SEC("lsm/socket_connect")
-int BPF_PROG(socket_connect, struct socket *sock, struct sockaddr *address,
-             int addrlen) {
+// is_denied_v4 looks the destination up in the deny list, then in the shards in use, in order.
+// except is set when the entry of the deny list is DENY_ENTRY_EXCEPT. An entry that is
+// DENY_ENTRY_MONITOR does not deny: monitored is set and the shards are looked up. Userspace
+// writes neither to a shard.
+static __always_inline bool is_denied_v4(struct network_bouheki_config *c, struct ipv4_trie_key *key, bool *except,
+                                         bool *monitored) {
+  char *entry = bpf_map_lookup_elem(&denied_v4_cidr_list, key);
+  if (entry && *entry != DENY_ENTRY_MONITOR) {
+    *except = *entry == DENY_ENTRY_EXCEPT;
+    return true;
+  }
+  if (entry) {
+    *monitored = true;
+  }
+
+  u32 shards = c ? c->deny_shards : 0;
+#pragma unroll
+  for (u32 i = 0; i < DENY_SHARDS_MAX; i++) {
+    if (i >= shards)
+      break;
+    void *shard = bpf_map_lookup_elem(&denied_v4_cidr_shards, &i);
+    if (shard && bpf_map_lookup_elem(shard, key))
+      return true;
+  }
+  return false;
+}
+
+static __always_inline bool is_denied_v6(struct network_bouheki_config *c, struct ipv6_trie_key *key, bool *except,
+                                         bool *monitored) {
+  char *entry = bpf_map_lookup_elem(&denied_v6_cidr_list, key);
+  if (entry && *entry != DENY_ENTRY_MONITOR) {
+    *except = *entry == DENY_ENTRY_EXCEPT;
+    return true;
+  }
+  if (entry) {
+    *monitored = true;
+  }
+
+  u32 shards = c ? c->deny_shards : 0;
+#pragma unroll
+  for (u32 i = 0; i < DENY_SHARDS_MAX; i++) {
+    if (i >= shards)
+      break;
+    void *shard = bpf_map_lookup_elem(&denied_v6_cidr_shards, &i);
+    if (shard && bpf_map_lookup_elem(shard, key))
+      return true;
+  }
+  return false;
+}
+
+// record_rule_hit records the time a rule of list matched value, of size bytes, and counts the match.
+static __always_inline void record_rule_hit(struct network_bouheki_config *c, enum rule_list list,
+                                            u16 family, const void *value, u32 size) {
+  if (!c || !c->rule_hits)
+    return;
+
+  struct rule_hit_key key;
+  __builtin_memset(&key, 0, sizeof(key));
+  key.list = list;
+  key.family = family;
+  __builtin_memcpy(key.value, value, size < sizeof(key.value) ? size : sizeof(key.value));
+
+  u64 now = bpf_ktime_get_ns();
+  struct rule_hit *hit = bpf_map_lookup_elem(&rule_last_hit, &key);
+  if (!hit) {
+    struct rule_hit first = {.last_hit = now, .count = 1};
+    // Another CPU may insert the key first, its hit is counted then.
+    if (bpf_map_update_elem(&rule_last_hit, &key, &first, BPF_NOEXIST) == 0)
+      return;
+    hit = bpf_map_lookup_elem(&rule_last_hit, &key);
+    if (!hit)
+      return;
+  }
+  hit->last_hit = now;
+  __sync_fetch_and_add(&hit->count, 1);
+}
+
+static __always_inline void record_address_hit(struct network_bouheki_config *c, enum rule_list list,
+                                               bool is_ipv4, union ip_trie_key *key) {
+  if (is_ipv4) {
+    record_rule_hit(c, list, AF_INET, &key->v4.addr, sizeof(key->v4.addr));
+  } else {
+    record_rule_hit(c, list, AF_INET6, &key->v6.addr, sizeof(key->v6.addr));
+  }
+}
+
+static inline bool is_sendmsg_point(enum lsm_hook_point point) {
+  return point == SENDMSG || point == SENDMSG_KPROBE;
+}
+
+// is_repeated_report reports whether the destination was reported for the current task less than
+// the report interval of point ago, and records the report otherwise.
+static __always_inline bool is_repeated_report(struct network_bouheki_config *c, enum lsm_hook_point point,
+                                               bool is_ipv4, union ip_trie_key *key, u16 port) {
+  u64 interval = c ? c->report_interval_ns : 0;
+  if (interval == 0) {
+    if (!is_sendmsg_point(point))
+      return false;
+    interval = SENDMSG_REPORT_INTERVAL_NS;
+  }
+
+  struct sendmsg_report_key report_key;
+  __builtin_memset(&report_key, 0, sizeof(report_key));
+  report_key.tgid = (u32)(bpf_get_current_pid_tgid() >> 32);
+  report_key.port = port;
+  if (is_ipv4) {
+    report_key.family = AF_INET;
+    __builtin_memcpy(report_key.addr, &key->v4.addr, sizeof(key->v4.addr));
+  } else {
+    report_key.family = AF_INET6;
+    __builtin_memcpy(report_key.addr, &key->v6.addr, sizeof(key->v6.addr));
+  }
+
+  u64 now = bpf_ktime_get_ns();
+  u64 *last = bpf_map_lookup_elem(&sendmsg_reported, &report_key);
+  if (last && now - *last < interval)
+    return true;
+
+  bpf_map_update_elem(&sendmsg_reported, &report_key, &now, BPF_ANY);
+  return false;
+}
+
+// is_v4_mapped reports whether addr is an IPv4-mapped IPv6 address, ::ffff:0:0/96.
+static __always_inline bool is_v4_mapped(struct in6_addr *addr) {
+  return addr->in6_u.u6_addr32[0] == 0 && addr->in6_u.u6_addr32[1] == 0 &&
+         addr->in6_u.u6_addr16[4] == 0 && addr->in6_u.u6_addr16[5] == 0xffff;
+}
+
+// handle_socket_connect reports the connection and returns -EPERM if it must be blocked.
+// Pointers are read with BPF_CORE_READ so that it can also be called from a kprobe.
+// The evaluation is specified by evaluationOrder in pkg/audit/network/evalorder.go, whose
+// conformance tests transliterate this function: change the three together.
+static __always_inline int handle_socket_connect(void *ctx,
+                                                 struct socket *sock,
+                                                 struct sockaddr *address,
+                                                 enum lsm_hook_point point,
+                                                 bool ancestors) {
   int allow_connect = -EPERM;
   int allow_command = -EPERM;
   int allow_uid = -EPERM;
   int allow_gid = -EPERM;
-  bool is_ipv6 = (address->sa_family == AF_INET6);
-  bool is_ipv4 = (address->sa_family == AF_INET);
+  int allow_port = 0;
+  sa_family_t family = BPF_CORE_READ(address, sa_family);
+  bool is_ipv6 = (family == AF_INET6);
+  bool is_ipv4 = (family == AF_INET);
 
   if (!(is_ipv4 || is_ipv6))
     return 0;
 
   u64 cg = bpf_get_current_cgroup_id();
+  u64 matched = 0;
+  u8 container = 0;
 
   struct sockaddr_in *inet_addr4;
   struct sockaddr_in6 *inet_addr6;
@@ -172,12 +824,50 @@ int BPF_PROG(socket_connect, struct socket *sock, struct sockaddr *address,
     return 0;
   }
 
-  union ip_trie_key key = {.v4.prefixlen = 32, .v4.addr = inet_addr4->sin_addr};
+  union ip_trie_key key;
+  __builtin_memset(&key, 0, sizeof(key));
 
-  if (is_ipv6) {
+  struct port_trie_key port_key;
+  __builtin_memset(&port_key, 0, sizeof(port_key));
+  port_key.prefixlen = 16;
+
+  union ip_protocol_trie_key protocol_key;
+  __builtin_memset(&protocol_key, 0, sizeof(protocol_key));
+  u8 sock_type = (u8)BPF_CORE_READ(sock, type);
+
+  if (is_ipv4) {
+    key.v4.prefixlen = 32;
+    key.v4.addr = BPF_CORE_READ(inet_addr4, sin_addr);
+    port_key.port = BPF_CORE_READ(inet_addr4, sin_port);
+    protocol_key.v4.prefixlen = 8 + 32;
+    protocol_key.v4.sock_type = sock_type;
+    __builtin_memcpy(protocol_key.v4.addr, &key.v4.addr, sizeof(protocol_key.v4.addr));
+  } else {
     key.v6.prefixlen = 128;
     key.v6.addr = BPF_CORE_READ(inet_addr6, sin6_addr);
+    port_key.port = BPF_CORE_READ(inet_addr6, sin6_port);
+    protocol_key.v6.prefixlen = 8 + 128;
+    protocol_key.v6.sock_type = sock_type;
+    __builtin_memcpy(protocol_key.v6.addr, &key.v6.addr, sizeof(protocol_key.v6.addr));
+  }
+
+  // A dual-stack socket connecting to an IPv4-mapped address, ::ffff:a.b.c.d, makes an IPv4
+  // connection. Userspace writes the mapped rules and addresses as IPv4 keys, so the address is
+  // looked up in the v4 lists. The event still has the address of the socket.
+  bool v4_key = is_ipv4;
+  if (is_ipv6 && is_v4_mapped(&key.v6.addr)) {
+    u8 mapped[4];
+    __builtin_memcpy(mapped, &key.v6.addr.in6_u.u6_addr8[12], sizeof(mapped));
+    __builtin_memset(&key, 0, sizeof(key));
+    key.v4.prefixlen = 32;
+    __builtin_memcpy(&key.v4.addr, mapped, sizeof(mapped));
+    __builtin_memset(&protocol_key, 0, sizeof(protocol_key));
+    protocol_key.v4.prefixlen = 8 + 32;
+    protocol_key.v4.sock_type = sock_type;
+    __builtin_memcpy(protocol_key.v4.addr, mapped, sizeof(mapped));
+    v4_key = true;
   }
+  bool v6_key = !v4_key;
 
   struct allowed_command_key allowed_command;
   struct denied_command_key denied_command;
@@ -203,6 +893,15 @@ int BPF_PROG(socket_connect, struct socket *sock, struct sockaddr *address,
   int has_allow_command = 0;
   int has_allow_uid = 0;
   int has_allow_gid = 0;
+  int has_deny_command = 0;
+  int has_deny_uid = 0;
+  int has_deny_gid = 0;
+  int has_allow_port = 0;
+  int has_deny_port = 0;
+  int has_allow_path = 0;
+  int has_deny_path = 0;
+  int has_allow_command_pattern = 0;
+  int has_deny_command_pattern = 0;
 
   if (c && c->has_allow_command) {
     has_allow_command = c->has_allow_command;
@@ -210,94 +909,613 @@ int BPF_PROG(socket_connect, struct socket *sock, struct sockaddr *address,
   if (c && c->has_allow_uid) {
     has_allow_uid = c->has_allow_uid;
   }
+  if (c && c->has_allow_gid) {
+    has_allow_gid = c->has_allow_gid;
+  }
+  if (c && c->has_deny_command) {
+    has_deny_command = c->has_deny_command;
+  }
+  if (c && c->has_deny_uid) {
+    has_deny_uid = c->has_deny_uid;
+  }
+  if (c && c->has_deny_gid) {
+    has_deny_gid = c->has_deny_gid;
+  }
+  if (c && c->has_allow_port) {
+    has_allow_port = c->has_allow_port;
+  }
+  if (c && c->has_deny_port) {
+    has_deny_port = c->has_deny_port;
+  }
+  if (c && c->has_allow_path) {
+    has_allow_path = c->has_allow_path;
+  }
+  if (c && c->has_deny_path) {
+    has_deny_path = c->has_deny_path;
+  }
+  if (c && c->has_allow_command_pattern) {
+    has_allow_command_pattern = c->has_allow_command_pattern;
+  }
+  if (c && c->has_deny_command_pattern) {
+    has_deny_command_pattern = c->has_deny_command_pattern;
+  }
+
+  if (c && c->default_action == DEFAULT_ACTION_ALLOW) {
+    allow_connect = 0;
+  }
 
   if (c && c->target == TARGET_CONTAINER) {
-    if (!is_container()) {
+    if (!is_classified_container(c, cg, ancestors, &matched)) {
       return 0;
     }
+    container = 1;
+  } else if (c && c->target == TARGET_ALL) {
+    container = is_classified_container(c, cg, ancestors, &matched) ? 1 : 0;
   }
 
-  if ((is_ipv4 && bpf_map_lookup_elem(&allowed_v4_cidr_list, &key.v4)) ||
-      (is_ipv6 && bpf_map_lookup_elem(&allowed_v6_cidr_list, &key.v6))) {
+  if (c && (c->disabled_families & (v4_key ? FAMILY_IPV4 : FAMILY_IPV6))) {
+    if (!c->other_families_audit || c->audit_disabled) {
+      return 0;
+    }
+    if (c->quiesced) {
+      count_audit_stat(AUDIT_EVENTS_SUPPRESSED);
+      return 0;
+    }
+    if (is_repeated_report(c, point, v4_key, &key, port_key.port)) {
+      count_audit_stat(AUDIT_EVENTS_REPEATED);
+      return 0;
+    }
+    if (is_ipv4) {
+      report_ipv4_event(ctx, cg, matched, ACTION_MONITOR, VERDICT_ALLOW, 0, 0, container, point,
+                        sock, inet_addr4);
+    } else {
+      report_ipv6_event(ctx, cg, matched, ACTION_MONITOR, VERDICT_ALLOW, 0, 0, container, point,
+                        sock, inet_addr6);
+    }
+    return 0;
+  }
+
+  // Userspace lowercases the configured commands too.
+  if (c && c->command_case_insensitive) {
+    to_lower(allowed_command.comm, sizeof(allowed_command.comm));
+    to_lower(denied_command.comm, sizeof(denied_command.comm));
+  }
+
+  // The entry of network.policies that selects the task decides its destination in place of
+  // network.cidr, network.domain and their overrides.
+  int entry = select_policy_entry(c, &allowed_command, allowed_uid.uid, allowed_gid.gid, container);
+  bool allowed_destination = false;
+
+  if (entry < 0 &&
+      ((v4_key && bpf_map_lookup_elem(&allowed_v4_cidr_list, &key.v4)) ||
+       (v6_key && bpf_map_lookup_elem(&allowed_v6_cidr_list, &key.v6)))) {
     allow_connect = 0;
+    allowed_destination = true;
+    record_address_hit(c, RULE_ALLOWED_CIDR, v4_key, &key);
   }
 
-  if (bpf_map_lookup_elem(&allowed_uid_list, &allowed_uid) ||
-      has_allow_uid == 0) {
+  // The keys of the protocol lists hold the socket type, so a rule of the other protocol never matches.
+  if (entry < 0 &&
+      ((v4_key && bpf_map_lookup_elem(&allowed_v4_protocol_cidr_list, &protocol_key.v4)) ||
+       (v6_key && bpf_map_lookup_elem(&allowed_v6_protocol_cidr_list, &protocol_key.v6)))) {
+    allow_connect = 0;
+    allowed_destination = true;
+    record_address_hit(c, RULE_ALLOWED_CIDR, v4_key, &key);
+  }
+
+  // A uid the hash does not have is looked up in the ranges.
+  struct uid_trie_key uid_key = {.prefixlen = 32, .uid = __builtin_bswap32(allowed_uid.uid)};
+  bool allowed_uid_listed = bpf_map_lookup_elem(&allowed_uid_list, &allowed_uid) ||
+                            bpf_map_lookup_elem(&allowed_uid_range_list, &uid_key);
+
+  if (allowed_uid_listed) {
+    allow_uid = 0;
+    record_rule_hit(c, RULE_ALLOWED_UID, 0, &allowed_uid.uid, sizeof(allowed_uid.uid));
+  } else if (has_allow_uid == 0) {
     allow_uid = 0;
   }
 
-  if (bpf_map_lookup_elem(&allowed_gid_list, &allowed_gid) ||
-      has_allow_gid == 0) {
+  if (bpf_map_lookup_elem(&allowed_gid_list, &allowed_gid)) {
+    allow_gid = 0;
+    record_rule_hit(c, RULE_ALLOWED_GID, 0, &allowed_gid.gid, sizeof(allowed_gid.gid));
+  } else if (has_allow_gid == 0) {
     allow_gid = 0;
   }
 
-  if (bpf_map_lookup_elem(&allowed_command_list, &allowed_command) ||
-      has_allow_command == 0) {
+  // A task whose executable is not known matches no path rule.
+  u32 tgid = bpf_get_current_pid_tgid() >> 32;
+  struct exe_path_entry *exe = bpf_map_lookup_elem(&task_exe_paths, &tgid);
+  bool allowed_path = exe && bpf_map_lookup_elem(&allowed_path_list, &exe->key);
+  // The patterns are only scanned for a comm that no command matches.
+  bool exact_allowed_command = bpf_map_lookup_elem(&allowed_command_list, &allowed_command) != NULL;
+  bool allowed_command_pattern = !exact_allowed_command &&
+                                 find_command_pattern(&allowed_command_pattern_list, has_allow_command_pattern, allowed_command.comm);
+
+  if (exact_allowed_command || allowed_command_pattern) {
+    allow_command = 0;
+    record_rule_hit(c, RULE_ALLOWED_COMMAND, 0, allowed_command.comm, sizeof(allowed_command.comm));
+  } else if (allowed_path) {
     allow_command = 0;
+  } else if (has_allow_command == 0 && has_allow_command_pattern == 0 && has_allow_path == 0) {
+    allow_command = 0;
+  }
+
+  // The deny lists that matched, for the rule of the event.
+  bool denied_command_listed = false;
+  bool denied_uid_listed = false;
+  bool denied_gid_listed = false;
+
+  // A command in mode: monitor does not deny, and the patterns are scanned for it as for a comm
+  // that no command matches.
+  u32 *command_entry = has_deny_command != 0 ? bpf_map_lookup_elem(&denied_command_list, &denied_command) : NULL;
+  bool monitored_command = false;
+  if (command_entry && *command_entry != DENY_ENTRY_MONITOR) {
+    allow_command = -EPERM;
+    denied_command_listed = true;
+    record_rule_hit(c, RULE_DENIED_COMMAND, 0, denied_command.comm, sizeof(denied_command.comm));
+  } else if (find_command_pattern(&denied_command_pattern_list, has_deny_command_pattern, denied_command.comm)) {
+    allow_command = -EPERM;
+    denied_command_listed = true;
+    record_rule_hit(c, RULE_DENIED_COMMAND, 0, denied_command.comm, sizeof(denied_command.comm));
+  } else if (command_entry) {
+    monitored_command = true;
+    record_rule_hit(c, RULE_DENIED_COMMAND, 0, denied_command.comm, sizeof(denied_command.comm));
   }
 
-  if (bpf_map_lookup_elem(&denied_command_list, &denied_command)) {
+  if (has_deny_path != 0 && exe &&
+      bpf_map_lookup_elem(&denied_path_list, &exe->key)) {
     allow_command = -EPERM;
+    denied_command_listed = true;
   }
 
-  if (bpf_map_lookup_elem(&denied_uid_list, &denied_uid)) {
+  if (has_deny_uid != 0 &&
+      (bpf_map_lookup_elem(&denied_uid_list, &denied_uid) ||
+       bpf_map_lookup_elem(&denied_uid_range_list, &uid_key))) {
     allow_uid = -EPERM;
+    denied_uid_listed = true;
+    record_rule_hit(c, RULE_DENIED_UID, 0, &denied_uid.uid, sizeof(denied_uid.uid));
   }
 
-  if (bpf_map_lookup_elem(&denied_gid_list, &denied_gid)) {
+  if (has_deny_gid != 0 &&
+      bpf_map_lookup_elem(&denied_gid_list, &denied_gid)) {
     allow_gid = -EPERM;
+    denied_gid_listed = true;
+    record_rule_hit(c, RULE_DENIED_GID, 0, &denied_gid.gid, sizeof(denied_gid.gid));
+  }
+
+  u16 port = __builtin_bswap16(port_key.port);
+
+  // A denied port is never overridden, by an allowed destination or an allowed subject.
+  bool denied_port = has_deny_port != 0 &&
+                     bpf_map_lookup_elem(&denied_port_list, &port_key);
+  if (denied_port) {
+    allow_port = -EPERM;
+    record_rule_hit(c, RULE_DENIED_PORT, 0, &port, sizeof(port));
+  }
+
+  if (!denied_port && has_allow_port != 0) {
+    if (bpf_map_lookup_elem(&allowed_port_list, &port_key)) {
+      record_rule_hit(c, RULE_ALLOWED_PORT, 0, &port, sizeof(port));
+    } else {
+      allow_port = -EPERM;
+    }
+  }
+
+  // A destination of network.cidr.allow_except is denied whatever the allow lists and subjects.
+  bool except_destination = false;
+  bool monitored_destination = false;
+  bool denied_destination = entry < 0 &&
+                            ((v4_key && is_denied_v4(c, &key.v4, &except_destination, &monitored_destination)) ||
+                             (v6_key && is_denied_v6(c, &key.v6, &except_destination, &monitored_destination)) ||
+                             (v4_key && bpf_map_lookup_elem(&denied_v4_protocol_cidr_list, &protocol_key.v4)) ||
+                             (v6_key && bpf_map_lookup_elem(&denied_v6_protocol_cidr_list, &protocol_key.v6)));
+
+  // With precedence: allow-first, the deny lists do not decide a destination of the allow lists.
+  if (c && c->precedence == PRECEDENCE_ALLOW_FIRST && allowed_destination && !except_destination) {
+    denied_destination = false;
+    monitored_destination = false;
   }
 
-  if ((is_ipv4 && bpf_map_lookup_elem(&denied_v4_cidr_list, &key.v4)) ||
-      (is_ipv6 && bpf_map_lookup_elem(&denied_v6_cidr_list, &key.v6))) {
+  if (denied_destination) {
     allow_connect = -EPERM;
+    record_address_hit(c, RULE_DENIED_CIDR, v4_key, &key);
   }
 
-  if (((is_ipv4 && bpf_map_lookup_elem(&denied_v4_cidr_list, &key.v4)) ||
-       (is_ipv6 && bpf_map_lookup_elem(&denied_v6_cidr_list, &key.v6))) &&
-      bpf_map_lookup_elem(&allowed_command_list, &allowed_command)) {
+  if (denied_destination && !except_destination &&
+      (exact_allowed_command || allowed_command_pattern || allowed_path)) {
     allow_connect = 0;
   }
 
-  if (((is_ipv4 && bpf_map_lookup_elem(&denied_v4_cidr_list, &key.v4)) ||
-       (is_ipv6 && bpf_map_lookup_elem(&denied_v6_cidr_list, &key.v6))) &&
-      bpf_map_lookup_elem(&allowed_uid_list, &allowed_uid)) {
+  if (denied_destination && !except_destination && allowed_uid_listed) {
     allow_connect = 0;
   }
 
-  if (((is_ipv4 && bpf_map_lookup_elem(&denied_v4_cidr_list, &key.v4)) ||
-       (is_ipv6 && bpf_map_lookup_elem(&denied_v6_cidr_list, &key.v6))) &&
+  if (denied_destination && !except_destination &&
       bpf_map_lookup_elem(&allowed_gid_list, &allowed_gid)) {
     allow_connect = 0;
   }
 
+  // An entry denies the destinations of its deny list, and permits the others if it has no
+  // allow list or lists them.
+  if (entry >= 0) {
+    union ip_protocol_trie_key entry_key = protocol_key;
+    if (v4_key) {
+      entry_key.v4.sock_type = (u8)(entry + 1);
+    } else {
+      entry_key.v6.sock_type = (u8)(entry + 1);
+    }
+    if ((v4_key && bpf_map_lookup_elem(&denied_v4_entry_cidr_list, &entry_key.v4)) ||
+        (v6_key && bpf_map_lookup_elem(&denied_v6_entry_cidr_list, &entry_key.v6))) {
+      allow_connect = -EPERM;
+    } else if ((c && !(c->policy_entry_has_allow & (1ULL << entry))) ||
+               (v4_key && bpf_map_lookup_elem(&allowed_v4_entry_cidr_list, &entry_key.v4)) ||
+               (v6_key && bpf_map_lookup_elem(&allowed_v6_entry_cidr_list, &entry_key.v6))) {
+      allow_connect = 0;
+    } else {
+      // Not left to network.policy.default, which is about the top-level lists.
+      allow_connect = -EPERM;
+    }
+  }
+
   int can_access = -EPERM;
   if (allow_connect == 0 && allow_uid == 0 && allow_gid == 0 &&
-      allow_command == 0) {
+      allow_command == 0 && allow_port == 0) {
     can_access = 0;
   }
+  enum verdict verdict = can_access == 0 ? VERDICT_ALLOW : VERDICT_DENY;
+
+  // The rule of the event is the first list that denied the connection, in the order userspace
+  // describes them: a denied port, the destination, then the command, the uid and the gid. A
+  // list of the allow side denies what it does not list.
+  u8 rule = 0;
+  if (allow_port != 0) {
+    rule = (denied_port ? RULE_DENIED_PORT : RULE_ALLOWED_PORT) + 1;
+  } else if (allow_connect != 0 && entry >= 0) {
+    rule = EVENT_RULE_POLICY_ENTRY;
+  } else if (allow_connect != 0) {
+    rule = (denied_destination ? RULE_DENIED_CIDR : RULE_ALLOWED_CIDR) + 1;
+  } else if (allow_command != 0) {
+    rule = (denied_command_listed ? RULE_DENIED_COMMAND : RULE_ALLOWED_COMMAND) + 1;
+  } else if (allow_uid != 0) {
+    rule = (denied_uid_listed ? RULE_DENIED_UID : RULE_ALLOWED_UID) + 1;
+  } else if (allow_gid != 0) {
+    rule = (denied_gid_listed ? RULE_DENIED_GID : RULE_ALLOWED_GID) + 1;
+  }
+
+  // A deny entry in mode: monitor reports a connection nothing denies, with the rule it would
+  // have denied it by. The subjects that override a denied destination override a monitored one.
+  bool monitored_by_destination = monitored_destination &&
+                                  !(exact_allowed_command || allowed_command_pattern || allowed_path ||
+                                    allowed_uid_listed || bpf_map_lookup_elem(&allowed_gid_list, &allowed_gid));
+  bool monitored = can_access == 0 && (monitored_by_destination || monitored_command);
+  if (monitored && monitored_by_destination) {
+    rule = RULE_DENIED_CIDR + 1;
+    record_address_hit(c, RULE_DENIED_CIDR, v4_key, &key);
+  } else if (monitored) {
+    rule = RULE_DENIED_COMMAND + 1;
+  }
+
+  // Without audit events, no space of audit_events is reserved for the decision.
+  if (c && c->audit_disabled) {
+    return c->mode == MODE_MONITOR ? 0 : can_access;
+  }
+
+  // The decision stands while userspace drains audit_events, but it is only counted.
+  if (c && c->quiesced && (c->mode == MODE_MONITOR || can_access != 0 || monitored)) {
+    count_audit_stat(AUDIT_EVENTS_SUPPRESSED);
+    return c->mode == MODE_MONITOR ? 0 : can_access;
+  }
+
+  bool reported = c && (c->mode == MODE_MONITOR || can_access != 0 || monitored);
+  if (reported && is_repeated_report(c, point, v4_key, &key, port_key.port)) {
+    count_audit_stat(AUDIT_EVENTS_REPEATED);
+    return c->mode == MODE_MONITOR ? 0 : can_access;
+  }
 
   if (can_access != 0 && c && c->mode == MODE_BLOCK) {
     if (is_ipv4) {
-      report_ipv4_event((void *)ctx, cg, ACTION_BLOCK, CONNECT, sock,
-                        inet_addr4);
+      report_ipv4_event(ctx, cg, matched, ACTION_BLOCK, verdict, rule, 0, container, point,
+                        sock, inet_addr4);
     } else {
-      report_ipv6_event((void *)ctx, cg, ACTION_BLOCK, CONNECT, sock,
-                        inet_addr6);
+      report_ipv6_event(ctx, cg, matched, ACTION_BLOCK, verdict, rule, 0, container, point,
+                        sock, inet_addr6);
     }
   }
 
-  if (c && c->mode == MODE_MONITOR) {
+  // A connection only a deny entry in mode: monitor denies is reported as monitor mode reports it.
+  if (c && (c->mode == MODE_MONITOR || monitored)) {
     if (is_ipv4) {
-      report_ipv4_event((void *)ctx, cg, ACTION_MONITOR, CONNECT, sock,
-                        inet_addr4);
+      report_ipv4_event(ctx, cg, matched, ACTION_MONITOR, verdict, rule, monitored, container,
+                        point, sock, inet_addr4);
     } else {
-      report_ipv6_event((void *)ctx, cg, ACTION_MONITOR, CONNECT, sock,
-                        inet_addr6);
+      report_ipv6_event(ctx, cg, matched, ACTION_MONITOR, verdict, rule, monitored, container,
+                        point, sock, inet_addr6);
     }
     return 0;
   }
 
   return can_access;
 }
+
+SEC("lsm/socket_connect")
+int BPF_PROG(socket_connect, struct socket *sock, struct sockaddr *address,
+             int addrlen) {
+  return handle_socket_connect((void *)ctx, sock, address, CONNECT, false);
+}
+
+// The variants that also match the ancestors of the current cgroup. Only one
+// variant of each hook is loaded.
+SEC("lsm/socket_connect")
+int BPF_PROG(socket_connect_ancestors, struct socket *sock,
+             struct sockaddr *address, int addrlen) {
+  return handle_socket_connect((void *)ctx, sock, address, CONNECT, true);
+}
+
+// Fallback for kernels without BPF LSM. A kprobe can not deny the connection,
+// so a blocked connection is only reported, unless userspace asked for the
+// violating task to be killed. The Manager writes MODE_MONITOR to the config
+// map when the signal is not enabled.
+SEC("kprobe/security_socket_connect")
+int BPF_KPROBE(kprobe_socket_connect, struct socket *sock,
+               struct sockaddr *address, int addrlen) {
+  if (handle_socket_connect((void *)ctx, sock, address, CONNECT_KPROBE, false) != 0) {
+    bpf_send_signal(SIGKILL);
+  }
+
+  return 0;
+}
+
+SEC("kprobe/security_socket_connect")
+int BPF_KPROBE(kprobe_socket_connect_ancestors, struct socket *sock,
+               struct sockaddr *address, int addrlen) {
+  if (handle_socket_connect((void *)ctx, sock, address, CONNECT_KPROBE, true) != 0) {
+    bpf_send_signal(SIGKILL);
+  }
+
+  return 0;
+}
+
+// handle_socket_sendmsg checks the destination of a datagram sent with sendto(2) or sendmsg(2) on
+// an unconnected socket, which never goes through socket_connect, as a connection to it. The
+// datagrams of a connected socket, and the streams, have no destination of their own: they were
+// checked when the socket was connected. The kernel has copied msg_name from userspace already.
+static __always_inline int handle_socket_sendmsg(void *ctx,
+                                                 struct socket *sock,
+                                                 struct msghdr *msg,
+                                                 enum lsm_hook_point point,
+                                                 bool ancestors) {
+  if (BPF_CORE_READ(sock, type) != SOCK_DGRAM)
+    return 0;
+
+  struct sockaddr *address = (struct sockaddr *)BPF_CORE_READ(msg, msg_name);
+  if (!address || BPF_CORE_READ(msg, msg_namelen) < (int)sizeof(struct sockaddr_in))
+    return 0;
+
+  return handle_socket_connect(ctx, sock, address, point, ancestors);
+}
+
+// The sendmsg hook is attached with the connect hook.
+SEC("lsm/socket_sendmsg")
+int BPF_PROG(socket_sendmsg, struct socket *sock, struct msghdr *msg, int size) {
+  return handle_socket_sendmsg((void *)ctx, sock, msg, SENDMSG, false);
+}
+
+SEC("lsm/socket_sendmsg")
+int BPF_PROG(socket_sendmsg_ancestors, struct socket *sock, struct msghdr *msg, int size) {
+  return handle_socket_sendmsg((void *)ctx, sock, msg, SENDMSG, true);
+}
+
+SEC("kprobe/security_socket_sendmsg")
+int BPF_KPROBE(kprobe_socket_sendmsg, struct socket *sock, struct msghdr *msg, int size) {
+  if (handle_socket_sendmsg((void *)ctx, sock, msg, SENDMSG_KPROBE, false) != 0) {
+    bpf_send_signal(SIGKILL);
+  }
+
+  return 0;
+}
+
+SEC("kprobe/security_socket_sendmsg")
+int BPF_KPROBE(kprobe_socket_sendmsg_ancestors, struct socket *sock, struct msghdr *msg, int size) {
+  if (handle_socket_sendmsg((void *)ctx, sock, msg, SENDMSG_KPROBE, true) != 0) {
+    bpf_send_signal(SIGKILL);
+  }
+
+  return 0;
+}
+
+// handle_socket_bind reports the bind and returns -EPERM if it must be blocked. The address bound
+// to is reported as the destination of the event, with the operation BIND or BIND_KPROBE. Only the
+// lists of network.ingress are looked up, as Policy.EvaluateBind in pkg/audit/network/ingress.go
+// does: change both together.
+static __always_inline int handle_socket_bind(void *ctx,
+                                              struct socket *sock,
+                                              struct sockaddr *address,
+                                              enum lsm_hook_point point,
+                                              bool ancestors) {
+  sa_family_t family = BPF_CORE_READ(address, sa_family);
+  bool is_ipv6 = (family == AF_INET6);
+  bool is_ipv4 = (family == AF_INET);
+
+  if (!(is_ipv4 || is_ipv6))
+    return 0;
+
+  struct sockaddr_in *inet_addr4 = (struct sockaddr_in *)address;
+  struct sockaddr_in6 *inet_addr6 = (struct sockaddr_in6 *)address;
+
+  // The kernel picks the port of a bind to port 0, which is not restricted.
+  if ((is_ipv6 && is_destination_port_zero_v6(inet_addr6)) ||
+      (is_ipv4 && is_destination_port_zero_v4(inet_addr4))) {
+    return 0;
+  }
+
+  u32 index = 0;
+  struct network_bouheki_config *c =
+      (struct network_bouheki_config *)bpf_map_lookup_elem(&network_bouheki_config_map, &index);
+  if (!c)
+    return 0;
+
+  u64 cg = bpf_get_current_cgroup_id();
+  u64 matched = 0;
+  u8 container = 0;
+  if (c->target == TARGET_CONTAINER && !is_classified_container(c, cg, ancestors, &matched))
+    return 0;
+  if (c->target != TARGET_HOST)
+    container = c->target == TARGET_CONTAINER || is_classified_container(c, cg, ancestors, &matched);
+
+  // The binds of the families network.families leaves out are never reported.
+  if (c->disabled_families & (is_ipv4 ? FAMILY_IPV4 : FAMILY_IPV6))
+    return 0;
+
+  union ip_trie_key key;
+  __builtin_memset(&key, 0, sizeof(key));
+
+  struct port_trie_key port_key;
+  __builtin_memset(&port_key, 0, sizeof(port_key));
+  port_key.prefixlen = 16;
+
+  if (is_ipv4) {
+    key.v4.prefixlen = 32;
+    key.v4.addr = BPF_CORE_READ(inet_addr4, sin_addr);
+    port_key.port = BPF_CORE_READ(inet_addr4, sin_port);
+  } else {
+    key.v6.prefixlen = 128;
+    key.v6.addr = BPF_CORE_READ(inet_addr6, sin6_addr);
+    port_key.port = BPF_CORE_READ(inet_addr6, sin6_port);
+  }
+
+  int can_bind = 0;
+
+  if (c->has_ingress_deny_port != 0 &&
+      bpf_map_lookup_elem(&ingress_denied_port_list, &port_key)) {
+    can_bind = -EPERM;
+  }
+
+  if ((is_ipv4 && bpf_map_lookup_elem(&ingress_denied_v4_cidr_list, &key.v4)) ||
+      (is_ipv6 && bpf_map_lookup_elem(&ingress_denied_v6_cidr_list, &key.v6))) {
+    can_bind = -EPERM;
+  }
+
+  if (c->has_ingress_allow_port != 0 &&
+      !bpf_map_lookup_elem(&ingress_allowed_port_list, &port_key)) {
+    can_bind = -EPERM;
+  }
+
+  if (c->has_ingress_allow_cidr != 0 &&
+      !((is_ipv4 && bpf_map_lookup_elem(&ingress_allowed_v4_cidr_list, &key.v4)) ||
+        (is_ipv6 && bpf_map_lookup_elem(&ingress_allowed_v6_cidr_list, &key.v6)))) {
+    can_bind = -EPERM;
+  }
+  enum verdict verdict = can_bind == 0 ? VERDICT_ALLOW : VERDICT_DENY;
+
+  if (c->audit_disabled) {
+    return c->mode == MODE_MONITOR ? 0 : can_bind;
+  }
+
+  if (c->quiesced && (c->mode == MODE_MONITOR || can_bind != 0)) {
+    count_audit_stat(AUDIT_EVENTS_SUPPRESSED);
+    return c->mode == MODE_MONITOR ? 0 : can_bind;
+  }
+
+  if (c->mode == MODE_MONITOR || can_bind != 0) {
+    enum action action = c->mode == MODE_MONITOR ? ACTION_MONITOR : ACTION_BLOCK;
+    if (is_ipv4) {
+      report_ipv4_event(ctx, cg, matched, action, verdict, 0, 0, container, point, sock, inet_addr4);
+    } else {
+      report_ipv6_event(ctx, cg, matched, action, verdict, 0, 0, container, point, sock, inet_addr6);
+    }
+  }
+
+  return c->mode == MODE_MONITOR ? 0 : can_bind;
+}
+
+// The bind hook is only attached when network.ingress has rules.
+SEC("lsm/socket_bind")
+int BPF_PROG(socket_bind, struct socket *sock, struct sockaddr *address,
+             int addrlen) {
+  return handle_socket_bind((void *)ctx, sock, address, BIND, false);
+}
+
+SEC("lsm/socket_bind")
+int BPF_PROG(socket_bind_ancestors, struct socket *sock,
+             struct sockaddr *address, int addrlen) {
+  return handle_socket_bind((void *)ctx, sock, address, BIND, true);
+}
+
+SEC("kprobe/security_socket_bind")
+int BPF_KPROBE(kprobe_socket_bind, struct socket *sock,
+               struct sockaddr *address, int addrlen) {
+  if (handle_socket_bind((void *)ctx, sock, address, BIND_KPROBE, false) != 0) {
+    bpf_send_signal(SIGKILL);
+  }
+
+  return 0;
+}
+
+SEC("kprobe/security_socket_bind")
+int BPF_KPROBE(kprobe_socket_bind_ancestors, struct socket *sock,
+               struct sockaddr *address, int addrlen) {
+  if (handle_socket_bind((void *)ctx, sock, address, BIND_KPROBE, true) != 0) {
+    bpf_send_signal(SIGKILL);
+  }
+
+  return 0;
+}
+
+#define DELETE_TASK_ENTRY(map) bpf_map_delete_elem(&map, &tgid);
+
+SEC("tracepoint/sched/sched_process_exit")
+int task_exit(void *ctx) {
+  u64 pid_tgid = bpf_get_current_pid_tgid();
+  u32 tgid = pid_tgid >> 32;
+
+  // The entries belong to the thread group, which exits with its leader.
+  if ((u32)pid_tgid != tgid) {
+    return 0;
+  }
+
+  TASK_MAPS(DELETE_TASK_ENTRY)
+  return 0;
+}
+
+// task_exec records the path of the executable a task runs. bpf_d_path is only allowed in the
+// sleepable LSM hooks, of which bprm_committed_creds runs once the task runs the executable.
+SEC("lsm.s/bprm_committed_creds")
+int BPF_PROG(task_exec, struct linux_binprm *bprm) {
+  u32 tgid = bpf_get_current_pid_tgid() >> 32;
+  struct exe_path_entry entry;
+  __builtin_memset(&entry, 0, sizeof(entry));
+  task_entry_init(&entry.task);
+
+  long len = bpf_d_path(&bprm->file->f_path, entry.key.path, sizeof(entry.key.path));
+  if (len <= 0) {
+    // A path that does not fit is not matched, rather than matched by its beginning.
+    bpf_map_delete_elem(&task_exe_paths, &tgid);
+    return 0;
+  }
+  entry.key.prefixlen = len * 8;
+  bpf_map_update_elem(&task_exe_paths, &tgid, &entry, BPF_ANY);
+  return 0;
+}
+
+// task_fork copies the path of the executable of a process to the processes it forks, which run
+// the same executable until they execute another one.
+SEC("raw_tp/sched_process_fork")
+int BPF_PROG(task_fork, struct task_struct *parent, struct task_struct *child) {
+  u32 child_tgid = BPF_CORE_READ(child, tgid);
+  // A new thread shares the entry of its thread group.
+  if (BPF_CORE_READ(child, pid) != child_tgid) {
+    return 0;
+  }
+
+  u32 parent_tgid = BPF_CORE_READ(parent, tgid);
+  struct exe_path_entry *exe = bpf_map_lookup_elem(&task_exe_paths, &parent_tgid);
+  if (!exe) {
+    return 0;
+  }
+
+  struct exe_path_entry entry;
+  __builtin_memcpy(&entry, exe, sizeof(entry));
+  entry.task.start_boottime = BPF_CORE_READ(child, start_boottime);
+  bpf_map_update_elem(&task_exe_paths, &child_tgid, &entry, BPF_ANY);
+  return 0;
+}
@@ -5,6 +5,12 @@
 
 #define AF_INET 2
 #define AF_INET6 10
+// The flags of the families network.families leaves out, in network_bouheki_config.disabled_families.
+#define FAMILY_IPV4 1
+#define FAMILY_IPV6 2
+#define SIGKILL 9
+// MAX_CGROUP_DEPTH bounds the ancestors of the current cgroup that are looked up.
+#define MAX_CGROUP_DEPTH 16
 
 enum audit_event_type {
   BLOCKED_IPV4,
@@ -17,11 +23,61 @@ enum action
   ACTION_BLOCK
 };
 
+// The decision made by the policy, regardless of mode.
+enum verdict
+{
+  VERDICT_ALLOW,
+  VERDICT_DENY
+};
+
+// network.policy.default: the decision of a destination in none of the CIDR lists.
+enum default_action
+{
+  DEFAULT_ACTION_DENY,
+  DEFAULT_ACTION_ALLOW
+};
+
+// network.policy.precedence: the list that wins for a destination in both an allow and a deny list.
+enum precedence
+{
+  PRECEDENCE_DENY_FIRST,
+  PRECEDENCE_ALLOW_FIRST
+};
+
+// The values of the entries of denied_v4_cidr_list and denied_v6_cidr_list. An entry of
+// network.cidr.allow_except, or a deny entry inside one, is written with DENY_ENTRY_EXCEPT. A
+// deny entry in mode: monitor is written with DENY_ENTRY_MONITOR, in these lists and, as a u32,
+// in denied_command_list.
+enum deny_entry
+{
+  DENY_ENTRY_DENY,
+  DENY_ENTRY_EXCEPT,
+  DENY_ENTRY_MONITOR
+};
+
+// EVENT_MAGIC starts the events since schema version 4, "BOHK" in little endian.
+#define EVENT_MAGIC 0x4b484f42
+// EVENT_SCHEMA_VERSION is the layout of the audit events, see eventschema.go. Increment it when
+// a field is added, and only ever add fields at the end of the header or of an event: the
+// decoders read the fields they know by offset and skip the rest with header_size and size.
+#define EVENT_SCHEMA_VERSION 8
+
 struct audit_event_header
 {
+  // magic, version, header_size and size never move.
+  u32 magic;
+  u16 version;
+  u16 header_size;
+  // The size of the event, the header included.
+  u32 size;
+  u32 reserved;
   u64 cgroup;
+  // The classified cgroup the current cgroup matched: itself or an ancestor.
+  u64 matched_cgroup;
   u32 pid;
   enum audit_event_type type;
+  u32 uid;
+  u32 gid;
   char nodename[NEW_UTS_LEN + 1];
   char task[TASK_COMM_LEN];
   char parent_task[TASK_COMM_LEN];
@@ -36,6 +92,30 @@ struct denied_command_key
   char comm[TASK_COMM_LEN];
 };
 
+// POLICY_ENTRY_MAX is the number of entries of network.policies, a bit of a u64 mask each.
+#define POLICY_ENTRY_MAX 64
+
+// COMMAND_PATTERN_MAX is the number of patterns of each command list, scanned in order.
+#define COMMAND_PATTERN_MAX 32
+
+// A pattern of the command lists matches the comms that begin with prefix and end with suffix.
+struct command_pattern
+{
+  u32 prefix_len;
+  u32 suffix_len;
+  char prefix[TASK_COMM_LEN];
+  char suffix[TASK_COMM_LEN];
+};
+
+// EXE_PATH_LEN is the size of a path in the path lists, NUL included: the largest data of an LPM trie.
+#define EXE_PATH_LEN 256
+
+struct path_trie_key
+{
+  u32 prefixlen;
+  char path[EXE_PATH_LEN];
+};
+
 struct allowed_uid_key
 {
   u32 uid;
@@ -46,6 +126,14 @@ struct denied_uid_key
   u32 uid;
 };
 
+// The key of the uid range lists, the prefixes that cover the ranges of network.uid: the uid
+// is in network byte order, as the trie compares it.
+struct uid_trie_key
+{
+  u32 prefixlen;
+  __be32 uid;
+};
+
 struct allowed_gid_key
 {
   u32 gid;
@@ -65,6 +153,17 @@ struct audit_event_ipv4
   u8 operation;
   u8 action;
   u8 sock_type;
+  u8 verdict;
+  // sport is the local port the socket is bound to, 0 when it is not, since version 5.
+  u16 sport;
+  // rule is the list that denied the connection, an enum rule_list plus one, or
+  // EVENT_RULE_POLICY_ENTRY. It is 0 when the connection is permitted, since version 6.
+  u8 rule;
+  // monitored is set when rule is a deny entry in mode: monitor, since version 7.
+  u8 monitored;
+  // container is set when the task is in a classified container, with target: container or
+  // all, since version 8.
+  u8 container;
 };
 
 struct audit_event_ipv6
@@ -76,6 +175,13 @@ struct audit_event_ipv6
   u8 operation;
   u8 action;
   u8 sock_type;
+  u8 verdict;
+  // sport, since version 5, rule, since version 6, monitored, since version 7, and container,
+  // since version 8, as in audit_event_ipv4.
+  u16 sport;
+  u8 rule;
+  u8 monitored;
+  u8 container;
 };
 
 struct ipv4_trie_key
@@ -95,6 +201,73 @@ union ip_trie_key {
   struct ipv6_trie_key v6;
 };
 
+// The keys of the protocol lists: the socket type, SOCK_STREAM or SOCK_DGRAM, then the address.
+// prefixlen covers the socket type, so it is 8 more than the prefix of the address. The address
+// is bytes so that it follows the socket type without padding.
+struct ipv4_protocol_trie_key
+{
+  u32 prefixlen;
+  u8 sock_type;
+  u8 addr[4];
+};
+
+struct ipv6_protocol_trie_key
+{
+  u32 prefixlen;
+  u8 sock_type;
+  u8 addr[16];
+};
+
+union ip_protocol_trie_key {
+  struct ipv4_protocol_trie_key v4;
+  struct ipv6_protocol_trie_key v6;
+};
+
+// The port is in network byte order, as the trie compares its bytes. pad keeps the key the size
+// userspace writes; only the first prefixlen bits, at most 16, are compared.
+struct port_trie_key
+{
+  u32 prefixlen;
+  __be16 port;
+  u16 pad;
+};
+
+
+// The lists of the rules whose hits are recorded in rule_last_hit, RULE_LIST_* of rulehits.go.
+enum rule_list
+{
+  RULE_ALLOWED_CIDR,
+  RULE_DENIED_CIDR,
+  RULE_ALLOWED_COMMAND,
+  RULE_DENIED_COMMAND,
+  RULE_ALLOWED_UID,
+  RULE_DENIED_UID,
+  RULE_ALLOWED_GID,
+  RULE_DENIED_GID,
+  RULE_ALLOWED_PORT,
+  RULE_DENIED_PORT
+};
+
+// The rule of an event denied by an entry of network.policies, which decides the destination
+// in place of the CIDR lists.
+#define EVENT_RULE_POLICY_ENTRY 255
+
+// The key of a hit is what was looked up in the list: the destination address for the CIDR lists,
+// which userspace attributes to the rule, the comm, the uid or gid, or the port in host byte order.
+struct rule_hit_key
+{
+  u32 list;
+  u16 family; // AF_INET or AF_INET6 for the CIDR lists, 0 otherwise.
+  u16 pad;
+  u8 value[16];
+};
+
+// The value of rule_last_hit: when the key last matched, and how many times since it was inserted.
+struct rule_hit
+{
+  u64 last_hit; // bpf_ktime_get_ns
+  u64 count;
+};
 
 static inline struct in_addr src_addr4(const struct socket *sock)
 {
@@ -112,4 +285,11 @@ static inline struct in6_addr src_addr6(const struct socket *sock)
 
   addr = BPF_CORE_READ(sock, sk, __sk_common.skc_v6_rcv_saddr);
   return addr;
+}
+
+// src_port is the local port of sock in host byte order, 0 when it is not bound yet: the
+// kernel picks the port of an unbound socket after connect is allowed.
+static inline u16 src_port(const struct socket *sock)
+{
+  return BPF_CORE_READ(sock, sk, __sk_common.skc_num);
 }
\ No newline at end of file
@@ -0,0 +1,133 @@
+// Package bundle assembles the debug bundle of `bouheki debug bundle`: one tar.gz of the files a
+// bug report needs, each generated by the code of the subcommand that prints it, and a manifest
+// of what was collected and what was not.
+//
+// Every file goes through a Redactor before it is written, so that the fields of the audit events
+// redaction.event_fields names are not in the bundle, whichever file they are in.
+package bundle
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// MANIFEST_NAME is the file of the Manifest, the last of the bundle.
+const MANIFEST_NAME = "manifest.json"
+
+// Manifest lists exactly what the bundle holds.
+type Manifest struct {
+	CreatedAt time.Time `json:"created_at"`
+	Version   string    `json:"version"`
+	// RedactedFields are the fields whose values are replaced by config.REDACTED in every file.
+	RedactedFields []string `json:"redacted_fields"`
+	Files          []File   `json:"files"`
+	// Skipped are the files that were not collected, and why.
+	Skipped []Skipped `json:"skipped"`
+}
+
+// File is a file of the bundle.
+type File struct {
+	Name string `json:"name"`
+	// Source is what generated the file, e.g. the subcommand that prints the same output.
+	Source string `json:"source"`
+	Size   int    `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Skipped is a file that is not in the bundle.
+type Skipped struct {
+	Name   string `json:"name"`
+	Source string `json:"source"`
+	Reason string `json:"reason"`
+}
+
+// Writer writes a bundle to a tar.gz stream. The files are in a directory named after the time
+// the bundle was created, so that the bundles of a report extract side by side.
+type Writer struct {
+	gz       *gzip.Writer
+	tar      *tar.Writer
+	redactor *Redactor
+	dir      string
+	manifest Manifest
+}
+
+func NewWriter(w io.Writer, redactor *Redactor, version string, now time.Time) *Writer {
+	gz := gzip.NewWriter(w)
+	return &Writer{
+		gz:       gz,
+		tar:      tar.NewWriter(gz),
+		redactor: redactor,
+		dir:      "bouheki-bundle-" + now.UTC().Format("20060102T150405Z"),
+		manifest: Manifest{
+			CreatedAt:      now.UTC(),
+			Version:        version,
+			RedactedFields: redactor.Fields(),
+			Files:          []File{},
+			Skipped:        []Skipped{},
+		},
+	}
+}
+
+// Add writes what generate writes as name, redacted. A file whose generate fails is skipped with
+// the error as the reason, and whatever generate wrote before is dropped. The error of Add is
+// the one of the archive.
+func (b *Writer) Add(name, source string, generate func(w io.Writer) error) error {
+	var buf bytes.Buffer
+	if err := generate(&buf); err != nil {
+		b.Skip(name, source, err.Error())
+		return nil
+	}
+
+	data := b.redactor.Redact(buf.Bytes())
+	if err := b.write(name, data); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	b.manifest.Files = append(b.manifest.Files, File{Name: name, Source: source, Size: len(data), SHA256: hex.EncodeToString(sum[:])})
+	return nil
+}
+
+// Skip records a file that is not collected, e.g. the event capture that was not requested.
+func (b *Writer) Skip(name, source, reason string) {
+	b.manifest.Skipped = append(b.manifest.Skipped, Skipped{Name: name, Source: source, Reason: reason})
+}
+
+// Manifest returns the manifest of the files added so far.
+func (b *Writer) Manifest() Manifest {
+	return b.manifest
+}
+
+// Close writes the manifest and ends the archive.
+func (b *Writer) Close() error {
+	data, err := json.MarshalIndent(b.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := b.write(MANIFEST_NAME, append(data, '\n')); err != nil {
+		return err
+	}
+	if err := b.tar.Close(); err != nil {
+		return err
+	}
+	return b.gz.Close()
+}
+
+func (b *Writer) write(name string, data []byte) error {
+	header := &tar.Header{
+		Name:    b.dir + "/" + name,
+		Mode:    0600,
+		Size:    int64(len(data)),
+		ModTime: b.manifest.CreatedAt,
+	}
+	if err := b.tar.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := b.tar.Write(data)
+	return err
+}
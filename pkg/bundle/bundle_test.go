@@ -0,0 +1,132 @@
+package bundle
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// readBundle returns the files of a bundle by their name in its directory.
+func readBundle(t *testing.T, data []byte) map[string]string {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	assert.Nil(t, err)
+	r := tar.NewReader(gz)
+	files := map[string]string{}
+	for {
+		header, err := r.Next()
+		if err == io.EOF {
+			return files
+		}
+		assert.Nil(t, err)
+		content, err := ioutil.ReadAll(r)
+		assert.Nil(t, err)
+		assert.True(t, strings.HasPrefix(header.Name, "bouheki-bundle-20261014T120000Z/"), header.Name)
+		files[strings.TrimPrefix(header.Name, "bouheki-bundle-20261014T120000Z/")] = string(content)
+	}
+}
+
+func testRedactor() *Redactor {
+	conf := config.DefaultConfig()
+	conf.Log.Labels = map[string]string{"env": "prod"}
+	return NewRedactor(conf)
+}
+
+func TestWriter(t *testing.T) {
+	var out bytes.Buffer
+	b := NewWriter(&out, testRedactor(), "0.0.10", time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC))
+	assert.Nil(t, b.Add("doctor.txt", "bouheki doctor", func(w io.Writer) error {
+		_, err := io.WriteString(w, "[OK]   root user\n")
+		return err
+	}))
+	assert.Nil(t, b.Add("status.json", "GET /v1/state", func(w io.Writer) error {
+		io.WriteString(w, "partial")
+		return errors.New("connection refused")
+	}))
+	b.Skip("events.jsonl", "--capture", "not requested")
+	assert.Nil(t, b.Close())
+
+	files := readBundle(t, out.Bytes())
+	assert.Equal(t, "[OK]   root user\n", files["doctor.txt"])
+	assert.NotContains(t, files, "status.json")
+
+	var manifest Manifest
+	assert.Nil(t, json.Unmarshal([]byte(files[MANIFEST_NAME]), &manifest))
+	assert.Equal(t, "0.0.10", manifest.Version)
+	sum := sha256.Sum256([]byte(files["doctor.txt"]))
+	assert.Equal(t, []File{
+		{Name: "doctor.txt", Source: "bouheki doctor", Size: len(files["doctor.txt"]), SHA256: hex.EncodeToString(sum[:])},
+	}, manifest.Files)
+	assert.Equal(t, []Skipped{
+		{Name: "status.json", Source: "GET /v1/state", Reason: "connection refused"},
+		{Name: "events.jsonl", Source: "--capture", Reason: "not requested"},
+	}, manifest.Skipped)
+	assert.Contains(t, manifest.RedactedFields, "Addr")
+	assert.Contains(t, manifest.RedactedFields, "env")
+}
+
+func TestRedactor(t *testing.T) {
+	r := testRedactor()
+
+	assert.Equal(t,
+		`{"Addr":"[redacted]","Comm":"curl","Port":443,"env":"[redacted]","msg":"Traffic is trapped in the filter."}`,
+		r.Line(`{"Addr":"10.0.0.1","Comm":"curl","Port":443,"env":"prod","msg":"Traffic is trapped in the filter."}`))
+	assert.Equal(t,
+		`time="2026-10-14T12:00:00Z" level=info msg="Traffic is trapped in the filter." Addr="[redacted]" Comm=curl Hostname="[redacted]" env="[redacted]"`,
+		r.Line(`time="2026-10-14T12:00:00Z" level=info msg="Traffic is trapped in the filter." Addr=10.0.0.1 Comm=curl Hostname="web 1" env=prod`))
+	assert.Equal(t, "not a log line", r.Line("not a log line"))
+
+	// The fields are replaced at any depth, whatever their case and underscores.
+	doc := "{\n  \"alerts\": [\n    {\n      \"local_addr\": \"10.0.0.2\",\n      \"count\": 12345678901234567890\n    }\n  ]\n}\n"
+	assert.Equal(t, "{\n  \"alerts\": [\n    {\n      \"count\": 12345678901234567890,\n      \"local_addr\": \"[redacted]\"\n    }\n  ]\n}\n", string(r.Redact([]byte(doc))))
+
+	lines := "{\"Domain\":\"example.com\"}\n{\"Domain\":\"example.org\"}\n"
+	assert.Equal(t, "{\"Domain\":\"[redacted]\"}\n{\"Domain\":\"[redacted]\"}\n", string(r.Redact([]byte(lines))))
+
+	conf := config.DefaultConfig()
+	conf.Redaction = config.RedactionConfig{}
+	assert.Equal(t, lines, string(NewRedactor(conf).Redact([]byte(lines))))
+}
+
+func TestTailAndCapture(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bouheki.log")
+	event := `{"Addr":"10.0.0.1","msg":"Traffic is trapped in the filter."}`
+	shutdown := `time="2026-10-14T12:00:00Z" level=info msg="Drained the audit events on shutdown." Drained=3`
+	assert.Nil(t, ioutil.WriteFile(path, []byte(strings.Join([]string{
+		`{"msg":"Serving metrics on 127.0.0.1:9913"}`, event, shutdown, `{"msg":"Terminate all audit."}`,
+	}, "\n")+"\n"), 0600))
+
+	assert.True(t, IsEvent(event))
+	assert.True(t, IsShutdown(shutdown))
+	assert.False(t, IsEvent(shutdown))
+
+	lines, err := Tail(path, 2, func(line string) bool { return !IsEvent(line) })
+	assert.Nil(t, err)
+	assert.Equal(t, []string{shutdown, `{"msg":"Terminate all audit."}`}, lines)
+
+	// Only the lines logged while the capture waits are captured.
+	lines, err = Capture(path, func() {
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+		assert.Nil(t, err)
+		file.WriteString(`{"Addr":"10.0.0.9","msg":"Traffic is trapped in the filter."}` + "\n" + `{"msg":"Reloaded the config."}` + "\n")
+		file.Close()
+	}, IsEvent)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{`{"Addr":"10.0.0.9","msg":"Traffic is trapped in the filter."}`}, lines)
+
+	_, err = Tail(filepath.Join(t.TempDir(), "missing.log"), 1, IsEvent)
+	assert.True(t, os.IsNotExist(err))
+}
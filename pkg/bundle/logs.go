@@ -0,0 +1,102 @@
+package bundle
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+
+	log "github.com/mrtc0/bouheki/pkg/log"
+)
+
+// MAX_LINE_SIZE is the longest log line that is read, longer ones end the read with an error.
+const MAX_LINE_SIZE = 1024 * 1024
+
+var textMessage = regexp.MustCompile(`(^|\s)msg=("(?:[^"\\]|\\.)*"|\S*)`)
+
+// Message returns the message of a line of the log, in either log.format, or "" if it has none.
+func Message(line string) string {
+	var entry struct {
+		Msg string `json:"msg"`
+	}
+	if json.Unmarshal([]byte(line), &entry) == nil {
+		return entry.Msg
+	}
+	m := textMessage.FindStringSubmatch(line)
+	if m == nil {
+		return ""
+	}
+	if msg, err := strconv.Unquote(m[2]); err == nil {
+		return msg
+	}
+	return m[2]
+}
+
+// IsEvent reports whether a line of the log is an audit event, rather than an operational log.
+func IsEvent(line string) bool {
+	switch Message(line) {
+	case log.NETWORK_EVENT_MESSAGE, log.FILE_ACCESS_EVENT_MESSAGE, log.MOUNT_EVENT_MESSAGE, log.EVENTS_DROPPED_MESSAGE:
+		return true
+	}
+	return false
+}
+
+// IsShutdown reports whether a line of the log is the report of a run, logged when it shuts down.
+func IsShutdown(line string) bool {
+	return Message(line) == log.SHUTDOWN_MESSAGE
+}
+
+// Tail returns the last n lines of the log file path that keep accepts, the oldest first.
+func Tail(path string, n int, keep func(line string) bool) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	lines := []string{}
+	err = scan(file, func(line string) {
+		if !keep(line) {
+			return
+		}
+		lines = append(lines, line)
+		if len(lines) > n {
+			lines = lines[1:]
+		}
+	})
+	return lines, err
+}
+
+// Capture returns the lines appended to the log file path while wait runs that keep accepts. The
+// lines written after the file is rotated are not read.
+func Capture(path string, wait func(), keep func(line string) bool) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if _, err := file.Seek(0, io.SeekEnd); err != nil {
+		return nil, err
+	}
+
+	wait()
+
+	lines := []string{}
+	err = scan(file, func(line string) {
+		if keep(line) {
+			lines = append(lines, line)
+		}
+	})
+	return lines, err
+}
+
+func scan(r io.Reader, f func(line string)) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), MAX_LINE_SIZE)
+	for scanner.Scan() {
+		f(scanner.Text())
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,133 @@
+package bundle
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+)
+
+// textField is a field of a log line of log.format: text, key=value or key="quoted value".
+var textField = regexp.MustCompile(`(^|\s)([A-Za-z_][A-Za-z0-9_.]*)=("(?:[^"\\]|\\.)*"|\S*)`)
+
+// Redactor replaces the values of the sensitive fields: the fields of redaction.event_fields,
+// and the labels with redaction.labels, which are fields of every log line.
+//
+// A field is matched whatever its case and its underscores, so that LocalAddr is also replaced
+// where it is written local_addr, e.g. in the filters of the state document.
+type Redactor struct {
+	names  []string
+	fields map[string]bool
+}
+
+func NewRedactor(conf *config.Config) *Redactor {
+	names := append([]string{}, conf.Redaction.EventFields...)
+	if conf.Redaction.Labels {
+		for key := range conf.Log.Labels {
+			names = append(names, key)
+		}
+	}
+	sort.Strings(names)
+
+	r := &Redactor{names: names, fields: map[string]bool{}}
+	for _, name := range names {
+		r.fields[fieldKey(name)] = true
+	}
+	return r
+}
+
+func fieldKey(name string) string {
+	return strings.ToLower(strings.ReplaceAll(name, "_", ""))
+}
+
+// Fields returns the names of the fields that are replaced.
+func (r *Redactor) Fields() []string {
+	return r.names
+}
+
+func (r *Redactor) sensitive(key string) bool {
+	return r.fields[fieldKey(key)]
+}
+
+// Redact replaces the sensitive fields of a JSON document, or of every line of a text, which may
+// be a JSON object or a line of log.format: text.
+func (r *Redactor) Redact(data []byte) []byte {
+	if len(r.fields) == 0 {
+		return data
+	}
+	if redacted, ok := r.redactJSON(data); ok {
+		// An indented document stays indented, a JSON line stays one line.
+		var buf bytes.Buffer
+		if bytes.Contains(bytes.TrimSpace(data), []byte("\n")) {
+			json.Indent(&buf, redacted, "", "  ")
+		} else {
+			buf.Write(redacted)
+		}
+		if bytes.HasSuffix(data, []byte("\n")) {
+			buf.WriteByte('\n')
+		}
+		return buf.Bytes()
+	}
+
+	lines := strings.Split(string(data), "\n")
+	for i, line := range lines {
+		lines[i] = r.Line(line)
+	}
+	return []byte(strings.Join(lines, "\n"))
+}
+
+// Line replaces the sensitive fields of a line of the log.
+func (r *Redactor) Line(line string) string {
+	if redacted, ok := r.redactJSON([]byte(line)); ok {
+		return string(redacted)
+	}
+	return textField.ReplaceAllStringFunc(line, func(field string) string {
+		m := textField.FindStringSubmatch(field)
+		if !r.sensitive(m[2]) {
+			return field
+		}
+		return m[1] + m[2] + "=" + strconv.Quote(config.REDACTED)
+	})
+}
+
+// redactJSON replaces the sensitive fields of an object or of an array, at any depth. It is not ok
+// when data is neither.
+func (r *Redactor) redactJSON(data []byte) ([]byte, bool) {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 || (trimmed[0] != '{' && trimmed[0] != '[') {
+		return nil, false
+	}
+	decoder := json.NewDecoder(bytes.NewReader(trimmed))
+	decoder.UseNumber()
+	var v interface{}
+	if err := decoder.Decode(&v); err != nil || decoder.More() {
+		return nil, false
+	}
+	redacted, err := json.Marshal(r.value(v))
+	if err != nil {
+		return nil, false
+	}
+	return redacted, true
+}
+
+func (r *Redactor) value(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if r.sensitive(key) {
+				v[key] = config.REDACTED
+			} else {
+				v[key] = r.value(value)
+			}
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = r.value(value)
+		}
+	}
+	return v
+}
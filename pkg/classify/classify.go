@@ -0,0 +1,330 @@
+// Package classify decides whether a process runs in a container, as configured by
+// network.classification. The BPF program makes the same decision in the kernel; this
+// package compiles the cgroup strategies into the cgroup ids the program looks up, and
+// explains the decision for `bouheki debug classify`.
+package classify
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+)
+
+const (
+	// HOST_MNT_NS_INUM is the inode number of the initial mount namespace, the first
+	// dynamically allocated proc inode. The BPF program compares with the same value.
+	HOST_MNT_NS_INUM = 0xF0000000
+
+	PROC_ROOT   = "/proc"
+	CGROUP_ROOT = "/sys/fs/cgroup"
+	// CGROUP_UNIFIED_DIR is where the hybrid layout of systemd mounts the cgroup v2 hierarchy,
+	// below CGROUP_ROOT and next to the cgroup v1 hierarchies of the controllers.
+	CGROUP_UNIFIED_DIR = "unified"
+)
+
+// ErrNoCgroupV2 is returned by UnifiedRoot when only the cgroup v1 hierarchies are mounted.
+// bpf_get_current_cgroup_id returns the id of the cgroup v2 hierarchy, so the cgroup strategies
+// can not tell its cgroups apart.
+var ErrNoCgroupV2 = errors.New("no cgroup v2 hierarchy is mounted, the cgroup strategies need it")
+
+// UnifiedRoot returns where the cgroup v2 hierarchy is mounted: root in the unified layout, and
+// its CGROUP_UNIFIED_DIR in the hybrid one, where the controllers are on cgroup v1 but the tasks
+// are still in a cgroup of the cgroup v2 hierarchy, whose id bpf_get_current_cgroup_id returns.
+// The cgroup v2 hierarchy is told by its cgroup.controllers file.
+func UnifiedRoot(root string) (string, error) {
+	for _, dir := range []string{root, filepath.Join(root, CGROUP_UNIFIED_DIR)} {
+		if _, err := os.Stat(filepath.Join(dir, "cgroup.controllers")); err == nil {
+			return dir, nil
+		}
+	}
+	return "", fmt.Errorf("%w: neither %s nor %s is a cgroup v2 mount", ErrNoCgroupV2, root, filepath.Join(root, CGROUP_UNIFIED_DIR))
+}
+
+// Process is what the strategies look at, read from /proc.
+type Process struct {
+	PID int
+	// MountNamespace is the inode number of the mount namespace.
+	MountNamespace uint64
+	// PIDNamespaceLevel is 0 in the initial pid namespace, and one more for every nested pid namespace.
+	PIDNamespaceLevel int
+	// Cgroup is the cgroup v2 path of the process, "" without the unified hierarchy.
+	Cgroup string
+}
+
+// Result is the classification of a process and why.
+type Result struct {
+	Container bool
+	Reason    string
+}
+
+type Classifier struct {
+	conf     config.ClassificationConfig
+	patterns []*regexp.Regexp
+	cgroups  []string
+}
+
+func New(conf config.ClassificationConfig) (*Classifier, error) {
+	c := &Classifier{conf: conf}
+
+	patterns := conf.CgroupPatterns
+	if len(patterns) == 0 {
+		patterns = config.DEFAULT_CGROUP_PATTERNS
+	}
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		c.patterns = append(c.patterns, re)
+	}
+
+	for _, cgroup := range conf.Cgroups {
+		c.cgroups = append(c.cgroups, filepath.Clean(cgroup))
+	}
+
+	return c, nil
+}
+
+func (c *Classifier) Strategy() string {
+	return c.conf.Strategy
+}
+
+// UsesCgroups reports whether the strategy needs the cgroup ids from CgroupIDs.
+func (c *Classifier) UsesCgroups() bool {
+	return c.conf.UsesCgroups()
+}
+
+// Classify classifies p with the configured strategy.
+func (c *Classifier) Classify(p Process) Result {
+	return c.ClassifyWith(c.conf.Strategy, p)
+}
+
+// ClassifyWith classifies p with strategy, so that the strategies can be compared.
+func (c *Classifier) ClassifyWith(strategy string, p Process) Result {
+	switch strategy {
+	case config.CLASSIFY_PID_NAMESPACE:
+		if p.PIDNamespaceLevel > 0 {
+			return Result{Container: true, Reason: fmt.Sprintf("pid namespace is nested %d level(s) below the initial one", p.PIDNamespaceLevel)}
+		}
+		return Result{Reason: "in the initial pid namespace"}
+	case config.CLASSIFY_CGROUP_PATTERN, config.CLASSIFY_CGROUP_LIST:
+		if p.Cgroup == "" {
+			return Result{Reason: "no cgroup v2 path"}
+		}
+		if match, ok := c.matchCgroup(strategy, p.Cgroup); ok {
+			return Result{Container: true, Reason: fmt.Sprintf("cgroup %s matches %s", p.Cgroup, match)}
+		}
+		return Result{Reason: fmt.Sprintf("cgroup %s matches no %s entry", p.Cgroup, strategy)}
+	default:
+		if p.MountNamespace != HOST_MNT_NS_INUM {
+			return Result{Container: true, Reason: fmt.Sprintf("mount namespace %d is not the initial one (%d)", p.MountNamespace, uint64(HOST_MNT_NS_INUM))}
+		}
+		return Result{Reason: "in the initial mount namespace"}
+	}
+}
+
+// matchCgroup returns the pattern or the listed cgroup that path matches.
+func (c *Classifier) matchCgroup(strategy string, path string) (string, bool) {
+	if strategy == config.CLASSIFY_CGROUP_LIST {
+		for _, cgroup := range c.cgroups {
+			if path == cgroup || strings.HasPrefix(path, strings.TrimSuffix(cgroup, "/")+"/") {
+				return cgroup, true
+			}
+		}
+		return "", false
+	}
+
+	for _, re := range c.patterns {
+		if re.MatchString(path) {
+			return re.String(), true
+		}
+	}
+	return "", false
+}
+
+// CgroupIDs walks the cgroup v2 hierarchy mounted at root and returns the ids of the
+// cgroups classified as containers, with their path. The id of a cgroup is the inode
+// number of its directory, which is what bpf_get_current_cgroup_id returns.
+func (c *Classifier) CgroupIDs(root string) (map[uint64]string, error) {
+	return c.CgroupIDsBelow(root, "/")
+}
+
+// CgroupIDsBelow is CgroupIDs for cgroup and the cgroups below it.
+func (c *Classifier) CgroupIDsBelow(root string, cgroup string) (map[uint64]string, error) {
+	ids := map[uint64]string{}
+	start := filepath.Join(root, filepath.FromSlash(cgroup))
+	err := filepath.WalkDir(start, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// A cgroup removed during the walk.
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+
+		cgroup, err := cgroupPath(root, path)
+		if err != nil {
+			return err
+		}
+		if _, ok := c.matchCgroup(c.conf.Strategy, cgroup); !ok {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			ids[stat.Ino] = cgroup
+		}
+		return nil
+	})
+	return ids, err
+}
+
+// Roots returns the cgroups of ids whose parent is not classified as a container.
+// A program that walks the ancestors of the current cgroup only needs these.
+func (c *Classifier) Roots(ids map[uint64]string) map[uint64]string {
+	roots := map[uint64]string{}
+	for id, cgroup := range ids {
+		if cgroup != "/" {
+			if _, ok := c.matchCgroup(c.conf.Strategy, path.Dir(cgroup)); ok {
+				continue
+			}
+		}
+		roots[id] = cgroup
+	}
+	return roots
+}
+
+// MissingCgroups returns the cgroups of the cgroup-list strategy that do not exist in the
+// hierarchy mounted at root, e.g. of a service that is not started yet, in the configured order.
+func (c *Classifier) MissingCgroups(root string) []string {
+	missing := []string{}
+	if c.conf.Strategy != config.CLASSIFY_CGROUP_LIST {
+		return missing
+	}
+	for _, cgroup := range c.cgroups {
+		if _, err := os.Stat(filepath.Join(root, filepath.FromSlash(cgroup))); os.IsNotExist(err) {
+			missing = append(missing, cgroup)
+		}
+	}
+	return missing
+}
+
+// WatchedCgroups returns the cgroups below which a new cgroup can be classified as a container.
+func (c *Classifier) WatchedCgroups() []string {
+	if c.conf.Strategy == config.CLASSIFY_CGROUP_LIST {
+		return c.cgroups
+	}
+	return []string{"/"}
+}
+
+// cgroupPath returns the cgroup of the directory dir of the hierarchy mounted at root.
+func cgroupPath(root string, dir string) (string, error) {
+	rel, err := filepath.Rel(root, dir)
+	if err != nil {
+		return "", err
+	}
+	if rel == "." {
+		return "/", nil
+	}
+	return "/" + filepath.ToSlash(rel), nil
+}
+
+// Read reads the namespaces and the cgroup of pid from the proc filesystem mounted at root.
+func Read(root string, pid int) (Process, error) {
+	dir := filepath.Join(root, strconv.Itoa(pid))
+	p := Process{PID: pid}
+
+	mntns, err := namespaceInode(filepath.Join(dir, "ns", "mnt"))
+	if err != nil {
+		return p, err
+	}
+	p.MountNamespace = mntns
+
+	if p.PIDNamespaceLevel, err = pidNamespaceLevel(filepath.Join(dir, "status")); err != nil {
+		return p, err
+	}
+
+	if p.Cgroup, err = cgroupV2Path(filepath.Join(dir, "cgroup")); err != nil {
+		return p, err
+	}
+
+	return p, nil
+}
+
+// Cgroup reads the cgroup v2 path of pid from the proc filesystem mounted at root, "" without the
+// unified hierarchy.
+func Cgroup(root string, pid int) (string, error) {
+	return cgroupV2Path(filepath.Join(root, strconv.Itoa(pid), "cgroup"))
+}
+
+// namespaceInode parses the target of a /proc/<pid>/ns/ link, e.g. mnt:[4026531840].
+func namespaceInode(path string) (uint64, error) {
+	target, err := os.Readlink(path)
+	if err != nil {
+		return 0, err
+	}
+
+	start, end := strings.Index(target, "["), strings.LastIndex(target, "]")
+	if start < 0 || end < start {
+		return 0, fmt.Errorf("%s: unexpected namespace %q", path, target)
+	}
+	return strconv.ParseUint(target[start+1:end], 10, 64)
+}
+
+// pidNamespaceLevel counts the pids of the NSpid line of /proc/<pid>/status,
+// one for every pid namespace the process is in.
+func pidNamespaceLevel(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) > 1 && fields[0] == "NSpid:" {
+			return len(fields) - 2, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	// Kernels before 4.1 have no NSpid line.
+	return 0, fmt.Errorf("%s: no NSpid line", path)
+}
+
+// cgroupV2Path returns the path of the unified hierarchy line (0::<path>) of /proc/<pid>/cgroup.
+func cgroupV2Path(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if cgroup := strings.TrimPrefix(scanner.Text(), "0::"); cgroup != scanner.Text() {
+			return cgroup, nil
+		}
+	}
+	return "", scanner.Err()
+}
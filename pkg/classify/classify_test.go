@@ -0,0 +1,212 @@
+package classify
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// The fixtures in testdata/proc were captured from the host, with one process per environment.
+var fixtures = []struct {
+	env string
+	pid int
+	// container is the expected classification per strategy.
+	container map[string]bool
+}{
+	{env: "host", pid: 812, container: map[string]bool{
+		config.CLASSIFY_MOUNT_NAMESPACE: false, config.CLASSIFY_PID_NAMESPACE: false, config.CLASSIFY_CGROUP_PATTERN: false,
+	}},
+	// A systemd service with PrivateTmp= has its own mount namespace.
+	{env: "host-private-mounts", pid: 640, container: map[string]bool{
+		config.CLASSIFY_MOUNT_NAMESPACE: true, config.CLASSIFY_PID_NAMESPACE: false, config.CLASSIFY_CGROUP_PATTERN: false,
+	}},
+	{env: "docker", pid: 23611, container: map[string]bool{
+		config.CLASSIFY_MOUNT_NAMESPACE: true, config.CLASSIFY_PID_NAMESPACE: true, config.CLASSIFY_CGROUP_PATTERN: true,
+	}},
+	// docker run --pid=host
+	{env: "docker-host-pid", pid: 23990, container: map[string]bool{
+		config.CLASSIFY_MOUNT_NAMESPACE: true, config.CLASSIFY_PID_NAMESPACE: false, config.CLASSIFY_CGROUP_PATTERN: true,
+	}},
+	{env: "docker-cgroupfs-hybrid", pid: 24410, container: map[string]bool{
+		config.CLASSIFY_MOUNT_NAMESPACE: true, config.CLASSIFY_PID_NAMESPACE: true, config.CLASSIFY_CGROUP_PATTERN: true,
+	}},
+	{env: "containerd-kubernetes", pid: 40211, container: map[string]bool{
+		config.CLASSIFY_MOUNT_NAMESPACE: true, config.CLASSIFY_PID_NAMESPACE: true, config.CLASSIFY_CGROUP_PATTERN: true,
+	}},
+	{env: "podman-rootless", pid: 51234, container: map[string]bool{
+		config.CLASSIFY_MOUNT_NAMESPACE: true, config.CLASSIFY_PID_NAMESPACE: true, config.CLASSIFY_CGROUP_PATTERN: true,
+	}},
+	{env: "nspawn", pid: 61200, container: map[string]bool{
+		config.CLASSIFY_MOUNT_NAMESPACE: true, config.CLASSIFY_PID_NAMESPACE: true, config.CLASSIFY_CGROUP_PATTERN: true,
+	}},
+	{env: "lxc", pid: 7000, container: map[string]bool{
+		config.CLASSIFY_MOUNT_NAMESPACE: true, config.CLASSIFY_PID_NAMESPACE: true, config.CLASSIFY_CGROUP_PATTERN: true,
+	}},
+}
+
+func newClassifier(t *testing.T, conf config.ClassificationConfig) *Classifier {
+	c, err := New(conf)
+	assert.Nil(t, err)
+	return c
+}
+
+func TestClassifyFixtures(t *testing.T) {
+	c := newClassifier(t, config.ClassificationConfig{Strategy: config.CLASSIFY_CGROUP_PATTERN})
+
+	for _, fixture := range fixtures {
+		t.Run(fixture.env, func(t *testing.T) {
+			p, err := Read(filepath.Join("testdata", "proc", fixture.env), fixture.pid)
+			assert.Nil(t, err)
+
+			for strategy, container := range fixture.container {
+				result := c.ClassifyWith(strategy, p)
+				assert.Equal(t, container, result.Container, "%s: %s", strategy, result.Reason)
+				assert.NotEmpty(t, result.Reason)
+			}
+		})
+	}
+}
+
+func TestRead(t *testing.T) {
+	p, err := Read(filepath.Join("testdata", "proc", "nspawn"), 61200)
+	assert.Nil(t, err)
+	assert.Equal(t, Process{
+		PID:               61200,
+		MountNamespace:    4026533120,
+		PIDNamespaceLevel: 1,
+		Cgroup:            "/machine.slice/systemd-nspawn@debian.service/payload/system.slice/nginx.service",
+	}, p)
+
+	_, err = Read(filepath.Join("testdata", "proc", "nspawn"), 1)
+	assert.NotNil(t, err)
+}
+
+func TestClassifyReasons(t *testing.T) {
+	c := newClassifier(t, config.ClassificationConfig{Strategy: config.CLASSIFY_MOUNT_NAMESPACE})
+	assert.Equal(t, Result{Reason: "in the initial mount namespace"}, c.Classify(Process{MountNamespace: HOST_MNT_NS_INUM}))
+	assert.Equal(t, Result{Container: true, Reason: "mount namespace 4026532713 is not the initial one (4026531840)"},
+		c.Classify(Process{MountNamespace: 4026532713}))
+
+	c = newClassifier(t, config.ClassificationConfig{Strategy: config.CLASSIFY_CGROUP_PATTERN, CgroupPatterns: []string{`^/jobs/`}})
+	assert.Equal(t, Result{Container: true, Reason: "cgroup /jobs/42 matches ^/jobs/"}, c.Classify(Process{Cgroup: "/jobs/42"}))
+	assert.Equal(t, Result{Reason: "cgroup /docker/42 matches no cgroup-pattern entry"}, c.Classify(Process{Cgroup: "/docker/42"}))
+	assert.Equal(t, Result{Reason: "no cgroup v2 path"}, c.Classify(Process{}))
+}
+
+func TestClassifyCgroupList(t *testing.T) {
+	c := newClassifier(t, config.ClassificationConfig{Strategy: config.CLASSIFY_CGROUP_LIST, Cgroups: []string{"/machine.slice/sandbox.scope/"}})
+
+	assert.True(t, c.Classify(Process{Cgroup: "/machine.slice/sandbox.scope"}).Container)
+	assert.True(t, c.Classify(Process{Cgroup: "/machine.slice/sandbox.scope/payload"}).Container)
+	assert.False(t, c.Classify(Process{Cgroup: "/machine.slice/sandbox.scope2"}).Container)
+	assert.False(t, c.Classify(Process{Cgroup: "/machine.slice"}).Container)
+}
+
+func TestCgroupIDs(t *testing.T) {
+	root := filepath.Join("testdata", "cgroupfs")
+
+	paths := func(conf config.ClassificationConfig) []string {
+		ids, err := newClassifier(t, conf).CgroupIDs(root)
+		assert.Nil(t, err)
+		paths := []string{}
+		for id, path := range ids {
+			assert.NotZero(t, id)
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		return paths
+	}
+
+	// The cgroups of a container and the cgroups below.
+	assert.Equal(t, []string{
+		"/kubepods.slice",
+		"/kubepods.slice/kubepods-burstable.slice",
+		"/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod6f1e2d3c_4b5a_6978_8a9b_0c1d2e3f4a5b.slice",
+		"/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod6f1e2d3c_4b5a_6978_8a9b_0c1d2e3f4a5b.slice/cri-containerd-0b1c2d3e4f5a6b7c8d9e0f1a2b3c4d5e6f7a8b9c0d1e2f3a4b5c6d7e8f9a0b1c.scope",
+		"/lxc.payload.web",
+		"/lxc.payload.web/system.slice",
+		"/lxc.payload.web/system.slice/cron.service",
+		"/machine.slice/systemd-nspawn@debian.service",
+		"/machine.slice/systemd-nspawn@debian.service/payload",
+		"/machine.slice/systemd-nspawn@debian.service/payload/system.slice",
+		"/machine.slice/systemd-nspawn@debian.service/payload/system.slice/nginx.service",
+		"/system.slice/docker-3f1c2b7e9a0d4c5b8e6f7a1b2c3d4e5f60718293a4b5c6d7e8f90a1b2c3d4e5f.scope",
+		"/user.slice/user-1000.slice/user@1000.service/user.slice/libpod-7e6d5c4b3a29180f7e6d5c4b3a29180f7e6d5c4b3a29180f7e6d5c4b3a291807.scope",
+		"/user.slice/user-1000.slice/user@1000.service/user.slice/libpod-7e6d5c4b3a29180f7e6d5c4b3a29180f7e6d5c4b3a29180f7e6d5c4b3a291807.scope/container",
+	}, paths(config.ClassificationConfig{Strategy: config.CLASSIFY_CGROUP_PATTERN}))
+
+	assert.Equal(t, []string{
+		"/machine.slice/systemd-nspawn@debian.service/payload",
+		"/machine.slice/systemd-nspawn@debian.service/payload/system.slice",
+		"/machine.slice/systemd-nspawn@debian.service/payload/system.slice/nginx.service",
+	}, paths(config.ClassificationConfig{Strategy: config.CLASSIFY_CGROUP_LIST, Cgroups: []string{"/machine.slice/systemd-nspawn@debian.service/payload"}}))
+}
+
+func TestMissingCgroups(t *testing.T) {
+	root := filepath.Join("testdata", "cgroupfs")
+	c := newClassifier(t, config.ClassificationConfig{Strategy: config.CLASSIFY_CGROUP_LIST, Cgroups: []string{
+		"/system.slice/nginx.service",
+		"/machine.slice/systemd-nspawn@debian.service/payload",
+		"/kubepods.slice/kubepods-besteffort.slice",
+	}})
+	assert.Equal(t, []string{"/system.slice/nginx.service", "/kubepods.slice/kubepods-besteffort.slice"}, c.MissingCgroups(root))
+
+	// The other strategies list no cgroup.
+	assert.Empty(t, newClassifier(t, config.ClassificationConfig{Strategy: config.CLASSIFY_CGROUP_PATTERN}).MissingCgroups(root))
+}
+
+func TestUnifiedRoot(t *testing.T) {
+	unified := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(unified, "cgroup.controllers"), []byte("cpu memory\n"), 0644))
+	root, err := UnifiedRoot(unified)
+	assert.Nil(t, err)
+	assert.Equal(t, unified, root)
+
+	// The hybrid layout mounts it below the hierarchies of the controllers.
+	hybrid := t.TempDir()
+	assert.Nil(t, os.MkdirAll(filepath.Join(hybrid, "memory"), 0755))
+	assert.Nil(t, os.MkdirAll(filepath.Join(hybrid, CGROUP_UNIFIED_DIR), 0755))
+	assert.Nil(t, os.WriteFile(filepath.Join(hybrid, CGROUP_UNIFIED_DIR, "cgroup.controllers"), nil, 0644))
+	root, err = UnifiedRoot(hybrid)
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(hybrid, CGROUP_UNIFIED_DIR), root)
+
+	legacy := t.TempDir()
+	assert.Nil(t, os.MkdirAll(filepath.Join(legacy, "memory"), 0755))
+	_, err = UnifiedRoot(legacy)
+	assert.ErrorIs(t, err, ErrNoCgroupV2)
+}
+
+func TestCgroupIDsBelow(t *testing.T) {
+	root := filepath.Join("testdata", "cgroupfs")
+	c := newClassifier(t, config.ClassificationConfig{Strategy: config.CLASSIFY_CGROUP_PATTERN})
+
+	ids, err := c.CgroupIDsBelow(root, "/lxc.payload.web/system.slice")
+	assert.Nil(t, err)
+	paths := []string{}
+	for _, path := range ids {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	assert.Equal(t, []string{"/lxc.payload.web/system.slice", "/lxc.payload.web/system.slice/cron.service"}, paths)
+
+	// A cgroup removed before it could be walked.
+	ids, err = c.CgroupIDsBelow(root, "/lxc.payload.gone")
+	assert.Nil(t, err)
+	assert.Empty(t, ids)
+}
+
+func TestRoots(t *testing.T) {
+	c := newClassifier(t, config.ClassificationConfig{Strategy: config.CLASSIFY_CGROUP_LIST, Cgroups: []string{"/machine.slice/sandbox.scope", "/jobs"}})
+
+	assert.Equal(t, map[uint64]string{1: "/machine.slice/sandbox.scope", 4: "/jobs"}, c.Roots(map[uint64]string{
+		1: "/machine.slice/sandbox.scope",
+		2: "/machine.slice/sandbox.scope/payload",
+		3: "/machine.slice/sandbox.scope/payload/nginx.service",
+		4: "/jobs",
+	}))
+}
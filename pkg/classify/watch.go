@@ -0,0 +1,198 @@
+package classify
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const WATCH_MASK = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_ONLYDIR
+
+var ErrWatcherClosed = errors.New("cgroup watcher is closed")
+
+// Change is a cgroup created or removed below a watched cgroup. Overflow means that
+// changes were lost and the hierarchy must be scanned again.
+type Change struct {
+	Cgroup   string
+	Removed  bool
+	Overflow bool
+}
+
+// Watcher reports the cgroups created and removed below the watched cgroups with inotify,
+// so that the cgroups of a new container are classified without waiting for the next scan.
+type Watcher struct {
+	root string
+	// fd is the inotify instance, read through file. File.Fd would make it blocking.
+	fd   int
+	file *os.File
+
+	mu sync.Mutex
+	// dirs maps the watch descriptors to the cgroup they watch, and cgroups the reverse.
+	dirs    map[int32]string
+	cgroups map[string]int32
+}
+
+// NewWatcher returns a Watcher of the cgroup v2 hierarchy mounted at root.
+func NewWatcher(root string) (*Watcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_NONBLOCK | syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Watcher{
+		root: root,
+		fd:   fd,
+		// A non-blocking fd is read through the runtime poller, so Close interrupts Read.
+		file:    os.NewFile(uintptr(fd), "inotify"),
+		dirs:    map[int32]string{},
+		cgroups: map[string]int32{},
+	}, nil
+}
+
+// Add watches cgroup and the cgroups below it. Watching a cgroup again is a no-op.
+func (w *Watcher) Add(cgroup string) error {
+	_, err := w.add(cgroup)
+	return err
+}
+
+// add returns the cgroups it started to watch.
+func (w *Watcher) add(cgroup string) ([]string, error) {
+	added := []string{}
+	start := filepath.Join(w.root, filepath.FromSlash(cgroup))
+	err := filepath.WalkDir(start, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+
+		cgroup, err := cgroupPath(w.root, path)
+		if err != nil {
+			return err
+		}
+		ok, err := w.watch(path, cgroup)
+		if ok {
+			added = append(added, cgroup)
+		}
+		return err
+	})
+	return added, err
+}
+
+func (w *Watcher) watch(path string, cgroup string) (bool, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, ok := w.cgroups[cgroup]; ok {
+		return false, nil
+	}
+
+	wd, err := syscall.InotifyAddWatch(w.fd, path, WATCH_MASK)
+	if err != nil {
+		// Removed before it could be watched.
+		if errors.Is(err, syscall.ENOENT) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to watch %s: %w", path, err)
+	}
+	w.dirs[int32(wd)] = cgroup
+	w.cgroups[cgroup] = int32(wd)
+	return true, nil
+}
+
+// Read blocks until cgroups are created or removed, and returns the changes. A created
+// cgroup is watched before Read returns, and so are the cgroups created below it meanwhile,
+// which are reported as created too.
+func (w *Watcher) Read() ([]Change, error) {
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	n, err := w.file.Read(buf)
+	if err != nil {
+		if errors.Is(err, os.ErrClosed) {
+			return nil, ErrWatcherClosed
+		}
+		return nil, err
+	}
+
+	changes := []Change{}
+	for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+		event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+		name := strings.TrimRight(string(buf[offset+syscall.SizeofInotifyEvent:offset+syscall.SizeofInotifyEvent+int(event.Len)]), "\x00")
+		offset += syscall.SizeofInotifyEvent + int(event.Len)
+
+		if event.Mask&syscall.IN_Q_OVERFLOW != 0 {
+			changes = append(changes, Change{Overflow: true})
+			continue
+		}
+		if event.Mask&syscall.IN_IGNORED != 0 {
+			w.forget(event.Wd)
+			continue
+		}
+		if event.Mask&syscall.IN_ISDIR == 0 {
+			continue
+		}
+
+		w.mu.Lock()
+		parent, ok := w.dirs[event.Wd]
+		w.mu.Unlock()
+		if !ok {
+			continue
+		}
+		cgroup := strings.TrimSuffix(parent, "/") + "/" + name
+
+		if event.Mask&(syscall.IN_DELETE|syscall.IN_MOVED_FROM) != 0 {
+			w.forgetBelow(cgroup)
+			changes = append(changes, Change{Cgroup: cgroup, Removed: true})
+			continue
+		}
+		added, err := w.add(cgroup)
+		for _, cgroup := range added {
+			changes = append(changes, Change{Cgroup: cgroup})
+		}
+		if err != nil {
+			return changes, err
+		}
+	}
+
+	return changes, nil
+}
+
+// forget drops the watch descriptor the kernel removed.
+func (w *Watcher) forget(wd int32) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if cgroup, ok := w.dirs[wd]; ok && w.cgroups[cgroup] == wd {
+		delete(w.cgroups, cgroup)
+	}
+	delete(w.dirs, wd)
+}
+
+// forgetBelow stops watching cgroup and the cgroups below it, so that a cgroup created again
+// with the same path, or moved back, is watched again under its path.
+func (w *Watcher) forgetBelow(cgroup string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for watched, wd := range w.cgroups {
+		if watched == cgroup || strings.HasPrefix(watched, cgroup+"/") {
+			// The kernel has already removed the watches of removed directories.
+			syscall.InotifyRmWatch(w.fd, uint32(wd))
+			delete(w.cgroups, watched)
+			delete(w.dirs, wd)
+		}
+	}
+}
+
+func (w *Watcher) Close() error {
+	return w.file.Close()
+}
@@ -0,0 +1,90 @@
+package classify
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// readChanges reads from w until n changes are returned.
+func readChanges(t *testing.T, w *Watcher, n int) []Change {
+	changes := []Change{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for len(changes) < n {
+			read, err := w.Read()
+			if err != nil {
+				return
+			}
+			changes = append(changes, read...)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("got %v, want %d changes", changes, n)
+	}
+	return changes
+}
+
+func TestWatcherLifecycle(t *testing.T) {
+	root := t.TempDir()
+	assert.Nil(t, os.MkdirAll(filepath.Join(root, "machine.slice", "sandbox.scope"), 0755))
+	assert.Nil(t, os.MkdirAll(filepath.Join(root, "system.slice"), 0755))
+
+	w, err := NewWatcher(root)
+	assert.Nil(t, err)
+	defer w.Close()
+	assert.Nil(t, w.Add("/machine.slice/sandbox.scope"))
+	assert.Nil(t, w.Add("/machine.slice/sandbox.scope"))
+
+	// A transient child scope, and one below it.
+	assert.Nil(t, os.Mkdir(filepath.Join(root, "machine.slice", "sandbox.scope", "run-u42.scope"), 0755))
+	assert.Equal(t, []Change{{Cgroup: "/machine.slice/sandbox.scope/run-u42.scope"}}, readChanges(t, w, 1))
+	assert.Nil(t, os.Mkdir(filepath.Join(root, "machine.slice", "sandbox.scope", "run-u42.scope", "payload"), 0755))
+	assert.Equal(t, []Change{{Cgroup: "/machine.slice/sandbox.scope/run-u42.scope/payload"}}, readChanges(t, w, 1))
+
+	// Files, and cgroups outside of the watched ones, are not reported.
+	assert.Nil(t, os.WriteFile(filepath.Join(root, "machine.slice", "sandbox.scope", "cgroup.procs"), nil, 0644))
+	assert.Nil(t, os.Mkdir(filepath.Join(root, "system.slice", "cron.service"), 0755))
+
+	assert.Nil(t, os.Remove(filepath.Join(root, "machine.slice", "sandbox.scope", "run-u42.scope", "payload")))
+	assert.Nil(t, os.Remove(filepath.Join(root, "machine.slice", "sandbox.scope", "run-u42.scope")))
+	assert.Equal(t, []Change{
+		{Cgroup: "/machine.slice/sandbox.scope/run-u42.scope/payload", Removed: true},
+		{Cgroup: "/machine.slice/sandbox.scope/run-u42.scope", Removed: true},
+	}, readChanges(t, w, 2))
+
+	// A cgroup created again under the same path is watched again.
+	assert.Nil(t, os.Mkdir(filepath.Join(root, "machine.slice", "sandbox.scope", "run-u42.scope"), 0755))
+	assert.Nil(t, os.Mkdir(filepath.Join(root, "machine.slice", "sandbox.scope", "run-u42.scope", "payload"), 0755))
+	changes := readChanges(t, w, 2)
+	assert.Equal(t, Change{Cgroup: "/machine.slice/sandbox.scope/run-u42.scope"}, changes[0])
+	assert.Equal(t, Change{Cgroup: "/machine.slice/sandbox.scope/run-u42.scope/payload"}, changes[1])
+}
+
+func TestWatcherClose(t *testing.T) {
+	w, err := NewWatcher(t.TempDir())
+	assert.Nil(t, err)
+	assert.Nil(t, w.Add("/"))
+
+	errs := make(chan error)
+	go func() {
+		_, err := w.Read()
+		errs <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	assert.Nil(t, w.Close())
+
+	select {
+	case err := <-errs:
+		assert.ErrorIs(t, err, ErrWatcherClosed)
+	case <-time.After(time.Second):
+		t.Fatal("Read was not interrupted by Close")
+	}
+}
@@ -0,0 +1,27 @@
+// Package clock is the time the timers of the network Manager run on: the DNS refreshes, the
+// expiry of the preloaded addresses and the other periodic jobs. The Manager uses Real unless
+// another Clock is given with network.WithClock, e.g. bouhekitest.Clock in tests.
+package clock
+
+import "time"
+
+type Clock interface {
+	Now() time.Time
+	// Sleep blocks until d has passed on the clock.
+	Sleep(d time.Duration)
+}
+
+type realClock struct{}
+
+// Real returns the clock of the system.
+func Real() Clock {
+	return realClock{}
+}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
@@ -0,0 +1,128 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// HostBitsEntry is a CIDR entry whose address has bits set past its prefix length, e.g.
+// 10.1.2.3/8. It is enforced as Effective, 10.0.0.0/8, which is likely broader than intended.
+type HostBitsEntry struct {
+	List      string
+	Entry     string
+	Effective string
+}
+
+func (e HostBitsEntry) String() string {
+	return fmt.Sprintf("%s: %q has host bits set, it is enforced as %s", e.List, e.Entry, e.Effective)
+}
+
+// AllowAllEntry is an entry of every address of a family, 0.0.0.0/0 or ::/0, in an allow list that
+// is empty by default, where it opens what the list restricts.
+type AllowAllEntry struct {
+	List  string
+	Entry string
+}
+
+func (e AllowAllEntry) String() string {
+	return fmt.Sprintf("%s: %q allows every address of the family", e.List, e.Entry)
+}
+
+// cidrLists are the CIDR lists of the network restriction, those of network.policies,
+// network.host and network.container included.
+func (c RestrictedNetworkConfig) cidrLists() []familyList {
+	lists := c.familyLists()
+	for _, entry := range c.PolicyEntries() {
+		lists = append(lists,
+			familyList{entry.Key() + ".cidr.allow", entry.CIDR.Allow, false},
+			familyList{entry.Key() + ".cidr.deny", entry.CIDR.Deny, true})
+	}
+	return lists
+}
+
+// HostBitsEntries returns the CIDR entries with host bits set, in the order of the lists.
+func (c *Config) HostBitsEntries() []HostBitsEntry {
+	entries := []HostBitsEntry{}
+	for _, list := range c.RestrictedNetworkConfig.cidrLists() {
+		for _, entry := range list.entries {
+			ip, n, err := net.ParseCIDR(stripZone(entry))
+			if err != nil || ip.Equal(n.IP) {
+				continue
+			}
+			entries = append(entries, HostBitsEntry{List: list.name, Entry: entry, Effective: Unmap(n).String()})
+		}
+	}
+	return entries
+}
+
+// CheckHostBits returns an error describing the entries with host bits set if strict is set.
+// The entries are returned either way so the caller can report them.
+func (c *Config) CheckHostBits(strict bool) ([]HostBitsEntry, error) {
+	entries := c.HostBitsEntries()
+	if len(entries) == 0 || !strict {
+		return entries, nil
+	}
+
+	messages := []string{}
+	for _, entry := range entries {
+		messages = append(messages, entry.String())
+	}
+	return entries, fmt.Errorf("%d CIDR entries with host bits set (write the network address, or drop --strict-cidrs to only warn): %s", len(entries), strings.Join(messages, "; "))
+}
+
+// AllowAllEntries returns the entries of every address of a family in the allow lists other than
+// network.cidr.allow, whose default is every address.
+func (c *Config) AllowAllEntries() []AllowAllEntry {
+	entries := []AllowAllEntry{}
+	for _, list := range c.RestrictedNetworkConfig.cidrLists() {
+		if list.deny || list.name == "network.cidr.allow" {
+			continue
+		}
+		for _, entry := range list.entries {
+			if normalized, ok := normalizeCIDR(entry); ok && isWholeFamily(normalized) {
+				entries = append(entries, AllowAllEntry{List: list.name, Entry: entry})
+			}
+		}
+	}
+	return entries
+}
+
+// CheckAllowAll returns an error describing the entries of every address of the allow lists
+// unless allowAll is set. The entries are returned either way so the caller can report them.
+func (c *Config) CheckAllowAll(allowAll bool) ([]AllowAllEntry, error) {
+	entries := c.AllowAllEntries()
+	if len(entries) == 0 || allowAll {
+		return entries, nil
+	}
+
+	messages := []string{}
+	for _, entry := range entries {
+		messages = append(messages, entry.String())
+	}
+	return entries, fmt.Errorf("%d allow list entries of every address (use --allow-all-destinations to confirm them): %s", len(entries), strings.Join(messages, "; "))
+}
+
+// Unmap returns n as an IPv4 prefix if it is an IPv4-mapped IPv6 prefix, e.g. ::ffff:10.0.0.0/104 as
+// 10.0.0.0/8: a dual-stack socket connecting to a mapped address makes an IPv4 connection.
+func Unmap(n *net.IPNet) *net.IPNet {
+	ones, bits := n.Mask.Size()
+	v4 := n.IP.To4()
+	if bits != 8*net.IPv6len || v4 == nil || ones < 8*(net.IPv6len-net.IPv4len) {
+		return n
+	}
+	return &net.IPNet{IP: v4, Mask: net.CIDRMask(ones-8*(net.IPv6len-net.IPv4len), 8*net.IPv4len)}
+}
+
+// stripZone drops the IPv6 zone of a CIDR entry, e.g. fe80::1%eth0/64 -> fe80::1/64.
+func stripZone(entry string) string {
+	i := strings.Index(entry, "%")
+	if i < 0 {
+		return entry
+	}
+	rest := ""
+	if j := strings.Index(entry[i:], "/"); j >= 0 {
+		rest = entry[i+j:]
+	}
+	return entry[:i] + rest
+}
@@ -0,0 +1,61 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHostBitsEntries(t *testing.T) {
+	config := DefaultConfig()
+	config.RestrictedNetworkConfig.CIDR.Allow = []string{"10.1.2.3/8", "10.0.0.0/8", "2001:db8::1/32", "fe80::1%eth0/64", "192.0.2.1/32"}
+	config.RestrictedNetworkConfig.CIDR.Deny = []string{"192.168.1.1/24"}
+	config.RestrictedNetworkConfig.Policies = []PolicyEntryConfig{{Name: "curl", CIDR: PolicyListsConfig{Deny: []string{"172.16.0.1/12"}}}}
+
+	entries := config.HostBitsEntries()
+	assert.Equal(t, []HostBitsEntry{
+		{List: "network.cidr.allow", Entry: "10.1.2.3/8", Effective: "10.0.0.0/8"},
+		{List: "network.cidr.allow", Entry: "2001:db8::1/32", Effective: "2001:db8::/32"},
+		{List: "network.cidr.allow", Entry: "fe80::1%eth0/64", Effective: "fe80::/64"},
+		{List: "network.cidr.deny", Entry: "192.168.1.1/24", Effective: "192.168.1.0/24"},
+		{List: "network.policies[curl].cidr.deny", Entry: "172.16.0.1/12", Effective: "172.16.0.0/12"},
+	}, entries)
+	assert.Equal(t, `network.cidr.allow: "10.1.2.3/8" has host bits set, it is enforced as 10.0.0.0/8`, entries[0].String())
+
+	found, err := config.CheckHostBits(false)
+	assert.Nil(t, err)
+	assert.Len(t, found, 5)
+
+	_, err = config.CheckHostBits(true)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "5 CIDR entries with host bits set (write the network address, or drop --strict-cidrs to only warn): ")
+
+	_, err = DefaultConfig().CheckHostBits(true)
+	assert.Nil(t, err)
+}
+
+func TestAllowAllEntries(t *testing.T) {
+	config := DefaultConfig()
+	// The default network.cidr.allow is every address.
+	assert.Equal(t, []AllowAllEntry{}, config.AllowAllEntries())
+
+	config.RestrictedNetworkConfig.CIDR.Deny = []string{"0.0.0.0/0"}
+	config.RestrictedNetworkConfig.CIDR.Protocols = []ProtocolRulesConfig{{Protocol: PROTOCOL_UDP, Allow: []string{"0.0.0.0/0"}}}
+	config.RestrictedNetworkConfig.Ingress.CIDR.Allow = []string{"10.0.0.0/8", "::/0"}
+	config.RestrictedNetworkConfig.Policies = []PolicyEntryConfig{{Name: "curl", CIDR: PolicyListsConfig{Allow: []string{"1.2.3.4/0"}}}}
+
+	entries := config.AllowAllEntries()
+	assert.Equal(t, []AllowAllEntry{
+		{List: "network.ingress.cidr.allow", Entry: "::/0"},
+		{List: "network.cidr.protocols[udp].allow", Entry: "0.0.0.0/0"},
+		{List: "network.policies[curl].cidr.allow", Entry: "1.2.3.4/0"},
+	}, entries)
+	assert.Equal(t, `network.ingress.cidr.allow: "::/0" allows every address of the family`, entries[0].String())
+
+	_, err := config.CheckAllowAll(false)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "3 allow list entries of every address (use --allow-all-destinations to confirm them): ")
+	found, err := config.CheckAllowAll(true)
+	assert.Nil(t, err)
+	assert.Len(t, found, 3)
+}
@@ -0,0 +1,226 @@
+package config
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+const (
+	// EXE_PATH_LEN is the size of a path of network.command.allow_paths and deny_paths in the
+	// maps, NUL included.
+	EXE_PATH_LEN = 256
+	// COMMAND_PATTERN_MAX is the number of patterns network.command.allow and deny can each
+	// have, which the programs scan for every connection whose comm no command matches.
+	COMMAND_PATTERN_MAX = 32
+)
+
+// CommandPattern is a command of the network lists with a *, e.g. python* or *-agent. It matches
+// the comms that begin with Prefix and end with Suffix, which the programs compare byte by byte:
+// a pattern with more than one * is not supported.
+type CommandPattern struct {
+	Prefix string
+	Suffix string
+}
+
+// IsCommandPattern reports whether the command of a network list is a CommandPattern.
+func IsCommandPattern(command string) bool {
+	return strings.Contains(command, "*")
+}
+
+// ParseCommandPattern parses command, a pattern of the network lists.
+func ParseCommandPattern(command string) (CommandPattern, error) {
+	i := strings.Index(command, "*")
+	if i < 0 {
+		return CommandPattern{}, fmt.Errorf("%q is not a pattern", command)
+	}
+	pattern := CommandPattern{Prefix: command[:i], Suffix: command[i+1:]}
+	if strings.Contains(pattern.Suffix, "*") {
+		return CommandPattern{}, fmt.Errorf("%q has more than one *: a pattern only matches the beginning and the end of the comm, e.g. python* or *-agent", command)
+	}
+	if pattern.Suffix != "" && len(pattern.Prefix)+len(pattern.Suffix) > TASK_COMM_LEN-1 {
+		return CommandPattern{}, fmt.Errorf("%q never matches: the comm of a task is at most %d bytes", command, TASK_COMM_LEN-1)
+	}
+	return pattern, nil
+}
+
+func (p CommandPattern) String() string {
+	return p.Prefix + "*" + p.Suffix
+}
+
+// Command returns the command the pattern is the same as, when its prefix fills the comm, e.g.
+// kubernetes-cont for kubernetes-control*: such a pattern is written to the command lists.
+func (p CommandPattern) Command() (string, bool) {
+	if p.Suffix != "" || len(p.Prefix) < TASK_COMM_LEN-1 {
+		return "", false
+	}
+	return p.Prefix[:TASK_COMM_LEN-1], true
+}
+
+// Match reports whether the pattern matches comm, the comm of a task.
+func (p CommandPattern) Match(comm string) bool {
+	if command, ok := p.Command(); ok {
+		return comm == command
+	}
+	return len(comm) >= len(p.Prefix)+len(p.Suffix) && strings.HasPrefix(comm, p.Prefix) && strings.HasSuffix(comm, p.Suffix)
+}
+
+// SplitCommands returns the commands of a network list, with the patterns that are the same as a
+// command, and the other patterns in the order of the list, without duplicates. The patterns
+// that can not be parsed are left out, which Validate rejects.
+func SplitCommands(entries []string) ([]string, []CommandPattern) {
+	commands, patterns := []string{}, []CommandPattern{}
+	seen := map[CommandPattern]bool{}
+	for _, entry := range entries {
+		if !IsCommandPattern(entry) {
+			commands = append(commands, entry)
+			continue
+		}
+		pattern, err := ParseCommandPattern(entry)
+		if err != nil {
+			continue
+		}
+		if command, ok := pattern.Command(); ok {
+			commands = append(commands, command)
+			continue
+		}
+		if !seen[pattern] {
+			seen[pattern] = true
+			patterns = append(patterns, pattern)
+		}
+	}
+	return commands, patterns
+}
+
+// validateCommandPatterns rejects the patterns of a network list that the programs can not
+// match, and more than COMMAND_PATTERN_MAX of them.
+func validateCommandPatterns(list string, commands []string) error {
+	for _, command := range commands {
+		if !IsCommandPattern(command) {
+			continue
+		}
+		if _, err := ParseCommandPattern(command); err != nil {
+			return fmt.Errorf("%s: %w", list, err)
+		}
+	}
+	if _, patterns := SplitCommands(commands); len(patterns) > COMMAND_PATTERN_MAX {
+		return fmt.Errorf("%s has %d patterns, at most %d are supported", list, len(patterns), COMMAND_PATTERN_MAX)
+	}
+	return nil
+}
+
+// TruncatedCommand is a command of the network lists longer than the comm of a task, which is
+// matched by its first TASK_COMM_LEN-1 bytes only.
+type TruncatedCommand struct {
+	List    string
+	Command string
+	// Comm is what the command is matched as.
+	Comm string
+	// Collisions are the other commands of the lists that are matched as Comm too.
+	Collisions []string
+}
+
+func (t TruncatedCommand) String() string {
+	message := fmt.Sprintf("%s: %q is longer than the %d bytes of the comm, it matches any command beginning with %q", t.List, t.Command, TASK_COMM_LEN-1, t.Comm)
+	if len(t.Collisions) > 0 {
+		message += fmt.Sprintf(", as %s", strings.Join(quoteAll(t.Collisions), ", "))
+	}
+	return message
+}
+
+func (c RestrictedNetworkConfig) commandLists() []struct {
+	name     string
+	commands []string
+} {
+	return []struct {
+		name     string
+		commands []string
+	}{
+		{"network.command.allow", c.Command.Allow},
+		{"network.command.deny", c.Command.Deny},
+	}
+}
+
+// TruncatedCommands returns the commands of the network lists that do not fit in the comm.
+func (c *Config) TruncatedCommands() []TruncatedCommand {
+	byComm := map[string][]string{}
+	for _, list := range c.RestrictedNetworkConfig.commandLists() {
+		for _, command := range list.commands {
+			if IsCommandPattern(command) {
+				continue
+			}
+			comm, _ := normalizeCommand(command)
+			byComm[comm] = appendUnique(byComm[comm], command)
+		}
+	}
+
+	truncated := []TruncatedCommand{}
+	for _, list := range c.RestrictedNetworkConfig.commandLists() {
+		for _, command := range list.commands {
+			// A pattern whose prefix fills the comm is meant to match the commands beginning with it.
+			comm, _ := normalizeCommand(command)
+			if comm == command || IsCommandPattern(command) {
+				continue
+			}
+			collisions := []string{}
+			for _, other := range byComm[comm] {
+				if other != command {
+					collisions = append(collisions, other)
+				}
+			}
+			sort.Strings(collisions)
+			truncated = append(truncated, TruncatedCommand{List: list.name, Command: command, Comm: comm, Collisions: collisions})
+		}
+	}
+	return truncated
+}
+
+// validateTruncatedCommands rejects the commands that do not fit in the comm with
+// network.command.strict.
+func (c *Config) validateTruncatedCommands() error {
+	if !c.RestrictedNetworkConfig.Command.Strict {
+		return nil
+	}
+	if truncated := c.TruncatedCommands(); len(truncated) > 0 {
+		return fmt.Errorf("network.command.strict: %s", truncated[0])
+	}
+	return nil
+}
+
+// validatePaths rejects the paths that are not absolute and clean, since the kernel resolves the
+// executable of a task to such a path, and the ones that do not fit in EXE_PATH_LEN.
+func validatePaths(list string, paths []string) error {
+	for _, p := range paths {
+		if !strings.HasPrefix(p, "/") {
+			return fmt.Errorf("%s: %q must be an absolute path", list, p)
+		}
+		if strings.ContainsRune(p, 0) {
+			return fmt.Errorf("%s: %q must not contain a NUL byte", list, p)
+		}
+		if trimmed := strings.TrimSuffix(p, "/"); trimmed != "" && path.Clean(trimmed) != trimmed {
+			return fmt.Errorf("%s: %q must be a clean path, e.g. %s", list, p, path.Clean(p))
+		}
+		if len(p) > EXE_PATH_LEN-1 {
+			return fmt.Errorf("%s: %q is longer than %d bytes", list, p, EXE_PATH_LEN-1)
+		}
+	}
+	return nil
+}
+
+func appendUnique(list []string, entry string) []string {
+	for _, e := range list {
+		if e == entry {
+			return list
+		}
+	}
+	return append(list, entry)
+}
+
+func quoteAll(entries []string) []string {
+	quoted := []string{}
+	for _, entry := range entries {
+		quoted = append(quoted, fmt.Sprintf("%q", entry))
+	}
+	return quoted
+}
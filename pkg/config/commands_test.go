@@ -0,0 +1,107 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTruncatedCommands(t *testing.T) {
+	conf := DefaultConfig()
+	conf.RestrictedNetworkConfig.Command.Allow = []string{"curl", "kubernetes-control-plane-agent", "kubernetes-control-proxy", "exactly15bytes!"}
+	conf.RestrictedNetworkConfig.Command.Deny = []string{"java-language-server"}
+
+	commands := conf.TruncatedCommands()
+	assert.Equal(t, []TruncatedCommand{
+		{List: "network.command.allow", Command: "kubernetes-control-plane-agent", Comm: "kubernetes-cont", Collisions: []string{"kubernetes-control-proxy"}},
+		{List: "network.command.allow", Command: "kubernetes-control-proxy", Comm: "kubernetes-cont", Collisions: []string{"kubernetes-control-plane-agent"}},
+		{List: "network.command.deny", Command: "java-language-server", Comm: "java-language-s", Collisions: []string{}},
+	}, commands)
+	assert.Equal(t, `network.command.allow: "kubernetes-control-plane-agent" is longer than the 15 bytes of the comm, it matches any command beginning with "kubernetes-cont", as "kubernetes-control-proxy"`, commands[0].String())
+	assert.Equal(t, `network.command.deny: "java-language-server" is longer than the 15 bytes of the comm, it matches any command beginning with "java-language-s"`, commands[2].String())
+	assert.Nil(t, conf.Validate())
+
+	conf.RestrictedNetworkConfig.Command.Strict = true
+	assert.EqualError(t, conf.Validate(), `network.command.strict: `+commands[0].String())
+
+	conf.RestrictedNetworkConfig.Command.Allow = []string{"curl", "exactly15bytes!"}
+	conf.RestrictedNetworkConfig.Command.Deny = nil
+	assert.Equal(t, []TruncatedCommand{}, conf.TruncatedCommands())
+	assert.Nil(t, conf.Validate())
+}
+
+func TestValidatePaths(t *testing.T) {
+	conf := DefaultConfig()
+	conf.RestrictedNetworkConfig.Command.AllowPaths = []string{"/usr/bin/curl", "/usr/local/bin/", "/"}
+	assert.Nil(t, conf.Validate())
+
+	for _, tc := range []struct {
+		path string
+		err  string
+	}{
+		{"curl", `network.command.deny_paths: "curl" must be an absolute path`},
+		{"/usr/bin/../bin/curl", `network.command.deny_paths: "/usr/bin/../bin/curl" must be a clean path, e.g. /usr/bin/curl`},
+		{"/usr//bin/", `network.command.deny_paths: "/usr//bin/" must be a clean path, e.g. /usr/bin`},
+		{"/usr/bin/curl\x00", `network.command.deny_paths: "/usr/bin/curl\x00" must not contain a NUL byte`},
+		{"/" + strings.Repeat("a", EXE_PATH_LEN), `network.command.deny_paths: "/` + strings.Repeat("a", EXE_PATH_LEN) + `" is longer than 255 bytes`},
+	} {
+		conf.RestrictedNetworkConfig.Command.DenyPaths = []string{tc.path}
+		assert.EqualError(t, conf.Validate(), tc.err, tc.path)
+	}
+}
+
+func TestParseCommandPattern(t *testing.T) {
+	pattern, err := ParseCommandPattern("python*")
+	assert.Nil(t, err)
+	assert.Equal(t, CommandPattern{Prefix: "python"}, pattern)
+	assert.True(t, pattern.Match("python3.11"))
+	assert.True(t, pattern.Match("python"))
+	assert.False(t, pattern.Match("ipython"))
+
+	pattern, err = ParseCommandPattern("*-agent")
+	assert.Nil(t, err)
+	assert.True(t, pattern.Match("node-agent"))
+	assert.False(t, pattern.Match("agent"))
+
+	// The prefix and the suffix do not overlap.
+	pattern, err = ParseCommandPattern("ab*ba")
+	assert.Nil(t, err)
+	assert.False(t, pattern.Match("aba"))
+	assert.True(t, pattern.Match("abba"))
+
+	// A prefix that fills the comm is the command it begins with.
+	pattern, err = ParseCommandPattern("kubernetes-control*")
+	assert.Nil(t, err)
+	command, ok := pattern.Command()
+	assert.True(t, ok)
+	assert.Equal(t, "kubernetes-cont", command)
+	assert.True(t, pattern.Match("kubernetes-cont"))
+
+	_, err = ParseCommandPattern("*foo*bar*")
+	assert.EqualError(t, err, `"*foo*bar*" has more than one *: a pattern only matches the beginning and the end of the comm, e.g. python* or *-agent`)
+	_, err = ParseCommandPattern("kubernetes*-agent")
+	assert.EqualError(t, err, `"kubernetes*-agent" never matches: the comm of a task is at most 15 bytes`)
+}
+
+func TestSplitCommands(t *testing.T) {
+	commands, patterns := SplitCommands([]string{"curl", "python*", "*-agent", "python*", "kubernetes-control*", "a*b*"})
+	assert.Equal(t, []string{"curl", "kubernetes-cont"}, commands)
+	assert.Equal(t, []CommandPattern{{Prefix: "python"}, {Suffix: "-agent"}}, patterns)
+}
+
+func TestValidateCommandPatterns(t *testing.T) {
+	conf := DefaultConfig()
+	conf.RestrictedNetworkConfig.Command.Allow = []string{"curl", "python*", "*-agent"}
+	assert.Nil(t, conf.Validate())
+
+	conf.RestrictedNetworkConfig.Command.Deny = []string{"*foo*bar*"}
+	assert.EqualError(t, conf.Validate(), `network.command.deny: "*foo*bar*" has more than one *: a pattern only matches the beginning and the end of the comm, e.g. python* or *-agent`)
+
+	conf.RestrictedNetworkConfig.Command.Deny = []string{}
+	for i := 0; i <= COMMAND_PATTERN_MAX; i++ {
+		conf.RestrictedNetworkConfig.Command.Deny = append(conf.RestrictedNetworkConfig.Command.Deny, fmt.Sprintf("tool%d*", i))
+	}
+	assert.EqualError(t, conf.Validate(), "network.command.deny has 33 patterns, at most 32 are supported")
+}
@@ -1,21 +1,68 @@
 package config
 
 import (
+	"encoding/base64"
 	"errors"
-	"os"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
 
-	"gopkg.in/yaml.v2"
+	"github.com/mrtc0/bouheki/pkg/errkind"
+	"github.com/mrtc0/bouheki/pkg/spool/spoolconf"
 )
 
 type RestrictedNetworkConfig struct {
-	Enable  bool
-	Mode    string        `yaml:"mode"`
-	Target  string        `yaml:"target"`
-	Command CommandConfig `yaml:"command"`
-	CIDR    CIDRConfig    `yaml:"cidr"`
-	Domain  DomainConfig  `yaml:"domain"`
-	UID     UIDConfig     `yaml:"uid"`
-	GID     GIDConfig     `yaml:"gid"`
+	Enable       bool
+	Mode         string             `yaml:"mode"`
+	Target       string             `yaml:"target"`
+	Command      CommandConfig      `yaml:"command"`
+	CIDR         CIDRConfig         `yaml:"cidr"`
+	Domain       DomainConfig       `yaml:"domain"`
+	UID          UIDConfig          `yaml:"uid"`
+	GID          GIDConfig          `yaml:"gid"`
+	Ports        PortsConfig        `yaml:"ports"`
+	Ingress      IngressConfig      `yaml:"ingress"`
+	Verification VerificationConfig `yaml:"verification"`
+	Enforcement  EnforcementConfig  `yaml:"enforcement"`
+	// DestinationTags labels events whose destination is a well-known endpoint.
+	DestinationTags DestinationTagsConfig `yaml:"destination_tags"`
+	Coverage        CoverageConfig        `yaml:"coverage"`
+	RuleSets        RuleSetsConfig        `yaml:"rule_sets"`
+	// Classification decides which processes are in a container, for target: container and all.
+	Classification ClassificationConfig `yaml:"classification"`
+	Shutdown       ShutdownConfig       `yaml:"shutdown"`
+	// DenialRecords lets users look up their own blocked connections with `bouheki why`.
+	DenialRecords DenialRecordsConfig `yaml:"denial_records"`
+	SelfExemption SelfExemptionConfig `yaml:"self_exemption"`
+	// PolicySnapshot logs how the policy changed since the last run.
+	PolicySnapshot PolicySnapshotConfig `yaml:"policy_snapshot"`
+	Audit          AuditConfig          `yaml:"audit"`
+	// OutcomeHistory counts the connections of every comm and destination, and proposes the
+	// frequent ones as allow-rule candidates.
+	OutcomeHistory OutcomeHistoryConfig `yaml:"outcome_history"`
+	// RuleHits records when every rule last decided a connection, to find the rules that no longer do.
+	RuleHits RuleHitsConfig `yaml:"rule_hits"`
+	// Learning records the connections of mode: learning, for `bouheki policy generate`.
+	Learning LearningConfig `yaml:"learning"`
+	// Families are the address families that are restricted, FAMILY_IPV4 and FAMILY_IPV6. The
+	// connections of the others are OTHER_FAMILIES_IGNORE'd or OTHER_FAMILIES_AUDIT'ed.
+	Families      []string `yaml:"families"`
+	OtherFamilies string   `yaml:"other_families"`
+	// Policies are the destinations of the tasks they select, in order, see PolicyEntryConfig.
+	Policies []PolicyEntryConfig `yaml:"policies"`
+	// Host and Container are the destinations of the tasks outside and inside the classified
+	// containers, with target: all, see TargetPolicyConfig.
+	Host      TargetPolicyConfig `yaml:"host"`
+	Container TargetPolicyConfig `yaml:"container"`
+	// Decision is the default decision of the destinations and the precedence of their lists.
+	Decision DecisionConfig `yaml:"policy"`
 }
 
 type RestrictedFileAccessConfig struct {
@@ -34,9 +81,159 @@ type RestrictedMountConfig struct {
 }
 
 type DomainConfig struct {
-	Allow    []string `yaml:"allow"`
-	Deny     []string `yaml:"deny"`
-	Interval uint     `yaml:"interval"` // deprecated
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+	// Monitor are the entries of Deny in mode: monitor, see the Monitor of CommandConfig.
+	Monitor []string `yaml:"monitor"`
+	// Protocols are the domains whose addresses are only allowed or denied to one protocol.
+	Protocols []ProtocolRulesConfig `yaml:"protocols"`
+	Interval  uint                  `yaml:"interval"` // deprecated
+	// PreloadFile is a signed snapshot exported by `bouheki domains export`.
+	PreloadFile      string        `yaml:"preload_file"`
+	PreloadPublicKey string        `yaml:"preload_public_key"`
+	PreloadMaxAge    time.Duration `yaml:"preload_max_age"`
+	// Refresh spreads the resolutions that keep the addresses of the domains up to date.
+	Refresh DomainRefreshConfig `yaml:"refresh"`
+	// Heal resolves an allowed domain again when a connection is blocked to an address near its addresses.
+	Heal DomainHealConfig `yaml:"heal"`
+	// Strict fails the startup when a domain does not resolve, instead of retrying it from the refreshes.
+	Strict bool `yaml:"strict"`
+	// Resolver are the DNS servers that resolve the domains, instead of the ones of /etc/resolv.conf.
+	Resolver DomainResolverConfig `yaml:"resolver"`
+	// WildcardMinTTL is the least time the addresses of a wildcard domain are kept in the maps,
+	// for the answers whose TTL is shorter.
+	WildcardMinTTL time.Duration `yaml:"wildcard_min_ttl"`
+}
+
+// IsWildcardDomain reports whether domain is a wildcard domain such as *.example.com, which
+// matches the names below example.com, at any depth, but not example.com itself.
+func IsWildcardDomain(domain string) bool {
+	return strings.HasPrefix(domain, "*.")
+}
+
+// MatchWildcardDomain reports whether name is below the wildcard domain pattern.
+func MatchWildcardDomain(pattern, name string) bool {
+	if !IsWildcardDomain(pattern) {
+		return false
+	}
+	suffix := strings.TrimSuffix(strings.ToLower(pattern[1:]), ".")
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	return len(name) > len(suffix) && strings.HasSuffix(name, suffix)
+}
+
+// wildcardDomains returns the wildcard domains of the lists of d.
+func (d DomainConfig) wildcardDomains() []string {
+	wildcards := []string{}
+	lists := [][]string{d.Allow, d.Deny}
+	for _, rules := range d.Protocols {
+		lists = append(lists, rules.Allow, rules.Deny)
+	}
+	for _, list := range lists {
+		for _, domain := range list {
+			if IsWildcardDomain(domain) {
+				wildcards = append(wildcards, domain)
+			}
+		}
+	}
+	return wildcards
+}
+
+// DomainHealConfig adds the addresses an allowed domain moved to between two refreshes, as
+// soon as a connection to one of them is blocked.
+type DomainHealConfig struct {
+	Enable bool `yaml:"enable"`
+	// Interval is the least time between two resolutions of a domain by the healing.
+	Interval time.Duration `yaml:"interval"`
+	// ReverseDNS also resolves the domain of a blocked address that is not near the addresses
+	// of an allowed domain by its PTR records.
+	ReverseDNS bool `yaml:"reverse_dns"`
+}
+
+// DomainResolverConfig queries Nameservers for the domains, with a deadline of Timeout for each
+// resolution.
+type DomainResolverConfig struct {
+	// Nameservers are the IP addresses of the servers, with an optional port: 53, or 853 with TLS.
+	// The servers of /etc/resolv.conf are queried when there is none.
+	Nameservers []string      `yaml:"nameservers"`
+	Timeout     time.Duration `yaml:"timeout"`
+	// TLS queries the Nameservers with DNS over TLS.
+	TLS bool `yaml:"tls"`
+	// ServerName is the name the certificates of the Nameservers are verified for, their
+	// address unless it is given.
+	ServerName string `yaml:"server_name"`
+}
+
+// DNS_PORT and DNS_OVER_TLS_PORT are the ports of the nameservers of network.domain.resolver
+// that do not give one.
+const (
+	DNS_PORT          = "53"
+	DNS_OVER_TLS_PORT = "853"
+)
+
+// Addresses returns the nameservers as ip:port.
+func (c DomainResolverConfig) Addresses() []string {
+	port := DNS_PORT
+	if c.TLS {
+		port = DNS_OVER_TLS_PORT
+	}
+	addresses := []string{}
+	for _, nameserver := range c.Nameservers {
+		if _, _, err := net.SplitHostPort(nameserver); err == nil {
+			addresses = append(addresses, nameserver)
+			continue
+		}
+		addresses = append(addresses, net.JoinHostPort(strings.Trim(nameserver, "[]"), port))
+	}
+	return addresses
+}
+
+func (c DomainResolverConfig) validate() error {
+	if c.Timeout <= 0 {
+		return fmt.Errorf("network.domain.resolver.timeout must be positive, got %s", c.Timeout)
+	}
+	for _, address := range c.Addresses() {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil || net.ParseIP(host) == nil {
+			return fmt.Errorf("network.domain.resolver.nameservers: %q must be an IP address with an optional port", address)
+		}
+		if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+			return fmt.Errorf("network.domain.resolver.nameservers: %q has an invalid port", address)
+		}
+	}
+	if c.ServerName != "" && !c.TLS {
+		return errors.New("network.domain.resolver.server_name requires network.domain.resolver.tls")
+	}
+	return nil
+}
+
+// DomainRefreshConfig schedules the resolutions of network.domain after their TTL.
+type DomainRefreshConfig struct {
+	// Jitter is the fraction of the TTL by which a refresh is brought forward at random, so that
+	// the domains with the same TTL, and the hosts deployed together, do not resolve at once.
+	Jitter float64 `yaml:"jitter"`
+	// MaxInFlight is the number of resolutions that run at the same time.
+	MaxInFlight int `yaml:"max_in_flight"`
+	// Tick is how often the due refreshes are started. The addresses they resolve are written
+	// to the maps by one job per tick.
+	Tick time.Duration `yaml:"tick"`
+	// MinInterval and MaxInterval bound the TTL a domain is resolved again after.
+	MinInterval time.Duration `yaml:"min_interval"`
+	MaxInterval time.Duration `yaml:"max_interval"`
+	// RemoveAfter is the number of consecutive resolutions an address must be missing from
+	// before it is removed, so that a round-robin domain that answers with a part of its
+	// addresses does not block the others in turn.
+	RemoveAfter int `yaml:"remove_after"`
+}
+
+// Interval returns ttl bounded by MinInterval and MaxInterval.
+func (c DomainRefreshConfig) Interval(ttl time.Duration) time.Duration {
+	if ttl < c.MinInterval {
+		return c.MinInterval
+	}
+	if c.MaxInterval > 0 && ttl > c.MaxInterval {
+		return c.MaxInterval
+	}
+	return ttl
 }
 
 type DNSProxyConfig struct {
@@ -45,24 +242,937 @@ type DNSProxyConfig struct {
 	BindAddresses []string `yaml:"bind"`
 }
 
+const (
+	PROTOCOL_ALL = "all"
+	PROTOCOL_TCP = "tcp"
+	PROTOCOL_UDP = "udp"
+)
+
 type CIDRConfig struct {
 	Allow []string `yaml:"allow"`
 	Deny  []string `yaml:"deny"`
+	// AllowExcept are the CIDRs carved out of Allow, which are denied whatever the other lists.
+	AllowExcept []string `yaml:"allow_except"`
+	// Monitor are the entries of Deny in mode: monitor, see the Monitor of CommandConfig.
+	Monitor []string `yaml:"monitor"`
+	// Protocols are the CIDRs only allowed or denied to one protocol.
+	Protocols []ProtocolRulesConfig `yaml:"protocols"`
+}
+
+// ProtocolRulesConfig are allow and deny lists of network.cidr or network.domain that only apply
+// to the connections of Protocol: PROTOCOL_TCP for the stream sockets, PROTOCOL_UDP for the
+// datagram sockets. The rules of PROTOCOL_ALL are the same as the lists they are in.
+type ProtocolRulesConfig struct {
+	Protocol string   `yaml:"protocol"`
+	Allow    []string `yaml:"allow"`
+	Deny     []string `yaml:"deny"`
 }
 
+// ProtocolLists returns the entries of the rules of protocol, PROTOCOL_TCP or PROTOCOL_UDP, in order.
+// The rules of PROTOCOL_ALL that normalize has not folded, e.g. of a config that was not read from
+// a file, apply to both.
+func ProtocolLists(rules []ProtocolRulesConfig, protocol string) (allow, deny []string) {
+	allow, deny = []string{}, []string{}
+	for _, rule := range rules {
+		if rule.Protocol == protocol || rule.Protocol == PROTOCOL_ALL {
+			allow = append(allow, rule.Allow...)
+			deny = append(deny, rule.Deny...)
+		}
+	}
+	return allow, deny
+}
+
+// CommandConfig, UIDConfig and GIDConfig restrict the tasks that connect. A list that is absent
+// and a list that is empty are the same: neither restricts.
 type CommandConfig struct {
+	// Allow and Deny are commands, or patterns with a *, e.g. python*, see CommandPattern.
 	Allow []string `yaml:"allow"`
 	Deny  []string `yaml:"deny"`
+	// Monitor are the entries of Deny in mode: monitor: a connection they deny is allowed and
+	// reported as monitor mode does, whatever network.mode.
+	Monitor []string `yaml:"monitor"`
+	// CaseInsensitive lowercases the configured commands and the comm of the task.
+	CaseInsensitive bool            `yaml:"case_insensitive"`
+	HostCheck       HostCheckConfig `yaml:"host_check"`
+	// AllowPaths and DenyPaths match the path of the executable of the task, which unlike the comm
+	// a task can not rename. A path ending with / matches every executable below it.
+	AllowPaths []string `yaml:"allow_paths"`
+	DenyPaths  []string `yaml:"deny_paths"`
+	// Strict rejects the commands longer than the comm of a task, TASK_COMM_LEN-1 bytes, instead
+	// of warning that only their beginning is matched.
+	Strict bool `yaml:"strict"`
 }
 
+// HostCheckConfig cross-checks the commands against the binaries installed on the host, or in the
+// containers with network.target: container. Its findings are warnings, never errors.
+type HostCheckConfig struct {
+	// OnStartup runs the check when bouheki starts.
+	OnStartup bool `yaml:"on_startup"`
+	// ExtraDirs are looked up after the PATH, e.g. the directories of the binaries run by their path.
+	ExtraDirs []string `yaml:"extra_dirs"`
+}
+
+// UIDConfig restricts the uids. An entry is a uid, e.g. 0, or an inclusive range of uids, e.g.
+// "10000-59999", see UIDRange. A user name in place of a uid, and a group name in place of a gid
+// of GIDConfig, is resolved when the config is parsed, see ResolvedNames.
 type UIDConfig struct {
-	Allow []uint `yaml:"allow"`
-	Deny  []uint `yaml:"deny"`
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+}
+
+// GIDConfig restricts the gids. An entry is a gid, e.g. 100.
+type GIDConfig struct {
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+}
+
+// PortsConfig restricts the destination ports. An entry is a port, e.g. "443", or an inclusive
+// range, e.g. "8000-8999". A port in deny is denied whatever the destination and the task.
+type PortsConfig struct {
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+}
+
+// IngressConfig restricts what the sockets bind to, e.g. a listener opened on 0.0.0.0:4444: CIDR
+// the local addresses and Ports the local ports, in the form of network.ports. A bind is permitted
+// when its address and its port are both permitted. The lists are independent of the ones of the
+// connections, and only restrict when they have entries.
+type IngressConfig struct {
+	CIDR  IngressCIDRConfig `yaml:"cidr"`
+	Ports PortsConfig       `yaml:"ports"`
+}
+
+type IngressCIDRConfig struct {
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+}
+
+// HasRules reports whether any list of network.ingress has an entry, without which the bind hook
+// is not attached.
+func (c IngressConfig) HasRules() bool {
+	return len(c.CIDR.Allow)+len(c.CIDR.Deny)+len(c.Ports.Allow)+len(c.Ports.Deny) > 0
+}
+
+// PortRange is an inclusive range of destination ports.
+type PortRange struct {
+	First uint16
+	Last  uint16
+}
+
+func (r PortRange) String() string {
+	if r.First == r.Last {
+		return strconv.Itoa(int(r.First))
+	}
+	return fmt.Sprintf("%d-%d", r.First, r.Last)
+}
+
+// ParsePortRange parses an entry of network.ports. Port 0 is never restricted, so it can not be listed.
+func ParsePortRange(entry string) (PortRange, error) {
+	first, last := entry, entry
+	if i := strings.Index(entry, "-"); i >= 0 {
+		first, last = entry[:i], entry[i+1:]
+	}
+	parse := func(s string) (uint16, error) {
+		port, err := strconv.ParseUint(strings.TrimSpace(s), 10, 16)
+		if err != nil || port == 0 {
+			return 0, fmt.Errorf("%q is not a port or a range of ports between 1 and 65535", entry)
+		}
+		return uint16(port), nil
+	}
+
+	r := PortRange{}
+	var err error
+	if r.First, err = parse(first); err != nil {
+		return PortRange{}, err
+	}
+	if r.Last, err = parse(last); err != nil {
+		return PortRange{}, err
+	}
+	if r.First > r.Last {
+		return PortRange{}, fmt.Errorf("%q: the first port of the range is greater than the last", entry)
+	}
+	return r, nil
+}
+
+// AuditConfig turns the audit events of the network restriction off, for hosts that only want the
+// connections blocked. The programs then emit no event at all, and no ring buffer is polled.
+// RingBufSize is the size of the ring buffer of the events in bytes, AUDIT_DEFAULT_RINGBUF_SIZE
+// unless set.
+type AuditConfig struct {
+	Enabled     bool             `yaml:"enabled"`
+	RingBufSize uint32           `yaml:"ringbuf_size"`
+	Dedup       AuditDedupConfig `yaml:"dedup"`
+}
+
+// AuditDedupConfig suppresses the events identical to one reported less than Window ago, of the
+// same comm, pid, destination and action, and reports them as a single summary once the window
+// closes. Windows of more than MaxKeys events at once are not deduplicated. KernelWindow has the
+// programs report a task's connections to a destination at most once per KernelWindow, 0 for the
+// datagrams only, once per second. The decisions of the connections are never suppressed.
+type AuditDedupConfig struct {
+	Enable       bool          `yaml:"enable"`
+	Window       time.Duration `yaml:"window"`
+	MaxKeys      int           `yaml:"max_keys"`
+	KernelWindow time.Duration `yaml:"kernel_window"`
+}
+
+const (
+	// AUDIT_DEFAULT_RINGBUF_SIZE is the size the ring buffer of the events is compiled with.
+	AUDIT_DEFAULT_RINGBUF_SIZE = 4 * 4096
+	// AUDIT_MIN_RINGBUF_SIZE is a page, the kernel wants a power of two number of pages.
+	AUDIT_MIN_RINGBUF_SIZE = 4096
+)
+
+// VerificationConfig re-evaluates a sample of kernel decisions in userspace
+// and reports any disagreement.
+type VerificationConfig struct {
+	Enable     bool    `yaml:"enable"`
+	SampleRate float64 `yaml:"sample_rate"`
+}
+
+const (
+	HOOK_AUTO   = "auto"
+	HOOK_LSM    = "lsm"
+	HOOK_KPROBE = "kprobe"
+)
+
+// EnforcementConfig selects how connections are hooked. With "auto", the BPF LSM
+// is used and a kprobe is attached instead when the BPF LSM is not available.
+// A kprobe can only audit, unless SendSignal kills the violating task.
+type EnforcementConfig struct {
+	Hook       string `yaml:"hook"`
+	SendSignal bool   `yaml:"send_signal"`
+}
+
+// DEFAULT_DENIAL_RECORDS_DIR is where `bouheki why` looks for the records without a config.
+const DEFAULT_DENIAL_RECORDS_DIR = "/run/bouheki/last-denials"
+
+// MAX_DENIAL_RECORDS bounds network.denial_records.max_records, and so the size of a file.
+const MAX_DENIAL_RECORDS = 100
+
+// DenialRecordsConfig writes the most recent blocked connections of every uid to
+// <dir>/<uid>.json, readable only by that uid. A file is rewritten at most once per
+// WriteInterval, and removed once the uid has had no block for Retention.
+type DenialRecordsConfig struct {
+	Enable        bool          `yaml:"enable"`
+	Dir           string        `yaml:"dir"`
+	MaxRecords    int           `yaml:"max_records"`
+	WriteInterval time.Duration `yaml:"write_interval"`
+	Retention     time.Duration `yaml:"retention"`
+}
+
+const (
+	// DEFAULT_OUTCOME_HISTORY_MAX_ENTRIES is the default network.outcome_history.max_entries,
+	// and MAX_OUTCOME_HISTORY_ENTRIES bounds it.
+	DEFAULT_OUTCOME_HISTORY_MAX_ENTRIES = 10000
+	MAX_OUTCOME_HISTORY_ENTRIES         = 200000
+)
+
+// MODE_LEARNING is the network.mode that blocks nothing, as monitor, and records every connection
+// in the learned connections, see LearningConfig.
+const MODE_LEARNING = "learning"
+
+const (
+	// DEFAULT_LEARNING_MAX_ENTRIES is the default network.learning.max_entries, and
+	// MAX_LEARNING_ENTRIES bounds it.
+	DEFAULT_LEARNING_MAX_ENTRIES = 50000
+	MAX_LEARNING_ENTRIES         = 500000
+)
+
+// LearningConfig aggregates the connections of mode: learning by comm, uid, destination and port,
+// the destination being the domain of the address or its prefix of V4Prefix (V6Prefix for IPv6)
+// bits, and keeps them in <StateDir>/learned-connections.json, rewritten every WriteInterval and
+// on shutdown, and continued by the next run. Once MaxEntries are kept, the least recently seen
+// is forgotten for a new one.
+type LearningConfig struct {
+	StateDir      string        `yaml:"state_dir"`
+	V4Prefix      int           `yaml:"v4_prefix"`
+	V6Prefix      int           `yaml:"v6_prefix"`
+	MaxEntries    int           `yaml:"max_entries"`
+	WriteInterval time.Duration `yaml:"write_interval"`
+}
+
+// OutcomeHistoryConfig aggregates the connections of the audit events by comm and destination,
+// the domain of the address or its /24 (/64 for IPv6), and keeps the counts in
+// <StateDir>/outcome-history.json, rewritten every WriteInterval. Once MaxEntries destinations
+// are kept, the least recently seen is forgotten for a new one.
+type OutcomeHistoryConfig struct {
+	Enable        bool                     `yaml:"enable"`
+	StateDir      string                   `yaml:"state_dir"`
+	MaxEntries    int                      `yaml:"max_entries"`
+	WriteInterval time.Duration            `yaml:"write_interval"`
+	Suggestions   OutcomeSuggestionsConfig `yaml:"suggestions"`
+}
+
+// OutcomeSuggestionsConfig writes the destinations of the history that the allow lists do not
+// permit, seen at least MinConnections times over at least MinObserved, to
+// <StateDir>/allow-suggestions.yaml for review. The policy is never changed.
+type OutcomeSuggestionsConfig struct {
+	Enable         bool          `yaml:"enable"`
+	MinConnections uint64        `yaml:"min_connections"`
+	MinObserved    time.Duration `yaml:"min_observed"`
+}
+
+// RuleHitsConfig has the programs record when the rules of the lists last matched a connection.
+// The times are kept in <StateDir>/rule-hits.json, rewritten every WriteInterval and on
+// shutdown, and merged with the ones of the previous runs, since the maps are recreated empty.
+type RuleHitsConfig struct {
+	Enable        bool          `yaml:"enable"`
+	StateDir      string        `yaml:"state_dir"`
+	WriteInterval time.Duration `yaml:"write_interval"`
+}
+
+// SelfExemptionConfig allows the endpoints bouheki itself connects to, such as its DNS
+// servers, so that the policy it enforces does not cut it off from them. The endpoints
+// given by name are resolved again every RefreshInterval.
+type SelfExemptionConfig struct {
+	Enable          bool          `yaml:"enable"`
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
+}
+
+// DEFAULT_POLICY_SNAPSHOT_DIR is the default network.policy_snapshot.state_dir.
+const (
+	DEFAULT_POLICY_SNAPSHOT_DIR = "/var/lib/bouheki"
+	DEFAULT_POLICY_VERSIONS     = 32
+)
+
+// PolicySnapshotConfig keeps the export of the policy loaded by the last run in
+// <StateDir>/policy.json, and logs the difference with it at startup.
+type PolicySnapshotConfig struct {
+	Enable   bool   `yaml:"enable"`
+	StateDir string `yaml:"state_dir"`
+	// Versions is the number of policies the events were decided by that are kept in
+	// <StateDir>/versions, by digest. 0 keeps none.
+	Versions int `yaml:"versions"`
+}
+
+// ShutdownConfig bounds how long the events the programs emitted before they were
+// detached are read from the ring buffer on shutdown.
+type ShutdownConfig struct {
+	DrainTimeout time.Duration `yaml:"drain_timeout"`
+}
+
+const (
+	CLASSIFY_MOUNT_NAMESPACE = "mount-namespace"
+	CLASSIFY_PID_NAMESPACE   = "pid-namespace"
+	CLASSIFY_CGROUP_PATTERN  = "cgroup-pattern"
+	CLASSIFY_CGROUP_LIST     = "cgroup-list"
+)
+
+const (
+	CGROUP_MATCHING_AUTO      = "auto"
+	CGROUP_MATCHING_ANCESTORS = "ancestors"
+	CGROUP_MATCHING_WATCH     = "watch"
+)
+
+// DEFAULT_CGROUP_PATTERNS match the cgroups created by Docker, containerd and CRI-O
+// (kubepods), Podman, systemd-nspawn and LXC, with the systemd and the cgroupfs drivers.
+var DEFAULT_CGROUP_PATTERNS = []string{
+	`^/system\.slice/(docker|nerdctl)-[0-9a-f]+\.scope(/|$)`,
+	`^/docker/`,
+	`^/kubepods`,
+	`/libpod-[0-9a-f]+\.scope(/|$)`,
+	`^/machine\.slice/`,
+	`^/(lxc|lxc\.payload)[./]`,
+}
+
+// ClassificationConfig selects how a process is classified as running in a container.
+// mount-namespace: not in the initial mount namespace.
+// pid-namespace: in a pid namespace other than the initial one.
+// cgroup-pattern: in a cgroup (v2) whose path matches one of CgroupPatterns.
+// cgroup-list: in one of Cgroups, or below.
+//
+// CgroupMatching selects how the cgroups created below a classified cgroup after the policy
+// is loaded are matched, for the cgroup strategies. With "ancestors", the BPF program walks
+// the ancestors of the current cgroup, which needs bpf_get_current_ancestor_cgroup_id (5.14).
+// With "watch", the cgroups are watched with inotify and the new ones are installed in the map.
+// "auto" uses ancestors and falls back to watch when the kernel does not have the helper.
+type ClassificationConfig struct {
+	Strategy string `yaml:"strategy"`
+	// CgroupPatterns are regular expressions. Empty uses DEFAULT_CGROUP_PATTERNS.
+	CgroupPatterns []string `yaml:"cgroup_patterns"`
+	Cgroups        []string `yaml:"cgroups"`
+	CgroupMatching string   `yaml:"cgroup_matching"`
+}
+
+// MIN_COVERAGE_WINDOW is the shortest coverage window.
+const MIN_COVERAGE_WINDOW = time.Minute
+
+// CoverageConfig measures the fraction of observed connections that the allow lists permit
+// over rolling windows. It is meant for monitor mode, where every connection is observed.
+type CoverageConfig struct {
+	Enable  bool            `yaml:"enable"`
+	Windows []time.Duration `yaml:"windows"`
+}
+
+const (
+	RULE_SET_LIST_ALLOW = "allow"
+	RULE_SET_LIST_DENY  = "deny"
+)
+
+// RuleSetsConfig are bulk CIDR lists generated outside of bouheki, e.g. the prefixes
+// of a GeoIP country or of an ASN. They are applied ChunkSize entries at a time,
+// ChunkDelay apart, so that other updates of the rules are not held up.
+type RuleSetsConfig struct {
+	ChunkSize  int           `yaml:"chunk_size"`
+	ChunkDelay time.Duration `yaml:"chunk_delay"`
+	// StateDir keeps the progress of the refreshes. Empty disables it.
+	StateDir string          `yaml:"state_dir"`
+	Sets     []RuleSetConfig `yaml:"sets"`
+}
+
+// RuleSetConfig is a file with one CIDR per line, added to List.
+type RuleSetConfig struct {
+	Name string `yaml:"name"`
+	List string `yaml:"list"`
+	File string `yaml:"file"`
+	// RefreshInterval is how often File is read again. Zero reads it only at startup.
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
+}
+
+// DestinationTagsConfig maps CIDRs to tags added to the events of matching destinations.
+// An entry replaces the built-in tags of the same CIDR.
+type DestinationTagsConfig struct {
+	DisableDefaults bool             `yaml:"disable_defaults"`
+	Entries         []DestinationTag `yaml:"entries"`
+}
+
+type DestinationTag struct {
+	CIDR string   `yaml:"cidr"`
+	Tags []string `yaml:"tags"`
+}
+
+type MetricsConfig struct {
+	Enable bool   `yaml:"enable"`
+	Listen string `yaml:"listen"`
+}
+
+// ControlConfig is the local control socket used by `bouheki subscribe` and `bouheki ctl`.
+type ControlConfig struct {
+	Enable bool   `yaml:"enable"`
+	Socket string `yaml:"socket"`
+}
+
+// FREEZE_TIME_LAYOUT is the layout of the start and the end of a freeze window.
+const FREEZE_TIME_LAYOUT = "2006-01-02T15:04"
+
+// AdminConfig is the change management of bouheki itself.
+type AdminConfig struct {
+	FreezeWindows []FreezeWindow `yaml:"freeze_windows"`
+	// FreezeOverrideToken lets a change through during a freeze window, for emergencies.
+	FreezeOverrideToken string `yaml:"freeze_override_token"`
+	// FreezeDNSRefresh also stops the refresh of the configured domains during a freeze window.
+	// By default they are refreshed, as that maintains the policy instead of changing it.
+	FreezeDNSRefresh bool `yaml:"freeze_dns_refresh"`
+}
+
+// FreezeWindow is a time range during which policy changes are rejected.
+type FreezeWindow struct {
+	Name  string `yaml:"name"`
+	Start string `yaml:"start"`
+	End   string `yaml:"end"`
+	// Timezone is an IANA time zone name, e.g. America/New_York. Default is UTC.
+	Timezone string `yaml:"timezone"`
+}
+
+// Range returns the start and the end of the window.
+func (w FreezeWindow) Range() (time.Time, time.Time, error) {
+	location := time.UTC
+	if w.Timezone != "" {
+		var err error
+		if location, err = time.LoadLocation(w.Timezone); err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+	}
+
+	start, err := time.ParseInLocation(FREEZE_TIME_LAYOUT, w.Start, location)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	end, err := time.ParseInLocation(FREEZE_TIME_LAYOUT, w.End, location)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	if !end.After(start) {
+		return time.Time{}, time.Time{}, fmt.Errorf("end %s is not after start %s", w.End, w.Start)
+	}
+
+	return start, end, nil
+}
+
+const (
+	RESOURCES_PROFILE_SMALL  = "small"
+	RESOURCES_PROFILE_MEDIUM = "medium"
+	RESOURCES_PROFILE_LARGE  = "large"
+
+	// RESOURCES_MAX_DENY_SHARDS is the number of shards the BPF program has for each family.
+	RESOURCES_MAX_DENY_SHARDS = 8
+)
+
+// ResourcesConfig sizes the maps of the network restriction before they are created.
+// Profile selects the size of every map, and MaxEntries overrides the size of a map by
+// its name, e.g. denied_v4_cidr_list. DenyShards splits the deny rule sets across that many
+// tries of each family, see RESOURCES_MAX_DENY_SHARDS; 0 writes them to denied_v4_cidr_list
+// and denied_v6_cidr_list.
+type ResourcesConfig struct {
+	Profile    string            `yaml:"profile"`
+	MaxEntries map[string]uint32 `yaml:"max_entries"`
+	DenyShards int               `yaml:"deny_shards"`
+}
+
+// BPFConfig is where the network restriction keeps its programs across restarts. With PinPath,
+// the policy maps and the LSM links are pinned in that directory of a bpffs, and adopted by the
+// next bouheki. The links are unpinned when bouheki exits, which detaches the programs, unless
+// KeepAttached is set, so that the connections are restricted while it restarts. UnpinOnExit
+// removes the maps too.
+type BPFConfig struct {
+	PinPath      string `yaml:"pin_path"`
+	KeepAttached bool   `yaml:"keep_attached"`
+	UnpinOnExit  bool   `yaml:"unpin_on_exit"`
+}
+
+// validateKeepAttached checks that KeepAttached has pins to keep, which UnpinOnExit would remove.
+func (c BPFConfig) validateKeepAttached() error {
+	if !c.KeepAttached {
+		return nil
+	}
+	if c.PinPath == "" {
+		return errors.New("bpf.keep_attached needs bpf.pin_path: the programs are detached when bouheki exits unless their links are pinned")
+	}
+	if c.UnpinOnExit {
+		return errors.New("bpf.keep_attached and bpf.unpin_on_exit can not both be set")
+	}
+	return nil
+}
+
+// CheckKeepAttached sets bpf.keep_attached if keepAttached is set, as with --keep-attached, and
+// returns an error if it can not keep the programs attached.
+func (c *Config) CheckKeepAttached(keepAttached bool) error {
+	c.BPF.KeepAttached = c.BPF.KeepAttached || keepAttached
+	return c.BPF.validateKeepAttached()
+}
+
+const (
+	// STARTUP_CONDITION_DNS resolves Target, a probe name, with the servers of /etc/resolv.conf.
+	STARTUP_CONDITION_DNS = "dns"
+	// STARTUP_CONDITION_SOCKET connects to Target, the unix socket of e.g. a container runtime.
+	STARTUP_CONDITION_SOCKET = "socket"
+	// STARTUP_CONDITION_HTTP gets Target, a URL such as the /pods of the kubelet.
+	STARTUP_CONDITION_HTTP = "http"
+
+	STARTUP_POLICY_WAIT     = "wait"
+	STARTUP_POLICY_DEGRADED = "proceed-degraded"
+	STARTUP_POLICY_FAIL     = "fail"
+)
+
+// StartupConfig are the dependencies the network restriction waits for before it writes the maps.
+type StartupConfig struct {
+	Conditions []StartupCondition `yaml:"conditions"`
+}
+
+// StartupCondition is probed every Interval until it is met. Once Timeout has passed, Policy
+// decides: wait keeps waiting, proceed-degraded starts without it and completes what is missing
+// once it is met, and fail exits.
+type StartupCondition struct {
+	Name     string        `yaml:"name"`
+	Type     string        `yaml:"type"`
+	Target   string        `yaml:"target"`
+	Timeout  time.Duration `yaml:"timeout"`
+	Interval time.Duration `yaml:"interval"`
+	Policy   string        `yaml:"policy"`
+}
+
+const (
+	DEFAULT_ALERTS_INTERVAL = 10 * time.Second
+
+	// The audits whose events an alert rule can count.
+	ALERT_AUDIT_NETWORK    = "network"
+	ALERT_AUDIT_FILEACCESS = "fileaccess"
+	ALERT_AUDIT_MOUNT      = "mount"
+)
+
+// AlertsConfig are threshold rules evaluated by bouheki itself every Interval, for deployments
+// without an alerting system of their own.
+type AlertsConfig struct {
+	Interval time.Duration `yaml:"interval"`
+	Rules    []AlertRule   `yaml:"rules"`
+}
+
+// AlertRule fires when more than Threshold happens in Window: the increase of the counter
+// Metric, e.g. verification_mismatch_total, or the number of audit events matching Event.
+// The value of a gauge is compared as is. It resolves once the condition clears, and does
+// not fire again until Cooldown has passed since it last fired.
+type AlertRule struct {
+	Name      string            `yaml:"name"`
+	Metric    string            `yaml:"metric"`
+	Event     *AlertEventFilter `yaml:"event"`
+	Window    time.Duration     `yaml:"window"`
+	Threshold float64           `yaml:"threshold"`
+	Cooldown  time.Duration     `yaml:"cooldown"`
+}
+
+// AlertEventFilter matches the audit events by their fields. An empty field matches every event.
+type AlertEventFilter struct {
+	Audit  string `yaml:"audit"`
+	Action string `yaml:"action"`
+	Comm   string `yaml:"comm"`
+	// LocalAddr matches the network events by the local address of the socket: an address, a
+	// CIDR, or ALERT_LOCAL_ADDR_UNBOUND for the sockets bound to no address and no port.
+	LocalAddr string `yaml:"local_addr"`
+	LocalPort uint16 `yaml:"local_port"`
+	// DestinationTags matches the network events whose destination has one of the tags of
+	// network.destination_tags.
+	DestinationTags []string `yaml:"destination_tags"`
+}
+
+// ALERT_LOCAL_ADDR_UNBOUND is the local_addr of the sockets that were not bound when they
+// connected, and get their address and port from the kernel afterwards.
+const ALERT_LOCAL_ADDR_UNBOUND = "unbound"
+
+// LocalNet returns the network of LocalAddr, nil when it is empty or ALERT_LOCAL_ADDR_UNBOUND.
+// An address is a network of its own.
+func (f AlertEventFilter) LocalNet() (*net.IPNet, error) {
+	if f.LocalAddr == "" || f.LocalAddr == ALERT_LOCAL_ADDR_UNBOUND {
+		return nil, nil
+	}
+	if ip := net.ParseIP(f.LocalAddr); ip != nil {
+		bits := 128
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, n, err := net.ParseCIDR(f.LocalAddr)
+	if err != nil {
+		return nil, fmt.Errorf("local_addr must be an address, a CIDR or %s, got %q", ALERT_LOCAL_ADDR_UNBOUND, f.LocalAddr)
+	}
+	return n, nil
+}
+
+// validate returns the errors of the filter, with the fields named after key, e.g. "event.audit".
+func (f AlertEventFilter) validate(key string) error {
+	switch f.Audit {
+	case "", ALERT_AUDIT_NETWORK, ALERT_AUDIT_FILEACCESS, ALERT_AUDIT_MOUNT:
+	default:
+		return fmt.Errorf("%s.audit must be one of %s, %s or %s, got %q",
+			key, ALERT_AUDIT_NETWORK, ALERT_AUDIT_FILEACCESS, ALERT_AUDIT_MOUNT, f.Audit)
+	}
+	if _, err := f.LocalNet(); err != nil {
+		return fmt.Errorf("%s.%w", key, err)
+	}
+	if f.LocalAddr == ALERT_LOCAL_ADDR_UNBOUND && f.LocalPort != 0 {
+		return fmt.Errorf("%s.local_port can not be set with local_addr %s, the unbound sockets have no port", key, ALERT_LOCAL_ADDR_UNBOUND)
+	}
+	if (f.LocalAddr != "" || f.LocalPort != 0) && f.Audit != "" && f.Audit != ALERT_AUDIT_NETWORK {
+		return fmt.Errorf("%s.local_addr and %s.local_port only match the %s events", key, key, ALERT_AUDIT_NETWORK)
+	}
+	for i, tag := range f.DestinationTags {
+		if tag == "" {
+			return fmt.Errorf("%s.destination_tags[%d] must not be empty", key, i)
+		}
+	}
+	if len(f.DestinationTags) > 0 && f.Audit != "" && f.Audit != ALERT_AUDIT_NETWORK {
+		return fmt.Errorf("%s.destination_tags only match the %s events", key, ALERT_AUDIT_NETWORK)
+	}
+	return nil
+}
+
+const (
+	EVENT_OUTPUT_FIFO     = "fifo"
+	EVENT_OUTPUT_UNIXGRAM = "unixgram"
+)
+
+// EventOutputConfig writes the audit events as newline-delimited JSON to a named pipe or to a
+// unix datagram socket, for consumers on the host. bouheki never waits for the consumer.
+type EventOutputConfig struct {
+	Enable bool   `yaml:"enable"`
+	Type   string `yaml:"type"`
+	Path   string `yaml:"path"`
+	// UID, GID and Mode are the owner and the permissions of the FIFO bouheki creates. The socket
+	// is bound by the consumer.
+	UID  uint32 `yaml:"uid"`
+	GID  uint32 `yaml:"gid"`
+	Mode uint32 `yaml:"mode"`
+	// Filter routes only the events it matches to the output. nil writes every event.
+	Filter *AlertEventFilter `yaml:"filter"`
+}
+
+func (c EventOutputConfig) validate() error {
+	if !c.Enable {
+		return nil
+	}
+
+	switch c.Type {
+	case EVENT_OUTPUT_FIFO, EVENT_OUTPUT_UNIXGRAM:
+	default:
+		return fmt.Errorf("event_output.type must be one of %s or %s, got %q", EVENT_OUTPUT_FIFO, EVENT_OUTPUT_UNIXGRAM, c.Type)
+	}
+	if !filepath.IsAbs(c.Path) {
+		return fmt.Errorf("event_output.path must be an absolute path, got %q", c.Path)
+	}
+	if c.Mode > 0777 {
+		return fmt.Errorf("event_output.mode must be permission bits, got %#o", c.Mode)
+	}
+	if c.Filter != nil {
+		return c.Filter.validate("event_output.filter")
+	}
+	return nil
+}
+
+const (
+	FALCO_OUTPUT_FALCOSIDEKICK = "falcosidekick"
+	FALCO_OUTPUT_FILE          = "file"
+
+	DEFAULT_FALCO_OUTPUT_TIMEOUT    = 5 * time.Second
+	DEFAULT_FALCO_OUTPUT_QUEUE_SIZE = 1024
+)
+
+// FalcoOutputConfig renders the audit events as the alerts of Falco, for the alert routers of an
+// existing Falco deployment: posted to falcosidekick, or appended to a file as the JSON lines of
+// the file output of Falco.
+type FalcoOutputConfig struct {
+	Enable bool   `yaml:"enable"`
+	Type   string `yaml:"type"`
+	// URL is where falcosidekick listens, e.g. http://falcosidekick:2801/.
+	URL     string        `yaml:"url"`
+	Timeout time.Duration `yaml:"timeout"`
+	// QueueSize is the number of alerts waiting to be posted, beyond which they are dropped.
+	QueueSize int `yaml:"queue_size"`
+	// Spool keeps the alerts falcosidekick did not take, which are posted again every RetryInterval.
+	Spool         spoolconf.Config `yaml:"spool"`
+	RetryInterval time.Duration    `yaml:"retry_interval"`
+	// Path is the file of type file.
+	Path string `yaml:"path"`
+	// Tags are added to the tags of every alert.
+	Tags []string `yaml:"tags"`
+	// Filter routes only the events it matches to the output. nil renders every event.
+	Filter *AlertEventFilter `yaml:"filter"`
+}
+
+func (c FalcoOutputConfig) validate() error {
+	if !c.Enable {
+		return nil
+	}
+
+	switch c.Type {
+	case FALCO_OUTPUT_FALCOSIDEKICK:
+		u, err := url.Parse(c.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("falco_output.url must be an http or https URL, got %q", c.URL)
+		}
+		if c.Timeout <= 0 {
+			return fmt.Errorf("falco_output.timeout must be positive, got %s", c.Timeout)
+		}
+		if c.QueueSize <= 0 {
+			return fmt.Errorf("falco_output.queue_size must be positive, got %d", c.QueueSize)
+		}
+		if err := c.Spool.Validate(); err != nil {
+			return fmt.Errorf("falco_output.%w", err)
+		}
+	case FALCO_OUTPUT_FILE:
+		if !filepath.IsAbs(c.Path) {
+			return fmt.Errorf("falco_output.path must be an absolute path, got %q", c.Path)
+		}
+	default:
+		return fmt.Errorf("falco_output.type must be one of %s or %s, got %q", FALCO_OUTPUT_FALCOSIDEKICK, FALCO_OUTPUT_FILE, c.Type)
+	}
+	if c.Filter != nil {
+		return c.Filter.validate("falco_output.filter")
+	}
+	return nil
+}
+
+const (
+	AUDIT_OUTPUT_FORMAT_JSON = "json"
+
+	DEFAULT_AUDIT_OUTPUT_MAX_SIZE = 100
+
+	DEFAULT_AUDIT_WEBHOOK_TIMEOUT            = 5 * time.Second
+	DEFAULT_AUDIT_WEBHOOK_RATE_LIMIT         = 1
+	DEFAULT_AUDIT_WEBHOOK_WINDOW             = 10 * time.Second
+	DEFAULT_AUDIT_WEBHOOK_QUEUE_SIZE         = 1024
+	DEFAULT_AUDIT_WEBHOOK_MAX_RETRIES        = 5
+	DEFAULT_AUDIT_WEBHOOK_RETRY_INTERVAL     = time.Second
+	DEFAULT_AUDIT_WEBHOOK_MAX_RETRY_INTERVAL = time.Minute
+)
+
+// AuditOutputConfig appends the audit events to File as JSON lines with stable field names, for
+// the log shippers that index them, next to the log. The file is rotated once it reaches
+// MaxSize megabytes, and every RotateInterval if set; the rotated files are removed after
+// MaxAge days and beyond MaxBackups, unless 0, and gzipped with Compress.
+type AuditOutputConfig struct {
+	Enable         bool          `yaml:"enable"`
+	Format         string        `yaml:"format"`
+	File           string        `yaml:"file"`
+	MaxSize        int           `yaml:"max_size"`
+	MaxAge         int           `yaml:"max_age"`
+	MaxBackups     int           `yaml:"max_backups"`
+	RotateInterval time.Duration `yaml:"rotate_interval"`
+	Compress       bool          `yaml:"compress"`
+	// Filter routes only the events it matches to the output. nil writes every event.
+	Filter *AlertEventFilter `yaml:"filter"`
+	// Webhook posts the events to a URL, whether the file is enabled or not.
+	Webhook AuditWebhookConfig `yaml:"webhook"`
+}
+
+func (c AuditOutputConfig) validate() error {
+	if err := c.Webhook.validate(); err != nil {
+		return err
+	}
+	if !c.Enable {
+		return nil
+	}
+
+	if c.Format != AUDIT_OUTPUT_FORMAT_JSON {
+		return fmt.Errorf("audit_output.format must be %s, got %q", AUDIT_OUTPUT_FORMAT_JSON, c.Format)
+	}
+	if !filepath.IsAbs(c.File) {
+		return fmt.Errorf("audit_output.file must be an absolute path, got %q", c.File)
+	}
+	if c.MaxSize <= 0 {
+		return fmt.Errorf("audit_output.max_size must be positive, got %d", c.MaxSize)
+	}
+	if c.MaxAge < 0 || c.MaxBackups < 0 || c.RotateInterval < 0 {
+		return fmt.Errorf("audit_output.max_age, max_backups and rotate_interval must not be negative")
+	}
+	if c.Filter != nil {
+		return c.Filter.validate("audit_output.filter")
+	}
+	return nil
+}
+
+// AuditWebhookConfig posts the audit events to URL, e.g. a Slack incoming webhook or the webhook
+// receiver of Alertmanager. The events of the same audit, action, comm and destination within
+// Window are posted once, with their count, and at most RateLimit requests are made per second,
+// so that a process retrying a blocked connection in a loop does not flood the receiver. A
+// request that fails is retried MaxRetries times, after RetryInterval doubling up to
+// MaxRetryInterval, and then dropped, unless Spool is set.
+type AuditWebhookConfig struct {
+	Enable bool   `yaml:"enable"`
+	URL    string `yaml:"url"`
+	// BearerToken is sent as the Authorization header, and Headers with every request.
+	BearerToken string            `yaml:"bearer_token"`
+	Headers     map[string]string `yaml:"headers"`
+	Timeout     time.Duration     `yaml:"timeout"`
+	// Body is a text/template of the body, executed with the event and its count. Empty posts
+	// them as JSON.
+	Body      string        `yaml:"body"`
+	RateLimit float64       `yaml:"rate_limit"`
+	Window    time.Duration `yaml:"window"`
+	// QueueSize is the number of events waiting to be posted, beyond which they are dropped.
+	QueueSize        int           `yaml:"queue_size"`
+	MaxRetries       int           `yaml:"max_retries"`
+	RetryInterval    time.Duration `yaml:"retry_interval"`
+	MaxRetryInterval time.Duration `yaml:"max_retry_interval"`
+	// Filter routes only the events it matches to the webhook. nil posts every event.
+	Filter *AlertEventFilter `yaml:"filter"`
+	// Spool keeps the events of a request that fails, which are posted again every RetryInterval
+	// and across restarts, in place of the retries. nil drops them after the retries.
+	Spool *spoolconf.Config `yaml:"spool"`
+}
+
+func (c AuditWebhookConfig) validate() error {
+	if !c.Enable {
+		return nil
+	}
+
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("audit_output.webhook.url must be an http or https URL, got %q", c.URL)
+	}
+	if c.Timeout <= 0 {
+		return fmt.Errorf("audit_output.webhook.timeout must be positive, got %s", c.Timeout)
+	}
+	if _, err := template.New("body").Parse(c.Body); err != nil {
+		return fmt.Errorf("audit_output.webhook.body: %w", err)
+	}
+	if c.RateLimit <= 0 {
+		return fmt.Errorf("audit_output.webhook.rate_limit must be positive, got %g", c.RateLimit)
+	}
+	if c.Window <= 0 {
+		return fmt.Errorf("audit_output.webhook.window must be positive, got %s", c.Window)
+	}
+	if c.QueueSize <= 0 {
+		return fmt.Errorf("audit_output.webhook.queue_size must be positive, got %d", c.QueueSize)
+	}
+	if c.MaxRetries < 0 {
+		return fmt.Errorf("audit_output.webhook.max_retries must not be negative, got %d", c.MaxRetries)
+	}
+	if c.RetryInterval <= 0 || c.MaxRetryInterval < c.RetryInterval {
+		return fmt.Errorf("audit_output.webhook.retry_interval must be positive and at most max_retry_interval, got %s and %s", c.RetryInterval, c.MaxRetryInterval)
+	}
+	if c.Spool != nil {
+		if err := c.Spool.Validate(); err != nil {
+			return fmt.Errorf("audit_output.webhook.%w", err)
+		}
+	}
+	if c.Filter != nil {
+		return c.Filter.validate("audit_output.webhook.filter")
+	}
+	return nil
+}
+
+const (
+	CONTAINER_RUNTIME_NONE       = "none"
+	CONTAINER_RUNTIME_DOCKER     = "docker"
+	CONTAINER_RUNTIME_CONTAINERD = "containerd"
+
+	DEFAULT_CONTAINERS_TIMEOUT    = time.Second
+	DEFAULT_CONTAINERS_CACHE_TTL  = time.Minute
+	DEFAULT_CONTAINERS_CACHE_SIZE = 4096
+)
+
+// ContainersConfig adds the container of the process to the audit events: its id, read from the
+// cgroup of the process, and with Runtime, its name, its image and its pod, looked up from Socket
+// for docker, or from the bundles of StateDir for containerd. The lookups are cached, CacheSize
+// at most, and the containers the runtime does not know are looked up again after CacheTTL.
+type ContainersConfig struct {
+	Enable    bool          `yaml:"enable"`
+	Runtime   string        `yaml:"runtime"`
+	Socket    string        `yaml:"socket"`
+	StateDir  string        `yaml:"state_dir"`
+	Timeout   time.Duration `yaml:"timeout"`
+	CacheTTL  time.Duration `yaml:"cache_ttl"`
+	CacheSize int           `yaml:"cache_size"`
+}
+
+func (c ContainersConfig) validate() error {
+	if !c.Enable {
+		return nil
+	}
+
+	switch c.Runtime {
+	case CONTAINER_RUNTIME_NONE:
+	case CONTAINER_RUNTIME_DOCKER:
+		if !filepath.IsAbs(c.Socket) {
+			return fmt.Errorf("containers.socket must be an absolute path, got %q", c.Socket)
+		}
+	case CONTAINER_RUNTIME_CONTAINERD:
+		if !filepath.IsAbs(c.StateDir) {
+			return fmt.Errorf("containers.state_dir must be an absolute path, got %q", c.StateDir)
+		}
+	default:
+		return fmt.Errorf("containers.runtime must be one of %s, %s or %s, got %q", CONTAINER_RUNTIME_NONE, CONTAINER_RUNTIME_DOCKER, CONTAINER_RUNTIME_CONTAINERD, c.Runtime)
+	}
+	if c.Timeout <= 0 {
+		return fmt.Errorf("containers.timeout must be positive, got %s", c.Timeout)
+	}
+	if c.CacheTTL <= 0 {
+		return fmt.Errorf("containers.cache_ttl must be positive, got %s", c.CacheTTL)
+	}
+	if c.CacheSize <= 0 {
+		return fmt.Errorf("containers.cache_size must be positive, got %d", c.CacheSize)
+	}
+	return nil
 }
 
-type GIDConfig struct {
-	Allow []uint `yaml:"allow"`
-	Deny  []uint `yaml:"deny"`
+// FallbackPolicyConfig is a minimal local policy bouheki applies when its config can not be
+// loaded, so that the host is not left unprotected by a broken config.
+type FallbackPolicyConfig struct {
+	Path string `yaml:"path"`
+	// ReloadFailures is the number of consecutive failed reloads after which the fallback is
+	// applied. 0 keeps the current policy however many reloads fail.
+	ReloadFailures int `yaml:"reload_failures"`
 }
 
 type LogConfig struct {
@@ -75,11 +1185,38 @@ type LogConfig struct {
 }
 
 type Config struct {
+	// Version selects the schema of the file, see CURRENT_VERSION.
+	Version                    int `yaml:"version"`
 	RestrictedNetworkConfig    `yaml:"network"`
 	RestrictedFileAccessConfig `yaml:"files"`
 	RestrictedMountConfig      `yaml:"mount"`
 	DNSProxyConfig             `yaml:"dns_proxy"`
 	Log                        LogConfig
+	Metrics                    MetricsConfig        `yaml:"metrics"`
+	Control                    ControlConfig        `yaml:"control"`
+	Admin                      AdminConfig          `yaml:"admin"`
+	Resources                  ResourcesConfig      `yaml:"resources"`
+	BPF                        BPFConfig            `yaml:"bpf"`
+	Startup                    StartupConfig        `yaml:"startup"`
+	Alerts                     AlertsConfig         `yaml:"alerts"`
+	EventOutput                EventOutputConfig    `yaml:"event_output"`
+	FalcoOutput                FalcoOutputConfig    `yaml:"falco_output"`
+	AuditOutput                AuditOutputConfig    `yaml:"audit_output"`
+	Containers                 ContainersConfig     `yaml:"containers"`
+	FallbackPolicy             FallbackPolicyConfig `yaml:"fallback_policy"`
+	Redaction                  RedactionConfig      `yaml:"redaction"`
+	// Groups are named sets of CIDRs and domains, referenced as group:<name> from the lists, as
+	// the presets are as @<name>.
+	Groups map[string]GroupConfig `yaml:"groups"`
+
+	// ignored are the unknown keys of a legacy config.
+	ignored []UnknownField
+	// entryGroups are the groups the entries of each list came from, and listGroups the
+	// groups each list references, once the references are expanded.
+	entryGroups map[string]map[string]string
+	listGroups  map[string][]string
+	// resolvedNames are the user and group names of the uid and gid lists, with their ids.
+	resolvedNames []ResolvedName
 }
 
 func DefaultConfig() *Config {
@@ -88,11 +1225,88 @@ func DefaultConfig() *Config {
 			Enable:  true,
 			Mode:    "monitor",
 			Target:  "host",
-			Command: CommandConfig{Allow: []string{}, Deny: []string{}},
-			CIDR:    CIDRConfig{Allow: []string{"0.0.0.0/0", "::/0"}, Deny: []string{}},
-			Domain:  DomainConfig{Allow: []string{}, Deny: []string{}, Interval: 5},
-			UID:     UIDConfig{Allow: []uint{}, Deny: []uint{}},
-			GID:     GIDConfig{Allow: []uint{}, Deny: []uint{}},
+			Command: CommandConfig{Allow: []string{}, Deny: []string{}, Monitor: []string{}},
+			CIDR:    CIDRConfig{Allow: []string{"0.0.0.0/0", "::/0"}, Deny: []string{}, AllowExcept: []string{}, Monitor: []string{}, Protocols: []ProtocolRulesConfig{}},
+			Domain:  DomainConfig{Allow: []string{}, Deny: []string{}, Monitor: []string{}, Protocols: []ProtocolRulesConfig{}, Interval: 5, PreloadMaxAge: 24 * time.Hour, Refresh: DomainRefreshConfig{Jitter: 0.1, MaxInFlight: 8, Tick: time.Second, MinInterval: 10 * time.Second, MaxInterval: time.Hour, RemoveAfter: 1}, Heal: DomainHealConfig{Enable: true, Interval: 30 * time.Second}, Resolver: DomainResolverConfig{Nameservers: []string{}, Timeout: 5 * time.Second}, WildcardMinTTL: time.Minute},
+			UID:     UIDConfig{Allow: []string{}, Deny: []string{}},
+			GID:     GIDConfig{Allow: []string{}, Deny: []string{}},
+			Ports:   PortsConfig{Allow: []string{}, Deny: []string{}},
+			Ingress: IngressConfig{
+				CIDR:  IngressCIDRConfig{Allow: []string{}, Deny: []string{}},
+				Ports: PortsConfig{Allow: []string{}, Deny: []string{}},
+			},
+			Families:      []string{FAMILY_IPV4, FAMILY_IPV6},
+			OtherFamilies: OTHER_FAMILIES_IGNORE,
+			Decision:      DecisionConfig{Default: DEFAULT_ACTION_DENY, Precedence: PRECEDENCE_DENY_FIRST},
+			Verification: VerificationConfig{
+				Enable:     false,
+				SampleRate: 0.01,
+			},
+			Enforcement: EnforcementConfig{
+				Hook:       HOOK_AUTO,
+				SendSignal: false,
+			},
+			Classification: ClassificationConfig{
+				Strategy:       CLASSIFY_MOUNT_NAMESPACE,
+				CgroupPatterns: []string{},
+				Cgroups:        []string{},
+				CgroupMatching: CGROUP_MATCHING_AUTO,
+			},
+			Coverage: CoverageConfig{
+				Enable:  false,
+				Windows: []time.Duration{time.Hour, 24 * time.Hour, 7 * 24 * time.Hour},
+			},
+			RuleSets: RuleSetsConfig{
+				ChunkSize:  1000,
+				ChunkDelay: 10 * time.Millisecond,
+				Sets:       []RuleSetConfig{},
+			},
+			Shutdown: ShutdownConfig{
+				DrainTimeout: 5 * time.Second,
+			},
+			DenialRecords: DenialRecordsConfig{
+				Enable:        false,
+				Dir:           DEFAULT_DENIAL_RECORDS_DIR,
+				MaxRecords:    20,
+				WriteInterval: time.Second,
+				Retention:     24 * time.Hour,
+			},
+			OutcomeHistory: OutcomeHistoryConfig{
+				Enable:        false,
+				StateDir:      DEFAULT_POLICY_SNAPSHOT_DIR,
+				MaxEntries:    DEFAULT_OUTCOME_HISTORY_MAX_ENTRIES,
+				WriteInterval: time.Minute,
+				Suggestions:   OutcomeSuggestionsConfig{MinConnections: 100, MinObserved: 24 * time.Hour},
+			},
+			RuleHits: RuleHitsConfig{
+				Enable:        false,
+				StateDir:      DEFAULT_POLICY_SNAPSHOT_DIR,
+				WriteInterval: 10 * time.Minute,
+			},
+			Learning: LearningConfig{
+				StateDir:      DEFAULT_POLICY_SNAPSHOT_DIR,
+				V4Prefix:      24,
+				V6Prefix:      64,
+				MaxEntries:    DEFAULT_LEARNING_MAX_ENTRIES,
+				WriteInterval: time.Minute,
+			},
+			SelfExemption: SelfExemptionConfig{
+				Enable:          true,
+				RefreshInterval: 5 * time.Minute,
+			},
+			PolicySnapshot: PolicySnapshotConfig{
+				Enable:   true,
+				StateDir: DEFAULT_POLICY_SNAPSHOT_DIR,
+				Versions: DEFAULT_POLICY_VERSIONS,
+			},
+			Audit: AuditConfig{
+				Enabled: true,
+				Dedup: AuditDedupConfig{
+					Enable:  false,
+					Window:  10 * time.Second,
+					MaxKeys: 4096,
+				},
+			},
 		},
 		RestrictedFileAccessConfig: RestrictedFileAccessConfig{
 			Enable: true,
@@ -118,39 +1332,713 @@ func DefaultConfig() *Config {
 			Output: "stdout",
 			Labels: map[string]string{},
 		},
+		Metrics: MetricsConfig{
+			Enable: false,
+			Listen: "127.0.0.1:9913",
+		},
+		Control: ControlConfig{
+			Enable: false,
+			Socket: "/var/run/bouheki.sock",
+		},
+		Resources: ResourcesConfig{
+			Profile:    RESOURCES_PROFILE_SMALL,
+			MaxEntries: map[string]uint32{},
+		},
+		Startup: StartupConfig{
+			Conditions: []StartupCondition{},
+		},
+		Alerts: AlertsConfig{
+			Interval: DEFAULT_ALERTS_INTERVAL,
+			Rules:    []AlertRule{},
+		},
+		EventOutput: EventOutputConfig{
+			Enable: false,
+			Type:   EVENT_OUTPUT_FIFO,
+			Path:   "/var/run/bouheki.events",
+			Mode:   0600,
+		},
+		FalcoOutput: FalcoOutputConfig{
+			Enable:    false,
+			Type:      FALCO_OUTPUT_FALCOSIDEKICK,
+			URL:       "http://localhost:2801/",
+			Timeout:   DEFAULT_FALCO_OUTPUT_TIMEOUT,
+			QueueSize: DEFAULT_FALCO_OUTPUT_QUEUE_SIZE,
+			Spool:     spoolconf.Config{Dir: "/var/lib/bouheki/falco-spool"},
+			Path:      "/var/log/bouheki/falco.json",
+			Tags:      []string{},
+		},
+		AuditOutput: AuditOutputConfig{
+			Enable:  false,
+			Format:  AUDIT_OUTPUT_FORMAT_JSON,
+			File:    "/var/log/bouheki/audit.jsonl",
+			MaxSize: DEFAULT_AUDIT_OUTPUT_MAX_SIZE,
+			Webhook: AuditWebhookConfig{
+				Enable:           false,
+				Headers:          map[string]string{},
+				Timeout:          DEFAULT_AUDIT_WEBHOOK_TIMEOUT,
+				RateLimit:        DEFAULT_AUDIT_WEBHOOK_RATE_LIMIT,
+				Window:           DEFAULT_AUDIT_WEBHOOK_WINDOW,
+				QueueSize:        DEFAULT_AUDIT_WEBHOOK_QUEUE_SIZE,
+				MaxRetries:       DEFAULT_AUDIT_WEBHOOK_MAX_RETRIES,
+				RetryInterval:    DEFAULT_AUDIT_WEBHOOK_RETRY_INTERVAL,
+				MaxRetryInterval: DEFAULT_AUDIT_WEBHOOK_MAX_RETRY_INTERVAL,
+			},
+		},
+		Containers: ContainersConfig{
+			Enable:    false,
+			Runtime:   CONTAINER_RUNTIME_NONE,
+			Socket:    "/var/run/docker.sock",
+			StateDir:  "/run/containerd/io.containerd.runtime.v2.task",
+			Timeout:   DEFAULT_CONTAINERS_TIMEOUT,
+			CacheTTL:  DEFAULT_CONTAINERS_CACHE_TTL,
+			CacheSize: DEFAULT_CONTAINERS_CACHE_SIZE,
+		},
+		Redaction: RedactionConfig{
+			EventFields: []string{"Hostname", "Addr", "Domain", "LocalAddr", "ContainerCgroup", "Path", "SourcePath", "ContainerName", "PodName", "PodNamespace"},
+			Labels:      true,
+		},
 	}
 }
 
 func NewConfig(configPath string) (*Config, error) {
-	file, err := os.Open(configPath)
+	data, err := ioutil.ReadFile(configPath)
 	if err != nil {
-		return nil, err
+		return nil, errkind.New(errkind.Config, err)
 	}
-	defer file.Close()
 
-	d := yaml.NewDecoder(file)
+	return Parse(data)
+}
 
+// Parse decodes and validates the YAML of a config file, as NewConfig does for the file it reads.
+func Parse(data []byte) (*Config, error) {
 	config := DefaultConfig()
-	if err := d.Decode(&config); err != nil {
-		return nil, err
+	ignored, err := decodeVersioned(data, config)
+	if err != nil {
+		return nil, errkind.New(errkind.Config, err)
+	}
+	config.ignored = ignored
+	if err := config.expandGroups(); err != nil {
+		return nil, errkind.New(errkind.Config, err)
 	}
+	if err := config.resolveNames(); err != nil {
+		return nil, errkind.New(errkind.Config, err)
+	}
+	config.normalize()
 
 	err = config.Validate()
 	if err != nil {
-		return nil, err
+		return nil, errkind.New(errkind.Config, err)
 	}
 
 	return config, nil
 }
 
+// IgnoredFields returns the unknown keys that were ignored because the file has no `version: 2`.
+func (c *Config) IgnoredFields() []UnknownField {
+	return c.ignored
+}
+
+// normalize trims the whitespace YAML lets into commands, and lowercases them
+// if network.command.case_insensitive is set. The protocol rules of PROTOCOL_ALL
+// are moved to the lists they are in.
+func (c *Config) normalize() {
+	command := &c.RestrictedNetworkConfig.Command
+	for _, list := range [][]string{command.Allow, command.Deny, command.Monitor} {
+		for i := range list {
+			list[i] = strings.TrimSpace(list[i])
+			if command.CaseInsensitive {
+				list[i] = strings.ToLower(list[i])
+			}
+		}
+	}
+	// The paths are never lowercased: case_insensitive is about the comm.
+	for _, list := range [][]string{command.AllowPaths, command.DenyPaths} {
+		for i := range list {
+			list[i] = strings.TrimSpace(list[i])
+		}
+	}
+
+	c.normalizePolicies()
+
+	cidr, domain := &c.RestrictedNetworkConfig.CIDR, &c.RestrictedNetworkConfig.Domain
+	cidr.Protocols = foldProtocolRules(cidr.Protocols, &cidr.Allow, &cidr.Deny)
+	domain.Protocols = foldProtocolRules(domain.Protocols, &domain.Allow, &domain.Deny)
+}
+
+// foldProtocolRules appends the entries of the rules of PROTOCOL_ALL to allow and deny, and returns the others.
+func foldProtocolRules(rules []ProtocolRulesConfig, allow, deny *[]string) []ProtocolRulesConfig {
+	kept := []ProtocolRulesConfig{}
+	for _, rule := range rules {
+		rule.Protocol = strings.ToLower(strings.TrimSpace(rule.Protocol))
+		if rule.Protocol != PROTOCOL_ALL {
+			kept = append(kept, rule)
+			continue
+		}
+		*allow = append(*allow, rule.Allow...)
+		*deny = append(*deny, rule.Deny...)
+	}
+	return kept
+}
+
 func (c *Config) Validate() error {
 	if c.DNSProxyConfig.Enable && len(c.DNSProxyConfig.Upstreams) == 0 {
 		return errors.New("One or more dns_proxy.upstrems must be specified.")
 	}
 
+	if rate := c.RestrictedNetworkConfig.Verification.SampleRate; rate < 0 || rate > 1 {
+		return fmt.Errorf("network.verification.sample_rate must be between 0 and 1, got %v", rate)
+	}
+
+	if err := validateCommands("network.command.allow", c.RestrictedNetworkConfig.Command.Allow); err != nil {
+		return err
+	}
+	if err := validateCommands("network.command.deny", c.RestrictedNetworkConfig.Command.Deny); err != nil {
+		return err
+	}
+	if err := validatePaths("network.command.allow_paths", c.RestrictedNetworkConfig.Command.AllowPaths); err != nil {
+		return err
+	}
+	if err := validatePaths("network.command.deny_paths", c.RestrictedNetworkConfig.Command.DenyPaths); err != nil {
+		return err
+	}
+	for i, dir := range c.RestrictedNetworkConfig.Command.HostCheck.ExtraDirs {
+		if !filepath.IsAbs(dir) {
+			return fmt.Errorf("network.command.host_check.extra_dirs[%d] must be an absolute path, got %q", i, dir)
+		}
+	}
+
+	for _, list := range []struct {
+		name  string
+		rules []ProtocolRulesConfig
+	}{
+		{"network.cidr.protocols", c.RestrictedNetworkConfig.CIDR.Protocols},
+		{"network.domain.protocols", c.RestrictedNetworkConfig.Domain.Protocols},
+	} {
+		for i, rule := range list.rules {
+			if err := rule.validate(fmt.Sprintf("%s[%d]", list.name, i)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := c.validateIDs(); err != nil {
+		return err
+	}
+
+	for _, list := range []struct {
+		name    string
+		entries []string
+	}{
+		{"network.ports.allow", c.RestrictedNetworkConfig.Ports.Allow},
+		{"network.ports.deny", c.RestrictedNetworkConfig.Ports.Deny},
+		{"network.ingress.ports.allow", c.RestrictedNetworkConfig.Ingress.Ports.Allow},
+		{"network.ingress.ports.deny", c.RestrictedNetworkConfig.Ingress.Ports.Deny},
+	} {
+		for _, entry := range list.entries {
+			if _, err := ParsePortRange(entry); err != nil {
+				return fmt.Errorf("%s: %w", list.name, err)
+			}
+		}
+	}
+
+	if err := c.RestrictedNetworkConfig.validateFamilies(); err != nil {
+		return err
+	}
+	if err := c.validateDecision(); err != nil {
+		return err
+	}
+	if err := c.RestrictedNetworkConfig.validateMonitor(); err != nil {
+		return err
+	}
+
+	switch c.RestrictedNetworkConfig.Enforcement.Hook {
+	case HOOK_AUTO, HOOK_LSM, HOOK_KPROBE:
+	default:
+		return fmt.Errorf("network.enforcement.hook must be one of %s, %s or %s, got %q", HOOK_AUTO, HOOK_LSM, HOOK_KPROBE, c.RestrictedNetworkConfig.Enforcement.Hook)
+	}
+
+	for i, entry := range c.RestrictedNetworkConfig.DestinationTags.Entries {
+		if _, _, err := net.ParseCIDR(entry.CIDR); err != nil {
+			return fmt.Errorf("network.destination_tags.entries[%d].cidr: %w", i, err)
+		}
+		if len(entry.Tags) == 0 {
+			return fmt.Errorf("network.destination_tags.entries[%d].tags must not be empty", i)
+		}
+	}
+
+	for i, window := range c.RestrictedNetworkConfig.Coverage.Windows {
+		if window < MIN_COVERAGE_WINDOW {
+			return fmt.Errorf("network.coverage.windows[%d] must be at least %s, got %s", i, MIN_COVERAGE_WINDOW, window)
+		}
+	}
+
+	if err := c.RestrictedNetworkConfig.Classification.validate(); err != nil {
+		return err
+	}
+
+	if timeout := c.RestrictedNetworkConfig.Shutdown.DrainTimeout; timeout < 0 {
+		return fmt.Errorf("network.shutdown.drain_timeout must not be negative, got %s", timeout)
+	}
+
+	if err := c.RestrictedNetworkConfig.Domain.Refresh.validate(); err != nil {
+		return err
+	}
+	if heal := c.RestrictedNetworkConfig.Domain.Heal; heal.Enable && heal.Interval <= 0 {
+		return fmt.Errorf("network.domain.heal.interval must be positive, got %s", heal.Interval)
+	}
+	if err := c.RestrictedNetworkConfig.Domain.Resolver.validate(); err != nil {
+		return err
+	}
+	if err := c.validateTruncatedCommands(); err != nil {
+		return err
+	}
+	if err := c.validateWildcardDomains(); err != nil {
+		return err
+	}
+	if err := c.validatePolicies(); err != nil {
+		return err
+	}
+
+	if err := c.RestrictedNetworkConfig.RuleSets.validate(); err != nil {
+		return err
+	}
+
+	if err := c.RestrictedNetworkConfig.DenialRecords.validate(); err != nil {
+		return err
+	}
+	if err := c.RestrictedNetworkConfig.OutcomeHistory.validate(); err != nil {
+		return err
+	}
+	if err := c.RestrictedNetworkConfig.RuleHits.validate(); err != nil {
+		return err
+	}
+	if c.RestrictedNetworkConfig.Mode == MODE_LEARNING {
+		if err := c.RestrictedNetworkConfig.Learning.validate(); err != nil {
+			return err
+		}
+	}
+
+	if self := c.RestrictedNetworkConfig.SelfExemption; self.Enable && self.RefreshInterval <= 0 {
+		return fmt.Errorf("network.self_exemption.refresh_interval must be positive, got %s", self.RefreshInterval)
+	}
+
+	if snapshot := c.RestrictedNetworkConfig.PolicySnapshot; snapshot.Enable && !filepath.IsAbs(snapshot.StateDir) {
+		return fmt.Errorf("network.policy_snapshot.state_dir must be an absolute path, got %q", snapshot.StateDir)
+	}
+	if c.RestrictedNetworkConfig.PolicySnapshot.Versions < 0 {
+		return fmt.Errorf("network.policy_snapshot.versions must not be negative, got %d", c.RestrictedNetworkConfig.PolicySnapshot.Versions)
+	}
+
+	if size := c.RestrictedNetworkConfig.Audit.RingBufSize; size != 0 && (size < AUDIT_MIN_RINGBUF_SIZE || size&(size-1) != 0) {
+		return fmt.Errorf("network.audit.ringbuf_size must be a power of two of at least %d bytes, got %d", AUDIT_MIN_RINGBUF_SIZE, size)
+	}
+	if err := c.RestrictedNetworkConfig.Audit.Dedup.validate(); err != nil {
+		return err
+	}
+
+	if !c.RestrictedNetworkConfig.Audit.Enabled {
+		for _, feature := range []struct {
+			name    string
+			enabled bool
+		}{
+			{"network.verification", c.RestrictedNetworkConfig.Verification.Enable},
+			{"network.coverage", c.RestrictedNetworkConfig.Coverage.Enable},
+			{"network.denial_records", c.RestrictedNetworkConfig.DenialRecords.Enable},
+			{"network.outcome_history", c.RestrictedNetworkConfig.OutcomeHistory.Enable},
+			{"network.mode: learning", c.RestrictedNetworkConfig.Mode == MODE_LEARNING},
+			{"network.audit.dedup", c.RestrictedNetworkConfig.Audit.Dedup.Enable},
+		} {
+			if feature.enabled {
+				return fmt.Errorf("%s reads the audit events, which network.audit.enabled: false turns off", feature.name)
+			}
+		}
+	}
+
+	if err := c.Startup.validate(); err != nil {
+		return err
+	}
+
+	if err := c.Alerts.validate(); err != nil {
+		return err
+	}
+
+	if c.FallbackPolicy.ReloadFailures < 0 {
+		return fmt.Errorf("fallback_policy.reload_failures must not be negative, got %d", c.FallbackPolicy.ReloadFailures)
+	}
+
+	if err := c.EventOutput.validate(); err != nil {
+		return err
+	}
+
+	if err := c.FalcoOutput.validate(); err != nil {
+		return err
+	}
+
+	if err := c.AuditOutput.validate(); err != nil {
+		return err
+	}
+
+	if err := c.Containers.validate(); err != nil {
+		return err
+	}
+
+	if err := c.Redaction.validate(); err != nil {
+		return err
+	}
+
+	switch c.Resources.Profile {
+	case RESOURCES_PROFILE_SMALL, RESOURCES_PROFILE_MEDIUM, RESOURCES_PROFILE_LARGE:
+	default:
+		return fmt.Errorf("resources.profile must be one of %s, %s or %s, got %q",
+			RESOURCES_PROFILE_SMALL, RESOURCES_PROFILE_MEDIUM, RESOURCES_PROFILE_LARGE, c.Resources.Profile)
+	}
+	for name, entries := range c.Resources.MaxEntries {
+		if entries == 0 {
+			return fmt.Errorf("resources.max_entries.%s must be positive", name)
+		}
+	}
+	if c.Resources.DenyShards < 0 || c.Resources.DenyShards > RESOURCES_MAX_DENY_SHARDS {
+		return fmt.Errorf("resources.deny_shards must be between 0 and %d, got %d", RESOURCES_MAX_DENY_SHARDS, c.Resources.DenyShards)
+	}
+	if c.BPF.PinPath != "" && !filepath.IsAbs(c.BPF.PinPath) {
+		return fmt.Errorf("bpf.pin_path must be an absolute path, got %q", c.BPF.PinPath)
+	}
+	if err := c.BPF.validateKeepAttached(); err != nil {
+		return err
+	}
+
+	for i, window := range c.Admin.FreezeWindows {
+		if window.Name == "" {
+			return fmt.Errorf("admin.freeze_windows[%d].name must not be empty", i)
+		}
+		if _, _, err := window.Range(); err != nil {
+			return fmt.Errorf("admin.freeze_windows[%d] (%s): %w", i, window.Name, err)
+		}
+	}
+
+	if c.RestrictedNetworkConfig.Domain.PreloadFile != "" {
+		if _, err := c.RestrictedNetworkConfig.Domain.PreloadKey(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// UsesCgroups reports whether the strategy classifies by the cgroup of the process.
+func (c ClassificationConfig) UsesCgroups() bool {
+	return c.Strategy == CLASSIFY_CGROUP_PATTERN || c.Strategy == CLASSIFY_CGROUP_LIST
+}
+
+func (c ClassificationConfig) validate() error {
+	switch c.Strategy {
+	case CLASSIFY_MOUNT_NAMESPACE, CLASSIFY_PID_NAMESPACE:
+	case CLASSIFY_CGROUP_PATTERN:
+		for i, pattern := range c.CgroupPatterns {
+			if _, err := regexp.Compile(pattern); err != nil {
+				return fmt.Errorf("network.classification.cgroup_patterns[%d]: %w", i, err)
+			}
+		}
+	case CLASSIFY_CGROUP_LIST:
+		if len(c.Cgroups) == 0 {
+			return fmt.Errorf("network.classification.cgroups must not be empty with %s", CLASSIFY_CGROUP_LIST)
+		}
+		for i, cgroup := range c.Cgroups {
+			if !strings.HasPrefix(cgroup, "/") {
+				return fmt.Errorf("network.classification.cgroups[%d] must be a path from the cgroup root, got %q", i, cgroup)
+			}
+		}
+	default:
+		return fmt.Errorf("network.classification.strategy must be one of %s, %s, %s or %s, got %q",
+			CLASSIFY_MOUNT_NAMESPACE, CLASSIFY_PID_NAMESPACE, CLASSIFY_CGROUP_PATTERN, CLASSIFY_CGROUP_LIST, c.Strategy)
+	}
+
+	switch c.CgroupMatching {
+	case CGROUP_MATCHING_AUTO, CGROUP_MATCHING_ANCESTORS, CGROUP_MATCHING_WATCH:
+	default:
+		return fmt.Errorf("network.classification.cgroup_matching must be one of %s, %s or %s, got %q",
+			CGROUP_MATCHING_AUTO, CGROUP_MATCHING_ANCESTORS, CGROUP_MATCHING_WATCH, c.CgroupMatching)
+	}
+	return nil
+}
+
+func (c DomainRefreshConfig) validate() error {
+	if c.Jitter < 0 || c.Jitter >= 1 {
+		return fmt.Errorf("network.domain.refresh.jitter must be at least 0 and less than 1, got %v", c.Jitter)
+	}
+	if c.MaxInFlight <= 0 {
+		return fmt.Errorf("network.domain.refresh.max_in_flight must be positive, got %d", c.MaxInFlight)
+	}
+	if c.Tick <= 0 {
+		return fmt.Errorf("network.domain.refresh.tick must be positive, got %s", c.Tick)
+	}
+	if c.MinInterval <= 0 || c.MaxInterval < c.MinInterval {
+		return fmt.Errorf("network.domain.refresh.min_interval must be positive and at most max_interval, got %s and %s", c.MinInterval, c.MaxInterval)
+	}
+	if c.RemoveAfter < 1 {
+		return fmt.Errorf("network.domain.refresh.remove_after must be at least 1, got %d", c.RemoveAfter)
+	}
+	return nil
+}
+
+func (c DenialRecordsConfig) validate() error {
+	if !c.Enable {
+		return nil
+	}
+	if !filepath.IsAbs(c.Dir) {
+		return fmt.Errorf("network.denial_records.dir must be an absolute path, got %q", c.Dir)
+	}
+	if c.MaxRecords <= 0 || c.MaxRecords > MAX_DENIAL_RECORDS {
+		return fmt.Errorf("network.denial_records.max_records must be between 1 and %d, got %d", MAX_DENIAL_RECORDS, c.MaxRecords)
+	}
+	if c.WriteInterval <= 0 {
+		return fmt.Errorf("network.denial_records.write_interval must be positive, got %s", c.WriteInterval)
+	}
+	if c.Retention <= 0 {
+		return fmt.Errorf("network.denial_records.retention must be positive, got %s", c.Retention)
+	}
+	return nil
+}
+
+func (c OutcomeHistoryConfig) validate() error {
+	if !c.Enable {
+		return nil
+	}
+	if !filepath.IsAbs(c.StateDir) {
+		return fmt.Errorf("network.outcome_history.state_dir must be an absolute path, got %q", c.StateDir)
+	}
+	if c.MaxEntries <= 0 || c.MaxEntries > MAX_OUTCOME_HISTORY_ENTRIES {
+		return fmt.Errorf("network.outcome_history.max_entries must be between 1 and %d, got %d", MAX_OUTCOME_HISTORY_ENTRIES, c.MaxEntries)
+	}
+	if c.WriteInterval <= 0 {
+		return fmt.Errorf("network.outcome_history.write_interval must be positive, got %s", c.WriteInterval)
+	}
+	if c.Suggestions.Enable && c.Suggestions.MinConnections == 0 {
+		return errors.New("network.outcome_history.suggestions.min_connections must be positive")
+	}
+	if c.Suggestions.MinObserved < 0 {
+		return fmt.Errorf("network.outcome_history.suggestions.min_observed must not be negative, got %s", c.Suggestions.MinObserved)
+	}
+	return nil
+}
+
+func (c LearningConfig) validate() error {
+	if !filepath.IsAbs(c.StateDir) {
+		return fmt.Errorf("network.learning.state_dir must be an absolute path, got %q", c.StateDir)
+	}
+	if c.V4Prefix < 1 || c.V4Prefix > 32 {
+		return fmt.Errorf("network.learning.v4_prefix must be between 1 and 32, got %d", c.V4Prefix)
+	}
+	if c.V6Prefix < 1 || c.V6Prefix > 128 {
+		return fmt.Errorf("network.learning.v6_prefix must be between 1 and 128, got %d", c.V6Prefix)
+	}
+	if c.MaxEntries <= 0 || c.MaxEntries > MAX_LEARNING_ENTRIES {
+		return fmt.Errorf("network.learning.max_entries must be between 1 and %d, got %d", MAX_LEARNING_ENTRIES, c.MaxEntries)
+	}
+	if c.WriteInterval <= 0 {
+		return fmt.Errorf("network.learning.write_interval must be positive, got %s", c.WriteInterval)
+	}
+	return nil
+}
+
+func (c RuleHitsConfig) validate() error {
+	if !c.Enable {
+		return nil
+	}
+	if !filepath.IsAbs(c.StateDir) {
+		return fmt.Errorf("network.rule_hits.state_dir must be an absolute path, got %q", c.StateDir)
+	}
+	if c.WriteInterval <= 0 {
+		return fmt.Errorf("network.rule_hits.write_interval must be positive, got %s", c.WriteInterval)
+	}
+	return nil
+}
+
+func (c AuditDedupConfig) validate() error {
+	if !c.Enable {
+		return nil
+	}
+	if c.Window <= 0 {
+		return fmt.Errorf("network.audit.dedup.window must be positive, got %s", c.Window)
+	}
+	if c.MaxKeys <= 0 {
+		return fmt.Errorf("network.audit.dedup.max_keys must be positive, got %d", c.MaxKeys)
+	}
+	if c.KernelWindow < 0 {
+		return fmt.Errorf("network.audit.dedup.kernel_window must not be negative, got %s", c.KernelWindow)
+	}
+	return nil
+}
+
+func (c StartupConfig) validate() error {
+	names := map[string]bool{}
+	for i, condition := range c.Conditions {
+		if condition.Name == "" {
+			return fmt.Errorf("startup.conditions[%d].name must not be empty", i)
+		}
+		if names[condition.Name] {
+			return fmt.Errorf("startup.conditions[%d]: %s is defined twice", i, condition.Name)
+		}
+		names[condition.Name] = true
+
+		switch condition.Type {
+		case STARTUP_CONDITION_DNS, STARTUP_CONDITION_SOCKET, STARTUP_CONDITION_HTTP:
+		default:
+			return fmt.Errorf("startup.conditions[%d] (%s): type must be one of %s, %s or %s, got %q",
+				i, condition.Name, STARTUP_CONDITION_DNS, STARTUP_CONDITION_SOCKET, STARTUP_CONDITION_HTTP, condition.Type)
+		}
+		if condition.Target == "" {
+			return fmt.Errorf("startup.conditions[%d] (%s): target must not be empty", i, condition.Name)
+		}
+		switch condition.Policy {
+		case STARTUP_POLICY_WAIT, STARTUP_POLICY_DEGRADED, STARTUP_POLICY_FAIL:
+		default:
+			return fmt.Errorf("startup.conditions[%d] (%s): policy must be one of %s, %s or %s, got %q",
+				i, condition.Name, STARTUP_POLICY_WAIT, STARTUP_POLICY_DEGRADED, STARTUP_POLICY_FAIL, condition.Policy)
+		}
+		if condition.Timeout <= 0 {
+			return fmt.Errorf("startup.conditions[%d] (%s): timeout must be positive, got %s", i, condition.Name, condition.Timeout)
+		}
+		if condition.Interval < 0 {
+			return fmt.Errorf("startup.conditions[%d] (%s): interval must not be negative, got %s", i, condition.Name, condition.Interval)
+		}
+	}
+	return nil
+}
+
+func (c AlertsConfig) validate() error {
+	if len(c.Rules) > 0 && c.Interval <= 0 {
+		return fmt.Errorf("alerts.interval must be positive, got %s", c.Interval)
+	}
+
+	names := map[string]bool{}
+	for i, rule := range c.Rules {
+		if rule.Name == "" {
+			return fmt.Errorf("alerts.rules[%d].name must not be empty", i)
+		}
+		if names[rule.Name] {
+			return fmt.Errorf("alerts.rules[%d]: %s is defined twice", i, rule.Name)
+		}
+		names[rule.Name] = true
+
+		if (rule.Metric == "") == (rule.Event == nil) {
+			return fmt.Errorf("alerts.rules[%d] (%s): exactly one of metric or event must be set", i, rule.Name)
+		}
+		if rule.Event != nil {
+			if err := rule.Event.validate("event"); err != nil {
+				return fmt.Errorf("alerts.rules[%d] (%s): %w", i, rule.Name, err)
+			}
+		}
+		if rule.Window <= 0 {
+			return fmt.Errorf("alerts.rules[%d] (%s): window must be positive, got %s", i, rule.Name, rule.Window)
+		}
+		if rule.Threshold < 0 {
+			return fmt.Errorf("alerts.rules[%d] (%s): threshold must not be negative, got %v", i, rule.Name, rule.Threshold)
+		}
+		if rule.Cooldown < 0 {
+			return fmt.Errorf("alerts.rules[%d] (%s): cooldown must not be negative, got %s", i, rule.Name, rule.Cooldown)
+		}
+	}
+	return nil
+}
+
+func (c RuleSetsConfig) validate() error {
+	if c.ChunkSize <= 0 {
+		return fmt.Errorf("network.rule_sets.chunk_size must be positive, got %d", c.ChunkSize)
+	}
+	if c.ChunkDelay < 0 {
+		return fmt.Errorf("network.rule_sets.chunk_delay must not be negative, got %s", c.ChunkDelay)
+	}
+
+	names := map[string]bool{}
+	for i, set := range c.Sets {
+		// The name is also the file name of the progress in state_dir.
+		if set.Name == "" || strings.ContainsAny(set.Name, "/\\") || set.Name == "." || set.Name == ".." {
+			return fmt.Errorf("network.rule_sets.sets[%d].name must be a non-empty name without a slash, got %q", i, set.Name)
+		}
+		if names[set.Name] {
+			return fmt.Errorf("network.rule_sets.sets[%d]: %s is defined twice", i, set.Name)
+		}
+		names[set.Name] = true
+
+		if set.List != RULE_SET_LIST_ALLOW && set.List != RULE_SET_LIST_DENY {
+			return fmt.Errorf("network.rule_sets.sets[%d] (%s): list must be %s or %s, got %q", i, set.Name, RULE_SET_LIST_ALLOW, RULE_SET_LIST_DENY, set.List)
+		}
+		if set.File == "" {
+			return fmt.Errorf("network.rule_sets.sets[%d] (%s): file must not be empty", i, set.Name)
+		}
+		if set.RefreshInterval < 0 {
+			return fmt.Errorf("network.rule_sets.sets[%d] (%s): refresh_interval must not be negative", i, set.Name)
+		}
+	}
+	return nil
+}
+
+// validate checks the protocol of a rule. The entries are checked as the other entries of their list are.
+func (r ProtocolRulesConfig) validate(key string) error {
+	switch r.Protocol {
+	case PROTOCOL_TCP, PROTOCOL_UDP, PROTOCOL_ALL:
+	default:
+		return fmt.Errorf("%s.protocol must be one of %s, %s or %s, got %q", key, PROTOCOL_TCP, PROTOCOL_UDP, PROTOCOL_ALL, r.Protocol)
+	}
+	for _, entry := range append(append([]string{}, r.Allow...), r.Deny...) {
+		if _, ok := GroupName(entry); ok {
+			return fmt.Errorf("%s: group references are not supported in the protocol rules, got %q", key, entry)
+		}
+	}
+	return nil
+}
+
+// validateWildcardDomains checks the wildcard domains of network.domain. Their names are only
+// known from the answers the DNS proxy relays, so they need it.
+func (c *Config) validateWildcardDomains() error {
+	domain := c.RestrictedNetworkConfig.Domain
+	if domain.WildcardMinTTL < 0 {
+		return fmt.Errorf("network.domain.wildcard_min_ttl must not be negative, got %s", domain.WildcardMinTTL)
+	}
+	for _, wildcard := range domain.wildcardDomains() {
+		suffix := strings.TrimSuffix(wildcard[2:], ".")
+		if suffix == "" || strings.Contains(suffix, "*") || strings.HasPrefix(suffix, ".") {
+			return fmt.Errorf("network.domain: %q must be a * label followed by a domain, e.g. *.example.com", wildcard)
+		}
+		if !c.DNSProxyConfig.Enable {
+			return fmt.Errorf("network.domain: the wildcard domain %s needs dns_proxy.enable, the names it matches are learned from the answers of the DNS proxy", wildcard)
+		}
+	}
 	return nil
 }
 
+func validateCommands(list string, commands []string) error {
+	for _, command := range commands {
+		if command == "" {
+			return fmt.Errorf("%s must not contain an empty command (an empty or absent list does not restrict)", list)
+		}
+		if strings.ContainsRune(command, 0) {
+			return fmt.Errorf("%s: %q must not contain a NUL byte", list, command)
+		}
+	}
+
+	return validateCommandPatterns(list, commands)
+}
+
+// PRELOAD_PUBLIC_KEY_SIZE is the size of an ed25519 public key, ed25519.PublicKeySize, which
+// the config does not import crypto for.
+const PRELOAD_PUBLIC_KEY_SIZE = 32
+
+// PreloadKey decodes the base64 ed25519 public key that verifies the preload file.
+func (d DomainConfig) PreloadKey() ([]byte, error) {
+	if d.PreloadPublicKey == "" {
+		return nil, errors.New("network.domain.preload_public_key is required when network.domain.preload_file is set")
+	}
+
+	key, err := base64.StdEncoding.DecodeString(d.PreloadPublicKey)
+	if err != nil || len(key) != PRELOAD_PUBLIC_KEY_SIZE {
+		return nil, errors.New("network.domain.preload_public_key must be a base64 encoded ed25519 public key")
+	}
+
+	return key, nil
+}
+
 func (c *Config) EnableDNSProxy() bool {
 	return c.DNSProxyConfig.Enable
 }
@@ -180,6 +2068,12 @@ func (c *Config) IsRestrictedMode(target string) bool {
 	}
 }
 
+// ClassifiesContainers reports whether the restriction of target tells the processes in a
+// container apart: with target: container, and target: all of the network restriction.
+func (c *Config) ClassifiesContainers(target string) bool {
+	return c.IsOnlyContainer(target) || (target == "network" && c.RestrictedNetworkConfig.Target == TARGET_ALL)
+}
+
 func (c *Config) IsOnlyContainer(target string) bool {
 	switch target {
 	case "network":
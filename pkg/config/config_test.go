@@ -1,8 +1,13 @@
 package config
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/mrtc0/bouheki/pkg/errkind"
+	"github.com/mrtc0/bouheki/pkg/spool/spoolconf"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -60,3 +65,824 @@ func TestIsRestrictedMode(t *testing.T) {
 		})
 	})
 }
+
+func TestIngressHasRules(t *testing.T) {
+	ingress := DefaultConfig().RestrictedNetworkConfig.Ingress
+	assert.False(t, ingress.HasRules())
+
+	ingress.Ports.Deny = []string{"4444"}
+	assert.True(t, ingress.HasRules())
+}
+
+func TestValidate(t *testing.T) {
+	t.Run("verification.sample_rate must be between 0 and 1", func(t *testing.T) {
+		config := DefaultConfig()
+		config.RestrictedNetworkConfig.Verification.SampleRate = 1
+		assert.Nil(t, config.Validate())
+
+		config.RestrictedNetworkConfig.Verification.SampleRate = 1.5
+		assert.NotNil(t, config.Validate())
+
+		config.RestrictedNetworkConfig.Verification.SampleRate = -0.1
+		assert.NotNil(t, config.Validate())
+	})
+
+	t.Run("network.enforcement.hook must be auto, lsm or kprobe", func(t *testing.T) {
+		config := DefaultConfig()
+		for _, hook := range []string{HOOK_AUTO, HOOK_LSM, HOOK_KPROBE} {
+			config.RestrictedNetworkConfig.Enforcement.Hook = hook
+			assert.Nil(t, config.Validate())
+		}
+
+		config.RestrictedNetworkConfig.Enforcement.Hook = "fentry"
+		assert.NotNil(t, config.Validate())
+	})
+
+	t.Run("network.domain.preload_file requires a valid public key", func(t *testing.T) {
+		config := DefaultConfig()
+		config.RestrictedNetworkConfig.Domain.PreloadFile = "/etc/bouheki/domains.json"
+		assert.NotNil(t, config.Validate())
+
+		config.RestrictedNetworkConfig.Domain.PreloadPublicKey = "bm90IGEga2V5"
+		assert.NotNil(t, config.Validate())
+
+		config.RestrictedNetworkConfig.Domain.PreloadPublicKey = "11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo="
+		assert.Nil(t, config.Validate())
+	})
+
+	t.Run("network.destination_tags entries need a CIDR and tags", func(t *testing.T) {
+		config := DefaultConfig()
+		config.RestrictedNetworkConfig.DestinationTags.Entries = []DestinationTag{{CIDR: "10.96.0.1/32", Tags: []string{"kubernetes-api"}}}
+		assert.Nil(t, config.Validate())
+
+		config.RestrictedNetworkConfig.DestinationTags.Entries = []DestinationTag{{CIDR: "10.96.0.1", Tags: []string{"kubernetes-api"}}}
+		assert.NotNil(t, config.Validate())
+
+		config.RestrictedNetworkConfig.DestinationTags.Entries = []DestinationTag{{CIDR: "10.96.0.1/32"}}
+		assert.NotNil(t, config.Validate())
+	})
+
+	t.Run("network.classification needs a known strategy and valid cgroups", func(t *testing.T) {
+		config := DefaultConfig()
+		config.RestrictedNetworkConfig.Classification.Strategy = CLASSIFY_CGROUP_PATTERN
+		config.RestrictedNetworkConfig.Classification.CgroupPatterns = []string{`^/jobs/`}
+		assert.Nil(t, config.Validate())
+
+		for _, matching := range []string{CGROUP_MATCHING_AUTO, CGROUP_MATCHING_ANCESTORS, CGROUP_MATCHING_WATCH} {
+			config.RestrictedNetworkConfig.Classification.CgroupMatching = matching
+			assert.Nil(t, config.Validate())
+		}
+
+		for _, classification := range []ClassificationConfig{
+			{Strategy: "cgroup", CgroupMatching: CGROUP_MATCHING_AUTO},
+			{Strategy: CLASSIFY_CGROUP_PATTERN, CgroupPatterns: []string{`^/jobs/(`}, CgroupMatching: CGROUP_MATCHING_AUTO},
+			{Strategy: CLASSIFY_CGROUP_LIST, CgroupMatching: CGROUP_MATCHING_AUTO},
+			{Strategy: CLASSIFY_CGROUP_LIST, Cgroups: []string{"machine.slice"}, CgroupMatching: CGROUP_MATCHING_AUTO},
+			{Strategy: CLASSIFY_CGROUP_PATTERN, CgroupMatching: "children"},
+		} {
+			config.RestrictedNetworkConfig.Classification = classification
+			assert.NotNil(t, config.Validate())
+		}
+	})
+
+	t.Run("network.shutdown.drain_timeout must not be negative", func(t *testing.T) {
+		config := DefaultConfig()
+		config.RestrictedNetworkConfig.Shutdown.DrainTimeout = 0
+		assert.Nil(t, config.Validate())
+
+		config.RestrictedNetworkConfig.Shutdown.DrainTimeout = -time.Second
+		assert.NotNil(t, config.Validate())
+	})
+
+	t.Run("network.domain.refresh needs a jitter below 1, concurrency, a tick, intervals and remove_after", func(t *testing.T) {
+		config := DefaultConfig()
+		config.RestrictedNetworkConfig.Domain.Refresh.Jitter = 0
+		assert.Nil(t, config.Validate())
+
+		for _, refresh := range []DomainRefreshConfig{
+			{Jitter: 1, MaxInFlight: 8, Tick: time.Second, MinInterval: time.Second, MaxInterval: time.Hour, RemoveAfter: 1},
+			{Jitter: -0.1, MaxInFlight: 8, Tick: time.Second, MinInterval: time.Second, MaxInterval: time.Hour, RemoveAfter: 1},
+			{Jitter: 0.1, MaxInFlight: 0, Tick: time.Second, MinInterval: time.Second, MaxInterval: time.Hour, RemoveAfter: 1},
+			{Jitter: 0.1, MaxInFlight: 8, MinInterval: time.Second, MaxInterval: time.Hour, RemoveAfter: 1},
+			{Jitter: 0.1, MaxInFlight: 8, Tick: time.Second, MaxInterval: time.Hour, RemoveAfter: 1},
+			{Jitter: 0.1, MaxInFlight: 8, Tick: time.Second, MinInterval: time.Hour, MaxInterval: time.Minute, RemoveAfter: 1},
+			{Jitter: 0.1, MaxInFlight: 8, Tick: time.Second, MinInterval: time.Second, MaxInterval: time.Hour},
+		} {
+			config.RestrictedNetworkConfig.Domain.Refresh = refresh
+			assert.NotNil(t, config.Validate())
+		}
+	})
+
+	t.Run("network.domain.heal needs an interval when enabled", func(t *testing.T) {
+		config := DefaultConfig()
+		config.RestrictedNetworkConfig.Domain.Heal.Interval = 0
+		assert.NotNil(t, config.Validate())
+
+		config.RestrictedNetworkConfig.Domain.Heal.Enable = false
+		assert.Nil(t, config.Validate())
+	})
+
+	t.Run("network.domain.resolver needs IP nameservers and a timeout", func(t *testing.T) {
+		config := DefaultConfig()
+		config.RestrictedNetworkConfig.Domain.Resolver.Nameservers = []string{"10.0.0.53", "10.0.0.54:5353", "2001:db8::53", "[2001:db8::54]:53"}
+		assert.Nil(t, config.Validate())
+		assert.Equal(t, []string{"10.0.0.53:53", "10.0.0.54:5353", "[2001:db8::53]:53", "[2001:db8::54]:53"}, config.RestrictedNetworkConfig.Domain.Resolver.Addresses())
+
+		config.RestrictedNetworkConfig.Domain.Resolver.TLS = true
+		config.RestrictedNetworkConfig.Domain.Resolver.ServerName = "dns.example.com"
+		assert.Nil(t, config.Validate())
+		assert.Equal(t, "10.0.0.53:853", config.RestrictedNetworkConfig.Domain.Resolver.Addresses()[0])
+
+		for _, nameserver := range []string{"dns.example.com", "10.0.0.53:0", "10.0.0.53:dns"} {
+			config.RestrictedNetworkConfig.Domain.Resolver.Nameservers = []string{nameserver}
+			assert.NotNil(t, config.Validate(), nameserver)
+		}
+
+		config.RestrictedNetworkConfig.Domain.Resolver = DomainResolverConfig{ServerName: "dns.example.com", Timeout: time.Second}
+		assert.NotNil(t, config.Validate())
+		config.RestrictedNetworkConfig.Domain.Resolver = DomainResolverConfig{}
+		assert.NotNil(t, config.Validate())
+	})
+
+	t.Run("network.domain wildcards need the DNS proxy and a domain after the *", func(t *testing.T) {
+		config := DefaultConfig()
+		config.RestrictedNetworkConfig.Domain.Allow = []string{"*.s3.amazonaws.com"}
+		assert.NotNil(t, config.Validate())
+
+		config.DNSProxyConfig = DNSProxyConfig{Enable: true, Upstreams: []string{"8.8.8.8"}}
+		assert.Nil(t, config.Validate())
+
+		for _, wildcard := range []string{"*.", "*.*.example.com", "*..example.com"} {
+			config.RestrictedNetworkConfig.Domain.Protocols = []ProtocolRulesConfig{{Protocol: PROTOCOL_UDP, Deny: []string{wildcard}}}
+			assert.NotNil(t, config.Validate(), wildcard)
+		}
+
+		config.RestrictedNetworkConfig.Domain.Protocols = nil
+		config.RestrictedNetworkConfig.Domain.WildcardMinTTL = -time.Second
+		assert.NotNil(t, config.Validate())
+	})
+
+	t.Run("network.rule_sets need a chunk size, unique names, a list and a file", func(t *testing.T) {
+		config := DefaultConfig()
+		config.RestrictedNetworkConfig.RuleSets.Sets = []RuleSetConfig{{Name: "geoip-xx", List: RULE_SET_LIST_DENY, File: "/etc/bouheki/geoip-xx.txt"}}
+		assert.Nil(t, config.Validate())
+
+		config.RestrictedNetworkConfig.RuleSets.ChunkSize = 0
+		assert.NotNil(t, config.Validate())
+		config.RestrictedNetworkConfig.RuleSets.ChunkSize = 1000
+
+		for _, sets := range [][]RuleSetConfig{
+			{{Name: "../geoip", List: RULE_SET_LIST_DENY, File: "/etc/bouheki/geoip-xx.txt"}},
+			{{Name: "geoip-xx", List: "block", File: "/etc/bouheki/geoip-xx.txt"}},
+			{{Name: "geoip-xx", List: RULE_SET_LIST_DENY}},
+			{{Name: "geoip-xx", List: RULE_SET_LIST_DENY, File: "a"}, {Name: "geoip-xx", List: RULE_SET_LIST_ALLOW, File: "b"}},
+		} {
+			config.RestrictedNetworkConfig.RuleSets.Sets = sets
+			assert.NotNil(t, config.Validate())
+		}
+	})
+
+	t.Run("network.denial_records need an absolute dir and bounded records when enabled", func(t *testing.T) {
+		config := DefaultConfig()
+		config.RestrictedNetworkConfig.DenialRecords.Dir = "last-denials"
+		assert.Nil(t, config.Validate())
+
+		config.RestrictedNetworkConfig.DenialRecords = DenialRecordsConfig{Enable: true, Dir: DEFAULT_DENIAL_RECORDS_DIR, MaxRecords: 20, WriteInterval: time.Second, Retention: time.Hour}
+		assert.Nil(t, config.Validate())
+
+		for _, records := range []DenialRecordsConfig{
+			{Enable: true, Dir: "last-denials", MaxRecords: 20, Retention: time.Hour},
+			{Enable: true, Dir: DEFAULT_DENIAL_RECORDS_DIR, MaxRecords: 0, Retention: time.Hour},
+			{Enable: true, Dir: DEFAULT_DENIAL_RECORDS_DIR, MaxRecords: MAX_DENIAL_RECORDS + 1, Retention: time.Hour},
+			{Enable: true, Dir: DEFAULT_DENIAL_RECORDS_DIR, MaxRecords: 20, WriteInterval: -time.Second, Retention: time.Hour},
+			{Enable: true, Dir: DEFAULT_DENIAL_RECORDS_DIR, MaxRecords: 20},
+		} {
+			config.RestrictedNetworkConfig.DenialRecords = records
+			assert.NotNil(t, config.Validate())
+		}
+	})
+
+	t.Run("network.outcome_history needs an absolute dir and bounded entries when enabled", func(t *testing.T) {
+		config := DefaultConfig()
+		config.RestrictedNetworkConfig.OutcomeHistory.StateDir = "state"
+		assert.Nil(t, config.Validate())
+
+		config.RestrictedNetworkConfig.OutcomeHistory = OutcomeHistoryConfig{Enable: true, StateDir: DEFAULT_POLICY_SNAPSHOT_DIR, MaxEntries: 100, WriteInterval: time.Minute,
+			Suggestions: OutcomeSuggestionsConfig{Enable: true, MinConnections: 100}}
+		assert.Nil(t, config.Validate())
+
+		for _, history := range []OutcomeHistoryConfig{
+			{Enable: true, StateDir: "state", MaxEntries: 100, WriteInterval: time.Minute},
+			{Enable: true, StateDir: DEFAULT_POLICY_SNAPSHOT_DIR, MaxEntries: 0, WriteInterval: time.Minute},
+			{Enable: true, StateDir: DEFAULT_POLICY_SNAPSHOT_DIR, MaxEntries: MAX_OUTCOME_HISTORY_ENTRIES + 1, WriteInterval: time.Minute},
+			{Enable: true, StateDir: DEFAULT_POLICY_SNAPSHOT_DIR, MaxEntries: 100},
+			{Enable: true, StateDir: DEFAULT_POLICY_SNAPSHOT_DIR, MaxEntries: 100, WriteInterval: time.Minute, Suggestions: OutcomeSuggestionsConfig{Enable: true}},
+			{Enable: true, StateDir: DEFAULT_POLICY_SNAPSHOT_DIR, MaxEntries: 100, WriteInterval: time.Minute, Suggestions: OutcomeSuggestionsConfig{MinObserved: -time.Hour}},
+		} {
+			config.RestrictedNetworkConfig.OutcomeHistory = history
+			assert.NotNil(t, config.Validate())
+		}
+	})
+
+	t.Run("network.learning needs an absolute dir, prefixes and bounded entries with mode: learning", func(t *testing.T) {
+		config := DefaultConfig()
+		config.RestrictedNetworkConfig.Learning.StateDir = "state"
+		assert.Nil(t, config.Validate())
+
+		config.RestrictedNetworkConfig.Mode = MODE_LEARNING
+		config.RestrictedNetworkConfig.Learning = DefaultConfig().RestrictedNetworkConfig.Learning
+		assert.Nil(t, config.Validate())
+
+		for _, learning := range []LearningConfig{
+			{StateDir: "state", V4Prefix: 24, V6Prefix: 64, MaxEntries: 100, WriteInterval: time.Minute},
+			{StateDir: DEFAULT_POLICY_SNAPSHOT_DIR, V4Prefix: 33, V6Prefix: 64, MaxEntries: 100, WriteInterval: time.Minute},
+			{StateDir: DEFAULT_POLICY_SNAPSHOT_DIR, V4Prefix: 24, V6Prefix: 0, MaxEntries: 100, WriteInterval: time.Minute},
+			{StateDir: DEFAULT_POLICY_SNAPSHOT_DIR, V4Prefix: 24, V6Prefix: 64, MaxEntries: MAX_LEARNING_ENTRIES + 1, WriteInterval: time.Minute},
+			{StateDir: DEFAULT_POLICY_SNAPSHOT_DIR, V4Prefix: 24, V6Prefix: 64, MaxEntries: 100},
+		} {
+			config.RestrictedNetworkConfig.Learning = learning
+			assert.NotNil(t, config.Validate())
+		}
+
+		// The connections are learned from the audit events.
+		config.RestrictedNetworkConfig.Learning = DefaultConfig().RestrictedNetworkConfig.Learning
+		config.RestrictedNetworkConfig.Audit.Enabled = false
+		assert.EqualError(t, config.Validate(), "network.mode: learning reads the audit events, which network.audit.enabled: false turns off")
+	})
+
+	t.Run("network.rule_hits needs an absolute dir and a write interval when enabled", func(t *testing.T) {
+		config := DefaultConfig()
+		config.RestrictedNetworkConfig.RuleHits.Enable = true
+		assert.Nil(t, config.Validate())
+
+		for _, hits := range []RuleHitsConfig{
+			{Enable: true, StateDir: "state", WriteInterval: time.Minute},
+			{Enable: true, StateDir: DEFAULT_POLICY_SNAPSHOT_DIR},
+		} {
+			config.RestrictedNetworkConfig.RuleHits = hits
+			assert.NotNil(t, config.Validate())
+		}
+	})
+
+	t.Run("network.self_exemption needs a refresh interval when enabled", func(t *testing.T) {
+		config := DefaultConfig()
+		assert.True(t, config.RestrictedNetworkConfig.SelfExemption.Enable)
+		assert.Nil(t, config.Validate())
+
+		config.RestrictedNetworkConfig.SelfExemption.RefreshInterval = 0
+		assert.NotNil(t, config.Validate())
+
+		config.RestrictedNetworkConfig.SelfExemption.Enable = false
+		assert.Nil(t, config.Validate())
+	})
+
+	t.Run("network.policy_snapshot needs an absolute state_dir when enabled", func(t *testing.T) {
+		config := DefaultConfig()
+		config.RestrictedNetworkConfig.PolicySnapshot.StateDir = "bouheki"
+		assert.NotNil(t, config.Validate())
+
+		config.RestrictedNetworkConfig.PolicySnapshot.Enable = false
+		assert.Nil(t, config.Validate())
+	})
+
+	t.Run("network.policy_snapshot.versions must not be negative", func(t *testing.T) {
+		config := DefaultConfig()
+		config.RestrictedNetworkConfig.PolicySnapshot.Versions = 0
+		assert.Nil(t, config.Validate())
+
+		config.RestrictedNetworkConfig.PolicySnapshot.Versions = -1
+		assert.NotNil(t, config.Validate())
+	})
+
+	t.Run("resources need a known profile and positive sizes", func(t *testing.T) {
+		config := DefaultConfig()
+		config.Resources.Profile = RESOURCES_PROFILE_LARGE
+		config.Resources.MaxEntries = map[string]uint32{"denied_v4_cidr_list": 600000}
+		assert.Nil(t, config.Validate())
+
+		config.Resources.MaxEntries = map[string]uint32{"denied_v4_cidr_list": 0}
+		assert.NotNil(t, config.Validate())
+
+		config.Resources = ResourcesConfig{Profile: "huge"}
+		assert.NotNil(t, config.Validate())
+	})
+
+	t.Run("resources.deny_shards must be between 0 and the shards of the program", func(t *testing.T) {
+		config := DefaultConfig()
+		config.Resources.DenyShards = RESOURCES_MAX_DENY_SHARDS
+		assert.Nil(t, config.Validate())
+
+		config.Resources.DenyShards = RESOURCES_MAX_DENY_SHARDS + 1
+		assert.NotNil(t, config.Validate())
+
+		config.Resources.DenyShards = -1
+		assert.NotNil(t, config.Validate())
+	})
+
+	t.Run("network.audit.ringbuf_size must be a power of two pages", func(t *testing.T) {
+		config := DefaultConfig()
+		config.RestrictedNetworkConfig.Audit.RingBufSize = 1 << 20
+		assert.Nil(t, config.Validate())
+
+		config.RestrictedNetworkConfig.Audit.RingBufSize = 3 * 4096
+		assert.NotNil(t, config.Validate())
+
+		config.RestrictedNetworkConfig.Audit.RingBufSize = 1024
+		assert.NotNil(t, config.Validate())
+	})
+
+	t.Run("network.audit.dedup needs a window and the audit events", func(t *testing.T) {
+		config := DefaultConfig()
+		config.RestrictedNetworkConfig.Audit.Dedup.Enable = true
+		config.RestrictedNetworkConfig.Audit.Dedup.KernelWindow = time.Second
+		assert.Nil(t, config.Validate())
+
+		config.RestrictedNetworkConfig.Audit.Dedup.Window = 0
+		assert.NotNil(t, config.Validate())
+
+		config = DefaultConfig()
+		config.RestrictedNetworkConfig.Audit.Dedup.Enable = true
+		config.RestrictedNetworkConfig.Audit.Dedup.MaxKeys = 0
+		assert.NotNil(t, config.Validate())
+
+		config = DefaultConfig()
+		config.RestrictedNetworkConfig.Audit.Dedup.Enable = true
+		config.RestrictedNetworkConfig.Audit.Enabled = false
+		assert.NotNil(t, config.Validate())
+	})
+
+	t.Run("bpf.pin_path must be absolute", func(t *testing.T) {
+		config := DefaultConfig()
+		config.BPF.PinPath = "/sys/fs/bpf/bouheki"
+		assert.Nil(t, config.Validate())
+
+		config.BPF.PinPath = "bouheki"
+		assert.NotNil(t, config.Validate())
+	})
+
+	t.Run("bpf.keep_attached needs bpf.pin_path and excludes bpf.unpin_on_exit", func(t *testing.T) {
+		config := DefaultConfig()
+		assert.NotNil(t, config.CheckKeepAttached(true))
+
+		config.BPF.PinPath = "/sys/fs/bpf/bouheki"
+		assert.Nil(t, config.CheckKeepAttached(true))
+		assert.True(t, config.BPF.KeepAttached)
+		assert.Nil(t, config.Validate())
+
+		config.BPF.UnpinOnExit = true
+		assert.NotNil(t, config.Validate())
+	})
+
+	t.Run("startup.conditions need a name, a known type and policy, a target and a timeout", func(t *testing.T) {
+		config := DefaultConfig()
+		config.Startup.Conditions = []StartupCondition{
+			{Name: "dns", Type: STARTUP_CONDITION_DNS, Target: "example.com", Timeout: 30 * time.Second, Policy: STARTUP_POLICY_DEGRADED},
+			{Name: "containerd", Type: STARTUP_CONDITION_SOCKET, Target: "/run/containerd/containerd.sock", Timeout: time.Minute, Policy: STARTUP_POLICY_WAIT},
+		}
+		assert.Nil(t, config.Validate())
+
+		for _, condition := range []StartupCondition{
+			{Type: STARTUP_CONDITION_DNS, Target: "example.com", Timeout: time.Second, Policy: STARTUP_POLICY_FAIL},
+			{Name: "dns", Type: STARTUP_CONDITION_DNS, Target: "example.com", Timeout: time.Second, Policy: STARTUP_POLICY_FAIL},
+			{Name: "kubelet", Type: "tcp", Target: "127.0.0.1:10250", Timeout: time.Second, Policy: STARTUP_POLICY_FAIL},
+			{Name: "kubelet", Type: STARTUP_CONDITION_HTTP, Timeout: time.Second, Policy: STARTUP_POLICY_FAIL},
+			{Name: "kubelet", Type: STARTUP_CONDITION_HTTP, Target: "http://127.0.0.1:10255/pods", Timeout: time.Second, Policy: "retry"},
+			{Name: "kubelet", Type: STARTUP_CONDITION_HTTP, Target: "http://127.0.0.1:10255/pods", Policy: STARTUP_POLICY_FAIL},
+			{Name: "kubelet", Type: STARTUP_CONDITION_HTTP, Target: "http://127.0.0.1:10255/pods", Timeout: time.Second, Interval: -time.Second, Policy: STARTUP_POLICY_FAIL},
+		} {
+			config.Startup.Conditions = []StartupCondition{
+				{Name: "dns", Type: STARTUP_CONDITION_DNS, Target: "example.com", Timeout: 30 * time.Second, Policy: STARTUP_POLICY_DEGRADED},
+				condition,
+			}
+			assert.NotNil(t, config.Validate())
+		}
+	})
+
+	t.Run("alerts.rules need a name, a metric or an event, and a window", func(t *testing.T) {
+		config := DefaultConfig()
+		config.Alerts.Rules = []AlertRule{
+			{Name: "blocks", Event: &AlertEventFilter{Audit: ALERT_AUDIT_NETWORK, Action: "BLOCKED"}, Window: 5 * time.Minute, Threshold: 50, Cooldown: 15 * time.Minute},
+			{Name: "mismatches", Metric: "verification_mismatch_total", Window: time.Minute},
+		}
+		assert.Nil(t, config.Validate())
+
+		for _, rule := range []AlertRule{
+			{Metric: "verification_mismatch_total", Window: time.Minute},
+			{Name: "blocks", Metric: "verification_mismatch_total", Window: time.Minute},
+			{Name: "both", Metric: "verification_mismatch_total", Event: &AlertEventFilter{}, Window: time.Minute},
+			{Name: "neither", Window: time.Minute},
+			{Name: "dns", Event: &AlertEventFilter{Audit: "dns"}, Window: time.Minute},
+			{Name: "windowless", Metric: "verification_mismatch_total"},
+			{Name: "negative", Metric: "verification_mismatch_total", Window: time.Minute, Threshold: -1},
+			{Name: "negative", Metric: "verification_mismatch_total", Window: time.Minute, Cooldown: -time.Minute},
+		} {
+			config.Alerts.Rules = []AlertRule{config.Alerts.Rules[0], rule}
+			assert.NotNil(t, config.Validate(), rule.Name)
+		}
+
+		config.Alerts.Rules = config.Alerts.Rules[:1]
+		config.Alerts.Interval = 0
+		assert.NotNil(t, config.Validate())
+	})
+
+	t.Run("network.audit.enabled: false conflicts with what reads the events", func(t *testing.T) {
+		config := DefaultConfig()
+		config.RestrictedNetworkConfig.Audit.Enabled = false
+		assert.Nil(t, config.Validate())
+
+		config.RestrictedNetworkConfig.Coverage.Enable = true
+		err := config.Validate()
+		assert.NotNil(t, err)
+		assert.Contains(t, err.Error(), "network.coverage")
+	})
+
+	t.Run("event_output needs a known type, an absolute path and permission bits", func(t *testing.T) {
+		config := DefaultConfig()
+		config.EventOutput.Enable = true
+		for _, typ := range []string{EVENT_OUTPUT_FIFO, EVENT_OUTPUT_UNIXGRAM} {
+			config.EventOutput.Type = typ
+			assert.Nil(t, config.Validate())
+		}
+
+		for _, output := range []EventOutputConfig{
+			{Enable: true, Type: "tcp", Path: "/var/run/bouheki.events"},
+			{Enable: true, Type: EVENT_OUTPUT_FIFO, Path: "bouheki.events"},
+			{Enable: true, Type: EVENT_OUTPUT_FIFO, Path: "/var/run/bouheki.events", Mode: 01777},
+		} {
+			config.EventOutput = output
+			assert.NotNil(t, config.Validate())
+		}
+	})
+
+	t.Run("falco_output needs a known type, an http URL or an absolute path, and a spool", func(t *testing.T) {
+		config := DefaultConfig()
+		config.FalcoOutput.Enable = true
+		for _, typ := range []string{FALCO_OUTPUT_FALCOSIDEKICK, FALCO_OUTPUT_FILE} {
+			config.FalcoOutput.Type = typ
+			assert.Nil(t, config.Validate())
+		}
+
+		for key, update := range map[string]func(c *FalcoOutputConfig){
+			"falco_output.type":       func(c *FalcoOutputConfig) { c.Type = "grpc" },
+			"falco_output.url":        func(c *FalcoOutputConfig) { c.URL = "falcosidekick:2801" },
+			"falco_output.timeout":    func(c *FalcoOutputConfig) { c.Timeout = 0 },
+			"falco_output.queue_size": func(c *FalcoOutputConfig) { c.QueueSize = 0 },
+			"falco_output.spool.dir":  func(c *FalcoOutputConfig) { c.Spool.Dir = "" },
+			"falco_output.filter":     func(c *FalcoOutputConfig) { c.Filter = &AlertEventFilter{Audit: "dns"} },
+			"falco_output.path": func(c *FalcoOutputConfig) {
+				c.Type = FALCO_OUTPUT_FILE
+				c.Path = "falco.json"
+			},
+		} {
+			config := DefaultConfig()
+			config.FalcoOutput.Enable = true
+			update(&config.FalcoOutput)
+			err := config.Validate()
+			assert.NotNil(t, err, key)
+			assert.Contains(t, err.Error(), key)
+		}
+	})
+
+	t.Run("audit_output needs the json format, an absolute file and a positive max_size", func(t *testing.T) {
+		config := DefaultConfig()
+		config.AuditOutput.Enable = true
+		assert.Nil(t, config.Validate())
+
+		for key, update := range map[string]func(c *AuditOutputConfig){
+			"audit_output.format":   func(c *AuditOutputConfig) { c.Format = "text" },
+			"audit_output.file":     func(c *AuditOutputConfig) { c.File = "audit.jsonl" },
+			"audit_output.max_size": func(c *AuditOutputConfig) { c.MaxSize = 0 },
+			"audit_output.max_age":  func(c *AuditOutputConfig) { c.MaxAge = -1 },
+			"audit_output.filter":   func(c *AuditOutputConfig) { c.Filter = &AlertEventFilter{Audit: "dns"} },
+		} {
+			config := DefaultConfig()
+			config.AuditOutput.Enable = true
+			update(&config.AuditOutput)
+			err := config.Validate()
+			assert.NotNil(t, err, key)
+			assert.Contains(t, err.Error(), key)
+		}
+	})
+
+	t.Run("audit_output.webhook needs an http URL, a body template, a rate limit and a window", func(t *testing.T) {
+		config := DefaultConfig()
+		config.AuditOutput.Webhook.Enable = true
+		config.AuditOutput.Webhook.URL = "https://hooks.example.com/bouheki"
+		assert.Nil(t, config.Validate())
+
+		for key, update := range map[string]func(c *AuditWebhookConfig){
+			"audit_output.webhook.url":            func(c *AuditWebhookConfig) { c.URL = "hooks.example.com" },
+			"audit_output.webhook.timeout":        func(c *AuditWebhookConfig) { c.Timeout = 0 },
+			"audit_output.webhook.body":           func(c *AuditWebhookConfig) { c.Body = "{{.Comm" },
+			"audit_output.webhook.rate_limit":     func(c *AuditWebhookConfig) { c.RateLimit = 0 },
+			"audit_output.webhook.window":         func(c *AuditWebhookConfig) { c.Window = 0 },
+			"audit_output.webhook.queue_size":     func(c *AuditWebhookConfig) { c.QueueSize = 0 },
+			"audit_output.webhook.max_retries":    func(c *AuditWebhookConfig) { c.MaxRetries = -1 },
+			"audit_output.webhook.retry_interval": func(c *AuditWebhookConfig) { c.MaxRetryInterval = c.RetryInterval / 2 },
+			"audit_output.webhook.filter":         func(c *AuditWebhookConfig) { c.Filter = &AlertEventFilter{Audit: "dns"} },
+			"audit_output.webhook.spool.dir":      func(c *AuditWebhookConfig) { c.Spool = &spoolconf.Config{} },
+		} {
+			config := DefaultConfig()
+			config.AuditOutput.Webhook.Enable = true
+			config.AuditOutput.Webhook.URL = "https://hooks.example.com/bouheki"
+			update(&config.AuditOutput.Webhook)
+			err := config.Validate()
+			assert.NotNil(t, err, key)
+			assert.Contains(t, err.Error(), key)
+		}
+	})
+
+	t.Run("containers needs a known runtime with an absolute socket or state_dir", func(t *testing.T) {
+		config := DefaultConfig()
+		config.Containers.Enable = true
+		for _, runtime := range []string{CONTAINER_RUNTIME_NONE, CONTAINER_RUNTIME_DOCKER, CONTAINER_RUNTIME_CONTAINERD} {
+			config.Containers.Runtime = runtime
+			assert.Nil(t, config.Validate())
+		}
+
+		for key, update := range map[string]func(c *ContainersConfig){
+			"containers.runtime":    func(c *ContainersConfig) { c.Runtime = "cri-o" },
+			"containers.socket":     func(c *ContainersConfig) { c.Runtime, c.Socket = CONTAINER_RUNTIME_DOCKER, "docker.sock" },
+			"containers.state_dir":  func(c *ContainersConfig) { c.Runtime, c.StateDir = CONTAINER_RUNTIME_CONTAINERD, "" },
+			"containers.timeout":    func(c *ContainersConfig) { c.Timeout = 0 },
+			"containers.cache_ttl":  func(c *ContainersConfig) { c.CacheTTL = 0 },
+			"containers.cache_size": func(c *ContainersConfig) { c.CacheSize = 0 },
+		} {
+			config := DefaultConfig()
+			config.Containers.Enable = true
+			update(&config.Containers)
+			err := config.Validate()
+			assert.NotNil(t, err, key)
+			assert.Contains(t, err.Error(), key)
+		}
+	})
+
+	t.Run("network.command.host_check.extra_dirs must be absolute", func(t *testing.T) {
+		config := DefaultConfig()
+		config.RestrictedNetworkConfig.Command.HostCheck.ExtraDirs = []string{"/opt/agent/bin"}
+		assert.Nil(t, config.Validate())
+
+		config.RestrictedNetworkConfig.Command.HostCheck.ExtraDirs = []string{"/opt/agent/bin", "bin"}
+		err := config.Validate()
+		assert.NotNil(t, err)
+		assert.Contains(t, err.Error(), "extra_dirs[1]")
+	})
+
+	t.Run("protocol rules need tcp, udp or all and no group references", func(t *testing.T) {
+		config := DefaultConfig()
+		config.RestrictedNetworkConfig.CIDR.Protocols = []ProtocolRulesConfig{{Protocol: PROTOCOL_UDP, Allow: []string{"10.0.0.53/32"}}, {Protocol: PROTOCOL_ALL}}
+		config.RestrictedNetworkConfig.Domain.Protocols = []ProtocolRulesConfig{{Protocol: PROTOCOL_TCP, Deny: []string{"example.com"}}}
+		assert.Nil(t, config.Validate())
+
+		config.RestrictedNetworkConfig.Domain.Protocols[0].Protocol = "icmp"
+		err := config.Validate()
+		assert.NotNil(t, err)
+		assert.Contains(t, err.Error(), "network.domain.protocols[0].protocol must be one of tcp, udp or all")
+
+		config.RestrictedNetworkConfig.Domain.Protocols = nil
+		config.RestrictedNetworkConfig.CIDR.Protocols[1].Deny = []string{"group:office"}
+		err = config.Validate()
+		assert.NotNil(t, err)
+		assert.Contains(t, err.Error(), "network.cidr.protocols[1]: group references are not supported")
+	})
+
+	t.Run("network.ports need ports or ranges between 1 and 65535", func(t *testing.T) {
+		config := DefaultConfig()
+		config.RestrictedNetworkConfig.Ports.Allow = []string{"443", "5432", "8000-8999", "1-65535"}
+		config.RestrictedNetworkConfig.Ports.Deny = []string{"8080"}
+		assert.Nil(t, config.Validate())
+
+		for _, entry := range []string{"", "0", "65536", "http", "8999-8000", "8000-", "-8000", "1-2-3"} {
+			config.RestrictedNetworkConfig.Ports.Deny = []string{entry}
+			err := config.Validate()
+			if assert.NotNil(t, err, entry) {
+				assert.Contains(t, err.Error(), "network.ports.deny", entry)
+			}
+		}
+
+		config.RestrictedNetworkConfig.Ports.Deny = []string{"8080"}
+		config.RestrictedNetworkConfig.Ingress.Ports.Deny = []string{"0"}
+		err := config.Validate()
+		if assert.NotNil(t, err) {
+			assert.Contains(t, err.Error(), "network.ingress.ports.deny")
+		}
+
+		r, err := ParsePortRange(" 8000 - 8999 ")
+		assert.Nil(t, err)
+		assert.Equal(t, PortRange{First: 8000, Last: 8999}, r)
+		assert.Equal(t, "8000-8999", r.String())
+		r, _ = ParsePortRange("443-443")
+		assert.Equal(t, "443", r.String())
+	})
+
+	t.Run("event filters match the local address of the network events", func(t *testing.T) {
+		config := DefaultConfig()
+		config.EventOutput = EventOutputConfig{Enable: true, Type: EVENT_OUTPUT_UNIXGRAM, Path: "/var/run/bouheki.events"}
+		for _, filter := range []AlertEventFilter{
+			{Audit: ALERT_AUDIT_NETWORK, LocalAddr: "10.0.0.0/8", LocalPort: 8080},
+			{LocalAddr: "2001:db8::2"},
+			{LocalAddr: ALERT_LOCAL_ADDR_UNBOUND},
+			{LocalPort: 53},
+		} {
+			filter := filter
+			config.EventOutput.Filter = &filter
+			assert.Nil(t, config.Validate(), filter)
+			config.Alerts.Rules = []AlertRule{{Name: "local", Event: &filter, Window: time.Minute}}
+			assert.Nil(t, config.Validate(), filter)
+		}
+
+		for _, filter := range []AlertEventFilter{
+			{LocalAddr: "10.0.0.0/33"},
+			{LocalAddr: "localhost"},
+			{LocalAddr: ALERT_LOCAL_ADDR_UNBOUND, LocalPort: 8080},
+			{Audit: ALERT_AUDIT_MOUNT, LocalPort: 8080},
+		} {
+			filter := filter
+			config.Alerts.Rules = nil
+			config.EventOutput.Filter = &filter
+			err := config.Validate()
+			assert.NotNil(t, err, filter)
+			assert.Contains(t, err.Error(), "event_output.filter.local_")
+
+			config.EventOutput.Filter = nil
+			config.Alerts.Rules = []AlertRule{{Name: "local", Event: &filter, Window: time.Minute}}
+			err = config.Validate()
+			assert.NotNil(t, err, filter)
+			assert.Contains(t, err.Error(), "alerts.rules[0] (local): event.local_")
+		}
+
+		local, err := AlertEventFilter{LocalAddr: "10.0.0.2"}.LocalNet()
+		assert.Nil(t, err)
+		assert.Equal(t, "10.0.0.2/32", local.String())
+		local, err = AlertEventFilter{LocalAddr: ALERT_LOCAL_ADDR_UNBOUND}.LocalNet()
+		assert.Nil(t, err)
+		assert.Nil(t, local)
+	})
+
+	t.Run("event filters match the destination tags of the network events", func(t *testing.T) {
+		config := DefaultConfig()
+		config.EventOutput = EventOutputConfig{Enable: true, Type: EVENT_OUTPUT_UNIXGRAM, Path: "/var/run/bouheki.events"}
+		config.EventOutput.Filter = &AlertEventFilter{Audit: ALERT_AUDIT_NETWORK, DestinationTags: []string{"cloud-metadata"}}
+		assert.Nil(t, config.Validate())
+
+		config.EventOutput.Filter = &AlertEventFilter{DestinationTags: []string{"cloud-metadata", ""}}
+		assert.EqualError(t, config.Validate(), "event_output.filter.destination_tags[1] must not be empty")
+		config.EventOutput.Filter = &AlertEventFilter{Audit: ALERT_AUDIT_FILEACCESS, DestinationTags: []string{"cloud-metadata"}}
+		assert.EqualError(t, config.Validate(), "event_output.filter.destination_tags only match the network events")
+	})
+
+	t.Run("fallback_policy.reload_failures must not be negative", func(t *testing.T) {
+		config := DefaultConfig()
+		config.FallbackPolicy = FallbackPolicyConfig{Path: "/etc/bouheki/fallback.yaml", ReloadFailures: 3}
+		assert.Nil(t, config.Validate())
+
+		config.FallbackPolicy.ReloadFailures = -1
+		err := config.Validate()
+		assert.NotNil(t, err)
+		assert.Contains(t, err.Error(), "fallback_policy.reload_failures")
+	})
+
+	t.Run("admin.freeze_windows need a name and a valid range", func(t *testing.T) {
+		config := DefaultConfig()
+		config.Admin.FreezeWindows = []FreezeWindow{{Name: "year-end", Start: "2026-12-20T00:00", End: "2027-01-04T09:00", Timezone: "Asia/Tokyo"}}
+		assert.Nil(t, config.Validate())
+
+		for _, window := range []FreezeWindow{
+			{Start: "2026-12-20T00:00", End: "2027-01-04T09:00"},
+			{Name: "year-end", Start: "2026-12-20", End: "2027-01-04T09:00"},
+			{Name: "year-end", Start: "2027-01-04T09:00", End: "2026-12-20T00:00"},
+			{Name: "year-end", Start: "2026-12-20T00:00", End: "2027-01-04T09:00", Timezone: "Mars/Olympus"},
+		} {
+			config.Admin.FreezeWindows = []FreezeWindow{window}
+			assert.NotNil(t, config.Validate())
+		}
+	})
+
+	t.Run("network.policy.default: deny with only deny lists denies everything", func(t *testing.T) {
+		config := DefaultConfig()
+		config.RestrictedNetworkConfig.CIDR.Allow = []string{}
+		config.RestrictedNetworkConfig.CIDR.Deny = []string{"10.0.0.0/8"}
+		err := config.Validate()
+		assert.NotNil(t, err)
+		assert.Contains(t, err.Error(), "network.policy.default")
+
+		config.RestrictedNetworkConfig.Decision.Default = DEFAULT_ACTION_ALLOW
+		assert.Nil(t, config.Validate())
+
+		config.RestrictedNetworkConfig.Decision.Default = "permit"
+		assert.NotNil(t, config.Validate())
+
+		config.RestrictedNetworkConfig.Decision = DecisionConfig{Default: DEFAULT_ACTION_DENY, Precedence: "allow-last"}
+		config.RestrictedNetworkConfig.CIDR.Allow = []string{"10.0.1.0/24"}
+		assert.NotNil(t, config.Validate())
+	})
+}
+
+func TestNewConfigClassifiesErrors(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		assert.Nil(t, os.WriteFile(path, []byte(content), 0600))
+		return path
+	}
+
+	tests := []struct {
+		name string
+		path string
+	}{
+		{name: "missing file", path: filepath.Join(dir, "missing.yaml")},
+		{name: "invalid yaml", path: write("invalid.yaml", "network: [")},
+		{name: "invalid value", path: write("sample_rate.yaml", "network:\n  verification:\n    sample_rate: 2\n")},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NewConfig(test.path)
+			assert.NotNil(t, err)
+			assert.Equal(t, errkind.Config, errkind.KindOf(err))
+		})
+	}
+}
+
+func TestNormalizeCommands(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "command.yaml")
+
+	assert.Nil(t, os.WriteFile(path, []byte("network:\n  command:\n    allow: [\"wget \"]\n    deny: [\" Curl\"]\n"), 0600))
+	config, err := NewConfig(path)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"wget"}, config.RestrictedNetworkConfig.Command.Allow)
+	assert.Equal(t, []string{"Curl"}, config.RestrictedNetworkConfig.Command.Deny)
+
+	assert.Nil(t, os.WriteFile(path, []byte("network:\n  command:\n    case_insensitive: true\n    deny: [\" Curl\"]\n"), 0600))
+	config, err = NewConfig(path)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"curl"}, config.RestrictedNetworkConfig.Command.Deny)
+
+	assert.Nil(t, os.WriteFile(path, []byte("network:\n  command:\n    deny: [\"cu\\0rl\"]\n"), 0600))
+	_, err = NewConfig(path)
+	assert.NotNil(t, err)
+
+	assert.Nil(t, os.WriteFile(path, []byte("network:\n  command:\n    deny: [\"  \"]\n"), 0600))
+	_, err = NewConfig(path)
+	assert.NotNil(t, err)
+}
+
+func TestNormalizeProtocolRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "protocols.yaml")
+	assert.Nil(t, os.WriteFile(path, []byte(`network:
+  cidr:
+    allow: [10.0.0.0/8]
+    protocols:
+      - protocol: UDP
+        allow: [10.0.0.53/32]
+      - protocol: all
+        allow: [192.0.2.0/24]
+        deny: [192.0.2.1/32]
+      - protocol: udp
+        deny: [0.0.0.0/0]
+`), 0600))
+	config, err := NewConfig(path)
+	assert.Nil(t, err)
+
+	cidr := config.RestrictedNetworkConfig.CIDR
+	assert.Equal(t, []string{"10.0.0.0/8", "192.0.2.0/24"}, cidr.Allow)
+	assert.Equal(t, []string{"192.0.2.1/32"}, cidr.Deny)
+	assert.Len(t, cidr.Protocols, 2)
+
+	allow, deny := ProtocolLists(cidr.Protocols, PROTOCOL_UDP)
+	assert.Equal(t, []string{"10.0.0.53/32"}, allow)
+	assert.Equal(t, []string{"0.0.0.0/0"}, deny)
+	allow, deny = ProtocolLists(cidr.Protocols, PROTOCOL_TCP)
+	assert.Empty(t, allow)
+	assert.Empty(t, deny)
+
+	// A rule of every protocol that is not folded applies to both.
+	allow, _ = ProtocolLists([]ProtocolRulesConfig{{Protocol: PROTOCOL_ALL, Allow: []string{"192.0.2.0/24"}}}, PROTOCOL_TCP)
+	assert.Equal(t, []string{"192.0.2.0/24"}, allow)
+}
+
+func TestMatchWildcardDomain(t *testing.T) {
+	for _, c := range []struct {
+		pattern, name string
+		match         bool
+	}{
+		{"*.example.com", "www.example.com.", true},
+		{"*.example.com", "a.b.example.com", true},
+		{"*.Example.com", "WWW.example.COM.", true},
+		{"*.example.com", "example.com.", false},
+		{"*.example.com", "badexample.com.", false},
+		{"*.example.com", "www.example.org.", false},
+		{"example.com", "www.example.com.", false},
+	} {
+		assert.Equal(t, c.match, MatchWildcardDomain(c.pattern, c.name), c.pattern+" "+c.name)
+	}
+}
+
+func TestDomainRefreshInterval(t *testing.T) {
+	refresh := DefaultConfig().RestrictedNetworkConfig.Domain.Refresh
+	assert.Equal(t, 10*time.Second, refresh.Interval(0))
+	assert.Equal(t, 10*time.Second, refresh.Interval(5*time.Second))
+	assert.Equal(t, 5*time.Minute, refresh.Interval(5*time.Minute))
+	assert.Equal(t, time.Hour, refresh.Interval(24*time.Hour))
+}
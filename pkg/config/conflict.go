@@ -0,0 +1,177 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// TASK_COMM_LEN is the size of the kernel's task comm including the trailing NUL.
+// Commands longer than TASK_COMM_LEN-1 are truncated by the kernel.
+const TASK_COMM_LEN = 16
+
+// Conflict is an entry that is in both the allow and deny list after normalization.
+// The deny side wins in the BPF program, unless AllowWins.
+type Conflict struct {
+	List       string
+	Allow      string
+	Deny       string
+	Normalized string
+	// Overlap is set when the entries are different ranges, Normalized being the uids of both.
+	Overlap bool
+	// AllowWins is set for the destination lists with network.policy.precedence: allow-first.
+	AllowWins bool
+}
+
+func (c Conflict) String() string {
+	winner := "deny wins"
+	if c.AllowWins {
+		winner = "allow wins"
+	}
+	if c.Allow == c.Deny {
+		return fmt.Sprintf("%s: %q is in both allow and deny, %s", c.List, c.Allow, winner)
+	}
+	if c.Overlap {
+		return fmt.Sprintf("%s: allow %q and deny %q overlap on %q, %s", c.List, c.Allow, c.Deny, c.Normalized, winner)
+	}
+	return fmt.Sprintf("%s: allow %q and deny %q are both %q, %s", c.List, c.Allow, c.Deny, c.Normalized, winner)
+}
+
+// Conflicts returns the entries of the network lists that are in both allow and deny.
+func (c *Config) Conflicts() []Conflict {
+	network := c.RestrictedNetworkConfig
+	conflicts := []Conflict{}
+
+	conflicts = append(conflicts, findConflicts("network.cidr", network.CIDR.Allow, network.CIDR.Deny, normalizeCIDR)...)
+	conflicts = append(conflicts, findConflicts("network.domain", network.Domain.Allow, network.Domain.Deny, normalizeDomain)...)
+	conflicts = append(conflicts, findConflicts("network.command", network.Command.Allow, network.Command.Deny, normalizeCommand)...)
+	conflicts = append(conflicts, findUIDConflicts(network.UID.Allow, network.UID.Deny)...)
+	conflicts = append(conflicts, findConflicts("network.gid", network.GID.Allow, network.GID.Deny, normalizeGID)...)
+	conflicts = append(conflicts, findConflicts("network.ports", network.Ports.Allow, network.Ports.Deny, normalizePortRange)...)
+	conflicts = append(conflicts, findConflicts("network.ingress.cidr", network.Ingress.CIDR.Allow, network.Ingress.CIDR.Deny, normalizeCIDR)...)
+	conflicts = append(conflicts, findConflicts("network.ingress.ports", network.Ingress.Ports.Allow, network.Ingress.Ports.Deny, normalizePortRange)...)
+	for _, protocol := range []string{PROTOCOL_TCP, PROTOCOL_UDP} {
+		allow, deny := ProtocolLists(network.CIDR.Protocols, protocol)
+		conflicts = append(conflicts, findConflicts(fmt.Sprintf("network.cidr.protocols[%s]", protocol), allow, deny, normalizeCIDR)...)
+		allow, deny = ProtocolLists(network.Domain.Protocols, protocol)
+		conflicts = append(conflicts, findConflicts(fmt.Sprintf("network.domain.protocols[%s]", protocol), allow, deny, normalizeDomain)...)
+	}
+
+	if network.Decision.Precedence == PRECEDENCE_ALLOW_FIRST {
+		for i := range conflicts {
+			if strings.HasPrefix(conflicts[i].List, "network.cidr") || strings.HasPrefix(conflicts[i].List, "network.domain") {
+				conflicts[i].AllowWins = true
+			}
+		}
+	}
+	return conflicts
+}
+
+// CheckConflicts returns an error describing the conflicts unless allowConflicts is set.
+// The conflicts are returned either way so the caller can report them.
+func (c *Config) CheckConflicts(allowConflicts bool) ([]Conflict, error) {
+	conflicts := c.Conflicts()
+	if len(conflicts) == 0 || allowConflicts {
+		return conflicts, nil
+	}
+
+	messages := []string{}
+	for _, conflict := range conflicts {
+		messages = append(messages, conflict.String())
+	}
+
+	return conflicts, fmt.Errorf("%d conflicting entries in allow and deny lists (use --allow-conflicts to only warn): %s", len(conflicts), strings.Join(messages, "; "))
+}
+
+// findConflicts returns the entries of allow and deny that normalize to the same value.
+// Entries that can not be normalized are left to the other validations.
+func findConflicts(list string, allow []string, deny []string, normalize func(string) (string, bool)) []Conflict {
+	allowed := map[string]string{}
+	for _, entry := range allow {
+		if normalized, ok := normalize(entry); ok {
+			if _, exists := allowed[normalized]; !exists {
+				allowed[normalized] = entry
+			}
+		}
+	}
+
+	conflicts := []Conflict{}
+	for _, entry := range deny {
+		normalized, ok := normalize(entry)
+		if !ok {
+			continue
+		}
+		if allowedEntry, exists := allowed[normalized]; exists {
+			conflicts = append(conflicts, Conflict{List: list, Allow: allowedEntry, Deny: entry, Normalized: normalized})
+		}
+	}
+
+	return conflicts
+}
+
+// findUIDConflicts returns the entries of network.uid.allow and deny whose uids overlap. A deny
+// range inside a larger allow range only carves its uids out of it, which is not a conflict; any
+// other overlap leaves the allow entry, or a part of it, without effect.
+func findUIDConflicts(allow []string, deny []string) []Conflict {
+	conflicts := []Conflict{}
+	for _, d := range deny {
+		denied, err := ParseUIDRange(d)
+		if err != nil {
+			continue
+		}
+		for _, a := range allow {
+			allowed, err := ParseUIDRange(a)
+			if err != nil {
+				continue
+			}
+			overlap, ok := allowed.overlap(denied)
+			if !ok || (overlap == denied && denied != allowed) {
+				continue
+			}
+			conflicts = append(conflicts, Conflict{List: "network.uid", Allow: a, Deny: d, Normalized: overlap.String(), Overlap: denied != allowed})
+			break
+		}
+	}
+	return conflicts
+}
+
+// normalizeCIDR masks the address, e.g. 10.1.2.3/16 -> 10.1.0.0/16, and drops an IPv6 zone.
+func normalizeCIDR(entry string) (string, bool) {
+	_, n, err := net.ParseCIDR(stripZone(entry))
+	if err != nil {
+		return "", false
+	}
+
+	return Unmap(n).String(), true
+}
+
+func normalizeDomain(entry string) (string, bool) {
+	normalized := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(entry)), ".")
+	return normalized, normalized != ""
+}
+
+func normalizeCommand(entry string) (string, bool) {
+	if len(entry) > TASK_COMM_LEN-1 {
+		entry = entry[:TASK_COMM_LEN-1]
+	}
+	return entry, entry != ""
+}
+
+// normalizePortRange formats the range as it is parsed, e.g. 443-443 -> 443. Ranges that only
+// overlap are not conflicts: the ports of the overlap are denied.
+func normalizePortRange(entry string) (string, bool) {
+	r, err := ParsePortRange(entry)
+	if err != nil {
+		return "", false
+	}
+	return r.String(), true
+}
+
+func normalizeGID(entry string) (string, bool) {
+	gid, err := ParseGID(entry)
+	if err != nil {
+		return "", false
+	}
+	return strconv.FormatUint(uint64(gid), 10), true
+}
@@ -0,0 +1,153 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConflicts(t *testing.T) {
+	tests := []struct {
+		name     string
+		modify   func(c *Config)
+		expected []Conflict
+	}{
+		{
+			name:     "no conflicts",
+			modify:   func(c *Config) {},
+			expected: []Conflict{},
+		},
+		{
+			name: "cidr conflicts after masking",
+			modify: func(c *Config) {
+				c.RestrictedNetworkConfig.CIDR.Allow = []string{"10.1.2.3/16"}
+				c.RestrictedNetworkConfig.CIDR.Deny = []string{"10.1.0.0/16", "10.2.0.0/16"}
+			},
+			expected: []Conflict{{List: "network.cidr", Allow: "10.1.2.3/16", Deny: "10.1.0.0/16", Normalized: "10.1.0.0/16"}},
+		},
+		{
+			name: "cidr conflicts ignoring the IPv6 zone",
+			modify: func(c *Config) {
+				c.RestrictedNetworkConfig.CIDR.Allow = []string{"fe80::1%eth0/64"}
+				c.RestrictedNetworkConfig.CIDR.Deny = []string{"fe80::/64"}
+			},
+			expected: []Conflict{{List: "network.cidr", Allow: "fe80::1%eth0/64", Deny: "fe80::/64", Normalized: "fe80::/64"}},
+		},
+		{
+			name: "domain conflicts after normalization",
+			modify: func(c *Config) {
+				c.RestrictedNetworkConfig.Domain.Allow = []string{"Example.com."}
+				c.RestrictedNetworkConfig.Domain.Deny = []string{"example.com"}
+			},
+			expected: []Conflict{{List: "network.domain", Allow: "Example.com.", Deny: "example.com", Normalized: "example.com"}},
+		},
+		{
+			name: "allow wins the destination conflicts with allow-first",
+			modify: func(c *Config) {
+				c.RestrictedNetworkConfig.Decision.Precedence = PRECEDENCE_ALLOW_FIRST
+				c.RestrictedNetworkConfig.CIDR.Allow = []string{"10.1.0.0/16"}
+				c.RestrictedNetworkConfig.CIDR.Deny = []string{"10.1.0.0/16"}
+				c.RestrictedNetworkConfig.Command.Allow = []string{"curl"}
+				c.RestrictedNetworkConfig.Command.Deny = []string{"curl"}
+			},
+			expected: []Conflict{
+				{List: "network.cidr", Allow: "10.1.0.0/16", Deny: "10.1.0.0/16", Normalized: "10.1.0.0/16", AllowWins: true},
+				{List: "network.command", Allow: "curl", Deny: "curl", Normalized: "curl"},
+			},
+		},
+		{
+			name: "command conflicts after truncation",
+			modify: func(c *Config) {
+				c.RestrictedNetworkConfig.Command.Allow = []string{"very-long-command-a"}
+				c.RestrictedNetworkConfig.Command.Deny = []string{"very-long-command-b", "curl"}
+			},
+			expected: []Conflict{{List: "network.command", Allow: "very-long-command-a", Deny: "very-long-command-b", Normalized: "very-long-comma"}},
+		},
+		{
+			name: "uid and gid conflicts",
+			modify: func(c *Config) {
+				c.RestrictedNetworkConfig.UID.Allow = []string{"0", "1000"}
+				c.RestrictedNetworkConfig.UID.Deny = []string{"1000"}
+				c.RestrictedNetworkConfig.GID.Allow = []string{"0"}
+				c.RestrictedNetworkConfig.GID.Deny = []string{"0"}
+			},
+			expected: []Conflict{
+				{List: "network.uid", Allow: "1000", Deny: "1000", Normalized: "1000"},
+				{List: "network.gid", Allow: "0", Deny: "0", Normalized: "0"},
+			},
+		},
+		{
+			name: "uid ranges that overlap, but not a deny range inside an allow range",
+			modify: func(c *Config) {
+				c.RestrictedNetworkConfig.UID.Allow = []string{"10000-59999", "0-0", "500"}
+				c.RestrictedNetworkConfig.UID.Deny = []string{"10000-10099", "0", "60000-60010", "400-600"}
+			},
+			expected: []Conflict{
+				{List: "network.uid", Allow: "0-0", Deny: "0", Normalized: "0"},
+				{List: "network.uid", Allow: "500", Deny: "400-600", Normalized: "500", Overlap: true},
+			},
+		},
+		{
+			name: "port conflicts after parsing, but not overlapping ranges",
+			modify: func(c *Config) {
+				c.RestrictedNetworkConfig.Ports.Allow = []string{"443", "8000-8999"}
+				c.RestrictedNetworkConfig.Ports.Deny = []string{"443-443", "8080"}
+			},
+			expected: []Conflict{{List: "network.ports", Allow: "443", Deny: "443-443", Normalized: "443"}},
+		},
+		{
+			name: "ingress conflicts are reported apart from the connections",
+			modify: func(c *Config) {
+				c.RestrictedNetworkConfig.CIDR.Allow = []string{"127.0.0.1/32"}
+				c.RestrictedNetworkConfig.Ingress.CIDR.Allow = []string{"127.0.0.1/8"}
+				c.RestrictedNetworkConfig.Ingress.CIDR.Deny = []string{"127.0.0.0/8"}
+				c.RestrictedNetworkConfig.Ingress.Ports.Allow = []string{"8080"}
+				c.RestrictedNetworkConfig.Ports.Deny = []string{"8080"}
+			},
+			expected: []Conflict{{List: "network.ingress.cidr", Allow: "127.0.0.1/8", Deny: "127.0.0.0/8", Normalized: "127.0.0.0/8"}},
+		},
+		{
+			name: "protocol rules conflict within their protocol only",
+			modify: func(c *Config) {
+				c.RestrictedNetworkConfig.CIDR.Protocols = []ProtocolRulesConfig{
+					{Protocol: PROTOCOL_UDP, Allow: []string{"10.0.0.53/32"}},
+					{Protocol: PROTOCOL_TCP, Deny: []string{"10.0.0.53/32"}},
+					{Protocol: PROTOCOL_UDP, Deny: []string{"10.0.0.53/32"}},
+				}
+			},
+			expected: []Conflict{{List: "network.cidr.protocols[udp]", Allow: "10.0.0.53/32", Deny: "10.0.0.53/32", Normalized: "10.0.0.53/32"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := DefaultConfig()
+			test.modify(config)
+			assert.Equal(t, test.expected, config.Conflicts())
+		})
+	}
+}
+
+func TestCheckConflicts(t *testing.T) {
+	config := DefaultConfig()
+	config.RestrictedNetworkConfig.UID.Allow = []string{"1000"}
+	config.RestrictedNetworkConfig.UID.Deny = []string{"1000"}
+
+	conflicts, err := config.CheckConflicts(false)
+	assert.Len(t, conflicts, 1)
+	assert.EqualError(t, err, `1 conflicting entries in allow and deny lists (use --allow-conflicts to only warn): network.uid: "1000" is in both allow and deny, deny wins`)
+
+	conflicts, err = config.CheckConflicts(true)
+	assert.Len(t, conflicts, 1)
+	assert.Nil(t, err)
+}
+
+func TestUIDConflictString(t *testing.T) {
+	config := DefaultConfig()
+	config.RestrictedNetworkConfig.UID.Allow = []string{"1000-2000"}
+	config.RestrictedNetworkConfig.UID.Deny = []string{"1500-2500"}
+
+	conflicts := config.Conflicts()
+	assert.Len(t, conflicts, 1)
+	assert.Equal(t, `network.uid: allow "1000-2000" and deny "1500-2500" overlap on "1500-2000", deny wins`, conflicts[0].String())
+}
@@ -0,0 +1,65 @@
+package config
+
+import "fmt"
+
+const (
+	// DEFAULT_ACTION_DENY denies the destinations that no list decides, DEFAULT_ACTION_ALLOW
+	// permits them.
+	DEFAULT_ACTION_DENY  = "deny"
+	DEFAULT_ACTION_ALLOW = "allow"
+
+	// PRECEDENCE_DENY_FIRST denies a destination that is in both an allow and a deny list,
+	// PRECEDENCE_ALLOW_FIRST permits it.
+	PRECEDENCE_DENY_FIRST  = "deny-first"
+	PRECEDENCE_ALLOW_FIRST = "allow-first"
+)
+
+// DecisionConfig is network.policy: how the destination lists of network.cidr, network.domain
+// and the rule sets decide a destination. The defaults are how bouheki always decided.
+type DecisionConfig struct {
+	// Default is the decision of a destination in none of the lists.
+	Default string `yaml:"default"`
+	// Precedence is the list that wins for a destination in both an allow and a deny list,
+	// whatever the prefix lengths.
+	Precedence string `yaml:"precedence"`
+}
+
+func (c *Config) validateDecision() error {
+	network := c.RestrictedNetworkConfig
+	switch network.Decision.Default {
+	case DEFAULT_ACTION_DENY, DEFAULT_ACTION_ALLOW:
+	default:
+		return fmt.Errorf("network.policy.default must be %s or %s, got %q", DEFAULT_ACTION_DENY, DEFAULT_ACTION_ALLOW, network.Decision.Default)
+	}
+	switch network.Decision.Precedence {
+	case PRECEDENCE_DENY_FIRST, PRECEDENCE_ALLOW_FIRST:
+	default:
+		return fmt.Errorf("network.policy.precedence must be %s or %s, got %q", PRECEDENCE_DENY_FIRST, PRECEDENCE_ALLOW_FIRST, network.Decision.Precedence)
+	}
+
+	if network.Enable && network.Decision.Default == DEFAULT_ACTION_DENY && network.denyListsOnly() {
+		return fmt.Errorf("network.policy.default: %s with only deny lists denies every destination: list the allowed destinations in network.cidr.allow or network.domain.allow, or set network.policy.default: %s", DEFAULT_ACTION_DENY, DEFAULT_ACTION_ALLOW)
+	}
+	return nil
+}
+
+// denyListsOnly reports whether the destination deny lists have entries and the allow lists none.
+func (c RestrictedNetworkConfig) denyListsOnly() bool {
+	allow := len(c.CIDR.Allow) + len(c.Domain.Allow)
+	deny := len(c.CIDR.Deny) + len(c.CIDR.AllowExcept) + len(c.Domain.Deny)
+	for _, protocol := range []string{PROTOCOL_TCP, PROTOCOL_UDP} {
+		for _, rules := range [][]ProtocolRulesConfig{c.CIDR.Protocols, c.Domain.Protocols} {
+			allowed, denied := ProtocolLists(rules, protocol)
+			allow += len(allowed)
+			deny += len(denied)
+		}
+	}
+	for _, set := range c.RuleSets.Sets {
+		if set.List == RULE_SET_LIST_ALLOW {
+			allow++
+		} else {
+			deny++
+		}
+	}
+	return allow == 0 && deny > 0
+}
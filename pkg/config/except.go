@@ -0,0 +1,63 @@
+package config
+
+import (
+	"fmt"
+	"net"
+)
+
+// UncoveredExcept is an entry of network.cidr.allow_except that no entry of network.cidr.allow
+// contains, so it carves nothing out of the allow list and only denies as a deny entry does.
+type UncoveredExcept struct {
+	Entry string
+}
+
+func (e UncoveredExcept) String() string {
+	return fmt.Sprintf("network.cidr.allow_except: %q is not inside any entry of network.cidr.allow", e.Entry)
+}
+
+// UncoveredExcepts returns the entries of network.cidr.allow_except that are not inside an entry
+// of network.cidr.allow. Entries are compared after normalization, as conflicts are.
+func (c *Config) UncoveredExcepts() []UncoveredExcept {
+	network := c.RestrictedNetworkConfig
+	allowed := []*net.IPNet{}
+	for _, entry := range network.CIDR.Allow {
+		if n, ok := parseNormalizedCIDR(entry); ok {
+			allowed = append(allowed, n)
+		}
+	}
+
+	uncovered := []UncoveredExcept{}
+	for _, entry := range network.CIDR.AllowExcept {
+		n, ok := parseNormalizedCIDR(entry)
+		if !ok {
+			continue
+		}
+		covered := false
+		for _, allow := range allowed {
+			if PrefixInside(n, allow) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			uncovered = append(uncovered, UncoveredExcept{Entry: entry})
+		}
+	}
+	return uncovered
+}
+
+func parseNormalizedCIDR(entry string) (*net.IPNet, bool) {
+	normalized, ok := normalizeCIDR(entry)
+	if !ok {
+		return nil, false
+	}
+	_, n, err := net.ParseCIDR(normalized)
+	return n, err == nil
+}
+
+// PrefixInside reports whether every address of n is in outer.
+func PrefixInside(n, outer *net.IPNet) bool {
+	ones, bits := n.Mask.Size()
+	outerOnes, outerBits := outer.Mask.Size()
+	return bits == outerBits && ones >= outerOnes && outer.Contains(n.IP)
+}
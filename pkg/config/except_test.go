@@ -0,0 +1,19 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUncoveredExcepts(t *testing.T) {
+	config := DefaultConfig()
+	config.RestrictedNetworkConfig.CIDR.Allow = []string{"10.0.0.0/8", "2001:db8::/32"}
+	config.RestrictedNetworkConfig.CIDR.AllowExcept = []string{"10.0.0.1/32", "10.1.2.3/16", "2001:db8::1/128"}
+	assert.Equal(t, []UncoveredExcept{}, config.UncoveredExcepts())
+
+	config.RestrictedNetworkConfig.CIDR.AllowExcept = []string{"10.0.0.0/7", "192.168.0.0/16", "::ffff:10.0.0.1/128", "2001:db9::/32"}
+	excepts := config.UncoveredExcepts()
+	assert.Equal(t, []UncoveredExcept{{Entry: "10.0.0.0/7"}, {Entry: "192.168.0.0/16"}, {Entry: "2001:db9::/32"}}, excepts)
+	assert.Equal(t, `network.cidr.allow_except: "10.0.0.0/7" is not inside any entry of network.cidr.allow`, excepts[0].String())
+}
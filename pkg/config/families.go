@@ -0,0 +1,184 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+const (
+	FAMILY_IPV4 = "ipv4"
+	FAMILY_IPV6 = "ipv6"
+
+	// OTHER_FAMILIES_IGNORE lets the connections of the families network.families leaves out
+	// through without an event, OTHER_FAMILIES_AUDIT reports them as allowed.
+	OTHER_FAMILIES_IGNORE = "ignore"
+	OTHER_FAMILIES_AUDIT  = "audit"
+)
+
+// families are the address families the network restriction can restrict.
+var families = []string{FAMILY_IPV4, FAMILY_IPV6}
+
+// FamilyEnabled reports whether network.families lists family. Without network.families, e.g. in
+// a config that was not read from a file, both are.
+func (c RestrictedNetworkConfig) FamilyEnabled(family string) bool {
+	if c.Families == nil {
+		return true
+	}
+	for _, f := range c.Families {
+		if f == family {
+			return true
+		}
+	}
+	return false
+}
+
+// EnabledFamilies returns the families network.families lists, in the order of families.
+func (c RestrictedNetworkConfig) EnabledFamilies() []string {
+	enabled := []string{}
+	for _, family := range families {
+		if c.FamilyEnabled(family) {
+			enabled = append(enabled, family)
+		}
+	}
+	return enabled
+}
+
+// DisabledFamilies returns the families network.families leaves out, in the order of families.
+func (c RestrictedNetworkConfig) DisabledFamilies() []string {
+	disabled := []string{}
+	for _, family := range families {
+		if !c.FamilyEnabled(family) {
+			disabled = append(disabled, family)
+		}
+	}
+	return disabled
+}
+
+// CIDRFamily returns the family of a CIDR of the network lists, "" if it does not parse.
+func CIDRFamily(entry string) string {
+	normalized, ok := normalizeCIDR(entry)
+	if !ok {
+		return ""
+	}
+	_, n, _ := net.ParseCIDR(normalized)
+	if n.IP.To4() != nil {
+		return FAMILY_IPV4
+	}
+	return FAMILY_IPV6
+}
+
+// isWholeFamily reports whether a normalized CIDR is every address of its family, as the
+// default network.cidr.allow lists both.
+func isWholeFamily(normalized string) bool {
+	return normalized == "0.0.0.0/0" || normalized == "::/0"
+}
+
+// FamilyRule is an allow rule of a family network.families leaves out. It is not written to the
+// maps: the connections of the family are not restricted at all.
+type FamilyRule struct {
+	List   string
+	Entry  string
+	Family string
+}
+
+func (r FamilyRule) String() string {
+	return fmt.Sprintf("%s: %q is an %s rule, which network.families does not restrict, it is not enforced", r.List, r.Entry, r.Family)
+}
+
+// familyList is a CIDR list of the network restriction, and whether it denies.
+type familyList struct {
+	name    string
+	entries []string
+	deny    bool
+}
+
+func (c RestrictedNetworkConfig) familyLists() []familyList {
+	lists := []familyList{
+		{"network.cidr.allow", c.CIDR.Allow, false},
+		{"network.cidr.deny", c.CIDR.Deny, true},
+		{"network.cidr.allow_except", c.CIDR.AllowExcept, true},
+		{"network.ingress.cidr.allow", c.Ingress.CIDR.Allow, false},
+		{"network.ingress.cidr.deny", c.Ingress.CIDR.Deny, true},
+	}
+	for _, rule := range c.CIDR.Protocols {
+		lists = append(lists,
+			familyList{fmt.Sprintf("network.cidr.protocols[%s].allow", rule.Protocol), rule.Allow, false},
+			familyList{fmt.Sprintf("network.cidr.protocols[%s].deny", rule.Protocol), rule.Deny, true})
+	}
+	return lists
+}
+
+// FamilyRules returns the allow rules of the families network.families leaves out, except the
+// whole family, e.g. ::/0 of the default network.cidr.allow.
+func (c *Config) FamilyRules() []FamilyRule {
+	network := c.RestrictedNetworkConfig
+	rules := []FamilyRule{}
+	for _, list := range network.familyLists() {
+		if list.deny {
+			continue
+		}
+		for _, entry := range list.entries {
+			family := CIDRFamily(entry)
+			if family == "" || network.FamilyEnabled(family) {
+				continue
+			}
+			if normalized, _ := normalizeCIDR(entry); isWholeFamily(normalized) {
+				continue
+			}
+			rules = append(rules, FamilyRule{List: list.name, Entry: entry, Family: family})
+		}
+	}
+	return rules
+}
+
+// validateFamilies rejects a network.families that leaves out the family of a deny rule, which
+// would not be enforced, or every family network.cidr.allow lists, which would deny every
+// connection of the families it keeps.
+func (c RestrictedNetworkConfig) validateFamilies() error {
+	if c.Families != nil && len(c.Families) == 0 {
+		return fmt.Errorf("network.families must list %s, %s or both", FAMILY_IPV4, FAMILY_IPV6)
+	}
+	seen := map[string]bool{}
+	for _, family := range c.Families {
+		if family != FAMILY_IPV4 && family != FAMILY_IPV6 {
+			return fmt.Errorf("network.families must be %s or %s, got %q", FAMILY_IPV4, FAMILY_IPV6, family)
+		}
+		if seen[family] {
+			return fmt.Errorf("network.families lists %s twice", family)
+		}
+		seen[family] = true
+	}
+
+	switch c.OtherFamilies {
+	case "", OTHER_FAMILIES_IGNORE:
+	case OTHER_FAMILIES_AUDIT:
+		if !c.Audit.Enabled {
+			return fmt.Errorf("network.other_families: %s reports the connections as audit events, which network.audit.enabled: false turns off", OTHER_FAMILIES_AUDIT)
+		}
+	default:
+		return fmt.Errorf("network.other_families must be %s or %s, got %q", OTHER_FAMILIES_IGNORE, OTHER_FAMILIES_AUDIT, c.OtherFamilies)
+	}
+
+	for _, list := range c.familyLists() {
+		if !list.deny {
+			continue
+		}
+		for _, entry := range list.entries {
+			if family := CIDRFamily(entry); family != "" && !c.FamilyEnabled(family) {
+				return fmt.Errorf("%s: %q is an %s rule, but network.families does not restrict %s", list.name, entry, family, family)
+			}
+		}
+	}
+
+	if len(c.CIDR.Allow) == 0 || len(c.Domain.Allow) > 0 {
+		return nil
+	}
+	for _, entry := range c.CIDR.Allow {
+		if family := CIDRFamily(entry); family == "" || c.FamilyEnabled(family) {
+			return nil
+		}
+	}
+	return fmt.Errorf("network.cidr.allow only lists %s rules, which network.families does not restrict: every connection of %s would be denied",
+		strings.Join(c.DisabledFamilies(), ", "), strings.Join(c.EnabledFamilies(), ", "))
+}
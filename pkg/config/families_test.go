@@ -0,0 +1,172 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFamilies(t *testing.T) {
+	config := DefaultConfig()
+	assert.True(t, config.RestrictedNetworkConfig.FamilyEnabled(FAMILY_IPV4))
+	assert.True(t, config.RestrictedNetworkConfig.FamilyEnabled(FAMILY_IPV6))
+	assert.Equal(t, []string{}, config.RestrictedNetworkConfig.DisabledFamilies())
+
+	config.RestrictedNetworkConfig.Families = []string{FAMILY_IPV6}
+	assert.Equal(t, []string{FAMILY_IPV6}, config.RestrictedNetworkConfig.EnabledFamilies())
+	assert.Equal(t, []string{FAMILY_IPV4}, config.RestrictedNetworkConfig.DisabledFamilies())
+
+	// A config that was not read from a file restricts both.
+	assert.True(t, RestrictedNetworkConfig{}.FamilyEnabled(FAMILY_IPV6))
+
+	for entry, family := range map[string]string{
+		"10.0.0.0/8":          FAMILY_IPV4,
+		"::/0":                FAMILY_IPV6,
+		"fe80::1%eth0/128":    FAMILY_IPV6,
+		"::ffff:10.0.0.1/128": FAMILY_IPV4,
+		"10.0.0.1":            "",
+	} {
+		assert.Equal(t, family, CIDRFamily(entry), entry)
+	}
+}
+
+func TestValidateFamilies(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(c *RestrictedNetworkConfig)
+		err    string
+	}{
+		{
+			name:   "both families",
+			modify: func(c *RestrictedNetworkConfig) {},
+		},
+		{
+			name: "ipv4 only keeps the default ::/0",
+			modify: func(c *RestrictedNetworkConfig) {
+				c.Families = []string{FAMILY_IPV4}
+			},
+		},
+		{
+			name: "an empty list",
+			modify: func(c *RestrictedNetworkConfig) {
+				c.Families = []string{}
+			},
+			err: "network.families must list ipv4, ipv6 or both",
+		},
+		{
+			name: "an unknown family",
+			modify: func(c *RestrictedNetworkConfig) {
+				c.Families = []string{"inet"}
+			},
+			err: `network.families must be ipv4 or ipv6, got "inet"`,
+		},
+		{
+			name: "a family twice",
+			modify: func(c *RestrictedNetworkConfig) {
+				c.Families = []string{FAMILY_IPV4, FAMILY_IPV4}
+			},
+			err: "network.families lists ipv4 twice",
+		},
+		{
+			name: "a deny rule of the disabled family",
+			modify: func(c *RestrictedNetworkConfig) {
+				c.Families = []string{FAMILY_IPV4}
+				c.CIDR.Deny = []string{"10.1.0.0/16", "2001:db8::/32"}
+			},
+			err: `network.cidr.deny: "2001:db8::/32" is an ipv6 rule, but network.families does not restrict ipv6`,
+		},
+		{
+			name: "a protocol deny rule of the disabled family",
+			modify: func(c *RestrictedNetworkConfig) {
+				c.Families = []string{FAMILY_IPV6}
+				c.CIDR.Protocols = []ProtocolRulesConfig{{Protocol: PROTOCOL_UDP, Deny: []string{"0.0.0.0/0"}}}
+			},
+			err: `network.cidr.protocols[udp].deny: "0.0.0.0/0" is an ipv4 rule, but network.families does not restrict ipv4`,
+		},
+		{
+			name: "an ingress deny rule of the disabled family",
+			modify: func(c *RestrictedNetworkConfig) {
+				c.Families = []string{FAMILY_IPV4}
+				c.Ingress.CIDR.Deny = []string{"::/0"}
+			},
+			err: `network.ingress.cidr.deny: "::/0" is an ipv6 rule, but network.families does not restrict ipv6`,
+		},
+		{
+			name: "an allow list of the disabled family only",
+			modify: func(c *RestrictedNetworkConfig) {
+				c.Families = []string{FAMILY_IPV4}
+				c.CIDR.Allow = []string{"2001:db8::/32"}
+			},
+			err: "network.cidr.allow only lists ipv6 rules, which network.families does not restrict: every connection of ipv4 would be denied",
+		},
+		{
+			name: "an allow list of the disabled family with allowed domains",
+			modify: func(c *RestrictedNetworkConfig) {
+				c.Families = []string{FAMILY_IPV4}
+				c.CIDR.Allow = []string{"2001:db8::/32"}
+				c.Domain.Allow = []string{"example.com"}
+			},
+		},
+		{
+			name: "an empty allow list denies every connection on purpose",
+			modify: func(c *RestrictedNetworkConfig) {
+				c.Families = []string{FAMILY_IPV4}
+				c.CIDR.Allow = []string{}
+			},
+		},
+		{
+			name: "the other families audited",
+			modify: func(c *RestrictedNetworkConfig) {
+				c.Families = []string{FAMILY_IPV4}
+				c.OtherFamilies = OTHER_FAMILIES_AUDIT
+			},
+		},
+		{
+			name: "the other families audited without audit events",
+			modify: func(c *RestrictedNetworkConfig) {
+				c.OtherFamilies = OTHER_FAMILIES_AUDIT
+				c.Audit.Enabled = false
+			},
+			err: "network.other_families: audit reports the connections as audit events, which network.audit.enabled: false turns off",
+		},
+		{
+			name: "an unknown treatment of the other families",
+			modify: func(c *RestrictedNetworkConfig) {
+				c.OtherFamilies = "block"
+			},
+			err: `network.other_families must be ignore or audit, got "block"`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := DefaultConfig()
+			test.modify(&config.RestrictedNetworkConfig)
+			err := config.Validate()
+			if test.err == "" {
+				assert.Nil(t, err)
+				return
+			}
+			if assert.NotNil(t, err) {
+				assert.Equal(t, test.err, err.Error())
+			}
+		})
+	}
+}
+
+func TestFamilyRules(t *testing.T) {
+	config := DefaultConfig()
+	config.RestrictedNetworkConfig.CIDR.Allow = []string{"0.0.0.0/0", "::/0", "2001:db8::/32"}
+	config.RestrictedNetworkConfig.CIDR.Protocols = []ProtocolRulesConfig{{Protocol: PROTOCOL_UDP, Allow: []string{"2001:db8::53/128", "10.0.0.53/32"}}}
+	config.RestrictedNetworkConfig.Ingress.CIDR.Allow = []string{"fd00::/8"}
+	assert.Equal(t, []FamilyRule{}, config.FamilyRules())
+
+	config.RestrictedNetworkConfig.Families = []string{FAMILY_IPV4}
+	rules := config.FamilyRules()
+	assert.Equal(t, []FamilyRule{
+		{List: "network.cidr.allow", Entry: "2001:db8::/32", Family: FAMILY_IPV6},
+		{List: "network.ingress.cidr.allow", Entry: "fd00::/8", Family: FAMILY_IPV6},
+		{List: "network.cidr.protocols[udp].allow", Entry: "2001:db8::53/128", Family: FAMILY_IPV6},
+	}, rules)
+	assert.Equal(t, `network.cidr.allow: "2001:db8::/32" is an ipv6 rule, which network.families does not restrict, it is not enforced`, rules[0].String())
+}
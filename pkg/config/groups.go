@@ -0,0 +1,260 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	// GROUP_REFERENCE_PREFIX starts an entry of network.cidr, network.domain or of a group that
+	// stands for the entries of a group, e.g. group:corp-proxies.
+	GROUP_REFERENCE_PREFIX = "group:"
+	// PRESET_REFERENCE_PREFIX starts a reference to a preset, a group bouheki defines, e.g. @private.
+	PRESET_REFERENCE_PREFIX = "@"
+
+	GROUP_KIND_CIDR   = "cidr"
+	GROUP_KIND_DOMAIN = "domain"
+)
+
+// GroupConfig is a named set of destinations. Its CIDRs are the entries of a reference from
+// network.cidr.allow, network.cidr.deny or another CIDR list of GroupListKeys, and its domains of a
+// reference from network.domain.allow or network.domain.deny. A group may reference other groups
+// and presets, whose entries of the same kind it includes.
+type GroupConfig struct {
+	CIDR   []string `yaml:"cidr"`
+	Domain []string `yaml:"domain"`
+}
+
+// presets are the groups that can be referenced as @<name> without being defined under groups.
+var presets = map[string]GroupConfig{
+	"private":    {CIDR: []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"}},
+	"link-local": {CIDR: []string{"169.254.0.0/16", "fe80::/10"}},
+	// The instance metadata services of AWS, GCP, Azure and OpenStack, of Alibaba Cloud, and
+	// of AWS over IPv6.
+	"cloud-metadata": {CIDR: []string{"169.254.169.254/32", "100.100.100.200/32", "fd00:ec2::254/128"}},
+	"loopback":       {CIDR: []string{"127.0.0.0/8", "::1/128"}},
+}
+
+// PresetNames returns the names of the presets, sorted.
+func PresetNames() []string {
+	names := make([]string, 0, len(presets))
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// IsPreset reports whether name, as GroupName returns it, is a preset, e.g. @private.
+func IsPreset(name string) bool {
+	return strings.HasPrefix(name, PRESET_REFERENCE_PREFIX)
+}
+
+// GroupReference returns the entry that references the group name, e.g. group:corp-proxies or @private.
+func GroupReference(name string) string {
+	if IsPreset(name) {
+		return name
+	}
+	return GROUP_REFERENCE_PREFIX + name
+}
+
+func (g GroupConfig) entries(kind string) []string {
+	if kind == GROUP_KIND_DOMAIN {
+		return g.Domain
+	}
+	return g.CIDR
+}
+
+// groupLists are the lists that accept group references, with the kind of entries they take.
+var groupLists = []struct {
+	key  string
+	kind string
+	list func(c *Config) *[]string
+}{
+	{"network.cidr.allow", GROUP_KIND_CIDR, func(c *Config) *[]string { return &c.RestrictedNetworkConfig.CIDR.Allow }},
+	{"network.cidr.deny", GROUP_KIND_CIDR, func(c *Config) *[]string { return &c.RestrictedNetworkConfig.CIDR.Deny }},
+	{"network.cidr.allow_except", GROUP_KIND_CIDR, func(c *Config) *[]string { return &c.RestrictedNetworkConfig.CIDR.AllowExcept }},
+	{"network.cidr.monitor", GROUP_KIND_CIDR, func(c *Config) *[]string { return &c.RestrictedNetworkConfig.CIDR.Monitor }},
+	{"network.ingress.cidr.allow", GROUP_KIND_CIDR, func(c *Config) *[]string { return &c.RestrictedNetworkConfig.Ingress.CIDR.Allow }},
+	{"network.ingress.cidr.deny", GROUP_KIND_CIDR, func(c *Config) *[]string { return &c.RestrictedNetworkConfig.Ingress.CIDR.Deny }},
+	{"network.domain.allow", GROUP_KIND_DOMAIN, func(c *Config) *[]string { return &c.RestrictedNetworkConfig.Domain.Allow }},
+	{"network.domain.deny", GROUP_KIND_DOMAIN, func(c *Config) *[]string { return &c.RestrictedNetworkConfig.Domain.Deny }},
+	{"network.domain.monitor", GROUP_KIND_DOMAIN, func(c *Config) *[]string { return &c.RestrictedNetworkConfig.Domain.Monitor }},
+}
+
+// GroupListKeys returns the lists that accept group references.
+func GroupListKeys() []string {
+	keys := []string{}
+	for _, l := range groupLists {
+		keys = append(keys, l.key)
+	}
+	return keys
+}
+
+// GroupName returns the group an entry references, if it is a reference. The name of a preset
+// keeps its @, so that it does not clash with a group of the same name.
+func GroupName(entry string) (string, bool) {
+	entry = strings.TrimSpace(entry)
+	if strings.HasPrefix(entry, PRESET_REFERENCE_PREFIX) {
+		return entry, true
+	}
+	if !strings.HasPrefix(entry, GROUP_REFERENCE_PREFIX) {
+		return "", false
+	}
+	return strings.TrimPrefix(entry, GROUP_REFERENCE_PREFIX), true
+}
+
+// group returns the group or the preset name.
+func (c *Config) group(name string) (GroupConfig, bool) {
+	if IsPreset(name) {
+		group, ok := presets[strings.TrimPrefix(name, PRESET_REFERENCE_PREFIX)]
+		return group, ok
+	}
+	group, ok := c.Groups[name]
+	return group, ok
+}
+
+// expandGroups replaces the group references of the lists with the entries of the groups. The
+// groups each entry came from are kept, see EntryGroup and ListGroups.
+func (c *Config) expandGroups() error {
+	for _, name := range c.GroupNames() {
+		if name == "" || strings.ContainsAny(name, " \t:") || IsPreset(name) {
+			return fmt.Errorf("groups: invalid group name %q", name)
+		}
+		for _, kind := range []string{GROUP_KIND_CIDR, GROUP_KIND_DOMAIN} {
+			if _, err := c.groupEntries(kind, []string{name}, c.Groups[name].entries(kind)); err != nil {
+				return err
+			}
+		}
+	}
+
+	c.entryGroups = map[string]map[string]string{}
+	c.listGroups = map[string][]string{}
+	for _, l := range groupLists {
+		list := l.list(c)
+		expanded := []string{}
+		groups := map[string]string{}
+		direct := map[string]struct{}{}
+		for _, entry := range *list {
+			name, ok := GroupName(entry)
+			if !ok {
+				expanded = append(expanded, entry)
+				direct[entry] = struct{}{}
+				continue
+			}
+			group, ok := c.group(name)
+			if !ok && IsPreset(name) {
+				return fmt.Errorf("%s: unknown preset %s, the presets are @%s", l.key, name, strings.Join(PresetNames(), ", @"))
+			}
+			if !ok {
+				return fmt.Errorf("%s: unknown group %q", l.key, name)
+			}
+			entries, err := c.groupEntries(l.kind, []string{name}, group.entries(l.kind))
+			if err != nil {
+				return err
+			}
+			if len(entries) == 0 {
+				if IsPreset(name) {
+					return fmt.Errorf("%s: preset %s has no %s entries", l.key, name, l.kind)
+				}
+				return fmt.Errorf("%s: group %q has no %s entries", l.key, name, l.kind)
+			}
+			if !containsString(c.listGroups[l.key], name) {
+				c.listGroups[l.key] = append(c.listGroups[l.key], name)
+			}
+			for _, e := range entries {
+				if _, ok := groups[e]; !ok {
+					groups[e] = name
+				}
+				expanded = append(expanded, e)
+			}
+		}
+		// An entry that is also listed directly does not come from a group.
+		for entry := range direct {
+			delete(groups, entry)
+		}
+
+		if len(c.listGroups[l.key]) > 0 {
+			*list = expanded
+			c.entryGroups[l.key] = groups
+			sort.Strings(c.listGroups[l.key])
+		}
+	}
+	return nil
+}
+
+// groupEntries returns the entries of kind, with the references expanded. path is the chain of
+// groups that led to entries, the last one listing them.
+func (c *Config) groupEntries(kind string, path []string, entries []string) ([]string, error) {
+	expanded := []string{}
+	for _, entry := range entries {
+		name, ok := GroupName(entry)
+		if !ok {
+			expanded = append(expanded, entry)
+			continue
+		}
+		for i, seen := range path {
+			if seen == name {
+				cycle := append(append([]string{}, path[i:]...), name)
+				return nil, fmt.Errorf("groups: %s%s forms a cycle", GROUP_REFERENCE_PREFIX, strings.Join(cycle, " -> "+GROUP_REFERENCE_PREFIX))
+			}
+		}
+		group, ok := c.group(name)
+		if !ok && IsPreset(name) {
+			return nil, fmt.Errorf("groups.%s.%s: unknown preset %s, the presets are @%s", path[len(path)-1], kind, name, strings.Join(PresetNames(), ", @"))
+		}
+		if !ok {
+			return nil, fmt.Errorf("groups.%s.%s: unknown group %q", path[len(path)-1], kind, name)
+		}
+		nested, err := c.groupEntries(kind, append(append([]string{}, path...), name), group.entries(kind))
+		if err != nil {
+			return nil, err
+		}
+		expanded = append(expanded, nested...)
+	}
+	return expanded, nil
+}
+
+// GroupNames returns the names of the groups, sorted.
+func (c *Config) GroupNames() []string {
+	names := make([]string, 0, len(c.Groups))
+	for name := range c.Groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// GroupEntries returns the entries of kind of a group or a preset, with the references expanded.
+func (c *Config) GroupEntries(name, kind string) []string {
+	group, ok := c.group(name)
+	if !ok {
+		return nil
+	}
+	entries, err := c.groupEntries(kind, []string{name}, group.entries(kind))
+	if err != nil {
+		return nil
+	}
+	return entries
+}
+
+// EntryGroup returns the group an entry of a list, e.g. network.cidr.deny, came from, or "" if
+// it was listed directly. With nested groups, it is the group the list references.
+func (c *Config) EntryGroup(list, entry string) string {
+	return c.entryGroups[list][entry]
+}
+
+// ListGroups returns the groups a list references, sorted.
+func (c *Config) ListGroups(list string) []string {
+	return append([]string{}, c.listGroups[list]...)
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,156 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const groupsConfig = `
+version: 2
+groups:
+  corp-proxies:
+    cidr: [10.0.1.0/24, 10.0.2.0/24]
+    domain: [proxy.corp.example.com]
+  observability-endpoints:
+    cidr: [192.0.2.0/24, group:corp-proxies]
+    domain: [metrics.example.com]
+  unused:
+    cidr: [203.0.113.0/24]
+network:
+  mode: block
+  cidr:
+    allow: [127.0.0.1/32, group:observability-endpoints]
+    deny: [group:corp-proxies, 10.0.1.0/24]
+  domain:
+    allow: [group:corp-proxies, group:observability-endpoints]
+`
+
+func TestGroupsAreExpandedInTheLists(t *testing.T) {
+	config, err := NewConfig(writeConfig(t, groupsConfig))
+	assert.Nil(t, err)
+
+	network := config.RestrictedNetworkConfig
+	assert.Equal(t, []string{"127.0.0.1/32", "192.0.2.0/24", "10.0.1.0/24", "10.0.2.0/24"}, network.CIDR.Allow)
+	assert.Equal(t, []string{"10.0.1.0/24", "10.0.2.0/24", "10.0.1.0/24"}, network.CIDR.Deny)
+	assert.Equal(t, []string{"proxy.corp.example.com", "metrics.example.com"}, network.Domain.Allow)
+	assert.Empty(t, network.Domain.Deny)
+
+	// The entries of a nested group came from the group the list references.
+	assert.Equal(t, "observability-endpoints", config.EntryGroup("network.cidr.allow", "10.0.2.0/24"))
+	assert.Equal(t, "", config.EntryGroup("network.cidr.allow", "127.0.0.1/32"))
+	// An entry also listed directly does not come from a group.
+	assert.Equal(t, "", config.EntryGroup("network.cidr.deny", "10.0.1.0/24"))
+	assert.Equal(t, "corp-proxies", config.EntryGroup("network.cidr.deny", "10.0.2.0/24"))
+	// The first reference of an entry in a list names its group.
+	assert.Equal(t, "corp-proxies", config.EntryGroup("network.domain.allow", "proxy.corp.example.com"))
+
+	assert.Equal(t, []string{"corp-proxies", "observability-endpoints"}, config.ListGroups("network.domain.allow"))
+	assert.Equal(t, []string{"corp-proxies"}, config.ListGroups("network.cidr.deny"))
+	assert.Empty(t, config.ListGroups("network.domain.deny"))
+	assert.Equal(t, []string{"192.0.2.0/24", "10.0.1.0/24", "10.0.2.0/24"}, config.GroupEntries("observability-endpoints", GROUP_KIND_CIDR))
+	assert.Equal(t, []string{"corp-proxies", "observability-endpoints", "unused"}, config.GroupNames())
+}
+
+func TestGroupReferencesAreValidated(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		groups map[string]GroupConfig
+		allow  []string
+		err    string
+	}{
+		{"unknown group", nil, []string{"group:corp-proxies"}, `network.cidr.allow: unknown group "corp-proxies"`},
+		{"unknown nested group", map[string]GroupConfig{"a": {CIDR: []string{"group:b"}}}, nil, `groups.a.cidr: unknown group "b"`},
+		{"cycle", map[string]GroupConfig{
+			"a": {CIDR: []string{"10.0.0.0/8", "group:b"}},
+			"b": {CIDR: []string{"group:c"}},
+			"c": {CIDR: []string{"group:a"}},
+		}, nil, "groups: group:a -> group:b -> group:c -> group:a forms a cycle"},
+		{"self reference", map[string]GroupConfig{"a": {Domain: []string{"group:a"}}}, nil, "groups: group:a -> group:a forms a cycle"},
+		{"no entry of the kind", map[string]GroupConfig{"a": {Domain: []string{"example.com"}}}, []string{"group:a"}, `network.cidr.allow: group "a" has no cidr entries`},
+		{"invalid name", map[string]GroupConfig{"a:b": {CIDR: []string{"10.0.0.0/8"}}}, nil, `groups: invalid group name "a:b"`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			config := DefaultConfig()
+			config.Groups = test.groups
+			config.RestrictedNetworkConfig.CIDR.Allow = test.allow
+			err := config.expandGroups()
+			assert.NotNil(t, err)
+			assert.Equal(t, test.err, err.Error())
+		})
+	}
+}
+
+func TestConfigWithoutGroupReferencesIsUnchanged(t *testing.T) {
+	config := DefaultConfig()
+	config.RestrictedNetworkConfig.CIDR.Allow = []string{"10.0.0.0/8"}
+	config.Groups = map[string]GroupConfig{"a": {CIDR: []string{"192.0.2.0/24"}}}
+	assert.Nil(t, config.expandGroups())
+	assert.Equal(t, []string{"10.0.0.0/8"}, config.RestrictedNetworkConfig.CIDR.Allow)
+	assert.Empty(t, config.RestrictedNetworkConfig.CIDR.Deny)
+	assert.Empty(t, config.ListGroups("network.cidr.allow"))
+}
+
+func TestVersion2ConfigRejectsUnknownGroupFields(t *testing.T) {
+	_, err := NewConfig(writeConfig(t, "version: 2\ngroups:\n  a:\n    cdir: [10.0.0.0/8]\n"))
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "groups.a.cdir")
+}
+
+func TestPresetsAreExpandedInTheLists(t *testing.T) {
+	config, err := Parse([]byte(`
+version: 2
+groups:
+  private:
+    cidr: [192.0.2.0/24]
+  internal:
+    cidr: ["@private", "@loopback"]
+network:
+  mode: block
+  cidr:
+    allow: [group:internal]
+    deny: ["@cloud-metadata", "@link-local", group:private]
+  ingress:
+    cidr:
+      allow: ["@private"]
+`))
+	assert.Nil(t, err)
+
+	network := config.RestrictedNetworkConfig
+	assert.Equal(t, []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7", "127.0.0.0/8", "::1/128"}, network.CIDR.Allow)
+	// A group of the name of a preset is another group.
+	assert.Equal(t, []string{"169.254.169.254/32", "100.100.100.200/32", "fd00:ec2::254/128", "169.254.0.0/16", "fe80::/10", "192.0.2.0/24"}, network.CIDR.Deny)
+	assert.Equal(t, []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"}, network.Ingress.CIDR.Allow)
+
+	assert.Equal(t, "@cloud-metadata", config.EntryGroup("network.cidr.deny", "169.254.169.254/32"))
+	assert.Equal(t, "private", config.EntryGroup("network.cidr.deny", "192.0.2.0/24"))
+	assert.Equal(t, []string{"@cloud-metadata", "@link-local", "private"}, config.ListGroups("network.cidr.deny"))
+	assert.Equal(t, []string{"internal", "private"}, config.GroupNames())
+	assert.Equal(t, "@private", GroupReference("@private"))
+	assert.Equal(t, "group:private", GroupReference("private"))
+}
+
+func TestPresetReferencesAreValidated(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		groups map[string]GroupConfig
+		allow  []string
+		domain []string
+		err    string
+	}{
+		{"unknown preset", nil, []string{"@metadata"}, nil, "network.cidr.allow: unknown preset @metadata, the presets are @cloud-metadata, @link-local, @loopback, @private"},
+		{"unknown nested preset", map[string]GroupConfig{"a": {CIDR: []string{"@rfc1918"}}}, nil, nil, "groups.a.cidr: unknown preset @rfc1918, the presets are @cloud-metadata, @link-local, @loopback, @private"},
+		{"preset in a domain list", nil, nil, []string{"@private"}, "network.domain.allow: preset @private has no domain entries"},
+		{"group named as a preset", map[string]GroupConfig{"@private": {CIDR: []string{"10.0.0.0/8"}}}, nil, nil, `groups: invalid group name "@private"`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			config := DefaultConfig()
+			config.Groups = test.groups
+			config.RestrictedNetworkConfig.CIDR.Allow = test.allow
+			config.RestrictedNetworkConfig.Domain.Allow = test.domain
+			err := config.expandGroups()
+			assert.NotNil(t, err)
+			assert.Equal(t, test.err, err.Error())
+		})
+	}
+}
@@ -0,0 +1,348 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+
+	yamlv2 "gopkg.in/yaml.v2"
+	"gopkg.in/yaml.v3"
+)
+
+// The severities of a Problem.
+const (
+	// SEVERITY_ERROR is a problem bouheki does not start with.
+	SEVERITY_ERROR = "error"
+	// SEVERITY_WARNING is a problem bouheki starts with, logging it, unless --strict-config.
+	SEVERITY_WARNING = "warning"
+)
+
+// Problem is a finding of Lint about a key or an entry of the config file.
+type Problem struct {
+	Severity string `json:"severity"`
+	// Path is the YAML path of the key or list, e.g. "network.cidr.allow".
+	Path string `json:"path,omitempty"`
+	// Line is the line of the key or entry in the file, 0 when it is not there, e.g. for an
+	// entry of a group.
+	Line    int    `json:"line,omitempty"`
+	Message string `json:"message"`
+}
+
+// Location returns where the problem is in the file at path, e.g. "bouheki.yaml:12".
+func (p Problem) Location(path string) string {
+	if p.Line == 0 {
+		return path
+	}
+	return fmt.Sprintf("%s:%d", path, p.Line)
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%s: %s", p.Severity, p.Message)
+}
+
+// Lint checks the YAML of a config file more strictly than Parse: unknown fields are errors
+// whatever the version, every entry of the CIDR, uid and gid lists is checked rather than the
+// first bad one, and the warnings bouheki logs as it loads the config are returned with the
+// duplicate entries and the empty allow lists of block mode. The problems are in the order of
+// the checks, each with the line of its key or entry.
+func Lint(data []byte) []Problem {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return []Problem{{Severity: SEVERITY_ERROR, Message: err.Error()}}
+	}
+	l := &linter{root: &root, problems: []Problem{}}
+
+	var tree interface{}
+	if err := yamlv2.Unmarshal(data, &tree); err != nil {
+		return []Problem{{Severity: SEVERITY_ERROR, Message: err.Error()}}
+	}
+	for _, field := range unknownFields("", tree, reflect.TypeOf(Config{})) {
+		l.add(SEVERITY_ERROR, field.Path, "", field.String())
+	}
+
+	conf, err := Parse(data)
+	var unknown *UnknownFieldsError
+	if errors.As(err, &unknown) {
+		return l.problems
+	}
+	if err != nil {
+		// Validate stops at the first bad entry: the config is checked as it decodes, so that
+		// every one is reported.
+		decoded, ok := decodeEntries(data)
+		if !ok {
+			l.add(SEVERITY_ERROR, "", "", err.Error())
+			return l.problems
+		}
+		conf = decoded
+	}
+	l.entries(conf)
+	if err != nil && !l.reported(err.Error()) {
+		l.add(SEVERITY_ERROR, "", "", err.Error())
+	}
+
+	for _, conflict := range conf.Conflicts() {
+		l.add(SEVERITY_WARNING, conflict.List+".deny", conflict.Deny, conflict.String())
+	}
+	for _, entry := range conf.HostBitsEntries() {
+		l.add(SEVERITY_WARNING, entry.List, entry.Entry, entry.String())
+	}
+	for _, entry := range conf.AllowAllEntries() {
+		l.add(SEVERITY_WARNING, entry.List, entry.Entry, entry.String())
+	}
+	for _, entry := range conf.ShadowedEntries() {
+		l.add(SEVERITY_WARNING, entry.List, entry.Entry, entry.String())
+	}
+	for _, command := range conf.TruncatedCommands() {
+		l.add(SEVERITY_WARNING, command.List, command.Command, command.String())
+	}
+	for _, rule := range conf.FamilyRules() {
+		l.add(SEVERITY_WARNING, rule.List, rule.Entry, rule.String())
+	}
+	for _, except := range conf.UncoveredExcepts() {
+		l.add(SEVERITY_WARNING, "network.cidr.allow_except", except.Entry, except.String())
+	}
+	l.duplicates(conf)
+	l.emptyAllowLists(conf)
+	return l.problems
+}
+
+// linter collects the problems of Lint, with their lines in root.
+type linter struct {
+	root     *yaml.Node
+	problems []Problem
+}
+
+// add adds a problem about path, or about its entry if entry is not empty.
+func (l *linter) add(severity, path, entry, message string) {
+	l.problems = append(l.problems, Problem{Severity: severity, Path: path, Line: lineOf(l.root, path, entry), Message: message})
+}
+
+func (l *linter) reported(message string) bool {
+	for _, problem := range l.problems {
+		if problem.Message == message {
+			return true
+		}
+	}
+	return false
+}
+
+// entries checks every entry of the CIDR, uid and gid lists, with the messages of Validate.
+func (l *linter) entries(conf *Config) {
+	for _, list := range conf.RestrictedNetworkConfig.cidrLists() {
+		for _, entry := range list.entries {
+			if _, _, err := net.ParseCIDR(stripZone(entry)); err != nil {
+				l.add(SEVERITY_ERROR, list.name, entry, fmt.Sprintf("%s: %q is not a CIDR", list.name, entry))
+			}
+		}
+	}
+	network := conf.RestrictedNetworkConfig
+	for _, list := range []struct {
+		name    string
+		entries []string
+		parse   func(string) error
+	}{
+		{"network.uid.allow", network.UID.Allow, parseUIDEntry},
+		{"network.uid.deny", network.UID.Deny, parseUIDEntry},
+		{"network.gid.allow", network.GID.Allow, parseGIDEntry},
+		{"network.gid.deny", network.GID.Deny, parseGIDEntry},
+	} {
+		for _, entry := range list.entries {
+			if err := list.parse(entry); err != nil {
+				l.add(SEVERITY_ERROR, list.name, entry, fmt.Sprintf("%s: %v", list.name, err))
+			}
+		}
+	}
+}
+
+// duplicates warns about the entries of a list that are the same as an earlier one once
+// normalized, e.g. 10.0.0.0/8 and 10.1.0.0/8.
+func (l *linter) duplicates(conf *Config) {
+	network := conf.RestrictedNetworkConfig
+	type list struct {
+		name      string
+		entries   []string
+		normalize func(string) (string, bool)
+	}
+	lists := []list{}
+	for _, cidrs := range network.cidrLists() {
+		lists = append(lists, list{cidrs.name, cidrs.entries, normalizeCIDR})
+	}
+	lists = append(lists,
+		list{"network.domain.allow", network.Domain.Allow, normalizeDomain},
+		list{"network.domain.deny", network.Domain.Deny, normalizeDomain},
+		list{"network.command.allow", network.Command.Allow, normalizeEntry},
+		list{"network.command.deny", network.Command.Deny, normalizeEntry},
+		list{"network.uid.allow", network.UID.Allow, normalizeUIDRange},
+		list{"network.uid.deny", network.UID.Deny, normalizeUIDRange},
+		list{"network.gid.allow", network.GID.Allow, normalizeGID},
+		list{"network.gid.deny", network.GID.Deny, normalizeGID},
+		list{"network.ports.allow", network.Ports.Allow, normalizePortRange},
+		list{"network.ports.deny", network.Ports.Deny, normalizePortRange})
+
+	for _, list := range lists {
+		seen := map[string]string{}
+		for _, entry := range list.entries {
+			normalized, ok := list.normalize(entry)
+			if !ok {
+				continue
+			}
+			first, exists := seen[normalized]
+			if !exists {
+				seen[normalized] = entry
+				continue
+			}
+			if first != entry {
+				l.add(SEVERITY_WARNING, list.name, entry, fmt.Sprintf("%s: %q is the same as %q", list.name, entry, first))
+				continue
+			}
+			// The line is the one of the repeat, not of the first entry.
+			lines := entryLines(l.root, list.name, entry)
+			line := 0
+			if len(lines) > 1 {
+				line = lines[len(lines)-1]
+			}
+			l.problems = append(l.problems, Problem{Severity: SEVERITY_WARNING, Path: list.name, Line: line, Message: fmt.Sprintf("%s: %q is listed twice", list.name, entry)})
+		}
+	}
+}
+
+// emptyAllowLists warns about the allow lists of block mode written empty in the file: an empty
+// list does not restrict, so `allow: []` lets every command, uid, gid or port connect.
+func (l *linter) emptyAllowLists(conf *Config) {
+	if conf.RestrictedNetworkConfig.Mode != "block" {
+		return
+	}
+	for _, path := range []string{"network.command.allow", "network.uid.allow", "network.gid.allow", "network.ports.allow"} {
+		node := lookup(l.root, path)
+		empty := node != nil && ((node.Kind == yaml.SequenceNode && len(node.Content) == 0) || node.Tag == "!!null")
+		if !empty {
+			continue
+		}
+		l.add(SEVERITY_WARNING, path, "", fmt.Sprintf("%s is empty, which does not restrict, in block mode", path))
+	}
+}
+
+// decodeEntries decodes data as Parse does, without validating it.
+func decodeEntries(data []byte) (*Config, bool) {
+	conf := DefaultConfig()
+	if _, err := decodeVersioned(data, conf); err != nil {
+		return nil, false
+	}
+	if conf.expandGroups() != nil || conf.resolveNames() != nil {
+		return nil, false
+	}
+	conf.normalize()
+	return conf, true
+}
+
+func normalizeEntry(entry string) (string, bool) {
+	entry = strings.TrimSpace(entry)
+	return entry, entry != ""
+}
+
+func normalizeUIDRange(entry string) (string, bool) {
+	r, err := ParseUIDRange(entry)
+	if err != nil {
+		return "", false
+	}
+	return r.String(), true
+}
+
+// lineOf returns the line of the item entry of the list at path, or of the key of path if entry is
+// empty or not in the list, and 0 if the file has no path.
+func lineOf(root *yaml.Node, path, entry string) int {
+	if lines := entryLines(root, path, entry); len(lines) > 0 {
+		return lines[0]
+	}
+	line, _ := find(root, path)
+	return line
+}
+
+// entryLines returns the lines of the items entry of the list at path.
+func entryLines(root *yaml.Node, path, entry string) []int {
+	node := lookup(root, path)
+	if node == nil || entry == "" || node.Kind != yaml.SequenceNode {
+		return nil
+	}
+	lines := []int{}
+	for _, item := range node.Content {
+		if item.Kind == yaml.ScalarNode && item.Value == entry {
+			lines = append(lines, item.Line)
+		}
+	}
+	return lines
+}
+
+// lookup returns the node at path in root, or nil.
+func lookup(root *yaml.Node, path string) *yaml.Node {
+	_, node := find(root, path)
+	return node
+}
+
+// find returns the node at path in root, e.g. "network.cidr.protocols[tcp].allow", and the line
+// of its key. The index of a sequence is its position, or the value of a field of the item, as the
+// protocol of a protocol rule or the name of an entry of network.policies.
+func find(root *yaml.Node, path string) (int, *yaml.Node) {
+	if path == "" {
+		return 0, nil
+	}
+	line, node := 0, root
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	for _, segment := range strings.Split(path, ".") {
+		key, index := segment, ""
+		if i := strings.Index(segment, "["); i >= 0 && strings.HasSuffix(segment, "]") {
+			key, index = segment[:i], segment[i+1:len(segment)-1]
+		}
+		if line, node = mappingValue(node, key); node == nil {
+			return 0, nil
+		}
+		if index != "" {
+			if node = sequenceItem(node, index); node == nil {
+				return 0, nil
+			}
+			line = node.Line
+		}
+	}
+	return line, node
+}
+
+// mappingValue returns the value of key in node, and the line of key.
+func mappingValue(node *yaml.Node, key string) (int, *yaml.Node) {
+	if node.Kind != yaml.MappingNode {
+		return 0, nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i].Line, node.Content[i+1]
+		}
+	}
+	return 0, nil
+}
+
+func sequenceItem(node *yaml.Node, index string) *yaml.Node {
+	if node.Kind != yaml.SequenceNode {
+		return nil
+	}
+	if i, err := strconv.Atoi(index); err == nil {
+		if i < 0 || i >= len(node.Content) {
+			return nil
+		}
+		return node.Content[i]
+	}
+	for _, item := range node.Content {
+		if item.Kind != yaml.MappingNode {
+			continue
+		}
+		for i := 1; i < len(item.Content); i += 2 {
+			if item.Content[i].Kind == yaml.ScalarNode && item.Content[i].Value == index {
+				return item
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLint(t *testing.T) {
+	problems := Lint([]byte(`
+network:
+  mode: block
+  cider:
+    allow: [10.0.0.0/8]
+  cidr:
+    allow:
+      - 10.0.0.0/8
+      - 300.0.0.0/8
+      - 10.0.0.0/8
+  uid:
+    allow: [1000, 99999999999]
+  command:
+    allow: []
+`))
+	assert.Equal(t, []Problem{
+		{Severity: SEVERITY_ERROR, Path: "network.cider", Line: 4, Message: "network.cider: unknown field, did you mean network.cidr?"},
+		{Severity: SEVERITY_ERROR, Path: "network.cidr.allow", Line: 9, Message: `network.cidr.allow: "300.0.0.0/8" is not a CIDR`},
+		{Severity: SEVERITY_ERROR, Path: "network.uid.allow", Line: 12, Message: `network.uid.allow: "99999999999" is not a uid or a range of uids between 0 and 4294967294`},
+		{Severity: SEVERITY_WARNING, Path: "network.cidr.allow", Line: 10, Message: `network.cidr.allow: "10.0.0.0/8" is listed twice`},
+		{Severity: SEVERITY_WARNING, Path: "network.command.allow", Line: 14, Message: "network.command.allow is empty, which does not restrict, in block mode"},
+	}, problems)
+
+	// A version 2 config is not decoded with unknown fields, they are its only problems.
+	problems = Lint([]byte(`
+version: 2
+network:
+  ciddr:
+    allow: [10.0.0.0/8, 10.0.0.0/8]
+`))
+	assert.Equal(t, []Problem{{Severity: SEVERITY_ERROR, Path: "network.ciddr", Line: 4, Message: "network.ciddr: unknown field, did you mean network.cidr?"}}, problems)
+
+	assert.Empty(t, Lint([]byte("network:\n  mode: block\n")))
+	assert.Len(t, Lint([]byte("network: [")), 1)
+}
+
+func TestLineOf(t *testing.T) {
+	problems := Lint([]byte(`
+network:
+  cidr:
+    protocols:
+      - protocol: tcp
+        allow: [192.0.2.0/24]
+      - protocol: udp
+        allow: [192.0.2.1/24]
+  policies:
+    - name: web
+      cidr:
+        allow: [198.51.100.1/24]
+`))
+	lines := map[string]int{}
+	for _, problem := range problems {
+		lines[problem.Path] = problem.Line
+	}
+	assert.Equal(t, 8, lines["network.cidr.protocols[udp].allow"])
+	assert.Equal(t, 12, lines["network.policies[web].cidr.allow"])
+}
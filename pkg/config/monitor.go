@@ -0,0 +1,43 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// validateMonitor checks that every entry of the monitor lists is an entry of the deny list of
+// its section: mode: monitor is an attribute of a deny entry, not a list of its own. The entries
+// are compared after normalization, as conflicts are. The protocol rules and the policies have no
+// monitor list.
+func (c RestrictedNetworkConfig) validateMonitor() error {
+	for _, list := range []struct {
+		name      string
+		deny      []string
+		monitor   []string
+		normalize func(string) (string, bool)
+	}{
+		{"network.cidr", c.CIDR.Deny, c.CIDR.Monitor, normalizeCIDR},
+		{"network.domain", c.Domain.Deny, c.Domain.Monitor, normalizeDomain},
+		{"network.command", c.Command.Deny, c.Command.Monitor, normalizeEntry},
+	} {
+		denied := map[string]struct{}{}
+		for _, entry := range list.deny {
+			if normalized, ok := list.normalize(entry); ok {
+				denied[normalized] = struct{}{}
+			}
+		}
+		for _, entry := range list.monitor {
+			if list.name == "network.command" && strings.Contains(entry, "*") {
+				return fmt.Errorf("network.command.monitor: %q is a pattern, only the commands of network.command.deny can be in mode: monitor", entry)
+			}
+			normalized, ok := list.normalize(entry)
+			if !ok {
+				return fmt.Errorf("%s.monitor: %q is not an entry of %s.deny", list.name, entry, list.name)
+			}
+			if _, ok := denied[normalized]; !ok {
+				return fmt.Errorf("%s.monitor: %q is not an entry of %s.deny", list.name, entry, list.name)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateMonitor(t *testing.T) {
+	config := DefaultConfig()
+	config.RestrictedNetworkConfig.CIDR.Deny = []string{"10.1.0.0/16", "2001:db8::/32"}
+	config.RestrictedNetworkConfig.CIDR.Monitor = []string{"10.1.2.3/16", "2001:db8::/32"}
+	config.RestrictedNetworkConfig.Domain.Deny = []string{"example.com", "example.org"}
+	config.RestrictedNetworkConfig.Domain.Monitor = []string{"Example.org."}
+	config.RestrictedNetworkConfig.Command.Deny = []string{"curl", "python*"}
+	config.RestrictedNetworkConfig.Command.Monitor = []string{"curl"}
+	assert.Nil(t, config.Validate())
+
+	config.RestrictedNetworkConfig.CIDR.Monitor = []string{"10.0.0.0/8"}
+	assert.EqualError(t, config.Validate(), `network.cidr.monitor: "10.0.0.0/8" is not an entry of network.cidr.deny`)
+	config.RestrictedNetworkConfig.CIDR.Monitor = []string{}
+
+	config.RestrictedNetworkConfig.Domain.Monitor = []string{"www.example.com"}
+	assert.EqualError(t, config.Validate(), `network.domain.monitor: "www.example.com" is not an entry of network.domain.deny`)
+	config.RestrictedNetworkConfig.Domain.Monitor = []string{}
+
+	config.RestrictedNetworkConfig.Command.Monitor = []string{"python*"}
+	assert.EqualError(t, config.Validate(), `network.command.monitor: "python*" is a pattern, only the commands of network.command.deny can be in mode: monitor`)
+}
@@ -0,0 +1,75 @@
+package config
+
+import (
+	"fmt"
+	"os/user"
+	"strings"
+)
+
+// lookupUser and lookupGroup return the id of a user or a group name of the host.
+var (
+	lookupUser = func(name string) (string, error) {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return "", err
+		}
+		return u.Uid, nil
+	}
+	lookupGroup = func(name string) (string, error) {
+		g, err := user.LookupGroup(name)
+		if err != nil {
+			return "", err
+		}
+		return g.Gid, nil
+	}
+)
+
+// ResolvedName is a user name of network.uid or a group name of network.gid, and the id it was
+// resolved to on the host.
+type ResolvedName struct {
+	List string
+	Name string
+	ID   string
+}
+
+func (n ResolvedName) String() string {
+	return fmt.Sprintf("%s: %q is %s", n.List, n.Name, n.ID)
+}
+
+// resolveNames replaces the user names of network.uid and the group names of network.gid with
+// their ids, as the same name can have a different id on each host. An entry of digits, a uid, a
+// range of uids or a gid, is kept as it is, and Validate parses it.
+func (c *Config) resolveNames() error {
+	network := &c.RestrictedNetworkConfig
+	c.resolvedNames = []ResolvedName{}
+	for _, list := range []struct {
+		name    string
+		entries []string
+		lookup  func(string) (string, error)
+	}{
+		{"network.uid.allow", network.UID.Allow, lookupUser},
+		{"network.uid.deny", network.UID.Deny, lookupUser},
+		{"network.gid.allow", network.GID.Allow, lookupGroup},
+		{"network.gid.deny", network.GID.Deny, lookupGroup},
+	} {
+		for i, entry := range list.entries {
+			name := strings.TrimSpace(entry)
+			if strings.Trim(name, "0123456789- ") == "" {
+				continue
+			}
+			id, err := list.lookup(name)
+			if err != nil {
+				return fmt.Errorf("%s: can not resolve %q: %w", list.name, name, err)
+			}
+			list.entries[i] = id
+			c.resolvedNames = append(c.resolvedNames, ResolvedName{List: list.name, Name: name, ID: id})
+		}
+	}
+	return nil
+}
+
+// ResolvedNames returns the user and group names of the uid and gid lists, with the ids they
+// were replaced with.
+func (c *Config) ResolvedNames() []ResolvedName {
+	return c.resolvedNames
+}
@@ -0,0 +1,57 @@
+package config
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func fakeLookup(ids map[string]string) func(string) (string, error) {
+	return func(name string) (string, error) {
+		if id, ok := ids[name]; ok {
+			return id, nil
+		}
+		return "", fmt.Errorf("unknown name %s", name)
+	}
+}
+
+func TestResolveNames(t *testing.T) {
+	defer func(u, g func(string) (string, error)) { lookupUser, lookupGroup = u, g }(lookupUser, lookupGroup)
+	lookupUser = fakeLookup(map[string]string{"postgres": "107", "nobody": "65534"})
+	lookupGroup = fakeLookup(map[string]string{"docker": "999"})
+
+	conf, err := Parse([]byte(`
+network:
+  uid:
+    allow: [postgres, 0, "10000-59999"]
+    deny: [" nobody "]
+  gid:
+    allow: [docker, 100]
+`))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"107", "0", "10000-59999"}, conf.RestrictedNetworkConfig.UID.Allow)
+	assert.Equal(t, []string{"65534"}, conf.RestrictedNetworkConfig.UID.Deny)
+	assert.Equal(t, []uint{999, 100}, GIDs(conf.RestrictedNetworkConfig.GID.Allow))
+	assert.Equal(t, []ResolvedName{
+		{List: "network.uid.allow", Name: "postgres", ID: "107"},
+		{List: "network.uid.deny", Name: "nobody", ID: "65534"},
+		{List: "network.gid.allow", Name: "docker", ID: "999"},
+	}, conf.ResolvedNames())
+	assert.Equal(t, `network.uid.allow: "postgres" is 107`, conf.ResolvedNames()[0].String())
+
+	_, err = Parse([]byte(`
+network:
+  gid:
+    deny: [wheel]
+`))
+	assert.EqualError(t, err, `network.gid.deny: can not resolve "wheel": unknown name wheel`)
+
+	// Digits are never looked up, and an invalid uid is left to Validate.
+	_, err = Parse([]byte(`
+network:
+  uid:
+    allow: [4294967295]
+`))
+	assert.EqualError(t, err, `network.uid.allow: "4294967295" is not a uid or a range of uids between 0 and 4294967294`)
+}
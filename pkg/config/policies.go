@@ -0,0 +1,186 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// POLICY_ENTRY_MAX is the number of entries network.policies can have: the programs match the
+// task with a bitmask of the entries. network.host and network.container take one each.
+const POLICY_ENTRY_MAX = 64
+
+// The values of network.target. TARGET_ALL restricts every process, with the destinations of
+// network.host and network.container, and is only supported by the network restriction.
+const (
+	TARGET_HOST      = "host"
+	TARGET_CONTAINER = "container"
+	TARGET_ALL       = "all"
+)
+
+// PolicyEntryConfig is an entry of network.policies: the destinations the tasks it selects may
+// connect to, instead of the ones of network.cidr and network.domain. A task is selected when
+// each selector that is set matches it: its comm is in Command, its uid in UID and its gid in
+// GID. The first entry that selects a task decides its destinations; the other lists of
+// network, e.g. network.command and network.ports, still apply.
+type PolicyEntryConfig struct {
+	// Name names the entry in the events and the rules.
+	Name    string   `yaml:"name"`
+	Command []string `yaml:"command"`
+	UID     []uint   `yaml:"uid"`
+	GID     []uint   `yaml:"gid"`
+	// A destination in Deny is denied. With entries in Allow, a destination is denied unless
+	// it is in Allow; without, it is permitted unless it is in Deny.
+	CIDR   PolicyListsConfig `yaml:"cidr"`
+	Domain PolicyListsConfig `yaml:"domain"`
+	// Target is set for the entries of network.host and network.container, TARGET_HOST or
+	// TARGET_CONTAINER: they select the tasks outside or inside a classified container instead.
+	Target string `yaml:"-"`
+}
+
+// TargetPolicyConfig is network.host or network.container: with target: all, the destinations of
+// the tasks outside or inside the classified containers, as those of an entry of network.policies
+// that selects them. An entry of network.policies that selects a task still comes first, and a
+// section without entries leaves the tasks to network.cidr and network.domain.
+type TargetPolicyConfig struct {
+	CIDR   PolicyListsConfig `yaml:"cidr"`
+	Domain PolicyListsConfig `yaml:"domain"`
+}
+
+func (t TargetPolicyConfig) isEmpty() bool {
+	return len(t.CIDR.Allow)+len(t.CIDR.Deny)+len(t.Domain.Allow)+len(t.Domain.Deny) == 0
+}
+
+// PolicyListsConfig are the allow and deny lists of an entry of network.policies.
+type PolicyListsConfig struct {
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+}
+
+// HasAllow reports whether the entry restricts its tasks to the destinations it allows.
+func (e PolicyEntryConfig) HasAllow() bool {
+	return len(e.CIDR.Allow)+len(e.Domain.Allow) > 0
+}
+
+// Key returns the key of the entry in the errors and the rules, e.g. "network.policies[curl]",
+// or "network.host" and "network.container".
+func (e PolicyEntryConfig) Key() string {
+	if e.Target != "" {
+		return "network." + e.Target
+	}
+	return fmt.Sprintf("network.policies[%s]", e.Name)
+}
+
+// PolicyEntries returns the entries of network.policies, followed by network.host and
+// network.container when they have entries, in the order the programs select them.
+func (c RestrictedNetworkConfig) PolicyEntries() []PolicyEntryConfig {
+	entries := append([]PolicyEntryConfig{}, c.Policies...)
+	for _, target := range []struct {
+		name   string
+		policy TargetPolicyConfig
+	}{
+		{TARGET_HOST, c.Host},
+		{TARGET_CONTAINER, c.Container},
+	} {
+		if !target.policy.isEmpty() {
+			entries = append(entries, PolicyEntryConfig{Name: target.name, CIDR: target.policy.CIDR, Domain: target.policy.Domain, Target: target.name})
+		}
+	}
+	return entries
+}
+
+// normalizePolicies trims the commands of the entries, and lowercases them if
+// network.command.case_insensitive is set.
+func (c *Config) normalizePolicies() {
+	for _, entry := range c.RestrictedNetworkConfig.Policies {
+		for i := range entry.Command {
+			entry.Command[i] = strings.TrimSpace(entry.Command[i])
+			if c.RestrictedNetworkConfig.Command.CaseInsensitive {
+				entry.Command[i] = strings.ToLower(entry.Command[i])
+			}
+		}
+	}
+}
+
+// validatePolicies checks the entries of network.policies. Their CIDRs are checked when they
+// are written, as the ones of network.cidr are.
+func (c *Config) validatePolicies() error {
+	network := c.RestrictedNetworkConfig
+	switch network.Target {
+	case "", TARGET_HOST, TARGET_CONTAINER, TARGET_ALL:
+	default:
+		return fmt.Errorf("network.target must be %s, %s or %s, got %q", TARGET_HOST, TARGET_CONTAINER, TARGET_ALL, network.Target)
+	}
+	if network.Target != TARGET_ALL {
+		for name, target := range map[string]TargetPolicyConfig{"network.host": network.Host, "network.container": network.Container} {
+			if !target.isEmpty() {
+				return fmt.Errorf("%s needs network.target: %s, got %q", name, TARGET_ALL, network.Target)
+			}
+		}
+	}
+
+	entries := network.PolicyEntries()
+	if len(entries) > POLICY_ENTRY_MAX {
+		return fmt.Errorf("network.policies can have at most %d entries, got %d", POLICY_ENTRY_MAX, len(entries))
+	}
+
+	names := map[string]bool{}
+	for i, entry := range entries {
+		if entry.Target != "" {
+			if err := entry.validateLists(); err != nil {
+				return err
+			}
+			continue
+		}
+		if entry.Name == "" || strings.ContainsAny(entry.Name, "[] \t") {
+			return fmt.Errorf("network.policies[%d].name must be a non-empty name without spaces or brackets, got %q", i, entry.Name)
+		}
+		if names[entry.Name] {
+			return fmt.Errorf("network.policies[%d]: %s is defined twice", i, entry.Name)
+		}
+		names[entry.Name] = true
+
+		if len(entry.Command)+len(entry.UID)+len(entry.GID) == 0 {
+			return fmt.Errorf("%s selects every task: it needs a command, uid or gid", entry.Key())
+		}
+		for _, command := range entry.Command {
+			if command == "" || strings.ContainsRune(command, 0) {
+				return fmt.Errorf("%s.command: %q is not a command", entry.Key(), command)
+			}
+			if IsCommandPattern(command) {
+				return fmt.Errorf("%s.command: the pattern %q is not supported, only network.command takes patterns", entry.Key(), command)
+			}
+		}
+		if err := entry.validateLists(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateLists checks that the lists of the entry have neither group references nor wildcard
+// domains.
+func (e PolicyEntryConfig) validateLists() error {
+	section := "network.policies"
+	if e.Target != "" {
+		section = e.Key()
+	}
+	for _, list := range []struct {
+		name    string
+		entries []string
+	}{
+		{"cidr.allow", e.CIDR.Allow},
+		{"cidr.deny", e.CIDR.Deny},
+		{"domain.allow", e.Domain.Allow},
+		{"domain.deny", e.Domain.Deny},
+	} {
+		for _, entry := range list.entries {
+			if _, ok := GroupName(entry); ok {
+				return fmt.Errorf("%s.%s: group references are not supported in %s, got %q", e.Key(), list.name, section, entry)
+			}
+			if IsWildcardDomain(entry) {
+				return fmt.Errorf("%s.%s: the wildcard domain %s is not supported in %s", e.Key(), list.name, entry, section)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package config
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePolicies(t *testing.T) {
+	conf, err := Parse([]byte(`
+network:
+  command:
+    case_insensitive: true
+  policies:
+    - name: curl
+      command: [" Curl "]
+      cidr:
+        allow: [10.1.0.0/16]
+    - name: deploy
+      uid: [1000]
+      gid: [100]
+      domain:
+        deny: [example.com]
+`))
+	assert.Nil(t, err)
+	policies := conf.RestrictedNetworkConfig.Policies
+	assert.Equal(t, []PolicyEntryConfig{
+		{Name: "curl", Command: []string{"curl"}, CIDR: PolicyListsConfig{Allow: []string{"10.1.0.0/16"}}},
+		{Name: "deploy", UID: []uint{1000}, GID: []uint{100}, Domain: PolicyListsConfig{Deny: []string{"example.com"}}},
+	}, policies)
+	assert.True(t, policies[0].HasAllow())
+	assert.False(t, policies[1].HasAllow())
+	assert.Equal(t, "network.policies[deploy]", policies[1].Key())
+}
+
+func TestValidatePolicies(t *testing.T) {
+	for _, tc := range []struct {
+		entries []PolicyEntryConfig
+		err     string
+	}{
+		{[]PolicyEntryConfig{{Name: "curl", Command: []string{"curl"}}}, ""},
+		{[]PolicyEntryConfig{{Command: []string{"curl"}}}, `network.policies[0].name must be a non-empty name without spaces or brackets, got ""`},
+		{[]PolicyEntryConfig{{Name: "a b", Command: []string{"curl"}}}, `network.policies[0].name must be a non-empty name without spaces or brackets, got "a b"`},
+		{[]PolicyEntryConfig{{Name: "curl", Command: []string{"curl"}}, {Name: "curl", UID: []uint{0}}}, "network.policies[1]: curl is defined twice"},
+		{[]PolicyEntryConfig{{Name: "all"}}, "network.policies[all] selects every task: it needs a command, uid or gid"},
+		{[]PolicyEntryConfig{{Name: "py", Command: []string{"python*"}}}, `network.policies[py].command: the pattern "python*" is not supported, only network.command takes patterns`},
+		{[]PolicyEntryConfig{{Name: "curl", Command: []string{""}}}, `network.policies[curl].command: "" is not a command`},
+		{[]PolicyEntryConfig{{Name: "s3", UID: []uint{0}, Domain: PolicyListsConfig{Allow: []string{"*.s3.amazonaws.com"}}}}, "network.policies[s3].domain.allow: the wildcard domain *.s3.amazonaws.com is not supported in network.policies"},
+		{[]PolicyEntryConfig{{Name: "g", UID: []uint{0}, CIDR: PolicyListsConfig{Deny: []string{"group:private"}}}}, `network.policies[g].cidr.deny: group references are not supported in network.policies, got "group:private"`},
+	} {
+		conf := DefaultConfig()
+		conf.RestrictedNetworkConfig.Policies = tc.entries
+		err := conf.Validate()
+		if tc.err == "" {
+			assert.Nil(t, err)
+		} else {
+			assert.EqualError(t, err, tc.err)
+		}
+	}
+
+	conf := DefaultConfig()
+	for i := 0; i <= POLICY_ENTRY_MAX; i++ {
+		conf.RestrictedNetworkConfig.Policies = append(conf.RestrictedNetworkConfig.Policies, PolicyEntryConfig{Name: fmt.Sprintf("p%d", i), UID: []uint{uint(i)}})
+	}
+	assert.EqualError(t, conf.Validate(), "network.policies can have at most 64 entries, got 65")
+}
+
+func TestTargetPolicies(t *testing.T) {
+	conf, err := Parse([]byte(`
+network:
+  target: all
+  policies:
+    - name: curl
+      command: [curl]
+      cidr:
+        allow: [10.1.0.0/16]
+  host:
+    cidr:
+      allow: [10.0.0.0/8]
+  container:
+    domain:
+      allow: [example.com]
+`))
+	assert.Nil(t, err)
+	assert.True(t, conf.ClassifiesContainers("network"))
+	assert.False(t, conf.IsOnlyContainer("network"))
+
+	entries := conf.RestrictedNetworkConfig.PolicyEntries()
+	assert.Len(t, entries, 3)
+	assert.Equal(t, "network.policies[curl]", entries[0].Key())
+	assert.Equal(t, "network.host", entries[1].Key())
+	assert.Equal(t, "network.container", entries[2].Key())
+	assert.True(t, entries[2].HasAllow())
+
+	// An empty section takes no entry.
+	conf.RestrictedNetworkConfig.Container = TargetPolicyConfig{}
+	assert.Len(t, conf.RestrictedNetworkConfig.PolicyEntries(), 2)
+
+	conf.RestrictedNetworkConfig.Target = "host"
+	assert.EqualError(t, conf.Validate(), `network.host needs network.target: all, got "host"`)
+
+	conf.RestrictedNetworkConfig.Target = "all"
+	conf.RestrictedNetworkConfig.Host.Domain.Allow = []string{"*.example.com"}
+	assert.EqualError(t, conf.Validate(), "network.host.domain.allow: the wildcard domain *.example.com is not supported in network.host")
+
+	conf.RestrictedNetworkConfig.Target = "everything"
+	assert.EqualError(t, conf.Validate(), `network.target must be host, container or all, got "everything"`)
+}
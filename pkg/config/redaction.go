@@ -0,0 +1,69 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// REDACTED replaces the values `bouheki debug bundle` leaves out.
+const REDACTED = "[redacted]"
+
+// EVENT_FIELDS are the fields of the audit events, which redaction.event_fields can name.
+var EVENT_FIELDS = []string{
+	"Action", "Hostname", "PID", "Comm", "ParentComm", "EventVersion", "PolicyDigest", "Operation",
+	"Addr", "Domain", "Port", "Protocol", "LocalAddr", "LocalPort", "Unbound", "DestinationTags",
+	"ContainerCgroup", "Self", "CommandPattern", "PolicyEntry", "Rule", "Count", "UID", "GID", "Path",
+	"SourcePath", "CgroupID", "ContainerID", "ContainerName", "ContainerImage", "PodName", "PodNamespace",
+}
+
+// RedactionConfig is what `bouheki debug bundle` leaves out of a bundle, for it to be attached
+// to a public bug report.
+type RedactionConfig struct {
+	// EventFields are the fields of the audit events that are replaced by REDACTED, wherever
+	// they are in the bundle.
+	EventFields []string `yaml:"event_fields"`
+	// Labels replaces the values of log.labels, in the config and in the logs.
+	Labels bool `yaml:"labels"`
+}
+
+func (c RedactionConfig) validate() error {
+	for i, field := range c.EventFields {
+		known := false
+		for _, f := range EVENT_FIELDS {
+			known = known || f == field
+		}
+		if !known {
+			return fmt.Errorf("redaction.event_fields[%d]: %q is not a field of the audit events", i, field)
+		}
+	}
+	return nil
+}
+
+// Redacted returns a copy of the config without its secrets, the freeze override token, the
+// credentials of falco_output.url and the bearer token and headers of audit_output.webhook, and without the values of the labels if redaction.labels is set.
+func (c *Config) Redacted() *Config {
+	redacted := *c
+	if redacted.Admin.FreezeOverrideToken != "" {
+		redacted.Admin.FreezeOverrideToken = REDACTED
+	}
+	if u, err := url.Parse(redacted.FalcoOutput.URL); err == nil && u.User != nil {
+		u.User = url.User(REDACTED)
+		redacted.FalcoOutput.URL = u.String()
+	}
+	webhook := c.AuditOutput.Webhook
+	if webhook.BearerToken != "" {
+		webhook.BearerToken = REDACTED
+	}
+	webhook.Headers = map[string]string{}
+	for key := range c.AuditOutput.Webhook.Headers {
+		webhook.Headers[key] = REDACTED
+	}
+	redacted.AuditOutput.Webhook = webhook
+	if c.Redaction.Labels {
+		redacted.Log.Labels = map[string]string{}
+		for key := range c.Log.Labels {
+			redacted.Log.Labels[key] = REDACTED
+		}
+	}
+	return &redacted
+}
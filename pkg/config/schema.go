@@ -0,0 +1,230 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// LEGACY_VERSION is the version of a config file without a `version:` key.
+	// Unknown fields are ignored with a warning.
+	LEGACY_VERSION = 1
+	// CURRENT_VERSION rejects unknown fields.
+	CURRENT_VERSION = 2
+)
+
+// UnknownField is a key of the config file that does not match any field.
+type UnknownField struct {
+	// Path is the YAML path of the key, e.g. "network.ciddr".
+	Path string
+	// Suggestion is the path of the nearest known field, if there is a close one.
+	Suggestion string
+}
+
+func (f UnknownField) String() string {
+	if f.Suggestion == "" {
+		return fmt.Sprintf("%s: unknown field", f.Path)
+	}
+	return fmt.Sprintf("%s: unknown field, did you mean %s?", f.Path, f.Suggestion)
+}
+
+// UnknownFieldsError is returned for unknown fields in a version 2 config.
+type UnknownFieldsError struct {
+	Fields []UnknownField
+}
+
+func (e *UnknownFieldsError) Error() string {
+	paths := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		paths[i] = f.Path
+	}
+	return fmt.Sprintf("unknown fields in config: %s", strings.Join(paths, ", "))
+}
+
+// decodeVersioned decodes data into config. Version 2 configs are decoded strictly,
+// versionless ones leniently with the ignored keys returned.
+func decodeVersioned(data []byte, config *Config) ([]UnknownField, error) {
+	var header struct {
+		Version int `yaml:"version"`
+	}
+	if err := yaml.Unmarshal(data, &header); err != nil {
+		return nil, err
+	}
+
+	switch header.Version {
+	case 0, LEGACY_VERSION, CURRENT_VERSION:
+	default:
+		return nil, fmt.Errorf("unsupported config version %d, the latest is %d", header.Version, CURRENT_VERSION)
+	}
+
+	var tree interface{}
+	if err := yaml.Unmarshal(data, &tree); err != nil {
+		return nil, err
+	}
+	unknown := unknownFields("", tree, reflect.TypeOf(Config{}))
+
+	if header.Version == CURRENT_VERSION && len(unknown) > 0 {
+		return unknown, &UnknownFieldsError{Fields: unknown}
+	}
+
+	if err := yaml.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+	if config.Version == 0 {
+		config.Version = LEGACY_VERSION
+	}
+
+	return unknown, nil
+}
+
+// yamlFields returns the YAML keys of the struct t, resolved the same way as yaml.v2 does.
+func yamlFields(t reflect.Type) map[string]reflect.Type {
+	fields := map[string]reflect.Type{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" && !field.Anonymous {
+			continue
+		}
+
+		tag := field.Tag.Get("yaml")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if strings.Contains(tag, ",inline") {
+			for k, v := range yamlFields(field.Type) {
+				fields[k] = v
+			}
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		fields[name] = field.Type
+	}
+	return fields
+}
+
+func unknownFields(path string, node interface{}, t reflect.Type) []UnknownField {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	unknown := []UnknownField{}
+	switch t.Kind() {
+	case reflect.Struct:
+		m, ok := node.(map[interface{}]interface{})
+		if !ok {
+			return unknown
+		}
+
+		fields := yamlFields(t)
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, fmt.Sprint(k))
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			fieldType, ok := fields[key]
+			if !ok {
+				field := UnknownField{Path: joinPath(path, key)}
+				if suggestion := nearestField(key, fields); suggestion != "" {
+					field.Suggestion = joinPath(path, suggestion)
+				}
+				unknown = append(unknown, field)
+				continue
+			}
+			unknown = append(unknown, unknownFields(joinPath(path, key), m[key], fieldType)...)
+		}
+	case reflect.Map:
+		m, ok := node.(map[interface{}]interface{})
+		if !ok {
+			return unknown
+		}
+
+		keys := make([]string, 0, len(m))
+		values := map[string]interface{}{}
+		for k, v := range m {
+			keys = append(keys, fmt.Sprint(k))
+			values[fmt.Sprint(k)] = v
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			unknown = append(unknown, unknownFields(joinPath(path, key), values[key], t.Elem())...)
+		}
+	case reflect.Slice:
+		items, ok := node.([]interface{})
+		if !ok {
+			return unknown
+		}
+		for i, item := range items {
+			unknown = append(unknown, unknownFields(fmt.Sprintf("%s[%d]", path, i), item, t.Elem())...)
+		}
+	}
+
+	return unknown
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// nearestField returns the known field closest to key by edit distance, if it is close enough to be a typo.
+func nearestField(key string, fields map[string]reflect.Type) string {
+	best, bestDistance := "", -1
+	for name := range fields {
+		d := editDistance(key, name)
+		if bestDistance == -1 || d < bestDistance || (d == bestDistance && name < best) {
+			best, bestDistance = name, d
+		}
+	}
+
+	maxDistance := len(key) / 3
+	if maxDistance < 1 {
+		maxDistance = 1
+	}
+	if bestDistance == -1 || bestDistance > maxDistance {
+		return ""
+	}
+	return best
+}
+
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
+
+func min(values ...int) int {
+	m := values[0]
+	for _, v := range values[1:] {
+		if v < m {
+			m = v
+		}
+	}
+	return m
+}
@@ -0,0 +1,101 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/mrtc0/bouheki/pkg/errkind"
+	"github.com/stretchr/testify/assert"
+)
+
+const typoConfig = `
+nework:
+  mode: block
+network:
+  mode: block
+  ciddr:
+    allow: [10.0.0.0/8]
+  domain:
+    allow: [example.com]
+    preload_fiel: /etc/bouheki/domains.json
+log:
+  level: debug
+  labels:
+    any_label: value
+`
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "bouheki.yaml")
+	assert.Nil(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestLegacyConfigIgnoresUnknownFields(t *testing.T) {
+	config, err := NewConfig(writeConfig(t, typoConfig))
+	assert.Nil(t, err)
+	assert.Equal(t, LEGACY_VERSION, config.Version)
+	assert.Equal(t, "block", config.RestrictedNetworkConfig.Mode)
+	assert.Equal(t, []string{"example.com"}, config.RestrictedNetworkConfig.Domain.Allow)
+	assert.Equal(t, []UnknownField{
+		{Path: "network.ciddr", Suggestion: "network.cidr"},
+		{Path: "network.domain.preload_fiel", Suggestion: "network.domain.preload_file"},
+		{Path: "nework", Suggestion: "network"},
+	}, config.IgnoredFields())
+}
+
+func TestVersion2ConfigRejectsUnknownFields(t *testing.T) {
+	_, err := NewConfig(writeConfig(t, "version: 2\n"+typoConfig))
+	assert.NotNil(t, err)
+	assert.Equal(t, errkind.Config, errkind.KindOf(err))
+
+	var unknown *UnknownFieldsError
+	assert.True(t, errors.As(err, &unknown))
+	assert.Equal(t, "unknown fields in config: network.ciddr, network.domain.preload_fiel, nework", unknown.Error())
+	assert.Equal(t, "network.ciddr: unknown field, did you mean network.cidr?", unknown.Fields[0].String())
+}
+
+func TestVersion2Config(t *testing.T) {
+	config, err := NewConfig(writeConfig(t, `
+version: 2
+network:
+  enable: true
+  mode: block
+  cidr:
+    allow: [10.0.0.0/8]
+  command:
+    deny: [curl]
+log:
+  format: json
+metrics:
+  enable: true
+`))
+	assert.Nil(t, err)
+	assert.Equal(t, CURRENT_VERSION, config.Version)
+	assert.Empty(t, config.IgnoredFields())
+	assert.Equal(t, []string{"10.0.0.0/8"}, config.RestrictedNetworkConfig.CIDR.Allow)
+}
+
+func TestUnsupportedConfigVersion(t *testing.T) {
+	_, err := NewConfig(writeConfig(t, "version: 3\n"))
+	assert.NotNil(t, err)
+	assert.Equal(t, errkind.Config, errkind.KindOf(err))
+}
+
+func TestNearestField(t *testing.T) {
+	fields := yamlFields(reflect.TypeOf(Config{}))
+
+	assert.Equal(t, "network", nearestField("nework", fields))
+	assert.Equal(t, "dns_proxy", nearestField("dns_prxy", fields))
+	assert.Equal(t, "", nearestField("completely_unrelated", fields))
+	assert.Equal(t, "", nearestField("x", fields))
+}
+
+func TestEditDistance(t *testing.T) {
+	assert.Equal(t, 0, editDistance("cidr", "cidr"))
+	assert.Equal(t, 1, editDistance("ciddr", "cidr"))
+	assert.Equal(t, 2, editDistance("preload_fiel", "preload_file"))
+	assert.Equal(t, 4, editDistance("", "cidr"))
+}
@@ -0,0 +1,97 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ShadowedEntry is a CIDR entry inside an entry of the other side that wins over it with the
+// precedence of network.policy, so that it never decides a connection: an allow entry inside a
+// deny entry with deny-first, or a deny entry inside an allow entry with allow-first. An allow
+// entry inside an entry of network.cidr.allow_except is shadowed with either precedence.
+type ShadowedEntry struct {
+	List  string
+	Entry string
+	// By is the list and ByEntry the entry that wins over it.
+	By         string
+	ByEntry    string
+	Precedence string
+}
+
+func (e ShadowedEntry) String() string {
+	if e.By == "network.cidr.allow_except" {
+		return fmt.Sprintf("%s: %q is inside %s %q, which always wins, the entry has no effect", e.List, e.Entry, e.By, e.ByEntry)
+	}
+	return fmt.Sprintf("%s: %q is inside %s %q, which wins with %s, the entry has no effect", e.List, e.Entry, e.By, e.ByEntry, e.Precedence)
+}
+
+// cidrEntry is an entry of a CIDR list, parsed.
+type cidrEntry struct {
+	list  string
+	entry string
+	n     *net.IPNet
+}
+
+func parseCIDREntries(list string, entries []string) []cidrEntry {
+	parsed := []cidrEntry{}
+	for _, entry := range entries {
+		if n, ok := parseNormalizedCIDR(entry); ok {
+			parsed = append(parsed, cidrEntry{list: list, entry: entry, n: n})
+		}
+	}
+	return parsed
+}
+
+// ShadowedEntries returns the entries of network.cidr and of its protocol lists that never decide
+// a connection. An entry the same as one of the other side is a conflict, not shadowed.
+func (c *Config) ShadowedEntries() []ShadowedEntry {
+	network := c.RestrictedNetworkConfig
+	precedence := network.Decision.Precedence
+	if precedence == "" {
+		precedence = PRECEDENCE_DENY_FIRST
+	}
+
+	allow := parseCIDREntries("network.cidr.allow", network.CIDR.Allow)
+	deny := parseCIDREntries("network.cidr.deny", network.CIDR.Deny)
+	excepts := parseCIDREntries("network.cidr.allow_except", network.CIDR.AllowExcept)
+
+	shadowed := []ShadowedEntry{}
+	seen := map[string]bool{}
+	// With a protocol list, only the pairs with an entry of it are checked, the others being
+	// those of network.cidr.
+	check := func(inner, outer []cidrEntry, protocolList string) {
+		for _, i := range inner {
+			for _, o := range outer {
+				if protocolList != "" && !strings.HasPrefix(i.list, protocolList) && !strings.HasPrefix(o.list, protocolList) {
+					continue
+				}
+				if i.n.String() == o.n.String() || !PrefixInside(i.n, o.n) || seen[i.list+" "+i.entry] {
+					continue
+				}
+				seen[i.list+" "+i.entry] = true
+				shadowed = append(shadowed, ShadowedEntry{List: i.list, Entry: i.entry, By: o.list, ByEntry: o.entry, Precedence: precedence})
+				break
+			}
+		}
+	}
+	byPrecedence := func(allow, deny []cidrEntry, protocolList string) {
+		check(allow, excepts, protocolList)
+		if precedence == PRECEDENCE_ALLOW_FIRST {
+			check(deny, allow, protocolList)
+		} else {
+			check(allow, deny, protocolList)
+		}
+	}
+
+	byPrecedence(allow, deny, "")
+	for _, protocol := range []string{PROTOCOL_TCP, PROTOCOL_UDP} {
+		list := fmt.Sprintf("network.cidr.protocols[%s]", protocol)
+		protocolAllow, protocolDeny := ProtocolLists(network.CIDR.Protocols, protocol)
+		byPrecedence(
+			append(append([]cidrEntry{}, allow...), parseCIDREntries(list+".allow", protocolAllow)...),
+			append(append([]cidrEntry{}, deny...), parseCIDREntries(list+".deny", protocolDeny)...),
+			list)
+	}
+	return shadowed
+}
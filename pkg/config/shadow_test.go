@@ -0,0 +1,77 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShadowedEntries(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(c *RestrictedNetworkConfig)
+		want   []ShadowedEntry
+	}{
+		{
+			name:   "the default config",
+			modify: func(c *RestrictedNetworkConfig) {},
+			want:   []ShadowedEntry{},
+		},
+		{
+			name: "a deny entry inside an allow entry carves it out with deny-first",
+			modify: func(c *RestrictedNetworkConfig) {
+				c.CIDR.Allow = []string{"10.0.0.0/8"}
+				c.CIDR.Deny = []string{"10.1.0.0/16"}
+			},
+			want: []ShadowedEntry{},
+		},
+		{
+			name: "an allow entry inside a deny entry with deny-first",
+			modify: func(c *RestrictedNetworkConfig) {
+				c.CIDR.Allow = []string{"10.1.0.0/16", "192.168.0.0/16", "10.0.0.0/8"}
+				c.CIDR.Deny = []string{"10.0.0.0/8"}
+			},
+			want: []ShadowedEntry{{List: "network.cidr.allow", Entry: "10.1.0.0/16", By: "network.cidr.deny", ByEntry: "10.0.0.0/8", Precedence: PRECEDENCE_DENY_FIRST}},
+		},
+		{
+			name: "a deny entry inside an allow entry with allow-first",
+			modify: func(c *RestrictedNetworkConfig) {
+				c.Decision.Precedence = PRECEDENCE_ALLOW_FIRST
+				c.CIDR.Allow = []string{"10.0.0.0/8"}
+				c.CIDR.Deny = []string{"10.1.0.0/16", "192.168.0.0/16"}
+			},
+			want: []ShadowedEntry{{List: "network.cidr.deny", Entry: "10.1.0.0/16", By: "network.cidr.allow", ByEntry: "10.0.0.0/8", Precedence: PRECEDENCE_ALLOW_FIRST}},
+		},
+		{
+			name: "an allow entry inside an except with either precedence",
+			modify: func(c *RestrictedNetworkConfig) {
+				c.Decision.Precedence = PRECEDENCE_ALLOW_FIRST
+				c.CIDR.Allow = []string{"0.0.0.0/0", "169.254.169.254/32"}
+				c.CIDR.AllowExcept = []string{"169.254.0.0/16"}
+			},
+			want: []ShadowedEntry{{List: "network.cidr.allow", Entry: "169.254.169.254/32", By: "network.cidr.allow_except", ByEntry: "169.254.0.0/16", Precedence: PRECEDENCE_ALLOW_FIRST}},
+		},
+		{
+			name: "a protocol allow entry inside a deny entry",
+			modify: func(c *RestrictedNetworkConfig) {
+				c.CIDR.Allow = []string{"10.0.0.0/8"}
+				c.CIDR.Deny = []string{"10.1.0.0/16"}
+				c.CIDR.Protocols = []ProtocolRulesConfig{{Protocol: PROTOCOL_UDP, Allow: []string{"10.1.0.53/32"}}}
+			},
+			want: []ShadowedEntry{{List: "network.cidr.protocols[udp].allow", Entry: "10.1.0.53/32", By: "network.cidr.deny", ByEntry: "10.1.0.0/16", Precedence: PRECEDENCE_DENY_FIRST}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := DefaultConfig()
+			test.modify(&config.RestrictedNetworkConfig)
+			assert.Equal(t, test.want, config.ShadowedEntries())
+		})
+	}
+
+	assert.Equal(t, `network.cidr.allow: "10.1.0.0/16" is inside network.cidr.deny "10.0.0.0/8", which wins with deny-first, the entry has no effect`,
+		ShadowedEntry{List: "network.cidr.allow", Entry: "10.1.0.0/16", By: "network.cidr.deny", ByEntry: "10.0.0.0/8", Precedence: PRECEDENCE_DENY_FIRST}.String())
+	assert.Equal(t, `network.cidr.allow: "169.254.169.254/32" is inside network.cidr.allow_except "169.254.0.0/16", which always wins, the entry has no effect`,
+		ShadowedEntry{List: "network.cidr.allow", Entry: "169.254.169.254/32", By: "network.cidr.allow_except", ByEntry: "169.254.0.0/16"}.String())
+}
@@ -0,0 +1,136 @@
+package config
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// UIDRange is an inclusive range of uids of network.uid.
+type UIDRange struct {
+	First uint32
+	Last  uint32
+}
+
+func (r UIDRange) String() string {
+	if r.First == r.Last {
+		return strconv.FormatUint(uint64(r.First), 10)
+	}
+	return fmt.Sprintf("%d-%d", r.First, r.Last)
+}
+
+// Contains reports whether uid is in the range.
+func (r UIDRange) Contains(uid uint32) bool {
+	return r.First <= uid && uid <= r.Last
+}
+
+// overlap returns the uids of both r and o.
+func (r UIDRange) overlap(o UIDRange) (UIDRange, bool) {
+	first, last := r.First, r.Last
+	if o.First > first {
+		first = o.First
+	}
+	if o.Last < last {
+		last = o.Last
+	}
+	return UIDRange{First: first, Last: last}, first <= last
+}
+
+// ParseUIDRange parses an entry of network.uid: a uid, e.g. 0, or an inclusive range, e.g. 10000-59999.
+func ParseUIDRange(entry string) (UIDRange, error) {
+	first, last := entry, entry
+	if i := strings.Index(entry, "-"); i >= 0 {
+		first, last = entry[:i], entry[i+1:]
+	}
+	parse := func(s string) (uint32, error) {
+		uid, err := strconv.ParseUint(strings.TrimSpace(s), 10, 32)
+		if err != nil || uid == math.MaxUint32 {
+			return 0, fmt.Errorf("%q is not a uid or a range of uids between 0 and %d", entry, uint32(math.MaxUint32-1))
+		}
+		return uint32(uid), nil
+	}
+
+	r := UIDRange{}
+	var err error
+	if r.First, err = parse(first); err != nil {
+		return UIDRange{}, err
+	}
+	if r.Last, err = parse(last); err != nil {
+		return UIDRange{}, err
+	}
+	if r.First > r.Last {
+		return UIDRange{}, fmt.Errorf("%q: the first uid of the range is greater than the last", entry)
+	}
+	return r, nil
+}
+
+// SplitUIDs returns the uids of a list of network.uid, and the ranges of more than one uid, in
+// the order of the list. The entries that can not be parsed are left out, which Validate rejects.
+func SplitUIDs(entries []string) ([]uint, []UIDRange) {
+	uids, ranges := []uint{}, []UIDRange{}
+	for _, entry := range entries {
+		r, err := ParseUIDRange(entry)
+		if err != nil {
+			continue
+		}
+		if r.First == r.Last {
+			uids = append(uids, uint(r.First))
+		} else {
+			ranges = append(ranges, r)
+		}
+	}
+	return uids, ranges
+}
+
+// ParseGID parses an entry of network.gid, a gid between 0 and 4294967294.
+func ParseGID(entry string) (uint32, error) {
+	gid, err := strconv.ParseUint(strings.TrimSpace(entry), 10, 32)
+	if err != nil || gid == math.MaxUint32 {
+		return 0, fmt.Errorf("%q is not a gid between 0 and %d", entry, uint32(math.MaxUint32-1))
+	}
+	return uint32(gid), nil
+}
+
+// GIDs returns the gids of a list of network.gid. The entries that can not be parsed are left
+// out, which Validate rejects.
+func GIDs(entries []string) []uint {
+	gids := []uint{}
+	for _, entry := range entries {
+		if gid, err := ParseGID(entry); err == nil {
+			gids = append(gids, uint(gid))
+		}
+	}
+	return gids
+}
+
+// validateIDs parses the entries of network.uid and network.gid.
+func (c *Config) validateIDs() error {
+	for _, list := range []struct {
+		name    string
+		entries []string
+		parse   func(string) error
+	}{
+		{"network.uid.allow", c.RestrictedNetworkConfig.UID.Allow, parseUIDEntry},
+		{"network.uid.deny", c.RestrictedNetworkConfig.UID.Deny, parseUIDEntry},
+		{"network.gid.allow", c.RestrictedNetworkConfig.GID.Allow, parseGIDEntry},
+		{"network.gid.deny", c.RestrictedNetworkConfig.GID.Deny, parseGIDEntry},
+	} {
+		for _, entry := range list.entries {
+			if err := list.parse(entry); err != nil {
+				return fmt.Errorf("%s: %w", list.name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func parseUIDEntry(entry string) error {
+	_, err := ParseUIDRange(entry)
+	return err
+}
+
+func parseGIDEntry(entry string) error {
+	_, err := ParseGID(entry)
+	return err
+}
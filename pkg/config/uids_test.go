@@ -0,0 +1,65 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseUIDs(t *testing.T) {
+	conf, err := Parse([]byte(`
+network:
+  uid:
+    allow: ["10000-59999", 0]
+    deny: [" 20000 - 20999 "]
+`))
+	assert.Nil(t, err)
+	uid := conf.RestrictedNetworkConfig.UID
+	assert.Equal(t, []string{"10000-59999", "0"}, uid.Allow)
+
+	uids, ranges := SplitUIDs(uid.Allow)
+	assert.Equal(t, []uint{0}, uids)
+	assert.Equal(t, []UIDRange{{First: 10000, Last: 59999}}, ranges)
+	_, ranges = SplitUIDs(uid.Deny)
+	assert.Equal(t, "20000-20999", ranges[0].String())
+	assert.True(t, ranges[0].Contains(20999))
+	assert.False(t, ranges[0].Contains(21000))
+}
+
+func TestParseUIDRange(t *testing.T) {
+	for _, tc := range []struct {
+		entry    string
+		expected UIDRange
+		err      string
+	}{
+		{entry: "0", expected: UIDRange{First: 0, Last: 0}},
+		{entry: "1000-1000", expected: UIDRange{First: 1000, Last: 1000}},
+		{entry: "0-4294967294", expected: UIDRange{First: 0, Last: 4294967294}},
+		{entry: "59999-10000", err: `"59999-10000": the first uid of the range is greater than the last`},
+		{entry: "4294967295", err: `"4294967295" is not a uid or a range of uids between 0 and 4294967294`},
+		{entry: "-1", err: `"-1" is not a uid or a range of uids between 0 and 4294967294`},
+		{entry: "root", err: `"root" is not a uid or a range of uids between 0 and 4294967294`},
+	} {
+		r, err := ParseUIDRange(tc.entry)
+		if tc.err != "" {
+			assert.EqualError(t, err, tc.err)
+			continue
+		}
+		assert.Nil(t, err)
+		assert.Equal(t, tc.expected, r)
+	}
+
+	conf := DefaultConfig()
+	conf.RestrictedNetworkConfig.UID.Deny = []string{"2000-1000"}
+	assert.EqualError(t, conf.Validate(), `network.uid.deny: "2000-1000": the first uid of the range is greater than the last`)
+}
+
+func TestParseGID(t *testing.T) {
+	gid, err := ParseGID(" 100 ")
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(100), gid)
+
+	_, err = ParseGID("100-200")
+	assert.EqualError(t, err, `"100-200" is not a gid between 0 and 4294967294`)
+	assert.Equal(t, []uint{0, 100}, GIDs([]string{"0", "x", "100"}))
+}
@@ -0,0 +1,245 @@
+// Package containers adds the container of the process to the audit events, as configured by
+// containers. The id of the container is read from the cgroup of the process: from
+// /proc/<pid>/cgroup, or, when the process has already exited or its pid was reused, from the
+// cgroup of the id the program wrote to the event. The name, the image and the pod of the
+// container are looked up from the container runtime.
+//
+// The lookups are cached: the cgroups by id, which the kernel does not reuse, and the
+// containers by id.
+package containers
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/classify"
+	"github.com/mrtc0/bouheki/pkg/clock"
+	"github.com/mrtc0/bouheki/pkg/config"
+	log "github.com/mrtc0/bouheki/pkg/log"
+)
+
+// containerID matches the id of a container in a cgroup path, e.g. the one of
+// /kubepods.slice/kubepods-pod<uid>.slice/cri-containerd-<id>.scope or /docker/<id>.
+var containerID = regexp.MustCompile(`[0-9a-f]{64}`)
+
+// errNotFound is returned by a Runtime that does not know a container.
+var errNotFound = errors.New("no such container")
+
+// errFound stops the walk of the cgroups once the cgroup is found.
+var errFound = errors.New("found")
+
+// DefaultEnricher is the enricher used by the package level Enrich. It is nil unless containers
+// is enabled.
+var DefaultEnricher *Enricher
+
+// Enrich adds the container of event with the DefaultEnricher.
+func Enrich(event *log.AuditEventLog) {
+	if DefaultEnricher != nil {
+		DefaultEnricher.Enrich(event)
+	}
+}
+
+// ID returns the id of the container of cgroup, "" if cgroup is not the cgroup of a container.
+// A cgroup below the one of the container, e.g. of the systemd of the container, is in it.
+func ID(cgroup string) string {
+	ids := containerID.FindAllString(cgroup, -1)
+	if len(ids) == 0 {
+		return ""
+	}
+	return ids[len(ids)-1]
+}
+
+// Info is what the container runtime knows of a container.
+type Info struct {
+	Name         string
+	Image        string
+	PodName      string
+	PodNamespace string
+}
+
+// Runtime looks up the containers of a container runtime.
+type Runtime interface {
+	// Lookup returns the container of id, or errNotFound.
+	Lookup(id string) (Info, error)
+}
+
+// container is a container of the cache, or one the runtime did not know at the time.
+type container struct {
+	info    Info
+	missing bool
+	at      time.Time
+}
+
+type Enricher struct {
+	mu         sync.Mutex
+	conf       config.ContainersConfig
+	clock      clock.Clock
+	procRoot   string
+	cgroupRoot string
+	// runtime is nil without containers.runtime.
+	runtime Runtime
+	// cgroups are the paths of the cgroups by id, "" for the ones removed before they were found.
+	cgroups map[uint64]string
+	// containers are the containers by id.
+	containers map[string]container
+}
+
+// New returns the enricher of conf, reading the processes and the cgroups of the host.
+func New(conf config.ContainersConfig, clk clock.Clock) *Enricher {
+	e := newEnricher(conf, clk, classify.PROC_ROOT, classify.CGROUP_ROOT)
+	switch conf.Runtime {
+	case config.CONTAINER_RUNTIME_DOCKER:
+		e.runtime = newDocker(conf.Socket, conf.Timeout)
+	case config.CONTAINER_RUNTIME_CONTAINERD:
+		e.runtime = containerd{stateDir: conf.StateDir}
+	}
+	return e
+}
+
+func newEnricher(conf config.ContainersConfig, clk clock.Clock, procRoot string, cgroupRoot string) *Enricher {
+	return &Enricher{
+		conf:       conf,
+		clock:      clk,
+		procRoot:   procRoot,
+		cgroupRoot: cgroupRoot,
+		cgroups:    map[uint64]string{},
+		containers: map[string]container{},
+	}
+}
+
+// Enrich sets the container of the process of event, found by its PID and its CgroupID. It leaves
+// event as it is for a process that is not in a container.
+func (e *Enricher) Enrich(event *log.AuditEventLog) {
+	id := ID(e.cgroup(event.PID, event.CgroupID))
+	if id == "" {
+		return
+	}
+	info := e.container(id)
+	event.ContainerID = id
+	event.ContainerName = info.Name
+	event.ContainerImage = info.Image
+	event.PodName = info.PodName
+	event.PodNamespace = info.PodNamespace
+}
+
+// cgroup returns the cgroup of pid, whose id was cgroupID when the event was written. The cgroup
+// is read from the proc filesystem, unless the process has exited or is in another cgroup by
+// now, e.g. a new process with the same pid, when the cgroup of cgroupID is looked up instead.
+func (e *Enricher) cgroup(pid uint32, cgroupID uint64) string {
+	if cgroupID != 0 {
+		e.mu.Lock()
+		path, ok := e.cgroups[cgroupID]
+		e.mu.Unlock()
+		if ok {
+			return path
+		}
+	}
+
+	path, err := classify.Cgroup(e.procRoot, int(pid))
+	if cgroupID == 0 {
+		if err != nil {
+			return ""
+		}
+		return path
+	}
+	if err != nil || e.cgroupInode(path) != cgroupID {
+		if path, err = e.findCgroup(cgroupID); err != nil {
+			log.Debug(fmt.Sprintf("containers: failed to find the cgroup of id %d: %s", cgroupID, err))
+			return ""
+		}
+	}
+
+	e.mu.Lock()
+	if len(e.cgroups) >= e.conf.CacheSize {
+		e.cgroups = map[uint64]string{}
+	}
+	e.cgroups[cgroupID] = path
+	e.mu.Unlock()
+	return path
+}
+
+// cgroupInode returns the inode of the directory of cgroup, which is its id, or 0.
+func (e *Enricher) cgroupInode(cgroup string) uint64 {
+	if cgroup == "" {
+		return 0
+	}
+	info, err := os.Stat(filepath.Join(e.cgroupRoot, filepath.FromSlash(cgroup)))
+	if err != nil {
+		return 0
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return stat.Ino
+	}
+	return 0
+}
+
+// findCgroup walks the cgroups for the one of id, "" if it has been removed.
+func (e *Enricher) findCgroup(id uint64) (string, error) {
+	found := ""
+	err := filepath.WalkDir(e.cgroupRoot, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// A cgroup removed during the walk.
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if stat, ok := info.Sys().(*syscall.Stat_t); !ok || stat.Ino != id {
+			return nil
+		}
+		rel, err := filepath.Rel(e.cgroupRoot, path)
+		if err != nil {
+			return err
+		}
+		found = "/" + filepath.ToSlash(rel)
+		return errFound
+	})
+	if err != nil && err != errFound {
+		return "", err
+	}
+	return found, nil
+}
+
+// container returns the container of id from the cache, or from the runtime. A container the
+// runtime does not know, or could not be asked for, is asked for again after cache_ttl.
+func (e *Enricher) container(id string) Info {
+	if e.runtime == nil {
+		return Info{}
+	}
+
+	now := e.clock.Now()
+	e.mu.Lock()
+	c, ok := e.containers[id]
+	e.mu.Unlock()
+	if ok && (!c.missing || now.Sub(c.at) < e.conf.CacheTTL) {
+		return c.info
+	}
+
+	info, err := e.runtime.Lookup(id)
+	c = container{info: info, missing: err != nil, at: now}
+	if err != nil && err != errNotFound {
+		log.Debug(fmt.Sprintf("containers: failed to look up container %s: %s", id, err))
+	}
+
+	e.mu.Lock()
+	if len(e.containers) >= e.conf.CacheSize {
+		e.containers = map[string]container{}
+	}
+	e.containers[id] = c
+	e.mu.Unlock()
+	return c.info
+}
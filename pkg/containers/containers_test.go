@@ -0,0 +1,206 @@
+package containers
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/bouhekitest"
+	"github.com/mrtc0/bouheki/pkg/config"
+	log "github.com/mrtc0/bouheki/pkg/log"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	id       = "3f4c3a8a9b1a2c0e5d6f7a8b9c0d1e2f3a4b5c6d7e8f9a0b1c2d3e4f5a6b7c8d"
+	podSlice = "/kubepods.slice/kubepods-besteffort.slice/kubepods-besteffort-pod1234.slice"
+)
+
+func TestID(t *testing.T) {
+	for cgroup, expected := range map[string]string{
+		podSlice + "/cri-containerd-" + id + ".scope": id,
+		"/system.slice/docker-" + id + ".scope":       id,
+		"/kubepods/burstable/pod1234/" + id:           id,
+		"/docker/" + id + "/init.scope":               id,
+		"/user.slice/user-1000.slice/session-1.scope": "",
+		"/": "",
+	} {
+		assert.Equal(t, expected, ID(cgroup), cgroup)
+	}
+}
+
+// fakeRuntime knows the containers of infos, and counts the lookups.
+type fakeRuntime struct {
+	infos   map[string]Info
+	lookups int
+}
+
+func (r *fakeRuntime) Lookup(id string) (Info, error) {
+	r.lookups++
+	info, ok := r.infos[id]
+	if !ok {
+		return Info{}, errNotFound
+	}
+	return info, nil
+}
+
+// testHost is a proc filesystem and a cgroup hierarchy with the cgroup of a container.
+type testHost struct {
+	procRoot   string
+	cgroupRoot string
+	// cgroupID is the id of the cgroup of the container.
+	cgroupID uint64
+}
+
+func newTestHost(t *testing.T) testHost {
+	dir := t.TempDir()
+	h := testHost{procRoot: filepath.Join(dir, "proc"), cgroupRoot: filepath.Join(dir, "cgroup")}
+	cgroup := filepath.Join(h.cgroupRoot, filepath.FromSlash(podSlice), "cri-containerd-"+id+".scope")
+	assert.Nil(t, os.MkdirAll(cgroup, 0755))
+	assert.Nil(t, os.MkdirAll(filepath.Join(h.cgroupRoot, "user.slice"), 0755))
+	info, err := os.Stat(cgroup)
+	assert.Nil(t, err)
+	h.cgroupID = info.Sys().(*syscall.Stat_t).Ino
+	return h
+}
+
+// process writes the /proc/<pid>/cgroup of a process in cgroup.
+func (h testHost) process(t *testing.T, pid int, cgroup string) {
+	dir := filepath.Join(h.procRoot, fmt.Sprint(pid))
+	assert.Nil(t, os.MkdirAll(dir, 0755))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "cgroup"), []byte("0::"+cgroup+"\n"), 0644))
+}
+
+func testEnricher(h testHost, runtime Runtime, clk *bouhekitest.Clock) *Enricher {
+	e := newEnricher(config.DefaultConfig().Containers, clk, h.procRoot, h.cgroupRoot)
+	e.runtime = runtime
+	return e
+}
+
+var nginx = Info{Name: "nginx", Image: "docker.io/library/nginx:1.25", PodName: "web-7d4b9", PodNamespace: "shop"}
+
+func TestEnrich(t *testing.T) {
+	h := newTestHost(t)
+	h.process(t, 4242, podSlice+"/cri-containerd-"+id+".scope")
+	h.process(t, 1, "/init.scope")
+	runtime := &fakeRuntime{infos: map[string]Info{id: nginx}}
+	e := testEnricher(h, runtime, bouhekitest.NewClock(time.Now()))
+
+	for i := 0; i < 2; i++ {
+		event := log.AuditEventLog{PID: 4242, CgroupID: h.cgroupID}
+		e.Enrich(&event)
+		assert.Equal(t, log.AuditEventLog{
+			PID:            4242,
+			CgroupID:       h.cgroupID,
+			ContainerID:    id,
+			ContainerName:  "nginx",
+			ContainerImage: "docker.io/library/nginx:1.25",
+			PodName:        "web-7d4b9",
+			PodNamespace:   "shop",
+		}, event)
+	}
+	// The container is looked up once.
+	assert.Equal(t, 1, runtime.lookups)
+
+	// A process of the host is left as it is.
+	event := log.AuditEventLog{PID: 1}
+	e.Enrich(&event)
+	assert.Equal(t, log.AuditEventLog{PID: 1}, event)
+}
+
+func TestEnrichExitedProcess(t *testing.T) {
+	h := newTestHost(t)
+	e := testEnricher(h, &fakeRuntime{infos: map[string]Info{id: nginx}}, bouhekitest.NewClock(time.Now()))
+
+	// The process has exited, its cgroup is found by its id.
+	event := log.AuditEventLog{PID: 4242, CgroupID: h.cgroupID}
+	e.Enrich(&event)
+	assert.Equal(t, id, event.ContainerID)
+	assert.Equal(t, "nginx", event.ContainerName)
+
+	// Its pid is reused by a process of the host.
+	h.process(t, 4343, "/user.slice")
+	event = log.AuditEventLog{PID: 4343, CgroupID: h.cgroupID}
+	e.Enrich(&event)
+	assert.Equal(t, id, event.ContainerID)
+
+	// The cgroup has been removed too.
+	event = log.AuditEventLog{PID: 4444, CgroupID: h.cgroupID + 1000}
+	e.Enrich(&event)
+	assert.Equal(t, "", event.ContainerID)
+}
+
+func TestEnrichUnknownContainer(t *testing.T) {
+	h := newTestHost(t)
+	h.process(t, 4242, podSlice+"/cri-containerd-"+id+".scope")
+	runtime := &fakeRuntime{infos: map[string]Info{}}
+	clk := bouhekitest.NewClock(time.Now())
+	e := testEnricher(h, runtime, clk)
+
+	event := log.AuditEventLog{PID: 4242, CgroupID: h.cgroupID}
+	e.Enrich(&event)
+	assert.Equal(t, id, event.ContainerID)
+	assert.Equal(t, "", event.ContainerName)
+	e.Enrich(&event)
+	assert.Equal(t, 1, runtime.lookups)
+
+	// The runtime is asked again after cache_ttl, and knows the container by then.
+	runtime.infos[id] = nginx
+	clk.Advance(config.DEFAULT_CONTAINERS_CACHE_TTL)
+	event = log.AuditEventLog{PID: 4242, CgroupID: h.cgroupID}
+	e.Enrich(&event)
+	assert.Equal(t, 2, runtime.lookups)
+	assert.Equal(t, "nginx", event.ContainerName)
+}
+
+func TestContainerd(t *testing.T) {
+	dir := t.TempDir()
+	bundle := filepath.Join(dir, "k8s.io", id)
+	assert.Nil(t, os.MkdirAll(bundle, 0755))
+	assert.Nil(t, os.WriteFile(filepath.Join(bundle, "config.json"), []byte(`{"ociVersion":"1.0.2","annotations":{
+		"io.kubernetes.cri.container-name":"nginx",
+		"io.kubernetes.cri.image-name":"docker.io/library/nginx:1.25",
+		"io.kubernetes.cri.sandbox-name":"web-7d4b9",
+		"io.kubernetes.cri.sandbox-namespace":"shop"}}`), 0644))
+
+	runtime := containerd{stateDir: dir}
+	info, err := runtime.Lookup(id)
+	assert.Nil(t, err)
+	assert.Equal(t, nginx, info)
+
+	_, err = runtime.Lookup("0000000000000000000000000000000000000000000000000000000000000000")
+	assert.Equal(t, errNotFound, err)
+}
+
+func TestDocker(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "docker.sock")
+	listener, err := net.Listen("unix", socket)
+	assert.Nil(t, err)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/containers/"+id+"/json" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"Name":"/k8s_nginx_web-7d4b9_shop_1234_0","Config":{"Image":"docker.io/library/nginx:1.25","Labels":{
+			"io.kubernetes.container.name":"nginx",
+			"io.kubernetes.pod.name":"web-7d4b9",
+			"io.kubernetes.pod.namespace":"shop"}}}`))
+	}))
+	server.Listener = listener
+	server.Start()
+	defer server.Close()
+
+	runtime := newDocker(socket, time.Second)
+	info, err := runtime.Lookup(id)
+	assert.Nil(t, err)
+	assert.Equal(t, nginx, info)
+
+	_, err = runtime.Lookup("0000000000000000000000000000000000000000000000000000000000000000")
+	assert.Equal(t, errNotFound, err)
+}
@@ -0,0 +1,118 @@
+package containers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// The labels and the annotations Kubernetes sets on the containers of a pod.
+	LABEL_POD_NAME       = "io.kubernetes.pod.name"
+	LABEL_POD_NAMESPACE  = "io.kubernetes.pod.namespace"
+	LABEL_CONTAINER_NAME = "io.kubernetes.container.name"
+
+	ANNOTATION_CONTAINER_NAME = "io.kubernetes.cri.container-name"
+	ANNOTATION_IMAGE_NAME     = "io.kubernetes.cri.image-name"
+	ANNOTATION_SANDBOX_NAME   = "io.kubernetes.cri.sandbox-name"
+	ANNOTATION_SANDBOX_NS     = "io.kubernetes.cri.sandbox-namespace"
+)
+
+// docker looks up the containers from the API of docker on its unix socket.
+type docker struct {
+	client *http.Client
+}
+
+func newDocker(socket string, timeout time.Duration) *docker {
+	return &docker{client: &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+	}}
+}
+
+func (d *docker) Lookup(id string) (Info, error) {
+	resp, err := d.client.Get("http://docker/containers/" + id + "/json")
+	if err != nil {
+		return Info{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return Info{}, errNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return Info{}, fmt.Errorf("docker answered %s", resp.Status)
+	}
+	var inspect struct {
+		Name   string
+		Config struct {
+			Image  string
+			Labels map[string]string
+		}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&inspect); err != nil {
+		return Info{}, err
+	}
+
+	labels := inspect.Config.Labels
+	info := Info{
+		Name:         strings.TrimPrefix(inspect.Name, "/"),
+		Image:        inspect.Config.Image,
+		PodName:      labels[LABEL_POD_NAME],
+		PodNamespace: labels[LABEL_POD_NAMESPACE],
+	}
+	// The containers of a pod are named after the pod by docker, and after the spec by Kubernetes.
+	if name := labels[LABEL_CONTAINER_NAME]; name != "" {
+		info.Name = name
+	}
+	return info, nil
+}
+
+// containerd looks up the containers from the annotations of their bundles, which the CRI plugin
+// of containerd writes to <state_dir>/<namespace>/<id>/config.json.
+type containerd struct {
+	stateDir string
+}
+
+func (c containerd) Lookup(id string) (Info, error) {
+	bundles, err := filepath.Glob(filepath.Join(c.stateDir, "*", id, "config.json"))
+	if err != nil {
+		return Info{}, err
+	}
+	if len(bundles) == 0 {
+		return Info{}, errNotFound
+	}
+	data, err := ioutil.ReadFile(bundles[0])
+	if os.IsNotExist(err) {
+		return Info{}, errNotFound
+	}
+	if err != nil {
+		return Info{}, err
+	}
+	var spec struct {
+		Annotations map[string]string `json:"annotations"`
+	}
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return Info{}, fmt.Errorf("%s: %w", bundles[0], err)
+	}
+
+	a := spec.Annotations
+	return Info{
+		Name:         a[ANNOTATION_CONTAINER_NAME],
+		Image:        a[ANNOTATION_IMAGE_NAME],
+		PodName:      a[ANNOTATION_SANDBOX_NAME],
+		PodNamespace: a[ANNOTATION_SANDBOX_NS],
+	}, nil
+}
@@ -0,0 +1,55 @@
+package control
+
+import (
+	"context"
+	"net/http"
+)
+
+// MAPS_PATH dumps the entries of the maps of the rules as JSON, see MapDump.
+const MAPS_PATH = "/v1/maps"
+
+// MapDump is the entries of a map of the rules, with their keys decoded.
+type MapDump struct {
+	Map     string     `json:"map"`
+	Count   int        `json:"count"`
+	Entries []MapEntry `json:"entries"`
+}
+
+// MapEntry is an entry of a map. Key is the CIDR, command, path, uid, gid, port or id the key
+// holds, Protocol the protocol of the protocol lists, and Value what the value tells, e.g. the
+// pattern of a command pattern list. Entries are the entries of network.policies the key selects.
+// Sources are what wrote the entry, e.g. config or domain, and Domains the domains that resolved
+// to it; an entry without a source was not written by this bouheki.
+type MapEntry struct {
+	Key      string   `json:"key"`
+	Protocol string   `json:"protocol,omitempty"`
+	Value    string   `json:"value,omitempty"`
+	Entries  []string `json:"entries,omitempty"`
+	Sources  []string `json:"sources"`
+	Domains  []string `json:"domains,omitempty"`
+}
+
+func (s *Server) dumpMaps(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r := currentRules()
+	if r == nil {
+		http.Error(w, "the network audit is not running", http.StatusServiceUnavailable)
+		return
+	}
+	maps, err := r.DumpMaps(req.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, maps)
+}
+
+// DumpMaps returns the entries of the maps of the rules of the bouheki listening on socketPath.
+func DumpMaps(ctx context.Context, socketPath string) ([]MapDump, error) {
+	maps := []MapDump{}
+	err := do(ctx, socketPath, http.MethodGet, MAPS_PATH, nil, &maps)
+	return maps, err
+}
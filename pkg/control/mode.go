@@ -0,0 +1,82 @@
+package control
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// MODE_PATH returns the mode of the network restriction as JSON with GET, and forces it into
+// monitor mode, or clears it, with PUT and a ModeRequest.
+const MODE_PATH = "/v1/mode"
+
+// ModeRequest forces the network restriction into monitor mode, or clears it.
+type ModeRequest struct {
+	ForceMonitor bool `json:"force_monitor"`
+}
+
+// ModeStatus is the mode of the network restriction. Mode is the mode the programs run in, and
+// Configured network.mode. Since, Source and UID are only set while it is forced into monitor
+// mode, and UID only when it was forced on the control socket.
+type ModeStatus struct {
+	Mode         string     `json:"mode"`
+	Configured   string     `json:"configured"`
+	ForceMonitor bool       `json:"force_monitor"`
+	Since        *time.Time `json:"since,omitempty"`
+	Source       string     `json:"source,omitempty"`
+	UID          *uint32    `json:"uid,omitempty"`
+}
+
+func (s *Server) mode(w http.ResponseWriter, req *http.Request) {
+	r := currentRules()
+	if r == nil {
+		http.Error(w, "the network audit is not running", http.StatusServiceUnavailable)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		writeJSON(w, r.Mode())
+	case http.MethodPut:
+		// As the changes of the rules, it is logged with the uid of the process that requested it.
+		peer, ok := peerOf(req)
+		if !ok {
+			http.Error(w, "the credentials of the peer can not be read", http.StatusForbidden)
+			return
+		}
+		var body ModeRequest
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		status, err := r.SetForceMonitor(body.ForceMonitor, peer.Uid)
+		if err != nil {
+			http.Error(w, err.Error(), statusOf(err))
+			return
+		}
+		writeJSON(w, status)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// GetMode returns the mode of the network restriction of the bouheki listening on socketPath.
+func GetMode(ctx context.Context, socketPath string) (ModeStatus, error) {
+	var status ModeStatus
+	err := do(ctx, socketPath, http.MethodGet, MODE_PATH, nil, &status)
+	return status, err
+}
+
+// SetForceMonitor forces the network restriction of the bouheki listening on socketPath into
+// monitor mode, or clears it.
+func SetForceMonitor(ctx context.Context, socketPath string, force bool) (ModeStatus, error) {
+	body, err := json.Marshal(ModeRequest{ForceMonitor: force})
+	if err != nil {
+		return ModeStatus{}, err
+	}
+	var status ModeStatus
+	err = do(ctx, socketPath, http.MethodPut, MODE_PATH, bytes.NewReader(body), &status)
+	return status, err
+}
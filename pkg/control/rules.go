@@ -0,0 +1,236 @@
+package control
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/errkind"
+	"github.com/mrtc0/bouheki/pkg/jobs"
+)
+
+const (
+	// RULES_PATH lists the CIDRs of network.cidr, of the config and added at runtime, as JSON.
+	RULES_PATH = "/v1/rules"
+	// CIDR_RULES_PATH adds a CIDR to a list of network.cidr with POST and a CIDRRequest, and
+	// removes one added at runtime with DELETE and the list and cidr query parameters.
+	CIDR_RULES_PATH = "/v1/rules/cidr"
+)
+
+// The sources of a Rule.
+const (
+	RULE_SOURCE_CONFIG  = "config"
+	RULE_SOURCE_RUNTIME = "runtime"
+)
+
+// ErrRuleNotFound is returned for the removal of a CIDR that was not added at runtime.
+var ErrRuleNotFound = errors.New("no such runtime rule")
+
+// CIDRRequest adds CIDR to List, allow or deny. TTL, e.g. 1h, removes it once it elapses.
+type CIDRRequest struct {
+	List string `json:"list"`
+	CIDR string `json:"cidr"`
+	TTL  string `json:"ttl,omitempty"`
+}
+
+// Rule is a CIDR of a list of network.cidr. UID, Added and Expires are only set for the rules
+// added at runtime, and Expires only for the ones with a TTL.
+type Rule struct {
+	Source  string     `json:"source"`
+	List    string     `json:"list"`
+	CIDR    string     `json:"cidr"`
+	UID     *uint32    `json:"uid,omitempty"`
+	Added   *time.Time `json:"added,omitempty"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// Rules are the rules of the running network audit the control socket changes. uid is the uid of
+// the process that requested the change.
+type Rules interface {
+	AddCIDR(list, cidr string, ttl time.Duration, uid uint32) (Rule, error)
+	RemoveCIDR(list, cidr string, uid uint32) (Rule, error)
+	List() []Rule
+	// DumpMaps returns the entries of the maps the programs look the rules up in.
+	DumpMaps(ctx context.Context) ([]MapDump, error)
+	// Mode returns the mode of the network restriction, and SetForceMonitor forces it into
+	// monitor mode or clears it.
+	Mode() ModeStatus
+	SetForceMonitor(force bool, uid uint32) (ModeStatus, error)
+}
+
+var (
+	rulesMu sync.Mutex
+	rules   Rules
+)
+
+// SetRules makes r the rules the control socket changes, once the network audit is running.
+func SetRules(r Rules) {
+	rulesMu.Lock()
+	defer rulesMu.Unlock()
+	rules = r
+}
+
+func currentRules() Rules {
+	rulesMu.Lock()
+	defer rulesMu.Unlock()
+	return rules
+}
+
+type peerKey struct{}
+
+// withPeer records in ctx the credentials of the process at the other end of conn, see SO_PEERCRED.
+func withPeer(ctx context.Context, conn net.Conn) context.Context {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return ctx
+	}
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		return ctx
+	}
+
+	var cred *syscall.Ucred
+	if err := raw.Control(func(fd uintptr) {
+		cred, err = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil || cred == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, peerKey{}, *cred)
+}
+
+func peerOf(req *http.Request) (syscall.Ucred, bool) {
+	cred, ok := req.Context().Value(peerKey{}).(syscall.Ucred)
+	return cred, ok
+}
+
+func (s *Server) listRules(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r := currentRules()
+	if r == nil {
+		http.Error(w, "the network audit is not running", http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, r.List())
+}
+
+func (s *Server) cidrRules(w http.ResponseWriter, req *http.Request) {
+	r := currentRules()
+	if r == nil {
+		http.Error(w, "the network audit is not running", http.StatusServiceUnavailable)
+		return
+	}
+	// Every change is logged with the uid of the process that requested it.
+	peer, ok := peerOf(req)
+	if !ok {
+		http.Error(w, "the credentials of the peer can not be read", http.StatusForbidden)
+		return
+	}
+
+	var rule Rule
+	var err error
+	switch req.Method {
+	case http.MethodPost:
+		var body CIDRRequest
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var ttl time.Duration
+		if body.TTL != "" {
+			if ttl, err = time.ParseDuration(body.TTL); err != nil || ttl < 0 {
+				http.Error(w, fmt.Sprintf("invalid ttl %q", body.TTL), http.StatusBadRequest)
+				return
+			}
+		}
+		rule, err = r.AddCIDR(body.List, body.CIDR, ttl, peer.Uid)
+	case http.MethodDelete:
+		query := req.URL.Query()
+		rule, err = r.RemoveCIDR(query.Get("list"), query.Get("cidr"), peer.Uid)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), statusOf(err))
+		return
+	}
+	writeJSON(w, rule)
+}
+
+// statusOf returns the status of the response to a change that failed with err.
+func statusOf(err error) int {
+	switch {
+	case errors.Is(err, ErrRuleNotFound):
+		return http.StatusNotFound
+	case errkind.KindOf(err) == errkind.Config:
+		return http.StatusBadRequest
+	case errors.Is(err, jobs.ErrRejected):
+		// e.g. a freeze window.
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// AddCIDR adds the CIDR of req to its list in the bouheki listening on socketPath.
+func AddCIDR(ctx context.Context, socketPath string, req CIDRRequest) (Rule, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return Rule{}, err
+	}
+	var rule Rule
+	err = do(ctx, socketPath, http.MethodPost, CIDR_RULES_PATH, bytes.NewReader(body), &rule)
+	return rule, err
+}
+
+// RemoveCIDR removes cidr, added at runtime, from list in the bouheki listening on socketPath.
+func RemoveCIDR(ctx context.Context, socketPath string, list, cidr string) (Rule, error) {
+	query := url.Values{"list": {list}, "cidr": {cidr}}
+	var rule Rule
+	err := do(ctx, socketPath, http.MethodDelete, CIDR_RULES_PATH+"?"+query.Encode(), nil, &rule)
+	return rule, err
+}
+
+// ListRules returns the CIDRs of network.cidr of the bouheki listening on socketPath.
+func ListRules(ctx context.Context, socketPath string) ([]Rule, error) {
+	rules := []Rule{}
+	err := do(ctx, socketPath, http.MethodGet, RULES_PATH, nil, &rules)
+	return rules, err
+}
+
+// do sends a request to the bouheki listening on socketPath and decodes its JSON response into v.
+func do(ctx context.Context, socketPath string, method, path string, body io.Reader, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, "http://bouheki"+path, body)
+	if err != nil {
+		return err
+	}
+	client := newClient(socketPath)
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+		return fmt.Errorf("%s returned %s: %s", strings.SplitN(path, "?", 2)[0], res.Status, strings.TrimSpace(string(message)))
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
@@ -0,0 +1,168 @@
+package control
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/errkind"
+	"github.com/mrtc0/bouheki/pkg/notify"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeRules records the changes with the uid that requested them.
+type fakeRules struct {
+	rules  map[string]Rule
+	uids   []uint32
+	forced *uint32
+}
+
+func (f *fakeRules) AddCIDR(list, cidr string, ttl time.Duration, uid uint32) (Rule, error) {
+	if list != "allow" && list != "deny" {
+		return Rule{}, errkind.Errorf(errkind.Config, "no list %q", list)
+	}
+	f.uids = append(f.uids, uid)
+	rule := Rule{Source: RULE_SOURCE_RUNTIME, List: list, CIDR: cidr, UID: &uid}
+	if ttl > 0 {
+		expires := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC).Add(ttl)
+		rule.Expires = &expires
+	}
+	f.rules[list+" "+cidr] = rule
+	return rule, nil
+}
+
+func (f *fakeRules) RemoveCIDR(list, cidr string, uid uint32) (Rule, error) {
+	f.uids = append(f.uids, uid)
+	rule, ok := f.rules[list+" "+cidr]
+	if !ok {
+		return Rule{}, fmt.Errorf("%s: %w", cidr, ErrRuleNotFound)
+	}
+	delete(f.rules, list+" "+cidr)
+	return rule, nil
+}
+
+func (f *fakeRules) List() []Rule {
+	rules := []Rule{{Source: RULE_SOURCE_CONFIG, List: "allow", CIDR: "10.0.0.0/8"}}
+	for _, rule := range f.rules {
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+func (f *fakeRules) DumpMaps(ctx context.Context) ([]MapDump, error) {
+	return []MapDump{{Map: "allowed_v4_cidr_list", Count: 1, Entries: []MapEntry{{Key: "10.0.0.0/8", Sources: []string{"config"}}}}}, nil
+}
+
+func (f *fakeRules) Mode() ModeStatus {
+	status := ModeStatus{Mode: "block", Configured: "block"}
+	if f.forced != nil {
+		since := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+		status.Mode, status.ForceMonitor, status.Since, status.Source, status.UID = "monitor", true, &since, "control", f.forced
+	}
+	return status
+}
+
+func (f *fakeRules) SetForceMonitor(force bool, uid uint32) (ModeStatus, error) {
+	f.uids = append(f.uids, uid)
+	f.forced = nil
+	if force {
+		f.forced = &uid
+	}
+	return f.Mode(), nil
+}
+
+func TestRules(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "bouheki.sock")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	served := make(chan error)
+	go func() { served <- NewServer(notify.NewHub(8)).Serve(ctx, socketPath) }()
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(socketPath)
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+
+	// Until the network audit runs, there are no rules to change.
+	_, err := ListRules(ctx, socketPath)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "503")
+
+	rules := &fakeRules{rules: map[string]Rule{}}
+	SetRules(rules)
+	defer SetRules(nil)
+
+	rule, err := AddCIDR(ctx, socketPath, CIDRRequest{List: "allow", CIDR: "203.0.113.0/24", TTL: "1h"})
+	assert.Nil(t, err)
+	assert.Equal(t, "203.0.113.0/24", rule.CIDR)
+	assert.Equal(t, time.Date(2026, 10, 14, 13, 0, 0, 0, time.UTC), rule.Expires.UTC())
+
+	listed, err := ListRules(ctx, socketPath)
+	assert.Nil(t, err)
+	assert.Len(t, listed, 2)
+	assert.Equal(t, RULE_SOURCE_CONFIG, listed[0].Source)
+	assert.Nil(t, listed[0].UID)
+
+	_, err = AddCIDR(ctx, socketPath, CIDRRequest{List: "allowed", CIDR: "203.0.113.0/24"})
+	assert.True(t, strings.Contains(err.Error(), "400"), err)
+	_, err = AddCIDR(ctx, socketPath, CIDRRequest{List: "allow", CIDR: "203.0.113.0/24", TTL: "an hour"})
+	assert.True(t, strings.Contains(err.Error(), "400"), err)
+
+	_, err = RemoveCIDR(ctx, socketPath, "allow", "203.0.113.0/24")
+	assert.Nil(t, err)
+	_, err = RemoveCIDR(ctx, socketPath, "allow", "203.0.113.0/24")
+	assert.True(t, strings.Contains(err.Error(), "404"), err)
+
+	maps, err := DumpMaps(ctx, socketPath)
+	assert.Nil(t, err)
+	assert.Equal(t, []MapDump{{Map: "allowed_v4_cidr_list", Count: 1, Entries: []MapEntry{{Key: "10.0.0.0/8", Sources: []string{"config"}}}}}, maps)
+
+	// Every change is requested with the uid of the client, read from the socket.
+	uid := uint32(os.Getuid())
+	assert.Equal(t, []uint32{uid, uid, uid}, rules.uids)
+
+	cancel()
+	assert.Nil(t, <-served)
+}
+
+func TestMode(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "bouheki.sock")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	served := make(chan error)
+	go func() { served <- NewServer(notify.NewHub(8)).Serve(ctx, socketPath) }()
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(socketPath)
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+
+	_, err := GetMode(ctx, socketPath)
+	assert.True(t, strings.Contains(err.Error(), "503"), err)
+
+	rules := &fakeRules{rules: map[string]Rule{}}
+	SetRules(rules)
+	defer SetRules(nil)
+
+	status, err := GetMode(ctx, socketPath)
+	assert.Nil(t, err)
+	assert.Equal(t, ModeStatus{Mode: "block", Configured: "block"}, status)
+
+	uid := uint32(os.Getuid())
+	status, err = SetForceMonitor(ctx, socketPath, true)
+	assert.Nil(t, err)
+	assert.True(t, status.ForceMonitor)
+	assert.Equal(t, "monitor", status.Mode)
+	assert.Equal(t, "block", status.Configured)
+	assert.Equal(t, uid, *status.UID)
+
+	status, err = SetForceMonitor(ctx, socketPath, false)
+	assert.Nil(t, err)
+	assert.Equal(t, ModeStatus{Mode: "block", Configured: "block"}, status)
+	assert.Equal(t, []uint32{uid, uid}, rules.uids)
+
+	cancel()
+	assert.Nil(t, <-served)
+}
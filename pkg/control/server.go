@@ -0,0 +1,155 @@
+// Package control serves the local control socket of a running bouheki.
+//
+// The socket speaks HTTP, so it can be used with `curl --unix-socket`. Besides the notifications,
+// it changes the CIDRs of network.cidr at runtime and dumps the maps of the rules, see Rules.
+package control
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+
+	log "github.com/mrtc0/bouheki/pkg/log"
+	"github.com/mrtc0/bouheki/pkg/notify"
+)
+
+// NOTIFICATIONS_PATH streams policy change notifications as JSON lines.
+// The type query parameter, which can be repeated, only streams the notifications of these types.
+const NOTIFICATIONS_PATH = "/v1/notifications"
+
+type Server struct {
+	hub *notify.Hub
+	mux *http.ServeMux
+}
+
+func NewServer(hub *notify.Hub) *Server {
+	s := &Server{hub: hub, mux: http.NewServeMux()}
+	s.mux.HandleFunc(NOTIFICATIONS_PATH, s.notifications)
+	s.mux.HandleFunc(RULES_PATH, s.listRules)
+	s.mux.HandleFunc(CIDR_RULES_PATH, s.cidrRules)
+	s.mux.HandleFunc(MAPS_PATH, s.dumpMaps)
+	s.mux.HandleFunc(MODE_PATH, s.mode)
+	return s
+}
+
+// Serve listens on socketPath until ctx is done. The socket is only accessible by the owner, root
+// for the socket of bouheki.
+func (s *Server) Serve(ctx context.Context, socketPath string) error {
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(socketPath)
+
+	if err := os.Chmod(socketPath, 0600); err != nil {
+		listener.Close()
+		return err
+	}
+
+	server := &http.Server{Handler: s.mux, ConnContext: withPeer}
+	go func() {
+		<-ctx.Done()
+		// Close instead of Shutdown, as the notification streams never become idle.
+		server.Close()
+	}()
+
+	if err := server.Serve(listener); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+func (s *Server) notifications(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	subscriber := s.hub.Subscribe(req.URL.Query()["type"]...)
+	defer s.hub.Unsubscribe(subscriber)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case n, ok := <-subscriber.C:
+			if !ok {
+				if subscriber.Dropped() {
+					log.Warn("disconnected a notification subscriber that did not keep up")
+				}
+				return
+			}
+
+			data, err := notify.Marshal(n)
+			if err != nil {
+				log.Error(err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "%s\n", data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// newClient returns a client of the bouheki listening on socketPath.
+func newClient(socketPath string) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socketPath)
+			},
+		},
+	}
+}
+
+// Subscribe streams the notifications of types, or of every type without types, of the bouheki listening
+// on socketPath to handle until ctx is done, the connection is closed or handle returns an error.
+func Subscribe(ctx context.Context, socketPath string, types []string, handle func(notify.Notification) error) error {
+	client := newClient(socketPath)
+	query := url.Values{"type": types}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://bouheki"+NOTIFICATIONS_PATH+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", NOTIFICATIONS_PATH, res.Status)
+	}
+
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		n, err := notify.Unmarshal(scanner.Bytes())
+		if err != nil {
+			return err
+		}
+		if err := handle(n); err != nil {
+			return err
+		}
+	}
+
+	if ctx.Err() != nil {
+		return nil
+	}
+	return scanner.Err()
+}
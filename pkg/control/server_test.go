@@ -0,0 +1,69 @@
+package control
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/notify"
+	"github.com/stretchr/testify/assert"
+)
+
+var errDone = errors.New("done")
+
+func TestSubscribe(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "bouheki.sock")
+	hub := notify.NewHub(8)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	served := make(chan error)
+	go func() { served <- NewServer(hub).Serve(ctx, socketPath) }()
+
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(socketPath)
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+
+	info, err := os.Stat(socketPath)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// publish once the subscriber is connected.
+	go func() {
+		for {
+			hub.Publish(notify.New(notify.DNSRuleChange{Domain: "example.com", List: "allow", Added: []string{"93.184.216.34/32"}}, "digest"))
+			hub.Publish(notify.New(notify.Alert{Rule: "blocks", State: notify.ALERT_FIRING}, ""))
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}()
+
+	var received notify.Notification
+	err = Subscribe(ctx, socketPath, []string{notify.TYPE_DNS_RULE_CHANGE}, func(n notify.Notification) error {
+		received = n
+		return errDone
+	})
+	assert.Equal(t, errDone, err)
+	assert.Equal(t, notify.TYPE_DNS_RULE_CHANGE, received.Type)
+	assert.Equal(t, "digest", received.PolicyDigest)
+	assert.Equal(t, notify.DNSRuleChange{Domain: "example.com", List: "allow", Added: []string{"93.184.216.34/32"}}, received.Payload)
+
+	err = Subscribe(ctx, socketPath, []string{notify.TYPE_ALERT}, func(n notify.Notification) error {
+		received = n
+		return errDone
+	})
+	assert.Equal(t, errDone, err)
+	assert.Equal(t, notify.TYPE_ALERT, received.Type)
+
+	cancel()
+	assert.Nil(t, <-served)
+	_, err = os.Stat(socketPath)
+	assert.True(t, os.IsNotExist(err))
+}
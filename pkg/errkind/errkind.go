@@ -0,0 +1,143 @@
+// Package errkind classifies fatal errors so that the exit status of bouheki
+// tells an orchestrator what to do next.
+package errkind
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+type Kind string
+
+const (
+	// Preflight means the host can not run bouheki (e.g. no BPF LSM). Retrying will not help.
+	Preflight Kind = "preflight"
+	// Config means the configuration is invalid. The policy owner has to fix it.
+	Config Kind = "config"
+	// BPFLoad means loading or attaching the BPF programs failed. It may succeed on retry.
+	BPFLoad Kind = "bpf_load"
+	// Runtime means a fatal error happened after startup.
+	Runtime Kind = "runtime"
+	// Unknown is used for errors that were not classified.
+	Unknown Kind = "unknown"
+)
+
+// Exit codes follow sysexits(3).
+const (
+	EXIT_OK          = 0
+	EXIT_UNKNOWN     = 1
+	EXIT_UNAVAILABLE = 69 // EX_UNAVAILABLE
+	EXIT_SOFTWARE    = 70 // EX_SOFTWARE
+	EXIT_TEMPFAIL    = 75 // EX_TEMPFAIL
+	EXIT_CONFIG      = 78 // EX_CONFIG
+)
+
+var kinds = map[Kind]struct {
+	exitCode  int
+	retryable bool
+}{
+	Preflight: {EXIT_UNAVAILABLE, false},
+	Config:    {EXIT_CONFIG, false},
+	BPFLoad:   {EXIT_TEMPFAIL, true},
+	Runtime:   {EXIT_SOFTWARE, true},
+	Unknown:   {EXIT_UNKNOWN, false},
+}
+
+// Error is an error with a Kind.
+type Error struct {
+	Kind Kind
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// New classifies err as kind. It returns nil if err is nil.
+func New(kind Kind, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Kind: kind, Err: err}
+}
+
+// Errorf formats an error classified as kind.
+func Errorf(kind Kind, format string, a ...interface{}) error {
+	return &Error{Kind: kind, Err: fmt.Errorf(format, a...)}
+}
+
+// Default classifies err as kind unless it is already classified.
+func Default(kind Kind, err error) error {
+	if err == nil {
+		return nil
+	}
+	if KindOf(err) != Unknown {
+		return err
+	}
+	return New(kind, err)
+}
+
+// KindOf returns the Kind of the outermost classified error in err's chain.
+func KindOf(err error) Kind {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Kind
+	}
+	return Unknown
+}
+
+func ExitCode(kind Kind) int {
+	if k, ok := kinds[kind]; ok {
+		return k.exitCode
+	}
+	return EXIT_UNKNOWN
+}
+
+func Retryable(kind Kind) bool {
+	return kinds[kind].retryable
+}
+
+// Report is the final structured error line written before exiting.
+type Report struct {
+	Level     string `json:"level"`
+	Kind      Kind   `json:"kind"`
+	ExitCode  int    `json:"exit_code"`
+	Retryable bool   `json:"retryable"`
+	Error     string `json:"error"`
+}
+
+func NewReport(err error) Report {
+	kind := KindOf(err)
+	return Report{
+		Level:     "fatal",
+		Kind:      kind,
+		ExitCode:  ExitCode(kind),
+		Retryable: Retryable(kind),
+		Error:     err.Error(),
+	}
+}
+
+// Write writes the report of err as a single JSON line and returns the exit code.
+func Write(w io.Writer, err error) int {
+	if err == nil {
+		return EXIT_OK
+	}
+
+	report := NewReport(err)
+	b, _ := json.Marshal(report)
+	fmt.Fprintln(w, string(b))
+
+	return report.ExitCode
+}
+
+// Exit reports err to stderr and exits with the code mapped from its Kind.
+func Exit(err error) {
+	os.Exit(Write(os.Stderr, err))
+}
@@ -0,0 +1,67 @@
+package errkind
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKindOf(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected Kind
+	}{
+		{name: "unclassified", err: errors.New("boom"), expected: Unknown},
+		{name: "classified", err: New(Config, errors.New("bad cidr")), expected: Config},
+		{name: "wrapped", err: fmt.Errorf("setup: %w", New(BPFLoad, errors.New("load"))), expected: BPFLoad},
+		{name: "Default keeps an existing kind", err: Default(Runtime, New(Preflight, errors.New("no lsm"))), expected: Preflight},
+		{name: "Default classifies an unknown error", err: Default(Runtime, errors.New("boom")), expected: Runtime},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, KindOf(test.err))
+		})
+	}
+
+	assert.Nil(t, New(Config, nil))
+	assert.Nil(t, Default(Config, nil))
+}
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		kind      Kind
+		exitCode  int
+		retryable bool
+	}{
+		{kind: Preflight, exitCode: 69, retryable: false},
+		{kind: Config, exitCode: 78, retryable: false},
+		{kind: BPFLoad, exitCode: 75, retryable: true},
+		{kind: Runtime, exitCode: 70, retryable: true},
+		{kind: Unknown, exitCode: 1, retryable: false},
+		{kind: Kind("undefined"), exitCode: 1, retryable: false},
+	}
+
+	for _, test := range tests {
+		t.Run(string(test.kind), func(t *testing.T) {
+			assert.Equal(t, test.exitCode, ExitCode(test.kind))
+			assert.Equal(t, test.retryable, Retryable(test.kind))
+		})
+	}
+}
+
+func TestWrite(t *testing.T) {
+	var buf bytes.Buffer
+	code := Write(&buf, New(Config, errors.New("network.cidr.allow: invalid CIDR address: 10.0.0.0/33")))
+
+	assert.Equal(t, EXIT_CONFIG, code)
+	assert.Equal(t, `{"level":"fatal","kind":"config","exit_code":78,"retryable":false,"error":"network.cidr.allow: invalid CIDR address: 10.0.0.0/33"}`+"\n", buf.String())
+
+	buf.Reset()
+	assert.Equal(t, EXIT_OK, Write(&buf, nil))
+	assert.Empty(t, buf.String())
+}
@@ -0,0 +1,222 @@
+// Package eventpipe writes the audit events as newline-delimited JSON to a named pipe or to a unix
+// datagram socket, for the agents on the host that consume them without files or TCP.
+//
+// A write never blocks the audits: without a consumer, or while the consumer does not keep up,
+// the event is dropped and counted. Once the consumer is back the events are written again,
+// reopening the pipe if it has to.
+package eventpipe
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/alert"
+	"github.com/mrtc0/bouheki/pkg/clock"
+	"github.com/mrtc0/bouheki/pkg/config"
+	log "github.com/mrtc0/bouheki/pkg/log"
+	"github.com/mrtc0/bouheki/pkg/metrics"
+)
+
+// PIPE_BUF is the largest write to a pipe that is not interleaved with a partial one. Longer
+// events are dropped, so that the consumer only ever reads whole lines.
+const PIPE_BUF = 4096
+
+var (
+	eventsWritten = metrics.NewCounter("event_output_written_total",
+		"Number of audit events written to the event output.")
+	eventsDropped = metrics.NewCounter("event_output_dropped_total",
+		"Number of audit events dropped because the consumer of the event output was absent or too slow.")
+)
+
+// DefaultOutput is the output used by the package level Write. It is nil unless event_output is enabled.
+var DefaultOutput *Output
+
+// Write writes event to the DefaultOutput. match is the audit of the event and the fields the
+// filter of the output matches.
+func Write(match alert.Event, event interface{}) {
+	if DefaultOutput != nil {
+		DefaultOutput.Write(match, event)
+	}
+}
+
+// Event is a line of the output.
+type Event struct {
+	Time  time.Time   `json:"time"`
+	Audit string      `json:"audit"`
+	Event interface{} `json:"event"`
+}
+
+// Stats are the events written and dropped since the output was created.
+type Stats struct {
+	Written uint64
+	Dropped uint64
+}
+
+type Output struct {
+	mu    sync.Mutex
+	conf  config.EventOutputConfig
+	clock clock.Clock
+	// filter is the filter of the config, nil to write every event.
+	filter *alert.Filter
+	// fd is the write end of the pipe, or the socket. It is -1 while the pipe has no reader.
+	fd    int
+	stats Stats
+	// available is whether the last event reached the consumer, to log when it comes and goes.
+	available bool
+}
+
+// New returns an output of conf. It creates the FIFO, or the socket the events are sent from.
+func New(conf config.EventOutputConfig, clk clock.Clock) (*Output, error) {
+	o := &Output{conf: conf, clock: clk, fd: -1, available: true}
+	if conf.Filter != nil {
+		filter, err := alert.NewFilter(*conf.Filter)
+		if err != nil {
+			return nil, fmt.Errorf("event_output.filter: %w", err)
+		}
+		o.filter = filter
+	}
+
+	switch conf.Type {
+	case config.EVENT_OUTPUT_FIFO:
+		if err := o.mkfifo(); err != nil {
+			return nil, err
+		}
+	case config.EVENT_OUTPUT_UNIXGRAM:
+		fd, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_DGRAM|syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC, 0)
+		if err != nil {
+			return nil, fmt.Errorf("event_output: %w", err)
+		}
+		o.fd = fd
+	default:
+		return nil, fmt.Errorf("event_output: unknown type %q", conf.Type)
+	}
+
+	return o, nil
+}
+
+// mkfifo creates the FIFO unless it exists, and gives it the owner and the permissions of the config.
+func (o *Output) mkfifo() error {
+	info, err := os.Stat(o.conf.Path)
+	switch {
+	case err == nil:
+		if info.Mode()&os.ModeNamedPipe == 0 {
+			return fmt.Errorf("event_output: %s exists and is not a FIFO", o.conf.Path)
+		}
+	case os.IsNotExist(err):
+		if err := syscall.Mkfifo(o.conf.Path, o.conf.Mode); err != nil {
+			return fmt.Errorf("event_output: mkfifo %s: %w", o.conf.Path, err)
+		}
+	default:
+		return fmt.Errorf("event_output: %w", err)
+	}
+
+	if err := os.Chown(o.conf.Path, int(o.conf.UID), int(o.conf.GID)); err != nil {
+		return fmt.Errorf("event_output: %w", err)
+	}
+	// The umask applied to mkfifo.
+	if err := os.Chmod(o.conf.Path, os.FileMode(o.conf.Mode)); err != nil {
+		return fmt.Errorf("event_output: %w", err)
+	}
+	return nil
+}
+
+// Write writes event of the audit of match as a line, or drops it if the consumer can not take
+// it right away. The events the filter does not match are skipped, and counted as neither.
+func (o *Output) Write(match alert.Event, event interface{}) {
+	if o.filter != nil && !o.filter.Match(match) {
+		return
+	}
+	line, err := json.Marshal(Event{Time: o.clock.Now().UTC(), Audit: match.Audit, Event: event})
+	if err != nil {
+		log.Error(fmt.Errorf("event_output: %w", err))
+		return
+	}
+	line = append(line, '\n')
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.conf.Type == config.EVENT_OUTPUT_FIFO {
+		err = o.writeFIFO(line)
+	} else {
+		err = o.send(line)
+	}
+
+	if err != nil {
+		o.stats.Dropped++
+		eventsDropped.Inc()
+		if o.available {
+			log.Warn(fmt.Sprintf("event_output: dropping the events until the consumer of %s takes them: %s", o.conf.Path, err))
+		}
+		o.available = false
+		return
+	}
+
+	o.stats.Written++
+	eventsWritten.Inc()
+	if !o.available {
+		log.Info(fmt.Sprintf("event_output: the consumer of %s takes the events again", o.conf.Path))
+	}
+	o.available = true
+}
+
+func (o *Output) writeFIFO(line []byte) error {
+	if len(line) > PIPE_BUF {
+		return fmt.Errorf("the event is longer than %d bytes", PIPE_BUF)
+	}
+
+	if o.fd < 0 {
+		// Without a reader, a nonblocking open fails with ENXIO instead of waiting for one.
+		fd, err := syscall.Open(o.conf.Path, syscall.O_WRONLY|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+		if err == syscall.ENOENT {
+			if err := o.mkfifo(); err != nil {
+				return err
+			}
+			fd, err = syscall.Open(o.conf.Path, syscall.O_WRONLY|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+		}
+		if err != nil {
+			return err
+		}
+		o.fd = fd
+	}
+
+	// Up to PIPE_BUF bytes, a nonblocking write is whole or fails with EAGAIN when the pipe is full.
+	_, err := syscall.Write(o.fd, line)
+	if err == syscall.EPIPE {
+		// The reader is gone: the next event opens the pipe again.
+		syscall.Close(o.fd)
+		o.fd = -1
+	}
+	return err
+}
+
+// send sends line as a datagram to the socket the consumer bound. It fails with ENOENT or
+// ECONNREFUSED without a consumer, and with EAGAIN while its receive queue is full.
+func (o *Output) send(line []byte) error {
+	return syscall.Sendto(o.fd, line, syscall.MSG_DONTWAIT, &syscall.SockaddrUnix{Name: o.conf.Path})
+}
+
+// Stats returns the events written and dropped so far.
+func (o *Output) Stats() Stats {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.stats
+}
+
+// Close closes the pipe or the socket. The FIFO is left for the consumer.
+func (o *Output) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.fd < 0 {
+		return nil
+	}
+	err := syscall.Close(o.fd)
+	o.fd = -1
+	return err
+}
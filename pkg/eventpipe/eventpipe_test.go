@@ -0,0 +1,225 @@
+package eventpipe
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/alert"
+	"github.com/mrtc0/bouheki/pkg/bouhekitest"
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+type testEvent struct {
+	Action string
+	Seq    int
+}
+
+func newOutput(t *testing.T, typ string) *Output {
+	conf := config.EventOutputConfig{
+		Enable: true,
+		Type:   typ,
+		Path:   filepath.Join(t.TempDir(), "events"),
+		UID:    uint32(os.Getuid()),
+		GID:    uint32(os.Getgid()),
+		Mode:   0640,
+	}
+	o, err := New(conf, bouhekitest.NewClock(time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)))
+	assert.Nil(t, err)
+	t.Cleanup(func() { o.Close() })
+	return o
+}
+
+// openReader opens the read end of the FIFO without waiting for a writer.
+func openReader(t *testing.T, path string) *os.File {
+	fd, err := syscall.Open(path, syscall.O_RDONLY|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	assert.Nil(t, err)
+	return os.NewFile(uintptr(fd), path)
+}
+
+func readEvent(t *testing.T, r *bufio.Reader) Event {
+	line, err := r.ReadBytes('\n')
+	assert.Nil(t, err)
+	event := Event{Event: &testEvent{}}
+	assert.Nil(t, json.Unmarshal(line, &event))
+	return event
+}
+
+func TestFIFOIsCreatedWithThePermissions(t *testing.T) {
+	o := newOutput(t, config.EVENT_OUTPUT_FIFO)
+
+	info, err := os.Stat(o.conf.Path)
+	assert.Nil(t, err)
+	assert.NotZero(t, info.Mode()&os.ModeNamedPipe)
+	assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+
+	// A FIFO that exists is reused, anything else is an error.
+	_, err = New(o.conf, o.clock)
+	assert.Nil(t, err)
+	conf := o.conf
+	conf.Path = filepath.Join(t.TempDir(), "regular")
+	assert.Nil(t, os.WriteFile(conf.Path, nil, 0600))
+	_, err = New(conf, o.clock)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "is not a FIFO")
+}
+
+func TestFIFOReaderStartsLate(t *testing.T) {
+	o := newOutput(t, config.EVENT_OUTPUT_FIFO)
+
+	o.Write(alert.Event{Audit: config.ALERT_AUDIT_NETWORK}, testEvent{Action: "BLOCKED", Seq: 1})
+	assert.Equal(t, Stats{Dropped: 1}, o.Stats())
+
+	reader := openReader(t, o.conf.Path)
+	defer reader.Close()
+	o.Write(alert.Event{Audit: config.ALERT_AUDIT_NETWORK}, testEvent{Action: "BLOCKED", Seq: 2})
+	assert.Equal(t, Stats{Written: 1, Dropped: 1}, o.Stats())
+
+	event := readEvent(t, bufio.NewReader(reader))
+	assert.Equal(t, time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC), event.Time)
+	assert.Equal(t, config.ALERT_AUDIT_NETWORK, event.Audit)
+	assert.Equal(t, &testEvent{Action: "BLOCKED", Seq: 2}, event.Event)
+}
+
+func TestFIFOSlowReaderNeverBlocks(t *testing.T) {
+	o := newOutput(t, config.EVENT_OUTPUT_FIFO)
+	reader := openReader(t, o.conf.Path)
+	defer reader.Close()
+
+	// The reader does not read: the pipe fills up and the rest is dropped.
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 5000; i++ {
+			o.Write(alert.Event{Audit: config.ALERT_AUDIT_MOUNT}, testEvent{Action: "MONITOR", Seq: i})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Write blocked on a full pipe")
+	}
+
+	stats := o.Stats()
+	assert.NotZero(t, stats.Written)
+	assert.NotZero(t, stats.Dropped)
+	assert.Equal(t, uint64(5000), stats.Written+stats.Dropped)
+
+	// Whatever was written is whole lines, in order.
+	r := bufio.NewReader(reader)
+	for i := 0; i < int(stats.Written); i++ {
+		assert.Equal(t, i, readEvent(t, r).Event.(*testEvent).Seq)
+	}
+
+	// Once the reader caught up, the events are written again.
+	o.Write(alert.Event{Audit: config.ALERT_AUDIT_MOUNT}, testEvent{Seq: 5000})
+	assert.Equal(t, 5000, readEvent(t, r).Event.(*testEvent).Seq)
+}
+
+func TestFIFOReaderDisappears(t *testing.T) {
+	o := newOutput(t, config.EVENT_OUTPUT_FIFO)
+	reader := openReader(t, o.conf.Path)
+	o.Write(alert.Event{Audit: config.ALERT_AUDIT_FILEACCESS}, testEvent{Seq: 1})
+	assert.Equal(t, 1, readEvent(t, bufio.NewReader(reader)).Event.(*testEvent).Seq)
+
+	reader.Close()
+	o.Write(alert.Event{Audit: config.ALERT_AUDIT_FILEACCESS}, testEvent{Seq: 2})
+	o.Write(alert.Event{Audit: config.ALERT_AUDIT_FILEACCESS}, testEvent{Seq: 3})
+	assert.Equal(t, Stats{Written: 1, Dropped: 2}, o.Stats())
+
+	// The consumer restarts, and even removed the FIFO.
+	assert.Nil(t, os.Remove(o.conf.Path))
+	o.Write(alert.Event{Audit: config.ALERT_AUDIT_FILEACCESS}, testEvent{Seq: 4})
+	reader = openReader(t, o.conf.Path)
+	defer reader.Close()
+	o.Write(alert.Event{Audit: config.ALERT_AUDIT_FILEACCESS}, testEvent{Seq: 5})
+	assert.Equal(t, 5, readEvent(t, bufio.NewReader(reader)).Event.(*testEvent).Seq)
+	assert.Equal(t, Stats{Written: 2, Dropped: 3}, o.Stats())
+}
+
+func TestFIFODropsEventsLongerThanPipeBuf(t *testing.T) {
+	o := newOutput(t, config.EVENT_OUTPUT_FIFO)
+	reader := openReader(t, o.conf.Path)
+	defer reader.Close()
+
+	o.Write(alert.Event{Audit: config.ALERT_AUDIT_NETWORK}, testEvent{Action: string(make([]byte, PIPE_BUF))})
+	assert.Equal(t, Stats{Dropped: 1}, o.Stats())
+}
+
+func listen(t *testing.T, path string) *net.UnixConn {
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	assert.Nil(t, err)
+	return conn
+}
+
+func receive(t *testing.T, conn *net.UnixConn) Event {
+	buf := make([]byte, PIPE_BUF)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, byte('\n'), buf[n-1])
+	event := Event{Event: &testEvent{}}
+	assert.Nil(t, json.Unmarshal(buf[:n], &event))
+	return event
+}
+
+func TestUnixgram(t *testing.T) {
+	o := newOutput(t, config.EVENT_OUTPUT_UNIXGRAM)
+
+	// No listener yet.
+	o.Write(alert.Event{Audit: config.ALERT_AUDIT_NETWORK}, testEvent{Seq: 1})
+	assert.Equal(t, Stats{Dropped: 1}, o.Stats())
+
+	conn := listen(t, o.conf.Path)
+	o.Write(alert.Event{Audit: config.ALERT_AUDIT_NETWORK}, testEvent{Seq: 2})
+	assert.Equal(t, 2, receive(t, conn).Event.(*testEvent).Seq)
+
+	// A listener that does not read: its queue fills up without blocking the writes.
+	for i := 0; i < 5000; i++ {
+		o.Write(alert.Event{Audit: config.ALERT_AUDIT_NETWORK}, testEvent{Seq: 3})
+	}
+	stats := o.Stats()
+	assert.NotZero(t, stats.Dropped-1)
+	assert.Equal(t, uint64(5002), stats.Written+stats.Dropped)
+
+	// The listener disappears, then comes back.
+	conn.Close()
+	os.Remove(o.conf.Path)
+	o.Write(alert.Event{Audit: config.ALERT_AUDIT_NETWORK}, testEvent{Seq: 4})
+	assert.Equal(t, stats.Dropped+1, o.Stats().Dropped)
+
+	conn = listen(t, o.conf.Path)
+	defer conn.Close()
+	o.Write(alert.Event{Audit: config.ALERT_AUDIT_NETWORK}, testEvent{Seq: 5})
+	assert.Equal(t, 5, receive(t, conn).Event.(*testEvent).Seq)
+}
+
+func TestFilterRoutesTheMatchedEvents(t *testing.T) {
+	conf := config.EventOutputConfig{
+		Enable: true,
+		Type:   config.EVENT_OUTPUT_UNIXGRAM,
+		Path:   filepath.Join(t.TempDir(), "events"),
+		Filter: &config.AlertEventFilter{Audit: config.ALERT_AUDIT_NETWORK, LocalAddr: "10.0.0.0/8"},
+	}
+	o, err := New(conf, bouhekitest.NewClock(time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)))
+	assert.Nil(t, err)
+	defer o.Close()
+	conn := listen(t, conf.Path)
+	defer conn.Close()
+
+	o.Write(alert.Event{Audit: config.ALERT_AUDIT_NETWORK, Unbound: true}, testEvent{Seq: 1})
+	o.Write(alert.Event{Audit: config.ALERT_AUDIT_MOUNT}, testEvent{Seq: 2})
+	o.Write(alert.Event{Audit: config.ALERT_AUDIT_NETWORK, LocalAddr: net.ParseIP("10.0.0.2"), LocalPort: 40000}, testEvent{Seq: 3})
+	assert.Equal(t, 3, receive(t, conn).Event.(*testEvent).Seq)
+	assert.Equal(t, Stats{Written: 1}, o.Stats())
+
+	conf.Filter = &config.AlertEventFilter{LocalAddr: "localhost"}
+	_, err = New(conf, o.clock)
+	assert.NotNil(t, err)
+}
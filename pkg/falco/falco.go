@@ -0,0 +1,212 @@
+// Package falco renders the audit events as the alerts of Falco, so that the alert routers of an
+// existing Falco deployment forward them without changes: posted to falcosidekick, which routes
+// them as it routes the alerts of Falco, or appended to a file as the JSON lines of the file
+// output of Falco.
+//
+// A write never blocks the audits. The alerts wait in a queue of falco_output.queue_size, beyond
+// which they are dropped and counted, and the ones falcosidekick does not take are spooled and
+// posted again, in order, once it is back.
+package falco
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/alert"
+	"github.com/mrtc0/bouheki/pkg/clock"
+	"github.com/mrtc0/bouheki/pkg/config"
+	log "github.com/mrtc0/bouheki/pkg/log"
+	"github.com/mrtc0/bouheki/pkg/metrics"
+	"github.com/mrtc0/bouheki/pkg/spool"
+)
+
+// SPOOL_NAME names the metrics of the spool, e.g. bouheki_spool_falco_records.
+const SPOOL_NAME = "falco"
+
+var (
+	alertsWritten = metrics.NewCounter("falco_output_written_total",
+		"Number of audit events written or posted to falcosidekick as Falco alerts.")
+	alertsDropped = metrics.NewCounter("falco_output_dropped_total",
+		"Number of audit events dropped because the queue of the Falco output was full or the alert could not be written.")
+)
+
+// DefaultOutput is the output used by the package level Write. It is nil unless falco_output is enabled.
+var DefaultOutput *Output
+
+// Write writes event to the DefaultOutput. match is the audit of the event and the fields the
+// filter of the output matches.
+func Write(match alert.Event, event interface{}) {
+	if DefaultOutput != nil {
+		DefaultOutput.Write(match, event)
+	}
+}
+
+// Stats are the alerts written and dropped since the output was created.
+type Stats struct {
+	Written uint64
+	Dropped uint64
+}
+
+type Output struct {
+	mu    sync.Mutex
+	conf  config.FalcoOutputConfig
+	clock clock.Clock
+	// filter is the filter of the config, nil to render every event.
+	filter *alert.Filter
+	stats  Stats
+
+	// file is the file of type file.
+	file *os.File
+	// queue feeds the sink of type falcosidekick, which spools what falcosidekick does not take.
+	queue chan []byte
+	sink  *spool.Sink
+	done  chan struct{}
+}
+
+// New returns an output of conf. It opens the file, or the spool of falcosidekick and the
+// goroutine that posts the alerts.
+func New(conf config.FalcoOutputConfig, clk clock.Clock) (*Output, error) {
+	o := &Output{conf: conf, clock: clk}
+	if conf.Filter != nil {
+		filter, err := alert.NewFilter(*conf.Filter)
+		if err != nil {
+			return nil, fmt.Errorf("falco_output.filter: %w", err)
+		}
+		o.filter = filter
+	}
+
+	switch conf.Type {
+	case config.FALCO_OUTPUT_FILE:
+		file, err := os.OpenFile(conf.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("falco_output: %w", err)
+		}
+		o.file = file
+	case config.FALCO_OUTPUT_FALCOSIDEKICK:
+		s, err := spool.Open(SPOOL_NAME, conf.Spool)
+		if err != nil {
+			return nil, fmt.Errorf("falco_output.spool: %w", err)
+		}
+		o.sink = spool.NewSink(&sidekick{url: conf.URL, client: &http.Client{Timeout: conf.Timeout}}, s, conf.RetryInterval)
+		o.queue = make(chan []byte, conf.QueueSize)
+		o.done = make(chan struct{})
+		go o.post()
+	default:
+		return nil, fmt.Errorf("falco_output: unknown type %q", conf.Type)
+	}
+	return o, nil
+}
+
+// Write renders event of the audit of match as an alert, and writes it or queues it to be
+// posted. The events the filter does not match are skipped, and counted as neither.
+func (o *Output) Write(match alert.Event, event interface{}) {
+	if o.filter != nil && !o.filter.Match(match) {
+		return
+	}
+	a, err := Render(match.Audit, event, o.clock.Now(), o.conf.Tags)
+	if err != nil {
+		o.drop(err)
+		return
+	}
+	line, err := json.Marshal(a)
+	if err != nil {
+		o.drop(err)
+		return
+	}
+
+	if o.file != nil {
+		o.mu.Lock()
+		_, err := o.file.Write(append(line, '\n'))
+		o.mu.Unlock()
+		if err != nil {
+			o.drop(err)
+			return
+		}
+		o.written()
+		return
+	}
+
+	select {
+	case o.queue <- line:
+	default:
+		o.drop(fmt.Errorf("the queue of %d alerts is full", cap(o.queue)))
+	}
+}
+
+// post hands the queued alerts to the sink, which posts them or spools them, until Close.
+func (o *Output) post() {
+	defer close(o.done)
+	for line := range o.queue {
+		if err := o.sink.Send(line); err != nil {
+			o.drop(err)
+			continue
+		}
+		o.written()
+	}
+}
+
+func (o *Output) written() {
+	o.mu.Lock()
+	o.stats.Written++
+	o.mu.Unlock()
+	alertsWritten.Inc()
+}
+
+func (o *Output) drop(err error) {
+	o.mu.Lock()
+	o.stats.Dropped++
+	o.mu.Unlock()
+	alertsDropped.Inc()
+	log.Debug(fmt.Sprintf("falco_output: dropped an alert: %s", err))
+}
+
+// Stats returns the alerts written and dropped so far. An alert spooled for falcosidekick is
+// written.
+func (o *Output) Stats() Stats {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.stats
+}
+
+// Sink returns the sink of the spool of falcosidekick, nil for the type file.
+func (o *Output) Sink() *spool.Sink {
+	return o.sink
+}
+
+// Close closes the file, or posts the queued alerts within timeout and keeps the rest in the spool.
+func (o *Output) Close(timeout time.Duration) error {
+	if o.file != nil {
+		return o.file.Close()
+	}
+	close(o.queue)
+	<-o.done
+	return o.sink.Close(timeout)
+}
+
+// sidekick posts the alerts to falcosidekick, as Falco does with its http output.
+type sidekick struct {
+	url    string
+	client *http.Client
+}
+
+func (s *sidekick) Send(event []byte) error {
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(event))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("falcosidekick at %s answered %s", s.url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package falco
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/alert"
+	"github.com/mrtc0/bouheki/pkg/bouhekitest"
+	"github.com/mrtc0/bouheki/pkg/config"
+	log "github.com/mrtc0/bouheki/pkg/log"
+	"github.com/mrtc0/bouheki/pkg/spool"
+	"github.com/stretchr/testify/assert"
+)
+
+var blocked = log.RestrictedNetworkLog{
+	AuditEventLog: log.AuditEventLog{Action: "BLOCKED", Hostname: "web-1", PID: 4242, Comm: "curl"},
+	Addr:          "203.0.113.10",
+	Port:          443,
+	Protocol:      "TCP",
+}
+
+func blockedMatch() alert.Event {
+	return alert.Event{Audit: config.ALERT_AUDIT_NETWORK, Action: "BLOCKED", Comm: "curl"}
+}
+
+// sidekickServer is a falcosidekick that records the alerts it takes, and fails while down.
+type sidekickServer struct {
+	mu     sync.Mutex
+	down   bool
+	alerts []Alert
+}
+
+func (s *sidekickServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.down {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	var a Alert
+	if r.Header.Get("Content-Type") != "application/json" || json.NewDecoder(r.Body).Decode(&a) != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	s.alerts = append(s.alerts, a)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *sidekickServer) received() []Alert {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]Alert{}, s.alerts...)
+}
+
+func (s *sidekickServer) setDown(down bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.down = down
+}
+
+func newSidekickOutput(t *testing.T, url string) *Output {
+	conf := config.DefaultConfig().FalcoOutput
+	conf.Enable = true
+	conf.URL = url
+	conf.Spool = spool.Config{Dir: t.TempDir()}
+	conf.RetryInterval = 10 * time.Millisecond
+	o, err := New(conf, bouhekitest.NewClock(renderTestTime))
+	assert.Nil(t, err)
+	return o
+}
+
+func TestOutputPostsToFalcosidekick(t *testing.T) {
+	server := &sidekickServer{}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	o := newSidekickOutput(t, ts.URL)
+
+	o.Write(blockedMatch(), blocked)
+	assert.Eventually(t, func() bool { return len(server.received()) == 1 }, time.Second, 5*time.Millisecond)
+	a := server.received()[0]
+	assert.Equal(t, "Bouheki Network Connection Blocked", a.Rule)
+	assert.Equal(t, PRIORITY_WARNING, a.Priority)
+	assert.Equal(t, SOURCE, a.Source)
+	assert.Equal(t, "web-1", a.Hostname)
+	assert.Equal(t, "203.0.113.10", a.OutputFields["fd.sip"])
+
+	// While falcosidekick is down, the alerts are spooled, then posted in order.
+	server.setDown(true)
+	o.Write(blockedMatch(), log.RestrictedNetworkLog{AuditEventLog: log.AuditEventLog{Action: "BLOCKED", Comm: "wget"}})
+	o.Write(blockedMatch(), log.RestrictedNetworkLog{AuditEventLog: log.AuditEventLog{Action: "BLOCKED", Comm: "nc"}})
+	assert.Eventually(t, func() bool { return o.sink.Stats().Records == 2 }, time.Second, 5*time.Millisecond)
+	server.setDown(false)
+	assert.Eventually(t, func() bool { return len(server.received()) == 3 }, time.Second, 5*time.Millisecond)
+	received := server.received()
+	assert.Equal(t, "wget", received[1].OutputFields["proc.name"])
+	assert.Equal(t, "nc", received[2].OutputFields["proc.name"])
+
+	assert.Nil(t, o.Close(time.Second))
+	assert.Equal(t, Stats{Written: 3}, o.Stats())
+}
+
+func TestOutputDropsWhenTheQueueIsFull(t *testing.T) {
+	o := &Output{conf: config.FalcoOutputConfig{Type: config.FALCO_OUTPUT_FALCOSIDEKICK}, clock: bouhekitest.NewClock(renderTestTime), queue: make(chan []byte, 1)}
+
+	o.Write(blockedMatch(), blocked)
+	o.Write(blockedMatch(), blocked)
+	assert.Len(t, o.queue, 1)
+	assert.Equal(t, Stats{Dropped: 1}, o.Stats())
+}
+
+func TestOutputWritesFalcoJSONLines(t *testing.T) {
+	conf := config.DefaultConfig().FalcoOutput
+	conf.Enable = true
+	conf.Type = config.FALCO_OUTPUT_FILE
+	conf.Path = filepath.Join(t.TempDir(), "falco.json")
+	conf.Filter = &config.AlertEventFilter{Action: "BLOCKED"}
+	o, err := New(conf, bouhekitest.NewClock(renderTestTime))
+	assert.Nil(t, err)
+
+	o.Write(blockedMatch(), blocked)
+	// The events the filter does not match are not written.
+	o.Write(alert.Event{Audit: config.ALERT_AUDIT_NETWORK, Action: "MONITOR"}, blocked)
+	o.Write(blockedMatch(), blocked)
+	assert.Nil(t, o.Close(time.Second))
+	assert.Equal(t, Stats{Written: 2}, o.Stats())
+
+	file, err := os.Open(conf.Path)
+	assert.Nil(t, err)
+	defer file.Close()
+	lines := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var a Alert
+		assert.Nil(t, json.Unmarshal(scanner.Bytes(), &a))
+		assert.Equal(t, "15:06:10.000000000: Warning Bouheki Network Connection Blocked (proc.name=curl proc.pid=4242 proc.pname=<NA> fd.sip=203.0.113.10 fd.sport=443 fd.sip.name=<NA> fd.l4proto=tcp fd.cip=<NA> fd.cport=0)", a.Output)
+		lines++
+	}
+	assert.Equal(t, 2, lines)
+}
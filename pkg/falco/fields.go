@@ -0,0 +1,168 @@
+package falco
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+)
+
+const (
+	// SOURCE is the source of the alerts, as the syscall source of the alerts of Falco.
+	SOURCE = "bouheki"
+	// FIELD_PREFIX prefixes the fields of the events that no field of Falco stands for.
+	FIELD_PREFIX = "bouheki."
+
+	PRIORITY_WARNING       = "Warning"
+	PRIORITY_NOTICE        = "Notice"
+	PRIORITY_INFORMATIONAL = "Informational"
+
+	// OUTPUT_TIME_FORMAT is the time the output of an alert begins with, as in Falco.
+	OUTPUT_TIME_FORMAT = "15:04:05.000000000"
+)
+
+// Alert is an event in the JSON shape of the alerts of Falco, which falcosidekick takes.
+type Alert struct {
+	Output       string                 `json:"output"`
+	Priority     string                 `json:"priority"`
+	Rule         string                 `json:"rule"`
+	Time         time.Time              `json:"time"`
+	Source       string                 `json:"source"`
+	Tags         []string               `json:"tags"`
+	Hostname     string                 `json:"hostname"`
+	OutputFields map[string]interface{} `json:"output_fields"`
+}
+
+// field maps a field of the events of bouheki to the field of Falco it is rendered as.
+type field struct {
+	bouheki string
+	falco   string
+	// lower lowercases the value, as Falco renders it.
+	lower bool
+	// container leaves the field out when it is empty, for the processes that are not in a
+	// container or whose container was not looked up.
+	container bool
+}
+
+// fields are the fields of the events that have a field of Falco, in the order the output lists
+// them. The other fields are rendered under FIELD_PREFIX, and Hostname and Action make the
+// hostname, the rule and the priority of the alert instead.
+var fields = []field{
+	{bouheki: "Comm", falco: "proc.name"},
+	{bouheki: "PID", falco: "proc.pid"},
+	{bouheki: "ParentComm", falco: "proc.pname"},
+	{bouheki: "Addr", falco: "fd.sip"},
+	{bouheki: "Port", falco: "fd.sport"},
+	{bouheki: "Domain", falco: "fd.sip.name"},
+	{bouheki: "Protocol", falco: "fd.l4proto", lower: true},
+	{bouheki: "LocalAddr", falco: "fd.cip"},
+	{bouheki: "LocalPort", falco: "fd.cport"},
+	{bouheki: "Path", falco: "fd.name"},
+	{bouheki: "SourcePath", falco: "fs.path.source"},
+	{bouheki: "ContainerID", falco: "container.id", container: true},
+	{bouheki: "ContainerName", falco: "container.name", container: true},
+	{bouheki: "ContainerImage", falco: "container.image", container: true},
+	{bouheki: "PodName", falco: "k8s.pod.name", container: true},
+	{bouheki: "PodNamespace", falco: "k8s.ns.name", container: true},
+}
+
+// rules are the names of the rules of the alerts, by audit.
+var rules = map[string]string{
+	config.ALERT_AUDIT_NETWORK:    "Bouheki Network Connection",
+	config.ALERT_AUDIT_FILEACCESS: "Bouheki File Access",
+	config.ALERT_AUDIT_MOUNT:      "Bouheki Mount",
+}
+
+// priorities are the priorities of the alerts, and the word their rule ends with, by action.
+var priorities = map[string]struct{ priority, word string }{
+	"BLOCKED": {PRIORITY_WARNING, "Blocked"},
+	"MONITOR": {PRIORITY_NOTICE, "Monitored"},
+	"ALLOWED": {PRIORITY_INFORMATIONAL, "Allowed"},
+}
+
+// Render returns the alert of event, an event of audit as written to the log, e.g. a
+// log.RestrictedNetworkLog, with the tags of the config.
+func Render(audit string, event interface{}, now time.Time, tags []string) (Alert, error) {
+	values, err := eventFields(event)
+	if err != nil {
+		return Alert{}, err
+	}
+	action, _ := values["Action"].(string)
+	hostname, _ := values["Hostname"].(string)
+	delete(values, "Action")
+	delete(values, "Hostname")
+
+	alert := Alert{
+		Time:         now.UTC(),
+		Source:       SOURCE,
+		Tags:         append([]string{SOURCE, audit}, tags...),
+		Hostname:     hostname,
+		OutputFields: map[string]interface{}{},
+	}
+	p, ok := priorities[action]
+	if !ok {
+		p.priority, p.word = PRIORITY_INFORMATIONAL, action
+	}
+	alert.Priority = p.priority
+	alert.Rule = strings.TrimSpace(rules[audit] + " " + p.word)
+
+	listed := []string{}
+	for _, f := range fields {
+		value, ok := values[f.bouheki]
+		if !ok {
+			continue
+		}
+		delete(values, f.bouheki)
+		if f.container && value == "" {
+			continue
+		}
+		if s, ok := value.(string); ok && f.lower {
+			value = strings.ToLower(s)
+		}
+		alert.OutputFields[f.falco] = value
+		listed = append(listed, fmt.Sprintf("%s=%v", f.falco, outputValue(value)))
+	}
+	for name, value := range values {
+		alert.OutputFields[FIELD_PREFIX+snakeCase(name)] = value
+	}
+	alert.OutputFields[FIELD_PREFIX+"action"] = action
+
+	alert.Output = fmt.Sprintf("%s: %s %s (%s)", alert.Time.Format(OUTPUT_TIME_FORMAT), alert.Priority, alert.Rule, strings.Join(listed, " "))
+	return alert, nil
+}
+
+// eventFields returns the fields of event by the name they have in its JSON, the numbers as
+// json.Number so that they are rendered as they are.
+func eventFields(event interface{}) (map[string]interface{}, error) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]interface{}{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&values); err != nil {
+		return nil, fmt.Errorf("an event must be a JSON object: %w", err)
+	}
+	return values, nil
+}
+
+// outputValue is a value as Falco writes it in the output, <NA> for an empty one.
+func outputValue(value interface{}) interface{} {
+	if value == nil || value == "" {
+		return "<NA>"
+	}
+	return value
+}
+
+var wordBoundary = regexp.MustCompile(`([a-z0-9])([A-Z])|([A-Z]+)([A-Z][a-z])`)
+
+// snakeCase returns the name of a field of the events as a field of Falco, e.g. policy_digest for
+// PolicyDigest.
+func snakeCase(name string) string {
+	return strings.ToLower(wordBoundary.ReplaceAllString(name, "${1}${3}_${2}${4}"))
+}
@@ -0,0 +1,120 @@
+package falco
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+	log "github.com/mrtc0/bouheki/pkg/log"
+	"github.com/stretchr/testify/assert"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files of testdata")
+
+var renderTestTime = time.Date(2026, 10, 14, 15, 6, 10, 0, time.UTC)
+
+func TestRenderGolden(t *testing.T) {
+	for _, test := range []struct {
+		golden string
+		audit  string
+		event  interface{}
+	}{
+		{
+			golden: "network_blocked.json",
+			audit:  config.ALERT_AUDIT_NETWORK,
+			event: log.RestrictedNetworkLog{
+				AuditEventLog:   log.AuditEventLog{Action: "BLOCKED", Hostname: "web-1", PID: 4242, Comm: "curl", ParentComm: "bash"},
+				EventVersion:    log.NETWORK_EVENT_VERSION,
+				PolicyDigest:    "5f1c0e",
+				Addr:            "203.0.113.10",
+				Port:            443,
+				Protocol:        "TCP",
+				Operation:       "connect",
+				Unbound:         true,
+				DestinationTags: []string{"cloud-metadata"},
+				Rule:            "denied by cidr 203.0.113.0/24",
+			},
+		},
+		{
+			golden: "network_blocked_container.json",
+			audit:  config.ALERT_AUDIT_NETWORK,
+			event: log.RestrictedNetworkLog{
+				AuditEventLog: log.AuditEventLog{
+					Action: "BLOCKED", Hostname: "node-3", PID: 4245, Comm: "wget", ParentComm: "sh",
+					CgroupID: 9876, ContainerID: "3f4c3a8a9b1a2c0e5d6f7a8b9c0d1e2f3a4b5c6d7e8f9a0b1c2d3e4f5a6b7c8d",
+					ContainerName: "nginx", ContainerImage: "docker.io/library/nginx:1.25", PodName: "web-7d4b9", PodNamespace: "shop",
+				},
+				EventVersion: log.NETWORK_EVENT_VERSION,
+				PolicyDigest: "5f1c0e",
+				Addr:         "198.51.100.7",
+				Port:         80,
+				Protocol:     "TCP",
+				Operation:    "connect",
+			},
+		},
+		{
+			golden: "fileaccess_monitor.json",
+			audit:  config.ALERT_AUDIT_FILEACCESS,
+			event: log.RestrictedFileAccessLog{
+				AuditEventLog: log.AuditEventLog{Action: "MONITOR", Hostname: "web-1", PID: 4243, Comm: "cat", ParentComm: "bash"},
+				Path:          "/etc/shadow",
+			},
+		},
+		{
+			golden: "mount_blocked.json",
+			audit:  config.ALERT_AUDIT_MOUNT,
+			event: log.RestrictedMountLog{
+				AuditEventLog: log.AuditEventLog{Action: "BLOCKED", Hostname: "web-1", PID: 4244, Comm: "mount", ParentComm: "sh"},
+				SourcePath:    "/var/run/docker.sock",
+			},
+		},
+	} {
+		t.Run(test.golden, func(t *testing.T) {
+			alert, err := Render(test.audit, test.event, renderTestTime, []string{"prod"})
+			assert.Nil(t, err)
+			data, err := json.MarshalIndent(alert, "", "  ")
+			assert.Nil(t, err)
+			data = append(data, '\n')
+
+			path := filepath.Join("testdata", test.golden)
+			if *updateGolden {
+				assert.Nil(t, ioutil.WriteFile(path, data, 0644))
+			}
+			golden, err := ioutil.ReadFile(path)
+			assert.Nil(t, err)
+			assert.Equal(t, string(golden), string(data))
+		})
+	}
+}
+
+func TestRenderPrefixesTheUnknownFields(t *testing.T) {
+	event := struct {
+		Action       string
+		Comm         string
+		QueueID      int
+		HTTPStatus   string
+		PolicyDigest string
+	}{Action: "DEFERRED", Comm: "curl", QueueID: 7, HTTPStatus: "503", PolicyDigest: "5f1c0e"}
+
+	alert, err := Render(config.ALERT_AUDIT_NETWORK, event, renderTestTime, nil)
+	assert.Nil(t, err)
+	// An unknown action keeps its name in the rule.
+	assert.Equal(t, "Bouheki Network Connection DEFERRED", alert.Rule)
+	assert.Equal(t, PRIORITY_INFORMATIONAL, alert.Priority)
+	assert.Equal(t, []string{SOURCE, config.ALERT_AUDIT_NETWORK}, alert.Tags)
+	assert.Equal(t, map[string]interface{}{
+		"proc.name":             "curl",
+		"bouheki.action":        "DEFERRED",
+		"bouheki.queue_id":      json.Number("7"),
+		"bouheki.http_status":   "503",
+		"bouheki.policy_digest": "5f1c0e",
+	}, alert.OutputFields)
+	assert.Equal(t, "15:06:10.000000000: Informational Bouheki Network Connection DEFERRED (proc.name=curl)", alert.Output)
+
+	_, err = Render(config.ALERT_AUDIT_NETWORK, "BLOCKED", renderTestTime, nil)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,261 @@
+// Package fallback applies the fallback_policy of the config when the config can not be loaded.
+//
+// When the config is missing or broken after a restart, bouheki can not start and the host runs
+// unprotected. Every time the config loads, its fallback_policy is loaded too, and a copy of it is
+// kept at COPY_PATH: a fallback that does not load is reported at once, rather than when it is
+// needed, and the last valid copy is kept. When the config can not be loaded at startup, or after
+// fallback_policy.reload_failures consecutive failed reloads, the copy is applied, and the config
+// is retried until it loads again.
+package fallback
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/errkind"
+	log "github.com/mrtc0/bouheki/pkg/log"
+	"github.com/mrtc0/bouheki/pkg/metrics"
+)
+
+const (
+	// STATUS_PATH is where the Status is served next to /metrics.
+	STATUS_PATH = "/fallback"
+	// COPY_PATH keeps the last fallback_policy that loaded, which is applied when the config
+	// can not be loaded, and so can not tell where its fallback_policy is.
+	COPY_PATH = "/var/lib/bouheki/fallback-policy.yaml"
+	// RETRY_INTERVAL is the interval at which the config is loaded again while the fallback is active.
+	RETRY_INTERVAL = 30 * time.Second
+
+	SOURCE_CONFIG   = "config"
+	SOURCE_FALLBACK = "fallback"
+)
+
+var (
+	activeGauge    = metrics.NewGauge("fallback_policy_active", "1 while the fallback policy is applied in place of the config.")
+	validGauge     = metrics.NewGauge("fallback_policy_valid", "1 if the fallback_policy of the config loaded with the config, 0 if it is not set or is invalid.")
+	failoverCount  = metrics.NewCounter("fallback_policy_failovers_total", "Number of times the fallback policy was applied because the config could not be loaded.")
+	promotionCount = metrics.NewCounter("fallback_policy_promotions_total", "Number of times the config was loaded again while the fallback policy was applied.")
+)
+
+// Load reads and validates the policy file at path.
+type Load func(path string) (*config.Config, error)
+
+type Status struct {
+	// Active is SOURCE_CONFIG or SOURCE_FALLBACK.
+	Active string    `json:"active"`
+	Since  time.Time `json:"since"`
+	Config string    `json:"config"`
+	// Fallback is the fallback_policy.path of the config, or the copy while it is applied.
+	Fallback string `json:"fallback,omitempty"`
+	// FallbackValid is whether Fallback loaded with the last loaded config.
+	FallbackValid bool   `json:"fallback_valid"`
+	FallbackError string `json:"fallback_error,omitempty"`
+	// Failures is the number of consecutive failed loads of the config, and Error the last one.
+	Failures   int    `json:"failures"`
+	Error      string `json:"error,omitempty"`
+	Failovers  int    `json:"failovers"`
+	Promotions int    `json:"promotions"`
+}
+
+// Source loads the config, or the fallback policy when it can not be loaded.
+type Source struct {
+	mu     sync.Mutex
+	path   string
+	copy   string
+	load   Load
+	status Status
+	// reloadFailures is the fallback_policy.reload_failures of the last loaded config.
+	reloadFailures int
+	interval       time.Duration
+	now            func() time.Time
+}
+
+// New returns a Source of the config at path, which keeps the copy of its fallback policy at copyPath.
+func New(path string, load Load, copyPath string) *Source {
+	return &Source{
+		path:     path,
+		copy:     copyPath,
+		load:     load,
+		status:   Status{Config: path},
+		interval: RETRY_INTERVAL,
+		now:      time.Now,
+	}
+}
+
+// Start loads the config, or the copy of its fallback policy if the config can not be loaded.
+func (s *Source) Start() (*config.Config, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	conf, err := s.load(s.path)
+	if err != nil {
+		return s.failover(err)
+	}
+	s.loaded(conf)
+	return conf, nil
+}
+
+// Reload loads the config again, and returns the policy to apply. While the config is applied, a
+// failed load returns an error and the current policy is kept, until reload_failures consecutive
+// loads failed and the fallback is returned. While the fallback is applied, it returns the config
+// once it loads.
+func (s *Source) Reload() (*config.Config, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	conf, err := s.load(s.path)
+	if err != nil {
+		if s.status.Active == SOURCE_CONFIG && s.reloadFailures > 0 && s.status.Failures+1 >= s.reloadFailures {
+			return s.failover(err)
+		}
+		s.failed(err)
+		return nil, err
+	}
+
+	if s.status.Active == SOURCE_FALLBACK {
+		s.promoted()
+	}
+	s.loaded(conf)
+	return conf, nil
+}
+
+// Run loads the config every RETRY_INTERVAL while the fallback is applied, and calls promote
+// with it once it loads. The config replaces the fallback once promote applies it; when promote
+// fails, the fallback stays applied and the config is loaded again at the next retry.
+func (s *Source) Run(ctx context.Context, promote func(conf *config.Config) error) {
+	for s.Active() == SOURCE_FALLBACK {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(s.interval):
+		}
+
+		conf, err := s.load(s.path)
+		if err == nil {
+			err = promote(conf)
+		}
+
+		s.mu.Lock()
+		if err != nil {
+			s.failed(err)
+			s.mu.Unlock()
+			continue
+		}
+		s.promoted()
+		s.loaded(conf)
+		s.mu.Unlock()
+		return
+	}
+}
+
+// promoted counts the config replacing the fallback.
+func (s *Source) promoted() {
+	s.status.Promotions++
+	promotionCount.Inc()
+	(&log.FallbackPolicyLog{Config: s.path, Fallback: s.status.Fallback, Failures: s.status.Failures}).Info()
+}
+
+func (s *Source) failed(err error) {
+	s.status.Failures++
+	s.status.Error = err.Error()
+}
+
+// failover applies the copy of the fallback policy, if it loads.
+func (s *Source) failover(err error) (*config.Config, error) {
+	s.failed(err)
+	conf, fallbackErr := s.load(s.copy)
+	if fallbackErr != nil {
+		if errors.Is(fallbackErr, os.ErrNotExist) {
+			return nil, err
+		}
+		return nil, errkind.New(errkind.Config, fmt.Errorf("%v, and the fallback policy %s can not be loaded: %v", err, s.copy, fallbackErr))
+	}
+
+	s.status.Active = SOURCE_FALLBACK
+	s.status.Since = s.now()
+	s.status.Fallback = s.copy
+	s.status.Failovers++
+	activeGauge.Set(1)
+	failoverCount.Inc()
+	(&log.FallbackPolicyLog{Config: s.path, Fallback: s.copy, Failures: s.status.Failures, LastError: s.status.Error}).Error()
+	return conf, nil
+}
+
+// loaded applies conf, and loads its fallback policy to replace the copy.
+func (s *Source) loaded(conf *config.Config) {
+	if s.status.Active != SOURCE_CONFIG {
+		s.status.Since = s.now()
+	}
+	s.status.Active = SOURCE_CONFIG
+	s.status.Failures = 0
+	s.status.Error = ""
+	s.reloadFailures = conf.FallbackPolicy.ReloadFailures
+	activeGauge.Set(0)
+
+	s.status.Fallback = conf.FallbackPolicy.Path
+	s.status.FallbackValid = false
+	s.status.FallbackError = ""
+	validGauge.Set(0)
+	if conf.FallbackPolicy.Path == "" {
+		// A copy of a fallback the config no longer has must not be applied.
+		if err := os.Remove(s.copy); err != nil && !os.IsNotExist(err) {
+			log.Error(fmt.Errorf("fallback_policy: %w", err))
+		}
+		return
+	}
+
+	if err := s.replaceCopy(conf.FallbackPolicy.Path); err != nil {
+		s.status.FallbackError = err.Error()
+		log.Error(fmt.Errorf("fallback_policy %s is invalid, the last valid copy is kept: %w", conf.FallbackPolicy.Path, err))
+		return
+	}
+	s.status.FallbackValid = true
+	validGauge.Set(1)
+}
+
+// replaceCopy loads the fallback policy at path, and replaces the copy with it if it loads.
+func (s *Source) replaceCopy(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if _, err := s.load(path); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.copy), 0700); err != nil {
+		return err
+	}
+	tmp := s.copy + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.copy)
+}
+
+// Active returns SOURCE_CONFIG or SOURCE_FALLBACK, or "" before Start.
+func (s *Source) Active() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status.Active
+}
+
+func (s *Source) Status() Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status
+}
+
+func (s *Source) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.Status())
+}
@@ -0,0 +1,263 @@
+package fallback
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+const fallbackPolicy = `
+network:
+  mode: block
+  cidr:
+    allow: [127.0.0.1/32]
+`
+
+type testFiles struct {
+	dir      string
+	config   string
+	fallback string
+	copy     string
+}
+
+func newTestFiles(t *testing.T) testFiles {
+	dir := t.TempDir()
+	files := testFiles{
+		dir:      dir,
+		config:   filepath.Join(dir, "bouheki.yaml"),
+		fallback: filepath.Join(dir, "fallback.yaml"),
+		copy:     filepath.Join(dir, "state", "fallback-policy.yaml"),
+	}
+	files.write(t, files.fallback, fallbackPolicy)
+	return files
+}
+
+func (f testFiles) write(t *testing.T, path, content string) {
+	assert.Nil(t, ioutil.WriteFile(path, []byte(content), 0600))
+}
+
+// primary writes a valid config with the fallback and reload_failures.
+func (f testFiles) primary(t *testing.T, reloadFailures int) {
+	f.write(t, f.config, fmt.Sprintf("fallback_policy:\n  path: %s\n  reload_failures: %d\nnetwork:\n  mode: monitor\n", f.fallback, reloadFailures))
+}
+
+func (f testFiles) broken(t *testing.T) {
+	f.write(t, f.config, "network: [\n")
+}
+
+func TestStartAppliesTheFallbackWhenTheConfigCanNotBeLoaded(t *testing.T) {
+	files := newTestFiles(t)
+	files.primary(t, 0)
+
+	source := New(files.config, config.NewConfig, files.copy)
+	conf, err := source.Start()
+	assert.Nil(t, err)
+	assert.Equal(t, "monitor", conf.RestrictedNetworkConfig.Mode)
+	status := source.Status()
+	assert.Equal(t, SOURCE_CONFIG, status.Active)
+	assert.True(t, status.FallbackValid)
+	copied, err := ioutil.ReadFile(files.copy)
+	assert.Nil(t, err)
+	assert.Equal(t, fallbackPolicy, string(copied))
+
+	// After a restart, the config is broken: the copy is applied, wherever the config said the fallback is.
+	files.broken(t)
+	assert.Nil(t, os.Remove(files.fallback))
+	source = New(files.config, config.NewConfig, files.copy)
+	conf, err = source.Start()
+	assert.Nil(t, err)
+	assert.Equal(t, "block", conf.RestrictedNetworkConfig.Mode)
+	status = source.Status()
+	assert.Equal(t, SOURCE_FALLBACK, status.Active)
+	assert.Equal(t, files.copy, status.Fallback)
+	assert.Equal(t, 1, status.Failures)
+	assert.Equal(t, 1, status.Failovers)
+	assert.NotEmpty(t, status.Error)
+	assert.Equal(t, float64(1), activeGauge.Value())
+}
+
+func TestStartFailsWithoutAFallback(t *testing.T) {
+	files := newTestFiles(t)
+	files.broken(t)
+
+	_, err := New(files.config, config.NewConfig, files.copy).Start()
+	assert.NotNil(t, err)
+	assert.NotContains(t, err.Error(), "fallback")
+
+	assert.Nil(t, os.MkdirAll(filepath.Dir(files.copy), 0700))
+	files.write(t, files.copy, "network: [\n")
+	_, err = New(files.config, config.NewConfig, files.copy).Start()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "and the fallback policy "+files.copy+" can not be loaded")
+}
+
+func TestAnInvalidFallbackIsReportedAndTheLastValidCopyIsKept(t *testing.T) {
+	files := newTestFiles(t)
+	files.primary(t, 0)
+	source := New(files.config, config.NewConfig, files.copy)
+	_, err := source.Start()
+	assert.Nil(t, err)
+
+	files.write(t, files.fallback, "network: [\n")
+	_, err = source.Reload()
+	assert.Nil(t, err)
+	status := source.Status()
+	assert.Equal(t, SOURCE_CONFIG, status.Active)
+	assert.False(t, status.FallbackValid)
+	assert.NotEmpty(t, status.FallbackError)
+	assert.Equal(t, float64(0), validGauge.Value())
+	copied, err := ioutil.ReadFile(files.copy)
+	assert.Nil(t, err)
+	assert.Equal(t, fallbackPolicy, string(copied))
+
+	// A config without a fallback removes the copy.
+	files.write(t, files.config, "network:\n  mode: monitor\n")
+	_, err = source.Reload()
+	assert.Nil(t, err)
+	_, err = os.Stat(files.copy)
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, "", source.Status().Fallback)
+}
+
+func TestFlappingConfig(t *testing.T) {
+	files := newTestFiles(t)
+	files.primary(t, 2)
+	source := New(files.config, config.NewConfig, files.copy)
+	_, err := source.Start()
+	assert.Nil(t, err)
+
+	step := func(valid bool) (*config.Config, error) {
+		if valid {
+			files.primary(t, 2)
+		} else {
+			files.broken(t)
+		}
+		return source.Reload()
+	}
+
+	// A single failed reload keeps the config: the next one loads and resets the failures.
+	_, err = step(false)
+	assert.NotNil(t, err)
+	assert.Equal(t, SOURCE_CONFIG, source.Active())
+	assert.Equal(t, 1, source.Status().Failures)
+	_, err = step(true)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, source.Status().Failures)
+
+	// reload_failures consecutive failures apply the fallback.
+	_, err = step(false)
+	assert.NotNil(t, err)
+	conf, err := step(false)
+	assert.Nil(t, err)
+	assert.Equal(t, "block", conf.RestrictedNetworkConfig.Mode)
+	assert.Equal(t, SOURCE_FALLBACK, source.Active())
+
+	// While the fallback is applied, failures keep it, and the first load promotes the config.
+	_, err = step(false)
+	assert.NotNil(t, err)
+	assert.Equal(t, SOURCE_FALLBACK, source.Active())
+	assert.Equal(t, 3, source.Status().Failures)
+	conf, err = step(true)
+	assert.Nil(t, err)
+	assert.Equal(t, "monitor", conf.RestrictedNetworkConfig.Mode)
+	status := source.Status()
+	assert.Equal(t, SOURCE_CONFIG, status.Active)
+	assert.Equal(t, 0, status.Failures)
+	assert.Equal(t, 1, status.Failovers)
+	assert.Equal(t, 1, status.Promotions)
+	assert.Equal(t, files.fallback, status.Fallback)
+	assert.True(t, status.FallbackValid)
+
+	// Without reload_failures, the config is kept however many reloads fail.
+	files.primary(t, 0)
+	_, err = source.Reload()
+	assert.Nil(t, err)
+	for i := 0; i < 5; i++ {
+		_, err = step(false)
+		assert.NotNil(t, err)
+	}
+	assert.Equal(t, SOURCE_CONFIG, source.Active())
+	assert.Equal(t, 1, source.Status().Failovers)
+}
+
+func TestRunPromotesTheConfigOnceItLoads(t *testing.T) {
+	files := newTestFiles(t)
+	files.primary(t, 0)
+	_, err := New(files.config, config.NewConfig, files.copy).Start()
+	assert.Nil(t, err)
+
+	files.broken(t)
+	source := New(files.config, config.NewConfig, files.copy)
+	source.interval = time.Millisecond
+	_, err = source.Start()
+	assert.Nil(t, err)
+
+	promoted := make(chan *config.Config)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go source.Run(ctx, func(conf *config.Config) error {
+		promoted <- conf
+		return nil
+	})
+
+	// The config is retried while it is broken.
+	for source.Status().Failures < 3 {
+		time.Sleep(time.Millisecond)
+	}
+	files.primary(t, 0)
+	select {
+	case conf := <-promoted:
+		assert.Equal(t, "monitor", conf.RestrictedNetworkConfig.Mode)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the config was not promoted")
+	}
+	assert.Equal(t, SOURCE_CONFIG, source.Active())
+}
+
+func TestRunRetriesAPromotionThatFails(t *testing.T) {
+	files := newTestFiles(t)
+	files.primary(t, 0)
+	_, err := New(files.config, config.NewConfig, files.copy).Start()
+	assert.Nil(t, err)
+
+	files.broken(t)
+	source := New(files.config, config.NewConfig, files.copy)
+	source.interval = time.Millisecond
+	_, err = source.Start()
+	assert.Nil(t, err)
+	files.primary(t, 0)
+
+	// The config loads, but the first promotions fail to apply it.
+	attempts := 0
+	promoted := make(chan *config.Config, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go source.Run(ctx, func(conf *config.Config) error {
+		attempts++
+		if attempts < 3 {
+			assert.Equal(t, SOURCE_FALLBACK, source.Active())
+			return errors.New("rejected")
+		}
+		promoted <- conf
+		return nil
+	})
+
+	select {
+	case <-promoted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the config was not promoted")
+	}
+	status := source.Status()
+	assert.Equal(t, SOURCE_CONFIG, status.Active)
+	assert.Equal(t, 3, attempts)
+	assert.Equal(t, 1, status.Promotions)
+	assert.Equal(t, 0, status.Failures)
+}
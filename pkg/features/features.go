@@ -0,0 +1,248 @@
+// Package features resolves the kernel capabilities the features of a config need, before the
+// BPF programs are loaded.
+//
+// Every feature declares the capabilities it requires in Requirements, and the preflight probes
+// them. A missing capability fails the startup with the table of what the config requested and
+// what the kernel lacks, unless the feature has a documented degraded mode: bouheki then proceeds
+// without it, logs a warning and lists it in the Report served on STATUS_PATH.
+package features
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/mrtc0/bouheki/pkg/classify"
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/errkind"
+	log "github.com/mrtc0/bouheki/pkg/log"
+	"github.com/mrtc0/bouheki/pkg/utils"
+)
+
+const (
+	// STATUS_PATH is where the Report is served next to /metrics.
+	STATUS_PATH = "/features"
+
+	CAP_BTF                = "BTF"
+	CAP_RINGBUF            = "BPF ring buffer"
+	CAP_BPF_LSM            = "BPF LSM"
+	CAP_KPROBE             = "kprobes"
+	CAP_SEND_SIGNAL        = "bpf_send_signal"
+	CAP_ANCESTOR_CGROUP_ID = "bpf_get_current_ancestor_cgroup_id"
+	CAP_CGROUP_V2          = "cgroup v2"
+
+	// KPROBE_PMU is the event source libbpf attaches kprobes with.
+	KPROBE_PMU = "/sys/bus/event_source/devices/kprobe"
+)
+
+// Probe returns nil when the kernel has the capability.
+type Probe func() error
+
+// Probes are the probes of the capabilities, by name.
+type Probes map[string]Probe
+
+// DefaultProbes probes the running kernel. The helpers are probed by the kernel version that introduced them.
+func DefaultProbes() Probes {
+	return Probes{
+		CAP_BTF:                utils.HasBTF,
+		CAP_RINGBUF:            kernelVersion("5.8.0"),
+		CAP_BPF_LSM:            utils.HasBPFLSM,
+		CAP_KPROBE:             exists(KPROBE_PMU),
+		CAP_SEND_SIGNAL:        kernelVersion("5.3.0"),
+		CAP_ANCESTOR_CGROUP_ID: kernelVersion("5.6.0"),
+		CAP_CGROUP_V2:          cgroupV2,
+	}
+}
+
+func kernelVersion(version string) Probe {
+	return func() error {
+		return utils.HasKernelVersion(version)
+	}
+}
+
+// cgroupV2 probes the cgroup v2 hierarchy, in the unified or the hybrid layout.
+func cgroupV2() error {
+	_, err := classify.UnifiedRoot(classify.CGROUP_ROOT)
+	return err
+}
+
+func exists(path string) Probe {
+	return func() error {
+		_, err := os.Stat(path)
+		return err
+	}
+}
+
+// Requirement is a capability a feature of the config needs.
+type Requirement struct {
+	// Feature names the config that requests the capability, e.g. "network.enforcement.hook: lsm".
+	Feature    string
+	Capability string
+	// Degraded is how bouheki runs without the capability. Empty fails the startup.
+	Degraded string
+	// Fallback is the capability whose absence falls back to this one. The requirement only holds without it.
+	Fallback string
+}
+
+// Requirements returns the capabilities the enabled features of conf need.
+func Requirements(conf *config.Config) []Requirement {
+	requirements := []Requirement{}
+	add := func(feature, capability, degraded string) {
+		requirements = append(requirements, Requirement{Feature: feature, Capability: capability, Degraded: degraded})
+	}
+	addFallback := func(feature, capability, fallback string) {
+		requirements = append(requirements, Requirement{Feature: feature, Capability: capability, Fallback: fallback})
+	}
+
+	network := conf.RestrictedNetworkConfig
+	if network.Enable {
+		add("network", CAP_BTF, "")
+		add("network", CAP_RINGBUF, "")
+
+		hook := "network.enforcement.hook: " + network.Enforcement.Hook
+		switch network.Enforcement.Hook {
+		case config.HOOK_LSM:
+			add(hook, CAP_BPF_LSM, "")
+		case config.HOOK_KPROBE:
+			add(hook, CAP_KPROBE, "")
+		default:
+			add(hook, CAP_BPF_LSM, "the kprobe fallback only reports blocked connections, unless network.enforcement.send_signal is set")
+			addFallback(hook, CAP_KPROBE, CAP_BPF_LSM)
+		}
+		// The kprobe programs call the helper whether or not the signal is sent.
+		if network.Enforcement.Hook != config.HOOK_LSM {
+			add(hook, CAP_SEND_SIGNAL, "")
+		}
+
+		if conf.ClassifiesContainers("network") && network.Classification.UsesCgroups() {
+			strategy := "network.classification.strategy: " + network.Classification.Strategy
+			add(strategy, CAP_CGROUP_V2, "")
+
+			matching := "network.classification.cgroup_matching: " + network.Classification.CgroupMatching
+			switch network.Classification.CgroupMatching {
+			case config.CGROUP_MATCHING_ANCESTORS:
+				add(matching, CAP_ANCESTOR_CGROUP_ID, "")
+			case config.CGROUP_MATCHING_AUTO:
+				add(matching, CAP_ANCESTOR_CGROUP_ID, "the cgroups created below the classified ones are watched, and written as they are created")
+			}
+		}
+	}
+
+	if conf.RestrictedFileAccessConfig.Enable {
+		add("files", CAP_BTF, "")
+		add("files", CAP_BPF_LSM, "")
+	}
+	if conf.RestrictedMountConfig.Enable {
+		add("mount", CAP_BTF, "")
+		add("mount", CAP_BPF_LSM, "")
+	}
+
+	return requirements
+}
+
+// Finding is a requirement whose capability is missing.
+type Finding struct {
+	Feature    string `json:"feature"`
+	Capability string `json:"capability"`
+	Error      string `json:"error"`
+	Degraded   string `json:"degraded,omitempty"`
+}
+
+// Report is what Resolve found missing.
+type Report struct {
+	// Missing are the findings that fail the startup.
+	Missing []Finding `json:"missing"`
+	// Degraded are the features that run in their degraded mode.
+	Degraded []Finding `json:"degraded"`
+}
+
+// Result is a requirement and the error of the probe of its capability, nil when the kernel has it.
+type Result struct {
+	Requirement
+	Err error
+}
+
+// Check probes the capabilities of the requirements of conf. Every capability is probed once.
+func Check(conf *config.Config, probes Probes) []Result {
+	results := []Result{}
+	probed := map[string]error{}
+
+	probe := func(capability string) error {
+		err, ok := probed[capability]
+		if !ok {
+			if p, known := probes[capability]; known {
+				err = p()
+			} else {
+				err = fmt.Errorf("no probe for %s", capability)
+			}
+			probed[capability] = err
+		}
+		return err
+	}
+
+	for _, requirement := range Requirements(conf) {
+		if requirement.Fallback != "" && probe(requirement.Fallback) == nil {
+			continue
+		}
+		results = append(results, Result{Requirement: requirement, Err: probe(requirement.Capability)})
+	}
+
+	return results
+}
+
+// Resolve returns the Report of the requirements of conf the kernel does not meet.
+func Resolve(conf *config.Config, probes Probes) *Report {
+	report := &Report{Missing: []Finding{}, Degraded: []Finding{}}
+	for _, result := range Check(conf, probes) {
+		if result.Err == nil {
+			continue
+		}
+
+		finding := Finding{Feature: result.Feature, Capability: result.Capability, Error: result.Err.Error(), Degraded: result.Degraded}
+		if result.Degraded == "" {
+			report.Missing = append(report.Missing, finding)
+		} else {
+			report.Degraded = append(report.Degraded, finding)
+		}
+	}
+
+	return report
+}
+
+// Err returns a preflight error with the table of the missing capabilities, or nil if none is missing.
+func (r *Report) Err() error {
+	if len(r.Missing) == 0 {
+		return nil
+	}
+
+	var b strings.Builder
+	fmt.Fprintln(&b, "the kernel lacks capabilities the config requests:")
+	Print(&b, r.Missing)
+	return errkind.New(errkind.Preflight, fmt.Errorf("%s", strings.TrimRight(b.String(), "\n")))
+}
+
+// Print writes the table of "requested feature -> missing kernel capability" of findings.
+func Print(w io.Writer, findings []Finding) {
+	for _, f := range findings {
+		fmt.Fprintf(w, "  %-48s -> %s (%s)\n", f.Feature, f.Capability, f.Error)
+		if f.Degraded != "" {
+			fmt.Fprintf(w, "  %-48s    degraded: %s\n", "", f.Degraded)
+		}
+	}
+}
+
+// Warn logs the features that run in their degraded mode.
+func (r *Report) Warn() {
+	for _, f := range r.Degraded {
+		log.Warn(fmt.Sprintf("%s: the kernel lacks %s (%s), %s.", f.Feature, f.Capability, f.Error, f.Degraded))
+	}
+}
+
+// ServeHTTP writes the Report as JSON.
+func (r *Report) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(r)
+}
@@ -0,0 +1,150 @@
+package features
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/errkind"
+	"github.com/stretchr/testify/assert"
+)
+
+// kernel returns probes of a kernel that lacks the missing capabilities, and counts the probes of each.
+func kernel(probed map[string]int, missing ...string) Probes {
+	probes := Probes{}
+	for _, capability := range []string{CAP_BTF, CAP_RINGBUF, CAP_BPF_LSM, CAP_KPROBE, CAP_SEND_SIGNAL, CAP_ANCESTOR_CGROUP_ID, CAP_CGROUP_V2} {
+		capability := capability
+		probes[capability] = func() error {
+			probed[capability]++
+			for _, m := range missing {
+				if m == capability {
+					return fmt.Errorf("no %s", capability)
+				}
+			}
+			return nil
+		}
+	}
+	return probes
+}
+
+// configOf returns the default config with only the given features enabled.
+func configOf(network, files, mount bool) *config.Config {
+	conf := config.DefaultConfig()
+	conf.RestrictedNetworkConfig.Enable = network
+	conf.RestrictedFileAccessConfig.Enable = files
+	conf.RestrictedMountConfig.Enable = mount
+	return conf
+}
+
+func networkConfig(hook string) *config.Config {
+	conf := configOf(true, false, false)
+	conf.RestrictedNetworkConfig.Enforcement.Hook = hook
+	return conf
+}
+
+func capabilities(requirements []Requirement) []string {
+	names := []string{}
+	for _, r := range requirements {
+		names = append(names, r.Capability)
+	}
+	return names
+}
+
+func TestRequirements(t *testing.T) {
+	assert.Equal(t, []string{CAP_BTF, CAP_RINGBUF, CAP_BPF_LSM}, capabilities(Requirements(networkConfig(config.HOOK_LSM))))
+	assert.Equal(t, []string{CAP_BTF, CAP_RINGBUF, CAP_KPROBE, CAP_SEND_SIGNAL}, capabilities(Requirements(networkConfig(config.HOOK_KPROBE))))
+	assert.Equal(t, []string{CAP_BTF, CAP_RINGBUF, CAP_BPF_LSM, CAP_KPROBE, CAP_SEND_SIGNAL}, capabilities(Requirements(networkConfig(config.HOOK_AUTO))))
+
+	conf := networkConfig(config.HOOK_LSM)
+	conf.RestrictedNetworkConfig.Target = "container"
+	// The namespaces are classified without cgroups.
+	assert.Equal(t, []string{CAP_BTF, CAP_RINGBUF, CAP_BPF_LSM}, capabilities(Requirements(conf)))
+
+	conf.RestrictedNetworkConfig.Classification.Strategy = config.CLASSIFY_CGROUP_PATTERN
+	assert.Equal(t, []string{CAP_BTF, CAP_RINGBUF, CAP_BPF_LSM, CAP_CGROUP_V2, CAP_ANCESTOR_CGROUP_ID}, capabilities(Requirements(conf)))
+	conf.RestrictedNetworkConfig.Classification.CgroupMatching = config.CGROUP_MATCHING_WATCH
+	assert.Equal(t, []string{CAP_BTF, CAP_RINGBUF, CAP_BPF_LSM, CAP_CGROUP_V2}, capabilities(Requirements(conf)))
+
+	conf = configOf(false, true, true)
+	requirements := Requirements(conf)
+	assert.Equal(t, []string{CAP_BTF, CAP_BPF_LSM, CAP_BTF, CAP_BPF_LSM}, capabilities(requirements))
+	assert.Equal(t, "files", requirements[0].Feature)
+	assert.Equal(t, "mount", requirements[2].Feature)
+
+	assert.Empty(t, Requirements(configOf(false, false, false)))
+}
+
+func TestResolveFailsFast(t *testing.T) {
+	probed := map[string]int{}
+	report := Resolve(networkConfig(config.HOOK_LSM), kernel(probed, CAP_BPF_LSM, CAP_RINGBUF))
+
+	assert.Empty(t, report.Degraded)
+	err := report.Err()
+	assert.Equal(t, errkind.Preflight, errkind.KindOf(err))
+	assert.Equal(t, `the kernel lacks capabilities the config requests:
+  network                                          -> BPF ring buffer (no BPF ring buffer)
+  network.enforcement.hook: lsm                    -> BPF LSM (no BPF LSM)`, err.Error())
+}
+
+func TestResolveDegrades(t *testing.T) {
+	probed := map[string]int{}
+	report := Resolve(networkConfig(config.HOOK_AUTO), kernel(probed, CAP_BPF_LSM))
+
+	assert.Nil(t, report.Err())
+	assert.Equal(t, []Finding{{
+		Feature:    "network.enforcement.hook: auto",
+		Capability: CAP_BPF_LSM,
+		Error:      "no BPF LSM",
+		Degraded:   "the kprobe fallback only reports blocked connections, unless network.enforcement.send_signal is set",
+	}}, report.Degraded)
+
+	// Without the fallback either, the hook has nothing to attach to.
+	report = Resolve(networkConfig(config.HOOK_AUTO), kernel(probed, CAP_BPF_LSM, CAP_KPROBE))
+	assert.NotNil(t, report.Err())
+	assert.Contains(t, report.Err().Error(), "network.enforcement.hook: auto                   -> kprobes (no kprobes)")
+}
+
+func TestCheckProbesEveryCapabilityOnce(t *testing.T) {
+	conf := networkConfig(config.HOOK_AUTO)
+	conf.RestrictedFileAccessConfig.Enable = true
+	conf.RestrictedMountConfig.Enable = true
+
+	probed := map[string]int{}
+	results := Check(conf, kernel(probed))
+	for _, result := range results {
+		assert.Nil(t, result.Err)
+	}
+	// The kprobe fallback is not checked while the kernel has BPF LSM.
+	assert.Equal(t, []string{CAP_BTF, CAP_RINGBUF, CAP_BPF_LSM, CAP_SEND_SIGNAL, CAP_BTF, CAP_BPF_LSM, CAP_BTF, CAP_BPF_LSM}, capabilities(requirementsOf(results)))
+	assert.Equal(t, map[string]int{CAP_BTF: 1, CAP_RINGBUF: 1, CAP_BPF_LSM: 1, CAP_SEND_SIGNAL: 1}, probed)
+}
+
+func requirementsOf(results []Result) []Requirement {
+	requirements := []Requirement{}
+	for _, r := range results {
+		requirements = append(requirements, r.Requirement)
+	}
+	return requirements
+}
+
+func TestCheckWithoutProbe(t *testing.T) {
+	results := Check(networkConfig(config.HOOK_LSM), Probes{CAP_BTF: func() error { return nil }, CAP_RINGBUF: func() error { return errors.New("5.8.0 is required") }})
+	assert.Nil(t, results[0].Err)
+	assert.Equal(t, "5.8.0 is required", results[1].Err.Error())
+	assert.Equal(t, "no probe for BPF LSM", results[2].Err.Error())
+}
+
+func TestServeReport(t *testing.T) {
+	report := Resolve(networkConfig(config.HOOK_AUTO), kernel(map[string]int{}, CAP_BPF_LSM))
+
+	rec := httptest.NewRecorder()
+	report.ServeHTTP(rec, httptest.NewRequest("GET", STATUS_PATH, nil))
+	assert.JSONEq(t, `{"missing":[],"degraded":[{"feature":"network.enforcement.hook: auto","capability":"BPF LSM","error":"no BPF LSM","degraded":"the kprobe fallback only reports blocked connections, unless network.enforcement.send_signal is set"}]}`, rec.Body.String())
+
+	var out bytes.Buffer
+	Print(&out, report.Degraded)
+	assert.Contains(t, out.String(), "    degraded: the kprobe fallback")
+}
@@ -0,0 +1,149 @@
+// Package freeze rejects policy changes during the freeze windows declared in admin.freeze_windows.
+//
+// Changes are either mutations, which change the intent of the policy (a reloaded config,
+// a rule added on the control socket, a temporary rule, a new version of a rule set), or
+// maintenance, which keeps the intent up to date (the refresh of the configured domains).
+// Mutations are always frozen; maintenance is only frozen with admin.freeze_dns_refresh.
+package freeze
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/jobs"
+	log "github.com/mrtc0/bouheki/pkg/log"
+)
+
+const (
+	CHANGE_CONFIG_RELOAD  = "config-reload"
+	CHANGE_CONTROL        = "control"
+	CHANGE_TEMPORARY_RULE = "temporary-rule"
+	// CHANGE_RULE_SET_REFRESH is a new version of a bulk rule set, e.g. a GeoIP database update.
+	CHANGE_RULE_SET_REFRESH = "rule-set-refresh"
+	// CHANGE_DNS_REFRESH is maintenance: the refresh of the addresses of the configured domains.
+	CHANGE_DNS_REFRESH = "dns-refresh"
+
+	RESULT_REJECTED   = "rejected"
+	RESULT_OVERRIDDEN = "overridden"
+)
+
+type Window struct {
+	Name  string
+	Start time.Time
+	End   time.Time
+}
+
+// contains reports whether t is in [Start, End).
+func (w Window) contains(t time.Time) bool {
+	return !t.Before(w.Start) && t.Before(w.End)
+}
+
+// FrozenError is returned for a change rejected during Window.
+// It wraps jobs.ErrRejected, so a rejected job is not reported as failed.
+type FrozenError struct {
+	Change string
+	Window Window
+}
+
+func (e *FrozenError) Error() string {
+	return fmt.Sprintf("%s rejected: policy changes are frozen by the freeze window %q until %s",
+		e.Change, e.Window.Name, e.Window.End.Format(time.RFC3339))
+}
+
+func (e *FrozenError) Unwrap() error {
+	return jobs.ErrRejected
+}
+
+type Guard struct {
+	windows          []Window
+	overrideToken    string
+	freezeDNSRefresh bool
+	now              func() time.Time
+}
+
+func New(conf config.AdminConfig) (*Guard, error) {
+	return NewWithClock(conf, time.Now)
+}
+
+// NewWithClock returns a Guard that evaluates the windows at the time returned by now.
+func NewWithClock(conf config.AdminConfig, now func() time.Time) (*Guard, error) {
+	g := &Guard{
+		overrideToken:    conf.FreezeOverrideToken,
+		freezeDNSRefresh: conf.FreezeDNSRefresh,
+		now:              now,
+	}
+
+	for _, w := range conf.FreezeWindows {
+		start, end, err := w.Range()
+		if err != nil {
+			return nil, fmt.Errorf("freeze window %s: %w", w.Name, err)
+		}
+		g.windows = append(g.windows, Window{Name: w.Name, Start: start, End: end})
+	}
+
+	return g, nil
+}
+
+// Active returns the freeze window in effect. When windows overlap, the one ending last is returned.
+func (g *Guard) Active() (Window, bool) {
+	if g == nil {
+		return Window{}, false
+	}
+
+	now := g.now()
+	active, ok := Window{}, false
+	for _, w := range g.windows {
+		if w.contains(now) && (!ok || w.End.After(active.End)) {
+			active, ok = w, true
+		}
+	}
+	return active, ok
+}
+
+// Check returns a *FrozenError if change must not be applied now. description names the
+// change in the admin-audit log. A matching overrideToken lets the change through; the
+// override is logged too. A nil Guard allows every change.
+func (g *Guard) Check(change, description, overrideToken string) error {
+	if g == nil {
+		return nil
+	}
+	if change == CHANGE_DNS_REFRESH && !g.freezeDNSRefresh {
+		return nil
+	}
+
+	window, ok := g.Active()
+	if !ok {
+		return nil
+	}
+
+	auditLog := log.AdminAuditLog{
+		Change:      change,
+		Description: description,
+		Window:      window.Name,
+		WindowEnd:   window.End,
+		Result:      RESULT_REJECTED,
+	}
+
+	if g.overridden(overrideToken) {
+		auditLog.Result = RESULT_OVERRIDDEN
+		auditLog.Warn()
+		return nil
+	}
+
+	// The refresh of every domain is attempted every few seconds, so it is not audited.
+	if change == CHANGE_DNS_REFRESH {
+		log.Debug(fmt.Sprintf("%s rejected during the freeze window %s", description, window.Name))
+	} else {
+		auditLog.Warn()
+	}
+	return &FrozenError{Change: change, Window: window}
+}
+
+func (g *Guard) overridden(token string) bool {
+	if g.overrideToken == "" || token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(g.overrideToken), []byte(token)) == 1
+}
@@ -0,0 +1,126 @@
+package freeze
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/jobs"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestGuard(t *testing.T, conf config.AdminConfig) (*Guard, *time.Time) {
+	now := time.Date(2026, 12, 19, 12, 0, 0, 0, time.UTC)
+	g, err := NewWithClock(conf, func() time.Time { return now })
+	assert.Nil(t, err)
+	return g, &now
+}
+
+func yearEnd() config.AdminConfig {
+	return config.AdminConfig{
+		FreezeWindows: []config.FreezeWindow{
+			{Name: "year-end", Start: "2026-12-20T00:00", End: "2027-01-04T09:00", Timezone: "Asia/Tokyo"},
+		},
+		FreezeOverrideToken: "break-glass",
+	}
+}
+
+func TestActive(t *testing.T) {
+	g, now := newTestGuard(t, yearEnd())
+	tokyo, _ := time.LoadLocation("Asia/Tokyo")
+
+	_, ok := g.Active()
+	assert.False(t, ok)
+
+	// The window starts at midnight in Tokyo, which is 15:00 UTC the day before.
+	*now = time.Date(2026, 12, 19, 14, 59, 59, 0, time.UTC)
+	_, ok = g.Active()
+	assert.False(t, ok)
+
+	*now = time.Date(2026, 12, 19, 15, 0, 0, 0, time.UTC)
+	window, ok := g.Active()
+	assert.True(t, ok)
+	assert.Equal(t, "year-end", window.Name)
+	assert.True(t, window.End.Equal(time.Date(2027, 1, 4, 9, 0, 0, 0, tokyo)))
+
+	// The end is excluded.
+	*now = time.Date(2027, 1, 4, 9, 0, 0, 0, tokyo)
+	_, ok = g.Active()
+	assert.False(t, ok)
+}
+
+func TestActiveOverlapping(t *testing.T) {
+	conf := yearEnd()
+	conf.FreezeWindows = append(conf.FreezeWindows, config.FreezeWindow{Name: "release", Start: "2026-12-19T00:00", End: "2026-12-21T00:00"})
+	g, now := newTestGuard(t, conf)
+
+	window, ok := g.Active()
+	assert.True(t, ok)
+	assert.Equal(t, "release", window.Name)
+
+	*now = time.Date(2026, 12, 20, 12, 0, 0, 0, time.UTC)
+	window, ok = g.Active()
+	assert.True(t, ok)
+	assert.Equal(t, "year-end", window.Name)
+}
+
+func TestCheck(t *testing.T) {
+	g, now := newTestGuard(t, yearEnd())
+
+	assert.Nil(t, g.Check(CHANGE_CONFIG_RELOAD, "SIGHUP", ""))
+
+	*now = time.Date(2026, 12, 25, 0, 0, 0, 0, time.UTC)
+	for _, change := range []string{CHANGE_CONFIG_RELOAD, CHANGE_CONTROL, CHANGE_TEMPORARY_RULE} {
+		err := g.Check(change, "test", "")
+		var frozen *FrozenError
+		assert.True(t, errors.As(err, &frozen))
+		assert.Equal(t, change, frozen.Change)
+		assert.Equal(t, "year-end", frozen.Window.Name)
+		assert.Contains(t, err.Error(), `"year-end"`)
+		assert.Contains(t, err.Error(), "2027-01-04T09:00:00+09:00")
+		assert.True(t, errors.Is(err, jobs.ErrRejected))
+	}
+}
+
+func TestCheckOverride(t *testing.T) {
+	g, now := newTestGuard(t, yearEnd())
+	*now = time.Date(2026, 12, 25, 0, 0, 0, 0, time.UTC)
+
+	assert.Nil(t, g.Check(CHANGE_CONTROL, "test", "break-glass"))
+	assert.NotNil(t, g.Check(CHANGE_CONTROL, "test", "break-glas"))
+	assert.NotNil(t, g.Check(CHANGE_CONTROL, "test", ""))
+
+	// Without a configured token, nothing overrides the freeze.
+	conf := yearEnd()
+	conf.FreezeOverrideToken = ""
+	g, now = newTestGuard(t, conf)
+	*now = time.Date(2026, 12, 25, 0, 0, 0, 0, time.UTC)
+	assert.NotNil(t, g.Check(CHANGE_CONTROL, "test", ""))
+}
+
+func TestCheckDNSRefresh(t *testing.T) {
+	g, now := newTestGuard(t, yearEnd())
+	*now = time.Date(2026, 12, 25, 0, 0, 0, 0, time.UTC)
+	assert.Nil(t, g.Check(CHANGE_DNS_REFRESH, "dns-refresh example.com", ""))
+
+	conf := yearEnd()
+	conf.FreezeDNSRefresh = true
+	g, now = newTestGuard(t, conf)
+	assert.Nil(t, g.Check(CHANGE_DNS_REFRESH, "dns-refresh example.com", ""))
+	*now = time.Date(2026, 12, 25, 0, 0, 0, 0, time.UTC)
+	assert.NotNil(t, g.Check(CHANGE_DNS_REFRESH, "dns-refresh example.com", ""))
+}
+
+func TestNilGuard(t *testing.T) {
+	var g *Guard
+	assert.Nil(t, g.Check(CHANGE_CONFIG_RELOAD, "SIGHUP", ""))
+	_, ok := g.Active()
+	assert.False(t, ok)
+}
+
+func TestNewRejectsInvalidWindows(t *testing.T) {
+	_, err := New(config.AdminConfig{FreezeWindows: []config.FreezeWindow{{Name: "broken", Start: "2026-12-20T00:00", End: "2026-12-19T00:00"}}})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "broken")
+}
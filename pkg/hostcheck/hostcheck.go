@@ -0,0 +1,319 @@
+// Package hostcheck cross-checks the commands of the config against the binaries installed on the
+// host, or in the containers when the network restriction targets them.
+//
+// The kernel matches a command with the comm of the task: the first TASK_COMM_LEN-1 bytes of the
+// name the binary was executed by. A command that is not the name of an installed binary, e.g.
+// "python" where only python3.11 is, never matches, and a binary whose name is longer than the
+// comm is matched by its truncated name, along with every other one that begins the same. The
+// check is advisory: its findings are logged as warnings and served on STATUS_PATH, since the
+// binaries may well be installed after bouheki starts.
+package hostcheck
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+	log "github.com/mrtc0/bouheki/pkg/log"
+)
+
+const (
+	// STATUS_PATH is where the Report is served next to /metrics.
+	STATUS_PATH = "/host-check"
+
+	// WARNING_NOT_FOUND is a command that no binary is named after, or a path that does not exist.
+	WARNING_NOT_FOUND = "not found"
+	// WARNING_TRUNCATED is a binary whose name is longer than the comm the kernel matches.
+	WARNING_TRUNCATED = "truncated"
+	// WARNING_NOT_EXECUTABLE is a path that is not an executable file.
+	WARNING_NOT_EXECUTABLE = "not executable"
+
+	// MAX_CANDIDATES is the number of binaries a command that is not found is compared with.
+	MAX_CANDIDATES = 5
+	// MAX_SYMLINKS is the number of symbolic links resolve follows, as the kernel does.
+	MAX_SYMLINKS = 40
+)
+
+// Warning is a command of the config that may not match what it is meant to.
+type Warning struct {
+	List    string `json:"list"`
+	Command string `json:"command"`
+	Kind    string `json:"kind"`
+	// Root is the Name of the root the binary is in, empty for a command found in none.
+	Root string `json:"root,omitempty"`
+	// Binary is the path of the binary in Root.
+	Binary string `json:"binary,omitempty"`
+	// Candidates are the binaries whose name begins with a command that is not found, e.g.
+	// python3 and python3.11 for python.
+	Candidates []string `json:"candidates,omitempty"`
+}
+
+func (w Warning) String() string {
+	switch w.Kind {
+	case WARNING_TRUNCATED:
+		return fmt.Sprintf("%s: %q matches %s in %s, whose name the kernel truncates to %d bytes: any command beginning with %q matches too",
+			w.List, w.Command, w.Binary, w.Root, config.TASK_COMM_LEN-1, comm(path.Base(w.Binary)))
+	case WARNING_NOT_EXECUTABLE:
+		return fmt.Sprintf("%s: %s in %s is not an executable file", w.List, w.Command, w.Root)
+	}
+
+	if isPath(w.Command) {
+		return fmt.Sprintf("%s: %s does not exist", w.List, w.Command)
+	}
+	if config.IsCommandPattern(w.Command) {
+		return fmt.Sprintf("%s: %q matches no binary in the PATH", w.List, w.Command)
+	}
+	message := fmt.Sprintf("%s: %q is not the name of any binary in the PATH", w.List, w.Command)
+	if len(w.Candidates) > 0 {
+		message += fmt.Sprintf(", the comm of the task may be one of %s", strings.Join(w.Candidates, ", "))
+	}
+	return message
+}
+
+// Report is what Check found.
+type Report struct {
+	// Roots are the Names of the roots the commands were looked up in.
+	Roots    []string  `json:"roots"`
+	Warnings []Warning `json:"warnings"`
+}
+
+// Check looks the commands of network.command up in roots, in their PATH and in the extra_dirs of
+// network.command.host_check. A command is found when it is in any of the roots.
+func Check(conf *config.Config, roots []Root) *Report {
+	report := &Report{Roots: []string{}, Warnings: []Warning{}}
+	commands := conf.RestrictedNetworkConfig.Command
+	binaries := make([]map[string]string, len(roots))
+	for i, root := range roots {
+		report.Roots = append(report.Roots, root.Name)
+		binaries[i] = root.binaries(append(append([]string{}, root.Path...), commands.HostCheck.ExtraDirs...), commands.CaseInsensitive)
+	}
+
+	for _, list := range []struct {
+		name     string
+		commands []string
+	}{
+		{"network.command.allow", commands.Allow},
+		{"network.command.deny", commands.Deny},
+	} {
+		for _, command := range list.commands {
+			switch {
+			case isPath(command):
+				report.Warnings = append(report.Warnings, checkPath(list.name, command, roots)...)
+			case config.IsCommandPattern(command):
+				report.Warnings = append(report.Warnings, checkPattern(list.name, command, binaries, commands.CaseInsensitive)...)
+			default:
+				report.Warnings = append(report.Warnings, checkName(list.name, command, roots, binaries, commands.CaseInsensitive)...)
+			}
+		}
+	}
+	return report
+}
+
+// checkName looks command up by the comm of the binaries of every root.
+func checkName(list, command string, roots []Root, binaries []map[string]string, caseInsensitive bool) []Warning {
+	if caseInsensitive {
+		command = strings.ToLower(command)
+	}
+
+	warnings := []Warning{}
+	found := false
+	candidates := map[string]bool{}
+	for i, root := range roots {
+		for _, name := range sortedNames(binaries[i]) {
+			switch {
+			case comm(name) == comm(command):
+				found = true
+				if len(name) > len(comm(name)) {
+					warnings = append(warnings, Warning{List: list, Command: command, Kind: WARNING_TRUNCATED, Root: root.Name, Binary: binaries[i][name]})
+				}
+			case strings.HasPrefix(name, command):
+				candidates[name] = true
+			}
+		}
+	}
+	if found {
+		return warnings
+	}
+
+	warning := Warning{List: list, Command: command, Kind: WARNING_NOT_FOUND}
+	for name := range candidates {
+		warning.Candidates = append(warning.Candidates, name)
+	}
+	sort.Strings(warning.Candidates)
+	if len(warning.Candidates) > MAX_CANDIDATES {
+		warning.Candidates = warning.Candidates[:MAX_CANDIDATES]
+	}
+	return []Warning{warning}
+}
+
+// checkPattern looks for a binary of any root whose comm matches command, a pattern.
+func checkPattern(list, command string, binaries []map[string]string, caseInsensitive bool) []Warning {
+	if caseInsensitive {
+		command = strings.ToLower(command)
+	}
+	pattern, err := config.ParseCommandPattern(command)
+	if err != nil {
+		// Rejected by the validation of the config.
+		return []Warning{}
+	}
+	for _, names := range binaries {
+		for name := range names {
+			if pattern.Match(comm(name)) {
+				return []Warning{}
+			}
+		}
+	}
+	return []Warning{{List: list, Command: command, Kind: WARNING_NOT_FOUND}}
+}
+
+// checkPath checks that command, a path, is an executable file in every root it exists in.
+func checkPath(list, command string, roots []Root) []Warning {
+	warnings := []Warning{}
+	found := false
+	for _, root := range roots {
+		resolved, err := resolve(root.Dir, command)
+		if err != nil {
+			continue
+		}
+		info, err := os.Stat(resolved)
+		if err != nil {
+			continue
+		}
+		found = true
+		if !info.Mode().IsRegular() || info.Mode().Perm()&0111 == 0 {
+			warnings = append(warnings, Warning{List: list, Command: command, Kind: WARNING_NOT_EXECUTABLE, Root: root.Name, Binary: command})
+		}
+	}
+	if !found {
+		return []Warning{{List: list, Command: command, Kind: WARNING_NOT_FOUND}}
+	}
+	return warnings
+}
+
+// binaries returns the paths of the files of dirs in the root by their name. A name in several
+// dirs is the first one, as the PATH is looked up.
+func (r Root) binaries(dirs []string, caseInsensitive bool) map[string]string {
+	binaries := map[string]string{}
+	for _, dir := range dirs {
+		resolved, err := resolve(r.Dir, dir)
+		if err != nil {
+			continue
+		}
+		entries, err := ioutil.ReadDir(resolved)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+			name := entry.Name()
+			if caseInsensitive {
+				name = strings.ToLower(name)
+			}
+			if _, ok := binaries[name]; !ok {
+				binaries[name] = path.Join(dir, entry.Name())
+			}
+		}
+	}
+	return binaries
+}
+
+// resolve returns where p, a path of the root at dir, is seen from bouheki. The symbolic links
+// of every component are followed inside the root: an absolute link, e.g. /bin -> /usr/bin in a
+// container, resolves from dir and not from the root of bouheki.
+func resolve(dir, p string) (string, error) {
+	resolved := "/"
+	rest := strings.Split(p, "/")
+	links := 0
+	for len(rest) > 0 {
+		component := rest[0]
+		rest = rest[1:]
+		switch component {
+		case "", ".":
+			continue
+		case "..":
+			resolved = path.Dir(resolved)
+			continue
+		}
+
+		next := path.Join(resolved, component)
+		info, err := os.Lstat(filepath.Join(dir, next))
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		links++
+		if links > MAX_SYMLINKS {
+			return "", fmt.Errorf("%s: too many levels of symbolic links", p)
+		}
+		target, err := os.Readlink(filepath.Join(dir, next))
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(target) {
+			resolved = "/"
+		}
+		rest = append(strings.Split(target, "/"), rest...)
+	}
+	return filepath.Join(dir, resolved), nil
+}
+
+// comm is the comm of a task executed as name.
+func comm(name string) string {
+	if len(name) > config.TASK_COMM_LEN-1 {
+		return name[:config.TASK_COMM_LEN-1]
+	}
+	return name
+}
+
+// isPath reports whether command is a full path rather than a comm.
+func isPath(command string) bool {
+	return strings.HasPrefix(command, "/")
+}
+
+func sortedNames(binaries map[string]string) []string {
+	names := []string{}
+	for name := range binaries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Print writes the warnings of the report, one per line.
+func (r *Report) Print(w io.Writer) {
+	fmt.Fprintf(w, "host check (%s):\n", strings.Join(r.Roots, ", "))
+	if len(r.Warnings) == 0 {
+		fmt.Fprintln(w, "  every command is installed")
+		return
+	}
+	for _, warning := range r.Warnings {
+		fmt.Fprintf(w, "  %s\n", warning)
+	}
+}
+
+// Warn logs the warnings of the report.
+func (r *Report) Warn() {
+	for _, warning := range r.Warnings {
+		log.Warn(warning.String())
+	}
+}
+
+// ServeHTTP writes the Report as JSON.
+func (r *Report) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(r)
+}
@@ -0,0 +1,137 @@
+package hostcheck
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// fixtureTree creates the files of tree under a temporary directory: an entry ending with "/"
+// is a directory, "-> target" a symbolic link, "x" an executable file and "-" any other file.
+func fixtureTree(t *testing.T, tree map[string]string) string {
+	dir := t.TempDir()
+	for name, kind := range tree {
+		p := filepath.Join(dir, name)
+		assert.Nil(t, os.MkdirAll(filepath.Dir(p), 0755))
+		switch {
+		case strings.HasSuffix(name, "/"):
+			assert.Nil(t, os.MkdirAll(p, 0755))
+		case strings.HasPrefix(kind, "-> "):
+			assert.Nil(t, os.Symlink(strings.TrimPrefix(kind, "-> "), p))
+		case kind == "x":
+			assert.Nil(t, os.WriteFile(p, nil, 0755))
+		default:
+			assert.Nil(t, os.WriteFile(p, nil, 0644))
+		}
+	}
+	return dir
+}
+
+// hostTree is a merged /usr whose /bin is an absolute link, which only resolves inside the root.
+var hostTree = map[string]string{
+	"bin":                             "-> /usr/bin",
+	"usr/bin/curl":                    "x",
+	"usr/bin/busybox":                 "x",
+	"usr/bin/wget":                    "-> busybox",
+	"usr/bin/python3.11":              "x",
+	"usr/bin/python3":                 "-> python3.11",
+	"usr/bin/kube-controller-manager": "x",
+	"opt/agent/bin/agent":             "x",
+	"opt/tool/run":                    "-",
+	"opt/tool/lib/":                   "",
+}
+
+func checkConfig(allow, deny []string) *config.Config {
+	conf := config.DefaultConfig()
+	conf.RestrictedNetworkConfig.Command.Allow = allow
+	conf.RestrictedNetworkConfig.Command.Deny = deny
+	return conf
+}
+
+func TestCheck(t *testing.T) {
+	root := Root{Name: HOST, Dir: fixtureTree(t, hostTree), Path: []string{"/bin"}}
+
+	conf := checkConfig([]string{"curl", "wget", "python", "kube-controller", "/opt/tool/run", "/opt/tool/lib", "/usr/bin/curl", "/opt/missing"}, []string{"agent"})
+	report := Check(conf, []Root{root})
+	assert.Equal(t, []string{HOST}, report.Roots)
+	assert.Equal(t, []Warning{
+		{List: "network.command.allow", Command: "python", Kind: WARNING_NOT_FOUND, Candidates: []string{"python3", "python3.11"}},
+		{List: "network.command.allow", Command: "kube-controller", Kind: WARNING_TRUNCATED, Root: HOST, Binary: "/bin/kube-controller-manager"},
+		{List: "network.command.allow", Command: "/opt/tool/run", Kind: WARNING_NOT_EXECUTABLE, Root: HOST, Binary: "/opt/tool/run"},
+		{List: "network.command.allow", Command: "/opt/tool/lib", Kind: WARNING_NOT_EXECUTABLE, Root: HOST, Binary: "/opt/tool/lib"},
+		{List: "network.command.allow", Command: "/opt/missing", Kind: WARNING_NOT_FOUND},
+		{List: "network.command.deny", Command: "agent", Kind: WARNING_NOT_FOUND},
+	}, report.Warnings)
+
+	assert.Equal(t, `network.command.allow: "python" is not the name of any binary in the PATH, the comm of the task may be one of python3, python3.11`, report.Warnings[0].String())
+	assert.Equal(t, `network.command.allow: "kube-controller" matches /bin/kube-controller-manager in host, whose name the kernel truncates to 15 bytes: any command beginning with "kube-controller" matches too`, report.Warnings[1].String())
+	assert.Equal(t, "network.command.allow: /opt/tool/run in host is not an executable file", report.Warnings[2].String())
+	assert.Equal(t, "network.command.allow: /opt/missing does not exist", report.Warnings[4].String())
+
+	// The extra dirs are looked up after the PATH.
+	conf.RestrictedNetworkConfig.Command.HostCheck.ExtraDirs = []string{"/opt/agent/bin"}
+	warnings := Check(conf, []Root{root}).Warnings
+	assert.Len(t, warnings, 5)
+	assert.Equal(t, "/opt/missing", warnings[4].Command)
+}
+
+func TestCheckIsCaseInsensitiveToo(t *testing.T) {
+	root := Root{Name: HOST, Dir: fixtureTree(t, map[string]string{"usr/bin/Xvfb": "x"}), Path: []string{"/usr/bin"}}
+
+	assert.Len(t, Check(checkConfig([]string{"xvfb"}, nil), []Root{root}).Warnings, 1)
+	conf := checkConfig([]string{"xvfb"}, nil)
+	conf.RestrictedNetworkConfig.Command.CaseInsensitive = true
+	assert.Empty(t, Check(conf, []Root{root}).Warnings)
+}
+
+func TestCheckMatchesThePatterns(t *testing.T) {
+	root := Root{Name: HOST, Dir: fixtureTree(t, hostTree), Path: []string{"/bin"}}
+
+	report := Check(checkConfig([]string{"python*", "*-manager", "kube-controller*"}, []string{"ruby*"}), []Root{root})
+	assert.Equal(t, []Warning{
+		{List: "network.command.allow", Command: "*-manager", Kind: WARNING_NOT_FOUND},
+		{List: "network.command.deny", Command: "ruby*", Kind: WARNING_NOT_FOUND},
+	}, report.Warnings)
+	// kube-controller-manager is matched by its comm, which does not end with -manager.
+	assert.Equal(t, `network.command.allow: "*-manager" matches no binary in the PATH`, report.Warnings[0].String())
+}
+
+func TestCheckFindsTheCommandsInAnyRoot(t *testing.T) {
+	web := Root{Name: "mnt:[4026532281]", Dir: fixtureTree(t, map[string]string{"usr/local/bin/nginx": "x"}), Path: []string{"/usr/local/bin"}}
+	batch := Root{Name: "mnt:[4026532282]", Dir: fixtureTree(t, hostTree), Path: []string{"/bin"}}
+
+	report := Check(checkConfig([]string{"nginx", "curl", "/usr/bin/curl", "kube-controller-manager"}, nil), []Root{web, batch})
+	assert.Equal(t, []string{"mnt:[4026532281]", "mnt:[4026532282]"}, report.Roots)
+	assert.Equal(t, []Warning{
+		{List: "network.command.allow", Command: "kube-controller-manager", Kind: WARNING_TRUNCATED, Root: "mnt:[4026532282]", Binary: "/bin/kube-controller-manager"},
+	}, report.Warnings)
+}
+
+func TestResolve(t *testing.T) {
+	dir := fixtureTree(t, map[string]string{
+		"bin":          "-> /usr/bin",
+		"usr/bin/curl": "x",
+		"usr/sbin":     "-> ../bin",
+		"loop":         "-> /loop",
+	})
+
+	for p, expected := range map[string]string{
+		"/bin/curl":          "/usr/bin/curl",
+		"/usr/sbin/curl":     "/usr/bin/curl",
+		"/usr/../bin/./curl": "/usr/bin/curl",
+	} {
+		resolved, err := resolve(dir, p)
+		assert.Nil(t, err, p)
+		assert.Equal(t, filepath.Join(dir, expected), resolved, p)
+	}
+
+	_, err := resolve(dir, "/loop")
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "too many levels of symbolic links")
+	_, err = resolve(dir, "/bin/wget")
+	assert.True(t, os.IsNotExist(err))
+}
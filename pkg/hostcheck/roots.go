@@ -0,0 +1,111 @@
+package hostcheck
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+)
+
+const (
+	// HOST is the Name of the root of the host.
+	HOST = "host"
+	// PROC is where the processes of the containers are found.
+	PROC = "/proc"
+	// DEFAULT_PATH is the PATH of a root whose processes have none.
+	DEFAULT_PATH = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+)
+
+// Root is a filesystem the commands are looked up in.
+type Root struct {
+	// Name is HOST, or the mount namespace of a container, e.g. "mnt:[4026532281]".
+	Name string
+	// Dir is where the root is seen from bouheki: "/" for the host, /proc/<pid>/root for a container.
+	Dir string
+	// Path are the directories of the PATH, as seen inside the root.
+	Path []string
+}
+
+// Roots returns the roots the commands of conf are meant for: with network.target: container,
+// the one of each mount namespace of the processes of proc other than the one of its pid 1, with
+// network.target: all, the host followed by them, and otherwise, or without any container
+// running, the host with hostPath.
+func Roots(conf *config.Config, proc, hostPath string) []Root {
+	host := Root{Name: HOST, Dir: "/", Path: splitPath(hostPath)}
+	if !conf.ClassifiesContainers("network") {
+		return []Root{host}
+	}
+	roots := containerRoots(proc)
+	if !conf.IsOnlyContainer("network") || len(roots) == 0 {
+		return append([]Root{host}, roots...)
+	}
+	return roots
+}
+
+// containerRoots returns a root for every mount namespace of the processes of proc but the one
+// of pid 1, with the root and the PATH of its lowest pid. The processes that can not be read,
+// e.g. that exited meanwhile, are skipped.
+func containerRoots(proc string) []Root {
+	hostNamespace, err := os.Readlink(filepath.Join(proc, "1", "ns", "mnt"))
+	if err != nil {
+		return nil
+	}
+	entries, err := ioutil.ReadDir(proc)
+	if err != nil {
+		return nil
+	}
+
+	pids := []int{}
+	for _, entry := range entries {
+		if pid, err := strconv.Atoi(entry.Name()); err == nil {
+			pids = append(pids, pid)
+		}
+	}
+	sort.Ints(pids)
+
+	roots := []Root{}
+	seen := map[string]bool{hostNamespace: true}
+	for _, pid := range pids {
+		dir := filepath.Join(proc, strconv.Itoa(pid))
+		namespace, err := os.Readlink(filepath.Join(dir, "ns", "mnt"))
+		if err != nil || seen[namespace] {
+			continue
+		}
+		seen[namespace] = true
+		roots = append(roots, Root{Name: namespace, Dir: filepath.Join(dir, "root"), Path: splitPath(environPath(filepath.Join(dir, "environ")))})
+	}
+	return roots
+}
+
+// environPath returns the PATH of the environ file of a process, or DEFAULT_PATH without one.
+func environPath(environ string) string {
+	data, err := ioutil.ReadFile(environ)
+	if err != nil {
+		return DEFAULT_PATH
+	}
+	for _, variable := range bytes.Split(data, []byte{0}) {
+		if value := strings.TrimPrefix(string(variable), "PATH="); value != string(variable) && value != "" {
+			return value
+		}
+	}
+	return DEFAULT_PATH
+}
+
+// splitPath returns the absolute directories of a PATH, or of DEFAULT_PATH when it is empty.
+func splitPath(p string) []string {
+	if p == "" {
+		p = DEFAULT_PATH
+	}
+	dirs := []string{}
+	for _, dir := range strings.Split(p, ":") {
+		if filepath.IsAbs(dir) {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
@@ -0,0 +1,55 @@
+package hostcheck
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoots(t *testing.T) {
+	container := fixtureTree(t, map[string]string{"bin/busybox": "x"})
+	proc := fixtureTree(t, map[string]string{
+		"1/ns/mnt":     "-> mnt:[4026531840]",
+		"self":         "-> 1",
+		"812/ns/mnt":   "-> mnt:[4026531840]",
+		"4242/ns/mnt":  "-> mnt:[4026532281]",
+		"4242/root":    "-> " + container,
+		"4242/environ": "",
+		"4243/ns/mnt":  "-> mnt:[4026532281]",
+		"5000/ns/mnt":  "-> mnt:[4026532282]",
+		"5000/root":    "-> " + container,
+		// A process without a mount namespace, e.g. one that exited.
+		"6000/": "",
+	})
+	assert.Nil(t, writeEnviron(filepath.Join(proc, "5000", "environ"), "HOME=/root", "PATH=/app/bin:relative:/bin"))
+
+	conf := checkConfig(nil, nil)
+	assert.Equal(t, []Root{{Name: HOST, Dir: "/", Path: []string{"/usr/bin", "/bin"}}}, Roots(conf, proc, "/usr/bin:/bin"))
+
+	conf.RestrictedNetworkConfig.Target = "container"
+	assert.Equal(t, []Root{
+		{Name: "mnt:[4026532281]", Dir: filepath.Join(proc, "4242", "root"), Path: splitPath(DEFAULT_PATH)},
+		{Name: "mnt:[4026532282]", Dir: filepath.Join(proc, "5000", "root"), Path: []string{"/app/bin", "/bin"}},
+	}, Roots(conf, proc, "/usr/bin:/bin"))
+
+	// The commands of the containers are looked up through /proc/<pid>/root.
+	report := Check(checkConfig([]string{"busybox"}, nil), Roots(conf, proc, ""))
+	assert.Empty(t, report.Warnings)
+
+	// With target: all, the host is checked along with the containers.
+	conf.RestrictedNetworkConfig.Target = "all"
+	roots := Roots(conf, proc, "/usr/bin:/bin")
+	assert.Len(t, roots, 3)
+	assert.Equal(t, HOST, roots[0].Name)
+
+	// Without a container, the host is checked.
+	hostOnly := fixtureTree(t, map[string]string{"1/ns/mnt": "-> mnt:[4026531840]"})
+	assert.Equal(t, []Root{{Name: HOST, Dir: "/", Path: splitPath(DEFAULT_PATH)}}, Roots(conf, hostOnly, ""))
+}
+
+func writeEnviron(path string, variables ...string) error {
+	return os.WriteFile(path, []byte(strings.Join(variables, "\x00")+"\x00"), 0644)
+}
@@ -0,0 +1,279 @@
+// Package jobs runs mutations of shared state as named jobs on a single worker.
+//
+// DNS refresh, preload expiry and the other dynamic features all write the same BPF maps and
+// in-memory caches. Submitting them to one Queue serializes them without a lock per cache.
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/metrics"
+)
+
+const (
+	DEFAULT_QUEUE_SIZE   = 256
+	DEFAULT_HISTORY_SIZE = 32
+
+	// STATUS_PATH is where the Status is served next to /metrics.
+	STATUS_PATH = "/jobs"
+
+	OUTCOME_OK        = "ok"
+	OUTCOME_FAILED    = "failed"
+	OUTCOME_CANCELLED = "cancelled"
+	OUTCOME_REJECTED  = "rejected"
+)
+
+var (
+	ErrQueueFull = errors.New("job queue is full")
+	ErrStopped   = errors.New("job queue is stopped")
+	// ErrRejected is wrapped by the errors of jobs that refused to run, e.g. during a change freeze.
+	ErrRejected = errors.New("job rejected")
+)
+
+// Func is the body of a job. Long-running jobs must return when ctx is cancelled on shutdown.
+type Func func(ctx context.Context) error
+
+// Info describes a queued, running or finished job.
+type Info struct {
+	Name        string        `json:"name"`
+	SubmittedAt time.Time     `json:"submitted_at"`
+	StartedAt   time.Time     `json:"started_at"`
+	Duration    time.Duration `json:"duration"`
+	Outcome     string        `json:"outcome,omitempty"`
+	Error       string        `json:"error,omitempty"`
+}
+
+// Status is a snapshot of the queue, as shown by `bouheki status --jobs`.
+type Status struct {
+	Depth    int    `json:"depth"`
+	Capacity int    `json:"capacity"`
+	Running  *Info  `json:"running,omitempty"`
+	History  []Info `json:"history"`
+}
+
+type Job struct {
+	info Info
+	fn   Func
+	done chan error
+	// unrecorded jobs are left out of the history and the metrics, see Snapshot.
+	unrecorded bool
+}
+
+// Wait blocks until the job has finished and returns its error.
+func (j *Job) Wait() error {
+	return <-j.done
+}
+
+type queueMetrics struct {
+	depth     *metrics.Gauge
+	completed *metrics.Counter
+	failed    *metrics.Counter
+}
+
+type Queue struct {
+	queue   chan *Job
+	ctx     context.Context
+	cancel  context.CancelFunc
+	stopped chan struct{}
+
+	mu          sync.Mutex
+	closing     bool
+	running     *Job
+	history     []Info
+	historySize int
+	metrics     queueMetrics
+}
+
+// New starts a worker for a queue of up to size jobs. name prefixes the metrics of the queue.
+func New(name string, size int) *Queue {
+	if size <= 0 {
+		size = DEFAULT_QUEUE_SIZE
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	q := &Queue{
+		queue:       make(chan *Job, size),
+		ctx:         ctx,
+		cancel:      cancel,
+		stopped:     make(chan struct{}),
+		historySize: DEFAULT_HISTORY_SIZE,
+		metrics: queueMetrics{
+			depth:     metrics.NewGauge(name+"_jobs_queue_depth", "Number of jobs waiting for the worker."),
+			completed: metrics.NewCounter(name+"_jobs_completed_total", "Number of finished jobs."),
+			failed:    metrics.NewCounter(name+"_jobs_failed_total", "Number of jobs that returned an error or were cancelled. Rejected jobs are not counted."),
+		},
+	}
+	go q.worker()
+
+	return q
+}
+
+// Submit queues the job without waiting for it. It fails with ErrQueueFull instead of blocking the caller.
+func (q *Queue) Submit(name string, fn Func) (*Job, error) {
+	return q.submit(name, fn, false)
+}
+
+func (q *Queue) submit(name string, fn Func, unrecorded bool) (*Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closing {
+		return nil, ErrStopped
+	}
+
+	j := &Job{
+		info:       Info{Name: name, SubmittedAt: time.Now()},
+		fn:         fn,
+		done:       make(chan error, 1),
+		unrecorded: unrecorded,
+	}
+	select {
+	case q.queue <- j:
+		q.metrics.depth.Set(float64(len(q.queue)))
+		return j, nil
+	default:
+		return nil, ErrQueueFull
+	}
+}
+
+// Do submits the job and waits for it.
+func (q *Queue) Do(name string, fn Func) error {
+	j, err := q.Submit(name, fn)
+	if err != nil {
+		return err
+	}
+	return j.Wait()
+}
+
+// Snapshot runs fn on the worker between two jobs, so that what fn reads is never half written
+// by a job. It is meant for reads: fn is left out of the history and the metrics, so that a
+// client polling the state does not push the jobs out of the history. Snapshot returns the
+// error of ctx if it is done before fn has run; fn still runs later.
+func (q *Queue) Snapshot(ctx context.Context, name string, fn Func) error {
+	j, err := q.submit(name, fn, true)
+	if err != nil {
+		return err
+	}
+	select {
+	case err := <-j.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Stop cancels the running job, fails the queued ones with ErrStopped and waits for the worker to exit.
+// It is safe to call Stop more than once.
+func (q *Queue) Stop() {
+	q.mu.Lock()
+	q.closing = true
+	q.mu.Unlock()
+
+	q.cancel()
+	<-q.stopped
+
+	for {
+		select {
+		case j := <-q.queue:
+			q.finish(j, ErrStopped)
+		default:
+			q.metrics.depth.Set(0)
+			return
+		}
+	}
+}
+
+func (q *Queue) Status() Status {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	status := Status{
+		Depth:    len(q.queue),
+		Capacity: cap(q.queue),
+		History:  append([]Info{}, q.history...),
+	}
+	if q.running != nil {
+		running := q.running.info
+		running.Duration = time.Since(running.StartedAt)
+		status.Running = &running
+	}
+	return status
+}
+
+// ServeHTTP writes the Status as JSON.
+func (q *Queue) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(q.Status())
+}
+
+func (q *Queue) worker() {
+	defer close(q.stopped)
+
+	for {
+		select {
+		case <-q.ctx.Done():
+			return
+		case j := <-q.queue:
+			if q.ctx.Err() != nil {
+				q.finish(j, ErrStopped)
+				return
+			}
+			q.run(j)
+		}
+	}
+}
+
+func (q *Queue) run(j *Job) {
+	q.mu.Lock()
+	j.info.StartedAt = time.Now()
+	q.running = j
+	q.metrics.depth.Set(float64(len(q.queue)))
+	q.mu.Unlock()
+
+	q.finish(j, j.fn(q.ctx))
+}
+
+func (q *Queue) finish(j *Job, err error) {
+	q.mu.Lock()
+	if !j.info.StartedAt.IsZero() {
+		j.info.Duration = time.Since(j.info.StartedAt)
+	}
+	switch {
+	case err == nil:
+		j.info.Outcome = OUTCOME_OK
+	case err == ErrStopped || errors.Is(err, context.Canceled):
+		j.info.Outcome = OUTCOME_CANCELLED
+		j.info.Error = err.Error()
+	case errors.Is(err, ErrRejected):
+		j.info.Outcome = OUTCOME_REJECTED
+		j.info.Error = err.Error()
+	default:
+		j.info.Outcome = OUTCOME_FAILED
+		j.info.Error = err.Error()
+	}
+
+	if q.running == j {
+		q.running = nil
+	}
+	if j.unrecorded {
+		q.mu.Unlock()
+		j.done <- err
+		return
+	}
+	q.history = append(q.history, j.info)
+	if len(q.history) > q.historySize {
+		q.history = q.history[len(q.history)-q.historySize:]
+	}
+	q.mu.Unlock()
+
+	q.metrics.completed.Inc()
+	if err != nil && !errors.Is(err, ErrRejected) {
+		q.metrics.failed.Inc()
+	}
+	j.done <- err
+}
@@ -0,0 +1,236 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// rules mimics a BPF map and its userspace mirror, which must always hold the same keys.
+type rules struct {
+	kernel map[string]int
+	mirror map[string]int
+}
+
+func (r *rules) set(key string, value int) {
+	r.kernel[key] = value
+	// widen the window between the two writes.
+	time.Sleep(time.Microsecond)
+	r.mirror[key] = value
+}
+
+func (r *rules) delete(key string) {
+	delete(r.kernel, key)
+	time.Sleep(time.Microsecond)
+	delete(r.mirror, key)
+}
+
+func TestQueueSerializesOverlappingJobs(t *testing.T) {
+	q := New("test", 1024)
+	defer q.Stop()
+
+	r := &rules{kernel: map[string]int{}, mirror: map[string]int{}}
+	var inFlight, maxInFlight int32
+
+	track := func(fn func()) Func {
+		return func(ctx context.Context) error {
+			n := atomic.AddInt32(&inFlight, 1)
+			defer atomic.AddInt32(&inFlight, -1)
+			for {
+				max := atomic.LoadInt32(&maxInFlight)
+				if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+					break
+				}
+			}
+			fn()
+			return nil
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(3)
+		go func(i int) {
+			defer wg.Done()
+			key := fmt.Sprintf("example-%d.com", i%5)
+			assert.NoError(t, q.Do("dns-refresh "+key, track(func() { r.set(key, i) })))
+		}(i)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, q.Do("reload", track(func() {
+				for key := range r.kernel {
+					r.delete(key)
+				}
+				for i := 0; i < 5; i++ {
+					r.set(fmt.Sprintf("example-%d.com", i), -1)
+				}
+			})))
+		}()
+		go func(i int) {
+			defer wg.Done()
+			key := fmt.Sprintf("manual-%d", i)
+			assert.NoError(t, q.Do("manual-rule "+key, track(func() { r.set(key, i) })))
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), maxInFlight)
+	assert.Equal(t, r.kernel, r.mirror)
+}
+
+func TestQueueReportsOutcome(t *testing.T) {
+	q := New("test", 8)
+	defer q.Stop()
+
+	assert.NoError(t, q.Do("ok", func(ctx context.Context) error { return nil }))
+	assert.Error(t, q.Do("failed", func(ctx context.Context) error { return errors.New("map update failed") }))
+
+	status := q.Status()
+	assert.Equal(t, 0, status.Depth)
+	assert.Equal(t, 8, status.Capacity)
+	assert.Nil(t, status.Running)
+	assert.Equal(t, 2, len(status.History))
+	assert.Equal(t, "ok", status.History[0].Name)
+	assert.Equal(t, OUTCOME_OK, status.History[0].Outcome)
+	assert.Equal(t, OUTCOME_FAILED, status.History[1].Outcome)
+	assert.Equal(t, "map update failed", status.History[1].Error)
+}
+
+func TestQueueStatusShowsRunningJob(t *testing.T) {
+	q := New("test", 8)
+	defer q.Stop()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	j, err := q.Submit("geoip-reload", func(ctx context.Context) error {
+		close(started)
+		<-release
+		return nil
+	})
+	assert.NoError(t, err)
+	<-started
+
+	_, err = q.Submit("dns-refresh example.com", func(ctx context.Context) error { return nil })
+	assert.NoError(t, err)
+
+	status := q.Status()
+	assert.Equal(t, 1, status.Depth)
+	if assert.NotNil(t, status.Running) {
+		assert.Equal(t, "geoip-reload", status.Running.Name)
+	}
+
+	close(release)
+	assert.NoError(t, j.Wait())
+}
+
+func TestQueueFull(t *testing.T) {
+	q := New("test", 1)
+	defer q.Stop()
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	_, err := q.Submit("running", func(ctx context.Context) error {
+		close(started)
+		<-release
+		return nil
+	})
+	assert.NoError(t, err)
+	<-started
+
+	_, err = q.Submit("queued", func(ctx context.Context) error { return nil })
+	assert.NoError(t, err)
+	_, err = q.Submit("rejected", func(ctx context.Context) error { return nil })
+	assert.Equal(t, ErrQueueFull, err)
+
+	close(release)
+}
+
+func TestQueueStopCancelsRunningJob(t *testing.T) {
+	q := New("test", 8)
+
+	started := make(chan struct{})
+	running, err := q.Submit("geoip-reload", func(ctx context.Context) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	assert.NoError(t, err)
+	<-started
+
+	queued, err := q.Submit("dns-refresh example.com", func(ctx context.Context) error { return nil })
+	assert.NoError(t, err)
+
+	stopped := make(chan struct{})
+	go func() {
+		q.Stop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Stop did not cancel the running job")
+	}
+
+	assert.Equal(t, context.Canceled, running.Wait())
+	assert.Equal(t, ErrStopped, queued.Wait())
+	assert.Equal(t, ErrStopped, q.Do("after-stop", func(ctx context.Context) error { return nil }))
+
+	for _, info := range q.Status().History {
+		assert.Equal(t, OUTCOME_CANCELLED, info.Outcome)
+	}
+	q.Stop()
+}
+
+func TestQueueHistoryIsBounded(t *testing.T) {
+	q := New("test", 8)
+	defer q.Stop()
+
+	for i := 0; i < DEFAULT_HISTORY_SIZE+5; i++ {
+		assert.NoError(t, q.Do(fmt.Sprintf("job-%d", i), func(ctx context.Context) error { return nil }))
+	}
+
+	history := q.Status().History
+	assert.Equal(t, DEFAULT_HISTORY_SIZE, len(history))
+	assert.Equal(t, fmt.Sprintf("job-%d", DEFAULT_HISTORY_SIZE+4), history[len(history)-1].Name)
+}
+
+func TestQueueSnapshotIsNotRecorded(t *testing.T) {
+	q := New("test", 8)
+	defer q.Stop()
+
+	assert.NoError(t, q.Do("job", func(ctx context.Context) error { return nil }))
+	ran := false
+	assert.NoError(t, q.Snapshot(context.Background(), "snapshot", func(ctx context.Context) error {
+		ran = true
+		return nil
+	}))
+	assert.True(t, ran)
+	assert.Equal(t, 1, len(q.Status().History))
+
+	// A snapshot behind a running job gives up with its context, and runs after the job.
+	release := make(chan struct{})
+	j, err := q.Submit("slow", func(ctx context.Context) error {
+		<-release
+		return nil
+	})
+	assert.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	later := make(chan struct{})
+	err = q.Snapshot(ctx, "snapshot", func(ctx context.Context) error {
+		close(later)
+		return nil
+	})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	close(release)
+	assert.NoError(t, j.Wait())
+	<-later
+	assert.Equal(t, 2, len(q.Status().History))
+}
@@ -3,7 +3,9 @@ package logger
 import (
 	"os"
 	"strings"
+	"time"
 
+	"github.com/mrtc0/bouheki/pkg/errkind"
 	"github.com/sirupsen/logrus"
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/natefinch/lumberjack.v2"
@@ -62,7 +64,7 @@ func SetOutput(path string) {
 	} else {
 		file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
 		if err != nil {
-			Logger.Fatal(err)
+			Fatal(errkind.New(errkind.Config, err))
 		}
 		Logger.Logger.Out = file
 	}
@@ -80,14 +82,24 @@ func SetRotation(path string, maxSize, maxAge int) {
 	})
 }
 
+// Flush syncs the log file to disk. Writes are not buffered, so stdout needs nothing.
+func Flush() error {
+	if file, ok := Logger.Logger.Out.(*os.File); ok && file != os.Stdout && file != os.Stderr {
+		return file.Sync()
+	}
+	return nil
+}
+
 func SetLabel(labels map[string]string) {
 	for k, v := range labels {
 		Logger = Logger.WithFields(log.Fields{k: v})
 	}
 }
 
+// Fatal logs err, writes the final error report to stderr and exits with the code mapped from its kind.
 func Fatal(err error) {
-	Logger.Fatal(err)
+	Logger.Error(err)
+	errkind.Exit(err)
 }
 
 func Debug(message string) {
@@ -98,6 +110,10 @@ func Info(message string) {
 	Logger.Info(message)
 }
 
+func Warn(message string) {
+	Logger.Warn(message)
+}
+
 func Error(err error) {
 	Logger.Error(err)
 }
@@ -106,6 +122,19 @@ func WithFields(fields log.Fields) *log.Entry {
 	return log.WithFields(fields)
 }
 
+// The messages of the audit events, which tell them from the operational logs.
+const (
+	NETWORK_EVENT_MESSAGE     = "Traffic is trapped in the filter."
+	FILE_ACCESS_EVENT_MESSAGE = "File access is trapped in th filter."
+	MOUNT_EVENT_MESSAGE       = "Mount event is trapped in th filter."
+	// EVENTS_DROPPED_MESSAGE is the message of the DroppedEventsLog, which tells the consumers of
+	// the events that they missed some.
+	EVENTS_DROPPED_MESSAGE = "Audit events were dropped."
+
+	// SHUTDOWN_MESSAGE is the message of the ShutdownLog, the last log of a run.
+	SHUTDOWN_MESSAGE = "Drained the audit events on shutdown."
+)
+
 type LogLabels struct {
 	Labels map[string]string
 }
@@ -116,14 +145,215 @@ type AuditEventLog struct {
 	PID        uint32
 	Comm       string
 	ParentComm string
+	// CgroupID is the cgroup v2 id of the process when the event was written. With
+	// containers.enable, ContainerID is the container of the cgroup, and ContainerName,
+	// ContainerImage, PodName and PodNamespace are looked up from the container runtime.
+	CgroupID       uint64
+	ContainerID    string
+	ContainerName  string
+	ContainerImage string
+	PodName        string
+	PodNamespace   string
 }
 
+// NETWORK_EVENT_VERSION is the version of the fields of RestrictedNetworkLog. Version 2 added
+// EventVersion and PolicyDigest, version 3 LocalAddr, LocalPort and Unbound, version 4 Operation,
+// version 5 CommandPattern, version 6 PolicyEntry, version 7 UID and GID, version 8 CgroupID and
+// the fields of the container, version 9 Rule, version 10 Count, version 11 MonitorRule; the
+// events without EventVersion are version 1.
+const NETWORK_EVENT_VERSION = 11
+
 type RestrictedNetworkLog struct {
 	AuditEventLog
-	Addr     string
-	Domain   string
-	Port     uint16
-	Protocol string
+	EventVersion int
+	// PolicyDigest is the digest of the policy in the maps when the event was read, which
+	// `bouheki policy show` resolves to the rules.
+	PolicyDigest string
+	// Operation is "connect", "sendmsg" for a datagram sent to Addr and Port without a connection,
+	// or "bind" for a socket bound to LocalAddr and LocalPort, which has no Addr and no Port.
+	Operation string
+	Addr      string
+	Domain    string
+	Port      uint16
+	Protocol  string
+	// LocalAddr and LocalPort are the address and the port the socket was bound to when it
+	// connected, or binds to. Unbound is set when it was bound to neither, and the kernel picked
+	// them after the decision. The programs before event schema version 5 do not report LocalPort.
+	LocalAddr string
+	LocalPort uint16
+	Unbound   bool
+	// DestinationTags name well-known destinations, e.g. "cloud-metadata".
+	DestinationTags []string
+	// ContainerCgroup is the classified cgroup the process was matched with, itself or an ancestor.
+	ContainerCgroup string
+	// Self is set for the connections of bouheki itself.
+	Self bool
+	// CommandPattern is the pattern of network.command.allow or deny the comm matched, e.g.
+	// "network.command.deny python*", when no command of the lists did.
+	CommandPattern string
+	// PolicyEntry is the entry of network.policies that decided the destination, e.g.
+	// "network.policies[curl]", or "network.host" and "network.container", if one selected the task.
+	PolicyEntry string
+	// Rule describes the rule the programs report denied the connection, e.g. "denied by cidr
+	// 10.0.0.0/8". It is empty for a permitted connection, and before event schema version 6.
+	Rule string
+	// MonitorRule is set when Rule is a deny entry in mode: monitor, which reported the
+	// connection without denying it. It is false before event schema version 7.
+	MonitorRule bool
+	// Count is the number of the events identical to this one that network.audit.dedup
+	// suppressed in a window, for the summary of the window. It is 0 for an event logged as read.
+	Count uint64
+	// UID and GID are the ids of the process, 0 in the events of the programs before event
+	// schema version 2.
+	UID uint32
+	GID uint32
+}
+
+type VerificationLog struct {
+	RestrictedNetworkLog
+	Result           string
+	KernelDenied     bool
+	ExpectedDenied   bool
+	PolicyGeneration uint64
+	// Trace are the checks of the evaluation order that lead to ExpectedDenied.
+	Trace []string
+}
+
+// AdminAuditLog is a policy change attempted during a freeze window.
+type AdminAuditLog struct {
+	Change      string
+	Description string
+	Window      string
+	WindowEnd   time.Time
+	Result      string
+}
+
+// RuntimeRuleLog is a rule added or removed on the control socket, or removed once its TTL
+// expired. UID is the uid of the process that requested the change, read from the socket, or
+// the one that added the rule when it expired. Err is why the change failed.
+type RuntimeRuleLog struct {
+	Operation string
+	List      string
+	CIDR      string
+	TTL       time.Duration
+	Expires   time.Time
+	UID       uint32
+	Err       string
+}
+
+// ForceMonitorLog is the network restriction forced into monitor mode, or back into its configured
+// Mode. Source is what forced it, the --force-monitor flag or the control socket, and UID the uid
+// of the process that requested it on the control socket. Err is why the change failed.
+type ForceMonitorLog struct {
+	Forced bool
+	Mode   string
+	Source string
+	UID    uint32
+	Err    string
+}
+
+// ShutdownLog is the outcome of draining the events of an audit on shutdown.
+type ShutdownLog struct {
+	Audit       string
+	Submitted   uint64
+	Drained     uint64
+	Lost        uint64
+	Dropped     uint64
+	Suppressed  uint64
+	DeadlineHit bool
+	Duration    time.Duration
+	// Startup is how long the audit took to be ready, and StartupSlowest its slowest phase.
+	Startup        time.Duration
+	StartupSlowest string
+}
+
+// DroppedEventsLog is the number of events of an audit that were dropped since Since, because the
+// ring buffer was full, and Total the number dropped since the start.
+type DroppedEventsLog struct {
+	Audit   string
+	Dropped uint64
+	Total   uint64
+	Since   time.Time
+}
+
+// TimingLog is the timing of a run, e.g. the startup of an audit. Phases is its table of phases.
+type TimingLog struct {
+	Run             string
+	Total           time.Duration
+	Slowest         string
+	SlowestDuration time.Duration
+	Phases          string
+}
+
+// StartupLog is the outcome of a startup condition.
+type StartupLog struct {
+	Condition string
+	Type      string
+	Policy    string
+	State     string
+	Waited    time.Duration
+	Error     string
+}
+
+// FallbackPolicyLog is a switch between the config and its fallback_policy. Failures is the
+// number of consecutive failed loads of the config, and LastError the last one.
+type FallbackPolicyLog struct {
+	Config    string
+	Fallback  string
+	Failures  int
+	LastError string
+}
+
+// ConfigReloadLog is a reload of the config by every module. Stage is the stage that failed, and
+// Err its errors, unless the config was applied. Diff is what each module changes, Added and
+// Removed the number of entries it adds and removes.
+type ConfigReloadLog struct {
+	Stage   string
+	Diff    string
+	Added   int
+	Removed int
+	Err     string
+}
+
+// DNSHealLog is a blocked address of an allowed domain that was added to the maps. Since is
+// when the first connection to it was blocked, Blocked the number of connections blocked since.
+type DNSHealLog struct {
+	Domain  string
+	Addr    string
+	Since   time.Time
+	Gap     time.Duration
+	Blocked int
+}
+
+// MapInvariantLog is a key of a policy map that Job did not leave as it must be, because Writer
+// changed it since or still has it, and which is written again. Expected is the value the key
+// must have and Found the one it had, "deleted" for none.
+type MapInvariantLog struct {
+	Job      string
+	Writer   string
+	Map      string
+	Key      string
+	Expected string
+	Found    string
+}
+
+// PolicyDiffLog is how the policy changed since the policy snapshot taken at Since.
+type PolicyDiffLog struct {
+	Since   time.Time
+	Added   int
+	Removed int
+	Changed int
+	Diff    string
+}
+
+// AlertLog is an alert rule that fired or resolved.
+type AlertLog struct {
+	Rule      string
+	Value     float64
+	Threshold float64
+	Window    time.Duration
+	// Since is when the resolved alert fired.
+	Since time.Time
 }
 
 type RestrictedFileAccessLog struct {
@@ -138,36 +368,290 @@ type RestrictedMountLog struct {
 
 func (l *RestrictedNetworkLog) Info() {
 	Logger.WithFields(logrus.Fields{
-		"Action":     l.Action,
-		"Hostname":   l.Hostname,
-		"PID":        l.PID,
-		"Comm":       l.Comm,
-		"ParentComm": l.ParentComm,
-		"Addr":       l.Addr,
-		"Domain":     l.Domain,
-		"Port":       l.Port,
-		"Protocol":   l.Protocol,
-	}).Info("Traffic is trapped in the filter.")
+		"Action":          l.Action,
+		"Hostname":        l.Hostname,
+		"PID":             l.PID,
+		"Comm":            l.Comm,
+		"ParentComm":      l.ParentComm,
+		"EventVersion":    l.EventVersion,
+		"PolicyDigest":    l.PolicyDigest,
+		"Operation":       l.Operation,
+		"Addr":            l.Addr,
+		"Domain":          l.Domain,
+		"Port":            l.Port,
+		"Protocol":        l.Protocol,
+		"LocalAddr":       l.LocalAddr,
+		"LocalPort":       l.LocalPort,
+		"Unbound":         l.Unbound,
+		"DestinationTags": l.DestinationTags,
+		"ContainerCgroup": l.ContainerCgroup,
+		"Self":            l.Self,
+		"CommandPattern":  l.CommandPattern,
+		"PolicyEntry":     l.PolicyEntry,
+		"Rule":            l.Rule,
+		"MonitorRule":     l.MonitorRule,
+		"Count":           l.Count,
+		"UID":             l.UID,
+		"GID":             l.GID,
+		"CgroupID":        l.CgroupID,
+		"ContainerID":     l.ContainerID,
+		"ContainerName":   l.ContainerName,
+		"ContainerImage":  l.ContainerImage,
+		"PodName":         l.PodName,
+		"PodNamespace":    l.PodNamespace,
+	}).Info(NETWORK_EVENT_MESSAGE)
+}
+
+func (l *VerificationLog) Warn() {
+	Logger.WithFields(logrus.Fields{
+		"Action":           l.Action,
+		"Hostname":         l.Hostname,
+		"PID":              l.PID,
+		"Comm":             l.Comm,
+		"ParentComm":       l.ParentComm,
+		"Addr":             l.Addr,
+		"Domain":           l.Domain,
+		"Port":             l.Port,
+		"Protocol":         l.Protocol,
+		"LocalAddr":        l.LocalAddr,
+		"LocalPort":        l.LocalPort,
+		"Unbound":          l.Unbound,
+		"DestinationTags":  l.DestinationTags,
+		"ContainerCgroup":  l.ContainerCgroup,
+		"Self":             l.Self,
+		"UID":              l.UID,
+		"GID":              l.GID,
+		"Result":           l.Result,
+		"KernelDenied":     l.KernelDenied,
+		"ExpectedDenied":   l.ExpectedDenied,
+		"PolicyGeneration": l.PolicyGeneration,
+		"Trace":            l.Trace,
+	}).Warn("Kernel decision disagrees with the userspace policy.")
+}
+
+func (l *AdminAuditLog) Warn() {
+	Logger.WithFields(logrus.Fields{
+		"Change":      l.Change,
+		"Description": l.Description,
+		"Window":      l.Window,
+		"WindowEnd":   l.WindowEnd,
+		"Result":      l.Result,
+	}).Warn("Policy change attempted during a freeze window.")
+}
+
+func (l *RuntimeRuleLog) fields() logrus.Fields {
+	fields := logrus.Fields{
+		"Operation": l.Operation,
+		"List":      l.List,
+		"CIDR":      l.CIDR,
+		"UID":       l.UID,
+	}
+	if l.TTL > 0 {
+		fields["TTL"] = l.TTL.String()
+	}
+	if !l.Expires.IsZero() {
+		fields["Expires"] = l.Expires
+	}
+	return fields
+}
+
+func (l *RuntimeRuleLog) Info() {
+	Logger.WithFields(l.fields()).Info("Runtime rule is changed.")
+}
+
+func (l *RuntimeRuleLog) Warn() {
+	Logger.WithFields(l.fields()).WithField("Error", l.Err).Warn("Runtime rule can not be changed.")
+}
+
+func (l *ForceMonitorLog) Warn() {
+	fields := logrus.Fields{
+		"Forced": l.Forced,
+		"Mode":   l.Mode,
+		"Source": l.Source,
+		"UID":    l.UID,
+	}
+	switch {
+	case l.Err != "":
+		Logger.WithFields(fields).WithField("Error", l.Err).Warn("Force monitor mode can not be changed.")
+	case l.Forced:
+		Logger.WithFields(fields).Warn("FORCE MONITOR: the network restriction is forced into monitor mode, nothing is blocked until it is cleared.")
+	default:
+		Logger.WithFields(fields).Warn("Force monitor mode is cleared, the network restriction is back in its configured mode.")
+	}
+}
+
+func (l *ShutdownLog) Info() {
+	Logger.WithFields(logrus.Fields{
+		"Audit":          l.Audit,
+		"Submitted":      l.Submitted,
+		"Drained":        l.Drained,
+		"Lost":           l.Lost,
+		"Dropped":        l.Dropped,
+		"Suppressed":     l.Suppressed,
+		"DeadlineHit":    l.DeadlineHit,
+		"Duration":       l.Duration.String(),
+		"Startup":        l.Startup.String(),
+		"StartupSlowest": l.StartupSlowest,
+	}).Info(SHUTDOWN_MESSAGE)
+}
+
+func (l *DroppedEventsLog) Warn() {
+	Logger.WithFields(logrus.Fields{
+		"Audit":   l.Audit,
+		"Dropped": l.Dropped,
+		"Total":   l.Total,
+		"Since":   l.Since,
+	}).Warn(EVENTS_DROPPED_MESSAGE)
+}
+
+func (l *TimingLog) Info() {
+	Logger.WithFields(logrus.Fields{
+		"Run":             l.Run,
+		"Total":           l.Total.String(),
+		"Slowest":         l.Slowest,
+		"SlowestDuration": l.SlowestDuration.String(),
+		"Phases":          l.Phases,
+	}).Info("Timed the phases of " + l.Run + ".")
+}
+
+func (l *StartupLog) fields() logrus.Fields {
+	return logrus.Fields{
+		"Condition": l.Condition,
+		"Type":      l.Type,
+		"Policy":    l.Policy,
+		"State":     l.State,
+		"Waited":    l.Waited.String(),
+		"Error":     l.Error,
+	}
+}
+
+func (l *StartupLog) Info() {
+	Logger.WithFields(l.fields()).Info("Startup condition is met.")
+}
+
+func (l *StartupLog) Warn() {
+	Logger.WithFields(l.fields()).Warn("Startup condition is not met.")
+}
+
+func (l *FallbackPolicyLog) fields() logrus.Fields {
+	return logrus.Fields{
+		"Config":    l.Config,
+		"Fallback":  l.Fallback,
+		"Failures":  l.Failures,
+		"LastError": l.LastError,
+	}
+}
+
+// Error logs that the fallback policy was applied.
+func (l *FallbackPolicyLog) Error() {
+	Logger.WithFields(l.fields()).Error("Config can not be loaded, the fallback policy is active.")
+}
+
+// Info logs that the config was loaded again in place of the fallback policy.
+func (l *FallbackPolicyLog) Info() {
+	Logger.WithFields(l.fields()).Info("Config is loaded again, the fallback policy is no longer active.")
+}
+
+func (l *ConfigReloadLog) Info() {
+	Logger.WithFields(logrus.Fields{"Diff": l.Diff, "Added": l.Added, "Removed": l.Removed}).Info("Config is reloaded.")
+}
+
+// Warn logs that the config was not reloaded, and every module is left on the previous config
+// unless Err says it could not be rolled back.
+func (l *ConfigReloadLog) Warn() {
+	Logger.WithFields(logrus.Fields{
+		"Stage": l.Stage,
+		"Diff":  l.Diff,
+		"Error": l.Err,
+	}).Warn("Config can not be reloaded.")
+}
+
+func (l *DNSHealLog) Info() {
+	Logger.WithFields(logrus.Fields{
+		"Domain":  l.Domain,
+		"Addr":    l.Addr,
+		"Since":   l.Since,
+		"Gap":     l.Gap.String(),
+		"Blocked": l.Blocked,
+	}).Info("Self-healed a blocked address of an allowed domain.")
+}
+
+func (l *MapInvariantLog) Error() {
+	Logger.WithFields(logrus.Fields{
+		"Job":      l.Job,
+		"Writer":   l.Writer,
+		"Map":      l.Map,
+		"Key":      l.Key,
+		"Expected": l.Expected,
+		"Found":    l.Found,
+	}).Error("Policy map invariant violated, the key is written again.")
+}
+
+func (l *PolicyDiffLog) Info() {
+	message := "Policy changed since the last run."
+	if l.Added+l.Removed+l.Changed == 0 {
+		message = "Policy is unchanged since the last run."
+	}
+	Logger.WithFields(logrus.Fields{
+		"Since":   l.Since,
+		"Added":   l.Added,
+		"Removed": l.Removed,
+		"Changed": l.Changed,
+		"Diff":    l.Diff,
+	}).Info(message)
+}
+
+func (l *AlertLog) fields() logrus.Fields {
+	return logrus.Fields{
+		"Rule":      l.Rule,
+		"Value":     l.Value,
+		"Threshold": l.Threshold,
+		"Window":    l.Window.String(),
+	}
+}
+
+// Error logs the alert that fired.
+func (l *AlertLog) Error() {
+	Logger.WithFields(l.fields()).Error("Alert is firing.")
+}
+
+// Info logs the alert that resolved.
+func (l *AlertLog) Info() {
+	fields := l.fields()
+	fields["Since"] = l.Since
+	Logger.WithFields(fields).Info("Alert is resolved.")
 }
 
 func (l *RestrictedFileAccessLog) Info() {
 	Logger.WithFields(logrus.Fields{
-		"Action":     l.Action,
-		"Hostname":   l.Hostname,
-		"PID":        l.PID,
-		"Comm":       l.Comm,
-		"ParentComm": l.ParentComm,
-		"Path":       l.Path,
-	}).Info("File access is trapped in th filter.")
+		"Action":         l.Action,
+		"Hostname":       l.Hostname,
+		"PID":            l.PID,
+		"Comm":           l.Comm,
+		"ParentComm":     l.ParentComm,
+		"Path":           l.Path,
+		"CgroupID":       l.CgroupID,
+		"ContainerID":    l.ContainerID,
+		"ContainerName":  l.ContainerName,
+		"ContainerImage": l.ContainerImage,
+		"PodName":        l.PodName,
+		"PodNamespace":   l.PodNamespace,
+	}).Info(FILE_ACCESS_EVENT_MESSAGE)
 }
 
 func (l *RestrictedMountLog) Info() {
 	Logger.WithFields(logrus.Fields{
-		"Action":     l.Action,
-		"Hostname":   l.Hostname,
-		"PID":        l.PID,
-		"Comm":       l.Comm,
-		"ParentComm": l.ParentComm,
-		"SourcePath": l.SourcePath,
-	}).Info("Mount event is trapped in th filter.")
+		"Action":         l.Action,
+		"Hostname":       l.Hostname,
+		"PID":            l.PID,
+		"Comm":           l.Comm,
+		"ParentComm":     l.ParentComm,
+		"SourcePath":     l.SourcePath,
+		"CgroupID":       l.CgroupID,
+		"ContainerID":    l.ContainerID,
+		"ContainerName":  l.ContainerName,
+		"ContainerImage": l.ContainerImage,
+		"PodName":        l.PodName,
+		"PodNamespace":   l.PodNamespace,
+	}).Info(MOUNT_EVENT_MESSAGE)
 }
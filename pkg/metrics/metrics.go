@@ -0,0 +1,180 @@
+// Package metrics holds bouheki's internal counters and exposes them in the Prometheus text format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+const namespace = "bouheki"
+
+type metric interface {
+	kind() string
+	help() string
+	value() float64
+}
+
+type Counter struct {
+	description string
+	v           uint64
+}
+
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.v, 1)
+}
+
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.v, n)
+}
+
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.v)
+}
+
+func (c *Counter) kind() string   { return "counter" }
+func (c *Counter) help() string   { return c.description }
+func (c *Counter) value() float64 { return float64(c.Value()) }
+
+type Gauge struct {
+	description string
+	bits        uint64
+}
+
+func (g *Gauge) Set(v float64) {
+	atomic.StoreUint64(&g.bits, math.Float64bits(v))
+}
+
+func (g *Gauge) Value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&g.bits))
+}
+
+func (g *Gauge) kind() string   { return "gauge" }
+func (g *Gauge) help() string   { return g.description }
+func (g *Gauge) value() float64 { return g.Value() }
+
+type Registry struct {
+	mu      sync.Mutex
+	metrics map[string]metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{metrics: map[string]metric{}}
+}
+
+// DefaultRegistry is the registry used by the package level functions.
+var DefaultRegistry = NewRegistry()
+
+// Counter returns the counter registered as name, creating it if needed.
+func (r *Registry) Counter(name, help string) *Counter {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if m, ok := r.metrics[name]; ok {
+		if c, ok := m.(*Counter); ok {
+			return c
+		}
+		panic(fmt.Sprintf("metric %s is already registered as a %s", name, m.kind()))
+	}
+
+	c := &Counter{description: help}
+	r.metrics[name] = c
+	return c
+}
+
+// Gauge returns the gauge registered as name, creating it if needed.
+func (r *Registry) Gauge(name, help string) *Gauge {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if m, ok := r.metrics[name]; ok {
+		if g, ok := m.(*Gauge); ok {
+			return g
+		}
+		panic(fmt.Sprintf("metric %s is already registered as a %s", name, m.kind()))
+	}
+
+	g := &Gauge{description: help}
+	r.metrics[name] = g
+	return g
+}
+
+// Snapshot returns the current value of every metric.
+func (r *Registry) Snapshot() map[string]float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	snapshot := make(map[string]float64, len(r.metrics))
+	for name, m := range r.metrics {
+		snapshot[name] = m.value()
+	}
+	return snapshot
+}
+
+// Kind returns "counter" or "gauge" for the metric registered as name, or "" if there is none.
+func (r *Registry) Kind(name string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if m, ok := r.metrics[name]; ok {
+		return m.kind()
+	}
+	return ""
+}
+
+// Write writes every metric in the Prometheus text exposition format.
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	metrics := make([]metric, len(names))
+	for i, name := range names {
+		metrics[i] = r.metrics[name]
+	}
+	r.mu.Unlock()
+
+	for i, name := range names {
+		m := metrics[i]
+		fullName := namespace + "_" + name
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", fullName, m.help(), fullName, m.kind(), fullName, m.value()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.Write(w)
+}
+
+func NewCounter(name, help string) *Counter {
+	return DefaultRegistry.Counter(name, help)
+}
+
+func NewGauge(name, help string) *Gauge {
+	return DefaultRegistry.Gauge(name, help)
+}
+
+var serveMux = http.NewServeMux()
+
+func init() {
+	serveMux.Handle("/metrics", DefaultRegistry)
+}
+
+// Handle registers an additional handler, such as /jobs, on the server started by Serve.
+func Handle(pattern string, handler http.Handler) {
+	serveMux.Handle(pattern, handler)
+}
+
+// Serve exposes the default registry on addr at /metrics.
+func Serve(addr string) error {
+	return http.ListenAndServe(addr, serveMux)
+}
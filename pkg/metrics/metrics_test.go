@@ -0,0 +1,42 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+
+	c := r.Counter("events_total", "Number of events.")
+	c.Inc()
+	c.Add(2)
+	assert.Same(t, c, r.Counter("events_total", "Number of events."))
+
+	g := r.Gauge("unresolved_domains", "Number of domains.")
+	g.Set(1.5)
+
+	assert.Equal(t, map[string]float64{"events_total": 3, "unresolved_domains": 1.5}, r.Snapshot())
+	assert.Equal(t, "counter", r.Kind("events_total"))
+	assert.Equal(t, "gauge", r.Kind("unresolved_domains"))
+	assert.Equal(t, "", r.Kind("unknown"))
+
+	t.Run("Registering a name twice with another type panics", func(t *testing.T) {
+		assert.Panics(t, func() { r.Gauge("events_total", "") })
+	})
+}
+
+func TestWrite(t *testing.T) {
+	r := NewRegistry()
+	r.Gauge("b", "Gauge b.").Set(2)
+	r.Counter("a", "Counter a.").Inc()
+
+	var buf bytes.Buffer
+	assert.Nil(t, r.Write(&buf))
+
+	expected := "# HELP bouheki_a Counter a.\n# TYPE bouheki_a counter\nbouheki_a 1\n" +
+		"# HELP bouheki_b Gauge b.\n# TYPE bouheki_b gauge\nbouheki_b 2\n"
+	assert.Equal(t, expected, buf.String())
+}
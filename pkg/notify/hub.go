@@ -0,0 +1,102 @@
+package notify
+
+import (
+	"sync"
+
+	"github.com/mrtc0/bouheki/pkg/metrics"
+)
+
+const DEFAULT_SUBSCRIBER_QUEUE_SIZE = 64
+
+var (
+	notificationsPublished = metrics.NewCounter("notifications_published_total",
+		"Number of policy change notifications published.")
+	subscribersDropped = metrics.NewCounter("notifications_subscribers_dropped_total",
+		"Number of subscribers disconnected because their queue was full.")
+	subscribersGauge = metrics.NewGauge("notifications_subscribers",
+		"Number of connected notification subscribers.")
+)
+
+// DefaultHub is the hub used by the package level Publish.
+var DefaultHub = NewHub(DEFAULT_SUBSCRIBER_QUEUE_SIZE)
+
+type Subscriber struct {
+	// C is closed when the subscriber is dropped or unsubscribed.
+	C chan Notification
+	// Dropped is set when the subscriber was disconnected for being too slow.
+	dropped bool
+	// types are the types of notifications the subscriber receives. Empty receives every type.
+	types map[string]bool
+}
+
+func (s *Subscriber) Dropped() bool {
+	return s.dropped
+}
+
+type Hub struct {
+	mu          sync.Mutex
+	queueSize   int
+	subscribers map[*Subscriber]struct{}
+}
+
+func NewHub(queueSize int) *Hub {
+	return &Hub{queueSize: queueSize, subscribers: map[*Subscriber]struct{}{}}
+}
+
+// Subscribe returns a subscriber of the notifications of types, or of every notification without types.
+func (h *Hub) Subscribe(types ...string) *Subscriber {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s := &Subscriber{C: make(chan Notification, h.queueSize)}
+	if len(types) > 0 {
+		s.types = map[string]bool{}
+		for _, t := range types {
+			s.types[t] = true
+		}
+	}
+	h.subscribers[s] = struct{}{}
+	subscribersGauge.Set(float64(len(h.subscribers)))
+	return s
+}
+
+func (h *Hub) Unsubscribe(s *Subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.remove(s)
+}
+
+// Publish queues n for every subscriber without blocking. A subscriber whose queue is full is dropped.
+func (h *Hub) Publish(n Notification) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	notificationsPublished.Inc()
+	for s := range h.subscribers {
+		if s.types != nil && !s.types[n.Type] {
+			continue
+		}
+		select {
+		case s.C <- n:
+		default:
+			s.dropped = true
+			h.remove(s)
+			subscribersDropped.Inc()
+		}
+	}
+}
+
+func (h *Hub) remove(s *Subscriber) {
+	if _, ok := h.subscribers[s]; !ok {
+		return
+	}
+	delete(h.subscribers, s)
+	close(s.C)
+	subscribersGauge.Set(float64(len(h.subscribers)))
+}
+
+// Publish publishes the payload to the DefaultHub.
+func Publish(payload interface{}, policyDigest string) {
+	DefaultHub.Publish(New(payload, policyDigest))
+}
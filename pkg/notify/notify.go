@@ -0,0 +1,155 @@
+// Package notify publishes policy change notifications to subscribers of the control socket.
+//
+// Notifications are independent of the audit events: every subscriber has its own bounded queue,
+// and a subscriber that does not keep up is disconnected instead of slowing down the publisher.
+package notify
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// VERSION is the version of the serialized notification. It is incremented
+// when a field is removed or changes meaning; new fields keep the version.
+const VERSION = 1
+
+const (
+	TYPE_CONFIG_RELOAD     = "config_reload"
+	TYPE_DNS_RULE_CHANGE   = "dns_rule_change"
+	TYPE_TEMPORARY_RULE    = "temporary_rule"
+	TYPE_ENFORCEMENT_MODE  = "enforcement_mode"
+	TYPE_TAMPER_CORRECTION = "tamper_correction"
+	TYPE_ALERT             = "alert"
+)
+
+// Notification is a policy change. PolicyDigest is the digest of the policy after the change.
+type Notification struct {
+	Version      int         `json:"version"`
+	Type         string      `json:"type"`
+	Time         time.Time   `json:"time"`
+	PolicyDigest string      `json:"policy_digest"`
+	Payload      interface{} `json:"payload"`
+}
+
+// ConfigReload is sent when a reloaded config is applied or rejected.
+type ConfigReload struct {
+	Applied bool   `json:"applied"`
+	Error   string `json:"error,omitempty"`
+	// Diff is a summary of the changed rules, e.g. "+2 -1 network.cidr.allow".
+	Diff string `json:"diff,omitempty"`
+}
+
+// DNSRuleChange is sent when the addresses of a configured domain are added to or removed from the maps.
+type DNSRuleChange struct {
+	Domain  string   `json:"domain"`
+	List    string   `json:"list"`
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+}
+
+const (
+	TEMPORARY_RULE_ADDED   = "added"
+	TEMPORARY_RULE_EXPIRED = "expired"
+)
+
+// TemporaryRule is sent when a rule with an expiry is added or expires.
+type TemporaryRule struct {
+	Action    string    `json:"action"`
+	Rule      string    `json:"rule"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// EnforcementMode is sent when the enforcement changes, e.g. from the LSM to the kprobe fallback.
+type EnforcementMode struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// TamperCorrection is sent when a map entry that was changed outside of bouheki is restored.
+type TamperCorrection struct {
+	Map    string `json:"map"`
+	Entry  string `json:"entry"`
+	Action string `json:"action"`
+}
+
+const (
+	ALERT_FIRING   = "firing"
+	ALERT_RESOLVED = "resolved"
+)
+
+// Alert is sent when an alert rule fires, and when it resolves.
+type Alert struct {
+	Rule      string  `json:"rule"`
+	State     string  `json:"state"`
+	Value     float64 `json:"value"`
+	Threshold float64 `json:"threshold"`
+	// Window is the duration the value is counted over, e.g. "5m0s".
+	Window string `json:"window"`
+	// Since is when a resolved alert fired.
+	Since time.Time `json:"since,omitempty"`
+}
+
+var payloadTypes = map[string]reflect.Type{
+	TYPE_CONFIG_RELOAD:     reflect.TypeOf(ConfigReload{}),
+	TYPE_DNS_RULE_CHANGE:   reflect.TypeOf(DNSRuleChange{}),
+	TYPE_TEMPORARY_RULE:    reflect.TypeOf(TemporaryRule{}),
+	TYPE_ENFORCEMENT_MODE:  reflect.TypeOf(EnforcementMode{}),
+	TYPE_TAMPER_CORRECTION: reflect.TypeOf(TamperCorrection{}),
+	TYPE_ALERT:             reflect.TypeOf(Alert{}),
+}
+
+// New returns a notification of the type matching payload.
+func New(payload interface{}, policyDigest string) Notification {
+	return Notification{
+		Version:      VERSION,
+		Type:         typeOf(payload),
+		Time:         time.Now().UTC(),
+		PolicyDigest: policyDigest,
+		Payload:      payload,
+	}
+}
+
+func typeOf(payload interface{}) string {
+	t := reflect.TypeOf(payload)
+	for name, payloadType := range payloadTypes {
+		if payloadType == t {
+			return name
+		}
+	}
+	panic(fmt.Sprintf("unknown notification payload %T", payload))
+}
+
+func Marshal(n Notification) ([]byte, error) {
+	return json.Marshal(n)
+}
+
+// Unmarshal decodes a notification and its payload. Notifications of a newer version are rejected.
+func Unmarshal(data []byte) (Notification, error) {
+	var raw struct {
+		Notification
+		Payload json.RawMessage `json:"payload"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return Notification{}, err
+	}
+
+	n := raw.Notification
+	if n.Version < 1 || n.Version > VERSION {
+		return Notification{}, fmt.Errorf("unsupported notification version %d", n.Version)
+	}
+
+	payloadType, ok := payloadTypes[n.Type]
+	if !ok {
+		return Notification{}, fmt.Errorf("unknown notification type %q", n.Type)
+	}
+	payload := reflect.New(payloadType)
+	if err := json.Unmarshal(raw.Payload, payload.Interface()); err != nil {
+		return Notification{}, err
+	}
+	n.Payload = payload.Elem().Interface()
+
+	return n, nil
+}
@@ -0,0 +1,103 @@
+package notify
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMarshalRoundTrip(t *testing.T) {
+	payloads := []interface{}{
+		ConfigReload{Applied: false, Error: "network.cidr.allow: invalid CIDR", Diff: "+1 network.cidr.allow"},
+		DNSRuleChange{Domain: "example.com", List: "allow", Added: []string{"93.184.216.34/32"}, Removed: []string{"93.184.216.35/32"}},
+		TemporaryRule{Action: TEMPORARY_RULE_ADDED, Rule: "network.cidr.allow 10.0.0.1/32", ExpiresAt: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)},
+		EnforcementMode{From: "lsm", To: "monitor-only fallback", Reason: "BPF LSM is not active"},
+		TamperCorrection{Map: "allowed_cidr_list", Entry: "10.0.0.0/8", Action: "restored"},
+		Alert{Rule: "blocks", State: ALERT_RESOLVED, Value: 3, Threshold: 50, Window: "5m0s", Since: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)},
+	}
+
+	for _, payload := range payloads {
+		n := New(payload, "digest")
+		data, err := Marshal(n)
+		assert.Nil(t, err)
+
+		decoded, err := Unmarshal(data)
+		assert.Nil(t, err)
+		assert.Equal(t, VERSION, decoded.Version)
+		assert.Equal(t, n.Type, decoded.Type)
+		assert.Equal(t, "digest", decoded.PolicyDigest)
+		assert.True(t, n.Time.Equal(decoded.Time))
+		assert.Equal(t, payload, decoded.Payload)
+	}
+}
+
+func TestMarshalFormat(t *testing.T) {
+	n := New(EnforcementMode{From: "lsm", To: "signal fallback"}, "abc")
+	n.Time = time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	data, err := Marshal(n)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"version":1,"type":"enforcement_mode","time":"2026-01-02T03:04:05Z","policy_digest":"abc","payload":{"from":"lsm","to":"signal fallback"}}`, string(data))
+}
+
+func TestUnmarshalRejectsUnknownVersionsAndTypes(t *testing.T) {
+	_, err := Unmarshal([]byte(`{"version":2,"type":"enforcement_mode","payload":{}}`))
+	assert.NotNil(t, err)
+
+	_, err = Unmarshal([]byte(`{"version":0,"type":"enforcement_mode","payload":{}}`))
+	assert.NotNil(t, err)
+
+	_, err = Unmarshal([]byte(`{"version":1,"type":"unknown","payload":{}}`))
+	assert.NotNil(t, err)
+
+	// fields added later are ignored by older readers.
+	n, err := Unmarshal([]byte(`{"version":1,"type":"enforcement_mode","payload":{"from":"lsm","to":"lsm","new_field":1}}`))
+	assert.Nil(t, err)
+	assert.Equal(t, EnforcementMode{From: "lsm", To: "lsm"}, n.Payload)
+}
+
+func TestHubDropsSlowSubscribers(t *testing.T) {
+	hub := NewHub(2)
+	fast := hub.Subscribe()
+	slow := hub.Subscribe()
+
+	dropped := subscribersDropped.Value()
+	for i := 0; i < 3; i++ {
+		hub.Publish(New(EnforcementMode{From: "lsm", To: "lsm"}, ""))
+		<-fast.C
+	}
+
+	assert.Equal(t, dropped+1, subscribersDropped.Value())
+	assert.True(t, slow.Dropped())
+	assert.False(t, fast.Dropped())
+
+	// the queued notifications are still delivered before the channel is closed.
+	received := 0
+	for range slow.C {
+		received++
+	}
+	assert.Equal(t, 2, received)
+
+	hub.Publish(New(EnforcementMode{From: "lsm", To: "lsm"}, ""))
+	_, ok := <-fast.C
+	assert.True(t, ok)
+
+	hub.Unsubscribe(fast)
+	_, ok = <-fast.C
+	assert.False(t, ok)
+	hub.Unsubscribe(fast)
+}
+
+func TestHubFiltersByType(t *testing.T) {
+	hub := NewHub(2)
+	alerts := hub.Subscribe(TYPE_ALERT)
+	all := hub.Subscribe()
+
+	hub.Publish(New(EnforcementMode{From: "lsm", To: "lsm"}, ""))
+	hub.Publish(New(Alert{Rule: "blocks", State: ALERT_FIRING}, ""))
+
+	assert.Equal(t, TYPE_ALERT, (<-alerts.C).Type)
+	assert.Len(t, alerts.C, 0)
+	assert.Len(t, all.C, 2)
+}
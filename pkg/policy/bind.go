@@ -0,0 +1,71 @@
+package policy
+
+import (
+	"fmt"
+	"net"
+)
+
+// Binding is the local address and port of a bind(2) call.
+type Binding struct {
+	Addr        net.IP
+	Port        uint16
+	InContainer bool
+}
+
+// HasIngressRules reports whether any list of network.ingress is in the policy.
+func (p *Policy) HasIngressRules() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.ingressAllowedCIDR.Len()+p.ingressDeniedCIDR.Len()+len(p.ingressAllowedPorts)+len(p.ingressDeniedPorts) > 0
+}
+
+// EvaluateBind returns what socket_bind in restricted-network.bpf.c decides for b: a denied
+// address or port denies the bind, and so does an address or a port missing from an allow list
+// that has entries. The lists of the connections, and the task, play no part. Port 0, for which
+// the kernel picks the port, is never restricted.
+func (p *Policy) EvaluateBind(b Binding) Decision {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if b.Port == 0 || (p.configured && p.target == TARGET_CONTAINER && !b.InContainer) || p.outOfFamilies(b.Addr) {
+		return Decision{}
+	}
+
+	decision := Decision{}
+	deny := func(denyList bool, rule string) {
+		if !decision.Denied {
+			decision.Denied = true
+			decision.Rule = rule
+		}
+		decision.DenyListed = decision.DenyListed || denyList
+	}
+
+	if p.lists.IngressDenyPort != 0 {
+		if prefix, ok := lookupPort(p.ingressDeniedPorts, b.Port); ok {
+			deny(true, fmt.Sprintf("network.ingress.ports.deny %s", prefix.Range()))
+		}
+	}
+	if n, _, ok := p.ingressDeniedCIDR.Lookup(b.Addr); ok {
+		deny(true, fmt.Sprintf("network.ingress.cidr.deny %s", n))
+	}
+	if p.lists.IngressAllowPort != 0 {
+		if _, ok := lookupPort(p.ingressAllowedPorts, b.Port); !ok {
+			deny(false, fmt.Sprintf("network.ingress.ports.allow does not list %d", b.Port))
+		}
+	}
+	if p.lists.IngressAllowCIDR != 0 && !p.ingressAllowedCIDR.Contains(b.Addr) {
+		deny(false, fmt.Sprintf("network.ingress.cidr.allow does not list %s", b.Addr))
+	}
+
+	switch {
+	case !p.configured:
+		decision.Blocked = decision.Denied
+	case p.mode == MODE_MONITOR:
+		decision.Audited = true
+	default:
+		decision.Audited = decision.Denied
+		decision.Blocked = decision.Denied
+	}
+	return decision
+}
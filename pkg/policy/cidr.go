@@ -0,0 +1,42 @@
+package policy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+)
+
+// ParseCIDR parses a CIDR of the config as it is written to the maps, and returns its zone. A zone
+// is only valid for an IPv6 address, and the rule applies to the prefix on all interfaces.
+func ParseCIDR(cidr string) (*net.IPNet, string, error) {
+	unzoned, zone := SplitZone(cidr)
+	_, n, err := net.ParseCIDR(unzoned)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if zone != "" && n.IP.To4() != nil {
+		return nil, "", fmt.Errorf("%s: zone %q is only valid for IPv6 addresses", cidr, zone)
+	}
+	// A v4-mapped prefix (e.g. ::ffff:10.0.0.0/104) is written as its IPv4 prefix, which a
+	// dual-stack socket connecting to a v4-mapped address is looked up with.
+	return config.Unmap(n), zone, nil
+}
+
+// SplitZone removes an IPv6 zone from a CIDR.
+// e.g. fe80::1%eth0/64 -> (fe80::1/64, eth0)
+func SplitZone(cidr string) (string, string) {
+	i := strings.Index(cidr, "%")
+	if i < 0 {
+		return cidr, ""
+	}
+
+	j := strings.Index(cidr[i:], "/")
+	if j < 0 {
+		return cidr[:i], cidr[i+1:]
+	}
+
+	return cidr[:i] + cidr[i+j:], cidr[i+1 : i+j]
+}
@@ -0,0 +1,54 @@
+package policy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitZone(t *testing.T) {
+	tests := []struct {
+		cidr         string
+		expectedCIDR string
+		expectedZone string
+	}{
+		{cidr: "fe80::1%eth0/64", expectedCIDR: "fe80::1/64", expectedZone: "eth0"},
+		{cidr: "fe80::1%eth0", expectedCIDR: "fe80::1", expectedZone: "eth0"},
+		{cidr: "2001:db8::/32", expectedCIDR: "2001:db8::/32", expectedZone: ""},
+		{cidr: "10.0.0.0/8", expectedCIDR: "10.0.0.0/8", expectedZone: ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.cidr, func(t *testing.T) {
+			cidr, zone := SplitZone(test.cidr)
+			assert.Equal(t, test.expectedCIDR, cidr)
+			assert.Equal(t, test.expectedZone, zone)
+		})
+	}
+}
+
+func TestParseCIDR(t *testing.T) {
+	n, zone, err := ParseCIDR("fe80::1%eth0/64")
+	assert.Nil(t, err)
+	assert.Equal(t, "fe80::/64", n.String())
+	assert.Equal(t, "eth0", zone)
+
+	n, _, err = ParseCIDR("10.1.2.3/8")
+	assert.Nil(t, err)
+	assert.Equal(t, "10.0.0.0/8", n.String())
+
+	_, _, err = ParseCIDR("10.0.0.1%eth0/32")
+	assert.EqualError(t, err, `10.0.0.1%eth0/32: zone "eth0" is only valid for IPv6 addresses`)
+	n, _, err = ParseCIDR("::ffff:10.0.0.0/104")
+	assert.Nil(t, err)
+	assert.Equal(t, "10.0.0.0/8", n.String())
+	assert.Len(t, n.IP, 4)
+	n, _, err = ParseCIDR("::ffff:203.0.113.7/128")
+	assert.Nil(t, err)
+	assert.Equal(t, "203.0.113.7/32", n.String())
+	n, _, err = ParseCIDR("::ffff:0:0/64")
+	assert.Nil(t, err)
+	assert.Equal(t, "::/64", n.String())
+	_, _, err = ParseCIDR("10.0.0.0")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,213 @@
+// Package cidrset is a userspace counterpart of the LPM trie maps used by the BPF programs.
+package cidrset
+
+import (
+	"net"
+	"sort"
+	"sync"
+)
+
+type table struct {
+	bits     int
+	prefixes map[int]map[string]*entry
+	// lengths is the set of prefix lengths in use, longest first.
+	lengths []int
+}
+
+type entry struct {
+	network *net.IPNet
+	value   interface{}
+}
+
+// Set holds IPv4 and IPv6 prefixes and answers longest-prefix-match lookups.
+// It is safe for concurrent use.
+type Set struct {
+	mu sync.RWMutex
+	v4 *table
+	v6 *table
+}
+
+func New() *Set {
+	return &Set{
+		v4: newTable(32),
+		v6: newTable(128),
+	}
+}
+
+func newTable(bits int) *table {
+	return &table{bits: bits, prefixes: map[int]map[string]*entry{}}
+}
+
+func (s *Set) tableFor(ip net.IP) (*table, net.IP) {
+	if v4 := ip.To4(); v4 != nil {
+		return s.v4, v4
+	}
+	return s.v6, ip.To16()
+}
+
+// normalize returns the masked network address in the length matching its mask.
+func normalize(n *net.IPNet) (net.IP, int, int) {
+	ones, bits := n.Mask.Size()
+	ip := n.IP.To16()
+	if bits == 32 {
+		ip = n.IP.To4()
+	}
+	return ip.Mask(net.CIDRMask(ones, bits)), ones, bits
+}
+
+// Insert adds n to the set, replacing the value of an identical prefix.
+func (s *Set) Insert(n *net.IPNet, value interface{}) {
+	ip, ones, bits := normalize(n)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t := s.v4
+	if bits == 128 {
+		t = s.v6
+	}
+
+	entries, ok := t.prefixes[ones]
+	if !ok {
+		entries = map[string]*entry{}
+		t.prefixes[ones] = entries
+		t.lengths = append(t.lengths, ones)
+		sort.Sort(sort.Reverse(sort.IntSlice(t.lengths)))
+	}
+	entries[string(ip)] = &entry{
+		network: &net.IPNet{IP: ip, Mask: net.CIDRMask(ones, bits)},
+		value:   value,
+	}
+}
+
+// Delete removes exactly n from the set and reports whether it was present.
+func (s *Set) Delete(n *net.IPNet) bool {
+	ip, ones, bits := normalize(n)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t := s.v4
+	if bits == 128 {
+		t = s.v6
+	}
+
+	entries, ok := t.prefixes[ones]
+	if !ok {
+		return false
+	}
+	if _, ok := entries[string(ip)]; !ok {
+		return false
+	}
+	delete(entries, string(ip))
+
+	if len(entries) == 0 {
+		delete(t.prefixes, ones)
+		for i, l := range t.lengths {
+			if l == ones {
+				t.lengths = append(t.lengths[:i], t.lengths[i+1:]...)
+				break
+			}
+		}
+	}
+
+	return true
+}
+
+// Lookup returns the longest prefix containing ip and its value.
+func (s *Set) Lookup(ip net.IP) (*net.IPNet, interface{}, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	t, addr := s.tableFor(ip)
+	if addr == nil {
+		return nil, nil, false
+	}
+
+	for _, l := range t.lengths {
+		masked := addr.Mask(net.CIDRMask(l, t.bits))
+		if e, ok := t.prefixes[l][string(masked)]; ok {
+			return e.network, e.value, true
+		}
+	}
+
+	return nil, nil, false
+}
+
+// Contains reports whether any prefix in the set contains ip.
+func (s *Set) Contains(ip net.IP) bool {
+	_, _, ok := s.Lookup(ip)
+	return ok
+}
+
+// Get returns the value stored for exactly n.
+func (s *Set) Get(n *net.IPNet) (interface{}, bool) {
+	ip, ones, bits := normalize(n)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	t := s.v4
+	if bits == 128 {
+		t = s.v6
+	}
+
+	e, ok := t.prefixes[ones][string(ip)]
+	if !ok {
+		return nil, false
+	}
+	return e.value, true
+}
+
+// Len returns the number of prefixes in the set.
+func (s *Set) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	n := 0
+	for _, t := range []*table{s.v4, s.v6} {
+		for _, entries := range t.prefixes {
+			n += len(entries)
+		}
+	}
+	return n
+}
+
+// Prefixes returns every prefix in the set, IPv4 first, ordered by address then prefix length.
+func (s *Set) Prefixes() []*net.IPNet {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var result []*net.IPNet
+	for _, t := range []*table{s.v4, s.v6} {
+		var networks []*net.IPNet
+		for _, entries := range t.prefixes {
+			for _, e := range entries {
+				networks = append(networks, e.network)
+			}
+		}
+		sort.Slice(networks, func(i, j int) bool {
+			if c := compareIP(networks[i].IP, networks[j].IP); c != 0 {
+				return c < 0
+			}
+			a, _ := networks[i].Mask.Size()
+			b, _ := networks[j].Mask.Size()
+			return a < b
+		})
+		result = append(result, networks...)
+	}
+
+	return result
+}
+
+func compareIP(a, b net.IP) int {
+	for i := range a {
+		if a[i] != b[i] {
+			if a[i] < b[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
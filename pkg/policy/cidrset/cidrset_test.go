@@ -0,0 +1,79 @@
+package cidrset
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func mustParseCIDR(cidr string) *net.IPNet {
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+func TestLookup(t *testing.T) {
+	set := New()
+	set.Insert(mustParseCIDR("10.0.0.0/8"), "wide")
+	set.Insert(mustParseCIDR("10.1.0.0/16"), "narrow")
+	set.Insert(mustParseCIDR("2001:db8::/32"), "v6")
+	set.Insert(mustParseCIDR("::/0"), "v6-any")
+
+	tests := []struct {
+		name           string
+		ip             string
+		expectedPrefix string
+		expectedValue  interface{}
+		found          bool
+	}{
+		{name: "longest prefix wins", ip: "10.1.2.3", expectedPrefix: "10.1.0.0/16", expectedValue: "narrow", found: true},
+		{name: "falls back to shorter prefix", ip: "10.2.2.3", expectedPrefix: "10.0.0.0/8", expectedValue: "wide", found: true},
+		{name: "IPv4 miss", ip: "192.168.1.1", found: false},
+		{name: "IPv4-mapped IPv6 is looked up as IPv4", ip: "::ffff:10.1.2.3", expectedPrefix: "10.1.0.0/16", expectedValue: "narrow", found: true},
+		{name: "IPv6 match", ip: "2001:db8::1", expectedPrefix: "2001:db8::/32", expectedValue: "v6", found: true},
+		{name: "IPv6 default route", ip: "2001:db9::1", expectedPrefix: "::/0", expectedValue: "v6-any", found: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			prefix, value, found := set.Lookup(net.ParseIP(test.ip))
+			assert.Equal(t, test.found, found)
+			if test.found {
+				assert.Equal(t, test.expectedPrefix, prefix.String())
+				assert.Equal(t, test.expectedValue, value)
+			}
+		})
+	}
+}
+
+func TestInsertAndDelete(t *testing.T) {
+	set := New()
+	set.Insert(mustParseCIDR("10.1.2.3/16"), 1)
+	set.Insert(mustParseCIDR("10.1.0.0/16"), 2)
+	assert.Equal(t, 1, set.Len(), "host bits are masked before insertion")
+
+	value, ok := set.Get(mustParseCIDR("10.1.0.0/16"))
+	assert.True(t, ok)
+	assert.Equal(t, 2, value)
+
+	assert.False(t, set.Delete(mustParseCIDR("10.0.0.0/8")))
+	assert.True(t, set.Delete(mustParseCIDR("10.1.0.0/16")))
+	assert.False(t, set.Contains(net.ParseIP("10.1.2.3")))
+	assert.Equal(t, 0, set.Len())
+}
+
+func TestPrefixes(t *testing.T) {
+	set := New()
+	for _, cidr := range []string{"2001:db8::/32", "10.1.0.0/16", "10.0.0.0/8", "1.1.1.1/32"} {
+		set.Insert(mustParseCIDR(cidr), nil)
+	}
+
+	var actual []string
+	for _, n := range set.Prefixes() {
+		actual = append(actual, n.String())
+	}
+	assert.Equal(t, []string{"1.1.1.1/32", "10.0.0.0/8", "10.1.0.0/16", "2001:db8::/32"}, actual)
+}
@@ -0,0 +1,32 @@
+package policy_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/mrtc0/bouheki/pkg/bouhekitest"
+	"github.com/mrtc0/bouheki/pkg/policy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadPolicyDecidesTheConformanceCorpus(t *testing.T) {
+	cases, err := bouhekitest.LoadConformanceCases("testdata/conformance.yaml")
+	assert.Nil(t, err)
+	assert.NotEmpty(t, cases)
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			p, err := policy.LoadPolicy([]byte(c.Config))
+			if !assert.Nil(t, err) {
+				return
+			}
+			for _, conn := range c.Connections {
+				decision := p.Evaluate(conn.Input())
+				message := fmt.Sprintf("%+v", conn)
+				assert.Equal(t, conn.Denied(), decision.Denied, message)
+				assert.Equal(t, conn.Rule, decision.Rule, message)
+				assert.Equal(t, !conn.Denied(), policy.SocketConnect(p, conn.Input()), message)
+			}
+		})
+	}
+}
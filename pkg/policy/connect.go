@@ -0,0 +1,37 @@
+package policy
+
+import "net"
+
+// ConnInput is the subject and destination of a connect(2) call, the connection Evaluate decides.
+type ConnInput struct {
+	Addr net.IP
+	Port uint16
+	// SockType is TCP or UDP, which the protocol lists are looked up with. The connections of
+	// another or of an unknown socket type, 0, are only evaluated with the other lists.
+	SockType uint8
+	Command  string
+	// ExePath is the path of the executable of the task, which the path lists match. No path
+	// rule matches when it is empty, e.g. when the task was not seen executing.
+	ExePath     string
+	UID         uint32
+	GID         uint32
+	InContainer bool
+}
+
+// Evaluate returns what socket_connect in restricted-network.bpf.c decides for c, by applying
+// the checks of evaluationOrder.
+func (p *Policy) Evaluate(c ConnInput) Decision {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	decision, _ := p.evaluate(c, false)
+	return decision
+}
+
+// Trace is Evaluate, and the result of every check of the evaluation order that is not kernel only.
+func (p *Policy) Trace(c ConnInput) (Decision, []TraceStep) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.evaluate(c, true)
+}
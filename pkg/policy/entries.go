@@ -0,0 +1,263 @@
+package policy
+
+import (
+	"fmt"
+	"io"
+	"math/bits"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/policy/cidrset"
+)
+
+// POLICY_ENTRY_MAX is the number of entries of network.policies, each a bit of the masks of PolicyEntries.
+const POLICY_ENTRY_MAX = config.POLICY_ENTRY_MAX
+
+// PolicyEntries are the masks of the entries of network.policies in the config map. Bit i is
+// the entry at index i. The selector lists map a command, a uid or a gid to the mask of the
+// entries that list it, and an entry without a selector matches any value of it.
+type PolicyEntries struct {
+	// Count is the number of entries. socket_connect selects none when it is 0.
+	Count uint32
+	// AnyCommand, AnyUID and AnyGID are the entries without a command, uid or gid selector.
+	AnyCommand uint64
+	AnyUID     uint64
+	AnyGID     uint64
+	// HasAllow are the entries with a cidr.allow or a domain.allow, which deny the other destinations.
+	HasAllow uint64
+	// Host and Container are the entries of network.host and network.container, which only select
+	// the tasks outside or inside a classified container.
+	Host      uint64
+	Container uint64
+}
+
+// EntryTag returns the byte the keys of the entry CIDR lists of the entry at index start with,
+// where the keys of the protocol lists have the socket type.
+func EntryTag(index int) uint8 {
+	return uint8(index + 1)
+}
+
+// EntryMasks returns the PolicyEntries of entries, and the masks of their commands, uids and gids.
+func EntryMasks(entries []config.PolicyEntryConfig) (PolicyEntries, map[string]uint64, map[uint32]uint64, map[uint32]uint64) {
+	masks := PolicyEntries{Count: uint32(len(entries))}
+	commands, uids, gids := map[string]uint64{}, map[uint32]uint64{}, map[uint32]uint64{}
+	for i, entry := range entries {
+		bit := uint64(1) << uint(i)
+		if len(entry.Command) == 0 {
+			masks.AnyCommand |= bit
+		}
+		if len(entry.UID) == 0 {
+			masks.AnyUID |= bit
+		}
+		if len(entry.GID) == 0 {
+			masks.AnyGID |= bit
+		}
+		if entry.HasAllow() {
+			masks.HasAllow |= bit
+		}
+		switch entry.Target {
+		case config.TARGET_HOST:
+			masks.Host |= bit
+		case config.TARGET_CONTAINER:
+			masks.Container |= bit
+		}
+		for _, command := range entry.Command {
+			commands[string(CommandKey(command))] |= bit
+		}
+		for _, uid := range entry.UID {
+			uids[uint32(uid)] |= bit
+		}
+		for _, gid := range entry.GID {
+			gids[uint32(gid)] |= bit
+		}
+	}
+	return masks, commands, uids, gids
+}
+
+// SetPolicyEntries sets the masks of the config map, and the names of the entries, which the
+// maps do not have.
+func (p *Policy) SetPolicyEntries(entries PolicyEntries, names []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.entries != entries || fmt.Sprint(p.entryNames) != fmt.Sprint(names) {
+		p.entries = entries
+		p.entryNames = names
+		p.changed()
+	}
+}
+
+func (p *Policy) entrySelectorSet(list List) map[uint32]uint64 {
+	switch list {
+	case LIST_ENTRY_UID:
+		return p.entryUIDs
+	case LIST_ENTRY_GID:
+		return p.entryGIDs
+	default:
+		return nil
+	}
+}
+
+// SetEntryCommand sets the mask of the entries that select command. A mask of 0 deletes it.
+func (p *Policy) SetEntryCommand(command string, mask uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key := string(CommandKey(command))
+	if mask == 0 {
+		delete(p.entryCommands, key)
+	} else {
+		p.entryCommands[key] = mask
+	}
+	p.changed()
+}
+
+// SetEntryID sets the mask of the entries that select id in list, LIST_ENTRY_UID or
+// LIST_ENTRY_GID. A mask of 0 deletes it.
+func (p *Policy) SetEntryID(list List, id uint32, mask uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ids := p.entrySelectorSet(list)
+	if ids == nil {
+		return
+	}
+	if mask == 0 {
+		delete(ids, id)
+	} else {
+		ids[id] = mask
+	}
+	p.changed()
+}
+
+// entryCIDRSet returns the set of the entry of tag in list, which it creates if create is set.
+func (p *Policy) entryCIDRSet(list List, tag uint8, create bool) *cidrset.Set {
+	sets := p.allowedEntryCIDR
+	if list == LIST_DENY_ENTRY_CIDR {
+		sets = p.deniedEntryCIDR
+	}
+	set, ok := sets[tag]
+	if !ok && create {
+		set = cidrset.New()
+		sets[tag] = set
+	}
+	return set
+}
+
+// selectEntry returns the index of the first entry that selects the task of e, as
+// select_policy_entry does, or -1. It is called with p.mu held.
+func (p *Policy) selectEntry(e *evaluation) int {
+	if p.entries.Count == 0 {
+		return -1
+	}
+	mask := (p.entryCommands[e.commandKey()] | p.entries.AnyCommand) &
+		(p.entryUIDs[e.conn.UID] | p.entries.AnyUID) &
+		(p.entryGIDs[e.conn.GID] | p.entries.AnyGID)
+	if p.entries.Count < POLICY_ENTRY_MAX {
+		mask &= uint64(1)<<p.entries.Count - 1
+	}
+	if e.conn.InContainer {
+		mask &^= p.entries.Host
+	} else {
+		mask &^= p.entries.Container
+	}
+	if mask == 0 {
+		return -1
+	}
+	return bits.TrailingZeros64(mask)
+}
+
+// entryKey returns the key of the entry at index in the rules, e.g. "network.policies[curl]"
+// or "network.host".
+func (p *Policy) entryKey(index int) string {
+	bit := uint64(1) << uint(index)
+	switch {
+	case p.entries.Host&bit != 0:
+		return config.PolicyEntryConfig{Target: config.TARGET_HOST}.Key()
+	case p.entries.Container&bit != 0:
+		return config.PolicyEntryConfig{Target: config.TARGET_CONTAINER}.Key()
+	}
+	if index < len(p.entryNames) {
+		return config.PolicyEntryConfig{Name: p.entryNames[index]}.Key()
+	}
+	return fmt.Sprintf("network.policies[%d]", index)
+}
+
+// entryDenies returns the prefix of the deny list of the entry at index addr is in.
+func (p *Policy) entryDenies(index int, addr net.IP) (*net.IPNet, bool) {
+	set := p.entryCIDRSet(LIST_DENY_ENTRY_CIDR, EntryTag(index), false)
+	if set == nil {
+		return nil, false
+	}
+	n, _, ok := set.Lookup(addr)
+	return n, ok
+}
+
+// entryAllows reports whether the entry at index permits addr when it does not deny it.
+func (p *Policy) entryAllows(index int, addr net.IP) bool {
+	if p.entries.HasAllow&(uint64(1)<<uint(index)) == 0 {
+		return true
+	}
+	set := p.entryCIDRSet(LIST_ALLOW_ENTRY_CIDR, EntryTag(index), false)
+	return set != nil && set.Contains(addr)
+}
+
+// PolicyEntry returns the key of the entry of network.policies, network.host or
+// network.container that decides the destination of c, e.g. "network.policies[curl]", or "" if
+// none selects its task.
+func (p *Policy) PolicyEntry(c ConnInput) string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	e := &evaluation{conn: c, command: c.Command}
+	if p.commandCaseInsensitive {
+		e.command = strings.ToLower(e.command)
+	}
+	if index := p.selectEntry(e); index >= 0 {
+		return p.entryKey(index)
+	}
+	return ""
+}
+
+// digestEntries writes network.policies to the digest h. It is called with p.mu held.
+func (p *Policy) digestEntries(h io.Writer) {
+	fmt.Fprintf(h, "policy_entries count=%d any_command=%x any_uid=%x any_gid=%x has_allow=%x host=%x container=%x names=%q\n",
+		p.entries.Count, p.entries.AnyCommand, p.entries.AnyUID, p.entries.AnyGID, p.entries.HasAllow, p.entries.Host, p.entries.Container, p.entryNames)
+	commands := make([]string, 0, len(p.entryCommands))
+	for command := range p.entryCommands {
+		commands = append(commands, command)
+	}
+	sort.Strings(commands)
+	for _, command := range commands {
+		fmt.Fprintf(h, "entry_command %q %x\n", command, p.entryCommands[command])
+	}
+	for _, ids := range []struct {
+		name string
+		set  map[uint32]uint64
+	}{{"entry_uid", p.entryUIDs}, {"entry_gid", p.entryGIDs}} {
+		keys := make([]int, 0, len(ids.set))
+		for id := range ids.set {
+			keys = append(keys, int(id))
+		}
+		sort.Ints(keys)
+		for _, id := range keys {
+			fmt.Fprintf(h, "%s %d %x\n", ids.name, id, ids.set[uint32(id)])
+		}
+	}
+	for _, sets := range []struct {
+		name string
+		sets map[uint8]*cidrset.Set
+	}{{"entry_allow_cidr", p.allowedEntryCIDR}, {"entry_deny_cidr", p.deniedEntryCIDR}} {
+		for tag := 1; tag <= POLICY_ENTRY_MAX; tag++ {
+			set, ok := sets.sets[uint8(tag)]
+			if !ok {
+				continue
+			}
+			for _, n := range set.Prefixes() {
+				fmt.Fprintf(h, "%s %d %s\n", sets.name, tag, n)
+			}
+		}
+	}
+}
@@ -0,0 +1,699 @@
+package policy
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+)
+
+const (
+	CHECK_ACTIVE  = "active"
+	CHECK_SKIPPED = "skipped"
+
+	TRACE_PASS         = "pass"
+	TRACE_PERMIT       = "permit"
+	TRACE_DENY         = "deny"
+	TRACE_OUT_OF_SCOPE = "out of scope"
+	TRACE_SKIPPED      = "skipped"
+	// TRACE_SELECTED is the result of policies.select when an entry of network.policies selects
+	// the task, which the Rule of the step names.
+	TRACE_SELECTED = "selected"
+	// TRACE_MONITOR is the result of a check whose entry in mode: monitor would have denied the
+	// connection, which the Rule of the step names.
+	TRACE_MONITOR = "monitored"
+)
+
+// The dimensions of a connection a check permits or denies. A connection is permitted when none is denied.
+const (
+	dimensionDestination = iota
+	dimensionCommand
+	dimensionUID
+	dimensionGID
+	dimensionPort
+	dimensions
+)
+
+// EvaluationCheck is a step of the evaluation of a connection. The checks of evaluationOrder
+// are applied in order, and a later check never permits what an earlier one denied, except
+// for network.cidr.deny, which allowed subjects override. Nothing overrides network.ports.deny
+// and network.cidr.allow_except.
+type EvaluationCheck struct {
+	Name string
+	// Semantics is what the check decides, as printed by `bouheki policy explain-order`.
+	Semantics string
+	// KernelOnly checks are made by socket_connect on what a connection can not describe,
+	// and are not applied by Evaluate.
+	KernelOnly bool
+	// configured reports whether the check can change a decision of a policy. nil is always.
+	configured func(s Shape) bool
+	apply      func(p *Policy, e *evaluation) string
+}
+
+// evaluationOrder is the order socket_connect in restricted-network.bpf.c evaluates a connection
+// in. Evaluate, the decision traces and `bouheki policy explain-order` are all made from it,
+// and the conformance tests check socket_connect against it: keep both in sync.
+var evaluationOrder = []EvaluationCheck{
+	{
+		Name:       "scope.family",
+		Semantics:  "Only the IPv4 and IPv6 connections are restricted.",
+		KernelOnly: true,
+	},
+	{
+		Name:       "scope.port",
+		Semantics:  "A connection to port 0 is not restricted. Connections without a port are evaluated as if to any port, which the port lists never deny.",
+		KernelOnly: true,
+	},
+	{
+		Name:      "scope.target",
+		Semantics: "With target: container, the connections outside the classified containers are not restricted.",
+		configured: func(s Shape) bool {
+			return s.Configured && s.Target == TARGET_CONTAINER
+		},
+		apply: func(p *Policy, e *evaluation) string {
+			if !e.conn.InContainer {
+				e.outOfScope = true
+				return TRACE_OUT_OF_SCOPE
+			}
+			return TRACE_PASS
+		},
+	},
+	{
+		Name:      "scope.families",
+		Semantics: "The connections of the families network.families leaves out are not restricted. With network.other_families: audit, they are reported as allowed.",
+		configured: func(s Shape) bool {
+			return s.DisabledFamilies != 0
+		},
+		apply: func(p *Policy, e *evaluation) string {
+			if !p.outOfFamilies(e.conn.Addr) {
+				return TRACE_PASS
+			}
+			e.outOfScope = true
+			e.audited = p.otherFamiliesAudit
+			return TRACE_OUT_OF_SCOPE
+		},
+	},
+	{
+		Name:      "command.case_insensitive",
+		Semantics: "The command is lowercased before the command lists are looked up.",
+		configured: func(s Shape) bool {
+			return s.CommandCaseInsensitive
+		},
+		apply: func(p *Policy, e *evaluation) string {
+			e.command = strings.ToLower(e.command)
+			return TRACE_PASS
+		},
+	},
+	{
+		Name:      "policies.select",
+		Semantics: "The first entry of network.policies whose command, uid and gid selectors all match the task decides its destination, instead of network.cidr and network.domain.",
+		configured: func(s Shape) bool {
+			return s.PolicyEntries != 0
+		},
+		apply: func(p *Policy, e *evaluation) string {
+			e.entry = p.selectEntry(e)
+			if e.entry < 0 {
+				return TRACE_PASS
+			}
+			return TRACE_SELECTED
+		},
+	},
+	{
+		Name:      "cidr.allow_except",
+		Semantics: "A destination in network.cidr.allow_except is denied, whatever the allow lists, the precedence and the allowed subjects, unless policies.select selected an entry.",
+		configured: func(s Shape) bool {
+			return s.ExceptCIDR
+		},
+		apply: func(p *Policy, e *evaluation) string {
+			if e.entry >= 0 {
+				return TRACE_PASS
+			}
+			n, _, ok := p.exceptCIDR.Lookup(e.conn.Addr)
+			if !ok {
+				return TRACE_PASS
+			}
+			e.except = true
+			return e.deny(dimensionDestination, true, fmt.Sprintf("network.cidr.allow_except %s", n))
+		},
+	},
+	{
+		Name:      "precedence.allow_first",
+		Semantics: "With network.policy.precedence: allow-first, a destination cidr.allow would permit is permitted before cidr.deny, unless policies.select selected an entry.",
+		configured: func(s Shape) bool {
+			return s.Precedence == PRECEDENCE_ALLOW_FIRST && s.DeniedCIDR
+		},
+		apply: func(p *Policy, e *evaluation) string {
+			if e.entry >= 0 || e.decided(dimensionDestination) || !p.allowedDestination(e.conn) {
+				return TRACE_PASS
+			}
+			return e.permit(dimensionDestination)
+		},
+	},
+	{
+		Name:      "cidr.deny",
+		Semantics: "A destination in network.cidr.deny, or an address of network.domain.deny, is denied, as is one in the deny list of the protocol of the socket, unless policies.select selected an entry or precedence.allow_first permitted it. An entry in mode: monitor does not deny, it reports the connection if nothing else denies it.",
+		configured: func(s Shape) bool {
+			return s.DeniedCIDR
+		},
+		apply: func(p *Policy, e *evaluation) string {
+			if e.entry >= 0 || e.decided(dimensionDestination) {
+				return TRACE_PASS
+			}
+			n, _, ok := p.deniedCIDR.Lookup(e.conn.Addr)
+			if !ok {
+				return p.denyProtocolCIDR(e)
+			}
+			rule := fmt.Sprintf("network.cidr.deny %s", n)
+			if group := p.deniedGroups[n.String()]; group != "" {
+				rule += fmt.Sprintf(" (%s)", config.GroupReference(group))
+			}
+			if _, ok := p.monitorCIDR.Get(n); !ok {
+				return e.deny(dimensionDestination, true, rule)
+			}
+			// socket_connect goes on to the shards and the protocol lists.
+			e.monitor(dimensionDestination, rule)
+			if result := p.denyProtocolCIDR(e); result == TRACE_DENY {
+				return result
+			}
+			return TRACE_MONITOR
+		},
+	},
+	{
+		Name:      "cidr.deny.override",
+		Semantics: "A command, executable, uid or gid in its allow list, or a command matching a pattern of it, still connects to a destination denied by cidr.deny, whatever the size of the list, and is not reported for an entry in mode: monitor.",
+		configured: func(s Shape) bool {
+			return s.DeniedCIDR && s.AllowedSubjects
+		},
+		apply: func(p *Policy, e *evaluation) string {
+			if !(e.denied(dimensionDestination) || e.monitored(dimensionDestination)) || e.except {
+				return TRACE_PASS
+			}
+			inAllowedCommands := p.allowedCommand(e)
+			_, inAllowedPaths := lookupPath(p.allowedPaths, e.conn.ExePath)
+			_, inAllowedUIDs := matchUID(p.allowedUIDs, p.allowedUIDRanges, e.conn.UID)
+			_, inAllowedGIDs := p.allowedGIDs[e.conn.GID]
+			if !(inAllowedCommands || inAllowedPaths || inAllowedUIDs || inAllowedGIDs) {
+				return TRACE_PASS
+			}
+			e.unmonitor(dimensionDestination)
+			if !e.denied(dimensionDestination) {
+				return TRACE_PASS
+			}
+			return e.permit(dimensionDestination)
+		},
+	},
+	{
+		Name:      "policies.deny",
+		Semantics: "A destination in the cidr.deny or the domain.deny of the selected entry is denied, whatever the allow lists of the subjects.",
+		configured: func(s Shape) bool {
+			return s.PolicyEntries != 0
+		},
+		apply: func(p *Policy, e *evaluation) string {
+			if e.entry < 0 {
+				return TRACE_PASS
+			}
+			n, ok := p.entryDenies(e.entry, e.conn.Addr)
+			if !ok {
+				return TRACE_PASS
+			}
+			return e.deny(dimensionDestination, true, fmt.Sprintf("%s.cidr.deny %s", p.entryKey(e.entry), n))
+		},
+	},
+	{
+		Name:      "command.deny",
+		Semantics: "A command in network.command.deny or matching one of its patterns, or an executable in network.command.deny_paths, is denied. A command in mode: monitor does not deny, it reports the connection if nothing else denies it.",
+		configured: func(s Shape) bool {
+			return s.Lists.DenyCommand != 0 || s.Lists.DenyCommandPattern != 0 || s.Lists.DenyPath != 0
+		},
+		apply: func(p *Policy, e *evaluation) string {
+			_, listed := p.deniedCommands[e.commandKey()]
+			listed = listed && p.lists.DenyCommand != 0
+			rule := fmt.Sprintf("network.command.deny %s", strings.TrimRight(e.commandKey(), "\x00"))
+			if listed && !p.monitoredCommand(e.commandKey()) {
+				return e.deny(dimensionCommand, true, rule)
+			}
+			// The patterns are scanned for a command in mode: monitor too.
+			if pattern, ok := lookupCommandPattern(p.deniedCommandPatterns, p.lists.DenyCommandPattern, e.commandKey()); ok {
+				return e.deny(dimensionCommand, true, fmt.Sprintf("network.command.deny %s", pattern))
+			}
+			if rule, ok := lookupPath(p.deniedPaths, e.conn.ExePath); ok && p.lists.DenyPath != 0 {
+				return e.deny(dimensionCommand, true, fmt.Sprintf("network.command.deny_paths %s", rule))
+			}
+			if listed {
+				return e.monitor(dimensionCommand, rule)
+			}
+			return TRACE_PASS
+		},
+	},
+	{
+		Name:      "uid.deny",
+		Semantics: "A uid in network.uid.deny is denied.",
+		configured: func(s Shape) bool {
+			return s.Lists.DenyUID != 0
+		},
+		apply: func(p *Policy, e *evaluation) string {
+			entry, ok := matchUID(p.deniedUIDs, p.deniedUIDRanges, e.conn.UID)
+			if !ok {
+				return TRACE_PASS
+			}
+			return e.deny(dimensionUID, true, fmt.Sprintf("network.uid.deny %s", entry))
+		},
+	},
+	{
+		Name:      "gid.deny",
+		Semantics: "A gid in network.gid.deny is denied.",
+		configured: func(s Shape) bool {
+			return s.Lists.DenyGID != 0
+		},
+		apply: func(p *Policy, e *evaluation) string {
+			if _, ok := p.deniedGIDs[e.conn.GID]; !ok {
+				return TRACE_PASS
+			}
+			return e.deny(dimensionGID, true, fmt.Sprintf("network.gid.deny %d", e.conn.GID))
+		},
+	},
+	{
+		Name:      "port.deny",
+		Semantics: "A destination port in network.ports.deny is denied, whatever the destination and the subject.",
+		configured: func(s Shape) bool {
+			return s.Lists.DenyPort != 0
+		},
+		apply: func(p *Policy, e *evaluation) string {
+			if e.conn.Port == 0 {
+				return TRACE_PASS
+			}
+			prefix, ok := lookupPort(p.deniedPorts, e.conn.Port)
+			if !ok {
+				return TRACE_PASS
+			}
+			return e.deny(dimensionPort, true, fmt.Sprintf("network.ports.deny %s", prefix.Range()))
+		},
+	},
+	{
+		Name:      "cidr.allow",
+		Semantics: "A destination that cidr.deny has not decided is permitted if it is in network.cidr.allow, or an address of network.domain.allow, or in the allow list of the protocol of the socket, and denied otherwise, unless policies.select selected an entry. With network.policy.default: allow, it is not denied.",
+		apply: func(p *Policy, e *evaluation) string {
+			if e.entry >= 0 || e.decided(dimensionDestination) {
+				return TRACE_PASS
+			}
+			if !p.allowedDestination(e.conn) {
+				if p.defaultAction == DEFAULT_ACTION_ALLOW {
+					return TRACE_PASS
+				}
+				return e.deny(dimensionDestination, false, fmt.Sprintf("network.cidr.allow does not list %s", e.conn.Addr))
+			}
+			return e.permit(dimensionDestination)
+		},
+	},
+	{
+		Name:      "policies.allow",
+		Semantics: "A destination that policies.deny has not denied is permitted if the selected entry has no allow list or it is in its cidr.allow or domain.allow, and denied otherwise.",
+		configured: func(s Shape) bool {
+			return s.PolicyEntries != 0
+		},
+		apply: func(p *Policy, e *evaluation) string {
+			if e.entry < 0 || e.decided(dimensionDestination) {
+				return TRACE_PASS
+			}
+			if !p.entryAllows(e.entry, e.conn.Addr) {
+				return e.deny(dimensionDestination, false, fmt.Sprintf("%s.cidr.allow does not list %s", p.entryKey(e.entry), e.conn.Addr))
+			}
+			return e.permit(dimensionDestination)
+		},
+	},
+	{
+		Name:      "command.allow",
+		Semantics: "A command that command.deny has not denied is denied unless it is in network.command.allow or matches one of its patterns, or its executable is in network.command.allow_paths.",
+		configured: func(s Shape) bool {
+			return s.Lists.AllowCommand != 0 || s.Lists.AllowCommandPattern != 0 || s.Lists.AllowPath != 0
+		},
+		apply: func(p *Policy, e *evaluation) string {
+			if e.decided(dimensionCommand) {
+				return TRACE_PASS
+			}
+			inAllowedCommands := p.allowedCommand(e)
+			_, inAllowedPaths := lookupPath(p.allowedPaths, e.conn.ExePath)
+			if inAllowedCommands || inAllowedPaths {
+				return e.permit(dimensionCommand)
+			}
+			return e.deny(dimensionCommand, false, p.unlistedCommand(e))
+		},
+	},
+	{
+		Name:      "uid.allow",
+		Semantics: "A uid that uid.deny has not denied is denied if it is not in network.uid.allow.",
+		configured: func(s Shape) bool {
+			return s.Lists.AllowUID != 0
+		},
+		apply: func(p *Policy, e *evaluation) string {
+			if e.decided(dimensionUID) {
+				return TRACE_PASS
+			}
+			if _, ok := matchUID(p.allowedUIDs, p.allowedUIDRanges, e.conn.UID); !ok {
+				return e.deny(dimensionUID, false, fmt.Sprintf("network.uid.allow does not list %d", e.conn.UID))
+			}
+			return e.permit(dimensionUID)
+		},
+	},
+	{
+		Name:      "gid.allow",
+		Semantics: "A gid that gid.deny has not denied is denied if it is not in network.gid.allow.",
+		configured: func(s Shape) bool {
+			return s.Lists.AllowGID != 0
+		},
+		apply: func(p *Policy, e *evaluation) string {
+			if e.decided(dimensionGID) {
+				return TRACE_PASS
+			}
+			if _, ok := p.allowedGIDs[e.conn.GID]; !ok {
+				return e.deny(dimensionGID, false, fmt.Sprintf("network.gid.allow does not list %d", e.conn.GID))
+			}
+			return e.permit(dimensionGID)
+		},
+	},
+	{
+		Name:      "port.allow",
+		Semantics: "A destination port that port.deny has not denied is denied if it is not in network.ports.allow.",
+		configured: func(s Shape) bool {
+			return s.Lists.AllowPort != 0
+		},
+		apply: func(p *Policy, e *evaluation) string {
+			if e.conn.Port == 0 || e.decided(dimensionPort) {
+				return TRACE_PASS
+			}
+			if _, ok := lookupPort(p.allowedPorts, e.conn.Port); !ok {
+				return e.deny(dimensionPort, false, fmt.Sprintf("network.ports.allow does not list %d", e.conn.Port))
+			}
+			return e.permit(dimensionPort)
+		},
+	},
+	{
+		Name:      "verdict",
+		Semantics: "The connection is permitted if none of the destination, the port, the command, the uid and the gid is denied, and reported if an entry in mode: monitor would have denied it.",
+		apply: func(p *Policy, e *evaluation) string {
+			for d := 0; d < dimensions; d++ {
+				if e.denied(d) {
+					return TRACE_DENY
+				}
+			}
+			if len(e.monitors) > 0 {
+				return TRACE_MONITOR
+			}
+			return TRACE_PERMIT
+		},
+	},
+	{
+		Name:      "mode",
+		Semantics: "In block mode a denied connection is refused and reported. In monitor mode every connection is reported and none is refused.",
+		apply: func(p *Policy, e *evaluation) string {
+			if p.configured && p.mode == MODE_MONITOR {
+				return "monitor"
+			}
+			return "block"
+		},
+	},
+}
+
+// monitoredCommand reports whether the command key of the deny list is in mode: monitor.
+func (p *Policy) monitoredCommand(key string) bool {
+	_, ok := p.monitorCommands[key]
+	return ok
+}
+
+// allowedCommand reports whether the command of e is in network.command.allow or matches one of
+// its patterns.
+func (p *Policy) allowedCommand(e *evaluation) bool {
+	if _, ok := p.allowedCommands[e.commandKey()]; ok {
+		return true
+	}
+	_, ok := lookupCommandPattern(p.allowedCommandPatterns, p.lists.AllowCommandPattern, e.commandKey())
+	return ok
+}
+
+// unlistedCommand names the allow lists of the commands a connection is denied by.
+func (p *Policy) unlistedCommand(e *evaluation) string {
+	command := strings.TrimRight(e.commandKey(), "\x00")
+	exe := e.conn.ExePath
+	if exe == "" {
+		exe = "an unknown executable"
+	}
+	switch {
+	case p.lists.AllowPath == 0:
+		return fmt.Sprintf("network.command.allow does not list %s", command)
+	case p.lists.AllowCommand == 0 && p.lists.AllowCommandPattern == 0:
+		return fmt.Sprintf("network.command.allow_paths does not list %s", exe)
+	default:
+		return fmt.Sprintf("network.command.allow and allow_paths do not list %s, %s", command, exe)
+	}
+}
+
+// allowedDestination reports whether the destination of c is in network.cidr.allow or in the
+// allow list of its protocol.
+func (p *Policy) allowedDestination(c ConnInput) bool {
+	return p.allowedCIDR.Contains(c.Addr) || p.allowedByProtocol(c)
+}
+
+// allowedByProtocol reports whether the destination of c is in the allow list of its protocol.
+func (p *Policy) allowedByProtocol(c ConnInput) bool {
+	set, ok := p.allowedProtocolCIDR[c.SockType]
+	return ok && set.Contains(c.Addr)
+}
+
+// denyProtocolCIDR denies a destination in the deny list of the protocol of the connection.
+func (p *Policy) denyProtocolCIDR(e *evaluation) string {
+	set, ok := p.deniedProtocolCIDR[e.conn.SockType]
+	if !ok {
+		return TRACE_PASS
+	}
+	n, _, ok := set.Lookup(e.conn.Addr)
+	if !ok {
+		return TRACE_PASS
+	}
+	protocol := protocolName(e.conn.SockType)
+	return e.deny(dimensionDestination, true, fmt.Sprintf("network.cidr.protocols[%s].deny %s", protocol, n))
+}
+
+// protocolName returns the protocol of the config a socket type is written as in the rules.
+func protocolName(sockType uint8) string {
+	switch sockType {
+	case TCP:
+		return config.PROTOCOL_TCP
+	case UDP:
+		return config.PROTOCOL_UDP
+	default:
+		return "unknown"
+	}
+}
+
+// Shape is what decides whether the checks of evaluationOrder can change a decision.
+type Shape struct {
+	Configured             bool
+	Target                 uint32
+	CommandCaseInsensitive bool
+	Lists                  ListSizes
+	// DeniedCIDR is set when the CIDR deny lists have entries.
+	DeniedCIDR bool
+	// AllowedSubjects is set when the command, path, uid or gid allow lists have entries.
+	AllowedSubjects bool
+	// DisabledFamilies are the flags of the families that are not restricted.
+	DisabledFamilies uint32
+	// PolicyEntries is the number of entries of network.policies.
+	PolicyEntries uint32
+	// DefaultAction and Precedence are network.policy.
+	DefaultAction uint32
+	Precedence    uint32
+	// ExceptCIDR is set when network.cidr.allow_except has entries.
+	ExceptCIDR bool
+}
+
+func (p *Policy) shape() Shape {
+	return Shape{
+		Configured:             p.configured,
+		Target:                 p.target,
+		CommandCaseInsensitive: p.commandCaseInsensitive,
+		Lists:                  p.lists,
+		DeniedCIDR:             p.deniedCIDR.Len()+p.deniedProtocolCIDR[TCP].Len()+p.deniedProtocolCIDR[UDP].Len() > 0,
+		AllowedSubjects:        len(p.allowedCommands)+len(p.allowedCommandPatterns)+len(p.allowedPaths)+len(p.allowedUIDs)+len(p.allowedUIDRanges)+len(p.allowedGIDs) > 0,
+		DisabledFamilies:       p.disabledFamilies,
+		PolicyEntries:          p.entries.Count,
+		DefaultAction:          p.defaultAction,
+		Precedence:             p.precedence,
+		ExceptCIDR:             p.exceptCIDR.Len() > 0,
+	}
+}
+
+// OrderedCheck is a check of the evaluation order and whether it can change a decision of a config.
+type OrderedCheck struct {
+	EvaluationCheck
+	// Status is CHECK_ACTIVE or CHECK_SKIPPED.
+	Status string
+}
+
+// Order returns the evaluation order of the connections with a policy of shape s. The checks of
+// the dimensions s does not restrict are CHECK_SKIPPED.
+func Order(s Shape) []OrderedCheck {
+	checks := make([]OrderedCheck, 0, len(evaluationOrder))
+	for _, check := range evaluationOrder {
+		status := CHECK_ACTIVE
+		if check.configured != nil && !check.configured(s) {
+			status = CHECK_SKIPPED
+		}
+		checks = append(checks, OrderedCheck{EvaluationCheck: check, Status: status})
+	}
+	return checks
+}
+
+// TraceStep is the result of a check of the evaluation order for a connection.
+type TraceStep struct {
+	Check  string `json:"check"`
+	Result string `json:"result"`
+	// Rule names the entry, or the allow list, a TRACE_DENY step denied the connection by, the
+	// entry in mode: monitor of a TRACE_MONITOR step, and the entry of network.policies a
+	// TRACE_SELECTED step selected.
+	Rule string `json:"rule,omitempty"`
+}
+
+func (s TraceStep) String() string {
+	if s.Rule != "" {
+		return fmt.Sprintf("%s: %s (%s)", s.Check, s.Result, s.Rule)
+	}
+	return fmt.Sprintf("%s: %s", s.Check, s.Result)
+}
+
+type dimensionState struct {
+	decided bool
+	denied  bool
+}
+
+type denial struct {
+	dimension int
+	denyList  bool
+	rule      string
+}
+
+// evaluation is the state of a connection through the checks of evaluationOrder.
+type evaluation struct {
+	conn    ConnInput
+	command string
+	// entry is the index of the entry of network.policies policies.select selected, or -1.
+	entry int
+	// except is set when cidr.allow_except denied the destination, which nothing overrides.
+	except     bool
+	outOfScope bool
+	audited    bool // of a connection out of scope, whose family is audited
+	state      [dimensions]dimensionState
+	// denials are in the order of the checks. The Rule of the decision is the first one that stands.
+	denials []denial
+	// monitors are the entries in mode: monitor that would have denied the connection, in the
+	// order of the checks. The Rule of a decision that nothing denies is the first one.
+	monitors []denial
+}
+
+func (e *evaluation) commandKey() string {
+	return string(CommandKey(e.command))
+}
+
+func (e *evaluation) decided(dimension int) bool {
+	return e.state[dimension].decided
+}
+
+func (e *evaluation) denied(dimension int) bool {
+	return e.state[dimension].denied
+}
+
+func (e *evaluation) deny(dimension int, denyList bool, rule string) string {
+	e.state[dimension] = dimensionState{decided: true, denied: true}
+	e.denials = append(e.denials, denial{dimension: dimension, denyList: denyList, rule: rule})
+	return TRACE_DENY
+}
+
+func (e *evaluation) monitored(dimension int) bool {
+	for _, m := range e.monitors {
+		if m.dimension == dimension {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *evaluation) monitor(dimension int, rule string) string {
+	e.monitors = append(e.monitors, denial{dimension: dimension, denyList: true, rule: rule})
+	return TRACE_MONITOR
+}
+
+// unmonitor drops the entries in mode: monitor of dimension, which would not have denied.
+func (e *evaluation) unmonitor(dimension int) {
+	monitors := []denial{}
+	for _, m := range e.monitors {
+		if m.dimension != dimension {
+			monitors = append(monitors, m)
+		}
+	}
+	e.monitors = monitors
+}
+
+func (e *evaluation) permit(dimension int) string {
+	e.state[dimension] = dimensionState{decided: true}
+	return TRACE_PERMIT
+}
+
+// evaluate applies evaluationOrder to c, and returns the steps if trace is set. It is called
+// with p.mu held.
+func (p *Policy) evaluate(c ConnInput, trace bool) (Decision, []TraceStep) {
+	e := &evaluation{conn: c, command: c.Command, entry: -1}
+	shape := p.shape()
+
+	var steps []TraceStep
+	for _, check := range evaluationOrder {
+		if check.KernelOnly {
+			continue
+		}
+		result := TRACE_SKIPPED
+		if check.configured == nil || check.configured(shape) {
+			result = check.apply(p, e)
+		}
+		if trace {
+			step := TraceStep{Check: check.Name, Result: result}
+			if result == TRACE_DENY && check.Name != "verdict" {
+				step.Rule = e.denials[len(e.denials)-1].rule
+			}
+			if result == TRACE_MONITOR && check.Name != "verdict" {
+				step.Rule = e.monitors[len(e.monitors)-1].rule
+			}
+			if result == TRACE_SELECTED {
+				step.Rule = p.entryKey(e.entry)
+			}
+			steps = append(steps, step)
+		}
+		if e.outOfScope {
+			return Decision{Audited: e.audited}, steps
+		}
+	}
+
+	decision := Decision{}
+	for _, d := range e.denials {
+		if !e.denied(d.dimension) {
+			continue
+		}
+		if !decision.Denied {
+			decision.Denied = true
+			decision.Rule = d.rule
+		}
+		decision.DenyListed = decision.DenyListed || d.denyList
+	}
+	if !decision.Denied && len(e.monitors) > 0 {
+		decision.Monitored = true
+		decision.Rule = e.monitors[0].rule
+	}
+
+	switch {
+	case !p.configured:
+		decision.Blocked = decision.Denied
+	case p.mode == MODE_MONITOR:
+		decision.Audited = true
+	default:
+		decision.Audited = decision.Denied || decision.Monitored
+		decision.Blocked = decision.Denied
+	}
+	return decision, steps
+}
@@ -0,0 +1,601 @@
+package policy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// SocketConnect is socketConnect, for the tests of package policy_test.
+var SocketConnect = socketConnect
+
+// socketConnect returns whether handleSocketConnect permits the connection.
+func socketConnect(policy *Policy, c ConnInput) bool {
+	permitted, _ := handleSocketConnect(policy, c)
+	return permitted
+}
+
+// handleSocketConnect is handle_socket_connect of restricted-network.bpf.c, statement by
+// statement, run on the maps policy is the content of. It returns whether the connection is
+// permitted, and whether it is reported for an entry in mode: monitor. Keep it a transliteration
+// of the C code: the conformance tests check evaluationOrder against it.
+func handleSocketConnect(policy *Policy, c ConnInput) (bool, bool) {
+	policy.mu.RLock()
+	defer policy.mu.RUnlock()
+
+	if c.Addr != nil && policy.disabledFamilies&FamilyOf(c.Addr) != 0 {
+		return true, false
+	}
+
+	allowConnect, allowCommand, allowUID, allowGID, allowPort := false, false, false, false, true
+	if policy.defaultAction == DEFAULT_ACTION_ALLOW {
+		allowConnect = true
+	}
+	hasAllowGID := policy.lists.AllowGID
+
+	comm := c.Command
+	if policy.commandCaseInsensitive {
+		comm = strings.ToLower(comm)
+	}
+	command := string(CommandKey(comm))
+	_, inAllowedCommands := policy.allowedCommands[command]
+	_, inDeniedCommands := policy.deniedCommands[command]
+	_, monitorCommand := policy.monitorCommands[command]
+	inAllowedCommandPatterns := false
+	if !inAllowedCommands {
+		_, inAllowedCommandPatterns = lookupCommandPattern(policy.allowedCommandPatterns, policy.lists.AllowCommandPattern, command)
+	}
+	_, inDeniedCommandPatterns := lookupCommandPattern(policy.deniedCommandPatterns, policy.lists.DenyCommandPattern, command)
+	_, inAllowedPaths := lookupPath(policy.allowedPaths, c.ExePath)
+	_, inDeniedPaths := lookupPath(policy.deniedPaths, c.ExePath)
+	// allowed_uid_listed: the hash, then the ranges.
+	_, inAllowedUIDs := policy.allowedUIDs[c.UID]
+	_, inAllowedUIDRanges := lookupUID(policy.allowedUIDRanges, c.UID)
+	inAllowedUIDs = inAllowedUIDs || inAllowedUIDRanges
+	_, inDeniedUIDs := policy.deniedUIDs[c.UID]
+	_, inDeniedUIDRanges := lookupUID(policy.deniedUIDRanges, c.UID)
+	inDeniedUIDs = inDeniedUIDs || inDeniedUIDRanges
+	_, inAllowedGIDs := policy.allowedGIDs[c.GID]
+	_, inDeniedGIDs := policy.deniedGIDs[c.GID]
+
+	// select_policy_entry
+	entry := -1
+	if policy.entries.Count != 0 {
+		mask := (policy.entryCommands[command] | policy.entries.AnyCommand) &
+			(policy.entryUIDs[c.UID] | policy.entries.AnyUID) &
+			(policy.entryGIDs[c.GID] | policy.entries.AnyGID)
+		if c.InContainer {
+			mask &^= policy.entries.Host
+		} else {
+			mask &^= policy.entries.Container
+		}
+		if policy.entries.Count < POLICY_ENTRY_MAX {
+			mask &= (uint64(1) << policy.entries.Count) - 1
+		}
+		for i := 0; i < POLICY_ENTRY_MAX; i++ {
+			if mask&(uint64(1)<<uint(i)) != 0 {
+				entry = i
+				break
+			}
+		}
+	}
+
+	allowedDestination := false
+	if entry < 0 && policy.allowedCIDR.Contains(c.Addr) {
+		allowConnect = true
+		allowedDestination = true
+	}
+	if set, ok := policy.allowedProtocolCIDR[c.SockType]; entry < 0 && ok && set.Contains(c.Addr) {
+		allowConnect = true
+		allowedDestination = true
+	}
+	if inAllowedUIDs || policy.lists.AllowUID == 0 {
+		allowUID = true
+	}
+	if inAllowedGIDs || hasAllowGID == 0 {
+		allowGID = true
+	}
+	if inAllowedCommands || inAllowedCommandPatterns || inAllowedPaths || (policy.lists.AllowCommand == 0 && policy.lists.AllowCommandPattern == 0 && policy.lists.AllowPath == 0) {
+		allowCommand = true
+	}
+	monitoredCommand := false
+	if policy.lists.DenyCommand != 0 && inDeniedCommands && !monitorCommand {
+		allowCommand = false
+	} else if inDeniedCommandPatterns {
+		allowCommand = false
+	} else if policy.lists.DenyCommand != 0 && inDeniedCommands {
+		monitoredCommand = true
+	}
+	if policy.lists.DenyPath != 0 && inDeniedPaths {
+		allowCommand = false
+	}
+	if policy.lists.DenyUID != 0 && inDeniedUIDs {
+		allowUID = false
+	}
+	if policy.lists.DenyGID != 0 && inDeniedGIDs {
+		allowGID = false
+	}
+	_, inDeniedPorts := lookupPort(policy.deniedPorts, c.Port)
+	_, inAllowedPorts := lookupPort(policy.allowedPorts, c.Port)
+	deniedPort := policy.lists.DenyPort != 0 && inDeniedPorts
+	if deniedPort {
+		allowPort = false
+	}
+	if !deniedPort && policy.lists.AllowPort != 0 && !inAllowedPorts {
+		allowPort = false
+	}
+	// The deny list and its shards are all mirrored in deniedCIDR, and the entries of
+	// DENY_ENTRY_EXCEPT in exceptCIDR and of DENY_ENTRY_MONITOR in monitorCIDR too.
+	deniedDestination, exceptDestination, monitoredDestination := false, false, false
+	if n, _, ok := policy.deniedCIDR.Lookup(c.Addr); entry < 0 && ok {
+		_, exceptDestination = policy.exceptCIDR.Get(n)
+		_, monitoredDestination = policy.monitorCIDR.Get(n)
+		deniedDestination = !monitoredDestination
+	}
+	if set, ok := policy.deniedProtocolCIDR[c.SockType]; entry < 0 && ok && set.Contains(c.Addr) {
+		deniedDestination = true
+	}
+	if policy.precedence == PRECEDENCE_ALLOW_FIRST && allowedDestination && !exceptDestination {
+		deniedDestination = false
+		monitoredDestination = false
+	}
+	if deniedDestination {
+		allowConnect = false
+	}
+	if deniedDestination && !exceptDestination && (inAllowedCommands || inAllowedCommandPatterns || inAllowedPaths) {
+		allowConnect = true
+	}
+	if deniedDestination && !exceptDestination && inAllowedUIDs {
+		allowConnect = true
+	}
+	if deniedDestination && !exceptDestination && inAllowedGIDs {
+		allowConnect = true
+	}
+	if entry >= 0 {
+		tag := uint8(entry + 1)
+		allowed, denied := policy.allowedEntryCIDR[tag], policy.deniedEntryCIDR[tag]
+		if denied != nil && denied.Contains(c.Addr) {
+			allowConnect = false
+		} else if policy.entries.HasAllow&(uint64(1)<<uint(entry)) == 0 || (allowed != nil && allowed.Contains(c.Addr)) {
+			allowConnect = true
+		} else {
+			allowConnect = false
+		}
+	}
+
+	canAccess := allowConnect && allowUID && allowGID && allowCommand && allowPort
+	allowedSubject := inAllowedCommands || inAllowedCommandPatterns || inAllowedPaths || inAllowedUIDs || inAllowedGIDs
+	monitored := canAccess && ((monitoredDestination && !allowedSubject) || monitoredCommand)
+	return canAccess, monitored
+}
+
+// conformancePolicies are the policies of every combination of the lists.
+func conformancePolicies() []*Policy {
+	policies := []*Policy{}
+	for combination := 0; combination < 1<<10; combination++ {
+		has := func(bit int) bool { return combination&(1<<bit) != 0 }
+
+		policy := NewPolicy()
+		policy.SetModeAndTarget(MODE_BLOCK, TARGET_HOST)
+		policy.SetCommandCaseInsensitive(has(0))
+		for _, cidr := range []string{"10.0.0.0/8", "2001:db8::/32"} {
+			_, n, _ := net.ParseCIDR(cidr)
+			policy.AddCIDR(LIST_ALLOW_CIDR, PROTOCOL_ALL, n)
+		}
+		_, n, _ := net.ParseCIDR("203.0.113.0/24")
+		policy.AddCIDR(LIST_ALLOW_PROTOCOL_CIDR, UDP, n)
+		if has(1) {
+			_, n, _ := net.ParseCIDR("10.1.0.0/16")
+			policy.AddCIDR(LIST_DENY_CIDR, PROTOCOL_ALL, n)
+			_, n, _ = net.ParseCIDR("192.168.0.0/16")
+			policy.AddCIDR(LIST_DENY_CIDR, PROTOCOL_ALL, n)
+			_, n, _ = net.ParseCIDR("10.0.0.0/16")
+			policy.AddCIDR(LIST_DENY_PROTOCOL_CIDR, TCP, n)
+		}
+		// The path lists and the patterns come with the command lists, so that every
+		// combination of them is decided without multiplying the policies.
+		if has(2) {
+			policy.AddCommand(LIST_ALLOW_COMMAND, "curl")
+			if combination%3 != 0 {
+				policy.AddPath(LIST_ALLOW_PATH, "/usr/local/bin/")
+			}
+			if combination%4 == 1 {
+				policy.SetCommandPattern(LIST_ALLOW_COMMAND_PATTERN, 0, config.CommandPattern{Prefix: "wg"})
+			}
+		}
+		if has(3) {
+			policy.AddCommand(LIST_DENY_COMMAND, "wget")
+			if combination%5 != 0 {
+				policy.AddPath(LIST_DENY_PATH, "/usr/local/bin/nc")
+			}
+			if combination%6 == 1 {
+				policy.SetCommandPattern(LIST_DENY_COMMAND_PATTERN, 0, config.CommandPattern{Suffix: "url"})
+			}
+		}
+		if !has(2) && !has(3) && combination%9 == 0 {
+			policy.SetCommandPattern(LIST_DENY_COMMAND_PATTERN, 0, config.CommandPattern{Prefix: "n", Suffix: "c"})
+		}
+		if !has(2) && combination%7 == 0 {
+			policy.AddPath(LIST_ALLOW_PATH, "/usr/bin/curl")
+		}
+		if has(4) {
+			policy.AddID(LIST_ALLOW_UID, 1000)
+			if combination%3 == 1 {
+				for _, prefix := range UIDRangePrefixes(config.UIDRange{First: 1500, Last: 2999}) {
+					policy.AddUIDPrefix(LIST_ALLOW_UID_RANGE, prefix)
+				}
+			}
+		}
+		if has(5) {
+			policy.AddID(LIST_DENY_UID, 0)
+			if combination%4 == 3 {
+				for _, prefix := range UIDRangePrefixes(config.UIDRange{First: 1900, Last: 2100}) {
+					policy.AddUIDPrefix(LIST_DENY_UID_RANGE, prefix)
+				}
+			}
+		}
+		if has(6) {
+			policy.AddID(LIST_ALLOW_GID, 100)
+		}
+		if has(7) {
+			policy.AddID(LIST_DENY_GID, 200)
+		}
+		if has(8) {
+			for _, prefix := range PortRangePrefixes(config.PortRange{First: 443, Last: 443}) {
+				policy.AddPort(LIST_ALLOW_PORT, prefix)
+			}
+			for _, prefix := range PortRangePrefixes(config.PortRange{First: 8000, Last: 8999}) {
+				policy.AddPort(LIST_ALLOW_PORT, prefix)
+			}
+		}
+		if has(9) {
+			for _, prefix := range PortRangePrefixes(config.PortRange{First: 8080, Last: 8080}) {
+				policy.AddPort(LIST_DENY_PORT, prefix)
+			}
+		}
+		// The entries of network.policies come with a sample of the combinations.
+		if combination%5 == 2 || combination%11 == 3 {
+			entries := []config.PolicyEntryConfig{
+				{Name: "curl", Command: []string{"curl"}, CIDR: config.PolicyListsConfig{Allow: []string{"192.168.0.0/16"}, Deny: []string{"10.0.0.0/8"}}},
+				{Name: "deploy", UID: []uint{1000}, GID: []uint{300}, CIDR: config.PolicyListsConfig{Deny: []string{"203.0.113.0/24"}}},
+			}
+			if combination%11 == 3 {
+				entries = append(entries, config.PolicyEntryConfig{Name: "users", GID: []uint{100}, CIDR: config.PolicyListsConfig{Allow: []string{"2001:db8::/32"}}},
+					config.PolicyEntryConfig{Name: config.TARGET_HOST, Target: config.TARGET_HOST, CIDR: config.PolicyListsConfig{Deny: []string{"10.1.0.0/16"}}},
+					config.PolicyEntryConfig{Name: config.TARGET_CONTAINER, Target: config.TARGET_CONTAINER, CIDR: config.PolicyListsConfig{Allow: []string{"10.0.0.0/8"}}})
+			}
+			if err := loadPolicyEntries(policy, entries); err != nil {
+				panic(err)
+			}
+		}
+		policies = append(policies, withListSizes(policy))
+	}
+	return policies
+}
+
+// withListSizes sets the sizes of the lists of policy to the numbers of their entries, as
+// FromConfig does.
+func withListSizes(policy *Policy) *Policy {
+	policy.SetListSizes(ListSizes{
+		AllowCommand: uint32(len(policy.allowedCommands)),
+		AllowUID:     uint32(len(policy.allowedUIDs) + len(policy.allowedUIDRanges)),
+		AllowGID:     uint32(len(policy.allowedGIDs)),
+		DenyCommand:  uint32(len(policy.deniedCommands)),
+		DenyUID:      uint32(len(policy.deniedUIDs) + len(policy.deniedUIDRanges)),
+		DenyGID:      uint32(len(policy.deniedGIDs)),
+		AllowPort:    uint32(len(policy.allowedPorts)),
+		DenyPort:     uint32(len(policy.deniedPorts)),
+		AllowPath:    uint32(len(policy.allowedPaths)),
+		DenyPath:     uint32(len(policy.deniedPaths)),
+
+		AllowCommandPattern: uint32(len(policy.allowedCommandPatterns)),
+		DenyCommandPattern:  uint32(len(policy.deniedCommandPatterns)),
+	})
+	return policy
+}
+
+// conformanceConnections are connections to the addresses, with the commands, the uids and
+// the gids the lists of conformancePolicies have, and others.
+func conformanceConnections() []ConnInput {
+	connections := []ConnInput{}
+	for _, addr := range []string{"10.0.0.1", "10.1.0.1", "192.168.0.1", "203.0.113.1", "2001:db8::1"} {
+		for _, command := range []string{"curl", "CURL", "wget", "nc"} {
+			for _, uid := range []uint32{0, 1000, 2000} {
+				for _, gid := range []uint32{100, 200, 300} {
+					// The ports and the socket types cycle over the connections rather than multiply them.
+					port := []uint16{443, 8080, 8999, 22}[len(connections)%4]
+					sockType := []uint8{TCP, UDP}[len(connections)/4%2]
+					exe := []string{"/usr/bin/curl", "/usr/local/bin/nc", "/usr/local/bin/tool", ""}[len(connections)/8%4]
+					inContainer := len(connections)/32%2 == 1
+					connections = append(connections, ConnInput{Addr: net.ParseIP(addr), Port: port, Command: command, UID: uid, GID: gid, SockType: sockType, ExePath: exe, InContainer: inContainer})
+				}
+			}
+		}
+	}
+	return connections
+}
+
+func TestEvaluateConformsToSocketConnect(t *testing.T) {
+	decisions, denied := 0, 0
+	for i, policy := range conformancePolicies() {
+		for _, c := range conformanceConnections() {
+			permitted := socketConnect(policy, c)
+			decision, steps := policy.Trace(c)
+			if !assert.Equal(t, !permitted, decision.Denied, fmt.Sprintf("policy %010b, %+v", i, c)) {
+				return
+			}
+			assert.Equal(t, policy.Evaluate(c), decision)
+			assert.Equal(t, "verdict", steps[len(steps)-2].Check)
+			decisions++
+			if !permitted {
+				denied++
+			}
+		}
+	}
+	// The corpus has both decisions, in every combination of the lists.
+	assert.Equal(t, 1024*len(conformanceConnections()), decisions)
+	assert.True(t, denied > 0 && denied < decisions)
+}
+
+func TestEvaluateConformsToSocketConnectWithFamilies(t *testing.T) {
+	policies := conformancePolicies()
+	for disabled := uint32(0); disabled <= FAMILY_IPV4|FAMILY_IPV6; disabled++ {
+		for _, audit := range []bool{false, true} {
+			// Every combination of the families and a sample of the lists.
+			for i := 0; i < len(policies); i += 31 {
+				policy := policies[i]
+				baseline := map[int]Decision{}
+				for j, c := range conformanceConnections() {
+					baseline[j] = policy.Evaluate(c)
+				}
+				policy.SetFamilies(disabled, audit)
+
+				for j, c := range conformanceConnections() {
+					message := fmt.Sprintf("policy %010b, families %02b, audit %t, %+v", i, disabled, audit, c)
+					decision, steps := policy.Trace(c)
+					if !assert.Equal(t, !socketConnect(policy, c), decision.Denied, message) {
+						return
+					}
+					if disabled&FamilyOf(c.Addr) == 0 {
+						// The families that are restricted are decided as if both were.
+						assert.Equal(t, baseline[j], decision, message)
+						continue
+					}
+					assert.Equal(t, Decision{Audited: audit}, decision, message)
+					assert.Equal(t, TraceStep{Check: "scope.families", Result: TRACE_OUT_OF_SCOPE}, steps[len(steps)-1], message)
+				}
+				policy.SetFamilies(0, false)
+			}
+		}
+	}
+}
+
+func TestEvaluateConformsToSocketConnectWithDefaultAndPrecedence(t *testing.T) {
+	policies := conformancePolicies()
+	for _, defaultAction := range []uint32{DEFAULT_ACTION_DENY, DEFAULT_ACTION_ALLOW} {
+		for _, precedence := range []uint32{PRECEDENCE_DENY_FIRST, PRECEDENCE_ALLOW_FIRST} {
+			for i := 0; i < len(policies); i += 7 {
+				policy := policies[i]
+				policy.SetDefaultAndPrecedence(defaultAction, precedence)
+				for _, c := range conformanceConnections() {
+					message := fmt.Sprintf("policy %010b, default %d, precedence %d, %+v", i, defaultAction, precedence, c)
+					if !assert.Equal(t, !socketConnect(policy, c), policy.Evaluate(c).Denied, message) {
+						return
+					}
+				}
+				policy.SetDefaultAndPrecedence(DEFAULT_ACTION_DENY, PRECEDENCE_DENY_FIRST)
+			}
+		}
+	}
+}
+
+func TestEvaluateConformsToSocketConnectWithExcepts(t *testing.T) {
+	policies := conformancePolicies()
+	for i := 0; i < len(policies); i += 5 {
+		policy := policies[i]
+		// 10.0.0.0/24 is inside the allow list, 10.1.0.0/17 inside a deny prefix.
+		for _, cidr := range []string{"10.0.0.0/24", "10.1.0.0/17"} {
+			_, n, _ := net.ParseCIDR(cidr)
+			policy.AddCIDR(LIST_DENY_CIDR, PROTOCOL_ALL, n)
+			policy.AddCIDR(LIST_DENY_EXCEPT_CIDR, PROTOCOL_ALL, n)
+		}
+		for _, precedence := range []uint32{PRECEDENCE_DENY_FIRST, PRECEDENCE_ALLOW_FIRST} {
+			policy.SetDefaultAndPrecedence(DEFAULT_ACTION_DENY, precedence)
+			for _, c := range conformanceConnections() {
+				message := fmt.Sprintf("policy %010b, precedence %d, %+v", i, precedence, c)
+				if !assert.Equal(t, !socketConnect(policy, c), policy.Evaluate(c).Denied, message) {
+					return
+				}
+				if c.Addr.Equal(net.ParseIP("10.0.0.1")) && policy.PolicyEntry(c) == "" {
+					assert.Equal(t, "network.cidr.allow_except 10.0.0.0/24", policy.Evaluate(c).Rule, message)
+				}
+			}
+		}
+	}
+}
+
+func TestEvaluateConformsToSocketConnectWithMonitors(t *testing.T) {
+	policies := conformancePolicies()
+	monitored := 0
+	for i := 0; i < len(policies); i += 3 {
+		policy := policies[i]
+		// 10.1.0.0/16 is in the deny list of half the policies, and 10.0.0.0/24 inside the allow list.
+		for _, cidr := range []string{"10.1.0.0/16", "10.0.0.0/24"} {
+			_, n, _ := net.ParseCIDR(cidr)
+			policy.AddCIDR(LIST_DENY_CIDR, PROTOCOL_ALL, n)
+			policy.AddCIDR(LIST_DENY_MONITOR_CIDR, PROTOCOL_ALL, n)
+		}
+		policy.AddCommand(LIST_DENY_MONITOR_COMMAND, "wget")
+		for _, precedence := range []uint32{PRECEDENCE_DENY_FIRST, PRECEDENCE_ALLOW_FIRST} {
+			policy.SetDefaultAndPrecedence(DEFAULT_ACTION_DENY, precedence)
+			for _, c := range conformanceConnections() {
+				message := fmt.Sprintf("policy %010b, precedence %d, %+v", i, precedence, c)
+				permitted, reported := handleSocketConnect(policy, c)
+				decision := policy.Evaluate(c)
+				if !assert.Equal(t, !permitted, decision.Denied, message) || !assert.Equal(t, reported, decision.Monitored, message) {
+					return
+				}
+				if decision.Monitored {
+					monitored++
+					assert.True(t, decision.Audited, message)
+					assert.False(t, decision.Blocked, message)
+				}
+			}
+		}
+	}
+	assert.True(t, monitored > 0)
+}
+
+func TestMonitoredEntries(t *testing.T) {
+	policy := NewPolicy()
+	policy.SetModeAndTarget(MODE_BLOCK, TARGET_HOST)
+	_, n, _ := net.ParseCIDR("10.0.0.0/8")
+	policy.AddCIDR(LIST_ALLOW_CIDR, PROTOCOL_ALL, n)
+	_, n, _ = net.ParseCIDR("10.1.0.0/16")
+	policy.AddCIDR(LIST_DENY_CIDR, PROTOCOL_ALL, n)
+	policy.AddCommand(LIST_DENY_COMMAND, "wget")
+	withListSizes(policy)
+	digest := policy.Digest()
+
+	policy.AddCIDR(LIST_DENY_MONITOR_CIDR, PROTOCOL_ALL, n)
+	policy.AddCommand(LIST_DENY_MONITOR_COMMAND, "wget")
+	assert.NotEqual(t, digest, policy.Digest())
+
+	// The connection a deny entry in mode: monitor would have denied is permitted and reported.
+	decision, steps := policy.Trace(ConnInput{Addr: net.ParseIP("10.1.0.1"), Command: "wget"})
+	assert.Equal(t, Decision{Audited: true, Monitored: true, Rule: "network.cidr.deny 10.1.0.0/16"}, decision)
+	assert.Equal(t, "cidr.deny: monitored (network.cidr.deny 10.1.0.0/16)", steps[6].String())
+	assert.Equal(t, "command.deny: monitored (network.command.deny wget)", steps[9].String())
+	assert.Equal(t, "verdict: monitored", steps[19].String())
+
+	// A connection another list denies is not.
+	decision = policy.Evaluate(ConnInput{Addr: net.ParseIP("192.168.0.1"), Command: "wget"})
+	assert.Equal(t, Decision{Audited: true, Denied: true, Blocked: true, Rule: "network.cidr.allow does not list 192.168.0.1"}, decision)
+
+	policy.DeleteCIDR(LIST_DENY_MONITOR_CIDR, PROTOCOL_ALL, n)
+	policy.DeleteCommand(LIST_DENY_MONITOR_COMMAND, "wget")
+	assert.Equal(t, digest, policy.Digest())
+}
+
+func TestTargetEntries(t *testing.T) {
+	conf := config.DefaultConfig()
+	conf.RestrictedNetworkConfig.Mode = "block"
+	conf.RestrictedNetworkConfig.Target = "all"
+	conf.RestrictedNetworkConfig.Policies = []config.PolicyEntryConfig{
+		{Name: "curl", Command: []string{"curl"}, CIDR: config.PolicyListsConfig{Allow: []string{"10.1.0.0/16"}}},
+	}
+	conf.RestrictedNetworkConfig.Host.CIDR.Allow = []string{"10.2.0.0/16"}
+	conf.RestrictedNetworkConfig.Container.CIDR.Allow = []string{"10.3.0.0/16"}
+	policy, err := FromConfig(conf)
+	assert.Nil(t, err)
+
+	host := ConnInput{Addr: net.ParseIP("10.2.0.1"), Command: "wget"}
+	container := ConnInput{Addr: net.ParseIP("10.2.0.1"), Command: "wget", InContainer: true}
+	assert.Equal(t, "network.host", policy.PolicyEntry(host))
+	assert.False(t, policy.Evaluate(host).Denied)
+	assert.Equal(t, "network.container", policy.PolicyEntry(container))
+	assert.True(t, policy.Evaluate(container).Denied)
+
+	// An entry of network.policies comes first, inside a container or not.
+	container.Command = "curl"
+	assert.Equal(t, "network.policies[curl]", policy.PolicyEntry(container))
+}
+
+func TestDefaultAndPrecedence(t *testing.T) {
+	policy := NewPolicy()
+	policy.SetModeAndTarget(MODE_BLOCK, TARGET_HOST)
+	_, n, _ := net.ParseCIDR("10.0.0.0/8")
+	policy.AddCIDR(LIST_ALLOW_CIDR, PROTOCOL_ALL, n)
+	_, n, _ = net.ParseCIDR("10.1.0.0/16")
+	policy.AddCIDR(LIST_DENY_CIDR, PROTOCOL_ALL, n)
+	digest := policy.Digest()
+
+	both := ConnInput{Addr: net.ParseIP("10.1.0.1"), Command: "curl"}
+	unlisted := ConnInput{Addr: net.ParseIP("192.168.0.1"), Command: "curl"}
+	assert.Equal(t, "network.cidr.deny 10.1.0.0/16", policy.Evaluate(both).Rule)
+	assert.Equal(t, "network.cidr.allow does not list 192.168.0.1", policy.Evaluate(unlisted).Rule)
+
+	policy.SetDefaultAndPrecedence(DEFAULT_ACTION_ALLOW, PRECEDENCE_ALLOW_FIRST)
+	assert.NotEqual(t, digest, policy.Digest())
+	decision, steps := policy.Trace(both)
+	assert.False(t, decision.Denied)
+	assert.Equal(t, TraceStep{Check: "precedence.allow_first", Result: TRACE_PERMIT}, steps[5])
+	assert.Equal(t, TraceStep{Check: "cidr.deny", Result: TRACE_PASS}, steps[6])
+	decision, steps = policy.Trace(unlisted)
+	assert.False(t, decision.Denied)
+	assert.Equal(t, TraceStep{Check: "cidr.allow", Result: TRACE_PASS}, steps[13])
+
+	policy.SetDefaultAndPrecedence(DEFAULT_ACTION_DENY, PRECEDENCE_DENY_FIRST)
+	assert.Equal(t, digest, policy.Digest())
+}
+
+func TestFamiliesChangeTheDigest(t *testing.T) {
+	policy := NewPolicy()
+	policy.SetModeAndTarget(MODE_BLOCK, TARGET_HOST)
+	digest := policy.Digest()
+
+	policy.SetFamilies(FAMILY_IPV6, false)
+	ipv4Only := policy.Digest()
+	assert.NotEqual(t, digest, ipv4Only)
+	policy.SetFamilies(FAMILY_IPV6, true)
+	assert.NotEqual(t, ipv4Only, policy.Digest())
+	policy.SetFamilies(0, false)
+	assert.Equal(t, digest, policy.Digest())
+}
+
+func TestTraceFollowsTheEvaluationOrder(t *testing.T) {
+	policy := NewPolicy()
+	policy.SetModeAndTarget(MODE_MONITOR, TARGET_HOST)
+	_, n, _ := net.ParseCIDR("10.0.0.0/8")
+	policy.AddCIDR(LIST_ALLOW_CIDR, PROTOCOL_ALL, n)
+	_, n, _ = net.ParseCIDR("10.1.0.0/16")
+	policy.AddCIDR(LIST_DENY_CIDR, PROTOCOL_ALL, n)
+	policy.AddCommand(LIST_ALLOW_COMMAND, "curl")
+	policy.AddCommand(LIST_DENY_COMMAND, "wget")
+	withListSizes(policy)
+
+	// An allowed command overrides the denied destination.
+	decision, steps := policy.Trace(ConnInput{Addr: net.ParseIP("10.1.0.1"), Command: "curl"})
+	assert.Equal(t, Decision{Audited: true}, decision)
+	assert.Equal(t, []TraceStep{
+		{Check: "scope.target", Result: TRACE_SKIPPED},
+		{Check: "scope.families", Result: TRACE_SKIPPED},
+		{Check: "command.case_insensitive", Result: TRACE_SKIPPED},
+		{Check: "policies.select", Result: TRACE_SKIPPED},
+		{Check: "cidr.allow_except", Result: TRACE_SKIPPED},
+		{Check: "precedence.allow_first", Result: TRACE_SKIPPED},
+		{Check: "cidr.deny", Result: TRACE_DENY, Rule: "network.cidr.deny 10.1.0.0/16"},
+		{Check: "cidr.deny.override", Result: TRACE_PERMIT},
+		{Check: "policies.deny", Result: TRACE_SKIPPED},
+		{Check: "command.deny", Result: TRACE_PASS},
+		{Check: "uid.deny", Result: TRACE_SKIPPED},
+		{Check: "gid.deny", Result: TRACE_SKIPPED},
+		{Check: "port.deny", Result: TRACE_SKIPPED},
+		{Check: "cidr.allow", Result: TRACE_PASS},
+		{Check: "policies.allow", Result: TRACE_SKIPPED},
+		{Check: "command.allow", Result: TRACE_PERMIT},
+		{Check: "uid.allow", Result: TRACE_SKIPPED},
+		{Check: "gid.allow", Result: TRACE_SKIPPED},
+		{Check: "port.allow", Result: TRACE_SKIPPED},
+		{Check: "verdict", Result: TRACE_PERMIT},
+		{Check: "mode", Result: "monitor"},
+	}, steps)
+
+	// The first denial that stands is the rule.
+	decision, steps = policy.Trace(ConnInput{Addr: net.ParseIP("192.168.0.1"), Command: "wget"})
+	assert.Equal(t, "network.command.deny wget", decision.Rule)
+	assert.True(t, decision.DenyListed)
+	assert.Equal(t, "command.deny: deny (network.command.deny wget)", steps[9].String())
+	assert.Equal(t, "cidr.allow: deny (network.cidr.allow does not list 192.168.0.1)", steps[13].String())
+	assert.Equal(t, "verdict: deny", steps[19].String())
+
+	// The connections out of the target are not evaluated further.
+	policy.SetModeAndTarget(MODE_BLOCK, TARGET_CONTAINER)
+	decision, steps = policy.Trace(ConnInput{Addr: net.ParseIP("192.168.0.1"), Command: "wget"})
+	assert.Equal(t, Decision{}, decision)
+	assert.Equal(t, []TraceStep{{Check: "scope.target", Result: TRACE_OUT_OF_SCOPE}}, steps)
+}
@@ -0,0 +1,46 @@
+package policy
+
+import (
+	"net"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+)
+
+// The values of the entries of the deny CIDR lists. socket_connect lets neither an allow list
+// nor an allowed subject override an entry of DENY_ENTRY_EXCEPT: a prefix of
+// network.cidr.allow_except, or a deny prefix inside one, which the longest prefix match of the
+// list finds before it. An entry of DENY_ENTRY_MONITOR, which the command deny list has too,
+// never denies, see MonitoredEntry.
+const (
+	DENY_ENTRY_DENY    = 0
+	DENY_ENTRY_EXCEPT  = 1
+	DENY_ENTRY_MONITOR = 2
+)
+
+// ExceptPrefixes returns the prefixes of network.cidr.allow_except. The entries that can not be
+// parsed are left out, as writing the maps rejects them.
+func ExceptPrefixes(network config.RestrictedNetworkConfig) []*net.IPNet {
+	prefixes := []*net.IPNet{}
+	for _, entry := range network.CIDR.AllowExcept {
+		if n, _, err := ParseCIDR(entry); err == nil {
+			prefixes = append(prefixes, n)
+		}
+	}
+	return prefixes
+}
+
+// InsideExcept reports whether every address of n is in a prefix of excepts, so that the deny
+// entry n is written with DENY_ENTRY_EXCEPT.
+func InsideExcept(n *net.IPNet, excepts []*net.IPNet) bool {
+	return InsidePrefixes(n, excepts)
+}
+
+// InsidePrefixes reports whether every address of n is in a prefix of prefixes.
+func InsidePrefixes(n *net.IPNet, prefixes []*net.IPNet) bool {
+	for _, prefix := range prefixes {
+		if config.PrefixInside(n, prefix) {
+			return true
+		}
+	}
+	return false
+}
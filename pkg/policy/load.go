@@ -0,0 +1,233 @@
+package policy
+
+import (
+	"fmt"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/errkind"
+)
+
+// cidrList is a CIDR list of the config, and the list of the Policy it is written to.
+type cidrList struct {
+	name     string
+	list     List
+	protocol uint8
+	entries  []string
+}
+
+// LoadPolicy parses the YAML of a config file and returns the Policy its network rules are
+// written to the maps as, as FromConfig does.
+func LoadPolicy(data []byte) (*Policy, error) {
+	conf, err := config.Parse(data)
+	if err != nil {
+		return nil, err
+	}
+	return FromConfig(conf)
+}
+
+// FromConfig returns the Policy the network rules of conf are written to the maps as. The
+// addresses of network.domain and of the rule sets are resolved or downloaded by the Manager, and
+// are not part of it: a connection to them is evaluated as a connection to any other address.
+func FromConfig(conf *config.Config) (*Policy, error) {
+	network := conf.RestrictedNetworkConfig
+	p := NewPolicy()
+
+	mode, target := MODE_MONITOR, TARGET_HOST
+	if conf.IsRestrictedMode("network") {
+		mode = MODE_BLOCK
+	}
+	if conf.IsOnlyContainer("network") {
+		target = TARGET_CONTAINER
+	} else if conf.ClassifiesContainers("network") {
+		target = TARGET_ALL
+	}
+	p.SetModeAndTarget(mode, target)
+	p.SetCommandCaseInsensitive(network.Command.CaseInsensitive)
+	p.SetFamilies(DisabledFamilies(network), network.OtherFamilies == config.OTHER_FAMILIES_AUDIT)
+	p.SetDefaultAndPrecedence(DefaultAndPrecedence(network))
+
+	cidrs := []cidrList{
+		{"network.cidr.allow", LIST_ALLOW_CIDR, PROTOCOL_ALL, network.CIDR.Allow},
+		{"network.cidr.deny", LIST_DENY_CIDR, PROTOCOL_ALL, network.CIDR.Deny},
+		{"network.cidr.allow_except", LIST_DENY_CIDR, PROTOCOL_ALL, network.CIDR.AllowExcept},
+	}
+	for _, protocol := range RuleProtocols {
+		allow, deny := config.ProtocolLists(network.CIDR.Protocols, protocol)
+		cidrs = append(cidrs,
+			cidrList{fmt.Sprintf("network.cidr.protocols[%s].allow", protocol), LIST_ALLOW_PROTOCOL_CIDR, ProtocolSockType(protocol), allow},
+			cidrList{fmt.Sprintf("network.cidr.protocols[%s].deny", protocol), LIST_DENY_PROTOCOL_CIDR, ProtocolSockType(protocol), deny},
+		)
+	}
+	cidrs = append(cidrs,
+		cidrList{"network.ingress.cidr.allow", LIST_INGRESS_ALLOW_CIDR, PROTOCOL_ALL, network.Ingress.CIDR.Allow},
+		cidrList{"network.ingress.cidr.deny", LIST_INGRESS_DENY_CIDR, PROTOCOL_ALL, network.Ingress.CIDR.Deny},
+	)
+	groups := map[string]string{}
+	for _, cidrs := range cidrs {
+		for _, entry := range cidrs.entries {
+			n, _, err := ParseCIDR(entry)
+			if err != nil {
+				return nil, errkind.Errorf(errkind.Config, "%s: %w", cidrs.name, err)
+			}
+			p.AddCIDR(cidrs.list, cidrs.protocol, n)
+			if cidrs.list == LIST_DENY_CIDR {
+				if group := conf.EntryGroup("network.cidr.deny", entry); group != "" {
+					groups[n.String()] = group
+				}
+			}
+		}
+	}
+	// A prefix that is also written directly in network.cidr.deny is not named after a group.
+	for _, entry := range network.CIDR.Deny {
+		if n, _, err := ParseCIDR(entry); err == nil && conf.EntryGroup("network.cidr.deny", entry) == "" {
+			delete(groups, n.String())
+		}
+	}
+	p.SetDeniedGroups(groups)
+	excepts := ExceptPrefixes(network)
+	monitored, denied := MonitorPrefixes(network)
+	for _, n := range p.deniedCIDR.Prefixes() {
+		if InsideExcept(n, excepts) {
+			p.AddCIDR(LIST_DENY_EXCEPT_CIDR, PROTOCOL_ALL, n)
+		}
+		if MonitoredEntry(n, monitored, denied) {
+			p.AddCIDR(LIST_DENY_MONITOR_CIDR, PROTOCOL_ALL, n)
+		}
+	}
+
+	for _, commands := range []struct {
+		list        List
+		patternList List
+		entries     []string
+	}{
+		{LIST_ALLOW_COMMAND, LIST_ALLOW_COMMAND_PATTERN, network.Command.Allow},
+		{LIST_DENY_COMMAND, LIST_DENY_COMMAND_PATTERN, network.Command.Deny},
+	} {
+		exact, patterns := config.SplitCommands(commands.entries)
+		for _, command := range exact {
+			p.AddCommand(commands.list, command)
+		}
+		for i, pattern := range patterns {
+			p.SetCommandPattern(commands.patternList, uint32(i), pattern)
+		}
+	}
+	for key := range MonitoredCommands(network) {
+		if _, ok := p.deniedCommands[key]; ok {
+			p.AddCommand(LIST_DENY_MONITOR_COMMAND, key)
+		}
+	}
+	for _, path := range network.Command.AllowPaths {
+		p.AddPath(LIST_ALLOW_PATH, path)
+	}
+	for _, path := range network.Command.DenyPaths {
+		p.AddPath(LIST_DENY_PATH, path)
+	}
+	for _, uids := range []struct {
+		list      List
+		rangeList List
+		entries   []string
+	}{
+		{LIST_ALLOW_UID, LIST_ALLOW_UID_RANGE, network.UID.Allow},
+		{LIST_DENY_UID, LIST_DENY_UID_RANGE, network.UID.Deny},
+	} {
+		ids, ranges := config.SplitUIDs(uids.entries)
+		for _, id := range ids {
+			p.AddID(uids.list, uint32(id))
+		}
+		for _, r := range ranges {
+			for _, prefix := range UIDRangePrefixes(r) {
+				p.AddUIDPrefix(uids.rangeList, prefix)
+			}
+		}
+	}
+	for _, ids := range []struct {
+		list    List
+		entries []string
+	}{
+		{LIST_ALLOW_GID, network.GID.Allow},
+		{LIST_DENY_GID, network.GID.Deny},
+	} {
+		for _, id := range config.GIDs(ids.entries) {
+			p.AddID(ids.list, uint32(id))
+		}
+	}
+
+	for _, ports := range []struct {
+		name    string
+		list    List
+		entries []string
+	}{
+		{"network.ports.allow", LIST_ALLOW_PORT, network.Ports.Allow},
+		{"network.ports.deny", LIST_DENY_PORT, network.Ports.Deny},
+		{"network.ingress.ports.allow", LIST_INGRESS_ALLOW_PORT, network.Ingress.Ports.Allow},
+		{"network.ingress.ports.deny", LIST_INGRESS_DENY_PORT, network.Ingress.Ports.Deny},
+	} {
+		for _, entry := range ports.entries {
+			r, err := config.ParsePortRange(entry)
+			if err != nil {
+				return nil, errkind.Errorf(errkind.Config, "%s: %w", ports.name, err)
+			}
+			for _, prefix := range PortRangePrefixes(r) {
+				p.AddPort(ports.list, prefix)
+			}
+		}
+	}
+
+	if err := loadPolicyEntries(p, network.PolicyEntries()); err != nil {
+		return nil, err
+	}
+
+	// The sizes in the config map are the numbers of entries written to each list.
+	p.SetListSizes(ListSizes{
+		AllowCommand:        uint32(len(p.allowedCommands)),
+		AllowUID:            uint32(len(p.allowedUIDs) + len(p.allowedUIDRanges)),
+		AllowGID:            uint32(len(p.allowedGIDs)),
+		DenyCommand:         uint32(len(p.deniedCommands)),
+		DenyUID:             uint32(len(p.deniedUIDs) + len(p.deniedUIDRanges)),
+		DenyGID:             uint32(len(p.deniedGIDs)),
+		AllowPort:           uint32(len(p.allowedPorts)),
+		DenyPort:            uint32(len(p.deniedPorts)),
+		IngressAllowCIDR:    uint32(p.ingressAllowedCIDR.Len()),
+		IngressAllowPort:    uint32(len(p.ingressAllowedPorts)),
+		IngressDenyPort:     uint32(len(p.ingressDeniedPorts)),
+		AllowPath:           uint32(len(p.allowedPaths)),
+		DenyPath:            uint32(len(p.deniedPaths)),
+		AllowCommandPattern: uint32(len(p.allowedCommandPatterns)),
+		DenyCommandPattern:  uint32(len(p.deniedCommandPatterns)),
+	})
+	return p, nil
+}
+
+// loadPolicyEntries writes the entries of network.policies to p: their CIDRs to the entry lists,
+// by EntryTag, and the masks of their selectors.
+func loadPolicyEntries(p *Policy, entries []config.PolicyEntryConfig) error {
+	names := make([]string, 0, len(entries))
+	for i, entry := range entries {
+		names = append(names, entry.Name)
+		for _, cidrs := range []cidrList{
+			{entry.Key() + ".cidr.allow", LIST_ALLOW_ENTRY_CIDR, EntryTag(i), entry.CIDR.Allow},
+			{entry.Key() + ".cidr.deny", LIST_DENY_ENTRY_CIDR, EntryTag(i), entry.CIDR.Deny},
+		} {
+			for _, e := range cidrs.entries {
+				n, _, err := ParseCIDR(e)
+				if err != nil {
+					return errkind.Errorf(errkind.Config, "%s: %w", cidrs.name, err)
+				}
+				p.AddCIDR(cidrs.list, cidrs.protocol, n)
+			}
+		}
+	}
+
+	masks, commands, uids, gids := EntryMasks(entries)
+	for command, mask := range commands {
+		p.SetEntryCommand(command, mask)
+	}
+	for uid, mask := range uids {
+		p.SetEntryID(LIST_ENTRY_UID, uid, mask)
+	}
+	for gid, mask := range gids {
+		p.SetEntryID(LIST_ENTRY_GID, gid, mask)
+	}
+	p.SetPolicyEntries(masks, names)
+	return nil
+}
@@ -0,0 +1,86 @@
+package policy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/errkind"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadPolicy(t *testing.T) {
+	p, err := LoadPolicy([]byte(`
+groups:
+  corp-proxies:
+    cidr: [10.0.1.0/24]
+network:
+  mode: block
+  target: container
+  cidr:
+    allow: [0.0.0.0/0]
+    deny: [group:corp-proxies, 192.0.2.0/24, "@cloud-metadata"]
+  command:
+    allow: [curl, curl]
+  ports:
+    allow: [8000-8999]
+  ingress:
+    cidr:
+      allow: [127.0.0.0/8, "::1/128"]
+`))
+	assert.Nil(t, err)
+
+	s := p.Snapshot()
+	assert.Equal(t, MODE_BLOCK, s.Mode)
+	assert.Equal(t, TARGET_CONTAINER, s.Target)
+	assert.Equal(t, []string{"10.0.1.0/24", "100.100.100.200/32", "169.254.169.254/32", "192.0.2.0/24", "fd00:ec2::254/128"}, s.CIDR.Deny)
+	assert.True(t, s.HasIngressRules())
+	// The sizes are the numbers of keys, a port range being written as its prefixes.
+	assert.Equal(t, ListSizes{AllowCommand: 1, AllowPort: 6, IngressAllowCIDR: 2}, p.lists)
+
+	decision := p.Evaluate(ConnInput{Addr: net.ParseIP("10.0.1.1"), Port: 8080, Command: "wget", InContainer: true})
+	assert.Equal(t, "network.cidr.deny 10.0.1.0/24 (group:corp-proxies)", decision.Rule)
+	decision = p.Evaluate(ConnInput{Addr: net.ParseIP("169.254.169.254"), Port: 80, Command: "wget", InContainer: true})
+	assert.Equal(t, "network.cidr.deny 169.254.169.254/32 (@cloud-metadata)", decision.Rule)
+	// The hosts are out of the target.
+	assert.Equal(t, Decision{}, p.Evaluate(ConnInput{Addr: net.ParseIP("10.0.1.1"), Port: 8080, Command: "curl"}))
+}
+
+func TestLoadPolicyErrors(t *testing.T) {
+	_, err := LoadPolicy([]byte("network:\n  cidr:\n    allow: [10.0.0.0/33]\n"))
+	assert.NotNil(t, err)
+	assert.Equal(t, errkind.Config, errkind.KindOf(err))
+
+	conf := config.DefaultConfig()
+	conf.RestrictedNetworkConfig.Ingress.Ports.Deny = []string{"http"}
+	_, err = FromConfig(conf)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "network.ingress.ports.deny")
+}
+
+func TestLoadPolicyCommandPatterns(t *testing.T) {
+	p, err := LoadPolicy([]byte(`
+network:
+  mode: block
+  cidr:
+    allow: [0.0.0.0/0]
+  command:
+    case_insensitive: true
+    allow: [curl, Python*, "*-agent", kubernetes-control*]
+    deny: [python2*]
+`))
+	assert.Nil(t, err)
+
+	// The patterns that fill the comm are commands.
+	assert.Equal(t, ListSizes{AllowCommand: 2, DenyCommand: 0, AllowCommandPattern: 2, DenyCommandPattern: 1}, p.lists)
+	assert.Equal(t, []string{"*-agent", "curl", "kubernetes-cont", "python*"}, p.Snapshot().Command.Allow)
+
+	assert.Equal(t, "network.command.allow python*", p.CommandPattern("Python3"))
+	assert.Equal(t, "network.command.deny python2*", p.CommandPattern("python2.7"))
+	assert.Equal(t, "", p.CommandPattern("curl"))
+	assert.Equal(t, "", p.CommandPattern("wget"))
+
+	assert.False(t, p.Evaluate(ConnInput{Addr: net.ParseIP("192.0.2.1"), Command: "node-agent"}).Denied)
+	decision := p.Evaluate(ConnInput{Addr: net.ParseIP("192.0.2.1"), Command: "python2.7"})
+	assert.Equal(t, "network.command.deny python2*", decision.Rule)
+}
@@ -0,0 +1,64 @@
+package policy
+
+import (
+	"net"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+)
+
+// MonitorPrefixes returns the prefixes of network.cidr.monitor, and denied the prefixes of
+// network.cidr.deny and allow_except that are not in it, which deny whatever mode: monitor.
+// The entries that can not be parsed are left out, as writing the maps rejects them.
+func MonitorPrefixes(network config.RestrictedNetworkConfig) (monitored, denied []*net.IPNet) {
+	monitored = []*net.IPNet{}
+	keys := map[string]struct{}{}
+	for _, entry := range network.CIDR.Monitor {
+		if n, _, err := ParseCIDR(entry); err == nil {
+			monitored = append(monitored, n)
+			keys[n.String()] = struct{}{}
+		}
+	}
+	denied = ExceptPrefixes(network)
+	for _, entry := range network.CIDR.Deny {
+		n, _, err := ParseCIDR(entry)
+		if err != nil {
+			continue
+		}
+		if _, ok := keys[n.String()]; !ok {
+			denied = append(denied, n)
+		}
+	}
+	return monitored, denied
+}
+
+// MonitoredEntry reports whether the deny entry n is written with DENY_ENTRY_MONITOR: it is a
+// prefix of monitored, and no prefix of denied has every address of it, as a monitored entry
+// the longest prefix match finds must not hide a deny entry.
+func MonitoredEntry(n *net.IPNet, monitored, denied []*net.IPNet) bool {
+	for _, m := range monitored {
+		if m.String() == n.String() {
+			return !InsidePrefixes(n, denied)
+		}
+	}
+	return false
+}
+
+// MonitoredCommands returns the keys of the commands of network.command.deny written with
+// DENY_ENTRY_MONITOR: the ones of network.command.monitor, unless a command of the deny list
+// that is not in it has the same key once truncated.
+func MonitoredCommands(network config.RestrictedNetworkConfig) map[string]struct{} {
+	monitored := map[string]struct{}{}
+	for _, command := range network.Command.Monitor {
+		monitored[string(CommandKey(command))] = struct{}{}
+	}
+	names := map[string]struct{}{}
+	for _, command := range network.Command.Monitor {
+		names[command] = struct{}{}
+	}
+	for _, command := range network.Command.Deny {
+		if _, ok := names[command]; !ok {
+			delete(monitored, string(CommandKey(command)))
+		}
+	}
+	return monitored
+}
@@ -0,0 +1,79 @@
+package policy
+
+import (
+	"sort"
+	"strings"
+)
+
+// EXE_PATH_LEN is the size of the path of an executable in the path lists, NUL included: the
+// largest key an LPM trie has room for.
+const EXE_PATH_LEN = 256
+
+// IsPathPrefix reports whether the path rule matches every executable below it, e.g.
+// /usr/local/bin/, rather than a single executable.
+func IsPathPrefix(rule string) bool {
+	return strings.HasSuffix(rule, "/")
+}
+
+// MatchPath reports whether the path rule matches the executable exe, as the path lists do.
+func MatchPath(rule, exe string) bool {
+	if exe == "" {
+		return false
+	}
+	if IsPathPrefix(rule) {
+		return strings.HasPrefix(exe, rule)
+	}
+	return rule == exe
+}
+
+// lookupPath returns the longest rule of set that matches exe, as an LPM trie looks it up.
+func lookupPath(set map[string]struct{}, exe string) (string, bool) {
+	match, found := "", false
+	for rule := range set {
+		if MatchPath(rule, exe) && (!found || len(rule) > len(match)) {
+			match, found = rule, true
+		}
+	}
+	return match, found
+}
+
+func (p *Policy) pathSet(list List) map[string]struct{} {
+	switch list {
+	case LIST_ALLOW_PATH:
+		return p.allowedPaths
+	case LIST_DENY_PATH:
+		return p.deniedPaths
+	default:
+		return nil
+	}
+}
+
+func (p *Policy) AddPath(list List, path string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if paths := p.pathSet(list); paths != nil {
+		paths[path] = struct{}{}
+		p.changed()
+	}
+}
+
+func (p *Policy) DeletePath(list List, path string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	paths := p.pathSet(list)
+	if _, ok := paths[path]; ok {
+		delete(paths, path)
+		p.changed()
+	}
+}
+
+func pathStrings(set map[string]struct{}) []string {
+	result := make([]string, 0, len(set))
+	for path := range set {
+		result = append(result, path)
+	}
+	sort.Strings(result)
+	return result
+}
@@ -0,0 +1,96 @@
+package policy
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+)
+
+// COMMAND_PATTERN_MAX is the number of entries of each pattern list, which the programs scan.
+const COMMAND_PATTERN_MAX = config.COMMAND_PATTERN_MAX
+
+func (p *Policy) commandPatternSet(list List) map[uint32]config.CommandPattern {
+	switch list {
+	case LIST_ALLOW_COMMAND_PATTERN:
+		return p.allowedCommandPatterns
+	case LIST_DENY_COMMAND_PATTERN:
+		return p.deniedCommandPatterns
+	default:
+		return nil
+	}
+}
+
+// SetCommandPattern sets the pattern at index of list. The programs scan the patterns from index
+// 0 up to the size of the list, and the first that matches the comm names the rule.
+func (p *Policy) SetCommandPattern(list List, index uint32, pattern config.CommandPattern) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if patterns := p.commandPatternSet(list); patterns != nil {
+		patterns[index] = pattern
+		p.changed()
+	}
+}
+
+func (p *Policy) DeleteCommandPattern(list List, index uint32) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	patterns := p.commandPatternSet(list)
+	if _, ok := patterns[index]; ok {
+		delete(patterns, index)
+		p.changed()
+	}
+}
+
+// lookupCommandPattern returns the first of the size patterns of set that matches command, a key
+// of the command lists, as the programs scan them.
+func lookupCommandPattern(set map[uint32]config.CommandPattern, size uint32, command string) (config.CommandPattern, bool) {
+	comm := strings.TrimRight(command, "\x00")
+	for i := uint32(0); i < size && i < COMMAND_PATTERN_MAX; i++ {
+		if pattern, ok := set[i]; ok && pattern.Match(comm) {
+			return pattern, true
+		}
+	}
+	return config.CommandPattern{}, false
+}
+
+// CommandPattern returns the rule of the pattern command matches, the comm of a task, e.g.
+// "network.command.deny python*", or "" if it matches none or a command of the lists does.
+// A pattern of the deny list is named before one of the allow list, as it decides.
+func (p *Policy) CommandPattern(command string) string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.commandCaseInsensitive {
+		command = strings.ToLower(command)
+	}
+	key := string(CommandKey(command))
+	if _, ok := p.deniedCommands[key]; !ok || p.lists.DenyCommand == 0 || p.monitoredCommand(key) {
+		if pattern, ok := lookupCommandPattern(p.deniedCommandPatterns, p.lists.DenyCommandPattern, key); ok {
+			return "network.command.deny " + pattern.String()
+		}
+	}
+	if _, ok := p.allowedCommands[key]; ok {
+		return ""
+	}
+	if pattern, ok := lookupCommandPattern(p.allowedCommandPatterns, p.lists.AllowCommandPattern, key); ok {
+		return "network.command.allow " + pattern.String()
+	}
+	return ""
+}
+
+// patternStrings returns the patterns of set in the order the programs scan them.
+func patternStrings(set map[uint32]config.CommandPattern) []string {
+	indices := make([]int, 0, len(set))
+	for i := range set {
+		indices = append(indices, int(i))
+	}
+	sort.Ints(indices)
+	result := make([]string, 0, len(set))
+	for _, i := range indices {
+		result = append(result, set[uint32(i)].String())
+	}
+	return result
+}
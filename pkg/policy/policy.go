@@ -0,0 +1,810 @@
+// Package policy evaluates connections as the BPF programs of the network restriction decide
+// them. It is pure Go: it imports neither libbpfgo nor cgo, so that the policy review tools can
+// build it for GOOS=js GOARCH=wasm, while the network Manager mirrors its maps in the same Policy.
+package policy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/policy/cidrset"
+)
+
+const (
+	MODE_MONITOR uint32 = 0
+	MODE_BLOCK   uint32 = 1
+
+	TARGET_HOST      uint32 = 0
+	TARGET_CONTAINER uint32 = 1
+	// TARGET_ALL restricts every task, and tells the ones in a classified container apart for
+	// network.host and network.container.
+	TARGET_ALL uint32 = 2
+
+	// FAMILY_IPV4 and FAMILY_IPV6 are the flags of the families network.families leaves out, in
+	// the disabled families of the config map.
+	FAMILY_IPV4 uint32 = 1
+	FAMILY_IPV6 uint32 = 2
+
+	// DEFAULT_ACTION_DENY and DEFAULT_ACTION_ALLOW are network.policy.default in the config map,
+	// and PRECEDENCE_DENY_FIRST and PRECEDENCE_ALLOW_FIRST network.policy.precedence. A config
+	// map without them, all zeros, decides as bouheki always did.
+	DEFAULT_ACTION_DENY    uint32 = 0
+	DEFAULT_ACTION_ALLOW   uint32 = 1
+	PRECEDENCE_DENY_FIRST  uint32 = 0
+	PRECEDENCE_ALLOW_FIRST uint32 = 1
+
+	// PROTOCOL_ALL is the protocol of the rules that apply to every socket type.
+	PROTOCOL_ALL = 0
+	TCP          = 1
+	UDP          = 2
+
+	// TASK_COMM_LEN is the size of the comm of a task, NUL included.
+	TASK_COMM_LEN = 16
+	// PORT_KEY_BITS is the number of bits of a port a prefix of the port lists can have.
+	PORT_KEY_BITS = 16
+)
+
+// List is a list of the policy. The lists of both families of the maps are one list.
+type List int
+
+const (
+	LIST_ALLOW_CIDR List = iota
+	LIST_DENY_CIDR
+	// The protocol lists have a set of each socket type, TCP and UDP.
+	LIST_ALLOW_PROTOCOL_CIDR
+	LIST_DENY_PROTOCOL_CIDR
+	LIST_ALLOW_COMMAND
+	LIST_DENY_COMMAND
+	LIST_ALLOW_UID
+	LIST_DENY_UID
+	// The uid range lists have the prefixes that cover the ranges of network.uid.
+	LIST_ALLOW_UID_RANGE
+	LIST_DENY_UID_RANGE
+	LIST_ALLOW_GID
+	LIST_DENY_GID
+	LIST_ALLOW_PORT
+	LIST_DENY_PORT
+	LIST_INGRESS_ALLOW_CIDR
+	LIST_INGRESS_DENY_CIDR
+	LIST_INGRESS_ALLOW_PORT
+	LIST_INGRESS_DENY_PORT
+	LIST_ALLOW_PATH
+	LIST_DENY_PATH
+	LIST_ALLOW_COMMAND_PATTERN
+	LIST_DENY_COMMAND_PATTERN
+	// The entry lists of network.policies have a set of each entry, by EntryTag, and the
+	// selector lists map a uid or a gid to the mask of the entries that select it.
+	LIST_ALLOW_ENTRY_CIDR
+	LIST_DENY_ENTRY_CIDR
+	LIST_ENTRY_UID
+	LIST_ENTRY_GID
+	// The except list has the prefixes of the deny list written with DENY_ENTRY_EXCEPT.
+	LIST_DENY_EXCEPT_CIDR
+	// The monitor lists have the prefixes and the commands of the deny lists written with
+	// DENY_ENTRY_MONITOR.
+	LIST_DENY_MONITOR_CIDR
+	LIST_DENY_MONITOR_COMMAND
+)
+
+// RuleProtocols are the protocols of the protocol lists, in the order they are listed in.
+var RuleProtocols = []string{config.PROTOCOL_TCP, config.PROTOCOL_UDP}
+
+// ProtocolSockType returns the socket type of a protocol of the config, config.PROTOCOL_TCP or
+// config.PROTOCOL_UDP.
+func ProtocolSockType(protocol string) uint8 {
+	switch protocol {
+	case config.PROTOCOL_TCP:
+		return TCP
+	case config.PROTOCOL_UDP:
+		return UDP
+	default:
+		return PROTOCOL_ALL
+	}
+}
+
+// ListSizes are the sizes of the allow and deny lists in the config map. socket_connect only
+// looks the task up in a list whose size is not 0: an absent list and an empty one both
+// leave the connection unrestricted. AllowUID and DenyUID count the prefixes of the uid ranges
+// with the uids.
+type ListSizes struct {
+	AllowCommand uint32
+	AllowUID     uint32
+	AllowGID     uint32
+	DenyCommand  uint32
+	DenyUID      uint32
+	DenyGID      uint32
+	// AllowPort and DenyPort are the numbers of prefixes the port ranges are written as.
+	AllowPort uint32
+	DenyPort  uint32
+	// IngressAllowCIDR is the number of addresses of both families network.ingress.cidr.allow
+	// has, and IngressAllowPort and IngressDenyPort the prefixes of network.ingress.ports.
+	IngressAllowCIDR uint32
+	IngressAllowPort uint32
+	IngressDenyPort  uint32
+	// AllowPath and DenyPath are the sizes of network.command.allow_paths and deny_paths.
+	AllowPath uint32
+	DenyPath  uint32
+	// AllowCommandPattern and DenyCommandPattern are the numbers of patterns of
+	// network.command.allow and deny, which are not in AllowCommand and DenyCommand.
+	AllowCommandPattern uint32
+	DenyCommandPattern  uint32
+}
+
+// CommandKey returns the key of command in the command lists, as the kernel stores a comm: at
+// most TASK_COMM_LEN-1 bytes followed by NUL padding. Longer commands are truncated like the
+// kernel truncates the comm of the task.
+func CommandKey(command string) []byte {
+	key := make([]byte, TASK_COMM_LEN)
+	copy(key[:TASK_COMM_LEN-1], command)
+	return key
+}
+
+// Policy is the rules the BPF programs decide the connections by: the content of their maps.
+type Policy struct {
+	mu sync.RWMutex
+
+	configured bool
+	mode       uint32
+	target     uint32
+	// commandCaseInsensitive lowercases the comm before it is looked up, as the BPF program does.
+	commandCaseInsensitive bool
+	// lists are the sizes written to the config map. Like socket_connect, the evaluator ignores
+	// the entries of a list whose size is 0.
+	lists ListSizes
+	// disabledFamilies are the FAMILY_IPV4 and FAMILY_IPV6 flags of the families that are not
+	// restricted, whose connections are reported if otherFamiliesAudit is set.
+	disabledFamilies   uint32
+	otherFamiliesAudit bool
+	// defaultAction decides the destinations no list decides, and precedence the destinations
+	// of both an allow and a deny list, see network.policy.
+	defaultAction uint32
+	precedence    uint32
+
+	allowedCIDR *cidrset.Set
+	deniedCIDR  *cidrset.Set
+	// exceptCIDR are the prefixes of deniedCIDR of network.cidr.allow_except, or inside one.
+	exceptCIDR *cidrset.Set
+	// monitorCIDR are the prefixes of deniedCIDR in mode: monitor, which never deny.
+	monitorCIDR *cidrset.Set
+	// deniedGroups are the groups the prefixes of network.cidr.deny came from, named in the Rule.
+	deniedGroups map[string]string
+	// allowedProtocolCIDR and deniedProtocolCIDR are the protocol lists, by socket type.
+	allowedProtocolCIDR map[uint8]*cidrset.Set
+	deniedProtocolCIDR  map[uint8]*cidrset.Set
+
+	allowedCommands map[string]struct{}
+	deniedCommands  map[string]struct{}
+	// monitorCommands are the keys of deniedCommands in mode: monitor.
+	monitorCommands map[string]struct{}
+	// allowedPaths and deniedPaths are the path rules, matched with the executable of the task.
+	allowedPaths map[string]struct{}
+	deniedPaths  map[string]struct{}
+	// allowedCommandPatterns and deniedCommandPatterns are the patterns of the command lists, by
+	// their index in the pattern lists.
+	allowedCommandPatterns map[uint32]config.CommandPattern
+	deniedCommandPatterns  map[uint32]config.CommandPattern
+	allowedUIDs            map[uint32]struct{}
+	deniedUIDs             map[uint32]struct{}
+	// allowedUIDRanges and deniedUIDRanges are the prefixes of the uid ranges.
+	allowedUIDRanges map[UIDPrefix]struct{}
+	deniedUIDRanges  map[UIDPrefix]struct{}
+	allowedGIDs      map[uint32]struct{}
+	deniedGIDs       map[uint32]struct{}
+	allowedPorts     map[PortPrefix]struct{}
+	deniedPorts      map[PortPrefix]struct{}
+	// The lists of network.ingress, which EvaluateBind looks the binds up in.
+	ingressAllowedCIDR  *cidrset.Set
+	ingressDeniedCIDR   *cidrset.Set
+	ingressAllowedPorts map[PortPrefix]struct{}
+	ingressDeniedPorts  map[PortPrefix]struct{}
+
+	// entries are the masks of network.policies, entryNames the names of its entries.
+	entries    PolicyEntries
+	entryNames []string
+	// entryCommands, entryUIDs and entryGIDs are the masks of the entries that select each
+	// command, uid and gid, and allowedEntryCIDR and deniedEntryCIDR their lists, by EntryTag.
+	entryCommands    map[string]uint64
+	entryUIDs        map[uint32]uint64
+	entryGIDs        map[uint32]uint64
+	allowedEntryCIDR map[uint8]*cidrset.Set
+	deniedEntryCIDR  map[uint8]*cidrset.Set
+
+	// generation is incremented on every change.
+	generation uint64
+	updatedAt  time.Time
+	now        func() time.Time
+}
+
+// Decision is what the BPF program decides for a connection or a bind.
+type Decision struct {
+	// Audited is true when the BPF program emits an audit event.
+	Audited bool
+	// Denied is true when the policy does not permit the connection.
+	Denied bool
+	// Blocked is true when the connection is refused.
+	Blocked bool
+	// DenyListed is true when a deny list entry denies the connection,
+	// rather than the connection missing from an allow list.
+	DenyListed bool
+	// Monitored is true when a deny entry in mode: monitor would have denied a connection that
+	// is permitted. It is reported whatever the mode.
+	Monitored bool
+	// Rule names the list entry, or the allow list, that denied the connection, or the entry in
+	// mode: monitor of a Monitored one. It is empty when the connection is permitted otherwise.
+	Rule string
+}
+
+func NewPolicy() *Policy {
+	return &Policy{
+		allowedCIDR:            cidrset.New(),
+		deniedCIDR:             cidrset.New(),
+		exceptCIDR:             cidrset.New(),
+		monitorCIDR:            cidrset.New(),
+		allowedProtocolCIDR:    map[uint8]*cidrset.Set{TCP: cidrset.New(), UDP: cidrset.New()},
+		deniedProtocolCIDR:     map[uint8]*cidrset.Set{TCP: cidrset.New(), UDP: cidrset.New()},
+		allowedCommands:        map[string]struct{}{},
+		deniedCommands:         map[string]struct{}{},
+		monitorCommands:        map[string]struct{}{},
+		allowedPaths:           map[string]struct{}{},
+		deniedPaths:            map[string]struct{}{},
+		allowedCommandPatterns: map[uint32]config.CommandPattern{},
+		deniedCommandPatterns:  map[uint32]config.CommandPattern{},
+		allowedUIDs:            map[uint32]struct{}{},
+		deniedUIDs:             map[uint32]struct{}{},
+		allowedUIDRanges:       map[UIDPrefix]struct{}{},
+		deniedUIDRanges:        map[UIDPrefix]struct{}{},
+		allowedGIDs:            map[uint32]struct{}{},
+		deniedGIDs:             map[uint32]struct{}{},
+		allowedPorts:           map[PortPrefix]struct{}{},
+		deniedPorts:            map[PortPrefix]struct{}{},
+		ingressAllowedCIDR:     cidrset.New(),
+		ingressDeniedCIDR:      cidrset.New(),
+		ingressAllowedPorts:    map[PortPrefix]struct{}{},
+		ingressDeniedPorts:     map[PortPrefix]struct{}{},
+		entryCommands:          map[string]uint64{},
+		entryUIDs:              map[uint32]uint64{},
+		entryGIDs:              map[uint32]uint64{},
+		allowedEntryCIDR:       map[uint8]*cidrset.Set{},
+		deniedEntryCIDR:        map[uint8]*cidrset.Set{},
+		now:                    time.Now,
+	}
+}
+
+// SetClock replaces the clock the changes are timed with.
+func (p *Policy) SetClock(now func() time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.now = now
+}
+
+// Generation returns the number of changes applied to the policy and when the last one happened.
+func (p *Policy) Generation() (uint64, time.Time) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.generation, p.updatedAt
+}
+
+func (p *Policy) changed() {
+	p.generation++
+	p.updatedAt = p.now()
+}
+
+func (p *Policy) SetModeAndTarget(mode, target uint32) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.configured = true
+	p.mode = mode
+	p.target = target
+	p.changed()
+}
+
+// SetDeniedGroups sets the group each prefix of network.cidr.deny came from, by prefix.
+func (p *Policy) SetDeniedGroups(groups map[string]string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.deniedGroups = groups
+}
+
+func (p *Policy) SetCommandCaseInsensitive(caseInsensitive bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.commandCaseInsensitive != caseInsensitive {
+		p.commandCaseInsensitive = caseInsensitive
+		p.changed()
+	}
+}
+
+func (p *Policy) SetListSizes(lists ListSizes) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.lists != lists {
+		p.lists = lists
+		p.changed()
+	}
+}
+
+// SetFamilies sets the families that are not restricted, FAMILY_IPV4 and FAMILY_IPV6 flags, and
+// whether their connections are reported.
+func (p *Policy) SetFamilies(disabled uint32, audit bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.disabledFamilies != disabled || p.otherFamiliesAudit != audit {
+		p.disabledFamilies = disabled
+		p.otherFamiliesAudit = audit
+		p.changed()
+	}
+}
+
+// SetDefaultAndPrecedence sets network.policy, a DEFAULT_ACTION and a PRECEDENCE.
+func (p *Policy) SetDefaultAndPrecedence(defaultAction, precedence uint32) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.defaultAction != defaultAction || p.precedence != precedence {
+		p.defaultAction = defaultAction
+		p.precedence = precedence
+		p.changed()
+	}
+}
+
+// DefaultAndPrecedence returns the DEFAULT_ACTION and the PRECEDENCE of network.policy.
+func DefaultAndPrecedence(network config.RestrictedNetworkConfig) (uint32, uint32) {
+	defaultAction, precedence := DEFAULT_ACTION_DENY, PRECEDENCE_DENY_FIRST
+	if network.Decision.Default == config.DEFAULT_ACTION_ALLOW {
+		defaultAction = DEFAULT_ACTION_ALLOW
+	}
+	if network.Decision.Precedence == config.PRECEDENCE_ALLOW_FIRST {
+		precedence = PRECEDENCE_ALLOW_FIRST
+	}
+	return defaultAction, precedence
+}
+
+// DisabledFamilies returns the flags of the families network.families leaves out.
+func DisabledFamilies(network config.RestrictedNetworkConfig) uint32 {
+	disabled := uint32(0)
+	if !network.FamilyEnabled(config.FAMILY_IPV4) {
+		disabled |= FAMILY_IPV4
+	}
+	if !network.FamilyEnabled(config.FAMILY_IPV6) {
+		disabled |= FAMILY_IPV6
+	}
+	return disabled
+}
+
+// FamilyOf returns the flag of the family of ip.
+func FamilyOf(ip net.IP) uint32 {
+	if ip.To4() != nil {
+		return FAMILY_IPV4
+	}
+	return FAMILY_IPV6
+}
+
+// outOfFamilies reports whether ip is of a family that is not restricted. It is called with p.mu held.
+func (p *Policy) outOfFamilies(ip net.IP) bool {
+	return ip != nil && p.disabledFamilies&FamilyOf(ip) != 0
+}
+
+// cidrSet returns the set of list. protocol is the socket type of the protocol lists, the
+// EntryTag of the entry lists, and PROTOCOL_ALL for the others.
+func (p *Policy) cidrSet(list List, protocol uint8) *cidrset.Set {
+	switch list {
+	case LIST_ALLOW_CIDR:
+		return p.allowedCIDR
+	case LIST_DENY_CIDR:
+		return p.deniedCIDR
+	case LIST_DENY_EXCEPT_CIDR:
+		return p.exceptCIDR
+	case LIST_DENY_MONITOR_CIDR:
+		return p.monitorCIDR
+	case LIST_ALLOW_PROTOCOL_CIDR:
+		return p.allowedProtocolCIDR[protocol]
+	case LIST_DENY_PROTOCOL_CIDR:
+		return p.deniedProtocolCIDR[protocol]
+	case LIST_INGRESS_ALLOW_CIDR:
+		return p.ingressAllowedCIDR
+	case LIST_INGRESS_DENY_CIDR:
+		return p.ingressDeniedCIDR
+	case LIST_ALLOW_ENTRY_CIDR, LIST_DENY_ENTRY_CIDR:
+		return p.entryCIDRSet(list, protocol, false)
+	default:
+		return nil
+	}
+}
+
+func (p *Policy) AddCIDR(list List, protocol uint8, n *net.IPNet) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	set := p.cidrSet(list, protocol)
+	if set == nil && (list == LIST_ALLOW_ENTRY_CIDR || list == LIST_DENY_ENTRY_CIDR) {
+		set = p.entryCIDRSet(list, protocol, true)
+	}
+	if set != nil {
+		set.Insert(n, nil)
+		p.changed()
+	}
+}
+
+func (p *Policy) DeleteCIDR(list List, protocol uint8, n *net.IPNet) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if set := p.cidrSet(list, protocol); set != nil && set.Delete(n) {
+		p.changed()
+	}
+}
+
+func (p *Policy) HasCIDR(list List, protocol uint8, n *net.IPNet) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	set := p.cidrSet(list, protocol)
+	if set == nil {
+		return false
+	}
+	_, ok := set.Get(n)
+	return ok
+}
+
+func (p *Policy) commandSet(list List) map[string]struct{} {
+	switch list {
+	case LIST_ALLOW_COMMAND:
+		return p.allowedCommands
+	case LIST_DENY_COMMAND:
+		return p.deniedCommands
+	case LIST_DENY_MONITOR_COMMAND:
+		return p.monitorCommands
+	default:
+		return nil
+	}
+}
+
+func (p *Policy) AddCommand(list List, command string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if commands := p.commandSet(list); commands != nil {
+		commands[string(CommandKey(command))] = struct{}{}
+		p.changed()
+	}
+}
+
+func (p *Policy) DeleteCommand(list List, command string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key := string(CommandKey(command))
+	commands := p.commandSet(list)
+	if _, ok := commands[key]; ok {
+		delete(commands, key)
+		p.changed()
+	}
+}
+
+func (p *Policy) idSet(list List) map[uint32]struct{} {
+	switch list {
+	case LIST_ALLOW_UID:
+		return p.allowedUIDs
+	case LIST_DENY_UID:
+		return p.deniedUIDs
+	case LIST_ALLOW_GID:
+		return p.allowedGIDs
+	case LIST_DENY_GID:
+		return p.deniedGIDs
+	default:
+		return nil
+	}
+}
+
+func (p *Policy) AddID(list List, id uint32) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if ids := p.idSet(list); ids != nil {
+		ids[id] = struct{}{}
+		p.changed()
+	}
+}
+
+func (p *Policy) DeleteID(list List, id uint32) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ids := p.idSet(list)
+	if _, ok := ids[id]; ok {
+		delete(ids, id)
+		p.changed()
+	}
+}
+
+func (p *Policy) portSet(list List) map[PortPrefix]struct{} {
+	switch list {
+	case LIST_ALLOW_PORT:
+		return p.allowedPorts
+	case LIST_DENY_PORT:
+		return p.deniedPorts
+	case LIST_INGRESS_ALLOW_PORT:
+		return p.ingressAllowedPorts
+	case LIST_INGRESS_DENY_PORT:
+		return p.ingressDeniedPorts
+	default:
+		return nil
+	}
+}
+
+func (p *Policy) AddPort(list List, prefix PortPrefix) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if ports := p.portSet(list); ports != nil {
+		ports[prefix] = struct{}{}
+		p.changed()
+	}
+}
+
+func (p *Policy) DeletePort(list List, prefix PortPrefix) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ports := p.portSet(list)
+	if _, ok := ports[prefix]; ok {
+		delete(ports, prefix)
+		p.changed()
+	}
+}
+
+// Digest returns a hash of the policy contents. Two policies with the same rules have the same digest,
+// regardless of the order the rules were written in.
+func (p *Policy) Digest() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.digest()
+}
+
+func (p *Policy) digest() string {
+	h := sha256.New()
+	fmt.Fprintf(h, "configured=%t mode=%d target=%d case_insensitive=%t\n", p.configured, p.mode, p.target, p.commandCaseInsensitive)
+	// Written only when set, so that the digests of the policies of both families stay as they were.
+	if p.disabledFamilies != 0 {
+		fmt.Fprintf(h, "disabled_families=%d other_families_audit=%t\n", p.disabledFamilies, p.otherFamiliesAudit)
+	}
+	if p.defaultAction != DEFAULT_ACTION_DENY || p.precedence != PRECEDENCE_DENY_FIRST {
+		fmt.Fprintf(h, "default_action=%d precedence=%d\n", p.defaultAction, p.precedence)
+	}
+	for _, set := range []struct {
+		name string
+		set  *cidrset.Set
+	}{{"allow_cidr", p.allowedCIDR}, {"deny_cidr", p.deniedCIDR}, {"except_cidr", p.exceptCIDR}} {
+		for _, n := range set.set.Prefixes() {
+			fmt.Fprintf(h, "%s %s\n", set.name, n)
+		}
+	}
+	for _, protocol := range RuleProtocols {
+		sockType := ProtocolSockType(protocol)
+		for _, set := range []struct {
+			name string
+			set  *cidrset.Set
+		}{{"allow_cidr_" + protocol, p.allowedProtocolCIDR[sockType]}, {"deny_cidr_" + protocol, p.deniedProtocolCIDR[sockType]}} {
+			for _, n := range set.set.Prefixes() {
+				fmt.Fprintf(h, "%s %s\n", set.name, n)
+			}
+		}
+	}
+	for _, commands := range []struct {
+		name string
+		set  map[string]struct{}
+	}{{"allow_command", p.allowedCommands}, {"deny_command", p.deniedCommands}} {
+		keys := make([]string, 0, len(commands.set))
+		for key := range commands.set {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(h, "%s %q\n", commands.name, key)
+		}
+	}
+	// Written only when set, so that the digests of the policies without mode: monitor entries
+	// stay as they were.
+	for _, n := range p.monitorCIDR.Prefixes() {
+		fmt.Fprintf(h, "monitor_cidr %s\n", n)
+	}
+	monitorCommands := make([]string, 0, len(p.monitorCommands))
+	for key := range p.monitorCommands {
+		monitorCommands = append(monitorCommands, key)
+	}
+	sort.Strings(monitorCommands)
+	for _, key := range monitorCommands {
+		fmt.Fprintf(h, "monitor_command %q\n", key)
+	}
+	// Without path rules, the digest is the one of the policies before network.command.allow_paths.
+	for _, paths := range []struct {
+		name string
+		set  map[string]struct{}
+	}{{"allow_path", p.allowedPaths}, {"deny_path", p.deniedPaths}} {
+		for _, path := range pathStrings(paths.set) {
+			fmt.Fprintf(h, "%s %q\n", paths.name, path)
+		}
+	}
+	for _, patterns := range []struct {
+		name string
+		set  map[uint32]config.CommandPattern
+	}{{"allow_command_pattern", p.allowedCommandPatterns}, {"deny_command_pattern", p.deniedCommandPatterns}} {
+		for i, pattern := range patternStrings(patterns.set) {
+			fmt.Fprintf(h, "%s %d %q\n", patterns.name, i, pattern)
+		}
+	}
+	for _, ids := range []struct {
+		name string
+		set  map[uint32]struct{}
+	}{{"allow_uid", p.allowedUIDs}, {"deny_uid", p.deniedUIDs}, {"allow_gid", p.allowedGIDs}, {"deny_gid", p.deniedGIDs}} {
+		keys := make([]int, 0, len(ids.set))
+		for id := range ids.set {
+			keys = append(keys, int(id))
+		}
+		sort.Ints(keys)
+		for _, id := range keys {
+			fmt.Fprintf(h, "%s %d\n", ids.name, id)
+		}
+	}
+	// Without uid ranges, the digest is the one of the policies before them.
+	for _, ranges := range []struct {
+		name string
+		set  map[UIDPrefix]struct{}
+	}{{"allow_uid_range", p.allowedUIDRanges}, {"deny_uid_range", p.deniedUIDRanges}} {
+		for _, prefix := range sortedUIDPrefixes(ranges.set) {
+			fmt.Fprintf(h, "%s %d/%d\n", ranges.name, prefix.UID, prefix.PrefixLen)
+		}
+	}
+	for _, ports := range []struct {
+		name string
+		set  map[PortPrefix]struct{}
+	}{{"allow_port", p.allowedPorts}, {"deny_port", p.deniedPorts}} {
+		for _, prefix := range sortedPortPrefixes(ports.set) {
+			fmt.Fprintf(h, "%s %d/%d\n", ports.name, prefix.Port, prefix.PrefixLen)
+		}
+	}
+	// Without ingress rules, the digest is the one of the policies before network.ingress.
+	for _, set := range []struct {
+		name string
+		set  *cidrset.Set
+	}{{"ingress_allow_cidr", p.ingressAllowedCIDR}, {"ingress_deny_cidr", p.ingressDeniedCIDR}} {
+		for _, n := range set.set.Prefixes() {
+			fmt.Fprintf(h, "%s %s\n", set.name, n)
+		}
+	}
+	for _, ports := range []struct {
+		name string
+		set  map[PortPrefix]struct{}
+	}{{"ingress_allow_port", p.ingressAllowedPorts}, {"ingress_deny_port", p.ingressDeniedPorts}} {
+		for _, prefix := range sortedPortPrefixes(ports.set) {
+			fmt.Fprintf(h, "%s %d/%d\n", ports.name, prefix.Port, prefix.PrefixLen)
+		}
+	}
+
+	// Without network.policies, the digest is the one of the policies before it.
+	if p.entries.Count != 0 {
+		p.digestEntries(h)
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Lists are the entries of the lists of a Policy, sorted.
+type Lists struct {
+	Allow []string
+	Deny  []string
+}
+
+// IDLists are the entries of the uid or the gid lists of a Policy, sorted.
+type IDLists struct {
+	Allow []uint
+	Deny  []uint
+}
+
+// Snapshot is the content of a Policy at a generation.
+type Snapshot struct {
+	Digest     string
+	Generation uint64
+	UpdatedAt  time.Time
+
+	Configured             bool
+	Mode                   uint32
+	Target                 uint32
+	CommandCaseInsensitive bool
+
+	CIDR Lists
+	// ProtocolCIDR are the protocol lists that have entries, by protocol.
+	ProtocolCIDR map[string]Lists
+	Command      Lists
+	Paths        Lists
+	UID          IDLists
+	// UIDRanges are the ranges of the prefixes of the uid range lists.
+	UIDRanges    Lists
+	GID          IDLists
+	Ports        Lists
+	IngressCIDR  Lists
+	IngressPorts Lists
+}
+
+// HasIngressRules reports whether any list of network.ingress is in the snapshot.
+func (s Snapshot) HasIngressRules() bool {
+	return len(s.IngressCIDR.Allow)+len(s.IngressCIDR.Deny)+len(s.IngressPorts.Allow)+len(s.IngressPorts.Deny) > 0
+}
+
+// Snapshot returns the content of the policy, and the digest of the same rules.
+func (p *Policy) Snapshot() Snapshot {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	s := Snapshot{
+		Digest:                 p.digest(),
+		Generation:             p.generation,
+		UpdatedAt:              p.updatedAt,
+		Configured:             p.configured,
+		Mode:                   p.mode,
+		Target:                 p.target,
+		CommandCaseInsensitive: p.commandCaseInsensitive,
+		CIDR:                   Lists{Allow: prefixStrings(p.allowedCIDR), Deny: prefixStrings(p.deniedCIDR)},
+		ProtocolCIDR:           map[string]Lists{},
+		Command:                Lists{Allow: commandStrings(p.allowedCommands, p.allowedCommandPatterns), Deny: commandStrings(p.deniedCommands, p.deniedCommandPatterns)},
+		Paths:                  Lists{Allow: pathStrings(p.allowedPaths), Deny: pathStrings(p.deniedPaths)},
+		UID:                    IDLists{Allow: sortedIDs(p.allowedUIDs), Deny: sortedIDs(p.deniedUIDs)},
+		UIDRanges:              Lists{Allow: uidRangeStrings(p.allowedUIDRanges), Deny: uidRangeStrings(p.deniedUIDRanges)},
+		GID:                    IDLists{Allow: sortedIDs(p.allowedGIDs), Deny: sortedIDs(p.deniedGIDs)},
+		Ports:                  Lists{Allow: portStrings(p.allowedPorts), Deny: portStrings(p.deniedPorts)},
+		IngressCIDR:            Lists{Allow: prefixStrings(p.ingressAllowedCIDR), Deny: prefixStrings(p.ingressDeniedCIDR)},
+		IngressPorts:           Lists{Allow: portStrings(p.ingressAllowedPorts), Deny: portStrings(p.ingressDeniedPorts)},
+	}
+	for _, protocol := range RuleProtocols {
+		sockType := ProtocolSockType(protocol)
+		list := Lists{Allow: prefixStrings(p.allowedProtocolCIDR[sockType]), Deny: prefixStrings(p.deniedProtocolCIDR[sockType])}
+		if len(list.Allow)+len(list.Deny) > 0 {
+			s.ProtocolCIDR[protocol] = list
+		}
+	}
+	return s
+}
+
+func prefixStrings(set *cidrset.Set) []string {
+	result := []string{}
+	for _, n := range set.Prefixes() {
+		result = append(result, n.String())
+	}
+	sort.Strings(result)
+	return result
+}
+
+// commandStrings returns the commands of set and the patterns, sorted together.
+func commandStrings(set map[string]struct{}, patterns map[uint32]config.CommandPattern) []string {
+	result := make([]string, 0, len(set)+len(patterns))
+	for key := range set {
+		result = append(result, strings.TrimRight(key, "\x00"))
+	}
+	result = append(result, patternStrings(patterns)...)
+	sort.Strings(result)
+	return result
+}
+
+func sortedIDs(set map[uint32]struct{}) []uint {
+	result := make([]uint, 0, len(set))
+	for id := range set {
+		result = append(result, uint(id))
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+	return result
+}
@@ -0,0 +1,78 @@
+package policy
+
+import (
+	"sort"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+)
+
+// PortPrefix is an entry of the port lists: the ports whose first PrefixLen bits are those of Port.
+type PortPrefix struct {
+	Port      uint16
+	PrefixLen int
+}
+
+func (p PortPrefix) Contains(port uint16) bool {
+	mask := ^uint16(0) << (PORT_KEY_BITS - p.PrefixLen)
+	return port&mask == p.Port
+}
+
+// Range returns the range of the ports of the prefix.
+func (p PortPrefix) Range() config.PortRange {
+	return config.PortRange{First: p.Port, Last: p.Port | ^uint16(0)>>p.PrefixLen}
+}
+
+// PortRangePrefixes returns the fewest prefixes that cover r, e.g. 8000-8999 as 8000/10, 8064/9,
+// 8192/7, 8704/8, 8960/11 and 8992/13: a trie looks a port up by prefix, as it looks up the addresses.
+func PortRangePrefixes(r config.PortRange) []PortPrefix {
+	prefixes := []PortPrefix{}
+	first, last := uint32(r.First), uint32(r.Last)
+	for first <= last {
+		// The largest block of ports aligned on first that does not go past last.
+		prefixLen := PORT_KEY_BITS
+		for prefixLen > 0 {
+			size := uint32(1) << (PORT_KEY_BITS - prefixLen + 1)
+			if first%size != 0 || first+size-1 > last {
+				break
+			}
+			prefixLen--
+		}
+		prefixes = append(prefixes, PortPrefix{Port: uint16(first), PrefixLen: prefixLen})
+		first += uint32(1) << (PORT_KEY_BITS - prefixLen)
+	}
+	return prefixes
+}
+
+// lookupPort returns the longest prefix of ports that contains port, as the trie does.
+func lookupPort(ports map[PortPrefix]struct{}, port uint16) (PortPrefix, bool) {
+	match, found := PortPrefix{}, false
+	for prefix := range ports {
+		if prefix.Contains(port) && (!found || prefix.PrefixLen > match.PrefixLen) {
+			match, found = prefix, true
+		}
+	}
+	return match, found
+}
+
+func sortedPortPrefixes(set map[PortPrefix]struct{}) []PortPrefix {
+	result := make([]PortPrefix, 0, len(set))
+	for prefix := range set {
+		result = append(result, prefix)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Port != result[j].Port {
+			return result[i].Port < result[j].Port
+		}
+		return result[i].PrefixLen < result[j].PrefixLen
+	})
+	return result
+}
+
+// portStrings returns the ranges of the prefixes in the maps, in the order of the ports.
+func portStrings(set map[PortPrefix]struct{}) []string {
+	result := []string{}
+	for _, prefix := range sortedPortPrefixes(set) {
+		result = append(result, prefix.Range().String())
+	}
+	return result
+}
@@ -0,0 +1,50 @@
+package policy
+
+import (
+	"testing"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPortRangePrefixes(t *testing.T) {
+	tests := []struct {
+		r        config.PortRange
+		expected []PortPrefix
+	}{
+		{r: config.PortRange{First: 443, Last: 443}, expected: []PortPrefix{{Port: 443, PrefixLen: 16}}},
+		{r: config.PortRange{First: 8000, Last: 8999}, expected: []PortPrefix{{8000, 10}, {8064, 9}, {8192, 7}, {8704, 8}, {8960, 11}, {8992, 13}}},
+		{r: config.PortRange{First: 32768, Last: 65535}, expected: []PortPrefix{{Port: 32768, PrefixLen: 1}}},
+	}
+	for _, test := range tests {
+		prefixes := PortRangePrefixes(test.r)
+		assert.Equal(t, test.expected, prefixes, test.r.String())
+
+		// The prefixes cover the range, and no port outside of it.
+		for _, port := range []uint16{test.r.First - 1, test.r.First, test.r.Last, test.r.Last + 1} {
+			covered := false
+			for _, prefix := range prefixes {
+				covered = covered || prefix.Contains(port)
+			}
+			assert.Equal(t, port >= test.r.First && port <= test.r.Last, covered, port)
+		}
+	}
+}
+
+func TestLookupPort(t *testing.T) {
+	ports := map[PortPrefix]struct{}{}
+	for _, prefix := range PortRangePrefixes(config.PortRange{First: 8000, Last: 8999}) {
+		ports[prefix] = struct{}{}
+	}
+	ports[PortPrefix{Port: 8080, PrefixLen: 16}] = struct{}{}
+
+	// The longest prefix is the match, as in the trie.
+	prefix, ok := lookupPort(ports, 8080)
+	assert.True(t, ok)
+	assert.Equal(t, "8080", prefix.Range().String())
+	prefix, ok = lookupPort(ports, 8081)
+	assert.True(t, ok)
+	assert.Equal(t, "8064-8191", prefix.Range().String())
+	_, ok = lookupPort(ports, 9000)
+	assert.False(t, ok)
+}
@@ -0,0 +1,126 @@
+package policy
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+)
+
+// UID_KEY_BITS is the number of bits of a uid a prefix of the uid range lists can have.
+const UID_KEY_BITS = 32
+
+// UIDPrefix is an entry of the uid range lists: the uids whose first PrefixLen bits are those of UID.
+type UIDPrefix struct {
+	UID       uint32
+	PrefixLen int
+}
+
+func (p UIDPrefix) Contains(uid uint32) bool {
+	mask := ^uint32(0) << (UID_KEY_BITS - p.PrefixLen)
+	return uid&mask == p.UID
+}
+
+// Range returns the range of the uids of the prefix.
+func (p UIDPrefix) Range() config.UIDRange {
+	return config.UIDRange{First: p.UID, Last: p.UID | ^uint32(0)>>p.PrefixLen}
+}
+
+// UIDRangePrefixes returns the fewest prefixes that cover r, as PortRangePrefixes does for ports:
+// 10000-59999 is 13 prefixes, where the uid lists would have 50000 entries.
+func UIDRangePrefixes(r config.UIDRange) []UIDPrefix {
+	prefixes := []UIDPrefix{}
+	first, last := uint64(r.First), uint64(r.Last)
+	for first <= last {
+		// The largest block of uids aligned on first that does not go past last.
+		prefixLen := UID_KEY_BITS
+		for prefixLen > 0 {
+			size := uint64(1) << (UID_KEY_BITS - prefixLen + 1)
+			if first%size != 0 || first+size-1 > last {
+				break
+			}
+			prefixLen--
+		}
+		prefixes = append(prefixes, UIDPrefix{UID: uint32(first), PrefixLen: prefixLen})
+		first += uint64(1) << (UID_KEY_BITS - prefixLen)
+	}
+	return prefixes
+}
+
+// lookupUID returns the longest prefix of ranges that contains uid, as the trie does.
+func lookupUID(ranges map[UIDPrefix]struct{}, uid uint32) (UIDPrefix, bool) {
+	match, found := UIDPrefix{}, false
+	for prefix := range ranges {
+		if prefix.Contains(uid) && (!found || prefix.PrefixLen > match.PrefixLen) {
+			match, found = prefix, true
+		}
+	}
+	return match, found
+}
+
+func (p *Policy) uidRangeSet(list List) map[UIDPrefix]struct{} {
+	switch list {
+	case LIST_ALLOW_UID_RANGE:
+		return p.allowedUIDRanges
+	case LIST_DENY_UID_RANGE:
+		return p.deniedUIDRanges
+	default:
+		return nil
+	}
+}
+
+func (p *Policy) AddUIDPrefix(list List, prefix UIDPrefix) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if ranges := p.uidRangeSet(list); ranges != nil {
+		ranges[prefix] = struct{}{}
+		p.changed()
+	}
+}
+
+func (p *Policy) DeleteUIDPrefix(list List, prefix UIDPrefix) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ranges := p.uidRangeSet(list)
+	if _, ok := ranges[prefix]; ok {
+		delete(ranges, prefix)
+		p.changed()
+	}
+}
+
+// matchUID returns the entry of the uid list or the uid range list of ids that uid is in, the
+// uid itself or the range of a prefix, as socket_connect looks up the hash before the trie.
+func matchUID(ids map[uint32]struct{}, ranges map[UIDPrefix]struct{}, uid uint32) (string, bool) {
+	if _, ok := ids[uid]; ok {
+		return fmt.Sprint(uid), true
+	}
+	if prefix, ok := lookupUID(ranges, uid); ok {
+		return prefix.Range().String(), true
+	}
+	return "", false
+}
+
+func sortedUIDPrefixes(set map[UIDPrefix]struct{}) []UIDPrefix {
+	result := make([]UIDPrefix, 0, len(set))
+	for prefix := range set {
+		result = append(result, prefix)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].UID != result[j].UID {
+			return result[i].UID < result[j].UID
+		}
+		return result[i].PrefixLen < result[j].PrefixLen
+	})
+	return result
+}
+
+// uidRangeStrings returns the ranges of the prefixes in the maps, in the order of the uids.
+func uidRangeStrings(set map[UIDPrefix]struct{}) []string {
+	result := []string{}
+	for _, prefix := range sortedUIDPrefixes(set) {
+		result = append(result, prefix.Range().String())
+	}
+	return result
+}
@@ -0,0 +1,60 @@
+package policy
+
+import (
+	"testing"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUIDRangePrefixes(t *testing.T) {
+	tests := []struct {
+		r        config.UIDRange
+		expected []UIDPrefix
+	}{
+		{r: config.UIDRange{First: 1000, Last: 1000}, expected: []UIDPrefix{{UID: 1000, PrefixLen: 32}}},
+		{r: config.UIDRange{First: 20000, Last: 20999}, expected: []UIDPrefix{{20000, 27}, {20032, 26}, {20096, 25}, {20224, 24}, {20480, 23}, {20992, 29}}},
+		{r: config.UIDRange{First: 0, Last: 4294967294}, expected: nil},
+	}
+	for _, test := range tests {
+		prefixes := UIDRangePrefixes(test.r)
+		if test.expected != nil {
+			assert.Equal(t, test.expected, prefixes, test.r.String())
+		}
+
+		// The prefixes cover the range, and no uid outside of it.
+		for _, uid := range []uint32{test.r.First - 1, test.r.First, test.r.Last, test.r.Last + 1} {
+			covered := false
+			for _, prefix := range prefixes {
+				covered = covered || prefix.Contains(uid)
+			}
+			assert.Equal(t, uid >= test.r.First && uid <= test.r.Last, covered, uid)
+		}
+	}
+	assert.Len(t, UIDRangePrefixes(config.UIDRange{First: 10000, Last: 59999}), 13)
+}
+
+func TestMatchUID(t *testing.T) {
+	p, err := FromConfig(func() *config.Config {
+		conf := config.DefaultConfig()
+		conf.RestrictedNetworkConfig.UID.Allow = []string{"10000-59999", "20500"}
+		return conf
+	}())
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(14), p.lists.AllowUID)
+
+	// The uid is matched before the ranges, as in socket_connect.
+	entry, ok := matchUID(p.allowedUIDs, p.allowedUIDRanges, 20500)
+	assert.True(t, ok)
+	assert.Equal(t, "20500", entry)
+	entry, ok = matchUID(p.allowedUIDs, p.allowedUIDRanges, 20501)
+	assert.True(t, ok)
+	assert.Equal(t, "16384-32767", entry)
+	_, ok = matchUID(p.allowedUIDs, p.allowedUIDRanges, 60000)
+	assert.False(t, ok)
+
+	s := p.Snapshot()
+	assert.Equal(t, []uint{20500}, s.UID.Allow)
+	assert.Len(t, s.UIDRanges.Allow, 13)
+	assert.Equal(t, "10000-10015", s.UIDRanges.Allow[0])
+}
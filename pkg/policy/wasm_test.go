@@ -0,0 +1,41 @@
+//go:build wasmbuild
+// +build wasmbuild
+
+package policy
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestBuildsForWebAssembly checks that the package, and what it imports, stays pure Go and does
+// not pull the logs, the metrics server or the spool of bouheki into the WebAssembly build. It runs
+// go build, so it is only built with the wasmbuild tag, see make test/wasm.
+func TestBuildsForWebAssembly(t *testing.T) {
+	goBin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go is not in PATH")
+	}
+	env := append(os.Environ(), "GOOS=js", "GOARCH=wasm", "CGO_ENABLED=0")
+
+	build := exec.Command(goBin, "build", "./...")
+	build.Env = env
+	out, err := build.CombinedOutput()
+	assert.Nil(t, err, string(out))
+
+	list := exec.Command(goBin, "list", "-deps", ".")
+	list.Env = env
+	out, err = list.Output()
+	assert.Nil(t, err)
+	for _, dep := range strings.Fields(string(out)) {
+		assert.NotContains(t, dep, "libbpfgo")
+		assert.NotEqual(t, "C", dep)
+		for _, heavy := range []string{"net/http", "crypto/ed25519", "github.com/sirupsen/logrus", "gopkg.in/natefinch/lumberjack.v2", "github.com/mrtc0/bouheki/pkg/log", "github.com/mrtc0/bouheki/pkg/metrics", "github.com/mrtc0/bouheki/pkg/spool"} {
+			assert.NotEqual(t, heavy, dep)
+		}
+	}
+}
@@ -0,0 +1,341 @@
+// Package reload applies a reloaded config to every module of bouheki, or to none of them.
+//
+// Each module implements Reloadable and is registered with a Coordinator in the order its
+// plans are applied. A reload validates the config with every module, then plans the changes
+// of every module, and only then applies the plans one after another. When a plan fails to
+// apply, the plans applied before it, and the failed one, which may be half applied, are rolled
+// back in the reverse order. Every reload produces one Report of all the modules, which is
+// logged and published as a config_reload notification.
+package reload
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+	log "github.com/mrtc0/bouheki/pkg/log"
+	"github.com/mrtc0/bouheki/pkg/notify"
+)
+
+const (
+	// STAGE_LOAD is the loading of the config, before any module sees it, see LoadFailed.
+	STAGE_LOAD     = "load"
+	STAGE_VALIDATE = "validate"
+	STAGE_PLAN     = "plan"
+	STAGE_APPLY    = "apply"
+)
+
+// The status of a module in a Report.
+const (
+	// MODULE_APPLIED is a module whose plan was applied.
+	MODULE_APPLIED = "applied"
+	// MODULE_UNCHANGED is a module the config changes nothing of.
+	MODULE_UNCHANGED = "unchanged"
+	// MODULE_FAILED is the module that failed the stage of the Report.
+	MODULE_FAILED = "failed"
+	// MODULE_SKIPPED is a module whose plan was not applied because of another module.
+	MODULE_SKIPPED         = "skipped"
+	MODULE_ROLLED_BACK     = "rolled back"
+	MODULE_ROLLBACK_FAILED = "rollback failed"
+)
+
+// Plan is what a module changes to apply a config.
+type Plan struct {
+	// Summary describes the changes, e.g. "network.cidr.allow: +10.0.0.0/8".
+	Summary string
+	// Unchanged is set when the config changes nothing of the module. The plan is neither
+	// applied nor rolled back.
+	Unchanged bool
+	// Added and Removed are the number of entries the plan adds and removes.
+	Added   int
+	Removed int
+	// State is what the module needs to apply and roll back the plan. The Coordinator does not
+	// look into it.
+	State interface{}
+}
+
+// Reloadable is a module that applies a reloaded config.
+type Reloadable interface {
+	// Validate returns an error if the module can not apply conf, e.g. it changes a setting
+	// that needs a restart.
+	Validate(conf *config.Config) error
+	// Plan returns the changes that apply conf. It does not change anything yet.
+	Plan(conf *config.Config) (Plan, error)
+	// Apply makes the changes of the plan.
+	Apply(plan Plan) error
+	// Rollback undoes the changes of the plan, including when Apply failed half way.
+	Rollback(plan Plan) error
+}
+
+type ModuleReport struct {
+	Module  string `json:"module"`
+	Status  string `json:"status"`
+	Summary string `json:"summary,omitempty"`
+	Added   int    `json:"added,omitempty"`
+	Removed int    `json:"removed,omitempty"`
+	Error   string `json:"error,omitempty"`
+	// RollbackError is why the plan could not be rolled back, and the module is left in between.
+	RollbackError string `json:"rollback_error,omitempty"`
+}
+
+// Report is the outcome of a reload, for every module in the order they are registered.
+type Report struct {
+	Time    time.Time `json:"time"`
+	Applied bool      `json:"applied"`
+	// Stage is the stage that failed, empty when the config is applied.
+	Stage string `json:"stage,omitempty"`
+	// Error is why the config could not be loaded, when Stage is STAGE_LOAD.
+	Error   string         `json:"error,omitempty"`
+	Modules []ModuleReport `json:"modules"`
+}
+
+// Added returns the number of entries the plans of the modules add.
+func (r Report) Added() int {
+	n := 0
+	for _, m := range r.Modules {
+		n += m.Added
+	}
+	return n
+}
+
+// Removed returns the number of entries the plans of the modules remove.
+func (r Report) Removed() int {
+	n := 0
+	for _, m := range r.Modules {
+		n += m.Removed
+	}
+	return n
+}
+
+// RolledBack reports whether every plan applied before the failure was rolled back, so
+// that every module is back on the previous config.
+func (r Report) RolledBack() bool {
+	for _, m := range r.Modules {
+		if m.Status == MODULE_ROLLBACK_FAILED {
+			return false
+		}
+	}
+	return true
+}
+
+// Err returns the errors of the stage that failed, or nil when the config is applied.
+func (r Report) Err() error {
+	if r.Applied {
+		return nil
+	}
+	if r.Error != "" {
+		return fmt.Errorf("config reload failed to %s: %s", r.Stage, r.Error)
+	}
+	errs := []string{}
+	for _, m := range r.Modules {
+		if m.Error != "" {
+			errs = append(errs, fmt.Sprintf("%s: %s", m.Module, m.Error))
+		}
+	}
+	err := fmt.Sprintf("config reload failed to %s: %s", r.Stage, strings.Join(errs, "; "))
+	if !r.RolledBack() {
+		err += ", and could not be rolled back"
+	}
+	return fmt.Errorf("%s", err)
+}
+
+// Summary returns the changes of the modules on one line, e.g.
+// "network: network.cidr.allow: +10.0.0.0/8; mount: unchanged".
+func (r Report) Summary() string {
+	parts := []string{}
+	for _, m := range r.Modules {
+		summary := m.Summary
+		if m.Status == MODULE_UNCHANGED || summary == "" {
+			summary = m.Status
+		}
+		parts = append(parts, fmt.Sprintf("%s: %s", m.Module, summary))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// String returns the report with one line per module, e.g.
+//
+//	config reload failed to apply, rolled back:
+//	  network      rolled back      network.cidr.allow: +10.0.0.0/8
+//	  fileaccess   failed           open /etc/shadow: permission denied
+func (r Report) String() string {
+	var b strings.Builder
+	switch {
+	case r.Applied:
+		b.WriteString("config reload applied:\n")
+	case r.Error != "":
+		fmt.Fprintf(&b, "config reload failed to %s, every module is left on the previous config: %s\n", r.Stage, r.Error)
+	case r.RolledBack():
+		fmt.Fprintf(&b, "config reload failed to %s, rolled back:\n", r.Stage)
+	default:
+		fmt.Fprintf(&b, "config reload failed to %s, some modules could not be rolled back:\n", r.Stage)
+	}
+	for _, m := range r.Modules {
+		detail := m.Summary
+		if m.Error != "" {
+			detail = m.Error
+		}
+		if m.RollbackError != "" {
+			detail += " (rollback: " + m.RollbackError + ")"
+		}
+		fmt.Fprintf(&b, "  %-12s %-16s %s\n", m.Module, m.Status, detail)
+	}
+	return b.String()
+}
+
+type module struct {
+	name string
+	r    Reloadable
+}
+
+// Default is the Coordinator the modules of bouheki register with, and that reloads them on SIGHUP.
+var Default = NewCoordinator(nil)
+
+// Coordinator reloads the registered modules together.
+type Coordinator struct {
+	mu      sync.Mutex
+	modules []module
+	// policyDigest is the digest of the config_reload notifications. nil sends none.
+	policyDigest func() string
+	now          func() time.Time
+}
+
+// NewCoordinator returns a Coordinator whose reloads are published with the digest policyDigest
+// returns, if it is not nil.
+func NewCoordinator(policyDigest func() string) *Coordinator {
+	return &Coordinator{policyDigest: policyDigest, now: time.Now}
+}
+
+// SetPolicyDigest sets the digest the reloads are published with, nil to publish none.
+func (c *Coordinator) SetPolicyDigest(policyDigest func() string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.policyDigest = policyDigest
+}
+
+// Register adds a module, whose plans are applied after the ones of the modules registered before.
+func (c *Coordinator) Register(name string, r Reloadable) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.modules = append(c.modules, module{name: name, r: r})
+}
+
+// Reload applies conf to every module, or to none, and reports it. Reloads run one at a time.
+func (c *Coordinator) Reload(conf *config.Config) Report {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	report := c.reload(conf)
+	c.emit(report)
+	return report
+}
+
+// LoadFailed reports a reload whose config could not be loaded, e.g. it is invalid, so that no
+// module saw it and every module is left on the previous config.
+func (c *Coordinator) LoadFailed(err error) Report {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	report := Report{Time: c.now(), Stage: STAGE_LOAD, Error: err.Error(), Modules: make([]ModuleReport, len(c.modules))}
+	for i, m := range c.modules {
+		report.Modules[i] = ModuleReport{Module: m.name, Status: MODULE_SKIPPED}
+	}
+	c.emit(report)
+	return report
+}
+
+func (c *Coordinator) reload(conf *config.Config) Report {
+	report := Report{Time: c.now(), Modules: make([]ModuleReport, len(c.modules))}
+	for i, m := range c.modules {
+		report.Modules[i] = ModuleReport{Module: m.name, Status: MODULE_SKIPPED}
+	}
+
+	// Every module is validated, then planned, so that the report has all the errors of the stage.
+	for i, m := range c.modules {
+		if err := m.r.Validate(conf); err != nil {
+			report.Modules[i].Status = MODULE_FAILED
+			report.Modules[i].Error = err.Error()
+			report.Stage = STAGE_VALIDATE
+		}
+	}
+	if report.Stage != "" {
+		return report
+	}
+
+	plans := make([]Plan, len(c.modules))
+	for i, m := range c.modules {
+		plan, err := m.r.Plan(conf)
+		if err != nil {
+			report.Modules[i].Status = MODULE_FAILED
+			report.Modules[i].Error = err.Error()
+			report.Stage = STAGE_PLAN
+			continue
+		}
+		plans[i] = plan
+		report.Modules[i].Summary = plan.Summary
+		report.Modules[i].Added, report.Modules[i].Removed = plan.Added, plan.Removed
+	}
+	if report.Stage != "" {
+		return report
+	}
+
+	for i, m := range c.modules {
+		if plans[i].Unchanged {
+			report.Modules[i].Status = MODULE_UNCHANGED
+			continue
+		}
+		if err := m.r.Apply(plans[i]); err != nil {
+			report.Modules[i].Status = MODULE_FAILED
+			report.Modules[i].Error = err.Error()
+			report.Stage = STAGE_APPLY
+			c.rollback(&report, plans, i)
+			return report
+		}
+		report.Modules[i].Status = MODULE_APPLIED
+	}
+
+	report.Applied = true
+	return report
+}
+
+// rollback rolls back the plans of the modules up to failed, the failed one included, in the
+// reverse order. The modules after failed are left skipped.
+func (c *Coordinator) rollback(report *Report, plans []Plan, failed int) {
+	for i := failed; i >= 0; i-- {
+		if plans[i].Unchanged {
+			continue
+		}
+		err := c.modules[i].r.Rollback(plans[i])
+		if err != nil {
+			report.Modules[i].RollbackError = err.Error()
+		}
+		if i == failed {
+			if err != nil {
+				report.Modules[i].Status = MODULE_ROLLBACK_FAILED
+			}
+			continue
+		}
+		report.Modules[i].Status = MODULE_ROLLED_BACK
+		if err != nil {
+			report.Modules[i].Status = MODULE_ROLLBACK_FAILED
+		}
+	}
+}
+
+// emit logs the report, and publishes it as a config_reload notification.
+func (c *Coordinator) emit(report Report) {
+	l := &log.ConfigReloadLog{Stage: report.Stage, Diff: report.Summary(), Added: report.Added(), Removed: report.Removed()}
+	if err := report.Err(); err != nil {
+		l.Err = err.Error()
+		l.Warn()
+	} else {
+		l.Info()
+	}
+
+	if c.policyDigest == nil {
+		return
+	}
+	notify.Publish(notify.ConfigReload{Applied: report.Applied, Error: l.Err, Diff: l.Diff}, c.policyDigest())
+}
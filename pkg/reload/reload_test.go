@@ -0,0 +1,238 @@
+package reload
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/notify"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeModule records the calls of the Coordinator to calls, and fails the stages of fail.
+type fakeModule struct {
+	name      string
+	calls     *[]string
+	fail      map[string]bool
+	unchanged bool
+	// added and removed are the entries of its plans.
+	added, removed int
+}
+
+func (f *fakeModule) call(stage string) error {
+	*f.calls = append(*f.calls, fmt.Sprintf("%s %s", stage, f.name))
+	if f.fail[stage] {
+		return fmt.Errorf("%s of %s failed", stage, f.name)
+	}
+	return nil
+}
+
+func (f *fakeModule) Validate(conf *config.Config) error {
+	return f.call(STAGE_VALIDATE)
+}
+
+func (f *fakeModule) Plan(conf *config.Config) (Plan, error) {
+	if err := f.call(STAGE_PLAN); err != nil {
+		return Plan{}, err
+	}
+	return Plan{Summary: "+1 " + f.name, Unchanged: f.unchanged, Added: f.added, Removed: f.removed, State: f.name}, nil
+}
+
+func (f *fakeModule) Apply(plan Plan) error {
+	if plan.State != f.name {
+		return errors.New("applied the plan of another module")
+	}
+	return f.call(STAGE_APPLY)
+}
+
+func (f *fakeModule) Rollback(plan Plan) error {
+	return f.call("rollback")
+}
+
+func newTestCoordinator(modules ...*fakeModule) (*Coordinator, *[]string) {
+	calls := []string{}
+	c := NewCoordinator(nil)
+	c.now = func() time.Time { return time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC) }
+	for _, m := range modules {
+		m.calls = &calls
+		c.Register(m.name, m)
+	}
+	return c, &calls
+}
+
+func statuses(report Report) []string {
+	s := []string{}
+	for _, m := range report.Modules {
+		s = append(s, m.Status)
+	}
+	return s
+}
+
+func TestReloadAppliesEveryModuleInOrder(t *testing.T) {
+	c, calls := newTestCoordinator(&fakeModule{name: "network"}, &fakeModule{name: "fileaccess", unchanged: true}, &fakeModule{name: "mount"})
+
+	report := c.Reload(config.DefaultConfig())
+	assert.True(t, report.Applied)
+	assert.Nil(t, report.Err())
+	assert.Equal(t, "", report.Stage)
+	assert.Equal(t, []string{
+		"validate network", "validate fileaccess", "validate mount",
+		"plan network", "plan fileaccess", "plan mount",
+		"apply network", "apply mount",
+	}, *calls)
+	assert.Equal(t, []string{MODULE_APPLIED, MODULE_UNCHANGED, MODULE_APPLIED}, statuses(report))
+	assert.Equal(t, "network: +1 network; fileaccess: unchanged; mount: +1 mount", report.Summary())
+	assert.Equal(t, "config reload applied:\n"+
+		"  network      applied          +1 network\n"+
+		"  fileaccess   unchanged        +1 fileaccess\n"+
+		"  mount        applied          +1 mount\n", report.String())
+}
+
+func TestReloadFailsAtEachStage(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		fail     map[string]map[string]bool
+		stage    string
+		calls    []string
+		statuses []string
+	}{
+		{
+			name:     "every module is validated, and none is planned",
+			fail:     map[string]map[string]bool{"fileaccess": {STAGE_VALIDATE: true}, "mount": {STAGE_VALIDATE: true}},
+			stage:    STAGE_VALIDATE,
+			calls:    []string{"validate network", "validate fileaccess", "validate mount"},
+			statuses: []string{MODULE_SKIPPED, MODULE_FAILED, MODULE_FAILED},
+		},
+		{
+			name:  "every module is planned, and none is applied",
+			fail:  map[string]map[string]bool{"network": {STAGE_PLAN: true}},
+			stage: STAGE_PLAN,
+			calls: []string{
+				"validate network", "validate fileaccess", "validate mount",
+				"plan network", "plan fileaccess", "plan mount",
+			},
+			statuses: []string{MODULE_FAILED, MODULE_SKIPPED, MODULE_SKIPPED},
+		},
+		{
+			name:  "the applied plans are rolled back in the reverse order, the failed one included",
+			fail:  map[string]map[string]bool{"mount": {STAGE_APPLY: true}},
+			stage: STAGE_APPLY,
+			calls: []string{
+				"validate network", "validate fileaccess", "validate mount",
+				"plan network", "plan fileaccess", "plan mount",
+				"apply network", "apply fileaccess", "apply mount",
+				"rollback mount", "rollback fileaccess", "rollback network",
+			},
+			statuses: []string{MODULE_ROLLED_BACK, MODULE_ROLLED_BACK, MODULE_FAILED},
+		},
+		{
+			name:  "the modules after the failed one are not applied",
+			fail:  map[string]map[string]bool{"network": {STAGE_APPLY: true}},
+			stage: STAGE_APPLY,
+			calls: []string{
+				"validate network", "validate fileaccess", "validate mount",
+				"plan network", "plan fileaccess", "plan mount",
+				"apply network", "rollback network",
+			},
+			statuses: []string{MODULE_FAILED, MODULE_SKIPPED, MODULE_SKIPPED},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c, calls := newTestCoordinator(
+				&fakeModule{name: "network", fail: test.fail["network"]},
+				&fakeModule{name: "fileaccess", fail: test.fail["fileaccess"]},
+				&fakeModule{name: "mount", fail: test.fail["mount"]},
+			)
+
+			report := c.Reload(config.DefaultConfig())
+			assert.False(t, report.Applied)
+			assert.Equal(t, test.stage, report.Stage)
+			assert.Equal(t, test.calls, *calls)
+			assert.Equal(t, test.statuses, statuses(report))
+			assert.True(t, report.RolledBack())
+			assert.NotNil(t, report.Err())
+			assert.True(t, strings.HasPrefix(report.Err().Error(), "config reload failed to "+test.stage+": "))
+			for name, stages := range test.fail {
+				for stage := range stages {
+					assert.Contains(t, report.Err().Error(), fmt.Sprintf("%s: %s of %s failed", name, stage, name))
+				}
+			}
+		})
+	}
+}
+
+func TestReloadReportsTheFailedRollbacks(t *testing.T) {
+	c, calls := newTestCoordinator(
+		&fakeModule{name: "network", fail: map[string]bool{"rollback": true}},
+		&fakeModule{name: "fileaccess", unchanged: true},
+		&fakeModule{name: "mount", fail: map[string]bool{STAGE_APPLY: true}},
+	)
+
+	report := c.Reload(config.DefaultConfig())
+	assert.False(t, report.Applied)
+	// The unchanged module is neither applied nor rolled back, and a failed rollback does not stop the others.
+	assert.Equal(t, []string{"apply network", "apply mount", "rollback mount", "rollback network"}, (*calls)[6:])
+	assert.Equal(t, []string{MODULE_ROLLBACK_FAILED, MODULE_UNCHANGED, MODULE_FAILED}, statuses(report))
+	assert.Equal(t, "rollback of network failed", report.Modules[0].RollbackError)
+	assert.False(t, report.RolledBack())
+	assert.Equal(t, "config reload failed to apply: mount: apply of mount failed, and could not be rolled back", report.Err().Error())
+	assert.Equal(t, "config reload failed to apply, some modules could not be rolled back:\n"+
+		"  network      rollback failed  +1 network (rollback: rollback of network failed)\n"+
+		"  fileaccess   unchanged        +1 fileaccess\n"+
+		"  mount        failed           apply of mount failed\n", report.String())
+}
+
+func TestReloadIsPublished(t *testing.T) {
+	s := notify.DefaultHub.Subscribe(notify.TYPE_CONFIG_RELOAD)
+	defer notify.DefaultHub.Unsubscribe(s)
+
+	c, _ := newTestCoordinator(&fakeModule{name: "network"}, &fakeModule{name: "mount", fail: map[string]bool{STAGE_VALIDATE: true}})
+	// Without a digest, nothing is published.
+	c.Reload(config.DefaultConfig())
+	c.policyDigest = func() string { return "digest" }
+	c.Reload(config.DefaultConfig())
+
+	n := <-s.C
+	assert.Equal(t, "digest", n.PolicyDigest)
+	assert.Equal(t, notify.ConfigReload{
+		Applied: false,
+		Error:   "config reload failed to validate: mount: validate of mount failed",
+		Diff:    "network: skipped; mount: failed",
+	}, n.Payload)
+	assert.Len(t, s.C, 0)
+}
+
+func TestLoadFailedLeavesEveryModule(t *testing.T) {
+	s := notify.DefaultHub.Subscribe(notify.TYPE_CONFIG_RELOAD)
+	defer notify.DefaultHub.Unsubscribe(s)
+
+	c, calls := newTestCoordinator(&fakeModule{name: "network"}, &fakeModule{name: "mount"})
+	c.SetPolicyDigest(func() string { return "digest" })
+	report := c.LoadFailed(errors.New("network.cidr.allow: invalid CIDR address: 10.0.0.0/33"))
+
+	assert.Empty(t, *calls)
+	assert.False(t, report.Applied)
+	assert.Equal(t, STAGE_LOAD, report.Stage)
+	assert.Equal(t, []string{MODULE_SKIPPED, MODULE_SKIPPED}, statuses(report))
+	assert.EqualError(t, report.Err(), "config reload failed to load: network.cidr.allow: invalid CIDR address: 10.0.0.0/33")
+	assert.Equal(t, "config reload failed to load, every module is left on the previous config: network.cidr.allow: invalid CIDR address: 10.0.0.0/33\n"+
+		"  network      skipped          \n"+
+		"  mount        skipped          \n", report.String())
+
+	n := <-s.C
+	assert.Equal(t, "config reload failed to load: network.cidr.allow: invalid CIDR address: 10.0.0.0/33", n.Payload.(notify.ConfigReload).Error)
+}
+
+func TestReloadCountsTheEntriesOfThePlans(t *testing.T) {
+	c, _ := newTestCoordinator(&fakeModule{name: "network", added: 2, removed: 1}, &fakeModule{name: "mount"})
+
+	report := c.Reload(config.DefaultConfig())
+	assert.True(t, report.Applied)
+	assert.Equal(t, 2, report.Modules[0].Added)
+	assert.Equal(t, 1, report.Modules[0].Removed)
+	assert.Equal(t, 2, report.Added())
+	assert.Equal(t, 1, report.Removed())
+}
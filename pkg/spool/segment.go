@@ -0,0 +1,145 @@
+package spool
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+
+	log "github.com/mrtc0/bouheki/pkg/log"
+)
+
+// A record is stored as
+//
+//	| length (4 bytes, LE) | CRC32 of the payload (4 bytes, LE) | payload |
+const RECORD_HEADER_SIZE = 8
+
+var errCorruptRecord = errors.New("corrupt record")
+
+type segment struct {
+	seq   uint64
+	path  string
+	file  *os.File
+	size  int64
+	count int
+}
+
+// openSegment opens or creates the segment and truncates it after the last complete record.
+func openSegment(seq uint64, path string) (*segment, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	seg := &segment{seq: seq, path: path, file: file}
+	if err := seg.scan(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return seg, nil
+}
+
+func (seg *segment) scan() error {
+	info, err := seg.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	var offset int64
+	for offset < info.Size() {
+		_, next, err := seg.read(offset)
+		if err != nil {
+			log.Warn(fmt.Sprintf("spool segment %s has a torn record at offset %d, truncating %d bytes: %s", seg.path, offset, info.Size()-offset, err))
+			if err := seg.file.Truncate(offset); err != nil {
+				return err
+			}
+			break
+		}
+		offset = next
+		seg.count++
+	}
+	seg.size = offset
+
+	return nil
+}
+
+// read returns the record at offset and the offset of the next record.
+func (seg *segment) read(offset int64) ([]byte, int64, error) {
+	header := make([]byte, RECORD_HEADER_SIZE)
+	if _, err := seg.file.ReadAt(header, offset); err != nil {
+		return nil, 0, readError(err)
+	}
+
+	length := binary.LittleEndian.Uint32(header[0:4])
+	checksum := binary.LittleEndian.Uint32(header[4:8])
+
+	record := make([]byte, length)
+	if _, err := seg.file.ReadAt(record, offset+RECORD_HEADER_SIZE); err != nil {
+		return nil, 0, readError(err)
+	}
+	if crc32.ChecksumIEEE(record) != checksum {
+		return nil, 0, errCorruptRecord
+	}
+
+	return record, offset + RECORD_HEADER_SIZE + int64(length), nil
+}
+
+// boundary returns the offset and index of the first record starting at or after offset.
+func (seg *segment) boundary(offset int64) (int64, int) {
+	var current int64
+	for index := 0; index < seg.count; index++ {
+		if current >= offset {
+			return current, index
+		}
+		_, next, err := seg.read(current)
+		if err != nil {
+			break
+		}
+		current = next
+	}
+	return seg.size, seg.count
+}
+
+// append writes the record and syncs it, so an acknowledged Append survives a crash.
+func (seg *segment) append(record []byte) error {
+	buf := make([]byte, RECORD_HEADER_SIZE+len(record))
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(len(record)))
+	binary.LittleEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(record))
+	copy(buf[RECORD_HEADER_SIZE:], record)
+
+	if _, err := seg.file.WriteAt(buf, seg.size); err != nil {
+		// drop the partial write so the next record starts at a boundary.
+		seg.file.Truncate(seg.size)
+		return err
+	}
+	if err := seg.file.Sync(); err != nil {
+		return err
+	}
+
+	seg.size += int64(len(buf))
+	seg.count++
+	return nil
+}
+
+func (seg *segment) reset() error {
+	if err := seg.file.Truncate(0); err != nil {
+		return err
+	}
+	seg.size = 0
+	seg.count = 0
+	return nil
+}
+
+func (seg *segment) close() error {
+	return seg.file.Close()
+}
+
+func readError(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
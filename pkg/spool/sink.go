@@ -0,0 +1,112 @@
+package spool
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/mrtc0/bouheki/pkg/log"
+)
+
+const DEFAULT_RETRY_INTERVAL = 5 * time.Second
+
+// Sender delivers one event to a sink such as a webhook or a SIEM collector.
+type Sender interface {
+	Send(event []byte) error
+}
+
+// Sink delivers events through the Sender and spools the ones it could not deliver.
+// Spooled events are replayed in order by a background drainer before any new event is sent.
+type Sink struct {
+	mu            sync.Mutex
+	sender        Sender
+	spool         *Spool
+	retryInterval time.Duration
+	stop          chan struct{}
+	done          chan struct{}
+}
+
+func NewSink(sender Sender, spool *Spool, retryInterval time.Duration) *Sink {
+	if retryInterval <= 0 {
+		retryInterval = DEFAULT_RETRY_INTERVAL
+	}
+
+	s := &Sink{
+		sender:        sender,
+		spool:         spool,
+		retryInterval: retryInterval,
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	go s.drainer()
+
+	return s
+}
+
+// Send delivers the event, or spools it if the sender fails or older events are still spooled.
+func (s *Sink) Send(event []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.spool.Len() == 0 {
+		err := s.sender.Send(event)
+		if err == nil {
+			return nil
+		}
+		log.Debug(fmt.Sprintf("failed to deliver an event, spooling it: %s", err))
+	}
+
+	return s.spool.Append(event)
+}
+
+func (s *Sink) Stats() Stats {
+	return s.spool.Stats()
+}
+
+// Close stops the drainer, delivers what it can within timeout and persists the rest to disk.
+func (s *Sink) Close(timeout time.Duration) error {
+	close(s.stop)
+	<-s.done
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		delivered, err := s.drain()
+		if err == nil || delivered == 0 {
+			break
+		}
+	}
+
+	if remaining := s.spool.Len(); remaining > 0 {
+		log.Info(fmt.Sprintf("%d undelivered events are kept in the spool", remaining))
+	}
+	return s.spool.Close()
+}
+
+func (s *Sink) drainer() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.retryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			delivered, err := s.drain()
+			if delivered > 0 {
+				log.Info(fmt.Sprintf("replayed %d spooled events", delivered))
+			}
+			if err != nil {
+				log.Debug(fmt.Sprintf("sink is still unavailable: %s", err))
+			}
+		}
+	}
+}
+
+func (s *Sink) drain() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.spool.Drain(s.sender.Send)
+}
@@ -0,0 +1,433 @@
+// Package spool is a size-bounded on-disk queue for events a sink could not deliver.
+//
+// Records are appended to segment files and replayed in order. A record is only removed after it
+// is acknowledged, so delivery is at-least-once: events replayed after a crash must be
+// deduplicated downstream by their unique ID.
+package spool
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/mrtc0/bouheki/pkg/log"
+	"github.com/mrtc0/bouheki/pkg/metrics"
+	"github.com/mrtc0/bouheki/pkg/spool/spoolconf"
+)
+
+const (
+	OVERFLOW_DROP_OLDEST    = spoolconf.OVERFLOW_DROP_OLDEST
+	OVERFLOW_STOP_ACCEPTING = spoolconf.OVERFLOW_STOP_ACCEPTING
+
+	DEFAULT_MAX_SIZE     = spoolconf.DEFAULT_MAX_SIZE
+	DEFAULT_SEGMENT_SIZE = spoolconf.DEFAULT_SEGMENT_SIZE
+
+	SEGMENT_SUFFIX   = ".seg"
+	CURSOR_FILE_NAME = "cursor"
+)
+
+var (
+	ErrFull     = errors.New("spool is full")
+	ErrClosed   = errors.New("spool is closed")
+	ErrTooLarge = errors.New("record is larger than the spool")
+	ErrEmpty    = errors.New("spool is empty")
+)
+
+// Config is the config of a spool, in spoolconf so that pkg/config does not import the spool.
+type Config = spoolconf.Config
+
+// Stats is the state of a spool as reported in status and metrics.
+type Stats struct {
+	Records  int    `json:"records"`
+	Bytes    int64  `json:"bytes"`
+	Segments int    `json:"segments"`
+	Dropped  uint64 `json:"dropped"`
+	Rejected uint64 `json:"rejected"`
+}
+
+type spoolMetrics struct {
+	records  *metrics.Gauge
+	bytes    *metrics.Gauge
+	dropped  *metrics.Counter
+	rejected *metrics.Counter
+}
+
+func newSpoolMetrics(name string) spoolMetrics {
+	return spoolMetrics{
+		records:  metrics.NewGauge("spool_"+name+"_records", "Number of undelivered events in the spool."),
+		bytes:    metrics.NewGauge("spool_"+name+"_bytes", "Size of the spool segments on disk."),
+		dropped:  metrics.NewCounter("spool_"+name+"_dropped_total", "Number of spooled events dropped by the drop-oldest overflow policy."),
+		rejected: metrics.NewCounter("spool_"+name+"_rejected_total", "Number of events rejected by the stop-accepting overflow policy."),
+	}
+}
+
+type Spool struct {
+	mu       sync.Mutex
+	config   Config
+	segments []*segment
+	// offset and index of the next unacknowledged record in segments[0].
+	readOffset int64
+	readIndex  int
+	closed     bool
+	stats      Stats
+	metrics    spoolMetrics
+}
+
+// Open opens the spool in config.Dir, recovering the segments left by a previous run.
+// Records torn by a crash are truncated away.
+func Open(name string, config Config) (*Spool, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	config.SetDefaults()
+
+	if err := os.MkdirAll(config.Dir, 0700); err != nil {
+		return nil, err
+	}
+
+	s := &Spool{config: config, metrics: newSpoolMetrics(name)}
+	if err := s.recover(); err != nil {
+		s.closeSegments()
+		return nil, err
+	}
+	s.updateMetrics()
+
+	return s, nil
+}
+
+func (s *Spool) recover() error {
+	seqs, err := listSegments(s.config.Dir)
+	if err != nil {
+		return err
+	}
+
+	cursorSeq, cursorOffset := s.readCursor()
+	for _, seq := range seqs {
+		path := segmentPath(s.config.Dir, seq)
+		if seq < cursorSeq {
+			// already delivered before the last shutdown.
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+			continue
+		}
+
+		seg, err := openSegment(seq, path)
+		if err != nil {
+			return err
+		}
+		s.segments = append(s.segments, seg)
+	}
+
+	if len(s.segments) == 0 {
+		return s.rotate()
+	}
+
+	if s.segments[0].seq == cursorSeq {
+		s.readOffset, s.readIndex = s.segments[0].boundary(cursorOffset)
+	}
+	for len(s.segments) > 1 && s.readIndex == s.segments[0].count {
+		if err := s.releaseHead(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Append stores the record at the end of the spool.
+func (s *Spool) Append(record []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+
+	size := int64(RECORD_HEADER_SIZE + len(record))
+	if size > s.config.MaxSize {
+		return ErrTooLarge
+	}
+
+	for s.size()+size > s.config.MaxSize {
+		if s.config.Overflow == OVERFLOW_STOP_ACCEPTING {
+			s.stats.Rejected++
+			s.metrics.rejected.Inc()
+			return ErrFull
+		}
+		if err := s.dropOldest(); err != nil {
+			return err
+		}
+	}
+
+	if tail := s.tail(); tail.size > 0 && tail.size+size > s.config.SegmentSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	if err := s.tail().append(record); err != nil {
+		return err
+	}
+	s.updateMetrics()
+
+	return nil
+}
+
+// Peek returns the oldest unacknowledged record.
+func (s *Spool) Peek() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, ErrClosed
+	}
+	if s.pending() == 0 {
+		return nil, ErrEmpty
+	}
+
+	record, _, err := s.segments[0].read(s.readOffset)
+	return record, err
+}
+
+// Ack removes the record returned by Peek.
+func (s *Spool) Ack() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+	if s.pending() == 0 {
+		return ErrEmpty
+	}
+
+	head := s.segments[0]
+	_, next, err := head.read(s.readOffset)
+	if err != nil {
+		return err
+	}
+	s.readOffset = next
+	s.readIndex++
+
+	if s.readIndex == head.count {
+		if err := s.releaseHead(); err != nil {
+			return err
+		}
+	}
+	s.updateMetrics()
+
+	return s.writeCursor()
+}
+
+// Drain delivers the spooled records in order until deliver fails or the spool is empty.
+// It returns the number of delivered records.
+func (s *Spool) Drain(deliver func([]byte) error) (int, error) {
+	delivered := 0
+	for {
+		record, err := s.Peek()
+		if err == ErrEmpty {
+			return delivered, nil
+		}
+		if err != nil {
+			return delivered, err
+		}
+
+		if err := deliver(record); err != nil {
+			return delivered, err
+		}
+		if err := s.Ack(); err != nil {
+			return delivered, err
+		}
+		delivered++
+	}
+}
+
+func (s *Spool) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.pending()
+}
+
+func (s *Spool) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := s.stats
+	stats.Records = s.pending()
+	stats.Bytes = s.size()
+	stats.Segments = len(s.segments)
+	return stats
+}
+
+// Close syncs the segments and persists the read position. Undelivered records are replayed by the next Open.
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	err := s.writeCursor()
+	if closeErr := s.closeSegments(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (s *Spool) closeSegments() error {
+	var err error
+	for _, seg := range s.segments {
+		if closeErr := seg.close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+func (s *Spool) pending() int {
+	records := -s.readIndex
+	for _, seg := range s.segments {
+		records += seg.count
+	}
+	return records
+}
+
+func (s *Spool) size() int64 {
+	var size int64
+	for _, seg := range s.segments {
+		size += seg.size
+	}
+	return size
+}
+
+func (s *Spool) tail() *segment {
+	return s.segments[len(s.segments)-1]
+}
+
+func (s *Spool) rotate() error {
+	var seq uint64
+	if len(s.segments) > 0 {
+		seq = s.tail().seq + 1
+	}
+
+	seg, err := openSegment(seq, segmentPath(s.config.Dir, seq))
+	if err != nil {
+		return err
+	}
+	s.segments = append(s.segments, seg)
+	return nil
+}
+
+func (s *Spool) dropOldest() error {
+	if len(s.segments) == 1 {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	dropped := s.segments[0].count - s.readIndex
+	s.stats.Dropped += uint64(dropped)
+	s.metrics.dropped.Add(uint64(dropped))
+	log.Warn(fmt.Sprintf("spool %s is full, dropped %d undelivered events", s.config.Dir, dropped))
+
+	return s.releaseHead()
+}
+
+// releaseHead removes the fully acknowledged (or dropped) head segment.
+// The tail is truncated instead, as it is still being written.
+func (s *Spool) releaseHead() error {
+	head := s.segments[0]
+	s.readOffset, s.readIndex = 0, 0
+
+	if len(s.segments) == 1 {
+		return head.reset()
+	}
+
+	if err := head.close(); err != nil {
+		return err
+	}
+	if err := os.Remove(head.path); err != nil {
+		return err
+	}
+	s.segments = s.segments[1:]
+	return nil
+}
+
+func (s *Spool) updateMetrics() {
+	s.metrics.records.Set(float64(s.pending()))
+	s.metrics.bytes.Set(float64(s.size()))
+}
+
+func (s *Spool) cursorPath() string {
+	return filepath.Join(s.config.Dir, CURSOR_FILE_NAME)
+}
+
+func (s *Spool) readCursor() (uint64, int64) {
+	data, err := ioutil.ReadFile(s.cursorPath())
+	if err != nil {
+		return 0, 0
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) != 2 {
+		return 0, 0
+	}
+	seq, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return 0, 0
+	}
+	offset, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return 0, 0
+	}
+
+	return seq, offset
+}
+
+// writeCursor persists the read position. A crash before it is written replays
+// the acknowledged records, which is allowed by the at-least-once guarantee.
+func (s *Spool) writeCursor() error {
+	tmp := s.cursorPath() + ".tmp"
+	data := fmt.Sprintf("%d %d\n", s.segments[0].seq, s.readOffset)
+	if err := ioutil.WriteFile(tmp, []byte(data), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.cursorPath())
+}
+
+func segmentPath(dir string, seq uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", seq, SEGMENT_SUFFIX))
+}
+
+func listSegments(dir string) ([]uint64, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	seqs := []uint64{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, SEGMENT_SUFFIX) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, SEGMENT_SUFFIX), 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs, nil
+}
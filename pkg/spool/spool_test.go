@@ -0,0 +1,295 @@
+package spool
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func openTestSpool(t *testing.T, config Config) *Spool {
+	if config.Dir == "" {
+		config.Dir = t.TempDir()
+	}
+	s, err := Open("test", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func appendRecords(t *testing.T, s *Spool, records ...string) {
+	for _, record := range records {
+		if err := s.Append([]byte(record)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func drainAll(t *testing.T, s *Spool) []string {
+	got := []string{}
+	_, err := s.Drain(func(record []byte) error {
+		got = append(got, string(record))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, "*"+SEGMENT_SUFFIX))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestSpoolAppendAndDrainInOrder(t *testing.T) {
+	s := openTestSpool(t, Config{SegmentSize: 32})
+	defer s.Close()
+
+	appendRecords(t, s, "event-1", "event-2", "event-3", "event-4")
+	assert.Equal(t, 4, s.Len())
+	assert.Greater(t, s.Stats().Segments, 1)
+
+	assert.Equal(t, []string{"event-1", "event-2", "event-3", "event-4"}, drainAll(t, s))
+	assert.Equal(t, 0, s.Len())
+	assert.Equal(t, 1, s.Stats().Segments)
+}
+
+func TestSpoolDrainStopsAtFailure(t *testing.T) {
+	s := openTestSpool(t, Config{})
+	defer s.Close()
+
+	appendRecords(t, s, "event-1", "event-2", "event-3")
+
+	delivered, err := s.Drain(func(record []byte) error {
+		if string(record) == "event-2" {
+			return errors.New("collector is down")
+		}
+		return nil
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, delivered)
+	assert.Equal(t, []string{"event-2", "event-3"}, drainAll(t, s))
+}
+
+func TestSpoolReopen(t *testing.T) {
+	dir := t.TempDir()
+	config := Config{Dir: dir, SegmentSize: 32}
+
+	s := openTestSpool(t, config)
+	appendRecords(t, s, "event-1", "event-2", "event-3", "event-4")
+	record, err := s.Peek()
+	assert.NoError(t, err)
+	assert.Equal(t, "event-1", string(record))
+	assert.NoError(t, s.Ack())
+	assert.NoError(t, s.Close())
+
+	s = openTestSpool(t, config)
+	defer s.Close()
+	assert.Equal(t, []string{"event-2", "event-3", "event-4"}, drainAll(t, s))
+}
+
+func TestSpoolReplaysUnacknowledgedRecords(t *testing.T) {
+	dir := t.TempDir()
+	config := Config{Dir: dir}
+
+	s := openTestSpool(t, config)
+	appendRecords(t, s, "event-1", "event-2")
+	// delivered but crashed before the acknowledgement.
+	_, err := s.Peek()
+	assert.NoError(t, err)
+	s.closeSegments()
+
+	s = openTestSpool(t, config)
+	defer s.Close()
+	assert.Equal(t, []string{"event-1", "event-2"}, drainAll(t, s))
+}
+
+func TestSpoolRecoversTornRecords(t *testing.T) {
+	tests := []struct {
+		name     string
+		corrupt  func(path string, size int64) error
+		expected []string
+	}{
+		{
+			name: "truncated in the header",
+			corrupt: func(path string, size int64) error {
+				return os.Truncate(path, size-int64(len("event-3"))-4)
+			},
+			expected: []string{"event-1", "event-2"},
+		},
+		{
+			name: "truncated in the payload",
+			corrupt: func(path string, size int64) error {
+				return os.Truncate(path, size-2)
+			},
+			expected: []string{"event-1", "event-2"},
+		},
+		{
+			name: "corrupted payload",
+			corrupt: func(path string, size int64) error {
+				f, err := os.OpenFile(path, os.O_WRONLY, 0600)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				_, err = f.WriteAt([]byte("X"), size-1)
+				return err
+			},
+			expected: []string{"event-1", "event-2"},
+		},
+		{
+			name: "garbage after the last record",
+			corrupt: func(path string, size int64) error {
+				f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				_, err = f.Write([]byte{0xff, 0xff})
+				return err
+			},
+			expected: []string{"event-1", "event-2", "event-3"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			config := Config{Dir: dir}
+
+			s := openTestSpool(t, config)
+			appendRecords(t, s, "event-1", "event-2", "event-3")
+			size := s.Stats().Bytes
+			assert.NoError(t, s.Close())
+
+			files := segmentFiles(t, dir)
+			assert.Equal(t, 1, len(files))
+			assert.NoError(t, test.corrupt(files[0], size))
+
+			s = openTestSpool(t, config)
+			assert.Equal(t, len(test.expected), s.Len())
+
+			// the next record must be readable after the recovered ones.
+			appendRecords(t, s, "event-4")
+			assert.NoError(t, s.Close())
+
+			s = openTestSpool(t, config)
+			defer s.Close()
+			assert.Equal(t, append(test.expected, "event-4"), drainAll(t, s))
+		})
+	}
+}
+
+func TestSpoolOverflowDropOldest(t *testing.T) {
+	// every record is 8 + 7 bytes.
+	s := openTestSpool(t, Config{MaxSize: 60, SegmentSize: 30, Overflow: OVERFLOW_DROP_OLDEST})
+	defer s.Close()
+
+	appendRecords(t, s, "event-1", "event-2", "event-3", "event-4", "event-5")
+
+	stats := s.Stats()
+	assert.Equal(t, uint64(2), stats.Dropped)
+	assert.LessOrEqual(t, stats.Bytes, int64(60))
+	assert.Equal(t, []string{"event-3", "event-4", "event-5"}, drainAll(t, s))
+}
+
+func TestSpoolOverflowStopAccepting(t *testing.T) {
+	s := openTestSpool(t, Config{MaxSize: 60, SegmentSize: 30, Overflow: OVERFLOW_STOP_ACCEPTING})
+	defer s.Close()
+
+	appendRecords(t, s, "event-1", "event-2", "event-3", "event-4")
+	assert.Equal(t, ErrFull, s.Append([]byte("event-5")))
+	assert.Equal(t, uint64(1), s.Stats().Rejected)
+	assert.Equal(t, []string{"event-1", "event-2", "event-3", "event-4"}, drainAll(t, s))
+}
+
+func TestSpoolRecordTooLarge(t *testing.T) {
+	s := openTestSpool(t, Config{MaxSize: 16})
+	defer s.Close()
+
+	assert.Equal(t, ErrTooLarge, s.Append([]byte("0123456789")))
+}
+
+func TestConfigValidate(t *testing.T) {
+	assert.NoError(t, (&Config{Dir: "/tmp"}).Validate())
+	assert.NoError(t, (&Config{Dir: "/tmp", Overflow: OVERFLOW_STOP_ACCEPTING}).Validate())
+	assert.Error(t, (&Config{}).Validate())
+	assert.Error(t, (&Config{Dir: "/tmp", Overflow: "drop-newest"}).Validate())
+	assert.Error(t, (&Config{Dir: "/tmp", MaxSize: -1}).Validate())
+}
+
+type fakeSender struct {
+	mu     sync.Mutex
+	down   bool
+	events []string
+}
+
+func (f *fakeSender) Send(event []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.down {
+		return errors.New("collector is down")
+	}
+	f.events = append(f.events, string(event))
+	return nil
+}
+
+func (f *fakeSender) setDown(down bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.down = down
+}
+
+func (f *fakeSender) received() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.events...)
+}
+
+func TestSinkSpoolsDuringOutage(t *testing.T) {
+	sender := &fakeSender{}
+	sink := NewSink(sender, openTestSpool(t, Config{}), 10*time.Millisecond)
+
+	assert.NoError(t, sink.Send([]byte("event-1")))
+	sender.setDown(true)
+	for i := 2; i <= 4; i++ {
+		assert.NoError(t, sink.Send([]byte(fmt.Sprintf("event-%d", i))))
+	}
+	assert.Equal(t, 3, sink.Stats().Records)
+
+	sender.setDown(false)
+	assert.Eventually(t, func() bool { return sink.Stats().Records == 0 }, time.Second, 10*time.Millisecond)
+	assert.NoError(t, sink.Send([]byte("event-5")))
+
+	assert.NoError(t, sink.Close(time.Second))
+	assert.Equal(t, []string{"event-1", "event-2", "event-3", "event-4", "event-5"}, sender.received())
+}
+
+func TestSinkCloseKeepsUndelivered(t *testing.T) {
+	dir := t.TempDir()
+	sender := &fakeSender{down: true}
+	sink := NewSink(sender, openTestSpool(t, Config{Dir: dir}), time.Hour)
+
+	assert.NoError(t, sink.Send([]byte("event-1")))
+	assert.NoError(t, sink.Send([]byte("event-2")))
+	assert.NoError(t, sink.Close(10*time.Millisecond))
+
+	s := openTestSpool(t, Config{Dir: dir})
+	defer s.Close()
+	assert.Equal(t, []string{"event-1", "event-2"}, drainAll(t, s))
+
+	_, err := ioutil.ReadFile(filepath.Join(dir, CURSOR_FILE_NAME))
+	assert.NoError(t, err)
+}
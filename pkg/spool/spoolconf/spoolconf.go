@@ -0,0 +1,55 @@
+// Package spoolconf is the config of a spool. It imports nothing of bouheki, so that pkg/config,
+// and the packages that only read the config, do not import the spool, its logs and its metrics.
+package spoolconf
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	OVERFLOW_DROP_OLDEST    = "drop-oldest"
+	OVERFLOW_STOP_ACCEPTING = "stop-accepting"
+
+	DEFAULT_MAX_SIZE     = 64 * 1024 * 1024
+	DEFAULT_SEGMENT_SIZE = 4 * 1024 * 1024
+)
+
+type Config struct {
+	Dir         string `yaml:"dir"`
+	MaxSize     int64  `yaml:"max_size"`
+	SegmentSize int64  `yaml:"segment_size"`
+	Overflow    string `yaml:"overflow"`
+}
+
+// SetDefaults sets the sizes and the overflow policy that are not set.
+func (c *Config) SetDefaults() {
+	if c.MaxSize == 0 {
+		c.MaxSize = DEFAULT_MAX_SIZE
+	}
+	if c.SegmentSize == 0 {
+		c.SegmentSize = DEFAULT_SEGMENT_SIZE
+	}
+	if c.SegmentSize > c.MaxSize {
+		c.SegmentSize = c.MaxSize
+	}
+	if c.Overflow == "" {
+		c.Overflow = OVERFLOW_DROP_OLDEST
+	}
+}
+
+func (c *Config) Validate() error {
+	if c.Dir == "" {
+		return errors.New("spool.dir is required")
+	}
+	if c.MaxSize < 0 || c.SegmentSize < 0 {
+		return errors.New("spool sizes must not be negative")
+	}
+
+	switch c.Overflow {
+	case "", OVERFLOW_DROP_OLDEST, OVERFLOW_STOP_ACCEPTING:
+		return nil
+	default:
+		return fmt.Errorf("spool.overflow must be %s or %s, got %q", OVERFLOW_DROP_OLDEST, OVERFLOW_STOP_ACCEPTING, c.Overflow)
+	}
+}
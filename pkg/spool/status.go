@@ -0,0 +1,35 @@
+package spool
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+// STATUS_PATH is where the Status of the spools is served next to /metrics.
+const STATUS_PATH = "/spools"
+
+// SinkStatus is the state of the spool of a sink.
+type SinkStatus struct {
+	Name string `json:"name"`
+	Stats
+}
+
+// Sinks are the sinks that spool, by the name of their spool.
+type Sinks map[string]*Sink
+
+// Status returns the state of the spool of every sink, by name.
+func (s Sinks) Status() []SinkStatus {
+	status := make([]SinkStatus, 0, len(s))
+	for name, sink := range s {
+		status = append(status, SinkStatus{Name: name, Stats: sink.Stats()})
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].Name < status[j].Name })
+	return status
+}
+
+// ServeHTTP writes the Status as JSON.
+func (s Sinks) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.Status())
+}
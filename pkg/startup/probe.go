@@ -0,0 +1,103 @@
+package startup
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/miekg/dns"
+	"github.com/mrtc0/bouheki/pkg/config"
+)
+
+// NewProbe returns the probe of a startup condition. The dns conditions query servers with client.
+func NewProbe(cond config.StartupCondition, client *dns.Client, servers []string) (Probe, error) {
+	switch cond.Type {
+	case config.STARTUP_CONDITION_DNS:
+		return DNSProbe(client, servers, cond.Target), nil
+	case config.STARTUP_CONDITION_SOCKET:
+		return SocketProbe(cond.Target), nil
+	case config.STARTUP_CONDITION_HTTP:
+		return HTTPProbe(cond.Target)
+	default:
+		return nil, fmt.Errorf("unknown condition type %q", cond.Type)
+	}
+}
+
+// DNSProbe is met when one of servers resolves the A record of name, queried with client,
+// or over UDP when it is nil.
+func DNSProbe(client *dns.Client, servers []string, name string) Probe {
+	if client == nil {
+		client = new(dns.Client)
+	}
+	return func(ctx context.Context) error {
+		if len(servers) == 0 {
+			return errors.New("no DNS server is configured")
+		}
+
+		msg := new(dns.Msg)
+		msg.SetQuestion(dns.Fqdn(name), dns.TypeA)
+
+		var err error
+		for _, server := range servers {
+			var res *dns.Msg
+			res, _, err = client.ExchangeContext(ctx, msg, server)
+			if err != nil {
+				continue
+			}
+			if res.Rcode != dns.RcodeSuccess {
+				err = fmt.Errorf("%s answered %s for %s", server, dns.RcodeToString[res.Rcode], name)
+				continue
+			}
+			return nil
+		}
+		return err
+	}
+}
+
+// SocketProbe is met when the unix socket at path accepts a connection, e.g. the socket of
+// the container runtime.
+func SocketProbe(path string) Probe {
+	return func(ctx context.Context) error {
+		conn, err := (&net.Dialer{}).DialContext(ctx, "unix", path)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
+
+// HTTPProbe is met when rawURL answers without a server error. The response is not used,
+// so the certificate of an https endpoint, such as the kubelet, is not verified.
+func HTTPProbe(rawURL string) (Probe, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("%s is not an http or https URL", rawURL)
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+	}
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+		if err != nil {
+			return err
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+
+		if res.StatusCode >= http.StatusInternalServerError {
+			return fmt.Errorf("%s returned %s", rawURL, res.Status)
+		}
+		return nil
+	}, nil
+}
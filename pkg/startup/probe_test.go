@@ -0,0 +1,105 @@
+package startup
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// startDNSServer answers example.com and refuses any other name.
+func startDNSServer(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", func(w dns.ResponseWriter, req *dns.Msg) {
+		res := new(dns.Msg)
+		res.SetReply(req)
+		if req.Question[0].Name == "example.com." {
+			rr, _ := dns.NewRR("example.com. 60 IN A 192.0.2.1")
+			res.Answer = append(res.Answer, rr)
+		} else {
+			res.Rcode = dns.RcodeRefused
+		}
+		w.WriteMsg(res)
+	})
+	server := &dns.Server{PacketConn: conn, Handler: mux}
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+
+	return conn.LocalAddr().String()
+}
+
+func TestDNSProbe(t *testing.T) {
+	server := startDNSServer(t)
+
+	assert.Nil(t, DNSProbe(nil, []string{server}, "example.com")(context.Background()))
+
+	err := DNSProbe(new(dns.Client), []string{server}, "example.org")(context.Background())
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "answered REFUSED for example.org")
+
+	assert.NotNil(t, DNSProbe(nil, nil, "example.com")(context.Background()))
+}
+
+func TestSocketProbe(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "containerd.sock")
+	probe := SocketProbe(path)
+	assert.NotNil(t, probe(context.Background()))
+
+	listener, err := net.Listen("unix", path)
+	assert.Nil(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	assert.Nil(t, probe(context.Background()))
+}
+
+func TestHTTPProbe(t *testing.T) {
+	status := http.StatusUnauthorized
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "/pods", req.URL.Path)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	// A kubelet that requires authentication is reachable.
+	probe, err := HTTPProbe(server.URL + "/pods")
+	assert.Nil(t, err)
+	assert.Nil(t, probe(context.Background()))
+
+	status = http.StatusServiceUnavailable
+	assert.NotNil(t, probe(context.Background()))
+
+	_, err = HTTPProbe("unix:///run/kubelet.sock")
+	assert.NotNil(t, err)
+}
+
+func TestFromConfig(t *testing.T) {
+	c, err := FromConfig(config.StartupConfig{Conditions: []config.StartupCondition{
+		{Name: "dns", Type: config.STARTUP_CONDITION_DNS, Target: "example.com", Policy: config.STARTUP_POLICY_DEGRADED},
+		{Name: "kubelet", Type: config.STARTUP_CONDITION_HTTP, Target: "http://127.0.0.1:10255/pods", Policy: config.STARTUP_POLICY_WAIT},
+	}}, nil, []string{"127.0.0.53:53"})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(c.Status().Conditions))
+	assert.Equal(t, DEFAULT_INTERVAL, c.conditions[0].Interval)
+
+	_, err = FromConfig(config.StartupConfig{Conditions: []config.StartupCondition{
+		{Name: "kubelet", Type: config.STARTUP_CONDITION_HTTP, Target: "127.0.0.1:10255", Policy: config.STARTUP_POLICY_WAIT},
+	}}, nil, nil)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,286 @@
+// Package startup waits for the dependencies of the network restriction, as configured by
+// startup.conditions, before the maps are written.
+//
+// On boot, bouheki may start before DNS is reachable or before the container runtime is up.
+// Writing the maps then resolves no domain and finds no container cgroup. A condition is probed
+// until it is met or its timeout passes, and its policy then decides whether the startup waits
+// longer, proceeds degraded, or fails. A degraded condition keeps being probed in the background,
+// and the tasks registered with OnRecovered complete what was skipped once it is met.
+package startup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/mrtc0/bouheki/pkg/config"
+	log "github.com/mrtc0/bouheki/pkg/log"
+	"github.com/mrtc0/bouheki/pkg/timing"
+)
+
+const (
+	// STATUS_PATH is where the Status is served next to /metrics.
+	STATUS_PATH = "/startup"
+
+	// DEFAULT_INTERVAL is the interval of a condition without one.
+	DEFAULT_INTERVAL = time.Second
+	// PROBE_TIMEOUT bounds a single probe.
+	PROBE_TIMEOUT = 5 * time.Second
+
+	STATE_PENDING = "pending"
+	STATE_READY   = "ready"
+	// STATE_WAITING is a condition with the wait policy that is not met after its timeout.
+	STATE_WAITING  = "waiting"
+	STATE_DEGRADED = "degraded"
+	STATE_FAILED   = "failed"
+)
+
+// Probe returns nil when the condition is met.
+type Probe func(ctx context.Context) error
+
+type Condition struct {
+	config.StartupCondition
+	Probe Probe
+}
+
+type ConditionStatus struct {
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Policy string `json:"policy"`
+	State  string `json:"state"`
+	// Waited is how long the condition took to be met, or has been probed so far.
+	Waited   time.Duration `json:"waited"`
+	Attempts int           `json:"attempts"`
+	// Error is the error of the last probe.
+	Error string `json:"error,omitempty"`
+}
+
+type Status struct {
+	Conditions []ConditionStatus `json:"conditions"`
+	// Timing are the phases of the startup, the conditions among them, see SetTiming.
+	Timing *timing.Record `json:"timing,omitempty"`
+}
+
+type condition struct {
+	Condition
+	status ConditionStatus
+	// degraded is set once the startup proceeded without the condition.
+	degraded bool
+	// recovered are run once a degraded condition is met.
+	recovered []func()
+}
+
+// Checker probes the conditions.
+type Checker struct {
+	mu         sync.Mutex
+	conditions []*condition
+	now        func() time.Time
+	timer      *timing.Timer
+}
+
+func New(conditions []Condition) *Checker {
+	c := &Checker{now: time.Now}
+	for _, cond := range conditions {
+		if cond.Interval == 0 {
+			cond.Interval = DEFAULT_INTERVAL
+		}
+		c.conditions = append(c.conditions, &condition{
+			Condition: cond,
+			status:    ConditionStatus{Name: cond.Name, Type: cond.Type, Policy: cond.Policy, State: STATE_PENDING},
+		})
+	}
+	return c
+}
+
+// FromConfig returns a Checker of the conditions of conf. servers are the DNS servers
+// the dns conditions query with client, as host:port.
+func FromConfig(conf config.StartupConfig, client *dns.Client, servers []string) (*Checker, error) {
+	conditions := []Condition{}
+	for _, cond := range conf.Conditions {
+		probe, err := NewProbe(cond, client, servers)
+		if err != nil {
+			return nil, fmt.Errorf("startup.conditions %s: %w", cond.Name, err)
+		}
+		conditions = append(conditions, Condition{StartupCondition: cond, Probe: probe})
+	}
+	return New(conditions), nil
+}
+
+// Wait probes the conditions concurrently, and returns once every condition is met or its
+// policy lets the startup proceed without it. It returns an error when a condition with the
+// fail policy is not met before its timeout, or when ctx is done.
+//
+// The conditions that proceeded degraded are probed until they are met or ctx is done.
+func (c *Checker) Wait(ctx context.Context) error {
+	done := make(chan error, len(c.conditions))
+	for _, cond := range c.conditions {
+		go c.run(ctx, cond, done)
+	}
+
+	for range c.conditions {
+		select {
+		case err := <-done:
+			if err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// run sends on done once the startup may proceed, or fails, and keeps probing a degraded condition.
+func (c *Checker) run(ctx context.Context, cond *condition, done chan<- error) {
+	start := c.now()
+	deadline := start.Add(cond.Timeout)
+	proceeded := false
+
+	for {
+		err := c.probe(ctx, cond, start)
+		if err == nil {
+			if !proceeded {
+				done <- nil
+			}
+			c.ready(cond)
+			return
+		}
+
+		if !proceeded && !c.now().Before(deadline) {
+			switch cond.Policy {
+			case config.STARTUP_POLICY_FAIL:
+				c.setState(cond, STATE_FAILED)
+				c.logStatus(cond).Warn()
+				done <- fmt.Errorf("startup condition %s is not met after %s: %w", cond.Name, cond.Timeout, err)
+				return
+			case config.STARTUP_POLICY_DEGRADED:
+				c.mu.Lock()
+				cond.degraded = true
+				cond.status.State = STATE_DEGRADED
+				c.mu.Unlock()
+				c.logStatus(cond).Warn()
+				proceeded = true
+				done <- nil
+			default:
+				if c.setState(cond, STATE_WAITING) {
+					c.logStatus(cond).Warn()
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(cond.Interval):
+		}
+	}
+}
+
+func (c *Checker) probe(ctx context.Context, cond *condition, start time.Time) error {
+	probeCtx, cancel := context.WithTimeout(ctx, PROBE_TIMEOUT)
+	defer cancel()
+	err := cond.Probe(probeCtx)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cond.status.Attempts++
+	cond.status.Waited = c.now().Sub(start)
+	cond.status.Error = ""
+	if err != nil {
+		cond.status.Error = err.Error()
+	}
+	return err
+}
+
+// setState reports whether the state changed.
+func (c *Checker) setState(cond *condition, state string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	changed := cond.status.State != state
+	cond.status.State = state
+	return changed
+}
+
+// ready marks cond as met and runs the tasks that complete a degraded startup.
+func (c *Checker) ready(cond *condition) {
+	c.mu.Lock()
+	cond.status.State = STATE_READY
+	recovered := cond.recovered
+	cond.recovered = nil
+	c.mu.Unlock()
+
+	c.logStatus(cond).Info()
+	for _, fn := range recovered {
+		fn()
+	}
+}
+
+func (c *Checker) logStatus(cond *condition) *log.StartupLog {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return &log.StartupLog{
+		Condition: cond.status.Name,
+		Type:      cond.status.Type,
+		Policy:    cond.status.Policy,
+		State:     cond.status.State,
+		Waited:    cond.status.Waited,
+		Error:     cond.status.Error,
+	}
+}
+
+// OnRecovered registers fn to complete what the startup skipped without the conditions of
+// conditionType. fn runs once for every such condition that proceeded degraded, when it is met,
+// or right away if it has been met since. Conditions that were met in time do not run fn.
+func (c *Checker) OnRecovered(conditionType string, fn func()) {
+	run := 0
+
+	c.mu.Lock()
+	for _, cond := range c.conditions {
+		if cond.Type != conditionType || !cond.degraded {
+			continue
+		}
+		if cond.status.State == STATE_READY {
+			run++
+		} else {
+			cond.recovered = append(cond.recovered, fn)
+		}
+	}
+	c.mu.Unlock()
+
+	for i := 0; i < run; i++ {
+		fn()
+	}
+}
+
+// SetTiming adds the phases timer has recorded to the Status.
+func (c *Checker) SetTiming(timer *timing.Timer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.timer = timer
+}
+
+func (c *Checker) Status() Status {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	status := Status{Conditions: []ConditionStatus{}}
+	for _, cond := range c.conditions {
+		status.Conditions = append(status.Conditions, cond.status)
+	}
+	if c.timer != nil {
+		record := c.timer.Record()
+		status.Timing = &record
+	}
+	return status
+}
+
+func (c *Checker) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c.Status())
+}
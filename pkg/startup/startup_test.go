@@ -0,0 +1,162 @@
+package startup
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mrtc0/bouheki/pkg/config"
+	"github.com/mrtc0/bouheki/pkg/timing"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeProbe is met once up is set.
+type fakeProbe struct {
+	up    int32
+	calls int32
+}
+
+func (p *fakeProbe) probe(ctx context.Context) error {
+	atomic.AddInt32(&p.calls, 1)
+	if atomic.LoadInt32(&p.up) == 1 {
+		return nil
+	}
+	return errors.New("connection refused")
+}
+
+func (p *fakeProbe) setUp() {
+	atomic.StoreInt32(&p.up, 1)
+}
+
+func newCondition(name string, policy string, timeout time.Duration, probe Probe) Condition {
+	return Condition{
+		StartupCondition: config.StartupCondition{
+			Name:     name,
+			Type:     config.STARTUP_CONDITION_SOCKET,
+			Target:   "/run/containerd/containerd.sock",
+			Timeout:  timeout,
+			Interval: time.Millisecond,
+			Policy:   policy,
+		},
+		Probe: probe,
+	}
+}
+
+func TestWaitForMetConditions(t *testing.T) {
+	up := &fakeProbe{up: 1}
+	c := New([]Condition{newCondition("containerd", config.STARTUP_POLICY_FAIL, time.Second, up.probe)})
+
+	assert.Nil(t, c.Wait(context.Background()))
+	status := c.Status().Conditions[0]
+	assert.Equal(t, STATE_READY, status.State)
+	assert.Equal(t, 1, status.Attempts)
+	assert.Empty(t, status.Error)
+}
+
+func TestStatusHasTheTiming(t *testing.T) {
+	up := &fakeProbe{up: 1}
+	c := New([]Condition{newCondition("containerd", config.STARTUP_POLICY_FAIL, time.Second, up.probe)})
+	assert.Nil(t, c.Status().Timing)
+
+	timer := timing.New("network startup", nil)
+	c.SetTiming(timer)
+	wait := timer.Begin("startup-conditions")
+	assert.Nil(t, c.Wait(context.Background()))
+	wait.End(nil)
+
+	// The status of a startup that has not ended has the phases so far.
+	status := c.Status()
+	assert.False(t, status.Timing.Done)
+	assert.Equal(t, "startup-conditions", status.Timing.Phases[0].Name)
+	timer.End()
+	assert.True(t, c.Status().Timing.Done)
+}
+
+func TestWaitFailsAfterTheTimeout(t *testing.T) {
+	down := &fakeProbe{}
+	c := New([]Condition{newCondition("containerd", config.STARTUP_POLICY_FAIL, 20*time.Millisecond, down.probe)})
+
+	err := c.Wait(context.Background())
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "startup condition containerd is not met after 20ms: connection refused")
+	assert.Equal(t, STATE_FAILED, c.Status().Conditions[0].State)
+	assert.Equal(t, "connection refused", c.Status().Conditions[0].Error)
+}
+
+func TestWaitKeepsWaitingAfterTheTimeout(t *testing.T) {
+	down := &fakeProbe{}
+	c := New([]Condition{newCondition("containerd", config.STARTUP_POLICY_WAIT, 10*time.Millisecond, down.probe)})
+
+	waited := make(chan error)
+	go func() { waited <- c.Wait(context.Background()) }()
+
+	assert.Eventually(t, func() bool { return c.Status().Conditions[0].State == STATE_WAITING }, time.Second, time.Millisecond)
+	select {
+	case <-waited:
+		t.Fatal("Wait returned before the condition was met")
+	default:
+	}
+
+	down.setUp()
+	assert.Nil(t, <-waited)
+	assert.Equal(t, STATE_READY, c.Status().Conditions[0].State)
+}
+
+func TestWaitProceedsDegradedAndRecovers(t *testing.T) {
+	down := &fakeProbe{}
+	c := New([]Condition{newCondition("containerd", config.STARTUP_POLICY_DEGRADED, 10*time.Millisecond, down.probe)})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	assert.Nil(t, c.Wait(ctx))
+	assert.Equal(t, STATE_DEGRADED, c.Status().Conditions[0].State)
+
+	var recovered, other int32
+	c.OnRecovered(config.STARTUP_CONDITION_SOCKET, func() { atomic.AddInt32(&recovered, 1) })
+	c.OnRecovered(config.STARTUP_CONDITION_DNS, func() { atomic.AddInt32(&other, 1) })
+	assert.Equal(t, int32(0), atomic.LoadInt32(&recovered))
+
+	down.setUp()
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&recovered) == 1 }, time.Second, time.Millisecond)
+	assert.Equal(t, STATE_READY, c.Status().Conditions[0].State)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&other))
+
+	// A task registered after the condition recovered runs right away.
+	c.OnRecovered(config.STARTUP_CONDITION_SOCKET, func() { atomic.AddInt32(&recovered, 1) })
+	assert.Equal(t, int32(2), atomic.LoadInt32(&recovered))
+}
+
+func TestOnRecoveredIgnoresConditionsMetInTime(t *testing.T) {
+	up := &fakeProbe{up: 1}
+	c := New([]Condition{newCondition("containerd", config.STARTUP_POLICY_DEGRADED, time.Second, up.probe)})
+	assert.Nil(t, c.Wait(context.Background()))
+
+	ran := false
+	c.OnRecovered(config.STARTUP_CONDITION_SOCKET, func() { ran = true })
+	assert.False(t, ran)
+}
+
+func TestWaitStopsWithTheContext(t *testing.T) {
+	down := &fakeProbe{}
+	c := New([]Condition{newCondition("containerd", config.STARTUP_POLICY_WAIT, time.Hour, down.probe)})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	assert.Equal(t, context.Canceled, c.Wait(ctx))
+
+	// The condition is no longer probed.
+	calls := atomic.LoadInt32(&down.calls)
+	time.Sleep(10 * time.Millisecond)
+	assert.LessOrEqual(t, atomic.LoadInt32(&down.calls), calls+1)
+}
+
+func TestWaitWithoutConditions(t *testing.T) {
+	c := New(nil)
+	assert.Nil(t, c.Wait(context.Background()))
+	assert.Equal(t, Status{Conditions: []ConditionStatus{}}, c.Status())
+}
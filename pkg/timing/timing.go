@@ -0,0 +1,283 @@
+// Package timing records how long the named phases of a run take, e.g. the startup of the
+// network audit or a config reload, to tell which of them makes it slow.
+//
+// A Timer is started when the run begins. Each phase is timed with Begin and End, and can
+// contain phases of its own. The phases that run many times, e.g. the writes to one map, are
+// added up with Add instead. Record returns the phases recorded so far, which the callers log,
+// serve and print with WriteTable. Every method is a no-op on a nil Timer or Span, so that a
+// step of a run can be timed whether or not its caller times the run.
+package timing
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Phase is how long a phase took, and the phases it contains in the order they began.
+type Phase struct {
+	Name     string        `json:"name"`
+	Duration time.Duration `json:"duration"`
+	// Runs is the number of durations of a phase recorded with Add. It is 0 for a phase timed with Begin.
+	Runs int `json:"runs,omitempty"`
+	// Running is set when the phase has not ended yet, Duration is then how long it has run so far.
+	Running bool    `json:"running,omitempty"`
+	Error   string  `json:"error,omitempty"`
+	Phases  []Phase `json:"phases,omitempty"`
+}
+
+// Record is the timing of a run.
+type Record struct {
+	Name  string    `json:"name"`
+	Start time.Time `json:"start"`
+	// Total is the time from the start of the run to its end, or to the Record while it runs.
+	Total  time.Duration `json:"total"`
+	Done   bool          `json:"done"`
+	Phases []Phase       `json:"phases"`
+}
+
+type node struct {
+	phase    Phase
+	start    time.Time
+	children []*node
+}
+
+// Timer times a run.
+type Timer struct {
+	mu    sync.Mutex
+	now   func() time.Time
+	name  string
+	start time.Time
+	end   time.Time
+	root  node
+}
+
+// Span is a phase that began and has not necessarily ended.
+type Span struct {
+	t *Timer
+	n *node
+}
+
+// New starts the timer of the run name. now is the clock of the timer, nil for the wall clock.
+func New(name string, now func() time.Time) *Timer {
+	if now == nil {
+		now = time.Now
+	}
+	return &Timer{now: now, name: name, start: now()}
+}
+
+// Begin begins a phase of the run. A run that has ended records no more phases, and returns nil.
+func (t *Timer) Begin(name string) *Span {
+	if t == nil {
+		return nil
+	}
+	return t.begin(&t.root, name)
+}
+
+func (t *Timer) begin(parent *node, name string) *Span {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.end.IsZero() {
+		return nil
+	}
+	n := &node{phase: Phase{Name: name, Running: true}, start: t.now()}
+	parent.children = append(parent.children, n)
+	return &Span{t: t, n: n}
+}
+
+// End ends the run and returns its Record. The phases that are still running are recorded as such.
+func (t *Timer) End() Record {
+	if t == nil {
+		return Record{}
+	}
+	t.mu.Lock()
+	if t.end.IsZero() {
+		t.end = t.now()
+	}
+	t.mu.Unlock()
+	return t.Record()
+}
+
+// Record returns the phases recorded so far.
+func (t *Timer) Record() Record {
+	if t == nil {
+		return Record{}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	r := Record{Name: t.name, Start: t.start, Total: now.Sub(t.start), Done: !t.end.IsZero(), Phases: t.phases(&t.root, now)}
+	if r.Done {
+		r.Total = t.end.Sub(t.start)
+	}
+	return r
+}
+
+// phases copies the children of n, with the durations of the running ones as of now.
+func (t *Timer) phases(n *node, now time.Time) []Phase {
+	phases := []Phase{}
+	for _, child := range n.children {
+		phase := child.phase
+		if phase.Running {
+			phase.Duration = now.Sub(child.start)
+		}
+		phase.Phases = nil
+		if len(child.children) > 0 {
+			phase.Phases = t.phases(child, now)
+		}
+		phases = append(phases, phase)
+	}
+	return phases
+}
+
+// Begin begins a phase within the phase of s.
+func (s *Span) Begin(name string) *Span {
+	if s == nil {
+		return nil
+	}
+	return s.t.begin(s.n, name)
+}
+
+// Add adds d to the phase name within the phase of s, which is created the first time.
+func (s *Span) Add(name string, d time.Duration) {
+	if s == nil {
+		return
+	}
+	s.t.mu.Lock()
+	defer s.t.mu.Unlock()
+
+	for _, child := range s.n.children {
+		if child.phase.Name == name && child.phase.Runs > 0 {
+			child.phase.Duration += d
+			child.phase.Runs++
+			return
+		}
+	}
+	s.n.children = append(s.n.children, &node{phase: Phase{Name: name, Duration: d, Runs: 1}})
+}
+
+// Measure runs fn and adds how long it took to the phase name, as Add.
+func (s *Span) Measure(name string, fn func() error) error {
+	if s == nil {
+		return fn()
+	}
+	start := s.t.now()
+	err := fn()
+	s.Add(name, s.t.now().Sub(start))
+	return err
+}
+
+// End ends the phase, err is the error it failed with, if any. Only the first End counts.
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+	s.t.mu.Lock()
+	defer s.t.mu.Unlock()
+
+	if !s.n.phase.Running {
+		return
+	}
+	s.n.phase.Running = false
+	s.n.phase.Duration = s.t.now().Sub(s.n.start)
+	if err != nil {
+		s.n.phase.Error = err.Error()
+	}
+}
+
+// Slowest returns the phase of the run that took the longest. ok is false when the run has no phase.
+func (r Record) Slowest() (phase Phase, ok bool) {
+	for _, p := range r.Phases {
+		if !ok || p.Duration > phase.Duration {
+			phase, ok = p, true
+		}
+	}
+	return phase, ok
+}
+
+// Find returns the phase at path, the names of the phases from the top, e.g. "maps-populate"
+// and then the name of a map.
+func (r Record) Find(path ...string) (Phase, bool) {
+	phases := r.Phases
+	var found Phase
+	for _, name := range path {
+		ok := false
+		for _, p := range phases {
+			if p.Name == name {
+				found, ok = p, true
+				break
+			}
+		}
+		if !ok {
+			return Phase{}, false
+		}
+		phases = found.Phases
+	}
+	return found, len(path) > 0
+}
+
+// Unaccounted is the part of Total that no phase of the run was timed in, e.g. the steps
+// between the phases.
+func (r Record) Unaccounted() time.Duration {
+	d := r.Total
+	for _, p := range r.Phases {
+		d -= p.Duration
+	}
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// NAME_WIDTH is the width of the column of the names in WriteTable, with the indentation.
+const NAME_WIDTH = 40
+
+// WriteTable writes the run and its phases down to depth levels, every level if depth is 0, one
+// line each with its duration and its share of the total, indented by its level.
+func (r Record) WriteTable(w io.Writer, depth int) {
+	total := fmt.Sprint(r.Total.Round(time.Millisecond))
+	if !r.Done {
+		total += " (running)"
+	}
+	fmt.Fprintf(w, "%-*s %10s\n", NAME_WIDTH, r.Name, total)
+	writePhases(w, r.Phases, r.Total, 1, depth)
+}
+
+func writePhases(w io.Writer, phases []Phase, total time.Duration, level int, depth int) {
+	if depth > 0 && level > depth {
+		return
+	}
+	for _, p := range phases {
+		name := strings.Repeat("  ", level) + p.Name
+		if p.Runs > 1 {
+			name += fmt.Sprintf(" (%d)", p.Runs)
+		}
+		line := fmt.Sprintf("%-*s %10s %6s", NAME_WIDTH, name, p.Duration.Round(time.Millisecond), share(p.Duration, total))
+		switch {
+		case p.Running:
+			line += "  running"
+		case p.Error != "":
+			line += "  " + p.Error
+		}
+		fmt.Fprintln(w, line)
+		writePhases(w, p.Phases, total, level+1, depth)
+	}
+}
+
+func share(d, total time.Duration) string {
+	if total <= 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f%%", float64(d)*100/float64(total))
+}
+
+// Table returns the lines of WriteTable.
+func (r Record) Table(depth int) string {
+	b := strings.Builder{}
+	r.WriteTable(&b, depth)
+	return b.String()
+}
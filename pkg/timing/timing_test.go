@@ -0,0 +1,177 @@
+package timing
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func newTestTimer() (*Timer, *fakeClock) {
+	c := &fakeClock{now: time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)}
+	return New("startup", c.Now), c
+}
+
+func TestTimerNestsThePhases(t *testing.T) {
+	timer, c := newTestTimer()
+
+	load := timer.Begin("load")
+	c.advance(300 * time.Millisecond)
+	load.End(nil)
+
+	domains := timer.Begin("domains-resolve")
+	for _, domain := range []string{"example.com", "example.org"} {
+		span := domains.Begin(domain)
+		c.advance(time.Second)
+		span.End(nil)
+	}
+	domains.End(nil)
+	c.advance(200 * time.Millisecond)
+
+	r := timer.End()
+	assert.True(t, r.Done)
+	assert.Equal(t, 2500*time.Millisecond, r.Total)
+	assert.Equal(t, []Phase{
+		{Name: "load", Duration: 300 * time.Millisecond},
+		{Name: "domains-resolve", Duration: 2 * time.Second, Phases: []Phase{
+			{Name: "example.com", Duration: time.Second},
+			{Name: "example.org", Duration: time.Second},
+		}},
+	}, r.Phases)
+
+	found, ok := r.Find("domains-resolve", "example.org")
+	assert.True(t, ok)
+	assert.Equal(t, time.Second, found.Duration)
+	_, ok = r.Find("domains-resolve", "example.net")
+	assert.False(t, ok)
+	_, ok = r.Find()
+	assert.False(t, ok)
+
+	// The timer stopped at End.
+	c.advance(time.Hour)
+	assert.Equal(t, 2500*time.Millisecond, timer.Record().Total)
+	assert.Nil(t, timer.Begin("attach"))
+	assert.Len(t, timer.Record().Phases, 2)
+}
+
+func TestSpanAddAggregatesTheRuns(t *testing.T) {
+	timer, c := newTestTimer()
+	populate := timer.Begin("maps-populate")
+	populate.Add("allowed_v4_cidr_list", time.Millisecond)
+	populate.Add("denied_v4_cidr_list", 5*time.Millisecond)
+	populate.Add("allowed_v4_cidr_list", 2*time.Millisecond)
+	err := populate.Measure("denied_v4_cidr_list", func() error {
+		c.advance(time.Millisecond)
+		return errors.New("no space left")
+	})
+	assert.NotNil(t, err)
+	populate.End(nil)
+
+	found, ok := timer.Record().Find("maps-populate")
+	assert.True(t, ok)
+	assert.Equal(t, []Phase{
+		{Name: "allowed_v4_cidr_list", Duration: 3 * time.Millisecond, Runs: 2},
+		{Name: "denied_v4_cidr_list", Duration: 6 * time.Millisecond, Runs: 2},
+	}, found.Phases)
+}
+
+func TestRecordOfARunningTimer(t *testing.T) {
+	timer, c := newTestTimer()
+	wait := timer.Begin("startup-conditions")
+	c.advance(3 * time.Second)
+
+	r := timer.Record()
+	assert.False(t, r.Done)
+	assert.Equal(t, 3*time.Second, r.Total)
+	assert.Equal(t, []Phase{{Name: "startup-conditions", Duration: 3 * time.Second, Running: true}}, r.Phases)
+
+	wait.End(errors.New("dns is not reachable"))
+	c.advance(time.Second)
+	// Only the first End counts.
+	wait.End(nil)
+	assert.Equal(t, []Phase{{Name: "startup-conditions", Duration: 3 * time.Second, Error: "dns is not reachable"}}, timer.Record().Phases)
+}
+
+func TestRecordAggregation(t *testing.T) {
+	r := Record{
+		Total: 10 * time.Second,
+		Phases: []Phase{
+			{Name: "load", Duration: time.Second},
+			{Name: "domains-resolve", Duration: 6 * time.Second},
+			{Name: "attach", Duration: 2 * time.Second},
+		},
+	}
+
+	slowest, ok := r.Slowest()
+	assert.True(t, ok)
+	assert.Equal(t, "domains-resolve", slowest.Name)
+	assert.Equal(t, time.Second, r.Unaccounted())
+
+	_, ok = Record{}.Slowest()
+	assert.False(t, ok)
+	// The phases that overlap can add up to more than the total.
+	assert.Equal(t, time.Duration(0), Record{Total: time.Second, Phases: []Phase{{Duration: 2 * time.Second}}}.Unaccounted())
+}
+
+func TestWriteTable(t *testing.T) {
+	r := Record{
+		Name:  "startup",
+		Total: 4 * time.Second,
+		Done:  true,
+		Phases: []Phase{
+			{Name: "load", Duration: 1200 * time.Millisecond},
+			{Name: "maps-populate", Duration: 800 * time.Millisecond, Phases: []Phase{
+				{Name: "denied_v4_cidr_list", Duration: 600 * time.Millisecond, Runs: 3},
+			}},
+			{Name: "domains-resolve", Duration: 2 * time.Second, Error: "i/o timeout", Phases: []Phase{
+				{Name: "example.com", Duration: 2 * time.Second},
+			}},
+		},
+	}
+
+	assert.Equal(t, ""+
+		"startup                                          4s\n"+
+		"  load                                         1.2s  30.0%\n"+
+		"  maps-populate                               800ms  20.0%\n"+
+		"    denied_v4_cidr_list (3)                   600ms  15.0%\n"+
+		"  domains-resolve                                2s  50.0%  i/o timeout\n"+
+		"    example.com                                  2s  50.0%\n", r.Table(0))
+
+	// The phases below depth are left out.
+	assert.Equal(t, ""+
+		"startup                                          4s\n"+
+		"  load                                         1.2s  30.0%\n"+
+		"  maps-populate                               800ms  20.0%\n"+
+		"  domains-resolve                                2s  50.0%  i/o timeout\n", r.Table(1))
+
+	running := Record{Name: "network.reload", Total: time.Second, Phases: []Phase{{Name: "maps-populate", Duration: time.Second, Running: true}}}
+	assert.Equal(t, ""+
+		"network.reload                           1s (running)\n"+
+		"  maps-populate                                  1s 100.0%  running\n", running.Table(0))
+	assert.Equal(t, "run                                              0s\n", Record{Name: "run", Done: true}.Table(0))
+}
+
+func TestNilTimer(t *testing.T) {
+	var timer *Timer
+	span := timer.Begin("load")
+	assert.Nil(t, span)
+	span.Begin("open").End(nil)
+	span.Add("allowed_v4_cidr_list", time.Second)
+	assert.Nil(t, span.Measure("denied_v4_cidr_list", func() error { return nil }))
+	span.End(errors.New("failed"))
+	assert.Equal(t, Record{}, timer.Record())
+	assert.Equal(t, Record{}, timer.End())
+}
@@ -11,10 +11,12 @@ import (
 	"strings"
 
 	"github.com/coreos/go-semver/semver"
+	"github.com/mrtc0/bouheki/pkg/errkind"
 )
 
 const supportKernelVersion = "5.8.0"
 const btfFile = "/sys/kernel/btf/vmlinux"
+const activeLSMFile = "/sys/kernel/security/lsm"
 
 func isLinux() bool {
 	return runtime.GOOS == "linux"
@@ -49,19 +51,33 @@ func parseKernelVersion(buf []byte) (*semver.Version, error) {
 }
 
 func hasSupportKernelVersion() error {
-	supportVersion := semver.New(supportKernelVersion)
-	version, err := currentKernelVersion()
+	if err := HasKernelVersion(supportKernelVersion); err != nil {
+		return fmt.Errorf("current kernel version not supported. minimum supported kernel version is %v", supportKernelVersion)
+	}
+
+	return nil
+}
+
+// HasKernelVersion returns an error if the running kernel is older than version, e.g. "5.6.0".
+func HasKernelVersion(version string) error {
+	required := semver.New(version)
+	current, err := currentKernelVersion()
 	if err != nil {
 		return err
 	}
 
-	if version.LessThan(*supportVersion) {
-		return fmt.Errorf("current kernel version not supported. minimum supported kernel version is %v", supportKernelVersion)
+	if current.LessThan(*required) {
+		return fmt.Errorf("kernel %s is older than %s", current, required)
 	}
 
 	return nil
 }
 
+// HasBTF returns an error if the kernel does not expose its BTF.
+func HasBTF() error {
+	return hasBTF()
+}
+
 func hasBTF() error {
 	f, err := os.Open(btfFile)
 
@@ -90,6 +106,24 @@ func rawKernelVersion() ([]byte, error) {
 	return buf, nil
 }
 
+// KernelRelease returns the release of the running kernel, e.g. 5.11.0-34-generic.
+func KernelRelease() (string, error) {
+	buf, err := rawKernelVersion()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(buf)), nil
+}
+
+// ActiveLSMs returns the active LSMs, in the order the kernel calls them.
+func ActiveLSMs() ([]string, error) {
+	buf, err := ioutil.ReadFile(activeLSMFile)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(strings.TrimSpace(string(buf)), ","), nil
+}
+
 func readKernelConfig() (string, error) {
 	buf, err := rawKernelVersion()
 	if err != nil {
@@ -155,26 +189,86 @@ func hasBPFLSM() error {
 	return fmt.Errorf("BPF LSM is not enabled. Build the kernel enabled in CONFIG_LSM or add it to the boot parameters")
 }
 
+// HasBPFLSM returns an error if the BPF LSM is not active. When the active LSMs can not be read,
+// the kernel config and the boot parameters are checked instead.
+func HasBPFLSM() error {
+	active, err := IsBPFLSMActive()
+	if err != nil {
+		return hasBPFLSM()
+	}
+	if !active {
+		return errors.New("bpf is not in the active LSMs. Add it to CONFIG_LSM or to the lsm= boot parameter")
+	}
+	return nil
+}
+
+// IsBPFLSMActive reports whether "bpf" is in the list of active LSMs.
+// Unlike hasBPFLSM, it does not depend on the kernel config being installed.
+func IsBPFLSMActive() (bool, error) {
+	lsms, err := ActiveLSMs()
+	if err != nil {
+		return false, err
+	}
+
+	for _, lsm := range lsms {
+		if lsm == "bpf" {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
 func AmIRootUser() bool {
 	return os.Geteuid() == 0
 }
 
-func IsCompatible() error {
-	if !isLinux() {
-		return errors.New("required to run on Linux")
+// Check is a named preflight check of the host.
+type Check struct {
+	Name string
+	Run  func() error
+}
+
+func PreflightChecks() []Check {
+	return []Check{
+		{Name: "Linux", Run: func() error {
+			if !isLinux() {
+				return errors.New("required to run on Linux")
+			}
+			return nil
+		}},
+		{Name: "kernel version", Run: hasSupportKernelVersion},
+		{Name: "BTF", Run: hasBTF},
+		{Name: "BPF LSM", Run: hasBPFLSM},
 	}
+}
 
-	if err := hasSupportKernelVersion(); err != nil {
-		return err
+func IsCompatible() error {
+	for _, check := range PreflightChecks() {
+		if err := check.Run(); err != nil {
+			return errkind.New(errkind.Preflight, err)
+		}
 	}
 
-	if err := hasBTF(); err != nil {
-		return err
+	return nil
+}
+
+func SkipCompatibleCheck() bool {
+	return os.Getenv("BOUHEKI_SKIP_COMPATIBLE_CHECK") != ""
+}
+
+// ClassifyBPFError classifies an error from loading or attaching BPF programs.
+// It is a preflight error if the host is not compatible, since retrying will not help.
+func ClassifyBPFError(err error) error {
+	if err == nil {
+		return nil
 	}
 
-	if err := hasBPFLSM(); err != nil {
-		return err
+	if !SkipCompatibleCheck() {
+		if cerr := IsCompatible(); cerr != nil {
+			return errkind.Errorf(errkind.Preflight, "%v: %v", err, cerr)
+		}
 	}
 
-	return nil
+	return errkind.Default(errkind.BPFLoad, err)
 }
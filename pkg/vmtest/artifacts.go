@@ -0,0 +1,124 @@
+package vmtest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// SCRIPT_NAME is the script of the artifacts the guest runs.
+	SCRIPT_NAME = "run.sh"
+	// MARKER begins the lines the script prints for the harness, between the outputs of the tests.
+	MARKER = "bouheki-vmtest:"
+)
+
+// Binary is a test binary of the artifacts.
+type Binary struct {
+	Package string
+	// Dir is the directory of the package, where the binary runs.
+	Dir  string
+	Path string
+}
+
+// Artifacts are what the guest needs to run the tests: the test binaries, and the script
+// running them one after another.
+type Artifacts struct {
+	Dir      string
+	Script   string
+	Binaries []Binary
+}
+
+// ArtifactsDir is where the artifacts are built, in the source tree so that both backends see
+// it at the same path as the host.
+func ArtifactsDir(root string) string {
+	return filepath.Join(root, "build", "vmtest")
+}
+
+// Package builds a test binary of each package of the config with the integration tag, and
+// writes the script of the guest. The binaries are linked statically, like make build, to run
+// on whatever libraries the guest has. The output of go is written to out.
+func Package(ctx context.Context, conf Config, out io.Writer) (*Artifacts, error) {
+	a := &Artifacts{Dir: ArtifactsDir(conf.Root)}
+	a.Script = filepath.Join(a.Dir, SCRIPT_NAME)
+	if err := os.MkdirAll(a.Dir, 0755); err != nil {
+		return nil, err
+	}
+
+	for _, pkg := range conf.Packages {
+		binary := Binary{
+			Package: pkg,
+			Dir:     filepath.Join(conf.Root, pkg),
+			Path:    filepath.Join(a.Dir, binaryName(pkg)),
+		}
+		cmd := exec.CommandContext(ctx, "go", buildArgs(pkg, binary.Path)...)
+		cmd.Dir = conf.Root
+		cmd.Stdout = out
+		cmd.Stderr = out
+		if err := cmd.Run(); err != nil {
+			return nil, fmt.Errorf("failed to build the tests of %s: %w", pkg, err)
+		}
+		a.Binaries = append(a.Binaries, binary)
+	}
+
+	if err := ioutil.WriteFile(a.Script, []byte(script(a, conf.Run)), 0755); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func buildArgs(pkg, output string) []string {
+	return []string{"test", "-c", "-tags", "integration netgo", "-ldflags", `-extldflags "-static"`, "-o", output, pkg}
+}
+
+func binaryName(pkg string) string {
+	return strings.ReplaceAll(strings.Trim(strings.TrimPrefix(pkg, "./"), "/"), "/", "_") + ".test"
+}
+
+// script returns the script of the guest. It mounts the filesystems the programs and the tests
+// need when the guest has not, starts dockerd for the containers of the tests when none is
+// running, then runs each binary verbosely in the directory of its package, and prints the
+// kernel and the exit code of every binary after MARKER for the harness.
+func script(a *Artifacts, run string) string {
+	var b strings.Builder
+	b.WriteString(`#!/bin/sh
+# Written by pkg/vmtest, run by the guest.
+set -u
+
+mountpoint -q /sys/fs/bpf || mount -t bpf bpf /sys/fs/bpf
+mountpoint -q /sys/kernel/debug || mount -t debugfs debugfs /sys/kernel/debug
+mountpoint -q /sys/kernel/tracing || mount -t tracefs tracefs /sys/kernel/tracing 2>/dev/null
+
+if ! docker info >/dev/null 2>&1 && command -v dockerd >/dev/null; then
+	dockerd >/tmp/bouheki-vmtest-dockerd.log 2>&1 &
+	for i in $(seq 30); do
+		docker info >/dev/null 2>&1 && break
+		sleep 1
+	done
+fi
+
+`)
+	fmt.Fprintf(&b, "echo \"%s kernel $(uname -r)\"\n", MARKER)
+	b.WriteString("status=0\n")
+
+	args := "-test.v"
+	if run != "" {
+		args += " -test.run " + shellQuote(run)
+	}
+	for _, binary := range a.Binaries {
+		fmt.Fprintf(&b, "\n(cd %s && %s %s) 2>&1\n", shellQuote(binary.Dir), shellQuote(binary.Path), args)
+		fmt.Fprintf(&b, "code=$?\necho \"%s package %s exit $code\"\n", MARKER, binary.Package)
+		b.WriteString("[ $code -eq 0 ] || status=1\n")
+	}
+	b.WriteString("\nexit $status\n")
+	return b.String()
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
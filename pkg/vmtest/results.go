@@ -0,0 +1,143 @@
+package vmtest
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	TEST_PASS = "PASS"
+	TEST_FAIL = "FAIL"
+	TEST_SKIP = "SKIP"
+)
+
+type TestResult struct {
+	// Name is the name of the test, with the names of its parents for a subtest.
+	Name    string
+	Status  string
+	Elapsed time.Duration
+	// Output is what a top-level test printed, without the lines of go test.
+	Output []string
+}
+
+type PackageResult struct {
+	Package  string
+	ExitCode int
+	Tests    []TestResult
+}
+
+// Result is the outcome of the tests on a kernel.
+type Result struct {
+	Kernel string
+	// Release is the release of the kernel the guest booted, as uname -r prints it.
+	Release  string
+	Packages []PackageResult
+}
+
+// Failed is whether a package failed, including when its binary exited without a test failing,
+// e.g. TestMain could not start the containers.
+func (r *Result) Failed() bool {
+	for _, pkg := range r.Packages {
+		if pkg.ExitCode != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// resultWriter parses the output of the guest into a Result, line by line, and copies it to
+// the stream.
+type resultWriter struct {
+	stream  io.Writer
+	partial []byte
+	result  Result
+	tests   []TestResult
+	// output is what the current top-level test printed so far.
+	output []string
+}
+
+func newResultWriter(kernel string, stream io.Writer) *resultWriter {
+	return &resultWriter{stream: stream, result: Result{Kernel: kernel}}
+}
+
+func (w *resultWriter) Write(p []byte) (int, error) {
+	if _, err := w.stream.Write(p); err != nil {
+		return 0, err
+	}
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+		w.line(string(w.partial[:i]))
+		w.partial = w.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+func (w *resultWriter) finish() *Result {
+	if len(w.partial) > 0 {
+		w.line(string(w.partial))
+		w.partial = nil
+	}
+	return &w.result
+}
+
+func (w *resultWriter) line(line string) {
+	trimmed := strings.TrimSpace(line)
+	switch {
+	case strings.HasPrefix(trimmed, MARKER):
+		w.marker(strings.Fields(strings.TrimPrefix(trimmed, MARKER)))
+	case strings.HasPrefix(trimmed, "=== RUN"):
+		if name := strings.TrimSpace(strings.TrimPrefix(trimmed, "=== RUN")); !strings.Contains(name, "/") {
+			w.output = nil
+		}
+	case strings.HasPrefix(trimmed, "--- "):
+		w.test(strings.TrimPrefix(trimmed, "--- "))
+	case strings.HasPrefix(trimmed, "=== "), trimmed == TEST_PASS, trimmed == TEST_FAIL:
+	default:
+		w.output = append(w.output, line)
+	}
+}
+
+// marker reads a line printed by the script: "kernel <release>" or "package <package> exit <code>".
+func (w *resultWriter) marker(fields []string) {
+	switch {
+	case len(fields) == 2 && fields[0] == "kernel":
+		w.result.Release = fields[1]
+	case len(fields) == 4 && fields[0] == "package" && fields[2] == "exit":
+		code, err := strconv.Atoi(fields[3])
+		if err != nil {
+			code = -1
+		}
+		w.result.Packages = append(w.result.Packages, PackageResult{Package: fields[1], ExitCode: code, Tests: w.tests})
+		w.tests = nil
+		w.output = nil
+	}
+}
+
+// test reads the line ending a test, e.g. "PASS: TestAudit_Mount (0.12s)".
+func (w *resultWriter) test(s string) {
+	i := strings.Index(s, ": ")
+	if i < 0 {
+		return
+	}
+	status, fields := s[:i], strings.Fields(s[i+2:])
+	if (status != TEST_PASS && status != TEST_FAIL && status != TEST_SKIP) || len(fields) == 0 {
+		return
+	}
+
+	test := TestResult{Name: fields[0], Status: status}
+	if len(fields) > 1 {
+		test.Elapsed, _ = time.ParseDuration(strings.Trim(fields[1], "()"))
+	}
+	if !strings.Contains(test.Name, "/") {
+		test.Output = w.output
+		w.output = nil
+	}
+	w.tests = append(w.tests, test)
+}
@@ -0,0 +1,61 @@
+package vmtest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+)
+
+// command returns the command running the script of the artifacts on kernel.
+func command(ctx context.Context, conf Config, kernel string, a *Artifacts) *exec.Cmd {
+	var cmd *exec.Cmd
+	switch conf.Backend {
+	case BACKEND_VMTEST:
+		// vmtest runs the command with a shell, in the directory it was started from.
+		cmd = exec.CommandContext(ctx, conf.VMTest, "-k", kernel, "sh "+shellQuote(a.Script))
+	default:
+		// The container shares the BPF filesystem, the tracing filesystem and the docker daemon of
+		// the host, and its pid and network namespaces so that the containers of the tests are
+		// reachable and told apart from the host like without the harness.
+		cmd = exec.CommandContext(ctx, "docker", "run", "--rm", "--privileged",
+			"--pid=host", "--network=host",
+			"-v", "/sys/fs/bpf:/sys/fs/bpf",
+			"-v", "/sys/kernel/debug:/sys/kernel/debug",
+			"-v", "/var/run/docker.sock:/var/run/docker.sock",
+			"-v", conf.Root+":"+conf.Root,
+			"-w", conf.Root,
+			"--entrypoint", "/bin/sh",
+			conf.Image, a.Script)
+	}
+	cmd.Dir = conf.Root
+	return cmd
+}
+
+// Run runs the tests of the artifacts on kernel, streaming the output of the guest to stream.
+// An error is returned when the guest could not run the script to its end, e.g. it did not
+// boot or timed out; a failure of the tests is in the Result.
+func Run(ctx context.Context, conf Config, kernel string, a *Artifacts, stream io.Writer) (*Result, error) {
+	ctx, cancel := context.WithTimeout(ctx, conf.Timeout)
+	defer cancel()
+
+	r := newResultWriter(kernel, stream)
+	cmd := command(ctx, conf, kernel, a)
+	cmd.Stdout = r
+	cmd.Stderr = r
+	err := cmd.Run()
+	result := r.finish()
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return result, fmt.Errorf("the tests on %s did not finish in %s", kernel, conf.Timeout)
+	}
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return result, fmt.Errorf("failed to run the tests on %s: %w", kernel, err)
+	}
+	if len(result.Packages) < len(a.Binaries) {
+		return result, fmt.Errorf("the tests on %s ended after %d of %d packages", kernel, len(result.Packages), len(a.Binaries))
+	}
+	return result, nil
+}
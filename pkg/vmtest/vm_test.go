@@ -0,0 +1,72 @@
+//go:build vm
+// +build vm
+
+package vmtest
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestIntegrationSuite runs the integration tests of the packages on every kernel of the
+// environment, see ConfigFromEnv, and reports the tests of each package as its subtests.
+func TestIntegrationSuite(t *testing.T) {
+	root, err := filepath.Abs("../..")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf, err := ConfigFromEnv(os.Getenv, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stream io.Writer = io.Discard
+	if testing.Verbose() {
+		stream = os.Stdout
+	}
+	artifacts, err := Package(context.Background(), conf, stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, kernel := range conf.KernelNames() {
+		t.Run(filepath.Base(kernel), func(t *testing.T) {
+			result, err := Run(context.Background(), conf, kernel, artifacts, stream)
+			if err != nil {
+				t.Error(err)
+			}
+			t.Logf("kernel %s", result.Release)
+			for _, pkg := range result.Packages {
+				reportPackage(t, pkg)
+			}
+		})
+	}
+}
+
+func reportPackage(t *testing.T, pkg PackageResult) {
+	t.Run(strings.TrimPrefix(pkg.Package, "./"), func(t *testing.T) {
+		failed := false
+		for _, test := range pkg.Tests {
+			if strings.Contains(test.Name, "/") {
+				continue
+			}
+			test := test
+			t.Run(test.Name, func(t *testing.T) {
+				switch test.Status {
+				case TEST_FAIL:
+					failed = true
+					t.Error(strings.Join(test.Output, "\n"))
+				case TEST_SKIP:
+					t.Skip(strings.Join(test.Output, "\n"))
+				}
+			})
+		}
+		if pkg.ExitCode != 0 && !failed {
+			t.Errorf("the tests exited with %d", pkg.ExitCode)
+		}
+	})
+}
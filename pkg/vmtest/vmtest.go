@@ -0,0 +1,147 @@
+// Package vmtest runs the root-gated integration tests of bouheki, the ones built with the
+// integration tag, in a machine where they can attach the BPF programs: a VM booted by
+// vmtest (https://github.com/danobi/vmtest) on a given kernel image, or a privileged
+// container on the kernel of the host.
+//
+// The test binaries are built on the host with go test -c, next to a script that the guest
+// runs from the source tree, so the tests find their fixtures at the same relative paths as
+// with make test. The output of the guest is streamed back and parsed into a Result per
+// kernel. TestIntegrationSuite, built with the vm tag, drives it from the environment:
+//
+//	BOUHEKI_VM_KERNEL=5.8,5.15,6.1 go test -tags=vm -v ./pkg/vmtest/
+package vmtest
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type Backend string
+
+const (
+	// BACKEND_VMTEST boots a VM on each kernel of the config with vmtest, which shares the
+	// root filesystem of the host with the guest.
+	BACKEND_VMTEST Backend = "vmtest"
+	// BACKEND_CONTAINER runs the tests in a privileged container on the kernel of the host.
+	BACKEND_CONTAINER Backend = "container"
+)
+
+const (
+	DEFAULT_VMTEST  = "vmtest"
+	DEFAULT_IMAGE   = "bouheki-vmtest:latest"
+	DEFAULT_TIMEOUT = 30 * time.Minute
+	// HOST_KERNEL is the name of the kernel the container backend runs on.
+	HOST_KERNEL = "host"
+)
+
+// INTEGRATION_PACKAGES are the packages with the tests built with the integration tag,
+// relative to the root of the source tree.
+var INTEGRATION_PACKAGES = []string{
+	"./pkg/audit/network",
+	"./pkg/audit/fileaccess",
+	"./pkg/audit/mount",
+}
+
+type Config struct {
+	Backend Backend
+	// Kernels are the paths of the kernel images to boot, one VM each.
+	Kernels []string
+	VMTest  string
+	Image   string
+	// Packages are the packages to test, relative to Root.
+	Packages []string
+	// Run is given to the test binaries as -test.run, unless it is empty.
+	Run     string
+	Timeout time.Duration
+	// Root is the absolute path of the source tree.
+	Root string
+}
+
+// ConfigFromEnv reads the config of the harness from the environment:
+//
+//   - BOUHEKI_VM_KERNEL: comma separated kernel images to boot. An entry without a slash is a
+//     version, e.g. 5.15, of the image bzImage-<version> in BOUHEKI_VM_KERNEL_DIR, which
+//     defaults to build/vmtest/kernels.
+//   - BOUHEKI_VM_BACKEND: vmtest or container. It is vmtest when a kernel is given, and
+//     container otherwise.
+//   - BOUHEKI_VMTEST: the vmtest binary, and BOUHEKI_VM_IMAGE: the image of the container.
+//   - BOUHEKI_VM_PACKAGES: comma separated packages to test, BOUHEKI_VM_RUN: the tests to
+//     run, and BOUHEKI_VM_TIMEOUT: how long the tests may run on one kernel.
+func ConfigFromEnv(getenv func(string) string, root string) (Config, error) {
+	conf := Config{
+		Backend:  Backend(getenv("BOUHEKI_VM_BACKEND")),
+		VMTest:   getenv("BOUHEKI_VMTEST"),
+		Image:    getenv("BOUHEKI_VM_IMAGE"),
+		Packages: splitList(getenv("BOUHEKI_VM_PACKAGES")),
+		Run:      getenv("BOUHEKI_VM_RUN"),
+		Timeout:  DEFAULT_TIMEOUT,
+		Root:     root,
+	}
+	if conf.VMTest == "" {
+		conf.VMTest = DEFAULT_VMTEST
+	}
+	if conf.Image == "" {
+		conf.Image = DEFAULT_IMAGE
+	}
+	if len(conf.Packages) == 0 {
+		conf.Packages = INTEGRATION_PACKAGES
+	}
+	if timeout := getenv("BOUHEKI_VM_TIMEOUT"); timeout != "" {
+		d, err := time.ParseDuration(timeout)
+		if err != nil || d <= 0 {
+			return conf, fmt.Errorf("BOUHEKI_VM_TIMEOUT %q is not a positive duration", timeout)
+		}
+		conf.Timeout = d
+	}
+
+	kernelDir := getenv("BOUHEKI_VM_KERNEL_DIR")
+	if kernelDir == "" {
+		kernelDir = filepath.Join(root, "build", "vmtest", "kernels")
+	}
+	for _, kernel := range splitList(getenv("BOUHEKI_VM_KERNEL")) {
+		if !strings.Contains(kernel, "/") {
+			kernel = filepath.Join(kernelDir, "bzImage-"+kernel)
+		}
+		conf.Kernels = append(conf.Kernels, kernel)
+	}
+
+	if conf.Backend == "" {
+		conf.Backend = BACKEND_CONTAINER
+		if len(conf.Kernels) > 0 {
+			conf.Backend = BACKEND_VMTEST
+		}
+	}
+	switch conf.Backend {
+	case BACKEND_VMTEST:
+		if len(conf.Kernels) == 0 {
+			return conf, fmt.Errorf("the vmtest backend needs a kernel in BOUHEKI_VM_KERNEL")
+		}
+	case BACKEND_CONTAINER:
+		if len(conf.Kernels) > 0 {
+			return conf, fmt.Errorf("the container backend runs on the kernel of the host, BOUHEKI_VM_KERNEL can not be given")
+		}
+	default:
+		return conf, fmt.Errorf("BOUHEKI_VM_BACKEND %q is not vmtest or container", conf.Backend)
+	}
+	return conf, nil
+}
+
+// KernelNames are the names of the kernels the tests run on, one Run each.
+func (c Config) KernelNames() []string {
+	if c.Backend == BACKEND_CONTAINER {
+		return []string{HOST_KERNEL}
+	}
+	return c.Kernels
+}
+
+func splitList(s string) []string {
+	list := []string{}
+	for _, entry := range strings.Split(s, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
@@ -0,0 +1,160 @@
+package vmtest
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func env(vars map[string]string) func(string) string {
+	return func(key string) string { return vars[key] }
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	t.Run("without a kernel, the tests run in a container", func(t *testing.T) {
+		conf, err := ConfigFromEnv(env(nil), "/src/bouheki")
+		assert.Nil(t, err)
+		assert.Equal(t, BACKEND_CONTAINER, conf.Backend)
+		assert.Equal(t, DEFAULT_IMAGE, conf.Image)
+		assert.Equal(t, INTEGRATION_PACKAGES, conf.Packages)
+		assert.Equal(t, DEFAULT_TIMEOUT, conf.Timeout)
+		assert.Equal(t, []string{HOST_KERNEL}, conf.KernelNames())
+	})
+
+	t.Run("the kernels are versions in the kernel dir or paths", func(t *testing.T) {
+		conf, err := ConfigFromEnv(env(map[string]string{
+			"BOUHEKI_VM_KERNEL":   "5.8, 5.15,/boot/vmlinuz-6.1",
+			"BOUHEKI_VM_PACKAGES": "./pkg/audit/mount",
+			"BOUHEKI_VM_RUN":      "TestAudit_Mount",
+			"BOUHEKI_VM_TIMEOUT":  "10m",
+		}), "/src/bouheki")
+		assert.Nil(t, err)
+		assert.Equal(t, BACKEND_VMTEST, conf.Backend)
+		assert.Equal(t, DEFAULT_VMTEST, conf.VMTest)
+		assert.Equal(t, []string{
+			"/src/bouheki/build/vmtest/kernels/bzImage-5.8",
+			"/src/bouheki/build/vmtest/kernels/bzImage-5.15",
+			"/boot/vmlinuz-6.1",
+		}, conf.KernelNames())
+		assert.Equal(t, []string{"./pkg/audit/mount"}, conf.Packages)
+		assert.Equal(t, "TestAudit_Mount", conf.Run)
+		assert.Equal(t, 10*time.Minute, conf.Timeout)
+
+		conf, err = ConfigFromEnv(env(map[string]string{"BOUHEKI_VM_KERNEL": "5.15", "BOUHEKI_VM_KERNEL_DIR": "/kernels"}), "/src/bouheki")
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"/kernels/bzImage-5.15"}, conf.Kernels)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, vars := range []map[string]string{
+			{"BOUHEKI_VM_BACKEND": "vmtest"},
+			{"BOUHEKI_VM_BACKEND": "container", "BOUHEKI_VM_KERNEL": "5.15"},
+			{"BOUHEKI_VM_BACKEND": "qemu"},
+			{"BOUHEKI_VM_TIMEOUT": "-1s"},
+		} {
+			_, err := ConfigFromEnv(env(vars), "/src/bouheki")
+			assert.NotNil(t, err, vars)
+		}
+	})
+}
+
+func TestScript(t *testing.T) {
+	a := &Artifacts{Binaries: []Binary{
+		{Package: "./pkg/audit/network", Dir: "/src/bouheki/pkg/audit/network", Path: "/src/bouheki/build/vmtest/pkg_audit_network.test"},
+		{Package: "./pkg/audit/mount", Dir: "/src/bouheki/pkg/audit/mount", Path: "/src/bouheki/build/vmtest/pkg_audit_mount.test"},
+	}}
+	s := script(a, "TestAudit_'Mount")
+
+	assert.True(t, strings.HasPrefix(s, "#!/bin/sh\n"))
+	assert.Contains(t, s, "(cd '/src/bouheki/pkg/audit/network' && '/src/bouheki/build/vmtest/pkg_audit_network.test' -test.v -test.run 'TestAudit_'\\''Mount') 2>&1\n")
+	assert.Contains(t, s, `echo "bouheki-vmtest: package ./pkg/audit/mount exit $code"`)
+	assert.True(t, strings.Index(s, "pkg_audit_network.test") < strings.Index(s, "pkg_audit_mount.test"))
+	assert.True(t, strings.HasSuffix(s, "exit $status\n"))
+
+	assert.Equal(t, "pkg_audit_network.test", binaryName("./pkg/audit/network"))
+	assert.Equal(t, []string{"test", "-c", "-tags", "integration netgo", "-ldflags", `-extldflags "-static"`, "-o", "/out/x.test", "./x"}, buildArgs("./x", "/out/x.test"))
+}
+
+func TestCommand(t *testing.T) {
+	a := &Artifacts{Script: "/src/bouheki/build/vmtest/run.sh"}
+	conf := Config{Backend: BACKEND_VMTEST, VMTest: "/usr/local/bin/vmtest", Root: "/src/bouheki"}
+	cmd := command(context.Background(), conf, "/kernels/bzImage-5.15", a)
+	assert.Equal(t, []string{"/usr/local/bin/vmtest", "-k", "/kernels/bzImage-5.15", "sh '/src/bouheki/build/vmtest/run.sh'"}, cmd.Args)
+	assert.Equal(t, "/src/bouheki", cmd.Dir)
+
+	conf = Config{Backend: BACKEND_CONTAINER, Image: DEFAULT_IMAGE, Root: "/src/bouheki"}
+	cmd = command(context.Background(), conf, HOST_KERNEL, a)
+	assert.Equal(t, "docker", cmd.Args[0])
+	assert.Contains(t, cmd.Args, "--privileged")
+	assert.Contains(t, cmd.Args, "/src/bouheki:/src/bouheki")
+	assert.Equal(t, []string{DEFAULT_IMAGE, a.Script}, cmd.Args[len(cmd.Args)-2:])
+}
+
+func TestResultWriter(t *testing.T) {
+	output := `bouheki-vmtest: kernel 5.15.0-91-generic
+Creating network "testdata_bouheki_compose_network" with the default driver
+=== RUN   TestActionResultForV4
+--- PASS: TestActionResultForV4 (0.01s)
+=== RUN   TestAuditBlockModeV4
+    audit_test.go:181:
+        	Error:      	Expected value not to be nil.
+--- FAIL: TestAuditBlockModeV4 (1.52s)
+=== RUN   TestRestrictedCommandWithOddNames
+=== RUN   TestRestrictedCommandWithOddNames/space
+--- PASS: TestRestrictedCommandWithOddNames (0.30s)
+    --- PASS: TestRestrictedCommandWithOddNames/space (0.10s)
+FAIL
+bouheki-vmtest: package ./pkg/audit/network exit 1
+=== RUN   TestAudit_Mount
+    audit_test.go:40: mount is not supported
+--- SKIP: TestAudit_Mount (0.00s)
+PASS
+bouheki-vmtest: package ./pkg/audit/mount exit 0
+`
+	var stream bytes.Buffer
+	w := newResultWriter("bzImage-5.15", &stream)
+	// The output arrives in chunks that do not end with a line.
+	for i := 0; i < len(output); i += 7 {
+		end := i + 7
+		if end > len(output) {
+			end = len(output)
+		}
+		n, err := w.Write([]byte(output[i:end]))
+		assert.Nil(t, err)
+		assert.Equal(t, end-i, n)
+	}
+	result := w.finish()
+
+	assert.Equal(t, output, stream.String())
+	assert.Equal(t, "bzImage-5.15", result.Kernel)
+	assert.Equal(t, "5.15.0-91-generic", result.Release)
+	assert.True(t, result.Failed())
+	assert.Equal(t, 2, len(result.Packages))
+
+	network := result.Packages[0]
+	assert.Equal(t, "./pkg/audit/network", network.Package)
+	assert.Equal(t, 1, network.ExitCode)
+	assert.Equal(t, []TestResult{
+		{Name: "TestActionResultForV4", Status: TEST_PASS, Elapsed: 10 * time.Millisecond},
+		{Name: "TestAuditBlockModeV4", Status: TEST_FAIL, Elapsed: 1520 * time.Millisecond, Output: []string{
+			"    audit_test.go:181:",
+			"        \tError:      \tExpected value not to be nil.",
+		}},
+		{Name: "TestRestrictedCommandWithOddNames", Status: TEST_PASS, Elapsed: 300 * time.Millisecond},
+		{Name: "TestRestrictedCommandWithOddNames/space", Status: TEST_PASS, Elapsed: 100 * time.Millisecond},
+	}, network.Tests)
+
+	mount := result.Packages[1]
+	assert.Equal(t, 0, mount.ExitCode)
+	assert.Equal(t, []TestResult{
+		{Name: "TestAudit_Mount", Status: TEST_SKIP, Output: []string{"    audit_test.go:40: mount is not supported"}},
+	}, mount.Tests)
+
+	// A package exiting without a failed test, e.g. when TestMain fails, is still a failure.
+	assert.False(t, (&Result{Packages: []PackageResult{{ExitCode: 0}}}).Failed())
+	assert.True(t, (&Result{Packages: []PackageResult{{ExitCode: 1}}}).Failed())
+}